@@ -2,60 +2,156 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
 	"log"
 	"log/slog"
 	"net/http"
+	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
+	"time"
 
 	"github.com/strct-org/strct-agent/internal/agent"
 	"github.com/strct-org/strct-agent/internal/api"
+	"github.com/strct-org/strct-agent/internal/apidoc"
+	"github.com/strct-org/strct-agent/internal/audit"
+	"github.com/strct-org/strct-agent/internal/capabilities"
+	"github.com/strct-org/strct-agent/internal/cli"
 	"github.com/strct-org/strct-agent/internal/config"
+	"github.com/strct-org/strct-agent/internal/events"
 	adblock "github.com/strct-org/strct-agent/internal/features/adblocker"
 	"github.com/strct-org/strct-agent/internal/features/cloud"
 	monitor "github.com/strct-org/strct-agent/internal/features/monitor"
 	"github.com/strct-org/strct-agent/internal/features/router"
 	"github.com/strct-org/strct-agent/internal/features/vpn"
 	wifi_feature "github.com/strct-org/strct-agent/internal/features/wifi"
+	"github.com/strct-org/strct-agent/internal/httputil"
+	"github.com/strct-org/strct-agent/internal/latency"
 	"github.com/strct-org/strct-agent/internal/logger"
+	"github.com/strct-org/strct-agent/internal/maintenance"
+	"github.com/strct-org/strct-agent/internal/managed"
+	"github.com/strct-org/strct-agent/internal/metrics"
+	"github.com/strct-org/strct-agent/internal/operations"
+	"github.com/strct-org/strct-agent/internal/peers"
+	"github.com/strct-org/strct-agent/internal/platform/backend"
+	"github.com/strct-org/strct-agent/internal/platform/fileworker"
 	"github.com/strct-org/strct-agent/internal/platform/tunnel"
 	"github.com/strct-org/strct-agent/internal/platform/wifi"
+	"github.com/strct-org/strct-agent/internal/resources"
+	"github.com/strct-org/strct-agent/internal/telemetry"
+	"github.com/strct-org/strct-agent/internal/throttle"
+	"github.com/strct-org/strct-agent/ota"
 )
 
 var (
 	DefaultDomain = "localhost"
 	DefaultVPSIP  = "127.0.0.1"
+	// Version is the release, set with -X main.Version at build time.
+	Version = "0.0.0-dev"
 )
 
 func main() {
+	// `strct status`, `strct-agent files ls /` …: administer the running
+	// agent instead of starting one.
+	if filepath.Base(os.Args[0]) == "strct" || cli.IsCommand(os.Args[1:]) {
+		os.Exit(cli.Main(os.Args[1:]))
+	}
+
 	devMode := flag.Bool("dev", false, "Run in development mode (mock hardware)")
+	configFile := flag.String("config", "", "Config file in YAML or JSON (default "+config.ConfigFilePath(false)+", or "+config.ConfigFilePath(true)+" with -dev)")
+	workerSocket := flag.String(fileworker.Flag, "", "Serve the file API on this unix socket (started by the agent)")
+	workerData := flag.String(fileworker.DataFlag, "", "Data directory for -"+fileworker.Flag)
 	flag.Parse()
 
 	logger.Init(*devMode)
 
-	cfg := config.Load(*devMode, DefaultDomain, DefaultVPSIP)
+	if *workerSocket != "" {
+		runFileWorker(*workerSocket, *workerData, *devMode)
+		return
+	}
+
+	cfg := config.Load(*devMode, DefaultDomain, DefaultVPSIP, *configFile)
 	slog.Info("agent: config loaded",
 		"deviceID", cfg.DeviceID,
 		"dev", cfg.IsDev,
 		"dataDir", cfg.DataDir,
 	)
+	if err := cfg.ValidateAtStart(); err != nil {
+		log.Fatalf("agent: refusing to start: %v", err)
+	}
 
-	cloudSvc, err := cloud.NewFromConfig(cfg)
+	// Connectivity (and the setup wizard, on first boot) comes first: the
+	// wizard's storage step decides where cloud keeps its data.
+	a, err := agent.New(cfg, wifi.New(cfg.UseRealHardware()))
+	if err != nil {
+		log.Fatalf("agent init failed: %v", err)
+	}
+	// After New, which settles DataDir, and before the features that
+	// might trip over a stale copy start.
+	sweepObsolete(cfg)
+
+	gate := maintenance.New(cfg.MaintenancePath())
+	// What the features report, streamed on GET /api/events.
+	bus := events.New()
+	monitorSvc := monitor.NewFromConfig(cfg, gate, bus)
+	// File transfers share what the last speedtest measured, leaving the
+	// rest of the link for DNS and API calls.
+	governor := throttle.New(monitorSvc.LinkMbps, cfg.TransferShare)
+
+	cloudSvc, err := cloud.NewFromConfig(cfg, governor, bus)
 	if err != nil {
 		log.Fatalf("cloud init failed: %v", err)
 	}
+	cloudSvc.UseGate(gate)
+	var fileWorker *fileworker.Supervisor
+	if cfg.FileWorker {
+		fileWorker = fileworker.NewFromConfig(cfg)
+		cloudSvc.UseWorker(fileWorker.Handler())
+	}
 
-	monitorSvc := monitor.NewFromConfig(cfg)
-	adblockSvc := adblock.NewFromConfig(cfg)
-	routerSvc := router.NewFromConfig(cfg)
-	wifiSvc := wifi_feature.NewFromConfig(cfg)
-	vpnSvc := vpn.NewFromConfig(cfg, wifiSvc)
+	backendClient := backend.NewFromConfig(cfg)
+	registrar := backend.NewRegistrarFromConfig(cfg, Version, backendClient)
+	ops := operations.NewFromConfig(cfg, bus)
+	wifiSvc := wifi_feature.NewFromConfig(cfg, bus)
+	wifiSvc.UseTracker(ops)
+	monitorSvc.UseWiFi(wifiSvc)
+	adblockSvc := adblock.NewFromConfig(cfg, gate, wifiSvc, bus)
+	adblockSvc.UseTracker(ops)
+	routerSvc := router.NewFromConfig(cfg, wifiSvc, backendClient, governor, bus)
+	vpnSvc := vpn.NewFromConfig(cfg, wifiSvc, bus)
+	vpnSvc.UseTracker(ops)
 	tunnelSvc := tunnel.NewFromConfig(cfg)
+	tunnelUsage := tunnel.NewUsageFromConfig(cfg)
+	var reportAnchor func(context.Context, audit.Anchor) error
+	if cfg.AuditReport {
+		reportAnchor = func(ctx context.Context, anchor audit.Anchor) error {
+			return backendClient.PostLatest(ctx, backendClient.DevicePath("audit_anchor"), anchor)
+		}
+	}
+	auditLog := audit.NewFromConfig(cfg, httputil.FromTunnel, reportAnchor)
+	telemetrySvc := telemetry.NewFromConfig(cfg, Version, backendClient, wifiSvc, adblockSvc, vpnSvc, tunnelSvc)
+	capabilitiesSvc := capabilities.NewFromConfig(cfg, Version, bus, wifiSvc, vpnSvc, adblockSvc)
+	// An apply can bring up or give up an AP the probes check for.
+	wifiSvc.OnApply(capabilitiesSvc.Refresh)
+	watchConfig(cfg, backendClient, monitorSvc, vpnSvc, tunnelSvc)
+	peersSvc := peers.NewFromConfig(cfg, Version, func() string { return capabilitiesSvc.Document().Hash() }, backendClient)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	// An installed update shuts the agent down as SIGTERM does, and it
+	// then starts the new binary; see restartIntoUpdate.
+	ctx, restart := context.WithCancelCause(ctx)
+	otaSvc := ota.NewFromConfig(cfg, Version, gate, func() { restart(ota.ErrRestart) })
 
-	apiSvc := registerRoutes(cfg, cloudSvc, monitorSvc, wifiSvc, vpnSvc, adblockSvc, routerSvc)
+	apiSvc := registerRoutes(a, cfg, gate, ops, auditLog, bus, registrar, otaSvc, cloudSvc, monitorSvc, wifiSvc, vpnSvc, adblockSvc, routerSvc, tunnelSvc, tunnelUsage,
+		telemetrySvc, capabilitiesSvc, peersSvc, gatewayListener(cfg, wifiSvc, a.PortalReleased()))
 
-	a, err := agent.New(cfg, wifi.New(cfg.IsArm64()), []agent.Service{
+	a.Register(
+		backendClient,
+		registrar,
 		cloudSvc,
 		monitorSvc,
 		wifiSvc,
@@ -63,42 +159,247 @@ func main() {
 		adblockSvc,
 		routerSvc,
 		tunnelSvc,
+		tunnelUsage,
+		auditLog,
+		telemetrySvc,
+		capabilitiesSvc,
+		otaSvc,
+		resources.Default,
 		apiSvc,
 		&agent.ProfilerService{Port: cfg.PprofPort},
-	})
+	)
+
+	if fileWorker != nil {
+		a.Register(fileWorker)
+	}
+	if cfg.PeerDiscovery {
+		a.Register(peersSvc)
+	}
+
+	// SIGHUP reloads the config, as POST /api/config/reload does.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			cfg.Reload() //nolint:errcheck // Load made cfg; Reload logs what it did
+		}
+	}()
+
+	err = a.Start(ctx)
+	cloudSvc.Close()
 	if err != nil {
-		log.Fatalf("agent init failed: %v", err)
+		log.Fatalf("agent stopped: %v", err)
+	}
+	if errors.Is(context.Cause(ctx), ota.ErrRestart) {
+		restartIntoUpdate()
 	}
+	slog.Info("agent: shutdown complete")
+}
+
+// restartIntoUpdate replaces the stopped agent with the binary an update
+// installed, with the same arguments and environment. Should that fail,
+// the agent exits non-zero for systemd to start it instead.
+func restartIntoUpdate() {
+	exe, err := os.Executable()
+	if err == nil {
+		slog.Info("agent: shutdown complete, starting the update", "path", exe)
+		err = syscall.Exec(exe, os.Args, os.Environ())
+	}
+	log.Fatalf("agent: could not start the update, exiting for systemd to restart: %v", err)
+}
 
+// sweepObsolete moves files earlier releases generated and this one no
+// longer does out of the way, once per version. A failure is logged and
+// retried on the next boot; it never stops the agent.
+func sweepObsolete(cfg *config.Config) {
+	work, err := os.Getwd()
+	if err != nil {
+		slog.Warn("agent: obsolete file sweep skipped", "err", err)
+		return
+	}
+	dirs := managed.Dirs{Root: "/", Data: cfg.DataDir, Work: work}
+	if cfg.IsDev {
+		dirs.Root = "" // stay out of the dev machine's /etc
+	}
+	if _, err := managed.Sweep(managed.Options{
+		Dirs:      dirs,
+		Version:   Version,
+		StatePath: cfg.ManagedStatePath(),
+		DryRun:    cfg.SweepDryRun,
+	}); err != nil {
+		slog.Warn("agent: obsolete file sweep incomplete", "err", err)
+	}
+}
+
+// gatewayListener serves the API on :80 (and :443 with a certificate) of
+// the AP gateway while router mode is on, so the gateway IP typed into a
+// browser reaches the UI. nil when GATEWAY_HTTP is off, and in dev mode,
+// where the ports can't be bound.
+func gatewayListener(cfg *config.Config, w *wifi_feature.WiFi, portalReleased <-chan struct{}) *api.Gateway {
+	if !cfg.GatewayHTTP || cfg.IsDev {
+		return nil
+	}
+	g := &api.Gateway{
+		IP: func() string {
+			st := w.Status()
+			if st.Mode != wifi_feature.ModeRouter || !st.Active {
+				return ""
+			}
+			return st.GatewayIP
+		},
+		After: portalReleased,
+	}
+	if cfg.TLSCertFile != "" || cfg.TLSKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			slog.Warn("agent: TLS certificate unusable, serving the gateway on :80 only", "err", err)
+		} else {
+			g.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+		}
+	}
+	w.OnApply(g.Changed)
+	return g
+}
+
+// runFileWorker is the child process side of FILE_WORKER: only the cloud
+// file routes, on a unix socket, as the unprivileged user the agent
+// started it as. Storage is already mounted by the parent.
+func runFileWorker(socket, dataDir string, devMode bool) {
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
 
-	a.Start(ctx)
-	slog.Info("agent: shutdown complete")
+	mux := http.NewServeMux()
+	// Slow requests are logged here too, where the cloud handlers' phase
+	// marks are.
+	tracker := latency.New(latency.Config{Slow: config.SlowRequest()})
+	c := cloud.New(dataDir, config.APIPort, devMode)
+	c.TrashRetention = time.Duration(config.TrashRetentionDays()) * 24 * time.Hour
+	c.UploadReserve, c.UploadReservePercent = config.UploadReserve()
+	c.SystemReserve, c.SystemReservePercent = config.SystemReserve()
+	c.DAVUser, c.DAVPassword = config.WebDAV()
+	c.JobWorkers, c.JobPace = config.CloudJobs()
+	c.RegisterFileRoutes(mux)
+	c.Start(ctx) //nolint:errcheck // upkeep only, never fails
+	err := fileworker.Serve(ctx, socket, tracker.Middleware(mux))
+	c.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// watchConfig hands the settings a config reload changed to the features
+// that use them; see config.Reload. The rest need a restart.
+func watchConfig(cfg *config.Config, b *backend.Client, m *monitor.NetworkMonitor, v *vpn.VPN, t *tunnel.Service) {
+	apply := func(ch <-chan config.Config, fn func(config.Config)) {
+		go func() {
+			for c := range ch {
+				fn(c)
+			}
+		}()
+	}
+	apply(cfg.Watch("BACKEND_URL", config.SecretAuthToken), func(c config.Config) {
+		b.SetServer(c.EffectiveBackendURL(), c.Secret(config.SecretAuthToken))
+	})
+	apply(cfg.Watch("BACKEND_URL"), func(c config.Config) {
+		m.SetBackendURL(c.EffectiveBackendURL())
+	})
+	apply(cfg.Watch(config.SecretTailscaleKey), func(c config.Config) {
+		v.SetAuthKey(c.Secret(config.SecretTailscaleKey))
+	})
+	apply(cfg.Watch("VPS_IP", "VPS_PORT", config.SecretAuthToken), func(c config.Config) {
+		t.SetServer(c.VPSIP, c.VPSPort, c.Secret(config.SecretAuthToken))
+	})
 }
 
 func registerRoutes(
+	a *agent.Agent,
 	cfg *config.Config,
+	gate *maintenance.Gate,
+	ops *operations.Tracker,
+	auditLog *audit.Log,
+	bus *events.Bus,
+	reg *backend.Registrar,
+	updater *ota.Service,
 	c *cloud.Cloud,
 	m *monitor.NetworkMonitor,
 	w *wifi_feature.WiFi,
 	v *vpn.VPN,
 	ab *adblock.AdBlock,
 	rc *router.RouterController,
+	ts *tunnel.Service,
+	tu *tunnel.Usage,
+	tel *telemetry.Service,
+	caps *capabilities.Service,
+	ps *peers.Service,
+	gw *api.Gateway,
 ) *api.Server {
 	mux := http.NewServeMux()
+	tracker := latency.New(latency.Config{Slow: cfg.SlowRequest, FromTunnel: httputil.FromTunnel})
 
-	mux.HandleFunc("GET /api/health", agent.HealthHandler)
+	// The registered services report their own health and warnings.
+	mux.HandleFunc("GET /api/health", a.HealthHandler(gate))
+	mux.HandleFunc("GET /api/health/live", agent.LiveHandler)
+	mux.HandleFunc("GET /api/agent/services", a.ServicesHandler)
+	mux.HandleFunc("POST /api/agent/services/{name}/restart", a.RestartHandler)
+	mux.HandleFunc("GET /api/agent/identity", a.IdentityHandler(reg))
+	mux.HandleFunc("GET /api/config", a.ConfigHandler)
+	mux.HandleFunc("POST /api/config/reload", a.ReloadConfigHandler)
+	mux.Handle("GET /metrics", metrics.Default.Handler())
+	metrics.Default.Register(ab, rc, ts)
+	resources.Default.RegisterRoutes(mux)
+	logger.Recent.RegisterRoutes(mux)
+	ops.RegisterRoutes(mux)
+	tracker.RegisterRoutes(mux)
+	auditLog.RegisterRoutes(mux)
+	updater.RegisterRoutes(mux)
+	gate.RegisterRoutes(mux)
 	c.RegisterRoutes(mux)
 	m.RegisterRoutes(mux)
 	w.RegisterRoutes(mux)
 	v.RegisterRoutes(mux)
 	ab.RegisterRoutes(mux)
 	rc.RegisterRoutes(mux)
+	ts.RegisterRoutes(mux)
+	tu.RegisterRoutes(mux)
+	tel.RegisterRoutes(mux)
+	caps.RegisterRoutes(mux)
+	ps.RegisterRoutes(mux)
+	apidoc.Default.RegisterRoutes(mux, Version)
+
+	auth, err := api.NewAuth(api.AuthConfig{Path: cfg.APITokenPath()})
+	if err != nil {
+		log.Fatalf("api token init failed: %v", err)
+	}
+	auth.RegisterRoutes(mux)
+	mux.HandleFunc("GET /api/system/security", agent.SecurityHandler(auth, tel))
+
+	limits, err := api.ParseLimits(cfg.RateLimits)
+	if err != nil {
+		slog.Warn("agent: RATE_LIMITS ignored, using the default limits", "err", err)
+		limits = api.DefaultLimits
+	}
 
-	return api.New(api.Config{
+	srv := api.New(api.Config{
 		Port:    c.Port,
 		DataDir: c.DataDir,
 		IsDev:   cfg.IsDev,
+		// The meter is outermost of the routes so tunnel traffic is
+		// counted whole, including what the file worker serves; the
+		// tracker goes around it to time its refusals too. The audit
+		// trail goes inside the tracker, which reads the route back.
+		Middleware: func(h http.Handler) http.Handler {
+			return tracker.Middleware(auditLog.Middleware(tu.Meter(h)))
+		},
+		// The strct CLI; see internal/cli.
+		Socket:      cfg.AdminSocketPath(),
+		SocketGroup: "strct",
+		Gateway:     gw,
+		Auth:        auth,
+		RateLimit:   api.NewRateLimiter(api.RateLimitConfig{Limits: limits}),
+		Events:      bus,
+		// frpc proxies to the API's tunnel listener.
+		OnPort: ts.SetLocalPort,
 	}, mux)
+	srv.RegisterRoutes(mux)
+	return srv
 }
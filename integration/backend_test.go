@@ -0,0 +1,99 @@
+//go:build integration
+
+package integration_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/config"
+	"github.com/strct-org/strct-agent/internal/platform/backend"
+)
+
+func TestBackend_ReportsAreSigned(t *testing.T) {
+	fb := newFakeBackend(t, secret)
+	cfg := newAgentConfig(t, fb.URL)
+	c := backend.NewFromConfig(cfg)
+	ctx := context.Background()
+
+	report := map[string]any{"devices": []map[string]string{{"mac": "aa:bb:cc:dd:ee:ff", "ip": "192.168.4.20"}}}
+	if err := c.PostLatest(ctx, c.DevicePath("connected_devices"), report); err != nil {
+		t.Fatalf("PostLatest: %v", err)
+	}
+	fb.answer("usage_policy", map[string]int{"limit_mb": 512})
+	var policy struct {
+		LimitMB int `json:"limit_mb"`
+	}
+	if err := c.Query(ctx, c.DevicePath("usage_policy"), map[string]string{}, &policy); err != nil || policy.LimitMB != 512 {
+		t.Fatalf("Query = %+v, %v", policy, err)
+	}
+
+	got := fb.received("connected_devices")
+	if len(got) != 1 {
+		t.Fatalf("backend got %d reports, want 1", len(got))
+	}
+	r := got[0]
+	if r.SignatureErr != "" || r.Device != deviceID || r.Method != http.MethodPost {
+		t.Errorf("report = %s %s device %q, signature: %q", r.Method, r.Path, r.Device, r.SignatureErr)
+	}
+	var body map[string]any
+	if err := json.Unmarshal(r.Body, &body); err != nil || body["devices"] == nil {
+		t.Errorf("body = %s", r.Body)
+	}
+
+	// Signed with another secret, the backend refuses it, and a refusal
+	// is not retried.
+	wrong := newAgentConfig(t, fb.URL)
+	wrong.SetSecret(config.SecretAuthToken, "not-the-secret")
+	w := backend.NewFromConfig(wrong)
+	var se *backend.StatusError
+	if err := w.Post(ctx, w.DevicePath("connected_devices"), report); !errors.As(err, &se) || se.Code != http.StatusUnauthorized {
+		t.Errorf("wrong secret: %v, want 401", err)
+	}
+	if w.QueueLen() != 0 {
+		t.Errorf("a refused report was queued")
+	}
+}
+
+func TestBackend_QueuesThroughAnOutage(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for the queue's 30s flush")
+	}
+	fb := newFakeBackend(t, secret)
+	cfg := newAgentConfig(t, fb.URL)
+	path := "connected_devices"
+
+	fb.failWith(http.StatusServiceUnavailable)
+	c := backend.NewFromConfig(cfg)
+	ctx := context.Background()
+	if err := c.PostLatest(ctx, c.DevicePath(path), map[string]int{"count": 1}); !errors.Is(err, backend.ErrQueued) {
+		t.Fatalf("during the outage: %v, want ErrQueued", err)
+	}
+	if err := c.PostLatest(ctx, c.DevicePath(path), map[string]int{"count": 2}); !errors.Is(err, backend.ErrQueued) {
+		t.Fatalf("during the outage: %v, want ErrQueued", err)
+	}
+	if n := c.QueueLen(); n != 1 {
+		t.Fatalf("queue holds %d, want only the latest snapshot", n)
+	}
+
+	// The agent restarts and the backend comes back: the queue was kept
+	// in DataDir and is flushed, signed afresh.
+	fb.failWith(0)
+	restarted := backend.NewFromConfig(cfg)
+	if n := restarted.QueueLen(); n != 1 {
+		t.Fatalf("queue after a restart holds %d, want 1", n)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	restarted.Start(ctx)
+	waitFor(t, 45*time.Second, "the queue to flush", func() bool { return restarted.QueueLen() == 0 })
+
+	delivered := fb.received(path)
+	if len(delivered) != 1 || string(delivered[0].Body) != `{"count":2}` {
+		t.Errorf("delivered %+v, want the one latest report", delivered)
+	}
+}
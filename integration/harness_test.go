@@ -0,0 +1,369 @@
+//go:build integration
+
+// Package integration runs the agent's services in dev mode against fakes
+// of what they talk to on the internet: the strct backend, the OTA
+// release storage and frps. Unit tests with executil.Mock never reach
+// these protocol surfaces.
+//
+//	go test -tags integration -v ./integration/
+//
+// The backend and the release storage are in-process fakes. frps is the
+// real one: the tunnel test uses $STRCT_FRP_DIR, a directory holding frps
+// and frpc, or downloads the frp release the tunnel pins into the user
+// cache once, and is skipped when neither works.
+package integration_test
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/config"
+	"github.com/strct-org/strct-agent/internal/platform/backend"
+)
+
+const (
+	deviceID = "device-integration"
+	secret   = "integration-s3cret"
+)
+
+// newAgentConfig is the config the agent would load in dev mode, with
+// its own DataDir and the frp token secret.
+func newAgentConfig(t *testing.T, backendURL string) *config.Config {
+	t.Helper()
+	cfg := &config.Config{
+		IsDev:        true,
+		DeviceID:     deviceID,
+		Domain:       "localhost",
+		DataDir:      t.TempDir(),
+		BackendURL:   backendURL,
+		StoreBackend: config.StoreBackendJSONL,
+	}
+	cfg.SetSecret(config.SecretAuthToken, secret)
+	return cfg
+}
+
+// ─── Fake backend ────────────────────────────────────────────────────────────
+
+// backendRequest is one request the fake backend received.
+type backendRequest struct {
+	Method string
+	Path   string
+	Device string
+	Status int // what the fake answered
+	// SignatureErr is why the signature didn't check out, "" if it did.
+	SignatureErr string
+	Body         json.RawMessage
+}
+
+// fakeBackend answers the device API the way the backend does, checking
+// every request's signature on its own rather than with the client's
+// code, and records what arrived.
+type fakeBackend struct {
+	*httptest.Server
+	secret string
+
+	mu       sync.Mutex
+	requests []backendRequest
+	status   int            // what to answer; 0 is 200
+	answers  map[string]any // JSON answers by path suffix
+}
+
+func newFakeBackend(t *testing.T, secret string) *fakeBackend {
+	t.Helper()
+	b := &fakeBackend{secret: secret, answers: map[string]any{}}
+	b.Server = httptest.NewServer(http.HandlerFunc(b.serve))
+	t.Cleanup(b.Close)
+	return b
+}
+
+func (b *fakeBackend) serve(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	req := backendRequest{
+		Method:       r.Method,
+		Path:         r.URL.Path,
+		Device:       r.Header.Get(backend.HeaderDevice),
+		SignatureErr: b.checkSignature(r, body),
+		Body:         body,
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	req.Status = http.StatusOK
+	switch {
+	case b.status != 0:
+		req.Status = b.status
+	case req.SignatureErr != "":
+		req.Status = http.StatusUnauthorized
+	}
+	b.requests = append(b.requests, req)
+	if req.Status != http.StatusOK {
+		http.Error(w, req.SignatureErr, req.Status)
+		return
+	}
+	var answer any
+	for suffix, a := range b.answers {
+		if strings.HasSuffix(r.URL.Path, suffix) {
+			answer = a
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if answer == nil {
+		answer = map[string]string{"status": "ok"}
+	}
+	json.NewEncoder(w).Encode(answer)
+}
+
+// checkSignature verifies
+//
+//	hex(HMAC-SHA256(secret, timestamp + "\n" + method + "\n" + path + "\n" + hex(sha256(body))))
+//
+// and that the timestamp is within five minutes.
+func (b *fakeBackend) checkSignature(r *http.Request, body []byte) string {
+	ts := r.Header.Get(backend.HeaderTimestamp)
+	sig := r.Header.Get(backend.HeaderSignature)
+	if ts == "" || sig == "" {
+		return "unsigned"
+	}
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return "bad timestamp " + ts
+	}
+	if d := time.Since(time.Unix(unix, 0)); d > 5*time.Minute || d < -5*time.Minute {
+		return "timestamp off by " + d.String()
+	}
+	sum := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(b.secret))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s", ts, r.Method, r.URL.Path, hex.EncodeToString(sum[:]))
+	if !hmac.Equal([]byte(hex.EncodeToString(mac.Sum(nil))), []byte(sig)) {
+		return "signature mismatch"
+	}
+	return ""
+}
+
+// failWith answers every request with code from now on; 0 stops.
+func (b *fakeBackend) failWith(code int) {
+	b.mu.Lock()
+	b.status = code
+	b.mu.Unlock()
+}
+
+// answer makes requests to paths ending in suffix get v as JSON.
+func (b *fakeBackend) answer(suffix string, v any) {
+	b.mu.Lock()
+	b.answers[suffix] = v
+	b.mu.Unlock()
+}
+
+// received returns the requests to the device path ending in suffix the
+// fake accepted.
+func (b *fakeBackend) received(suffix string) []backendRequest {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var out []backendRequest
+	for _, r := range b.requests {
+		if r.Path == "/api/v1/device/agent/"+deviceID+"/"+suffix && r.Status == http.StatusOK {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// ─── Fake release storage ────────────────────────────────────────────────────
+
+// releaseServer is the OTA storage URL: static files, as the release
+// bucket serves them, with a release on the stable channel.
+type releaseServer struct {
+	*httptest.Server
+	dir string
+}
+
+// path is name's file on the stable channel.
+func (s *releaseServer) path(name string) string {
+	return filepath.Join(s.dir, "stable", name)
+}
+
+func newReleaseServer(t *testing.T) *releaseServer {
+	t.Helper()
+	s := &releaseServer{dir: t.TempDir()}
+	s.Server = httptest.NewServer(http.FileServer(http.Dir(s.dir)))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// binaryName is the release asset for this platform.
+func binaryName() string {
+	return fmt.Sprintf("strct-agent-%s-%s", runtime.GOOS, runtime.GOARCH)
+}
+
+// publish puts up version with binary for this platform and checksum as
+// its .sha256; "" publishes binary's real one.
+func (s *releaseServer) publish(t *testing.T, version string, binary []byte, checksum string) {
+	t.Helper()
+	if checksum == "" {
+		sum := sha256.Sum256(binary)
+		checksum = hex.EncodeToString(sum[:])
+	}
+	if err := os.MkdirAll(s.path(""), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range map[string][]byte{
+		"version.txt":            []byte(version + "\n"),
+		binaryName():             binary,
+		binaryName() + ".sha256": []byte(checksum + "  " + binaryName() + "\n"),
+	} {
+		if err := os.WriteFile(s.path(name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// ─── frp ─────────────────────────────────────────────────────────────────────
+
+// frpVersion is the release internal/platform/tunnel pins.
+const frpVersion = "0.61.0"
+
+// frpBinaries returns a directory with frps and frpc in it, skipping the
+// test when there is none to be had.
+func frpBinaries(t *testing.T) string {
+	t.Helper()
+	if dir := os.Getenv("STRCT_FRP_DIR"); dir != "" {
+		return dir
+	}
+	cache, err := os.UserCacheDir()
+	if err != nil {
+		t.Skipf("no frp: set STRCT_FRP_DIR (%v)", err)
+	}
+	asset := fmt.Sprintf("frp_%s_%s_%s", frpVersion, runtime.GOOS, runtime.GOARCH)
+	dir := filepath.Join(cache, "strct-agent-test", asset)
+	if _, err := os.Stat(filepath.Join(dir, "frps")); err == nil {
+		return dir
+	}
+	if err := downloadFRP(asset+".tar.gz", dir); err != nil {
+		t.Skipf("no frp: set STRCT_FRP_DIR or allow the download (%v)", err)
+	}
+	return dir
+}
+
+// downloadFRP fetches the frp release, checks it against the tunnel's
+// pinned checksums and extracts frps and frpc into dir.
+func downloadFRP(asset, dir string) error {
+	sums, err := os.ReadFile(filepath.Join("..", "internal", "platform", "tunnel", "frp_sha256_checksums.txt"))
+	if err != nil {
+		return err
+	}
+	var want string
+	sc := bufio.NewScanner(strings.NewReader(string(sums)))
+	for sc.Scan() {
+		if f := strings.Fields(sc.Text()); len(f) == 2 && !strings.HasPrefix(f[0], "#") && f[1] == asset {
+			want = f[0]
+		}
+	}
+	if want == "" {
+		return fmt.Errorf("no pinned checksum for %s", asset)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	url := fmt.Sprintf("%s/v%s/%s", config.DefaultFRPCMirrorURL, frpVersion, asset)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	archive, err := io.ReadAll(io.LimitReader(resp.Body, 64<<20))
+	if err != nil {
+		return err
+	}
+	if sum := sha256.Sum256(archive); hex.EncodeToString(sum[:]) != want {
+		return fmt.Errorf("%s does not match its pinned checksum", asset)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.MkdirTemp(filepath.Dir(dir), ".frp-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	zr, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(zr)
+	found := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name := path.Base(hdr.Name)
+		if hdr.Typeflag != tar.TypeReg || (name != "frps" && name != "frpc") {
+			continue
+		}
+		f, err := os.OpenFile(filepath.Join(tmp, name), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0755)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, tr)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		found++
+	}
+	if found != 2 {
+		return fmt.Errorf("%s holds no frps and frpc", asset)
+	}
+	return os.Rename(tmp, dir)
+}
+
+// freePort returns a loopback TCP port nothing listens on.
+func freePort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// waitFor polls cond every 100ms until it holds or timeout passes.
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out after %v waiting for %s", timeout, what)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,61 @@
+//go:build integration
+
+package integration_test
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/strct-org/strct-agent/ota"
+)
+
+func TestOTA_InstallsOnlyAVerifiedBinary(t *testing.T) {
+	rs := newReleaseServer(t)
+	target := filepath.Join(t.TempDir(), "strct-agent")
+	old := []byte("#!/bin/sh\necho 1.0.0\n")
+	if err := os.WriteFile(target, old, 0755); err != nil {
+		t.Fatal(err)
+	}
+	cfg := ota.Config{CurrentVersion: "1.0.0", StorageURL: rs.URL, TargetPath: target}
+	ctx := context.Background()
+	next := []byte("#!/bin/sh\necho 1.1.0\n")
+
+	// A binary that doesn't match its checksum, as a corrupted or
+	// swapped upload, is refused and the old one kept.
+	rs.publish(t, "1.1.0", next, "0000000000000000000000000000000000000000000000000000000000000000")
+	if _, err := ota.Install(ctx, cfg); err == nil {
+		t.Fatal("installed a binary that does not match its checksum")
+	}
+	if b, _ := os.ReadFile(target); !bytes.Equal(b, old) {
+		t.Fatalf("target changed after a refused update: %q", b)
+	}
+
+	// No checksum published, nothing installed.
+	rs.publish(t, "1.1.0", next, "")
+	os.Remove(rs.path(binaryName() + ".sha256"))
+	if _, err := ota.Install(ctx, cfg); err == nil {
+		t.Fatal("installed a binary without a checksum")
+	}
+
+	rs.publish(t, "1.1.0", next, "")
+	rel, err := ota.Install(ctx, cfg)
+	if err != nil || !rel.Available || rel.Latest != "1.1.0" {
+		t.Fatalf("Install = %+v, %v", rel, err)
+	}
+	if b, _ := os.ReadFile(target); !bytes.Equal(b, next) {
+		t.Fatalf("target = %q, want the new binary", b)
+	}
+	if info, _ := os.Stat(target); info.Mode().Perm()&0100 == 0 {
+		t.Errorf("new binary mode %v, not executable", info.Mode().Perm())
+	}
+
+	// Up to date: nothing is downloaded.
+	cfg.CurrentVersion = "1.1.0"
+	os.Remove(rs.path(binaryName()))
+	if rel, err := ota.Install(ctx, cfg); err != nil || rel.Available {
+		t.Errorf("same version: %+v, %v", rel, err)
+	}
+}
@@ -0,0 +1,143 @@
+//go:build integration
+
+package integration_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/platform/executil"
+	"github.com/strct-org/strct-agent/internal/platform/tunnel"
+)
+
+// subDomainHost is the fake VPS's domain; the device is served at
+// <device-id>.strct.test.
+const subDomainHost = "strct.test"
+
+// startFRPS runs frps on loopback as the VPS does and returns its bind
+// and vhost HTTP ports.
+func startFRPS(t *testing.T, dir, token string) (bindPort, vhostPort int) {
+	t.Helper()
+	bindPort, vhostPort = freePort(t), freePort(t)
+	cfgPath := filepath.Join(t.TempDir(), "frps.toml")
+	cfg := fmt.Sprintf(`bindAddr = "127.0.0.1"
+bindPort = %d
+vhostHTTPPort = %d
+subDomainHost = %q
+auth.method = "token"
+auth.token = %q
+`, bindPort, vhostPort, subDomainHost, token)
+	if err := os.WriteFile(cfgPath, []byte(cfg), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cmd := exec.CommandContext(ctx, filepath.Join(dir, "frps"), "-c", cfgPath)
+	cmd.Stdout, cmd.Stderr = testWriter{t}, testWriter{t}
+	if err := cmd.Start(); err != nil {
+		cancel()
+		t.Fatalf("frps: %v", err)
+	}
+	t.Cleanup(func() {
+		cancel()
+		cmd.Wait()
+	})
+	waitFor(t, 10*time.Second, "frps to listen", func() bool {
+		c, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(bindPort)))
+		if err == nil {
+			c.Close()
+		}
+		return err == nil
+	})
+	return bindPort, vhostPort
+}
+
+// testWriter logs a process's output with the test's.
+type testWriter struct{ t *testing.T }
+
+func (w testWriter) Write(p []byte) (int, error) {
+	w.t.Logf("%s", p)
+	return len(p), nil
+}
+
+func TestTunnel_ServesTheDeviceThroughFRPS(t *testing.T) {
+	frp := frpBinaries(t)
+	bindPort, vhostPort := startFRPS(t, frp, secret)
+
+	// The agent's HTTP server, as the tunnel's default proxy exposes it.
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "agent %s", r.URL.Path)
+	}))
+	t.Cleanup(app.Close)
+	appPort := app.Listener.Addr().(*net.TCPAddr).Port
+
+	dataDir := t.TempDir()
+	frpc, err := os.ReadFile(filepath.Join(frp, "frpc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dataDir, "frpc"), frpc, 0700); err != nil {
+		t.Fatal(err)
+	}
+	svc := tunnel.New(tunnel.Config{
+		ServerIP:   "127.0.0.1",
+		ServerPort: bindPort,
+		AuthToken:  secret,
+		DeviceID:   deviceID,
+		DataDir:    dataDir,
+		LocalPort:  appPort,
+		AdminPort:  freePort(t),
+	}, executil.Real{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := svc.Start(ctx); err != nil {
+		cancel()
+		t.Fatalf("Start: %v", err)
+	}
+	t.Cleanup(func() {
+		cancel()
+		stop, done := context.WithTimeout(context.Background(), 10*time.Second)
+		defer done()
+		if err := svc.Stop(stop); err != nil {
+			t.Errorf("Stop: %v", err)
+		}
+	})
+
+	// Connected once frpc's admin API, polled every 30s, shows the proxy
+	// running on frps.
+	if svc.Status().Connected {
+		t.Error("connected before the first admin poll")
+	}
+	waitFor(t, 45*time.Second, "the tunnel to connect", func() bool { return svc.Status().Connected })
+
+	req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("http://127.0.0.1:%d/api/status", vhostPort), nil)
+	req.Host = deviceID + "." + subDomainHost
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("through frps: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "agent /api/status" {
+		t.Errorf("through frps: %d %q", resp.StatusCode, body)
+	}
+
+	// Another subdomain is not this device.
+	req.Host = "someone-else." + subDomainHost
+	if resp, err := http.DefaultClient.Do(req); err == nil {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			t.Error("frps routed another subdomain to the device")
+		}
+	}
+}
@@ -7,6 +7,8 @@ import (
 	"fmt"
 	"log/slog"
 	"net/http"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
@@ -14,6 +16,9 @@ import (
 
 	"github.com/strct-org/strct-agent/internal/config"
 	"github.com/strct-org/strct-agent/internal/errs"
+	"github.com/strct-org/strct-agent/internal/httputil"
+	"github.com/strct-org/strct-agent/internal/platform/backend"
+	"github.com/strct-org/strct-agent/internal/platform/disk"
 	"github.com/strct-org/strct-agent/internal/platform/wifi"
 	"github.com/strct-org/strct-agent/internal/setup"
 )
@@ -31,42 +36,109 @@ type Service interface {
 }
 
 type Agent struct {
-	cfg      *config.Config
-	wifi     wifi.Provider
-	services []Service
+	cfg  *config.Config
+	wifi wifi.Provider
+
+	mu      sync.Mutex
+	entries []*entry // registered services; see services.go
+	ordered []*entry // entries in start order, once Start sorted them
+	// ctx is Start's, the parent of each service's; stopping is set once
+	// it is done, after which wg takes no more services.
+	ctx      context.Context
+	stopping bool
+	wg       sync.WaitGroup
+
+	started time.Time
+	// hasInternet is wifi.HasInternet, for /api/health.
+	hasInternet func() bool
+	// portalDone is closed once the setup portal's server has shut down
+	// and let go of :80, or at once if it never ran.
+	portalDone chan struct{}
 }
 
-func New(cfg *config.Config, w wifi.Provider, services []Service) (*Agent, error) {
-	a := &Agent{cfg: cfg, wifi: w, services: services}
+// New brings the device online — running the setup wizard if there is no
+// internet — before returning. Construct services after New: the wizard
+// may decide where storage lives, and cloud reads that decision.
+func New(cfg *config.Config, w wifi.Provider) (*Agent, error) {
+	a := &Agent{cfg: cfg, wifi: w, portalDone: make(chan struct{}), started: time.Now(), hasInternet: wifi.HasInternet}
 	if err := a.ensureConnectivity(); err != nil {
 		return nil, errs.E(opNew, err)
 	}
 	return a, nil
 }
 
-func (a *Agent) Start(ctx context.Context) {
-	slog.Info("agent: starting services", "count", len(a.services))
+// PortalReleased is closed when the setup portal no longer holds :80, the
+// port the API takes over on the AP gateway in router mode.
+func (a *Agent) PortalReleased() <-chan struct{} {
+	return a.portalDone
+}
+
+// Register adds services to be started by Start.
+func (a *Agent) Register(services ...Service) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, svc := range services {
+		e := newEntry(svc)
+		e.critical = a.cfg != nil && slices.Contains(a.cfg.CriticalServices, e.name)
+		a.entries = append(a.entries, e)
+	}
+}
+
+// Start starts the services in dependency order and blocks until ctx is
+// done, or a critical service fails, and they have all returned. The
+// failure is returned; a bad wiring (an unknown dependency, a cycle) is
+// returned before anything starts.
+func (a *Agent) Start(ctx context.Context) error {
+	a.mu.Lock()
+	ordered, err := order(a.entries)
+	a.ordered = ordered
+	a.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("agent: %w", err)
+	}
+	names := make([]string, len(ordered))
+	for i, e := range ordered {
+		names[i] = e.name
+	}
+	slog.Info("agent: starting services", "count", len(ordered), "order", strings.Join(names, ","))
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	a.mu.Lock()
+	a.ctx = ctx
+	a.mu.Unlock()
+	var failure error
+	var once sync.Once
+	fail := func(err error) {
+		once.Do(func() {
+			failure = err
+			slog.Error("agent: shutting down", "err", err)
+			cancel()
+		})
+	}
 
-	var wg sync.WaitGroup
-	for _, svc := range a.services {
-		svc := svc
-		wg.Add(1)
+	for _, e := range ordered {
+		a.wg.Add(1)
 		go func() {
-			defer wg.Done()
-			if err := svc.Start(ctx); err != nil {
-				slog.Error("agent: service failed to start", "err", err)
-			}
+			defer a.wg.Done()
+			a.run(ctx, e, fail)
 		}()
 	}
 
 	<-ctx.Done()
 	slog.Info("agent: shutdown signal received, waiting for services")
-	wg.Wait()
+	a.mu.Lock()
+	a.stopping = true
+	a.mu.Unlock()
+	a.wg.Wait()
+	a.stopAll()
+	return failure
 }
 
 func (a *Agent) ensureConnectivity() error {
 	if wifi.HasInternet() {
 		slog.Info("agent: internet detected, skipping setup wizard")
+		close(a.portalDone)
 		return nil
 	}
 	slog.Info("agent: no internet detected, starting setup wizard")
@@ -107,13 +179,18 @@ func (a *Agent) runSetupWizard() {
 	portalCtx, cancelPortal := context.WithCancel(context.Background())
 	defer cancelPortal()
 
-	go setup.StartCaptivePortal(portalCtx, a.wifi, done, a.cfg.IsDev)
+	go func() {
+		defer close(a.portalDone)
+		setup.StartCaptivePortal(portalCtx, a.wifi, a.storageStep(), done, a.cfg.IsDev)
+	}()
 	slog.Info("agent: captive portal running, waiting for WiFi credentials")
 	<-done // blocks until user connects
 
-	// Tell the portal to shut down. Its deferred iptables cleanup runs as
-	// ListenAndServe exits, before StopHotspot below.
+	// Tell the portal to shut down and wait for it: its deferred iptables
+	// cleanup runs as ListenAndServe exits, before StopHotspot below, and
+	// :80 is free for the API once it returns.
 	cancelPortal()
+	<-a.portalDone
 
 	if err := a.wifi.StopHotspot(); err != nil {
 		slog.Warn("agent: error stopping hotspot", "err", err)
@@ -122,6 +199,22 @@ func (a *Agent) runSetupWizard() {
 	slog.Info("agent: setup wizard complete, waiting for network to come up")
 }
 
+// storageStep returns the wizard's storage step, or nil when it should be
+// skipped: mocked hardware (cloud always uses ./data), headless installs
+// (STORAGE_SETUP=auto), or a choice already made on an earlier boot.
+func (a *Agent) storageStep() *setup.Storage {
+	if !a.cfg.UseRealHardware() || a.cfg.StorageSetup == config.StorageSetupAuto {
+		return nil
+	}
+	dec, err := disk.LoadDecision(a.cfg.StorageDecisionPath())
+	if err != nil {
+		slog.Warn("agent: unreadable storage decision, asking again", "err", err)
+	} else if dec != nil {
+		return nil
+	}
+	return setup.NewStorage(setup.SystemDrives{}, a.cfg.StorageDecisionPath())
+}
+
 type ProfilerService struct {
 	Port int
 }
@@ -140,16 +233,55 @@ func (p *ProfilerService) Start(ctx context.Context) error {
 	return nil
 }
 
-func HealthHandler(w http.ResponseWriter, r *http.Request) {
-	type response struct {
-		Status    string `json:"status"`
-		Internet  bool   `json:"internet_access"`
-		Timestamp string `json:"timestamp"`
+// ReloadConfigHandler reads the env files again and answers with what was
+// applied and what needs a restart; see config.Reload.
+// POST /api/config/reload
+func (a *Agent) ReloadConfigHandler(w http.ResponseWriter, r *http.Request) {
+	res, err := a.cfg.Reload()
+	if err != nil {
+		httputil.Error(w, http.StatusConflict, err.Error())
+		return
+	}
+	httputil.OK(w, res)
+}
+
+// ConfigHandler answers with the settings the agent runs with and where
+// each came from, passwords masked; see config.Loaded.
+// GET /api/config
+func (a *Agent) ConfigHandler(w http.ResponseWriter, r *http.Request) {
+	httputil.OK(w, a.cfg.Loaded())
+}
+
+// Identity is GET /api/agent/identity's answer.
+type Identity struct {
+	config.Identity
+	Registration backend.RegistrationStatus `json:"registration"`
+}
+
+// IdentityHandler answers with who the device is, what hardware its ID
+// is tied to, and whether it is registered with the backend.
+// GET /api/agent/identity
+func (a *Agent) IdentityHandler(reg *backend.Registrar) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		httputil.OK(w, Identity{Identity: a.cfg.Identity, Registration: reg.Status()})
+	}
+}
+
+// SecurityReporter is a feature whose state matters for what the device
+// exposes or sends, e.g. whether anything leaves it on its own.
+type SecurityReporter interface {
+	SecurityPosture() (name string, v any)
+}
+
+// SecurityHandler reports each reporter's posture under its name.
+func SecurityHandler(reporters ...SecurityReporter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		posture := make(map[string]any, len(reporters))
+		for _, rp := range reporters {
+			name, v := rp.SecurityPosture()
+			posture[name] = v
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(posture)
 	}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response{
-		Status:    "ok",
-		Internet:  wifi.HasInternet(),
-		Timestamp: time.Now().UTC().Format(time.RFC3339),
-	})
 }
@@ -0,0 +1,138 @@
+package agent
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/maintenance"
+)
+
+// ─── Health ──────────────────────────────────────────────────────────────────
+
+// GET /api/health is for people and uptime monitors alike. Each service
+// that implements Healther reports a component, and the worst of them is
+// the agent's status: down if a critical component is down, degraded if
+// any component is not ok. Down answers 503, so a monitor pointed at the
+// URL alerts without parsing the body. GET /api/health/live only says the
+// process answers; the tunnel checks reachability with it, which a 503
+// for a full disk would otherwise fail.
+
+// Component statuses, best to worst.
+const (
+	HealthOK       = "ok"
+	HealthDegraded = "degraded"
+	HealthDown     = "down"
+)
+
+// ComponentHealth is one component's part of /api/health.
+type ComponentHealth struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"` // HealthOK, HealthDegraded or HealthDown
+	Message string `json:"message,omitempty"`
+	// Critical is set on a component the device is no use without; it
+	// being down makes the agent down.
+	Critical bool `json:"critical,omitempty"`
+}
+
+// Healther is a service that reports its own health on /api/health.
+type Healther interface {
+	Health() ComponentHealth
+}
+
+// HealthWarner is a feature with problems worth surfacing on /api/health
+// without failing it, e.g. rules that keep disappearing.
+type HealthWarner interface {
+	HealthWarnings() []string
+}
+
+// Health is GET /api/health.
+type Health struct {
+	Status      string             `json:"status"`
+	Internet    bool               `json:"internet_access"`
+	Maintenance maintenance.Status `json:"maintenance"`
+	Components  []ComponentHealth  `json:"components"`
+	Warnings    []string           `json:"warnings,omitempty"`
+	Restarts    []ServiceRestart   `json:"restarts,omitempty"`
+	StartedAt   time.Time          `json:"started_at"`
+	Uptime      int64              `json:"uptime_seconds"`
+	Timestamp   string             `json:"timestamp"`
+}
+
+// ServiceRestart is a service restarted since the agent started; see
+// Agent.Restart.
+type ServiceRestart struct {
+	Service string    `json:"service"`
+	Count   int       `json:"count"`
+	LastAt  time.Time `json:"last_at"`
+}
+
+// Health collects the registered services' components and warnings.
+func (a *Agent) Health(gate *maintenance.Gate) Health {
+	now := time.Now()
+	h := Health{
+		Status:      HealthOK,
+		Internet:    a.hasInternet(),
+		Maintenance: gate.Status(),
+		Components:  []ComponentHealth{},
+		StartedAt:   a.started.UTC(),
+		Uptime:      int64(now.Sub(a.started).Seconds()),
+		Timestamp:   now.UTC().Format(time.RFC3339),
+	}
+	a.mu.Lock()
+	entries := slices.Clone(a.entries)
+	a.mu.Unlock()
+	for _, e := range entries {
+		svc := e.svc
+		var c ComponentHealth
+		hr, ok := svc.(Healther)
+		if ok {
+			c = hr.Health()
+		}
+		// A service that never came up is down, whatever it reports.
+		if down, err := e.failed(); down {
+			c = ComponentHealth{Name: e.name, Status: HealthDown, Message: err.Error(), Critical: e.critical}
+			ok = true
+		}
+		if ok {
+			h.Components = append(h.Components, c)
+			switch {
+			case c.Status == HealthDown && c.Critical:
+				h.Status = HealthDown
+			case c.Status != HealthOK && h.Status == HealthOK:
+				h.Status = HealthDegraded
+			}
+		}
+		if wr, ok := svc.(HealthWarner); ok {
+			h.Warnings = append(h.Warnings, wr.HealthWarnings()...)
+		}
+		if st := e.snapshot(); st.Restarts > 0 {
+			h.Restarts = append(h.Restarts, ServiceRestart{Service: e.name, Count: st.Restarts, LastAt: *st.RestartedAt})
+		}
+	}
+	return h
+}
+
+// HealthHandler serves Health, with 503 when the agent is down. It reads
+// the services on each request, so it may be built before they are
+// registered.
+func (a *Agent) HealthHandler(gate *maintenance.Gate) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h := a.Health(gate)
+		code := http.StatusOK
+		if h.Status == HealthDown {
+			code = http.StatusServiceUnavailable
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(h)
+	}
+}
+
+// LiveHandler answers 200 while the process serves requests, whatever
+// its components' health. GET /api/health/live
+func LiveHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"status":"ok"}` + "\n"))
+}
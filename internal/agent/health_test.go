@@ -0,0 +1,80 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/maintenance"
+)
+
+type component struct {
+	h        ComponentHealth
+	warnings []string
+}
+
+func (c *component) Start(context.Context) error { return nil }
+func (c *component) Health() ComponentHealth     { return c.h }
+func (c *component) HealthWarnings() []string    { return c.warnings }
+
+type plain struct{}
+
+func (plain) Start(context.Context) error { return nil }
+
+func TestHealthHandler_Aggregates(t *testing.T) {
+	storage := &component{h: ComponentHealth{Name: "storage", Status: HealthOK, Critical: true}}
+	tunnel := &component{h: ComponentHealth{Name: "tunnel", Status: HealthOK}, warnings: []string{"tunnel: 90% of the month's quota used"}}
+	a := &Agent{started: time.Now().Add(-time.Hour), hasInternet: func() bool { return true }}
+	handler := a.HealthHandler(maintenance.New(""))
+	// Registered after the handler was built, as main does.
+	a.Register(storage, plain{}, tunnel)
+
+	get := func() (int, Health) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", "/api/health", nil))
+		var h Health
+		if err := json.Unmarshal(w.Body.Bytes(), &h); err != nil {
+			t.Fatalf("decode %s: %v", w.Body, err)
+		}
+		return w.Code, h
+	}
+
+	code, h := get()
+	if code != http.StatusOK || h.Status != HealthOK || len(h.Components) != 2 || !h.Internet {
+		t.Fatalf("all ok: %d %+v", code, h)
+	}
+	if h.Uptime < 3599 || len(h.Warnings) != 1 {
+		t.Errorf("uptime %d, warnings %v", h.Uptime, h.Warnings)
+	}
+
+	// A non-critical component down degrades the agent.
+	tunnel.h.Status = HealthDown
+	if code, h := get(); code != http.StatusOK || h.Status != HealthDegraded {
+		t.Errorf("tunnel down: %d %s", code, h.Status)
+	}
+
+	// A critical one takes it down, and uptime monitors get a 503.
+	storage.h.Status = HealthDown
+	if code, h := get(); code != http.StatusServiceUnavailable || h.Status != HealthDown {
+		t.Errorf("storage down: %d %s", code, h.Status)
+	}
+
+	// Critical but only degraded is not down.
+	storage.h.Status = HealthDegraded
+	tunnel.h.Status = HealthOK
+	if code, h := get(); code != http.StatusOK || h.Status != HealthDegraded {
+		t.Errorf("storage degraded: %d %s", code, h.Status)
+	}
+}
+
+func TestLiveHandler(t *testing.T) {
+	w := httptest.NewRecorder()
+	LiveHandler(w, httptest.NewRequest("GET", "/api/health/live", nil))
+	if w.Code != http.StatusOK || w.Body.String() != `{"status":"ok"}`+"\n" {
+		t.Errorf("live: %d %s", w.Code, w.Body)
+	}
+}
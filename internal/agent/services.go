@@ -0,0 +1,468 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/httputil"
+)
+
+// ─── Service wiring ──────────────────────────────────────────────────────────
+
+// Services start in dependency order. A service that implements Dependent
+// starts once every service it names has returned from Start; the others
+// start at once, concurrently. A dependency's Start must therefore return:
+// a server that blocks in Start until shutdown cannot be depended on.
+//
+// A service whose Start fails or panics is down, and the services that
+// depend on it are skipped. If it is critical (config.CriticalServices)
+// the agent shuts down and Start returns the failure, so systemd restarts
+// it rather than leave it half up.
+//
+// Each service runs with a context of its own, so one can be restarted
+// without the agent: Restart cancels it, waits for Start to return and
+// for Stop if it is a Stopper, and calls Start again. Its dependents are
+// not restarted. Critical services are not restarted this way; the API
+// is one, and could not answer a request that restarts it.
+
+// Named is a service with a name for DependsOn and GET /api/agent/services.
+// Others are named after their type, e.g. "backend.Client".
+type Named interface {
+	Name() string
+}
+
+// Dependent is a service that must start after others, by name.
+type Dependent interface {
+	DependsOn() []string
+}
+
+// Stopper is a service whose Start returns while work it began goes on
+// in the background. Stop is called once its context is cancelled, on a
+// restart or at shutdown, and returns when that work has ended or ctx is
+// done. A service that serves from inside Start needs no Stop: Start
+// returning is its exit.
+type Stopper interface {
+	Stop(ctx context.Context) error
+}
+
+// Service states, in the order they are passed through.
+const (
+	ServiceWaiting  = "waiting"  // for a dependency
+	ServiceStarting = "starting" // in Start
+	ServiceRunning  = "running"  // Start returned, or has run startWait without returning
+	ServiceFailed   = "failed"   // Start returned an error or panicked
+	ServiceSkipped  = "skipped"  // a dependency failed
+	ServiceStopped  = "stopped"  // Start returned after shutdown began
+)
+
+// startWait is how long a Start may run before its service is shown as
+// running: a server serves from inside Start.
+const startWait = 2 * time.Second
+
+// stopWait bounds how long a restart waits for a service to exit, and
+// shutdown for the Stoppers.
+const stopWait = 30 * time.Second
+
+// Restart errors, for RestartHandler's status codes.
+var (
+	ErrUnknownService = errors.New("no such service")
+	ErrNotRestartable = errors.New("cannot be restarted")
+	ErrShuttingDown   = errors.New("the agent is shutting down")
+)
+
+// ServiceState is one service in GET /api/agent/services.
+type ServiceState struct {
+	Name      string     `json:"name"`
+	State     string     `json:"state"`
+	DependsOn []string   `json:"depends_on,omitempty"`
+	Critical  bool       `json:"critical,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	StartedAt *time.Time `json:"started_at,omitempty"` // Start was called
+	// StartSeconds is how long Start took, once it returned.
+	StartSeconds float64    `json:"start_seconds,omitempty"`
+	Restarts     int        `json:"restarts,omitempty"`
+	RestartedAt  *time.Time `json:"restarted_at,omitempty"`
+}
+
+// Services is GET /api/agent/services.
+type Services struct {
+	Order    []string       `json:"order"` // the order Start is called in
+	Services []ServiceState `json:"services"`
+}
+
+// entry is a registered service and how its start went.
+type entry struct {
+	svc  Service
+	name string
+	deps []string
+
+	done chan struct{} // closed once Start returned, failed or was skipped
+
+	mu       sync.Mutex
+	state    string
+	err      error
+	critical bool
+	started  time.Time
+	took     time.Duration
+
+	// gen counts Start calls; an outcome from an earlier one, which a
+	// restart cancelled, is not recorded.
+	gen         int
+	cancel      context.CancelFunc // the running Start's context
+	exited      chan struct{}      // closed when that Start returns
+	restarting  bool
+	restarts    int
+	restartedAt time.Time
+}
+
+func newEntry(svc Service) *entry {
+	e := &entry{svc: svc, name: serviceName(svc), state: ServiceWaiting, done: make(chan struct{})}
+	if d, ok := svc.(Dependent); ok {
+		e.deps = d.DependsOn()
+	}
+	return e
+}
+
+func serviceName(svc Service) string {
+	if n, ok := svc.(Named); ok {
+		return n.Name()
+	}
+	return strings.TrimPrefix(fmt.Sprintf("%T", svc), "*")
+}
+
+func (e *entry) set(state string, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.state, e.err = state, err
+}
+
+func (e *entry) snapshot() ServiceState {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	st := ServiceState{Name: e.name, State: e.state, DependsOn: e.deps, Critical: e.critical}
+	if e.err != nil {
+		st.Error = e.err.Error()
+	}
+	if !e.started.IsZero() {
+		at := e.started.UTC()
+		st.StartedAt = &at
+	}
+	if e.took > 0 {
+		st.StartSeconds = e.took.Seconds()
+	}
+	if e.restarts > 0 {
+		st.Restarts = e.restarts
+		at := e.restartedAt.UTC()
+		st.RestartedAt = &at
+	}
+	if st.State == ServiceStarting && time.Since(e.started) >= startWait {
+		st.State = ServiceRunning
+	}
+	return st
+}
+
+// failed reports whether the service is down for good, and why.
+func (e *entry) failed() (bool, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.state == ServiceFailed || e.state == ServiceSkipped, e.err
+}
+
+// order sorts the entries so each comes after its dependencies, in
+// registration order otherwise. An unknown name or a cycle is an error.
+func order(entries []*entry) ([]*entry, error) {
+	byName := make(map[string]*entry, len(entries))
+	for _, e := range entries {
+		if _, dup := byName[e.name]; dup {
+			return nil, fmt.Errorf("two services are named %q", e.name)
+		}
+		byName[e.name] = e
+	}
+	for _, e := range entries {
+		for _, d := range e.deps {
+			if _, ok := byName[d]; !ok {
+				return nil, fmt.Errorf("%s depends on %q, which is not registered", e.name, d)
+			}
+		}
+	}
+	placed := make(map[string]bool, len(entries))
+	out := make([]*entry, 0, len(entries))
+	for len(out) < len(entries) {
+		progress := false
+		for _, e := range entries {
+			if placed[e.name] || !allPlaced(e.deps, placed) {
+				continue
+			}
+			placed[e.name] = true
+			out = append(out, e)
+			progress = true
+		}
+		if !progress {
+			var stuck []string
+			for _, e := range entries {
+				if !placed[e.name] {
+					stuck = append(stuck, e.name)
+				}
+			}
+			return nil, fmt.Errorf("dependency cycle among %s", strings.Join(stuck, ", "))
+		}
+	}
+	return out, nil
+}
+
+func allPlaced(names []string, placed map[string]bool) bool {
+	for _, n := range names {
+		if !placed[n] {
+			return false
+		}
+	}
+	return true
+}
+
+// run starts e once its dependencies have, and reports a critical
+// failure to fail.
+func (a *Agent) run(ctx context.Context, e *entry, fail func(error)) {
+	defer close(e.done)
+	for _, name := range e.deps {
+		dep := a.entry(name)
+		select {
+		case <-dep.done:
+		case <-ctx.Done():
+			e.set(ServiceStopped, nil)
+			return
+		}
+		if down, _ := dep.failed(); down {
+			err := fmt.Errorf("dependency %s is down", name)
+			e.set(ServiceSkipped, err)
+			slog.Error("agent: service skipped", "service", e.name, "err", err)
+			if e.critical {
+				fail(fmt.Errorf("critical service %s: %w", e.name, err))
+			}
+			return
+		}
+	}
+
+	a.launch(ctx, e, fail)
+}
+
+// launch calls Start with a context of the service's own, a child of
+// parent, and records how it went unless a restart took over meanwhile.
+// A critical failure goes to fail. It returns Start's error.
+func (a *Agent) launch(parent context.Context, e *entry, fail func(error)) error {
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+	e.mu.Lock()
+	e.gen++
+	gen := e.gen
+	exited := make(chan struct{})
+	e.cancel, e.exited = cancel, exited
+	e.state, e.err, e.started, e.took = ServiceStarting, nil, time.Now(), 0
+	e.mu.Unlock()
+
+	err := startService(ctx, e)
+	close(exited)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.gen != gen {
+		return err
+	}
+	e.took = time.Since(e.started)
+	switch {
+	case err != nil && ctx.Err() != nil:
+		e.state, e.err = ServiceStopped, err
+		slog.Warn("agent: service stopped with an error", "service", e.name, "err", err)
+	case err != nil:
+		e.state, e.err = ServiceFailed, err
+		slog.Error("agent: service failed to start", "service", e.name, "err", err)
+		if e.critical {
+			fail(fmt.Errorf("critical service %s: %w", e.name, err))
+		}
+	case ctx.Err() != nil:
+		e.state = ServiceStopped
+	default:
+		e.state = ServiceRunning
+	}
+	return err
+}
+
+// Restart stops the named service and starts it again, and returns its
+// state once Start has returned or run for startWait. A Start that fails
+// is returned as an error along with the state.
+func (a *Agent) Restart(name string) (ServiceState, error) {
+	e := a.entry(name)
+	if e == nil {
+		return ServiceState{}, fmt.Errorf("%w: %s", ErrUnknownService, name)
+	}
+	a.mu.Lock()
+	parent, stopping := a.ctx, a.stopping
+	a.mu.Unlock()
+	if parent == nil || stopping {
+		return ServiceState{}, ErrShuttingDown
+	}
+
+	e.mu.Lock()
+	switch {
+	case e.critical:
+		e.mu.Unlock()
+		return ServiceState{}, fmt.Errorf("%s %w: it is critical; restart the agent", name, ErrNotRestartable)
+	case e.state == ServiceWaiting || e.state == ServiceSkipped:
+		e.mu.Unlock()
+		return ServiceState{}, fmt.Errorf("%s %w: it has not started", name, ErrNotRestartable)
+	case e.restarting:
+		e.mu.Unlock()
+		return ServiceState{}, fmt.Errorf("%s %w: a restart is in progress", name, ErrNotRestartable)
+	}
+	e.restarting = true
+	e.gen++ // the running Start's outcome no longer counts
+	cancel, exited := e.cancel, e.exited
+	e.state = ServiceStopped
+	e.mu.Unlock()
+	defer func() {
+		e.mu.Lock()
+		e.restarting = false
+		e.mu.Unlock()
+	}()
+
+	slog.Info("agent: restarting service", "service", name)
+	if err := stopService(e, cancel, exited); err != nil {
+		e.set(ServiceFailed, err)
+		slog.Error("agent: service did not stop", "service", name, "err", err)
+		return e.snapshot(), err
+	}
+
+	a.mu.Lock()
+	if a.stopping {
+		a.mu.Unlock()
+		return e.snapshot(), ErrShuttingDown
+	}
+	a.wg.Add(1)
+	a.mu.Unlock()
+	e.mu.Lock()
+	e.restarts++
+	e.restartedAt = time.Now()
+	e.mu.Unlock()
+
+	result := make(chan error, 1)
+	go func() {
+		defer a.wg.Done()
+		result <- a.launch(parent, e, nil)
+	}()
+	select {
+	case err := <-result:
+		return e.snapshot(), err
+	case <-time.After(startWait):
+		return e.snapshot(), nil
+	}
+}
+
+// stopService cancels a service's context and waits, up to stopWait, for
+// its Start to return and its Stop.
+func stopService(e *entry, cancel context.CancelFunc, exited <-chan struct{}) error {
+	ctx, done := context.WithTimeout(context.Background(), stopWait)
+	defer done()
+	if cancel != nil {
+		cancel()
+	}
+	if exited != nil {
+		select {
+		case <-exited:
+		case <-ctx.Done():
+			return fmt.Errorf("start did not return within %s", stopWait)
+		}
+	}
+	if s, ok := e.svc.(Stopper); ok {
+		if err := s.Stop(ctx); err != nil {
+			return fmt.Errorf("stop: %w", err)
+		}
+	}
+	return nil
+}
+
+// stopAll gives the Stoppers stopWait, all together, to finish once the
+// agent's context is done, last started first.
+func (a *Agent) stopAll() {
+	a.mu.Lock()
+	ordered := slices.Clone(a.ordered)
+	a.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), stopWait)
+	defer cancel()
+	for _, e := range slices.Backward(ordered) {
+		if s, ok := e.svc.(Stopper); ok {
+			if err := s.Stop(ctx); err != nil {
+				slog.Warn("agent: service did not stop cleanly", "service", e.name, "err", err)
+			}
+		}
+	}
+}
+
+// startService calls Start, turning a panic into an error.
+func startService(ctx context.Context, e *entry) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			slog.Error("agent: service panicked", "service", e.name, "panic", p, "stack", string(debug.Stack()))
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+	return e.svc.Start(ctx)
+}
+
+func (a *Agent) entry(name string) *entry {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, e := range a.entries {
+		if e.name == name {
+			return e
+		}
+	}
+	return nil
+}
+
+// Services reports the start order and each service's state.
+func (a *Agent) Services() Services {
+	a.mu.Lock()
+	entries := slices.Clone(a.entries)
+	ordered := slices.Clone(a.ordered)
+	a.mu.Unlock()
+	out := Services{Order: []string{}, Services: make([]ServiceState, 0, len(entries))}
+	for _, e := range ordered {
+		out.Order = append(out.Order, e.name)
+	}
+	for _, e := range entries {
+		out.Services = append(out.Services, e.snapshot())
+	}
+	return out
+}
+
+// ServicesHandler serves Services. GET /api/agent/services
+func (a *Agent) ServicesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.Services())
+}
+
+// RestartHandler restarts one service and answers with its state.
+// POST /api/agent/services/{name}/restart
+func (a *Agent) RestartHandler(w http.ResponseWriter, r *http.Request) {
+	st, err := a.Restart(r.PathValue("name"))
+	switch {
+	case errors.Is(err, ErrUnknownService):
+		httputil.Error(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, ErrNotRestartable):
+		httputil.Error(w, http.StatusConflict, err.Error())
+	case errors.Is(err, ErrShuttingDown):
+		httputil.Error(w, http.StatusServiceUnavailable, err.Error())
+	case err != nil:
+		httputil.Error(w, http.StatusInternalServerError, st.Name+": "+err.Error())
+	default:
+		httputil.OK(w, st)
+	}
+}
@@ -0,0 +1,385 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/config"
+	"github.com/strct-org/strct-agent/internal/maintenance"
+)
+
+// svc is a named service that records when Start ran, and returns err or
+// panics with panicWith.
+type svc struct {
+	name      string
+	deps      []string
+	err       error
+	panicWith string
+	block     bool // serve until ctx is done, like the API
+
+	log *startLog
+}
+
+type startLog struct {
+	mu    sync.Mutex
+	names []string
+}
+
+func (s *svc) Name() string        { return s.name }
+func (s *svc) DependsOn() []string { return s.deps }
+
+func (s *svc) Start(ctx context.Context) error {
+	if s.log != nil {
+		s.log.mu.Lock()
+		s.log.names = append(s.log.names, s.name)
+		s.log.mu.Unlock()
+	}
+	if s.panicWith != "" {
+		panic(s.panicWith)
+	}
+	if s.block {
+		<-ctx.Done()
+	}
+	return s.err
+}
+
+func newAgent(critical ...string) *Agent {
+	return &Agent{cfg: &config.Config{CriticalServices: critical}, started: time.Now(), hasInternet: func() bool { return true }}
+}
+
+// startFor runs Start until it returns or d passes, and returns its error.
+func startFor(t *testing.T, a *Agent, d time.Duration) error {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	return a.Start(ctx)
+}
+
+func TestStart_DependencyOrder(t *testing.T) {
+	log := &startLog{}
+	a := newAgent()
+	a.Register(
+		&svc{name: "vpn", deps: []string{"wifi"}, log: log},
+		&svc{name: "adblock", deps: []string{"wifi"}, log: log},
+		&svc{name: "wifi", log: log},
+		plain{},
+	)
+	if err := startFor(t, a, 100*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(a.Services().Order, ","); got != "wifi,agent.plain,vpn,adblock" {
+		t.Errorf("order = %s", got)
+	}
+	if log.names[0] != "wifi" {
+		t.Errorf("started %v, wifi not first", log.names)
+	}
+	for _, st := range a.Services().Services {
+		if st.State != ServiceStopped && st.State != ServiceRunning {
+			t.Errorf("%s: %s", st.Name, st.State)
+		}
+	}
+}
+
+func TestStart_BadWiring(t *testing.T) {
+	for name, services := range map[string][]Service{
+		"unknown": {&svc{name: "vpn", deps: []string{"wifi"}}},
+		"cycle":   {&svc{name: "a", deps: []string{"b"}}, &svc{name: "b", deps: []string{"a"}}},
+		"twice":   {&svc{name: "a"}, &svc{name: "a"}},
+	} {
+		log := &startLog{}
+		for _, s := range services {
+			s.(*svc).log = log
+		}
+		a := newAgent()
+		a.Register(services...)
+		if err := startFor(t, a, time.Second); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+		if len(log.names) != 0 {
+			t.Errorf("%s: started %v", name, log.names)
+		}
+	}
+}
+
+func TestStart_FailedDependencySkipsDependents(t *testing.T) {
+	log := &startLog{}
+	a := newAgent("api")
+	a.Register(
+		&svc{name: "wifi", err: errors.New("no radio"), log: log},
+		&svc{name: "vpn", deps: []string{"wifi"}, log: log},
+		&svc{name: "api", block: true, log: log},
+	)
+	if err := startFor(t, a, 100*time.Millisecond); err != nil {
+		t.Fatalf("a non-critical failure stopped the agent: %v", err)
+	}
+	states := map[string]ServiceState{}
+	for _, st := range a.Services().Services {
+		states[st.Name] = st
+	}
+	if st := states["wifi"]; st.State != ServiceFailed || st.Error != "no radio" {
+		t.Errorf("wifi: %+v", st)
+	}
+	if st := states["vpn"]; st.State != ServiceSkipped || st.Error != "dependency wifi is down" {
+		t.Errorf("vpn: %+v", st)
+	}
+	if !states["api"].Critical {
+		t.Error("api not critical")
+	}
+	for _, n := range log.names {
+		if n == "vpn" {
+			t.Error("vpn started")
+		}
+	}
+
+	// Both are down on /api/health, but neither is critical.
+	h := a.Health(maintenance.New(""))
+	if h.Status != HealthDegraded || len(h.Components) != 2 {
+		t.Errorf("health: %+v", h)
+	}
+}
+
+func TestStart_CriticalFailureStopsAgent(t *testing.T) {
+	a := newAgent("api")
+	other := &svc{name: "cloud", block: true}
+	a.Register(other, &svc{name: "api", err: errors.New("address in use")})
+
+	done := make(chan error, 1)
+	go func() { done <- a.Start(context.Background()) }()
+	select {
+	case err := <-done:
+		if err == nil || err.Error() != "critical service api: address in use" {
+			t.Errorf("Start = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start did not return")
+	}
+	if st := a.Services().Services[0]; st.State != ServiceStopped {
+		t.Errorf("cloud: %+v", st)
+	}
+	h := a.Health(maintenance.New(""))
+	if h.Status != HealthDown {
+		t.Errorf("health: %s", h.Status)
+	}
+}
+
+func TestStart_PanicIsAFailure(t *testing.T) {
+	a := newAgent()
+	a.Register(&svc{name: "router", panicWith: "nil map"})
+	if err := startFor(t, a, 100*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if st := a.Services().Services[0]; st.State != ServiceFailed || st.Error != "panic: nil map" {
+		t.Errorf("router: %+v", st)
+	}
+}
+
+func TestServicesHandler(t *testing.T) {
+	a := newAgent("api")
+	a.Register(&svc{name: "wifi"}, &svc{name: "vpn", deps: []string{"wifi"}}, &svc{name: "api"})
+	if err := startFor(t, a, 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	a.ServicesHandler(w, httptest.NewRequest("GET", "/api/agent/services", nil))
+	var got Services
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decode %s: %v", w.Body, err)
+	}
+	if strings.Join(got.Order, ",") != "wifi,vpn,api" || len(got.Services) != 3 {
+		t.Fatalf("services: %s", w.Body)
+	}
+	vpn := got.Services[1]
+	if vpn.Name != "vpn" || len(vpn.DependsOn) != 1 || vpn.StartedAt == nil || vpn.Critical {
+		t.Errorf("vpn: %+v", vpn)
+	}
+	if !got.Services[2].Critical {
+		t.Errorf("api: %+v", got.Services[2])
+	}
+}
+
+// looper works in the background after Start returns, like most
+// features, and reports how often it was started and stopped.
+type looper struct {
+	name    string
+	failing int // Start calls to fail first
+
+	mu      sync.Mutex
+	starts  int
+	stops   int
+	running int // background loops not yet ended
+}
+
+func (l *looper) Name() string { return l.name }
+
+func (l *looper) Start(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.starts++
+	if l.starts <= l.failing {
+		return errors.New("wedged")
+	}
+	l.running++
+	go func() {
+		<-ctx.Done()
+		time.Sleep(10 * time.Millisecond) // cleanup
+		l.mu.Lock()
+		l.running--
+		l.mu.Unlock()
+	}()
+	return nil
+}
+
+// Stop waits for the loop to end, as a Stopper must.
+func (l *looper) Stop(ctx context.Context) error {
+	for {
+		l.mu.Lock()
+		running := l.running
+		if running == 0 {
+			l.stops++
+		}
+		l.mu.Unlock()
+		if running == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+func (l *looper) counts() (starts, stops, running int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.starts, l.stops, l.running
+}
+
+// startAgent runs Start in the background until the test ends, and
+// waits for every service to have left waiting.
+func startAgent(t *testing.T, a *Agent) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		a.Start(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		ready := len(a.Services().Order) > 0
+		for _, st := range a.Services().Services {
+			ready = ready && st.State != ServiceWaiting
+		}
+		if ready {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("services did not start")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRestart_StopsAndStartsAgain(t *testing.T) {
+	tunnel := &looper{name: "tunnel"}
+	server := &svc{name: "server", block: true}
+	a := newAgent()
+	a.Register(tunnel, server)
+	startAgent(t, a)
+
+	st, err := a.Restart("tunnel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.State != ServiceRunning || st.Restarts != 1 || st.RestartedAt == nil {
+		t.Errorf("after restart: %+v", st)
+	}
+	// The old loop ended before the new Start: one running, not two.
+	if starts, stops, running := tunnel.counts(); starts != 2 || stops != 1 || running != 1 {
+		t.Errorf("starts %d, stops %d, running %d", starts, stops, running)
+	}
+
+	// A server's Start returning is its exit; it serves again after.
+	if _, err := a.Restart("server"); err != nil {
+		t.Fatal(err)
+	}
+	if st := a.Services().Services[1]; st.State != ServiceRunning || st.Restarts != 1 {
+		t.Errorf("server: %+v", st)
+	}
+
+	h := a.Health(maintenance.New(""))
+	if len(h.Restarts) != 2 || h.Restarts[0].Service != "tunnel" || h.Restarts[0].Count != 1 {
+		t.Errorf("health restarts: %+v", h.Restarts)
+	}
+}
+
+func TestRestart_RecoversAFailedService(t *testing.T) {
+	adblock := &looper{name: "adblock", failing: 1}
+	a := newAgent()
+	a.Register(adblock)
+	startAgent(t, a)
+	if st := a.Services().Services[0]; st.State != ServiceFailed {
+		t.Fatalf("first start: %+v", st)
+	}
+	st, err := a.Restart("adblock")
+	if err != nil || st.State != ServiceRunning || st.Error != "" {
+		t.Errorf("restart: %+v, %v", st, err)
+	}
+	if h := a.Health(maintenance.New("")); h.Status != HealthOK {
+		t.Errorf("health after recovery: %s", h.Status)
+	}
+}
+
+func TestRestartHandler(t *testing.T) {
+	a := newAgent("api")
+	a.Register(&svc{name: "api", block: true}, &looper{name: "tunnel", failing: 2})
+	startAgent(t, a)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/agent/services/{name}/restart", a.RestartHandler)
+	for name, want := range map[string]int{
+		"tunnel": http.StatusInternalServerError, // fails again
+		"api":    http.StatusConflict,            // critical
+		"nope":   http.StatusNotFound,
+	} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("POST", "/api/agent/services/"+name+"/restart", nil))
+		if w.Code != want {
+			t.Errorf("%s: %d %s", name, w.Code, w.Body)
+		}
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("POST", "/api/agent/services/tunnel/restart", nil))
+	var st ServiceState
+	json.Unmarshal(w.Body.Bytes(), &st)
+	if w.Code != http.StatusOK || st.Name != "tunnel" || st.Restarts != 2 {
+		t.Errorf("third start: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestStart_ShutdownWaitsForStoppers(t *testing.T) {
+	l := &looper{name: "adblock"}
+	a := newAgent()
+	a.Register(l)
+	if err := startFor(t, a, 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if _, stops, running := l.counts(); stops != 1 || running != 0 {
+		t.Errorf("Start returned with %d loops running, %d stops", running, stops)
+	}
+	if _, err := a.Restart("adblock"); !errors.Is(err, ErrShuttingDown) {
+		t.Errorf("restart after shutdown: %v", err)
+	}
+}
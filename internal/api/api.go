@@ -6,63 +6,226 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/strct-org/strct-agent/internal/errs"
+	"github.com/strct-org/strct-agent/internal/events"
+	"github.com/strct-org/strct-agent/internal/httputil"
 )
 
 const opStart errs.Op = "api.Server.Start"
 
+// tunnelAddr is where the tunnel listener binds: loopback, where frpc
+// runs, on any free port.
+const tunnelAddr = "127.0.0.1:0"
+
+// shutdownTimeout is how long Start waits for requests in flight once its
+// context is done.
+const shutdownTimeout = 5 * time.Second
+
 type Config struct {
 	DataDir string
 	Port    int
 	IsDev   bool
+	// Middleware, if set, wraps the feature routes. It sees the path
+	// after the /api/v1/ prefix is resolved.
+	Middleware func(http.Handler) http.Handler
+	// Socket, if set, is a unix socket the same handler is served on, for
+	// the strct CLI. It is created 0660 and given to SocketGroup if that
+	// group exists, root-only otherwise.
+	Socket      string
+	SocketGroup string
+	// Gateway, if set, also serves the API on the standard ports of the
+	// AP gateway. See Gateway.
+	Gateway *Gateway
+	// OnPort, if set, opens the tunnel listener, a second one on loopback
+	// for frpc to proxy to, and is called with its port. Requests on it
+	// are marked for httputil.FromTunnel: on the API's own port, frpc's
+	// would pass for the device's. It returns before Ports reports the
+	// API listening.
+	OnPort func(port int)
+	// Auth, if set, requires the device API token on /api and
+	// /strct_agent routes. See Auth.
+	Auth *Auth
+	// RateLimit, if set, refuses a client's requests over its route's
+	// limit. See RateLimiter.
+	RateLimit *RateLimiter
+	// Events, if set, is streamed on GET /api/events. See events.go.
+	Events *events.Bus
 }
 
 type Server struct {
 	cfg Config
 	mux *http.ServeMux
+	ls  listeners
+
+	stopping chan struct{} // closed on shutdown, ending event streams
+	stopOnce sync.Once
 }
 
 func New(cfg Config, mux *http.ServeMux) *Server {
-	return &Server{cfg: cfg, mux: mux}
+	s := &Server{cfg: cfg, mux: mux, stopping: make(chan struct{})}
+	s.ls.api = PortStatus{Name: "api", Port: cfg.Port, State: PortOff}
+	s.ls.socket = PortStatus{Name: "socket", Addr: cfg.Socket, State: PortOff}
+	s.ls.tunnel = PortStatus{Name: "tunnel", State: PortOff}
+	return s
 }
 
+// effectivePort is the port the API binds for a configured port: dev mode
+// moves privileged ones to 8080, so the agent runs without root. 0 stays
+// 0, any free port.
+func effectivePort(port int, isDev bool) int {
+	if isDev && port > 0 && port <= 1024 {
+		return 8080
+	}
+	return port
+}
+
+// Name is the API's name in the agent's start order; see
+// config.DefaultCriticalServices.
+func (s *Server) Name() string { return "api" }
+
+// Start serves the API until ctx is done. It returns once requests in
+// flight have finished, or after shutdownTimeout.
 func (s *Server) Start(ctx context.Context) error {
-	port := s.cfg.Port
-	if s.cfg.IsDev && port <= 1024 {
-		slog.Info("api: Dev mode: redirecting API port", "from", port, "to", 8080)
-		port = 8080
+	port := effectivePort(s.cfg.Port, s.cfg.IsDev)
+	if port != s.cfg.Port {
+		slog.Info("api: Dev mode: redirecting API port", "from", s.cfg.Port, "to", port)
 	}
 
+	addr := fmt.Sprintf(":%d", port)
 	srv := &http.Server{
-		Addr:    fmt.Sprintf(":%d", port),
-		Handler: corsMiddleware(s.mux),
+		Addr:    addr,
+		Handler: s.Handler(),
+	}
+	var tunnel *http.Server
+	if s.cfg.OnPort != nil {
+		tunnel = &http.Server{
+			Handler: s.Handler(),
+			ConnContext: func(ctx context.Context, _ net.Conn) context.Context {
+				return httputil.WithTunnel(ctx)
+			},
+		}
 	}
 
+	shutDown := make(chan struct{})
 	go func() {
+		defer close(shutDown)
 		<-ctx.Done()
 		slog.Info("api: shutting down")
-		shutCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		s.stopOnce.Do(func() { close(s.stopping) })
+		shutCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
 		defer cancel()
+		if tunnel != nil {
+			tunnel.Shutdown(shutCtx)
+		}
 		srv.Shutdown(shutCtx)
 	}()
 
+	if s.cfg.Socket != "" {
+		go s.serveSocket(ctx)
+	}
+	if s.cfg.Gateway != nil {
+		go s.cfg.Gateway.Run(ctx, s.Handler())
+	}
+
 	slog.Info("api: starting server", "port", port, "isDev", s.cfg.IsDev)
-	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		s.setPort(&s.ls.api, failed("api", port, addr, err))
 		return errs.E(opStart, errs.KindNetwork, err, fmt.Sprintf("server failed on port %d", port))
 	}
+	port = ln.Addr().(*net.TCPAddr).Port
+	// OnPort first: whoever sees the API listening can rely on it having
+	// been told the port.
+	if tunnel != nil {
+		s.serveTunnel(tunnel)
+	}
+	s.setPort(&s.ls.api, PortStatus{Name: "api", Port: port, Addr: addr, State: PortListening})
+	s.ls.mu.Lock()
+	s.ls.addr = ln.Addr()
+	s.ls.mu.Unlock()
+	if err := srv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+		s.setPort(&s.ls.api, PortStatus{Name: "api", Port: port, Addr: addr, State: PortError, Error: err.Error()})
+		return errs.E(opStart, errs.KindNetwork, err, fmt.Sprintf("server failed on port %d", port))
+	}
+	<-shutDown
+	s.setPort(&s.ls.api, PortStatus{Name: "api", Port: port, State: PortOff})
+	if tunnel != nil {
+		s.setPort(&s.ls.tunnel, PortStatus{Name: "tunnel", State: PortOff})
+	}
 	return nil
 }
 
+// serveTunnel opens the tunnel listener and tells OnPort its port. If it
+// can't, OnPort is never called and frpc has nothing to proxy to, which
+// only costs the tunnel.
+func (s *Server) serveTunnel(srv *http.Server) {
+	ln, err := net.Listen("tcp", tunnelAddr)
+	if err != nil {
+		slog.Error("api: tunnel listener unavailable, the tunnel will not work", "err", err)
+		s.setPort(&s.ls.tunnel, failed("tunnel", 0, tunnelAddr, err))
+		return
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	s.cfg.OnPort(port)
+	addr := ln.Addr().String()
+	s.setPort(&s.ls.tunnel, PortStatus{Name: "tunnel", Port: port, Addr: addr, State: PortListening})
+	go func() {
+		if err := srv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("api: tunnel listener stopped", "addr", addr, "err", err)
+			s.setPort(&s.ls.tunnel, PortStatus{Name: "tunnel", Port: port, Addr: addr, State: PortError, Error: err.Error()})
+		}
+	}()
+}
+
+// Handler is the full request path: CORS, then the /api/v1/ prefix, then
+// Config.Auth, then Config.Middleware, then Config.RateLimit, then the
+// feature routes.
+func (s *Server) Handler() http.Handler {
+	h := s.cfg.RateLimit.middleware(s.mux, s.mux)
+	if s.cfg.Middleware != nil {
+		h = s.cfg.Middleware(h)
+	}
+	return corsMiddleware(httputil.Versioned(s.cfg.Auth.Middleware(h)))
+}
+
+// sharePrefix is the cloud's share-link download route. Those links are
+// opened by whoever they were sent to, from any site, and carry no
+// credentials, so they are readable cross-origin.
+const sharePrefix = "/share/"
+
+// davPrefix is the cloud's WebDAV mount. Its clients are file managers,
+// not browsers, and OPTIONS there is WebDAV's own discovery request, so
+// it bypasses CORS entirely.
+const davPrefix = "/dav"
+
 func corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == davPrefix || strings.HasPrefix(r.URL.Path, davPrefix+"/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, sharePrefix) {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			w.Header().Set("Access-Control-Expose-Headers", "Content-Length, Content-Range, Accept-Ranges, Content-Disposition")
+			if r.Method == http.MethodOptions {
+				w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
+				w.Header().Set("Access-Control-Allow-Headers", "Range")
+				w.Header().Set("Access-Control-Max-Age", "3600")
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
 		origin := r.Header.Get("Origin")
-		if strings.HasPrefix(origin, "http://localhost") ||
-			strings.HasSuffix(origin, ".strct.org") ||
-			origin == "https://strct.org" {
+		if allowedOrigin(origin) {
 			w.Header().Set("Access-Control-Allow-Origin", origin)
 			w.Header().Set("Access-Control-Allow-Credentials", "true")
 		}
@@ -76,3 +239,22 @@ func corsMiddleware(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// allowedOrigin reports whether a page from origin may call the API with
+// credentials: the dashboard on strct.org, or one in development on
+// localhost, on any port.
+func allowedOrigin(origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || u.Path != "" {
+		return false
+	}
+	switch host := u.Hostname(); {
+	case host == "localhost":
+		return u.Scheme == "http"
+	case host == "strct.org":
+		return u.Scheme == "https"
+	case strings.HasSuffix(host, ".strct.org"):
+		return u.Scheme == "http" || u.Scheme == "https"
+	}
+	return false
+}
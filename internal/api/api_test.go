@@ -1,150 +1,248 @@
-// // Tests for the API server layer: CORS middleware, port selection, shutdown.
-// // We test the middleware in isolation — not the features it serves.
 package api_test
 
-// import (
-// 	"context"
-// 	"fmt"
-// 	"net/http"
-// 	"net/http/httptest"
-// 	"testing"
-// 	"time"
-
-// 	"github.com/strct-org/strct-agent/internal/api"
-// )
-
-// // ---------------------------------------------------------------------------
-// // CORS middleware
-// // ---------------------------------------------------------------------------
-
-// // newTestServer builds an api.Server wired to a simple echo handler.
-// // We use httptest.NewServer to bind a real (random) port so we can test
-// // the full server lifecycle without hardcoding ports.
-// func newTestMux() *http.ServeMux {
-// 	mux := http.NewServeMux()
-// 	mux.HandleFunc("GET /ping", func(w http.ResponseWriter, r *http.Request) {
-// 		w.WriteHeader(http.StatusOK)
-// 		w.Write([]byte("pong"))
-// 	})
-// 	return mux
-// }
-
-// func TestCORSMiddleware_AllowedOrigins(t *testing.T) {
-// 	tests := []struct {
-// 		origin      string
-// 		wantAllowed bool
-// 	}{
-// 		{"http://localhost:3000", true},
-// 		{"http://localhost:5173", true},
-// 		{"https://app.strct.org", true},
-// 		{"https://strct.org", true},
-// 		{"https://evil.com", false},
-// 		{"", false},
-// 	}
-
-// 	// We test CORS by calling the server's handler directly via httptest.
-// 	// api.New is not started — we just use it to get the wrapped handler.
-// 	srv := api.New(api.Config{Port: 8080, IsDev: false}, newTestMux())
-// 	handler := srv.Handler() // see note: add Handler() method to api.Server
-
-// 	for _, tt := range tests {
-// 		t.Run(tt.origin, func(t *testing.T) {
-// 			req := httptest.NewRequest(http.MethodGet, "/ping", nil)
-// 			req.Header.Set("Origin", tt.origin)
-// 			w := httptest.NewRecorder()
-// 			handler.ServeHTTP(w, req)
-
-// 			got := w.Header().Get("Access-Control-Allow-Origin")
-// 			if tt.wantAllowed && got != tt.origin {
-// 				t.Errorf("origin %q: expected ACAO=%q, got %q", tt.origin, tt.origin, got)
-// 			}
-// 			if !tt.wantAllowed && got != "" {
-// 				t.Errorf("origin %q: expected no ACAO header, got %q", tt.origin, got)
-// 			}
-// 		})
-// 	}
-// }
-
-// func TestCORSMiddleware_PreflightOptions(t *testing.T) {
-// 	srv := api.New(api.Config{Port: 8080, IsDev: false}, newTestMux())
-// 	handler := srv.Handler()
-
-// 	req := httptest.NewRequest(http.MethodOptions, "/ping", nil)
-// 	req.Header.Set("Origin", "http://localhost:3000")
-// 	req.Header.Set("Access-Control-Request-Method", "POST")
-// 	w := httptest.NewRecorder()
-// 	handler.ServeHTTP(w, req)
-
-// 	if w.Code != http.StatusOK {
-// 		t.Errorf("preflight: expected 200, got %d", w.Code)
-// 	}
-// 	if w.Header().Get("Access-Control-Allow-Methods") == "" {
-// 		t.Error("preflight: missing Access-Control-Allow-Methods header")
-// 	}
-// }
-
-// // ---------------------------------------------------------------------------
-// // Port selection (dev mode redirect)
-// // ---------------------------------------------------------------------------
-
-// // Note: we can't easily test the port selection in Start() without binding
-// // a real port. The correct approach is to extract port selection into a
-// // pure function:
-// //
-// //   func effectivePort(cfg Config) int {
-// //       if cfg.IsDev && cfg.Port <= 1024 { return 8080 }
-// //       return cfg.Port
-// //   }
-// //
-// // Then test that directly without any server lifecycle. This is a common
-// // Go pattern: isolate the decision from the side effect.
-
-// // ---------------------------------------------------------------------------
-// // Graceful shutdown
-// // ---------------------------------------------------------------------------
-
-// func TestServer_GracefulShutdown(t *testing.T) {
-// 	// Use a random available port to avoid conflicts.
-// 	mux := http.NewServeMux()
-// 	mux.HandleFunc("GET /slow", func(w http.ResponseWriter, r *http.Request) {
-// 		// Simulate a handler that takes some time.
-// 		time.Sleep(50 * time.Millisecond)
-// 		w.WriteHeader(http.StatusOK)
-// 	})
-
-// 	srv := api.New(api.Config{Port: 0, IsDev: true}, mux)
-// 	// Port 0 = OS assigns a random free port.
-// 	// api.Server needs to expose the actual bound address for this test to work:
-// 	//   func (s *Server) Addr() string — returns the net.Listener address after Start.
-
-// 	ctx, cancel := context.WithCancel(context.Background())
-
-// 	done := make(chan error, 1)
-// 	go func() {
-// 		done <- srv.Start(ctx)
-// 	}()
-
-// 	// Give the server time to bind.
-// 	time.Sleep(50 * time.Millisecond)
-
-// 	addr := srv.Addr() // ":<port>"
-// 	if addr == "" {
-// 		t.Skip("server did not expose Addr() — add it to api.Server")
-// 	}
-
-// 	// Kick off a request that will be in-flight during shutdown.
-// 	go http.Get(fmt.Sprintf("http://localhost%s/slow", addr))
-// 	time.Sleep(10 * time.Millisecond)
-
-// 	// Signal shutdown.
-// 	cancel()
-
-// 	select {
-// 	case err := <-done:
-// 		if err != nil {
-// 			t.Errorf("Start() returned error after shutdown: %v", err)
-// 		}
-// 	case <-time.After(3 * time.Second):
-// 		t.Error("server did not shut down within 3 seconds")
-// 	}
-// }
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/api"
+	"github.com/strct-org/strct-agent/internal/httputil"
+)
+
+func TestHandler_MiddlewareSeesResolvedPath(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/files", func(w http.ResponseWriter, r *http.Request) {})
+	var seen []string
+	h := api.New(api.Config{
+		Port: 8080,
+		Middleware: func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				seen = append(seen, r.URL.Path)
+				next.ServeHTTP(w, r)
+			})
+		},
+	}, mux).Handler()
+
+	for _, target := range []string{"/api/files", "/api/v1/files"} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: %d", target, w.Code)
+		}
+	}
+	if len(seen) != 2 || seen[0] != "/api/files" || seen[1] != "/api/files" {
+		t.Errorf("middleware saw %v", seen)
+	}
+}
+
+func TestHandler_WebDAVOptionsReachTheRoute(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/dav/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("DAV", "1, 2")
+	})
+	mux.HandleFunc("/api/files", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("DAV", "1, 2")
+	})
+	h := api.New(api.Config{Port: 8080}, mux).Handler()
+
+	for target, wantDAV := range map[string]bool{"/dav/docs": true, "/api/files": false} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("OPTIONS", target, nil))
+		if got := w.Header().Get("DAV") != ""; got != wantDAV {
+			t.Errorf("OPTIONS %s reached the route: %v, want %v", target, got, wantDAV)
+		}
+	}
+}
+
+func TestStart_ServesTheAdminSocket(t *testing.T) {
+	dir, err := os.MkdirTemp("", "strct") // t.TempDir can exceed the socket path limit
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "run", "agent.sock")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get(httputil.VersionHeader)))
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		api.New(api.Config{Port: 0, Socket: sock, SocketGroup: "no-such-group"}, mux).Start(ctx)
+		close(done)
+	}()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", sock)
+		},
+	}}
+	var resp *http.Response
+	for i := 0; i < 50; i++ {
+		if resp, err = client.Get("http://strct/api/v1/status"); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "1" {
+		t.Errorf("over the socket: %d %q", resp.StatusCode, body)
+	}
+	if fi, err := os.Stat(sock); err != nil || fi.Mode().Perm() != 0660 {
+		t.Errorf("socket mode = %v, %v", fi.Mode(), err)
+	}
+
+	cancel()
+	<-done
+	// The socket is removed once its server has shut down.
+	for i := 0; i < 50; i++ {
+		if _, err = os.Stat(sock); os.IsNotExist(err) {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Errorf("socket left behind: %v", err)
+}
+
+func TestEffectivePort(t *testing.T) {
+	for _, tc := range []struct {
+		port  int
+		isDev bool
+		want  int
+	}{
+		{80, false, 80},
+		{80, true, 8080},
+		{1024, true, 8080},
+		{1025, true, 1025},
+		{0, true, 0},
+		{0, false, 0},
+		{8080, true, 8080},
+	} {
+		if got := api.EffectivePort(tc.port, tc.isDev); got != tc.want {
+			t.Errorf("EffectivePort(%d, %v) = %d, want %d", tc.port, tc.isDev, got, tc.want)
+		}
+	}
+}
+
+// startServer starts s on a free port and returns its base URL and a
+// channel that gets Start's result.
+func startServer(t *testing.T, ctx context.Context, s *api.Server) (string, <-chan error) {
+	t.Helper()
+	if s.Addr() != nil {
+		t.Fatalf("Addr before Start: %v", s.Addr())
+	}
+	done := make(chan error, 1)
+	go func() { done <- s.Start(ctx) }()
+	for i := 0; i < 100; i++ {
+		if addr := s.Addr(); addr != nil {
+			port := addr.(*net.TCPAddr).Port
+			if port == 0 || port != s.Port() {
+				t.Fatalf("Addr %v, Port %d", addr, s.Port())
+			}
+			return fmt.Sprintf("http://127.0.0.1:%d", port), done
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("server did not start")
+	return "", nil
+}
+
+func TestStart_PortZeroBindsAFreePort(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("up"))
+	})
+	var onPort int
+	s := api.New(api.Config{Port: 0, OnPort: func(p int) { onPort = p }}, mux)
+	ctx, cancel := context.WithCancel(context.Background())
+	base, done := startServer(t, ctx, s)
+
+	resp, err := http.Get(base + "/api/v1/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "up" {
+		t.Errorf("GET: %d %q", resp.StatusCode, body)
+	}
+	if onPort == 0 || onPort != s.TunnelPort() || onPort == s.Port() {
+		t.Errorf("OnPort got %d, TunnelPort is %d, Port is %d", onPort, s.TunnelPort(), s.Port())
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Start: %v", err)
+	}
+	if s.Addr() != nil || s.Port() != 0 || s.TunnelPort() != 0 {
+		t.Errorf("after shutdown: Addr %v, Port %d, TunnelPort %d", s.Addr(), s.Port(), s.TunnelPort())
+	}
+}
+
+func TestStart_ShutdownWaitsForRequestsInFlight(t *testing.T) {
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(entered)
+		<-release
+		w.Write([]byte("finished"))
+	})
+	s := api.New(api.Config{Port: 0}, mux)
+	ctx, cancel := context.WithCancel(context.Background())
+	base, done := startServer(t, ctx, s)
+
+	type result struct {
+		body string
+		err  error
+	}
+	got := make(chan result, 1)
+	go func() {
+		resp, err := http.Get(base + "/api/slow")
+		if err != nil {
+			got <- result{err: err}
+			return
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		got <- result{string(body), err}
+	}()
+	<-entered
+
+	cancel()
+	// No new connections, but Start waits for the one in flight.
+	for i := 0; i < 100; i++ {
+		c, err := net.Dial("tcp", strings.TrimPrefix(base, "http://"))
+		if err != nil {
+			break
+		}
+		c.Close()
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("Start returned with a request in flight: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	if r := <-got; r.err != nil || r.body != "finished" {
+		t.Errorf("request in flight: %q, %v", r.body, r.err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Start: %v", err)
+	}
+}
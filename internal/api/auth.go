@@ -0,0 +1,275 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/errs"
+	"github.com/strct-org/strct-agent/internal/httputil"
+	"github.com/strct-org/strct-agent/internal/statefile"
+)
+
+// ─── Device API token ────────────────────────────────────────────────────────
+
+// Every /api, /strct_agent, /files/ and /metrics request carries the
+// device's API token:
+//
+//	Authorization: Bearer <token>
+//
+// GET and HEAD may pass it as ?access_token= instead, for the links a
+// browser opens itself: downloads, thumbnails, streams. The token is made
+// on first start and kept, 0600, next to the device ID. A LAN client gets
+// it once; until one has, it is printed on the console at every start:
+//
+//	POST /api/auth/pair     the token, to the first LAN client that asks
+//	POST /api/auth/rotate   a new token; the old one stops working
+//
+// Left open: GET /api/health, pairing, and the admin socket, whose file
+// permissions already decide who gets in. The captive portal is a server
+// of its own, and share and upload links carry their own tokens.
+//
+// /files/ serves DataDir as it is, so it needs the token too; a browser
+// passes it as ?access_token=. So does /metrics, which would otherwise
+// tell the internet, through the tunnel, what the device runs.
+const (
+	opAuth     errs.Op = "api.Auth"
+	tokenBytes         = 32
+
+	tokenQuery = "access_token"
+)
+
+// openRoutes need no token.
+var openRoutes = map[string]bool{
+	"/api/health":      true,
+	"/api/health/live": true,
+	"/api/auth/pair":   true,
+}
+
+var tokenSchema = statefile.Schema{
+	Name:       "api-token",
+	Migrations: []statefile.Migration{statefile.Stamp},
+}
+
+// tokenState is api-token.json.
+type tokenState struct {
+	Token     string     `json:"token"`
+	CreatedAt time.Time  `json:"created_at"`
+	PairedAt  *time.Time `json:"paired_at,omitempty"` // nil until a client paired
+}
+
+// AuthConfig configures NewAuth.
+type AuthConfig struct {
+	// Path is the token file. Empty keeps the token in memory only.
+	Path string
+	// Console is where an unpaired token is printed; os.Stderr if nil.
+	// Not the log: /api/system/logs would hand it out.
+	Console io.Writer
+}
+
+// Auth checks the device API token. A nil Auth lets everything through.
+type Auth struct {
+	cfg AuthConfig
+	mu  sync.Mutex
+	st  tokenState
+}
+
+// NewAuth loads the token from cfg.Path, generating it on first start. A
+// token that cannot be saved still guards the API, until the next start.
+func NewAuth(cfg AuthConfig) (*Auth, error) {
+	if cfg.Console == nil {
+		cfg.Console = os.Stderr
+	}
+	a := &Auth{cfg: cfg}
+	if cfg.Path != "" {
+		err := statefile.Load(cfg.Path, tokenSchema, &a.st)
+		if err != nil && !statefile.Fresh(err) {
+			return nil, fmt.Errorf("load API token: %w", err)
+		}
+	}
+	if a.st.Token == "" {
+		tok, err := newToken()
+		if err != nil {
+			return nil, err
+		}
+		a.st = tokenState{Token: tok, CreatedAt: time.Now().UTC()}
+		slog.Info("api: generated the device API token", "path", cfg.Path)
+		a.saveLocked()
+	}
+	if a.st.PairedAt == nil {
+		fmt.Fprintf(cfg.Console, "\nstrct: device API token (no client has paired yet):\n\n    %s\n\n", a.st.Token)
+	}
+	return a, nil
+}
+
+func newToken() (string, error) {
+	b := make([]byte, tokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generate API token: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (a *Auth) saveLocked() {
+	if a.cfg.Path == "" {
+		return
+	}
+	if err := statefile.Save(a.cfg.Path, tokenSchema, a.st); err != nil {
+		slog.Error("api: could not save the API token; it changes at the next start", "path", a.cfg.Path, "err", err)
+	}
+}
+
+// Middleware refuses /api, /strct_agent, /files/ and /metrics requests
+// without the token.
+// It goes inside the /api/v1/ prefix, so it sees the resolved path.
+func (a *Auth) Middleware(next http.Handler) http.Handler {
+	if a == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !guarded(r.URL.Path) || fromSocket(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !a.valid(requestToken(r)) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="strct"`)
+			errs.HTTPResponse(w, errs.E(opAuth, errs.KindUnauthorized,
+				"missing or invalid API token: send Authorization: Bearer <token>"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// guarded reports whether path needs the token.
+func guarded(path string) bool {
+	if openRoutes[path] {
+		return false
+	}
+	return path == "/api" || strings.HasPrefix(path, "/api/") ||
+		path == "/strct_agent" || strings.HasPrefix(path, "/strct_agent/") ||
+		strings.HasPrefix(path, "/files/") || path == "/metrics"
+}
+
+// fromSocket reports whether r came over the admin socket, whose peers
+// have no address.
+func fromSocket(r *http.Request) bool {
+	_, _, err := net.SplitHostPort(r.RemoteAddr)
+	return err != nil
+}
+
+// requestToken is the token r carries, "" if none.
+func requestToken(r *http.Request) string {
+	if scheme, tok, ok := strings.Cut(r.Header.Get("Authorization"), " "); ok && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(tok)
+	}
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return r.URL.Query().Get(tokenQuery)
+	}
+	return ""
+}
+
+func (a *Auth) valid(tok string) bool {
+	if tok == "" {
+		return false
+	}
+	a.mu.Lock()
+	want := a.st.Token
+	a.mu.Unlock()
+	return subtle.ConstantTimeCompare([]byte(tok), []byte(want)) == 1
+}
+
+// RegisterRoutes adds the pairing and rotation routes.
+func (a *Auth) RegisterRoutes(mux *http.ServeMux) {
+	if a == nil {
+		return
+	}
+	mux.HandleFunc("POST /api/auth/pair", a.handlePair)
+	mux.HandleFunc("POST /api/auth/rotate", a.handleRotate)
+}
+
+// TokenResponse is what pairing and rotation return.
+type TokenResponse struct {
+	Token string `json:"token"`
+}
+
+// handlePair hands the token to the first LAN client that asks. The
+// admin socket may always read it.
+// POST /api/auth/pair
+func (a *Auth) handlePair(w http.ResponseWriter, r *http.Request) {
+	socket := fromSocket(r)
+	if !socket && !fromLAN(r) {
+		httputil.Error(w, http.StatusForbidden, "pairing is only open on the local network")
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if socket {
+		httputil.OK(w, TokenResponse{Token: a.st.Token})
+		return
+	}
+	if a.st.PairedAt != nil {
+		httputil.Error(w, http.StatusConflict, "already paired on "+a.st.PairedAt.Format(time.RFC3339)+
+			": rotate the token to pair again")
+		return
+	}
+	now := time.Now().UTC()
+	a.st.PairedAt = &now
+	a.saveLocked()
+	slog.Info("api: client paired", "remote", r.RemoteAddr)
+	httputil.OK(w, TokenResponse{Token: a.st.Token})
+}
+
+// handleRotate replaces the token. The caller, who has to hold the old
+// one, gets the new one and counts as paired.
+// POST /api/auth/rotate
+func (a *Auth) handleRotate(w http.ResponseWriter, r *http.Request) {
+	tok, err := newToken()
+	if err != nil {
+		httputil.InternalError(w, err.Error())
+		return
+	}
+	now := time.Now().UTC()
+	a.mu.Lock()
+	a.st = tokenState{Token: tok, CreatedAt: now, PairedAt: &now}
+	a.saveLocked()
+	a.mu.Unlock()
+	slog.Info("api: API token rotated")
+	httputil.OK(w, TokenResponse{Token: tok})
+}
+
+// SecurityPosture reports whether a client holds the token, and since
+// when; never the token itself.
+func (a *Auth) SecurityPosture() (string, any) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return "api_token", struct {
+		Paired    bool       `json:"paired"`
+		PairedAt  *time.Time `json:"paired_at,omitempty"`
+		CreatedAt time.Time  `json:"created_at"`
+	}{a.st.PairedAt != nil, a.st.PairedAt, a.st.CreatedAt}
+}
+
+// fromLAN reports whether r came from this network rather than the tunnel
+// or the internet. frpc connects from loopback too, so only the tunnel
+// listener tells its requests apart.
+func fromLAN(r *http.Request) bool {
+	if httputil.FromTunnel(r) {
+		return false
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && (ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast())
+}
@@ -0,0 +1,237 @@
+package api_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/strct-org/strct-agent/internal/api"
+	"github.com/strct-org/strct-agent/internal/httputil"
+)
+
+func newAuthHandler(t *testing.T, path string) (http.Handler, *strings.Builder) {
+	t.Helper()
+	console := &strings.Builder{}
+	auth, err := api.NewAuth(api.AuthConfig{
+		Path:    path,
+		Console: console,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	mux.HandleFunc("GET /api/health", ok)
+	mux.HandleFunc("GET /api/files", ok)
+	mux.HandleFunc("POST /strct_agent/fs/upload", ok)
+	mux.HandleFunc("GET /share/{token}", ok)
+	mux.HandleFunc("GET /files/", ok)
+	mux.HandleFunc("GET /metrics", ok)
+	auth.RegisterRoutes(mux)
+	return api.New(api.Config{Port: 8080, Auth: auth}, mux).Handler(), console
+}
+
+func send(h http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// pairFrom is POST /api/auth/pair from addr.
+func pairFrom(addr string) *http.Request {
+	r := httptest.NewRequest("POST", "/api/auth/pair", nil)
+	r.RemoteAddr = addr
+	return r
+}
+
+// viaTunnel marks r as delivered by frpc, as the tunnel listener does.
+func viaTunnel(r *http.Request) *http.Request {
+	return r.WithContext(httputil.WithTunnel(r.Context()))
+}
+
+func tokenOf(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	if w.Code != http.StatusOK {
+		t.Fatalf("%d %s", w.Code, w.Body)
+	}
+	var resp api.TokenResponse
+	json.Unmarshal(w.Body.Bytes(), &resp) //nolint:errcheck
+	if len(resp.Token) != 64 {
+		t.Fatalf("token = %q", resp.Token)
+	}
+	return resp.Token
+}
+
+func TestAuth_PairThenUseTheToken(t *testing.T) {
+	h, console := newAuthHandler(t, filepath.Join(t.TempDir(), "api-token.json"))
+
+	// Open without a token.
+	for _, r := range []*http.Request{
+		httptest.NewRequest("GET", "/api/health", nil),
+		httptest.NewRequest("GET", "/api/v1/health", nil),
+		httptest.NewRequest("GET", "/share/abc", nil),
+		httptest.NewRequest("OPTIONS", "/api/files", nil),
+	} {
+		if w := send(h, r); w.Code != http.StatusOK {
+			t.Errorf("%s %s without a token: %d", r.Method, r.URL, w.Code)
+		}
+	}
+	// Refused without one.
+	for _, r := range []*http.Request{
+		httptest.NewRequest("GET", "/api/files", nil),
+		httptest.NewRequest("GET", "/api/v1/files", nil),
+		httptest.NewRequest("POST", "/strct_agent/fs/upload", nil),
+		httptest.NewRequest("POST", "/api/auth/rotate", nil),
+		httptest.NewRequest("GET", "/api/nope", nil),
+		httptest.NewRequest("GET", "/files/x", nil),
+		viaTunnel(httptest.NewRequest("GET", "/files/x", nil)),
+		httptest.NewRequest("GET", "/metrics", nil),
+		viaTunnel(httptest.NewRequest("GET", "/metrics", nil)),
+	} {
+		w := send(h, r)
+		if w.Code != http.StatusUnauthorized || !strings.HasPrefix(w.Header().Get("WWW-Authenticate"), "Bearer") {
+			t.Errorf("%s %s without a token: %d", r.Method, r.URL, w.Code)
+		}
+	}
+
+	// Pairing is for the LAN only, and only once. Through the tunnel it
+	// is refused whatever the Host, though frpc connects from loopback.
+	remote := pairFrom("203.0.113.9:40000")
+	tunnel := pairFrom("127.0.0.1:40000")
+	tunnel.Host = "device-1.strct.org"
+	other := pairFrom("127.0.0.1:40000")
+	other.Host = "foo-device-1.strct.org"
+	for _, r := range []*http.Request{remote, viaTunnel(tunnel), viaTunnel(other)} {
+		if w := send(h, r); w.Code != http.StatusForbidden {
+			t.Errorf("pair from %s (%s): %d", r.RemoteAddr, r.Host, w.Code)
+		}
+	}
+	tok := tokenOf(t, send(h, pairFrom("192.168.1.20:40000")))
+	if !strings.Contains(console.String(), tok) {
+		t.Errorf("token not printed on the console: %q", console)
+	}
+	if w := send(h, pairFrom("[fe80::1]:40000")); w.Code != http.StatusConflict {
+		t.Errorf("second pairing: %d", w.Code)
+	}
+
+	r := httptest.NewRequest("GET", "/api/files", nil)
+	r.Header.Set("Authorization", "Bearer "+tok)
+	if w := send(h, r); w.Code != http.StatusOK {
+		t.Errorf("with the token: %d", w.Code)
+	}
+	r.Header.Set("Authorization", "Bearer "+strings.Repeat("0", 64))
+	if w := send(h, r); w.Code != http.StatusUnauthorized {
+		t.Errorf("with a wrong token: %d", w.Code)
+	}
+	// In the query for links, but only on reads.
+	if w := send(h, httptest.NewRequest("GET", "/api/files?access_token="+tok, nil)); w.Code != http.StatusOK {
+		t.Errorf("GET with access_token: %d", w.Code)
+	}
+	if w := send(h, httptest.NewRequest("GET", "/files/x?access_token="+tok, nil)); w.Code != http.StatusOK {
+		t.Errorf("GET /files/ with access_token: %d", w.Code)
+	}
+	if w := send(h, httptest.NewRequest("POST", "/strct_agent/fs/upload?access_token="+tok, nil)); w.Code != http.StatusUnauthorized {
+		t.Errorf("POST with access_token: %d", w.Code)
+	}
+}
+
+func TestAuth_NoPairingOnTheTunnelListener(t *testing.T) {
+	auth, err := api.NewAuth(api.AuthConfig{Console: io.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	auth.RegisterRoutes(mux)
+	var tunnelPort int
+	s := api.New(api.Config{Port: 0, Auth: auth, OnPort: func(p int) { tunnelPort = p }}, mux)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	base, done := startServer(t, ctx, s)
+
+	pair := func(url, host string) int {
+		t.Helper()
+		r, _ := http.NewRequest("POST", url+"/api/auth/pair", nil)
+		r.Host = host
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	// Both come from loopback; only the listener tells them apart.
+	tunnel := fmt.Sprintf("http://127.0.0.1:%d", tunnelPort)
+	for _, host := range []string{"device-1.strct.org", "foo-device-1.strct.org", "localhost"} {
+		if code := pair(tunnel, host); code != http.StatusForbidden {
+			t.Errorf("pair through the tunnel as %s: %d", host, code)
+		}
+	}
+	if code := pair(base, "foo-device-1.strct.org"); code != http.StatusOK {
+		t.Errorf("pair on the device: %d", code)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Start: %v", err)
+	}
+}
+
+func TestAuth_RotateAndReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "api-token.json")
+	h, _ := newAuthHandler(t, path)
+	tok := tokenOf(t, send(h, pairFrom("127.0.0.1:40000")))
+
+	// A restart keeps the token, and no longer prints it.
+	h, console := newAuthHandler(t, path)
+	r := httptest.NewRequest("POST", "/api/auth/rotate", nil)
+	r.Header.Set("Authorization", "Bearer "+tok)
+	if console.Len() != 0 {
+		t.Errorf("paired token printed again: %q", console)
+	}
+	rotated := tokenOf(t, send(h, r))
+	if rotated == tok {
+		t.Fatal("rotate kept the token")
+	}
+
+	for want, tok := range map[int]string{http.StatusUnauthorized: tok, http.StatusOK: rotated} {
+		r := httptest.NewRequest("GET", "/api/files", nil)
+		r.Header.Set("Authorization", "Bearer "+tok)
+		if w := send(h, r); w.Code != want {
+			t.Errorf("after rotate: %d, want %d", w.Code, want)
+		}
+	}
+	h, _ = newAuthHandler(t, path)
+	r = httptest.NewRequest("GET", "/api/files", nil)
+	r.Header.Set("Authorization", "bearer "+rotated)
+	if w := send(h, r); w.Code != http.StatusOK {
+		t.Errorf("rotated token after a restart: %d", w.Code)
+	}
+}
+
+func TestAuth_AdminSocketIsTrusted(t *testing.T) {
+	h, _ := newAuthHandler(t, "")
+	r := httptest.NewRequest("GET", "/api/files", nil)
+	r.RemoteAddr = "@"
+	if w := send(h, r); w.Code != http.StatusOK {
+		t.Errorf("socket request: %d", w.Code)
+	}
+	for i := 0; i < 2; i++ {
+		tokenOf(t, send(h, pairFrom("@")))
+	}
+}
+
+func TestAuth_NilLetsEverythingThrough(t *testing.T) {
+	var auth *api.Auth
+	h := auth.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok") //nolint:errcheck
+	}))
+	if w := send(h, httptest.NewRequest("GET", "/api/files", nil)); w.Body.String() != "ok" {
+		t.Errorf("nil Auth: %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,117 @@
+package api_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/strct-org/strct-agent/internal/api"
+)
+
+func TestCORS_ShareLinksAnyOrigin(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /share/{token}", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("GET /api/files", func(w http.ResponseWriter, r *http.Request) {})
+	h := api.New(api.Config{Port: 8080}, mux).Handler()
+
+	for target, want := range map[string]string{
+		"/share/abc": "*",
+		"/api/files": "",
+	} {
+		r := httptest.NewRequest("GET", target, nil)
+		r.Header.Set("Origin", "https://mail.example.com")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != want {
+			t.Errorf("%s: Access-Control-Allow-Origin = %q, want %q", target, got, want)
+		}
+		if w.Header().Get("Access-Control-Allow-Credentials") != "" {
+			t.Errorf("%s: allows credentials", target)
+		}
+	}
+
+	r := httptest.NewRequest("OPTIONS", "/share/abc", nil)
+	r.Header.Set("Origin", "https://mail.example.com")
+	r.Header.Set("Access-Control-Request-Headers", "Range")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Header().Get("Access-Control-Allow-Headers") != "Range" {
+		t.Errorf("preflight: %d %v", w.Code, w.Header())
+	}
+}
+
+func TestCORS_Origins(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/files", func(w http.ResponseWriter, r *http.Request) {})
+	h := api.New(api.Config{Port: 8080}, mux).Handler()
+
+	for origin, allowed := range map[string]bool{
+		"http://localhost":             true,
+		"http://localhost:5173":        true,
+		"https://strct.org":            true,
+		"https://app.strct.org":        true,
+		"http://dev.strct.org:3000":    true,
+		"":                             false,
+		"null":                         false,
+		"https://localhost":            false,
+		"http://localhost.evil.com":    false,
+		"http://localhost@evil.com":    false,
+		"http://strct.org":             false,
+		"https://evilstrct.org":        false,
+		"https://strct.org.evil.com":   false,
+		"https://app.strct.org/x":      false,
+		"ftp://app.strct.org":          false,
+		"https://mail.example.com":     false,
+		"https://strct.org.":           false,
+		"https://app.strct.org.evil.c": false,
+	} {
+		r := httptest.NewRequest("GET", "/api/files", nil)
+		r.Header.Set("Origin", origin)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		got := w.Header().Get("Access-Control-Allow-Origin")
+		if allowed && (got != origin || w.Header().Get("Access-Control-Allow-Credentials") != "true") {
+			t.Errorf("%q: not allowed: %v", origin, w.Header())
+		}
+		if !allowed && got != "" {
+			t.Errorf("%q: Access-Control-Allow-Origin = %q", origin, got)
+		}
+	}
+}
+
+func TestCORS_Preflight(t *testing.T) {
+	reached := false
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/files", func(w http.ResponseWriter, r *http.Request) { reached = true })
+	auth, err := api.NewAuth(api.AuthConfig{Console: io.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := api.New(api.Config{Port: 8080, Auth: auth}, mux).Handler()
+
+	for origin, want := range map[string]string{
+		"https://app.strct.org": "https://app.strct.org",
+		"https://evil.com":      "",
+	} {
+		r := httptest.NewRequest("OPTIONS", "/api/v1/files", nil)
+		r.Header.Set("Origin", origin)
+		r.Header.Set("Access-Control-Request-Method", "DELETE")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		// Answered before auth: a browser sends no token with a preflight.
+		if w.Code != http.StatusOK || w.Header().Get("Access-Control-Allow-Origin") != want {
+			t.Errorf("%s: %d, Allow-Origin %q", origin, w.Code, w.Header().Get("Access-Control-Allow-Origin"))
+		}
+		if m := w.Header().Get("Access-Control-Allow-Methods"); !strings.Contains(m, "DELETE") {
+			t.Errorf("%s: Allow-Methods %q", origin, m)
+		}
+		if hd := w.Header().Get("Access-Control-Allow-Headers"); !strings.Contains(hd, "Authorization") {
+			t.Errorf("%s: Allow-Headers %q", origin, hd)
+		}
+	}
+	if reached {
+		t.Error("a preflight reached the route")
+	}
+}
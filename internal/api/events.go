@@ -0,0 +1,116 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/apidoc"
+	"github.com/strct-org/strct-agent/internal/events"
+	"github.com/strct-org/strct-agent/internal/httputil"
+	"github.com/strct-org/strct-agent/internal/latency"
+)
+
+// ─── Event stream ────────────────────────────────────────────────────────────
+
+// GET /api/events streams Config.Events as Server-Sent Events, so the
+// dashboard hears about a device joining or the internet going down
+// without polling. Each event is one data line holding its envelope:
+//
+//	data: {"type":"vpn.status","ts":"2026-10-16T09:12:03Z","payload":{...}}
+//
+// ?types=vpn.status,outage.started narrows the stream to those types. A
+// comment every eventsHeartbeat keeps proxies, frp among them, from
+// closing a quiet stream. A client that falls eventsBuffer events behind
+// is dropped: its stream ends with an `event: dropped` and EventSource
+// reconnects after the retry the stream opened with. Streams end when the
+// server shuts down, instead of holding up its wait for requests in
+// flight.
+const (
+	eventsHeartbeat = 25 * time.Second
+	eventsBuffer    = 64
+	eventsRetry     = 3 * time.Second
+)
+
+// exampleEvent is the envelope in the API docs.
+var exampleEvent = events.Event{
+	Type:    events.OutageStarted,
+	TS:      time.Date(2026, 10, 16, 9, 12, 3, 0, time.UTC),
+	Payload: map[string]any{"start": "2026-10-16T09:10:03Z", "duration_s": 120, "diagnosis": "lan_ok_wan_down"},
+}
+
+func (s *Server) registerEvents(mux *http.ServeMux) {
+	if s.cfg.Events == nil {
+		return
+	}
+	apidoc.On(mux, "events").Register("GET", "/api/events", s.handleEvents, apidoc.RouteDoc{
+		Summary: "A Server-Sent Events stream of what the features report",
+		Description: "Each event is a `data:` line holding the JSON envelope shown. Types: " +
+			strings.Join(events.Types, ", ") + ". A client that falls behind gets `event: dropped` and " +
+			"the stream ends; EventSource reconnects by itself.",
+		Query:        []apidoc.Param{{Name: "types", Description: "comma-separated event types to receive; all if unset"}},
+		Response:     exampleEvent,
+		ResponseType: "text/event-stream",
+	})
+}
+
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	var types []string
+	if v := r.URL.Query().Get("types"); v != "" {
+		types = strings.Split(v, ",")
+		for _, t := range types {
+			if !slices.Contains(events.Types, t) {
+				httputil.BadRequest(w, fmt.Sprintf("unknown event type %q; one of %s", t, strings.Join(events.Types, ", ")))
+				return
+			}
+		}
+	}
+	latency.Stream(r.Context())
+	sub := s.cfg.Events.Subscribe(eventsBuffer, types...)
+	defer sub.Close()
+
+	rc := http.NewResponseController(w)
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("X-Accel-Buffering", "no") // proxies that honour it pass events on at once
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", eventsRetry.Milliseconds())
+	if err := rc.Flush(); err != nil {
+		slog.Error("api: event stream cannot be flushed", "err", err)
+		return
+	}
+
+	heartbeat := time.NewTicker(eventsHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case e, ok := <-sub.C:
+			if !ok {
+				io.WriteString(w, "event: dropped\ndata: {}\n\n")
+				rc.Flush() //nolint:errcheck // ending anyway
+				return
+			}
+			b, err := json.Marshal(e)
+			if err != nil {
+				slog.Warn("api: could not encode event", "type", e.Type, "err", err)
+				continue
+			}
+			fmt.Fprintf(w, "data: %s\n\n", b)
+		case <-heartbeat.C:
+			io.WriteString(w, ": heartbeat\n\n")
+		case <-r.Context().Done():
+			return
+		case <-s.stopping:
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return // the client is gone
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package api_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/api"
+	"github.com/strct-org/strct-agent/internal/events"
+	"github.com/strct-org/strct-agent/internal/latency"
+	"github.com/strct-org/strct-agent/internal/metrics"
+)
+
+func TestEvents_StreamsTheBus(t *testing.T) {
+	bus := events.New()
+	mux := http.NewServeMux()
+	tracker := latency.New(latency.Config{Registry: metrics.NewRegistry()})
+	s := api.New(api.Config{Port: 0, Events: bus, Middleware: tracker.Middleware}, mux)
+	s.RegisterRoutes(mux)
+	ctx, cancel := context.WithCancel(context.Background())
+	base, done := startServer(t, ctx, s)
+
+	resp, err := http.Get(base + "/api/v1/events?types=" + events.VPNStatus + "," + events.OutageStarted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("GET /api/v1/events: %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	lines := bufio.NewScanner(resp.Body)
+	next := func() string {
+		t.Helper()
+		for lines.Scan() {
+			if l := lines.Text(); l != "" {
+				return l
+			}
+		}
+		t.Fatalf("stream ended: %v", lines.Err())
+		return ""
+	}
+	if l := next(); !strings.HasPrefix(l, "retry: ") {
+		t.Fatalf("first line = %q", l)
+	}
+	// Subscribed once the retry line is flushed.
+	bus.Publish(events.WiFiStatus, "filtered out")
+	bus.Publish(events.VPNStatus, map[string]bool{"tailscale_up": true})
+
+	data, ok := strings.CutPrefix(next(), "data: ")
+	if !ok {
+		t.Fatalf("not a data line: %q", data)
+	}
+	var e struct {
+		Type    string          `json:"type"`
+		TS      time.Time       `json:"ts"`
+		Payload map[string]bool `json:"payload"`
+	}
+	if err := json.Unmarshal([]byte(data), &e); err != nil {
+		t.Fatalf("decode %s: %v", data, err)
+	}
+	if e.Type != events.VPNStatus || e.TS.IsZero() || !e.Payload["tailscale_up"] {
+		t.Errorf("event = %+v", e)
+	}
+
+	// Shutdown ends the stream rather than waiting it out.
+	start := time.Now()
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Start: %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("shutdown took %v with a stream open", d)
+	}
+	if bus.Subscribers() != 0 {
+		t.Errorf("%d subscribers left", bus.Subscribers())
+	}
+	if r := tracker.Report().Routes[0]; r.Count != 0 || r.Codes[200] != 1 {
+		t.Errorf("the stream was timed: %+v", r)
+	}
+}
+
+func TestEvents_RejectsUnknownTypes(t *testing.T) {
+	mux := http.NewServeMux()
+	s := api.New(api.Config{Events: events.New()}, mux)
+	s.RegisterRoutes(mux)
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/api/events?types=vpn.status,wifi.bogus", nil))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "wifi.bogus") {
+		t.Errorf("GET: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestEvents_NotServedWithoutABus(t *testing.T) {
+	mux := http.NewServeMux()
+	api.New(api.Config{}, mux).RegisterRoutes(mux)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/api/events", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("GET without a bus: %d", w.Code)
+	}
+}
@@ -0,0 +1,4 @@
+package api
+
+// EffectivePort is effectivePort, for api_test.
+var EffectivePort = effectivePort
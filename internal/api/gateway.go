@@ -0,0 +1,212 @@
+package api
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Gateway serves the API on the standard ports of one address: in router
+// mode, the AP gateway, so typing 192.168.100.1 into a browser reaches the
+// UI. It binds that IP only, never the wildcard, so the WAN side (eth0)
+// never gets a listener.
+//
+// :80 has two owners over a boot. The setup portal holds it, on every
+// interface, until the device is online; the gateway binds nothing until
+// After is closed, which the agent does once the portal's server has shut
+// down. A bind that fails, say because another program has the port, is
+// reported on GET /api/system/ports and retried.
+type Gateway struct {
+	// IP returns the address to serve on, "" for none. It is read again
+	// after Changed and on every retry.
+	IP func() string
+	// TLS, if set, adds :443.
+	TLS *tls.Config
+	// After is closed when the setup portal has let go of :80. nil: no
+	// portal ran.
+	After <-chan struct{}
+	// Listen opens the listeners; nil is net.Listen. Tests fake it.
+	Listen func(network, addr string) (net.Listener, error)
+
+	kick chan struct{}
+	once sync.Once
+
+	mu     sync.Mutex
+	bound  map[int]*gatewayServer
+	status map[int]PortStatus
+}
+
+// gatewayRetry is how often a failed bind is tried again. A var so tests
+// don't wait on it.
+var gatewayRetry = 30 * time.Second
+
+type gatewayServer struct {
+	addr string
+	srv  *http.Server
+}
+
+func (g *Gateway) init() {
+	g.once.Do(func() {
+		g.kick = make(chan struct{}, 1)
+		g.bound = make(map[int]*gatewayServer)
+		g.status = make(map[int]PortStatus)
+	})
+}
+
+func (g *Gateway) ports() []int {
+	if g.TLS != nil {
+		return []int{80, 443}
+	}
+	return []int{80}
+}
+
+// Changed tells the gateway its IP may have changed. It does not block,
+// so it can be called from a WiFi apply hook.
+func (g *Gateway) Changed() {
+	g.init()
+	select {
+	case g.kick <- struct{}{}:
+	default:
+	}
+}
+
+// Run keeps the listeners in line with IP until ctx is done.
+func (g *Gateway) Run(ctx context.Context, h http.Handler) {
+	g.init()
+	if g.After != nil {
+		for _, port := range g.ports() {
+			g.setStatus(port, PortStatus{State: PortWaiting, Error: "setup portal owns the port"})
+		}
+		select {
+		case <-g.After:
+			slog.Info("api: setup portal released :80, binding the gateway ports")
+		case <-ctx.Done():
+			return
+		}
+	}
+	t := time.NewTicker(gatewayRetry)
+	defer t.Stop()
+	for {
+		g.Sync(h)
+		select {
+		case <-ctx.Done():
+			g.closeAll()
+			return
+		case <-g.kick:
+		case <-t.C:
+		}
+	}
+}
+
+// Sync binds, moves or closes the listeners to match IP once.
+func (g *Gateway) Sync(h http.Handler) {
+	g.init()
+	ip := g.IP()
+	for _, port := range g.ports() {
+		addr := ""
+		if ip != "" {
+			addr = net.JoinHostPort(ip, strconv.Itoa(port))
+		}
+		g.mu.Lock()
+		cur := g.bound[port]
+		g.mu.Unlock()
+		if cur != nil && cur.addr == addr {
+			continue
+		}
+		if cur != nil {
+			g.close(port, cur)
+		}
+		if addr == "" {
+			g.setStatus(port, PortStatus{State: PortOff})
+			continue
+		}
+		g.bind(port, addr, h)
+	}
+}
+
+func (g *Gateway) bind(port int, addr string, h http.Handler) {
+	listen := g.Listen
+	if listen == nil {
+		listen = net.Listen
+	}
+	ln, err := listen("tcp", addr)
+	if err != nil {
+		st := failed("gateway", port, addr, err)
+		if prev := g.Status(port); prev.State != st.State || prev.Error != st.Error {
+			slog.Warn("api: could not bind the gateway port", "addr", addr, "state", st.State, "err", err)
+		}
+		g.setStatus(port, st)
+		return
+	}
+	srv := &http.Server{Handler: h, ReadHeaderTimeout: 10 * time.Second}
+	if port == 443 {
+		ln = tls.NewListener(ln, g.TLS)
+	}
+	g.mu.Lock()
+	g.bound[port] = &gatewayServer{addr: addr, srv: srv}
+	g.mu.Unlock()
+	g.setStatus(port, PortStatus{Addr: addr, State: PortListening})
+	slog.Info("api: serving on the gateway", "addr", addr)
+	go func() {
+		if err := srv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("api: gateway listener stopped", "addr", addr, "err", err)
+			g.mu.Lock()
+			if g.bound[port] != nil && g.bound[port].srv == srv {
+				delete(g.bound, port)
+			}
+			g.mu.Unlock()
+			g.setStatus(port, PortStatus{Addr: addr, State: PortError, Error: err.Error()})
+		}
+	}()
+}
+
+func (g *Gateway) close(port int, gs *gatewayServer) {
+	shutCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	gs.srv.Shutdown(shutCtx) //nolint:errcheck
+	g.mu.Lock()
+	if g.bound[port] == gs {
+		delete(g.bound, port)
+	}
+	g.mu.Unlock()
+	slog.Info("api: stopped serving on the gateway", "addr", gs.addr)
+}
+
+func (g *Gateway) closeAll() {
+	g.mu.Lock()
+	bound := make(map[int]*gatewayServer, len(g.bound))
+	for port, gs := range g.bound {
+		bound[port] = gs
+	}
+	g.mu.Unlock()
+	for port, gs := range bound {
+		g.close(port, gs)
+		g.setStatus(port, PortStatus{State: PortOff})
+	}
+}
+
+func (g *Gateway) setStatus(port int, st PortStatus) {
+	st.Name = "gateway"
+	st.Port = port
+	g.mu.Lock()
+	g.status[port] = st
+	g.mu.Unlock()
+}
+
+// Status reports one of the gateway's ports.
+func (g *Gateway) Status(port int) PortStatus {
+	g.init()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	st, ok := g.status[port]
+	if !ok {
+		return PortStatus{Name: "gateway", Port: port, State: PortOff}
+	}
+	return st
+}
@@ -0,0 +1,206 @@
+package api_test
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/api"
+)
+
+// fakeListen stands in for net.Listen: each bind gets a loopback listener
+// on a free port, remembered under the address asked for, unless that
+// address is marked taken.
+type fakeListen struct {
+	mu    sync.Mutex
+	asked []string
+	open  map[string]net.Listener
+	taken map[string]bool
+}
+
+func newFakeListen(t *testing.T) *fakeListen {
+	f := &fakeListen{open: map[string]net.Listener{}, taken: map[string]bool{}}
+	t.Cleanup(func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		for _, ln := range f.open {
+			ln.Close()
+		}
+	})
+	return f
+}
+
+func (f *fakeListen) listen(network, addr string) (net.Listener, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.asked = append(f.asked, addr)
+	if f.taken[addr] {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: os.NewSyscallError("bind", syscall.EADDRINUSE)}
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	f.open[addr] = ln
+	return ln, nil
+}
+
+func (f *fakeListen) calls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.asked...)
+}
+
+// get fetches path from whatever stands in for addr.
+func (f *fakeListen) get(t *testing.T, addr, path string) (string, error) {
+	t.Helper()
+	f.mu.Lock()
+	ln := f.open[addr]
+	f.mu.Unlock()
+	if ln == nil {
+		return "", fmt.Errorf("%s was never bound", addr)
+	}
+	client := http.Client{Timeout: 2 * time.Second}
+	resp, err := client.Get("http://" + ln.Addr().String() + path)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	return string(b), nil
+}
+
+var hello = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	io.WriteString(w, "strct")
+})
+
+// ipVar is a gateway IP tests change under the Gateway.
+type ipVar struct {
+	mu sync.Mutex
+	ip string
+}
+
+func (v *ipVar) set(ip string) { v.mu.Lock(); v.ip = ip; v.mu.Unlock() }
+func (v *ipVar) get() string   { v.mu.Lock(); defer v.mu.Unlock(); return v.ip }
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestGateway_WaitsForThePortal(t *testing.T) {
+	fl := newFakeListen(t)
+	released := make(chan struct{})
+	g := &api.Gateway{IP: func() string { return "192.168.100.1" }, After: released, Listen: fl.listen}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go g.Run(ctx, hello)
+
+	waitFor(t, "the waiting state", func() bool { return g.Status(80).State == api.PortWaiting })
+	g.Changed() // a WiFi apply during setup doesn't jump the queue
+	time.Sleep(20 * time.Millisecond)
+	if calls := fl.calls(); len(calls) != 0 {
+		t.Fatalf("bound %v while the portal held :80", calls)
+	}
+
+	close(released)
+	waitFor(t, "the bind", func() bool { return g.Status(80).State == api.PortListening })
+	if body, err := fl.get(t, "192.168.100.1:80", "/"); err != nil || body != "strct" {
+		t.Errorf("GET through the gateway: %q, %v", body, err)
+	}
+
+	cancel()
+	waitFor(t, "shutdown", func() bool { return g.Status(80).State == api.PortOff })
+}
+
+func TestGateway_BindsTheGatewayIPOnly(t *testing.T) {
+	fl := newFakeListen(t)
+	ip := &ipVar{}
+	g := &api.Gateway{IP: ip.get, Listen: fl.listen}
+
+	g.Sync(hello)
+	if calls := fl.calls(); len(calls) != 0 {
+		t.Fatalf("bound %v with router mode off", calls)
+	}
+
+	ip.set("192.168.100.1")
+	g.Sync(hello)
+	g.Sync(hello) // unchanged: no second bind
+	if calls := fl.calls(); len(calls) != 1 || calls[0] != "192.168.100.1:80" {
+		t.Fatalf("binds = %v, want only 192.168.100.1:80", calls)
+	}
+	if st := g.Status(80); st.State != api.PortListening || st.Addr != "192.168.100.1:80" {
+		t.Errorf("status = %+v", st)
+	}
+
+	// A new subnet moves the listener; router mode off closes it.
+	ip.set("10.10.0.1")
+	g.Sync(hello)
+	if _, err := fl.get(t, "192.168.100.1:80", "/"); err == nil {
+		t.Error("the old gateway address still answers")
+	}
+	if body, err := fl.get(t, "10.10.0.1:80", "/"); err != nil || body != "strct" {
+		t.Errorf("GET on the new gateway: %q, %v", body, err)
+	}
+	ip.set("")
+	g.Sync(hello)
+	if _, err := fl.get(t, "10.10.0.1:80", "/"); err == nil {
+		t.Error("the gateway still answers with router mode off")
+	}
+	if st := g.Status(80); st.State != api.PortOff {
+		t.Errorf("status = %+v", st)
+	}
+}
+
+func TestGateway_ReportsConflictsAndRetries(t *testing.T) {
+	fl := newFakeListen(t)
+	fl.taken["192.168.100.1:80"] = true
+	g := &api.Gateway{IP: func() string { return "192.168.100.1" }, Listen: fl.listen}
+	srv := api.New(api.Config{Port: 8080, Gateway: g}, http.NewServeMux())
+
+	g.Sync(hello)
+	var gw api.PortStatus
+	for _, p := range srv.Ports() {
+		if p.Name == "gateway" && p.Port == 80 {
+			gw = p
+		}
+	}
+	if gw.State != api.PortConflict || gw.Addr != "192.168.100.1:80" || gw.Error == "" {
+		t.Fatalf("ports report %+v, want a conflict", gw)
+	}
+
+	fl.mu.Lock()
+	delete(fl.taken, "192.168.100.1:80")
+	fl.mu.Unlock()
+	g.Sync(hello)
+	if st := g.Status(80); st.State != api.PortListening {
+		t.Errorf("after the port was freed: %+v", st)
+	}
+}
+
+func TestGateway_TLSAddsPort443(t *testing.T) {
+	fl := newFakeListen(t)
+	g := &api.Gateway{IP: func() string { return "192.168.100.1" }, TLS: &tls.Config{}, Listen: fl.listen}
+	g.Sync(hello)
+	calls := fl.calls()
+	if len(calls) != 2 || calls[0] != "192.168.100.1:80" || calls[1] != "192.168.100.1:443" {
+		t.Errorf("binds = %v", calls)
+	}
+	if st := g.Status(443); st.State != api.PortListening {
+		t.Errorf(":443 = %+v", st)
+	}
+}
@@ -0,0 +1,114 @@
+package api
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"syscall"
+
+	"github.com/strct-org/strct-agent/internal/httputil"
+)
+
+// Port states on GET /api/system/ports.
+const (
+	PortListening = "listening"
+	PortWaiting   = "waiting"  // held by another part of the agent, for now
+	PortConflict  = "conflict" // another program has it
+	PortError     = "error"
+	PortOff       = "off"
+)
+
+// PortStatus is one listener the agent opens.
+type PortStatus struct {
+	Name  string `json:"name"` // api, socket, tunnel, gateway
+	Port  int    `json:"port,omitempty"`
+	Addr  string `json:"addr,omitempty"`
+	State string `json:"state"`
+	Error string `json:"error,omitempty"`
+}
+
+// listeners holds the state of the server's own listeners.
+type listeners struct {
+	mu     sync.Mutex
+	api    PortStatus
+	socket PortStatus
+	tunnel PortStatus
+	addr   net.Addr // the API's, once bound
+}
+
+// Ports reports every listener: the API port, the admin socket, the
+// tunnel listener and the gateway's ports.
+func (s *Server) Ports() []PortStatus {
+	s.ls.mu.Lock()
+	out := []PortStatus{s.ls.api}
+	if s.cfg.Socket != "" {
+		out = append(out, s.ls.socket)
+	}
+	if s.cfg.OnPort != nil {
+		out = append(out, s.ls.tunnel)
+	}
+	s.ls.mu.Unlock()
+	if g := s.cfg.Gateway; g != nil {
+		for _, port := range g.ports() {
+			out = append(out, g.Status(port))
+		}
+	}
+	return out
+}
+
+// Port is the port the API listens on, 0 until it does.
+func (s *Server) Port() int {
+	s.ls.mu.Lock()
+	defer s.ls.mu.Unlock()
+	if s.ls.api.State != PortListening {
+		return 0
+	}
+	return s.ls.api.Port
+}
+
+// TunnelPort is the port of the tunnel listener, 0 until it listens.
+func (s *Server) TunnelPort() int {
+	s.ls.mu.Lock()
+	defer s.ls.mu.Unlock()
+	if s.ls.tunnel.State != PortListening {
+		return 0
+	}
+	return s.ls.tunnel.Port
+}
+
+// Addr is the address the API is bound to, nil until it is. With Port 0
+// it carries the port the kernel picked.
+func (s *Server) Addr() net.Addr {
+	s.ls.mu.Lock()
+	defer s.ls.mu.Unlock()
+	if s.ls.api.State != PortListening {
+		return nil
+	}
+	return s.ls.addr
+}
+
+// failed is the status of a listener that could not bind: a conflict if
+// another program has the address.
+func failed(name string, port int, addr string, err error) PortStatus {
+	st := PortStatus{Name: name, Port: port, Addr: addr, State: PortError, Error: err.Error()}
+	if errors.Is(err, syscall.EADDRINUSE) {
+		st.State = PortConflict
+	}
+	return st
+}
+
+func (s *Server) setPort(p *PortStatus, st PortStatus) {
+	s.ls.mu.Lock()
+	*p = st
+	s.ls.mu.Unlock()
+}
+
+// RegisterRoutes adds GET /api/system/ports and, with Config.Events,
+// GET /api/events.
+func (s *Server) RegisterRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/system/ports", func(w http.ResponseWriter, r *http.Request) {
+		httputil.OK(w, map[string]any{"ports": s.Ports()})
+	})
+	s.registerEvents(mux)
+}
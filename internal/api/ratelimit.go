@@ -0,0 +1,292 @@
+package api
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/httputil"
+)
+
+// ─── Rate limits ─────────────────────────────────────────────────────────────
+
+// Each client gets a token bucket for every route with a limit of its own,
+// and one shared by all other routes, so a tab polling the speed test or a
+// script deleting in a loop cannot take the device down with it. A refused
+// request gets 429 and Retry-After. Routes are matched by mux pattern, the
+// way /metrics labels them; DefaultLimits has the limits, RATE_LIMITS
+// overrides them.
+//
+// Clients are told apart by address; see httputil.ClientAddr. Everything
+// frpc delivers arrives from 127.0.0.1, so a tunnel request is keyed by
+// the visitor's address frp puts in X-Forwarded-For. Without it, as on a
+// tcp proxy, tunnel requests share one set of buckets. The admin socket
+// is not limited.
+const (
+	// maxBuckets bounds the buckets kept; past it, idle full ones go.
+	maxBuckets = 4096
+
+	// defaultRoute is the key of the limit for routes without their own,
+	// and how RATE_LIMITS spells it.
+	defaultRoute    = ""
+	defaultRouteEnv = "*"
+)
+
+// Limit is how often one client may call a route.
+type Limit struct {
+	// Requests may be made per Per, at once or spread out. 0 is no limit.
+	Requests int
+	Per      time.Duration
+	// Concurrent caps the client's requests in flight. 0 is no cap.
+	Concurrent int
+}
+
+func (l Limit) String() string {
+	var parts []string
+	if l.Requests > 0 {
+		parts = append(parts, fmt.Sprintf("%d/%s", l.Requests, shortDuration(l.Per)))
+	}
+	if l.Concurrent > 0 {
+		parts = append(parts, fmt.Sprintf("%d concurrent", l.Concurrent))
+	}
+	if len(parts) == 0 {
+		return "off"
+	}
+	return strings.Join(parts, " ")
+}
+
+// shortDuration is d the way RATE_LIMITS takes it: 1m, not 1m0s.
+func shortDuration(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
+
+// DefaultLimits are the limits by mux pattern; "" is every route without
+// one. Uploads take as long as they take, so they are only capped in
+// number, and so are event streams, which last as long as the page that
+// opened them; thumbnails and WebDAV come in floods from a single page or
+// file manager and are not limited at all.
+var DefaultLimits = map[string]Limit{
+	defaultRoute:                  {Requests: 600, Per: time.Minute},
+	"POST /api/network/speedtest": {Requests: 1, Per: time.Minute},
+	"GET /api/wifi/scan":          {Requests: 6, Per: time.Minute},
+	"DELETE /api/delete":          {Requests: 60, Per: time.Minute},
+	"DELETE /api/trash":           {Requests: 60, Per: time.Minute},
+	"POST /api/trash/empty":       {Requests: 6, Per: time.Minute},
+	"POST /strct_agent/fs/upload": {Concurrent: 3},
+	"PUT /api/upload/{id}":        {Concurrent: 3},
+	"POST /u/{token}":             {Concurrent: 3},
+	"GET /api/events":             {Concurrent: 8},
+	"GET /api/thumb":              {},
+	"/dav":                        {},
+	"/dav/":                       {},
+}
+
+// ParseLimits returns DefaultLimits with RATE_LIMITS' items applied. Each
+// replaces one route's limit:
+//
+//	POST /api/network/speedtest=2/1m
+//	PUT /api/upload/{id}=5 concurrent
+//	GET /api/wifi/scan=6/1m 1 concurrent
+//	GET /api/thumb=off
+//	*=1200/1m                      the default
+func ParseLimits(items []string) (map[string]Limit, error) {
+	limits := make(map[string]Limit, len(DefaultLimits)+len(items))
+	for route, l := range DefaultLimits {
+		limits[route] = l
+	}
+	for _, item := range items {
+		route, value, ok := strings.Cut(item, "=")
+		route = strings.TrimSpace(route)
+		if !ok || (route != defaultRouteEnv && !strings.Contains(route, "/")) {
+			return nil, fmt.Errorf("rate limit %q: want ROUTE=LIMIT, ROUTE a mux pattern or *", item)
+		}
+		l, err := parseLimit(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("rate limit %q: %w", item, err)
+		}
+		if route == defaultRouteEnv {
+			route = defaultRoute
+		}
+		limits[route] = l
+	}
+	return limits, nil
+}
+
+func parseLimit(s string) (Limit, error) {
+	var l Limit
+	if s == "off" {
+		return l, nil
+	}
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return l, fmt.Errorf("empty limit")
+	}
+	for i := 0; i < len(fields); i++ {
+		if n, per, ok := strings.Cut(fields[i], "/"); ok {
+			requests, err := strconv.Atoi(n)
+			d, derr := time.ParseDuration(per)
+			if err != nil || derr != nil || requests <= 0 || d <= 0 {
+				return l, fmt.Errorf("%q: want REQUESTS/DURATION, e.g. 6/1m", fields[i])
+			}
+			l.Requests, l.Per = requests, d
+			continue
+		}
+		n, err := strconv.Atoi(fields[i])
+		if err != nil || n <= 0 || i+1 >= len(fields) || fields[i+1] != "concurrent" {
+			return l, fmt.Errorf("%q: want REQUESTS/DURATION, N concurrent, or off", s)
+		}
+		l.Concurrent = n
+		i++
+	}
+	return l, nil
+}
+
+// RateLimitConfig configures NewRateLimiter.
+type RateLimitConfig struct {
+	// Limits are by mux pattern, "" for the rest; nil is DefaultLimits.
+	Limits map[string]Limit
+	// Now is the clock; nil is time.Now.
+	Now func() time.Time
+}
+
+// RateLimiter refuses requests over their route's Limit. A nil
+// RateLimiter lets everything through.
+type RateLimiter struct {
+	cfg     RateLimitConfig
+	mu      sync.Mutex
+	buckets map[bucketKey]*bucket
+}
+
+type bucketKey struct{ client, route string }
+
+type bucket struct {
+	tokens   float64
+	at       time.Time // when tokens was last topped up
+	inFlight int
+}
+
+func NewRateLimiter(cfg RateLimitConfig) *RateLimiter {
+	if cfg.Limits == nil {
+		cfg.Limits = DefaultLimits
+	}
+	if cfg.Now == nil {
+		cfg.Now = time.Now
+	}
+	return &RateLimiter{cfg: cfg, buckets: make(map[bucketKey]*bucket)}
+}
+
+// middleware limits requests to mux's routes. It goes right around the
+// mux, inside Config.Middleware, so the latency tracker counts the 429s.
+func (l *RateLimiter) middleware(next http.Handler, mux *http.ServeMux) http.Handler {
+	if l == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := httputil.ClientAddr(r)
+		if host == "" {
+			next.ServeHTTP(w, r) // the admin socket
+			return
+		}
+		_, pattern := mux.Handler(r)
+		route := pattern
+		if _, ok := l.cfg.Limits[route]; !ok {
+			route = defaultRoute
+		}
+		limit := l.cfg.Limits[route]
+		if limit.Requests == 0 && limit.Concurrent == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key := bucketKey{client: host, route: route}
+		if wait, ok := l.take(key, limit); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			what := "this route"
+			if route == defaultRoute {
+				what = "the API"
+			}
+			httputil.Error(w, http.StatusTooManyRequests,
+				fmt.Sprintf("too many requests to %s: the limit is %s per client", what, limit))
+			return
+		}
+		defer l.release(key)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// take spends one of key's tokens and counts it in flight. If there is
+// none, or too many are in flight, it returns how long to wait.
+func (l *RateLimiter) take(key bucketKey, limit Limit) (time.Duration, bool) {
+	now := l.cfg.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxBuckets {
+			l.pruneLocked(now)
+		}
+		b = &bucket{tokens: float64(limit.Requests), at: now}
+		l.buckets[key] = b
+	}
+	if limit.Concurrent > 0 && b.inFlight >= limit.Concurrent {
+		return time.Second, false
+	}
+	if limit.Requests > 0 {
+		refill(b, limit, now)
+		if b.tokens < 1 {
+			return time.Duration((1 - b.tokens) / rate(limit) * float64(time.Second)), false
+		}
+		b.tokens--
+	}
+	b.inFlight++
+	return 0, true
+}
+
+func (l *RateLimiter) release(key bucketKey) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if b, ok := l.buckets[key]; ok {
+		b.inFlight--
+	}
+}
+
+// rate is limit's tokens per second.
+func rate(limit Limit) float64 {
+	return float64(limit.Requests) / limit.Per.Seconds()
+}
+
+func refill(b *bucket, limit Limit, now time.Time) {
+	if elapsed := now.Sub(b.at).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(float64(limit.Requests), b.tokens+elapsed*rate(limit))
+		b.at = now
+	}
+}
+
+// pruneLocked drops the buckets a new one would start out the same as:
+// nothing in flight, and full again by now.
+func (l *RateLimiter) pruneLocked(now time.Time) {
+	for key, b := range l.buckets {
+		limit := l.cfg.Limits[key.route]
+		if b.inFlight > 0 {
+			continue
+		}
+		if limit.Requests > 0 {
+			refill(b, limit, now)
+			if b.tokens < float64(limit.Requests) {
+				continue
+			}
+		}
+		delete(l.buckets, key)
+	}
+}
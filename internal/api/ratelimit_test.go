@@ -0,0 +1,203 @@
+package api_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/api"
+	"github.com/strct-org/strct-agent/internal/httputil"
+)
+
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+func newLimitedHandler(t *testing.T, limits map[string]api.Limit, mux *http.ServeMux) (http.Handler, *fakeClock) {
+	t.Helper()
+	clock := &fakeClock{now: time.Date(2024, 6, 3, 12, 0, 0, 0, time.UTC)}
+	l := api.NewRateLimiter(api.RateLimitConfig{Limits: limits, Now: clock.Now})
+	return api.New(api.Config{Port: 8080, RateLimit: l}, mux).Handler(), clock
+}
+
+func from(method, path, addr string) *http.Request {
+	r := httptest.NewRequest(method, path, nil)
+	r.RemoteAddr = addr
+	return r
+}
+
+func TestRateLimit_PerRouteAndClient(t *testing.T) {
+	mux := http.NewServeMux()
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	mux.HandleFunc("POST /api/network/speedtest", ok)
+	mux.HandleFunc("GET /api/files", ok)
+	mux.HandleFunc("GET /api/thumb", ok)
+	h, clock := newLimitedHandler(t, map[string]api.Limit{
+		"":                            {Requests: 3, Per: time.Minute},
+		"POST /api/network/speedtest": {Requests: 1, Per: time.Minute},
+		"GET /api/thumb":              {},
+	}, mux)
+
+	const a, b = "192.168.1.20:40000", "192.168.1.21:40000"
+	if w := send(h, from("POST", "/api/network/speedtest", a)); w.Code != http.StatusOK {
+		t.Fatalf("first speedtest: %d", w.Code)
+	}
+	w := send(h, from("POST", "/api/v1/network/speedtest", a))
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "60" {
+		t.Fatalf("second speedtest: %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	if !strings.Contains(w.Body.String(), "1/1m per client") {
+		t.Errorf("body: %s", w.Body)
+	}
+	// Another client, and the other routes, have buckets of their own.
+	if w := send(h, from("POST", "/api/network/speedtest", b)); w.Code != http.StatusOK {
+		t.Errorf("speedtest from another client: %d", w.Code)
+	}
+	for i := 0; i < 3; i++ {
+		if w := send(h, from("GET", "/api/files", a)); w.Code != http.StatusOK {
+			t.Fatalf("files %d: %d", i, w.Code)
+		}
+	}
+	// The default bucket is shared by every route without a limit, 404s
+	// included.
+	if w := send(h, from("GET", "/api/nope", a)); w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "20" {
+		t.Errorf("fourth request: %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	for i := 0; i < 10; i++ {
+		if w := send(h, from("GET", "/api/thumb", a)); w.Code != http.StatusOK {
+			t.Fatalf("unlimited route: %d", w.Code)
+		}
+	}
+	if w := send(h, from("POST", "/api/network/speedtest", "@")); w.Code != http.StatusOK {
+		t.Errorf("admin socket: %d", w.Code)
+	}
+
+	// Tokens come back at the limit's rate.
+	clock.Advance(20 * time.Second)
+	if w := send(h, from("GET", "/api/files", a)); w.Code != http.StatusOK {
+		t.Errorf("after 20s: %d", w.Code)
+	}
+	if w := send(h, from("POST", "/api/network/speedtest", a)); w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "40" {
+		t.Errorf("speedtest after 20s: %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	clock.Advance(40 * time.Second)
+	if w := send(h, from("POST", "/api/network/speedtest", a)); w.Code != http.StatusOK {
+		t.Errorf("speedtest after a minute: %d", w.Code)
+	}
+}
+
+func TestRateLimit_Concurrent(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("PUT /api/upload/{id}", func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	})
+	h, _ := newLimitedHandler(t, map[string]api.Limit{"PUT /api/upload/{id}": {Concurrent: 2}}, mux)
+
+	const a = "10.0.0.5:40000"
+	var wg sync.WaitGroup
+	for _, id := range []string{"1", "2"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			send(h, from("PUT", "/api/upload/"+id, a))
+		}()
+		<-started
+	}
+	w := send(h, from("PUT", "/api/upload/3", a))
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("third upload at once: %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	close(release)
+	wg.Wait()
+	go func() { <-started }()
+	if w := send(h, from("PUT", "/api/upload/3", a)); w.Code != http.StatusOK {
+		t.Errorf("upload once the others finished: %d", w.Code)
+	}
+}
+
+func TestRateLimit_TunnelVisitorsApart(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/network/speedtest", func(w http.ResponseWriter, r *http.Request) {})
+	h, _ := newLimitedHandler(t, map[string]api.Limit{"POST /api/network/speedtest": {Requests: 1, Per: time.Minute}}, mux)
+
+	// frpc connects from loopback; frp puts the visitor in X-Forwarded-For,
+	// after whatever the visitor sent.
+	visitor := func(fwd string) *http.Request {
+		r := from("POST", "/api/network/speedtest", "127.0.0.1:40000")
+		r.Header.Set("X-Forwarded-For", fwd)
+		return r.WithContext(httputil.WithTunnel(r.Context()))
+	}
+	if w := send(h, visitor("203.0.113.9")); w.Code != http.StatusOK {
+		t.Fatalf("first visitor: %d", w.Code)
+	}
+	if w := send(h, visitor("198.51.100.7")); w.Code != http.StatusOK {
+		t.Errorf("second visitor: %d", w.Code)
+	}
+	if w := send(h, visitor("198.51.100.7, 203.0.113.9")); w.Code != http.StatusTooManyRequests {
+		t.Errorf("first visitor with a forged entry: %d, want 429", w.Code)
+	}
+	// Outside the tunnel the header is the client's own say-so.
+	lan := from("POST", "/api/network/speedtest", "192.168.1.20:40000")
+	lan.Header.Set("X-Forwarded-For", "10.9.9.9")
+	if w := send(h, lan); w.Code != http.StatusOK {
+		t.Fatalf("LAN client: %d", w.Code)
+	}
+	lan.Header.Set("X-Forwarded-For", "10.9.9.8")
+	if w := send(h, lan); w.Code != http.StatusTooManyRequests {
+		t.Errorf("LAN client with another header: %d, want 429", w.Code)
+	}
+}
+
+func TestParseLimits(t *testing.T) {
+	limits, err := api.ParseLimits([]string{
+		"POST /api/network/speedtest=2/1m",
+		"PUT /api/upload/{id}=5 concurrent",
+		"GET /api/wifi/scan = 6/1m 1 concurrent",
+		"GET /api/thumb=off",
+		"*=1200/1m",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for route, want := range map[string]api.Limit{
+		"POST /api/network/speedtest": {Requests: 2, Per: time.Minute},
+		"PUT /api/upload/{id}":        {Concurrent: 5},
+		"GET /api/wifi/scan":          {Requests: 6, Per: time.Minute, Concurrent: 1},
+		"GET /api/thumb":              {},
+		"":                            {Requests: 1200, Per: time.Minute},
+		"DELETE /api/delete":          api.DefaultLimits["DELETE /api/delete"],
+	} {
+		if got, ok := limits[route]; !ok || got != want {
+			t.Errorf("%q = %+v, want %+v", route, got, want)
+		}
+	}
+	if api.DefaultLimits["POST /api/network/speedtest"].Requests != 1 {
+		t.Error("an override changed DefaultLimits")
+	}
+
+	for _, bad := range []string{"speedtest=1/1m", "GET /api/files", "GET /api/files=fast", "GET /api/files=0/1m", "GET /api/files=3", "GET /api/files=1/soon"} {
+		if _, err := api.ParseLimits([]string{bad}); err == nil {
+			t.Errorf("ParseLimits(%q) accepted", bad)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// serveSocket serves the API on cfg.Socket until ctx is done. Anyone who
+// can open the socket is trusted like a LAN client, so access is left to
+// file permissions: 0660, group SocketGroup. A failure here only costs the
+// CLI, so it is logged rather than stopping the HTTP server.
+func (s *Server) serveSocket(ctx context.Context) {
+	ln, err := listenSocket(s.cfg.Socket, s.cfg.SocketGroup)
+	if err != nil {
+		slog.Error("api: admin socket unavailable, the strct CLI will not work", "socket", s.cfg.Socket, "err", err)
+		s.setPort(&s.ls.socket, PortStatus{Name: "socket", Addr: s.cfg.Socket, State: PortError, Error: err.Error()})
+		return
+	}
+	s.setPort(&s.ls.socket, PortStatus{Name: "socket", Addr: s.cfg.Socket, State: PortListening})
+	srv := &http.Server{Handler: s.Handler()}
+	go func() {
+		<-ctx.Done()
+		shutCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutCtx)
+		os.Remove(s.cfg.Socket) //nolint:errcheck
+	}()
+
+	slog.Info("api: serving admin socket", "socket", s.cfg.Socket)
+	if err := srv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("api: admin socket stopped", "socket", s.cfg.Socket, "err", err)
+	}
+}
+
+func listenSocket(path, group string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	os.Remove(path) //nolint:errcheck — stale socket from the last run
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0660); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	if group == "" {
+		return ln, nil
+	}
+	g, err := user.LookupGroup(group)
+	if err != nil {
+		slog.Info("api: admin socket is root-only; add a group to share it", "group", group, "err", err)
+		return ln, nil
+	}
+	gid, _ := strconv.Atoi(g.Gid)
+	if err := os.Chown(path, -1, gid); err != nil {
+		slog.Warn("api: could not give the admin socket to its group", "group", group, "err", err)
+	}
+	return ln, nil
+}
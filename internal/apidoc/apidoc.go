@@ -0,0 +1,168 @@
+// Package apidoc keeps a description of every documented route and serves
+// it as an OpenAPI 3 document at GET /api/openapi.json, with a plain
+// listing at GET /api/docs. Features register their routes through a
+// Router, which puts them on the mux and records what they take and
+// return in one step, so the document can't list a route the agent does
+// not serve:
+//
+//	r := apidoc.On(mux, "wifi")
+//	r.Register("GET", "/api/wifi/status", s.handleGetStatus, apidoc.RouteDoc{
+//		Summary:  "Current mode and AP state",
+//		Response: Status{Mode: ModeRouter, Active: true},
+//	})
+//
+// Request and Response are example payloads. Their types give the schemas,
+// named after the Go types, and the values are shown as the examples.
+package apidoc
+
+import (
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// RouteDoc describes one route.
+type RouteDoc struct {
+	Summary     string
+	Description string
+
+	// Query are the ?name= parameters. Path parameters come from the
+	// pattern's {name} segments.
+	Query []Param
+
+	// Request is an example JSON body; nil if the route takes none.
+	// RequestType is the content type of a body that is not JSON, such
+	// as multipart/form-data, described in Description.
+	Request     any
+	RequestType string
+
+	// Response is an example of the success body; nil if there is none.
+	// ResponseType is the content type of one that is not JSON, such as
+	// application/zip.
+	Response     any
+	ResponseType string
+
+	// Status is the success status; 0 is 200.
+	Status int
+
+	// Validates is set when a bad request body is answered 400 with
+	// every problem listed, as errs.Validation renders it.
+	Validates bool
+}
+
+// Param is a query parameter.
+type Param struct {
+	Name        string
+	Description string
+	Required    bool
+}
+
+// Spec is a set of documented routes.
+type Spec struct {
+	title string
+
+	mu     sync.Mutex
+	routes map[string]route // by method and path
+}
+
+type route struct {
+	method, path, tag string
+	doc               RouteDoc
+}
+
+// Default is the agent's spec, served by RegisterRoutes.
+var Default = NewSpec("strct agent API")
+
+func NewSpec(title string) *Spec {
+	return &Spec{title: title, routes: make(map[string]route)}
+}
+
+// Router registers documented routes on a mux, under one tag.
+type Router struct {
+	mux  *http.ServeMux
+	spec *Spec
+	tag  string
+}
+
+// On returns a Router that documents in Default. tag groups the routes,
+// usually the feature's name.
+func On(mux *http.ServeMux, tag string) Router {
+	return Default.On(mux, tag)
+}
+
+func (s *Spec) On(mux *http.ServeMux, tag string) Router {
+	return Router{mux: mux, spec: s, tag: tag}
+}
+
+// Register serves h at method and path and documents it. An empty method
+// matches every method and documents nothing, as for a file server.
+func (r Router) Register(method, path string, h http.HandlerFunc, doc RouteDoc) {
+	r.Handle(method, path, h, doc)
+}
+
+// Handle is Register for an http.Handler.
+func (r Router) Handle(method, path string, h http.Handler, doc RouteDoc) {
+	if method == "" {
+		r.mux.Handle(path, h)
+		return
+	}
+	r.mux.Handle(method+" "+path, h)
+	r.spec.Document(method, path, r.tag, doc)
+}
+
+// Document records a route served some other way, e.g. by a proxy.
+func (s *Spec) Document(method, path, tag string, doc RouteDoc) {
+	s.mu.Lock()
+	s.routes[method+" "+path] = route{method: method, path: path, tag: tag, doc: doc}
+	s.mu.Unlock()
+}
+
+// sorted returns the routes by path, then method.
+func (s *Spec) sorted() []route {
+	s.mu.Lock()
+	out := make([]route, 0, len(s.routes))
+	for _, r := range s.routes {
+		out = append(out, r)
+	}
+	s.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].path != out[j].path {
+			return out[i].path < out[j].path
+		}
+		return methodOrder(out[i].method) < methodOrder(out[j].method)
+	})
+	return out
+}
+
+func methodOrder(m string) int {
+	for i, o := range []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"} {
+		if m == o {
+			return i
+		}
+	}
+	return 99
+}
+
+var pathParamRe = regexp.MustCompile(`\{([A-Za-z_][A-Za-z0-9_]*)(\.\.\.)?\}`)
+
+// pathParams are the {name} segments of a mux pattern's path.
+func pathParams(path string) []string {
+	var names []string
+	for _, m := range pathParamRe.FindAllStringSubmatch(path, -1) {
+		names = append(names, m[1])
+	}
+	return names
+}
+
+// specPath is path as the document lists it. Routes under /api/ are
+// listed under /api/v1/: the versioned shapes are the documented ones.
+// Unversioned, a few keep older shapes for existing clients.
+func specPath(path string) string {
+	path = pathParamRe.ReplaceAllString(path, "{$1}")
+	if rest, ok := strings.CutPrefix(path, "/api/"); ok {
+		return "/api/v1/" + rest
+	}
+	return path
+}
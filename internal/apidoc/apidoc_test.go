@@ -0,0 +1,214 @@
+package apidoc
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type page[T any] struct {
+	Items []T `json:"items"`
+	Total int `json:"total"`
+}
+
+type item struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size,omitempty"`
+	Modified time.Time `json:"modified_at"`
+	Parent   *item     `json:"parent,omitempty"`
+	secret   string
+	Skipped  string `json:"-"`
+}
+
+type embedded struct {
+	ID string `json:"id"`
+}
+
+type record struct {
+	embedded
+	Tags []string `json:"tags"`
+}
+
+func newTestSpec() (*Spec, *http.ServeMux) {
+	s := NewSpec("test API")
+	mux := http.NewServeMux()
+	r := s.On(mux, "things")
+	r.Register("GET", "/api/things", func(w http.ResponseWriter, _ *http.Request) {
+		io.WriteString(w, "listed")
+	}, RouteDoc{
+		Summary:  "List things",
+		Query:    []Param{{Name: "path", Description: "a folder"}},
+		Response: page[item]{Items: []item{{Name: "a"}}, Total: 1},
+	})
+	r.Register("POST", "/api/things/{id}/tags", func(w http.ResponseWriter, _ *http.Request) {}, RouteDoc{
+		Summary:   "Tag a thing",
+		Request:   map[string]any{"tag": "red", "count": 2},
+		Response:  record{embedded: embedded{ID: "x"}},
+		Status:    http.StatusCreated,
+		Validates: true,
+	})
+	r.Handle("", "/raw/", http.NotFoundHandler(), RouteDoc{Summary: "never listed"})
+	s.Document("GET", "/share/{token}", "proxied", RouteDoc{Summary: "Served elsewhere", ResponseType: "application/zip"})
+	return s, mux
+}
+
+func TestRegister_ServesTheRoute(t *testing.T) {
+	_, mux := newTestSpec()
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/api/things", nil))
+	if rec.Body.String() != "listed" {
+		t.Errorf("GET /api/things = %q", rec.Body.String())
+	}
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("DELETE", "/api/things", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("DELETE /api/things = %d, want 405", rec.Code)
+	}
+}
+
+func TestOpenAPI_Paths(t *testing.T) {
+	s, _ := newTestSpec()
+	doc := s.OpenAPI("1.2.3")
+
+	if doc.Info.Version != "1.2.3" || doc.Info.Title != "test API" {
+		t.Errorf("info = %+v", doc.Info)
+	}
+	var paths []string
+	for p := range doc.Paths {
+		paths = append(paths, p)
+	}
+	want := map[string]bool{"/api/v1/things": true, "/api/v1/things/{id}/tags": true, "/share/{token}": true}
+	if len(paths) != len(want) {
+		t.Fatalf("paths = %v", paths)
+	}
+	for _, p := range paths {
+		if !want[p] {
+			t.Errorf("unexpected path %s", p)
+		}
+	}
+
+	tag := doc.Paths["/api/v1/things/{id}/tags"]["post"]
+	if tag == nil || tag.Tags[0] != "things" {
+		t.Fatalf("post op = %+v", tag)
+	}
+	if len(tag.Parameters) != 1 || tag.Parameters[0].Name != "id" || tag.Parameters[0].In != "path" || !tag.Parameters[0].Required {
+		t.Errorf("path params = %+v", tag.Parameters)
+	}
+	if _, ok := tag.Responses["201"]; !ok {
+		t.Errorf("responses = %v, want a 201", tag.Responses)
+	}
+	if tag.Responses["default"].Content[jsonType].Schema.Ref != "#/components/schemas/Error" {
+		t.Errorf("default response = %+v", tag.Responses["default"])
+	}
+	if tag.Responses["400"].Content[jsonType].Schema.Ref != "#/components/schemas/ValidationError" {
+		t.Errorf("400 response = %+v", tag.Responses["400"])
+	}
+	if _, ok := doc.Paths["/api/v1/things"]["get"].Responses["400"]; ok {
+		t.Error("a route that doesn't validate has a 400")
+	}
+	body := tag.RequestBody.Content[jsonType].Schema
+	if body.Type != "object" || body.Properties["tag"].Type != "string" || body.Properties["count"].Type != "integer" {
+		t.Errorf("map example schema = %+v", body)
+	}
+
+	list := doc.Paths["/api/v1/things"]["get"]
+	if len(list.Parameters) != 1 || list.Parameters[0].In != "query" {
+		t.Errorf("query params = %+v", list.Parameters)
+	}
+	share := doc.Paths["/share/{token}"]["get"]
+	if _, ok := share.Responses["200"].Content["application/zip"]; !ok || share.Tags[0] != "proxied" {
+		t.Errorf("documented route = %+v", share)
+	}
+}
+
+func TestOpenAPI_Components(t *testing.T) {
+	s, _ := newTestSpec()
+	schemas := s.OpenAPI("").Components.Schemas
+
+	pg, ok := schemas["pageOfitem"]
+	if !ok {
+		t.Fatalf("no component for page[item]: %v", reflect.ValueOf(schemas).MapKeys())
+	}
+	if pg.Properties["items"].Items.Ref != "#/components/schemas/item" {
+		t.Errorf("page items = %+v", pg.Properties["items"].Items)
+	}
+
+	it := schemas["item"]
+	if it.Properties["modified_at"].Format != "date-time" {
+		t.Errorf("time field = %+v", it.Properties["modified_at"])
+	}
+	if it.Properties["parent"].Ref != "#/components/schemas/item" {
+		t.Errorf("self reference = %+v", it.Properties["parent"])
+	}
+	for _, name := range []string{"secret", "Skipped", "-"} {
+		if _, ok := it.Properties[name]; ok {
+			t.Errorf("%s should not be in the schema", name)
+		}
+	}
+	if strings.Join(it.Required, ",") != "modified_at,name" {
+		t.Errorf("required = %v, want modified_at,name", it.Required)
+	}
+
+	rec := schemas["record"]
+	if rec.Properties["id"] == nil || rec.Properties["tags"].Type != "array" {
+		t.Errorf("embedded fields should be promoted: %+v", rec.Properties)
+	}
+}
+
+func TestRegisterRoutes_ServesTheSpec(t *testing.T) {
+	s, mux := newTestSpec()
+	s.RegisterRoutes(mux, "1.2.3")
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/api/openapi.json", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /api/openapi.json = %d", rec.Code)
+	}
+	var doc map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("not JSON: %v", err)
+	}
+	if doc["openapi"] != "3.0.3" {
+		t.Errorf("openapi = %v", doc["openapi"])
+	}
+	paths := doc["paths"].(map[string]any)
+	if _, ok := paths["/api/v1/openapi.json"]; !ok {
+		t.Error("the spec should document itself")
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/api/docs", nil))
+	html := rec.Body.String()
+	if !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/html") {
+		t.Errorf("content type = %q", rec.Header().Get("Content-Type"))
+	}
+	for _, want := range []string{"<h2>things</h2>", "/api/v1/things/{id}/tags", "List things", "pageOfitem", "<h2>docs</h2>"} {
+		if !strings.Contains(html, want) {
+			t.Errorf("docs page lacks %q", want)
+		}
+	}
+	if strings.Contains(html, "never listed") {
+		t.Error("a method-less route should not be documented")
+	}
+}
+
+func TestComponentName(t *testing.T) {
+	cases := []struct {
+		t    reflect.Type
+		want string
+	}{
+		{reflect.TypeOf(item{}), "item"},
+		{reflect.TypeOf(page[item]{}), "pageOfitem"},
+		{reflect.TypeOf(page[time.Time]{}), "pageOfTime"},
+	}
+	for _, c := range cases {
+		if got := componentName(c.t); got != c.want {
+			t.Errorf("componentName(%v) = %q, want %q", c.t, got, c.want)
+		}
+	}
+}
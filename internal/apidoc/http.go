@@ -0,0 +1,124 @@
+package apidoc
+
+import (
+	"html/template"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/strct-org/strct-agent/internal/httputil"
+)
+
+// RegisterRoutes serves the spec:
+//
+//	GET /api/openapi.json  the OpenAPI 3 document
+//	GET /api/docs          the routes as a plain HTML page
+//
+// version is the agent's, the document's info.version.
+func (s *Spec) RegisterRoutes(mux *http.ServeMux, version string) {
+	r := s.On(mux, "docs")
+	r.Register("GET", "/api/openapi.json", func(w http.ResponseWriter, _ *http.Request) {
+		httputil.OK(w, s.OpenAPI(version))
+	}, RouteDoc{
+		Summary:      "This document",
+		ResponseType: "application/json",
+	})
+	r.Register("GET", "/api/docs", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := docsPage.Execute(w, s.listing(version)); err != nil {
+			slog.Warn("apidoc: could not write the docs page", "err", err)
+		}
+	}, RouteDoc{
+		Summary:      "The routes as an HTML page",
+		ResponseType: "text/html",
+	})
+}
+
+// listing is the docs page's data.
+type listing struct {
+	Title, Version string
+	Groups         []group
+}
+
+type group struct {
+	Tag    string
+	Routes []listedRoute
+}
+
+type listedRoute struct {
+	Method, Path, Summary string
+	Request, Response     string // type names
+}
+
+func (s *Spec) listing(version string) listing {
+	l := listing{Title: s.title, Version: version}
+	byTag := map[string]int{}
+	for _, r := range s.sorted() {
+		i, ok := byTag[r.tag]
+		if !ok {
+			i = len(l.Groups)
+			byTag[r.tag] = i
+			l.Groups = append(l.Groups, group{Tag: r.tag})
+		}
+		l.Groups[i].Routes = append(l.Groups[i].Routes, listedRoute{
+			Method:   r.method,
+			Path:     specPath(r.path),
+			Summary:  r.doc.Summary,
+			Request:  bodyName(r.doc.Request, r.doc.RequestType),
+			Response: bodyName(r.doc.Response, r.doc.ResponseType),
+		})
+	}
+	return l
+}
+
+// bodyName names an example body's type the way the document's schemas
+// do: FileItem, []FileItem, object.
+func bodyName(example any, contentType string) string {
+	if example == nil {
+		return contentType
+	}
+	t := reflect.TypeOf(example)
+	prefix := ""
+	for t.Kind() == reflect.Pointer || t.Kind() == reflect.Slice {
+		if t.Kind() == reflect.Slice {
+			prefix += "[]"
+		}
+		t = t.Elem()
+	}
+	switch {
+	case t.Kind() == reflect.Struct && t.Name() != "" && t != timeType:
+		return prefix + componentName(t)
+	case t.Kind() == reflect.Map || t.Kind() == reflect.Struct:
+		return prefix + "object"
+	}
+	return prefix + strings.ToLower(t.Kind().String())
+}
+
+var docsPage = template.Must(template.New("docs").Parse(`<!doctype html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font: 14px/1.4 system-ui, sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+td, th { text-align: left; padding: .25em 1em .25em 0; vertical-align: top; }
+th { border-bottom: 1px solid #ccc; }
+code { font-size: 13px; }
+.m { font-weight: 600; }
+</style>
+</head>
+<body>
+<h1>{{.Title}} <small>{{.Version}}</small></h1>
+<p>The full request and response schemas, with examples, are in <a href="/api/v1/openapi.json">openapi.json</a>.</p>
+{{range .Groups}}
+<h2>{{if .Tag}}{{.Tag}}{{else}}other{{end}}</h2>
+<table>
+<tr><th>Method</th><th>Path</th><th>Summary</th><th>Request</th><th>Response</th></tr>
+{{range .Routes}}<tr><td class="m">{{.Method}}</td><td><code>{{.Path}}</code></td><td>{{.Summary}}</td><td><code>{{.Request}}</code></td><td><code>{{.Response}}</code></td></tr>
+{{end}}</table>
+{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,343 @@
+package apidoc
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Document is an OpenAPI 3.0 document, as much of it as the agent uses.
+type Document struct {
+	OpenAPI    string                           `json:"openapi"`
+	Info       Info                             `json:"info"`
+	Paths      map[string]map[string]*Operation `json:"paths"`
+	Components Components                       `json:"components"`
+}
+
+type Info struct {
+	Title       string `json:"title"`
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+}
+
+type Components struct {
+	Schemas map[string]*Schema `json:"schemas"`
+}
+
+type Operation struct {
+	Summary     string              `json:"summary,omitempty"`
+	Description string              `json:"description,omitempty"`
+	Tags        []string            `json:"tags,omitempty"`
+	Parameters  []Parameter         `json:"parameters,omitempty"`
+	RequestBody *RequestBody        `json:"requestBody,omitempty"`
+	Responses   map[string]Response `json:"responses"`
+}
+
+type Parameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"` // path | query
+	Required    bool    `json:"required,omitempty"`
+	Description string  `json:"description,omitempty"`
+	Schema      *Schema `json:"schema"`
+}
+
+type RequestBody struct {
+	Required bool             `json:"required"`
+	Content  map[string]Media `json:"content"`
+}
+
+type Response struct {
+	Description string           `json:"description"`
+	Content     map[string]Media `json:"content,omitempty"`
+}
+
+type Media struct {
+	Schema  *Schema `json:"schema,omitempty"`
+	Example any     `json:"example,omitempty"`
+}
+
+// Schema is a JSON schema, as OpenAPI 3.0 spells it.
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+}
+
+const (
+	jsonType = "application/json"
+
+	// errorSchema is httputil.Error's body, the answer to most failures.
+	errorSchema = "Error"
+	// validationSchema is the 400 of a route with RouteDoc.Validates.
+	validationSchema = "ValidationError"
+)
+
+// OpenAPI builds the document. version is the agent's.
+func (s *Spec) OpenAPI(version string) Document {
+	g := &schemaGen{schemas: map[string]*Schema{}, names: map[reflect.Type]string{}}
+	g.schemas[errorSchema] = &Schema{
+		Type:       "object",
+		Properties: map[string]*Schema{"error": {Type: "string"}},
+		Required:   []string{"error"},
+	}
+	g.schemas[validationSchema] = &Schema{
+		Type: "object",
+		Properties: map[string]*Schema{
+			"error": {Type: "string"},
+			"errors": {Type: "array", Items: &Schema{
+				Type: "object",
+				Properties: map[string]*Schema{
+					"field":   {Type: "string"},
+					"code":    {Type: "string"},
+					"message": {Type: "string"},
+				},
+				Required: []string{"code", "field", "message"},
+			}},
+		},
+		Required: []string{"error", "errors"},
+	}
+	doc := Document{
+		OpenAPI: "3.0.3",
+		Info: Info{
+			Title:   s.title,
+			Version: version,
+			Description: "Every /api/ route is also served without the v1 prefix, where a few keep " +
+				"older field names for existing clients. Requests need the device API token as a bearer token.",
+		},
+		Paths:      map[string]map[string]*Operation{},
+		Components: Components{Schemas: g.schemas},
+	}
+	for _, r := range s.sorted() {
+		path := specPath(r.path)
+		if doc.Paths[path] == nil {
+			doc.Paths[path] = map[string]*Operation{}
+		}
+		doc.Paths[path][strings.ToLower(r.method)] = g.operation(r)
+	}
+	return doc
+}
+
+func (g *schemaGen) operation(r route) *Operation {
+	d := r.doc
+	op := &Operation{Summary: d.Summary, Description: d.Description, Responses: map[string]Response{}}
+	if r.tag != "" {
+		op.Tags = []string{r.tag}
+	}
+	for _, name := range pathParams(r.path) {
+		op.Parameters = append(op.Parameters, Parameter{Name: name, In: "path", Required: true, Schema: &Schema{Type: "string"}})
+	}
+	for _, q := range d.Query {
+		op.Parameters = append(op.Parameters, Parameter{Name: q.Name, In: "query", Required: q.Required, Description: q.Description, Schema: &Schema{Type: "string"}})
+	}
+	switch {
+	case d.Request != nil:
+		op.RequestBody = &RequestBody{Required: true, Content: map[string]Media{
+			jsonType: {Schema: g.of(reflect.TypeOf(d.Request), reflect.ValueOf(d.Request)), Example: d.Request},
+		}}
+	case d.RequestType != "":
+		op.RequestBody = &RequestBody{Required: true, Content: map[string]Media{d.RequestType: {}}}
+	}
+
+	status := d.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	ok := Response{Description: http.StatusText(status)}
+	switch {
+	case d.Response != nil:
+		ok.Content = map[string]Media{
+			jsonType: {Schema: g.of(reflect.TypeOf(d.Response), reflect.ValueOf(d.Response)), Example: d.Response},
+		}
+	case d.ResponseType != "":
+		ok.Content = map[string]Media{d.ResponseType: {}}
+	}
+	op.Responses[strconv.Itoa(status)] = ok
+	if d.Validates {
+		op.Responses[strconv.Itoa(http.StatusBadRequest)] = Response{
+			Description: "Every problem with the request",
+			Content:     map[string]Media{jsonType: {Schema: &Schema{Ref: "#/components/schemas/" + validationSchema}}},
+		}
+	}
+	op.Responses["default"] = Response{
+		Description: "Error",
+		Content:     map[string]Media{jsonType: {Schema: &Schema{Ref: "#/components/schemas/" + errorSchema}}},
+	}
+	return op
+}
+
+// schemaGen turns example values into schemas. Named struct types become
+// components, referred to by name.
+type schemaGen struct {
+	schemas map[string]*Schema
+	names   map[reflect.Type]string
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage(nil))
+)
+
+// of is t's schema. v is an example of it, or the zero Value; it fills in
+// what the type leaves open, such as the keys of a map[string]any.
+func (g *schemaGen) of(t reflect.Type, v reflect.Value) *Schema {
+	if t == nil {
+		return &Schema{}
+	}
+	switch t {
+	case timeType:
+		return &Schema{Type: "string", Format: "date-time"}
+	case rawMessageType:
+		return &Schema{}
+	}
+	switch t.Kind() {
+	case reflect.Interface:
+		if v.IsValid() && !v.IsNil() {
+			return g.of(v.Elem().Type(), v.Elem())
+		}
+		return &Schema{}
+	case reflect.Pointer:
+		if v.IsValid() && !v.IsNil() {
+			return g.of(t.Elem(), v.Elem())
+		}
+		return g.of(t.Elem(), reflect.Value{})
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.object(t, v)
+		}
+		return g.named(t, v)
+	case reflect.Map:
+		if t.Key().Kind() == reflect.String && t.Elem().Kind() == reflect.Interface && v.IsValid() && v.Len() > 0 {
+			// An ad-hoc object: its keys are its properties.
+			s := &Schema{Type: "object", Properties: map[string]*Schema{}}
+			for _, k := range v.MapKeys() {
+				s.Properties[k.String()] = g.of(t.Elem(), v.MapIndex(k))
+			}
+			return s
+		}
+		var elem reflect.Value
+		if v.IsValid() && v.Len() > 0 {
+			iter := v.MapRange()
+			iter.Next()
+			elem = iter.Value()
+		}
+		return &Schema{Type: "object", AdditionalProperties: g.of(t.Elem(), elem)}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &Schema{Type: "string", Format: "byte"}
+		}
+		var elem reflect.Value
+		if v.IsValid() && v.Len() > 0 {
+			elem = v.Index(0)
+		}
+		return &Schema{Type: "array", Items: g.of(t.Elem(), elem)}
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return &Schema{Type: "integer"}
+	case reflect.Int64, reflect.Uint64:
+		return &Schema{Type: "integer", Format: "int64"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	}
+	return &Schema{}
+}
+
+// named is a reference to t's component, which is built the first time.
+func (g *schemaGen) named(t reflect.Type, v reflect.Value) *Schema {
+	name, ok := g.names[t]
+	if !ok {
+		name = componentName(t)
+		if _, taken := g.schemas[name]; taken {
+			name = packageName(t) + "." + name
+		}
+		g.names[t] = name
+		g.schemas[name] = &Schema{} // a placeholder, in case t refers to itself
+		*g.schemas[name] = *g.object(t, v)
+	}
+	return &Schema{Ref: "#/components/schemas/" + name}
+}
+
+// object is a struct's schema, field by field as encoding/json writes them.
+func (g *schemaGen) object(t reflect.Type, v reflect.Value) *Schema {
+	s := &Schema{Type: "object", Properties: map[string]*Schema{}}
+	g.fields(s, t, v)
+	sort.Strings(s.Required)
+	return s
+}
+
+func (g *schemaGen) fields(s *Schema, t reflect.Type, v reflect.Value) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		var fv reflect.Value
+		if v.IsValid() {
+			fv = v.Field(i)
+		}
+		name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" && opts == "" {
+			continue
+		}
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+				if fv.IsValid() && !fv.IsNil() {
+					fv = fv.Elem()
+				} else {
+					fv = reflect.Value{}
+				}
+			}
+			if ft.Kind() == reflect.Struct {
+				g.fields(s, ft, fv) // promoted, as encoding/json does
+				continue
+			}
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		s.Properties[name] = g.of(f.Type, fv)
+		if !strings.Contains(opts, "omitempty") && !strings.Contains(opts, "omitzero") && f.Type.Kind() != reflect.Pointer {
+			s.Required = append(s.Required, name)
+		}
+	}
+}
+
+// typeArgRe matches the package paths in a generic type's name:
+// Page[github.com/x/y/cloud.FileItem].
+var typeArgRe = regexp.MustCompile(`[\w./-]*/`)
+
+// componentName is t's name, made a valid component key: Page[FileItem]
+// is PageOfFileItem.
+func componentName(t reflect.Type) string {
+	name := typeArgRe.ReplaceAllString(t.Name(), "")
+	if base, args, ok := strings.Cut(name, "["); ok {
+		args = strings.TrimSuffix(args, "]")
+		var parts []string
+		for _, a := range strings.Split(args, ",") {
+			if _, n, ok := strings.Cut(a, "."); ok {
+				a = n
+			}
+			parts = append(parts, a)
+		}
+		name = base + "Of" + strings.Join(parts, "And")
+	}
+	return name
+}
+
+func packageName(t reflect.Type) string {
+	p := t.PkgPath()
+	return p[strings.LastIndex(p, "/")+1:]
+}
@@ -0,0 +1,397 @@
+// Package audit keeps an append-only, signed trail of security-relevant
+// API actions: wifi and VPN changes, blocked devices, maintenance mode,
+// deleted, moved and shared files. Each record says who (the connection
+// the request came from: the admin socket, the tunnel, the LAN address),
+// what, on what, and whether it worked.
+//
+// Records are JSON lines in DataDir/audit-security.jsonl. Each carries
+// the hash of the one before it and its own HMAC-SHA256 under a device
+// key, so a record edited, dropped or inserted anywhere breaks the chain
+// from there on. Truncating the tail keeps the chain whole; to catch that
+// the head (sequence number and hash) is anchored every anchorInterval to
+// a file on the SD card, away from the data drive, and optionally
+// reported to the backend. GET /api/system/audit/security verifies the
+// whole chain against the anchor on every call.
+//
+// The middleware records requests by route:
+//
+//	Middleware: func(h http.Handler) http.Handler {
+//		return tracker.Middleware(auditLog.Middleware(h))
+//	}
+//
+// and handlers say what they acted on when the URL doesn't:
+//
+//	audit.Target(r.Context(), "mac="+mac)
+//
+// Target on a context the middleware didn't make does nothing. A nil
+// *Log records nothing.
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/config"
+	"github.com/strct-org/strct-agent/internal/statefile"
+)
+
+const (
+	logName        = "audit-security.jsonl"
+	keySize        = 32
+	anchorInterval = time.Hour
+)
+
+// Outcomes, from the response status.
+const (
+	OutcomeOK     = "ok"     // 1xx-3xx
+	OutcomeDenied = "denied" // 401, 403
+	OutcomeFailed = "failed" // any other 4xx, 5xx
+)
+
+var anchorSchema = statefile.Schema{
+	Name:       "audit-anchor",
+	Migrations: []statefile.Migration{statefile.Stamp},
+}
+
+type Config struct {
+	Path       string // the log
+	KeyPath    string // created on first use
+	AnchorPath string
+	// FromTunnel reports whether a request came through the tunnel, for
+	// the actor. Optional.
+	FromTunnel func(*http.Request) bool
+	// Report sends each new anchor off the device. Optional.
+	Report func(context.Context, Anchor) error
+	// Actions maps a route to the action it records; nil is
+	// SecurityActions.
+	Actions map[string]string
+}
+
+// Record is one line of the log.
+type Record struct {
+	Seq     uint64    `json:"seq"`
+	Time    time.Time `json:"time"`
+	Actor   string    `json:"actor"`
+	Action  string    `json:"action"`
+	Method  string    `json:"method"`
+	Route   string    `json:"route"`
+	Target  string    `json:"target"`
+	Outcome string    `json:"outcome"`
+	Status  int       `json:"status"`
+	Prev    string    `json:"prev"` // the previous record's hash; "" for the first
+	Hash    string    `json:"hash,omitempty"`
+}
+
+// Anchor is the head of the log at a point in time.
+type Anchor struct {
+	Seq  uint64    `json:"seq"`
+	Hash string    `json:"hash"`
+	Time time.Time `json:"time"`
+}
+
+// Log is the audit trail. Safe for concurrent use.
+type Log struct {
+	cfg Config
+	key []byte
+	now func() time.Time
+
+	mu       sync.Mutex
+	seq      uint64
+	head     string
+	anchored uint64 // seq of the last anchor written
+}
+
+// New loads or creates the key and picks the chain up where the log ends.
+func New(cfg Config) (*Log, error) {
+	if cfg.Actions == nil {
+		cfg.Actions = SecurityActions
+	}
+	key, err := loadKey(cfg.KeyPath)
+	if err != nil {
+		return nil, err
+	}
+	l := &Log{cfg: cfg, key: key, now: time.Now}
+
+	// Past a break the chain goes on from the last line, so the damage
+	// stays where it is instead of being papered over.
+	recs, v, err := l.read()
+	if err != nil {
+		return nil, err
+	}
+	if !v.OK {
+		slog.Error("audit: security trail does not verify", "line", v.BrokenAt, "reason", v.Reason)
+	}
+	l.seq = uint64(v.Records)
+	if n := len(recs); n > 0 {
+		l.head = recs[n-1].Hash
+	}
+	if v.Anchor != nil {
+		l.anchored = v.Anchor.Seq
+	}
+	return l, nil
+}
+
+// NewFromConfig is New with the device paths. A log that can't be set up
+// is logged and left off: the agent runs without it.
+func NewFromConfig(cfg *config.Config, fromTunnel func(*http.Request) bool, report func(context.Context, Anchor) error) *Log {
+	l, err := New(Config{
+		Path:       filepath.Join(cfg.DataDir, logName),
+		KeyPath:    cfg.AuditKeyPath(),
+		AnchorPath: cfg.AuditAnchorPath(),
+		FromTunnel: fromTunnel,
+		Report:     report,
+	})
+	if err != nil {
+		slog.Error("audit: security trail disabled", "err", err)
+		return nil
+	}
+	return l
+}
+
+// loadKey reads the signing key, generating it on first use.
+func loadKey(path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err == nil {
+		key, err := hex.DecodeString(string(bytes.TrimSpace(b)))
+		if err != nil || len(key) != keySize {
+			return nil, fmt.Errorf("audit key %s is not %d hex bytes", path, keySize)
+		}
+		return key, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	key := make([]byte, keySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	// O_EXCL: never replace a key, or every existing record stops
+	// verifying.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("create audit key: %w", err)
+	}
+	_, err = f.WriteString(hex.EncodeToString(key) + "\n")
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("write audit key: %w", err)
+	}
+	slog.Info("audit: created signing key", "path", path)
+	return key, nil
+}
+
+// sign is the HMAC of rec without its hash.
+func (l *Log) sign(rec Record) string {
+	rec.Hash = ""
+	b, _ := json.Marshal(rec)
+	mac := hmac.New(sha256.New, l.key)
+	mac.Write(b)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Append chains rec onto the log and writes it through to disk.
+func (l *Log) Append(rec Record) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	rec.Seq = l.seq + 1
+	rec.Prev = l.head
+	if rec.Time.IsZero() {
+		rec.Time = l.now()
+	}
+	rec.Time = rec.Time.UTC() // so it reads back byte for byte
+	rec.Hash = l.sign(rec)
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(l.cfg.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("open audit log: %w", err)
+	}
+	_, err = f.Write(append(line, '\n'))
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("write audit log: %w", err)
+	}
+	l.seq, l.head = rec.Seq, rec.Hash
+	return nil
+}
+
+// ─── Verification ────────────────────────────────────────────────────────────
+
+// Verification is the state of the chain.
+type Verification struct {
+	OK      bool   `json:"ok"`
+	Records int    `json:"records"`
+	Head    string `json:"head,omitempty"`
+	// BrokenAt is the 1-based line where the chain first breaks, and
+	// Reason what is wrong there; 0 when only the anchor disagrees.
+	BrokenAt int     `json:"broken_at,omitempty"`
+	Reason   string  `json:"reason,omitempty"`
+	Anchor   *Anchor `json:"anchor,omitempty"`
+}
+
+// Verify checks every record's sequence number, link and signature, and
+// the log against the last anchor.
+func (l *Log) Verify() (Verification, error) {
+	_, v, err := l.read()
+	return v, err
+}
+
+// read returns every record the log holds, and the verification of the
+// chain. Records past a break are returned too: they are what the file
+// says, which is worth seeing, but nothing vouches for them.
+func (l *Log) read() ([]Record, Verification, error) {
+	v := Verification{OK: true}
+	var a Anchor
+	switch err := statefile.Load(l.cfg.AnchorPath, anchorSchema, &a); {
+	case err == nil:
+		v.Anchor = &a
+	case !statefile.Fresh(err):
+		return nil, v, err
+	}
+
+	f, err := os.Open(l.cfg.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		l.checkAnchor(&v, nil)
+		return nil, v, nil
+	}
+	if err != nil {
+		return nil, v, err
+	}
+	defer f.Close()
+
+	var (
+		recs []Record
+		line int
+		prev string
+	)
+	brk := func(reason string) {
+		if v.OK {
+			v.OK, v.BrokenAt, v.Reason = false, line, reason
+		}
+	}
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64<<10), 1<<20)
+	for sc.Scan() {
+		line++
+		var rec Record
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			brk("not a record: " + err.Error())
+			continue
+		}
+		switch {
+		case rec.Seq != uint64(line):
+			brk(fmt.Sprintf("sequence %d, want %d", rec.Seq, line))
+		case rec.Prev != prev:
+			brk("does not link to the record before it")
+		case !hmac.Equal([]byte(rec.Hash), []byte(l.sign(rec))):
+			brk("signature does not match")
+		}
+		recs = append(recs, rec)
+		prev = rec.Hash
+	}
+	if err := sc.Err(); err != nil {
+		return nil, v, err
+	}
+	v.Records = line
+	if v.OK {
+		l.checkAnchor(&v, recs)
+	}
+	if n := len(recs); n > 0 {
+		v.Head = recs[n-1].Hash
+	}
+	return recs, v, nil
+}
+
+// checkAnchor holds an intact chain against the anchor: the anchored
+// record must still be there with the anchored hash.
+func (l *Log) checkAnchor(v *Verification, recs []Record) {
+	a := v.Anchor
+	if a == nil || a.Seq == 0 {
+		return
+	}
+	if uint64(len(recs)) < a.Seq {
+		v.OK, v.Reason = false, fmt.Sprintf("log ends at record %d but record %d was anchored at %s: truncated",
+			len(recs), a.Seq, a.Time.Format(time.RFC3339))
+		return
+	}
+	if recs[a.Seq-1].Hash != a.Hash {
+		v.OK, v.Reason = false, fmt.Sprintf("record %d differs from its anchor of %s", a.Seq, a.Time.Format(time.RFC3339))
+	}
+}
+
+// ─── Anchoring ───────────────────────────────────────────────────────────────
+
+// Start anchors the head now and then every anchorInterval, until ctx
+// ends.
+func (l *Log) Start(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	l.anchor(ctx)
+	ticker := time.NewTicker(anchorInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			l.anchor(context.Background())
+			return nil
+		case <-ticker.C:
+			l.anchor(ctx)
+		}
+	}
+}
+
+// anchor writes the head to the anchor file, and reports it, if it moved
+// since the last anchor.
+func (l *Log) anchor(ctx context.Context) {
+	l.mu.Lock()
+	a := Anchor{Seq: l.seq, Hash: l.head, Time: l.now().UTC()}
+	moved := l.seq != l.anchored
+	l.mu.Unlock()
+	if !moved {
+		return
+	}
+	if err := statefile.Save(l.cfg.AnchorPath, anchorSchema, a); err != nil {
+		slog.Warn("audit: could not anchor the security trail", "err", err)
+		return
+	}
+	l.mu.Lock()
+	l.anchored = a.Seq
+	l.mu.Unlock()
+	if l.cfg.Report != nil {
+		if err := l.cfg.Report(ctx, a); err != nil {
+			slog.Warn("audit: could not report the anchor", "err", err)
+		}
+	}
+}
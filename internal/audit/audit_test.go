@@ -0,0 +1,261 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testConfig(t *testing.T) Config {
+	dir := t.TempDir()
+	return Config{
+		Path:       filepath.Join(dir, logName),
+		KeyPath:    filepath.Join(dir, "audit.key"),
+		AnchorPath: filepath.Join(dir, "audit-anchor.json"),
+	}
+}
+
+func newLog(t *testing.T, cfg Config) *Log {
+	t.Helper()
+	l, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func appendN(t *testing.T, l *Log, n int) {
+	t.Helper()
+	for i := range n {
+		if err := l.Append(Record{Actor: "socket", Action: "files.delete", Target: "/api/delete?path=/f" + string(rune('a'+i)), Outcome: OutcomeOK, Status: 200}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// rewrite replaces the log's lines with edit's result.
+func rewrite(t *testing.T, path string, edit func(lines [][]byte) [][]byte) {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := edit(bytes.Split(bytes.TrimSuffix(b, []byte("\n")), []byte("\n")))
+	if err := os.WriteFile(path, append(bytes.Join(lines, []byte("\n")), '\n'), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerify_DetectsTamperedMiddleRecord(t *testing.T) {
+	cfg := testConfig(t)
+	l := newLog(t, cfg)
+	appendN(t, l, 5)
+	if v, err := l.Verify(); err != nil || !v.OK || v.Records != 5 {
+		t.Fatalf("intact log: %+v %v", v, err)
+	}
+	orig, _ := os.ReadFile(cfg.Path)
+
+	for _, tt := range []struct {
+		name   string
+		edit   func([][]byte) [][]byte
+		line   int
+		reason string
+	}{
+		{"edited", func(lines [][]byte) [][]byte {
+			lines[2] = bytes.Replace(lines[2], []byte("/fc"), []byte("/fz"), 1)
+			return lines
+		}, 3, "signature"},
+		{"re-signed without the key", func(lines [][]byte) [][]byte {
+			var rec Record
+			json.Unmarshal(lines[2], &rec)
+			rec.Outcome = OutcomeDenied
+			forged := &Log{key: []byte("not the key")}
+			rec.Hash = forged.sign(rec)
+			lines[2], _ = json.Marshal(rec)
+			return lines
+		}, 3, "signature"},
+		{"dropped", func(lines [][]byte) [][]byte {
+			return append(lines[:2:2], lines[3:]...)
+		}, 3, "sequence"},
+		{"garbled", func(lines [][]byte) [][]byte {
+			lines[1] = []byte("{")
+			return lines
+		}, 2, "not a record"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			os.WriteFile(cfg.Path, orig, 0o600)
+			rewrite(t, cfg.Path, tt.edit)
+			v, err := l.Verify()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v.OK || v.BrokenAt != tt.line || !strings.Contains(v.Reason, tt.reason) {
+				t.Errorf("verification = %+v, want broken at line %d (%s)", v, tt.line, tt.reason)
+			}
+		})
+	}
+}
+
+func TestNew_ContinuesChain(t *testing.T) {
+	cfg := testConfig(t)
+	appendN(t, newLog(t, cfg), 2)
+	l := newLog(t, cfg)
+	appendN(t, l, 2)
+	if v, err := l.Verify(); err != nil || !v.OK || v.Records != 4 {
+		t.Fatalf("verification = %+v %v", v, err)
+	}
+
+	// Another key can't extend the chain.
+	os.WriteFile(cfg.KeyPath, []byte(strings.Repeat("ab", keySize)), 0o600)
+	if v, _ := newLog(t, cfg).Verify(); v.OK || v.BrokenAt != 1 {
+		t.Errorf("verification under another key = %+v", v)
+	}
+}
+
+func TestVerify_DetectsTruncationAgainstAnchor(t *testing.T) {
+	cfg := testConfig(t)
+	var reported []Anchor
+	cfg.Report = func(_ context.Context, a Anchor) error {
+		reported = append(reported, a)
+		return nil
+	}
+	l := newLog(t, cfg)
+	appendN(t, l, 3)
+	l.anchor(context.Background())
+	l.anchor(context.Background()) // nothing new: not written or reported again
+	if len(reported) != 1 || reported[0].Seq != 3 || reported[0].Hash != l.head {
+		t.Fatalf("reported = %+v", reported)
+	}
+	if v, _ := l.Verify(); !v.OK || v.Anchor == nil || v.Anchor.Seq != 3 {
+		t.Fatalf("verification = %+v", v)
+	}
+
+	// Dropping the tail leaves an intact chain; only the anchor knows.
+	rewrite(t, cfg.Path, func(lines [][]byte) [][]byte { return lines[:2] })
+	if v, _ := l.Verify(); v.OK || !strings.Contains(v.Reason, "truncated") {
+		t.Errorf("truncated log: %+v", v)
+	}
+	os.Remove(cfg.Path)
+	if v, _ := l.Verify(); v.OK {
+		t.Errorf("removed log verifies: %+v", v)
+	}
+}
+
+func TestMiddleware_RecordsSecurityActions(t *testing.T) {
+	l := newLog(t, testConfig(t))
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/router/block", func(w http.ResponseWriter, r *http.Request) {
+		Target(r.Context(), "mac=aa:bb:cc:dd:ee:ff block=true")
+	})
+	mux.HandleFunc("DELETE /api/share/{token}", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+	})
+	mux.HandleFunc("/dav/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("POST /api/mkdir", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("GET /api/files", func(w http.ResponseWriter, r *http.Request) {})
+
+	var patterns []string
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l.Middleware(mux).ServeHTTP(w, r)
+		patterns = append(patterns, r.Pattern)
+	})
+	do := func(method, target, remote string) {
+		r := httptest.NewRequest(method, target, nil)
+		r.RemoteAddr = remote
+		h.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	do("POST", "/api/router/block", "192.168.100.23:50000")
+	do("DELETE", "/api/share/0123456789abcdef", "8.8.8.8:443")
+	do("DELETE", "/dav/photos/a.jpg", "@")
+	do("POST", "/api/mkdir?path=/x", "127.0.0.1:1")
+	do("GET", "/api/files", "127.0.0.1:1")
+
+	if patterns[0] != "POST /api/router/block" || patterns[4] != "GET /api/files" {
+		t.Errorf("route not passed back out: %q", patterns)
+	}
+	recs, v, err := l.read()
+	if err != nil || !v.OK {
+		t.Fatalf("%+v %v", v, err)
+	}
+	want := []Record{
+		{Actor: "lan:192.168.100.23", Action: "router.block", Target: "mac=aa:bb:cc:dd:ee:ff block=true", Outcome: OutcomeOK, Status: 200},
+		{Actor: "remote:8.8.8.8", Action: "files.share.revoke", Target: "/api/share/012345…", Outcome: OutcomeDenied, Status: 403},
+		{Actor: "socket", Action: "files.dav.delete", Target: "/dav/photos/a.jpg", Outcome: OutcomeOK, Status: 204},
+	}
+	if len(recs) != len(want) {
+		t.Fatalf("%d records, want %d: %+v", len(recs), len(want), recs)
+	}
+	for i, w := range want {
+		got := recs[i]
+		if got.Actor != w.Actor || got.Action != w.Action || got.Target != w.Target || got.Outcome != w.Outcome || got.Status != w.Status {
+			t.Errorf("record %d = %+v, want %+v", i+1, got, w)
+		}
+	}
+}
+
+func TestHandleList_Filters(t *testing.T) {
+	l := newLog(t, testConfig(t))
+	now := time.Now().UTC()
+	for _, rec := range []Record{
+		{Time: now.Add(-48 * time.Hour), Actor: "lan:192.168.100.23", Action: "files.delete"},
+		{Time: now.Add(-time.Hour), Actor: "tunnel", Action: "files.share.create"},
+		{Time: now.Add(-time.Minute), Actor: "lan:192.168.100.40", Action: "wifi.config"},
+		{Time: now, Actor: "lan:192.168.100.23", Action: "files.move"},
+	} {
+		if err := l.Append(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mux := http.NewServeMux()
+	l.RegisterRoutes(mux)
+	get := func(query string) (int, []string) {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", "/api/system/audit/security?"+query, nil))
+		var resp struct {
+			Verification Verification `json:"verification"`
+			Records      []Record     `json:"records"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		if w.Code == http.StatusOK && !resp.Verification.OK {
+			t.Errorf("%s: verification = %+v", query, resp.Verification)
+		}
+		var got []string
+		for _, rec := range resp.Records {
+			got = append(got, rec.Action)
+		}
+		return w.Code, got
+	}
+
+	since := now.Add(-2 * time.Hour).Format(time.RFC3339)
+	for _, tt := range []struct {
+		query string
+		want  string
+	}{
+		{"", "files.move wifi.config files.share.create files.delete"},
+		{"actor=lan", "files.move wifi.config files.delete"},
+		{"actor=lan:192.168.100.23&action=files", "files.move files.delete"},
+		{"action=files.share", "files.share.create"},
+		{"action=file", ""},
+		{"since=" + since, "files.move wifi.config files.share.create"},
+		{"limit=1", "files.move"},
+	} {
+		code, got := get(tt.query)
+		if code != http.StatusOK || strings.Join(got, " ") != tt.want {
+			t.Errorf("%q: %d %v, want %s", tt.query, code, got, tt.want)
+		}
+	}
+	for _, q := range []string{"since=yesterday", "limit=0", "limit=5000"} {
+		if code, _ := get(q); code != http.StatusBadRequest {
+			t.Errorf("%q: %d, want 400", q, code)
+		}
+	}
+}
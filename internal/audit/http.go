@@ -0,0 +1,85 @@
+package audit
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/httputil"
+)
+
+const (
+	defaultLimit = 100
+	maxLimit     = 1000
+)
+
+func (l *Log) RegisterRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/system/audit/security", l.handleList)
+}
+
+// Query filters the records of GET /api/system/audit/security.
+type Query struct {
+	Actor  string    // "lan" matches "lan:192.168.100.23"
+	Action string    // "files" matches "files.delete"
+	Since  time.Time // zero: all
+	Limit  int
+}
+
+// matches reports whether v is q or starts with q and a separator.
+func matches(v, q string) bool {
+	return q == "" || v == q || strings.HasPrefix(v, q+".") || strings.HasPrefix(v, q+":")
+}
+
+// filter returns the records matching q, newest first.
+func filter(recs []Record, q Query) []Record {
+	out := []Record{}
+	for i := len(recs) - 1; i >= 0 && len(out) < q.Limit; i-- {
+		rec := recs[i]
+		if matches(rec.Actor, q.Actor) && matches(rec.Action, q.Action) && !rec.Time.Before(q.Since) {
+			out = append(out, rec)
+		}
+	}
+	return out
+}
+
+// handleList returns the matching records, newest first, and whether the
+// chain verifies.
+// GET /api/system/audit/security?actor=lan&action=files&since=2026-10-01T00:00:00Z&limit=100
+func (l *Log) handleList(w http.ResponseWriter, r *http.Request) {
+	if l == nil {
+		httputil.Error(w, http.StatusServiceUnavailable, "the audit trail is unavailable; see the agent log")
+		return
+	}
+	q := Query{
+		Actor:  r.URL.Query().Get("actor"),
+		Action: r.URL.Query().Get("action"),
+		Limit:  defaultLimit,
+	}
+	if s := r.URL.Query().Get("since"); s != "" {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			httputil.BadRequest(w, "since must be an RFC 3339 time, e.g. 2026-10-01T00:00:00Z")
+			return
+		}
+		q.Since = t
+	}
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxLimit {
+			httputil.BadRequest(w, "limit must be between 1 and "+strconv.Itoa(maxLimit))
+			return
+		}
+		q.Limit = n
+	}
+
+	recs, v, err := l.read()
+	if err != nil {
+		httputil.InternalError(w, err.Error())
+		return
+	}
+	httputil.OK(w, map[string]any{
+		"verification": v,
+		"records":      filter(recs, q),
+	})
+}
@@ -0,0 +1,187 @@
+package audit
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// SecurityActions are the routes recorded, by the pattern the mux
+// matched. Patterns without a method, like WebDAV's, are looked up as
+// "METHOD pattern".
+var SecurityActions = map[string]string{
+	"POST /api/wifi/config":                   "wifi.config",
+	"POST /api/wifi/stop":                     "wifi.stop",
+	"POST /api/vpn/config":                    "vpn.config",
+	"POST /api/vpn/stop":                      "vpn.stop",
+	"POST /api/adblock/config":                "adblock.config",
+	"POST /api/adblock/import/pihole":         "adblock.import",
+	"POST /api/adblock/import/adguard":        "adblock.import",
+	"POST /api/adblock/split-dns":             "adblock.split_dns",
+	"POST /api/router/config":                 "router.config",
+	"POST /api/router/block":                  "router.block",
+	"POST /api/router/schedule":               "router.schedule.set",
+	"DELETE /api/router/schedule":             "router.schedule.remove",
+	"POST /api/router/limit":                  "router.limit.set",
+	"DELETE /api/router/limit":                "router.limit.remove",
+	"POST /api/system/maintenance-mode":       "system.maintenance",
+	"POST /api/system/telemetry":              "system.telemetry",
+	"POST /api/agent/services/{name}/restart": "agent.restart",
+	"POST /api/config/reload":                 "config.reload",
+	"POST /api/auth/pair":                     "auth.pair",
+	"POST /api/auth/rotate":                   "auth.rotate",
+	"POST /api/tunnel/proxies":                "tunnel.proxies",
+	"DELETE /api/delete":                      "files.delete",
+	"POST /api/move":                          "files.move",
+	"POST /api/trash/empty":                   "files.trash.empty",
+	"DELETE /api/trash":                       "files.trash.delete",
+	"POST /api/share":                         "files.share.create",
+	"DELETE /api/share/{token}":               "files.share.revoke",
+	"POST /api/share/upload-link":             "files.upload_link.create",
+	"DELETE /api/share/upload-link/{id}":      "files.upload_link.revoke",
+	"POST /u/{token}":                         "files.upload_link.upload",
+	"POST /api/files/layout":                  "files.layout",
+	"POST /api/files/layout/users":            "files.layout.users",
+	"POST /api/files/adopt-layout":            "files.layout.adopt",
+	"POST /api/storage/attach":                "storage.attach",
+	"DELETE /api/storage/attach/{name}":       "storage.detach",
+	"DELETE /dav/":                            "files.dav.delete",
+	"MOVE /dav/":                              "files.dav.move",
+}
+
+type ctxKey struct{}
+
+// note is what a handler adds to its request's record.
+type note struct{ target string }
+
+// Target sets what the request acted on, in place of its URL.
+func Target(ctx context.Context, target string) {
+	if n, _ := ctx.Value(ctxKey{}).(*note); n != nil {
+		n.target = target
+	}
+}
+
+// statusWriter records the status.
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *statusWriter) ReadFrom(src io.Reader) (int64, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	return io.Copy(w.ResponseWriter, src)
+}
+
+// Unwrap lets http.ResponseController reach the connection's writer.
+func (w *statusWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+// Middleware records the requests whose route is in Config.Actions once
+// they are answered. Reads pass straight through. It has to wrap the mux
+// to see the route; the route is copied back onto the request it was
+// given, for middlewares around it that read it too.
+func (l *Log) Middleware(next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, "PROPFIND":
+			next.ServeHTTP(w, r)
+			return
+		}
+		n := &note{}
+		sw := &statusWriter{ResponseWriter: w}
+		rr := r.WithContext(context.WithValue(r.Context(), ctxKey{}, n))
+		next.ServeHTTP(sw, rr)
+		r.Pattern = rr.Pattern
+
+		action, ok := l.cfg.Actions[rr.Pattern]
+		if !ok {
+			action, ok = l.cfg.Actions[rr.Method+" "+rr.Pattern]
+		}
+		if !ok {
+			return
+		}
+		code := sw.code
+		if code == 0 {
+			code = http.StatusOK
+		}
+		rec := Record{
+			Actor:   l.actor(r),
+			Action:  action,
+			Method:  r.Method,
+			Route:   rr.Pattern,
+			Target:  n.target,
+			Outcome: outcome(code),
+			Status:  code,
+		}
+		if rec.Target == "" {
+			rec.Target = target(rr)
+		}
+		if err := l.Append(rec); err != nil {
+			slog.Error("audit: could not record", "action", action, "err", err)
+		}
+	})
+}
+
+// actor is where r came from: "socket" for the strct CLI on the admin
+// socket, "tunnel", "local", or "lan:" or "remote:" and the address.
+// The API has no accounts; the connection is all there is to go by.
+func (l *Log) actor(r *http.Request) string {
+	if l.cfg.FromTunnel != nil && l.cfg.FromTunnel(r) {
+		return "tunnel"
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return "socket"
+	}
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		return "unknown"
+	case ip.IsLoopback():
+		return "local"
+	case ip.IsPrivate() || ip.IsLinkLocalUnicast():
+		return "lan:" + host
+	}
+	return "remote:" + host
+}
+
+// target is the request's URL with a share token cut short: the record
+// should say which share, not hand out the link.
+func target(r *http.Request) string {
+	t := r.URL.RequestURI()
+	if tok := r.PathValue("token"); len(tok) > 6 {
+		t = strings.Replace(t, tok, tok[:6]+"…", 1)
+	}
+	return t
+}
+
+func outcome(code int) string {
+	switch {
+	case code == http.StatusUnauthorized || code == http.StatusForbidden:
+		return OutcomeDenied
+	case code >= 400:
+		return OutcomeFailed
+	}
+	return OutcomeOK
+}
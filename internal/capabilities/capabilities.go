@@ -0,0 +1,452 @@
+// Package capabilities tells the portal what this device can do, so it
+// hides what doesn't apply instead of showing buttons that 501: a second
+// radio, tailscale, a data drive, root.
+//
+//	GET /api/capabilities
+//
+// The document is a compatibility surface. Capability names and fields
+// are never renamed or removed; a new capability is added with a new
+// name, and a breaking change bumps Schema. testdata/document.golden
+// holds its shape, and a test fails when the JSON drifts from it.
+//
+// Probing looks at the machine, as wifi.Detect and disk.Detect do: what
+// is installed, what the kernel has, what hardware is plugged in. It runs
+// at Start, every probeEvery and on Refresh, and the result is cached.
+// Whether a feature is switched on is read from the features for each
+// document, so it is never stale.
+package capabilities
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/config"
+	"github.com/strct-org/strct-agent/internal/events"
+	"github.com/strct-org/strct-agent/internal/platform/disk"
+	"github.com/strct-org/strct-agent/internal/platform/wifi"
+)
+
+const (
+	// Schema is the document's version; bump it only for a change that
+	// breaks a reader, never for an added capability.
+	Schema = 1
+
+	// APIVersion is the versioned API prefix, /api/v1/.
+	APIVersion = "v1"
+
+	probeEvery = 5 * time.Minute
+)
+
+// Capability names, the keys of Document.Capabilities. Features use them
+// in EnabledCapabilities.
+const (
+	WiFi           = "wifi"
+	AccessPoint    = "access_point"
+	SecondRadio    = "second_radio"
+	DataDrive      = "data_drive"
+	VPN            = "vpn"
+	Adblock        = "adblock"
+	TrafficShaping = "traffic_shaping"
+	SMART          = "smart"
+	Antivirus      = "antivirus"
+	Docker         = "docker"
+	Privileged     = "privileged"
+)
+
+// Names are the capabilities, in document order.
+var Names = []string{WiFi, AccessPoint, SecondRadio, DataDrive, VPN, Adblock, TrafficShaping, SMART, Antivirus, Docker, Privileged}
+
+// Capability is one thing the device can or can't do. Enabled is whether
+// it is switched on; one with nothing to switch, smartctl being
+// installed say, is enabled whenever it is supported.
+type Capability struct {
+	Supported bool   `json:"supported"`
+	Enabled   bool   `json:"enabled"`
+	Reason    string `json:"reason,omitempty"` // why not, when unsupported
+}
+
+// Document is GET /api/capabilities.
+type Document struct {
+	Schema       int                   `json:"schema"`
+	APIVersion   string                `json:"api_version"`
+	AgentVersion string                `json:"agent_version"`
+	ProbedAt     time.Time             `json:"probed_at"` // when the probes last ran
+	Capabilities map[string]Capability `json:"capabilities"`
+}
+
+// Hash sums what the device supports and has switched on, for peers to
+// tell whether the document changed without fetching it. Reasons and the
+// probe time are left out.
+func (d Document) Hash() string {
+	h := sha256.New()
+	for _, name := range Names {
+		c := d.Capabilities[name]
+		fmt.Fprintf(h, "%s=%t,%t\n", name, c.Supported, c.Enabled)
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// Source is a feature that says which capabilities it has switched on,
+// by name.
+type Source interface {
+	EnabledCapabilities() map[string]bool
+}
+
+// Env is what probing looks at.
+type Env struct {
+	LookPath    func(file string) (string, error)
+	SysClassNet string                 // normally /sys/class/net
+	IWList      func() ([]byte, error) // `iw list`
+	ListDrives  func() ([]disk.Drive, error)
+	// OnSystemDisk reports whether path is on the root filesystem.
+	OnSystemDisk func(path string) bool
+	ProcModules  string // loaded modules, normally /proc/modules
+	// ModulesDir holds a directory per kernel release with modules.dep
+	// and modules.builtin, normally /lib/modules.
+	ModulesDir   string
+	OSRelease    string // the running kernel's release, normally /proc/sys/kernel/osrelease
+	ClamdSocket  string
+	DockerSocket string
+	Geteuid      func() int
+}
+
+// SystemEnv is this machine.
+func SystemEnv() Env {
+	return Env{
+		LookPath:    exec.LookPath,
+		SysClassNet: "/sys/class/net",
+		IWList:      func() ([]byte, error) { return exec.Command("iw", "list").Output() },
+		ListDrives:  disk.ListDrives,
+		OnSystemDisk: func(path string) bool {
+			same, err := disk.SameDevice(path, "/")
+			return err == nil && same
+		},
+		ProcModules:  "/proc/modules",
+		ModulesDir:   "/lib/modules",
+		OSRelease:    "/proc/sys/kernel/osrelease",
+		ClamdSocket:  "/run/clamav/clamd.ctl",
+		DockerSocket: "/var/run/docker.sock",
+		Geteuid:      os.Geteuid,
+	}
+}
+
+type Config struct {
+	Version string // the agent's release
+	// DataDir is the cloud's; data_drive is enabled when it is on a
+	// drive of its own.
+	DataDir string
+	Env     Env
+	Sources []Source
+	// Events hears capabilities.changed when a probe's result changes;
+	// nil is events.Discard.
+	Events events.Publisher
+}
+
+// Service probes and serves the document. Safe for concurrent use.
+type Service struct {
+	cfg     Config
+	now     func() time.Time
+	refresh chan struct{}
+
+	mu       sync.Mutex
+	probed   map[string]Capability // Enabled unset
+	probedAt time.Time
+}
+
+func New(cfg Config) *Service {
+	if cfg.Events == nil {
+		cfg.Events = events.Discard
+	}
+	return &Service{cfg: cfg, now: time.Now, refresh: make(chan struct{}, 1)}
+}
+
+// NewFromConfig probes this machine, with the agent's features as
+// sources.
+func NewFromConfig(cfg *config.Config, version string, pub events.Publisher, sources ...Source) *Service {
+	return New(Config{Version: version, DataDir: cfg.DataDir, Env: SystemEnv(), Sources: sources, Events: pub})
+}
+
+// Start probes, then probes again every probeEvery and on Refresh, until
+// ctx is done.
+func (s *Service) Start(ctx context.Context) error {
+	s.probe()
+	go func() {
+		t := time.NewTicker(probeEvery)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			case <-s.refresh:
+			}
+			s.probe()
+		}
+	}()
+	return nil
+}
+
+// Refresh asks for the probes to run again soon, as after the WiFi
+// config was applied.
+func (s *Service) Refresh() {
+	select {
+	case s.refresh <- struct{}{}:
+	default: // one is pending
+	}
+}
+
+// Document is the cached probes with what the sources have switched on.
+func (s *Service) Document() Document {
+	s.mu.Lock()
+	probed, at := s.probed, s.probedAt
+	s.mu.Unlock()
+	if probed == nil {
+		probed = unprobed()
+	}
+
+	enabled := map[string]bool{}
+	for _, src := range s.cfg.Sources {
+		for name, on := range src.EnabledCapabilities() {
+			enabled[name] = enabled[name] || on
+		}
+	}
+	doc := Document{
+		Schema:       Schema,
+		APIVersion:   APIVersion,
+		AgentVersion: s.cfg.Version,
+		ProbedAt:     at,
+		Capabilities: make(map[string]Capability, len(probed)),
+	}
+	for name, c := range probed {
+		if c.Supported {
+			switch name {
+			case WiFi, AccessPoint, SecondRadio, VPN, Adblock:
+				c.Enabled = enabled[name]
+			case DataDrive:
+				c.Enabled = s.cfg.DataDir != "" && !s.cfg.Env.OnSystemDisk(s.cfg.DataDir)
+			default:
+				c.Enabled = true
+			}
+		}
+		doc.Capabilities[name] = c
+	}
+	return doc
+}
+
+// unprobed is the probes' result before they first ran: nothing
+// supported.
+func unprobed() map[string]Capability {
+	m := make(map[string]Capability, len(Names))
+	for _, name := range Names {
+		m[name] = Capability{Reason: "not probed yet"}
+	}
+	return m
+}
+
+// probe runs the probes and caches the result, logging and publishing
+// what changed since the last run.
+func (s *Service) probe() {
+	got := Probe(s.cfg.Env)
+	now := s.now().UTC()
+
+	s.mu.Lock()
+	prev := s.probed
+	s.probed, s.probedAt = got, now
+	s.mu.Unlock()
+
+	if prev == nil {
+		slog.Info("capabilities: probed", "supported", supportedNames(got))
+		return
+	}
+	var changed []string
+	for _, name := range Names {
+		if prev[name] != got[name] {
+			changed = append(changed, name)
+		}
+	}
+	if len(changed) > 0 {
+		slog.Info("capabilities: changed", "capabilities", changed, "supported", supportedNames(got))
+		s.cfg.Events.Publish(events.CapabilitiesChanged, s.Document())
+	}
+}
+
+func supportedNames(m map[string]Capability) []string {
+	var names []string
+	for _, name := range Names {
+		if m[name].Supported {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// ─── Probes ──────────────────────────────────────────────────────────────────
+
+// Probe reports, for every name in Names, whether env supports it and
+// why not. Enabled is left unset.
+func Probe(env Env) map[string]Capability {
+	m := make(map[string]Capability, len(Names))
+	set := func(name string, err error) {
+		if err != nil {
+			m[name] = Capability{Reason: err.Error()}
+		} else {
+			m[name] = Capability{Supported: true}
+		}
+	}
+
+	wifiErr := probeWiFi(env)
+	set(WiFi, wifiErr)
+	apErr, radioErr := wifiErr, wifiErr
+	if wifiErr == nil {
+		apErr, radioErr = probeAccessPoint(env), probeSecondRadio(env)
+	}
+	set(AccessPoint, apErr)
+	set(SecondRadio, radioErr)
+	set(DataDrive, disk.Detect(env.LookPath, env.ListDrives))
+	set(VPN, probeVPN(env))
+	set(Adblock, needTools(env, "dnsmasq"))
+	set(TrafficShaping, probeTrafficShaping(env))
+	set(SMART, needTools(env, "smartctl"))
+	set(Antivirus, probeDaemon(env, "clamd", env.ClamdSocket))
+	set(Docker, probeDaemon(env, "docker", env.DockerSocket))
+	set(Privileged, probePrivileged(env))
+	return m
+}
+
+func probeWiFi(env Env) error {
+	_, err := wifi.Detect(wifi.Env{SysClassNet: env.SysClassNet, LookPath: env.LookPath})
+	return err
+}
+
+// probeAccessPoint is whether router and extender mode can run: hostapd
+// and a radio that can be an AP.
+func probeAccessPoint(env Env) error {
+	if err := needTools(env, "hostapd", "dnsmasq"); err != nil {
+		return err
+	}
+	out, err := env.IWList()
+	if err != nil {
+		return fmt.Errorf("iw list: %w", err)
+	}
+	if !wifi.SupportsAP(out) {
+		return fmt.Errorf("the WiFi radio does not support AP mode")
+	}
+	return nil
+}
+
+// probeSecondRadio is whether extender mode can run its AP on a radio of
+// its own, wlan1, instead of a virtual interface sharing wlan0's.
+func probeSecondRadio(env Env) error {
+	_, radios, err := wifi.Wireless(env.SysClassNet)
+	if err != nil {
+		return err
+	}
+	if radios < 2 {
+		return fmt.Errorf("one WiFi radio; a USB WiFi adapter adds a second")
+	}
+	return nil
+}
+
+func probeVPN(env Env) error {
+	if err := needTools(env, "tailscale", "tailscaled"); err != nil {
+		return err
+	}
+	return needModules(env, "tun")
+}
+
+func probeTrafficShaping(env Env) error {
+	if err := needTools(env, "tc"); err != nil {
+		return err
+	}
+	return needModules(env, "sch_htb")
+}
+
+// probeDaemon is whether name is installed and running, by its socket.
+func probeDaemon(env Env, name, socket string) error {
+	if err := needTools(env, name); err != nil {
+		return err
+	}
+	if _, err := os.Stat(socket); err != nil {
+		return fmt.Errorf("%s is not running: no socket at %s", name, socket)
+	}
+	return nil
+}
+
+func probePrivileged(env Env) error {
+	if uid := env.Geteuid(); uid != 0 {
+		return fmt.Errorf("running as uid %d; WiFi, the firewall and mounting drives need root", uid)
+	}
+	return nil
+}
+
+func needTools(env Env, tools ...string) error {
+	for _, tool := range tools {
+		if _, err := env.LookPath(tool); err != nil {
+			return fmt.Errorf("%s not installed", tool)
+		}
+	}
+	return nil
+}
+
+// needModules fails unless each kernel module is loaded, built in, or
+// can be loaded.
+func needModules(env Env, modules ...string) error {
+	have := kernelModules(env)
+	for _, mod := range modules {
+		if !have[mod] {
+			return fmt.Errorf("kernel module %s not available", mod)
+		}
+	}
+	return nil
+}
+
+// kernelModules are the names of the modules in /proc/modules and the
+// running release's modules.builtin and modules.dep, with dashes as
+// underscores, as modprobe treats them.
+func kernelModules(env Env) map[string]bool {
+	have := map[string]bool{}
+	if data, err := os.ReadFile(env.ProcModules); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			if f := strings.Fields(line); len(f) > 0 {
+				have[moduleName(f[0])] = true
+			}
+		}
+	}
+	release, err := os.ReadFile(env.OSRelease)
+	if err != nil {
+		return have
+	}
+	dir := filepath.Join(env.ModulesDir, strings.TrimSpace(string(release)))
+	for _, list := range []string{"modules.builtin", "modules.dep"} {
+		data, err := os.ReadFile(filepath.Join(dir, list))
+		if err != nil {
+			continue
+		}
+		sc := bufio.NewScanner(bytes.NewReader(data))
+		for sc.Scan() {
+			// kernel/net/sched/sch_htb.ko.xz: kernel/net/sched/...
+			path, _, _ := strings.Cut(sc.Text(), ":")
+			name, ok := strings.CutSuffix(filepath.Base(path), ".ko")
+			if !ok {
+				name, _, ok = strings.Cut(filepath.Base(path), ".ko.")
+			}
+			if ok {
+				have[moduleName(name)] = true
+			}
+		}
+	}
+	return have
+}
+
+func moduleName(s string) string { return strings.ReplaceAll(s, "-", "_") }
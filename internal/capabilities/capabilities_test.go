@@ -0,0 +1,263 @@
+package capabilities
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/events"
+	"github.com/strct-org/strct-agent/internal/platform/disk"
+)
+
+var update = flag.Bool("update", false, "rewrite testdata/document.golden")
+
+const iwListAP = "Wiphy phy0\n\tSupported interface modes:\n\t\t * managed\n\t\t * AP\n"
+
+// fakeEnv is a device with everything but docker: two radios, a data
+// drive, tun loaded, sch_htb loadable, clamd running, root.
+func fakeEnv(t *testing.T) Env {
+	t.Helper()
+	dir := t.TempDir()
+	write := func(path, data string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	net := filepath.Join(dir, "net")
+	for iface, phy := range map[string]string{"wlan0": "phy0", "wlan1": "phy1"} {
+		if err := os.MkdirAll(filepath.Join(net, iface), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink("../../ieee80211/"+phy, filepath.Join(net, iface, "phy80211")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(filepath.Join(dir, "proc-modules"), "tun 49152 0 - Live 0x0000000000000000\n")
+	write(filepath.Join(dir, "osrelease"), "6.1.0-rockchip\n")
+	write(filepath.Join(dir, "modules", "6.1.0-rockchip", "modules.dep"),
+		"kernel/net/sched/sch_htb.ko.xz:\nkernel/net/sched/sch_prio.ko.xz:\n")
+	write(filepath.Join(dir, "clamd.ctl"), "")
+
+	missing := map[string]bool{"docker": true}
+	return Env{
+		LookPath: func(file string) (string, error) {
+			if missing[file] {
+				return "", exec.ErrNotFound
+			}
+			return "/usr/bin/" + file, nil
+		},
+		SysClassNet:  net,
+		IWList:       func() ([]byte, error) { return []byte(iwListAP), nil },
+		ListDrives:   func() ([]disk.Drive, error) { return []disk.Drive{{Path: "/dev/sda"}}, nil },
+		OnSystemDisk: func(string) bool { return false },
+		ProcModules:  filepath.Join(dir, "proc-modules"),
+		ModulesDir:   filepath.Join(dir, "modules"),
+		OSRelease:    filepath.Join(dir, "osrelease"),
+		ClamdSocket:  filepath.Join(dir, "clamd.ctl"),
+		DockerSocket: filepath.Join(dir, "docker.sock"),
+		Geteuid:      func() int { return 0 },
+	}
+}
+
+type source map[string]bool
+
+func (s source) EnabledCapabilities() map[string]bool { return s }
+
+// TestDocument_Contract locks the document's JSON: capability names and
+// field names are what portals gate on. A diff here is a breaking change
+// unless it only adds; run with -update only for that.
+func TestDocument_Contract(t *testing.T) {
+	s := New(Config{
+		Version: "1.4.0",
+		DataDir: "/mnt/data",
+		Env:     fakeEnv(t),
+		Sources: []Source{source{WiFi: true, AccessPoint: true, SecondRadio: false}, source{VPN: true}},
+	})
+	s.now = func() time.Time { return time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC) }
+	s.probe()
+
+	got, err := json.MarshalIndent(s.Document(), "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = append(got, '\n')
+	golden := filepath.Join("testdata", "document.golden")
+	if *update {
+		if err := os.WriteFile(golden, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("the document changed; fields and capability names are a compatibility surface.\ngot:\n%s\nwant:\n%s", got, want)
+	}
+
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(want, &doc); err != nil {
+		t.Fatal(err)
+	}
+	var caps map[string]Capability
+	if err := json.Unmarshal(doc["capabilities"], &caps); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range Names {
+		if _, ok := caps[name]; !ok {
+			t.Errorf("%s is not in the golden document", name)
+		}
+	}
+}
+
+func TestProbe_Reasons(t *testing.T) {
+	env := fakeEnv(t)
+	if got := Probe(env); !got[SecondRadio].Supported || !got[VPN].Supported || !got[TrafficShaping].Supported {
+		t.Fatalf("fake device: %+v", got)
+	}
+
+	if err := os.RemoveAll(filepath.Join(env.SysClassNet, "wlan1")); err != nil {
+		t.Fatal(err)
+	}
+	env.IWList = func() ([]byte, error) {
+		return []byte("Wiphy phy0\n\tSupported interface modes:\n\t\t * managed\n"), nil
+	}
+	env.ListDrives = func() ([]disk.Drive, error) { return []disk.Drive{{Path: "/dev/mmcblk0", System: true}}, nil }
+	if err := os.WriteFile(env.ProcModules, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(env.ClamdSocket); err != nil {
+		t.Fatal(err)
+	}
+	env.Geteuid = func() int { return 1000 }
+
+	got := Probe(env)
+	for name, want := range map[string]string{
+		AccessPoint: "the WiFi radio does not support AP mode",
+		SecondRadio: "one WiFi radio; a USB WiFi adapter adds a second",
+		DataDrive:   "no drive besides the system disk",
+		VPN:         "kernel module tun not available",
+		Antivirus:   "clamd is not running: no socket at " + env.ClamdSocket,
+		Docker:      "docker not installed",
+		Privileged:  "running as uid 1000; WiFi, the firewall and mounting drives need root",
+	} {
+		if c := got[name]; c.Supported || c.Reason != want {
+			t.Errorf("%s = %+v, want reason %q", name, c, want)
+		}
+	}
+	if !got[TrafficShaping].Supported {
+		t.Errorf("sch_htb in modules.dep: %+v", got[TrafficShaping])
+	}
+
+	// Without WiFi, neither AP nor second radio is asked about.
+	env.IWList = func() ([]byte, error) { return nil, errors.New("iw list called") }
+	if err := os.RemoveAll(env.SysClassNet); err != nil {
+		t.Fatal(err)
+	}
+	got = Probe(env)
+	if got[WiFi].Supported || got[AccessPoint].Reason != got[WiFi].Reason || got[SecondRadio].Reason != got[WiFi].Reason {
+		t.Errorf("no WiFi: %+v", got)
+	}
+}
+
+func TestDocument_EnabledFollowsSourcesAndSupport(t *testing.T) {
+	env := fakeEnv(t)
+	env.Geteuid = func() int { return 1000 }
+	vpn := source{VPN: false}
+	s := New(Config{Env: env, DataDir: "/", Sources: []Source{vpn, source{Adblock: true}}})
+	s.probe()
+
+	caps := s.Document().Capabilities
+	if caps[VPN].Enabled || !caps[Adblock].Enabled || caps[WiFi].Enabled {
+		t.Errorf("from sources: %+v", caps)
+	}
+	if !caps[SMART].Enabled || caps[Privileged].Enabled || caps[Docker].Enabled {
+		t.Errorf("nothing to switch: enabled when supported: %+v", caps)
+	}
+	vpn[VPN] = true
+	if !s.Document().Capabilities[VPN].Enabled {
+		t.Error("enabled was cached")
+	}
+
+	s.cfg.Env.OnSystemDisk = func(string) bool { return true }
+	if s.Document().Capabilities[DataDrive].Enabled {
+		t.Error("data_drive enabled with the data on the system disk")
+	}
+}
+
+func TestDocument_Hash(t *testing.T) {
+	d := exampleDocument
+	other := d
+	other.ProbedAt = d.ProbedAt.Add(time.Hour)
+	other.Capabilities = map[string]Capability{}
+	for name, c := range d.Capabilities {
+		c.Reason = "reworded"
+		other.Capabilities[name] = c
+	}
+	if d.Hash() != other.Hash() || len(d.Hash()) != 16 {
+		t.Errorf("hash %q changed with reasons and probe time: %q", d.Hash(), other.Hash())
+	}
+	other.Capabilities[VPN] = Capability{Supported: true, Enabled: true}
+	if d.Hash() == other.Hash() {
+		t.Error("hash did not change when the VPN was switched on")
+	}
+}
+
+func TestProbe_PublishesChanges(t *testing.T) {
+	bus := events.New()
+	sub := bus.Subscribe(4, events.CapabilitiesChanged)
+	defer sub.Close()
+	env := fakeEnv(t)
+	s := New(Config{Env: env, Events: bus})
+
+	if c := s.Document().Capabilities[WiFi]; c.Supported || c.Reason != "not probed yet" {
+		t.Errorf("before the first probe: %+v", c)
+	}
+	s.probe()
+	s.probe()
+	if len(sub.C) != 0 {
+		t.Fatalf("%d events without a change", len(sub.C))
+	}
+
+	// A USB dongle unplugged.
+	if err := os.RemoveAll(filepath.Join(env.SysClassNet, "wlan1")); err != nil {
+		t.Fatal(err)
+	}
+	s.probe()
+	e := <-sub.C
+	doc, ok := e.Payload.(Document)
+	if !ok || doc.Capabilities[SecondRadio].Supported {
+		t.Errorf("event = %+v", e)
+	}
+}
+
+func TestHandleCapabilities(t *testing.T) {
+	s := New(Config{Version: "1.4.0", Env: fakeEnv(t)})
+	mux := http.NewServeMux()
+	s.RegisterRoutes(mux)
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/api/capabilities?refresh=true", nil))
+	var doc Document
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("GET: %d %s", w.Code, w.Body)
+	}
+	if doc.ProbedAt.IsZero() || !doc.Capabilities[WiFi].Supported {
+		t.Errorf("refresh=true did not probe: %+v", doc)
+	}
+	if doc.APIVersion != "v1" || doc.AgentVersion != "1.4.0" || len(doc.Capabilities) != len(Names) {
+		t.Errorf("doc = %+v", doc)
+	}
+}
@@ -0,0 +1,43 @@
+package capabilities
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/apidoc"
+	"github.com/strct-org/strct-agent/internal/httputil"
+)
+
+// Example for /api/openapi.json.
+var exampleDocument = Document{
+	Schema:       Schema,
+	APIVersion:   APIVersion,
+	AgentVersion: "1.4.0",
+	ProbedAt:     time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC),
+	Capabilities: map[string]Capability{
+		WiFi:        {Supported: true, Enabled: true},
+		SecondRadio: {Reason: "one WiFi radio; a USB WiFi adapter adds a second"},
+		VPN:         {Supported: true},
+		Docker:      {Reason: "docker not installed"},
+	},
+}
+
+func (s *Service) RegisterRoutes(mux *http.ServeMux) {
+	apidoc.On(mux, "capabilities").Register("GET", "/api/capabilities", s.handleCapabilities, apidoc.RouteDoc{
+		Summary: "What this device supports and has switched on, for hiding what doesn't apply",
+		Description: "Every capability is always present. Names and fields are stable: new capabilities " +
+			"are added, none are renamed or removed. Probes are cached; refresh=true runs them again first.",
+		Query:    []apidoc.Param{{Name: "refresh", Description: "true to probe again before answering"}},
+		Response: exampleDocument,
+	})
+}
+
+// handleCapabilities serves the document.
+// GET /api/capabilities
+// GET /api/capabilities?refresh=true  probe again first, as after plugging in a drive
+func (s *Service) handleCapabilities(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("refresh") == "true" {
+		s.probe()
+	}
+	httputil.OK(w, s.Document())
+}
@@ -0,0 +1,195 @@
+// Package cli is the strct command: local administration of a running
+// agent from a shell on the device. It talks to the agent over its admin
+// socket (config.AdminSocket), which serves the same /api/v1 routes as
+// the HTTP API, so the CLI can do nothing the web UI cannot.
+//
+// The CLI is the agent binary itself: main hands over to Main when the
+// first argument is a command, or when the binary is invoked as "strct".
+package cli
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/strct-org/strct-agent/internal/config"
+	"github.com/strct-org/strct-agent/internal/platform/executil"
+)
+
+// command is one subcommand. run gets the positional arguments after the
+// command name.
+type command struct {
+	usage string
+	help  string
+	run   func(ctx context.Context, c *CLI, args []string) error
+}
+
+var commands = map[string]command{
+	"status":   {"status", "Agent health, storage and upload room", runStatus},
+	"overview": {"overview", "One screen of everything: storage, WiFi, ad blocking, tunnel", runOverview},
+	"files":    {"files ls [PATH] | files rm PATH...", "List a folder, or move files to the trash", runFiles},
+	"wifi":     {"wifi status | wifi apply", "Access point state, or re-apply the saved WiFi config", runWiFi},
+	"adblock":  {"adblock status | on | off | toggle", "Ad blocking state, or switch it", runAdblock},
+	"logs":     {"logs [tail] [-f] [-n N] [--level LEVEL]", "Recent agent log records; -f keeps following", runLogs},
+	"update":   {"update check", "Whether a newer agent release is published", runUpdate},
+
+	"migrate-legacy": {"migrate-legacy [--dry-run] [--legacy-dir DIR]", "Move a cloud-agent install onto this agent, once", runMigrate},
+}
+
+// order is the order commands are listed in the help.
+var order = []string{"status", "overview", "files", "wifi", "adblock", "logs", "update", "migrate-legacy"}
+
+// IsCommand reports whether args (os.Args[1:]) ask for the CLI rather
+// than the agent.
+func IsCommand(args []string) bool {
+	for _, a := range args {
+		if strings.HasPrefix(a, "-") {
+			continue
+		}
+		_, ok := commands[a]
+		return ok || a == "help"
+	}
+	return false
+}
+
+// CLI is one invocation. Stdout and Stderr are the process's in Main and
+// buffers in tests.
+type CLI struct {
+	Stdout, Stderr io.Writer
+	// Color allows ANSI colors; --no-color and --json turn them off.
+	Color bool
+
+	opts   options
+	client *client
+	// root and cmd are what migrate-legacy works on, which needs no
+	// agent: / and the real commands in Main.
+	root string
+	cmd  commander
+}
+
+type options struct {
+	json   bool
+	socket string
+	follow bool
+	lines  int
+	level  string
+
+	dryRun    bool
+	legacyDir string
+}
+
+// Main runs the CLI with os.Args[1:] and returns the exit code.
+func Main(args []string) int {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	c := &CLI{
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+		Color:  isTerminal(os.Stdout) && os.Getenv("NO_COLOR") == "",
+		root:   "/",
+		cmd:    executil.Real{},
+	}
+	return c.Run(ctx, args)
+}
+
+// Run parses args, runs the command and returns the exit code: 0 on
+// success, 1 if the command failed, 2 for bad usage.
+func (c *CLI) Run(ctx context.Context, args []string) int {
+	fs := flag.NewFlagSet("strct", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.BoolVar(&c.opts.json, "json", false, "")
+	dev := fs.Bool("dev", false, "")
+	noColor := fs.Bool("no-color", false, "")
+	fs.StringVar(&c.opts.socket, "socket", "", "")
+	fs.BoolVar(&c.opts.follow, "f", false, "")
+	fs.BoolVar(&c.opts.follow, "follow", false, "")
+	fs.IntVar(&c.opts.lines, "n", 50, "")
+	fs.StringVar(&c.opts.level, "level", "info", "")
+	fs.BoolVar(&c.opts.dryRun, "dry-run", false, "")
+	fs.StringVar(&c.opts.legacyDir, "legacy-dir", "", "")
+
+	pos, err := parseInterspersed(fs, args)
+	if err == flag.ErrHelp || (err == nil && (len(pos) == 0 || pos[0] == "help")) {
+		c.usage()
+		return 0
+	}
+	if err != nil {
+		fmt.Fprintf(c.Stderr, "strct: %v\n", err)
+		return 2
+	}
+	cmd, ok := commands[pos[0]]
+	if !ok {
+		fmt.Fprintf(c.Stderr, "strct: unknown command %q (see strct help)\n", pos[0])
+		return 2
+	}
+	if *noColor || c.opts.json {
+		c.Color = false
+	}
+	if c.opts.socket == "" {
+		c.opts.socket = config.AdminSocket(*dev)
+	}
+	c.client = newClient(c.opts.socket)
+
+	if err := cmd.run(ctx, c, pos[1:]); err != nil {
+		if u, ok := err.(usageError); ok {
+			fmt.Fprintf(c.Stderr, "strct: %s\nusage: strct %s\n", string(u), cmd.usage)
+			return 2
+		}
+		fmt.Fprintf(c.Stderr, "strct: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// usageError is a command called with the wrong arguments.
+type usageError string
+
+func (e usageError) Error() string { return string(e) }
+
+func (c *CLI) usage() {
+	w := c.Stdout
+	fmt.Fprintln(w, "Administer the strct agent running on this device.")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Usage: strct [--json] [--no-color] [--socket PATH] COMMAND")
+	fmt.Fprintln(w)
+	rows := make([][]cell, 0, len(order))
+	for _, name := range order {
+		rows = append(rows, []cell{plain("  " + commands[name].usage), plain(commands[name].help)})
+	}
+	c.table(nil, rows)
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "--json prints the API's response for scripts. The agent must be running;")
+	fmt.Fprintln(w, "its socket is "+config.AdminSocket(false)+" (root or the strct group).")
+	fmt.Fprintln(w, "migrate-legacy works on the files and services directly and needs root.")
+}
+
+// parseInterspersed parses flags wherever they appear, so both
+// "strct --json status" and "strct files ls /photos --json" work.
+// Everything after "--" is positional.
+func parseInterspersed(fs *flag.FlagSet, args []string) ([]string, error) {
+	var pos []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		rest := fs.Args()
+		if consumed := len(args) - len(rest); consumed > 0 && args[consumed-1] == "--" {
+			return append(pos, rest...), nil
+		}
+		if len(rest) == 0 {
+			return pos, nil
+		}
+		pos = append(pos, rest[0])
+		args = rest[1:]
+	}
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
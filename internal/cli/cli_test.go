@@ -0,0 +1,357 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/platform/executil"
+)
+
+var update = flag.Bool("update", false, "rewrite testdata/*.golden")
+
+// Canned /api/v1 responses, shaped like the agent's.
+const (
+	healthJSON = `{"status":"degraded","internet_access":true,"maintenance":{"enabled":false},` +
+		`"components":[{"name":"storage","status":"ok","message":"/dev/sda1 mounted, 76.0 GB free","critical":true},` +
+		`{"name":"wifi","status":"ok","message":"router mode on wlan0, 4 devices connected","critical":true},` +
+		`{"name":"adblock","status":"down","message":"dnsmasq is not answering DNS; failing open"}],` +
+		`"warnings":["adblock: the DNS redirect was removed 3 times in the last hour",` +
+		`"critical: adblock: dnsmasq has not answered DNS since 2024-06-03T11:58:00Z; devices are resolving through the upstream directly, without blocking (1 restarts tried)"],` +
+		`"started_at":"2024-06-03T08:48:00Z","uptime_seconds":11520,"timestamp":"2024-06-03T12:00:00Z"}`
+	statusJSON = `{"uptime":11520,"ip":"192.168.1.10","used":12884901888,"trash":1073741824,"total":107374182400,"is_online":true,` +
+		`"quota":{"total":107374182400,"used":25769803776,"reserved":5368709120,"available_for_upload":76235669504},"computed_at":"2024-06-03T11:59:30Z"}`
+	wifiStatusJSON = `{"mode":"router","ssid":"Strct-Home","ap_interface":"wlan0","subnet_base":"192.168.100",` +
+		`"gateway_ip":"192.168.100.1","connected_ips":4,"active":true,` +
+		`"dhcp_pool":{"start":"192.168.100.50","end":"192.168.100.150","size":100,"reserved":1,"active":88,"used_percent":88}}`
+	wifiConfigJSON = `{"mode":"router","router":{"ssid":"Strct-Home","password":"hunter22","band":"2.4GHz",` +
+		`"subnet_base":"192.168.100","dns_provider":"cloudflare","max_clients":0,"channel":6},` +
+		`"extender":{"upstream_ssid":"","upstream_password":"","extender_ssid":"","extender_password":"","extender_band":"","use_second_radio":false}}`
+	adblockStatusJSON = `{"enabled":true,"entry_count":84213,"last_updated":"2024-06-03T06:00:00Z","updating":false,` +
+		`"blocklist_age":21600,"blocklist_stale":false,"redirect_repairs":3,"last_redirect_repair":"2024-06-03T10:00:00Z",` +
+		`"dns_down":true,"failed_open":true,"dns_restarts":1,"last_dns_outage":"2024-06-03T11:58:00Z"}`
+	adblockConfigJSON = `{"enabled":true,"update_schedule":"daily","block_ttl":0,"fail_mode":"closed"}`
+	tunnelJSON        = `{"month":"2024-06","days":[],"bytes_in":161061273,"bytes_out":1127428915,"total_bytes":1288490188,` +
+		`"requests":420,"budget_bytes":53687091200,"used_percent":2.4,"downloads_blocked":false}`
+	filesJSON = `{"items":[{"name":"2024","size":"4.0 KB","type":"folder","modified_at":"2024-06-01T09:30:00+02:00"},` +
+		`{"name":"beach.jpg","size":"3.2 MB","type":"file","modified_at":"2024-06-02T18:04:11+02:00"}],` +
+		`"pagination":{"offset":0,"limit":500,"total":3}}`
+	filesPage2JSON = `{"items":[{"name":"notes from the trip.txt","size":"812 B","type":"file","modified_at":"2024-06-03T08:15:00+02:00"}],` +
+		`"pagination":{"offset":2,"limit":500,"total":3}}`
+	logsJSON = `{"entries":[` +
+		`{"seq":41,"time":"2024-06-03T11:57:50Z","level":"INFO","msg":"adblock: blocklist loaded","attrs":"domains=84213"},` +
+		`{"seq":42,"time":"2024-06-03T11:58:00Z","level":"WARN","msg":"adblock: dnsmasq did not answer the liveness probe","attrs":"misses=1 err=\"i/o timeout\""},` +
+		`{"seq":43,"time":"2024-06-03T11:58:20Z","level":"ERROR","msg":"adblock: dnsmasq is not answering DNS","attrs":"misses=3 fail_mode=open"}` +
+		`],"next":43}`
+	updateJSON = `{"current":"1.2.0","latest":"1.3.0","update_available":true,"channel":"beta"}`
+)
+
+// fakeAgent serves canned responses on a unix socket and records every
+// request as "METHOD /path?query body".
+type fakeAgent struct {
+	socket string
+	routes map[string]string // "GET /api/v1/status" → body; "!404 …" for an error
+	onCall func(call string)
+
+	mu    sync.Mutex
+	calls []string
+}
+
+func newFakeAgent(t *testing.T, routes map[string]string) *fakeAgent {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "strct") // t.TempDir can exceed the socket path limit
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	fa := &fakeAgent{socket: filepath.Join(dir, "agent.sock"), routes: routes}
+	ln, err := net.Listen("unix", fa.socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: fa}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+	return fa
+}
+
+func (fa *fakeAgent) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := r.Method + " " + r.URL.RequestURI()
+	body, _ := io.ReadAll(r.Body)
+	fa.mu.Lock()
+	fa.calls = append(fa.calls, strings.TrimSpace(key+" "+string(body)))
+	fa.mu.Unlock()
+	if fa.onCall != nil {
+		fa.onCall(key)
+	}
+	resp, ok := fa.routes[key]
+	switch {
+	case !ok:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("404 page not found\n"))
+	case strings.HasPrefix(resp, "!"):
+		code, msg, _ := strings.Cut(resp[1:], " ")
+		w.Header().Set("Content-Type", "application/json")
+		n, _ := strconv.Atoi(code)
+		w.WriteHeader(n)
+		w.Write([]byte(msg))
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(resp))
+	}
+}
+
+func (fa *fakeAgent) called(call string) bool {
+	fa.mu.Lock()
+	defer fa.mu.Unlock()
+	for _, c := range fa.calls {
+		if c == call {
+			return true
+		}
+	}
+	return false
+}
+
+// run runs the CLI against fa and returns what it printed.
+func run(t *testing.T, ctx context.Context, fa *fakeAgent, color bool, args ...string) (stdout, stderr string, code int) {
+	t.Helper()
+	var out, errOut bytes.Buffer
+	c := &CLI{Stdout: &out, Stderr: &errOut, Color: color}
+	code = c.Run(ctx, append([]string{"--socket", fa.socket}, args...))
+	return out.String(), errOut.String(), code
+}
+
+// golden compares got with testdata/<name>.golden, or rewrites the file
+// with -update.
+func golden(t *testing.T, name, got string) {
+	t.Helper()
+	path := filepath.Join("testdata", name+".golden")
+	if *update {
+		os.MkdirAll("testdata", 0755)
+		if err := os.WriteFile(path, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v (run go test -update to create it)", err)
+	}
+	if got != string(want) {
+		t.Errorf("%s differs from %s:\n--- got ---\n%s--- want ---\n%s", name, path, got, want)
+	}
+}
+
+var allRoutes = map[string]string{
+	"GET /api/v1/health":                                  healthJSON,
+	"GET /api/v1/status":                                  statusJSON,
+	"GET /api/v1/wifi/status":                             wifiStatusJSON,
+	"GET /api/v1/wifi/config":                             wifiConfigJSON,
+	"POST /api/v1/wifi/config":                            `{"status":"applying"}`,
+	"GET /api/v1/adblock/status":                          adblockStatusJSON,
+	"GET /api/v1/adblock/config":                          adblockConfigJSON,
+	"POST /api/v1/adblock/config":                         `{"status":"applying","flush_guidance":"Devices may keep blocked answers cached for up to 1m0s."}`,
+	"GET /api/v1/tunnel/usage":                            tunnelJSON,
+	"GET /api/v1/files?limit=500&offset=0&path=%2Fphotos": filesJSON,
+	"GET /api/v1/files?limit=500&offset=2&path=%2Fphotos": filesPage2JSON,
+	"GET /api/v1/files?limit=500&offset=0&path=%2Fempty":  `{"items":[],"pagination":{"offset":0,"limit":500,"total":0}}`,
+	"DELETE /api/v1/delete?path=%2Fphotos%2Fbeach.jpg":    "",
+	"DELETE /api/v1/delete?path=%2Fphotos%2Fmissing.jpg":  `!404 {"error":"not found: /photos/missing.jpg"}`,
+	"GET /api/v1/system/logs?level=info&limit=50":         logsJSON,
+	"POST /api/v1/ota/check":                              updateJSON,
+}
+
+func TestCommands_Golden(t *testing.T) {
+	fa := newFakeAgent(t, allRoutes)
+	for _, tc := range []struct {
+		name  string
+		args  []string
+		color bool
+		code  int
+	}{
+		{"status", []string{"status"}, false, 0},
+		{"status_color", []string{"status"}, true, 0},
+		{"status_json", []string{"status", "--json"}, false, 0},
+		{"overview", []string{"overview"}, false, 0},
+		{"files_ls", []string{"files", "ls", "/photos"}, false, 0},
+		{"files_ls_color", []string{"files", "ls", "/photos"}, true, 0},
+		{"files_ls_json", []string{"--json", "files", "ls", "/photos"}, false, 0},
+		{"files_ls_empty", []string{"files", "ls", "/empty"}, false, 0},
+		{"files_rm", []string{"files", "rm", "/photos/beach.jpg", "photos/missing.jpg"}, false, 1},
+		{"wifi_status", []string{"wifi", "status"}, false, 0},
+		{"wifi_apply", []string{"wifi", "apply"}, false, 0},
+		{"adblock_status", []string{"adblock", "status"}, true, 0},
+		{"adblock_toggle", []string{"adblock", "toggle"}, false, 0},
+		{"logs", []string{"logs", "tail"}, false, 0},
+		{"logs_json", []string{"logs", "--json"}, false, 0},
+		{"update_check", []string{"update", "check"}, false, 0},
+		{"help", []string{"help"}, false, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			out, errOut, code := run(t, context.Background(), fa, tc.color, tc.args...)
+			if code != tc.code {
+				t.Errorf("exit %d, want %d; stderr: %s", code, tc.code, errOut)
+			}
+			golden(t, tc.name, out)
+		})
+	}
+}
+
+func TestOverview_MissingSectionsAreReportedNotFatal(t *testing.T) {
+	routes := map[string]string{}
+	for k, v := range allRoutes {
+		routes[k] = v
+	}
+	delete(routes, "GET /api/v1/tunnel/usage")
+	routes["GET /api/v1/adblock/status"] = `!503 {"error":"adblock is starting"}`
+	fa := newFakeAgent(t, routes)
+
+	out, _, code := run(t, context.Background(), fa, false, "overview")
+	if code != 0 {
+		t.Fatalf("exit %d", code)
+	}
+	golden(t, "overview_partial", out)
+}
+
+func TestStatus_AgentDownIsShownNotAnError(t *testing.T) {
+	routes := map[string]string{}
+	for k, v := range allRoutes {
+		routes[k] = v
+	}
+	routes["GET /api/v1/health"] = `!503 {"status":"down","internet_access":false,"maintenance":{"enabled":false},` +
+		`"components":[{"name":"storage","status":"down","message":"/mnt/data: no such file or directory","critical":true}],` +
+		`"started_at":"2024-06-03T08:48:00Z","uptime_seconds":11520,"timestamp":"2024-06-03T12:00:00Z"}`
+	fa := newFakeAgent(t, routes)
+
+	out, errOut, code := run(t, context.Background(), fa, false, "status")
+	if code != 0 {
+		t.Fatalf("exit %d: %s", code, errOut)
+	}
+	for _, want := range []string{"Agent        down", "Components   storage: down — /mnt/data: no such file or directory"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("status output lacks %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestMutations_SendWhatTheAgentExpects(t *testing.T) {
+	fa := newFakeAgent(t, allRoutes)
+
+	run(t, context.Background(), fa, false, "wifi", "apply")
+	if !fa.called("POST /api/v1/wifi/config " + wifiConfigJSON) {
+		t.Errorf("wifi apply did not post the saved config back: %v", fa.calls)
+	}
+
+	// toggle flips enabled and keeps the rest, fail_mode included.
+	run(t, context.Background(), fa, false, "adblock", "toggle")
+	if !fa.called(`POST /api/v1/adblock/config {"block_ttl":0,"enabled":false,"fail_mode":"closed","update_schedule":"daily"}`) {
+		t.Errorf("adblock toggle: %v", fa.calls)
+	}
+
+	_, errOut, _ := run(t, context.Background(), fa, false, "files", "rm", "/photos/missing.jpg")
+	if !strings.Contains(errOut, "not found: /photos/missing.jpg (404)") {
+		t.Errorf("rm error = %q", errOut)
+	}
+}
+
+func TestLogs_Follow(t *testing.T) {
+	defer func(d time.Duration) { followInterval = d }(followInterval)
+	followInterval = time.Millisecond
+
+	routes := map[string]string{
+		"GET /api/v1/system/logs?level=warn&limit=2": `{"entries":[],"next":43}`,
+		"GET /api/v1/system/logs?level=warn&limit=1000&since=43": `{"entries":[` +
+			`{"seq":44,"time":"2024-06-03T11:58:30Z","level":"WARN","msg":"adblock: failing open","attrs":"iface=wlan0"}],"next":44}`,
+		// The agent restarted: numbering starts over.
+		"GET /api/v1/system/logs?level=warn&limit=1000&since=44": `{"entries":[],"next":2}`,
+		"GET /api/v1/system/logs?level=warn&limit=1000&since=0": `{"entries":[` +
+			`{"seq":2,"time":"2024-06-03T11:59:01Z","level":"ERROR","msg":"wifi: apply failed","attrs":"err=\"hostapd exited\""}],"next":2}`,
+		"GET /api/v1/system/logs?level=warn&limit=1000&since=2": `{"entries":[],"next":2}`,
+	}
+	fa := newFakeAgent(t, routes)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fa.onCall = func(call string) {
+		if strings.HasSuffix(call, "since=2") {
+			cancel()
+		}
+	}
+
+	out, errOut, code := run(t, ctx, fa, false, "logs", "-f", "-n", "2", "--level", "warn")
+	if code != 0 {
+		t.Fatalf("exit %d: %s", code, errOut)
+	}
+	golden(t, "logs_follow", out)
+}
+
+func TestErrors(t *testing.T) {
+	fa := newFakeAgent(t, allRoutes)
+	for _, tc := range []struct {
+		args []string
+		code int
+		want string
+	}{
+		{[]string{"files", "mv", "/a", "/b"}, 2, `unknown files command "mv"`},
+		{[]string{"adblock"}, 2, "usage: strct adblock status | on | off | toggle"},
+		{[]string{"status", "--lines", "3"}, 2, "flag provided but not defined: -lines"},
+		{[]string{"update", "check", "--socket", fa.socket + ".gone"}, 1, "the agent is not running"},
+	} {
+		_, errOut, code := run(t, context.Background(), fa, false, tc.args...)
+		if code != tc.code || !strings.Contains(errOut, tc.want) {
+			t.Errorf("%v: exit %d, stderr %q", tc.args, code, errOut)
+		}
+	}
+}
+
+func TestMigrateLegacy_DryRun(t *testing.T) {
+	root := t.TempDir()
+	for path, content := range map[string]string{
+		"etc/systemd/system/cloud-agent.service": "[Service]\nWorkingDirectory=/home/pi/cloud-agent\n",
+		"home/pi/cloud-agent/device-id.lock":     "device-1f0c\n",
+		"home/pi/cloud-agent/.env":               "VPS_IP=203.0.113.7\nAUTH_TOKEN=s3cret\n",
+		"mnt/data/photos/beach.jpg":              "jpeg",
+	} {
+		p := filepath.Join(root, path)
+		os.MkdirAll(filepath.Dir(p), 0755)
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m := &executil.Mock{}
+	m.Expect("docker inspect --format {{.State.Status}} filebrowser", executil.MockResult{Output: []byte("running\n")})
+
+	var out, errOut bytes.Buffer
+	c := &CLI{Stdout: &out, Stderr: &errOut, root: root, cmd: m}
+	if code := c.Run(context.Background(), []string{"migrate-legacy", "--dry-run"}); code != 0 {
+		t.Fatalf("exit %d: %s", code, errOut.String())
+	}
+	golden(t, "migrate_legacy_dry_run", out.String())
+	if _, err := os.Stat(filepath.Join(root, "etc/strct")); !os.IsNotExist(err) {
+		t.Errorf("a dry run wrote to /etc/strct: %v", err)
+	}
+}
+
+func TestIsCommand(t *testing.T) {
+	for args, want := range map[string]bool{
+		"status":                               true,
+		"--json files ls /":                    true,
+		"help":                                 true,
+		"":                                     false,
+		"-dev":                                 false,
+		"-file-worker /run/strct-files/f.sock": false,
+	} {
+		if got := IsCommand(strings.Fields(args)); got != want {
+			t.Errorf("IsCommand(%q) = %v", args, got)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"syscall"
+)
+
+// client calls the agent's /api/v1 routes over its admin socket.
+type client struct {
+	socket string
+	http   *http.Client
+}
+
+func newClient(socket string) *client {
+	return &client{
+		socket: socket,
+		http: &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+			},
+		}},
+	}
+}
+
+// get decodes GET /api/v1<path> into out. Status codes in also are
+// decoded as if they were 2xx: /health answers 503 with a body when the
+// agent is down.
+func (cl *client) get(ctx context.Context, path string, out any, also ...int) error {
+	return cl.do(ctx, http.MethodGet, path, nil, out, also...)
+}
+
+// do sends body (if not nil) as JSON and decodes the response into out
+// (if not nil). A non-2xx answer not in also is an error carrying the
+// API's message.
+func (cl *client) do(ctx context.Context, method, path string, body, out any, also ...int) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, "http://strct/api/v1"+path, r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := cl.http.Do(req)
+	if err != nil {
+		return cl.dialError(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 && !slices.Contains(also, resp.StatusCode) {
+		return apiError(resp)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("%s %s: unreadable response: %w", method, path, err)
+	}
+	return nil
+}
+
+// dialError turns "no such file" and "permission denied" on the socket
+// into what to do about them.
+func (cl *client) dialError(err error) error {
+	switch {
+	case errors.Is(err, os.ErrNotExist), errors.Is(err, syscall.ECONNREFUSED):
+		return fmt.Errorf("the agent is not running (no answer on %s)", cl.socket)
+	case errors.Is(err, os.ErrPermission):
+		return fmt.Errorf("no access to %s: run as root or join the strct group", cl.socket)
+	}
+	return err
+}
+
+// apiError reads the message out of an error response. Most handlers
+// answer {"error": "..."}; the older ones plain text.
+func apiError(resp *http.Response) error {
+	raw, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	var body struct {
+		Error string `json:"error"`
+	}
+	msg := strings.TrimSpace(string(raw))
+	if json.Unmarshal(raw, &body) == nil && body.Error != "" {
+		msg = body.Error
+	}
+	if msg == "" {
+		msg = http.StatusText(resp.StatusCode)
+	}
+	return fmt.Errorf("%s (%d)", msg, resp.StatusCode)
+}
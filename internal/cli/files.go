@@ -0,0 +1,102 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/strct-org/strct-agent/internal/features/cloud"
+	"github.com/strct-org/strct-agent/internal/httputil"
+)
+
+// filesPage is how many entries files ls asks for at a time.
+const filesPage = 500
+
+func runFiles(ctx context.Context, c *CLI, args []string) error {
+	if len(args) == 0 {
+		return usageError("expected files ls or files rm")
+	}
+	switch args[0] {
+	case "ls":
+		if len(args) > 2 {
+			return usageError("files ls takes one folder")
+		}
+		dir := "/"
+		if len(args) == 2 {
+			dir = args[1]
+		}
+		return filesList(ctx, c, dir)
+	case "rm":
+		if len(args) < 2 {
+			return usageError("files rm needs at least one path")
+		}
+		return filesRemove(ctx, c, args[1:])
+	}
+	return usageError(fmt.Sprintf("unknown files command %q", args[0]))
+}
+
+func filesList(ctx context.Context, c *CLI, dir string) error {
+	var items []cloud.FileItem
+	for {
+		var page httputil.Page[cloud.FileItem]
+		q := url.Values{"path": {dir}, "offset": {fmt.Sprint(len(items))}, "limit": {fmt.Sprint(filesPage)}}
+		if err := c.client.get(ctx, "/files?"+q.Encode(), &page); err != nil {
+			return err
+		}
+		items = append(items, page.Items...)
+		if len(page.Items) == 0 || len(items) >= page.Pagination.Total {
+			break
+		}
+	}
+	if c.opts.json {
+		if items == nil {
+			items = []cloud.FileItem{}
+		}
+		return c.printJSON(items)
+	}
+	if len(items) == 0 {
+		fmt.Fprintln(c.Stdout, c.paint(dim, dir+" is empty"))
+		return nil
+	}
+
+	rows := make([][]cell, 0, len(items))
+	for _, it := range items {
+		name, size := plain(it.Name), plain(it.Size)
+		if it.Type == "folder" {
+			name, size = colored(blue, it.Name+"/"), plain("-")
+		}
+		rows = append(rows, []cell{name, size, plain(stamp(it.ModifiedAt))})
+	}
+	c.table([]string{"NAME", "SIZE", "MODIFIED"}, rows)
+	return nil
+}
+
+// filesRemove moves each path to the trash, carrying on past failures.
+func filesRemove(ctx context.Context, c *CLI, paths []string) error {
+	removed := []string{}
+	var failed []string
+	for _, p := range paths {
+		if !strings.HasPrefix(p, "/") {
+			p = "/" + p
+		}
+		if err := c.client.do(ctx, "DELETE", "/delete?"+url.Values{"path": {p}}.Encode(), nil, nil); err != nil {
+			fmt.Fprintf(c.Stderr, "strct: %s: %v\n", p, err)
+			failed = append(failed, p)
+			continue
+		}
+		removed = append(removed, p)
+		if !c.opts.json {
+			fmt.Fprintf(c.Stdout, "moved %s to the trash\n", p)
+		}
+	}
+	if c.opts.json {
+		if err := c.printJSON(map[string]any{"removed": removed}); err != nil {
+			return err
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d not removed", len(failed), len(paths))
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/logger"
+)
+
+// followInterval is how often logs -f asks for new records. A var for tests.
+var followInterval = time.Second
+
+// logsResponse is GET /api/system/logs.
+type logsResponse struct {
+	Entries []logger.Entry `json:"entries"`
+	Next    uint64         `json:"next"`
+}
+
+func runLogs(ctx context.Context, c *CLI, args []string) error {
+	if len(args) > 0 && args[0] == "tail" {
+		args = args[1:]
+	}
+	if len(args) > 0 {
+		return usageError("logs takes no arguments besides its flags")
+	}
+	if c.opts.lines < 1 {
+		return usageError("-n must be at least 1")
+	}
+
+	q := url.Values{"limit": {fmt.Sprint(c.opts.lines)}, "level": {c.opts.level}}
+	var resp logsResponse
+	if err := c.client.get(ctx, "/system/logs?"+q.Encode(), &resp); err != nil {
+		return err
+	}
+	c.printLogs(resp.Entries)
+
+	since := resp.Next
+	for c.opts.follow {
+		select {
+		case <-ctx.Done():
+			return nil // ^C ends -f
+		case <-time.After(followInterval):
+		}
+		q.Set("limit", "1000")
+		q.Set("since", fmt.Sprint(since))
+		resp = logsResponse{}
+		err := c.client.get(ctx, "/system/logs?"+q.Encode(), &resp)
+		if err == nil && resp.Next < since {
+			// The agent restarted and numbered its records from 1 again.
+			fmt.Fprintln(c.Stdout, c.paint(dim, "-- agent restarted --"))
+			q.Set("since", "0")
+			err = c.client.get(ctx, "/system/logs?"+q.Encode(), &resp)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		c.printLogs(resp.Entries)
+		since = resp.Next
+	}
+	return nil
+}
+
+// printLogs writes one line per record, or one JSON object per line with
+// --json so -f can be piped into jq.
+func (c *CLI) printLogs(entries []logger.Entry) {
+	for _, e := range entries {
+		if c.opts.json {
+			b, _ := json.Marshal(e)
+			fmt.Fprintln(c.Stdout, string(b))
+			continue
+		}
+		color := dim
+		switch e.Level {
+		case "WARN":
+			color = yellow
+		case "ERROR":
+			color = red
+		case "INFO":
+			color = ""
+		}
+		line := fmt.Sprintf("%s %s %s", e.Time.Format("2006-01-02 15:04:05"), c.paint(color, fmt.Sprintf("%-5s", e.Level)), e.Msg)
+		if e.Attrs != "" {
+			line += " " + c.paint(dim, e.Attrs)
+		}
+		fmt.Fprintln(c.Stdout, line)
+	}
+}
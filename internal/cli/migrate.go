@@ -0,0 +1,77 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/strct-org/strct-agent/internal/legacy"
+)
+
+// commander is what migrate-legacy runs systemctl and docker with.
+type commander interface {
+	Output(name string, args ...string) ([]byte, error)
+	CombinedOutput(name string, args ...string) ([]byte, error)
+}
+
+// runMigrate is migrate-legacy. Unlike the other commands it does not go
+// through the agent: the agent it migrates to may not have started yet.
+func runMigrate(ctx context.Context, c *CLI, args []string) error {
+	if len(args) != 0 {
+		return usageError("migrate-legacy takes no arguments")
+	}
+	r, err := legacy.Migrate(legacy.Options{
+		Root:   c.root,
+		Dir:    c.opts.legacyDir,
+		DryRun: c.opts.dryRun,
+		Cmd:    c.cmd,
+	})
+	if errors.Is(err, legacy.ErrMigrated) {
+		fmt.Fprintf(c.Stdout, "Nothing to do: %v\n", err)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if c.opts.json {
+		if err := c.printJSON(r); err != nil {
+			return err
+		}
+	} else {
+		c.printMigration(r)
+	}
+	if r.Failed() {
+		return errors.New("migration incomplete; fix the failed steps and run it again")
+	}
+	return nil
+}
+
+func (c *CLI) printMigration(r legacy.Report) {
+	if !r.Found {
+		fmt.Fprintln(c.Stdout, "No cloud-agent install found (looked in "+r.Dir+"; set --legacy-dir if it ran elsewhere).")
+		return
+	}
+	title := "Migrated from cloud-agent in " + r.Dir
+	if r.DryRun {
+		title = "Dry run: would migrate from cloud-agent in " + r.Dir
+	}
+	fmt.Fprintln(c.Stdout, c.paint(bold, title))
+	rows := make([][]cell, 0, len(r.Actions))
+	for _, a := range r.Actions {
+		color := ""
+		switch a.Status {
+		case legacy.ActionDone:
+			color = green
+		case legacy.ActionPlanned:
+			color = blue
+		case legacy.ActionFailed:
+			color = red
+		}
+		rows = append(rows, []cell{plain("  " + a.Step), colored(color, a.Status), plain(a.Detail)})
+	}
+	c.table(nil, rows)
+	if !r.DryRun && !r.Failed() {
+		fmt.Fprintln(c.Stdout)
+		fmt.Fprintln(c.Stdout, "Restart the agent to pick up the device ID and settings: systemctl restart strct-agent")
+	}
+}
@@ -0,0 +1,183 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	adblock "github.com/strct-org/strct-agent/internal/features/adblocker"
+	wifi_feature "github.com/strct-org/strct-agent/internal/features/wifi"
+)
+
+func runWiFi(ctx context.Context, c *CLI, args []string) error {
+	if len(args) != 1 {
+		return usageError("expected wifi status or wifi apply")
+	}
+	switch args[0] {
+	case "status":
+		var st wifi_feature.Status
+		if err := c.client.get(ctx, "/wifi/status", &st); err != nil {
+			return err
+		}
+		if c.opts.json {
+			return c.printJSON(st)
+		}
+		c.table(nil, wifiRows(st))
+		return nil
+	case "apply":
+		return wifiApply(ctx, c)
+	}
+	return usageError(fmt.Sprintf("unknown wifi command %q", args[0]))
+}
+
+func wifiRows(st wifi_feature.Status) [][]cell {
+	active := yesNo(st.Active, "yes", "no")
+	if st.Error != "" {
+		active = colored(red, "no: "+st.Error)
+	}
+	rows := [][]cell{
+		{plain("Mode"), plain(string(st.Mode))},
+		{plain("Active"), active},
+	}
+	add := func(label, value string) {
+		if value != "" {
+			rows = append(rows, []cell{plain(label), plain(value)})
+		}
+	}
+	add("SSID", st.SSID)
+	add("Upstream", st.UpstreamSSID)
+	add("Interface", st.APInterface)
+	add("Gateway", st.GatewayIP)
+	if st.Mode != wifi_feature.ModeOff {
+		add("Clients", fmt.Sprint(st.ConnectedIPs))
+	}
+	if p := st.DHCPPool; p != nil {
+		pool := plain(fmt.Sprintf("%d of %d addresses leased (%d%%), %s-%s", p.Active, p.Size, p.UsedPercent, p.Start, p.End))
+		if p.Full() {
+			pool = colored(yellow, pool.text)
+		}
+		rows = append(rows, []cell{plain("DHCP pool"), pool})
+	}
+	for i, m := range st.Mismatches {
+		label := ""
+		if i == 0 {
+			label = "Mismatches"
+		}
+		rows = append(rows, []cell{plain(label), colored(yellow, m)})
+	}
+	if len(st.Leftovers) > 0 {
+		rows = append(rows, []cell{plain("Leftovers"), colored(yellow, strings.Join(st.Leftovers, ", "))})
+	}
+	return rows
+}
+
+// wifiApply re-applies the saved config: it posts back what GET
+// /api/wifi/config returns, which is what the UI's Save does.
+func wifiApply(ctx context.Context, c *CLI) error {
+	var conf json.RawMessage
+	if err := c.client.get(ctx, "/wifi/config", &conf); err != nil {
+		return err
+	}
+	var resp map[string]any
+	if err := c.client.do(ctx, "POST", "/wifi/config", conf, &resp); err != nil {
+		return err
+	}
+	if c.opts.json {
+		return c.printJSON(resp)
+	}
+	var mode struct {
+		Mode string `json:"mode"`
+	}
+	json.Unmarshal(conf, &mode) //nolint:errcheck — only for the message
+	fmt.Fprintf(c.Stdout, "Applying %s mode; check progress with strct wifi status\n", mode.Mode)
+	return nil
+}
+
+func runAdblock(ctx context.Context, c *CLI, args []string) error {
+	if len(args) != 1 {
+		return usageError("expected adblock status, on, off or toggle")
+	}
+	switch args[0] {
+	case "status":
+		var st adblock.Status
+		if err := c.client.get(ctx, "/adblock/status", &st); err != nil {
+			return err
+		}
+		if c.opts.json {
+			return c.printJSON(st)
+		}
+		c.table(nil, adblockRows(st))
+		return nil
+	case "on", "off", "toggle":
+		return adblockSet(ctx, c, args[0])
+	}
+	return usageError(fmt.Sprintf("unknown adblock command %q", args[0]))
+}
+
+func adblockRows(st adblock.Status) [][]cell {
+	rows := [][]cell{{plain("Blocking"), yesNo(st.Enabled, "on", "off")}}
+	if !st.Enabled {
+		return rows
+	}
+	list := fmt.Sprintf("%d domains, updated %s (%s ago)", st.EntryCount,
+		st.LastUpdated.Format("2006-01-02 15:04"), duration(time.Duration(st.BlocklistAge)*time.Second))
+	listCell := plain(list)
+	if st.BlocklistStale {
+		listCell = colored(yellow, list+", stale")
+	}
+	rows = append(rows, []cell{plain("Blocklist"), listCell})
+	if st.UpdateError != "" {
+		rows = append(rows, []cell{plain("Last update"), colored(red, st.UpdateError)})
+	}
+	dns := colored(green, "answering")
+	switch {
+	case st.DNSDown && st.FailedOpen:
+		dns = colored(red, "dnsmasq down, failing open to the upstream")
+	case st.DNSDown:
+		dns = colored(red, "dnsmasq down")
+	}
+	rows = append(rows, []cell{plain("DNS"), dns})
+	if st.RedirectRepairs > 0 || st.DNSRestarts > 0 {
+		rows = append(rows, []cell{plain("Repairs"),
+			plain(fmt.Sprintf("%d redirect repairs, %d dnsmasq restarts", st.RedirectRepairs, st.DNSRestarts))})
+	}
+	return rows
+}
+
+// adblockSet switches blocking through POST /api/adblock/config. The rest
+// of the config is sent back as read, including fields this build does
+// not know about.
+func adblockSet(ctx context.Context, c *CLI, action string) error {
+	var conf map[string]any
+	if err := c.client.get(ctx, "/adblock/config", &conf); err != nil {
+		return err
+	}
+	enabled, _ := conf["enabled"].(bool)
+	switch action {
+	case "on":
+		enabled = true
+	case "off":
+		enabled = false
+	default:
+		enabled = !enabled
+	}
+	conf["enabled"] = enabled
+	var resp map[string]any
+	if err := c.client.do(ctx, "POST", "/adblock/config", conf, &resp); err != nil {
+		return err
+	}
+	if c.opts.json {
+		return c.printJSON(resp)
+	}
+	if enabled {
+		fmt.Fprintln(c.Stdout, "Ad blocking "+c.paint(green, "on")+"; the blocklist is loading")
+	} else {
+		fmt.Fprintln(c.Stdout, "Ad blocking "+c.paint(yellow, "off"))
+	}
+	if g, _ := resp["flush_guidance"].(string); g != "" {
+		fmt.Fprintln(c.Stdout, c.paint(dim, g))
+	}
+	return nil
+}
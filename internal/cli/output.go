@@ -0,0 +1,119 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/strct-org/strct-agent/internal/humanize"
+)
+
+// ANSI SGR codes.
+const (
+	bold   = "1"
+	dim    = "2"
+	red    = "31"
+	green  = "32"
+	yellow = "33"
+	blue   = "34"
+)
+
+// cell is one table cell. Columns are padded on the plain text and color
+// is added afterwards, so escape codes don't throw the alignment off.
+type cell struct {
+	text  string
+	color string
+}
+
+func plain(s string) cell          { return cell{text: s} }
+func colored(color, s string) cell { return cell{text: s, color: color} }
+func (c *CLI) paint(color, s string) string {
+	if !c.Color || color == "" {
+		return s
+	}
+	return "\x1b[" + color + "m" + s + "\x1b[0m"
+}
+
+// table prints rows in columns two spaces apart, under a bold header if
+// one is given.
+func (c *CLI) table(header []string, rows [][]cell) {
+	if header != nil {
+		h := make([]cell, len(header))
+		for i, s := range header {
+			h[i] = colored(bold, s)
+		}
+		rows = append([][]cell{h}, rows...)
+	}
+	var widths []int
+	for _, row := range rows {
+		for i, cl := range row {
+			if i == len(widths) {
+				widths = append(widths, 0)
+			}
+			widths[i] = max(widths[i], utf8.RuneCountInString(cl.text))
+		}
+	}
+	for _, row := range rows {
+		var b strings.Builder
+		for i, cl := range row {
+			text := cl.text
+			if i < len(row)-1 {
+				text += strings.Repeat(" ", widths[i]-utf8.RuneCountInString(cl.text)+2)
+				// Color only the text, not the padding.
+				b.WriteString(c.paint(cl.color, cl.text) + text[len(cl.text):])
+				continue
+			}
+			b.WriteString(c.paint(cl.color, text))
+		}
+		fmt.Fprintln(c.Stdout, b.String())
+	}
+}
+
+// printJSON is --json: v indented, as the API returned it.
+func (c *CLI) printJSON(v any) error {
+	enc := json.NewEncoder(c.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// warningCell colors a /api/health warning by its severity prefix.
+func warningCell(w string) cell {
+	if strings.HasPrefix(w, "critical:") {
+		return colored(red, w)
+	}
+	return colored(yellow, w)
+}
+
+func yesNo(b bool, yes, no string) cell {
+	if b {
+		return colored(green, yes)
+	}
+	return colored(yellow, no)
+}
+
+func size(n uint64) string { return humanize.Bytes(int64(n)) }
+
+// duration is a rough "3d 4h", "2h 5m" or "40s".
+func duration(d time.Duration) string {
+	d = d.Round(time.Second)
+	switch {
+	case d >= 24*time.Hour:
+		return fmt.Sprintf("%dd %dh", d/(24*time.Hour), d%(24*time.Hour)/time.Hour)
+	case d >= time.Hour:
+		return fmt.Sprintf("%dh %dm", d/time.Hour, d%time.Hour/time.Minute)
+	case d >= time.Minute:
+		return fmt.Sprintf("%dm %ds", d/time.Minute, d%time.Minute/time.Second)
+	}
+	return fmt.Sprintf("%ds", d/time.Second)
+}
+
+// stamp shortens an RFC 3339 time to minutes, in the zone it was given in.
+func stamp(s string) string {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return s
+	}
+	return t.Format("2006-01-02 15:04")
+}
@@ -0,0 +1,265 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/agent"
+	adblock "github.com/strct-org/strct-agent/internal/features/adblocker"
+	"github.com/strct-org/strct-agent/internal/features/cloud"
+	wifi_feature "github.com/strct-org/strct-agent/internal/features/wifi"
+	"github.com/strct-org/strct-agent/internal/maintenance"
+	"github.com/strct-org/strct-agent/internal/platform/tunnel"
+	"github.com/strct-org/strct-agent/ota"
+)
+
+// getHealth reads GET /api/health, which answers 503 when the agent is
+// down; that is a status to show, not an error.
+func getHealth(ctx context.Context, c *CLI, h *agent.Health) error {
+	return c.client.get(ctx, "/health", h, http.StatusServiceUnavailable)
+}
+
+// healthColor is green for ok, yellow for degraded and red for down.
+func healthColor(status string) string {
+	switch status {
+	case agent.HealthOK:
+		return green
+	case agent.HealthDegraded:
+		return yellow
+	}
+	return red
+}
+
+func runStatus(ctx context.Context, c *CLI, args []string) error {
+	if len(args) > 0 {
+		return usageError("status takes no arguments")
+	}
+	var st cloud.StatusResponse
+	var h agent.Health
+	if err := getHealth(ctx, c, &h); err != nil {
+		return err
+	}
+	if err := c.client.get(ctx, "/status", &st); err != nil {
+		return err
+	}
+	if c.opts.json {
+		return c.printJSON(map[string]any{"health": h, "status": st})
+	}
+
+	rows := [][]cell{
+		{plain("Agent"), colored(healthColor(h.Status), h.Status)},
+		{plain("Internet"), yesNo(h.Internet, "online", "offline")},
+		{plain("Uptime"), plain(duration(time.Duration(st.Uptime) * time.Second))},
+		{plain("IP"), plain(st.IP)},
+		{plain("Storage"), plain(fmt.Sprintf("%s used, %s in trash, %s total", size(st.Used), size(st.Trash), size(st.Total)))},
+	}
+	if q := st.Quota; q != nil {
+		room := plain(fmt.Sprintf("%s (%s kept free)", size(q.Available), size(q.Reserved)))
+		if q.Available == 0 {
+			room.color = red
+		}
+		rows = append(rows, []cell{plain("Upload room"), room})
+	}
+	rows = append(rows, []cell{plain("Maintenance"), maintenanceCell(h.Maintenance)})
+	for i, comp := range h.Components {
+		label := ""
+		if i == 0 {
+			label = "Components"
+		}
+		s := comp.Name + ": " + comp.Status
+		if comp.Message != "" {
+			s += " — " + comp.Message
+		}
+		rows = append(rows, []cell{plain(label), colored(healthColor(comp.Status), s)})
+	}
+	rows = append(rows, warningRows(h.Warnings)...)
+	c.table(nil, rows)
+	return nil
+}
+
+func maintenanceCell(m maintenance.Status) cell {
+	if !m.Enabled {
+		return plain("off")
+	}
+	s := "on"
+	if m.Reason != "" {
+		s += ": " + m.Reason
+	}
+	if m.ExpiresAt != nil {
+		s += ", until " + m.ExpiresAt.Format("2006-01-02 15:04")
+	}
+	return colored(yellow, s)
+}
+
+func warningRows(warnings []string) [][]cell {
+	if len(warnings) == 0 {
+		return [][]cell{{plain("Warnings"), colored(green, "none")}}
+	}
+	rows := make([][]cell, len(warnings))
+	for i, w := range warnings {
+		label := ""
+		if i == 0 {
+			label = "Warnings"
+		}
+		rows[i] = []cell{plain(label), warningCell(w)}
+	}
+	return rows
+}
+
+// overview is what runOverview collects. A section that could not be
+// read is nil and its error is in Errors.
+type overview struct {
+	Health  *agent.Health         `json:"health"`
+	Status  *cloud.StatusResponse `json:"status"`
+	WiFi    *wifi_feature.Status  `json:"wifi"`
+	AdBlock *adblock.Status       `json:"adblock"`
+	Tunnel  *tunnel.MonthUsage    `json:"tunnel"`
+	Errors  map[string]string     `json:"errors,omitempty"`
+}
+
+func runOverview(ctx context.Context, c *CLI, args []string) error {
+	if len(args) > 0 {
+		return usageError("overview takes no arguments")
+	}
+	var o overview
+	fetch := func(name, path string, out any) bool {
+		if err := c.client.get(ctx, path, out); err != nil {
+			if o.Errors == nil {
+				o.Errors = map[string]string{}
+			}
+			o.Errors[name] = err.Error()
+			return false
+		}
+		return true
+	}
+	var (
+		h  agent.Health
+		st cloud.StatusResponse
+		wf wifi_feature.Status
+		ab adblock.Status
+		tu tunnel.MonthUsage
+	)
+	// Health first: if the agent is not there at all, say only that.
+	if err := getHealth(ctx, c, &h); err != nil {
+		return err
+	}
+	o.Health = &h
+	if fetch("status", "/status", &st) {
+		o.Status = &st
+	}
+	if fetch("wifi", "/wifi/status", &wf) {
+		o.WiFi = &wf
+	}
+	if fetch("adblock", "/adblock/status", &ab) {
+		o.AdBlock = &ab
+	}
+	if fetch("tunnel", "/tunnel/usage", &tu) {
+		o.Tunnel = &tu
+	}
+	if c.opts.json {
+		return c.printJSON(o)
+	}
+
+	summary := colored(healthColor(h.Status), h.Status+", internet online")
+	if !h.Internet {
+		summary.text = h.Status + ", internet offline"
+		if summary.color == green {
+			summary.color = yellow
+		}
+	}
+	if o.Status != nil {
+		summary.text += ", up " + duration(time.Duration(st.Uptime)*time.Second)
+	}
+	rows := [][]cell{{plain("Agent"), summary}}
+
+	section := func(label, name string, ok bool, value func() cell) {
+		if !ok {
+			rows = append(rows, []cell{plain(label), colored(dim, "unavailable: "+o.Errors[name])})
+			return
+		}
+		rows = append(rows, []cell{plain(label), value()})
+	}
+	section("Storage", "status", o.Status != nil, func() cell {
+		s := fmt.Sprintf("%s of %s used", size(st.Used+st.Trash), size(st.Total))
+		if q := st.Quota; q != nil {
+			s += fmt.Sprintf(", %s free for uploads", size(q.Available))
+		}
+		return plain(s)
+	})
+	section("WiFi", "wifi", o.WiFi != nil, func() cell { return wifiSummary(wf) })
+	section("Ad blocking", "adblock", o.AdBlock != nil, func() cell { return adblockSummary(ab) })
+	section("Tunnel", "tunnel", o.Tunnel != nil, func() cell {
+		s := fmt.Sprintf("%s this month", size(uint64(tu.Total)))
+		if tu.Budget > 0 {
+			s += fmt.Sprintf(" of %s (%.0f%%)", size(uint64(tu.Budget)), tu.UsedPercent)
+		}
+		if tu.DownloadsBlocked {
+			return colored(red, s+", downloads paused")
+		}
+		return plain(s)
+	})
+	rows = append(rows, warningRows(h.Warnings)...)
+	c.table(nil, rows)
+	return nil
+}
+
+func wifiSummary(st wifi_feature.Status) cell {
+	if st.Mode == wifi_feature.ModeOff || st.Mode == "" {
+		return colored(dim, "off")
+	}
+	s := fmt.Sprintf("%s %q on %s, %d clients", st.Mode, st.SSID, st.APInterface, st.ConnectedIPs)
+	if p := st.DHCPPool; p != nil {
+		s += fmt.Sprintf(", DHCP pool %d%% used", p.UsedPercent)
+	}
+	if st.Error != "" {
+		return colored(red, s+": "+st.Error)
+	}
+	if !st.Active {
+		return colored(yellow, s+", not active")
+	}
+	if p := st.DHCPPool; p != nil && p.Full() {
+		return colored(yellow, s)
+	}
+	return plain(s)
+}
+
+func adblockSummary(st adblock.Status) cell {
+	if !st.Enabled {
+		return colored(dim, "off")
+	}
+	s := fmt.Sprintf("on, %d domains, list %s old", st.EntryCount, duration(time.Duration(st.BlocklistAge)*time.Second))
+	switch {
+	case st.DNSDown && st.FailedOpen:
+		return colored(red, s+", dnsmasq down (failing open)")
+	case st.DNSDown:
+		return colored(red, s+", dnsmasq down")
+	case st.BlocklistStale:
+		return colored(yellow, s+", stale")
+	}
+	return plain(s)
+}
+
+func runUpdate(ctx context.Context, c *CLI, args []string) error {
+	if len(args) != 1 || args[0] != "check" {
+		return usageError("expected update check")
+	}
+	var rel ota.Status
+	if err := c.client.do(ctx, http.MethodPost, "/ota/check", nil, &rel); err != nil {
+		return err
+	}
+	if c.opts.json {
+		return c.printJSON(rel)
+	}
+	release := "release"
+	if rel.Channel != "" {
+		release = rel.Channel + " release"
+	}
+	if rel.Available {
+		fmt.Fprintf(c.Stdout, "%s %s → %s (%s)\n", c.paint(yellow, "Update available:"), rel.Current, rel.Latest, release)
+		return nil
+	}
+	fmt.Fprintf(c.Stdout, "%s (%s is the latest %s)\n", c.paint(green, "Up to date"), rel.Current, release)
+	return nil
+}
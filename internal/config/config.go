@@ -2,60 +2,629 @@ package config
 
 import (
 	"log/slog"
+	"net"
 	"os"
 	"runtime"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
 
+// Storage setup modes for STORAGE_SETUP.
+const (
+	// StorageSetupPrompt asks in the setup portal which drive holds the data.
+	StorageSetupPrompt = "prompt"
+	// StorageSetupAuto keeps the headless behaviour: mount the first
+	// formatted SSD found, fall back to the SD card.
+	StorageSetupAuto = "auto"
+)
+
+// APIPort is where the agent's HTTP API and file server listen.
+const APIPort = 8080
+
+// DefaultTransferShare is the fraction of the measured link that file
+// transfers may use together, leaving the rest for DNS and API calls.
+const DefaultTransferShare = 0.8
+
+// A speedtest downloads over SpeedtestConnections parallel connections
+// for SpeedtestSeconds; these are the defaults and the most either may be.
+const (
+	DefaultSpeedtestSeconds     = 10
+	MaxSpeedtestSeconds         = 60
+	DefaultSpeedtestConnections = 4
+	MaxSpeedtestConnections     = 16
+)
+
+// Network monitor samples are sent to the backend in batches every
+// DefaultMonitorReportMinutes; MaxMonitorReportMinutes is the longest
+// interval allowed.
+const (
+	DefaultMonitorReportMinutes = 10
+	MaxMonitorReportMinutes     = 24 * 60
+)
+
+// The updater checks UPDATE_URL every DefaultUpdateCheckHours;
+// MaxUpdateCheckHours is the longest interval allowed.
+const (
+	DefaultUpdateCheckHours = 24
+	MaxUpdateCheckHours     = 30 * 24
+)
+
+// DefaultMonitorDNSUpstream is the resolver the monitor's DNS probe
+// compares the AP's dnsmasq with.
+const DefaultMonitorDNSUpstream = "1.1.1.1"
+
+// DefaultTrashRetentionDays is how long the cloud trash keeps deleted files.
+const DefaultTrashRetentionDays = 30
+
+// Uploads must leave the larger of these free on the data drive.
+const (
+	DefaultUploadReserveGB      = 1
+	DefaultUploadReservePercent = 5
+)
+
+// When DataDir shares a filesystem with /, as on the SD card, the larger
+// of these is kept free for the OS.
+const (
+	DefaultSystemReserveGB      = 1
+	DefaultSystemReservePercent = 5
+)
+
+// DefaultSlowRequestMs is how long an API request may take before it is
+// logged as slow.
+const DefaultSlowRequestMs = 1000
+
+// The cloud's background jobs (thumbnails, hashing, index rebuilds) run
+// on DefaultCloudJobWorkers workers, and maintenance jobs pause
+// DefaultCloudJobPaceMs after each file.
+const (
+	DefaultCloudJobWorkers = 2
+	DefaultCloudJobPaceMs  = 10
+)
+
+// DefaultWebDAVUser is the WebDAV login name unless WEBDAV_USER says
+// otherwise.
+const DefaultWebDAVUser = "strct"
+
+// DefaultCriticalServices shut the agent down when they fail to start:
+// without the API there is nothing to manage the device with.
+var DefaultCriticalServices = []string{"api"}
+
+// DefaultFRPCMirrorURL is where a missing frpc is downloaded from: frp's
+// GitHub releases, or a mirror laid out the same way.
+const DefaultFRPCMirrorURL = "https://github.com/fatedier/frp/releases/download"
+
+// Channels for UPDATE_CHANNEL: which of the releases under UPDATE_URL
+// the device follows.
+const (
+	UpdateChannelStable = "stable"
+	UpdateChannelBeta   = "beta"
+)
+
+// Backends for STORE_BACKEND, the record logs of internal/store under the
+// monitor's history and report queue.
+const (
+	// StoreBackendJSONL keeps one JSON line per record.
+	StoreBackendJSONL = "jsonl"
+	// StoreBackendBolt keeps a bbolt database, which reads a time range
+	// without scanning the whole log.
+	StoreBackendBolt = "bolt"
+)
+
 type BackendURL string
 type DataDir string
 
 type Config struct {
-	DeviceID           string
-	Domain             string
-	VPSIP              string
-	AuthToken          string
-	DataDir            string
-	BackendURL         string
-	TailScaleClientId  string
-	TailScaleAuthToken string
-	VPSPort            int
-	PprofPort          int
-	IsDev              bool
-}
-
-func Load(devMode bool, defaultDomain, defaultVPSIP string) *Config {
+	DeviceID          string
+	Domain            string
+	VPSIP             string
+	DataDir           string
+	BackendURL        string
+	TailScaleClientId string
+	StorageSetup      string
+	VPSPort           int
+	PprofPort         int
+	IsDev             bool
+	// ForceMockHardware uses the mock WiFi and disk even where the real
+	// ones would work, without the rest of dev mode.
+	ForceMockHardware bool
+	// TrafficPriority installs tc rules that send DNS and API replies on
+	// the AP interface ahead of bulk traffic.
+	TrafficPriority bool
+	// TransferShare caps file transfers at this fraction of the link
+	// speed the monitor measured. 1 disables the cap.
+	TransferShare float64
+	// SpeedtestURLs are downloaded from by the speedtest, in order, with
+	// Cloudflare's speed test as the fallback. SpeedtestUploadURL, if
+	// set, is POSTed random bytes to measure upload speed too.
+	SpeedtestURLs        []string
+	SpeedtestUploadURL   string
+	SpeedtestSeconds     int
+	SpeedtestConnections int
+
+	// MonitorReportMinutes is how often queued monitor samples are sent
+	// to the backend.
+	MonitorReportMinutes int
+	// MonitorDNSUpstream is the resolver the monitor times lookups
+	// against next to the AP's dnsmasq.
+	MonitorDNSUpstream string
+	// FileWorker serves the file API from a child process running as
+	// the strct-files user instead of in the root agent.
+	FileWorker bool
+	// TrashRetentionDays is how long deleted files stay in the cloud
+	// trash before they are purged. 0 keeps them until the trash is
+	// emptied.
+	TrashRetentionDays int
+	// UploadReserve (bytes) and UploadReservePercent of the data drive,
+	// whichever is larger, are kept free: uploads that would use them
+	// are refused.
+	UploadReserve        int64
+	UploadReservePercent float64
+	// SystemReserve (bytes) and SystemReservePercent, whichever is
+	// larger, are kept free when DataDir is on the root filesystem:
+	// uploads and thumbnails that would use them are refused.
+	SystemReserve        int64
+	SystemReservePercent float64
+	// CloudJobWorkers run the cloud's background jobs, pausing
+	// CloudJobPace between maintenance jobs.
+	CloudJobWorkers int
+	CloudJobPace    time.Duration
+	// TunnelBudgetGB is the monthly allowance for traffic through the
+	// tunnel, in GB (2^30 bytes). 0 sets no budget.
+	TunnelBudgetGB float64
+	// TunnelBlockDownloads refuses file downloads through the tunnel once
+	// the month's budget is used up.
+	TunnelBlockDownloads bool
+	// WiFiAuthAutoBlock puts a station that keeps failing to join the AP
+	// on hostapd's deny list for a while.
+	WiFiAuthAutoBlock bool
+	// UpdateURL is where releases are published (version.txt and the
+	// binaries). Empty disables update checks.
+	UpdateURL string
+	// UpdateChannel is UpdateChannelStable or UpdateChannelBeta, the
+	// directory under UpdateURL releases are taken from.
+	UpdateChannel string
+	// UpdateCheckHours is how often the updater checks for, and
+	// installs, a newer release.
+	UpdateCheckHours int
+	// WebDAVUser and WebDAVPassword are the basic auth credential for
+	// the /dav/ endpoint. No password turns WebDAV off.
+	WebDAVUser     string
+	WebDAVPassword string
+	// SlowRequest is how long an API request may take before it is
+	// logged with its timing breakdown. 0 logs none.
+	SlowRequest time.Duration
+	// GatewayHTTP also serves the API and UI on :80 of the AP gateway in
+	// router mode, and on :443 with TLSCertFile and TLSKeyFile.
+	GatewayHTTP bool
+	TLSCertFile string
+	TLSKeyFile  string
+	// SweepDryRun logs the obsolete files an upgrade would move out of
+	// the way instead of moving them.
+	SweepDryRun bool
+	// AuditReport sends the head of the security audit trail to the
+	// backend whenever it is anchored.
+	AuditReport bool
+	// RateLimits override the API's per-route rate limits, one
+	// "ROUTE=LIMIT" each; see api.ParseLimits.
+	RateLimits []string
+	// CriticalServices name the services the agent cannot run without: one
+	// that fails to start shuts the agent down. See agent.Start.
+	CriticalServices []string
+	// StoreBackend is StoreBackendJSONL or StoreBackendBolt.
+	StoreBackend string
+	// FRPCAutoDownload fetches frpc from FRPCMirrorURL when it is
+	// missing. Air-gapped installs turn it off.
+	FRPCAutoDownload bool
+	FRPCMirrorURL    string
+	// PeerDiscovery announces the agent over mDNS and lists the other
+	// strct devices it hears on GET /api/peers.
+	PeerDiscovery bool
+	// WiFiSSID, WiFiPassword, WiFiBand and WiFiChannel are the AP's
+	// settings until the portal saves its own. Empty or 0 keeps the
+	// built-in default.
+	WiFiSSID     string
+	WiFiPassword string
+	WiFiBand     string
+	WiFiChannel  int
+	// AdblockSources are the hosts-file URLs a blocklist update tries,
+	// in order. None: StevenBlack's unified list.
+	AdblockSources []string
+	// MonitorTargets are the ping targets until some are set through
+	// the API, and what an empty list restores. None: the monitor's own.
+	MonitorTargets []string
+	// TunnelProxies are what frpc exposes until a set is saved through
+	// the API. None: the agent at the device's subdomain.
+	TunnelProxies []TunnelProxy
+	// Identity is how DeviceID was arrived at; see device.go.
+	Identity Identity
+
+	w         *watcher          // see Reload
+	file      *loadedFile       // see file.go; nil if Load didn't make c
+	malformed map[string]string // intKeys that didn't parse; see Validate
+	secrets   map[string]string // see Secret; replaced, never changed in place
+	store     *secretStore      // nil: secrets are kept in memory only
+}
+
+// Load reads the settings from the environment, the env files and the
+// config file at configFile; "" is ConfigFilePath's, which need not
+// exist. See file.go for the precedence.
+func Load(devMode bool, defaultDomain, defaultVPSIP, configFile string) *Config {
+	w := newWatcher([]string{".env", EnvPath(devMode)}, defaultVPSIP)
 	if err := godotenv.Load(); err != nil {
 		slog.Debug("config: no .env file found, relying on system env vars")
 	}
+	// Loaded second, so the environment and ./.env win over it.
+	if path := EnvPath(devMode); path != "" {
+		if err := godotenv.Load(path); err == nil {
+			slog.Debug("config: loaded device settings", "path", path)
+		}
+	}
+	// And the config file last, under both.
+	explicit := configFile != ""
+	if !explicit {
+		configFile = ConfigFilePath(devMode)
+	}
+	file := readFile(configFile, explicit)
+	w.file = file.values
 
 	cfg := &Config{
-		IsDev:              devMode,
-		VPSIP:              getEnv("VPS_IP", defaultVPSIP),
-		VPSPort:            getEnvAsInt("VPS_PORT", 7000),
-		AuthToken:          getEnv("AUTH_TOKEN", "default-secret"),
-		Domain:             getEnv("DOMAIN", defaultDomain),
-		BackendURL:         getEnv("BACKEND_URL", ""),
-		PprofPort:          getEnvAsInt("PPROF_PORT", 6060),
-		TailScaleClientId:  getEnv("TAILSCALE_CLIENT_ID", ""),
-		TailScaleAuthToken: getEnv("TAILSCALE_AUTH_TOKEN", ""),
+		IsDev:                devMode,
+		VPSIP:                getEnv("VPS_IP", defaultVPSIP),
+		VPSPort:              getEnvAsInt("VPS_PORT", 7000),
+		Domain:               getEnv("DOMAIN", defaultDomain),
+		BackendURL:           getEnv("BACKEND_URL", ""),
+		PprofPort:            getEnvAsInt("PPROF_PORT", 6060),
+		TailScaleClientId:    getEnv("TAILSCALE_CLIENT_ID", ""),
+		StorageSetup:         getEnv("STORAGE_SETUP", StorageSetupPrompt),
+		ForceMockHardware:    getEnvAsBool("FORCE_MOCK_HARDWARE", false),
+		TrafficPriority:      getEnvAsBool("TRAFFIC_PRIORITY", false),
+		TransferShare:        getEnvAsFloat("TRANSFER_BANDWIDTH_SHARE", DefaultTransferShare),
+		SpeedtestURLs:        getEnvAsList("SPEEDTEST_URLS"),
+		SpeedtestUploadURL:   getEnv("SPEEDTEST_UPLOAD_URL", ""),
+		SpeedtestSeconds:     getEnvAsInt("SPEEDTEST_SECONDS", DefaultSpeedtestSeconds),
+		SpeedtestConnections: getEnvAsInt("SPEEDTEST_CONNECTIONS", DefaultSpeedtestConnections),
+		MonitorReportMinutes: getEnvAsInt("MONITOR_REPORT_MINUTES", DefaultMonitorReportMinutes),
+		MonitorDNSUpstream:   getEnv("MONITOR_DNS_UPSTREAM", DefaultMonitorDNSUpstream),
+		FileWorker:           getEnvAsBool("FILE_WORKER", false),
+		TrashRetentionDays:   TrashRetentionDays(),
+		TunnelBudgetGB:       getEnvAsFloat("TUNNEL_MONTHLY_BUDGET_GB", 0),
+		TunnelBlockDownloads: getEnvAsBool("TUNNEL_BUDGET_BLOCK_DOWNLOADS", false),
+		WiFiAuthAutoBlock:    getEnvAsBool("WIFI_AUTH_AUTOBLOCK", false),
+		UpdateURL:            getEnv("UPDATE_URL", ""),
+		UpdateChannel:        getEnv("UPDATE_CHANNEL", UpdateChannelStable),
+		UpdateCheckHours:     getEnvAsInt("UPDATE_CHECK_HOURS", DefaultUpdateCheckHours),
+		SweepDryRun:          getEnvAsBool("OBSOLETE_SWEEP_DRY_RUN", false),
+		GatewayHTTP:          getEnvAsBool("GATEWAY_HTTP", true),
+		TLSCertFile:          getEnv("TLS_CERT_FILE", ""),
+		TLSKeyFile:           getEnv("TLS_KEY_FILE", ""),
+		AuditReport:          getEnvAsBool("AUDIT_REPORT", true),
+		RateLimits:           getEnvAsList("RATE_LIMITS"),
+		CriticalServices:     getEnvAsList("CRITICAL_SERVICES"),
+		StoreBackend:         getEnv("STORE_BACKEND", StoreBackendJSONL),
+		FRPCAutoDownload:     getEnvAsBool("FRPC_AUTO_DOWNLOAD", true),
+		FRPCMirrorURL:        getEnv("FRPC_MIRROR_URL", DefaultFRPCMirrorURL),
+		PeerDiscovery:        getEnvAsBool("PEER_DISCOVERY", true),
+		WiFiSSID:             getEnv("WIFI_SSID", ""),
+		WiFiPassword:         getEnv("WIFI_PASSWORD", ""),
+		WiFiBand:             getEnv("WIFI_BAND", ""),
+		WiFiChannel:          getEnvAsInt("WIFI_CHANNEL", 0),
+		AdblockSources:       getEnvAsList("ADBLOCK_SOURCES"),
+		MonitorTargets:       getEnvAsList("MONITOR_TARGETS"),
+		TunnelProxies:        tunnelProxies(),
+		file:                 file,
+	}
+	if cfg.StorageSetup != StorageSetupPrompt && cfg.StorageSetup != StorageSetupAuto {
+		slog.Warn("config: unknown STORAGE_SETUP, using default",
+			"value", cfg.StorageSetup,
+			"default", StorageSetupPrompt,
+		)
+		cfg.StorageSetup = StorageSetupPrompt
+	}
+	if cfg.StoreBackend != StoreBackendJSONL && cfg.StoreBackend != StoreBackendBolt {
+		slog.Warn("config: unknown STORE_BACKEND, using default",
+			"value", cfg.StoreBackend,
+			"default", StoreBackendJSONL,
+		)
+		cfg.StoreBackend = StoreBackendJSONL
+	}
+	if cfg.UpdateChannel != UpdateChannelStable && cfg.UpdateChannel != UpdateChannelBeta {
+		slog.Warn("config: unknown UPDATE_CHANNEL, using default",
+			"value", cfg.UpdateChannel,
+			"default", UpdateChannelStable,
+		)
+		cfg.UpdateChannel = UpdateChannelStable
+	}
+	if cfg.UpdateCheckHours < 1 || cfg.UpdateCheckHours > MaxUpdateCheckHours {
+		slog.Warn("config: UPDATE_CHECK_HOURS must be between 1 and 720, using default",
+			"value", cfg.UpdateCheckHours,
+			"default", DefaultUpdateCheckHours,
+		)
+		cfg.UpdateCheckHours = DefaultUpdateCheckHours
 	}
 
-	if cfg.IsArm64() {
-		cfg.DataDir = "/mnt/data"
-	} else {
-		cfg.DataDir = "./data"
+	if cfg.TransferShare <= 0 || cfg.TransferShare > 1 {
+		slog.Warn("config: TRANSFER_BANDWIDTH_SHARE must be in (0, 1], using default",
+			"value", cfg.TransferShare,
+			"default", DefaultTransferShare,
+		)
+		cfg.TransferShare = DefaultTransferShare
 	}
 
-	cfg.DeviceID = getOrGenerateDeviceID(cfg.IsDev)
+	if cfg.SpeedtestSeconds < 1 || cfg.SpeedtestSeconds > MaxSpeedtestSeconds {
+		slog.Warn("config: SPEEDTEST_SECONDS must be between 1 and 60, using default",
+			"value", cfg.SpeedtestSeconds,
+			"default", DefaultSpeedtestSeconds,
+		)
+		cfg.SpeedtestSeconds = DefaultSpeedtestSeconds
+	}
+	if cfg.SpeedtestConnections < 1 || cfg.SpeedtestConnections > MaxSpeedtestConnections {
+		slog.Warn("config: SPEEDTEST_CONNECTIONS must be between 1 and 16, using default",
+			"value", cfg.SpeedtestConnections,
+			"default", DefaultSpeedtestConnections,
+		)
+		cfg.SpeedtestConnections = DefaultSpeedtestConnections
+	}
+	if cfg.MonitorReportMinutes < 1 || cfg.MonitorReportMinutes > MaxMonitorReportMinutes {
+		slog.Warn("config: MONITOR_REPORT_MINUTES must be between 1 and 1440, using default",
+			"value", cfg.MonitorReportMinutes,
+			"default", DefaultMonitorReportMinutes,
+		)
+		cfg.MonitorReportMinutes = DefaultMonitorReportMinutes
+	}
+	if cfg.WiFiBand != "" && cfg.WiFiBand != "2.4GHz" && cfg.WiFiBand != "5GHz" {
+		slog.Warn("config: WIFI_BAND must be 2.4GHz or 5GHz, using default",
+			"value", cfg.WiFiBand,
+		)
+		cfg.WiFiBand = ""
+	}
+	if net.ParseIP(cfg.MonitorDNSUpstream) == nil {
+		slog.Warn("config: MONITOR_DNS_UPSTREAM must be an IP address, using default",
+			"value", cfg.MonitorDNSUpstream,
+			"default", DefaultMonitorDNSUpstream,
+		)
+		cfg.MonitorDNSUpstream = DefaultMonitorDNSUpstream
+	}
+
+	if len(cfg.CriticalServices) == 0 {
+		cfg.CriticalServices = DefaultCriticalServices
+	}
+
+	cfg.UploadReserve, cfg.UploadReservePercent = UploadReserve()
+	cfg.SystemReserve, cfg.SystemReservePercent = SystemReserve()
+	cfg.WebDAVUser, cfg.WebDAVPassword = WebDAV()
+	cfg.CloudJobWorkers, cfg.CloudJobPace = CloudJobs()
+	cfg.SlowRequest = SlowRequest()
+
+	if cfg.TunnelBudgetGB < 0 {
+		slog.Warn("config: TUNNEL_MONTHLY_BUDGET_GB must not be negative, setting no budget",
+			"value", cfg.TunnelBudgetGB,
+		)
+		cfg.TunnelBudgetGB = 0
+	}
 
+	cfg.DataDir = cfg.DefaultDataDir()
+
+	cfg.Identity = loadIdentity(DeviceIDPath(cfg.IsDev), IdentityPath(cfg.IsDev))
+	cfg.DeviceID = cfg.Identity.DeviceID
+	cfg.malformed = malformedInts(intKeys...)
+	cfg.loadSecrets(w.files)
+
+	w.fromFiles = w.read()
+	w.hot = *cfg
+	cfg.w = w
 	return cfg
 }
 
-func (c *Config) IsArm64() bool {
-	return runtime.GOOS == "linux" && runtime.GOARCH == "arm64" && !c.IsDev
+// TrashRetentionDays reads TRASH_RETENTION_DAYS. It is separate from Load
+// because the file worker, which never calls Load, needs it too; it
+// inherits the agent's environment.
+func TrashRetentionDays() int {
+	days := getEnvAsInt("TRASH_RETENTION_DAYS", DefaultTrashRetentionDays)
+	if days < 0 {
+		slog.Warn("config: TRASH_RETENTION_DAYS must not be negative, using default",
+			"value", days,
+			"default", DefaultTrashRetentionDays,
+		)
+		return DefaultTrashRetentionDays
+	}
+	return days
+}
+
+// UploadReserve reads UPLOAD_RESERVE_GB and UPLOAD_RESERVE_PERCENT, and
+// returns the first in bytes. Like TrashRetentionDays it is separate from
+// Load for the file worker.
+func UploadReserve() (bytes int64, percent float64) {
+	gb := getEnvAsFloat("UPLOAD_RESERVE_GB", DefaultUploadReserveGB)
+	if gb < 0 {
+		slog.Warn("config: UPLOAD_RESERVE_GB must not be negative, using default",
+			"value", gb,
+			"default", DefaultUploadReserveGB,
+		)
+		gb = DefaultUploadReserveGB
+	}
+	percent = getEnvAsFloat("UPLOAD_RESERVE_PERCENT", DefaultUploadReservePercent)
+	if percent < 0 || percent >= 100 {
+		slog.Warn("config: UPLOAD_RESERVE_PERCENT must be in [0, 100), using default",
+			"value", percent,
+			"default", DefaultUploadReservePercent,
+		)
+		percent = DefaultUploadReservePercent
+	}
+	return int64(gb * (1 << 30)), percent
+}
+
+// SystemReserve reads SYSTEM_RESERVE_GB and SYSTEM_RESERVE_PERCENT, and
+// returns the first in bytes. Like UploadReserve it is separate from Load
+// for the file worker.
+func SystemReserve() (bytes int64, percent float64) {
+	gb := getEnvAsFloat("SYSTEM_RESERVE_GB", DefaultSystemReserveGB)
+	if gb < 0 {
+		slog.Warn("config: SYSTEM_RESERVE_GB must not be negative, using default",
+			"value", gb,
+			"default", DefaultSystemReserveGB,
+		)
+		gb = DefaultSystemReserveGB
+	}
+	percent = getEnvAsFloat("SYSTEM_RESERVE_PERCENT", DefaultSystemReservePercent)
+	if percent < 0 || percent >= 100 {
+		slog.Warn("config: SYSTEM_RESERVE_PERCENT must be in [0, 100), using default",
+			"value", percent,
+			"default", DefaultSystemReservePercent,
+		)
+		percent = DefaultSystemReservePercent
+	}
+	return int64(gb * (1 << 30)), percent
+}
+
+// WebDAV reads WEBDAV_USER and WEBDAV_PASSWORD. Like TrashRetentionDays
+// it is separate from Load for the file worker.
+func WebDAV() (user, password string) {
+	return getEnv("WEBDAV_USER", DefaultWebDAVUser), getEnv("WEBDAV_PASSWORD", "")
+}
+
+// CloudJobs reads CLOUD_JOB_WORKERS and CLOUD_JOB_PACE_MS. Like
+// TrashRetentionDays it is separate from Load for the file worker.
+func CloudJobs() (workers int, pace time.Duration) {
+	workers = getEnvAsInt("CLOUD_JOB_WORKERS", DefaultCloudJobWorkers)
+	if workers < 1 {
+		slog.Warn("config: CLOUD_JOB_WORKERS must be at least 1, using default",
+			"value", workers,
+			"default", DefaultCloudJobWorkers,
+		)
+		workers = DefaultCloudJobWorkers
+	}
+	ms := getEnvAsInt("CLOUD_JOB_PACE_MS", DefaultCloudJobPaceMs)
+	if ms < 0 {
+		slog.Warn("config: CLOUD_JOB_PACE_MS must not be negative, using default",
+			"value", ms,
+			"default", DefaultCloudJobPaceMs,
+		)
+		ms = DefaultCloudJobPaceMs
+	}
+	return workers, time.Duration(ms) * time.Millisecond
+}
+
+// SlowRequest reads SLOW_REQUEST_MS. Like TrashRetentionDays it is
+// separate from Load for the file worker.
+func SlowRequest() time.Duration {
+	ms := getEnvAsInt("SLOW_REQUEST_MS", DefaultSlowRequestMs)
+	if ms < 0 {
+		slog.Warn("config: SLOW_REQUEST_MS must not be negative, using default",
+			"value", ms,
+			"default", DefaultSlowRequestMs,
+		)
+		ms = DefaultSlowRequestMs
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// UseRealHardware reports whether the agent may drive the machine's
+// WiFi and drives. It doesn't say they exist: wifi.Detect and
+// disk.Detect look for that, on any architecture. Dev mode and
+// FORCE_MOCK_HARDWARE rule it out, as does any OS but Linux.
+func (c *Config) UseRealHardware() bool {
+	return runtime.GOOS == "linux" && !c.IsDev && !c.ForceMockHardware
+}
+
+// DefaultDataDir is where files live unless the setup wizard picked
+// another place: the data drive's mount point on real hardware, ./data
+// otherwise.
+func (c *Config) DefaultDataDir() string {
+	if c.UseRealHardware() {
+		return "/mnt/data"
+	}
+	return "./data"
+}
+
+// StorageDecisionPath is where the setup portal records the chosen data
+// drive. It lives next to the device ID on the SD card, not in DataDir —
+// DataDir may be on the very drive the decision is about.
+func (c *Config) StorageDecisionPath() string {
+	if c.IsDev {
+		return "storage.json"
+	}
+	return "/etc/strct/storage.json"
+}
+
+// EnvPath is the device's own settings file, in .env syntax: values
+// carried over from a legacy install by strct migrate-legacy. There is
+// none in dev mode, where ./.env serves the purpose.
+func EnvPath(isDev bool) string {
+	if isDev {
+		return ""
+	}
+	return "/etc/strct/agent.env"
+}
+
+// MaintenancePath is where maintenance mode is persisted. Like the
+// storage decision it stays on the SD card: maintenance is often about
+// swapping the drive DataDir lives on.
+func (c *Config) MaintenancePath() string {
+	if c.IsDev {
+		return "maintenance.json"
+	}
+	return "/etc/strct/maintenance.json"
+}
+
+// ManagedStatePath records the last version that swept obsolete files;
+// see internal/managed. On the SD card, so a new data drive doesn't make
+// the same version sweep /etc again.
+func (c *Config) ManagedStatePath() string {
+	if c.IsDev {
+		return "managed.json"
+	}
+	return "/etc/strct/managed.json"
+}
+
+// AuditKeyPath is the key the security audit trail is signed with, and
+// AuditAnchorPath where its head is anchored; see internal/audit. Both
+// stay on the SD card, away from the log on the data drive, so editing
+// the log alone is caught.
+func (c *Config) AuditKeyPath() string {
+	if c.IsDev {
+		return "audit.key"
+	}
+	return "/etc/strct/audit.key"
+}
+
+func (c *Config) AuditAnchorPath() string {
+	if c.IsDev {
+		return "audit-anchor.json"
+	}
+	return "/etc/strct/audit-anchor.json"
+}
+
+// APITokenPath is the device API token, next to the device ID; see
+// api.Auth.
+func (c *Config) APITokenPath() string {
+	if c.IsDev {
+		return "api-token.json"
+	}
+	return "/etc/strct/api-token.json"
+}
+
+// TelemetryPath is where the usage statistics opt-in is kept.
+func (c *Config) TelemetryPath() string {
+	if c.IsDev {
+		return "telemetry.json"
+	}
+	return "/etc/strct/telemetry.json"
+}
+
+// AdminSocket is the unix socket the API is also served on for the strct
+// CLI. It takes isDev rather than a Config because the CLI never loads one.
+func AdminSocket(isDev bool) string {
+	if isDev {
+		return "strct-agent.sock"
+	}
+	return "/run/strct/agent.sock"
+}
+
+func (c *Config) AdminSocketPath() string {
+	return AdminSocket(c.IsDev)
 }
 
 func (c *Config) EffectiveBackendURL() string {
@@ -90,6 +659,51 @@ func getEnvAsInt(key string, fallback int) int {
 	return v
 }
 
+// getEnvAsList splits a comma-separated variable, dropping empty items.
+func getEnvAsList(key string) []string {
+	var out []string
+	for _, v := range strings.Split(getEnv(key, ""), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func getEnvAsBool(key string, fallback bool) bool {
+	raw := getEnv(key, "")
+	if raw == "" {
+		return fallback
+	}
+	v, err := strconv.ParseBool(raw)
+	if err != nil {
+		slog.Warn("config: invalid boolean env var, using default",
+			"key", key,
+			"value", raw,
+			"default", fallback,
+		)
+		return fallback
+	}
+	return v
+}
+
+func getEnvAsFloat(key string, fallback float64) float64 {
+	raw := getEnv(key, "")
+	if raw == "" {
+		return fallback
+	}
+	v, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		slog.Warn("config: invalid number env var, using default",
+			"key", key,
+			"value", raw,
+			"default", fallback,
+		)
+		return fallback
+	}
+	return v
+}
+
 func ProvideBackendURL(cfg *Config) BackendURL {
 	return BackendURL(cfg.EffectiveBackendURL())
 }
@@ -2,9 +2,15 @@
 package config
 
 import (
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
+
+	"github.com/joho/godotenv"
 )
 
 func TestGetEnvAsInt(t *testing.T) {
@@ -94,45 +100,169 @@ func TestEffectiveBackendURL(t *testing.T) {
 	}
 }
 
-func TestIsArm64_DevModeAlwaysFalse(t *testing.T) {
-	cfg := &Config{IsDev: true}
-	if cfg.IsArm64() {
-		t.Error("IsArm64() should always return false in dev mode")
+func TestUseRealHardware_DevModeAndForceMockAlwaysFalse(t *testing.T) {
+	for _, cfg := range []*Config{{IsDev: true}, {ForceMockHardware: true}} {
+		if cfg.UseRealHardware() {
+			t.Errorf("UseRealHardware() = true for %+v", cfg)
+		}
+		if got := cfg.DefaultDataDir(); got != "./data" {
+			t.Errorf("DefaultDataDir() = %q for %+v, want ./data", got, cfg)
+		}
+	}
+	cfg := &Config{}
+	if runtime.GOOS == "linux" && (!cfg.UseRealHardware() || cfg.DefaultDataDir() != "/mnt/data") {
+		t.Errorf("on %s/%s: UseRealHardware() = %t, DefaultDataDir() = %q", runtime.GOOS, runtime.GOARCH, cfg.UseRealHardware(), cfg.DefaultDataDir())
 	}
 }
 
-func TestGetOrGenerateDeviceID_PersistsAcrossCalls(t *testing.T) {
-	// Use a temp dir so we don't pollute the repo root.
-	tmp := t.TempDir()
-	lockFile := filepath.Join(tmp, "device-id.lock")
-
-	// We can't call getOrGenerateDeviceID with a custom path directly
-	// because it constructs the path internally based on isDev.
-	//! This is a design smell — the path should be injected.
-	// For now, test the observable behavior via Load in dev mode
-	// (which writes to ./device-id.lock in the working directory).
-	//
-	// Better: refactor getOrGenerateDeviceID to accept the path as a param,
-	// then this test becomes straightforward.
-	//
-	// Demonstrating the test for the refactored version:
-	id1 := generateDeviceIDToFile(lockFile)
-	id2 := generateDeviceIDToFile(lockFile)
-
-	if id1 != id2 {
-		t.Errorf("device ID changed between calls: %q → %q", id1, id2)
-	}
-	if id1 == "" {
-		t.Error("device ID should not be empty")
+// fakeHardware points the hardware ID at a board with serial, none if
+// "".
+func fakeHardware(t *testing.T, serial string) {
+	t.Helper()
+	dir := t.TempDir()
+	old := [3]string{cpuInfoPath, ethMACPath, modelPath}
+	t.Cleanup(func() { cpuInfoPath, ethMACPath, modelPath = old[0], old[1], old[2] })
+	cpuInfoPath, ethMACPath = filepath.Join(dir, "cpuinfo"), filepath.Join(dir, "address")
+	modelPath = filepath.Join(dir, "model")
+	os.WriteFile(modelPath, []byte("Raspberry Pi 4 Model B Rev 1.4\x00"), 0644)
+	if serial != "" {
+		os.WriteFile(cpuInfoPath, []byte("processor\t: 0\nSerial\t\t: "+serial+"\nModel\t\t: Raspberry Pi 4\n"), 0644)
 	}
 }
 
-func generateDeviceIDToFile(filePath string) string {
-	content, err := os.ReadFile(filePath)
-	if err == nil {
-		return string(content)
+func TestLoadIdentity(t *testing.T) {
+	card := func(t *testing.T) (idPath, recordPath string) {
+		dir := t.TempDir()
+		return filepath.Join(dir, "device-id.lock"), filepath.Join(dir, "device-identity.json")
+	}
+
+	t.Run("stable across restarts and re-flashes", func(t *testing.T) {
+		fakeHardware(t, "10000000abcdef01")
+		idPath, recordPath := card(t)
+		first := loadIdentity(idPath, recordPath)
+		if first.Source != IdentityHardware || first.Hardware != "cpu_serial" || first.Model != "Raspberry Pi 4 Model B Rev 1.4" {
+			t.Errorf("first boot %+v", first)
+		}
+		if again := loadIdentity(idPath, recordPath); again.DeviceID != first.DeviceID || again.Source != IdentityStored {
+			t.Errorf("restart %+v, want %s stored", again, first.DeviceID)
+		}
+		reflashed, recordPath := card(t)
+		if id := loadIdentity(reflashed, recordPath); id.DeviceID != first.DeviceID {
+			t.Errorf("re-flashed card got %s, want %s", id.DeviceID, first.DeviceID)
+		}
+		if b, _ := os.ReadFile(recordPath); strings.Contains(string(b), "abcdef01") {
+			t.Errorf("the serial was recorded: %s", b)
+		}
+	})
+
+	t.Run("a cloned card gets its own ID", func(t *testing.T) {
+		fakeHardware(t, "10000000abcdef01")
+		idPath, recordPath := card(t)
+		original := loadIdentity(idPath, recordPath)
+
+		fakeHardware(t, "10000000fedcba99")
+		clone := loadIdentity(idPath, recordPath)
+		if clone.DeviceID == original.DeviceID || clone.Source != IdentityRederived || clone.PreviousID != original.DeviceID || clone.ChangedAt.IsZero() {
+			t.Errorf("clone %+v of %s", clone, original.DeviceID)
+		}
+		if again := loadIdentity(idPath, recordPath); again.DeviceID != clone.DeviceID || again.Source != IdentityStored || again.PreviousID != original.DeviceID {
+			t.Errorf("clone after a restart %+v", again)
+		}
+	})
+
+	t.Run("an ID from before is kept", func(t *testing.T) {
+		fakeHardware(t, "10000000abcdef01")
+		idPath, recordPath := card(t)
+		os.WriteFile(idPath, []byte("device-1f0c\n"), 0644)
+		if id := loadIdentity(idPath, recordPath); id.DeviceID != "device-1f0c" || id.Source != IdentityStored {
+			t.Errorf("legacy card %+v", id)
+		}
+		// migrate-legacy replaced it: not a hardware change.
+		os.WriteFile(idPath, []byte("device-9a77"), 0644)
+		if id := loadIdentity(idPath, recordPath); id.DeviceID != "device-9a77" || id.PreviousID != "" {
+			t.Errorf("migrated card %+v", id)
+		}
+	})
+
+	t.Run("no hardware ID", func(t *testing.T) {
+		fakeHardware(t, "")
+		idPath, recordPath := card(t)
+		first := loadIdentity(idPath, recordPath)
+		if first.Source != IdentityGenerated || first.Fingerprint != "" || !strings.HasPrefix(first.DeviceID, "device-") {
+			t.Errorf("first boot %+v", first)
+		}
+		if again := loadIdentity(idPath, recordPath); again.DeviceID != first.DeviceID {
+			t.Errorf("device ID changed between calls: %q → %q", first.DeviceID, again.DeviceID)
+		}
+	})
+}
+
+func TestReload_AppliesHotSettingsOnly(t *testing.T) {
+	env := filepath.Join(t.TempDir(), "agent.env")
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(env, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, k := range []string{"BACKEND_URL", "STORAGE_SETUP", "TAILSCALE_AUTH_TOKEN"} {
+		t.Setenv(k, "") // restored after the test
+		os.Unsetenv(k)
+	}
+	// Set for the agent itself: the files can't change it.
+	t.Setenv("VPS_PORT", "7001")
+
+	// As Load leaves it.
+	write("BACKEND_URL=https://a.example\nSTORAGE_SETUP=prompt\n")
+	w := newWatcher([]string{env}, "127.0.0.1")
+	if err := godotenv.Load(env); err != nil {
+		t.Fatal(err)
+	}
+	w.fromFiles = w.read()
+	cfg := &Config{BackendURL: "https://a.example", VPSPort: 7001, StorageSetup: StorageSetupPrompt, DataDir: "/mnt/data", w: w}
+	w.hot = *cfg
+	backend := cfg.Watch("BACKEND_URL")
+	vpn := cfg.Watch("TAILSCALE_AUTH_TOKEN")
+
+	write("BACKEND_URL=https://b.example\nSTORAGE_SETUP=auto\nVPS_PORT=9000\n")
+	r, err := cfg.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(r.Applied) != "[BACKEND_URL]" || fmt.Sprint(r.NeedsRestart) != "[STORAGE_SETUP]" {
+		t.Errorf("reloaded %+v", r)
+	}
+	select {
+	case c := <-backend:
+		if c.BackendURL != "https://b.example" || c.StorageSetup != StorageSetupPrompt || c.DataDir != "/mnt/data" || c.VPSPort != 7001 {
+			t.Errorf("watcher got %+v", c)
+		}
+	default:
+		t.Fatal("the backend watcher was not told")
+	}
+	select {
+	case c := <-vpn:
+		t.Errorf("the VPN watcher was told: %+v", c)
+	default:
+	}
+	if os.Getenv("STORAGE_SETUP") != StorageSetupPrompt || os.Getenv("VPS_PORT") != "7001" || os.Getenv("BACKEND_URL") != "https://b.example" {
+		t.Errorf("environment: STORAGE_SETUP=%q VPS_PORT=%q BACKEND_URL=%q",
+			os.Getenv("STORAGE_SETUP"), os.Getenv("VPS_PORT"), os.Getenv("BACKEND_URL"))
+	}
+	if cfg.BackendURL != "https://a.example" {
+		t.Errorf("the loaded config changed: %s", cfg.BackendURL)
+	}
+
+	// A setting taken out of the file goes back to its default.
+	write("STORAGE_SETUP=auto\n")
+	if r, _ := cfg.Reload(); fmt.Sprint(r.Applied) != "[BACKEND_URL]" || fmt.Sprint(r.NeedsRestart) != "[STORAGE_SETUP]" {
+		t.Errorf("second reload %+v", r)
+	}
+	if c := <-backend; c.BackendURL != "" {
+		t.Errorf("backend URL %q", c.BackendURL)
+	}
+
+	if _, err := (&Config{}).Reload(); !errors.Is(err, ErrNotReloadable) {
+		t.Errorf("reload without Load: %v", err)
 	}
-	id := "device-test-" + "fixed-uuid-for-test"
-	os.WriteFile(filePath, []byte(id), 0644)
-	return id
 }
@@ -1,46 +1,204 @@
 package config
 
 import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"log/slog"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/strct-org/strct-agent/internal/fsutil"
 )
 
-func getOrGenerateDeviceID(isDev bool) string {
-	var filePath string
-
+// DeviceIDPath is where the device ID is kept. The tunnel subdomain is
+// derived from it, so it must survive reinstalls and migrations.
+func DeviceIDPath(isDev bool) string {
 	if isDev {
-		filePath = "device-id.lock"
-	} else {
-		filePath = "/etc/strct/device-id.lock"
+		return "device-id.lock"
 	}
+	return "/etc/strct/device-id.lock"
+}
 
-	content, err := os.ReadFile(filePath)
-	if err == nil {
-		return strings.TrimSpace(string(content))
+// IdentityPath is where the hardware the device ID was made on is
+// recorded, next to DeviceIDPath.
+func IdentityPath(isDev bool) string {
+	if isDev {
+		return "device-identity.json"
 	}
+	return "/etc/strct/device-identity.json"
+}
 
-	newID := "device-" + uuid.New().String()
-	slog.Info("config: generated new device ID", "id", newID)
+// ─── Device identity ─────────────────────────────────────────────────────────
 
-	dir := filepath.Dir(filePath)
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		slog.Warn("config: could not create device ID directory", "dir", dir, "err", err)
+// The device ID lives on the SD card, which is not the device: a
+// re-flashed card used to get a new random ID, orphaning the backend's
+// history, and two cards cloned from one image shared an ID. The ID is
+// now tied to the hardware as well, by the CPU serial (a Raspberry Pi's)
+// or else eth0's MAC, of which only a hash is kept:
+//
+//   - A fresh card derives its ID from the hardware alone, so re-flashing
+//     the same board gives back the same ID.
+//   - A card whose recorded hardware is not the board it runs on was
+//     cloned or moved. Its ID is derived again from the hardware mixed
+//     with the old ID, the change logged and kept as PreviousID, which
+//     registration tells the backend.
+//   - Without a hardware ID (a VM, a container, dev mode on a laptop)
+//     the ID is random, as before.
+//
+// A card that predates this keeps its ID, which is recorded against the
+// hardware it next starts on.
+
+// How the device ID was arrived at, in Identity.Source.
+const (
+	IdentityStored    = "stored"    // read from DeviceIDPath, hardware unchanged
+	IdentityHardware  = "hardware"  // a fresh card, derived from the hardware
+	IdentityRederived = "rederived" // the card was on other hardware
+	IdentityGenerated = "generated" // random, with no hardware ID to use
+)
+
+// idNamespace keys the derived IDs, so they match no other name-based
+// UUID.
+var idNamespace = uuid.MustParse("5b0c7d8e-3a1f-4c2b-9e6d-7f4a8b2c1d0e")
 
-		return newID
+// Where the hardware ID and model are read; tests point them elsewhere.
+var (
+	cpuInfoPath = "/proc/cpuinfo"
+	ethMACPath  = "/sys/class/net/eth0/address"
+	modelPath   = "/proc/device-tree/model"
+)
+
+// Identity is who the device is, for registration and
+// GET /api/agent/identity.
+type Identity struct {
+	DeviceID string `json:"device_id"`
+	Source   string `json:"source"`
+	// Hardware is what the ID is tied to, "cpu_serial" or "eth0_mac";
+	// "" with neither.
+	Hardware string `json:"hardware,omitempty"`
+	// Fingerprint is a hash of the hardware ID, which is never stored or
+	// sent itself.
+	Fingerprint string `json:"fingerprint,omitempty"`
+	Model       string `json:"model,omitempty"`
+	// PreviousID and ChangedAt are set when the ID changed with the
+	// hardware.
+	PreviousID string    `json:"previous_id,omitempty"`
+	ChangedAt  time.Time `json:"changed_at,omitzero"`
+}
+
+// identityRecord is the file at IdentityPath.
+type identityRecord struct {
+	DeviceID    string    `json:"device_id"`
+	Hardware    string    `json:"hardware,omitempty"`
+	Fingerprint string    `json:"fingerprint,omitempty"`
+	PreviousID  string    `json:"previous_id,omitempty"`
+	ChangedAt   time.Time `json:"changed_at,omitzero"`
+}
+
+// hardwareID is the board's own ID and what it is, ("", "") for none.
+func hardwareID() (kind, id string) {
+	if f, err := os.Open(cpuInfoPath); err == nil {
+		defer f.Close()
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			k, v, ok := strings.Cut(sc.Text(), ":")
+			if ok && strings.TrimSpace(k) == "Serial" {
+				if v = strings.TrimSpace(v); strings.Trim(v, "0") != "" {
+					return "cpu_serial", v
+				}
+			}
+		}
+	}
+	if b, err := os.ReadFile(ethMACPath); err == nil {
+		if mac := strings.ToLower(strings.TrimSpace(string(b))); strings.Trim(mac, "0:") != "" {
+			return "eth0_mac", mac
+		}
 	}
+	return "", ""
+}
 
-	err = os.WriteFile(filePath, []byte(newID), 0644)
-	if err != nil {
-		slog.Warn("config: could not persist device ID", "path", filePath, "err", err)
+// fingerprint hashes a hardware ID for keeping and sending.
+func fingerprint(kind, id string) string {
+	sum := sha256.Sum256([]byte("strct-device:" + kind + ":" + id))
+	return hex.EncodeToString(sum[:16])
+}
+
+// deriveID is the device ID for fp, mixed with the ID the card had.
+func deriveID(fp, previous string) string {
+	return "device-" + uuid.NewSHA1(idNamespace, []byte(fp+"\n"+previous)).String()
+}
+
+func boardModel() string {
+	b, _ := os.ReadFile(modelPath)
+	return strings.TrimSpace(strings.TrimRight(string(b), "\x00"))
+}
 
-	} else {
-		slog.Info("config: device ID persisted", "path", filePath)
+// loadIdentity reads the device ID at idPath and the record at
+// recordPath, and settles the ID against the hardware; see above.
+func loadIdentity(idPath, recordPath string) Identity {
+	kind, hwID := hardwareID()
+	id := Identity{Hardware: kind, Model: boardModel()}
+	if kind != "" {
+		id.Fingerprint = fingerprint(kind, hwID)
+	}
+
+	var rec identityRecord
+	if err := fsutil.ReadJSON(recordPath, &rec); err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Warn("config: device identity record unreadable, recording it again", "path", recordPath, "err", err)
+	}
+	content, err := os.ReadFile(idPath)
+	stored := strings.TrimSpace(string(content))
+	switch {
+	case err == nil && stored != "":
+		id.DeviceID, id.Source = stored, IdentityStored
+		// The record is only the card's own if it names the stored ID:
+		// migrate-legacy puts another ID in place.
+		if rec.DeviceID == stored {
+			id.PreviousID, id.ChangedAt = rec.PreviousID, rec.ChangedAt
+			if rec.Fingerprint != "" && id.Fingerprint != "" && rec.Fingerprint != id.Fingerprint {
+				id.DeviceID, id.Source = deriveID(id.Fingerprint, stored), IdentityRederived
+				id.PreviousID, id.ChangedAt = stored, time.Now().UTC()
+				slog.Warn("config: device identity changed: this card was made on other hardware, cloned or moved",
+					"previous_id", stored, "id", id.DeviceID, "hardware", kind)
+			}
+		}
+	case id.Fingerprint != "":
+		id.DeviceID, id.Source = deriveID(id.Fingerprint, ""), IdentityHardware
+		slog.Info("config: device ID derived from hardware", "id", id.DeviceID, "hardware", kind)
+	default:
+		id.DeviceID, id.Source = "device-"+uuid.New().String(), IdentityGenerated
+		slog.Info("config: generated new device ID", "id", id.DeviceID)
+	}
 
+	next := identityRecord{DeviceID: id.DeviceID, Hardware: kind, Fingerprint: id.Fingerprint, PreviousID: id.PreviousID, ChangedAt: id.ChangedAt}
+	if id.Fingerprint == "" {
+		// Keep what the ID was made on until a hardware ID turns up.
+		next.Hardware, next.Fingerprint = rec.Hardware, rec.Fingerprint
 	}
+	if id.DeviceID != stored {
+		persistDeviceID(idPath, id.DeviceID)
+	}
+	if next != rec {
+		if err := fsutil.WriteJSON(recordPath, next); err != nil {
+			slog.Warn("config: could not record device identity", "path", recordPath, "err", err)
+		}
+	}
+	return id
+}
 
-	return newID
+func persistDeviceID(filePath, id string) {
+	dir := filepath.Dir(filePath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		slog.Warn("config: could not create device ID directory", "dir", dir, "err", err)
+		return
+	}
+	if err := fsutil.WriteFileAtomic(filePath, []byte(id), 0644); err != nil {
+		slog.Warn("config: could not persist device ID", "path", filePath, "err", err)
+		return
+	}
+	slog.Info("config: device ID persisted", "path", filePath)
 }
@@ -0,0 +1,582 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/strct-org/strct-agent/internal/errs"
+	"gopkg.in/yaml.v3"
+)
+
+// ─── Config file ─────────────────────────────────────────────────────────────
+
+// A fleet is provisioned with one file rather than a page of env vars:
+// /etc/strct/config.yaml, config.yaml in dev mode, or the one -config
+// names. It holds the same settings as the env vars, in the sections of
+// File:
+//
+//	tunnel:
+//	  vps_ip: 203.0.113.7
+//	  proxies:
+//	    - {name: web, type: http, local_port: 8080}
+//	monitor:
+//	  targets: [gateway, 1.1.1.1, 9.9.9.9]
+//
+// JSON works too; yaml.v3 reads it. The environment and the env files win
+// over the file, and the file over the defaults: Load puts each value the
+// file sets into the process environment where neither set it, before
+// reading any of them, so the file worker inherits them as well. A key
+// the agent doesn't know is logged with the nearest one it does. A value
+// of the wrong type, a file that doesn't parse and a -config file that
+// doesn't exist are Validate problems.
+//
+// The secrets are not read from the file, which is never rewritten: they
+// go in an env file, from where they are moved to the encrypted store.
+// The file is read at start; a change to it needs a restart.
+
+// ConfigFilePath is the config file Load reads unless -config names
+// another.
+func ConfigFilePath(isDev bool) string {
+	if isDev {
+		return "config.yaml"
+	}
+	return "/etc/strct/config.yaml"
+}
+
+// File is the config file's layout. Each setting has its yaml key, the
+// same in JSON, and the env var it stands for. mask hides the value on
+// GET /api/config.
+type File struct {
+	Agent   AgentSettings   `yaml:"agent" json:"agent"`
+	API     APISettings     `yaml:"api" json:"api"`
+	Tunnel  TunnelSettings  `yaml:"tunnel" json:"tunnel"`
+	WiFi    WiFiSettings    `yaml:"wifi" json:"wifi"`
+	Adblock AdblockSettings `yaml:"adblock" json:"adblock"`
+	Monitor MonitorSettings `yaml:"monitor" json:"monitor"`
+	Cloud   CloudSettings   `yaml:"cloud" json:"cloud"`
+	VPN     VPNSettings     `yaml:"vpn" json:"vpn"`
+}
+
+type AgentSettings struct {
+	Domain              string   `yaml:"domain" json:"domain" env:"DOMAIN"`
+	BackendURL          string   `yaml:"backend_url" json:"backend_url" env:"BACKEND_URL"`
+	UpdateURL           string   `yaml:"update_url" json:"update_url" env:"UPDATE_URL"`
+	UpdateChannel       string   `yaml:"update_channel" json:"update_channel" env:"UPDATE_CHANNEL"`
+	UpdateCheckHours    int      `yaml:"update_check_hours" json:"update_check_hours" env:"UPDATE_CHECK_HOURS"`
+	StorageSetup        string   `yaml:"storage_setup" json:"storage_setup" env:"STORAGE_SETUP"`
+	StoreBackend        string   `yaml:"store_backend" json:"store_backend" env:"STORE_BACKEND"`
+	ForceMockHardware   bool     `yaml:"force_mock_hardware" json:"force_mock_hardware" env:"FORCE_MOCK_HARDWARE"`
+	CriticalServices    []string `yaml:"critical_services" json:"critical_services" env:"CRITICAL_SERVICES"`
+	PprofPort           int      `yaml:"pprof_port" json:"pprof_port" env:"PPROF_PORT"`
+	ObsoleteSweepDryRun bool     `yaml:"obsolete_sweep_dry_run" json:"obsolete_sweep_dry_run" env:"OBSOLETE_SWEEP_DRY_RUN"`
+	AuditReport         bool     `yaml:"audit_report" json:"audit_report" env:"AUDIT_REPORT"`
+	PeerDiscovery       bool     `yaml:"peer_discovery" json:"peer_discovery" env:"PEER_DISCOVERY"`
+}
+
+type APISettings struct {
+	SlowRequestMs int      `yaml:"slow_request_ms" json:"slow_request_ms" env:"SLOW_REQUEST_MS"`
+	RateLimits    []string `yaml:"rate_limits" json:"rate_limits" env:"RATE_LIMITS"`
+	GatewayHTTP   bool     `yaml:"gateway_http" json:"gateway_http" env:"GATEWAY_HTTP"`
+	TLSCertFile   string   `yaml:"tls_cert_file" json:"tls_cert_file" env:"TLS_CERT_FILE"`
+	TLSKeyFile    string   `yaml:"tls_key_file" json:"tls_key_file" env:"TLS_KEY_FILE"`
+}
+
+type TunnelSettings struct {
+	VPSIP                string        `yaml:"vps_ip" json:"vps_ip" env:"VPS_IP"`
+	VPSPort              int           `yaml:"vps_port" json:"vps_port" env:"VPS_PORT"`
+	MonthlyBudgetGB      float64       `yaml:"monthly_budget_gb" json:"monthly_budget_gb" env:"TUNNEL_MONTHLY_BUDGET_GB"`
+	BudgetBlockDownloads bool          `yaml:"budget_block_downloads" json:"budget_block_downloads" env:"TUNNEL_BUDGET_BLOCK_DOWNLOADS"`
+	FRPCAutoDownload     bool          `yaml:"frpc_auto_download" json:"frpc_auto_download" env:"FRPC_AUTO_DOWNLOAD"`
+	FRPCMirrorURL        string        `yaml:"frpc_mirror_url" json:"frpc_mirror_url" env:"FRPC_MIRROR_URL"`
+	Proxies              []TunnelProxy `yaml:"proxies" json:"proxies" env:"TUNNEL_PROXIES"`
+}
+
+// TunnelProxy is one frpc proxy, as tunnel.ProxySpec; see
+// internal/platform/tunnel/proxies.go.
+type TunnelProxy struct {
+	Name       string `yaml:"name" json:"name"`
+	Type       string `yaml:"type" json:"type"`
+	LocalPort  int    `yaml:"local_port" json:"local_port"`
+	Subdomain  string `yaml:"subdomain,omitempty" json:"subdomain,omitempty"`
+	RemotePort int    `yaml:"remote_port,omitempty" json:"remote_port,omitempty"`
+	SecretKey  string `yaml:"secret_key,omitempty" json:"secret_key,omitempty"`
+}
+
+type WiFiSettings struct {
+	SSID            string `yaml:"ssid" json:"ssid" env:"WIFI_SSID"`
+	Password        string `yaml:"password" json:"password" env:"WIFI_PASSWORD" mask:"true"`
+	Band            string `yaml:"band" json:"band" env:"WIFI_BAND"`
+	Channel         int    `yaml:"channel" json:"channel" env:"WIFI_CHANNEL"`
+	AuthAutoBlock   bool   `yaml:"auth_autoblock" json:"auth_autoblock" env:"WIFI_AUTH_AUTOBLOCK"`
+	TrafficPriority bool   `yaml:"traffic_priority" json:"traffic_priority" env:"TRAFFIC_PRIORITY"`
+}
+
+type AdblockSettings struct {
+	Sources []string `yaml:"sources" json:"sources" env:"ADBLOCK_SOURCES"`
+}
+
+type MonitorSettings struct {
+	Targets              []string `yaml:"targets" json:"targets" env:"MONITOR_TARGETS"`
+	ReportMinutes        int      `yaml:"report_minutes" json:"report_minutes" env:"MONITOR_REPORT_MINUTES"`
+	DNSUpstream          string   `yaml:"dns_upstream" json:"dns_upstream" env:"MONITOR_DNS_UPSTREAM"`
+	SpeedtestURLs        []string `yaml:"speedtest_urls" json:"speedtest_urls" env:"SPEEDTEST_URLS"`
+	SpeedtestUploadURL   string   `yaml:"speedtest_upload_url" json:"speedtest_upload_url" env:"SPEEDTEST_UPLOAD_URL"`
+	SpeedtestSeconds     int      `yaml:"speedtest_seconds" json:"speedtest_seconds" env:"SPEEDTEST_SECONDS"`
+	SpeedtestConnections int      `yaml:"speedtest_connections" json:"speedtest_connections" env:"SPEEDTEST_CONNECTIONS"`
+}
+
+type CloudSettings struct {
+	FileWorker             bool    `yaml:"file_worker" json:"file_worker" env:"FILE_WORKER"`
+	TrashRetentionDays     int     `yaml:"trash_retention_days" json:"trash_retention_days" env:"TRASH_RETENTION_DAYS"`
+	UploadReserveGB        float64 `yaml:"upload_reserve_gb" json:"upload_reserve_gb" env:"UPLOAD_RESERVE_GB"`
+	UploadReservePercent   float64 `yaml:"upload_reserve_percent" json:"upload_reserve_percent" env:"UPLOAD_RESERVE_PERCENT"`
+	SystemReserveGB        float64 `yaml:"system_reserve_gb" json:"system_reserve_gb" env:"SYSTEM_RESERVE_GB"`
+	SystemReservePercent   float64 `yaml:"system_reserve_percent" json:"system_reserve_percent" env:"SYSTEM_RESERVE_PERCENT"`
+	JobWorkers             int     `yaml:"job_workers" json:"job_workers" env:"CLOUD_JOB_WORKERS"`
+	JobPaceMs              int     `yaml:"job_pace_ms" json:"job_pace_ms" env:"CLOUD_JOB_PACE_MS"`
+	TransferBandwidthShare float64 `yaml:"transfer_bandwidth_share" json:"transfer_bandwidth_share" env:"TRANSFER_BANDWIDTH_SHARE"`
+	WebDAVUser             string  `yaml:"webdav_user" json:"webdav_user" env:"WEBDAV_USER"`
+	WebDAVPassword         string  `yaml:"webdav_password" json:"webdav_password" env:"WEBDAV_PASSWORD" mask:"true"`
+}
+
+type VPNSettings struct {
+	TailscaleClientID string `yaml:"tailscale_client_id" json:"tailscale_client_id" env:"TAILSCALE_CLIENT_ID"`
+}
+
+// fileKey is one setting of File: its dotted yaml path, env var and Go
+// type.
+type fileKey struct {
+	path string
+	env  string
+	typ  reflect.Type
+	mask bool
+}
+
+// fileKeys are File's settings, by dotted path, and fileSections its
+// section names.
+var fileKeys, fileSections = fileSchema()
+
+func fileSchema() (map[string]fileKey, []string) {
+	keys := map[string]fileKey{}
+	var sections []string
+	ft := reflect.TypeOf(File{})
+	for i := range ft.NumField() {
+		sf := ft.Field(i)
+		section := yamlName(sf)
+		sections = append(sections, section)
+		for j := range sf.Type.NumField() {
+			f := sf.Type.Field(j)
+			path := section + "." + yamlName(f)
+			keys[path] = fileKey{path: path, env: f.Tag.Get("env"), typ: f.Type, mask: f.Tag.Get("mask") == "true"}
+		}
+	}
+	return keys, sections
+}
+
+func yamlName(f reflect.StructField) string {
+	name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+	return name
+}
+
+// loadedFile is what Load took from the config file.
+type loadedFile struct {
+	path     string
+	values   map[string]string // env var → the file's value, as the env var would hold it
+	problems []fileProblem     // reported by Validate
+}
+
+type fileProblem struct {
+	field, code, message string
+}
+
+// readFile reads the config file at path into the process environment,
+// leaving the variables already set alone. A missing file is fine unless
+// explicit, when -config named it.
+func readFile(path string, explicit bool) *loadedFile {
+	lf := &loadedFile{path: path, values: map[string]string{}}
+	if path == "" {
+		return lf
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) && !explicit {
+		lf.path = ""
+		return lf
+	}
+	if err != nil {
+		lf.problem("config file", errs.CodeNotFound, "config file %s could not be read: %v; fix the path given to -config", path, err)
+		return lf
+	}
+	var doc map[string]any
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		lf.problem("config file", errs.CodeInvalid, "config file %s is not valid YAML or JSON: %v", path, err)
+		return lf
+	}
+	lf.walk("", doc)
+
+	applied := 0
+	for env, v := range lf.values {
+		if _, set := os.LookupEnv(env); set {
+			continue
+		}
+		os.Setenv(env, v)
+		applied++
+	}
+	slog.Info("config: read config file", "path", path, "settings", len(lf.values), "applied", applied)
+	return lf
+}
+
+func (lf *loadedFile) problem(field, code, format string, args ...any) {
+	lf.problems = append(lf.problems, fileProblem{field: field, code: code, message: fmt.Sprintf(format, args...)})
+}
+
+// walk takes the settings out of the section or document m, whose path
+// is prefix.
+func (lf *loadedFile) walk(prefix string, m map[string]any) {
+	for name, v := range m {
+		path := name
+		if prefix != "" {
+			path = prefix + "." + name
+		}
+		if k, ok := fileKeys[path]; ok {
+			s, err := envValue(k, v)
+			if err != nil {
+				lf.problem(path, errs.CodeInvalid, "%s in %s: %v", path, lf.path, err)
+				continue
+			}
+			lf.values[k.env] = s
+			continue
+		}
+		if sub, ok := v.(map[string]any); ok && prefix == "" && slices.Contains(fileSections, name) {
+			lf.walk(path, sub)
+			continue
+		}
+		if isSecret(strings.ToUpper(name)) {
+			slog.Warn("config: secrets are not read from the config file, set it in an env file instead",
+				"key", path, "var", strings.ToUpper(name), "env_file", EnvPath(false))
+			continue
+		}
+		slog.Warn("config: unknown key in config file, ignored", "path", lf.path, "key", path, "nearest", nearestKey(path))
+	}
+}
+
+// envValue is v, as the yaml decoder gave it, written the way k's env
+// var takes it: lists comma-separated, proxies as JSON.
+func envValue(k fileKey, v any) (string, error) {
+	if v == nil {
+		return "", nil
+	}
+	switch k.typ.Kind() {
+	case reflect.String:
+		switch v.(type) {
+		case string, int, float64, bool:
+			return fmt.Sprint(v), nil
+		}
+		return "", fmt.Errorf("want a string, got %s", kindOf(v))
+	case reflect.Int:
+		if n, ok := v.(int); ok {
+			return strconv.Itoa(n), nil
+		}
+		return "", fmt.Errorf("want a whole number, got %s", kindOf(v))
+	case reflect.Float64:
+		switch n := v.(type) {
+		case int:
+			return strconv.Itoa(n), nil
+		case float64:
+			return strconv.FormatFloat(n, 'g', -1, 64), nil
+		}
+		return "", fmt.Errorf("want a number, got %s", kindOf(v))
+	case reflect.Bool:
+		if b, ok := v.(bool); ok {
+			return strconv.FormatBool(b), nil
+		}
+		return "", fmt.Errorf("want true or false, got %s", kindOf(v))
+	case reflect.Slice:
+		if k.typ.Elem().Kind() == reflect.String {
+			return listValue(v)
+		}
+		// A list of records: checked against the type, passed on as JSON.
+		raw, err := json.Marshal(v)
+		if err != nil {
+			return "", err
+		}
+		dec := json.NewDecoder(bytes.NewReader(raw))
+		dec.DisallowUnknownFields()
+		out := reflect.New(k.typ)
+		if err := dec.Decode(out.Interface()); err != nil {
+			return "", fmt.Errorf("want a list of %s: %v", k.typ.Elem().Name(), err)
+		}
+		norm, err := json.Marshal(out.Interface())
+		return string(norm), err
+	}
+	return "", fmt.Errorf("unsupported setting type %s", k.typ)
+}
+
+// listValue takes a list of strings, or one comma-separated string.
+func listValue(v any) (string, error) {
+	if s, ok := v.(string); ok {
+		return s, nil
+	}
+	items, ok := v.([]any)
+	if !ok {
+		return "", fmt.Errorf("want a list, got %s", kindOf(v))
+	}
+	out := make([]string, 0, len(items))
+	for _, it := range items {
+		switch it.(type) {
+		case string, int, float64:
+		default:
+			return "", fmt.Errorf("want a list of strings, got %s in it", kindOf(it))
+		}
+		s := fmt.Sprint(it)
+		if strings.Contains(s, ",") {
+			return "", fmt.Errorf("item %q has a comma, which the setting can't hold", s)
+		}
+		out = append(out, s)
+	}
+	return strings.Join(out, ","), nil
+}
+
+func kindOf(v any) string {
+	switch v.(type) {
+	case string:
+		return "a string"
+	case int, float64:
+		return "a number"
+	case bool:
+		return "a boolean"
+	case []any:
+		return "a list"
+	case map[string]any:
+		return "a section"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// nearestKey is the known key or section closest to path by edit
+// distance.
+func nearestKey(path string) string {
+	best, bestDist := "", -1
+	for _, candidate := range slices.AppendSeq(slices.Clone(fileSections), maps.Keys(fileKeys)) {
+		if d := editDistance(path, candidate); bestDist < 0 || d < bestDist || d == bestDist && candidate < best {
+			best, bestDist = candidate, d
+		}
+	}
+	return best
+}
+
+// editDistance is the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// ─── GET /api/config ─────────────────────────────────────────────────────────
+
+// Where a setting's value came from, in Loaded.Sources.
+const (
+	SourceEnv     = "env"      // the agent's own environment
+	SourceEnvFile = "env_file" // .env or agent.env
+	SourceFile    = "file"     // the config file
+	SourceDefault = "default"
+)
+
+// masked stands in for a masked setting's value.
+const masked = "********"
+
+// Loaded is what the agent runs with, for GET /api/config: the settings
+// after defaults and range checks, with hot-reloaded ones as last
+// applied. Passwords are masked and the secrets only said to be set.
+type Loaded struct {
+	// File is the config file read; "" if there was none.
+	File     string `json:"file"`
+	Settings File   `json:"settings"`
+	// Sources say where each setting, by dotted path, came from.
+	Sources map[string]string `json:"sources"`
+	// Secrets are "set", "default" (AUTH_TOKEN's public fallback) or
+	// "unset", by name.
+	Secrets map[string]string `json:"secrets"`
+}
+
+// Loaded returns the settings the agent runs with.
+func (c *Config) Loaded() Loaded {
+	cur := *c
+	if c.w != nil {
+		c.w.mu.Lock()
+		cur.BackendURL = c.w.hot.BackendURL
+		cur.VPSIP, cur.VPSPort = c.w.hot.VPSIP, c.w.hot.VPSPort
+		cur.secrets = c.w.hot.secrets
+		c.w.mu.Unlock()
+	}
+	out := Loaded{Settings: cur.settings(), Sources: map[string]string{}, Secrets: map[string]string{}}
+	if c.file != nil {
+		out.File = c.file.path
+	}
+	maskSettings(reflect.ValueOf(&out.Settings).Elem())
+
+	for path, k := range fileKeys {
+		out.Sources[path] = c.source(k.env)
+	}
+	for _, k := range append(slices.Clone(secretKeys), SecretRegistrationToken) {
+		switch _, ok := cur.secrets[k]; {
+		case ok:
+			out.Secrets[k] = "set"
+		case k == SecretAuthToken:
+			out.Secrets[k] = "default"
+		default:
+			out.Secrets[k] = "unset"
+		}
+	}
+	return out
+}
+
+// source says where env var key came from.
+func (c *Config) source(key string) string {
+	switch {
+	case c.w == nil:
+		return SourceDefault
+	case c.w.process[key]:
+		return SourceEnv
+	}
+	c.w.mu.Lock()
+	_, fromEnvFile := c.w.fromFiles[key]
+	c.w.mu.Unlock()
+	if fromEnvFile {
+		return SourceEnvFile
+	}
+	if _, ok := c.w.file[key]; ok {
+		return SourceFile
+	}
+	return SourceDefault
+}
+
+// maskSettings replaces the set values of masked fields in the File v.
+func maskSettings(v reflect.Value) {
+	for i := range v.NumField() {
+		section := v.Field(i)
+		for j := range section.NumField() {
+			if section.Type().Field(j).Tag.Get("mask") == "true" && section.Field(j).String() != "" {
+				section.Field(j).SetString(masked)
+			}
+		}
+	}
+}
+
+// settings is c in the config file's layout.
+func (c *Config) settings() File {
+	proxies := c.TunnelProxies
+	if proxies == nil {
+		proxies = []TunnelProxy{}
+	}
+	return File{
+		Agent: AgentSettings{
+			Domain:              c.Domain,
+			BackendURL:          c.BackendURL,
+			UpdateURL:           c.UpdateURL,
+			UpdateChannel:       c.UpdateChannel,
+			UpdateCheckHours:    c.UpdateCheckHours,
+			StorageSetup:        c.StorageSetup,
+			StoreBackend:        c.StoreBackend,
+			ForceMockHardware:   c.ForceMockHardware,
+			CriticalServices:    orEmpty(c.CriticalServices),
+			PprofPort:           c.PprofPort,
+			ObsoleteSweepDryRun: c.SweepDryRun,
+			AuditReport:         c.AuditReport,
+			PeerDiscovery:       c.PeerDiscovery,
+		},
+		API: APISettings{
+			SlowRequestMs: int(c.SlowRequest.Milliseconds()),
+			RateLimits:    orEmpty(c.RateLimits),
+			GatewayHTTP:   c.GatewayHTTP,
+			TLSCertFile:   c.TLSCertFile,
+			TLSKeyFile:    c.TLSKeyFile,
+		},
+		Tunnel: TunnelSettings{
+			VPSIP:                c.VPSIP,
+			VPSPort:              c.VPSPort,
+			MonthlyBudgetGB:      c.TunnelBudgetGB,
+			BudgetBlockDownloads: c.TunnelBlockDownloads,
+			FRPCAutoDownload:     c.FRPCAutoDownload,
+			FRPCMirrorURL:        c.FRPCMirrorURL,
+			Proxies:              proxies,
+		},
+		WiFi: WiFiSettings{
+			SSID:            c.WiFiSSID,
+			Password:        c.WiFiPassword,
+			Band:            c.WiFiBand,
+			Channel:         c.WiFiChannel,
+			AuthAutoBlock:   c.WiFiAuthAutoBlock,
+			TrafficPriority: c.TrafficPriority,
+		},
+		Adblock: AdblockSettings{Sources: orEmpty(c.AdblockSources)},
+		Monitor: MonitorSettings{
+			Targets:              orEmpty(c.MonitorTargets),
+			ReportMinutes:        c.MonitorReportMinutes,
+			DNSUpstream:          c.MonitorDNSUpstream,
+			SpeedtestURLs:        orEmpty(c.SpeedtestURLs),
+			SpeedtestUploadURL:   c.SpeedtestUploadURL,
+			SpeedtestSeconds:     c.SpeedtestSeconds,
+			SpeedtestConnections: c.SpeedtestConnections,
+		},
+		Cloud: CloudSettings{
+			FileWorker:             c.FileWorker,
+			TrashRetentionDays:     c.TrashRetentionDays,
+			UploadReserveGB:        float64(c.UploadReserve) / (1 << 30),
+			UploadReservePercent:   c.UploadReservePercent,
+			SystemReserveGB:        float64(c.SystemReserve) / (1 << 30),
+			SystemReservePercent:   c.SystemReservePercent,
+			JobWorkers:             c.CloudJobWorkers,
+			JobPaceMs:              int(c.CloudJobPace.Milliseconds()),
+			TransferBandwidthShare: c.TransferShare,
+			WebDAVUser:             c.WebDAVUser,
+			WebDAVPassword:         c.WebDAVPassword,
+		},
+		VPN: VPNSettings{TailscaleClientID: c.TailScaleClientId},
+	}
+}
+
+// orEmpty keeps an unset list from reading as null.
+func orEmpty(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
+
+// tunnelProxies reads TUNNEL_PROXIES, a JSON list of TunnelProxy. None,
+// or one that doesn't parse, leaves the tunnel's default proxy.
+func tunnelProxies() []TunnelProxy {
+	raw := getEnv("TUNNEL_PROXIES", "")
+	if raw == "" {
+		return nil
+	}
+	var out []TunnelProxy
+	if err := json.Unmarshal([]byte(raw), &out); err != nil {
+		slog.Warn("config: TUNNEL_PROXIES is not a JSON list of proxies, using the default proxy", "err", err)
+		return nil
+	}
+	return out
+}
@@ -0,0 +1,138 @@
+package config
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeConfigFile writes content to name in a fresh directory.
+func writeConfigFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// unsetEnv clears keys for the test, restoring them after.
+func unsetEnv(t *testing.T, keys ...string) {
+	for _, k := range keys {
+		t.Setenv(k, "")
+		os.Unsetenv(k)
+	}
+}
+
+func TestReadFile_UnderTheEnvironment(t *testing.T) {
+	unsetEnv(t, "VPS_IP", "VPS_PORT", "MONITOR_TARGETS", "TUNNEL_PROXIES", "WIFI_SSID", "AUTH_TOKEN", "DOMAIN")
+	t.Setenv("VPS_PORT", "7001")
+	path := writeConfigFile(t, "config.yaml", `
+tunnel:
+  vps_ip: 203.0.113.7
+  vps_port: 9000
+  vps_pot: 9001
+  proxies:
+    - {name: web, type: http, local_port: 8080}
+monitor:
+  targets: [gateway, 1.1.1.1]
+wifi:
+  ssid: Home
+  auth_token: s3cret
+agent:
+  domain: [not, a, string]
+`)
+
+	lf := readFile(path, false)
+	for k, want := range map[string]string{
+		"VPS_IP":          "203.0.113.7",
+		"VPS_PORT":        "7001", // set for the agent: the file can't change it
+		"MONITOR_TARGETS": "gateway,1.1.1.1",
+		"TUNNEL_PROXIES":  `[{"name":"web","type":"http","local_port":8080}]`,
+		"WIFI_SSID":       "Home",
+		"AUTH_TOKEN":      "", // secrets are not read from the file
+		"DOMAIN":          "", // the wrong type is a problem, not a value
+	} {
+		if got := os.Getenv(k); got != want {
+			t.Errorf("%s = %q, want %q", k, got, want)
+		}
+	}
+	if lf.values["VPS_PORT"] != "9000" {
+		t.Errorf("the file's VPS_PORT = %q, want it kept for the sources", lf.values["VPS_PORT"])
+	}
+	if len(lf.problems) != 1 || lf.problems[0].field != "agent.domain" {
+		t.Errorf("problems = %+v, want only agent.domain", lf.problems)
+	}
+}
+
+func TestReadFile_JSONAndMissing(t *testing.T) {
+	unsetEnv(t, "SPEEDTEST_SECONDS", "WEBDAV_USER")
+	lf := readFile(writeConfigFile(t, "config.json", `{"monitor": {"speedtest_seconds": 5}, "cloud": {"webdav_user": "ana"}}`), true)
+	if len(lf.problems) != 0 || os.Getenv("SPEEDTEST_SECONDS") != "5" || os.Getenv("WEBDAV_USER") != "ana" {
+		t.Errorf("JSON file: problems %+v, SPEEDTEST_SECONDS=%q WEBDAV_USER=%q", lf.problems, os.Getenv("SPEEDTEST_SECONDS"), os.Getenv("WEBDAV_USER"))
+	}
+
+	missing := filepath.Join(t.TempDir(), "config.yaml")
+	if lf := readFile(missing, false); lf.path != "" || len(lf.problems) != 0 {
+		t.Errorf("missing default file: %+v", lf)
+	}
+	if lf := readFile(missing, true); len(lf.problems) != 1 {
+		t.Errorf("missing -config file: problems %+v", lf.problems)
+	}
+	if lf := readFile(writeConfigFile(t, "config.yaml", "tunnel: [\n"), false); len(lf.problems) != 1 {
+		t.Errorf("invalid YAML: problems %+v", lf.problems)
+	}
+}
+
+func TestNearestKey(t *testing.T) {
+	for in, want := range map[string]string{
+		"tunnel.vps_pot": "tunnel.vps_port",
+		"tunel":          "tunnel",
+		"monitor.target": "monitor.targets",
+		"wifi.passwrd":   "wifi.password",
+	} {
+		if got := nearestKey(in); got != want {
+			t.Errorf("nearestKey(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestLoaded_MasksAndSaysWhereFrom(t *testing.T) {
+	unsetEnv(t, "WIFI_SSID", "BACKEND_URL")
+	t.Setenv("VPS_IP", "203.0.113.7")
+	w := newWatcher(nil, "127.0.0.1")
+	w.fromFiles = map[string]string{"BACKEND_URL": "https://a.example"}
+	w.file = map[string]string{"WIFI_SSID": "Home", "WIFI_PASSWORD": "hunter22", "VPS_IP": "198.51.100.1"}
+	cfg := &Config{
+		VPSIP: "203.0.113.7", BackendURL: "https://a.example", WiFiSSID: "Home", WiFiPassword: "hunter22",
+		file: &loadedFile{path: "/etc/strct/config.yaml"}, w: w,
+	}
+	cfg.SetSecret(SecretTailscaleKey, "tskey-auth-abc123")
+	w.hot = *cfg
+
+	got := cfg.Loaded()
+	if got.File != "/etc/strct/config.yaml" || got.Settings.WiFi.SSID != "Home" || got.Settings.WiFi.Password != masked {
+		t.Errorf("file %q, wifi %+v", got.File, got.Settings.WiFi)
+	}
+	for path, want := range map[string]string{
+		"tunnel.vps_ip":     SourceEnv,
+		"agent.backend_url": SourceEnvFile,
+		"wifi.ssid":         SourceFile,
+		"monitor.targets":   SourceDefault,
+	} {
+		if got.Sources[path] != want {
+			t.Errorf("source of %s = %q, want %q", path, got.Sources[path], want)
+		}
+	}
+	if got.Secrets[SecretTailscaleKey] != "set" || got.Secrets[SecretAuthToken] != "default" {
+		t.Errorf("secrets = %v", got.Secrets)
+	}
+	b, _ := json.Marshal(got)
+	for _, leak := range []string{"hunter22", "tskey-auth-abc123"} {
+		if strings.Contains(string(b), leak) {
+			t.Errorf("GET /api/config shows %q", leak)
+		}
+	}
+}
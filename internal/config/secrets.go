@@ -0,0 +1,345 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/strct-org/strct-agent/internal/fsutil"
+)
+
+// ─── Secrets ─────────────────────────────────────────────────────────────────
+
+// The frp token and the Tailscale auth key are kept encrypted in
+// $DataDir/secrets.enc rather than in plaintext env files on the SD card.
+// The key is derived from the device ID, salted with /etc/machine-id, so
+// the file is useless copied to another device. It is not a vault: both
+// inputs live on the same card, and someone who images all of it can
+// derive the key. It keeps the secrets out of a casual read of the card
+// and out of the environment the agent's child processes inherit.
+//
+// A secret found in the environment or an env file at Load or Reload is
+// taken as its new value: it is moved into the store, unset from the
+// process environment, and, outside dev mode, scrubbed from the env
+// files. Read them with Config.Secret.
+//
+// The registration token is kept there too, but the backend hands it
+// out; it is never read from the environment. See SaveSecret.
+const (
+	SecretAuthToken         = "AUTH_TOKEN"
+	SecretTailscaleKey      = "TAILSCALE_AUTH_TOKEN"
+	SecretRegistrationToken = "REGISTRATION_TOKEN"
+)
+
+var secretKeys = []string{SecretAuthToken, SecretTailscaleKey}
+
+func isSecret(key string) bool {
+	for _, k := range secretKeys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrSecretsTampered is a secrets file that does not decrypt: modified,
+// cut short, or written on another device.
+var ErrSecretsTampered = errors.New("config: secrets file was modified or belongs to another device")
+
+// secretsMagic starts the file and is authenticated with it, so a file of
+// another format or version is refused rather than misread.
+const secretsMagic = "strct-secrets-v1\n"
+
+// machineIDPaths are where the systemd and D-Bus machine IDs live.
+var machineIDPaths = []string{"/etc/machine-id", "/var/lib/dbus/machine-id"}
+
+// SecretsPath is the encrypted secrets file in dataDir.
+func SecretsPath(dataDir string) string {
+	return filepath.Join(dataDir, "secrets.enc")
+}
+
+// Secret returns the secret name, SecretAuthToken or SecretTailscaleKey.
+// AUTH_TOKEN falls back to the public default, like the env var did;
+// other secrets to "".
+func (c *Config) Secret(name string) string {
+	if v, ok := c.secrets[name]; ok {
+		return v
+	}
+	if name == SecretAuthToken {
+		return defaultAuthToken
+	}
+	return ""
+}
+
+// SetSecret sets a secret in this Config only, without storing it, as a
+// feature does with a value a reload handed it.
+func (c *Config) SetSecret(name, value string) {
+	next := maps.Clone(c.secrets)
+	if next == nil {
+		next = map[string]string{}
+	}
+	next[name] = value
+	c.secrets = next
+}
+
+// SaveSecret stores a secret the agent was handed rather than found in
+// the environment, and has Reload and Watch pass it on from now on. Like
+// a reload, it leaves c as loaded.
+func (c *Config) SaveSecret(name, value string) error {
+	if c.store == nil {
+		return errors.New("config: no secrets store to save " + name + " in")
+	}
+	hot := c
+	if c.w != nil {
+		c.w.mu.Lock()
+		defer c.w.mu.Unlock()
+		hot = &c.w.hot
+	}
+	next := maps.Clone(hot.secrets)
+	if next == nil {
+		next = map[string]string{}
+	}
+	next[name] = value
+	if err := c.store.save(next); err != nil {
+		return fmt.Errorf("config: save %s: %w", name, err)
+	}
+	hot.secrets = next
+	return nil
+}
+
+// secretStore reads and writes the encrypted secrets file.
+type secretStore struct {
+	path string
+	key  []byte
+}
+
+func newSecretStore(path, deviceID, machineID string) (*secretStore, error) {
+	key, err := hkdf.Key(sha256.New, []byte(deviceID), []byte(machineID), "strct-agent secrets", 32)
+	if err != nil {
+		return nil, err
+	}
+	return &secretStore{path: path, key: key}, nil
+}
+
+// load returns the stored secrets; none for a missing file.
+func (s *secretStore) load() (map[string]string, error) {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := s.aead()
+	if err != nil {
+		return nil, err
+	}
+	body, ok := bytes.CutPrefix(data, []byte(secretsMagic))
+	if !ok || len(body) < gcm.NonceSize() {
+		return nil, ErrSecretsTampered
+	}
+	nonce, sealed := body[:gcm.NonceSize()], body[gcm.NonceSize():]
+	plain, err := gcm.Open(nil, nonce, sealed, []byte(secretsMagic))
+	if err != nil {
+		return nil, ErrSecretsTampered
+	}
+	vals := map[string]string{}
+	if err := json.Unmarshal(plain, &vals); err != nil {
+		return nil, fmt.Errorf("decode secrets: %w", err)
+	}
+	return vals, nil
+}
+
+// save encrypts vals under a fresh nonce and replaces the file.
+func (s *secretStore) save(vals map[string]string) error {
+	plain, err := json.Marshal(vals)
+	if err != nil {
+		return err
+	}
+	gcm, err := s.aead()
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	out := append([]byte(secretsMagic), nonce...)
+	out = gcm.Seal(out, nonce, plain, []byte(secretsMagic))
+	return fsutil.WriteFileAtomic(s.path, out, 0600)
+}
+
+func (s *secretStore) aead() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(s.key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// machineID is the first machine ID found, "" where there is none (not
+// Linux, or a container).
+func machineID() string {
+	for _, p := range machineIDPaths {
+		if b, err := os.ReadFile(p); err == nil {
+			if id := strings.TrimSpace(string(b)); id != "" {
+				return id
+			}
+		}
+	}
+	return ""
+}
+
+// loadSecrets opens the store in DataDir and moves the secrets still in
+// the environment into it. files are the env files to scrub them from.
+func (c *Config) loadSecrets(files []string) {
+	store, err := newSecretStore(SecretsPath(c.DataDir), c.DeviceID, machineID())
+	if err != nil {
+		slog.Error("config: secrets store unavailable, using the environment", "err", err)
+	}
+	c.store = store
+
+	stored := map[string]string{}
+	if store != nil {
+		stored, err = store.load()
+		if errors.Is(err, ErrSecretsTampered) && c.Identity.PreviousID != "" {
+			stored, err = rekeySecrets(store, c.Identity.PreviousID)
+		}
+		if err != nil {
+			// Keep the file for a look; the environment may still hold
+			// the secrets.
+			slog.Error("config: secrets store unreadable, using the environment", "path", store.path, "err", err)
+			c.store, stored = nil, map[string]string{}
+		}
+	}
+	plain := map[string]string{}
+	for _, k := range secretKeys {
+		if v, ok := os.LookupEnv(k); ok && v != "" {
+			plain[k] = v
+		}
+	}
+	c.secrets = stored
+	c.storeSecrets(plain, files)
+}
+
+// rekeySecrets opens the store under previousID, the device ID before it
+// changed with the hardware, and saves it under the new one. The
+// registration token was the other device's and is dropped.
+func rekeySecrets(store *secretStore, previousID string) (map[string]string, error) {
+	old, err := newSecretStore(store.path, previousID, machineID())
+	if err != nil {
+		return nil, err
+	}
+	vals, err := old.load()
+	if err != nil {
+		return nil, err
+	}
+	delete(vals, SecretRegistrationToken)
+	if err := store.save(vals); err != nil {
+		return nil, err
+	}
+	slog.Info("config: secrets store moved to the new device ID", "path", store.path, "previous_id", previousID)
+	return vals, nil
+}
+
+// storeSecrets sets the secrets in plain, found in the environment or the
+// env files, saves them encrypted and scrubs them from both. Saved
+// secrets already equal are only scrubbed. Without a store, or if saving
+// fails, they are used as they are and left in place.
+func (c *Config) storeSecrets(plain map[string]string, files []string) {
+	if len(plain) == 0 {
+		return
+	}
+	next := maps.Clone(c.secrets)
+	if next == nil {
+		next = map[string]string{}
+	}
+	changed := false
+	for k, v := range plain {
+		changed = changed || next[k] != v
+		next[k] = v
+	}
+	c.secrets = next
+	if c.store == nil {
+		return
+	}
+	if changed {
+		if err := c.store.save(next); err != nil {
+			slog.Warn("config: secrets not saved, leaving them in plaintext", "path", c.store.path, "err", err)
+			return
+		}
+		slog.Info("config: secrets moved to the encrypted store", "vars", secretNames(plain), "path", c.store.path)
+	}
+	for k := range plain {
+		os.Unsetenv(k)
+	}
+	if c.IsDev {
+		return
+	}
+	for _, f := range files {
+		if err := scrubEnvFile(f, plain); err != nil {
+			slog.Warn("config: could not remove secrets from env file", "path", f, "err", err)
+		}
+	}
+}
+
+// scrubEnvFile drops the lines of path that set one of keys, leaving a
+// comment in their place. A missing file is fine.
+func scrubEnvFile(path string, keys map[string]string) error {
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var out bytes.Buffer
+	scrubbed := false
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		line := sc.Text()
+		k, _, ok := strings.Cut(strings.TrimPrefix(strings.TrimSpace(line), "export "), "=")
+		if _, secret := keys[strings.TrimSpace(k)]; ok && secret {
+			fmt.Fprintf(&out, "# %s is kept encrypted in secrets.enc; set it here again to replace it\n", strings.TrimSpace(k))
+			scrubbed = true
+			continue
+		}
+		out.WriteString(line + "\n")
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	if !scrubbed {
+		return nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	return fsutil.WriteFileAtomic(path, out.Bytes(), info.Mode().Perm())
+}
+
+func secretNames(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for _, k := range secretKeys {
+		if _, ok := m[k]; ok {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
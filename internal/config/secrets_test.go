@@ -0,0 +1,238 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/joho/godotenv"
+)
+
+func TestSecretStore_RoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secrets.enc")
+	s, err := newSecretStore(path, "device-1", "0123456789abcdef")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vals, err := s.load(); err != nil || len(vals) != 0 {
+		t.Fatalf("missing file: %v %v", vals, err)
+	}
+	want := map[string]string{SecretAuthToken: "s3cret", SecretTailscaleKey: "tskey-auth-abc123"}
+	if err := s.save(want); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.load()
+	if err != nil || fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("load = %v, %v", got, err)
+	}
+
+	data, _ := os.ReadFile(path)
+	if bytes.Contains(data, []byte("s3cret")) || bytes.Contains(data, []byte("tskey-")) {
+		t.Error("secrets written in plaintext")
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0600 {
+		t.Errorf("mode %v, want 0600", info.Mode().Perm())
+	}
+	// A fresh nonce each save: the same secrets never look the same.
+	s.save(want)
+	if again, _ := os.ReadFile(path); bytes.Equal(again, data) {
+		t.Error("saved twice to the same bytes")
+	}
+
+	for name, other := range map[string][2]string{
+		"another device":  {"device-2", "0123456789abcdef"},
+		"another machine": {"device-1", "fedcba9876543210"},
+	} {
+		o, _ := newSecretStore(path, other[0], other[1])
+		if _, err := o.load(); !errors.Is(err, ErrSecretsTampered) {
+			t.Errorf("%s: load = %v, want ErrSecretsTampered", name, err)
+		}
+	}
+}
+
+func TestSecretStore_DetectsTampering(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secrets.enc")
+	s, _ := newSecretStore(path, "device-1", "0123456789abcdef")
+	if err := s.save(map[string]string{SecretAuthToken: "s3cret"}); err != nil {
+		t.Fatal(err)
+	}
+	good, _ := os.ReadFile(path)
+	nonceAt, sealedAt := len(secretsMagic), len(secretsMagic)+12
+
+	for name, tamper := range map[string]func([]byte) []byte{
+		"header":            func(b []byte) []byte { b[len("strct-secrets-v")] = '2'; return b },
+		"nonce":             func(b []byte) []byte { b[nonceAt] ^= 1; return b },
+		"ciphertext":        func(b []byte) []byte { b[sealedAt] ^= 1; return b },
+		"tag":               func(b []byte) []byte { b[len(b)-1] ^= 1; return b },
+		"truncated":         func(b []byte) []byte { return b[:len(b)-4] },
+		"cut to the header": func(b []byte) []byte { return b[:nonceAt+3] },
+		"empty":             func(b []byte) []byte { return nil },
+	} {
+		os.WriteFile(path, tamper(bytes.Clone(good)), 0600)
+		if vals, err := s.load(); !errors.Is(err, ErrSecretsTampered) {
+			t.Errorf("%s: load = %v, %v, want ErrSecretsTampered", name, vals, err)
+		}
+	}
+}
+
+func TestLoadSecrets_MovesPlaintextToTheStore(t *testing.T) {
+	dataDir := t.TempDir()
+	env := filepath.Join(t.TempDir(), "agent.env")
+	os.WriteFile(env, []byte("VPS_IP=203.0.113.7\nAUTH_TOKEN=s3cret\nexport TAILSCALE_AUTH_TOKEN=tskey-auth-abc123\n"), 0640)
+	t.Setenv(SecretAuthToken, "s3cret")
+	t.Setenv(SecretTailscaleKey, "tskey-auth-abc123")
+
+	c := &Config{DataDir: dataDir, DeviceID: "device-1"}
+	c.loadSecrets([]string{env, filepath.Join(t.TempDir(), "missing.env")})
+	if c.Secret(SecretAuthToken) != "s3cret" || c.Secret(SecretTailscaleKey) != "tskey-auth-abc123" {
+		t.Fatalf("secrets = %v", c.secrets)
+	}
+	for _, k := range secretKeys {
+		if _, ok := os.LookupEnv(k); ok {
+			t.Errorf("%s still in the environment", k)
+		}
+	}
+	scrubbed, _ := os.ReadFile(env)
+	if strings.Contains(string(scrubbed), "s3cret") || strings.Contains(string(scrubbed), "tskey-") ||
+		!strings.Contains(string(scrubbed), "VPS_IP=203.0.113.7\n") {
+		t.Errorf("env file after the move:\n%s", scrubbed)
+	}
+	if vals, _ := godotenv.Read(env); len(vals) != 1 {
+		t.Errorf("env file sets %v", vals)
+	}
+	if info, _ := os.Stat(env); info.Mode().Perm() != 0640 {
+		t.Errorf("env file mode %v, want 0640", info.Mode().Perm())
+	}
+
+	// The next start reads them back from the store alone.
+	next := &Config{DataDir: dataDir, DeviceID: "device-1"}
+	next.loadSecrets([]string{env})
+	if next.Secret(SecretAuthToken) != "s3cret" || next.Secret(SecretTailscaleKey) != "tskey-auth-abc123" {
+		t.Errorf("after restart: %v", next.secrets)
+	}
+
+	// A store that doesn't decrypt is left alone, and the environment used.
+	t.Setenv(SecretAuthToken, "n3w")
+	other := &Config{DataDir: dataDir, DeviceID: "device-2"}
+	other.loadSecrets([]string{env})
+	if other.Secret(SecretAuthToken) != "n3w" || other.Secret(SecretTailscaleKey) != "" || other.store != nil {
+		t.Errorf("unreadable store: %v", other.secrets)
+	}
+	if v, ok := os.LookupEnv(SecretAuthToken); !ok || v != "n3w" {
+		t.Error("secret taken out of the environment without a store to keep it")
+	}
+}
+
+func TestLoadSecrets_KeepsDevEnvFiles(t *testing.T) {
+	env := filepath.Join(t.TempDir(), ".env")
+	os.WriteFile(env, []byte("AUTH_TOKEN=s3cret\n"), 0644)
+	t.Setenv(SecretAuthToken, "s3cret")
+	t.Setenv(SecretTailscaleKey, "")
+
+	c := &Config{IsDev: true, DataDir: t.TempDir(), DeviceID: "device-1"}
+	c.loadSecrets([]string{env})
+	if c.Secret(SecretAuthToken) != "s3cret" {
+		t.Errorf("secret = %q", c.Secret(SecretAuthToken))
+	}
+	if b, _ := os.ReadFile(env); string(b) != "AUTH_TOKEN=s3cret\n" {
+		t.Errorf("dev .env rewritten:\n%s", b)
+	}
+	if _, err := os.Stat(SecretsPath(c.DataDir)); err != nil {
+		t.Errorf("not stored: %v", err)
+	}
+	if (&Config{}).Secret(SecretAuthToken) != defaultAuthToken {
+		t.Error("AUTH_TOKEN does not fall back to the default")
+	}
+}
+
+func TestReload_MovesNewSecretsToTheStore(t *testing.T) {
+	env := filepath.Join(t.TempDir(), "agent.env")
+	os.WriteFile(env, []byte("VPS_IP=203.0.113.7\n"), 0600)
+	for _, k := range append([]string{"VPS_IP"}, secretKeys...) {
+		t.Setenv(k, "") // restored after the test
+		os.Unsetenv(k)
+	}
+	w := newWatcher([]string{env}, "127.0.0.1")
+	godotenv.Load(env)
+	cfg := &Config{DataDir: t.TempDir(), DeviceID: "device-1", VPSIP: "203.0.113.7", w: w}
+	cfg.loadSecrets(w.files)
+	cfg.SetSecret(SecretAuthToken, "old")
+	cfg.store.save(cfg.secrets)
+	w.fromFiles = w.read()
+	w.hot = *cfg
+	tunnel := cfg.Watch(SecretAuthToken)
+
+	os.WriteFile(env, []byte("VPS_IP=203.0.113.7\nAUTH_TOKEN=n3w\n"), 0600)
+	r, err := cfg.Reload()
+	if err != nil || fmt.Sprint(r.Applied) != "[AUTH_TOKEN]" {
+		t.Fatalf("reload = %+v, %v", r, err)
+	}
+	select {
+	case c := <-tunnel:
+		if c.Secret(SecretAuthToken) != "n3w" {
+			t.Errorf("watcher got %q", c.Secret(SecretAuthToken))
+		}
+	default:
+		t.Fatal("the tunnel watcher was not told")
+	}
+	if cfg.Secret(SecretAuthToken) != "old" {
+		t.Errorf("the loaded config changed: %q", cfg.Secret(SecretAuthToken))
+	}
+	if b, _ := os.ReadFile(env); strings.Contains(string(b), "n3w") {
+		t.Errorf("env file not scrubbed:\n%s", b)
+	}
+	if vals, _ := cfg.store.load(); vals[SecretAuthToken] != "n3w" {
+		t.Errorf("stored %v", vals)
+	}
+
+	// The scrub itself is not a change.
+	if r, _ := cfg.Reload(); len(r.Applied) != 0 || len(r.NeedsRestart) != 0 {
+		t.Errorf("reload after the scrub: %+v", r)
+	}
+}
+
+func TestSaveSecret_KeptAcrossReloadsAndRekeyed(t *testing.T) {
+	unsetEnv(t, SecretAuthToken, SecretTailscaleKey)
+	dataDir := t.TempDir()
+	env := filepath.Join(t.TempDir(), "agent.env")
+	os.WriteFile(env, []byte("AUTH_TOKEN=s3cret\n"), 0600)
+	godotenv.Load(env)
+
+	w := newWatcher([]string{env}, "127.0.0.1")
+	c := &Config{DataDir: dataDir, DeviceID: "device-1", w: w}
+	c.loadSecrets(w.files)
+	w.fromFiles = w.read()
+	w.hot = *c
+	if err := c.SaveSecret(SecretRegistrationToken, "reg-1"); err != nil {
+		t.Fatal(err)
+	}
+	if c.Secret(SecretRegistrationToken) != "" {
+		t.Error("SaveSecret changed the loaded config")
+	}
+	// A reload saving another secret keeps the token.
+	os.WriteFile(env, []byte("TAILSCALE_AUTH_TOKEN=tskey-auth-abc123\n"), 0600)
+	if _, err := c.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	next := &Config{DataDir: dataDir, DeviceID: "device-1"}
+	next.loadSecrets(nil)
+	if next.Secret(SecretRegistrationToken) != "reg-1" || next.Secret(SecretTailscaleKey) != "tskey-auth-abc123" || next.Secret(SecretAuthToken) != "s3cret" {
+		t.Errorf("after restart: %v", next.secrets)
+	}
+
+	// The device ID changed with the hardware: the store moves over
+	// without the other device's token.
+	moved := &Config{DataDir: dataDir, DeviceID: "device-2", Identity: Identity{PreviousID: "device-1"}}
+	moved.loadSecrets(nil)
+	if moved.store == nil || moved.Secret(SecretAuthToken) != "s3cret" || moved.Secret(SecretRegistrationToken) != "" {
+		t.Errorf("rekeyed: %v", moved.secrets)
+	}
+	again := &Config{DataDir: dataDir, DeviceID: "device-2"}
+	if again.loadSecrets(nil); again.Secret(SecretAuthToken) != "s3cret" {
+		t.Errorf("not saved under the new ID: %v", again.secrets)
+	}
+}
@@ -0,0 +1,182 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/errs"
+)
+
+// ─── Validate ────────────────────────────────────────────────────────────────
+
+// defaultAuthToken is what AUTH_TOKEN falls back to. Anyone who reads the
+// source can log in to the VPS's frps with it.
+const defaultAuthToken = "default-secret"
+
+// resolveTimeout bounds the lookup of a VPS_IP hostname.
+const resolveTimeout = 3 * time.Second
+
+// dnsLabel is one label of a DNS name.
+var dnsLabel = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// intKeys are the integer settings Validate reports when they don't
+// parse, rather than letting Load's fallback hide the typo.
+var intKeys = []string{"VPS_PORT", "PPROF_PORT"}
+
+// Validate checks the settings a typo or an unset variable would break
+// without a word, long after start: the frp token, the VPS address and
+// port, the pprof port, DataDir, the domain and the Tailscale key. Every
+// problem is returned, as an *errs.Validation whose fields are the env
+// vars, or DataDir, and whose messages say what to set. The default
+// AUTH_TOKEN is only a problem outside dev mode.
+//
+// DataDir is created if missing, as the cloud would. A VPS_IP hostname
+// that doesn't resolve is only a problem when DNS says it doesn't exist:
+// on first boot there is no network to ask yet.
+func (c *Config) Validate() error {
+	return c.validate(net.DefaultResolver.LookupHost)
+}
+
+func (c *Config) validate(lookupHost func(ctx context.Context, host string) ([]string, error)) error {
+	var v errs.Validation
+
+	if token := c.Secret(SecretAuthToken); !c.IsDev && (token == "" || token == defaultAuthToken) {
+		v.Add("AUTH_TOKEN", errs.CodeRequired,
+			"AUTH_TOKEN is not set, so the tunnel uses the public default; set it to the token the VPS's frps expects")
+	}
+
+	switch {
+	case c.VPSIP == "":
+		v.Add("VPS_IP", errs.CodeRequired, "VPS_IP is empty; set it to the VPS's IP address or hostname")
+	case net.ParseIP(c.VPSIP) != nil:
+	case !isDNSName(c.VPSIP):
+		v.Addf("VPS_IP", errs.CodeInvalid, "VPS_IP %q is neither an IP address nor a hostname; set it to the VPS's address", c.VPSIP)
+	default:
+		ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+		_, err := lookupHost(ctx, c.VPSIP)
+		cancel()
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			v.Addf("VPS_IP", errs.CodeNotFound, "VPS_IP %q does not resolve; check the spelling or use the VPS's IP address", c.VPSIP)
+		}
+	}
+
+	for _, p := range []struct {
+		key  string
+		port int
+		hint string
+	}{
+		{"VPS_PORT", c.VPSPort, "set it to the port frps listens on, 7000 unless the VPS says otherwise"},
+		{"PPROF_PORT", c.PprofPort, "set it to a free local port, or leave it unset for 6060"},
+	} {
+		if raw, ok := c.malformed[p.key]; ok {
+			v.Addf(p.key, errs.CodeInvalid, "%s %q is not a number; %s", p.key, raw, p.hint)
+			continue
+		}
+		if p.port < 1 || p.port > 65535 {
+			v.Addf(p.key, errs.CodeOutOfRange, "%s %d is not a port (1-65535); %s", p.key, p.port, p.hint)
+		}
+	}
+
+	if err := checkWritable(c.DataDir); err != nil {
+		v.Addf("DataDir", errs.CodeInvalid, "data directory %s is not writable: %v; mount the data drive or fix its permissions", c.DataDir, err)
+	}
+
+	if !isDNSName(c.Domain) {
+		v.Addf("DOMAIN", errs.CodeInvalid, "DOMAIN %q is not a DNS name; set it to the domain devices get subdomains of, such as strct.org", c.Domain)
+	}
+
+	if key := c.Secret(SecretTailscaleKey); key != "" && !strings.HasPrefix(key, "tskey-") {
+		v.Add("TAILSCALE_AUTH_TOKEN", errs.CodeInvalid,
+			"TAILSCALE_AUTH_TOKEN does not start with tskey-; copy the whole auth key from the Tailscale admin console, or unset it")
+	}
+
+	if c.file != nil {
+		for _, p := range c.file.problems {
+			v.Add(p.field, p.code, p.message)
+		}
+	}
+
+	return v.Err()
+}
+
+// isDNSName reports whether name is a syntactically valid DNS name. A
+// trailing dot is allowed.
+func isDNSName(name string) bool {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	if name == "" || len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if !dnsLabel.MatchString(label) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkWritable creates dir if missing and a file in it.
+func checkWritable(dir string) error {
+	if dir == "" {
+		return errors.New("not set")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".strct-write-check-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// malformedInts returns the keys that are set but not integers, with
+// their values.
+func malformedInts(keys ...string) map[string]string {
+	out := map[string]string{}
+	for _, k := range keys {
+		raw, ok := os.LookupEnv(k)
+		if !ok || raw == "" {
+			continue
+		}
+		if _, err := strconv.Atoi(raw); err != nil {
+			out[k] = raw
+		}
+	}
+	return out
+}
+
+// ValidateAtStart runs Validate and logs each problem. Outside dev mode
+// the problems are returned and the agent must not start; in dev mode
+// they are only warnings.
+func (c *Config) ValidateAtStart() error {
+	err := c.Validate()
+	var v *errs.Validation
+	if !errors.As(err, &v) {
+		return err
+	}
+	for _, p := range v.Errors {
+		if c.IsDev {
+			slog.Warn("config: invalid setting, ignored in dev mode", "var", p.Field, "problem", p.Message)
+		} else {
+			slog.Error("config: invalid setting", "var", p.Field, "problem", p.Message)
+		}
+	}
+	if c.IsDev {
+		return nil
+	}
+	where := EnvPath(c.IsDev)
+	if c.file != nil && c.file.path != "" {
+		where += " or " + c.file.path
+	}
+	return fmt.Errorf("config: %d invalid settings, fix them in the environment or %s: %w", len(v.Errors), where, err)
+}
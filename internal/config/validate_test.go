@@ -0,0 +1,114 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/strct-org/strct-agent/internal/errs"
+)
+
+// fakeLookup resolves vps.example.com and nothing else, the way a
+// resolver with a network answers.
+func fakeLookup(_ context.Context, host string) ([]string, error) {
+	switch host {
+	case "vps.example.com":
+		return []string{"203.0.113.10"}, nil
+	case "offline.example.com":
+		return nil, &net.DNSError{Err: "i/o timeout", Name: host, IsTimeout: true}
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func TestValidate(t *testing.T) {
+	valid := func(t *testing.T) Config {
+		c := Config{
+			VPSIP: "203.0.113.10", VPSPort: 7000, PprofPort: 6060, DataDir: t.TempDir(), Domain: "strct.org",
+		}
+		c.SetSecret(SecretAuthToken, "s3cret")
+		c.SetSecret(SecretTailscaleKey, "tskey-auth-abc123")
+		return c
+	}
+	// A file where the directory should be: not writable, even for root.
+	notADir := filepath.Join(t.TempDir(), "data")
+	os.WriteFile(notADir, nil, 0644)
+
+	tests := []struct {
+		name   string
+		modify func(c *Config)
+		want   string // "FIELD=code ...", "" for none
+	}{
+		{"valid", func(c *Config) {}, ""},
+		{"resolvable hostname", func(c *Config) { c.VPSIP = "vps.example.com" }, ""},
+		{"hostname with no network to ask", func(c *Config) { c.VPSIP = "offline.example.com" }, ""},
+		{"no tailscale key", func(c *Config) { c.SetSecret(SecretTailscaleKey, "") }, ""},
+		{"default token", func(c *Config) { c.SetSecret(SecretAuthToken, defaultAuthToken) }, "AUTH_TOKEN=required"},
+		{"empty token", func(c *Config) { c.SetSecret(SecretAuthToken, "") }, "AUTH_TOKEN=required"},
+		{"default token in dev mode", func(c *Config) { c.IsDev = true; c.SetSecret(SecretAuthToken, defaultAuthToken) }, ""},
+		{"empty VPS_IP", func(c *Config) { c.VPSIP = "" }, "VPS_IP=required"},
+		{"garbled VPS_IP", func(c *Config) { c.VPSIP = "203.0.113.10:7000" }, "VPS_IP=invalid"},
+		{"unknown host", func(c *Config) { c.VPSIP = "vsp.example.com" }, "VPS_IP=not_found"},
+		{"port zero", func(c *Config) { c.VPSPort = 0 }, "VPS_PORT=out_of_range"},
+		{"port too high", func(c *Config) { c.PprofPort = 70000 }, "PPROF_PORT=out_of_range"},
+		{"port typo", func(c *Config) { c.malformed = map[string]string{"VPS_PORT": "70o0"} }, "VPS_PORT=invalid"},
+		{"unset data dir", func(c *Config) { c.DataDir = "" }, "DataDir=invalid"},
+		{"unwritable data dir", func(c *Config) { c.DataDir = filepath.Join(notADir, "cloud") }, "DataDir=invalid"},
+		{"domain with a scheme", func(c *Config) { c.Domain = "https://strct.org" }, "DOMAIN=invalid"},
+		{"domain label too long", func(c *Config) { c.Domain = strings.Repeat("a", 64) + ".org" }, "DOMAIN=invalid"},
+		{"not a tailscale key", func(c *Config) { c.SetSecret(SecretTailscaleKey, "abc123") }, "TAILSCALE_AUTH_TOKEN=invalid"},
+		{"config file type error", func(c *Config) {
+			c.file = readFile(writeConfigFile(t, "config.yaml", "tunnel:\n  vps_port: seven\n"), true)
+		}, "tunnel.vps_port=invalid"},
+		{"missing -config file", func(c *Config) {
+			c.file = readFile(filepath.Join(t.TempDir(), "config.yaml"), true)
+		}, "config file=not_found"},
+		{"everything at once", func(c *Config) {
+			c.VPSIP, c.VPSPort, c.Domain = "-", 0, ""
+			c.SetSecret(SecretAuthToken, "")
+		}, "AUTH_TOKEN=required VPS_IP=invalid VPS_PORT=out_of_range DOMAIN=invalid"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := valid(t)
+			tt.modify(&c)
+			err := c.validate(fakeLookup)
+			var got []string
+			var v *errs.Validation
+			if errors.As(err, &v) {
+				for _, e := range v.Errors {
+					got = append(got, e.Field+"="+e.Code)
+				}
+			} else if err != nil {
+				t.Fatalf("not a validation error: %v", err)
+			}
+			if strings.Join(got, " ") != tt.want {
+				t.Errorf("problems = %v, want %q (%v)", got, tt.want, err)
+			}
+		})
+	}
+}
+
+func TestMalformedInts(t *testing.T) {
+	t.Setenv("VPS_PORT", "70o0")
+	t.Setenv("PPROF_PORT", "6061")
+	if got := malformedInts(intKeys...); len(got) != 1 || got["VPS_PORT"] != "70o0" {
+		t.Errorf("malformed = %v", got)
+	}
+}
+
+func TestValidateAtStart_OnlyWarnsInDevMode(t *testing.T) {
+	c := Config{IsDev: true, VPSIP: "203.0.113.10", VPSPort: 0, PprofPort: 6060,
+		DataDir: t.TempDir(), Domain: "localhost"}
+	if err := c.ValidateAtStart(); err != nil {
+		t.Errorf("dev mode: %v", err)
+	}
+	c.IsDev = false
+	err := c.ValidateAtStart()
+	if err == nil || !strings.Contains(err.Error(), "2 invalid settings") {
+		t.Errorf("production: %v", err)
+	}
+}
@@ -0,0 +1,217 @@
+package config
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/joho/godotenv"
+)
+
+// ─── Reload ──────────────────────────────────────────────────────────────────
+
+// hotKeys are the settings a reload applies to the running agent, with
+// the fields they set. So are the secrets, which are moved to the
+// encrypted store first. Anything else in the env files needs a restart.
+var hotKeys = map[string]func(c *Config, w *watcher){
+	"BACKEND_URL": func(c *Config, _ *watcher) { c.BackendURL = getEnv("BACKEND_URL", "") },
+	"VPS_IP":      func(c *Config, w *watcher) { c.VPSIP = getEnv("VPS_IP", w.defaultVPSIP) },
+	"VPS_PORT":    func(c *Config, _ *watcher) { c.VPSPort = getEnvAsInt("VPS_PORT", 7000) },
+}
+
+// ErrNotReloadable is Reload on a Config that Load did not make.
+var ErrNotReloadable = errors.New("config: not loaded from env files, nothing to reload")
+
+// Reloaded is what a Reload changed, by env var name.
+type Reloaded struct {
+	// Applied reached the features that use them.
+	Applied []string `json:"applied"`
+	// NeedsRestart changed in a file but were not applied; the agent
+	// keeps running with the old value until it is restarted.
+	NeedsRestart []string `json:"needs_restart"`
+}
+
+// watcher remembers how Load read the env files, to read them again.
+type watcher struct {
+	files        []string // in order; the first to set a key wins
+	defaultVPSIP string
+	process      map[string]bool   // set in the environment before the files: always wins
+	fromFiles    map[string]string // what the files set, as applied
+	file         map[string]string // what the config file set; under the env files
+
+	mu   sync.Mutex
+	hot  Config // the hotKeys fields as last applied
+	subs []subscriber
+}
+
+type subscriber struct {
+	keys map[string]bool // nil: any
+	ch   chan Config
+}
+
+// newWatcher notes which keys the process environment sets, before the
+// files are loaded into it.
+func newWatcher(files []string, defaultVPSIP string) *watcher {
+	w := &watcher{files: files, defaultVPSIP: defaultVPSIP, process: map[string]bool{}}
+	for _, kv := range os.Environ() {
+		k, _, _ := strings.Cut(kv, "=")
+		w.process[k] = true
+	}
+	return w
+}
+
+// read merges the files the way Load applies them: godotenv.Load keeps
+// a value already set, so the earlier file wins.
+func (w *watcher) read() map[string]string {
+	out := map[string]string{}
+	for _, path := range w.files {
+		if path == "" {
+			continue
+		}
+		vals, err := godotenv.Read(path)
+		if err != nil {
+			continue
+		}
+		for k, v := range vals {
+			if _, ok := out[k]; !ok {
+				out[k] = v
+			}
+		}
+	}
+	return out
+}
+
+// Watch returns a channel that receives the config after every Reload
+// that changed one of keys, or any hot-reloadable setting with none.
+// Only the latest config is kept for a slow reader. The *Config Load
+// returned keeps the values the agent started with. A Config that Load
+// did not make never sends.
+func (c *Config) Watch(keys ...string) <-chan Config {
+	ch := make(chan Config, 1)
+	if c.w == nil {
+		return ch
+	}
+	s := subscriber{ch: ch}
+	if len(keys) > 0 {
+		s.keys = map[string]bool{}
+		for _, k := range keys {
+			s.keys[k] = true
+		}
+	}
+	c.w.mu.Lock()
+	c.w.subs = append(c.w.subs, s)
+	c.w.mu.Unlock()
+	return ch
+}
+
+// Reload reads the env files again, applies the settings in hotKeys that
+// changed, and tells their watchers. Changed settings that need a restart
+// are logged and left as they were, in the config and in the process
+// environment the file worker inherits. A setting in the agent's own
+// environment overrides the files, as it did at start.
+func (c *Config) Reload() (Reloaded, error) {
+	w := c.w
+	if w == nil {
+		return Reloaded{}, ErrNotReloadable
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	next := w.read()
+	moved := map[string]string{}
+	r := Reloaded{Applied: []string{}, NeedsRestart: []string{}}
+	seen := map[string]bool{}
+	for _, vals := range []map[string]string{w.fromFiles, next} {
+		for k := range vals {
+			if seen[k] || w.process[k] {
+				continue
+			}
+			seen[k] = true
+			old, hadOld := w.fromFiles[k]
+			val, has := next[k]
+			if old == val && hadOld == has {
+				continue
+			}
+			if isSecret(k) {
+				// Taken out of a file, most likely by the scrub: the
+				// store keeps it.
+				if has {
+					moved[k] = val
+					r.Applied = append(r.Applied, k)
+				}
+				continue
+			}
+			if hotKeys[k] == nil {
+				r.NeedsRestart = append(r.NeedsRestart, k)
+				continue
+			}
+			if has {
+				os.Setenv(k, val)
+				w.fromFiles[k] = val
+			} else if v, ok := w.file[k]; ok {
+				// Back to the config file's value, as at start.
+				os.Setenv(k, v)
+				delete(w.fromFiles, k)
+			} else {
+				os.Unsetenv(k)
+				delete(w.fromFiles, k)
+			}
+			hotKeys[k](&w.hot, w)
+			r.Applied = append(r.Applied, k)
+		}
+	}
+	if len(moved) > 0 {
+		w.hot.storeSecrets(moved, w.files)
+		after := w.read()
+		for k := range moved {
+			if v, ok := after[k]; ok {
+				w.fromFiles[k] = v
+			} else {
+				delete(w.fromFiles, k)
+			}
+		}
+	}
+	sort.Strings(r.Applied)
+	sort.Strings(r.NeedsRestart)
+
+	for _, k := range r.NeedsRestart {
+		slog.Warn("config: setting changed but needs a restart to apply, keeping the running value", "var", k)
+	}
+	if len(r.Applied) == 0 {
+		slog.Info("config: reloaded, nothing to apply", "needs_restart", len(r.NeedsRestart))
+		return r, nil
+	}
+	slog.Info("config: reloaded", "applied", r.Applied)
+	cur := *c
+	cur.BackendURL = w.hot.BackendURL
+	cur.VPSIP, cur.VPSPort = w.hot.VPSIP, w.hot.VPSPort
+	cur.TailScaleClientId = w.hot.TailScaleClientId
+	cur.secrets = w.hot.secrets
+	for _, s := range w.subs {
+		if !s.wants(r.Applied) {
+			continue
+		}
+		// Latest wins: drop a config the reader hasn't taken yet.
+		select {
+		case <-s.ch:
+		default:
+		}
+		s.ch <- cur
+	}
+	return r, nil
+}
+
+func (s subscriber) wants(changed []string) bool {
+	if s.keys == nil {
+		return true
+	}
+	for _, k := range changed {
+		if s.keys[k] {
+			return true
+		}
+	}
+	return false
+}
@@ -74,6 +74,19 @@ func (e *Error) Unwrap() error {
 }
 
 func HTTPResponse(w http.ResponseWriter, err error) {
+	var v *Validation
+	if errors.As(err, &v) {
+		// The client sent something wrong; nothing failed here.
+		slog.Info("errs: request rejected", "err", err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(struct {
+			Error  string       `json:"error"`
+			Errors []FieldError `json:"errors"`
+		}{v.Error(), v.Errors})
+		return
+	}
+
 	slog.Error("errs: request failed", "err", err)
 
 	code := http.StatusInternalServerError
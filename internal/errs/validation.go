@@ -0,0 +1,80 @@
+package errs
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Codes for FieldError.Code. Clients match on them; the messages are for
+// people.
+const (
+	CodeRequired   = "required"     // missing or empty
+	CodeTooShort   = "too_short"    // shorter than allowed
+	CodeOutOfRange = "out_of_range" // a number outside its bounds
+	CodeInvalid    = "invalid"      // the wrong form, e.g. not a MAC address
+	CodeDuplicate  = "duplicate"    // the same value twice where it must be unique
+	CodeConflict   = "conflict"     // fine alone, but clashes with another field
+	CodeNotFound   = "not_found"    // names something that does not exist
+)
+
+// FieldError is one problem with one field of a request. Field is the
+// JSON path, e.g. "router.reservations[1].mac"; "" is the request as a
+// whole.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Validation collects every problem with a request, so a form shows them
+// all at once instead of one per submit. HTTPResponse answers 400 with
+// the list under "errors".
+//
+//	var v errs.Validation
+//	if cfg.SSID == "" {
+//		v.Add("ssid", errs.CodeRequired, "ssid is required")
+//	}
+//	return v.Err()
+type Validation struct {
+	Errors []FieldError `json:"errors"`
+}
+
+// Add records a problem with field.
+func (v *Validation) Add(field, code, message string) {
+	v.Errors = append(v.Errors, FieldError{Field: field, Code: code, Message: message})
+}
+
+// Addf records a problem with field, its message formatted.
+func (v *Validation) Addf(field, code, format string, args ...any) {
+	v.Add(field, code, fmt.Sprintf(format, args...))
+}
+
+// Merge adds the problems of err, if it is a *Validation, or err as one
+// problem with field otherwise.
+func (v *Validation) Merge(field string, err error) {
+	if err == nil {
+		return
+	}
+	if other, ok := err.(*Validation); ok {
+		v.Errors = append(v.Errors, other.Errors...)
+		return
+	}
+	v.Add(field, CodeInvalid, err.Error())
+}
+
+// Err is v if anything was added, nil otherwise.
+func (v *Validation) Err() error {
+	if len(v.Errors) == 0 {
+		return nil
+	}
+	return v
+}
+
+// Error joins the messages, for logs and clients that read only "error".
+func (v *Validation) Error() string {
+	msgs := make([]string, len(v.Errors))
+	for i, e := range v.Errors {
+		msgs[i] = e.Message
+	}
+	return strings.Join(msgs, "; ")
+}
@@ -0,0 +1,133 @@
+// Package events is the agent's publish/subscribe bus. Features publish
+// what happens to them, a device joining or the VPN coming up, and
+// subscribers, GET /api/events for one, receive each as an Event.
+//
+// Publishing never blocks. Each subscriber has a buffer; one that lets it
+// fill is too slow to keep up and is dropped: its channel is closed, and
+// it resubscribes if it still cares. A feature that blocked on a stalled
+// dashboard tab would stall the agent with it.
+package events
+
+import (
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Event types. The payload of each is the feature's own status type.
+const (
+	WiFiStatus      = "wifi.status"      // wifi.Status, when it changes
+	DeviceJoined    = "device.joined"    // router.NewDeviceEvent
+	AdblockUpdated  = "adblock.updated"  // adblocker.BlocklistUpdated
+	VPNStatus       = "vpn.status"       // vpn.VPNStatus, when it changes
+	UploadCompleted = "upload.completed" // cloud.Activity
+	OutageStarted   = "outage.started"   // monitor.Outage, still open
+	OutageEnded     = "outage.ended"     // monitor.Outage
+
+	CapabilitiesChanged = "capabilities.changed" // capabilities.Document
+	WiFiAuthFailures    = "wifi.auth_failures"   // wifi.AuthFailure, a station past the threshold
+	OperationUpdated    = "operation.updated"    // operations.Operation, on progress and when it ends
+)
+
+// Types are the event types, in the order above.
+var Types = []string{WiFiStatus, DeviceJoined, AdblockUpdated, VPNStatus, UploadCompleted, OutageStarted, OutageEnded, CapabilitiesChanged, WiFiAuthFailures, OperationUpdated}
+
+// Event is what subscribers receive, and the JSON envelope of the stream.
+type Event struct {
+	Type    string    `json:"type"`
+	TS      time.Time `json:"ts"`
+	Payload any       `json:"payload"`
+}
+
+// Publisher is what features are given to publish with.
+type Publisher interface {
+	Publish(typ string, payload any)
+}
+
+type discard struct{}
+
+func (discard) Publish(string, any) {}
+
+// Discard publishes nowhere, for features built without a bus.
+var Discard Publisher = discard{}
+
+// Bus fans events out to its subscribers. The zero value is not usable;
+// call New. Safe for concurrent use.
+type Bus struct {
+	mu   sync.Mutex
+	subs map[*Subscription]struct{}
+	now  func() time.Time
+}
+
+func New() *Bus {
+	return &Bus{subs: make(map[*Subscription]struct{}), now: time.Now}
+}
+
+// Subscription receives events on C until it is closed, by Close or by
+// the bus for falling behind.
+type Subscription struct {
+	C <-chan Event
+	// Dropped is closed, before C, if the bus dropped the subscription
+	// for letting its buffer fill, as opposed to it being closed.
+	Dropped <-chan struct{}
+
+	c       chan Event
+	dropped chan struct{}
+	types   []string // nil: all
+	bus     *Bus
+}
+
+// Subscribe returns a subscription to the given event types, all of them
+// if none, that buffers up to buffer events.
+func (b *Bus) Subscribe(buffer int, types ...string) *Subscription {
+	c := make(chan Event, buffer)
+	d := make(chan struct{})
+	s := &Subscription{C: c, c: c, types: types, bus: b, Dropped: d, dropped: d}
+	if len(types) == 0 {
+		s.types = nil
+	}
+	b.mu.Lock()
+	b.subs[s] = struct{}{}
+	b.mu.Unlock()
+	return s
+}
+
+// Close ends the subscription and closes C. Closing twice, or after the
+// bus dropped it, does nothing.
+func (s *Subscription) Close() {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+	if _, ok := s.bus.subs[s]; ok {
+		delete(s.bus.subs, s)
+		close(s.c)
+	}
+}
+
+// Subscribers is how many subscriptions are open.
+func (b *Bus) Subscribers() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subs)
+}
+
+// Publish sends an event of type typ to every subscriber that wants it.
+// A subscriber whose buffer is full is dropped.
+func (b *Bus) Publish(typ string, payload any) {
+	e := Event{Type: typ, TS: b.now().UTC(), Payload: payload}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for s := range b.subs {
+		if s.types != nil && !slices.Contains(s.types, typ) {
+			continue
+		}
+		select {
+		case s.c <- e:
+		default:
+			delete(b.subs, s)
+			close(s.dropped)
+			close(s.c)
+			slog.Warn("events: dropped a slow subscriber", "type", typ, "buffer", cap(s.c))
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package events
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPublish_DeliversToMatchingSubscribers(t *testing.T) {
+	b := New()
+	all := b.Subscribe(4)
+	vpn := b.Subscribe(4, VPNStatus)
+	defer all.Close()
+	defer vpn.Close()
+
+	b.Publish(WiFiStatus, "up")
+	b.Publish(VPNStatus, map[string]bool{"connected": true})
+
+	if e := <-all.C; e.Type != WiFiStatus || e.Payload != "up" || e.TS.IsZero() {
+		t.Errorf("first event = %+v", e)
+	}
+	if e := <-all.C; e.Type != VPNStatus {
+		t.Errorf("second event = %+v", e)
+	}
+	if e := <-vpn.C; e.Type != VPNStatus {
+		t.Errorf("filtered event = %+v", e)
+	}
+	select {
+	case e := <-vpn.C:
+		t.Errorf("filtered subscriber got %+v", e)
+	default:
+	}
+}
+
+func TestPublish_DropsSlowSubscriberWithoutBlocking(t *testing.T) {
+	b := New()
+	slow := b.Subscribe(2)
+	fast := b.Subscribe(16)
+	defer fast.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range 10 {
+			b.Publish(UploadCompleted, nil)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Publish blocked on a subscriber that never reads")
+	}
+
+	select {
+	case <-slow.Dropped:
+	default:
+		t.Fatal("the slow subscriber was not dropped")
+	}
+	n := 0
+	for range slow.C {
+		n++
+	}
+	if n != 2 {
+		t.Errorf("slow subscriber drained %d events, want the 2 it buffered", n)
+	}
+	if len(fast.C) != 10 {
+		t.Errorf("fast subscriber has %d events, want 10", len(fast.C))
+	}
+	if b.Subscribers() != 1 {
+		t.Errorf("subscribers = %d, want 1", b.Subscribers())
+	}
+	slow.Close() // already dropped: a no-op
+}
+
+func TestClose_EndsTheSubscription(t *testing.T) {
+	b := New()
+	s := b.Subscribe(1)
+	s.Close()
+	s.Close()
+	if _, ok := <-s.C; ok {
+		t.Error("C is open after Close")
+	}
+	select {
+	case <-s.Dropped:
+		t.Error("Dropped closed by Close")
+	default:
+	}
+	b.Publish(OutageStarted, nil) // no subscribers left
+	if b.Subscribers() != 0 {
+		t.Errorf("subscribers = %d", b.Subscribers())
+	}
+}
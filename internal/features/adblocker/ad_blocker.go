@@ -8,7 +8,8 @@
 //  4. Sends SIGHUP to dnsmasq (reload without restart — no DHCP lease loss)
 //
 // Blocklist updates are scheduled daily and can be triggered manually via
-// POST /api/adblock/update.
+// POST /api/adblock/update. Each downloaded list is also kept in DataDir
+// (snapshot.go) so a reboot without internet still starts with it.
 package adblock
 
 import (
@@ -26,18 +27,75 @@ import (
 	"time"
 
 	"github.com/strct-org/strct-agent/internal/config"
+	"github.com/strct-org/strct-agent/internal/errs"
+	"github.com/strct-org/strct-agent/internal/events"
+	"github.com/strct-org/strct-agent/internal/maintenance"
+	"github.com/strct-org/strct-agent/internal/operations"
 	"github.com/strct-org/strct-agent/internal/platform/executil"
+	"github.com/strct-org/strct-agent/internal/resources"
 )
 
 const blocklistURL = "https://raw.githubusercontent.com/StevenBlack/hosts/master/hosts"
 
 const adblockConfPath = "/etc/dnsmasq.d/adblock.conf"
 
+// blockAddress is what dnsmasq answers for a blocked domain.
+const blockAddress = "0.0.0.0"
+
+// Block answer TTL bounds, in seconds. Clients cache the 0.0.0.0 answer for
+// this long, so it is also how long an unblocked domain keeps failing on a
+// device that already looked it up. Short by default; users who prefer
+// fewer repeated queries can raise it.
+const (
+	defaultBlockTTL = 30
+	maxBlockTTL     = 24 * 60 * 60
+)
+
+// usage accounts adblock background work for /api/system/resources.
+var usage = resources.For("adblock")
 
 type AdBlockConfig struct {
 	Enabled bool `json:"enabled"`
 
 	UpdateSchedule string `json:"update_schedule"`
+
+	// BlockTTL is the TTL in seconds on blocked answers. 0 means the default.
+	BlockTTL int `json:"block_ttl"`
+
+	// FailMode is what happens to the DNS redirect when dnsmasq stops
+	// answering: FailOpen ("" too) or FailClosed. See sentinel.go.
+	FailMode string `json:"fail_mode,omitempty"`
+
+	// MaxInflight caps the queries dnsmasq has out upstream at once, and
+	// ClientQPS the queries a second one client may send. 0 means the
+	// default. See dnslimit.go.
+	MaxInflight int `json:"max_inflight,omitempty"`
+	ClientQPS   int `json:"client_qps,omitempty"`
+}
+
+// FlushGuidance tells the UI when every client will see a config change:
+// devices holding a cached block answer keep it until its TTL runs out.
+type FlushGuidance struct {
+	BlockTTL         int       `json:"block_ttl"`
+	ClientsUpdatedBy time.Time `json:"clients_updated_by"`
+	Message          string    `json:"message"`
+}
+
+func flushGuidance(ttl int, now time.Time) FlushGuidance {
+	return FlushGuidance{
+		BlockTTL:         ttl,
+		ClientsUpdatedBy: now.Add(time.Duration(ttl) * time.Second).UTC(),
+		Message: fmt.Sprintf("Devices may keep using cached block answers for up to %s. "+
+			"Reconnecting a device to WiFi clears its cache sooner.", time.Duration(ttl)*time.Second),
+	}
+}
+
+// BlocklistUpdated is published each time a downloaded blocklist is
+// applied.
+type BlocklistUpdated struct {
+	Domains   int       `json:"domains"`
+	Source    string    `json:"source"`
+	UpdatedAt time.Time `json:"updated_at"`
 }
 
 type Status struct {
@@ -46,25 +104,94 @@ type Status struct {
 	LastUpdated time.Time `json:"last_updated"`
 	UpdateError string    `json:"update_error,omitempty"`
 	Updating    bool      `json:"updating"`
+	// Source is the URL the blocklist in use was downloaded from.
+	Source string `json:"source,omitempty"`
+
+	// BlocklistAge is the seconds since the list in use was downloaded.
+	// BlocklistStale is set once that is more than staleFactor update
+	// intervals: updates have been failing and new ad domains get through.
+	BlocklistAge   int64 `json:"blocklist_age"`
+	BlocklistStale bool  `json:"blocklist_stale"`
+
+	// RedirectRepairs counts the times the watchdog found the DNS redirect
+	// rules gone and put them back.
+	RedirectRepairs    int       `json:"redirect_repairs"`
+	LastRedirectRepair time.Time `json:"last_redirect_repair,omitempty"`
+
+	// DNSDown is set while dnsmasq fails the sentinel's probe, and
+	// FailedOpen while the AP's DNS bypasses it because of that.
+	DNSDown       bool      `json:"dns_down"`
+	FailedOpen    bool      `json:"failed_open"`
+	DNSRestarts   int       `json:"dns_restarts"`
+	LastDNSOutage time.Time `json:"last_dns_outage,omitempty"`
+
+	Limits DNSLimits `json:"dns_limits"` // see dnslimit.go
 }
 
 
 type AdBlock struct {
 	cfg    config.Config
 	state  AdBlockConfig
+	lists  Lists    // see lists.go
+	split  SplitDNS // see splitdns.go
 	status Status
 	mu     sync.RWMutex
 	cmd    executil.Runner
 	client *http.Client
+	gate   *maintenance.Gate // nil: never paused
+
+	// sources are the blocklist URLs an update tries, in order: the
+	// configured ADBLOCK_SOURCES, or blocklistURL.
+	sources []string
+
+	confPath    string // adblockConfPath; a temp dir in tests
+	dnsmasqConf string // dnsmasqConfPath; a temp dir in tests
+	recordsPath string // localRecordsPath; a temp dir in tests
+	forwardPath string // forwardConfPath; a temp dir in tests
+	arpPath     string // arpTablePath
+	localDNS    string // dnsmasq, where the split forwarder sends the rest
+
+	wifiSvc       wifiStatus // nil: no AP, no redirect
+	watchdogMu    sync.Mutex // one redirect check at a time
+	redirectIface string     // AP interface the redirect is installed for
+	redirectMACs  string     // split DNS devices the redirect sends to the forwarder
+	losses        []redirectLoss
+	recheck       chan struct{}
+	now           func() time.Time
+
+	probe       func() error // dnsmasq liveness, see sentinel.go
+	dnsFailures int          // probes missed in a row
+	failedOpen  bool         // the redirect chain bypasses dnsmasq
+
+	limitInstalled    string    // "iface qps" of the per-client rule, see dnslimit.go
+	overloadCheckedAt time.Time // last read of dnsmasq's warnings
+
+	events events.Publisher
+
+	ops      *operations.Tracker // see progress.go
+	updateOp *operations.Op      // the blocklist update running, if any
+
+	loops sync.WaitGroup // what Start began; see Stop
 }
 
 func New(cfg config.Config, cmd executil.Runner) *AdBlock {
 	return &AdBlock{
-		cfg: cfg,
-		cmd: cmd,
+		cfg:         cfg,
+		cmd:         cmd,
+		confPath:    adblockConfPath,
+		dnsmasqConf: dnsmasqConfPath,
+		recordsPath: localRecordsPath,
+		forwardPath: forwardConfPath,
+		arpPath:     arpTablePath,
+		localDNS:    localDNSAddr,
+		recheck:     make(chan struct{}, 1),
+		now:         time.Now,
+		probe:       probeDNSMasq,
+		events:      events.Discard,
 		state: AdBlockConfig{
 			Enabled:        false,
 			UpdateSchedule: "daily",
+			BlockTTL:       defaultBlockTTL,
 		},
 		client: &http.Client{
 			Timeout: 60 * time.Second,
@@ -73,17 +200,35 @@ func New(cfg config.Config, cmd executil.Runner) *AdBlock {
 				IdleConnTimeout:     90 * time.Second,
 			},
 		},
+		sources: blocklistSources(cfg.AdblockSources),
+	}
+}
+
+// blocklistSources are the configured sources, or blocklistURL.
+func blocklistSources(configured []string) []string {
+	if len(configured) == 0 {
+		return []string{blocklistURL}
 	}
+	return configured
 }
 
-func NewFromConfig(cfg *config.Config) *AdBlock {
+// NewFromConfig is the agent's ad blocker. Each blocklist applied is
+// published to pub as events.AdblockUpdated.
+func NewFromConfig(cfg *config.Config, gate *maintenance.Gate, wifiSvc wifiStatus, pub events.Publisher) *AdBlock {
 	var cmd executil.Runner
 	if cfg.IsDev {
 		cmd = executil.NewDevRunner()
 	} else {
 		cmd = executil.Real{}
 	}
-	return New(*cfg, cmd)
+	s := New(*cfg, cmd)
+	s.gate = gate
+	s.events = pub
+	if wifiSvc != nil {
+		s.wifiSvc = wifiSvc
+		wifiSvc.OnApply(s.kickWatchdog)
+	}
+	return s
 }
 
 func (s *AdBlock) RegisterRoutes(mux *http.ServeMux) {
@@ -91,29 +236,46 @@ func (s *AdBlock) RegisterRoutes(mux *http.ServeMux) {
 	mux.HandleFunc("POST /api/adblock/config", s.handleSetConfig)
 	mux.HandleFunc("GET /api/adblock/status", s.handleGetStatus)
 	mux.HandleFunc("POST /api/adblock/update", s.handleUpdate) // manual refresh
+	mux.HandleFunc("GET /api/adblock/diagnose", s.handleDiagnose)
+	mux.HandleFunc("GET /api/adblock/lists", s.handleGetLists)
+	mux.HandleFunc("POST /api/adblock/import/pihole", s.handleImportPihole)
+	mux.HandleFunc("POST /api/adblock/import/adguard", s.handleImportAdGuard)
+	mux.HandleFunc("GET /api/adblock/split-dns", s.handleGetSplit)
+	mux.HandleFunc("POST /api/adblock/split-dns", s.handleSetSplit)
 }
 
+func (s *AdBlock) Name() string { return "adblock" }
+
+// DependsOn is wifi: the blocklist goes into the dnsmasq wifi sets up,
+// and the DNS redirect onto its AP interface.
+func (s *AdBlock) DependsOn() []string { return []string{"wifi"} }
+
 func (s *AdBlock) Start(ctx context.Context) error {
 	slog.Info("adblock: service started")
 
-	if count := countExistingEntries(); count > 0 {
-		s.mu.Lock()
-		s.status.EntryCount = count
-		s.mu.Unlock()
+	if err := s.loadConfig(); err != nil {
+		slog.Error("adblock: " + err.Error())
 	}
-
-	go func() {
+	if err := s.loadLists(); err != nil {
+		slog.Error("adblock: " + err.Error())
+	}
+	if err := s.loadSplit(); err != nil {
+		slog.Error("adblock: " + err.Error())
+	}
+	s.restoreRecords()
+	s.restoreSplit()
+	s.restoreOnStart()
+	s.runSplitDNS(ctx)
+
+	s.loops.Add(3)
+	usage.Go(func() {
+		defer s.loops.Done()
 		for {
 			s.mu.RLock()
 			enabled := s.state.Enabled
-			schedule := s.state.UpdateSchedule
+			interval := updateInterval(s.state.UpdateSchedule)
 			s.mu.RUnlock()
 
-			interval := 24 * time.Hour
-			if schedule == "weekly" {
-				interval = 7 * 24 * time.Hour
-			}
-
 			select {
 			case <-ctx.Done():
 				if enabled {
@@ -123,15 +285,34 @@ func (s *AdBlock) Start(ctx context.Context) error {
 			case <-time.After(interval):
 				if enabled {
 					slog.Info("adblock: scheduled blocklist update")
-					s.downloadAndApply()
+					s.update() //nolint:errcheck // a skipped cycle is logged by the gate
 				}
 			}
 		}
-	}()
+	})
+	usage.Go(func() { defer s.loops.Done(); s.runWatchdog(ctx) })
+	usage.Go(func() { defer s.loops.Done(); s.runSentinel(ctx) })
 
 	return nil
 }
 
+// Stop waits, once Start's context is done, for blocking to be turned off
+// and the split DNS forwarder to let go of its port, so a restart begins
+// from a clean firewall.
+func (s *AdBlock) Stop(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.loops.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 
 func (s *AdBlock) handleGetConfig(w http.ResponseWriter, r *http.Request) {
 	s.mu.RLock()
@@ -148,36 +329,84 @@ func (s *AdBlock) handleSetConfig(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if req.BlockTTL == 0 {
+		req.BlockTTL = defaultBlockTTL
+	}
+	var v errs.Validation
+	if req.BlockTTL < 0 || req.BlockTTL > maxBlockTTL {
+		v.Addf("block_ttl", errs.CodeOutOfRange, "block_ttl must be between 1 and %d seconds", maxBlockTTL)
+	}
+	if req.FailMode != "" && req.FailMode != FailOpen && req.FailMode != FailClosed {
+		v.Add("fail_mode", errs.CodeInvalid, `fail_mode must be "open" or "closed"`)
+	}
+	req.validateLimits(&v)
+	if err := v.Err(); err != nil {
+		errs.HTTPResponse(w, err)
+		return
+	}
+
 	s.mu.RLock()
 	wasEnabled := s.state.Enabled
+	oldTTL := s.state.BlockTTL
+	oldInflight := s.state.maxInflight()
 	s.mu.RUnlock()
 
+	needsUpdate := req.Enabled && (!wasEnabled || req.BlockTTL != oldTTL)
+	if needsUpdate && s.gate.Active() {
+		http.Error(w, "blocklist updates are paused for maintenance", http.StatusConflict)
+		return
+	}
+
 	s.mu.Lock()
 	s.state = req
 	s.mu.Unlock()
 
+	if err := s.saveConfig(); err != nil {
+		slog.Error("adblock: could not persist config", "err", err)
+	}
+
 	go func() {
-		if req.Enabled && !wasEnabled {
-			// Just enabled — download blocklist immediately
-			s.downloadAndApply()
+		if needsUpdate {
+			// Just enabled, or the TTL changed — (re)write the blocklist
+			s.update() //nolint:errcheck
+		} else if req.Enabled && req.maxInflight() != oldInflight {
+			if err := s.rebuildConf(); err != nil {
+				slog.Error("adblock: " + err.Error())
+			}
 		} else if !req.Enabled && wasEnabled {
 			// Just disabled — remove blocklist and reload dnsmasq
 			s.disable()
 		}
+		s.checkRedirect(false) // install or remove the DNS redirect now
 	}()
 
+	// Answers already cached on clients were handed out under the old TTL.
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"status": "applying"})
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":         "applying",
+		"flush_guidance": flushGuidance(max(oldTTL, req.BlockTTL), time.Now()),
+	})
 }
 
 func (s *AdBlock) handleGetStatus(w http.ResponseWriter, r *http.Request) {
-	s.mu.RLock()
-	st := s.status
-	s.mu.RUnlock()
+	st := s.currentStatus()
+	st.Limits = s.limitStats()
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(st)
 }
 
+// HealthWarnings reports dnsmasq being down, a stale blocklist, repeated
+// DNS redirect losses and a recent DNS overload for /api/health.
+func (s *AdBlock) HealthWarnings() []string {
+	var warnings []string
+	for _, w := range []string{s.dnsWarning(), s.staleWarning(), s.redirectWarning(), s.overloadWarning()} {
+		if w != "" {
+			warnings = append(warnings, w)
+		}
+	}
+	return warnings
+}
+
 func (s *AdBlock) handleUpdate(w http.ResponseWriter, r *http.Request) {
 	s.mu.RLock()
 	enabled := s.state.Enabled
@@ -187,16 +416,57 @@ func (s *AdBlock) handleUpdate(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "ad blocking is not enabled", http.StatusBadRequest)
 		return
 	}
+	if s.gate.Active() {
+		http.Error(w, "blocklist updates are paused for maintenance", http.StatusConflict)
+		return
+	}
 
-	go s.downloadAndApply()
-
+	op, started := s.claimUpdate()
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"status": "updating"})
+	if !started {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error":        "a blocklist update is already running",
+			"operation_id": op.ID(),
+		})
+		return
+	}
+	go s.updateClaimed(op)
+
+	json.NewEncoder(w).Encode(map[string]string{"status": "updating", "operation_id": op.ID()})
 }
 
 // ─── Core logic ───────────────────────────────────────────────────────────────
 
-// downloadAndApply fetches the StevenBlack hosts list and applies it to dnsmasq.
+// update runs one blocklist refresh unless maintenance mode holds it or
+// one is already running. Switching maintenance on mid-download cancels
+// the request; the previous adblock.conf stays in place.
+func (s *AdBlock) update() error {
+	ctx, done, err := s.gate.Begin(context.Background(), maintenance.JobBlocklistUpdate)
+	if err != nil {
+		return err
+	}
+	defer done()
+	if op, started := s.claimUpdate(); started {
+		s.downloadAndApply(ctx, op)
+	}
+	return nil
+}
+
+// updateClaimed is update for a refresh handleUpdate has claimed, so
+// it could answer with the operation.
+func (s *AdBlock) updateClaimed(op *operations.Op) {
+	ctx, done, err := s.gate.Begin(context.Background(), maintenance.JobBlocklistUpdate)
+	if err != nil {
+		s.finishUpdate(op, err)
+		return
+	}
+	defer done()
+	s.downloadAndApply(ctx, op)
+}
+
+// downloadAndApply fetches the hosts list, from the first of the sources
+// that answers, and applies it to dnsmasq.
 //
 // Conversion:
 //
@@ -209,63 +479,137 @@ func (s *AdBlock) handleUpdate(w http.ResponseWriter, r *http.Request) {
 //
 // dnsmasq is reloaded with SIGHUP rather than a full restart, so existing
 // DHCP leases are preserved and connected devices aren't interrupted.
-func (s *AdBlock) downloadAndApply() {
-	s.mu.Lock()
-	if s.status.Updating {
-		s.mu.Unlock()
-		return // already running
+//
+// op, claimed with claimUpdate, gets the progress (see progress.go) and
+// is finished; canceling it cancels the download.
+func (s *AdBlock) downloadAndApply(ctx context.Context, op *operations.Op) {
+	defer usage.Time()()
+	err := s.fetchBlocklist(op.WithCancel(ctx), op)
+	if err != nil {
+		s.setError(err.Error())
 	}
-	s.status.Updating = true
-	s.mu.Unlock()
-
-	defer func() {
-		s.mu.Lock()
-		s.status.Updating = false
-		s.mu.Unlock()
-	}()
+	s.finishUpdate(op, err)
+}
 
-	slog.Info("adblock: downloading StevenBlack/hosts blocklist", "url", blocklistURL)
+func (s *AdBlock) fetchBlocklist(ctx context.Context, op *operations.Op) error {
+	op.Progress(operations.Progress{Phase: phaseDownloading})
 
-	resp, err := s.client.Get(blocklistURL)
+	resp, source, err := s.openBlocklist(ctx)
 	if err != nil {
-		s.setError(fmt.Sprintf("download failed: %v", err))
-		return
+		return err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		s.setError(fmt.Sprintf("download returned %d", resp.StatusCode))
-		return
+	hdr := s.confHeader()
+	lists := s.currentLists()
+
+	// The domains go to adblock.conf and the snapshot in the same pass. A
+	// snapshot that can't be written never holds up the update.
+	fetched := time.Now()
+	snap, err := createSnapshot(s.snapshotPath(), snapshotInfo{Fetched: fetched, Source: source})
+	if err != nil {
+		slog.Warn("adblock: blocklist snapshot not saved", "err", err)
 	}
 
 	// Stream-parse the hosts file to avoid loading the whole ~3MB into memory at once
-	count, err := s.writeAdblockConf(resp.Body)
+	parsed := 0
+	body := &progressReader{r: resp.Body, op: op, total: max(resp.ContentLength, 0), domains: &parsed}
+	count, err := s.writeAdblockConf(func(w io.Writer) (int, error) {
+		n, err := renderConf(w, hdr, fetched, lists, func(emit func(string)) error {
+			return parseHosts(usage.Reader(body), func(domain string) {
+				emit(domain)
+				snap.add(domain)
+				parsed++
+			})
+		})
+		if err == nil {
+			op.Progress(operations.Progress{Phase: phaseWriting, Items: n})
+		}
+		return n, err
+	})
 	if err != nil {
-		s.setError(fmt.Sprintf("write adblock.conf: %v", err))
-		return
+		snap.abort()
+		return fmt.Errorf("write adblock.conf: %w", err)
 	}
-
-	// Reload dnsmasq: SIGHUP triggers a config reload without restarting.
-	// The daemon re-reads all files in /etc/dnsmasq.d/ including adblock.conf.
-	// Existing DHCP leases are NOT affected.
-	if err := s.cmd.Run("systemctl", "kill", "-s", "HUP", "dnsmasq"); err != nil {
-		slog.Warn("adblock: dnsmasq HUP failed, trying restart", "err", err)
-		s.cmd.Run("systemctl", "restart", "dnsmasq") //nolint:errcheck
+	if count == 0 {
+		snap.abort() // keep the last good list for the next boot
+	} else if err := snap.commit(); err != nil {
+		slog.Warn("adblock: blocklist snapshot not saved", "err", err)
 	}
 
+	op.Progress(operations.Progress{Phase: phaseReloading, Items: count})
+	s.reloadDNSMasq()
+
 	s.mu.Lock()
 	s.status.Enabled = true
 	s.status.EntryCount = count
-	s.status.LastUpdated = time.Now()
+	s.status.LastUpdated = fetched
 	s.status.UpdateError = ""
+	s.status.Source = source
 	s.mu.Unlock()
 
-	slog.Info("adblock: blocklist applied", "domains_blocked", count)
+	slog.Info("adblock: blocklist applied", "domains_blocked", count, "source", source)
+	s.events.Publish(events.AdblockUpdated, BlocklistUpdated{Domains: count, Source: source, UpdatedAt: fetched})
+	return nil
+}
+
+// openBlocklist requests the blocklist from each source in turn and
+// returns the first that answers 200, with its URL. The error is the
+// last source's.
+func (s *AdBlock) openBlocklist(ctx context.Context) (*http.Response, string, error) {
+	var err error
+	for _, source := range s.sources {
+		slog.Info("adblock: downloading blocklist", "url", source)
+		var resp *http.Response
+		if resp, err = s.getBlocklist(ctx, source); err == nil {
+			return resp, source, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		slog.Warn("adblock: blocklist source failed", "url", source, "err", err)
+	}
+	return nil, "", err
+}
+
+func (s *AdBlock) getBlocklist(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("build request: %w", err)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("download failed: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("download returned %d", resp.StatusCode)
+	}
+	return resp, nil
+}
+
+// blocklistSource is where the blocklist in use came from; the first
+// source before one is known.
+func (s *AdBlock) blocklistSource() string {
+	if s.status.Source != "" {
+		return s.status.Source
+	}
+	return s.sources[0]
+}
+
+// reloadDNSMasq sends SIGHUP, which makes dnsmasq re-read /etc/dnsmasq.d/
+// (adblock.conf included) without restarting. Existing DHCP leases are NOT
+// affected.
+func (s *AdBlock) reloadDNSMasq() {
+	if err := s.cmd.Run("systemctl", "kill", "-s", "HUP", "dnsmasq"); err != nil {
+		slog.Warn("adblock: dnsmasq HUP failed, trying restart", "err", err)
+		s.cmd.Run("systemctl", "restart", "dnsmasq") //nolint:errcheck
+	}
 }
 
-// writeAdblockConf streams the hosts file and writes dnsmasq address= directives.
+// writeAdblockConf atomically replaces adblock.conf with what render writes.
 // Returns the number of entries written.
-func (s *AdBlock) writeAdblockConf(body io.Reader) (int, error) {
+func (s *AdBlock) writeAdblockConf(render func(w io.Writer) (int, error)) (int, error) {
 	f, err := os.CreateTemp("", "adblock-*.conf")
 	if err != nil {
 		return 0, err
@@ -277,14 +621,98 @@ func (s *AdBlock) writeAdblockConf(body io.Reader) (int, error) {
 		os.Remove(tmpPath) //nolint:errcheck
 	}()
 
-	w := bufio.NewWriterSize(f, 256*1024) // 256KB write buffer for performance
+	w := bufio.NewWriterSize(usage.Writer(f), 256*1024) // 256KB write buffer for performance
+	count, err := render(w)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := w.Flush(); err != nil {
+		return 0, fmt.Errorf("flush: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+
+	// Ensure the dnsmasq drop-in directory exists
+	if err := os.MkdirAll(filepath.Dir(s.confPath), 0755); err != nil {
+		return 0, fmt.Errorf("mkdir %s: %w", filepath.Dir(s.confPath), err)
+	}
+
+	// Atomic replace
+	if err := os.Rename(tmpPath, s.confPath); err != nil {
+		return 0, fmt.Errorf("rename to %s: %w", s.confPath, err)
+	}
+
+	return count, nil
+}
+
+// renderAdblockConf converts a hosts file into dnsmasq directives and
+// returns the number of domains blocked.
+//
+// local-ttl sets the TTL dnsmasq puts on answers it synthesizes from
+// address= lines. It is global to the dnsmasq instance, so it also covers
+// /etc/hosts and DHCP-lease names — both are local and cheap to re-ask.
+func renderAdblockConf(w io.Writer, body io.Reader, ttl int, now time.Time) (int, error) {
+	return renderConf(w, confHeader{TTL: ttl}, now, Lists{}, func(emit func(string)) error {
+		return parseHosts(body, emit)
+	})
+}
+
+// confHeader holds the global dnsmasq settings adblock.conf carries.
+type confHeader struct {
+	TTL        int // local-ttl
+	ForwardMax int // dns-forward-max; 0 leaves dnsmasq's default
+}
+
+func (s *AdBlock) confHeader() confHeader {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return confHeader{TTL: s.state.BlockTTL, ForwardMax: s.state.maxInflight()}
+}
+
+// renderConf writes the adblock.conf header, the user's lists and an
+// address= line for every domain the domains func emits. Allowed domains
+// are left out of the address= lines, and so are domains already written.
+func renderConf(w io.Writer, hdr confHeader, now time.Time, lists Lists, domains func(emit func(string)) error) (int, error) {
 	fmt.Fprintf(w, "# Ad block — generated by strct-agent from StevenBlack/hosts\n")
-	fmt.Fprintf(w, "# Updated: %s\n", time.Now().Format(time.RFC3339))
+	fmt.Fprintf(w, "# Updated: %s\n", now.Format(time.RFC3339))
+	fmt.Fprintf(w, "local-ttl=%d\n", hdr.TTL)
+	if hdr.ForwardMax > 0 {
+		fmt.Fprintf(w, "dns-forward-max=%d\n", hdr.ForwardMax)
+	}
 
+	skip := make(map[string]bool, len(lists.Allow)+len(lists.Block))
+	for _, domain := range lists.Allow {
+		fmt.Fprintln(w, allowLine(domain))
+		skip[domain] = true
+	}
+	count := 0
+	for _, domain := range lists.Block {
+		if !skip[domain] {
+			fmt.Fprintln(w, addressLine(domain))
+			skip[domain] = true
+			count++
+		}
+	}
+	err := domains(func(domain string) {
+		if skip[domain] {
+			return
+		}
+		fmt.Fprintln(w, addressLine(domain))
+		count++
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// parseHosts calls emit for every blocked domain in a hosts file.
+func parseHosts(body io.Reader, emit func(domain string)) error {
 	scanner := bufio.NewScanner(body)
 	scanner.Buffer(make([]byte, 64*1024), 64*1024)
 
-	count := 0
 	for scanner.Scan() {
 		line := strings.TrimSpace(scanner.Text())
 
@@ -305,44 +733,30 @@ func (s *AdBlock) writeAdblockConf(body io.Reader) (int, error) {
 			continue
 		}
 
-		fmt.Fprintf(w, "address=/%s/0.0.0.0\n", domain)
-		count++
+		emit(domain)
 	}
 	if err := scanner.Err(); err != nil {
-		return 0, fmt.Errorf("read hosts: %w", err)
-	}
-
-	if err := w.Flush(); err != nil {
-		return 0, fmt.Errorf("flush: %w", err)
-	}
-	if err := f.Close(); err != nil {
-		return 0, err
-	}
-
-	// Ensure the dnsmasq drop-in directory exists
-	if err := os.MkdirAll(filepath.Dir(adblockConfPath), 0755); err != nil {
-		return 0, fmt.Errorf("mkdir %s: %w", filepath.Dir(adblockConfPath), err)
-	}
-
-	// Atomic replace
-	if err := os.Rename(tmpPath, adblockConfPath); err != nil {
-		return 0, fmt.Errorf("rename to %s: %w", adblockConfPath, err)
+		return fmt.Errorf("read hosts: %w", err)
 	}
-
-	return count, nil
+	return nil
 }
 
 // disable removes the adblock conf file and reloads dnsmasq.
 func (s *AdBlock) disable() {
 	slog.Info("adblock: disabling")
-	os.Remove(adblockConfPath) //nolint:errcheck
+	os.Remove(s.confPath) //nolint:errcheck
 
-	if err := s.cmd.Run("systemctl", "kill", "-s", "HUP", "dnsmasq"); err != nil {
-		s.cmd.Run("systemctl", "restart", "dnsmasq") //nolint:errcheck
-	}
+	s.reloadDNSMasq()
 
 	s.mu.Lock()
-	s.status = Status{Enabled: false}
+	s.status = Status{
+		Enabled:            false,
+		RedirectRepairs:    s.status.RedirectRepairs,
+		LastRedirectRepair: s.status.LastRedirectRepair,
+		DNSRestarts:        s.status.DNSRestarts,
+		LastDNSOutage:      s.status.LastDNSOutage,
+		Limits:             s.status.Limits,
+	}
 	s.mu.Unlock()
 
 	slog.Info("adblock: disabled, dnsmasq reloaded")
@@ -355,8 +769,8 @@ func (s *AdBlock) setError(msg string) {
 	s.mu.Unlock()
 }
 
-func countExistingEntries() int {
-	f, err := os.Open(adblockConfPath)
+func (s *AdBlock) countExistingEntries() int {
+	f, err := os.Open(s.confPath)
 	if err != nil {
 		return 0
 	}
@@ -365,9 +779,28 @@ func countExistingEntries() int {
 	count := 0
 	scanner := bufio.NewScanner(f)
 	for scanner.Scan() {
-		if strings.HasPrefix(scanner.Text(), "address=") {
+		if _, ok := parseAddressLine(scanner.Text()); ok {
 			count++
 		}
 	}
 	return count
 }
+
+// addressLine is the dnsmasq directive that blocks domain and its
+// subdomains. parseAddressLine is its inverse; diagnose reads the
+// blocklist back through it so it sees exactly what dnsmasq loaded.
+func addressLine(domain string) string {
+	return "address=/" + domain + "/" + blockAddress
+}
+
+func parseAddressLine(line string) (domain string, ok bool) {
+	rest, ok := strings.CutPrefix(line, "address=/")
+	if !ok {
+		return "", false
+	}
+	domain, addr, ok := strings.Cut(rest, "/")
+	if !ok || addr != blockAddress || domain == "" {
+		return "", false
+	}
+	return strings.ToLower(domain), true
+}
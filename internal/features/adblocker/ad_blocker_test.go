@@ -0,0 +1,1142 @@
+package adblock
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/agent"
+	"github.com/strct-org/strct-agent/internal/config"
+	"github.com/strct-org/strct-agent/internal/errs"
+	"github.com/strct-org/strct-agent/internal/events"
+	"github.com/strct-org/strct-agent/internal/features/wifi"
+	"github.com/strct-org/strct-agent/internal/maintenance"
+	"github.com/strct-org/strct-agent/internal/operations"
+	"github.com/strct-org/strct-agent/internal/platform/executil"
+)
+
+const sampleHosts = `# StevenBlack
+127.0.0.1 localhost
+0.0.0.0 0.0.0.0
+0.0.0.0 doubleclick.net
+0.0.0.0 ads.example.com # tracker
+`
+
+func TestRenderAdblockConf_SetsBlockTTL(t *testing.T) {
+	var buf bytes.Buffer
+	count, err := renderAdblockConf(&buf, strings.NewReader(sampleHosts), 45, time.Unix(0, 0))
+	if err != nil {
+		t.Fatalf("render: %v", err)
+	}
+	if count != 2 {
+		t.Errorf("count = %d, want 2", count)
+	}
+
+	conf := buf.String()
+	for _, want := range []string{
+		"local-ttl=45\n",
+		"address=/doubleclick.net/0.0.0.0\n",
+		"address=/ads.example.com/0.0.0.0\n",
+	} {
+		if !strings.Contains(conf, want) {
+			t.Errorf("conf missing %q:\n%s", want, conf)
+		}
+	}
+	if strings.Contains(conf, "address=/localhost/") {
+		t.Error("meta entries must not be blocked")
+	}
+}
+
+func TestHandleSetConfig_BlockTTL(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		wantCode int
+		wantTTL  int
+	}{
+		{"default when omitted", `{"enabled":false}`, http.StatusOK, defaultBlockTTL},
+		{"raised", `{"enabled":false,"block_ttl":3600}`, http.StatusOK, 3600},
+		{"negative", `{"enabled":false,"block_ttl":-1}`, http.StatusBadRequest, defaultBlockTTL},
+		{"above a day", `{"enabled":false,"block_ttl":86401}`, http.StatusBadRequest, defaultBlockTTL},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New(config.Config{IsDev: true, DataDir: t.TempDir()}, &executil.Mock{})
+			rec := httptest.NewRecorder()
+			s.handleSetConfig(rec, httptest.NewRequest("POST", "/api/adblock/config", strings.NewReader(tt.body)))
+
+			if rec.Code != tt.wantCode {
+				t.Fatalf("code = %d (%s), want %d", rec.Code, rec.Body, tt.wantCode)
+			}
+			if s.state.BlockTTL != tt.wantTTL {
+				t.Errorf("BlockTTL = %d, want %d", s.state.BlockTTL, tt.wantTTL)
+			}
+		})
+	}
+}
+
+func TestHandleSetConfig_FlushGuidanceUsesLongerTTL(t *testing.T) {
+	s := New(config.Config{IsDev: true, DataDir: t.TempDir()}, &executil.Mock{})
+	s.state.BlockTTL = 600 // clients may still hold answers from the old TTL
+
+	before := time.Now()
+	rec := httptest.NewRecorder()
+	s.handleSetConfig(rec, httptest.NewRequest("POST", "/api/adblock/config",
+		strings.NewReader(`{"enabled":false,"block_ttl":30}`)))
+
+	var resp struct {
+		FlushGuidance FlushGuidance `json:"flush_guidance"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	g := resp.FlushGuidance
+	if g.BlockTTL != 600 {
+		t.Errorf("guidance TTL = %d, want 600", g.BlockTTL)
+	}
+	if d := g.ClientsUpdatedBy.Sub(before); d < 600*time.Second || d > 601*time.Second {
+		t.Errorf("clients_updated_by is %s after the request, want ~10m", d)
+	}
+	if !strings.Contains(g.Message, "10m0s") {
+		t.Errorf("message = %q", g.Message)
+	}
+}
+
+// blockingTransport holds every request until its context is cancelled.
+type blockingTransport struct {
+	requests atomic.Int32
+	started  chan struct{}
+}
+
+func (b *blockingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if b.requests.Add(1) == 1 {
+		close(b.started)
+	}
+	<-req.Context().Done()
+	return nil, req.Context().Err()
+}
+
+func newGatedAdBlock(t *testing.T) (*AdBlock, *maintenance.Gate, *blockingTransport) {
+	t.Helper()
+	s := New(config.Config{IsDev: true, DataDir: t.TempDir()}, &executil.Mock{})
+	s.state.Enabled = true
+	s.gate = maintenance.New(filepath.Join(t.TempDir(), "maintenance.json"))
+	tr := &blockingTransport{started: make(chan struct{})}
+	s.client = &http.Client{Transport: tr}
+	return s, s.gate, tr
+}
+
+func TestUpdate_SkippedDuringMaintenance(t *testing.T) {
+	s, gate, tr := newGatedAdBlock(t)
+	if _, err := gate.Enable("imaging SD card", time.Time{}, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.update(); !errors.Is(err, maintenance.ErrActive) {
+		t.Errorf("update() = %v, want ErrActive", err)
+	}
+	rec := httptest.NewRecorder()
+	s.handleUpdate(rec, httptest.NewRequest("POST", "/api/adblock/update", nil))
+	if rec.Code != http.StatusConflict {
+		t.Errorf("manual update: got %d, want 409", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	s.handleSetConfig(rec, httptest.NewRequest("POST", "/api/adblock/config",
+		strings.NewReader(`{"enabled":true,"block_ttl":60}`)))
+	if rec.Code != http.StatusConflict {
+		t.Errorf("TTL change needing a download: got %d, want 409", rec.Code)
+	}
+	if n := tr.requests.Load(); n != 0 {
+		t.Errorf("blocklist fetched %d times during maintenance", n)
+	}
+}
+
+func TestUpdate_CancelledWhenMaintenanceStarts(t *testing.T) {
+	s, gate, tr := newGatedAdBlock(t)
+
+	returned := make(chan error, 1)
+	go func() { returned <- s.update() }()
+	<-tr.started
+
+	st, err := gate.Enable("swap SSD", time.Time{}, 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(st.Running) != 0 {
+		t.Errorf("still running after drain: %v", st.Running)
+	}
+	if err := <-returned; err != nil {
+		t.Errorf("update() = %v, want nil (it had started)", err)
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if !strings.Contains(s.status.UpdateError, "context canceled") || s.status.Updating {
+		t.Errorf("status = %+v, want a cancelled, finished update", s.status)
+	}
+}
+
+func TestHandleUpdate_OneAtATimeAndCancelable(t *testing.T) {
+	s, _, tr := newGatedAdBlock(t)
+	ops := operations.New(&executil.Mock{}, nil)
+	s.UseTracker(ops)
+	post := func() (int, map[string]string) {
+		rec := httptest.NewRecorder()
+		s.handleUpdate(rec, httptest.NewRequest("POST", "/api/adblock/update", nil))
+		var body map[string]string
+		json.Unmarshal(rec.Body.Bytes(), &body)
+		return rec.Code, body
+	}
+
+	code, body := post()
+	id := body["operation_id"]
+	if code != http.StatusOK || id == "" {
+		t.Fatalf("update: %d %v", code, body)
+	}
+	<-tr.started
+	if code, body := post(); code != http.StatusConflict || body["operation_id"] != id {
+		t.Errorf("second update: %d %v, want 409 naming %s", code, body, id)
+	}
+
+	if _, err := ops.Cancel(id); err != nil {
+		t.Fatalf("cancel: %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if op, _, _ := ops.Get(id); op.Status != operations.StatusRunning {
+			if op.Status != operations.StatusCanceled {
+				t.Errorf("operation = %+v, want canceled", op)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("update still running after cancel")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	s.mu.RLock()
+	updating := s.status.Updating
+	s.mu.RUnlock()
+	if updating {
+		t.Error("still marked updating")
+	}
+	if code, body := post(); code != http.StatusOK || body["operation_id"] == id {
+		t.Errorf("update after cancel: %d %v", code, body)
+	}
+}
+
+// pipedHostsTransport serves what is written to w, announcing
+// sampleHosts' length as the Content-Length.
+type pipedHostsTransport struct{ r *io.PipeReader }
+
+func (p pipedHostsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		Body:          p.r,
+		ContentLength: int64(len(sampleHosts)),
+		Request:       req,
+	}, nil
+}
+
+func TestDownloadAndApply_ReportsProgress(t *testing.T) {
+	s, _ := newSnapshotAdBlock(t)
+	pr, pw := io.Pipe()
+	s.client = &http.Client{Transport: pipedHostsTransport{pr}}
+	ops := operations.New(&executil.Mock{}, nil)
+	bus := events.New()
+	sub := bus.Subscribe(16, events.OperationUpdated)
+	defer sub.Close()
+	ops.UseEvents(bus)
+	s.UseTracker(ops)
+
+	op, _ := s.claimUpdate()
+	done := make(chan struct{})
+	go func() {
+		s.downloadAndApply(context.Background(), op)
+		close(done)
+	}()
+
+	half := len(sampleHosts) / 2
+	pw.Write([]byte(sampleHosts[:half]))
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		got, _, _ := ops.Get(op.ID())
+		if p := got.Progress; p != nil && p.Bytes == int64(half) {
+			if p.Phase != phaseDownloading || p.Total != int64(len(sampleHosts)) || p.Percent != 50 {
+				t.Errorf("mid-download progress = %+v", p)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("progress = %+v, want %d bytes read", got.Progress, half)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	pw.Write([]byte(sampleHosts[half:]))
+	pw.Close()
+	<-done
+
+	var phases []string
+	for len(sub.C) > 0 {
+		o := (<-sub.C).Payload.(operations.Operation)
+		if o.Status != operations.StatusRunning {
+			phases = append(phases, o.Status)
+		} else {
+			phases = append(phases, o.Progress.Phase)
+		}
+	}
+	if want := "downloading writing reloading ok"; strings.Join(phases, " ") != want {
+		t.Errorf("published %q, want %q", strings.Join(phases, " "), want)
+	}
+	if got, _, _ := ops.Get(op.ID()); got.Progress == nil || got.Progress.Phase != phaseReloading || got.Progress.Items != 2 {
+		t.Errorf("last progress = %+v", got.Progress)
+	}
+}
+
+// renderedBlocklist renders sampleHosts and reads it back the way
+// diagnose does.
+func renderedBlocklist(t *testing.T) blocklist {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "adblock.conf")
+	var buf bytes.Buffer
+	if _, err := renderAdblockConf(&buf, strings.NewReader(sampleHosts), 30, time.Unix(0, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	bl, err := readBlocklist(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bl
+}
+
+func TestReadBlocklist_RoundTripsRenderedConf(t *testing.T) {
+	bl := renderedBlocklist(t)
+	if len(bl) != 2 {
+		t.Errorf("read %d domains, want 2: %v", len(bl), bl)
+	}
+	if bl, err := readBlocklist(filepath.Join(t.TempDir(), "missing.conf")); err != nil || len(bl) != 0 {
+		t.Errorf("missing file = %v, %v", bl, err)
+	}
+}
+
+func TestDiagnose(t *testing.T) {
+	const client = "192.168.100.52"
+	bl := renderedBlocklist(t)
+	upstreams := parseUpstreams(strings.NewReader("interface=wlan0\nserver=1.1.1.1\nserver=1.0.0.1\nno-resolv\n"))
+	queryLog := []byte("dnsmasq[812]: query[A] tracker.doubleclick.net from " + client + "\n" +
+		"dnsmasq[812]: config tracker.doubleclick.net is 0.0.0.0\n" +
+		"dnsmasq[812]: query[AAAA] example.org from 192.168.100.60\n")
+
+	tests := []struct {
+		name  string
+		in    diagnoseInput
+		check func(t *testing.T, d Diagnosis)
+	}{
+		{
+			name: "subdomain of a listed domain is blocked locally",
+			in: diagnoseInput{domain: "tracker.doubleclick.net", enabled: true, ttl: 30, source: blocklistURL,
+				blocklist: bl, upstreams: upstreams, conntrack: []byte{}, queryLog: queryLog},
+			check: func(t *testing.T, d Diagnosis) {
+				if d.Policy.Policy != "adblock" {
+					t.Errorf("policy = %+v", d.Policy)
+				}
+				if d.Rule == nil || d.Rule.Entry != "doubleclick.net" || d.Rule.Source != blocklistURL {
+					t.Errorf("rule = %+v", d.Rule)
+				}
+				if d.Answer != (Answer{Action: "blocked", Address: "0.0.0.0", TTL: 30}) {
+					t.Errorf("answer = %+v", d.Answer)
+				}
+				if !strings.Contains(d.Upstream.Reason, "not forwarded") {
+					t.Errorf("upstream = %+v", d.Upstream)
+				}
+				if !d.Resolver.Checked || d.Resolver.QueriesSeen != 1 || !d.Resolver.DomainSeen {
+					t.Errorf("resolver = %+v", d.Resolver)
+				}
+				if !d.Bypass.Checked || d.Bypass.Observed {
+					t.Errorf("bypass = %+v", d.Bypass)
+				}
+			},
+		},
+		{
+			name: "allowed subdomain of a listed domain is forwarded",
+			in: diagnoseInput{domain: "cdn.tracker.doubleclick.net", enabled: true, ttl: 30, blocklist: bl,
+				allowlist: blocklist{"tracker.doubleclick.net": {}}, upstreams: upstreams},
+			check: func(t *testing.T, d Diagnosis) {
+				if d.Answer.Action != "forwarded" || d.Rule == nil || d.Rule.List != "allowlist" || d.Rule.Entry != "tracker.doubleclick.net" {
+					t.Errorf("rule %+v answer %+v", d.Rule, d.Answer)
+				}
+			},
+		},
+		{
+			name: "unlisted domain is forwarded upstream",
+			in: diagnoseInput{domain: "example.org", enabled: true, ttl: 30,
+				blocklist: bl, upstreams: upstreams, queryLog: queryLog},
+			check: func(t *testing.T, d Diagnosis) {
+				if d.Rule != nil || d.Answer.Action != "forwarded" {
+					t.Errorf("rule %+v answer %+v", d.Rule, d.Answer)
+				}
+				if !reflect.DeepEqual(d.Upstream.Servers, []string{"1.1.1.1", "1.0.0.1"}) {
+					t.Errorf("upstreams = %v", d.Upstream.Servers)
+				}
+				// Only the other client asked for it.
+				if d.Resolver.DomainSeen {
+					t.Errorf("resolver = %+v", d.Resolver)
+				}
+			},
+		},
+		{
+			name: "enabled without a loaded list",
+			in:   diagnoseInput{domain: "doubleclick.net", enabled: true, blocklist: blocklist{}},
+			check: func(t *testing.T, d Diagnosis) {
+				if d.Policy.Policy != "off" || !strings.Contains(d.Policy.Reason, "no blocklist") {
+					t.Errorf("policy = %+v", d.Policy)
+				}
+				if d.Answer.Action != "forwarded" || d.Bypass.Checked || d.Resolver.Checked {
+					t.Errorf("answer %+v bypass %+v resolver %+v", d.Answer, d.Bypass, d.Resolver)
+				}
+			},
+		},
+		{
+			name: "client querying another resolver",
+			in: diagnoseInput{domain: "doubleclick.net", blocklist: bl, queryLog: []byte{},
+				conntrack: []byte(
+					"udp      17 29 src=192.168.100.52 dst=192.168.100.1 sport=40000 dport=53 src=192.168.100.1 dst=192.168.100.52 sport=53 dport=40000 mark=0 use=1\n" +
+						"udp      17 29 src=192.168.100.52 dst=8.8.8.8 sport=40001 dport=53 src=8.8.8.8 dst=10.0.0.5 sport=53 dport=40001 mark=0 use=1\n" +
+						"tcp      6 431999 ESTABLISHED src=192.168.100.52 dst=1.1.1.1 sport=40002 dport=853 src=1.1.1.1 dst=10.0.0.5 sport=853 dport=40002 [ASSURED] mark=0 use=1\n" +
+						// Caught by the DNS redirect: dnsmasq answered.
+						"udp      17 29 src=192.168.100.52 dst=9.9.9.9 sport=40003 dport=53 src=192.168.100.1 dst=192.168.100.52 sport=53 dport=40003 mark=0 use=1\n")},
+			check: func(t *testing.T, d Diagnosis) {
+				if !d.Bypass.Observed || !reflect.DeepEqual(d.Bypass.Destinations, []string{"1.1.1.1", "8.8.8.8"}) {
+					t.Errorf("bypass = %+v", d.Bypass)
+				}
+				if d.Resolver.QueriesSeen != 0 || !strings.Contains(d.Resolver.Note, "no queries") {
+					t.Errorf("resolver = %+v", d.Resolver)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.in.client = client
+			tt.check(t, diagnose(tt.in))
+		})
+	}
+}
+
+func TestHandleDiagnose_ValidatesQuery(t *testing.T) {
+	s := New(config.Config{}, &executil.Mock{})
+	for _, q := range []string{
+		"client=phone&domain=ads.example.com",
+		"client=fe80::1&domain=ads.example.com",
+		"client=192.168.100.52",
+		"client=192.168.100.52&domain=bad..name",
+	} {
+		w := httptest.NewRecorder()
+		s.handleDiagnose(w, httptest.NewRequest("GET", "/api/adblock/diagnose?"+q, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want 400", q, w.Code)
+		}
+	}
+}
+
+// ─── DNS redirect watchdog ───────────────────────────────────────────────────
+
+type fakeWiFi struct {
+	iface   string
+	onApply []func()
+}
+
+func (f *fakeWiFi) Status() wifi.Status { return wifi.Status{APInterface: f.iface} }
+func (f *fakeWiFi) OnApply(fn func())   { f.onApply = append(f.onApply, fn) }
+
+const (
+	checkJump = "iptables -t nat -C PREROUTING -j STRCT_DNS"
+	checkUDP  = "iptables -t nat -C STRCT_DNS -i wlan0 -p udp --dport 53 -j REDIRECT --to-ports 53"
+	checkTCP  = "iptables -t nat -C STRCT_DNS -i wlan0 -p tcp --dport 53 -j REDIRECT --to-ports 53"
+	addJump   = "iptables -t nat -I PREROUTING 1 -j STRCT_DNS"
+	addUDP    = "iptables -t nat -A STRCT_DNS -i wlan0 -p udp --dport 53 -j REDIRECT --to-ports 53"
+	addTCP    = "iptables -t nat -A STRCT_DNS -i wlan0 -p tcp --dport 53 -j REDIRECT --to-ports 53"
+)
+
+// newWatchedAdBlock is an enabled AdBlock whose redirect is installed on
+// wlan0 and, per the mock, still intact.
+func newWatchedAdBlock(t *testing.T) (*AdBlock, *executil.Mock, *fakeWiFi) {
+	t.Helper()
+	m := &executil.Mock{}
+	w := &fakeWiFi{iface: "wlan0"}
+	s := New(config.Config{}, m)
+	s.wifiSvc = w
+	s.state.Enabled = true
+	s.checkRedirect(false)
+	if s.redirectIface != "wlan0" {
+		t.Fatalf("redirect not installed: iface %q", s.redirectIface)
+	}
+	m.Calls = nil
+	return s, m, w
+}
+
+func TestCheckRedirect_InstallsOnceAndIsIdempotent(t *testing.T) {
+	m := &executil.Mock{}
+	for _, c := range []string{checkJump, checkUDP, checkTCP} {
+		m.Expect(c, executil.MockResult{Err: errors.New("exit status 1")})
+	}
+	s := New(config.Config{}, m)
+	s.wifiSvc = &fakeWiFi{iface: "wlan0"}
+	s.state.Enabled = true
+
+	s.checkRedirect(false)
+	for _, c := range []string{addJump, addUDP, addTCP} {
+		m.AssertCalled(t, c)
+	}
+
+	// The rules are in place now; further passes only check.
+	for _, c := range []string{checkJump, checkUDP, checkTCP} {
+		m.Expect(c, executil.MockResult{})
+	}
+	m.Calls = nil
+	s.checkRedirect(false)
+	s.checkRedirect(true)
+	for _, c := range m.Calls {
+		if len(c.Args) > 2 && c.Args[2] != "-C" {
+			t.Errorf("intact rules changed: %s", c)
+		}
+	}
+	if s.status.RedirectRepairs != 0 {
+		t.Errorf("RedirectRepairs = %d, want 0", s.status.RedirectRepairs)
+	}
+}
+
+func TestCheckRedirect_RepairsFlushedRules(t *testing.T) {
+	s, m, _ := newWatchedAdBlock(t)
+
+	// iptables -t nat -F: the jump and the chain's rules are gone.
+	for _, c := range []string{checkJump, checkUDP, checkTCP} {
+		m.Expect(c, executil.MockResult{Err: errors.New("exit status 1")})
+	}
+	s.checkRedirect(false)
+	for _, c := range []string{addJump, addUDP, addTCP} {
+		if n := m.CallCount(c); n != 1 {
+			t.Errorf("%s called %d times, want 1", c, n)
+		}
+	}
+	if s.status.RedirectRepairs != 1 || s.status.LastRedirectRepair.IsZero() {
+		t.Errorf("status = %+v", s.status)
+	}
+	if w := s.HealthWarnings(); w != nil {
+		t.Errorf("one loss warned: %v", w)
+	}
+}
+
+func TestCheckRedirect_RepeatedLossesWarn(t *testing.T) {
+	s, m, _ := newWatchedAdBlock(t)
+	now := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+	m.Expect(checkJump, executil.MockResult{Err: errors.New("exit status 1")})
+
+	for i := 0; i < lossWarnCount-1; i++ {
+		s.checkRedirect(false)
+		now = now.Add(10 * time.Minute)
+	}
+	if warnings := s.HealthWarnings(); warnings != nil {
+		t.Fatalf("warned before %d losses: %v", lossWarnCount, warnings)
+	}
+	s.checkRedirect(true)
+	warnings := s.HealthWarnings()
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "3 times") || !strings.Contains(warnings[0], "wifi apply") {
+		t.Fatalf("warnings = %v", warnings)
+	}
+
+	// Losses spread over more than an hour are not a pattern.
+	now = now.Add(2 * time.Hour)
+	if warnings := s.HealthWarnings(); warnings != nil {
+		t.Errorf("stale losses still warn: %v", warnings)
+	}
+}
+
+func TestCheckRedirect_FollowsAPAndDisable(t *testing.T) {
+	s, m, w := newWatchedAdBlock(t)
+
+	w.iface = "wlan0_ap" // switched to extender mode
+	s.checkRedirect(true)
+	m.AssertCalled(t, "iptables -t nat -F STRCT_DNS")
+	if s.redirectIface != "wlan0_ap" || s.status.RedirectRepairs != 0 {
+		t.Errorf("iface %q, repairs %d", s.redirectIface, s.status.RedirectRepairs)
+	}
+
+	s.state.Enabled = false
+	s.checkRedirect(false)
+	m.AssertCalled(t, "iptables -t nat -D PREROUTING -j STRCT_DNS")
+	if s.redirectIface != "" {
+		t.Errorf("redirect still recorded on %q", s.redirectIface)
+	}
+}
+
+func TestNewFromConfig_KicksWatchdogOnWiFiApply(t *testing.T) {
+	w := &fakeWiFi{iface: "wlan0"}
+	s := NewFromConfig(&config.Config{IsDev: true}, nil, w, events.Discard)
+	if len(w.onApply) != 1 {
+		t.Fatalf("registered %d apply hooks, want 1", len(w.onApply))
+	}
+	w.onApply[0]()
+	w.onApply[0]() // coalesced, never blocks
+	select {
+	case <-s.recheck:
+	default:
+		t.Fatal("apply did not request a check")
+	}
+}
+
+// ─── DNS sentinel ────────────────────────────────────────────────────────────
+
+const (
+	bypassUDP = "iptables -t nat -A STRCT_DNS -i wlan0 -p udp --dport 53 -j DNAT --to-destination 9.9.9.9:53"
+	bypassTCP = "iptables -t nat -A STRCT_DNS -i wlan0 -p tcp --dport 53 -j DNAT --to-destination 9.9.9.9:53"
+)
+
+// newSentinelAdBlock is a watched AdBlock whose dnsmasq probe fails while
+// *down is set, with 9.9.9.9 as its upstream.
+func newSentinelAdBlock(t *testing.T) (*AdBlock, *executil.Mock, *bool) {
+	t.Helper()
+	s, m, _ := newWatchedAdBlock(t)
+	s.dnsmasqConf = filepath.Join(t.TempDir(), "strct.conf")
+	os.WriteFile(s.dnsmasqConf, []byte("interface=wlan0\nserver=/lan/192.168.100.1\nserver=9.9.9.9\nserver=149.112.112.112\n"), 0644)
+	down := new(bool)
+	s.probe = func() error {
+		if *down {
+			return errors.New("i/o timeout")
+		}
+		return nil
+	}
+	// Rules are added only if the -C check says they are missing.
+	for _, c := range []string{bypassUDP, bypassTCP, addUDP, addTCP} {
+		m.Expect(strings.Replace(c, " -A ", " -C ", 1), executil.MockResult{Err: errors.New("exit status 1")})
+	}
+	return s, m, down
+}
+
+func TestCheckDNS_FailsOpenAndRecovers(t *testing.T) {
+	s, m, down := newSentinelAdBlock(t)
+
+	*down = true
+	for i := 0; i < sentinelFailLimit-1; i++ {
+		s.checkDNS()
+	}
+	if s.failedOpen || s.HealthWarnings() != nil || m.WasCalled(bypassUDP) {
+		t.Fatalf("acted before %d misses: %+v", sentinelFailLimit, s.status)
+	}
+
+	s.checkDNS()
+	m.AssertCalled(t, "iptables -t nat -F STRCT_DNS")
+	m.AssertCalled(t, bypassUDP)
+	m.AssertCalled(t, bypassTCP)
+	m.AssertCalled(t, "systemctl restart dnsmasq")
+	if st := s.currentStatus(); !st.DNSDown || !st.FailedOpen || st.DNSRestarts != 1 {
+		t.Errorf("status = %+v", st)
+	}
+	if w := s.HealthWarnings(); len(w) != 1 || !strings.HasPrefix(w[0], "critical:") || !strings.Contains(w[0], "without blocking") {
+		t.Errorf("warnings = %v", w)
+	}
+	// Failed open, devices still resolve: down, but not the agent.
+	if h := s.Health(); h.Status != agent.HealthDown || h.Critical {
+		t.Errorf("health = %+v", h)
+	}
+
+	// The watchdog must not put the redirect to a dead dnsmasq back.
+	m.Calls = nil
+	s.checkRedirect(false)
+	if len(m.Calls) != 0 {
+		t.Errorf("watchdog touched the bypass: %v", m.Calls)
+	}
+
+	// Restarts are retried, not on every pass.
+	for i := 0; i < sentinelFailLimit; i++ {
+		s.checkDNS()
+	}
+	if n := m.CallCount("systemctl restart dnsmasq"); n != 1 {
+		t.Errorf("restarted %d more times over %d misses, want 1", n, sentinelFailLimit)
+	}
+	if n := m.CallCount(bypassUDP); n != 0 {
+		t.Errorf("bypass re-installed %d times", n)
+	}
+
+	*down = false
+	m.Calls = nil
+	s.checkDNS()
+	m.AssertCalled(t, addUDP)
+	m.AssertCalled(t, addTCP)
+	if st := s.currentStatus(); st.DNSDown || st.FailedOpen || s.redirectIface != "wlan0" {
+		t.Errorf("after recovery: %+v, iface %q", st, s.redirectIface)
+	}
+	if w := s.HealthWarnings(); w != nil {
+		t.Errorf("warnings after recovery = %v", w)
+	}
+	if h := s.Health(); h.Status != agent.HealthOK {
+		t.Errorf("health after recovery = %+v", h)
+	}
+}
+
+func TestCheckDNS_FailClosedKeepsRedirect(t *testing.T) {
+	s, m, down := newSentinelAdBlock(t)
+	s.state.FailMode = FailClosed
+
+	*down = true
+	for i := 0; i < sentinelFailLimit; i++ {
+		s.checkDNS()
+	}
+	if m.WasCalled("iptables -t nat -F STRCT_DNS") || m.WasCalled(bypassUDP) {
+		t.Error("fail-closed changed the redirect")
+	}
+	m.AssertCalled(t, "systemctl restart dnsmasq")
+	if w := s.HealthWarnings(); len(w) != 1 || !strings.Contains(w[0], "fail_mode is closed") {
+		t.Errorf("warnings = %v", w)
+	}
+	if h := s.Health(); h.Status != agent.HealthDown || !h.Critical || !strings.Contains(h.Message, "no DNS") {
+		t.Errorf("health = %+v", h)
+	}
+
+	// Switching to fail-open mid-outage applies on the next pass.
+	s.state.FailMode = FailOpen
+	s.checkDNS()
+	m.AssertCalled(t, bypassUDP)
+}
+
+func TestCheckDNS_IdleWhileDisabled(t *testing.T) {
+	s, m, _ := newSentinelAdBlock(t)
+	s.state.Enabled = false
+	s.probe = func() error { t.Fatal("probed while disabled"); return nil }
+	for i := 0; i < sentinelFailLimit; i++ {
+		s.checkDNS()
+	}
+	m.AssertNotCalled(t, "systemctl restart dnsmasq")
+}
+
+func TestHandleSetConfig_FailMode(t *testing.T) {
+	for body, want := range map[string]int{
+		`{"enabled":false,"fail_mode":"closed"}`: http.StatusOK,
+		`{"enabled":false,"fail_mode":"open"}`:   http.StatusOK,
+		`{"enabled":false,"fail_mode":"maybe"}`:  http.StatusBadRequest,
+	} {
+		s := New(config.Config{IsDev: true, DataDir: t.TempDir()}, &executil.Mock{})
+		rec := httptest.NewRecorder()
+		s.handleSetConfig(rec, httptest.NewRequest("POST", "/api/adblock/config", strings.NewReader(body)))
+		if rec.Code != want {
+			t.Errorf("%s: %d, want %d", body, rec.Code, want)
+		}
+	}
+}
+
+// ─── DNS load limits ─────────────────────────────────────────────────────────
+
+const (
+	checkLimitJump = "iptables -t filter -C INPUT -j STRCT_DNS_LIMIT"
+	addLimitRule   = "iptables -t filter -A STRCT_DNS_LIMIT -i wlan0 -p udp --dport 53 -m hashlimit --hashlimit-mode srcip " +
+		"--hashlimit-above 100/sec --hashlimit-burst 200 --hashlimit-name strct-dns -j DROP"
+)
+
+func TestCheckRedirect_InstallsRateLimit(t *testing.T) {
+	m := &executil.Mock{}
+	m.Expect(checkLimitJump, executil.MockResult{Err: errors.New("exit status 1")})
+	s := New(config.Config{}, m)
+	s.wifiSvc = &fakeWiFi{iface: "wlan0"}
+	s.state.Enabled = true
+
+	s.checkRedirect(false)
+	m.AssertCalled(t, "iptables -t filter -I INPUT 1 -j STRCT_DNS_LIMIT")
+	if s.limitInstalled != "wlan0 100" {
+		t.Fatalf("limitInstalled = %q", s.limitInstalled)
+	}
+
+	// A new rate replaces the rule.
+	m.Expect(checkLimitJump, executil.MockResult{})
+	m.Calls = nil
+	s.state.ClientQPS = 20
+	s.checkRedirect(false)
+	m.AssertCalled(t, "iptables -t filter -F STRCT_DNS_LIMIT")
+	if s.limitInstalled != "wlan0 20" {
+		t.Errorf("limitInstalled = %q", s.limitInstalled)
+	}
+
+	s.state.Enabled = false
+	s.checkRedirect(false)
+	m.AssertCalled(t, "iptables -t filter -D INPUT -j STRCT_DNS_LIMIT")
+	if s.limitInstalled != "" {
+		t.Errorf("limit still recorded as %q", s.limitInstalled)
+	}
+}
+
+func TestCheckRedirect_RestoresFlushedRateLimit(t *testing.T) {
+	s, m, _ := newWatchedAdBlock(t)
+
+	// iptables -F: the jump from INPUT is gone.
+	m.Expect(checkLimitJump, executil.MockResult{Err: errors.New("exit status 1")})
+	s.checkRedirect(false)
+	m.AssertCalled(t, "iptables -t filter -I INPUT 1 -j STRCT_DNS_LIMIT")
+	m.AssertCalled(t, "iptables -t filter -C STRCT_DNS_LIMIT"+strings.TrimPrefix(addLimitRule, "iptables -t filter -A STRCT_DNS_LIMIT"))
+}
+
+func TestHandleSetConfig_Limits(t *testing.T) {
+	for body, want := range map[string]int{
+		`{"enabled":false,"max_inflight":1024,"client_qps":50}`: http.StatusOK,
+		`{"enabled":false,"max_inflight":-1}`:                   http.StatusBadRequest,
+		`{"enabled":false,"max_inflight":100000}`:               http.StatusBadRequest,
+		`{"enabled":false,"client_qps":20000}`:                  http.StatusBadRequest,
+	} {
+		s := New(config.Config{IsDev: true, DataDir: t.TempDir()}, &executil.Mock{})
+		rec := httptest.NewRecorder()
+		s.handleSetConfig(rec, httptest.NewRequest("POST", "/api/adblock/config", strings.NewReader(body)))
+		if rec.Code != want {
+			t.Errorf("%s: %d, want %d", body, rec.Code, want)
+		}
+	}
+
+	s := New(config.Config{IsDev: true, DataDir: t.TempDir()}, &executil.Mock{})
+	rec := httptest.NewRecorder()
+	s.handleSetConfig(rec, httptest.NewRequest("POST", "/api/adblock/config",
+		strings.NewReader(`{"enabled":false,"block_ttl":-1,"fail_mode":"maybe","max_inflight":-1,"client_qps":20000}`)))
+	var resp struct {
+		Errors []errs.FieldError `json:"errors"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	var fields []string
+	for _, e := range resp.Errors {
+		fields = append(fields, e.Field)
+	}
+	if rec.Code != http.StatusBadRequest || strings.Join(fields, ",") != "block_ttl,fail_mode,max_inflight,client_qps" {
+		t.Errorf("every problem at once: %d %s", rec.Code, rec.Body)
+	}
+
+	s, _ = newSnapshotAdBlock(t)
+	s.state.MaxInflight = 1024
+	var buf bytes.Buffer
+	if _, err := renderConf(&buf, s.confHeader(), time.Unix(0, 0), Lists{}, func(emit func(string)) error {
+		emit("ads.example.com")
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "dns-forward-max=1024\n") {
+		t.Errorf("conf:\n%s", buf.String())
+	}
+}
+
+func TestCheckOverload(t *testing.T) {
+	s, m, _ := newWatchedAdBlock(t)
+	now := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+	journal := fmt.Sprintf("journalctl -u dnsmasq -p warning --since @%d -o cat --no-pager", now.Add(-watchdogInterval).Unix())
+
+	s.checkOverload()
+	m.AssertCalled(t, journal)
+	if s.status.Limits.Overloads != 0 || s.HealthWarnings() != nil {
+		t.Fatalf("quiet journal: %+v, %v", s.status.Limits, s.HealthWarnings())
+	}
+
+	now = now.Add(watchdogInterval)
+	m.Expect(fmt.Sprintf("journalctl -u dnsmasq -p warning --since @%d -o cat --no-pager", now.Add(-watchdogInterval).Unix()),
+		executil.MockResult{Output: []byte(dnsmasqOverloadMsg + "\n" + dnsmasqOverloadMsg + "\n")})
+	s.checkOverload()
+	if s.status.Limits.Overloads != 1 || !s.status.Limits.LastOverload.Equal(now) {
+		t.Errorf("limits = %+v", s.status.Limits)
+	}
+	w := s.HealthWarnings()
+	if len(w) != 1 || !strings.Contains(w[0], "256 concurrent upstream queries") {
+		t.Errorf("warnings = %v", w)
+	}
+
+	now = now.Add(overloadWarnFor + time.Minute)
+	if w := s.HealthWarnings(); w != nil {
+		t.Errorf("old overload still warns: %v", w)
+	}
+}
+
+func TestLimitStats(t *testing.T) {
+	s, m, _ := newWatchedAdBlock(t)
+	hashlimitDir = t.TempDir()
+	t.Cleanup(func() { hashlimitDir = "/proc/net/ipt_hashlimit" })
+	os.WriteFile(filepath.Join(hashlimitDir, hashlimitName), []byte(
+		"9 192.168.100.52:0->0.0.0.0:0 0 6400000 32000\n"+
+			"9 192.168.100.7:0->0.0.0.0:0 6400000 6400000 32000\n"+
+			"3 192.168.100.31:0->0.0.0.0:0 1200 6400000 32000\n"), 0644)
+	m.Expect("iptables -t filter -L STRCT_DNS_LIMIT -v -x -n", executil.MockResult{Output: []byte(
+		"Chain STRCT_DNS_LIMIT (1 references)\n" +
+			"    pkts      bytes target     prot opt in     out     source               destination\n" +
+			"    4213   273845 DROP       udp  --  wlan0  *       0.0.0.0/0            0.0.0.0/0            udp dpt:53 limit: above 100/sec burst 200 mode srcip\n")})
+
+	mux := http.NewServeMux()
+	s.RegisterRoutes(mux)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/api/adblock/status", nil))
+	var st Status
+	if err := json.Unmarshal(rec.Body.Bytes(), &st); err != nil {
+		t.Fatal(err)
+	}
+	want := DNSLimits{MaxInflight: 256, ClientQPS: 100, RateDrops: 4213, Throttled: []string{"192.168.100.31", "192.168.100.52"}}
+	if !reflect.DeepEqual(st.Limits, want) {
+		t.Errorf("dns_limits = %+v, want %+v", st.Limits, want)
+	}
+}
+
+// ─── Blocklist snapshot ──────────────────────────────────────────────────────
+
+// hostsTransport answers every request with body.
+type hostsTransport string
+
+func (h hostsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(strings.NewReader(string(h))),
+		Request:    req,
+	}, nil
+}
+
+func newSnapshotAdBlock(t *testing.T) (*AdBlock, *executil.Mock) {
+	t.Helper()
+	m := &executil.Mock{}
+	s := New(config.Config{DataDir: t.TempDir()}, m)
+	s.confPath = filepath.Join(t.TempDir(), "dnsmasq.d", "adblock.conf")
+	s.recordsPath = filepath.Join(filepath.Dir(s.confPath), "local-records.conf")
+	s.state.Enabled = true
+	return s, m
+}
+
+func TestDownloadAndApply_SavesSnapshot(t *testing.T) {
+	s, m := newSnapshotAdBlock(t)
+	s.client = &http.Client{Transport: hostsTransport(sampleHosts)}
+	bus := events.New()
+	sub := bus.Subscribe(1)
+	defer sub.Close()
+	s.events = bus
+	s.downloadAndApply(context.Background(), nil)
+
+	if s.status.EntryCount != 2 || s.status.UpdateError != "" {
+		t.Fatalf("status = %+v", s.status)
+	}
+	m.AssertCalled(t, "systemctl kill -s HUP dnsmasq")
+	select {
+	case e := <-sub.C:
+		if u, ok := e.Payload.(BlocklistUpdated); e.Type != events.AdblockUpdated || !ok || u.Domains != 2 {
+			t.Errorf("event = %+v", e)
+		}
+	default:
+		t.Error("no adblock.updated event")
+	}
+
+	var domains []string
+	info, err := readSnapshot(s.snapshotPath(), func(d string) { domains = append(domains, d) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(domains, []string{"doubleclick.net", "ads.example.com"}) {
+		t.Errorf("snapshot domains = %v", domains)
+	}
+	if info.Source != blocklistURL || !info.Fetched.Equal(s.status.LastUpdated.Truncate(time.Second)) {
+		t.Errorf("snapshot header = %+v, last updated %v", info, s.status.LastUpdated)
+	}
+}
+
+func TestDownloadAndApply_EmptyListKeepsSnapshot(t *testing.T) {
+	s, _ := newSnapshotAdBlock(t)
+	s.client = &http.Client{Transport: hostsTransport(sampleHosts)}
+	s.downloadAndApply(context.Background(), nil)
+	s.client = &http.Client{Transport: hostsTransport("<html>captive portal</html>")}
+	s.downloadAndApply(context.Background(), nil)
+
+	n := 0
+	if _, err := readSnapshot(s.snapshotPath(), func(string) { n++ }); err != nil || n != 2 {
+		t.Errorf("snapshot after an empty download: %d domains, %v", n, err)
+	}
+}
+
+// sourcesTransport answers the hosts list for the URLs in ok and 503
+// for any other, recording what was asked for.
+type sourcesTransport struct {
+	ok    map[string]bool
+	asked *[]string
+}
+
+func (tr sourcesTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	*tr.asked = append(*tr.asked, req.URL.String())
+	if !tr.ok[req.URL.String()] {
+		return &http.Response{StatusCode: http.StatusServiceUnavailable, Body: http.NoBody, Request: req}, nil
+	}
+	return hostsTransport(sampleHosts).RoundTrip(req)
+}
+
+func TestDownloadAndApply_TriesSourcesInOrder(t *testing.T) {
+	const mirror, backup = "https://mirror.example/hosts", "https://backup.example/hosts"
+	m := &executil.Mock{}
+	s := New(config.Config{DataDir: t.TempDir(), AdblockSources: []string{mirror, backup}}, m)
+	s.confPath = filepath.Join(t.TempDir(), "dnsmasq.d", "adblock.conf")
+	s.recordsPath = filepath.Join(filepath.Dir(s.confPath), "local-records.conf")
+	var asked []string
+	s.client = &http.Client{Transport: sourcesTransport{ok: map[string]bool{backup: true}, asked: &asked}}
+
+	s.downloadAndApply(context.Background(), nil)
+	if s.status.EntryCount != 2 || s.status.Source != backup || s.status.UpdateError != "" {
+		t.Fatalf("status = %+v", s.status)
+	}
+	if !reflect.DeepEqual(asked, []string{mirror, backup}) {
+		t.Errorf("asked %v", asked)
+	}
+	if info, _ := readSnapshot(s.snapshotPath(), func(string) {}); info.Source != backup {
+		t.Errorf("snapshot source = %q", info.Source)
+	}
+
+	// All down: the last source's error is the update's.
+	asked = nil
+	s.client = &http.Client{Transport: sourcesTransport{asked: &asked}}
+	s.downloadAndApply(context.Background(), nil)
+	if s.status.UpdateError != "download returned 503" || len(asked) != 2 {
+		t.Errorf("all down: error %q, asked %v", s.status.UpdateError, asked)
+	}
+	if New(config.Config{}, m).sources[0] != blocklistURL {
+		t.Error("no sources configured does not fall back to StevenBlack's list")
+	}
+}
+
+// TestRestoreBlocklist rebuilds adblock.conf from the snapshot under the
+// current TTL, the way a start without internet does.
+func TestRestoreBlocklist(t *testing.T) {
+	s, m := newSnapshotAdBlock(t)
+	fetched := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	sw, err := createSnapshot(s.snapshotPath(), snapshotInfo{Fetched: fetched, Source: blocklistURL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sw.add("doubleclick.net")
+	sw.add("ads.example.com")
+	if err := sw.commit(); err != nil {
+		t.Fatal(err)
+	}
+	s.state.BlockTTL = 120
+
+	if err := s.restoreBlocklist(); err != nil {
+		t.Fatal(err)
+	}
+	conf := readFile(t, s.confPath)
+	for _, want := range []string{"local-ttl=120\n", "dns-forward-max=256\n", "address=/doubleclick.net/0.0.0.0\n", "address=/ads.example.com/0.0.0.0\n"} {
+		if !strings.Contains(conf, want) {
+			t.Errorf("conf missing %q:\n%s", want, conf)
+		}
+	}
+	if s.status.EntryCount != 2 || !s.status.Enabled || !s.status.LastUpdated.Equal(fetched) {
+		t.Errorf("status = %+v", s.status)
+	}
+	m.AssertCalled(t, "systemctl kill -s HUP dnsmasq")
+}
+
+func TestRestoreBlocklist_BadSnapshotKeepsConf(t *testing.T) {
+	s, _ := newSnapshotAdBlock(t)
+	if err := s.restoreBlocklist(); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("no snapshot: err = %v, want ErrNotExist", err)
+	}
+
+	sw, err := createSnapshot(s.snapshotPath(), snapshotInfo{Fetched: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 1000 {
+		sw.add(fmt.Sprintf("ads%d.example.com", i))
+	}
+	if err := sw.commit(); err != nil {
+		t.Fatal(err)
+	}
+	full, _ := os.ReadFile(s.snapshotPath())
+	os.WriteFile(s.snapshotPath(), full[:len(full)/2], 0600)
+	os.MkdirAll(filepath.Dir(s.confPath), 0755)
+	os.WriteFile(s.confPath, []byte("address=/old.example/0.0.0.0\n"), 0644)
+
+	if err := s.restoreBlocklist(); err == nil {
+		t.Fatal("truncated snapshot restored")
+	}
+	if conf := readFile(t, s.confPath); conf != "address=/old.example/0.0.0.0\n" {
+		t.Errorf("conf replaced by a partial list:\n%s", conf)
+	}
+}
+
+func TestCurrentStatus_BlocklistAge(t *testing.T) {
+	s, _ := newSnapshotAdBlock(t)
+	now := time.Date(2026, 1, 10, 0, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+	s.status.Enabled = true
+
+	s.status.LastUpdated = now.Add(-50 * time.Hour)
+	if st := s.currentStatus(); st.BlocklistAge != 50*3600 || st.BlocklistStale {
+		t.Errorf("50h on a daily schedule: %+v", st)
+	}
+	if w := s.HealthWarnings(); w != nil {
+		t.Errorf("warnings = %v", w)
+	}
+
+	s.status.LastUpdated = now.Add(-73 * time.Hour)
+	s.status.UpdateError = "download failed: no route to host"
+	if !s.currentStatus().BlocklistStale {
+		t.Error("73h on a daily schedule not stale")
+	}
+	w := s.HealthWarnings()
+	if len(w) != 1 || !strings.Contains(w[0], "73h0m0s old") || !strings.Contains(w[0], "no route to host") {
+		t.Errorf("warnings = %v", w)
+	}
+
+	s.state.UpdateSchedule = "weekly"
+	if s.currentStatus().BlocklistStale {
+		t.Error("73h on a weekly schedule is stale")
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	s, _ := newSnapshotAdBlock(t)
+	rec := httptest.NewRecorder()
+	s.handleSetConfig(rec, httptest.NewRequest("POST", "/api/adblock/config",
+		strings.NewReader(`{"enabled":false,"update_schedule":"weekly","block_ttl":600}`)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("set config: %d %s", rec.Code, rec.Body)
+	}
+
+	restarted := New(s.cfg, &executil.Mock{})
+	restarted.confPath = s.confPath
+	if err := restarted.loadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if want := (AdBlockConfig{UpdateSchedule: "weekly", BlockTTL: 600}); restarted.state != want {
+		t.Errorf("restored %+v, want %+v", restarted.state, want)
+	}
+}
+
+// TestLoadConfig_LegacyConfMeansEnabled: an agent from before the config
+// was kept, upgraded on a device that already serves a blocklist.
+func TestLoadConfig_LegacyConfMeansEnabled(t *testing.T) {
+	s, _ := newSnapshotAdBlock(t)
+	s.state.Enabled = false
+	if err := s.loadConfig(); err != nil || s.state.Enabled {
+		t.Fatalf("no file, no conf: enabled=%v err=%v", s.state.Enabled, err)
+	}
+	os.MkdirAll(filepath.Dir(s.confPath), 0755)
+	os.WriteFile(s.confPath, []byte("address=/doubleclick.net/0.0.0.0\n"), 0644)
+	if err := s.loadConfig(); err != nil || !s.state.Enabled || s.state.BlockTTL != defaultBlockTTL {
+		t.Errorf("legacy conf: state=%+v err=%v", s.state, err)
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
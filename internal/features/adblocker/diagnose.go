@@ -0,0 +1,398 @@
+package adblock
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// dnsmasqConfPath is the AP dnsmasq config wifi writes; its server= lines
+// are the upstreams every forwarded query goes to.
+const dnsmasqConfPath = "/etc/dnsmasq.d/strct.conf"
+
+// diagnoseWindow is how far back the resolver check reads dnsmasq's query
+// log (wifi enables log-queries).
+const diagnoseWindow = "-15min"
+
+// Diagnosis answers "why is this device (not) getting ads blocked" for one
+// client and domain, from what dnsmasq has loaded and what the kernel saw.
+type Diagnosis struct {
+	Client   string        `json:"client"`
+	Device   string        `json:"device,omitempty"` // the client's MAC, if it is in the neighbour table
+	Domain   string        `json:"domain"`
+	Policy   PolicyCheck   `json:"policy"`
+	Rule     *RuleMatch    `json:"rule,omitempty"` // nil: no blocklist entry matches
+	Answer   Answer        `json:"answer"`
+	Upstream UpstreamCheck `json:"upstream"`
+	Bypass   BypassCheck   `json:"bypass"`
+	Resolver ResolverCheck `json:"resolver"`
+}
+
+type PolicyCheck struct {
+	Policy string `json:"policy"` // adblock|off
+	Reason string `json:"reason"`
+}
+
+type RuleMatch struct {
+	List   string `json:"list"`   // blocklist|custom|allowlist
+	Source string `json:"source"` // where the list came from
+	Entry  string `json:"entry"`  // the listed domain that matched, maybe a parent
+}
+
+type Answer struct {
+	Action  string `json:"action"`            // blocked|forwarded
+	Address string `json:"address,omitempty"` // for blocked
+	TTL     int    `json:"ttl,omitempty"`     // for blocked
+}
+
+type UpstreamCheck struct {
+	// Route is default, global_rule, device_rule or device_upstreams,
+	// see splitdns.go; Rule is the forwarding rule's domain.
+	Route   string   `json:"route"`
+	Rule    string   `json:"rule,omitempty"`
+	Servers []string `json:"servers"`
+	Reason  string   `json:"reason"`
+}
+
+type BypassCheck struct {
+	Checked      bool     `json:"checked"`
+	Observed     bool     `json:"observed"`
+	Destinations []string `json:"destinations,omitempty"` // DNS/DoT servers other than ours
+	Note         string   `json:"note"`
+}
+
+type ResolverCheck struct {
+	Checked     bool   `json:"checked"`
+	QueriesSeen int    `json:"queries_seen"`
+	DomainSeen  bool   `json:"domain_seen"`
+	Note        string `json:"note"`
+}
+
+// blocklist is the set of domains dnsmasq answers with blockAddress.
+type blocklist map[string]struct{}
+
+// readBlocklist loads the address= lines from an adblock.conf written by
+// renderAdblockConf. A missing file is an empty list.
+func readBlocklist(path string) (blocklist, error) {
+	return readConfDomains(path, parseAddressLine)
+}
+
+// readAllowlist loads the server=/domain/# lines the same way.
+func readAllowlist(path string) (blocklist, error) {
+	return readConfDomains(path, parseAllowLine)
+}
+
+func readConfDomains(path string, parse func(line string) (string, bool)) (blocklist, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return blocklist{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	bl := blocklist{}
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if domain, ok := parse(sc.Text()); ok {
+			bl[domain] = struct{}{}
+		}
+	}
+	return bl, sc.Err()
+}
+
+// match reports the listed domain that blocks name. dnsmasq's
+// address=/example.com/ also covers every subdomain, so parents are
+// checked up to the top-level label.
+func (bl blocklist) match(name string) (string, bool) {
+	for d := name; d != ""; {
+		if _, ok := bl[d]; ok {
+			return d, true
+		}
+		_, parent, found := strings.Cut(d, ".")
+		if !found {
+			break
+		}
+		d = parent
+	}
+	return "", false
+}
+
+// decide is the answer dnsmasq gives for name with bl and allow loaded.
+// dnsmasq goes by the longest matching domain, so an allowed subdomain of
+// a blocked one is forwarded. custom are the user's own block rules.
+func decide(bl, allow blocklist, custom []string, source string, ttl int, name string) (Answer, *RuleMatch) {
+	entry, ok := bl.match(name)
+	if allowed, found := allow.match(name); found && (!ok || len(allowed) >= len(entry)) {
+		return Answer{Action: "forwarded"}, &RuleMatch{List: "allowlist", Source: "adblock-lists.json", Entry: allowed}
+	}
+	if !ok {
+		return Answer{Action: "forwarded"}, nil
+	}
+	rule := &RuleMatch{List: "blocklist", Source: source, Entry: entry}
+	if slices.Contains(custom, entry) {
+		rule.List, rule.Source = "custom", "adblock-lists.json"
+	}
+	return Answer{Action: "blocked", Address: blockAddress, TTL: ttl}, rule
+}
+
+// diagnoseInput is everything diagnose looks at, gathered by the handler.
+type diagnoseInput struct {
+	client, domain string
+	enabled        bool
+	ttl            int
+	blocklist      blocklist
+	allowlist      blocklist
+	custom         []string // the user's block rules, see Lists
+	source         string   // the URL the blocklist was downloaded from
+	upstreams      []string
+	split          SplitDNS
+	mac            string // the client's, "" if unknown
+	conntrack      []byte // nil: conntrack unavailable
+	queryLog       []byte // nil: journal unavailable
+}
+
+func diagnose(in diagnoseInput) Diagnosis {
+	d := Diagnosis{Client: in.client, Domain: in.domain}
+
+	// adblock.conf is loaded by the single AP dnsmasq, so whatever it holds
+	// applies to every client; only split DNS devices route around it,
+	// below.
+	switch {
+	case len(in.blocklist) > 0:
+		d.Policy = PolicyCheck{Policy: "adblock", Reason: fmt.Sprintf(
+			"the blocklist (%d domains) is loaded by the AP's dnsmasq and applies to every client", len(in.blocklist))}
+	case in.enabled:
+		d.Policy = PolicyCheck{Policy: "off", Reason: "ad blocking is enabled but no blocklist is loaded yet; check /api/adblock/status for an update error"}
+	default:
+		d.Policy = PolicyCheck{Policy: "off", Reason: "ad blocking is disabled"}
+	}
+
+	d.Answer, d.Rule = decide(in.blocklist, in.allowlist, in.custom, in.source, in.ttl, in.domain)
+
+	d.Upstream = UpstreamCheck{Route: routeDefault, Servers: in.upstreams}
+	switch {
+	case d.Answer.Action == "blocked":
+		d.Upstream.Reason = "not forwarded: dnsmasq answers blocked domains itself"
+	case len(in.upstreams) == 0:
+		d.Upstream.Reason = "no server= lines in " + dnsmasqConfPath + "; is the access point set up?"
+	default:
+		d.Upstream.Reason = "dnsmasq forwards to whichever of these answers fastest"
+	}
+
+	// Device settings ride on the redirect, which is only there while
+	// blocking is on.
+	mac := in.mac
+	if !in.enabled {
+		mac = ""
+	}
+	route := in.split.route(mac, in.domain)
+	switch route.Via {
+	case routeDeviceRule, routeDeviceUpstream:
+		d.Answer, d.Rule = Answer{Action: "forwarded"}, nil
+		d.Upstream = UpstreamCheck{Route: route.Via, Rule: route.Entry, Servers: route.Servers}
+		if route.Via == routeDeviceRule {
+			d.Upstream.Reason = fmt.Sprintf("this device's rule for %s sends the lookup to these servers, past dnsmasq and the blocklist", route.Entry)
+		} else {
+			d.Upstream.Reason = "this device resolves through its own upstreams, past dnsmasq and the blocklist"
+			d.Policy = PolicyCheck{Policy: "off", Reason: "this device has upstreams of its own in /api/adblock/split-dns, so its lookups skip the blocklist"}
+		}
+	case routeGlobalRule:
+		// dnsmasq goes by the longest domain, as with the allowlist.
+		if d.Answer.Action == "blocked" && len(d.Rule.Entry) > len(route.Entry) {
+			break
+		}
+		if d.Answer.Action == "blocked" {
+			d.Answer, d.Rule = Answer{Action: "forwarded"}, nil
+		}
+		d.Upstream = UpstreamCheck{Route: route.Via, Rule: route.Entry, Servers: route.Servers,
+			Reason: fmt.Sprintf("the forwarding rule for %s sends the lookup to these servers", route.Entry)}
+	}
+
+	d.Bypass = checkBypass(in.client, in.conntrack)
+	d.Resolver = checkResolver(in.client, in.domain, in.queryLog)
+	return d
+}
+
+// checkBypass looks for the client's DNS (53) and DoT (853) flows to
+// anything but our gateway that the DNS redirect didn't catch. DoH on 443
+// looks like any HTTPS and can't be told apart here.
+func checkBypass(client string, conntrack []byte) BypassCheck {
+	if conntrack == nil {
+		return BypassCheck{Note: "conntrack is not available on this device"}
+	}
+	gateway := gatewayFor(client)
+	seen := map[string]bool{}
+	sc := bufio.NewScanner(bytes.NewReader(conntrack))
+	for sc.Scan() {
+		// udp 17 29 src=192.168.100.52 dst=8.8.8.8 sport=40000 dport=53 ...
+		// The first src=/dst= pair is the original direction, the second
+		// the reply. A flow the DNS redirect caught is answered by us.
+		var src, dst, replySrc string
+		for _, f := range strings.Fields(sc.Text()) {
+			if v, ok := strings.CutPrefix(f, "src="); ok {
+				if src == "" {
+					src = v
+				} else if replySrc == "" {
+					replySrc = v
+				}
+			} else if v, ok := strings.CutPrefix(f, "dst="); ok && dst == "" {
+				dst = v
+			}
+		}
+		if src == client && dst != "" && dst != gateway && replySrc != gateway {
+			seen[dst] = true
+		}
+	}
+	c := BypassCheck{Checked: true}
+	for dst := range seen {
+		c.Destinations = append(c.Destinations, dst)
+	}
+	sort.Strings(c.Destinations)
+	c.Observed = len(c.Destinations) > 0
+	if c.Observed {
+		c.Note = "the client is talking DNS to servers other than this router, so its lookups skip the blocklist"
+	} else {
+		c.Note = "no plain DNS or DoT to other servers right now; DNS over HTTPS cannot be detected"
+	}
+	return c
+}
+
+// checkResolver counts the client's queries in dnsmasq's log:
+//
+//	dnsmasq[812]: query[A] ads.example.com from 192.168.100.52
+func checkResolver(client, domain string, log []byte) ResolverCheck {
+	if log == nil {
+		return ResolverCheck{Note: "dnsmasq query log is not available"}
+	}
+	c := ResolverCheck{Checked: true}
+	suffix := " from " + client
+	sc := bufio.NewScanner(bytes.NewReader(log))
+	for sc.Scan() {
+		line := sc.Text()
+		i := strings.Index(line, "query[")
+		if i < 0 || !strings.HasSuffix(line, suffix) {
+			continue
+		}
+		c.QueriesSeen++
+		f := strings.Fields(line[i:])
+		if len(f) >= 2 && strings.EqualFold(f[1], domain) {
+			c.DomainSeen = true
+		}
+	}
+	switch {
+	case c.QueriesSeen == 0:
+		c.Note = "no queries from this client reached dnsmasq in the last 15 minutes"
+	case !c.DomainSeen:
+		c.Note = "the client uses this resolver but has not asked for this domain recently; it may be cached on the device"
+	default:
+		c.Note = "the client's queries for this domain reach this resolver"
+	}
+	return c
+}
+
+// gatewayFor is the router's address on the client's /24, which dnsmasq
+// hands out as the DNS server (dhcp-option=6,X.1).
+func gatewayFor(client string) string {
+	i := strings.LastIndex(client, ".")
+	if i < 0 {
+		return ""
+	}
+	return client[:i] + ".1"
+}
+
+// parseUpstreams returns the server= addresses in a dnsmasq config.
+func parseUpstreams(r io.Reader) []string {
+	var servers []string
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		if v, ok := strings.CutPrefix(strings.TrimSpace(sc.Text()), "server="); ok {
+			servers = append(servers, v)
+		}
+	}
+	return servers
+}
+
+// handleDiagnose reports how dnsmasq treats one client's lookup of one
+// domain. GET /api/adblock/diagnose?client=192.168.100.52&domain=ads.example.com
+func (s *AdBlock) handleDiagnose(w http.ResponseWriter, r *http.Request) {
+	client := r.URL.Query().Get("client")
+	if ip := net.ParseIP(client); ip == nil || ip.To4() == nil {
+		http.Error(w, "client must be an IPv4 address", http.StatusBadRequest)
+		return
+	}
+	domain := strings.ToLower(strings.TrimSuffix(r.URL.Query().Get("domain"), "."))
+	if _, ok := dns.IsDomainName(domain); !ok || domain == "" {
+		http.Error(w, "invalid domain", http.StatusBadRequest)
+		return
+	}
+
+	bl, err := readBlocklist(s.confPath)
+	if err != nil {
+		http.Error(w, "could not read blocklist: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	allow, err := readAllowlist(s.confPath)
+	if err != nil {
+		http.Error(w, "could not read allowlist: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.mu.RLock()
+	in := diagnoseInput{
+		client:    client,
+		domain:    domain,
+		enabled:   s.state.Enabled,
+		ttl:       s.state.BlockTTL,
+		blocklist: bl,
+		allowlist: allow,
+		custom:    s.lists.Block,
+		source:    s.blocklistSource(),
+		split:     s.split,
+	}
+	s.mu.RUnlock()
+	in.mac = s.macOf(client)
+
+	if f, err := os.Open(s.dnsmasqConf); err == nil {
+		in.upstreams = parseUpstreams(f)
+		f.Close()
+	}
+	in.conntrack = s.conntrackDNS(client)
+	if out, err := s.cmd.CombinedOutput("journalctl", "-u", "dnsmasq", "--since", diagnoseWindow,
+		"-o", "cat", "--no-pager"); err == nil {
+		in.queryLog = out
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	d := diagnose(in)
+	d.Device = in.mac
+	json.NewEncoder(w).Encode(d)
+}
+
+// conntrackDNS lists the client's tracked DNS and DoT flows, or nil if
+// conntrack can't be run.
+func (s *AdBlock) conntrackDNS(client string) []byte {
+	var all []byte
+	for _, p := range [][2]string{{"udp", "53"}, {"tcp", "53"}, {"tcp", "853"}} {
+		out, err := s.cmd.CombinedOutput("conntrack", "-L", "-p", p[0], "--orig-src", client, "--orig-port-dst", p[1])
+		if err != nil {
+			return nil
+		}
+		all = append(all, out...)
+	}
+	if all == nil {
+		all = []byte{}
+	}
+	return all
+}
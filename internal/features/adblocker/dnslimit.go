@@ -0,0 +1,276 @@
+package adblock
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/errs"
+	"github.com/strct-org/strct-agent/internal/platform/firewall"
+)
+
+// DNS load limits. A device stuck in a lookup loop can send thousands of
+// queries a second; dnsmasq then holds one upstream exchange per query
+// until it runs out of them and everyone's lookups time out. While ad
+// blocking is on:
+//
+//   - adblock.conf sets dns-forward-max to MaxInflight, the upstream
+//     exchanges dnsmasq keeps open at once. Past it dnsmasq stops
+//     forwarding, logs "Maximum number of concurrent DNS queries
+//     reached" and keeps answering from its cache and the blocklist, so
+//     a storm sheds load instead of queueing.
+//
+//   - a hashlimit rule drops UDP queries past ClientQPS a second (burst
+//     twice that) from any one client on the AP:
+//
+//     iptables -A STRCT_DNS_LIMIT -i wlan0 -p udp --dport 53 -m hashlimit --hashlimit-mode srcip
+//     --hashlimit-above 100/sec --hashlimit-burst 200 --hashlimit-name strct-dns -j DROP
+//
+// The watchdog keeps the rule in place and reads dnsmasq's warnings every
+// pass; each time the limit was hit is counted and logged, and for
+// overloadWarnFor after it /api/health warns. GET /api/adblock/status
+// reports the drops and the clients being throttled right now.
+const (
+	limitChain    = "STRCT_DNS_LIMIT"
+	hashlimitName = "strct-dns"
+
+	defaultMaxInflight = 256
+	maxMaxInflight     = 4096
+	defaultClientQPS   = 100
+	maxClientQPS       = 10000
+
+	overloadWarnFor = 10 * time.Minute
+)
+
+// dnsmasqOverloadMsg is what dnsmasq logs when dns-forward-max is reached.
+const dnsmasqOverloadMsg = "Maximum number of concurrent DNS queries reached"
+
+// hashlimitDir is where the kernel lists hashlimit buckets. A var so tests
+// can point it at a temp dir.
+var hashlimitDir = "/proc/net/ipt_hashlimit"
+
+// DNSLimits is the load-limit part of Status.
+type DNSLimits struct {
+	MaxInflight int `json:"max_inflight"`
+	ClientQPS   int `json:"client_qps"`
+
+	// RateDrops counts queries the per-client limit dropped since the rule
+	// was installed; Throttled are the clients over their limit now.
+	RateDrops uint64   `json:"rate_drops"`
+	Throttled []string `json:"throttled"`
+
+	// Overloads counts the watchdog passes that found dnsmasq at
+	// MaxInflight.
+	Overloads    int       `json:"overloads"`
+	LastOverload time.Time `json:"last_overload,omitempty"`
+}
+
+func (c AdBlockConfig) maxInflight() int {
+	if c.MaxInflight <= 0 {
+		return defaultMaxInflight
+	}
+	return c.MaxInflight
+}
+
+func (c AdBlockConfig) clientQPS() int {
+	if c.ClientQPS <= 0 {
+		return defaultClientQPS
+	}
+	return c.ClientQPS
+}
+
+func (c AdBlockConfig) validateLimits(v *errs.Validation) {
+	if c.MaxInflight < 0 || c.MaxInflight > maxMaxInflight {
+		v.Addf("max_inflight", errs.CodeOutOfRange, "max_inflight must be between 1 and %d (0 for the default %d)", maxMaxInflight, defaultMaxInflight)
+	}
+	if c.ClientQPS < 0 || c.ClientQPS > maxClientQPS {
+		v.Addf("client_qps", errs.CodeOutOfRange, "client_qps must be between 1 and %d (0 for the default %d)", maxClientQPS, defaultClientQPS)
+	}
+}
+
+func limitRule(apIface string, qps int) []string {
+	return []string{
+		"-i", apIface, "-p", "udp", "--dport", "53",
+		"-m", "hashlimit", "--hashlimit-mode", "srcip",
+		"--hashlimit-above", strconv.Itoa(qps) + "/sec", "--hashlimit-burst", strconv.Itoa(2 * qps),
+		"--hashlimit-name", hashlimitName, "-j", "DROP",
+	}
+}
+
+// syncRateLimit installs, moves or removes the per-client rule to match
+// apIface ("" for none) and the configured rate, and rebuilds it if
+// something flushed the filter table.
+func (s *AdBlock) syncRateLimit(apIface string) {
+	s.mu.RLock()
+	qps := s.state.clientQPS()
+	installed := s.limitInstalled
+	s.mu.RUnlock()
+
+	want := ""
+	if apIface != "" {
+		want = apIface + " " + strconv.Itoa(qps)
+	}
+	switch {
+	case want == "" && installed == "":
+		return
+	case want == "":
+		s.removeRateLimit()
+		return
+	case want == installed && firewall.RuleExists(s.cmd, "filter", "INPUT", "-j", limitChain) &&
+		firewall.RuleExists(s.cmd, "filter", limitChain, limitRule(apIface, qps)...):
+		return
+	}
+	if err := firewall.EnsureChain(s.cmd, "filter", limitChain, "INPUT"); err != nil {
+		slog.Error("adblock: could not install the dns rate limit", "err", err)
+		return
+	}
+	firewall.FlushChain(s.cmd, "filter", limitChain) //nolint:errcheck
+	if err := firewall.EnsureRule(s.cmd, "filter", limitChain, limitRule(apIface, qps)...); err != nil {
+		slog.Error("adblock: could not install the dns rate limit", "err", err)
+		return
+	}
+	s.mu.Lock()
+	s.limitInstalled = want
+	s.mu.Unlock()
+	slog.Info("adblock: dns rate limit installed", "iface", apIface, "client_qps", qps)
+}
+
+func (s *AdBlock) removeRateLimit() {
+	firewall.FlushChain(s.cmd, "filter", limitChain)                //nolint:errcheck
+	firewall.DeleteRule(s.cmd, "filter", "INPUT", "-j", limitChain) //nolint:errcheck
+	s.mu.Lock()
+	s.limitInstalled = ""
+	s.mu.Unlock()
+}
+
+// checkOverload reads dnsmasq's warnings since the last pass for the
+// forward limit being hit.
+func (s *AdBlock) checkOverload() {
+	now := s.now()
+	s.mu.Lock()
+	since := s.overloadCheckedAt
+	s.overloadCheckedAt = now
+	limit := s.state.maxInflight()
+	s.mu.Unlock()
+	if since.IsZero() {
+		since = now.Add(-watchdogInterval)
+	}
+
+	// Warnings only: with log-queries on, a storm's full log is huge.
+	out, err := s.cmd.CombinedOutput("journalctl", "-u", "dnsmasq", "-p", "warning",
+		"--since", "@"+strconv.FormatInt(since.Unix(), 10), "-o", "cat", "--no-pager")
+	if err != nil {
+		return
+	}
+	hits := bytes.Count(out, []byte(dnsmasqOverloadMsg))
+	if hits == 0 {
+		return
+	}
+	s.mu.Lock()
+	s.status.Limits.Overloads++
+	s.status.Limits.LastOverload = now
+	s.mu.Unlock()
+	slog.Warn("adblock: dnsmasq reached its limit of concurrent upstream queries and is shedding load",
+		"max_inflight", limit, "warnings", hits, "throttled", s.throttledClients())
+}
+
+// overloadWarning is the /api/health warning after dnsmasq hit its
+// forward limit, or "".
+func (s *AdBlock) overloadWarning() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	l := s.status.Limits
+	if l.LastOverload.IsZero() || s.now().Sub(l.LastOverload) > overloadWarnFor {
+		return ""
+	}
+	return fmt.Sprintf("adblock: dnsmasq hit its limit of %d concurrent upstream queries at %s and answered only from cache; "+
+		"a device may be flooding DNS, see throttled clients in /api/adblock/status",
+		s.state.maxInflight(), l.LastOverload.Format(time.Kitchen))
+}
+
+// limitStats fills in the configured limits, the drop counter and the
+// throttled clients.
+func (s *AdBlock) limitStats() DNSLimits {
+	s.mu.RLock()
+	l := s.status.Limits
+	l.MaxInflight = s.state.maxInflight()
+	l.ClientQPS = s.state.clientQPS()
+	installed := s.limitInstalled != ""
+	s.mu.RUnlock()
+
+	l.Throttled = []string{}
+	if !installed {
+		return l
+	}
+	if out, err := s.cmd.Output("iptables", "-t", "filter", "-L", limitChain, "-v", "-x", "-n"); err == nil {
+		l.RateDrops = parseDropCount(out)
+	}
+	l.Throttled = s.throttledClients()
+	return l
+}
+
+// parseDropCount sums the packet counters of the DROP rules in
+// `iptables -L CHAIN -v -x -n`:
+//
+//	pkts bytes target prot opt in    out source    destination
+//	  42  2730 DROP   udp  --  wlan0 *   0.0.0.0/0 0.0.0.0/0   udp dpt:53 limit: above 100/sec burst 200 mode srcip
+func parseDropCount(out []byte) uint64 {
+	var total uint64
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		f := strings.Fields(sc.Text())
+		if len(f) < 3 || f[2] != "DROP" {
+			continue
+		}
+		if n, err := strconv.ParseUint(f[0], 10, 64); err == nil {
+			total += n
+		}
+	}
+	return total
+}
+
+func (s *AdBlock) throttledClients() []string {
+	b, err := os.ReadFile(hashlimitDir + "/" + hashlimitName)
+	if err != nil {
+		return []string{}
+	}
+	return parseHashlimit(b)
+}
+
+// parseHashlimit lists the clients whose bucket is out of credit in a
+// /proc/net/ipt_hashlimit table, one line per source:
+//
+//	expires src:port->dst:port credit credit_cap cost
+//	9 192.168.100.52:0->0.0.0.0:0 0 6400000 32000
+//
+// A packet costs cost credits; a client with less than that is being
+// dropped.
+func parseHashlimit(b []byte) []string {
+	out := []string{}
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for sc.Scan() {
+		f := strings.Fields(sc.Text())
+		if len(f) < 5 {
+			continue
+		}
+		src, _, _ := strings.Cut(f[1], "->")
+		host, _, err := net.SplitHostPort(src)
+		if err != nil || net.ParseIP(host) == nil {
+			continue
+		}
+		credit, err1 := strconv.ParseUint(f[2], 10, 64)
+		cost, err2 := strconv.ParseUint(f[4], 10, 64)
+		if err1 == nil && err2 == nil && credit < cost {
+			out = append(out, host)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,801 @@
+package adblock
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/miekg/dns"
+	"gopkg.in/yaml.v3"
+)
+
+// Import from the resolver strct replaces. Someone moving off a Pi-hole or
+// AdGuard Home has years of allow/block decisions and local names in it;
+// these bring them over into Lists:
+//
+//	POST /api/adblock/import/pihole   multipart: archive (Teleporter .tar.gz
+//	                                  or .zip), custom.list, whitelist, blacklist
+//	POST /api/adblock/import/adguard  AdGuardHome.yaml, or its filtering section
+//
+// Every entry read comes back in the report with what happened to it:
+// imported, a duplicate of what is already listed, unsupported (regexes,
+// CNAMEs, per-client rules: nothing dnsmasq can express), invalid, or
+// skipped because it was disabled at the source. Rules in dnsmasq always
+// cover subdomains, so an exact Pi-hole entry comes over a little wider.
+//
+// The parsers are pure functions over the uploaded bytes; the handlers
+// only unpack the form and merge.
+const maxImportBytes = 64 << 20
+
+// Kinds of imported entries.
+const (
+	kindAllow  = "allow"
+	kindBlock  = "block"
+	kindRecord = "record"
+)
+
+// What happened to an imported entry.
+const (
+	resultImported    = "imported"
+	resultDuplicate   = "duplicate"
+	resultUnsupported = "unsupported"
+	resultInvalid     = "invalid"
+	resultSkipped     = "skipped"
+)
+
+// ImportEntry is one entry read from an import.
+type ImportEntry struct {
+	Source  string `json:"source"`            // file or section it came from
+	Entry   string `json:"entry"`             // as written there
+	Kind    string `json:"kind,omitempty"`    // allow|block|record
+	Domain  string `json:"domain,omitempty"`  // what it maps to
+	Address string `json:"address,omitempty"` // record only
+	Result  string `json:"result"`
+	Note    string `json:"note,omitempty"`
+}
+
+// ImportReport counts the entries by result and lists them in file order.
+type ImportReport struct {
+	Imported    int           `json:"imported"`
+	Duplicate   int           `json:"duplicate"`
+	Unsupported int           `json:"unsupported"`
+	Invalid     int           `json:"invalid"`
+	Skipped     int           `json:"skipped"`
+	Entries     []ImportEntry `json:"entries"`
+}
+
+func domainEntry(source, raw, kind, domain string) ImportEntry {
+	if d, ok := cleanDomain(domain); ok {
+		return ImportEntry{Source: source, Entry: raw, Kind: kind, Domain: d}
+	}
+	return rejected(source, raw, resultInvalid, "not a domain name")
+}
+
+func recordEntry(source, raw, name, addr string) ImportEntry {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return rejected(source, raw, resultInvalid, "not an IP address: "+addr)
+	}
+	if d, ok := cleanDomain(name); ok {
+		return ImportEntry{Source: source, Entry: raw, Kind: kindRecord, Domain: d, Address: ip.String()}
+	}
+	return rejected(source, raw, resultInvalid, "not a host name: "+name)
+}
+
+func rejected(source, raw, result, note string) ImportEntry {
+	return ImportEntry{Source: source, Entry: raw, Result: result, Note: note}
+}
+
+// cleanDomain lower-cases d and checks it is a plain host name: no
+// wildcards, no regex, nothing dnsmasq would read as syntax.
+func cleanDomain(d string) (string, bool) {
+	d = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(d)), ".")
+	if d == "" || strings.Trim(d, "abcdefghijklmnopqrstuvwxyz0123456789-_.") != "" {
+		return "", false
+	}
+	_, ok := dns.IsDomainName(d)
+	return d, ok
+}
+
+// ─── Pi-hole ─────────────────────────────────────────────────────────────────
+
+// Pi-hole domainlist types.
+const (
+	piholeExactAllow = 0
+	piholeExactBlock = 1
+	piholeRegexAllow = 2
+	piholeRegexBlock = 3
+)
+
+// piholeWildcard is the regex Pi-hole's "add as wildcard" writes, which
+// matches a domain and its subdomains the way a dnsmasq rule does.
+var piholeWildcard = regexp.MustCompile(`^\(\\\.\|\^\)((?:[a-z0-9_-]+\\\.)*[a-z0-9_-]+)\$$`)
+
+// piholeEntry maps one domainlist row.
+func piholeEntry(source, raw string, typ int, domain string, enabled bool) ImportEntry {
+	if !enabled {
+		return rejected(source, raw, resultSkipped, "disabled in Pi-hole")
+	}
+	switch typ {
+	case piholeExactAllow:
+		return domainEntry(source, raw, kindAllow, domain)
+	case piholeExactBlock:
+		return domainEntry(source, raw, kindBlock, domain)
+	case piholeRegexAllow, piholeRegexBlock:
+		kind := kindBlock
+		if typ == piholeRegexAllow {
+			kind = kindAllow
+		}
+		if m := piholeWildcard.FindStringSubmatch(strings.ToLower(domain)); m != nil {
+			e := domainEntry(source, raw, kind, strings.ReplaceAll(m[1], `\.`, "."))
+			if e.Result == "" {
+				e.Note = "wildcard, which a dnsmasq rule covers"
+			}
+			return e
+		}
+		return rejected(source, raw, resultUnsupported, "regex rules have no dnsmasq equivalent")
+	}
+	return rejected(source, raw, resultInvalid, fmt.Sprintf("unknown domainlist type %d", typ))
+}
+
+// parseTeleporter reads a Pi-hole Teleporter export: the .tar.gz of v5 or
+// the .zip of v6.
+func parseTeleporter(data []byte) ([]ImportEntry, error) {
+	var out []ImportEntry
+	add := func(name string, b []byte) error {
+		entries, err := parsePiholeFile(name, b)
+		out = append(out, entries...)
+		return err
+	}
+	switch {
+	case bytes.HasPrefix(data, []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("teleporter archive: %w", err)
+		}
+		tr := tar.NewReader(gz)
+		for {
+			h, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("teleporter archive: %w", err)
+			}
+			if h.Typeflag != tar.TypeReg || !piholeFileWanted(h.Name) {
+				continue
+			}
+			b, err := io.ReadAll(tr)
+			if err != nil {
+				return nil, fmt.Errorf("teleporter archive: %w", err)
+			}
+			if err := add(h.Name, b); err != nil {
+				return nil, err
+			}
+		}
+	case bytes.HasPrefix(data, []byte("PK")):
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return nil, fmt.Errorf("teleporter archive: %w", err)
+		}
+		for _, f := range zr.File {
+			if path.Base(f.Name) == "gravity.db" {
+				out = append(out, rejected(f.Name, "gravity.db", resultUnsupported,
+					"domain lists inside gravity.db can't be read here; export them with "+
+						`sqlite3 -header -csv gravity.db "SELECT * FROM domainlist" and upload that as whitelist`))
+				continue
+			}
+			if f.FileInfo().IsDir() || !piholeFileWanted(f.Name) {
+				continue
+			}
+			rc, err := f.Open()
+			if err != nil {
+				return nil, fmt.Errorf("teleporter archive: %w", err)
+			}
+			b, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				return nil, fmt.Errorf("teleporter archive: %s: %w", f.Name, err)
+			}
+			if err := add(f.Name, b); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, errors.New("teleporter archive: not a .tar.gz or .zip")
+	}
+	if len(out) == 0 {
+		return nil, errors.New("teleporter archive: no domain lists or local DNS records in it")
+	}
+	return out, nil
+}
+
+// piholeFiles are the Teleporter files parsePiholeFile reads, by base name.
+var piholeFiles = []string{
+	"whitelist.exact.json", "whitelist.regex.json", "blacklist.exact.json", "blacklist.regex.json",
+	"whitelist.json", "blacklist.json", "regex_whitelist.json", "regex_blacklist.json", // v5.0
+	"whitelist.txt", "blacklist.txt", "regex.list", // v4
+	"custom.list", "05-pihole-custom-cname.conf", "pihole.toml",
+}
+
+func piholeFileWanted(name string) bool {
+	return slices.Contains(piholeFiles, path.Base(name))
+}
+
+// parsePiholeFile reads one file of a Teleporter export.
+func parsePiholeFile(name string, data []byte) ([]ImportEntry, error) {
+	base := path.Base(name)
+	switch base {
+	case "custom.list":
+		return parseCustomList(base, data), nil
+	case "05-pihole-custom-cname.conf":
+		return parseCNAMEConf(base, data), nil
+	case "pihole.toml":
+		return parsePiholeTOML(base, data)
+	case "whitelist.txt":
+		return parsePiholeDomains(base, data, piholeExactAllow), nil
+	case "blacklist.txt":
+		return parsePiholeDomains(base, data, piholeExactBlock), nil
+	case "regex.list":
+		return parsePiholeDomains(base, data, piholeRegexBlock), nil
+	}
+	// The v5 JSON files: rows of the domainlist table. v5.0's carry no
+	// type, which the file name gives.
+	typ := piholeExactBlock
+	switch {
+	case strings.HasPrefix(base, "regex_whitelist"), base == "whitelist.regex.json":
+		typ = piholeRegexAllow
+	case strings.HasPrefix(base, "regex_blacklist"), base == "blacklist.regex.json":
+		typ = piholeRegexBlock
+	case strings.HasPrefix(base, "whitelist"):
+		typ = piholeExactAllow
+	}
+	var rows []struct {
+		Type    *int   `json:"type"`
+		Domain  string `json:"domain"`
+		Enabled *int   `json:"enabled"`
+	}
+	if err := json.Unmarshal(data, &rows); err != nil {
+		return nil, fmt.Errorf("%s: %w", base, err)
+	}
+	out := make([]ImportEntry, 0, len(rows))
+	for _, r := range rows {
+		t := typ
+		if r.Type != nil {
+			t = *r.Type
+		}
+		out = append(out, piholeEntry(base, r.Domain, t, r.Domain, r.Enabled == nil || *r.Enabled != 0))
+	}
+	return out, nil
+}
+
+// parsePiholeDomains reads a whitelist or blacklist upload: an SQL dump of
+// the domainlist table, a CSV export of it, or one domain per line. typ is
+// the list type for rows that don't carry one.
+//
+//	sqlite3 gravity.db ".dump domainlist"
+//	sqlite3 -header -csv gravity.db "SELECT * FROM domainlist"
+func parsePiholeDomains(source string, data []byte, typ int) []ImportEntry {
+	text := string(data)
+	first := ""
+	for line := range strings.Lines(text) {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			first = line
+			break
+		}
+	}
+	switch {
+	case strings.Contains(strings.ToUpper(text), "INSERT INTO"):
+		return parsePiholeSQL(source, text, typ)
+	case strings.Contains(first, ","):
+		return parsePiholeCSV(source, text, typ)
+	}
+	var out []ImportEntry
+	for line := range strings.Lines(text) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		out = append(out, piholeEntry(source, line, typ, line, true))
+	}
+	return out
+}
+
+// piholeColumns is the domainlist column order, for rows without a header.
+var piholeColumns = []string{"id", "type", "domain", "enabled"}
+
+// piholeRow maps one domainlist row given its column names.
+func piholeRow(source, raw string, cols, vals []string, typ int) ImportEntry {
+	get := func(name string) (string, bool) {
+		i := slices.Index(cols, name)
+		if i < 0 || i >= len(vals) {
+			return "", false
+		}
+		return vals[i], true
+	}
+	domain, ok := get("domain")
+	if !ok {
+		return rejected(source, raw, resultInvalid, "no domain column")
+	}
+	if v, ok := get("type"); ok {
+		t, err := strconv.Atoi(v)
+		if err != nil {
+			return rejected(source, raw, resultInvalid, "type is not a number: "+v)
+		}
+		typ = t
+	}
+	enabled := true
+	if v, ok := get("enabled"); ok {
+		enabled = v != "0"
+	}
+	return piholeEntry(source, domain, typ, domain, enabled)
+}
+
+func parsePiholeCSV(source, text string, typ int) []ImportEntry {
+	r := csv.NewReader(strings.NewReader(text))
+	r.FieldsPerRecord = -1
+	r.Comment = '#'
+	records, err := r.ReadAll()
+	if err != nil {
+		return []ImportEntry{rejected(source, "", resultInvalid, err.Error())}
+	}
+	cols := piholeColumns
+	if len(records) > 0 && slices.Contains(records[0], "domain") {
+		cols, records = records[0], records[1:]
+	}
+	out := make([]ImportEntry, 0, len(records))
+	for _, rec := range records {
+		out = append(out, piholeRow(source, strings.Join(rec, ","), cols, rec, typ))
+	}
+	return out
+}
+
+// parsePiholeSQL reads the INSERTs into domainlist from an SQL dump, one
+// statement per line as sqlite3 writes them. Other tables are ignored.
+func parsePiholeSQL(source, text string, typ int) []ImportEntry {
+	var out []ImportEntry
+	for line := range strings.Lines(text) {
+		line = strings.TrimSpace(line)
+		upper := strings.ToUpper(line)
+		if !strings.HasPrefix(upper, "INSERT INTO") {
+			continue
+		}
+		i := strings.Index(upper, "VALUES")
+		if i < 0 {
+			continue
+		}
+		target := strings.TrimSpace(line[len("INSERT INTO"):i])
+		table, colList, _ := strings.Cut(target, "(")
+		if strings.Trim(strings.TrimSpace(table), `"'`+"`[]") != "domainlist" {
+			continue
+		}
+		cols := piholeColumns
+		if colList != "" {
+			cols = nil
+			for _, c := range strings.Split(strings.TrimSuffix(strings.TrimSpace(colList), ")"), ",") {
+				cols = append(cols, strings.Trim(strings.TrimSpace(c), `"'`+"`[]"))
+			}
+		}
+		vals, ok := sqlValues(line[i+len("VALUES"):])
+		if !ok {
+			out = append(out, rejected(source, line, resultInvalid, "could not read the VALUES list"))
+			continue
+		}
+		out = append(out, piholeRow(source, line, cols, vals, typ))
+	}
+	return out
+}
+
+// sqlValues splits "(1,0,'a,b',NULL);" into its values, unquoting strings.
+func sqlValues(s string) ([]string, bool) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "(") {
+		return nil, false
+	}
+	var (
+		vals   []string
+		cur    strings.Builder
+		quoted bool
+	)
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quoted && c == '\'' && i+1 < len(s) && s[i+1] == '\'':
+			cur.WriteByte('\'')
+			i++
+		case c == '\'':
+			quoted = !quoted
+		case quoted:
+			cur.WriteByte(c)
+		case c == ',' || c == ')':
+			v := strings.TrimSpace(cur.String())
+			if strings.EqualFold(v, "NULL") {
+				v = ""
+			}
+			vals = append(vals, v)
+			cur.Reset()
+			if c == ')' {
+				return vals, true
+			}
+		default:
+			cur.WriteByte(c)
+		}
+	}
+	return nil, false
+}
+
+// parseCustomList reads Pi-hole's local DNS records, hosts-file style:
+// "192.168.1.10 nas.lan [alias ...]".
+func parseCustomList(source string, data []byte) []ImportEntry {
+	var out []ImportEntry
+	for line := range strings.Lines(string(data)) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		out = append(out, hostsEntries(source, line)...)
+	}
+	return out
+}
+
+// hostsEntries maps one "address name [name ...]" line to records.
+func hostsEntries(source, line string) []ImportEntry {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return []ImportEntry{rejected(source, line, resultInvalid, `want "address name"`)}
+	}
+	out := make([]ImportEntry, 0, len(fields)-1)
+	for _, name := range fields[1:] {
+		out = append(out, recordEntry(source, line, name, fields[0]))
+	}
+	return out
+}
+
+// parseCNAMEConf reports Pi-hole's local CNAME records, which have no
+// place in Lists.
+func parseCNAMEConf(source string, data []byte) []ImportEntry {
+	var out []ImportEntry
+	for line := range strings.Lines(string(data)) {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "cname=") {
+			out = append(out, rejected(source, line, resultUnsupported, "CNAME records are not supported"))
+		}
+	}
+	return out
+}
+
+// parsePiholeTOML reads the local DNS records from v6's pihole.toml. Its
+// domain lists live in gravity.db.
+func parsePiholeTOML(source string, data []byte) ([]ImportEntry, error) {
+	var conf struct {
+		DNS struct {
+			Hosts        []string `toml:"hosts"`
+			CNAMERecords []string `toml:"cnameRecords"`
+		} `toml:"dns"`
+	}
+	if _, err := toml.Decode(string(data), &conf); err != nil {
+		return nil, fmt.Errorf("%s: %w", source, err)
+	}
+	var out []ImportEntry
+	for _, h := range conf.DNS.Hosts {
+		out = append(out, hostsEntries(source, h)...)
+	}
+	for _, c := range conf.DNS.CNAMERecords {
+		out = append(out, rejected(source, c, resultUnsupported, "CNAME records are not supported"))
+	}
+	return out, nil
+}
+
+// ─── AdGuard Home ────────────────────────────────────────────────────────────
+
+type adguardRewrite struct {
+	Domain  string `yaml:"domain"`
+	Answer  string `yaml:"answer"`
+	Enabled *bool  `yaml:"enabled"` // absent before v0.107.54
+}
+
+// adguardConfig is the part of AdGuardHome.yaml with user decisions. The
+// rewrites moved from dns to filtering in v0.107; both are read, and so is
+// a filtering section pasted on its own.
+type adguardConfig struct {
+	UserRules []string         `yaml:"user_rules"`
+	Rewrites  []adguardRewrite `yaml:"rewrites"`
+	DNS       struct {
+		Rewrites []adguardRewrite `yaml:"rewrites"`
+	} `yaml:"dns"`
+	Filtering struct {
+		UserRules []string         `yaml:"user_rules"`
+		Rewrites  []adguardRewrite `yaml:"rewrites"`
+	} `yaml:"filtering"`
+}
+
+// parseAdGuardYAML reads the user rules and DNS rewrites from an
+// AdGuardHome.yaml.
+func parseAdGuardYAML(data []byte) ([]ImportEntry, error) {
+	var conf adguardConfig
+	if err := yaml.Unmarshal(data, &conf); err != nil {
+		return nil, fmt.Errorf("AdGuard Home config: %w", err)
+	}
+	var out []ImportEntry
+	for _, sec := range []struct {
+		source string
+		rules  []string
+	}{{"user_rules", conf.UserRules}, {"filtering.user_rules", conf.Filtering.UserRules}} {
+		for _, rule := range sec.rules {
+			out = append(out, parseAdGuardRule(sec.source, rule)...)
+		}
+	}
+	for _, sec := range []struct {
+		source   string
+		rewrites []adguardRewrite
+	}{{"rewrites", conf.Rewrites}, {"dns.rewrites", conf.DNS.Rewrites}, {"filtering.rewrites", conf.Filtering.Rewrites}} {
+		for _, rw := range sec.rewrites {
+			out = append(out, adguardRewriteEntry(sec.source, rw))
+		}
+	}
+	if len(out) == 0 {
+		return nil, errors.New("AdGuard Home config: no user_rules or rewrites in it")
+	}
+	return out, nil
+}
+
+// adguardBlockIPs are the hosts-style answers that mean "blocked".
+var adguardBlockIPs = []string{"0.0.0.0", "127.0.0.1", "::", "::1"}
+
+// parseAdGuardRule maps one user rule. Only the forms a dnsmasq domain
+// rule can express come over: ||domain^, a bare domain, @@ for an
+// exception, $important, and hosts-file lines.
+func parseAdGuardRule(source, rule string) []ImportEntry {
+	line := strings.TrimSpace(rule)
+	if line == "" || strings.HasPrefix(line, "!") || strings.HasPrefix(line, "#") {
+		return nil // comment
+	}
+	if len(line) > 1 && strings.HasPrefix(line, "/") && strings.HasSuffix(line, "/") {
+		return []ImportEntry{rejected(source, rule, resultUnsupported, "regex rules have no dnsmasq equivalent")}
+	}
+	if fields := strings.Fields(line); len(fields) >= 2 && net.ParseIP(fields[0]) != nil {
+		if !slices.Contains(adguardBlockIPs, fields[0]) {
+			return hostsEntries(source, line)
+		}
+		out := make([]ImportEntry, 0, len(fields)-1)
+		for _, name := range fields[1:] {
+			out = append(out, domainEntry(source, rule, kindBlock, name))
+		}
+		return out
+	}
+
+	kind := kindBlock
+	if rest, ok := strings.CutPrefix(line, "@@"); ok {
+		kind, line = kindAllow, rest
+	}
+	if pattern, mods, ok := strings.Cut(line, "$"); ok {
+		for _, mod := range strings.Split(mods, ",") {
+			if mod != "important" {
+				return []ImportEntry{rejected(source, rule, resultUnsupported,
+					"the $"+strings.SplitN(mod, "=", 2)[0]+" modifier has no dnsmasq equivalent")}
+			}
+		}
+		line = pattern
+	}
+	if d, ok := strings.CutPrefix(line, "||"); ok {
+		line = strings.TrimSuffix(d, "^")
+	}
+	if strings.Contains(line, "*") {
+		return []ImportEntry{rejected(source, rule, resultUnsupported, "wildcard rules have no dnsmasq equivalent")}
+	}
+	if strings.ContainsAny(line, "|^/") {
+		return []ImportEntry{rejected(source, rule, resultUnsupported, "only ||domain^ rules have a dnsmasq equivalent")}
+	}
+	return []ImportEntry{domainEntry(source, rule, kind, line)}
+}
+
+// adguardRewriteEntry maps a DNS rewrite: one to an address is a local
+// record, anything else (a CNAME, keeping the upstream answer, a
+// wildcard) is not supported.
+func adguardRewriteEntry(source string, rw adguardRewrite) ImportEntry {
+	raw := rw.Domain + " → " + rw.Answer
+	switch {
+	case rw.Enabled != nil && !*rw.Enabled:
+		return rejected(source, raw, resultSkipped, "disabled in AdGuard Home")
+	case strings.Contains(rw.Domain, "*"):
+		return rejected(source, raw, resultUnsupported, "wildcard rewrites are not supported")
+	case net.ParseIP(rw.Answer) == nil:
+		return rejected(source, raw, resultUnsupported, "only rewrites to an IP address are supported")
+	}
+	return recordEntry(source, raw, rw.Domain, rw.Answer)
+}
+
+// ─── Merge ───────────────────────────────────────────────────────────────────
+
+// importEntries adds the entries the parsers accepted to s.lists, marks
+// each imported or duplicate, and applies the result.
+func (s *AdBlock) importEntries(entries []ImportEntry) (ImportReport, error) {
+	s.mu.Lock()
+	l := Lists{
+		Allow:   slices.Clone(s.lists.Allow),
+		Block:   slices.Clone(s.lists.Block),
+		Records: slices.Clone(s.lists.Records),
+	}
+	for i := range entries {
+		e := &entries[i]
+		if e.Result != "" {
+			continue
+		}
+		var dup bool
+		switch e.Kind {
+		case kindAllow:
+			if dup = slices.Contains(l.Allow, e.Domain); !dup {
+				l.Allow = append(l.Allow, e.Domain)
+			}
+		case kindBlock:
+			if dup = slices.Contains(l.Block, e.Domain); !dup {
+				l.Block = append(l.Block, e.Domain)
+			}
+		case kindRecord:
+			rec := LocalRecord{Name: e.Domain, Address: e.Address}
+			if dup = slices.Contains(l.Records, rec); !dup {
+				l.Records = append(l.Records, rec)
+			}
+		}
+		e.Result = resultImported
+		if dup {
+			e.Result = resultDuplicate
+		}
+	}
+	s.lists = l
+	s.mu.Unlock()
+
+	report := ImportReport{Entries: entries}
+	for _, e := range entries {
+		switch e.Result {
+		case resultImported:
+			report.Imported++
+		case resultDuplicate:
+			report.Duplicate++
+		case resultUnsupported:
+			report.Unsupported++
+		case resultInvalid:
+			report.Invalid++
+		case resultSkipped:
+			report.Skipped++
+		}
+	}
+	if report.Imported == 0 {
+		return report, nil
+	}
+	if err := s.saveLists(); err != nil {
+		return report, err
+	}
+	if err := s.applyLists(); err != nil {
+		return report, err
+	}
+	slog.Info("adblock: lists imported", "imported", report.Imported,
+		"duplicate", report.Duplicate, "unsupported", report.Unsupported)
+	return report, nil
+}
+
+// ─── Handlers ────────────────────────────────────────────────────────────────
+
+// piholeUploads are the form fields handleImportPihole reads.
+var piholeUploads = []string{"archive", "custom.list", "whitelist", "blacklist"}
+
+// handleImportPihole imports a Teleporter archive or loose Pi-hole files.
+// POST /api/adblock/import/pihole  multipart fields: see piholeUploads
+func (s *AdBlock) handleImportPihole(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportBytes)
+	if err := r.ParseMultipartForm(8 << 20); err != nil {
+		http.Error(w, "expected a multipart upload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.MultipartForm.RemoveAll() //nolint:errcheck
+
+	var entries []ImportEntry
+	found := false
+	for _, field := range piholeUploads {
+		data, ok, err := formFile(r, field)
+		if err != nil {
+			http.Error(w, field+": "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !ok {
+			continue
+		}
+		found = true
+		switch field {
+		case "archive":
+			got, err := parseTeleporter(data)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			entries = append(entries, got...)
+		case "custom.list":
+			entries = append(entries, parseCustomList(field, data)...)
+		case "whitelist":
+			entries = append(entries, parsePiholeDomains(field, data, piholeExactAllow)...)
+		case "blacklist":
+			entries = append(entries, parsePiholeDomains(field, data, piholeExactBlock)...)
+		}
+	}
+	if !found {
+		http.Error(w, "upload one of: "+strings.Join(piholeUploads, ", "), http.StatusBadRequest)
+		return
+	}
+	s.writeImport(w, entries)
+}
+
+// handleImportAdGuard imports the user rules and rewrites of an
+// AdGuardHome.yaml, sent as the body or as the multipart field "config".
+// POST /api/adblock/import/adguard
+func (s *AdBlock) handleImportAdGuard(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportBytes)
+	var (
+		data []byte
+		err  error
+	)
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+		var ok bool
+		if err = r.ParseMultipartForm(8 << 20); err == nil {
+			defer r.MultipartForm.RemoveAll() //nolint:errcheck
+			if data, ok, err = formFile(r, "config"); err == nil && !ok {
+				err = errors.New(`no "config" field`)
+			}
+		}
+	} else {
+		data, err = io.ReadAll(r.Body)
+	}
+	if err != nil {
+		http.Error(w, "could not read the upload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	entries, err := parseAdGuardYAML(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.writeImport(w, entries)
+}
+
+// formFile reads the multipart file field, reporting false if absent.
+func formFile(r *http.Request, field string) ([]byte, bool, error) {
+	f, _, err := r.FormFile(field)
+	if errors.Is(err, http.ErrMissingFile) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	return data, err == nil, err
+}
+
+func (s *AdBlock) writeImport(w http.ResponseWriter, entries []ImportEntry) {
+	if len(entries) == 0 {
+		http.Error(w, "nothing to import in the upload", http.StatusBadRequest)
+		return
+	}
+	report, err := s.importEntries(entries)
+	if err != nil {
+		slog.Error("adblock: import: " + err.Error())
+		http.Error(w, "import failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
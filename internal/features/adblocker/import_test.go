@@ -0,0 +1,309 @@
+package adblock
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func fixture(t *testing.T, name string) []byte {
+	t.Helper()
+	b, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// summarize lists entries as "result kind domain[=address]".
+func summarize(entries []ImportEntry) []string {
+	var out []string
+	for _, e := range entries {
+		s := e.Result
+		if s == "" {
+			s = "ok"
+		}
+		if e.Kind != "" {
+			s += " " + e.Kind + " " + e.Domain
+		} else {
+			s += " " + e.Entry
+		}
+		if e.Address != "" {
+			s += "=" + e.Address
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+// teleporterV5 packs the testdata/pihole files the way Pi-hole v5's
+// Teleporter does.
+func teleporterV5(t *testing.T, names ...string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, name := range names {
+		b := fixture(t, "pihole/"+name)
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(b)), Typeflag: tar.TypeReg})
+		tw.Write(b)
+	}
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+func TestParseTeleporter_V5(t *testing.T) {
+	archive := teleporterV5(t, "whitelist.exact.json", "whitelist.regex.json", "blacklist.exact.json",
+		"blacklist.regex.json", "custom.list", "05-pihole-custom-cname.conf", "adlist.json")
+	entries, err := parseTeleporter(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"ok allow s.youtube.com",
+		"ok allow login.live.com",
+		"skipped old.example.com",
+		"ok block telemetry.tv.example",
+		"ok block tiktok.com", // Pi-hole's wildcard form
+		`unsupported ^ad[0-9]+\.example\.net$`,
+		"ok record nas.lan=192.168.1.10",
+		"ok record printer.lan=192.168.1.11",
+		"ok record printer=192.168.1.11",
+		"ok record nas6.lan=fd00::10",
+		"invalid not-an-ip broken.lan",
+		"unsupported cname=plex.lan,nas.lan",
+	}
+	if got := summarize(entries); !reflect.DeepEqual(got, want) {
+		t.Errorf("entries:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestParseTeleporter_V6(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, body := range map[string][]byte{
+		"etc/pihole/pihole.toml": fixture(t, "pihole/pihole.toml"),
+		"etc/pihole/gravity.db":  []byte("SQLite format 3\x00"),
+		"etc/hosts":              []byte("127.0.0.1 localhost\n"),
+	} {
+		w, _ := zw.Create(name)
+		w.Write(body)
+	}
+	zw.Close()
+
+	entries, err := parseTeleporter(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Join(summarize(entries), "\n")
+	for _, want := range []string{
+		"ok record nas.lan=192.168.1.10",
+		"ok record tv.lan=192.168.1.20",
+		"unsupported plex.lan,nas.lan",
+		"unsupported gravity.db",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("entries missing %q:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "localhost") {
+		t.Errorf("read etc/hosts:\n%s", got)
+	}
+
+	if _, err := parseTeleporter([]byte("not an archive")); err == nil {
+		t.Error("garbage parsed as an archive")
+	}
+}
+
+// TestParsePiholeDomains reads the same domainlist as an SQL dump and as
+// a CSV export.
+func TestParsePiholeDomains(t *testing.T) {
+	want := []string{
+		"ok allow s.youtube.com",
+		"ok block telemetry.tv.example",
+		"ok block tiktok.com",
+		"skipped old.example.com",
+	}
+	for _, name := range []string{"domainlist.sql", "domainlist.csv"} {
+		got := summarize(parsePiholeDomains("whitelist", fixture(t, "pihole/"+name), piholeExactAllow))
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s:\n%s", name, strings.Join(got, "\n"))
+		}
+	}
+
+	// One domain per line takes the field's list type.
+	got := summarize(parsePiholeDomains("blacklist", []byte("# v4 blacklist.txt\nads.example.com\nbad domain\n"), piholeExactBlock))
+	if !reflect.DeepEqual(got, []string{"ok block ads.example.com", "invalid bad domain"}) {
+		t.Errorf("plain list = %v", got)
+	}
+}
+
+func TestParseAdGuardYAML(t *testing.T) {
+	entries, err := parseAdGuardYAML(fixture(t, "adguard/AdGuardHome.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"ok allow bank.example",
+		"ok block telemetry.tv.example",
+		"ok block ads.example.org",
+		"ok block tracker.example",
+		"ok record printer.lan=192.168.1.11",
+		`unsupported /^ad[0-9]+\./`,
+		"unsupported ||*.doubleclick.net^",
+		"unsupported ||cdn.example^$client=192.168.1.5",
+		"ok record nas.lan=192.168.1.10",
+		"unsupported *.lan → 192.168.1.1",
+		"unsupported plex.lan → nas.lan",
+		"skipped old.lan → 192.168.1.99",
+	}
+	if got := summarize(entries); !reflect.DeepEqual(got, want) {
+		t.Errorf("entries:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// The filtering section on its own.
+	entries, err = parseAdGuardYAML([]byte("rewrites:\n  - domain: nas.lan\n    answer: 192.168.1.10\n"))
+	if err != nil || len(entries) != 1 || entries[0].Kind != kindRecord {
+		t.Errorf("filtering section: %v, %v", summarize(entries), err)
+	}
+	if _, err := parseAdGuardYAML([]byte("http:\n  address: 0.0.0.0:3000\n")); err == nil {
+		t.Error("a config without rules imported")
+	}
+}
+
+func importPihole(t *testing.T, mux http.Handler, files map[string][]byte) (int, ImportReport) {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for field, b := range files {
+		fw, _ := mw.CreateFormFile(field, field)
+		fw.Write(b)
+	}
+	mw.Close()
+	req := httptest.NewRequest("POST", "/api/adblock/import/pihole", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	var report ImportReport
+	if w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+			t.Fatalf("decode %s: %v", w.Body, err)
+		}
+	}
+	return w.Code, report
+}
+
+// TestImport_MergesAndApplies imports into a running blocker: the lists
+// are saved, adblock.conf is rebuilt around them, the records go to their
+// own file, and a second import reports duplicates.
+func TestImport_MergesAndApplies(t *testing.T) {
+	s, m := newSnapshotAdBlock(t)
+	sw, err := createSnapshot(s.snapshotPath(), snapshotInfo{Source: blocklistURL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sw.add("s.youtube.com") // on the blocklist, allowed by the import
+	sw.add("doubleclick.net")
+	sw.add("telemetry.tv.example") // on the blocklist and the import
+	if err := sw.commit(); err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	s.RegisterRoutes(mux)
+
+	files := map[string][]byte{
+		"whitelist":   fixture(t, "pihole/domainlist.sql"),
+		"custom.list": fixture(t, "pihole/custom.list"),
+	}
+	code, report := importPihole(t, mux, files)
+	if code != http.StatusOK {
+		t.Fatalf("import: %d", code)
+	}
+	if report.Imported != 7 || report.Skipped != 1 || report.Invalid != 1 || report.Duplicate != 0 {
+		t.Errorf("report = %+v", summarize(report.Entries))
+	}
+	m.AssertCalled(t, "systemctl kill -s HUP dnsmasq")
+
+	conf := readFile(t, s.confPath)
+	for _, want := range []string{
+		"server=/s.youtube.com/#\n",
+		"address=/tiktok.com/0.0.0.0\n",
+		"address=/doubleclick.net/0.0.0.0\n",
+	} {
+		if !strings.Contains(conf, want) {
+			t.Errorf("adblock.conf missing %q:\n%s", want, conf)
+		}
+	}
+	if strings.Contains(conf, "address=/s.youtube.com/") || strings.Count(conf, "address=/telemetry.tv.example/") != 1 {
+		t.Errorf("allowed or repeated domains in adblock.conf:\n%s", conf)
+	}
+	if s.status.EntryCount != 3 {
+		t.Errorf("entry count = %d, want 3", s.status.EntryCount)
+	}
+	records := readFile(t, s.recordsPath)
+	if !strings.Contains(records, "host-record=printer,192.168.1.11\n") || !strings.Contains(records, "host-record=nas6.lan,fd00::10\n") {
+		t.Errorf("local-records.conf:\n%s", records)
+	}
+
+	// Saved for the next start.
+	fresh := New(s.cfg, m)
+	if err := fresh.loadLists(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(fresh.lists, s.lists) {
+		t.Errorf("reloaded lists = %+v, want %+v", fresh.lists, s.lists)
+	}
+
+	code, report = importPihole(t, mux, files)
+	if code != http.StatusOK || report.Imported != 0 || report.Duplicate != 7 {
+		t.Errorf("second import: %d %+v", code, summarize(report.Entries))
+	}
+
+	if code, _ := importPihole(t, mux, map[string][]byte{"notes": []byte("x")}); code != http.StatusBadRequest {
+		t.Errorf("no known field: %d, want 400", code)
+	}
+}
+
+func TestImport_AdGuardBody(t *testing.T) {
+	s, _ := newSnapshotAdBlock(t)
+	s.state.Enabled = false // the lists wait; the records apply
+	mux := http.NewServeMux()
+	s.RegisterRoutes(mux)
+
+	req := httptest.NewRequest("POST", "/api/adblock/import/adguard", bytes.NewReader(fixture(t, "adguard/AdGuardHome.yaml")))
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("import: %d %s", w.Code, w.Body)
+	}
+	var report ImportReport
+	json.Unmarshal(w.Body.Bytes(), &report)
+	if report.Imported != 6 || report.Unsupported != 5 || report.Skipped != 1 {
+		t.Errorf("report = %+v", summarize(report.Entries))
+	}
+	if _, err := os.Stat(s.confPath); !os.IsNotExist(err) {
+		t.Errorf("adblock.conf written with blocking off: %v", err)
+	}
+	if records := readFile(t, s.recordsPath); !strings.Contains(records, "host-record=nas.lan,192.168.1.10\n") {
+		t.Errorf("local-records.conf:\n%s", records)
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/api/adblock/lists", nil))
+	var lists Lists
+	json.Unmarshal(w.Body.Bytes(), &lists)
+	if !reflect.DeepEqual(lists.Allow, []string{"bank.example"}) || len(lists.Block) != 3 || len(lists.Records) != 2 {
+		t.Errorf("GET lists = %+v", lists)
+	}
+}
@@ -0,0 +1,221 @@
+package adblock
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/strct-org/strct-agent/internal/statefile"
+)
+
+// localRecordsPath holds the host-record= lines for local names. It is a
+// file of its own so the records resolve with ad blocking off.
+const localRecordsPath = "/etc/dnsmasq.d/local-records.conf"
+
+// Lists are the user's own decisions on top of the downloaded blocklist,
+// kept in DataDir/adblock-lists.json:
+//
+//   - Allow: never blocked, with their subdomains. dnsmasq gets a
+//     server=/domain/# line, which forwards the name as usual even when a
+//     listed parent is blocked.
+//   - Block: blocked as if they were on the blocklist.
+//   - Records: local names dnsmasq answers itself, such as a NAS.
+//
+// For now they are filled by an import from the resolver strct replaces
+// (import.go).
+type Lists struct {
+	Allow   []string      `json:"allow"`
+	Block   []string      `json:"block"`
+	Records []LocalRecord `json:"records"`
+}
+
+// LocalRecord is a name dnsmasq answers with Address.
+type LocalRecord struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+}
+
+// listsSchema versions adblock-lists.json.
+//
+//	v1: Lists as-is
+var listsSchema = statefile.Schema{
+	Name:       "adblock-lists",
+	Migrations: []statefile.Migration{statefile.Stamp},
+}
+
+func (s *AdBlock) listsPath() string {
+	return filepath.Join(s.cfg.DataDir, "adblock-lists.json")
+}
+
+// loadLists restores the persisted lists into s.lists.
+func (s *AdBlock) loadLists() error {
+	var l Lists
+	if err := statefile.Load(s.listsPath(), listsSchema, &l); err != nil {
+		if statefile.Fresh(err) {
+			return nil
+		}
+		return fmt.Errorf("load adblock lists: %w", err)
+	}
+	s.mu.Lock()
+	s.lists = l
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *AdBlock) saveLists() error {
+	s.mu.RLock()
+	l := s.lists
+	s.mu.RUnlock()
+	if err := statefile.Save(s.listsPath(), listsSchema, l); err != nil {
+		return fmt.Errorf("save adblock lists: %w", err)
+	}
+	return nil
+}
+
+// currentLists returns a copy of s.lists that is safe to use unlocked.
+func (s *AdBlock) currentLists() Lists {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return Lists{
+		Allow:   slices.Clone(s.lists.Allow),
+		Block:   slices.Clone(s.lists.Block),
+		Records: slices.Clone(s.lists.Records),
+	}
+}
+
+// allowLine is the dnsmasq directive that exempts domain and its
+// subdomains from any address= on a parent.
+func allowLine(domain string) string {
+	return "server=/" + domain + "/#"
+}
+
+func parseAllowLine(line string) (domain string, ok bool) {
+	rest, ok := strings.CutPrefix(line, "server=/")
+	if !ok {
+		return "", false
+	}
+	domain, ok = strings.CutSuffix(rest, "/#")
+	if !ok || domain == "" || strings.Contains(domain, "/") {
+		return "", false
+	}
+	return strings.ToLower(domain), true
+}
+
+// renderRecords writes local-records.conf for records.
+func renderRecords(records []LocalRecord) []byte {
+	var b strings.Builder
+	b.WriteString("# Local DNS records — generated by strct-agent\n")
+	for _, r := range records {
+		fmt.Fprintf(&b, "host-record=%s,%s\n", r.Name, r.Address)
+	}
+	return []byte(b.String())
+}
+
+// writeRecords puts the local records in place and reports whether the
+// file changed. No records removes it.
+func (s *AdBlock) writeRecords() (bool, error) {
+	var conf []byte
+	if records := s.currentLists().Records; len(records) > 0 {
+		conf = renderRecords(records)
+	}
+	return writeDropIn(s.recordsPath, conf)
+}
+
+// writeDropIn replaces the dnsmasq drop-in at path with conf, or removes
+// it for nil, and reports whether anything changed.
+func writeDropIn(path string, conf []byte) (bool, error) {
+	old, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false, err
+	}
+	if conf == nil {
+		if old == nil {
+			return false, nil
+		}
+		return true, os.Remove(path)
+	}
+	if string(old) == string(conf) {
+		return false, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return false, err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, conf, 0644); err != nil {
+		return false, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp) //nolint:errcheck
+		return false, err
+	}
+	return true, nil
+}
+
+// applyLists brings dnsmasq in line with s.lists: the records file, and
+// adblock.conf when blocking is on.
+func (s *AdBlock) applyLists() error {
+	changed, err := s.writeRecords()
+	if err != nil {
+		return fmt.Errorf("write %s: %w", filepath.Base(s.recordsPath), err)
+	}
+	s.mu.RLock()
+	enabled := s.state.Enabled
+	s.mu.RUnlock()
+	if enabled {
+		return s.rebuildConf() // reloads dnsmasq
+	}
+	if changed {
+		s.reloadDNSMasq()
+	}
+	return nil
+}
+
+// rebuildConf rewrites adblock.conf from the snapshot with the current
+// settings and lists, or downloads the list when there is no snapshot.
+func (s *AdBlock) rebuildConf() error {
+	err := s.restoreBlocklist()
+	if errors.Is(err, os.ErrNotExist) {
+		go s.update() //nolint:errcheck // a skipped cycle is logged by the gate
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("rebuild adblock.conf: %w", err)
+	}
+	return nil
+}
+
+// restoreRecords rewrites local-records.conf on start, in case an OS
+// update replaced /etc/dnsmasq.d.
+func (s *AdBlock) restoreRecords() {
+	changed, err := s.writeRecords()
+	if err != nil {
+		slog.Error("adblock: could not write local records", "err", err)
+		return
+	}
+	if changed {
+		s.reloadDNSMasq()
+	}
+}
+
+// handleGetLists returns the allowlist, custom block rules and local
+// records.
+func (s *AdBlock) handleGetLists(w http.ResponseWriter, r *http.Request) {
+	l := s.currentLists()
+	if l.Allow == nil {
+		l.Allow = []string{}
+	}
+	if l.Block == nil {
+		l.Block = []string{}
+	}
+	if l.Records == nil {
+		l.Records = []LocalRecord{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(l)
+}
@@ -0,0 +1,35 @@
+package adblock
+
+import (
+	"github.com/strct-org/strct-agent/internal/capabilities"
+	"github.com/strct-org/strct-agent/internal/metrics"
+	"github.com/strct-org/strct-agent/internal/telemetry"
+)
+
+// RegisterMetrics exports the blocklist's size and whether blocking is on.
+func (s *AdBlock) RegisterMetrics(g metrics.Gauges) {
+	g.GaugeFunc("strct_adblock_entries", "Domains on the blocklist in use.", func() float64 {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		return float64(s.status.EntryCount)
+	})
+	g.GaugeFunc("strct_adblock_enabled", "1 while ad blocking is on.", func() float64 {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		return metrics.Bool(s.state.Enabled)
+	})
+}
+
+// TelemetryFeature reports whether blocking is on, for usage statistics.
+func (s *AdBlock) TelemetryFeature() (string, telemetry.Feature) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return "adblock", telemetry.Feature{Enabled: s.state.Enabled}
+}
+
+// EnabledCapabilities reports whether blocking is on.
+func (s *AdBlock) EnabledCapabilities() map[string]bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return map[string]bool{capabilities.Adblock: s.state.Enabled}
+}
@@ -0,0 +1,72 @@
+package adblock
+
+import (
+	"io"
+
+	"github.com/strct-org/strct-agent/internal/operations"
+)
+
+// Blocklist update progress. Each update is an operation, so the portal
+// can follow one on GET /api/operations/{id} or the operation.updated
+// events, and stop a stuck download with its cancel route. The phases:
+//
+//   - downloading: bytes of the Content-Length, when the server sends
+//     one, and the domains parsed so far; the hosts file is parsed as
+//     it streams in, so there is no separate parsing phase
+//   - writing: adblock.conf swapped in and the snapshot saved
+//   - reloading: dnsmasq told to read the new list
+//
+// POST /api/adblock/update answers with the operation's ID, and with the
+// running one's and 409 while an update is already going.
+const (
+	phaseDownloading = "downloading"
+	phaseWriting     = "writing"
+	phaseReloading   = "reloading"
+)
+
+// UseTracker records blocklist updates in t, with dnsmasq's journal and
+// the failed command when one fails.
+func (s *AdBlock) UseTracker(t *operations.Tracker) {
+	s.ops = t
+	s.cmd = t.Watch(s.cmd)
+}
+
+// claimUpdate marks a blocklist update as running and begins its
+// operation. With one already running it returns that one's operation
+// and false.
+func (s *AdBlock) claimUpdate() (*operations.Op, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.status.Updating {
+		return s.updateOp, false
+	}
+	s.status.Updating = true
+	s.updateOp = s.ops.Begin("adblock", "update")
+	return s.updateOp, true
+}
+
+// finishUpdate ends the update claimUpdate began.
+func (s *AdBlock) finishUpdate(op *operations.Op, err error) {
+	s.mu.Lock()
+	s.status.Updating = false
+	s.updateOp = nil
+	s.mu.Unlock()
+	op.Finish(err, s.confPath)
+}
+
+// progressReader reports what is read through it as the downloading
+// phase of op, with the domains counted so far.
+type progressReader struct {
+	r       io.Reader
+	op      *operations.Op
+	total   int64 // 0: unknown
+	read    int64
+	domains *int
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.read += int64(n)
+	p.op.Progress(operations.Progress{Phase: phaseDownloading, Bytes: p.read, Total: p.total, Items: *p.domains})
+	return n, err
+}
@@ -0,0 +1,250 @@
+package adblock
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/features/wifi"
+	"github.com/strct-org/strct-agent/internal/platform/firewall"
+)
+
+// DNS redirect. While ad blocking is on, every port-53 packet a client on
+// the AP sends goes to our dnsmasq, whatever resolver the device was
+// configured with; otherwise a hardcoded 8.8.8.8 skips the blocklist.
+//
+//	iptables -t nat -I PREROUTING 1 -j STRCT_DNS
+//	iptables -t nat -A STRCT_DNS -i wlan0 -p udp --dport 53 -j REDIRECT --to-ports 53
+//	iptables -t nat -A STRCT_DNS -i wlan0 -p tcp --dport 53 -j REDIRECT --to-ports 53
+//
+// Devices with split DNS settings get the same two rules, ahead of these,
+// pointing at the forwarder instead (splitdns.go).
+//
+// Anything that flushes the nat table (an admin's `iptables -t nat -F`, a
+// VPN client's setup script) takes these with it, and blocking silently
+// stops. The watchdog re-checks them every minute and after every wifi
+// apply, puts back what is missing and counts each repair.
+const redirectChain = "STRCT_DNS"
+
+const (
+	watchdogInterval = 60 * time.Second
+
+	// Repairs within lossWindow that make /api/health warn. One loss can
+	// be a one-off; several mean something keeps flushing the table.
+	lossWarnCount = 3
+	lossWindow    = time.Hour
+)
+
+// Causes recorded for a lost redirect.
+const (
+	lossAfterWiFiApply = "wifi apply"
+	lossUnknown        = "outside the agent"
+)
+
+// wifiStatus is the narrow interface adblock needs from wifi: the AP
+// interface to redirect on, and a hook to re-check after wifi re-applies.
+type wifiStatus interface {
+	Status() wifi.Status
+	OnApply(fn func())
+}
+
+// redirectLoss is one time the watchdog found the rules missing.
+type redirectLoss struct {
+	at    time.Time
+	cause string
+}
+
+// redirectRules are the chain's rules: one pair per split DNS device in
+// macs, then the catch-all pair.
+func redirectRules(apIface string, macs []string) [][]string {
+	var rules [][]string
+	for _, mac := range macs {
+		for _, proto := range []string{"udp", "tcp"} {
+			rules = append(rules, []string{
+				"-i", apIface, "-m", "mac", "--mac-source", mac,
+				"-p", proto, "--dport", "53", "-j", "REDIRECT", "--to-ports", strconv.Itoa(splitPort),
+			})
+		}
+	}
+	for _, proto := range []string{"udp", "tcp"} {
+		rules = append(rules, []string{
+			"-i", apIface, "-p", proto, "--dport", "53", "-j", "REDIRECT", "--to-ports", "53",
+		})
+	}
+	return rules
+}
+
+// redirectIntact reports whether the jump and every rule for apIface are in
+// place, using `iptables -t nat -C`.
+func (s *AdBlock) redirectIntact(apIface string) bool {
+	if !firewall.RuleExists(s.cmd, "nat", "PREROUTING", "-j", redirectChain) {
+		return false
+	}
+	for _, rule := range redirectRules(apIface, s.currentSplit().macs()) {
+		if !firewall.RuleExists(s.cmd, "nat", redirectChain, rule...) {
+			return false
+		}
+	}
+	return true
+}
+
+// ensureRedirect adds whatever is missing of the chain, its jump and the
+// rules for apIface and macs. Running it on intact rules changes nothing.
+func (s *AdBlock) ensureRedirect(apIface string, macs []string) error {
+	if err := firewall.EnsureChain(s.cmd, "nat", redirectChain, "PREROUTING"); err != nil {
+		return fmt.Errorf("dns redirect chain: %w", err)
+	}
+	for _, rule := range redirectRules(apIface, macs) {
+		if err := firewall.EnsureRule(s.cmd, "nat", redirectChain, rule...); err != nil {
+			return fmt.Errorf("dns redirect rule: %w", err)
+		}
+	}
+	return nil
+}
+
+// removeRedirect empties the chain and unhooks it. Safe to call when the
+// rules were never installed.
+func (s *AdBlock) removeRedirect() {
+	firewall.FlushChain(s.cmd, "nat", redirectChain)                     //nolint:errcheck
+	firewall.DeleteRule(s.cmd, "nat", "PREROUTING", "-j", redirectChain) //nolint:errcheck
+	s.mu.Lock()
+	s.redirectIface, s.redirectMACs = "", ""
+	s.mu.Unlock()
+}
+
+// apInterface is the interface clients join, or "" while wifi has no AP
+// up (or there is no wifi, as in tests).
+func (s *AdBlock) apInterface() string {
+	if s.wifiSvc == nil {
+		return ""
+	}
+	return s.wifiSvc.Status().APInterface
+}
+
+// checkRedirect is one watchdog pass. afterApply says wifi just re-applied,
+// which is what a loss found now is blamed on.
+func (s *AdBlock) checkRedirect(afterApply bool) {
+	s.watchdogMu.Lock()
+	defer s.watchdogMu.Unlock()
+
+	s.mu.RLock()
+	enabled := s.state.Enabled
+	installed := s.redirectIface
+	installedMACs := s.redirectMACs
+	bypassed := s.failedOpen
+	macs := strings.Join(s.split.macs(), ",")
+	s.mu.RUnlock()
+
+	if enabled && bypassed {
+		return // the sentinel owns the chain until dnsmasq answers again
+	}
+	iface := ""
+	if enabled {
+		iface = s.apInterface()
+	}
+	s.syncRateLimit(iface)
+	switch {
+	case iface == "" && installed == "":
+		return
+	case iface == "":
+		s.removeRedirect()
+		return
+	case iface != installed || macs != installedMACs:
+		// First install, wifi moved the AP (router ↔ extender) or the
+		// split DNS devices changed. Not a loss: rebuild the chain.
+		s.installRedirect(iface)
+		return
+	case s.redirectIntact(iface):
+		return
+	}
+
+	cause := lossUnknown
+	if afterApply {
+		cause = lossAfterWiFiApply
+	}
+	// Rebuilt rather than topped up: a device rule appended after the
+	// catch-all would never match.
+	firewall.FlushChain(s.cmd, "nat", redirectChain) //nolint:errcheck
+	if err := s.ensureRedirect(iface, s.currentSplit().macs()); err != nil {
+		slog.Error("adblock: could not restore dns redirect", "iface", iface, "err", err)
+		return
+	}
+	now := s.now()
+	s.mu.Lock()
+	s.status.RedirectRepairs++
+	s.status.LastRedirectRepair = now
+	s.losses = append(s.losses, redirectLoss{at: now, cause: cause})
+	if len(s.losses) > lossWarnCount {
+		s.losses = s.losses[len(s.losses)-lossWarnCount:]
+	}
+	s.mu.Unlock()
+	slog.Warn("adblock: dns redirect rules were missing, re-installed", "iface", iface, "cause", cause)
+}
+
+// installRedirect rebuilds the chain for apIface, dropping rules for any
+// previous interface.
+func (s *AdBlock) installRedirect(apIface string) {
+	if err := firewall.EnsureChain(s.cmd, "nat", redirectChain, "PREROUTING"); err != nil {
+		slog.Error("adblock: could not install dns redirect", "err", err)
+		return
+	}
+	firewall.FlushChain(s.cmd, "nat", redirectChain) //nolint:errcheck
+	macs := s.currentSplit().macs()
+	if err := s.ensureRedirect(apIface, macs); err != nil {
+		slog.Error("adblock: could not install dns redirect", "err", err)
+		return
+	}
+	s.mu.Lock()
+	s.redirectIface = apIface
+	s.redirectMACs = strings.Join(macs, ",")
+	s.mu.Unlock()
+	slog.Info("adblock: dns redirect installed", "iface", apIface, "split_dns_devices", len(macs))
+}
+
+// kickWatchdog asks for a check now. Called from wifi's OnApply, so it
+// never blocks: a pending kick already covers this one.
+func (s *AdBlock) kickWatchdog() {
+	select {
+	case s.recheck <- struct{}{}:
+	default:
+	}
+}
+
+func (s *AdBlock) runWatchdog(ctx context.Context) {
+	ticker := time.NewTicker(watchdogInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			s.removeRedirect()
+			s.removeRateLimit()
+			return
+		case <-ticker.C:
+			s.checkRedirect(false)
+			s.checkOverload()
+		case <-s.recheck:
+			s.checkRedirect(true)
+		}
+	}
+}
+
+// redirectWarning is the /api/health warning for repeated redirect
+// losses, or "".
+func (s *AdBlock) redirectWarning() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.losses) < lossWarnCount || s.now().Sub(s.losses[0].at) > lossWindow {
+		return ""
+	}
+	last := s.losses[len(s.losses)-1]
+	culprit := "something outside the agent is flushing the nat table — check for scripts, VPN clients or admins running iptables -F / iptables -t nat -F"
+	if last.cause == lossAfterWiFiApply {
+		culprit = "the last loss followed a wifi apply"
+	}
+	return fmt.Sprintf(
+		"adblock: DNS redirect rules were removed %d times within an hour and re-installed (%d repairs in total); %s",
+		len(s.losses), s.status.RedirectRepairs, culprit)
+}
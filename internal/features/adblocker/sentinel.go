@@ -0,0 +1,250 @@
+package adblock
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/strct-org/strct-agent/internal/agent"
+	"github.com/strct-org/strct-agent/internal/platform/firewall"
+)
+
+// DNS sentinel. The redirect sends every client's DNS to dnsmasq, and
+// dnsmasq is also the resolver DHCP hands out, so if dnsmasq dies (OOM, a
+// bad conf) the whole network loses DNS — worse than no blocker at all.
+// While blocking is on, the sentinel asks dnsmasq for localhost over
+// loopback every sentinelInterval. After sentinelFailLimit misses in a row:
+//
+//   - fail_mode "open" (the default) swaps the redirect for a DNAT to the
+//     first upstream in strct.conf, so clients keep resolving, unblocked;
+//   - fail_mode "closed" leaves the redirect alone, for users who would
+//     rather have no DNS than unfiltered DNS;
+//
+// and either way /api/health turns critical and dnsmasq is restarted, again
+// after every further sentinelFailLimit misses. The redirect comes back
+// once dnsmasq answers the probe again.
+const (
+	sentinelInterval  = 10 * time.Second
+	sentinelFailLimit = 3
+	probeTimeout      = 2 * time.Second
+
+	// fallbackUpstream is used when strct.conf has no server= line; it is
+	// wifi's default provider.
+	fallbackUpstream = "1.1.1.1"
+)
+
+// Fail modes for AdBlockConfig.FailMode. "" is FailOpen.
+const (
+	FailOpen   = "open"
+	FailClosed = "closed"
+)
+
+// probeDNSMasq asks dnsmasq on loopback for localhost, which it answers
+// from /etc/hosts without going upstream. Any reply counts: the question
+// is whether dnsmasq is there, not what it thinks of localhost.
+func probeDNSMasq() error {
+	m := new(dns.Msg)
+	m.SetQuestion("localhost.", dns.TypeA)
+	c := &dns.Client{Net: "udp", Timeout: probeTimeout}
+	_, _, err := c.Exchange(m, net.JoinHostPort("127.0.0.1", "53"))
+	return err
+}
+
+// bypassRules send apIface's DNS straight to upstream instead of dnsmasq.
+func bypassRules(apIface, upstream string) [][]string {
+	var rules [][]string
+	for _, proto := range []string{"udp", "tcp"} {
+		rules = append(rules, []string{
+			"-i", apIface, "-p", proto, "--dport", "53", "-j", "DNAT", "--to-destination", net.JoinHostPort(upstream, "53"),
+		})
+	}
+	return rules
+}
+
+// upstream is the first server= in strct.conf that is a plain IP (a
+// server=/domain/ip line only covers that domain).
+func (s *AdBlock) upstream() string {
+	f, err := os.Open(s.dnsmasqConf)
+	if err != nil {
+		return fallbackUpstream
+	}
+	defer f.Close()
+	for _, srv := range parseUpstreams(f) {
+		if ip := net.ParseIP(strings.TrimSpace(srv)); ip != nil && ip.To4() != nil {
+			return ip.String()
+		}
+	}
+	return fallbackUpstream
+}
+
+func (s *AdBlock) runSentinel(ctx context.Context) {
+	ticker := time.NewTicker(sentinelInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.checkDNS()
+		}
+	}
+}
+
+// checkDNS is one sentinel pass.
+func (s *AdBlock) checkDNS() {
+	s.mu.RLock()
+	enabled := s.state.Enabled
+	failOpen := s.state.FailMode != FailClosed
+	s.mu.RUnlock()
+
+	if !enabled {
+		// Disabling removed the redirect, bypass included.
+		s.mu.Lock()
+		s.dnsFailures = 0
+		s.failedOpen = false
+		s.status.DNSDown, s.status.FailedOpen = false, false
+		s.mu.Unlock()
+		return
+	}
+
+	err := s.probe()
+	s.mu.Lock()
+	if err == nil {
+		wasDown, wasOpen := s.status.DNSDown, s.failedOpen
+		s.dnsFailures = 0
+		s.status.DNSDown = false
+		s.mu.Unlock()
+		if wasDown {
+			slog.Info("adblock: dnsmasq is answering again")
+		}
+		if wasOpen {
+			s.restoreRedirect()
+		}
+		return
+	}
+	s.dnsFailures++
+	n := s.dnsFailures
+	started := n == sentinelFailLimit
+	if started {
+		s.status.DNSDown = true
+		s.status.LastDNSOutage = s.now()
+	}
+	s.mu.Unlock()
+
+	if n < sentinelFailLimit {
+		slog.Warn("adblock: dnsmasq did not answer the liveness probe", "misses", n, "err", err)
+		return
+	}
+	if started {
+		mode := FailOpen
+		if !failOpen {
+			mode = FailClosed
+		}
+		slog.Error("adblock: dnsmasq is not answering DNS", "misses", n, "fail_mode", mode, "err", err)
+	}
+
+	// Follow fail_mode on every pass, so switching it mid-outage applies.
+	s.mu.RLock()
+	open := s.failedOpen
+	s.mu.RUnlock()
+	switch {
+	case failOpen && !open:
+		s.bypassRedirect()
+	case !failOpen && open:
+		s.restoreRedirect()
+	}
+
+	if (n-sentinelFailLimit)%sentinelFailLimit == 0 {
+		s.mu.Lock()
+		s.status.DNSRestarts++
+		s.mu.Unlock()
+		if err := s.cmd.Run("systemctl", "restart", "dnsmasq"); err != nil {
+			slog.Error("adblock: could not restart dnsmasq", "err", err)
+		} else {
+			slog.Info("adblock: dnsmasq restarted, waiting for it to answer")
+		}
+	}
+}
+
+// bypassRedirect points the redirect chain at the upstream resolver. The
+// watchdog leaves the chain alone until restoreRedirect.
+func (s *AdBlock) bypassRedirect() {
+	s.watchdogMu.Lock()
+	defer s.watchdogMu.Unlock()
+
+	s.mu.Lock()
+	s.failedOpen = true
+	s.status.FailedOpen = true
+	iface := s.redirectIface
+	s.mu.Unlock()
+	if iface == "" {
+		return // no redirect installed, nothing to bypass
+	}
+
+	upstream := s.upstream()
+	firewall.FlushChain(s.cmd, "nat", redirectChain) //nolint:errcheck
+	for _, rule := range bypassRules(iface, upstream) {
+		if err := firewall.EnsureRule(s.cmd, "nat", redirectChain, rule...); err != nil {
+			slog.Error("adblock: could not send DNS to the upstream", "iface", iface, "err", err)
+		}
+	}
+	slog.Warn("adblock: failing open, AP DNS goes straight to the upstream until dnsmasq recovers",
+		"iface", iface, "upstream", upstream)
+}
+
+// restoreRedirect puts the redirect to dnsmasq back after a bypass.
+func (s *AdBlock) restoreRedirect() {
+	s.mu.Lock()
+	s.failedOpen = false
+	s.status.FailedOpen = false
+	s.redirectIface = "" // the chain holds bypass rules; rebuild it
+	s.mu.Unlock()
+	s.checkRedirect(false)
+}
+
+// dnsWarning is the /api/health warning while dnsmasq is down, or "".
+// Health reports whether dnsmasq answers while blocking is on. Down with
+// fail_mode closed leaves the AP's devices without DNS, which is
+// critical; failed open they resolve, unblocked.
+func (s *AdBlock) Health() agent.ComponentHealth {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	h := agent.ComponentHealth{Name: "adblock", Status: agent.HealthOK}
+	switch {
+	case !s.state.Enabled:
+		h.Message = "off"
+	case s.status.DNSDown:
+		h.Status = agent.HealthDown
+		since := s.status.LastDNSOutage.Format(time.RFC3339)
+		if s.failedOpen {
+			h.Message = "dnsmasq has not answered since " + since + "; devices resolve through the upstream, unblocked"
+		} else {
+			h.Critical = true
+			h.Message = "dnsmasq has not answered since " + since + "; devices on the AP have no DNS"
+		}
+	default:
+		h.Message = fmt.Sprintf("dnsmasq answering, %d domains blocked", s.status.EntryCount)
+	}
+	return h
+}
+
+func (s *AdBlock) dnsWarning() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if !s.status.DNSDown {
+		return ""
+	}
+	since := s.status.LastDNSOutage.Format(time.RFC3339)
+	if s.failedOpen {
+		return fmt.Sprintf("critical: adblock: dnsmasq has not answered DNS since %s; "+
+			"devices are resolving through the upstream directly, without blocking (%d restarts tried)",
+			since, s.status.DNSRestarts)
+	}
+	return fmt.Sprintf("critical: adblock: dnsmasq has not answered DNS since %s and fail_mode is closed; "+
+		"devices on the AP have no DNS (%d restarts tried)", since, s.status.DNSRestarts)
+}
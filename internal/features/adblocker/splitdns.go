@@ -0,0 +1,467 @@
+package adblock
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/strct-org/strct-agent/internal/statefile"
+)
+
+// Split DNS. Some names only resolve on one resolver: a work laptop needs
+// the corporate one for corp.example.com, and everyone may want the ISP
+// router for *.lan. dnsmasq forwards by domain but not by client, so:
+//
+//   - Rules apply to everyone. dnsmasq gets them as
+//     server=/corp.example.com/10.10.0.53 lines in forward.conf, a file of
+//     their own so they work with ad blocking off.
+//
+//   - Devices, by MAC, can have rules of their own and their own
+//     upstreams. The DNS redirect sends their port-53 traffic to the
+//     agent's forwarder on splitPort instead of to dnsmasq:
+//
+//     iptables -t nat -A STRCT_DNS -i wlan0 -m mac --mac-source aa:bb:cc:dd:ee:01 -p udp --dport 53
+//     -j REDIRECT --to-ports 5354
+//
+//     ServeDNS sends each query to the servers of the longest matching
+//     rule, the device's or a global one (the device's wins a tie), else
+//     to the device's upstreams, else to dnsmasq, so the blocklist still
+//     covers whatever the device's own settings don't.
+//
+// Device settings ride on the redirect and so only apply while ad
+// blocking is on. The settings are kept in DataDir/adblock-split-dns.json;
+// GET/POST /api/adblock/split-dns reads and replaces them and
+// /api/adblock/diagnose shows the route a lookup takes.
+const (
+	forwardConfPath = "/etc/dnsmasq.d/forward.conf"
+	splitPort       = 5354
+	localDNSAddr    = "127.0.0.1:53"
+	forwardTimeout  = 2 * time.Second
+
+	maxForwardRules = 64
+	maxSplitDevices = 32
+	maxServers      = 4
+)
+
+// arpTablePath is the kernel's neighbour table, for a client's MAC.
+const arpTablePath = "/proc/net/arp"
+
+// Routes a lookup can take, see SplitDNS.route.
+const (
+	routeDefault        = "default"          // dnsmasq and the global upstreams
+	routeGlobalRule     = "global_rule"      // a rule for everyone
+	routeDeviceRule     = "device_rule"      // one of the device's rules
+	routeDeviceUpstream = "device_upstreams" // the device's own upstreams
+)
+
+// ForwardRule sends lookups of Domain and its subdomains to Servers.
+type ForwardRule struct {
+	Domain  string   `json:"domain"`  // "*.lan" is stored as "lan"
+	Servers []string `json:"servers"` // IPs, each with an optional #port
+}
+
+// DeviceDNS is one device's own DNS settings.
+type DeviceDNS struct {
+	MAC       string        `json:"mac"`
+	Name      string        `json:"name,omitempty"`
+	Upstreams []string      `json:"upstreams,omitempty"`
+	Rules     []ForwardRule `json:"rules,omitempty"`
+}
+
+// SplitDNS is what GET/POST /api/adblock/split-dns carry.
+type SplitDNS struct {
+	Rules   []ForwardRule `json:"rules"`
+	Devices []DeviceDNS   `json:"devices"`
+}
+
+// dnsRoute is where one lookup goes. Entry is the rule's domain.
+type dnsRoute struct {
+	Via     string
+	Entry   string
+	Servers []string
+}
+
+// device returns mac's settings, or nil.
+func (c SplitDNS) device(mac string) *DeviceDNS {
+	for i := range c.Devices {
+		if mac != "" && c.Devices[i].MAC == mac {
+			return &c.Devices[i]
+		}
+	}
+	return nil
+}
+
+// route picks the servers for mac's lookup of name.
+func (c SplitDNS) route(mac, name string) dnsRoute {
+	r, best := dnsRoute{Via: routeDefault}, -1
+	match := func(rules []ForwardRule, via string) {
+		for _, rule := range rules {
+			if (name == rule.Domain || strings.HasSuffix(name, "."+rule.Domain)) && len(rule.Domain) > best {
+				best, r = len(rule.Domain), dnsRoute{Via: via, Entry: rule.Domain, Servers: rule.Servers}
+			}
+		}
+	}
+	d := c.device(mac)
+	if d != nil {
+		match(d.Rules, routeDeviceRule)
+	}
+	match(c.Rules, routeGlobalRule)
+	if best < 0 && d != nil && len(d.Upstreams) > 0 {
+		r = dnsRoute{Via: routeDeviceUpstream, Servers: d.Upstreams}
+	}
+	return r
+}
+
+// macs are the devices the redirect sends to the forwarder, sorted.
+func (c SplitDNS) macs() []string {
+	var out []string
+	for _, d := range c.Devices {
+		out = append(out, d.MAC)
+	}
+	slices.Sort(out)
+	return out
+}
+
+// normalize cleans c up in place and checks it.
+func (c *SplitDNS) normalize() error {
+	if len(c.Devices) > maxSplitDevices {
+		return fmt.Errorf("at most %d devices", maxSplitDevices)
+	}
+	var err error
+	if c.Rules, err = normalizeRules(c.Rules); err != nil {
+		return err
+	}
+	seen := map[string]bool{}
+	for i := range c.Devices {
+		d := &c.Devices[i]
+		hw, err := net.ParseMAC(strings.TrimSpace(d.MAC))
+		if err != nil || len(hw) != 6 {
+			return fmt.Errorf("device %q: invalid MAC", d.MAC)
+		}
+		d.MAC = hw.String()
+		if seen[d.MAC] {
+			return fmt.Errorf("device %s is listed twice", d.MAC)
+		}
+		seen[d.MAC] = true
+		if d.Upstreams, err = normalizeServers(d.Upstreams); err != nil {
+			return fmt.Errorf("device %s: %w", d.MAC, err)
+		}
+		if d.Rules, err = normalizeRules(d.Rules); err != nil {
+			return fmt.Errorf("device %s: %w", d.MAC, err)
+		}
+		if len(d.Upstreams) == 0 && len(d.Rules) == 0 {
+			return fmt.Errorf("device %s has neither upstreams nor rules", d.MAC)
+		}
+	}
+	if c.Rules == nil {
+		c.Rules = []ForwardRule{}
+	}
+	if c.Devices == nil {
+		c.Devices = []DeviceDNS{}
+	}
+	return nil
+}
+
+func normalizeRules(rules []ForwardRule) ([]ForwardRule, error) {
+	if len(rules) > maxForwardRules {
+		return nil, fmt.Errorf("at most %d rules", maxForwardRules)
+	}
+	seen := map[string]bool{}
+	for i := range rules {
+		raw := rules[i].Domain
+		domain, ok := cleanDomain(strings.TrimPrefix(strings.TrimSpace(raw), "*."))
+		if !ok {
+			return nil, fmt.Errorf("rule %q: invalid domain", raw)
+		}
+		if seen[domain] {
+			return nil, fmt.Errorf("rule %q is listed twice", domain)
+		}
+		seen[domain] = true
+		servers, err := normalizeServers(rules[i].Servers)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %w", domain, err)
+		}
+		if len(servers) == 0 {
+			return nil, fmt.Errorf("rule %q has no servers", domain)
+		}
+		rules[i] = ForwardRule{Domain: domain, Servers: servers}
+	}
+	return rules, nil
+}
+
+// normalizeServers checks each server is an IP with an optional #port,
+// dnsmasq's syntax.
+func normalizeServers(servers []string) ([]string, error) {
+	if len(servers) > maxServers {
+		return nil, fmt.Errorf("at most %d servers", maxServers)
+	}
+	out := []string{}
+	for _, srv := range servers {
+		host, port, hasPort := strings.Cut(strings.TrimSpace(srv), "#")
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return nil, fmt.Errorf("server %q must be an IP address", srv)
+		}
+		srv = ip.String()
+		if hasPort {
+			if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+				return nil, fmt.Errorf("server %q: invalid port", srv+"#"+port)
+			}
+			srv += "#" + port
+		}
+		out = append(out, srv)
+	}
+	return out, nil
+}
+
+// serverAddr turns "10.10.0.53#5353" into a host:port to dial.
+func serverAddr(srv string) string {
+	host, port, ok := strings.Cut(srv, "#")
+	if !ok {
+		port = "53"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// ─── Persistence and forward.conf ────────────────────────────────────────────
+
+// splitSchema versions adblock-split-dns.json.
+//
+//	v1: SplitDNS as-is
+var splitSchema = statefile.Schema{
+	Name:       "adblock-split-dns",
+	Migrations: []statefile.Migration{statefile.Stamp},
+}
+
+func (s *AdBlock) splitPath() string {
+	return filepath.Join(s.cfg.DataDir, "adblock-split-dns.json")
+}
+
+func (s *AdBlock) loadSplit() error {
+	var c SplitDNS
+	if err := statefile.Load(s.splitPath(), splitSchema, &c); err != nil {
+		if statefile.Fresh(err) {
+			return nil
+		}
+		return fmt.Errorf("load split dns: %w", err)
+	}
+	s.mu.Lock()
+	s.split = c
+	s.mu.Unlock()
+	return nil
+}
+
+// currentSplit returns s.split; it is replaced whole, never changed in
+// place, so the copy is safe to use unlocked.
+func (s *AdBlock) currentSplit() SplitDNS {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.split
+}
+
+// renderForwardConf writes forward.conf for the global rules.
+func renderForwardConf(rules []ForwardRule) []byte {
+	var b strings.Builder
+	b.WriteString("# Conditional forwarding — generated by strct-agent\n")
+	for _, r := range rules {
+		for _, srv := range r.Servers {
+			fmt.Fprintf(&b, "server=/%s/%s\n", r.Domain, srv)
+		}
+	}
+	return []byte(b.String())
+}
+
+// writeForwardConf puts the global rules in place and reports whether the
+// file changed. No rules removes it.
+func (s *AdBlock) writeForwardConf() (bool, error) {
+	var conf []byte
+	if rules := s.currentSplit().Rules; len(rules) > 0 {
+		conf = renderForwardConf(rules)
+	}
+	return writeDropIn(s.forwardPath, conf)
+}
+
+// restoreSplit rewrites forward.conf on start, like restoreRecords.
+func (s *AdBlock) restoreSplit() {
+	changed, err := s.writeForwardConf()
+	if err != nil {
+		slog.Error("adblock: could not write forwarding rules", "err", err)
+		return
+	}
+	if changed {
+		s.reloadDNSMasq()
+	}
+}
+
+// ─── Forwarder ───────────────────────────────────────────────────────────────
+
+// runSplitDNS serves the forwarder on splitPort, UDP and TCP, until ctx
+// ends.
+func (s *AdBlock) runSplitDNS(ctx context.Context) {
+	addr := ":" + strconv.Itoa(splitPort)
+	for _, network := range []string{"udp", "tcp"} {
+		serving := make(chan struct{})
+		var once sync.Once
+		ready := func() { once.Do(func() { close(serving) }) }
+		srv := &dns.Server{Addr: addr, Net: network, Handler: s, NotifyStartedFunc: ready}
+		s.loops.Add(1)
+		go func() {
+			defer s.loops.Done()
+			defer ready()
+			if err := srv.ListenAndServe(); err != nil {
+				slog.Error("adblock: split dns forwarder stopped", "net", network, "err", err)
+			}
+		}()
+		// Shutdown before the server serves fails and leaves it running,
+		// which a quick restart would run into.
+		context.AfterFunc(ctx, func() {
+			<-serving
+			srv.Shutdown() //nolint:errcheck
+		})
+	}
+}
+
+// ServeDNS answers a query the redirect sent to the forwarder. Only the
+// devices with settings of their own are sent here; anyone else is
+// refused.
+func (s *AdBlock) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	client, _, _ := net.SplitHostPort(w.RemoteAddr().String())
+	w.WriteMsg(s.forward(client, req)) //nolint:errcheck
+}
+
+func (s *AdBlock) forward(client string, req *dns.Msg) *dns.Msg {
+	fail := func(rcode int) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetRcode(req, rcode)
+		return m
+	}
+	if len(req.Question) != 1 {
+		return fail(dns.RcodeFormatError)
+	}
+	split := s.currentSplit()
+	mac := s.macOf(client)
+	if split.device(mac) == nil {
+		return fail(dns.RcodeRefused)
+	}
+
+	name := strings.ToLower(strings.TrimSuffix(req.Question[0].Name, "."))
+	route := split.route(mac, name)
+	addrs := []string{s.localDNS}
+	if route.Via != routeDefault {
+		addrs = addrs[:0]
+		for _, srv := range route.Servers {
+			addrs = append(addrs, serverAddr(srv))
+		}
+	}
+	for _, addr := range addrs {
+		resp, err := exchange(req, addr)
+		if err == nil {
+			return resp
+		}
+		slog.Debug("adblock: split dns upstream failed", "client", client, "name", name, "server", addr, "err", err)
+	}
+	return fail(dns.RcodeServerFailure)
+}
+
+// exchange asks addr over UDP, and again over TCP if the answer was
+// truncated.
+func exchange(req *dns.Msg, addr string) (*dns.Msg, error) {
+	c := &dns.Client{Net: "udp", Timeout: forwardTimeout}
+	resp, _, err := c.Exchange(req, addr)
+	if err == nil && resp.Truncated {
+		c.Net = "tcp"
+		resp, _, err = c.Exchange(req, addr)
+	}
+	return resp, err
+}
+
+// macOf looks client up in the neighbour table, "" if it isn't there.
+func (s *AdBlock) macOf(client string) string {
+	data, err := os.ReadFile(s.arpPath)
+	if err != nil {
+		return ""
+	}
+	return parseARP(data, client)
+}
+
+// parseARP finds ip's MAC in /proc/net/arp:
+//
+//	IP address       HW type     Flags       HW address            Mask     Device
+//	192.168.100.52   0x1         0x2         aa:bb:cc:dd:ee:01     *        wlan0
+func parseARP(data []byte, ip string) string {
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		f := strings.Fields(sc.Text())
+		if len(f) >= 4 && f[0] == ip && f[3] != "00:00:00:00:00:00" {
+			return strings.ToLower(f[3])
+		}
+	}
+	return ""
+}
+
+// ─── Handlers ────────────────────────────────────────────────────────────────
+
+// handleGetSplit returns the forwarding rules and device settings.
+func (s *AdBlock) handleGetSplit(w http.ResponseWriter, r *http.Request) {
+	c := s.currentSplit()
+	if c.Rules == nil {
+		c.Rules = []ForwardRule{}
+	}
+	if c.Devices == nil {
+		c.Devices = []DeviceDNS{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c)
+}
+
+// handleSetSplit replaces the forwarding rules and device settings.
+// POST /api/adblock/split-dns
+//
+//	{"rules": [{"domain": "*.lan", "servers": ["192.168.1.1"]}],
+//	 "devices": [{"mac": "aa:bb:cc:dd:ee:01", "name": "work laptop",
+//	              "rules": [{"domain": "corp.example.com", "servers": ["10.10.0.53"]}]}]}
+func (s *AdBlock) handleSetSplit(w http.ResponseWriter, r *http.Request) {
+	var req SplitDNS
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if err := req.normalize(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := statefile.Save(s.splitPath(), splitSchema, req); err != nil {
+		http.Error(w, "save split dns: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.mu.Lock()
+	s.split = req
+	s.mu.Unlock()
+	slog.Info("adblock: split dns set", "rules", len(req.Rules), "devices", len(req.Devices))
+
+	changed, err := s.writeForwardConf()
+	if err != nil {
+		http.Error(w, "write "+filepath.Base(s.forwardPath)+": "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if changed {
+		s.reloadDNSMasq()
+	}
+	go s.checkRedirect(false) // redirect the devices now listed
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(req)
+}
@@ -0,0 +1,227 @@
+package adblock
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/strct-org/strct-agent/internal/config"
+	"github.com/strct-org/strct-agent/internal/platform/executil"
+)
+
+// fakeResolver serves h on a loopback UDP port and returns its address.
+func fakeResolver(t *testing.T, h dns.Handler) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ready := make(chan struct{})
+	srv := &dns.Server{PacketConn: pc, Handler: h, NotifyStartedFunc: func() { close(ready) }}
+	go srv.ActivateAndServe() //nolint:errcheck
+	<-ready
+	t.Cleanup(func() { srv.Shutdown() }) //nolint:errcheck
+	return pc.LocalAddr().String()
+}
+
+// answering answers every A query with answer and counts the queries.
+func answering(answer string, hits *atomic.Int32) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		hits.Add(1)
+		m := new(dns.Msg)
+		m.SetReply(r)
+		rr, _ := dns.NewRR(r.Question[0].Name + " 60 IN A " + answer)
+		m.Answer = append(m.Answer, rr)
+		w.WriteMsg(m) //nolint:errcheck
+	}
+}
+
+// hashPort turns "127.0.0.1:5300" into dnsmasq's "127.0.0.1#5300".
+func hashPort(addr string) string {
+	return strings.Replace(addr, ":", "#", 1)
+}
+
+// TestSplitDNS_Resolution runs the forwarder against fake upstreams: the
+// corporate resolver, the ISP router and dnsmasq. The laptop (127.0.0.2)
+// has a rule for corp.example.com; the phone (127.0.0.3) has no settings.
+func TestSplitDNS_Resolution(t *testing.T) {
+	var corpHits, routerHits, dnsmasqHits atomic.Int32
+	corp := fakeResolver(t, answering("10.10.0.10", &corpHits))
+	router := fakeResolver(t, answering("192.168.1.20", &routerHits))
+
+	s := New(config.Config{DataDir: t.TempDir()}, &executil.Mock{})
+	s.localDNS = fakeResolver(t, answering("93.184.216.34", &dnsmasqHits))
+	s.arpPath = filepath.Join(t.TempDir(), "arp")
+	os.WriteFile(s.arpPath, []byte(
+		"IP address       HW type     Flags       HW address            Mask     Device\n"+
+			"127.0.0.2        0x1         0x2         aa:bb:cc:dd:ee:01     *        wlan0\n"+
+			"127.0.0.3        0x1         0x2         aa:bb:cc:dd:ee:02     *        wlan0\n"), 0644)
+	s.split = SplitDNS{
+		Rules: []ForwardRule{{Domain: "lan", Servers: []string{hashPort(router)}}},
+		Devices: []DeviceDNS{{MAC: "aa:bb:cc:dd:ee:01", Name: "work laptop",
+			Rules: []ForwardRule{{Domain: "corp.example.com", Servers: []string{"127.0.0.1#1", hashPort(corp)}}}}},
+	}
+	forwarder := fakeResolver(t, s)
+
+	query := func(from, name string) *dns.Msg {
+		t.Helper()
+		c := &dns.Client{Net: "udp", Dialer: &net.Dialer{LocalAddr: &net.UDPAddr{IP: net.ParseIP(from)}}}
+		m := new(dns.Msg)
+		m.SetQuestion(dns.Fqdn(name), dns.TypeA)
+		resp, _, err := c.Exchange(m, forwarder)
+		if err != nil {
+			t.Fatalf("%s asking %s: %v", from, name, err)
+		}
+		return resp
+	}
+	answer := func(m *dns.Msg) string {
+		if len(m.Answer) != 1 {
+			return dns.RcodeToString[m.Rcode]
+		}
+		return m.Answer[0].(*dns.A).A.String()
+	}
+
+	for _, tt := range []struct {
+		from, name, want string
+	}{
+		{"127.0.0.2", "wiki.corp.example.com", "10.10.0.10"}, // the laptop's rule, past a dead first server
+		{"127.0.0.2", "nas.lan", "192.168.1.20"},             // the global rule
+		{"127.0.0.2", "example.com", "93.184.216.34"},        // everything else: dnsmasq
+		{"127.0.0.3", "wiki.corp.example.com", "REFUSED"},    // not a split DNS device
+	} {
+		if got := answer(query(tt.from, tt.name)); got != tt.want {
+			t.Errorf("%s asking %s: got %s, want %s", tt.from, tt.name, got, tt.want)
+		}
+	}
+	if corpHits.Load() != 1 || routerHits.Load() != 1 || dnsmasqHits.Load() != 1 {
+		t.Errorf("hits: corp %d, router %d, dnsmasq %d", corpHits.Load(), routerHits.Load(), dnsmasqHits.Load())
+	}
+}
+
+func TestSplitDNS_Route(t *testing.T) {
+	c := SplitDNS{
+		Rules: []ForwardRule{
+			{Domain: "lan", Servers: []string{"192.168.1.1"}},
+			{Domain: "example.com", Servers: []string{"9.9.9.9"}},
+		},
+		Devices: []DeviceDNS{{
+			MAC:       "aa:bb:cc:dd:ee:01",
+			Upstreams: []string{"10.10.0.53"},
+			Rules:     []ForwardRule{{Domain: "example.com", Servers: []string{"10.10.0.54"}}},
+		}},
+	}
+	for _, tt := range []struct {
+		mac, name string
+		want      dnsRoute
+	}{
+		{"aa:bb:cc:dd:ee:01", "www.example.com", dnsRoute{routeDeviceRule, "example.com", []string{"10.10.0.54"}}}, // the device wins a tie
+		{"aa:bb:cc:dd:ee:01", "printer.lan", dnsRoute{routeGlobalRule, "lan", []string{"192.168.1.1"}}},
+		{"aa:bb:cc:dd:ee:01", "ads.example.net", dnsRoute{Via: routeDeviceUpstream, Servers: []string{"10.10.0.53"}}},
+		{"aa:bb:cc:dd:ee:02", "www.example.com", dnsRoute{routeGlobalRule, "example.com", []string{"9.9.9.9"}}},
+		{"", "notexample.com", dnsRoute{Via: routeDefault}},
+	} {
+		if got := c.route(tt.mac, tt.name); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("route(%s, %s) = %+v, want %+v", tt.mac, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDiagnose_SplitDNS(t *testing.T) {
+	in := diagnoseInput{
+		client: "192.168.100.52", mac: "aa:bb:cc:dd:ee:01", domain: "ads.corp.example.com",
+		enabled: true, blocklist: blocklist{"corp.example.com": {}}, upstreams: []string{"1.1.1.1"},
+		split: SplitDNS{
+			Rules: []ForwardRule{{Domain: "example.com", Servers: []string{"192.168.1.1"}}},
+			Devices: []DeviceDNS{{MAC: "aa:bb:cc:dd:ee:01",
+				Rules: []ForwardRule{{Domain: "ads.corp.example.com", Servers: []string{"10.10.0.53"}}}}},
+		},
+	}
+	d := diagnose(in)
+	if d.Answer.Action != "forwarded" || d.Upstream.Route != routeDeviceRule || !reflect.DeepEqual(d.Upstream.Servers, []string{"10.10.0.53"}) {
+		t.Errorf("laptop: answer %+v upstream %+v", d.Answer, d.Upstream)
+	}
+
+	// Another client: the blocked corp.example.com is longer than the
+	// global example.com rule, so dnsmasq still blocks it.
+	in.mac = "aa:bb:cc:dd:ee:02"
+	if d := diagnose(in); d.Answer.Action != "blocked" || d.Upstream.Route != routeDefault {
+		t.Errorf("phone: answer %+v upstream %+v", d.Answer, d.Upstream)
+	}
+	in.domain = "www.example.com"
+	if d := diagnose(in); d.Upstream.Route != routeGlobalRule || d.Upstream.Servers[0] != "192.168.1.1" {
+		t.Errorf("phone, global rule: upstream %+v", d.Upstream)
+	}
+
+	// With blocking off there is no redirect to the forwarder.
+	in.mac, in.domain, in.enabled = "aa:bb:cc:dd:ee:01", "ads.corp.example.com", false
+	if d := diagnose(in); d.Upstream.Route == routeDeviceRule {
+		t.Errorf("blocking off: upstream %+v", d.Upstream)
+	}
+}
+
+func TestHandleSetSplit(t *testing.T) {
+	m := &executil.Mock{}
+	s := New(config.Config{DataDir: t.TempDir()}, m)
+	s.forwardPath = filepath.Join(t.TempDir(), "dnsmasq.d", "forward.conf")
+	mux := http.NewServeMux()
+	s.RegisterRoutes(mux)
+	set := func(body string) (int, string) {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("POST", "/api/adblock/split-dns", strings.NewReader(body)))
+		return w.Code, w.Body.String()
+	}
+
+	for _, body := range []string{
+		`{"rules":[{"domain":"lan","servers":["router.lan"]}]}`,
+		`{"rules":[{"domain":"lan","servers":[]}]}`,
+		`{"rules":[{"domain":"bad domain","servers":["192.168.1.1"]}]}`,
+		`{"devices":[{"mac":"laptop","upstreams":["10.10.0.53"]}]}`,
+		`{"devices":[{"mac":"aa:bb:cc:dd:ee:01"}]}`,
+		`{"rules":[{"domain":"lan","servers":["192.168.1.1#99999"]}]}`,
+	} {
+		if code, _ := set(body); code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want 400", body, code)
+		}
+	}
+
+	code, body := set(`{"rules":[{"domain":"*.LAN","servers":["192.168.1.1"]}],
+		"devices":[{"mac":"AA-BB-CC-DD-EE-01","rules":[{"domain":"corp.example.com","servers":["10.10.0.53","10.10.0.54#5353"]}]}]}`)
+	if code != http.StatusOK {
+		t.Fatalf("set: %d %s", code, body)
+	}
+	conf, _ := os.ReadFile(s.forwardPath)
+	if want := "# Conditional forwarding — generated by strct-agent\nserver=/lan/192.168.1.1\n"; string(conf) != want {
+		t.Errorf("forward.conf:\n%s", conf)
+	}
+	m.AssertCalled(t, "systemctl kill -s HUP dnsmasq")
+
+	restarted := New(config.Config{DataDir: s.cfg.DataDir}, &executil.Mock{})
+	if err := restarted.loadSplit(); err != nil {
+		t.Fatal(err)
+	}
+	if got := restarted.currentSplit(); got.Rules[0].Domain != "lan" || got.Devices[0].MAC != "aa:bb:cc:dd:ee:01" ||
+		got.Devices[0].Rules[0].Servers[1] != "10.10.0.54#5353" {
+		t.Errorf("reloaded %+v", got)
+	}
+
+	// The device's DNS goes to the forwarder ahead of the catch-all.
+	rules := redirectRules("wlan0", restarted.currentSplit().macs())
+	if len(rules) != 4 || !strings.Contains(strings.Join(rules[0], " "), "--mac-source aa:bb:cc:dd:ee:01") ||
+		rules[0][len(rules[0])-1] != "5354" || rules[3][len(rules[3])-1] != "53" {
+		t.Errorf("redirect rules = %v", rules)
+	}
+
+	if code, _ := set(`{}`); code != http.StatusOK {
+		t.Fatalf("clear: %d", code)
+	}
+	if _, err := os.Stat(s.forwardPath); !os.IsNotExist(err) {
+		t.Errorf("forward.conf left behind: %v", err)
+	}
+}
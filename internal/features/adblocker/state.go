@@ -0,0 +1,66 @@
+package adblock
+
+import (
+	"fmt"
+	"log/slog"
+	"path/filepath"
+
+	"github.com/strct-org/strct-agent/internal/statefile"
+)
+
+// configSchema versions adblock-config.json.
+//
+//	v1: AdBlockConfig as-is
+var configSchema = statefile.Schema{
+	Name:       "adblock-config",
+	Migrations: []statefile.Migration{statefile.Stamp},
+}
+
+// configPath is where the last config accepted by POST /api/adblock/config
+// is kept, so blocking comes back on by itself after a reboot.
+func (s *AdBlock) configPath() string {
+	return filepath.Join(s.cfg.DataDir, "adblock-config.json")
+}
+
+// loadConfig restores the persisted config into s.state.
+//
+// Agents from before the config was kept have no file. If such a device
+// already serves an adblock.conf the user had blocking on, so it stays on
+// with the default settings.
+func (s *AdBlock) loadConfig() error {
+	var cfg AdBlockConfig
+	if err := statefile.Load(s.configPath(), configSchema, &cfg); err != nil {
+		if !statefile.Fresh(err) {
+			return fmt.Errorf("load adblock config: %w", err)
+		}
+		if s.countExistingEntries() == 0 {
+			return nil
+		}
+		s.mu.Lock()
+		cfg = s.state
+		cfg.Enabled = true
+		s.mu.Unlock()
+	}
+	if cfg.BlockTTL <= 0 || cfg.BlockTTL > maxBlockTTL {
+		cfg.BlockTTL = defaultBlockTTL
+	}
+
+	s.mu.Lock()
+	s.state = cfg
+	s.mu.Unlock()
+
+	slog.Info("adblock: config restored", "path", s.configPath(), "enabled", cfg.Enabled)
+	return nil
+}
+
+// saveConfig writes the current config to disk.
+func (s *AdBlock) saveConfig() error {
+	s.mu.RLock()
+	cfg := s.state
+	s.mu.RUnlock()
+
+	if err := statefile.Save(s.configPath(), configSchema, cfg); err != nil {
+		return fmt.Errorf("save adblock config: %w", err)
+	}
+	return nil
+}
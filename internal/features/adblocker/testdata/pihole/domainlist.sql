@@ -0,0 +1,9 @@
+PRAGMA foreign_keys=OFF;
+BEGIN TRANSACTION;
+CREATE TABLE domainlist (id INTEGER PRIMARY KEY AUTOINCREMENT, type INTEGER NOT NULL DEFAULT 0, domain TEXT NOT NULL, enabled BOOLEAN NOT NULL DEFAULT 1, date_added INTEGER NOT NULL DEFAULT (cast(strftime('%s', 'now') as int)), date_modified INTEGER NOT NULL DEFAULT (cast(strftime('%s', 'now') as int)), comment TEXT, UNIQUE(domain, type));
+INSERT INTO domainlist VALUES(1,0,'s.youtube.com',1,1610000000,1610000000,'watch history, kids');
+INSERT INTO domainlist VALUES(2,1,'telemetry.tv.example',1,1610000000,1610000000,NULL);
+INSERT INTO domainlist VALUES(3,3,'(\.|^)tiktok\.com$',1,1610000000,1610000000,'it''s noisy');
+INSERT INTO domainlist VALUES(4,0,'old.example.com',0,1610000000,1610000000,NULL);
+INSERT INTO "adlist" VALUES(1,'https://example.com/hosts',1,1610000000,1610000000,NULL);
+COMMIT;
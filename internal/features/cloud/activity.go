@@ -0,0 +1,448 @@
+package cloud
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/events"
+	"github.com/strct-org/strct-agent/internal/httputil"
+)
+
+// Activity log. Uploads, deletes, new folders, moves, restores and share
+// links are appended to DataDir/.activity/activity.jsonl, one JSON object
+// per line, so a household sharing the drive can see who did what:
+//
+//	GET /api/activity?op=delete&path=/photos&limit=50
+//
+// Handlers never wait on the disk: entries go into a buffered channel that
+// one goroutine writes out, and an entry that finds the channel full is
+// dropped and counted. The file is rotated past activityMaxBytes, keeping
+// activityKeep older ones.
+//
+// With a file worker the worker writes the log and serves the route; the
+// agent reads the file for the counts on /api/status, and follows it for
+// the uploads to publish.
+const (
+	activityDirName  = ".activity"
+	activityFileName = "activity.jsonl"
+	activityMaxBytes = 1 << 20
+	activityKeep     = 4 // activity.jsonl.1 … .4
+	activityQueue    = 256
+
+	// workerActivityPoll is how often the agent in front of a file
+	// worker reads what the worker appended to the log.
+	workerActivityPoll = 2 * time.Second
+)
+
+// Operations in the activity log.
+const (
+	opUpload  = "upload"
+	opDelete  = "delete" // to the trash
+	opMkdir   = "mkdir"
+	opMove    = "move"
+	opRestore = "restore" // out of the trash
+	opShare   = "share"
+	opUnshare = "unshare"
+)
+
+var activityOps = []string{opUpload, opDelete, opMkdir, opMove, opRestore, opShare, opUnshare}
+
+// Activity is one line of the activity log.
+type Activity struct {
+	Time   time.Time `json:"time"`
+	Op     string    `json:"op"`
+	Path   string    `json:"path"`             // from the DataDir root
+	To     string    `json:"to,omitempty"`     // move and restore: where it went
+	Size   int64     `json:"size,omitempty"`   // bytes uploaded, deleted or moved
+	Client string    `json:"client,omitempty"` // IP the request came from
+}
+
+type activityMsg struct {
+	a       Activity
+	flushed chan struct{} // set: a flush request, closed once written
+}
+
+type activityLog struct {
+	once    sync.Once
+	ch      chan activityMsg
+	dropped atomic.Uint64
+
+	// Today's uploads and deletes for /api/status. In-process they are
+	// read from the file once and counted as entries are recorded after
+	// that; the agent in front of a file worker re-reads the file.
+	mu        sync.Mutex
+	day       string // local date the counts are for
+	counts    map[string]int
+	countedAt time.Time // last read of the file; zero if never
+}
+
+func (s *Cloud) activityDir() string { return filepath.Join(s.DataDir, activityDirName) }
+
+// logActivity records a for the request r.
+func (s *Cloud) logActivity(r *http.Request, a Activity) {
+	a.Client = clientIP(r)
+	s.recordActivity(a)
+}
+
+// recordActivity queues a for the log without blocking. An upload is
+// published too, logged or not.
+func (s *Cloud) recordActivity(a Activity) {
+	if a.Time.IsZero() {
+		a.Time = time.Now().UTC()
+	}
+	if a.Op == opUpload {
+		s.events.Publish(events.UploadCompleted, a)
+	}
+	al := &s.activity
+	// Queued under al.mu, so it is either in the file when the counts
+	// are first read or counted here.
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	select {
+	case s.activityQueue() <- activityMsg{a: a}:
+	default:
+		if al.dropped.Add(1)%100 == 1 {
+			slog.Warn("cloud: activity log is behind, dropping entries", "dropped", al.dropped.Load())
+		}
+		return
+	}
+	if !al.countedAt.IsZero() {
+		al.rollover(a.Time)
+		al.counts[a.Op]++
+	}
+}
+
+// activityQueue starts the writer on first use.
+func (s *Cloud) activityQueue() chan activityMsg {
+	al := &s.activity
+	al.once.Do(func() {
+		al.ch = make(chan activityMsg, activityQueue)
+		usage.Go(func() { s.writeActivity(al.ch) })
+	})
+	return al.ch
+}
+
+// flushActivity waits until everything queued before it is on disk.
+func (s *Cloud) flushActivity() {
+	done := make(chan struct{})
+	s.activityQueue() <- activityMsg{flushed: done}
+	<-done
+}
+
+// Close cancels the background jobs and writes out what is still
+// buffered: the activity log and pending checksum changes. Call it on
+// shutdown.
+func (s *Cloud) Close() {
+	s.jobs.close()
+	s.flushActivity()
+	s.checksums().close()
+}
+
+// writeActivity appends entries from ch, flushing whenever it catches up.
+func (s *Cloud) writeActivity(ch <-chan activityMsg) {
+	var (
+		f    *os.File
+		w    *bufio.Writer
+		size int64
+	)
+	closeFile := func() {
+		if f != nil {
+			w.Flush()
+			f.Close()
+			f = nil
+		}
+	}
+	for m := range ch {
+		if m.flushed != nil {
+			if w != nil {
+				w.Flush()
+			}
+			close(m.flushed)
+			continue
+		}
+		line, err := json.Marshal(m.a)
+		if err != nil {
+			continue
+		}
+		line = append(line, '\n')
+		if f != nil && size+int64(len(line)) > activityMaxBytes {
+			closeFile()
+			s.rotateActivity()
+		}
+		if f == nil {
+			if f, size, err = s.openActivity(); err != nil {
+				slog.Error("cloud: could not open the activity log", "err", err)
+				continue
+			}
+			w = bufio.NewWriter(f)
+		}
+		w.Write(line) //nolint:errcheck // surfaces on Flush
+		size += int64(len(line))
+		s.trackSize(f.Name(), int64(len(line)))
+		if len(ch) == 0 {
+			if err := w.Flush(); err != nil {
+				slog.Error("cloud: could not write the activity log", "err", err)
+				closeFile()
+			}
+		}
+	}
+}
+
+func (s *Cloud) openActivity() (*os.File, int64, error) {
+	if err := os.MkdirAll(s.activityDir(), 0755); err != nil {
+		return nil, 0, err
+	}
+	f, err := os.OpenFile(filepath.Join(s.activityDir(), activityFileName), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, info.Size(), nil
+}
+
+// rotateActivity shifts activity.jsonl to .1, .1 to .2 and so on, dropping
+// the oldest. The counters follow the removed file.
+func (s *Cloud) rotateActivity() {
+	base := filepath.Join(s.activityDir(), activityFileName)
+	oldest := fmt.Sprintf("%s.%d", base, activityKeep)
+	size := sizeOf(oldest)
+	if os.Remove(oldest) == nil {
+		s.trackSize(oldest, -size)
+	}
+	for i := activityKeep - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", base, i), fmt.Sprintf("%s.%d", base, i+1)) //nolint:errcheck
+	}
+	os.Rename(base, base+".1") //nolint:errcheck
+}
+
+// readActivity returns the logged entries that keep accepts, newest
+// first. Lines that don't parse, such as one being written by the file
+// worker, are skipped.
+func (s *Cloud) readActivity(keep func(Activity) bool) []Activity {
+	base := filepath.Join(s.activityDir(), activityFileName)
+	out := []Activity{}
+	for i := 0; i <= activityKeep; i++ {
+		name := base
+		if i > 0 {
+			name = fmt.Sprintf("%s.%d", base, i)
+		}
+		b, err := os.ReadFile(name)
+		if err != nil {
+			continue
+		}
+		var file []Activity
+		for _, line := range bytes.Split(b, []byte{'\n'}) {
+			var a Activity
+			if len(line) == 0 || json.Unmarshal(line, &a) != nil {
+				continue
+			}
+			if keep(a) {
+				file = append(file, a)
+			}
+		}
+		slices.Reverse(file)
+		out = append(out, file...)
+	}
+	return out
+}
+
+// ─── Uploads through a worker ────────────────────────────────────────────────
+
+// activityTail follows the log as another process appends to it.
+type activityTail struct {
+	file   os.FileInfo // the activity.jsonl being read; nil before it exists
+	offset int64       // past the last whole line read
+}
+
+// watchWorkerUploads publishes the uploads the file worker logs, until
+// ctx is done. Entries logged before it started are not published.
+func (s *Cloud) watchWorkerUploads(ctx context.Context) {
+	var t activityTail
+	s.tailActivity(&t, func(Activity) {})
+	ticker := time.NewTicker(workerActivityPoll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.tailActivity(&t, func(a Activity) {
+				if a.Op == opUpload {
+					s.events.Publish(events.UploadCompleted, a)
+				}
+			})
+		}
+	}
+}
+
+// tailActivity passes fn the entries appended since t. After a rotation
+// the rest of the old file, now activity.jsonl.1, is read first.
+func (s *Cloud) tailActivity(t *activityTail, fn func(Activity)) {
+	base := filepath.Join(s.activityDir(), activityFileName)
+	cur, err := os.Stat(base)
+	if err != nil {
+		cur = nil
+	}
+	if t.file != nil && (cur == nil || !os.SameFile(t.file, cur)) {
+		if old, err := os.Stat(base + ".1"); err == nil && os.SameFile(t.file, old) {
+			readActivityFrom(base+".1", t.offset, fn)
+		}
+		t.offset = 0
+	}
+	t.file = cur
+	if cur != nil {
+		t.offset = readActivityFrom(base, t.offset, fn)
+	}
+}
+
+// readActivityFrom passes fn each whole line of name past offset and
+// returns the offset after the last one. A line still being written is
+// left for the next read.
+func readActivityFrom(name string, offset int64, fn func(Activity)) int64 {
+	f, err := os.Open(name)
+	if err != nil {
+		return offset
+	}
+	defer f.Close()
+	b, err := io.ReadAll(io.NewSectionReader(f, offset, 1<<62))
+	if err != nil {
+		return offset
+	}
+	end := bytes.LastIndexByte(b, '\n')
+	if end < 0 {
+		return offset
+	}
+	for _, line := range bytes.Split(b[:end], []byte{'\n'}) {
+		var a Activity
+		if json.Unmarshal(line, &a) == nil {
+			fn(a)
+		}
+	}
+	return offset + int64(end) + 1
+}
+
+// ─── Today's counts ──────────────────────────────────────────────────────────
+
+// rollover resets the counts at local midnight. Callers hold al.mu.
+func (al *activityLog) rollover(now time.Time) {
+	if day := now.Local().Format(time.DateOnly); day != al.day {
+		al.day, al.counts = day, map[string]int{}
+	}
+}
+
+// activityToday returns today's count of each operation.
+func (s *Cloud) activityToday() map[string]int {
+	al := &s.activity
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	now := time.Now()
+	// Read the file the first time, and in front of a worker, which
+	// writes it, once it is older than the usage figures next to it.
+	if al.countedAt.IsZero() || s.worker != nil && now.Sub(al.countedAt) > statusUsageTTL {
+		if s.worker == nil {
+			s.flushActivity() // the writer never takes al.mu
+		}
+		midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+		al.day, al.counts = now.Format(time.DateOnly), map[string]int{}
+		for _, a := range s.readActivity(func(a Activity) bool { return !a.Time.Before(midnight) }) {
+			al.counts[a.Op]++
+		}
+		al.countedAt = now
+	}
+	al.rollover(now)
+	return maps.Clone(al.counts)
+}
+
+// ─── GET /api/activity ───────────────────────────────────────────────────────
+
+// handleActivity lists the log, newest first, as a httputil.Page.
+// ?op= takes one operation or a comma-separated list, ?path= a folder or
+// file whose entries to show (a move counts for both ends).
+func (s *Cloud) handleActivity(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var ops []string
+	if v := q.Get("op"); v != "" {
+		ops = strings.Split(v, ",")
+		for _, op := range ops {
+			if !slices.Contains(activityOps, op) {
+				httputil.BadRequest(w, fmt.Sprintf("op must be one of %s", strings.Join(activityOps, ", ")))
+				return
+			}
+		}
+	}
+	prefix := ""
+	if v := q.Get("path"); v != "" && v != "/" {
+		prefix = "/" + strings.Trim(filepath.ToSlash(filepath.Clean("/"+v)), "/")
+	}
+	under := func(p string) bool {
+		return p != "" && (p == prefix || strings.HasPrefix(p, prefix+"/"))
+	}
+
+	s.flushActivity()
+	items := s.readActivity(func(a Activity) bool {
+		if ops != nil && !slices.Contains(ops, a.Op) {
+			return false
+		}
+		return prefix == "" || under(a.Path) || under(a.To)
+	})
+	page, err := httputil.Paginate(r, items)
+	if err != nil {
+		httputil.BadRequest(w, err.Error())
+		return
+	}
+	httputil.OK(w, page)
+}
+
+// clientIP is the address r came from. The file worker gets its requests
+// over a unix socket from the agent's proxy, which sets X-Forwarded-For.
+func clientIP(r *http.Request) string {
+	if ip := httputil.ClientAddr(r); ip != "" {
+		return ip
+	}
+	if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+		parts := strings.Split(fwd, ",")
+		return strings.TrimSpace(parts[len(parts)-1])
+	}
+	return ""
+}
+
+// apiPath is full as the API names it: slash-separated from the DataDir
+// root.
+func (s *Cloud) apiPath(full string) string {
+	rel, err := filepath.Rel(s.DataDir, full)
+	if err != nil || rel == "." {
+		return "/"
+	}
+	return "/" + filepath.ToSlash(rel)
+}
+
+// clientKey carries a request's client IP to the WebDAV file system,
+// which sees only the context.
+type clientKey struct{}
+
+func withClient(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), clientKey{}, clientIP(r)))
+}
+
+func clientFrom(ctx context.Context) string {
+	ip, _ := ctx.Value(clientKey{}).(string)
+	return ip
+}
@@ -0,0 +1,222 @@
+package cloud
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/events"
+	"github.com/strct-org/strct-agent/internal/httputil"
+)
+
+func activityOf(t *testing.T, mux http.Handler, query string) httputil.Page[Activity] {
+	t.Helper()
+	w := do(t, mux, "GET", "/api/activity"+query, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("activity%s: %d %s", query, w.Code, w.Body)
+	}
+	var page httputil.Page[Activity]
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+		t.Fatalf("decode %s: %v", w.Body, err)
+	}
+	return page
+}
+
+func opsOf(items []Activity) []string {
+	var ops []string
+	for _, a := range items {
+		ops = append(ops, a.Op+" "+a.Path)
+	}
+	return ops
+}
+
+func TestActivity_RecordsAndFilters(t *testing.T) {
+	c, mux := newUploadMux(t)
+	writeFiles(t, c.DataDir, map[string]string{"notes.txt": "hello"})
+
+	if w := do(t, mux, "POST", "/api/mkdir", `{"path":"/","name":"photos"}`); w.Code >= 300 {
+		t.Fatalf("mkdir: %d %s", w.Code, w.Body)
+	}
+	if w := uploadAs(t, mux, "path=/photos", "beach.jpg", "jpeg"); w.Code >= 300 {
+		t.Fatalf("upload: %d %s", w.Code, w.Body)
+	}
+	if w := do(t, mux, "POST", "/api/move", `{"from":"/notes.txt","to":"/photos/notes.txt"}`); w.Code != http.StatusOK {
+		t.Fatalf("move: %d %s", w.Code, w.Body)
+	}
+	if w := do(t, mux, "DELETE", "/api/delete?path=/photos/beach.jpg", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("delete: %d %s", w.Code, w.Body)
+	}
+
+	page := activityOf(t, mux, "")
+	got := fmt.Sprint(opsOf(page.Items))
+	want := "[delete /photos/beach.jpg move /notes.txt upload /photos/beach.jpg mkdir /photos]"
+	if got != want {
+		t.Fatalf("activity = %s, want %s (newest first)", got, want)
+	}
+	if del := page.Items[0]; del.Size != 4 || del.Client != "192.0.2.1" || del.Time.IsZero() {
+		t.Errorf("delete entry = %+v, want size 4 from httptest's client", del)
+	}
+	if mv := page.Items[1]; mv.To != "/photos/notes.txt" || mv.Size != 5 {
+		t.Errorf("move entry = %+v", mv)
+	}
+
+	if got := opsOf(activityOf(t, mux, "?op=delete").Items); fmt.Sprint(got) != "[delete /photos/beach.jpg]" {
+		t.Errorf("?op=delete = %v", got)
+	}
+	if got := opsOf(activityOf(t, mux, "?op=upload,mkdir").Items); len(got) != 2 {
+		t.Errorf("?op=upload,mkdir = %v", got)
+	}
+	// A move shows under both its ends.
+	if got := opsOf(activityOf(t, mux, "?path=/notes.txt").Items); fmt.Sprint(got) != "[move /notes.txt]" {
+		t.Errorf("?path=/notes.txt = %v", got)
+	}
+	if got := opsOf(activityOf(t, mux, "?path=/photos").Items); len(got) != 4 {
+		t.Errorf("?path=/photos = %v, want all four", got)
+	}
+
+	page = activityOf(t, mux, "?limit=2&offset=1")
+	if page.Pagination.Total != 4 || fmt.Sprint(opsOf(page.Items)) != "[move /notes.txt upload /photos/beach.jpg]" {
+		t.Errorf("page 2 = %+v", page)
+	}
+
+	if w := do(t, mux, "GET", "/api/activity?op=chmod", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown op: %d, want 400", w.Code)
+	}
+}
+
+func TestActivity_ShareAndRestore(t *testing.T) {
+	c, mux := newUploadMux(t)
+	writeFiles(t, c.DataDir, map[string]string{"a.txt": "a"})
+
+	sh := createShare(t, mux, `{"path":"/a.txt"}`)
+	if w := do(t, mux, "DELETE", "/api/share/"+sh.Token, ""); w.Code != http.StatusNoContent {
+		t.Fatalf("revoke: %d %s", w.Code, w.Body)
+	}
+	do(t, mux, "DELETE", "/api/delete?path=/a.txt", "")
+	item := listTrash(t, mux).Items[0]
+	if w := do(t, mux, "POST", "/api/trash/restore", `{"path":"`+item.Path+`"}`); w.Code != http.StatusOK {
+		t.Fatalf("restore: %d %s", w.Code, w.Body)
+	}
+
+	// The restore is listed under the file's own path through To.
+	page := activityOf(t, mux, "?path=/a.txt")
+	got := fmt.Sprint(opsOf(page.Items))
+	if want := "[restore " + item.Path + " delete /a.txt unshare /a.txt share /a.txt]"; got != want {
+		t.Errorf("activity = %s, want %s", got, want)
+	}
+	if restore := page.Items[0]; restore.To != "/a.txt" || restore.Size != 1 {
+		t.Errorf("restore entry = %+v", restore)
+	}
+}
+
+func TestActivity_Rotates(t *testing.T) {
+	c, _ := newUploadMux(t)
+	// Enough entries to fill the cap a few times over.
+	long := "/" + strings.Repeat("x", 200)
+	n := activityMaxBytes / 200 * 3
+	for i := range n {
+		c.recordActivity(Activity{Op: opUpload, Path: long, Size: int64(i)})
+		if i%activityQueue == 0 {
+			c.flushActivity() // keep the queue from dropping any
+		}
+	}
+	c.Close()
+
+	base := filepath.Join(c.activityDir(), activityFileName)
+	for _, name := range []string{base, base + ".1", base + ".2"} {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatalf("%s: %v", filepath.Base(name), err)
+		}
+		if info.Size() > activityMaxBytes {
+			t.Errorf("%s is %d bytes, past the %d cap", filepath.Base(name), info.Size(), activityMaxBytes)
+		}
+	}
+	all := c.readActivity(func(Activity) bool { return true })
+	if len(all) != n || all[0].Size != int64(n-1) || all[n-1].Size != 0 {
+		t.Errorf("read back %d entries, want %d newest first", len(all), n)
+	}
+}
+
+func TestActivity_StatusCountsToday(t *testing.T) {
+	c, mux := newUploadMux(t)
+	writeFiles(t, c.DataDir, map[string]string{"a.txt": "a", "b.txt": "b"})
+	// Yesterday's entries don't count.
+	c.recordActivity(Activity{Op: opDelete, Path: "/old.txt", Time: time.Now().AddDate(0, 0, -1)})
+
+	uploadAs(t, mux, "path=/", "c.txt", "c")
+	do(t, mux, "DELETE", "/api/delete?path=/a.txt", "")
+	if st := statusOf(t, mux); st.UploadsToday != 1 || st.DeletesToday != 1 {
+		t.Fatalf("status = %d uploads, %d deletes today, want 1 and 1", st.UploadsToday, st.DeletesToday)
+	}
+	// Counted as they happen once the file has been read.
+	do(t, mux, "DELETE", "/api/delete?path=/b.txt", "")
+	if st := statusOf(t, mux); st.DeletesToday != 2 {
+		t.Errorf("deletes today = %d, want 2", st.DeletesToday)
+	}
+}
+
+func TestActivity_PublishesUploads(t *testing.T) {
+	c, mux := newUploadMux(t)
+	bus := events.New()
+	sub := bus.Subscribe(4)
+	defer sub.Close()
+	c.events = bus
+
+	uploadAs(t, mux, "path=/", "c.txt", "c")
+	do(t, mux, "POST", "/api/mkdir", `{"path":"/","name":"photos"}`)
+
+	if len(sub.C) != 1 {
+		t.Fatalf("published %d events, want the upload only", len(sub.C))
+	}
+	e := <-sub.C
+	if a, ok := e.Payload.(Activity); e.Type != events.UploadCompleted || !ok || a.Path != "/c.txt" || a.Size != 1 {
+		t.Errorf("event = %+v", e)
+	}
+}
+
+// TestTailActivity follows the log the way the agent in front of a file
+// worker does, across a rotation and a line caught half written.
+func TestTailActivity(t *testing.T) {
+	c := New(t.TempDir(), 8080, true)
+	base := filepath.Join(c.activityDir(), activityFileName)
+	if err := os.MkdirAll(c.activityDir(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	appendLines := func(name string, lines ...string) {
+		t.Helper()
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		for _, l := range lines {
+			f.WriteString(l)
+		}
+	}
+	entry := func(path string) string { return `{"op":"upload","path":"` + path + `"}` + "\n" }
+
+	var tail activityTail
+	var got []string
+	read := func() { c.tailActivity(&tail, func(a Activity) { got = append(got, a.Path) }) }
+
+	read() // no log yet
+	appendLines(base, entry("/a"), `{"op":"upl`)
+	read()
+	appendLines(base, `oad","path":"/b"}`+"\n", entry("/c"))
+	if err := os.Rename(base, base+".1"); err != nil {
+		t.Fatal(err)
+	}
+	appendLines(base, entry("/d"))
+	read()
+	read()
+
+	if fmt.Sprint(got) != "[/a /b /c /d]" {
+		t.Errorf("tailed %v, want [/a /b /c /d]", got)
+	}
+}
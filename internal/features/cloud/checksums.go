@@ -0,0 +1,287 @@
+package cloud
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/statefile"
+)
+
+// File checksums. Every file written through the API gets a SHA-256
+// recorded in DataDir/.checksums/checksums.json, keyed by its path from
+// the DataDir root, together with the size and modification time it had
+// when it was hashed. Moves, deletes and restores carry the entry along;
+// the trash keeps it under the item's trash path.
+//
+// The index is kept in memory. A change is written out after
+// checksumFlushDelay, so a folder of a thousand photos is one write, not a
+// thousand; Start sets the delay, and without it (tests, the worker
+// before Start) every change is written at once.
+//
+// POST /api/verify re-reads files and compares; see verify.go.
+const (
+	checksumsDirName   = ".checksums"
+	checksumFlushDelay = 5 * time.Second
+)
+
+// checksumsSchema versions checksums.json.
+//
+//	v1: checksumIndex as-is
+var checksumsSchema = statefile.Schema{
+	Name:       "cloud-checksums",
+	Migrations: []statefile.Migration{statefile.Stamp},
+}
+
+// checksum is what was recorded for one file.
+type checksum struct {
+	SHA256  string    `json:"sha256"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// current reports whether info still describes the file that was hashed.
+// A file changed outside the API no longer matches and is re-hashed, not
+// reported as corrupt.
+func (c checksum) current(info os.FileInfo) bool {
+	return c.Size == info.Size() && c.ModTime.Equal(info.ModTime())
+}
+
+type checksumIndex struct {
+	Files map[string]checksum `json:"files"`
+}
+
+type checksumStore struct {
+	mu     sync.Mutex
+	path   string
+	files  map[string]checksum // nil until loaded
+	delay  time.Duration       // 0: save on every change
+	timer  *time.Timer
+	closed bool
+}
+
+// checksums returns s's store, pointed at DataDir on first use: New
+// does not know the final DataDir yet.
+func (s *Cloud) checksums() *checksumStore {
+	cs := &s.sums
+	cs.mu.Lock()
+	if cs.path == "" {
+		cs.path = filepath.Join(s.DataDir, checksumsDirName, "checksums.json")
+	}
+	cs.mu.Unlock()
+	return cs
+}
+
+// sumKey is full's key in the index: its path from the DataDir root.
+func (s *Cloud) sumKey(full string) string {
+	rel, err := filepath.Rel(s.DataDir, full)
+	if err != nil {
+		return "" // matches nothing
+	}
+	if rel == "." {
+		return "/"
+	}
+	return "/" + filepath.ToSlash(rel)
+}
+
+// load reads the index the first time it is needed. mu must be held.
+func (cs *checksumStore) load() {
+	if cs.files != nil {
+		return
+	}
+	var idx checksumIndex
+	if err := statefile.Load(cs.path, checksumsSchema, &idx); err != nil && !statefile.Fresh(err) {
+		slog.Warn("cloud: could not read checksums, starting over", "err", err)
+	}
+	cs.files = idx.Files
+	if cs.files == nil {
+		cs.files = map[string]checksum{}
+	}
+}
+
+// changed saves now or schedules a save. mu must be held.
+func (cs *checksumStore) changed() {
+	if cs.delay <= 0 || cs.closed {
+		cs.saveLocked()
+		return
+	}
+	if cs.timer == nil {
+		cs.timer = time.AfterFunc(cs.delay, cs.flush)
+	}
+}
+
+// flush writes pending changes.
+func (cs *checksumStore) flush() {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.timer == nil {
+		return
+	}
+	cs.saveLocked()
+}
+
+func (cs *checksumStore) saveLocked() {
+	if cs.timer != nil {
+		cs.timer.Stop()
+		cs.timer = nil
+	}
+	if err := os.MkdirAll(filepath.Dir(cs.path), 0700); err != nil {
+		slog.Error("cloud: could not save checksums", "err", err)
+		return
+	}
+	if err := statefile.Save(cs.path, checksumsSchema, checksumIndex{Files: cs.files}); err != nil {
+		slog.Error("cloud: could not save checksums", "err", err)
+	}
+}
+
+// startChecksums batches index writes until ctx is done.
+func (s *Cloud) startChecksums(ctx context.Context) {
+	cs := s.checksums()
+	cs.mu.Lock()
+	cs.delay = checksumFlushDelay
+	cs.mu.Unlock()
+	context.AfterFunc(ctx, cs.close)
+}
+
+// close writes pending changes and saves every later one at once.
+func (cs *checksumStore) close() {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.closed = true
+	if cs.timer != nil {
+		cs.saveLocked()
+	}
+}
+
+func (cs *checksumStore) get(key string) (checksum, bool) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.load()
+	c, ok := cs.files[key]
+	return c, ok
+}
+
+func (cs *checksumStore) set(key string, c checksum) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.load()
+	cs.files[key] = c
+	cs.changed()
+}
+
+// move re-keys the entry for from, or every entry under it if it is a
+// folder, to to. Entries already under to are dropped: to was replaced.
+func (cs *checksumStore) move(from, to string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.load()
+	moved := map[string]checksum{}
+	n := 0
+	for k, c := range cs.files {
+		if _, ok := underKey(k, to); ok {
+			delete(cs.files, k)
+			n++
+		}
+		if rest, ok := underKey(k, from); ok {
+			moved[to+rest] = c
+			delete(cs.files, k)
+			n++
+		}
+	}
+	for k, c := range moved {
+		cs.files[k] = c
+	}
+	if n > 0 {
+		cs.changed()
+	}
+}
+
+// remove drops the entry for key and every entry under it.
+func (cs *checksumStore) remove(key string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.load()
+	n := 0
+	for k := range cs.files {
+		if _, ok := underKey(k, key); ok {
+			delete(cs.files, k)
+			n++
+		}
+	}
+	if n > 0 {
+		cs.changed()
+	}
+}
+
+// prune drops the entries under key that gone reports as deleted, and
+// returns how many.
+func (cs *checksumStore) prune(key string, gone func(string) bool) int {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.load()
+	n := 0
+	for k := range cs.files {
+		if _, ok := underKey(k, key); ok && gone(k) {
+			delete(cs.files, k)
+			n++
+		}
+	}
+	if n > 0 {
+		cs.changed()
+	}
+	return n
+}
+
+// underKey reports whether k is key or inside it, and the rest of k.
+func underKey(k, key string) (string, bool) {
+	if key == "" {
+		return "", false
+	}
+	if k == key {
+		return "", true
+	}
+	if key == "/" {
+		return k, true
+	}
+	if rest, ok := strings.CutPrefix(k, key); ok && strings.HasPrefix(rest, "/") {
+		return rest, true
+	}
+	return "", false
+}
+
+// ─── Hooks for the file handlers ─────────────────────────────────────────────
+
+// recordSum stores sum, hex, for the file now at full.
+func (s *Cloud) recordSum(full, sum string) {
+	info, err := os.Stat(full)
+	if err != nil {
+		return
+	}
+	s.checksums().set(s.sumKey(full), checksum{
+		SHA256:  sum,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	})
+}
+
+func (s *Cloud) moveSums(from, to string) {
+	s.checksums().move(s.sumKey(from), s.sumKey(to))
+}
+
+func (s *Cloud) dropSums(full string) {
+	s.checksums().remove(s.sumKey(full))
+}
+
+// fileSum returns the recorded SHA-256 of full if it still describes the
+// file, for FileItem.
+func (s *Cloud) fileSum(full string, info os.FileInfo) string {
+	c, ok := s.checksums().get(s.sumKey(full))
+	if !ok || !c.current(info) {
+		return ""
+	}
+	return c.SHA256
+}
@@ -2,21 +2,47 @@ package cloud
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"mime/multipart"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/strct-org/strct-agent/internal/apidoc"
 	"github.com/strct-org/strct-agent/internal/config"
+	"github.com/strct-org/strct-agent/internal/events"
 	"github.com/strct-org/strct-agent/internal/httputil"
 	"github.com/strct-org/strct-agent/internal/humanize"
+	"github.com/strct-org/strct-agent/internal/latency"
+	"github.com/strct-org/strct-agent/internal/maintenance"
 	"github.com/strct-org/strct-agent/internal/netx"
 	"github.com/strct-org/strct-agent/internal/platform/disk"
+	"github.com/strct-org/strct-agent/internal/platform/executil"
+	"github.com/strct-org/strct-agent/internal/resources"
+	"github.com/strct-org/strct-agent/internal/throttle"
+)
+
+// usage accounts cloud transfers for /api/system/resources.
+var usage = resources.For("cloud")
+
+// Phases the handlers mark for the slow-request log; see latency.Mark.
+const (
+	phaseResolve = "resolve" // request path to a path under DataDir
+	phaseReadDir = "readdir"
+	phaseStat    = "stat" // per-entry info and checksums
+	phaseSearch  = "search"
+	phaseUsage   = "usage"
+	phaseEncode  = "encode"
 )
 
 // Cloud manages local file storage and exposes it over HTTP.
@@ -26,24 +52,136 @@ type Cloud struct {
 	DataDir   string
 	Port      int
 	IsDev     bool
+
+	// RealHardware lets initFileSystem look for a data drive and mount
+	// it; see config.UseRealHardware.
+	RealHardware bool
+
+	// StorageDecisionPath is the drive choice saved by the setup wizard.
+	// Empty, or no file there, means auto-detect.
+	StorageDecisionPath string
+
+	// governor caps uploads and downloads so DNS and API traffic keep
+	// some of the link. nil: uncapped.
+	governor *throttle.Governor
+
+	// worker serves the file routes from a separate process. nil: they
+	// are handled in-process.
+	worker http.Handler
+
+	// events is where completed uploads are published; see activity.go.
+	events events.Publisher
+
+	// gate holds maintenance background jobs in maintenance mode. nil:
+	// never held.
+	gate *maintenance.Gate
+
+	// cmd mounts attached folders; see external.go. nil: a symlink
+	// stands in for the mount, as in dev mode.
+	cmd commander
+	// mountInfo is the mount table attached folders are checked against.
+	mountInfo string
+
+	uploadMu   sync.Mutex
+	uploadBusy map[string]bool // resumable upload ids with a request in flight
+
+	shareMu      sync.Mutex           // serialises read-modify-write of shares.json
+	shareReaders map[string]time.Time // token and client → last request; see handleShareDownload
+
+	layoutMu sync.RWMutex
+	layout   layoutState // see layout.go
+	adopt    *AdoptJob   // the last adopt-layout job; nil if none ran
+
+	// TrashRetention is how long deleted items stay in the trash. 0 keeps
+	// them until the trash is emptied.
+	TrashRetention time.Duration
+
+	// ThumbCacheCap is the size DataDir/.thumbs is pruned back under.
+	// 0: unbounded.
+	ThumbCacheCap int64
+
+	// UploadReserve and UploadReservePercent of the drive, whichever is
+	// larger, are kept free: uploads that would use them get 507. See
+	// quota.go.
+	UploadReserve        int64
+	UploadReservePercent float64
+	// SystemReserve and SystemReservePercent, whichever is larger, are
+	// kept free when DataDir is on the same filesystem as /. See
+	// quota.go.
+	SystemReserve        int64
+	SystemReservePercent float64
+
+	// VerifyReadRate caps how fast POST /api/verify reads the drive, in
+	// bytes per second. 0: uncapped.
+	VerifyReadRate int64
+
+	// DAVUser and DAVPassword guard /dav/. No password: WebDAV is off.
+	DAVUser     string
+	DAVPassword string
+
+	// JobWorkers run the background jobs, and JobPace is the pause after
+	// each maintenance job; see jobs.go.
+	JobWorkers int
+	JobPace    time.Duration
+
+	storage  usageCounters // bytes per category, see storage.go
+	index    searchIndex   // names under DataDir, see search.go
+	sums     checksumStore // SHA-256 per file, see checksums.go
+	verify   verifyJobs    // see verify.go
+	activity activityLog   // see activity.go
+	jobs     jobQueue      // see jobs.go
+	attach   attachments   // see external.go
 }
 
-// StatusResponse is the JSON shape returned by /api/status.
+// StatusResponse is the JSON shape returned by /api/v1/status.
 type StatusResponse struct {
 	Uptime   int64  `json:"uptime"`
 	IP       string `json:"ip"`
-	Used     uint64 `json:"used"`
+	Used     uint64 `json:"used"`  // everything but the trash
+	Trash    uint64 `json:"trash"` // deleted items, freed by emptying the trash
 	Total    uint64 `json:"total"`
-	IsOnline bool   `json:"isOnline"`
+	IsOnline bool   `json:"is_online"`
+	Quota    *Quota `json:"quota,omitempty"` // nil if the drive size is unknown
+	// ComputedAt is when Used and Trash were last measured in full; they
+	// are kept current between measurements but may lag behind changes
+	// made outside the API.
+	ComputedAt time.Time `json:"computed_at"`
+	// Uploads and deletes since local midnight, from the activity log.
+	UploadsToday int `json:"uploads_today"`
+	DeletesToday int `json:"deletes_today"`
 }
 
-// FilesResponse is the JSON shape returned by /api/files.
-type FilesResponse struct {
-	Files []FileItem `json:"files"`
+// FileItem represents a single file or folder entry. /api/v1/files
+// returns a httputil.Page of these.
+type FileItem struct {
+	Name       string `json:"name"`
+	Size       string `json:"size"`
+	Type       string `json:"type"`
+	ModifiedAt string `json:"modified_at"`
+	SHA256     string `json:"sha256,omitempty"` // recorded on upload; "" if none or the file changed since
+	Status     string `json:"status,omitempty"` // an attached folder's, in /external; see external.go
 }
 
-// FileItem represents a single file or folder entry.
-type FileItem struct {
+// The legacy /api/status and /api/files shapes predate the snake_case
+// convention and are kept for existing clients.
+type legacyStatusResponse struct {
+	Uptime       int64     `json:"uptime"`
+	IP           string    `json:"ip"`
+	Used         uint64    `json:"used"`
+	Trash        uint64    `json:"trash"`
+	Total        uint64    `json:"total"`
+	IsOnline     bool      `json:"isOnline"`
+	Quota        *Quota    `json:"quota,omitempty"`
+	ComputedAt   time.Time `json:"computedAt"`
+	UploadsToday int       `json:"uploadsToday"`
+	DeletesToday int       `json:"deletesToday"`
+}
+
+type legacyFilesResponse struct {
+	Files []legacyFileItem `json:"files"`
+}
+
+type legacyFileItem struct {
 	Name       string `json:"name"`
 	Size       string `json:"size"`
 	Type       string `json:"type"`
@@ -53,14 +191,39 @@ type FileItem struct {
 // New is the base constructor. Prefer NewFromConfig in application code.
 func New(dataDir string, port int, isDev bool) *Cloud {
 	return &Cloud{
-		DataDir: dataDir,
-		Port:    port,
-		IsDev:   isDev,
+		DataDir:              dataDir,
+		Port:                 port,
+		IsDev:                isDev,
+		TrashRetention:       config.DefaultTrashRetentionDays * 24 * time.Hour,
+		ThumbCacheCap:        defaultThumbCacheCap,
+		UploadReserve:        config.DefaultUploadReserveGB << 30,
+		UploadReservePercent: config.DefaultUploadReservePercent,
+		SystemReserve:        config.DefaultSystemReserveGB << 30,
+		SystemReservePercent: config.DefaultSystemReservePercent,
+		VerifyReadRate:       defaultVerifyReadRate,
+		JobWorkers:           config.DefaultCloudJobWorkers,
+		JobPace:              config.DefaultCloudJobPaceMs * time.Millisecond,
+		mountInfo:            mountInfoPath,
+		events:               events.Discard,
 	}
 }
 
-func NewFromConfig(cfg *config.Config) (*Cloud, error) {
-	c := New(cfg.DataDir, 8080, cfg.IsDev)
+// NewFromConfig is the agent's cloud. Completed uploads are published to
+// pub as events.UploadCompleted.
+func NewFromConfig(cfg *config.Config, governor *throttle.Governor, pub events.Publisher) (*Cloud, error) {
+	c := New(cfg.DataDir, config.APIPort, cfg.IsDev)
+	c.RealHardware = cfg.UseRealHardware()
+	c.StorageDecisionPath = cfg.StorageDecisionPath()
+	c.governor = governor
+	c.events = pub
+	c.TrashRetention = time.Duration(cfg.TrashRetentionDays) * 24 * time.Hour
+	c.UploadReserve, c.UploadReservePercent = cfg.UploadReserve, cfg.UploadReservePercent
+	c.SystemReserve, c.SystemReservePercent = cfg.SystemReserve, cfg.SystemReservePercent
+	c.DAVUser, c.DAVPassword = cfg.WebDAVUser, cfg.WebDAVPassword
+	c.JobWorkers, c.JobPace = cfg.CloudJobWorkers, cfg.CloudJobPace
+	if c.RealHardware {
+		c.cmd = executil.NewRealRunner()
+	}
 	if err := c.initFileSystem(); err != nil {
 		return nil, err
 	}
@@ -75,47 +238,242 @@ func NewFromConfig_Test(dataDir string) (*Cloud, error) {
 	return c, nil
 }
 
-func (s *Cloud) Start(_ context.Context) error {
+// Name is the feature's name in the agent's start order.
+func (s *Cloud) Name() string { return "cloud" }
+
+// Start runs the hourly upkeep of DataDir: expiring stale uploads, old
+// trash, share and upload links, and reconciling the storage counters.
+// With a file worker the worker owns DataDir and the counters, so it runs
+// this instead. Attached folders are mounted again hourly either way.
+func (s *Cloud) Start(ctx context.Context) error {
+	// Mounting is the agent's job, worker or not: drives come and go.
+	usage.Go(func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s.refreshAttached()
+			}
+		}
+	})
+	if s.worker != nil {
+		usage.Go(func() { s.watchWorkerUploads(ctx) })
+		return nil
+	}
+	s.startChecksums(ctx)
+	usage.Go(func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for {
+			s.expireUploads(time.Now())
+			s.expireTrash(time.Now())
+			s.expireShares(time.Now())
+			s.expireUploadLinks(time.Now())
+			// A walk of a large tree takes a while; shutdown doesn't
+			// wait for it.
+			select {
+			case <-ctx.Done():
+				return
+			case <-s.refreshUsage():
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	})
+	usage.Go(func() {
+		ticker := time.NewTicker(searchIndexRefresh)
+		defer ticker.Stop()
+		for {
+			s.queueIndex()
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	})
 	return nil
 }
 
+// fileRoute is a route whose handler reads or writes DataDir. Transfer
+// routes carry file bodies and are paced by the governor.
+type fileRoute struct {
+	pattern  string
+	transfer bool
+}
+
+var fileRoutes = []fileRoute{
+	{"GET /api/files", false},
+	{"POST /api/mkdir", false},
+	{"DELETE /api/delete", false},
+	{"POST /api/move", false},
+	{"POST /strct_agent/fs/upload", true},
+	{"/files/", true},
+	{"GET /api/uploads", false},
+	{"POST /api/upload/init", false},
+	{"GET /api/upload/{id}", false},
+	{"PUT /api/upload/{id}", true},
+	{"POST /api/upload/{id}/complete", false},
+	{"DELETE /api/upload/{id}", false},
+	{"GET /api/download", true},
+	{"GET /api/storage", false},
+	{"POST /api/trash/empty", false},
+	{"GET /api/trash", false},
+	{"POST /api/trash/restore", false},
+	{"DELETE /api/trash", false},
+	{"POST /api/storage/clear-cache", false},
+	{"GET /api/search", false},
+	{"GET /api/thumb", false},
+	{"GET /api/files/layout", false},
+	{"POST /api/files/layout", false},
+	{"POST /api/files/layout/users", false},
+	{"POST /api/files/adopt-layout", false},
+	{"GET /api/files/adopt-layout", false},
+	{"POST /api/share", false},
+	{"GET /api/share", false},
+	{"DELETE /api/share/{token}", false},
+	{"GET /share/{token}", true},
+	{"POST /api/share/upload-link", false},
+	{"GET /api/share/upload-link", false},
+	{"DELETE /api/share/upload-link/{id}", false},
+	{"GET /api/share/upload-link/{id}/activity", false},
+	{"GET /u/{token}", false},
+	{"POST /u/{token}", true},
+	{"POST /api/verify", false},
+	{"GET /api/verify/{id}", false},
+	{"GET /api/activity", false},
+	{davPrefix, true},
+	{davPrefix + "/", true},
+}
+
 func (s *Cloud) RegisterRoutes(mux *http.ServeMux) {
-	mux.HandleFunc("GET /api/status", s.handleStatus)
-	mux.HandleFunc("GET /api/files", s.handleFiles)
-	mux.HandleFunc("POST /api/mkdir", s.handleMkdir)
-	mux.HandleFunc("DELETE /api/delete", s.handleDelete)
-	mux.HandleFunc("POST /strct_agent/fs/upload", s.handleUpload)
-	mux.Handle("/files/", http.StripPrefix("/files/", http.FileServer(http.Dir(s.DataDir))))
+	r := apidoc.On(mux, "cloud")
+	r.Register("GET", "/api/status", s.handleStatus, statusDoc)
+	// Mounting needs root, so these stay in the agent; see external.go.
+	r.Register("GET", "/api/storage/attach", s.handleListAttached, attachDocs["GET /api/storage/attach"])
+	r.Register("POST", "/api/storage/attach", s.handleAttach, attachDocs["POST /api/storage/attach"])
+	r.Register("DELETE", "/api/storage/attach/{name}", s.handleDetach, attachDocs["DELETE /api/storage/attach/{name}"])
+	if s.worker != nil {
+		// The proxy's routes are documented here, in the agent.
+		for _, route := range fileRoutes {
+			route.handle(r, s.pace(route, s.worker))
+		}
+		return
+	}
+	s.RegisterFileRoutes(mux)
+}
+
+// RegisterFileRoutes registers the in-process handlers for the routes that
+// touch DataDir. The file worker process serves exactly these.
+func (s *Cloud) RegisterFileRoutes(mux *http.ServeMux) {
+	dav := s.handleDAV()
+	handlers := map[string]http.Handler{
+		"GET /api/files":                           http.HandlerFunc(s.handleFiles),
+		"POST /api/mkdir":                          http.HandlerFunc(s.handleMkdir),
+		"DELETE /api/delete":                       http.HandlerFunc(s.handleDelete),
+		"POST /api/move":                           http.HandlerFunc(s.handleMove),
+		"POST /strct_agent/fs/upload":              http.HandlerFunc(s.handleUpload),
+		"/files/":                                  http.StripPrefix("/files/", s.hideUploads(http.FileServer(http.Dir(s.DataDir)))),
+		"GET /api/uploads":                         http.HandlerFunc(s.handleListUploads),
+		"POST /api/upload/init":                    http.HandlerFunc(s.handleUploadInit),
+		"GET /api/upload/{id}":                     http.HandlerFunc(s.handleGetUpload),
+		"PUT /api/upload/{id}":                     http.HandlerFunc(s.handleUploadChunk),
+		"POST /api/upload/{id}/complete":           http.HandlerFunc(s.handleUploadComplete),
+		"DELETE /api/upload/{id}":                  http.HandlerFunc(s.handleCancelUpload),
+		"GET /api/download":                        http.HandlerFunc(s.handleDownload),
+		"GET /api/storage":                         http.HandlerFunc(s.handleStorage),
+		"POST /api/trash/empty":                    http.HandlerFunc(s.handleEmptyTrash),
+		"GET /api/trash":                           http.HandlerFunc(s.handleListTrash),
+		"POST /api/trash/restore":                  http.HandlerFunc(s.handleRestoreTrash),
+		"DELETE /api/trash":                        http.HandlerFunc(s.handleDeleteTrash),
+		"POST /api/storage/clear-cache":            http.HandlerFunc(s.handleClearCache),
+		"GET /api/search":                          http.HandlerFunc(s.handleSearch),
+		"GET /api/thumb":                           http.HandlerFunc(s.handleThumb),
+		"GET /api/files/layout":                    http.HandlerFunc(s.handleGetLayout),
+		"POST /api/files/layout":                   http.HandlerFunc(s.handleEnableLayout),
+		"POST /api/files/layout/users":             http.HandlerFunc(s.handleAddUser),
+		"POST /api/files/adopt-layout":             http.HandlerFunc(s.handleAdoptLayout),
+		"GET /api/files/adopt-layout":              http.HandlerFunc(s.handleGetAdopt),
+		"POST /api/share":                          http.HandlerFunc(s.handleCreateShare),
+		"GET /api/share":                           http.HandlerFunc(s.handleListShares),
+		"DELETE /api/share/{token}":                http.HandlerFunc(s.handleRevokeShare),
+		"GET /share/{token}":                       http.HandlerFunc(s.handleShareDownload),
+		"POST /api/share/upload-link":              http.HandlerFunc(s.handleCreateUploadLink),
+		"GET /api/share/upload-link":               http.HandlerFunc(s.handleListUploadLinks),
+		"DELETE /api/share/upload-link/{id}":       http.HandlerFunc(s.handleRevokeUploadLink),
+		"GET /api/share/upload-link/{id}/activity": http.HandlerFunc(s.handleUploadLinkActivity),
+		"GET /u/{token}":                           http.HandlerFunc(s.handleUploadPage),
+		"POST /u/{token}":                          http.HandlerFunc(s.handleLinkUpload),
+		"POST /api/verify":                         http.HandlerFunc(s.handleStartVerify),
+		"GET /api/verify/{id}":                     http.HandlerFunc(s.handleGetVerify),
+		"GET /api/activity":                        http.HandlerFunc(s.handleActivity),
+		davPrefix:                                  dav,
+		davPrefix + "/":                            dav,
+	}
+	r := apidoc.On(mux, "cloud")
+	for _, route := range fileRoutes {
+		route.handle(r, s.pace(route, handlers[route.pattern]))
+	}
+}
+
+// handle serves h at the route's pattern, documented from fileDocs. The
+// method-less ones, /files/ and WebDAV, are served undocumented.
+func (route fileRoute) handle(r apidoc.Router, h http.Handler) {
+	method, urlPath, ok := strings.Cut(route.pattern, " ")
+	if !ok {
+		method, urlPath = "", route.pattern
+	}
+	r.Handle(method, urlPath, h, fileDocs[route.pattern])
+}
+
+// UseWorker sends the file routes to h, the proxy in front of the
+// low-privilege file worker, instead of handling them in-process.
+func (s *Cloud) UseWorker(h http.Handler) {
+	s.worker = h
+}
+
+// hideUploads keeps partial uploads out of the file server; they are
+// only reachable through the upload API.
+func (s *Cloud) hideUploads(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := s.userPath(r.URL.Path); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (s *Cloud) pace(route fileRoute, h http.Handler) http.Handler {
+	if route.transfer {
+		return s.governor.Handler(h)
+	}
+	return h
 }
 
 // initFileSystem detects storage, mounts SSD if present, then ensures the
 // data directory exists. Unexported because it must be called exactly once
 // by NewFromConfig — callers should never call it directly.
 func (s *Cloud) initFileSystem() error {
-	// SSD detection is hardware-only. In dev mode we always use the
-	// configured DataDir (./data) so local test files remain visible.
-	if !s.IsDev {
-		candidates := []string{"/dev/nvme0n1", "/dev/sda"}
-		const ssdMountPoint = "/mnt/strct_data"
-
-		for _, devicePath := range candidates {
-			if _, err := os.Stat(devicePath); err != nil {
-				continue // device not present on this machine
-			}
-
-			d := &disk.RealDisk{DevicePath: devicePath}
-			if err := d.EnsureMounted(ssdMountPoint); err != nil {
-				slog.Warn("storage: device detected but could not mount (unformatted?)",
-					"device", devicePath, "err", err)
-				continue
-			}
-
-			slog.Info("storage: SSD selected",
-				"device", devicePath,
-				"mount", ssdMountPoint,
-			)
-			s.DataDir = ssdMountPoint
-			break
+	// SSD detection is hardware-only. In dev mode, or with the hardware
+	// mocked, we always use the configured DataDir (./data) so local test
+	// files remain visible.
+	if s.RealHardware {
+		dec := s.storageDecision()
+		switch {
+		case dec != nil && dec.UseSDCard:
+			slog.Info("storage: SD card chosen during setup, skipping SSD detection")
+		case dec != nil && dec.Device != "":
+			// Only the chosen drive — never silently adopt another one.
+			s.mountSSD([]string{dec.Device})
+		default:
+			s.mountSSD(dataDriveCandidates())
 		}
 	}
 
@@ -133,47 +491,122 @@ func (s *Cloud) initFileSystem() error {
 		return fmt.Errorf("cloud: could not create data directory %s: %w", s.DataDir, err)
 	}
 
+	if err := s.loadLayout(); err != nil {
+		slog.Warn("cloud: could not read the data layout, staying flat", "err", err)
+	}
+	s.refreshAttached()
+
 	s.StartTime = time.Now()
 	return nil
 }
 
+// storageDecision returns the setup wizard's choice, or nil to auto-detect.
+func (s *Cloud) storageDecision() *disk.Decision {
+	if s.StorageDecisionPath == "" {
+		return nil
+	}
+	dec, err := disk.LoadDecision(s.StorageDecisionPath)
+	if err != nil {
+		slog.Warn("storage: ignoring unreadable storage decision", "err", err)
+		return nil
+	}
+	return dec
+}
+
+// dataDriveCandidates are the drives auto-detection tries, in lsblk's
+// order: every disk but the system one. Without lsblk there are none;
+// guessing /dev/sda could mount an x86 box's own disk.
+func dataDriveCandidates() []string {
+	drives, err := disk.ListDrives()
+	if err != nil {
+		slog.Warn("storage: could not list drives, staying on the system disk", "err", err)
+		return nil
+	}
+	return disk.DataDrives(drives)
+}
+
+// mountSSD mounts the first candidate that mounts and points DataDir at it.
+func (s *Cloud) mountSSD(candidates []string) {
+	const ssdMountPoint = "/mnt/strct_data"
+
+	for _, devicePath := range candidates {
+		if _, err := os.Stat(devicePath); err != nil {
+			continue // device not present on this machine
+		}
+
+		d := &disk.RealDisk{DevicePath: devicePath}
+		if err := d.EnsureMounted(ssdMountPoint); err != nil {
+			slog.Warn("storage: device detected but could not mount (unformatted?)",
+				"device", devicePath, "err", err)
+			continue
+		}
+
+		slog.Info("storage: SSD selected",
+			"device", devicePath,
+			"mount", ssdMountPoint,
+		)
+		s.DataDir = ssdMountPoint
+		return
+	}
+}
+
 // ---------------------------------------------------------------------------
 // HTTP handlers
 // ---------------------------------------------------------------------------
 
 func (s *Cloud) handleStatus(w http.ResponseWriter, r *http.Request) {
 	realFree, _ := disk.GetFreeDiskSpace(s.DataDir)
-	userUsed, err := disk.GetDirSize(s.DataDir)
-	if err != nil {
-		slog.Error("cloud: failed to calculate dir size", "err", err)
+	b := s.cachedUsage()
+	latency.Mark(r.Context(), phaseUsage)
+	defer latency.Mark(r.Context(), phaseEncode)
+	trash := uint64(max(b.TrashBytes, 0))
+	// The counters can drift between walks; never report less than none.
+	used := uint64(max(b.UsedBytes-b.TrashBytes, 0))
+
+	st := StatusResponse{
+		IsOnline:   true,
+		Used:       used,
+		Trash:      trash,
+		Total:      used + trash + realFree,
+		IP:         netx.GetOutboundIP(),
+		Uptime:     int64(time.Since(s.StartTime).Seconds()),
+		ComputedAt: b.ReconciledAt,
 	}
-
-	httputil.OK(w, StatusResponse{
-		IsOnline: true,
-		Used:     userUsed,
-		Total:    userUsed + realFree,
-		IP:       netx.GetOutboundIP(),
-		Uptime:   int64(time.Since(s.StartTime).Seconds()),
-	})
+	if q, ok := s.quota(); ok {
+		st.Quota = &q
+	}
+	today := s.activityToday()
+	st.UploadsToday, st.DeletesToday = today[opUpload], today[opDelete]
+	if httputil.V1(r) {
+		httputil.OK(w, st)
+		return
+	}
+	httputil.OK(w, legacyStatusResponse(st))
 }
 
 func (s *Cloud) handleFiles(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
 	reqPath := r.URL.Query().Get("path")
-	fullPath, err := secureJoin(s.DataDir, reqPath)
+	fullPath, err := s.userPath(reqPath)
+	latency.Mark(ctx, phaseResolve)
 	if err != nil {
-		httputil.Forbidden(w)
+		pathError(w, err)
 		return
 	}
 
-	entries, err := os.ReadDir(fullPath)
-	if err != nil {
-		// Directory might not exist yet — return empty list, not an error
-		httputil.OK(w, FilesResponse{Files: []FileItem{}})
-		return
-	}
+	// Directory might not exist yet — return empty list, not an error
+	entries, _ := os.ReadDir(fullPath)
+	latency.Mark(ctx, phaseReadDir)
 
-	var fileList []FileItem
+	fileList := []FileItem{}
+	if fullPath == s.externalDir() {
+		// The missing ones too, which have no folder.
+		entries, fileList = nil, s.attachedItems()
+	}
 	for _, e := range entries {
+		if fullPath == s.DataDir && s.category(filepath.Join(fullPath, e.Name())) != catLive {
+			continue // trash, thumbnails, partial uploads, share links, /system; see /api/storage
+		}
 		info, err := e.Info()
 		if err != nil {
 			continue
@@ -182,15 +615,34 @@ func (s *Cloud) handleFiles(w http.ResponseWriter, r *http.Request) {
 		if e.IsDir() {
 			fileType = "folder"
 		}
-		fileList = append(fileList, FileItem{
+		item := FileItem{
 			Name:       e.Name(),
 			Size:       humanize.Bytes(info.Size()),
 			Type:       fileType,
 			ModifiedAt: info.ModTime().Format(time.RFC3339),
-		})
+		}
+		if info.Mode().IsRegular() {
+			item.SHA256 = s.fileSum(filepath.Join(fullPath, e.Name()), info)
+		}
+		fileList = append(fileList, item)
 	}
+	latency.Mark(ctx, phaseStat)
+	defer latency.Mark(ctx, phaseEncode)
 
-	httputil.OK(w, FilesResponse{Files: fileList})
+	if httputil.V1(r) {
+		page, err := httputil.Paginate(r, fileList)
+		if err != nil {
+			httputil.BadRequest(w, err.Error())
+			return
+		}
+		httputil.OK(w, page)
+		return
+	}
+	legacy := legacyFilesResponse{Files: []legacyFileItem{}}
+	for _, f := range fileList {
+		legacy.Files = append(legacy.Files, legacyFileItem{Name: f.Name, Size: f.Size, Type: f.Type, ModifiedAt: f.ModifiedAt})
+	}
+	httputil.OK(w, legacy)
 }
 
 func (s *Cloud) handleMkdir(w http.ResponseWriter, r *http.Request) {
@@ -207,13 +659,18 @@ func (s *Cloud) handleMkdir(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	parentDir, err := secureJoin(s.DataDir, req.Path)
+	parentDir, err := s.userPath(req.Path)
 	if err != nil {
 		httputil.Forbidden(w)
 		return
 	}
+	if err := s.canWriteIn(parentDir); err != nil {
+		pathError(w, err)
+		return
+	}
 
-	if err := os.Mkdir(filepath.Join(parentDir, req.Name), 0755); err != nil {
+	dir := filepath.Join(parentDir, req.Name)
+	if err := os.Mkdir(dir, 0755); err != nil {
 		if os.IsExist(err) {
 			httputil.Error(w, http.StatusConflict, "folder already exists")
 			return
@@ -222,71 +679,196 @@ func (s *Cloud) handleMkdir(w http.ResponseWriter, r *http.Request) {
 		httputil.InternalError(w, "could not create folder")
 		return
 	}
+	s.index.invalidate()
+	s.logActivity(r, Activity{Op: opMkdir, Path: s.apiPath(dir)})
 
 	httputil.JSON(w, http.StatusCreated, map[string]string{"status": "created"})
 }
 
 func (s *Cloud) handleDelete(w http.ResponseWriter, r *http.Request) {
 	targetPath := r.URL.Query().Get("path")
-	fullPath, err := secureJoin(s.DataDir, targetPath)
+	fullPath, err := s.userPath(targetPath)
 	if err != nil {
 		httputil.Forbidden(w)
 		return
 	}
-	if fullPath == s.DataDir {
+	if fullPath == s.DataDir || s.layoutRoot(fullPath) {
 		httputil.Forbidden(w)
 		return
 	}
-	if err := os.RemoveAll(fullPath); err != nil {
-		slog.Error("cloud: failed to delete", "path", fullPath, "err", err)
+	if err := s.canChange(fullPath); err != nil {
+		pathError(w, err)
+		return
+	}
+	if _, err := os.Lstat(fullPath); err != nil {
+		httputil.Error(w, http.StatusNotFound, "not found: "+targetPath)
+		return
+	}
+	size, err := s.deleteToTrash(fullPath)
+	if err != nil {
+		slog.Error("cloud: failed to move to trash", "path", fullPath, "err", err)
 		httputil.InternalError(w, "could not delete item")
 		return
 	}
+	s.logActivity(r, Activity{Op: opDelete, Path: s.apiPath(fullPath), Size: size})
 	httputil.NoContent(w)
 }
 
+// deleteToTrash is a delete through the API: full goes to the trash and
+// the counters, thumbnails and search index follow. It returns the size
+// of what was deleted.
+func (s *Cloud) deleteToTrash(full string) (int64, error) {
+	size := sizeOf(full)
+	s.dropThumbs(full)
+	if s.external(full) {
+		// The trash is on the data drive; see external.go.
+		if err := os.RemoveAll(full); err != nil {
+			return 0, err
+		}
+		s.dropSums(full)
+		s.index.invalidate()
+		return size, nil
+	}
+	item, err := s.moveToTrash(full, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	s.trackSize(full, -size)
+	s.trackSize(item, size+sizeOf(item+trashMetaExt))
+	s.index.invalidate()
+	return size, nil
+}
+
 func (s *Cloud) handleUpload(w http.ResponseWriter, r *http.Request) {
 	targetDir := r.URL.Query().Get("path")
-	saveDir, err := secureJoin(s.DataDir, targetDir)
+	saveDir, err := s.userPath(targetDir)
 	if err != nil {
 		httputil.Forbidden(w)
 		return
 	}
-
-	r.Body = http.MaxBytesReader(w, r.Body, 50<<30) // 50 GB hard limit
-	if err := r.ParseMultipartForm(32 << 20); err != nil {
-		httputil.BadRequest(w, "could not parse multipart form")
+	if err := s.canWriteIn(saveDir); err != nil {
+		pathError(w, err)
+		return
+	}
+	policy, err := parseConflict(r.URL.Query().Get("conflict"))
+	if err != nil {
+		httputil.BadRequest(w, err.Error())
 		return
 	}
 
-	file, header, err := r.FormFile("file")
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+	// Stream the file part straight to disk. ParseMultipartForm would
+	// first spool everything past 32 MB to a temp file, possibly on
+	// another filesystem.
+	mr, err := r.MultipartReader()
 	if err != nil {
-		httputil.BadRequest(w, "invalid file field")
+		httputil.BadRequest(w, "could not parse multipart form")
 		return
 	}
+	var file *multipart.Part
+	for {
+		p, err := mr.NextPart()
+		if err != nil {
+			httputil.BadRequest(w, "invalid file field")
+			return
+		}
+		if p.FormName() == "file" && p.FileName() != "" {
+			file = p
+			break
+		}
+		p.Close()
+	}
 	defer file.Close()
 
-	dst, err := os.Create(filepath.Join(saveDir, header.Filename))
+	name, err := sanitizeName(file.FileName())
 	if err != nil {
+		httputil.BadRequest(w, err.Error())
+		return
+	}
+	// Checked before creating anything, with the size the file replaces
+	// if it is overwritten. The body is a little larger than the file, so
+	// this errs on the side of refusing; the reserveReader below catches
+	// a missing or wrong Content-Length.
+	var replacing int64
+	if policy == conflictOverwrite {
+		replacing = sizeOf(filepath.Join(saveDir, name))
+	}
+	room, q, limited := s.uploadRoom(replacing)
+	if limited && r.ContentLength > room {
+		insufficientStorage(w, q)
+		return
+	}
+	dst, stored, replaced, err := s.createUpload(saveDir, name, policy)
+	switch {
+	case errors.Is(err, errInvalidName):
+		httputil.Forbidden(w)
+		return
+	case errors.Is(err, errNameTaken):
+		httputil.JSON(w, http.StatusConflict, map[string]any{"error": err.Error(), "name": name})
+		return
+	case err != nil:
 		slog.Error("cloud: failed to create destination file", "err", err)
 		httputil.InternalError(w, "disk error")
 		return
 	}
 	defer dst.Close()
+	target := dst.Name()
 
-	if _, err := io.Copy(dst, file); err != nil {
+	var src io.Reader = file
+	if limited {
+		src = &reserveReader{r: file, left: room}
+	}
+	sum := sha256.New()
+	n, err := io.Copy(io.MultiWriter(usage.Writer(dst), sum), src)
+	if errors.Is(err, errReserveReached) {
+		dst.Close()
+		os.Remove(target) //nolint:errcheck
+		s.trackSize(target, -replaced)
+		s.index.invalidate()
+		q, _ := s.quota()
+		insufficientStorage(w, q)
+		return
+	}
+	s.trackSize(target, n-replaced)
+	s.index.invalidate()
+	if err != nil {
 		slog.Error("cloud: failed to write uploaded file", "err", err)
 		httputil.InternalError(w, "upload failed")
 		return
 	}
-
-	httputil.JSON(w, http.StatusCreated, map[string]string{"status": "uploaded"})
+	s.recordSum(target, hex.EncodeToString(sum.Sum(nil)))
+	s.logActivity(r, Activity{Op: opUpload, Path: s.apiPath(target), Size: n})
+
+	httputil.JSON(w, http.StatusCreated, map[string]any{
+		"status": "uploaded",
+		"name":   stored,
+		"path":   path.Join("/", filepath.ToSlash(targetDir), stored),
+		"size":   n,
+	})
 }
 
 // ---------------------------------------------------------------------------
 // Helpers
 // ---------------------------------------------------------------------------
 
+// userPath resolves a path from a request under DataDir. The reserved
+// directories (trash, thumbnails, partial uploads, share links) are not
+// part of the user's files, and a path under external/ has to stay in
+// its attached folder.
+func (s *Cloud) userPath(p string) (string, error) {
+	full, err := secureJoin(s.DataDir, p)
+	if err != nil {
+		return "", err
+	}
+	if s.category(full) != catLive {
+		return "", fmt.Errorf("reserved path: %q", p)
+	}
+	if err := s.checkExternal(full); err != nil {
+		return "", err
+	}
+	return full, nil
+}
+
 // secureJoin safely joins a user-supplied path under root, rejecting traversal.
 func secureJoin(root, userPath string) (string, error) {
 	if userPath == "" {
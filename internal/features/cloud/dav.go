@@ -0,0 +1,343 @@
+package cloud
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/strct-org/strct-agent/internal/httputil"
+	"golang.org/x/net/webdav"
+)
+
+// WebDAV. /dav/ serves DataDir over WebDAV so it mounts as a network drive
+// in Finder (Go → Connect to Server), Explorer (Map network drive) and
+// davfs2. It is the same tree as the JSON API with the same rules: paths
+// resolve through userPath, so the reserved directories are invisible; a
+// DELETE goes to the trash; uploads stay out of the free-space reserve,
+// are counted and get a checksum.
+//
+// Every request needs HTTP basic auth with DAVUser and DAVPassword. With
+// no password set the endpoint is off. GET and HEAD go through
+// http.ServeContent, so Range and If-None-Match/If-Modified-Since work;
+// LOCK is in memory, which is all Finder needs to write.
+const davPrefix = "/dav"
+
+// handleDAV returns the /dav/ handler.
+func (s *Cloud) handleDAV() http.Handler {
+	h := &webdav.Handler{
+		Prefix:     davPrefix,
+		FileSystem: davFS{s},
+		LockSystem: webdav.NewMemLS(),
+		Logger: func(r *http.Request, err error) {
+			if err != nil && !os.IsNotExist(err) {
+				slog.Debug("cloud: webdav request failed", "method", r.Method, "path", r.URL.Path, "err", err)
+			}
+		},
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.DAVPassword == "" {
+			httputil.Error(w, http.StatusNotFound, "WebDAV is off: set WEBDAV_PASSWORD to turn it on")
+			return
+		}
+		user, pass, ok := r.BasicAuth()
+		if !ok || !equalSecret(user, s.DAVUser) || !equalSecret(pass, s.DAVPassword) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="strct", charset="UTF-8"`)
+			httputil.Error(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			r = withClient(r) // for the activity log
+		}
+		if r.Method == http.MethodPut {
+			s.davPut(h, w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func equalSecret(got, want string) bool {
+	return subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+}
+
+// davPut is a PUT kept out of the upload reserve, like handleUpload. The
+// webdav package answers a failed write with 405; one that ran into the
+// reserve is turned into the 507 the other upload routes give, and the
+// partial file is removed.
+func (s *Cloud) davPut(h http.Handler, w http.ResponseWriter, r *http.Request) {
+	target, err := s.userPath(strings.TrimPrefix(r.URL.Path, davPrefix))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	room, q, limited := s.uploadRoom(sizeOf(target))
+	if !limited {
+		h.ServeHTTP(w, r)
+		return
+	}
+	if r.ContentLength > room {
+		insufficientStorage(w, q)
+		return
+	}
+	body := &davBody{reserveReader: reserveReader{r: r.Body, left: room}}
+	r.Body = body
+	h.ServeHTTP(&davPutWriter{ResponseWriter: w, s: s, body: body}, r)
+	if body.full {
+		size := sizeOf(target)
+		if os.Remove(target) == nil {
+			s.trackSize(target, -size)
+			s.dropSums(target)
+			s.index.invalidate()
+		}
+	}
+}
+
+type davBody struct {
+	reserveReader
+	full bool
+}
+
+func (b *davBody) Read(p []byte) (int, error) {
+	n, err := b.reserveReader.Read(p)
+	if errors.Is(err, errReserveReached) {
+		b.full = true
+	}
+	return n, err
+}
+
+func (b *davBody) Close() error {
+	if c, ok := b.r.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// davPutWriter replaces the webdav package's 405 for a PUT that hit the
+// reserve with a 507.
+type davPutWriter struct {
+	http.ResponseWriter
+	s       *Cloud
+	body    *davBody
+	swallow bool
+}
+
+func (w *davPutWriter) WriteHeader(code int) {
+	if w.body.full && code == http.StatusMethodNotAllowed {
+		q, _ := w.s.quota()
+		insufficientStorage(w.ResponseWriter, q)
+		w.swallow = true
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *davPutWriter) Write(p []byte) (int, error) {
+	if w.swallow {
+		return len(p), nil
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// davFS is DataDir as the webdav package sees it. Names arrive cleaned
+// and slash-rooted, after the /dav prefix.
+type davFS struct{ s *Cloud }
+
+// path resolves name like the JSON API. A reserved path does not exist.
+func (fsys davFS) path(name string) (string, error) {
+	full, err := fsys.s.userPath(name)
+	if err != nil {
+		return "", os.ErrNotExist
+	}
+	return full, nil
+}
+
+// changeable resolves name for a delete or move: not DataDir itself, not
+// one of the layout's folders and not in a read-only attached folder.
+func (fsys davFS) changeable(name string) (string, error) {
+	full, err := fsys.path(name)
+	if err != nil {
+		return "", err
+	}
+	if full == fsys.s.DataDir || fsys.s.layoutRoot(full) || fsys.s.canChange(full) != nil {
+		return "", os.ErrPermission
+	}
+	return full, nil
+}
+
+func (fsys davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	full, err := fsys.path(name)
+	if err != nil {
+		return err
+	}
+	if fsys.s.canWriteIn(filepath.Dir(full)) != nil {
+		return os.ErrPermission
+	}
+	if err := os.Mkdir(full, 0755); err != nil {
+		return err
+	}
+	fsys.s.index.invalidate()
+	fsys.s.recordActivity(Activity{Op: opMkdir, Path: fsys.s.apiPath(full), Client: clientFrom(ctx)})
+	return nil
+}
+
+func (fsys davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	full, err := fsys.path(name)
+	if err != nil {
+		return nil, err
+	}
+	write := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	if !write {
+		f, err := os.Open(full)
+		if err != nil {
+			return nil, err
+		}
+		return &davFile{File: f, r: usage.Reader(f), s: fsys.s, full: full}, nil
+	}
+
+	if fsys.s.canChange(full) != nil {
+		return nil, os.ErrPermission
+	}
+	_, statErr := os.Lstat(full)
+	replaced := sizeOf(full)
+	f, err := os.OpenFile(full, flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+	df := &davFile{File: f, r: usage.Reader(f), w: usage.Writer(f), s: fsys.s, full: full, write: true, replaced: replaced, client: clientFrom(ctx)}
+	// Only a file written from the start in one pass can be hashed on
+	// the way in.
+	if flag&os.O_APPEND == 0 && (flag&os.O_TRUNC != 0 || os.IsNotExist(statErr)) {
+		df.sum = sha256.New()
+	}
+	return df, nil
+}
+
+func (fsys davFS) RemoveAll(ctx context.Context, name string) error {
+	full, err := fsys.changeable(name)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Lstat(full); err != nil {
+		return err
+	}
+	size, err := fsys.s.deleteToTrash(full)
+	if err != nil {
+		return err
+	}
+	fsys.s.recordActivity(Activity{Op: opDelete, Path: fsys.s.apiPath(full), Size: size, Client: clientFrom(ctx)})
+	return nil
+}
+
+func (fsys davFS) Rename(ctx context.Context, oldName, newName string) error {
+	src, err := fsys.changeable(oldName)
+	if err != nil {
+		return err
+	}
+	dst, err := fsys.changeable(newName)
+	if err != nil {
+		return err
+	}
+	if within(dst, src) {
+		return errors.New("cannot move a folder into itself")
+	}
+	// The webdav package has already removed an existing dst for an
+	// overwrite, to the trash.
+	if err := rename(src, dst); err != nil {
+		return err
+	}
+	if fsys.s.external(src) != fsys.s.external(dst) {
+		moved := sizeOf(dst)
+		fsys.s.trackSize(src, -moved)
+		fsys.s.trackSize(dst, moved)
+	}
+	fsys.s.moveSums(src, dst)
+	fsys.s.index.invalidate()
+	fsys.s.recordActivity(Activity{Op: opMove, Path: fsys.s.apiPath(src), To: fsys.s.apiPath(dst), Size: sizeOf(dst), Client: clientFrom(ctx)})
+	return nil
+}
+
+func (fsys davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	full, err := fsys.path(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(full)
+}
+
+// davFile is a file or folder opened through davFS. It embeds the
+// interface, not *os.File, so io.Copy can't reach around Write through
+// (*os.File).ReadFrom.
+type davFile struct {
+	webdav.File
+	r     io.Reader // File, counted for /api/system/resources
+	w     io.Writer
+	s     *Cloud
+	full  string
+	write bool
+
+	replaced int64     // bytes the file had when opened for writing
+	sum      hash.Hash // nil: not one sequential write, not hashed
+	client   string    // for the activity log
+}
+
+func (f *davFile) Read(p []byte) (int, error) {
+	return f.r.Read(p)
+}
+
+func (f *davFile) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if f.sum != nil {
+		f.sum.Write(p[:n])
+	}
+	return n, err
+}
+
+func (f *davFile) Seek(offset int64, whence int) (int64, error) {
+	if f.write {
+		f.sum = nil
+	}
+	return f.File.Seek(offset, whence)
+}
+
+// Readdir leaves out the reserved directories at the top of DataDir.
+func (f *davFile) Readdir(count int) ([]os.FileInfo, error) {
+	infos, err := f.File.Readdir(count)
+	if f.full != f.s.DataDir {
+		return infos, err
+	}
+	kept := infos[:0]
+	for _, fi := range infos {
+		if f.s.category(filepath.Join(f.full, fi.Name())) == catLive {
+			kept = append(kept, fi)
+		}
+	}
+	return kept, err
+}
+
+func (f *davFile) Close() error {
+	err := f.File.Close()
+	if !f.write {
+		return err
+	}
+	s := f.s
+	size := sizeOf(f.full)
+	s.trackSize(f.full, size-f.replaced)
+	s.dropThumbs(f.full)
+	s.index.invalidate()
+	s.recordActivity(Activity{Op: opUpload, Path: s.apiPath(f.full), Size: size, Client: f.client})
+	if f.sum != nil && err == nil {
+		s.recordSum(f.full, hex.EncodeToString(f.sum.Sum(nil)))
+	} else {
+		s.dropSums(f.full)
+	}
+	return err
+}
@@ -0,0 +1,154 @@
+package cloud
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newDAVMux(t *testing.T) (*Cloud, *http.ServeMux) {
+	t.Helper()
+	c, mux := newUploadMux(t)
+	c.DAVUser, c.DAVPassword = "strct", "hunter2"
+	return c, mux
+}
+
+// dav sends an authenticated WebDAV request.
+func dav(t *testing.T, mux http.Handler, method, target string, body io.Reader, header map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, target, body)
+	req.SetBasicAuth("strct", "hunter2")
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	return w
+}
+
+func TestDAV_Auth(t *testing.T) {
+	c, mux := newUploadMux(t)
+	if w := dav(t, mux, "PROPFIND", "/dav/", nil, nil); w.Code != http.StatusNotFound {
+		t.Errorf("no password configured: %d", w.Code)
+	}
+
+	c.DAVUser, c.DAVPassword = "strct", "hunter2"
+	req := httptest.NewRequest("PROPFIND", "/dav/", nil)
+	req.SetBasicAuth("strct", "wrong")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized || !strings.HasPrefix(w.Header().Get("WWW-Authenticate"), "Basic ") {
+		t.Errorf("wrong password: %d %v", w.Code, w.Header())
+	}
+	if w := dav(t, mux, "OPTIONS", "/dav/", nil, nil); w.Code != http.StatusOK || w.Header().Get("DAV") == "" {
+		t.Errorf("OPTIONS: %d %v", w.Code, w.Header())
+	}
+}
+
+func TestDAV_ListHidesReservedDirs(t *testing.T) {
+	c, mux := newDAVMux(t)
+	writeFiles(t, c.DataDir, map[string]string{"docs/a.txt": "alpha", "b.txt": "bravo"})
+	multipartUpload(t, mux, "/", "c.txt", "charlie") // creates .checksums
+	do(t, mux, "DELETE", "/api/delete?path=/b.txt", "")
+
+	for _, target := range []string{"/dav", "/dav/"} {
+		w := dav(t, mux, "PROPFIND", target, nil, map[string]string{"Depth": "1"})
+		if w.Code != http.StatusMultiStatus {
+			t.Fatalf("PROPFIND %s: %d %s", target, w.Code, w.Body)
+		}
+		body := w.Body.String()
+		if !strings.Contains(body, "/dav/docs/") || !strings.Contains(body, "/dav/c.txt") {
+			t.Errorf("PROPFIND %s is missing files: %s", target, body)
+		}
+		for _, hidden := range []string{trashDirName, checksumsDirName} {
+			if strings.Contains(body, hidden) {
+				t.Errorf("PROPFIND %s lists %s", target, hidden)
+			}
+		}
+	}
+	if w := dav(t, mux, "GET", "/dav/.trash/", nil, nil); w.Code != http.StatusNotFound {
+		t.Errorf("GET the trash: %d", w.Code)
+	}
+	// The mux cleans request paths; names reaching the file system are
+	// still resolved under DataDir.
+	if _, err := (davFS{c}).Stat(context.Background(), "/../../etc/passwd"); !os.IsNotExist(err) {
+		t.Errorf("traversal: %v", err)
+	}
+}
+
+func TestDAV_WriteMoveDelete(t *testing.T) {
+	c, mux := newDAVMux(t)
+	before := breakdownOf(t, mux)
+
+	if w := dav(t, mux, "MKCOL", "/dav/docs", nil, nil); w.Code != http.StatusCreated {
+		t.Fatalf("MKCOL: %d %s", w.Code, w.Body)
+	}
+	if w := dav(t, mux, "PUT", "/dav/docs/a.txt", strings.NewReader("0123456789"), nil); w.Code != http.StatusCreated {
+		t.Fatalf("PUT: %d %s", w.Code, w.Body)
+	}
+	if got := listedSums(t, mux, "/docs")["a.txt"]; got != sha("0123456789") {
+		t.Errorf("checksum after PUT = %q", got)
+	}
+	if got := breakdownOf(t, mux).LiveBytes - before.LiveBytes; got != 10 {
+		t.Errorf("live bytes grew by %d, want 10", got)
+	}
+
+	w := dav(t, mux, "GET", "/dav/docs/a.txt", nil, map[string]string{"Range": "bytes=2-4"})
+	if w.Code != http.StatusPartialContent || w.Body.String() != "234" {
+		t.Errorf("ranged GET: %d %q", w.Code, w.Body)
+	}
+	etag := dav(t, mux, "HEAD", "/dav/docs/a.txt", nil, nil).Header().Get("ETag")
+	if w := dav(t, mux, "GET", "/dav/docs/a.txt", nil, map[string]string{"If-None-Match": etag}); etag == "" || w.Code != http.StatusNotModified {
+		t.Errorf("conditional GET with %q: %d", etag, w.Code)
+	}
+
+	w = dav(t, mux, "MOVE", "/dav/docs/a.txt", nil, map[string]string{"Destination": "http://example.com/dav/b.txt"})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("MOVE: %d %s", w.Code, w.Body)
+	}
+	if got := readFile(t, filepath.Join(c.DataDir, "b.txt")); got != "0123456789" {
+		t.Errorf("moved file = %q", got)
+	}
+	if got := listedSums(t, mux, "/")["b.txt"]; got != sha("0123456789") {
+		t.Errorf("checksum after MOVE = %q", got)
+	}
+
+	if w := dav(t, mux, "DELETE", "/dav/b.txt", nil, nil); w.Code != http.StatusNoContent {
+		t.Fatalf("DELETE: %d %s", w.Code, w.Body)
+	}
+	if items := listTrash(t, mux).Items; len(items) != 1 || items[0].OriginalPath != "/b.txt" {
+		t.Errorf("trash after DELETE = %+v", items)
+	}
+	if w := dav(t, mux, "DELETE", "/dav/", nil, nil); w.Code == http.StatusNoContent {
+		t.Error("DELETE of the root succeeded")
+	}
+	if w := dav(t, mux, "PUT", "/dav/.trash/x", strings.NewReader("x"), nil); w.Code == http.StatusCreated {
+		t.Error("PUT into the trash succeeded")
+	}
+}
+
+func TestDAV_PutRespectsTheReserve(t *testing.T) {
+	c, mux := newDAVMux(t)
+	c.UploadReserve, c.UploadReservePercent = 100, 0
+	fakeDisk(t, 400, 1000) // 300 bytes left for uploads
+
+	if w := dav(t, mux, "PUT", "/dav/big.bin", strings.NewReader(strings.Repeat("x", 500)), nil); w.Code != http.StatusInsufficientStorage {
+		t.Fatalf("large PUT: %d %s", w.Code, w.Body)
+	}
+	// Without a Content-Length the limit applies while streaming.
+	w := dav(t, mux, "PUT", "/dav/big.bin", onlyReader{strings.NewReader(strings.Repeat("x", 500))}, nil)
+	if w.Code != http.StatusInsufficientStorage || !strings.Contains(w.Body.String(), "available_for_upload") {
+		t.Fatalf("streamed PUT: %d %s", w.Code, w.Body)
+	}
+	if _, err := os.Stat(filepath.Join(c.DataDir, "big.bin")); !os.IsNotExist(err) {
+		t.Error("partial PUT left behind")
+	}
+	if w := dav(t, mux, "PUT", "/dav/small.bin", strings.NewReader(strings.Repeat("x", 100)), nil); w.Code != http.StatusCreated {
+		t.Errorf("PUT within the room: %d %s", w.Code, w.Body)
+	}
+}
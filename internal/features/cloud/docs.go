@@ -0,0 +1,304 @@
+package cloud
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/apidoc"
+	"github.com/strct-org/strct-agent/internal/httputil"
+)
+
+// Docs for /api/openapi.json. fileDocs is keyed by fileRoutes' patterns;
+// the worker's proxy is documented with them, see RegisterRoutes.
+
+var (
+	exampleTime  = time.Date(2024, 6, 3, 12, 0, 0, 0, time.UTC)
+	exampleLater = exampleTime.Add(24 * time.Hour)
+
+	pathParam     = apidoc.Param{Name: "path", Description: "from the DataDir root; empty is the root"}
+	trashParam    = apidoc.Param{Name: "path", Description: "a trash item, /.trash/<id>", Required: true}
+	verifyPathDoc = apidoc.Param{Name: "path", Description: "the folder or file to check; empty is everything"}
+
+	exampleFileItem = FileItem{Name: "report.pdf", Size: "1.2 MB", Type: "file", ModifiedAt: "2024-06-03T12:00:00Z", SHA256: "3a7bd3e2…"}
+
+	exampleStorage = StorageBreakdown{
+		LiveBytes: 52_000_000_000, TrashBytes: 1_200_000_000, CacheBytes: 80_000_000, InternalBytes: 4_000_000,
+		ReclaimableBytes: 1_280_000_000, UsedBytes: 53_284_000_000, FreeBytes: 180_000_000_000, ReconciledAt: exampleTime,
+	}
+
+	exampleUpload = Upload{
+		ID: "5f0c6f1e-8d3a-4b7e-9a51-2f1d7c0b9e44", Path: "/photos", Name: "IMG_0412.jpg", Size: 4_812_003,
+		Offset: 1_048_576, CreatedAt: exampleTime, UpdatedAt: exampleTime, ExpiresAt: exampleLater,
+	}
+
+	exampleShare = Share{
+		Token: "q8Zr2mVf", Path: "/docs/report.pdf", URL: "/share/q8Zr2mVf",
+		CreatedAt: exampleTime, ExpiresAt: exampleLater, MaxDownloads: 5, Downloads: 1,
+	}
+
+	exampleUploadLink = UploadLink{
+		ID: "b1d2", Token: "Jk3pQx9w", Path: "/inbox", URL: "/u/Jk3pQx9w", CreatedAt: exampleTime, ExpiresAt: exampleLater,
+		MaxBytes: 1 << 30, MaxFiles: 20, Extensions: []string{".jpg", ".pdf"}, Bytes: 2_400_000, Files: 2, Active: true,
+	}
+
+	exampleAdopt = AdoptJob{
+		ID: "a9", State: "running", StartedAt: exampleTime,
+		Moves:      []AdoptMove{{From: "/Photos", Into: "/users/alice", Path: "/users/alice/Photos", Bytes: 8_000_000, Status: "moving"}},
+		BytesTotal: 8_000_000, BytesDone: 2_000_000,
+	}
+
+	exampleVerify = VerifyJob{
+		ID: "c4", Path: "/", State: "done", StartedAt: exampleTime, FinishedAt: &exampleLater,
+		FilesTotal: 1200, FilesDone: 1200, BytesTotal: 52_000_000_000, BytesDone: 52_000_000_000,
+		Verified: 1190, Recorded: 10, MismatchCount: 1,
+		Mismatches: []VerifyMismatch{{Path: "/photos/IMG_0001.jpg", Expected: "3a7bd3e2…", Actual: "91c0aa4f…"}},
+	}
+
+	examplePurge = purgeResult{ReclaimedBytes: 1_200_000_000, RemovedItems: 14, Storage: exampleStorage}
+
+	exampleAttachment = Attachment{
+		Name: "movies", Source: "/media/usb/Movies", Path: "/external/movies", Status: AttachMounted, CreatedAt: exampleTime,
+	}
+)
+
+var statusDoc = apidoc.RouteDoc{
+	Summary: "Uptime, address, usage and upload quota",
+	Response: StatusResponse{
+		Uptime: 86400, IP: "192.168.1.20", Used: 52_000_000_000, Trash: 1_200_000_000, Total: 240_000_000_000, IsOnline: true,
+		Quota:      &Quota{Total: 240_000_000_000, Used: 60_000_000_000, Reserved: 10_000_000_000, Available: 170_000_000_000},
+		ComputedAt: exampleTime, UploadsToday: 12, DeletesToday: 3,
+	},
+}
+
+var attachDocs = map[string]apidoc.RouteDoc{
+	"GET /api/storage/attach": {
+		Summary:  "Folders from other drives attached under /external",
+		Response: map[string]any{"attachments": []Attachment{exampleAttachment}},
+	},
+	"POST /api/storage/attach": {
+		Summary:     "Attach a folder from another drive",
+		Description: "Read-only unless read_write is set. 400 for a source on the data drive, the system disk, or an unsupported filesystem.",
+		Request:     map[string]any{"source": "/media/usb/Movies", "name": "movies", "read_write": false},
+		Response:    exampleAttachment,
+		Status:      http.StatusCreated,
+	},
+	"DELETE /api/storage/attach/{name}": {
+		Summary: "Detach a folder; its files stay on its drive",
+		Status:  http.StatusNoContent,
+	},
+}
+
+var fileDocs = map[string]apidoc.RouteDoc{
+	"GET /api/files": {
+		Summary:  "List a folder",
+		Query:    []apidoc.Param{pathParam, {Name: "offset"}, {Name: "limit", Description: "default 100"}},
+		Response: httputil.Page[FileItem]{Items: []FileItem{exampleFileItem}, Pagination: httputil.Pagination{Limit: 100, Total: 1}},
+	},
+	"POST /api/mkdir": {
+		Summary:  "Create a folder",
+		Request:  map[string]any{"path": "/docs", "name": "2024"},
+		Response: map[string]any{"status": "created"},
+		Status:   http.StatusCreated,
+	},
+	"DELETE /api/delete": {
+		Summary: "Move a file or folder to the trash",
+		Query:   []apidoc.Param{{Name: "path", Required: true}},
+		Status:  http.StatusNoContent,
+	},
+	"POST /api/move": {
+		Summary:  "Rename or move a file or folder",
+		Request:  moveRequest{From: "/a/old.txt", To: "/b/new.txt"},
+		Response: map[string]any{"status": "moved", "path": "/b/new.txt"},
+	},
+	"POST /strct_agent/fs/upload": {
+		Summary:     "Upload one file in a single request",
+		Description: "The file is the multipart field \"file\". 507 when it would eat into the upload reserve.",
+		Query:       []apidoc.Param{pathParam, {Name: "conflict", Description: "overwrite (the default), rename or reject"}},
+		RequestType: "multipart/form-data",
+		Response:    map[string]any{"status": "uploaded", "name": "report.pdf", "path": "/docs/report.pdf", "size": 1_204_332},
+		Status:      http.StatusCreated,
+	},
+	"GET /api/uploads": {
+		Summary:  "Resumable uploads in progress",
+		Response: map[string]any{"uploads": []Upload{exampleUpload}},
+	},
+	"POST /api/upload/init": {
+		Summary:  "Start a resumable upload",
+		Request:  map[string]any{"path": "/photos", "name": "IMG_0412.jpg", "size": 4_812_003, "sha256": "optional hex"},
+		Response: exampleUpload,
+		Status:   http.StatusCreated,
+	},
+	"GET /api/upload/{id}": {
+		Summary:  "A resumable upload, with the offset to resume from",
+		Response: exampleUpload,
+	},
+	"PUT /api/upload/{id}": {
+		Summary:     "Append a chunk at offset",
+		Description: "409 with the current offset when offset does not match.",
+		Query:       []apidoc.Param{{Name: "offset", Required: true}},
+		RequestType: "application/octet-stream",
+		Response:    map[string]any{"id": exampleUpload.ID, "offset": 2_097_152},
+	},
+	"POST /api/upload/{id}/complete": {
+		Summary:     "Finish a resumable upload",
+		Description: "422 when the file does not match the sha256 given here or at init.",
+		Request:     map[string]any{"sha256": "optional hex"},
+		Response:    map[string]any{"status": "uploaded", "path": "/photos/IMG_0412.jpg", "size": 4_812_003},
+		Status:      http.StatusCreated,
+	},
+	"DELETE /api/upload/{id}": {
+		Summary: "Cancel a resumable upload",
+		Status:  http.StatusNoContent,
+	},
+	"GET /api/download": {
+		Summary:      "Download files and folders as one zip",
+		Query:        []apidoc.Param{{Name: "paths", Description: "comma-separated, or repeated", Required: true}},
+		ResponseType: "application/zip",
+	},
+	"GET /api/storage": {
+		Summary:  "What the data folder's space is used for",
+		Response: exampleStorage,
+	},
+	"POST /api/trash/empty": {
+		Summary:  "Purge the trash, or the items older than older_than_days",
+		Request:  map[string]any{"older_than_days": 30},
+		Response: examplePurge,
+	},
+	"GET /api/trash": {
+		Summary: "Deleted items",
+		Response: TrashResponse{TotalBytes: 1_204_332, Items: []TrashEntry{{
+			Path: "/.trash/1717416000000000000-report.pdf", Name: "report.pdf", Type: "file", Size: 1_204_332,
+			OriginalPath: "/docs/report.pdf", DeletedAt: exampleTime, PurgeAt: &exampleLater,
+		}}},
+	},
+	"POST /api/trash/restore": {
+		Summary:  "Put a trash item back where it was",
+		Request:  map[string]any{"path": "/.trash/1717416000000000000-report.pdf"},
+		Response: map[string]any{"status": "restored", "path": "/docs/report.pdf"},
+	},
+	"DELETE /api/trash": {
+		Summary: "Purge one trash item",
+		Query:   []apidoc.Param{trashParam},
+		Status:  http.StatusNoContent,
+	},
+	"POST /api/storage/clear-cache": {
+		Summary:  "Remove the thumbnail cache",
+		Response: examplePurge,
+	},
+	"GET /api/search": {
+		Summary: "Find files and folders by name",
+		Query: []apidoc.Param{
+			{Name: "q", Description: "a substring, or a glob with * ? [", Required: true},
+			{Name: "path", Description: "the folder to search; empty is everything"},
+			{Name: "type", Description: "file or folder"},
+			{Name: "limit", Description: "1-1000, default 100"},
+		},
+		Response: SearchResponse{Indexed: true, Results: []SearchResult{{
+			Path: "/docs/2024/invoice.pdf", Name: "invoice.pdf", Type: "file", Size: 88_120, ModifiedAt: "2024-06-03T12:00:00Z",
+		}}},
+	},
+	"GET /api/thumb": {
+		Summary:      "A JPEG thumbnail of an image",
+		Query:        []apidoc.Param{{Name: "path", Required: true}, {Name: "size", Description: "the longest side in pixels, rounded up to a cached size"}},
+		ResponseType: "image/jpeg",
+	},
+	"GET /api/files/layout": {
+		Summary:  "Flat, or structured into /shared and /users",
+		Response: LayoutResponse{Layout: "structured", Users: []string{"alice", "bob"}},
+	},
+	"POST /api/files/layout": {
+		Summary:  "Switch to the structured layout",
+		Request:  map[string]any{"users": []string{"alice", "bob"}},
+		Response: LayoutResponse{Layout: "structured", Users: []string{"alice", "bob"}},
+	},
+	"POST /api/files/layout/users": {
+		Summary:  "Add a user folder",
+		Request:  map[string]any{"name": "carol"},
+		Response: map[string]any{"name": "carol", "path": "/users/carol"},
+		Status:   http.StatusCreated,
+	},
+	"POST /api/files/adopt-layout": {
+		Summary:  "Move existing top-level folders into the structured layout",
+		Request:  map[string]any{"moves": []map[string]any{{"from": "/Photos", "into": "/users/alice"}}},
+		Response: exampleAdopt,
+		Status:   http.StatusAccepted,
+	},
+	"GET /api/files/adopt-layout": {
+		Summary:  "The adopt job's progress",
+		Response: exampleAdopt,
+	},
+	"POST /api/share": {
+		Summary:  "Create a download link for a file",
+		Request:  map[string]any{"path": "/docs/report.pdf", "expires_in": "24h", "max_downloads": 5},
+		Response: exampleShare,
+		Status:   http.StatusCreated,
+	},
+	"GET /api/share": {
+		Summary:  "Active download links, newest first",
+		Response: []Share{exampleShare},
+	},
+	"DELETE /api/share/{token}": {
+		Summary: "Revoke a download link",
+		Status:  http.StatusNoContent,
+	},
+	"GET /share/{token}": {
+		Summary:      "Download a shared file; needs no token",
+		ResponseType: "application/octet-stream",
+	},
+	"POST /api/share/upload-link": {
+		Summary: "Create an upload link into a folder",
+		Request: map[string]any{
+			"path": "/inbox", "expires_in": "72h", "max_bytes": 1 << 30, "max_files": 20, "extensions": []string{".jpg", ".pdf"},
+		},
+		Response:  exampleUploadLink,
+		Status:    http.StatusCreated,
+		Validates: true,
+	},
+	"GET /api/share/upload-link": {
+		Summary:  "Upload links, newest first",
+		Response: []UploadLink{exampleUploadLink},
+	},
+	"DELETE /api/share/upload-link/{id}": {
+		Summary: "Revoke an upload link",
+		Status:  http.StatusNoContent,
+	},
+	"GET /api/share/upload-link/{id}/activity": {
+		Summary: "An upload link and the files received through it",
+		Response: uploadLinkRecord{UploadLink: exampleUploadLink, Uploads: []LinkUpload{{
+			Time: exampleTime, Name: "scan.pdf", Path: "/inbox/scan.pdf", Size: 1_200_000, Client: "203.0.113.7",
+		}}},
+	},
+	"GET /u/{token}": {
+		Summary:      "The upload page behind an upload link; needs no token",
+		ResponseType: "text/html",
+	},
+	"POST /u/{token}": {
+		Summary:     "Upload through an upload link; needs no token",
+		Description: "Any number of multipart \"file\" fields, within the link's limits.",
+		RequestType: "multipart/form-data",
+		Response:    map[string]any{"uploaded": []linkFile{{Name: "scan.pdf", Size: 1_200_000}}},
+		Status:      http.StatusCreated,
+	},
+	"POST /api/verify": {
+		Summary:  "Re-read files and check them against their recorded checksums",
+		Query:    []apidoc.Param{verifyPathDoc},
+		Response: exampleVerify,
+		Status:   http.StatusAccepted,
+	},
+	"GET /api/verify/{id}": {
+		Summary:  "A verify job's progress and mismatches",
+		Response: exampleVerify,
+	},
+	"GET /api/activity": {
+		Summary: "Uploads, deletes, moves and shares, newest first",
+		Query: []apidoc.Param{
+			{Name: "op", Description: "one operation or a comma-separated list"},
+			{Name: "path", Description: "a folder or file; a move counts for both ends"},
+			{Name: "offset"}, {Name: "limit", Description: "default 100"},
+		},
+		Response: httputil.Page[Activity]{
+			Items:      []Activity{{Time: exampleTime, Op: opUpload, Path: "/docs/report.pdf", Size: 1_204_332, Client: "192.168.1.31"}},
+			Pagination: httputil.Pagination{Limit: 100, Total: 1},
+		},
+	},
+}
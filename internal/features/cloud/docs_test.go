@@ -0,0 +1,52 @@
+package cloud
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/strct-org/strct-agent/internal/apidoc"
+)
+
+func TestFileDocs_CoverTheFileRoutes(t *testing.T) {
+	routes := map[string]bool{}
+	for _, route := range fileRoutes {
+		routes[route.pattern] = true
+		if !strings.Contains(route.pattern, " ") {
+			continue // served undocumented
+		}
+		if fileDocs[route.pattern].Summary == "" {
+			t.Errorf("%s has no doc", route.pattern)
+		}
+	}
+	for pattern := range fileDocs {
+		if !routes[pattern] {
+			t.Errorf("doc for %s, which is not a file route", pattern)
+		}
+	}
+}
+
+func TestDocs_ProxiedRoutesAreDocumented(t *testing.T) {
+	spec := apidoc.NewSpec("test")
+	r := spec.On(http.NewServeMux(), "cloud")
+	for _, route := range fileRoutes {
+		route.handle(r, http.NotFoundHandler()) // as the worker's proxy is
+	}
+
+	doc := spec.OpenAPI("")
+	for _, path := range []string{"/api/v1/files", "/api/v1/upload/{id}", "/share/{token}"} {
+		if doc.Paths[path] == nil {
+			t.Errorf("%s is not documented", path)
+		}
+	}
+	if doc.Paths["/files/"] != nil || doc.Paths["/dav"] != nil {
+		t.Error("method-less routes should not be documented")
+	}
+	if _, ok := doc.Components.Schemas["PageOfFileItem"]; !ok {
+		t.Error("no PageOfFileItem component")
+	}
+	if _, err := json.Marshal(doc); err != nil {
+		t.Fatal(err)
+	}
+}
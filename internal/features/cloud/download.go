@@ -0,0 +1,164 @@
+package cloud
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/strct-org/strct-agent/internal/httputil"
+)
+
+// storedExts are formats that are already compressed. Deflating them again
+// costs the Orange Pi's CPU for a few bytes, so they go into the zip as-is.
+var storedExts = map[string]bool{
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true, ".heic": true, ".avif": true,
+	".mp4": true, ".mov": true, ".mkv": true, ".avi": true, ".webm": true, ".m4v": true,
+	".mp3": true, ".aac": true, ".m4a": true, ".ogg": true, ".opus": true, ".flac": true,
+	".zip": true, ".gz": true, ".tgz": true, ".bz2": true, ".xz": true, ".zst": true, ".7z": true, ".rar": true,
+	".pdf": true, ".docx": true, ".xlsx": true, ".pptx": true, ".epub": true,
+}
+
+func zipMethod(name string) uint16 {
+	if storedExts[strings.ToLower(filepath.Ext(name))] {
+		return zip.Store
+	}
+	return zip.Deflate
+}
+
+// downloadItem is one selected path and the name it gets at the top of
+// the archive.
+type downloadItem struct {
+	full, name string
+}
+
+// handleDownload streams the selected files and folders as one zip built
+// while it is sent. GET /api/download?paths=/photos/2023,/docs/report.pdf
+func (s *Cloud) handleDownload(w http.ResponseWriter, r *http.Request) {
+	var paths []string
+	for _, v := range r.URL.Query()["paths"] {
+		for _, p := range strings.Split(v, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				paths = append(paths, p)
+			}
+		}
+	}
+	if len(paths) == 0 {
+		httputil.BadRequest(w, "paths is required")
+		return
+	}
+
+	// Everything is checked before the first byte goes out; after that the
+	// status is 200 whatever happens.
+	var items []downloadItem
+	taken := map[string]int{}
+	for _, p := range paths {
+		full, err := s.userPath(p)
+		if err != nil {
+			httputil.Forbidden(w)
+			return
+		}
+		info, err := os.Lstat(full)
+		if err != nil {
+			httputil.Error(w, http.StatusNotFound, "not found: "+p)
+			return
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			continue
+		}
+		name := filepath.Base(full)
+		if full == s.DataDir {
+			name = "strct"
+		}
+		// Two selections with the same base name, e.g. /a/notes and /b/notes.
+		if n := taken[name]; n > 0 {
+			taken[name]++
+			name = fmt.Sprintf("%s (%d)", name, n+1)
+		} else {
+			taken[name] = 1
+		}
+		items = append(items, downloadItem{full: full, name: name})
+	}
+
+	archive := "download.zip"
+	if len(items) == 1 {
+		archive = items[0].name + ".zip"
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": archive}))
+
+	zw := zip.NewWriter(w)
+	for _, it := range items {
+		if err := s.addToZip(r, zw, it); err != nil {
+			// The client sees a truncated archive; nothing better to send.
+			slog.Warn("cloud: zip download aborted", "path", it.full, "err", err)
+			return
+		}
+	}
+	if err := zw.Close(); err != nil {
+		slog.Warn("cloud: zip download aborted", "err", err)
+	}
+}
+
+// addToZip writes it, walking directories. Symlinks are skipped rather than
+// followed, so a link can't pull in files from outside DataDir.
+func (s *Cloud) addToZip(r *http.Request, zw *zip.Writer, it downloadItem) error {
+	return filepath.WalkDir(it.full, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if r.Context().Err() != nil {
+			return r.Context().Err()
+		}
+		if d.Type()&fs.ModeSymlink != 0 || !(d.IsDir() || d.Type().IsRegular()) {
+			return nil
+		}
+		if s.category(p) != catLive {
+			// The trash, share links, partial uploads and the agent's
+			// state under a root selection.
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(it.full, p)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		hdr, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		hdr.Name = path.Join(it.name, filepath.ToSlash(rel))
+		if d.IsDir() {
+			hdr.Name += "/"
+			hdr.Method = zip.Store
+			_, err = zw.CreateHeader(hdr)
+			return err
+		}
+		hdr.Method = zipMethod(p)
+
+		dst, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(dst, f)
+		return err
+	})
+}
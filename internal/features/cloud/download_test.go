@@ -0,0 +1,127 @@
+package cloud
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/strct-org/strct-agent/internal/managed"
+)
+
+func TestDownload_ZipsNestedFolder(t *testing.T) {
+	c, mux := newUploadMux(t)
+	root := filepath.Join(c.DataDir, "photos", "2023")
+	os.MkdirAll(filepath.Join(root, "summer", "empty"), 0755)
+	os.WriteFile(filepath.Join(root, "notes.txt"), []byte("trip notes"), 0644)
+	os.WriteFile(filepath.Join(root, "summer", "beach.jpg"), []byte("jpeg bytes"), 0644)
+	os.WriteFile(filepath.Join(c.DataDir, "report.pdf"), []byte("%PDF"), 0644)
+	outside := filepath.Join(t.TempDir(), "secret.txt")
+	os.WriteFile(outside, []byte("secret"), 0644)
+	os.Symlink(outside, filepath.Join(root, "link.txt"))
+
+	w := do(t, mux, "GET", "/api/download?paths=/photos/2023,/report.pdf", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("download: %d %s", w.Code, w.Body)
+	}
+	if cd := w.Header().Get("Content-Disposition"); cd != `attachment; filename=download.zip` {
+		t.Errorf("Content-Disposition = %q", cd)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	methods := map[string]uint16{}
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+		methods[f.Name] = f.Method
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(rc)
+		rc.Close()
+		got[f.Name] = string(b)
+	}
+	sort.Strings(names)
+	want := []string{
+		"2023/", "2023/notes.txt", "2023/summer/", "2023/summer/beach.jpg", "2023/summer/empty/", "report.pdf",
+	}
+	if strings.Join(names, " ") != strings.Join(want, " ") {
+		t.Fatalf("entries = %v, want %v", names, want)
+	}
+	if got["2023/notes.txt"] != "trip notes" || got["2023/summer/beach.jpg"] != "jpeg bytes" || got["report.pdf"] != "%PDF" {
+		t.Errorf("contents = %v", got)
+	}
+	if methods["2023/summer/beach.jpg"] != zip.Store || methods["2023/notes.txt"] != zip.Deflate {
+		t.Errorf("methods = %v", methods)
+	}
+}
+
+func TestDownload_RootLeavesReservedOut(t *testing.T) {
+	c, mux := newUploadMux(t)
+	writeFiles(t, c.DataDir, map[string]string{
+		"a.txt":                           "a",
+		"docs/b.txt":                      "b",
+		"z.txt":                           "z", // after the reserved file below
+		".shares/shares.json":             `{"token":"secret"}`,
+		".trash/1-c.txt":                  "c",
+		".uploads/partial":                "p",
+		".activity/log.jsonl":             "{}",
+		".checksums/sums.json":            "{}",
+		managed.ObsoleteDirName + "/v1/x": "x",
+		"wifi-config.json":                `{"password":"hunter22"}`,
+	})
+
+	w := do(t, mux, "GET", "/api/download?paths=/", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("download: %d %s", w.Code, w.Body)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	sort.Strings(names)
+	want := []string{"strct/", "strct/a.txt", "strct/docs/", "strct/docs/b.txt", "strct/z.txt"}
+	if strings.Join(names, " ") != strings.Join(want, " ") {
+		t.Errorf("entries = %v, want %v", names, want)
+	}
+}
+
+func TestDownload_SingleFolderName(t *testing.T) {
+	c, mux := newUploadMux(t)
+	os.Mkdir(filepath.Join(c.DataDir, "docs"), 0755)
+
+	w := do(t, mux, "GET", "/api/download?paths=/docs", "")
+	if cd := w.Header().Get("Content-Disposition"); cd != `attachment; filename=docs.zip` {
+		t.Errorf("Content-Disposition = %q", cd)
+	}
+}
+
+func TestDownload_Validation(t *testing.T) {
+	_, mux := newUploadMux(t)
+	for _, tc := range []struct {
+		target string
+		want   int
+	}{
+		{"/api/download", http.StatusBadRequest},
+		{"/api/download?paths=/missing", http.StatusNotFound},
+		{"/api/download?paths=/.uploads", http.StatusForbidden},
+	} {
+		if w := do(t, mux, "GET", tc.target, ""); w.Code != tc.want {
+			t.Errorf("%s: got %d, want %d", tc.target, w.Code, tc.want)
+		}
+	}
+}
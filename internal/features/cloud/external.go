@@ -0,0 +1,600 @@
+package cloud
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/audit"
+	"github.com/strct-org/strct-agent/internal/httputil"
+	"github.com/strct-org/strct-agent/internal/humanize"
+	"github.com/strct-org/strct-agent/internal/statefile"
+)
+
+// Attached folders. A folder on another mounted filesystem, say a USB
+// drive with a media library, can be browsed through the file API without
+// moving it into DataDir:
+//
+//	POST   /api/storage/attach          {"source":"/media/usb/Movies","name":"movies"}
+//	GET    /api/storage/attach
+//	DELETE /api/storage/attach/{name}
+//
+// The source is bind-mounted at DataDir/external/<name>, read-only unless
+// the request sets read_write. Without real hardware, where the agent
+// can't mount, a symlink stands in. The file API serves it like any
+// folder, with these differences:
+//
+//   - Each attachment is its own root: a path inside one is resolved
+//     through symlinks and must stay inside it.
+//   - In a read-only attachment every write gets 403, before the kernel
+//     would refuse it.
+//   - Deletes in a read-write one are permanent: the trash is on the data
+//     drive, and copying a film there to delete it helps no one.
+//   - external/ and the attachments themselves can't be written to, moved
+//     or deleted through the file API. Detaching unmounts and leaves the
+//     source as it was.
+//   - Their bytes count toward no storage figure.
+//
+// Attachments are kept in DataDir/.attachments.json and mounted again at
+// start, and hourly, if their source is there. One whose source is not is
+// "missing": its folder answers 503 rather than looking empty.
+const (
+	externalDirName = "external"
+	attachmentsFile = ".attachments.json"
+
+	mountInfoPath = "/proc/self/mountinfo"
+
+	AttachMounted = "mounted"
+	AttachMissing = "missing" // the source is not there; mounted again once it is
+	AttachFailed  = "failed"  // the source is there but did not mount; see Error
+)
+
+// attachFSTypes are the filesystems a source may be on: drives and network
+// shares, not /proc, tmpfs or the like.
+var attachFSTypes = []string{
+	"ext2", "ext3", "ext4", "btrfs", "xfs", "f2fs",
+	"vfat", "exfat", "ntfs", "ntfs3", "fuseblk", "hfsplus", "iso9660", "udf",
+	"nfs", "nfs4", "cifs", "smb3",
+}
+
+// attachNameRe is an attachment's name: its folder under external/.
+var attachNameRe = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
+var attachmentsSchema = statefile.Schema{
+	Name:       "attachments",
+	Migrations: []statefile.Migration{statefile.Stamp},
+}
+
+var (
+	errExternalManaged  = errors.New("external/ holds attached folders only: attach or detach with /api/storage/attach")
+	errExternalReadOnly = errors.New("the attached folder is read-only: attach it again with read_write to change it")
+	errExternalMissing  = errors.New("the attached folder is missing: its source is not mounted")
+	errExternalEscape   = errors.New("the path leaves its attached folder")
+)
+
+// Attachment is one attached folder. /api/storage/attach lists them.
+type Attachment struct {
+	Name      string    `json:"name"`
+	Source    string    `json:"source"`
+	ReadWrite bool      `json:"read_write"`
+	Path      string    `json:"path"` // in the file API
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// attachmentsState is .attachments.json. The agent writes it; a file
+// worker rereads it when it changes.
+type attachmentsState struct {
+	Attachments []Attachment `json:"attachments"`
+}
+
+// attachments caches .attachments.json.
+type attachments struct {
+	mu      sync.Mutex // held across attach and detach, which mount
+	list    []Attachment
+	modTime time.Time
+}
+
+func (s *Cloud) externalDir() string {
+	return filepath.Join(s.DataDir, externalDirName)
+}
+
+func (s *Cloud) attachmentsPath() string {
+	return filepath.Join(s.DataDir, attachmentsFile)
+}
+
+// external reports whether full is external/ or inside it.
+func (s *Cloud) external(full string) bool {
+	return full == s.externalDir() || within(full, s.externalDir())
+}
+
+// attached returns the attachments, rereading the file if it changed.
+func (s *Cloud) attached() []Attachment {
+	s.attach.mu.Lock()
+	defer s.attach.mu.Unlock()
+	return slices.Clone(s.attachedLocked())
+}
+
+func (s *Cloud) attachedLocked() []Attachment {
+	info, err := os.Stat(s.attachmentsPath())
+	if err != nil {
+		s.attach.list, s.attach.modTime = nil, time.Time{}
+		return nil
+	}
+	if info.ModTime().Equal(s.attach.modTime) {
+		return s.attach.list
+	}
+	var st attachmentsState
+	if err := statefile.Load(s.attachmentsPath(), attachmentsSchema, &st); err != nil && !statefile.Fresh(err) {
+		slog.Warn("cloud: could not read the attached folders", "err", err)
+		return s.attach.list
+	}
+	s.attach.list, s.attach.modTime = st.Attachments, info.ModTime()
+	return s.attach.list
+}
+
+func (s *Cloud) saveAttachedLocked(list []Attachment) error {
+	if err := statefile.Save(s.attachmentsPath(), attachmentsSchema, attachmentsState{Attachments: list}); err != nil {
+		return fmt.Errorf("save attached folders: %w", err)
+	}
+	s.attach.list = list
+	if info, err := os.Stat(s.attachmentsPath()); err == nil {
+		s.attach.modTime = info.ModTime()
+	}
+	return nil
+}
+
+// attachmentOf returns the attachment full is in, or its root.
+func (s *Cloud) attachmentOf(full string) (Attachment, bool) {
+	rel, err := filepath.Rel(s.externalDir(), full)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return Attachment{}, false
+	}
+	name, _, _ := strings.Cut(filepath.ToSlash(rel), "/")
+	for _, a := range s.attached() {
+		if a.Name == name {
+			return a, true
+		}
+	}
+	return Attachment{}, false
+}
+
+// checkExternal is userPath's check of a path under external/: it has to
+// be in a mounted attachment, and stay there once symlinks are followed.
+func (s *Cloud) checkExternal(full string) error {
+	if !within(full, s.externalDir()) {
+		return nil
+	}
+	a, ok := s.attachmentOf(full)
+	if !ok {
+		return os.ErrNotExist
+	}
+	if a.Status != AttachMounted {
+		return fmt.Errorf("%w: %s", errExternalMissing, a.Source)
+	}
+	root, err := filepath.EvalSymlinks(filepath.Join(s.externalDir(), a.Name))
+	if err != nil {
+		return fmt.Errorf("%w: %s", errExternalMissing, a.Source)
+	}
+	real, err := resolveExisting(full)
+	if err != nil {
+		return err
+	}
+	if real != root && !within(real, root) {
+		return errExternalEscape
+	}
+	return nil
+}
+
+// resolveExisting is full with the symlinks in its existing part
+// resolved; the rest, a file about to be created, is appended as is.
+func resolveExisting(full string) (string, error) {
+	var rest []string
+	p := full
+	for {
+		real, err := filepath.EvalSymlinks(p)
+		if err == nil {
+			return filepath.Join(append([]string{real}, rest...)...), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		parent := filepath.Dir(p)
+		if parent == p {
+			return "", err
+		}
+		rest = append([]string{filepath.Base(p)}, rest...)
+		p = parent
+	}
+}
+
+// canChange reports whether full may be written, replaced, moved or
+// deleted through the file API.
+func (s *Cloud) canChange(full string) error {
+	if !s.external(full) {
+		return nil
+	}
+	if a, ok := s.attachmentOf(full); !ok || full == filepath.Join(s.externalDir(), a.Name) {
+		return errExternalManaged
+	}
+	return s.canWriteIn(filepath.Dir(full))
+}
+
+// canWriteIn reports whether files and folders may be created in dir.
+func (s *Cloud) canWriteIn(dir string) error {
+	if !s.external(dir) {
+		return nil
+	}
+	a, ok := s.attachmentOf(dir)
+	switch {
+	case !ok:
+		return errExternalManaged
+	case a.Status != AttachMounted:
+		return fmt.Errorf("%w: %s", errExternalMissing, a.Source)
+	case !a.ReadWrite:
+		return errExternalReadOnly
+	}
+	return nil
+}
+
+// placeUpload moves a finished upload from the uploads folder to dst. An
+// attached folder is another drive, where a rename won't reach: the file
+// is copied, and a file it replaces is set aside until it is in place.
+func (s *Cloud) placeUpload(part, dst string) error {
+	if !s.external(dst) {
+		return os.Rename(part, dst)
+	}
+	info, err := os.Lstat(dst)
+	if err == nil && !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a file", dst)
+	}
+	return movePath(part, dst, err == nil)
+}
+
+// pathError answers a path the file API refused. The attached folders'
+// reasons are spelled out; anything else is a bare 403, as before.
+func pathError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errExternalMissing):
+		httputil.Error(w, http.StatusServiceUnavailable, err.Error())
+	case errors.Is(err, errExternalManaged), errors.Is(err, errExternalReadOnly), errors.Is(err, errExternalEscape):
+		httputil.Error(w, http.StatusForbidden, err.Error())
+	case errors.Is(err, os.ErrNotExist):
+		httputil.Error(w, http.StatusNotFound, "not found")
+	default:
+		httputil.Forbidden(w)
+	}
+}
+
+// attachedItems is the listing of external/: every attachment, the
+// missing ones included, with its status.
+func (s *Cloud) attachedItems() []FileItem {
+	items := []FileItem{}
+	for _, a := range s.attached() {
+		item := FileItem{
+			Name:       a.Name,
+			Size:       humanize.Bytes(0),
+			Type:       "folder",
+			ModifiedAt: a.CreatedAt.Format(time.RFC3339),
+			Status:     a.Status,
+		}
+		if info, err := os.Stat(filepath.Join(s.externalDir(), a.Name)); err == nil && a.Status == AttachMounted {
+			item.ModifiedAt = info.ModTime().Format(time.RFC3339)
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
+// ---------------------------------------------------------------------------
+// Mounting
+// ---------------------------------------------------------------------------
+
+// commander is the subset of executil.Runner mounting needs.
+type commander interface {
+	Run(name string, args ...string) error
+	CombinedOutput(name string, args ...string) ([]byte, error)
+}
+
+// mountEntry is a line of /proc/self/mountinfo.
+type mountEntry struct {
+	point  string
+	fstype string
+}
+
+// readMounts parses a mountinfo file.
+func readMounts(path string) ([]mountEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var mounts []mountEntry
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw
+		pre, post, ok := strings.Cut(sc.Text(), " - ")
+		fields, after := strings.Fields(pre), strings.Fields(post)
+		if !ok || len(fields) < 5 || len(after) < 1 {
+			continue
+		}
+		mounts = append(mounts, mountEntry{point: unescapeMount(fields[4]), fstype: after[0]})
+	}
+	return mounts, sc.Err()
+}
+
+// unescapeMount undoes mountinfo's octal escapes: \040 is a space.
+func unescapeMount(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// mountOf is the mount path is on: the one with the longest mount point
+// that contains it.
+func mountOf(mounts []mountEntry, path string) (mountEntry, bool) {
+	var best mountEntry
+	found := false
+	for _, m := range mounts {
+		if (path == m.point || m.point == "/" || within(path, m.point)) && len(m.point) >= len(best.point) {
+			best, found = m, true
+		}
+	}
+	return best, found
+}
+
+// checkSource resolves source and checks it may be attached: a folder on
+// a mounted drive or share, outside DataDir and not holding it.
+func (s *Cloud) checkSource(source string) (string, error) {
+	if !filepath.IsAbs(source) {
+		return "", errors.New("source must be an absolute path")
+	}
+	real, err := filepath.EvalSymlinks(filepath.Clean(source))
+	if err != nil {
+		return "", fmt.Errorf("source: %w", err)
+	}
+	if info, err := os.Stat(real); err != nil || !info.IsDir() {
+		return "", errors.New("source is not a folder")
+	}
+	data, err := filepath.EvalSymlinks(s.DataDir)
+	if err != nil {
+		data = s.DataDir
+	}
+	if real == data || within(real, data) || within(data, real) {
+		return "", errors.New("source must be outside the data folder, and not contain it")
+	}
+	mounts, err := readMounts(s.mountInfo)
+	if err != nil {
+		return "", fmt.Errorf("read mounts: %w", err)
+	}
+	m, ok := mountOf(mounts, real)
+	switch {
+	case !ok || m.point == "/":
+		return "", errors.New("source must be on a mounted drive or share, not the system disk")
+	case m.point == "/boot" || within(m.point, "/boot"):
+		return "", errors.New("source must not be the boot partition")
+	case !slices.Contains(attachFSTypes, m.fstype):
+		return "", fmt.Errorf("source is on a %s filesystem; attach folders on drives or network shares", m.fstype)
+	}
+	if dm, ok := mountOf(mounts, data); ok && dm.point == m.point && dm.point != "/" {
+		return "", errors.New("source must not be on the data drive")
+	}
+	return real, nil
+}
+
+// mount exposes a's source at its folder under external/.
+func (s *Cloud) mount(a Attachment) error {
+	target := filepath.Join(s.externalDir(), a.Name)
+	if s.cmd == nil {
+		os.Remove(target) //nolint:errcheck // a stale link
+		if err := os.MkdirAll(s.externalDir(), 0755); err != nil {
+			return err
+		}
+		return os.Symlink(a.Source, target)
+	}
+	if mounted, _ := s.mountedAt(target); mounted {
+		return nil
+	}
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return err
+	}
+	if out, err := s.cmd.CombinedOutput("mount", "--bind", a.Source, target); err != nil {
+		return fmt.Errorf("mount --bind: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	opts := "remount,bind,nosuid,nodev,ro"
+	if a.ReadWrite {
+		opts = "remount,bind,nosuid,nodev,rw"
+	}
+	if out, err := s.cmd.CombinedOutput("mount", "-o", opts, target); err != nil {
+		// Never leave it mounted read-write by mistake.
+		s.cmd.Run("umount", target) //nolint:errcheck
+		return fmt.Errorf("mount -o %s: %w: %s", opts, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// unmount removes a's folder under external/. The source is untouched.
+func (s *Cloud) unmount(a Attachment) error {
+	target := filepath.Join(s.externalDir(), a.Name)
+	if s.cmd == nil {
+		if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	if mounted, _ := s.mountedAt(target); mounted {
+		// Lazily: a stream still reading from it finishes.
+		if out, err := s.cmd.CombinedOutput("umount", "-l", target); err != nil {
+			return fmt.Errorf("umount: %w: %s", err, strings.TrimSpace(string(out)))
+		}
+	}
+	// Only ever an empty mount point: Remove, never RemoveAll.
+	if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *Cloud) mountedAt(target string) (bool, error) {
+	mounts, err := readMounts(s.mountInfo)
+	if err != nil {
+		return false, err
+	}
+	return slices.ContainsFunc(mounts, func(m mountEntry) bool { return m.point == target }), nil
+}
+
+// refreshAttached mounts the attachments whose source is there and marks
+// the others missing, unmounting those whose source went away.
+func (s *Cloud) refreshAttached() {
+	s.attach.mu.Lock()
+	defer s.attach.mu.Unlock()
+	list := slices.Clone(s.attachedLocked())
+	changed := false
+	for i, a := range list {
+		status, msg := AttachMounted, ""
+		if _, err := s.checkSource(a.Source); err != nil {
+			status = AttachMissing
+			if a.Status == AttachMounted {
+				slog.Warn("cloud: attached folder's source is gone", "name", a.Name, "source", a.Source, "err", err)
+			}
+			s.unmount(a) //nolint:errcheck // nothing to serve either way
+		} else if err := s.mount(a); err != nil {
+			status, msg = AttachFailed, err.Error()
+			slog.Error("cloud: could not mount attached folder", "name", a.Name, "source", a.Source, "err", err)
+		} else if a.Status != AttachMounted {
+			slog.Info("cloud: attached folder mounted", "name", a.Name, "source", a.Source, "read_write", a.ReadWrite)
+		}
+		if status != a.Status || msg != a.Error {
+			list[i].Status, list[i].Error, changed = status, msg, true
+		}
+	}
+	if changed {
+		if err := s.saveAttachedLocked(list); err != nil {
+			slog.Error("cloud: could not save the attached folders", "err", err)
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
+// HTTP handlers
+// ---------------------------------------------------------------------------
+
+func (s *Cloud) handleListAttached(w http.ResponseWriter, r *http.Request) {
+	s.refreshAttached()
+	list := s.attached()
+	if list == nil {
+		list = []Attachment{}
+	}
+	httputil.OK(w, map[string]any{"attachments": list})
+}
+
+// handleAttach exposes a folder on another drive under /external.
+// POST body: {"source":"/media/usb/Movies","name":"movies","read_write":false}
+func (s *Cloud) handleAttach(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Source    string `json:"source"`
+		Name      string `json:"name"`
+		ReadWrite bool   `json:"read_write"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httputil.BadRequest(w, "invalid JSON")
+		return
+	}
+	audit.Target(r.Context(), req.Name+" <- "+req.Source+" rw="+strconv.FormatBool(req.ReadWrite))
+	if !attachNameRe.MatchString(req.Name) {
+		httputil.BadRequest(w, "name must be 1-32 lowercase letters, digits, - or _")
+		return
+	}
+	source, err := s.checkSource(req.Source)
+	if err != nil {
+		httputil.Error(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	s.attach.mu.Lock()
+	defer s.attach.mu.Unlock()
+	list := slices.Clone(s.attachedLocked())
+	for _, a := range list {
+		if a.Name == req.Name {
+			httputil.Error(w, http.StatusConflict, "an attached folder is already named "+req.Name)
+			return
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(s.externalDir(), req.Name)); err == nil {
+		httputil.Error(w, http.StatusConflict, "external/"+req.Name+" already exists")
+		return
+	}
+	a := Attachment{
+		Name:      req.Name,
+		Source:    source,
+		ReadWrite: req.ReadWrite,
+		Path:      "/" + externalDirName + "/" + req.Name,
+		Status:    AttachMounted,
+		CreatedAt: time.Now().UTC(),
+	}
+	if err := s.mount(a); err != nil {
+		slog.Error("cloud: could not attach folder", "name", a.Name, "source", source, "err", err)
+		httputil.InternalError(w, "could not mount "+source+": "+err.Error())
+		return
+	}
+	if err := s.saveAttachedLocked(append(list, a)); err != nil {
+		s.unmount(a) //nolint:errcheck
+		httputil.InternalError(w, err.Error())
+		return
+	}
+	s.index.invalidate()
+	slog.Info("cloud: folder attached", "name", a.Name, "source", source, "read_write", a.ReadWrite)
+	httputil.JSON(w, http.StatusCreated, a)
+}
+
+// handleDetach unmounts an attached folder. Its files stay where they
+// are, on the source.
+// DELETE /api/storage/attach/{name}
+func (s *Cloud) handleDetach(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	audit.Target(r.Context(), name)
+	s.attach.mu.Lock()
+	defer s.attach.mu.Unlock()
+	list := slices.Clone(s.attachedLocked())
+	i := slices.IndexFunc(list, func(a Attachment) bool { return a.Name == name })
+	if i < 0 {
+		httputil.Error(w, http.StatusNotFound, "no attached folder named "+name)
+		return
+	}
+	if err := s.unmount(list[i]); err != nil {
+		slog.Error("cloud: could not detach folder", "name", name, "err", err)
+		httputil.InternalError(w, "could not unmount: "+err.Error())
+		return
+	}
+	if err := s.saveAttachedLocked(slices.Delete(list, i, i+1)); err != nil {
+		httputil.InternalError(w, err.Error())
+		return
+	}
+	s.index.invalidate()
+	slog.Info("cloud: folder detached", "name", name)
+	httputil.NoContent(w)
+}
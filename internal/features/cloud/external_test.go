@@ -0,0 +1,278 @@
+package cloud
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/strct-org/strct-agent/internal/httputil"
+)
+
+// newAttachMux is newUploadMux with a drive: a folder mountinfo says is
+// an ext4 filesystem of its own, holding Movies/film.mkv.
+func newAttachMux(t *testing.T) (*Cloud, http.Handler, string) {
+	t.Helper()
+	c, mux := newUploadMux(t)
+	drive, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, drive, map[string]string{"Movies/film.mkv": "film", "Music/song.mp3": "song"})
+	c.mountInfo = fakeMountInfo(t, drive)
+	return c, httputil.Versioned(mux), drive
+}
+
+func fakeMountInfo(t *testing.T, drive string) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), "mountinfo")
+	info := "22 1 179:2 / / rw,relatime - ext4 /dev/mmcblk0p2 rw\n" +
+		"23 22 0:5 / /proc rw - proc proc rw\n" +
+		fmt.Sprintf("40 22 8:1 / %s rw,relatime - ext4 /dev/sda1 rw\n", strings.ReplaceAll(drive, " ", `\040`))
+	if err := os.WriteFile(p, []byte(info), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func attach(t *testing.T, mux http.Handler, body string) Attachment {
+	t.Helper()
+	w := do(t, mux, "POST", "/api/storage/attach", body)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("attach %s: %d %s", body, w.Code, w.Body)
+	}
+	var a Attachment
+	if err := json.Unmarshal(w.Body.Bytes(), &a); err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func listFiles(t *testing.T, mux http.Handler, dir string) []FileItem {
+	t.Helper()
+	w := do(t, mux, "GET", "/api/v1/files?path="+dir, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("files %s: %d %s", dir, w.Code, w.Body)
+	}
+	var page httputil.Page[FileItem]
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+		t.Fatal(err)
+	}
+	return page.Items
+}
+
+func uploadTo(mux http.Handler, dir, name, body string) *httptest.ResponseRecorder {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fw, _ := mw.CreateFormFile("file", name)
+	fw.Write([]byte(body))
+	mw.Close()
+	req := httptest.NewRequest("POST", "/strct_agent/fs/upload?path="+dir, &buf)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	return w
+}
+
+func TestAttach_ReadOnlyByDefault(t *testing.T) {
+	c, mux, drive := newAttachMux(t)
+	a := attach(t, mux, fmt.Sprintf(`{"source":%q,"name":"movies"}`, filepath.Join(drive, "Movies")))
+	if a.ReadWrite || a.Status != AttachMounted || a.Path != "/external/movies" {
+		t.Errorf("attached: %+v", a)
+	}
+
+	items := listFiles(t, mux, "/external")
+	if len(items) != 1 || items[0].Name != "movies" || items[0].Type != "folder" || items[0].Status != AttachMounted {
+		t.Errorf("/external: %+v", items)
+	}
+	items = listFiles(t, mux, "/external/movies")
+	if len(items) != 1 || items[0].Name != "film.mkv" {
+		t.Errorf("/external/movies: %+v", items)
+	}
+	if w := do(t, mux, "GET", "/api/v1/files?path=/external/nope", ""); w.Code != http.StatusNotFound {
+		t.Errorf("an unknown attachment: %d", w.Code)
+	}
+
+	for _, tc := range []struct{ name, method, target, body string }{
+		{"mkdir", "POST", "/api/mkdir", `{"path":"/external/movies","name":"new"}`},
+		{"delete", "DELETE", "/api/delete?path=/external/movies/film.mkv", ""},
+		{"move out", "POST", "/api/move", `{"from":"/external/movies/film.mkv","to":"/film.mkv"}`},
+		{"delete the attachment", "DELETE", "/api/delete?path=/external/movies", ""},
+		{"delete external", "DELETE", "/api/delete?path=/external", ""},
+		{"mkdir in external", "POST", "/api/mkdir", `{"path":"/external","name":"new"}`},
+		{"resumable upload", "POST", "/api/upload/init", `{"path":"/external/movies","name":"x.mkv","size":1}`},
+	} {
+		if w := do(t, mux, tc.method, tc.target, tc.body); w.Code != http.StatusForbidden {
+			t.Errorf("%s: %d %s", tc.name, w.Code, w.Body)
+		}
+	}
+	if w := uploadTo(mux, "/external/movies", "x.mkv", "x"); w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "read-only") {
+		t.Errorf("upload: %d %s", w.Code, w.Body)
+	}
+	if readFile(t, filepath.Join(drive, "Movies", "film.mkv")) != "film" {
+		t.Error("the source changed")
+	}
+
+	// The drive's bytes are not the data drive's.
+	<-c.refreshUsage()
+	if b := breakdownOf(t, mux); b.LiveBytes != 0 {
+		t.Errorf("live bytes %d, want 0", b.LiveBytes)
+	}
+}
+
+func TestAttach_ReadWriteDeletesForGood(t *testing.T) {
+	c, mux, drive := newAttachMux(t)
+	attach(t, mux, fmt.Sprintf(`{"source":%q,"name":"music","read_write":true}`, filepath.Join(drive, "Music")))
+
+	if w := do(t, mux, "POST", "/api/mkdir", `{"path":"/external/music","name":"new"}`); w.Code != http.StatusCreated {
+		t.Fatalf("mkdir: %d %s", w.Code, w.Body)
+	}
+	if w := uploadTo(mux, "/external/music/new", "b.mp3", "bee"); w.Code != http.StatusCreated {
+		t.Fatalf("upload: %d %s", w.Code, w.Body)
+	}
+	if readFile(t, filepath.Join(drive, "Music", "new", "b.mp3")) != "bee" {
+		t.Error("upload did not land on the drive")
+	}
+	if w := do(t, mux, "DELETE", "/api/delete?path=/external/music/song.mp3", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("delete: %d %s", w.Code, w.Body)
+	}
+	if _, err := os.Stat(filepath.Join(drive, "Music", "song.mp3")); !os.IsNotExist(err) {
+		t.Error("deleted file still on the drive")
+	}
+	if entries, _ := os.ReadDir(filepath.Join(c.DataDir, trashDirName)); len(entries) != 0 {
+		t.Errorf("deleted file went to the trash: %v", entries)
+	}
+	// Still not the attachment itself.
+	if w := do(t, mux, "DELETE", "/api/delete?path=/external/music", ""); w.Code != http.StatusForbidden {
+		t.Errorf("delete the attachment: %d", w.Code)
+	}
+}
+
+func TestAttach_EachRootIsItsOwn(t *testing.T) {
+	c, mux, drive := newAttachMux(t)
+	attach(t, mux, fmt.Sprintf(`{"source":%q,"name":"movies"}`, filepath.Join(drive, "Movies")))
+	attach(t, mux, fmt.Sprintf(`{"source":%q,"name":"music"}`, filepath.Join(drive, "Music")))
+	writeFiles(t, c.DataDir, map[string]string{"private/notes.txt": "secret"})
+	os.Symlink(filepath.Join(drive, "Music"), filepath.Join(drive, "Movies", "music"))
+	os.Symlink(filepath.Join(c.DataDir, "private"), filepath.Join(drive, "Movies", "private"))
+	os.Symlink("../Movies", filepath.Join(drive, "Music", "up"))
+	os.Symlink(filepath.Join(drive, "Movies", "film.mkv"), filepath.Join(drive, "Movies", "same.mkv"))
+
+	for _, p := range []string{"/external/movies/music", "/external/movies/private", "/external/movies/private/notes.txt", "/external/music/up"} {
+		if w := do(t, mux, "GET", "/api/v1/files?path="+p, ""); w.Code != http.StatusForbidden {
+			t.Errorf("%s: %d %s", p, w.Code, w.Body)
+		}
+		if w := do(t, mux, "GET", "/files"+p, ""); w.Code != http.StatusNotFound {
+			t.Errorf("/files%s: %d", p, w.Code)
+		}
+	}
+	// A link that stays inside is fine.
+	if w := do(t, mux, "GET", "/files/external/movies/same.mkv", ""); w.Code != http.StatusOK || w.Body.String() != "film" {
+		t.Errorf("link inside the attachment: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestAttach_DetachAndMissingSource(t *testing.T) {
+	c, mux, drive := newAttachMux(t)
+	src := filepath.Join(drive, "Movies")
+	attach(t, mux, fmt.Sprintf(`{"source":%q,"name":"movies"}`, src))
+
+	if w := do(t, mux, "DELETE", "/api/storage/attach/movies", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("detach: %d %s", w.Code, w.Body)
+	}
+	if readFile(t, filepath.Join(src, "film.mkv")) != "film" {
+		t.Error("detach touched the source")
+	}
+	if w := do(t, mux, "GET", "/api/v1/files?path=/external/movies", ""); w.Code != http.StatusNotFound {
+		t.Errorf("detached: %d", w.Code)
+	}
+	if w := do(t, mux, "DELETE", "/api/storage/attach/movies", ""); w.Code != http.StatusNotFound {
+		t.Errorf("detach twice: %d", w.Code)
+	}
+
+	// Kept across a restart, and missing while the drive is away.
+	attach(t, mux, fmt.Sprintf(`{"source":%q,"name":"movies"}`, src))
+	if err := os.Rename(src, src+".away"); err != nil {
+		t.Fatal(err)
+	}
+	c2 := New(c.DataDir, 8080, true)
+	c2.mountInfo = c.mountInfo
+	if err := c2.initFileSystem(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c2.Close)
+	mux2 := http.NewServeMux()
+	c2.RegisterRoutes(mux2)
+	h := httputil.Versioned(mux2)
+
+	if items := listFiles(t, h, "/external"); len(items) != 1 || items[0].Status != AttachMissing {
+		t.Errorf("/external with the drive away: %+v", items)
+	}
+	if w := do(t, h, "GET", "/api/v1/files?path=/external/movies", ""); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("missing attachment: %d %s", w.Code, w.Body)
+	}
+	if w := do(t, h, "POST", "/api/storage/attach", fmt.Sprintf(`{"source":%q,"name":"movies"}`, filepath.Join(drive, "Music"))); w.Code != http.StatusConflict {
+		t.Errorf("name taken by a missing attachment: %d", w.Code)
+	}
+
+	// Back again: the next refresh mounts it.
+	if err := os.Rename(src+".away", src); err != nil {
+		t.Fatal(err)
+	}
+	w := do(t, h, "GET", "/api/storage/attach", "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"status":"mounted"`) {
+		t.Errorf("list: %d %s", w.Code, w.Body)
+	}
+	if items := listFiles(t, h, "/external/movies"); len(items) != 1 {
+		t.Errorf("remounted: %+v", items)
+	}
+}
+
+func TestAttach_Validation(t *testing.T) {
+	c, mux, drive := newAttachMux(t)
+	os.Mkdir(filepath.Join(c.DataDir, "inside"), 0755)
+	system := t.TempDir() // on "/" as far as the fake mountinfo goes
+
+	for body, want := range map[string]int{
+		fmt.Sprintf(`{"source":%q,"name":"in"}`, filepath.Join(c.DataDir, "inside")):       http.StatusUnprocessableEntity,
+		fmt.Sprintf(`{"source":%q,"name":"sys"}`, system):                                  http.StatusUnprocessableEntity,
+		`{"source":"/proc","name":"proc"}`:                                                 http.StatusUnprocessableEntity,
+		`{"source":"Movies","name":"rel"}`:                                                 http.StatusUnprocessableEntity,
+		fmt.Sprintf(`{"source":%q,"name":"gone"}`, filepath.Join(drive, "nope")):           http.StatusUnprocessableEntity,
+		fmt.Sprintf(`{"source":%q,"name":"file"}`, filepath.Join(drive, "Music/song.mp3")): http.StatusUnprocessableEntity,
+		fmt.Sprintf(`{"source":%q,"name":"Bad Name"}`, filepath.Join(drive, "Movies")):     http.StatusBadRequest,
+		fmt.Sprintf(`{"source":%q,"name":"../x"}`, filepath.Join(drive, "Movies")):         http.StatusBadRequest,
+		`not json`: http.StatusBadRequest,
+	} {
+		if w := do(t, mux, "POST", "/api/storage/attach", body); w.Code != want {
+			t.Errorf("%s: %d %s, want %d", body, w.Code, w.Body, want)
+		}
+	}
+
+	// A folder the user made called external is in the way.
+	os.Mkdir(filepath.Join(c.DataDir, "external"), 0755)
+	os.Mkdir(filepath.Join(c.DataDir, "external", "movies"), 0755)
+	if w := do(t, mux, "POST", "/api/storage/attach", fmt.Sprintf(`{"source":%q,"name":"movies"}`, filepath.Join(drive, "Movies"))); w.Code != http.StatusConflict {
+		t.Errorf("over an existing folder: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestUnescapeMount(t *testing.T) {
+	for in, want := range map[string]string{
+		`/media/usb`:          "/media/usb",
+		`/media/My\040Drive`:  "/media/My Drive",
+		`/media/a\134b`:       `/media/a\b`,
+		`/media/trailing\04`:  `/media/trailing\04`,
+		`/media/not\999octal`: `/media/not\999octal`,
+	} {
+		if got := unescapeMount(in); got != want {
+			t.Errorf("unescapeMount(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
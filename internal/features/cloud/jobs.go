@@ -0,0 +1,367 @@
+package cloud
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/maintenance"
+	"github.com/strct-org/strct-agent/internal/resources"
+)
+
+// Background jobs. Thumbnails, verify's hashing and search index rebuilds
+// all read the data drive, and each running its own walker or pool had
+// them fighting over the one disk. They share one queue instead:
+//
+//   - JobWorkers workers (CLOUD_JOB_WORKERS, default 2) run the jobs; they
+//     start when work arrives and exit when the queue is empty;
+//   - interactive jobs, which a request is waiting on (a missing
+//     thumbnail), run before maintenance ones (hashing for verify, index
+//     rebuilds);
+//   - a job for a key already queued or running (the same thumbnail, the
+//     same file's hash) is joined rather than run twice;
+//   - every job runs under its own context, cancelled on Close, and an
+//     interactive job whose last waiter gave up is cancelled too;
+//   - a worker pauses JobPace after each maintenance job, so a long verify
+//     leaves the disk gaps for everything else;
+//   - maintenance jobs are gated like the agent's other background work:
+//     they don't start in maintenance mode, and enabling it cancels the
+//     running ones. Interactive jobs are serving, which is never gated.
+//
+// At most maxQueuedJobs wait; past that submit fails. Depth, throughput
+// and per-type counts are reported on /api/system/resources under cloud.
+const (
+	prioInteractive = iota
+	prioMaintenance
+	numPriorities
+)
+
+// Job types.
+const (
+	jobThumb = "thumbnail"
+	jobHash  = "hash"
+	jobIndex = "search_index"
+)
+
+const (
+	defaultJobWorkers = 2
+	maxQueuedJobs     = 4096
+	jobRateWindow     = time.Minute
+)
+
+var errQueueFull = errors.New("background job queue is full")
+
+// bgJob is one queued or running job.
+type bgJob struct {
+	kind, key string
+	prio      int
+	run       func(ctx context.Context) (any, error)
+	ctx       context.Context
+	cancel    context.CancelFunc
+	running   bool
+	waiters   int
+	done      chan struct{}
+	val       any // run's result, set with err before done is closed
+	err       error
+}
+
+type jobTypeCounters struct {
+	running                          int
+	done, failed, cancelled, deduped uint64
+	total                            time.Duration // of the jobs done
+}
+
+type jobQueue struct {
+	mu       sync.Mutex
+	base     context.Context
+	stop     context.CancelFunc
+	workers  int
+	pace     time.Duration
+	gate     *maintenance.Gate
+	pending  [numPriorities][]*bgJob // FIFO per priority
+	active   map[string]*bgJob       // queued or running, by kind and key
+	up       int                     // workers running
+	types    map[string]*jobTypeCounters
+	finished []time.Time // completions within jobRateWindow
+	done     uint64
+}
+
+// UseGate holds the maintenance jobs of the background queue while
+// maintenance mode is on. Call before Start.
+func (s *Cloud) UseGate(g *maintenance.Gate) {
+	s.gate = g
+}
+
+// background returns s's job queue, set up from JobWorkers, JobPace and
+// the gate on first use.
+func (s *Cloud) background() *jobQueue {
+	q := &s.jobs
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.active == nil {
+		q.base, q.stop = context.WithCancel(context.Background())
+		q.workers = s.JobWorkers
+		if q.workers < 1 {
+			q.workers = defaultJobWorkers
+		}
+		q.pace, q.gate = s.JobPace, s.gate
+		q.active = map[string]*bgJob{}
+		q.types = map[string]*jobTypeCounters{}
+		usage.ReportQueue(q.stats)
+	}
+	return q
+}
+
+func jobID(kind, key string) string { return kind + "\x00" + key }
+
+func (q *jobQueue) counters(kind string) *jobTypeCounters {
+	c := q.types[kind]
+	if c == nil {
+		c = &jobTypeCounters{}
+		q.types[kind] = c
+	}
+	return c
+}
+
+// submit queues run as a job of kind for key, or returns the job already
+// queued or running for them. An empty key is never joined.
+func (q *jobQueue) submit(kind, key string, prio int, run func(ctx context.Context) (any, error)) (*bgJob, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if key != "" {
+		if j := q.active[jobID(kind, key)]; j != nil {
+			q.counters(kind).deduped++
+			if !j.running && prio < j.prio {
+				q.remove(j)
+				j.prio = prio
+				q.pending[prio] = append(q.pending[prio], j)
+			}
+			return j, nil
+		}
+	}
+	depth := 0
+	for _, p := range q.pending {
+		depth += len(p)
+	}
+	if depth >= maxQueuedJobs {
+		return nil, errQueueFull
+	}
+
+	j := &bgJob{kind: kind, key: key, prio: prio, run: run, done: make(chan struct{})}
+	j.ctx, j.cancel = context.WithCancel(q.base)
+	q.pending[prio] = append(q.pending[prio], j)
+	if key != "" {
+		q.active[jobID(kind, key)] = j
+	}
+	q.counters(kind) // listed from the first submit
+	if q.up < q.workers {
+		q.up++
+		usage.Go(q.work)
+	}
+	return j, nil
+}
+
+// remove takes a queued j out of pending. q.mu must be held.
+func (q *jobQueue) remove(j *bgJob) {
+	p := q.pending[j.prio]
+	for i := range p {
+		if p[i] == j {
+			q.pending[j.prio] = append(p[:i:i], p[i+1:]...)
+			return
+		}
+	}
+}
+
+// wait blocks until j finishes or ctx ends, and returns its result. The
+// last waiter to give up on an interactive job cancels it: nobody wants
+// the result any more.
+func (q *jobQueue) wait(ctx context.Context, j *bgJob) (any, error) {
+	q.mu.Lock()
+	j.waiters++
+	q.mu.Unlock()
+	select {
+	case <-j.done:
+		return j.val, j.err
+	case <-ctx.Done():
+		q.mu.Lock()
+		j.waiters--
+		abandon := j.waiters == 0 && j.prio == prioInteractive
+		q.mu.Unlock()
+		if abandon {
+			q.cancel(j)
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// do submits a job and waits for it. Joining a job for the same key gets
+// that job's result.
+func (q *jobQueue) do(ctx context.Context, kind, key string, prio int, run func(ctx context.Context) (any, error)) (any, error) {
+	j, err := q.submit(kind, key, prio, run)
+	if err != nil {
+		return nil, err
+	}
+	return q.wait(ctx, j)
+}
+
+// cancel stops j: a queued job is dropped, a running one has its context
+// cancelled and finishes as its run returns.
+func (q *jobQueue) cancel(j *bgJob) {
+	q.mu.Lock()
+	if j.running {
+		q.mu.Unlock()
+		j.cancel()
+		return
+	}
+	defer q.mu.Unlock()
+	select {
+	case <-j.done:
+		return
+	default:
+	}
+	q.remove(j)
+	q.finishLocked(j, nil, context.Canceled, 0)
+}
+
+// next pops the most urgent job, or returns nil and retires the worker
+// when there is none.
+func (q *jobQueue) next() *bgJob {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for prio := range q.pending {
+		if p := q.pending[prio]; len(p) > 0 {
+			j := p[0]
+			q.pending[prio] = p[1:]
+			j.running = true
+			q.counters(j.kind).running++
+			return j
+		}
+	}
+	q.up--
+	return nil
+}
+
+// work runs jobs until the queue is empty.
+func (q *jobQueue) work() {
+	for j := q.next(); j != nil; j = q.next() {
+		start := time.Now()
+		val, err := q.runJob(j)
+		q.finish(j, val, err, time.Since(start))
+		if j.prio == prioMaintenance && q.pace > 0 {
+			time.Sleep(q.pace)
+		}
+	}
+}
+
+func (q *jobQueue) runJob(j *bgJob) (any, error) {
+	ctx := j.ctx
+	if j.prio == prioMaintenance {
+		gctx, done, err := q.gate.Begin(ctx, maintenance.JobCloudBackground)
+		if err != nil {
+			return nil, err
+		}
+		defer done()
+		ctx = gctx
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	defer usage.Time()()
+	return j.run(ctx)
+}
+
+// finish records j's outcome and wakes its waiters.
+func (q *jobQueue) finish(j *bgJob, val any, err error, took time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.finishLocked(j, val, err, took)
+}
+
+func (q *jobQueue) finishLocked(j *bgJob, val any, err error, took time.Duration) {
+	if j.key != "" && q.active[jobID(j.kind, j.key)] == j {
+		delete(q.active, jobID(j.kind, j.key))
+	}
+	c := q.counters(j.kind)
+	if j.running {
+		c.running--
+	}
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, maintenance.ErrActive):
+		c.cancelled++
+	case err != nil:
+		c.failed++
+	default:
+		c.done++
+		c.total += took
+		q.done++
+		now := time.Now()
+		q.finished = append(q.finished, now)
+		q.trimFinished(now)
+	}
+	j.running = false
+	j.val, j.err = val, err
+	j.cancel()
+	close(j.done)
+}
+
+// trimFinished drops completions older than jobRateWindow. q.mu must be
+// held.
+func (q *jobQueue) trimFinished(now time.Time) {
+	drop := 0
+	for drop < len(q.finished) && now.Sub(q.finished[drop]) > jobRateWindow {
+		drop++
+	}
+	q.finished = q.finished[drop:]
+}
+
+// close cancels every job, queued or running. Waiters get
+// context.Canceled.
+func (q *jobQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.active == nil {
+		return
+	}
+	q.stop()
+	for prio := range q.pending {
+		for _, j := range q.pending[prio] {
+			q.finishLocked(j, nil, context.Canceled, 0)
+		}
+		q.pending[prio] = nil
+	}
+}
+
+// stats is the queue as /api/system/resources reports it.
+func (q *jobQueue) stats() resources.QueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.trimFinished(time.Now())
+	st := resources.QueueStats{Workers: q.workers, Done: q.done, DonePerMinute: float64(len(q.finished))}
+	queued := map[string]int{}
+	for _, p := range q.pending {
+		st.Depth += len(p)
+		for _, j := range p {
+			queued[j.kind]++
+		}
+	}
+	for kind, c := range q.types {
+		t := resources.JobTypeStats{
+			Type:         kind,
+			Queued:       queued[kind],
+			Running:      c.running,
+			Done:         c.done,
+			Failed:       c.failed,
+			Cancelled:    c.cancelled,
+			Deduplicated: c.deduped,
+		}
+		if c.done > 0 {
+			t.AvgMs = float64(c.total.Milliseconds()) / float64(c.done)
+		}
+		st.Running += t.Running
+		st.Types = append(st.Types, t)
+	}
+	sort.Slice(st.Types, func(i, j int) bool { return st.Types[i].Type < st.Types[j].Type })
+	return st
+}
@@ -0,0 +1,155 @@
+package cloud
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/maintenance"
+)
+
+// testQueue is a one-worker queue with no pacing.
+func testQueue(t *testing.T, gate *maintenance.Gate) *jobQueue {
+	s := New(t.TempDir(), 0, true)
+	s.JobWorkers, s.JobPace = 1, 0
+	s.UseGate(gate)
+	t.Cleanup(s.jobs.close)
+	return s.background()
+}
+
+// block occupies the worker until the returned func is called.
+func block(t *testing.T, q *jobQueue) (release func()) {
+	t.Helper()
+	started, hold := make(chan struct{}), make(chan struct{})
+	if _, err := q.submit("block", "", prioMaintenance, func(context.Context) (any, error) {
+		close(started)
+		<-hold
+		return nil, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	return func() { close(hold) }
+}
+
+func TestJobQueue_PrioritizesAndDeduplicates(t *testing.T) {
+	q := testQueue(t, nil)
+	release := block(t, q)
+
+	var (
+		mu  sync.Mutex
+		ran []string
+	)
+	job := func(name string) func(context.Context) (any, error) {
+		return func(context.Context) (any, error) {
+			mu.Lock()
+			ran = append(ran, name)
+			mu.Unlock()
+			return name, nil
+		}
+	}
+	hash, _ := q.submit(jobHash, "/a", prioMaintenance, job("hash /a"))
+	q.submit(jobIndex, "index", prioMaintenance, job("index"))         //nolint:errcheck
+	again, _ := q.submit(jobHash, "/a", prioMaintenance, job("again")) // joins
+	thumb, _ := q.submit(jobThumb, "/t.jpg", prioInteractive, job("thumb"))
+	q.submit(jobIndex, "index", prioInteractive, job("index again")) //nolint:errcheck // joins, moves up
+	if again != hash {
+		t.Fatal("a second hash of /a was queued")
+	}
+	if st := q.stats(); st.Depth != 3 || st.Running != 1 {
+		t.Fatalf("stats while blocked = %+v", st)
+	}
+
+	release()
+	if v, err := q.wait(context.Background(), thumb); err != nil || v != "thumb" {
+		t.Fatalf("thumb = %v, %v", v, err)
+	}
+	if v, err := q.wait(context.Background(), again); err != nil || v != "hash /a" {
+		t.Fatalf("joined hash = %v, %v", v, err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"thumb", "index", "hash /a"}; len(ran) != 3 || ran[0] != want[0] || ran[1] != want[1] || ran[2] != want[2] {
+		t.Errorf("ran %v, want %v", ran, want)
+	}
+
+	st := q.stats()
+	if st.Done != 4 || st.Depth != 0 || st.DonePerMinute != 4 {
+		t.Errorf("stats = %+v", st)
+	}
+	for _, ty := range st.Types {
+		if ty.Type == jobHash && (ty.Done != 1 || ty.Deduplicated != 1) {
+			t.Errorf("hash stats = %+v", ty)
+		}
+	}
+}
+
+func TestJobQueue_MaintenanceModeDrains(t *testing.T) {
+	gate := maintenance.New(filepath.Join(t.TempDir(), "maintenance.json"))
+	q := testQueue(t, gate)
+
+	running := make(chan struct{})
+	hash, _ := q.submit(jobHash, "/big.iso", prioMaintenance, func(ctx context.Context) (any, error) {
+		close(running)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	<-running
+	st, err := gate.Enable("swap SSD", time.Time{}, 2*time.Second)
+	if err != nil || len(st.Running) != 0 {
+		t.Fatalf("enable = %+v, %v", st, err)
+	}
+	if _, err := q.wait(context.Background(), hash); !errors.Is(err, context.Canceled) {
+		t.Errorf("running hash ended with %v, want cancelled", err)
+	}
+
+	// Queued maintenance work doesn't start; thumbnails still do.
+	if _, err := q.do(context.Background(), jobIndex, "index", prioMaintenance, func(context.Context) (any, error) {
+		t.Error("index rebuilt in maintenance mode")
+		return nil, nil
+	}); !errors.Is(err, maintenance.ErrActive) {
+		t.Errorf("index in maintenance mode: %v", err)
+	}
+	if v, err := q.do(context.Background(), jobThumb, "/t.jpg", prioInteractive, func(context.Context) (any, error) {
+		return "ok", nil
+	}); err != nil || v != "ok" {
+		t.Errorf("thumb in maintenance mode: %v, %v", v, err)
+	}
+}
+
+func TestJobQueue_AbandonedInteractiveJobIsCancelled(t *testing.T) {
+	q := testQueue(t, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	running, stopped := make(chan struct{}), make(chan error, 1)
+	go q.do(ctx, jobThumb, "/huge.png", prioInteractive, func(jctx context.Context) (any, error) { //nolint:errcheck
+		close(running)
+		<-jctx.Done()
+		stopped <- jctx.Err()
+		return nil, jctx.Err()
+	})
+	<-running
+	cancel()
+	select {
+	case err := <-stopped:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("job context ended with %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("job kept running after its only waiter left")
+	}
+
+	// A queued one is dropped before it starts.
+	release := block(t, q)
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if _, err := q.do(ctx, jobThumb, "/other.png", prioInteractive, func(context.Context) (any, error) {
+		t.Error("abandoned thumbnail ran")
+		return nil, nil
+	}); !errors.Is(err, context.Canceled) {
+		t.Errorf("do = %v", err)
+	}
+	release()
+}
@@ -0,0 +1,414 @@
+package cloud
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/strct-org/strct-agent/internal/httputil"
+	"github.com/strct-org/strct-agent/internal/statefile"
+)
+
+// Data layout. DataDir starts flat: whatever the user creates sits at the
+// top. The structured layout gives it a fixed skeleton:
+//
+//	/users/<name>  one home folder per user
+//	/shared        for everyone
+//	/system        features' own data; hidden from the file API
+//
+// Switching creates the skeleton and moves nothing. POST
+// /api/files/adopt-layout then relocates chosen top-level folders into it
+// in the background, reporting progress on GET. The skeleton folders
+// can't be deleted or moved while the layout is on.
+const (
+	usersDirName  = "users"
+	sharedDirName = "shared"
+	systemDirName = "system"
+	layoutFile    = "layout.json"
+)
+
+const (
+	LayoutFlat       = "flat"
+	LayoutStructured = "structured"
+)
+
+// layoutSchema versions system/layout.json.
+//
+//	v1: layoutState as-is
+var layoutSchema = statefile.Schema{
+	Name:       "cloud-layout",
+	Migrations: []statefile.Migration{statefile.Stamp},
+}
+
+var userNameRe = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,31}$`)
+
+// layoutState is kept in /system, so a flat DataDir simply has none.
+type layoutState struct {
+	Structured bool      `json:"structured"`
+	Users      []string  `json:"users"`
+	EnabledAt  time.Time `json:"enabled_at"`
+}
+
+// LayoutResponse is the JSON shape returned by /api/files/layout.
+type LayoutResponse struct {
+	Layout string   `json:"layout"` // flat|structured
+	Users  []string `json:"users"`
+}
+
+// AdoptMove is one folder an adopt job relocates.
+type AdoptMove struct {
+	From   string `json:"from"`
+	Into   string `json:"into"` // "/shared" or "/users/<name>"
+	Path   string `json:"path"` // where it ends up
+	Bytes  int64  `json:"bytes"`
+	Status string `json:"status"` // pending|moving|done|failed
+	Error  string `json:"error,omitempty"`
+}
+
+// AdoptJob is the progress of POST /api/files/adopt-layout.
+type AdoptJob struct {
+	ID         string      `json:"id"`
+	State      string      `json:"state"` // running|done|failed
+	StartedAt  time.Time   `json:"started_at"`
+	FinishedAt *time.Time  `json:"finished_at,omitempty"`
+	Moves      []AdoptMove `json:"moves"`
+	BytesTotal int64       `json:"bytes_total"`
+	BytesDone  int64       `json:"bytes_done"`
+}
+
+func (s *Cloud) layoutPath() string {
+	return filepath.Join(s.DataDir, systemDirName, layoutFile)
+}
+
+// loadLayout reads the layout from DataDir. No file is the flat layout.
+func (s *Cloud) loadLayout() error {
+	var st layoutState
+	if err := statefile.Load(s.layoutPath(), layoutSchema, &st); err != nil && !statefile.Fresh(err) {
+		return fmt.Errorf("load layout: %w", err)
+	}
+	s.layoutMu.Lock()
+	s.layout = st
+	s.layoutMu.Unlock()
+	if st.Structured {
+		slog.Info("cloud: structured data layout", "users", len(st.Users))
+	}
+	return nil
+}
+
+// saveLayout writes st and makes it current.
+func (s *Cloud) saveLayout(st layoutState) error {
+	if err := statefile.Save(s.layoutPath(), layoutSchema, st); err != nil {
+		return fmt.Errorf("save layout: %w", err)
+	}
+	s.layoutMu.Lock()
+	s.layout = st
+	s.layoutMu.Unlock()
+	return nil
+}
+
+func (s *Cloud) structured() bool {
+	s.layoutMu.RLock()
+	defer s.layoutMu.RUnlock()
+	return s.layout.Structured
+}
+
+func (s *Cloud) hasUser(name string) bool {
+	s.layoutMu.RLock()
+	defer s.layoutMu.RUnlock()
+	for _, u := range s.layout.Users {
+		if u == name {
+			return true
+		}
+	}
+	return false
+}
+
+// layoutRoot reports whether full is one of the skeleton folders of the
+// structured layout: /users, /shared or a user's home folder.
+func (s *Cloud) layoutRoot(full string) bool {
+	if !s.structured() {
+		return false
+	}
+	rel, err := filepath.Rel(s.DataDir, full)
+	if err != nil {
+		return false
+	}
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	switch {
+	case len(parts) == 1:
+		return parts[0] == usersDirName || parts[0] == sharedDirName
+	case len(parts) == 2 && parts[0] == usersDirName:
+		return s.hasUser(parts[1])
+	}
+	return false
+}
+
+// provisionUser creates a user's home folder.
+func (s *Cloud) provisionUser(name string) error {
+	return os.MkdirAll(filepath.Join(s.DataDir, usersDirName, name), 0755)
+}
+
+func validUsers(names []string) error {
+	seen := map[string]bool{}
+	for _, n := range names {
+		if !userNameRe.MatchString(n) {
+			return fmt.Errorf("invalid user name %q: lowercase letters, digits, - and _, starting with a letter", n)
+		}
+		if seen[n] {
+			return fmt.Errorf("user %q listed twice", n)
+		}
+		seen[n] = true
+	}
+	return nil
+}
+
+func (s *Cloud) handleGetLayout(w http.ResponseWriter, r *http.Request) {
+	s.layoutMu.RLock()
+	st := s.layout
+	s.layoutMu.RUnlock()
+	resp := LayoutResponse{Layout: LayoutFlat, Users: []string{}}
+	if st.Structured {
+		resp.Layout = LayoutStructured
+		resp.Users = append(resp.Users, st.Users...)
+	}
+	httputil.OK(w, resp)
+}
+
+// handleEnableLayout switches to the structured layout.
+// POST body: {"users":["alice","bob"]}
+func (s *Cloud) handleEnableLayout(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Users []string `json:"users"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httputil.BadRequest(w, "invalid JSON")
+		return
+	}
+	if err := validUsers(req.Users); err != nil {
+		httputil.BadRequest(w, err.Error())
+		return
+	}
+	if s.structured() {
+		httputil.Error(w, http.StatusConflict, "the structured layout is already on")
+		return
+	}
+	// /system disappears from the file API once the layout is on, so a
+	// folder of the user's by that name would vanish with it.
+	if _, err := os.Lstat(filepath.Join(s.DataDir, systemDirName)); err == nil {
+		httputil.Error(w, http.StatusConflict, "rename or move /system first; the structured layout reserves it")
+		return
+	}
+	for _, name := range []string{usersDirName, sharedDirName} {
+		if info, err := os.Lstat(filepath.Join(s.DataDir, name)); err == nil && !info.IsDir() {
+			httputil.Error(w, http.StatusConflict, "rename or move /"+name+" first; the structured layout needs a folder there")
+			return
+		}
+	}
+
+	for _, dir := range []string{usersDirName, sharedDirName, systemDirName} {
+		if err := os.MkdirAll(filepath.Join(s.DataDir, dir), 0755); err != nil {
+			slog.Error("cloud: could not create layout folder", "dir", dir, "err", err)
+			httputil.InternalError(w, "could not create the layout")
+			return
+		}
+	}
+	for _, u := range req.Users {
+		if err := s.provisionUser(u); err != nil {
+			slog.Error("cloud: could not create home folder", "user", u, "err", err)
+			httputil.InternalError(w, "could not create the layout")
+			return
+		}
+	}
+	st := layoutState{Structured: true, Users: append([]string{}, req.Users...), EnabledAt: time.Now().UTC()}
+	if err := s.saveLayout(st); err != nil {
+		slog.Error("cloud: could not save layout", "err", err)
+		httputil.InternalError(w, "could not create the layout")
+		return
+	}
+	s.index.invalidate()
+	slog.Info("cloud: structured data layout enabled", "users", st.Users)
+	s.handleGetLayout(w, r)
+}
+
+// handleAddUser creates a user and their home folder.
+// POST body: {"name":"carol"}
+func (s *Cloud) handleAddUser(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httputil.BadRequest(w, "invalid JSON")
+		return
+	}
+	if err := validUsers([]string{req.Name}); err != nil {
+		httputil.BadRequest(w, err.Error())
+		return
+	}
+
+	s.layoutMu.Lock()
+	defer s.layoutMu.Unlock()
+	if !s.layout.Structured {
+		httputil.Error(w, http.StatusConflict, "users need the structured layout")
+		return
+	}
+	for _, u := range s.layout.Users {
+		if u == req.Name {
+			httputil.Error(w, http.StatusConflict, "user already exists")
+			return
+		}
+	}
+	if err := s.provisionUser(req.Name); err != nil {
+		slog.Error("cloud: could not create home folder", "user", req.Name, "err", err)
+		httputil.InternalError(w, "could not create user")
+		return
+	}
+	st := s.layout
+	st.Users = append(append([]string{}, st.Users...), req.Name)
+	if err := statefile.Save(s.layoutPath(), layoutSchema, st); err != nil {
+		slog.Error("cloud: could not save layout", "err", err)
+		httputil.InternalError(w, "could not create user")
+		return
+	}
+	s.layout = st
+	s.index.invalidate()
+	httputil.JSON(w, http.StatusCreated, map[string]string{"name": req.Name, "path": "/" + usersDirName + "/" + req.Name})
+}
+
+// handleAdoptLayout starts moving top-level folders into the layout.
+// POST body: {"moves":[{"from":"/Photos","into":"/users/alice"},{"from":"/Movies","into":"/shared"}]}
+func (s *Cloud) handleAdoptLayout(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Moves []struct {
+			From string `json:"from"`
+			Into string `json:"into"`
+		} `json:"moves"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httputil.BadRequest(w, "invalid JSON")
+		return
+	}
+	if len(req.Moves) == 0 {
+		httputil.BadRequest(w, "moves is required")
+		return
+	}
+	if !s.structured() {
+		httputil.Error(w, http.StatusConflict, "enable the structured layout first")
+		return
+	}
+
+	job := &AdoptJob{ID: uuid.NewString(), State: "running", StartedAt: time.Now().UTC()}
+	taken := map[string]bool{}
+	for _, m := range req.Moves {
+		src, err := s.userPath(m.From)
+		if err != nil || filepath.Dir(src) != s.DataDir || s.layoutRoot(src) || s.canChange(src) != nil {
+			httputil.BadRequest(w, "from must be a top-level folder outside the layout: "+m.From)
+			return
+		}
+		info, err := os.Lstat(src)
+		if err != nil || !info.IsDir() {
+			httputil.Error(w, http.StatusNotFound, "no folder at "+m.From)
+			return
+		}
+		into := path.Clean("/" + m.Into)
+		if user, ok := strings.CutPrefix(into, "/"+usersDirName+"/"); !(into == "/"+sharedDirName || ok && s.hasUser(user)) {
+			httputil.BadRequest(w, "into must be /shared or /users/<name>: "+m.Into)
+			return
+		}
+		dst := path.Join(into, filepath.Base(src))
+		full, _ := s.userPath(dst)
+		if _, err := os.Lstat(full); err == nil || taken[dst] {
+			httputil.Error(w, http.StatusConflict, dst+" already exists")
+			return
+		}
+		taken[dst] = true
+		size := sizeOf(src)
+		job.BytesTotal += size
+		job.Moves = append(job.Moves, AdoptMove{From: "/" + filepath.Base(src), Into: into, Path: dst, Bytes: size, Status: "pending"})
+	}
+
+	s.layoutMu.Lock()
+	if s.adopt != nil && s.adopt.State == "running" {
+		s.layoutMu.Unlock()
+		httputil.Error(w, http.StatusConflict, "an adopt job is already running")
+		return
+	}
+	s.adopt = job
+	snapshot := s.adoptSnapshot()
+	s.layoutMu.Unlock()
+
+	slog.Info("cloud: adopting folders into the layout", "job", job.ID, "folders", len(job.Moves), "bytes", job.BytesTotal)
+	usage.Go(func() { s.runAdopt(job) })
+	httputil.JSON(w, http.StatusAccepted, snapshot)
+}
+
+// handleGetAdopt reports the progress of the last adopt job.
+func (s *Cloud) handleGetAdopt(w http.ResponseWriter, r *http.Request) {
+	s.layoutMu.RLock()
+	defer s.layoutMu.RUnlock()
+	if s.adopt == nil {
+		httputil.Error(w, http.StatusNotFound, "no adopt job")
+		return
+	}
+	httputil.OK(w, s.adoptSnapshot())
+}
+
+// adoptSnapshot copies s.adopt. layoutMu must be held.
+func (s *Cloud) adoptSnapshot() AdoptJob {
+	job := *s.adopt
+	job.Moves = append([]AdoptMove(nil), job.Moves...)
+	return job
+}
+
+// runAdopt moves job's folders one at a time. A folder that fails is
+// left where it was and the rest carry on.
+func (s *Cloud) runAdopt(job *AdoptJob) {
+	defer usage.Time()()
+	failed := false
+	for i := range job.Moves {
+		s.setAdoptMove(job, i, "moving", nil)
+		m := job.Moves[i]
+		src, _ := s.userPath(m.From)
+		dst, _ := s.userPath(m.Path)
+		err := movePath(src, dst, false)
+		if err != nil {
+			slog.Error("cloud: adopt move failed", "from", src, "to", dst, "err", err)
+			failed = true
+		} else {
+			s.moveSums(src, dst)
+		}
+		s.setAdoptMove(job, i, "done", err)
+		s.index.invalidate()
+	}
+
+	now := time.Now().UTC()
+	s.layoutMu.Lock()
+	job.State = "done"
+	if failed {
+		job.State = "failed"
+	}
+	job.FinishedAt = &now
+	s.layoutMu.Unlock()
+	slog.Info("cloud: adopt job finished", "job", job.ID, "state", job.State)
+}
+
+func (s *Cloud) setAdoptMove(job *AdoptJob, i int, status string, err error) {
+	s.layoutMu.Lock()
+	defer s.layoutMu.Unlock()
+	m := &job.Moves[i]
+	m.Status = status
+	if err != nil {
+		m.Status = "failed"
+		m.Error = err.Error()
+	}
+	if m.Status == "done" {
+		job.BytesDone += m.Bytes
+	}
+}
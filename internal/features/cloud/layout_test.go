@@ -0,0 +1,185 @@
+package cloud
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func getLayout(t *testing.T, mux http.Handler) LayoutResponse {
+	t.Helper()
+	var resp LayoutResponse
+	if err := json.Unmarshal(do(t, mux, "GET", "/api/files/layout", "").Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func waitAdopt(t *testing.T, mux http.Handler) AdoptJob {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var job AdoptJob
+		if err := json.Unmarshal(do(t, mux, "GET", "/api/files/adopt-layout", "").Body.Bytes(), &job); err != nil {
+			t.Fatal(err)
+		}
+		if job.State != "running" {
+			return job
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("adopt job still running: %+v", job)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLayout_EnableAndAddUser(t *testing.T) {
+	c, mux := newUploadMux(t)
+	writeFiles(t, c.DataDir, map[string]string{"Photos/a.jpg": "aaaa"})
+	if got := getLayout(t, mux); got.Layout != LayoutFlat || len(got.Users) != 0 {
+		t.Fatalf("initial layout = %+v", got)
+	}
+
+	if w := do(t, mux, "POST", "/api/files/layout", `{"users":["alice","bob"]}`); w.Code != http.StatusOK {
+		t.Fatalf("enable: %d %s", w.Code, w.Body)
+	}
+	for _, dir := range []string{"users/alice", "users/bob", "shared", "system"} {
+		if info, err := os.Stat(filepath.Join(c.DataDir, dir)); err != nil || !info.IsDir() {
+			t.Errorf("%s not created", dir)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(c.DataDir, "Photos/a.jpg")); err != nil {
+		t.Error("enabling moved existing files")
+	}
+	list := do(t, mux, "GET", "/api/files?path=/", "").Body.String()
+	if strings.Contains(list, `"system"`) || !strings.Contains(list, `"users"`) {
+		t.Errorf("listing = %s", list)
+	}
+
+	if w := do(t, mux, "POST", "/api/files/layout/users", `{"name":"carol"}`); w.Code != http.StatusCreated {
+		t.Fatalf("add user: %d %s", w.Code, w.Body)
+	}
+	if _, err := os.Stat(filepath.Join(c.DataDir, "users/carol")); err != nil {
+		t.Error("home folder not provisioned")
+	}
+
+	// The layout survives a restart.
+	c2 := New(c.DataDir, 8080, true)
+	if err := c2.loadLayout(); err != nil {
+		t.Fatal(err)
+	}
+	if !c2.structured() || !c2.hasUser("carol") || !c2.hasUser("alice") {
+		t.Errorf("reloaded layout = %+v", c2.layout)
+	}
+}
+
+func TestLayout_SkeletonIsProtected(t *testing.T) {
+	c, mux := newUploadMux(t)
+	do(t, mux, "POST", "/api/files/layout", `{"users":["alice"]}`)
+	writeFiles(t, c.DataDir, map[string]string{"users/alice/notes.txt": "n", "system/backup.db": "b"})
+
+	for _, tc := range []struct {
+		method, target, body string
+		want                 int
+	}{
+		{"DELETE", "/api/delete?path=/users/alice", "", http.StatusForbidden},
+		{"DELETE", "/api/delete?path=/shared", "", http.StatusForbidden},
+		{"DELETE", "/api/delete?path=/users", "", http.StatusForbidden},
+		{"DELETE", "/api/delete?path=/system/backup.db", "", http.StatusForbidden},
+		{"POST", "/api/move", `{"from":"/users/alice","to":"/alice"}`, http.StatusForbidden},
+		{"GET", "/api/files?path=/system", "", http.StatusForbidden},
+		{"DELETE", "/api/delete?path=/users/alice/notes.txt", "", http.StatusNoContent},
+	} {
+		if w := do(t, mux, tc.method, tc.target, tc.body); w.Code != tc.want {
+			t.Errorf("%s %s %s: %d, want %d", tc.method, tc.target, tc.body, w.Code, tc.want)
+		}
+	}
+	if b := breakdownOf(t, mux); b.InternalBytes == 0 {
+		t.Errorf("/system not counted as internal: %+v", b)
+	}
+}
+
+func TestLayout_Validation(t *testing.T) {
+	c, mux := newUploadMux(t)
+	writeFiles(t, c.DataDir, map[string]string{"system/mine.txt": "m"})
+
+	for body, want := range map[string]int{
+		`not json`:                    http.StatusBadRequest,
+		`{"users":["Alice"]}`:         http.StatusBadRequest,
+		`{"users":["../x"]}`:          http.StatusBadRequest,
+		`{"users":["bob","bob"]}`:     http.StatusBadRequest,
+		`{"users":["alice","carol"]}`: http.StatusConflict, // the user's own /system
+	} {
+		if w := do(t, mux, "POST", "/api/files/layout", body); w.Code != want {
+			t.Errorf("enable %s: %d, want %d", body, w.Code, want)
+		}
+	}
+	if w := do(t, mux, "POST", "/api/files/layout/users", `{"name":"dave"}`); w.Code != http.StatusConflict {
+		t.Errorf("add user while flat: %d", w.Code)
+	}
+	if w := do(t, mux, "POST", "/api/files/adopt-layout", `{"moves":[{"from":"/system","into":"/shared"}]}`); w.Code != http.StatusConflict {
+		t.Errorf("adopt while flat: %d", w.Code)
+	}
+
+	os.RemoveAll(filepath.Join(c.DataDir, "system"))
+	do(t, mux, "POST", "/api/files/layout", `{"users":["alice"]}`)
+	if w := do(t, mux, "POST", "/api/files/layout", `{"users":["alice"]}`); w.Code != http.StatusConflict {
+		t.Errorf("enable twice: %d", w.Code)
+	}
+	if w := do(t, mux, "POST", "/api/files/layout/users", `{"name":"alice"}`); w.Code != http.StatusConflict {
+		t.Errorf("add existing user: %d", w.Code)
+	}
+}
+
+func TestAdoptLayout_MovesFoldersWithProgress(t *testing.T) {
+	c, mux := newUploadMux(t)
+	writeFiles(t, c.DataDir, map[string]string{
+		"Photos/2024/a.jpg": "12345",
+		"Movies/b.mkv":      "123",
+		"Taken/x":           "x",
+		"shared/Taken/y":    "y",
+	})
+	do(t, mux, "POST", "/api/files/layout", `{"users":["alice"]}`)
+
+	for body, want := range map[string]int{
+		`{"moves":[]}`: http.StatusBadRequest,
+		`{"moves":[{"from":"/Photos/2024","into":"/shared"}]}`: http.StatusBadRequest,
+		`{"moves":[{"from":"/shared","into":"/users/alice"}]}`: http.StatusBadRequest,
+		`{"moves":[{"from":"/Photos","into":"/users/zed"}]}`:   http.StatusBadRequest,
+		`{"moves":[{"from":"/Photos","into":"/Movies"}]}`:      http.StatusBadRequest,
+		`{"moves":[{"from":"/Nope","into":"/shared"}]}`:        http.StatusNotFound,
+		`{"moves":[{"from":"/Taken","into":"/shared"}]}`:       http.StatusConflict,
+	} {
+		if w := do(t, mux, "POST", "/api/files/adopt-layout", body); w.Code != want {
+			t.Errorf("%s: %d, want %d", body, w.Code, want)
+		}
+	}
+
+	w := do(t, mux, "POST", "/api/files/adopt-layout",
+		`{"moves":[{"from":"/Photos","into":"/users/alice"},{"from":"/Movies","into":"/shared"}]}`)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("adopt: %d %s", w.Code, w.Body)
+	}
+	job := waitAdopt(t, mux)
+	if job.State != "done" || job.BytesTotal != 8 || job.BytesDone != 8 || job.FinishedAt == nil {
+		t.Errorf("job = %+v", job)
+	}
+	for _, m := range job.Moves {
+		if m.Status != "done" {
+			t.Errorf("move = %+v", m)
+		}
+	}
+	if got := readFile(t, filepath.Join(c.DataDir, "users/alice/Photos/2024/a.jpg")); got != "12345" {
+		t.Errorf("adopted file = %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(c.DataDir, "shared/Movies/b.mkv")); err != nil {
+		t.Error("Movies not adopted into /shared")
+	}
+	if _, err := os.Stat(filepath.Join(c.DataDir, "Photos")); !os.IsNotExist(err) {
+		t.Error("Photos still at the top")
+	}
+}
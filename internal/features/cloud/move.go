@@ -0,0 +1,208 @@
+package cloud
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/google/uuid"
+	"github.com/strct-org/strct-agent/internal/httputil"
+)
+
+type moveRequest struct {
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Overwrite bool   `json:"overwrite"`
+}
+
+// handleMove renames or moves a file or folder.
+// POST body: {"from":"/a/old.txt","to":"/b/new.txt","overwrite":false}
+func (s *Cloud) handleMove(w http.ResponseWriter, r *http.Request) {
+	var req moveRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httputil.BadRequest(w, "invalid JSON")
+		return
+	}
+	if req.From == "" || req.To == "" {
+		httputil.BadRequest(w, "from and to are required")
+		return
+	}
+	src, err := s.userPath(req.From)
+	if err != nil {
+		httputil.Forbidden(w)
+		return
+	}
+	dst, err := s.userPath(req.To)
+	if err != nil {
+		httputil.Forbidden(w)
+		return
+	}
+	if err := s.canChange(src); err != nil {
+		pathError(w, err)
+		return
+	}
+	if err := s.canChange(dst); err != nil {
+		pathError(w, err)
+		return
+	}
+	if src == s.DataDir || dst == s.DataDir || s.layoutRoot(src) || s.layoutRoot(dst) {
+		httputil.Forbidden(w)
+		return
+	}
+	if src == dst {
+		httputil.BadRequest(w, "from and to are the same")
+		return
+	}
+	if within(dst, src) {
+		httputil.BadRequest(w, "cannot move a folder into itself")
+		return
+	}
+	if within(src, dst) {
+		// Overwriting an ancestor would delete the source with it.
+		httputil.BadRequest(w, "cannot move an item onto a folder that contains it")
+		return
+	}
+
+	if _, err := os.Lstat(src); err != nil {
+		httputil.Error(w, http.StatusNotFound, "not found: "+req.From)
+		return
+	}
+	if info, err := os.Stat(filepath.Dir(dst)); err != nil || !info.IsDir() {
+		httputil.Error(w, http.StatusNotFound, "destination folder not found")
+		return
+	}
+	_, err = os.Lstat(dst)
+	exists := err == nil
+	if exists && !req.Overwrite {
+		httputil.Error(w, http.StatusConflict, "destination already exists")
+		return
+	}
+
+	replaced := int64(0)
+	if exists {
+		replaced = sizeOf(dst)
+	}
+	if err := movePath(src, dst, exists); err != nil {
+		slog.Error("cloud: failed to move", "from", src, "to", dst, "err", err)
+		httputil.InternalError(w, "could not move item")
+		return
+	}
+	s.trackSize(dst, -replaced)
+	if s.external(src) != s.external(dst) {
+		// Onto or off another drive: only one side is counted.
+		moved := sizeOf(dst)
+		s.trackSize(src, -moved)
+		s.trackSize(dst, moved)
+	}
+	s.moveSums(src, dst)
+	s.index.invalidate()
+	s.logActivity(r, Activity{Op: opMove, Path: s.apiPath(src), To: s.apiPath(dst), Size: sizeOf(dst)})
+	httputil.OK(w, map[string]string{"status": "moved", "path": req.To})
+}
+
+// within reports whether p is strictly inside dir.
+func within(p, dir string) bool {
+	return strings.HasPrefix(p, dir+string(filepath.Separator))
+}
+
+// movePath moves src to dst. An existing dst is set aside first and only
+// deleted once src is in its place, so a failed move leaves both intact.
+func movePath(src, dst string, replace bool) error {
+	var aside string
+	if replace {
+		aside = filepath.Join(filepath.Dir(dst), ".strct-move-"+uuid.NewString())
+		if err := os.Rename(dst, aside); err != nil {
+			return fmt.Errorf("set aside %s: %w", dst, err)
+		}
+	}
+	if err := rename(src, dst); err != nil {
+		if aside != "" {
+			os.Rename(aside, dst) //nolint:errcheck
+		}
+		return err
+	}
+	if aside != "" {
+		os.RemoveAll(aside) //nolint:errcheck
+	}
+	return nil
+}
+
+// osRename is swapped in tests to simulate a cross-device move.
+var osRename = os.Rename
+
+// rename is os.Rename with a copy-then-delete fallback for when src and
+// dst are on different filesystems, e.g. a folder mounted from the SSD.
+func rename(src, dst string) error {
+	err := osRename(src, dst)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	if err := copyTree(src, dst); err != nil {
+		os.RemoveAll(dst) //nolint:errcheck
+		return fmt.Errorf("copy across filesystems: %w", err)
+	}
+	return os.RemoveAll(src)
+}
+
+// copyTree copies a file, symlink or directory tree, keeping permissions
+// and file modification times.
+func copyTree(src, dst string) error {
+	return filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case d.IsDir():
+			if err := os.Mkdir(target, info.Mode().Perm()); err != nil {
+				return err
+			}
+		case !d.Type().IsRegular():
+			return nil // sockets, fifos: nothing a user stored
+		default:
+			if err := copyFile(p, target, info.Mode().Perm()); err != nil {
+				return err
+			}
+		}
+		return os.Chtimes(target, info.ModTime(), info.ModTime())
+	})
+}
+
+func copyFile(src, dst string, perm fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
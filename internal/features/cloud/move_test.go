@@ -0,0 +1,131 @@
+package cloud
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func writeFiles(t testing.TB, root string, files map[string]string) {
+	t.Helper()
+	for name, body := range files {
+		p := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func readFile(t *testing.T, p string) string {
+	t.Helper()
+	b, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatalf("read %s: %v", p, err)
+	}
+	return string(b)
+}
+
+func TestMove_RenamesFileAndFolder(t *testing.T) {
+	c, mux := newUploadMux(t)
+	writeFiles(t, c.DataDir, map[string]string{"a/old.txt": "hello", "photos/2023/x.jpg": "jpeg"})
+	os.Mkdir(filepath.Join(c.DataDir, "b"), 0755)
+
+	if w := do(t, mux, "POST", "/api/move", `{"from":"/a/old.txt","to":"/b/new.txt"}`); w.Code != http.StatusOK {
+		t.Fatalf("move file: %d %s", w.Code, w.Body)
+	}
+	if readFile(t, filepath.Join(c.DataDir, "b", "new.txt")) != "hello" {
+		t.Error("moved file has wrong content")
+	}
+	if _, err := os.Stat(filepath.Join(c.DataDir, "a", "old.txt")); !os.IsNotExist(err) {
+		t.Error("source still exists")
+	}
+
+	if w := do(t, mux, "POST", "/api/move", `{"from":"/photos/2023","to":"/b/2023"}`); w.Code != http.StatusOK {
+		t.Fatalf("move folder: %d %s", w.Code, w.Body)
+	}
+	if readFile(t, filepath.Join(c.DataDir, "b", "2023", "x.jpg")) != "jpeg" {
+		t.Error("folder contents not moved")
+	}
+}
+
+func TestMove_Overwrite(t *testing.T) {
+	c, mux := newUploadMux(t)
+	writeFiles(t, c.DataDir, map[string]string{"new.txt": "new", "old.txt": "old"})
+
+	if w := do(t, mux, "POST", "/api/move", `{"from":"/new.txt","to":"/old.txt"}`); w.Code != http.StatusConflict {
+		t.Fatalf("without overwrite: got %d, want 409", w.Code)
+	}
+	if readFile(t, filepath.Join(c.DataDir, "old.txt")) != "old" {
+		t.Fatal("refused move changed the destination")
+	}
+
+	if w := do(t, mux, "POST", "/api/move", `{"from":"/new.txt","to":"/old.txt","overwrite":true}`); w.Code != http.StatusOK {
+		t.Fatalf("with overwrite: %d %s", w.Code, w.Body)
+	}
+	if readFile(t, filepath.Join(c.DataDir, "old.txt")) != "new" {
+		t.Error("destination not replaced")
+	}
+	entries, _ := os.ReadDir(c.DataDir)
+	for _, e := range entries {
+		if e.Name() != "old.txt" && e.Name() != uploadsDirName {
+			t.Errorf("left behind %s", e.Name())
+		}
+	}
+}
+
+func TestMove_CrossDeviceFallsBackToCopy(t *testing.T) {
+	c, mux := newUploadMux(t)
+	writeFiles(t, c.DataDir, map[string]string{"src/a.txt": "a", "src/sub/b.txt": "b"})
+	os.Symlink("a.txt", filepath.Join(c.DataDir, "src", "link"))
+
+	osRename = func(from, to string) error {
+		return &os.LinkError{Op: "rename", Old: from, New: to, Err: syscall.EXDEV}
+	}
+	t.Cleanup(func() { osRename = os.Rename })
+
+	if w := do(t, mux, "POST", "/api/move", `{"from":"/src","to":"/dst"}`); w.Code != http.StatusOK {
+		t.Fatalf("move: %d %s", w.Code, w.Body)
+	}
+	if readFile(t, filepath.Join(c.DataDir, "dst", "sub", "b.txt")) != "b" {
+		t.Error("nested file not copied")
+	}
+	if link, err := os.Readlink(filepath.Join(c.DataDir, "dst", "link")); err != nil || link != "a.txt" {
+		t.Errorf("symlink = %q, %v", link, err)
+	}
+	if _, err := os.Stat(filepath.Join(c.DataDir, "src")); !os.IsNotExist(err) {
+		t.Error("source not removed after copy")
+	}
+}
+
+func TestMove_Rejects(t *testing.T) {
+	c, mux := newUploadMux(t)
+	writeFiles(t, c.DataDir, map[string]string{"dir/sub/f.txt": "f", "file.txt": "x"})
+
+	for _, tc := range []struct {
+		name, body string
+		want       int
+	}{
+		{"invalid json", `{`, http.StatusBadRequest},
+		{"missing to", `{"from":"/file.txt"}`, http.StatusBadRequest},
+		{"same path", `{"from":"/file.txt","to":"/file.txt"}`, http.StatusBadRequest},
+		{"into own descendant", `{"from":"/dir","to":"/dir/sub/dir"}`, http.StatusBadRequest},
+		{"onto own ancestor", `{"from":"/dir/sub","to":"/dir","overwrite":true}`, http.StatusBadRequest},
+		{"missing source", `{"from":"/nope.txt","to":"/x.txt"}`, http.StatusNotFound},
+		{"missing destination folder", `{"from":"/file.txt","to":"/nope/x.txt"}`, http.StatusNotFound},
+		{"existing destination", `{"from":"/file.txt","to":"/dir"}`, http.StatusConflict},
+		{"root", `{"from":"/","to":"/dir/root"}`, http.StatusForbidden},
+		{"uploads dir", `{"from":"/file.txt","to":"/.uploads/x"}`, http.StatusForbidden},
+	} {
+		if w := do(t, mux, "POST", "/api/move", tc.body); w.Code != tc.want {
+			t.Errorf("%s: got %d, want %d (%s)", tc.name, w.Code, tc.want, w.Body)
+		}
+	}
+	if readFile(t, filepath.Join(c.DataDir, "dir", "sub", "f.txt")) != "f" {
+		t.Error("rejected moves changed the tree")
+	}
+}
@@ -0,0 +1,120 @@
+package cloud
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Upload file names. A name from a client is only a suggestion: browsers
+// on Windows send C:\Users\…\photo.jpg, and a crafted request can send
+// anything. sanitizeName reduces it to one plain path element, and
+// createUpload decides what happens when a file of that name is there.
+
+// maxNameBytes is the longest name most file systems take.
+const maxNameBytes = 255
+
+// maxRenames bounds the search for a free "photo (n).jpg".
+const maxRenames = 1000
+
+var errInvalidName = errors.New("invalid file name")
+
+// sanitizeName returns the last path element of name, with control
+// characters removed and surrounding spaces and leading dots trimmed. The
+// dots go so an upload can't make a hidden file, or aim at one of the
+// reserved directories.
+func sanitizeName(name string) (string, error) {
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+	if !utf8.ValidString(name) {
+		return "", errInvalidName
+	}
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimRight(strings.TrimLeft(name, ". "), " ")
+	if name == "" || len(name) > maxNameBytes {
+		return "", errInvalidName
+	}
+	return name, nil
+}
+
+// conflictPolicy is what an upload does when its name is taken.
+type conflictPolicy string
+
+const (
+	conflictOverwrite conflictPolicy = "overwrite" // replace the file; the default
+	conflictRename    conflictPolicy = "rename"    // store as "photo (1).jpg"
+	conflictReject    conflictPolicy = "reject"    // answer 409
+)
+
+func parseConflict(v string) (conflictPolicy, error) {
+	switch p := conflictPolicy(v); p {
+	case "":
+		return conflictOverwrite, nil
+	case conflictOverwrite, conflictRename, conflictReject:
+		return p, nil
+	}
+	return "", fmt.Errorf("conflict must be overwrite, rename or reject, not %q", v)
+}
+
+// errNameTaken is createUpload's answer when the policy rejects, or no
+// free name was found.
+var errNameTaken = errors.New("a file with this name already exists")
+
+// numbered returns name with " (n)" before its extension.
+func numbered(name string, n int) string {
+	ext := filepath.Ext(name)
+	if ext == name {
+		ext = ""
+	}
+	return fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), n, ext)
+}
+
+// createUpload creates the file name in dir under policy and returns it
+// with the name it got and the size of the file it replaced. New names are
+// created exclusively, so two uploads renaming at once don't pick the same
+// one. A folder in the way is a conflict whatever the policy.
+func (s *Cloud) createUpload(dir, name string, policy conflictPolicy) (f *os.File, stored string, replaced int64, err error) {
+	for n := 0; n <= maxRenames; n++ {
+		stored = name
+		if n > 0 {
+			stored = numbered(name, n)
+		}
+		target := filepath.Join(dir, stored)
+		// The name is checked again once joined: it must land in dir and
+		// not be reserved.
+		if filepath.Dir(target) != dir || s.category(target) != catLive {
+			return nil, "", 0, errInvalidName
+		}
+		info, statErr := os.Lstat(target)
+		if statErr == nil && policy == conflictOverwrite && info.Mode().IsRegular() {
+			f, err = os.Create(target)
+			return f, stored, info.Size(), err
+		}
+		if statErr == nil {
+			if policy == conflictRename {
+				continue
+			}
+			return nil, "", 0, errNameTaken
+		}
+		f, err = os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if os.IsExist(err) {
+			// Another upload took the name since the Lstat.
+			if policy == conflictRename {
+				continue
+			}
+			return nil, "", 0, errNameTaken
+		}
+		return f, stored, 0, err
+	}
+	return nil, "", 0, errNameTaken
+}
@@ -0,0 +1,230 @@
+package cloud
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/strct-org/strct-agent/internal/agent"
+	"github.com/strct-org/strct-agent/internal/httputil"
+	"github.com/strct-org/strct-agent/internal/humanize"
+	"github.com/strct-org/strct-agent/internal/platform/disk"
+)
+
+// Upload reserve. Uploads stop short of filling the drive: once free space
+// would drop under the reserve they are refused with 507, because a full
+// filesystem takes dnsmasq's leases, the logs and the agent's own state
+// files down with it. The reserve is the larger of UploadReserve and
+// UploadReservePercent of the drive, and /api/status reports what is left
+// above it so the UI can warn before an upload starts.
+//
+// A DataDir on the SD card shares its filesystem with / (same st_dev), and
+// filling that stops journald, dpkg and the agent's own state writes. There
+// the system reserve holds too: the larger of SystemReserve and
+// SystemReservePercent, 1 GB or 5% by default. Uploads, resumable chunks and
+// thumbnails all stop at the stricter of the two, and a refusal the system
+// reserve causes carries code system_disk_reserve. On a dedicated data
+// drive only the upload reserve applies, and thumbnails are not limited.
+// /api/health warns once less than the reserve is left above it.
+
+// Codes of a 507 body.
+const (
+	codeUploadReserve = "upload_reserve"
+	codeSystemReserve = "system_disk_reserve"
+)
+
+// errReserveReached is returned by a reserveReader that would write into
+// the reserve.
+var errReserveReached = errors.New("upload would use the free-space reserve")
+
+// errSystemReserve is returned by background writes, like thumbnails,
+// while the system disk is at its reserve.
+var errSystemReserve = errors.New("the system disk is down to its free-space reserve")
+
+// diskSpace reports free and total bytes of the filesystem holding path.
+// A var so tests can fake a nearly full drive.
+var diskSpace = func(path string) (free, total uint64, err error) {
+	if free, err = disk.GetFreeDiskSpace(path); err != nil {
+		return 0, 0, err
+	}
+	total, err = disk.GetTotalDiskSpace(path)
+	return free, total, err
+}
+
+// onSystemDisk reports whether path is on the root filesystem. A var so
+// tests can fake either topology.
+var onSystemDisk = func(path string) bool {
+	same, err := disk.SameDevice(path, "/")
+	return err == nil && same
+}
+
+// Quota is the "quota" section of /api/status.
+type Quota struct {
+	Total     uint64 `json:"total"`    // size of the drive DataDir is on
+	Used      uint64 `json:"used"`     // by anything, not only the cloud
+	Reserved  uint64 `json:"reserved"` // kept free; uploads stop here
+	Available uint64 `json:"available_for_upload"`
+	// SystemDisk is set when DataDir shares the root filesystem, and
+	// SystemReserved is then the system reserve, part of Reserved.
+	SystemDisk     bool   `json:"system_disk,omitempty"`
+	SystemReserved uint64 `json:"system_reserved,omitempty"`
+}
+
+// code is why uploads stop at Reserved.
+func (q Quota) code() string {
+	if q.SystemDisk && q.SystemReserved >= q.Reserved {
+		return codeSystemReserve
+	}
+	return codeUploadReserve
+}
+
+// quota reads the drive. ok is false if its size could not be read, in
+// which case uploads are not limited.
+func (s *Cloud) quota() (Quota, bool) {
+	free, total, err := diskSpace(s.DataDir)
+	if err != nil || total == 0 {
+		return Quota{}, false
+	}
+	q := Quota{Total: total, Used: total - min(free, total)}
+	q.Reserved = reserve(total, s.UploadReserve, s.UploadReservePercent)
+	if onSystemDisk(s.DataDir) {
+		q.SystemDisk = true
+		q.SystemReserved = reserve(total, s.SystemReserve, s.SystemReservePercent)
+		q.Reserved = max(q.Reserved, q.SystemReserved)
+	}
+	if free > q.Reserved {
+		q.Available = free - q.Reserved
+	}
+	return q, true
+}
+
+// reserve is the larger of bytes and percent of total.
+func reserve(total uint64, bytes int64, percent float64) uint64 {
+	return max(uint64(max(bytes, 0)), uint64(float64(total)*percent/100))
+}
+
+// systemRoom is errSystemReserve when DataDir is on the system disk and
+// free space is down to the system reserve; nil otherwise.
+func (s *Cloud) systemRoom() (Quota, error) {
+	q, ok := s.quota()
+	if ok && q.SystemDisk && q.Total-q.Used <= q.SystemReserved {
+		return q, errSystemReserve
+	}
+	return q, nil
+}
+
+// uploadRoom returns how many bytes an upload may write, counting the
+// bytes of a file it replaces as freed. ok is false when there is no limit.
+func (s *Cloud) uploadRoom(replaced int64) (room int64, q Quota, ok bool) {
+	q, ok = s.quota()
+	if !ok {
+		return 0, q, false
+	}
+	return int64(min(q.Available, 1<<62)) + replaced, q, true
+}
+
+// reserveBody is the body of a 507: the reason, its code and what is left
+// for uploads.
+func reserveBody(q Quota) map[string]any {
+	msg := fmt.Sprintf("not enough free space: uploads must leave %s free on the drive",
+		humanize.Bytes(int64(q.Reserved)))
+	if q.code() == codeSystemReserve {
+		msg = fmt.Sprintf("not enough free space: the data folder is on the system disk, which must keep %s free",
+			humanize.Bytes(int64(q.Reserved)))
+	}
+	return map[string]any{
+		"error":                msg,
+		"code":                 q.code(),
+		"available_for_upload": q.Available,
+		"quota":                q,
+	}
+}
+
+func insufficientStorage(w http.ResponseWriter, q Quota) {
+	httputil.JSON(w, http.StatusInsufficientStorage, reserveBody(q))
+}
+
+// reserveReader fails with errReserveReached, or err if set, instead of
+// returning more than left bytes.
+type reserveReader struct {
+	r    io.Reader
+	left int64
+	err  error
+}
+
+func (rr *reserveReader) Read(p []byte) (int, error) {
+	if rr.left <= 0 {
+		// Only an error if there is more to come.
+		var one [1]byte
+		n, err := rr.r.Read(one[:])
+		if n > 0 && rr.err != nil {
+			return 0, rr.err
+		}
+		if n > 0 {
+			return 0, errReserveReached
+		}
+		return 0, err
+	}
+	if int64(len(p)) > rr.left {
+		p = p[:rr.left]
+	}
+	n, err := rr.r.Read(p)
+	rr.left -= int64(n)
+	return n, err
+}
+
+// HealthWarnings reports free space within a reserve's worth of the
+// reserve: uploads are about to stop, or have.
+func (s *Cloud) HealthWarnings() []string {
+	q, ok := s.quota()
+	if !ok || q.Available >= q.Reserved {
+		return nil
+	}
+	drive := "data drive"
+	if q.SystemDisk {
+		drive = "system disk (it holds the data folder)"
+	}
+	if q.Available == 0 {
+		refused := "uploads are refused"
+		if q.SystemDisk {
+			refused = "uploads and thumbnails are refused"
+		}
+		return []string{fmt.Sprintf("%s is down to its %s free-space reserve: %s",
+			drive, humanize.Bytes(int64(q.Reserved)), refused)}
+	}
+	return []string{fmt.Sprintf("%s has %s left before its %s free-space reserve",
+		drive, humanize.Bytes(int64(q.Available)), humanize.Bytes(int64(q.Reserved)))}
+}
+
+// Health reports the storage: whether the data folder is there, which
+// drive it is on and how much is free. The device is no use without it.
+func (s *Cloud) Health() agent.ComponentHealth {
+	h := agent.ComponentHealth{Name: "storage", Status: agent.HealthOK, Critical: true}
+	if _, err := os.Stat(s.DataDir); err != nil {
+		h.Status, h.Message = agent.HealthDown, fmt.Sprintf("data folder unavailable: %v", err)
+		return h
+	}
+	q, ok := s.quota()
+	if !ok {
+		h.Message = "data folder present; drive size unknown"
+		return h
+	}
+	drive := "its own drive"
+	if q.SystemDisk {
+		drive = "the system disk"
+	}
+	h.Message = fmt.Sprintf("data folder on %s, %s free", drive, humanize.Bytes(int64(q.Total-q.Used)))
+	if q.SystemDisk && s.RealHardware {
+		if dec := s.storageDecision(); dec != nil && dec.Device != "" {
+			h.Status = agent.HealthDegraded
+			h.Message += fmt.Sprintf("; %s, chosen during setup, is not mounted", dec.Device)
+		}
+	}
+	if q.Available == 0 {
+		h.Status = agent.HealthDegraded
+		h.Message += "; uploads are refused: down to the free-space reserve"
+	}
+	return h
+}
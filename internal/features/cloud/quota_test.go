@@ -0,0 +1,236 @@
+package cloud
+
+import (
+	"bytes"
+	"encoding/json"
+	"image/color"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/strct-org/strct-agent/internal/httputil"
+)
+
+// fakeDisk makes DataDir's drive a dedicated one of total bytes with free
+// of them free.
+func fakeDisk(t *testing.T, free, total uint64) {
+	t.Helper()
+	origSpace, origSystem := diskSpace, onSystemDisk
+	diskSpace = func(string) (uint64, uint64, error) { return free, total, nil }
+	onSystemDisk = func(string) bool { return false }
+	t.Cleanup(func() { diskSpace, onSystemDisk = origSpace, origSystem })
+}
+
+// fakeSystemDisk is fakeDisk with DataDir on the root filesystem.
+func fakeSystemDisk(t *testing.T, free, total uint64) {
+	t.Helper()
+	fakeDisk(t, free, total)
+	onSystemDisk = func(string) bool { return true }
+}
+
+// onlyReader hides the length of a body so the request is sent without
+// Content-Length.
+type onlyReader struct{ io.Reader }
+
+func postUpload(t *testing.T, mux http.Handler, name, body string, withLength bool) *httptest.ResponseRecorder {
+	t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fw, _ := mw.CreateFormFile("file", name)
+	fw.Write([]byte(body))
+	mw.Close()
+	var r io.Reader = &buf
+	if !withLength {
+		r = onlyReader{r}
+	}
+	req := httptest.NewRequest("POST", "/strct_agent/fs/upload?path=/", r)
+	if !withLength {
+		req.ContentLength = -1
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	return w
+}
+
+func TestQuota_ReserveIsTheLargerOfBytesAndPercent(t *testing.T) {
+	c, _ := newUploadMux(t)
+	fakeDisk(t, 3000, 10000)
+
+	c.UploadReserve, c.UploadReservePercent = 1000, 5
+	if q, _ := c.quota(); q != (Quota{Total: 10000, Used: 7000, Reserved: 1000, Available: 2000}) {
+		t.Errorf("bytes reserve: %+v", q)
+	}
+	c.UploadReservePercent = 40
+	if q, _ := c.quota(); q.Reserved != 4000 || q.Available != 0 {
+		t.Errorf("percent reserve: %+v", q)
+	}
+}
+
+func TestStatus_ReportsQuota(t *testing.T) {
+	c, mux := newUploadMux(t)
+	c.UploadReserve, c.UploadReservePercent = 100, 0
+	fakeDisk(t, 250, 1000)
+	h := httputil.Versioned(mux)
+
+	for _, target := range []string{"/api/status", "/api/v1/status"} {
+		var st struct{ Quota *Quota }
+		if err := json.Unmarshal(do(t, h, "GET", target, "").Body.Bytes(), &st); err != nil {
+			t.Fatal(err)
+		}
+		if st.Quota == nil || *st.Quota != (Quota{Total: 1000, Used: 750, Reserved: 100, Available: 150}) {
+			t.Errorf("%s quota = %+v", target, st.Quota)
+		}
+	}
+}
+
+func TestUpload_RejectedWhenItWouldUseTheReserve(t *testing.T) {
+	c, mux := newUploadMux(t)
+	c.UploadReserve, c.UploadReservePercent = 100, 0
+	fakeDisk(t, 400, 1000) // 300 bytes left for uploads
+	writeFiles(t, c.DataDir, map[string]string{"keep.bin": "old"})
+
+	// Refused up front from Content-Length; the file it would replace is
+	// left alone.
+	w := postUpload(t, mux, "keep.bin", strings.Repeat("x", 500), true)
+	if w.Code != http.StatusInsufficientStorage {
+		t.Fatalf("large upload: %d %s", w.Code, w.Body)
+	}
+	var body struct {
+		Error     string `json:"error"`
+		Available uint64 `json:"available_for_upload"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if body.Available != 300 || body.Error == "" {
+		t.Errorf("507 body = %s", w.Body)
+	}
+	if got := readFile(t, filepath.Join(c.DataDir, "keep.bin")); got != "old" {
+		t.Errorf("replaced file = %q", got)
+	}
+
+	// Without a Content-Length the limit applies while streaming, and the
+	// partial file is removed.
+	if w := postUpload(t, mux, "big.bin", strings.Repeat("x", 500), false); w.Code != http.StatusInsufficientStorage {
+		t.Fatalf("streamed upload: %d %s", w.Code, w.Body)
+	}
+	if _, err := os.Stat(filepath.Join(c.DataDir, "big.bin")); !os.IsNotExist(err) {
+		t.Error("partial upload left behind")
+	}
+
+	if w := postUpload(t, mux, "small.bin", strings.Repeat("x", 100), false); w.Code != http.StatusCreated {
+		t.Errorf("upload within the room: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestResumableUpload_RespectsTheReserve(t *testing.T) {
+	c, mux := newUploadMux(t)
+	c.UploadReserve, c.UploadReservePercent = 100, 0
+	fakeDisk(t, 400, 1000)
+
+	if w := do(t, mux, "POST", "/api/upload/init", `{"path":"/","name":"big.bin","size":500}`); w.Code != http.StatusInsufficientStorage {
+		t.Errorf("init over the room: %d %s", w.Code, w.Body)
+	}
+
+	u := initUpload(t, mux, `{"path":"/","name":"a.bin"}`)
+	req := httptest.NewRequest("PUT", "/api/upload/"+u.ID+"?offset=0", onlyReader{strings.NewReader(strings.Repeat("x", 500))})
+	req.ContentLength = -1
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusInsufficientStorage {
+		t.Fatalf("chunk over the room: %d %s", w.Code, w.Body)
+	}
+	var body struct{ Offset int64 }
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if body.Offset != 300 {
+		t.Errorf("offset after 507 = %d, want the 300 bytes written", body.Offset)
+	}
+}
+
+func TestQuota_SystemDiskReserve(t *testing.T) {
+	c, mux := newUploadMux(t)
+	c.UploadReserve, c.UploadReservePercent = 100, 0
+	c.SystemReserve, c.SystemReservePercent = 500, 10 // 10% of 1000 is less
+
+	// A dedicated drive keeps only the upload reserve.
+	fakeDisk(t, 600, 1000)
+	if q, _ := c.quota(); q != (Quota{Total: 1000, Used: 400, Reserved: 100, Available: 500}) {
+		t.Errorf("dedicated drive: %+v", q)
+	}
+	if w := postUpload(t, mux, "a.bin", strings.Repeat("x", 250), true); w.Code != http.StatusCreated {
+		t.Errorf("upload on a dedicated drive: %d %s", w.Code, w.Body)
+	}
+
+	// On the SD card the system reserve is the stricter one.
+	fakeSystemDisk(t, 600, 1000)
+	want := Quota{Total: 1000, Used: 400, Reserved: 500, Available: 100, SystemDisk: true, SystemReserved: 500}
+	if q, _ := c.quota(); q != want {
+		t.Errorf("system disk: %+v, want %+v", q, want)
+	}
+	var body struct {
+		Code  string `json:"code"`
+		Error string `json:"error"`
+	}
+	w := postUpload(t, mux, "b.bin", strings.Repeat("x", 250), true)
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if w.Code != http.StatusInsufficientStorage || body.Code != codeSystemReserve || !strings.Contains(body.Error, "system disk") {
+		t.Errorf("upload into the system reserve: %d %s", w.Code, w.Body)
+	}
+	u := initUpload(t, mux, `{"path":"/","name":"c.bin"}`)
+	w = do(t, mux, "PUT", "/api/upload/"+u.ID+"?offset=0", strings.Repeat("x", 250))
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if w.Code != http.StatusInsufficientStorage || body.Code != codeSystemReserve {
+		t.Errorf("chunk into the system reserve: %d %s", w.Code, w.Body)
+	}
+
+	// A larger upload reserve is the one that stops uploads then.
+	c.UploadReserve = 550
+	if w := postUpload(t, mux, "d.bin", "x", true); w.Code != http.StatusInsufficientStorage ||
+		!strings.Contains(w.Body.String(), `"code":"upload_reserve"`) {
+		t.Errorf("upload into the upload reserve: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestThumb_NotMadeIntoTheSystemReserve(t *testing.T) {
+	c, mux := newUploadMux(t)
+	c.SystemReserve, c.SystemReservePercent = 500, 0
+	writeFiles(t, c.DataDir, map[string]string{"p.jpg": encodeImage(t, "jpeg", solidImage(40, 40, color.Black))})
+
+	fakeSystemDisk(t, 500, 1000)
+	if w := do(t, mux, "GET", "/api/thumb?path=/p.jpg", ""); w.Code != http.StatusInsufficientStorage ||
+		!strings.Contains(w.Body.String(), codeSystemReserve) {
+		t.Errorf("thumb at the system reserve: %d %s", w.Code, w.Body)
+	}
+	if n := cachedThumbs(t, c); n != 0 {
+		t.Errorf("%d thumbnails written into the reserve", n)
+	}
+
+	// A dedicated drive as full makes them as before.
+	fakeDisk(t, 500, 1000)
+	if w, _ := thumbOf(t, mux, "path=/p.jpg"); w.Code != http.StatusOK {
+		t.Errorf("thumb on a dedicated drive: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestHealthWarnings_ReferTheReserve(t *testing.T) {
+	c, _ := newUploadMux(t)
+	c.UploadReserve, c.UploadReservePercent = 100, 0
+	c.SystemReserve, c.SystemReservePercent = 200, 0
+
+	fakeDisk(t, 500, 1000)
+	if got := c.HealthWarnings(); got != nil {
+		t.Errorf("plenty of room: %v", got)
+	}
+	fakeDisk(t, 150, 1000)
+	if got := c.HealthWarnings(); len(got) != 1 || !strings.HasPrefix(got[0], "data drive has 50 B left before its 100 B") {
+		t.Errorf("near the reserve: %v", got)
+	}
+	fakeSystemDisk(t, 150, 1000)
+	if got := c.HealthWarnings(); len(got) != 1 || !strings.HasPrefix(got[0], "system disk") || !strings.Contains(got[0], "200 B free-space reserve: uploads and thumbnails are refused") {
+		t.Errorf("at the system reserve: %v", got)
+	}
+}
@@ -0,0 +1,294 @@
+package cloud
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/httputil"
+	"github.com/strct-org/strct-agent/internal/latency"
+)
+
+// Search. GET /api/search matches file and folder names under a path. It
+// answers from an in-memory index of DataDir, rebuilt every
+// searchIndexRefresh and marked stale by every handler that changes the
+// tree. While the index is stale (or not built yet) a query walks the
+// requested folder itself and a rebuild starts in the background.
+const (
+	searchIndexRefresh = 10 * time.Minute
+	searchMaxDepth     = 32      // folders below DataDir
+	searchIndexCap     = 500_000 // entries; beyond this queries walk
+	searchDefaultLimit = 100
+	searchMaxLimit     = 1000
+)
+
+type SearchResult struct {
+	Path       string `json:"path"` // from the DataDir root, e.g. "/docs/2024/invoice.pdf"
+	Name       string `json:"name"`
+	Type       string `json:"type"` // file|folder
+	Size       int64  `json:"size"`
+	ModifiedAt string `json:"modified_at"`
+}
+
+type SearchResponse struct {
+	Results   []SearchResult `json:"results"`
+	Truncated bool           `json:"truncated"` // more matches than limit
+	Indexed   bool           `json:"indexed"`   // false: answered by a live walk
+}
+
+// searchIndex is a flat list of everything under DataDir.
+type searchIndex struct {
+	mu       sync.Mutex
+	entries  []SearchResult
+	built    bool
+	gen      uint64 // bumped by invalidate
+	builtGen uint64 // gen the entries reflect
+	building bool
+	// oversized: the last build hit searchIndexCap. Queries walk and
+	// only the timer tries again.
+	oversized bool
+}
+
+// invalidate marks the index stale after a change to the tree.
+func (ix *searchIndex) invalidate() {
+	ix.mu.Lock()
+	ix.gen++
+	ix.mu.Unlock()
+}
+
+// current returns the entries if they still reflect the tree.
+func (ix *searchIndex) current() ([]SearchResult, bool) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if !ix.built || ix.builtGen != ix.gen {
+		return nil, false
+	}
+	return ix.entries, true
+}
+
+// errStopWalk ends a walk early once enough has been collected.
+var errStopWalk = errors.New("stop walk")
+
+// walkTree calls fn for every file and folder under root (a path under
+// DataDir), skipping the reserved directories and symlinks, down to
+// searchMaxDepth. fn returns false to stop.
+func (s *Cloud) walkTree(root string, fn func(SearchResult) bool) error {
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == root {
+				return err
+			}
+			return nil // unreadable folder: skip it, keep searching
+		}
+		if p == root {
+			return nil
+		}
+		if d.Type()&fs.ModeSymlink != 0 {
+			return nil
+		}
+		rel, err := filepath.Rel(s.DataDir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if s.category(p) != catLive {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() && strings.Count(rel, "/") >= searchMaxDepth {
+			return filepath.SkipDir
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		r := SearchResult{
+			Path:       "/" + rel,
+			Name:       d.Name(),
+			Type:       "file",
+			Size:       info.Size(),
+			ModifiedAt: info.ModTime().Format(time.RFC3339),
+		}
+		if d.IsDir() {
+			r.Type, r.Size = "folder", 0
+		}
+		if !fn(r) {
+			return errStopWalk
+		}
+		return nil
+	})
+	if errors.Is(err, errStopWalk) {
+		return nil
+	}
+	return err
+}
+
+// refreshIndex rebuilds the index with one walk of DataDir.
+func (s *Cloud) refreshIndex() {
+	s.index.mu.Lock()
+	if s.index.building {
+		s.index.mu.Unlock()
+		return
+	}
+	s.index.building = true
+	gen := s.index.gen
+	s.index.mu.Unlock()
+
+	var entries []SearchResult
+	complete := true
+	err := s.walkTree(s.DataDir, func(r SearchResult) bool {
+		if len(entries) == searchIndexCap {
+			complete = false
+			return false
+		}
+		entries = append(entries, r)
+		return true
+	})
+
+	s.index.mu.Lock()
+	defer s.index.mu.Unlock()
+	s.index.building = false
+	if err != nil || !complete {
+		// Too big (or unreadable) to index: every query walks.
+		s.index.built, s.index.entries = false, nil
+		s.index.oversized = !complete
+		if err != nil {
+			slog.Warn("cloud: search index walk failed", "err", err)
+		} else {
+			slog.Warn("cloud: too many files to index for search", "cap", searchIndexCap)
+		}
+		return
+	}
+	s.index.entries, s.index.built, s.index.builtGen = entries, true, gen
+	s.index.oversized = false
+}
+
+// kickIndex queues a rebuild unless one is running or the tree is too big
+// to index.
+func (s *Cloud) kickIndex() {
+	s.index.mu.Lock()
+	skip := s.index.building || s.index.oversized
+	s.index.mu.Unlock()
+	if !skip {
+		s.queueIndex()
+	}
+}
+
+// queueIndex queues a rebuild on the background queue, joining one that
+// is already queued.
+func (s *Cloud) queueIndex() {
+	_, err := s.background().submit(jobIndex, "index", prioMaintenance, func(context.Context) (any, error) {
+		s.refreshIndex()
+		return nil, nil
+	})
+	if err != nil {
+		slog.Warn("cloud: search index rebuild not queued", "err", err)
+	}
+}
+
+// nameMatcher matches names case-insensitively: a glob if q has glob
+// characters, otherwise a substring.
+func nameMatcher(q string) (func(name string) bool, error) {
+	q = strings.ToLower(q)
+	if !strings.ContainsAny(q, "*?[") {
+		return func(name string) bool { return strings.Contains(strings.ToLower(name), q) }, nil
+	}
+	if _, err := path.Match(q, ""); err != nil {
+		return nil, err
+	}
+	return func(name string) bool {
+		ok, _ := path.Match(q, strings.ToLower(name))
+		return ok
+	}, nil
+}
+
+// handleSearch finds files and folders by name.
+// GET /api/search?q=invoice&path=/docs&type=file&limit=100
+func (s *Cloud) handleSearch(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	q := strings.TrimSpace(query.Get("q"))
+	if q == "" {
+		httputil.BadRequest(w, "q is required")
+		return
+	}
+	match, err := nameMatcher(q)
+	if err != nil {
+		httputil.BadRequest(w, "invalid pattern")
+		return
+	}
+	kind := query.Get("type")
+	if kind != "" && kind != "file" && kind != "folder" {
+		httputil.BadRequest(w, "type must be file or folder")
+		return
+	}
+	limit := searchDefaultLimit
+	if v := query.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > searchMaxLimit {
+			httputil.BadRequest(w, "limit must be between 1 and "+strconv.Itoa(searchMaxLimit))
+			return
+		}
+	}
+	root, err := s.userPath(query.Get("path"))
+	if err != nil {
+		httputil.Forbidden(w)
+		return
+	}
+	if info, err := os.Stat(root); err != nil || !info.IsDir() {
+		httputil.Error(w, http.StatusNotFound, "folder not found")
+		return
+	}
+	ctx := r.Context()
+	latency.Mark(ctx, phaseResolve)
+	prefix := "/"
+	if rel, _ := filepath.Rel(s.DataDir, root); rel != "." {
+		prefix = "/" + filepath.ToSlash(rel) + "/"
+	}
+
+	resp := SearchResponse{Results: []SearchResult{}}
+	// collect returns false once one match past limit shows truncation.
+	collect := func(e SearchResult) bool {
+		if !strings.HasPrefix(e.Path, prefix) || (kind != "" && e.Type != kind) || !match(e.Name) {
+			return true
+		}
+		if len(resp.Results) == limit {
+			resp.Truncated = true
+			return false
+		}
+		resp.Results = append(resp.Results, e)
+		return true
+	}
+
+	if entries, ok := s.index.current(); ok {
+		resp.Indexed = true
+		for _, e := range entries {
+			if !collect(e) {
+				break
+			}
+		}
+		latency.Mark(ctx, phaseSearch)
+		httputil.OK(w, resp)
+		latency.Mark(ctx, phaseEncode)
+		return
+	}
+
+	s.kickIndex()
+	if err := s.walkTree(root, collect); err != nil {
+		slog.Error("cloud: search walk failed", "root", root, "err", err)
+		httputil.InternalError(w, "search failed")
+		return
+	}
+	latency.Mark(ctx, phaseSearch)
+	httputil.OK(w, resp)
+	latency.Mark(ctx, phaseEncode)
+}
@@ -0,0 +1,166 @@
+package cloud
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"testing"
+)
+
+func search(t *testing.T, mux http.Handler, query string) SearchResponse {
+	t.Helper()
+	w := do(t, mux, "GET", "/api/search?"+query, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("search %q: %d %s", query, w.Code, w.Body)
+	}
+	var resp SearchResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func resultPaths(resp SearchResponse) []string {
+	var paths []string
+	for _, r := range resp.Results {
+		paths = append(paths, r.Path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func equalPaths(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func newSearchMux(t *testing.T) (*Cloud, *http.ServeMux) {
+	t.Helper()
+	c, mux := newUploadMux(t)
+	writeFiles(t, c.DataDir, map[string]string{
+		"docs/Invoice-2024.pdf":         "1234",
+		"docs/archive/invoice-2023.pdf": "12",
+		"docs/notes.txt":                "n",
+		"invoices/readme.md":            "r",
+		".trash/1-invoice.pdf":          "t",
+		".thumbs/invoice.jpg":           "c",
+	})
+	return c, mux
+}
+
+func TestSearch_MatchesNames(t *testing.T) {
+	for _, indexed := range []bool{false, true} {
+		c, mux := newSearchMux(t)
+		if indexed {
+			c.refreshIndex()
+		} else {
+			// As if a build were running, so the first query can't kick
+			// one off that answers the rest.
+			c.index.building = true
+		}
+		cases := []struct {
+			query string
+			want  []string
+		}{
+			{"q=INVOICE", []string{"/docs/Invoice-2024.pdf", "/docs/archive/invoice-2023.pdf", "/invoices"}},
+			{"q=invoice&type=file", []string{"/docs/Invoice-2024.pdf", "/docs/archive/invoice-2023.pdf"}},
+			{"q=invoice&type=folder", []string{"/invoices"}},
+			{"q=invoice&path=/docs/archive", []string{"/docs/archive/invoice-2023.pdf"}},
+			{"q=*.PDF", []string{"/docs/Invoice-2024.pdf", "/docs/archive/invoice-2023.pdf"}},
+			{"q=invoice-202?.pdf&path=/docs", []string{"/docs/Invoice-2024.pdf", "/docs/archive/invoice-2023.pdf"}},
+			{"q=nothing", nil},
+		}
+		for _, tc := range cases {
+			resp := search(t, mux, tc.query)
+			if resp.Indexed != indexed {
+				t.Errorf("%s: indexed = %v, want %v", tc.query, resp.Indexed, indexed)
+			}
+			if got := resultPaths(resp); !equalPaths(got, tc.want) {
+				t.Errorf("%s (indexed=%v): got %v, want %v", tc.query, indexed, got, tc.want)
+			}
+		}
+	}
+}
+
+func TestSearch_ResultFields(t *testing.T) {
+	_, mux := newSearchMux(t)
+	resp := search(t, mux, "q=invoice-2024")
+	if len(resp.Results) != 1 {
+		t.Fatalf("results = %+v", resp.Results)
+	}
+	r := resp.Results[0]
+	if r.Name != "Invoice-2024.pdf" || r.Type != "file" || r.Size != 4 || r.ModifiedAt == "" {
+		t.Errorf("result = %+v", r)
+	}
+}
+
+func TestSearch_LimitTruncates(t *testing.T) {
+	_, mux := newSearchMux(t)
+	resp := search(t, mux, "q=invoice&limit=2")
+	if len(resp.Results) != 2 || !resp.Truncated {
+		t.Errorf("limit 2: %d results, truncated=%v", len(resp.Results), resp.Truncated)
+	}
+	resp = search(t, mux, "q=invoice&limit=3")
+	if len(resp.Results) != 3 || resp.Truncated {
+		t.Errorf("limit 3: %d results, truncated=%v", len(resp.Results), resp.Truncated)
+	}
+}
+
+// TestSearch_IndexInvalidated checks that a change to the tree is never
+// answered from an index built before it.
+func TestSearch_IndexInvalidated(t *testing.T) {
+	c, mux := newSearchMux(t)
+	c.refreshIndex()
+	if !search(t, mux, "q=notes").Indexed {
+		t.Fatal("fresh index not used")
+	}
+
+	multipartUpload(t, mux, "/docs", "invoice-2025.pdf", "x")
+	resp := search(t, mux, "q=invoice-2025")
+	if resp.Indexed || len(resp.Results) != 1 {
+		t.Fatalf("after upload: %+v", resp)
+	}
+
+	c.refreshIndex()
+	do(t, mux, "POST", "/api/move", `{"from":"/docs/notes.txt","to":"/invoices/notes.txt"}`)
+	if got := resultPaths(search(t, mux, "q=notes")); !equalPaths(got, []string{"/invoices/notes.txt"}) {
+		t.Errorf("after move: %v", got)
+	}
+
+	c.refreshIndex()
+	do(t, mux, "DELETE", "/api/delete?path=/invoices", "")
+	if got := resultPaths(search(t, mux, "q=notes")); got != nil {
+		t.Errorf("after delete: %v", got)
+	}
+
+	c.refreshIndex()
+	do(t, mux, "POST", "/api/mkdir", `{"path":"/","name":"notes-2026"}`)
+	if got := resultPaths(search(t, mux, "q=notes")); !equalPaths(got, []string{"/notes-2026"}) {
+		t.Errorf("after mkdir: %v", got)
+	}
+}
+
+func TestSearch_Validation(t *testing.T) {
+	_, mux := newSearchMux(t)
+	for query, want := range map[string]int{
+		"":                         http.StatusBadRequest,
+		"q=a&type=link":            http.StatusBadRequest,
+		"q=a&limit=0":              http.StatusBadRequest,
+		"q=a&limit=5000":           http.StatusBadRequest,
+		"q=[":                      http.StatusBadRequest,
+		"q=a&path=/.trash":         http.StatusForbidden,
+		"q=a&path=/missing":        http.StatusNotFound,
+		"q=a&path=/docs/notes.txt": http.StatusNotFound,
+	} {
+		if w := do(t, mux, "GET", "/api/search?"+query, ""); w.Code != want {
+			t.Errorf("%q: %d, want %d", query, w.Code, want)
+		}
+	}
+}
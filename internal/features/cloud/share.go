@@ -0,0 +1,335 @@
+package cloud
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/httputil"
+	"github.com/strct-org/strct-agent/internal/statefile"
+)
+
+// Share links. POST /api/share hands out a token for one file, and
+// GET /share/{token} serves that file to whoever holds it — through the
+// tunnel, to a browser that has no access to the rest of the API:
+//
+//	POST   /api/share          {"path":"/docs/report.pdf","expires_in":"24h","max_downloads":3}
+//	GET    /share/{token}      the file, with Range support
+//	GET    /api/share          active links
+//	DELETE /api/share/{token}  revoke
+//
+// A link points at a path, so moving or deleting the file breaks it.
+// Links live in DataDir/.shares/shares.json; expired and used-up ones are
+// dropped by the hourly upkeep.
+const (
+	sharesDirName     = ".shares"
+	shareTokenBytes   = 32
+	defaultShareTTL   = 24 * time.Hour
+	maxShareTTL       = 30 * 24 * time.Hour
+	maxShareDownloads = 1000
+
+	// shareResumeWindow is how long after its last request a client's
+	// download can be resumed or seeked through without counting again.
+	shareResumeWindow = time.Hour
+)
+
+// sharesSchema versions shares.json.
+//
+//	v1: shareStore as-is
+var sharesSchema = statefile.Schema{
+	Name:       "cloud-shares",
+	Migrations: []statefile.Migration{statefile.Stamp},
+}
+
+// Share is one download link.
+type Share struct {
+	Token        string    `json:"token"`
+	Path         string    `json:"path"` // the shared file, from the DataDir root
+	URL          string    `json:"url"`  // "/share/<token>", on the agent or the tunnel host
+	CreatedAt    time.Time `json:"created_at"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	MaxDownloads int       `json:"max_downloads"` // 0: until it expires
+	Downloads    int       `json:"downloads"`
+}
+
+// active reports whether the link still serves the file at now.
+func (sh Share) active(now time.Time) bool {
+	return now.Before(sh.ExpiresAt) && (sh.MaxDownloads == 0 || sh.Downloads < sh.MaxDownloads)
+}
+
+type shareStore struct {
+	Shares []Share `json:"shares"`
+}
+
+func (s *Cloud) sharesPath() string {
+	return filepath.Join(s.DataDir, sharesDirName, "shares.json")
+}
+
+// updateShares loads the links, lets fn change them and saves the result
+// if fn reports a change. Links are read from disk on every call: they
+// are few, and a request for one is rare next to the file it serves.
+func (s *Cloud) updateShares(fn func(st *shareStore) bool) error {
+	s.shareMu.Lock()
+	defer s.shareMu.Unlock()
+
+	var st shareStore
+	if err := statefile.Load(s.sharesPath(), sharesSchema, &st); err != nil && !statefile.Fresh(err) {
+		return fmt.Errorf("load shares: %w", err)
+	}
+	if !fn(&st) {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(s.sharesPath()), 0700); err != nil {
+		return err
+	}
+	if err := statefile.Save(s.sharesPath(), sharesSchema, st); err != nil {
+		return fmt.Errorf("save shares: %w", err)
+	}
+	return nil
+}
+
+// newShareToken returns 256 random bits, URL-safe.
+func newShareToken() (string, error) {
+	b := make([]byte, shareTokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// shareFile resolves a shared path to a regular file under DataDir.
+func (s *Cloud) shareFile(p string) (string, os.FileInfo, bool) {
+	full, err := s.userPath(p)
+	if err != nil {
+		return "", nil, false
+	}
+	info, err := os.Lstat(full)
+	if err != nil || !info.Mode().IsRegular() {
+		return "", nil, false
+	}
+	return full, info, true
+}
+
+// expireShares drops the links that can no longer be used.
+func (s *Cloud) expireShares(now time.Time) {
+	removed := 0
+	err := s.updateShares(func(st *shareStore) bool {
+		kept := st.Shares[:0]
+		for _, sh := range st.Shares {
+			if sh.active(now) {
+				kept = append(kept, sh)
+			}
+		}
+		removed = len(st.Shares) - len(kept)
+		st.Shares = kept
+		for key, last := range s.shareReaders {
+			if now.Sub(last) > shareResumeWindow {
+				delete(s.shareReaders, key)
+			}
+		}
+		return removed > 0
+	})
+	if err != nil {
+		slog.Warn("cloud: could not expire share links", "err", err)
+	} else if removed > 0 {
+		slog.Info("cloud: expired share links", "count", removed)
+	}
+}
+
+// handleCreateShare creates a link to one file.
+// POST body: {"path":"/docs/report.pdf","expires_in":"24h","max_downloads":3}
+func (s *Cloud) handleCreateShare(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Path         string `json:"path"`
+		ExpiresIn    string `json:"expires_in"`
+		MaxDownloads int    `json:"max_downloads"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httputil.BadRequest(w, "invalid JSON")
+		return
+	}
+	ttl := defaultShareTTL
+	if req.ExpiresIn != "" {
+		d, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil || d <= 0 || d > maxShareTTL {
+			httputil.BadRequest(w, "expires_in must be a duration between 1s and 720h")
+			return
+		}
+		ttl = d
+	}
+	if req.MaxDownloads < 0 || req.MaxDownloads > maxShareDownloads {
+		httputil.BadRequest(w, fmt.Sprintf("max_downloads must be between 0 (no limit) and %d", maxShareDownloads))
+		return
+	}
+	if _, err := s.userPath(req.Path); err != nil {
+		httputil.Forbidden(w)
+		return
+	}
+	full, _, ok := s.shareFile(req.Path)
+	if !ok {
+		httputil.Error(w, http.StatusNotFound, "no file at "+req.Path)
+		return
+	}
+	rel, _ := filepath.Rel(s.DataDir, full)
+
+	token, err := newShareToken()
+	if err != nil {
+		slog.Error("cloud: could not generate share token", "err", err)
+		httputil.InternalError(w, "could not create link")
+		return
+	}
+	now := time.Now().UTC()
+	sh := Share{
+		Token:        token,
+		Path:         "/" + filepath.ToSlash(rel),
+		URL:          "/share/" + token,
+		CreatedAt:    now,
+		ExpiresAt:    now.Add(ttl),
+		MaxDownloads: req.MaxDownloads,
+	}
+	err = s.updateShares(func(st *shareStore) bool {
+		st.Shares = append(st.Shares, sh)
+		return true
+	})
+	if err != nil {
+		slog.Error("cloud: could not save share link", "err", err)
+		httputil.InternalError(w, "could not create link")
+		return
+	}
+	slog.Info("cloud: share link created", "path", sh.Path, "expires_at", sh.ExpiresAt, "max_downloads", sh.MaxDownloads)
+	s.logActivity(r, Activity{Op: opShare, Path: sh.Path})
+	httputil.JSON(w, http.StatusCreated, sh)
+}
+
+// handleListShares lists the links that still work, newest first.
+func (s *Cloud) handleListShares(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	shares := []Share{}
+	err := s.updateShares(func(st *shareStore) bool {
+		for _, sh := range st.Shares {
+			if sh.active(now) {
+				shares = append(shares, sh)
+			}
+		}
+		return false
+	})
+	if err != nil {
+		slog.Error("cloud: could not read share links", "err", err)
+		httputil.InternalError(w, "could not read links")
+		return
+	}
+	sort.Slice(shares, func(i, j int) bool { return shares[i].CreatedAt.After(shares[j].CreatedAt) })
+	httputil.OK(w, shares)
+}
+
+// handleRevokeShare deletes a link. DELETE /api/share/{token}
+func (s *Cloud) handleRevokeShare(w http.ResponseWriter, r *http.Request) {
+	token := r.PathValue("token")
+	found := false
+	var path string
+	err := s.updateShares(func(st *shareStore) bool {
+		for i, sh := range st.Shares {
+			if sh.Token == token {
+				st.Shares = append(st.Shares[:i], st.Shares[i+1:]...)
+				found, path = true, sh.Path
+				return true
+			}
+		}
+		return false
+	})
+	if err != nil {
+		slog.Error("cloud: could not revoke share link", "err", err)
+		httputil.InternalError(w, "could not revoke link")
+		return
+	}
+	if !found {
+		httputil.Error(w, http.StatusNotFound, "no such link")
+		return
+	}
+	s.logActivity(r, Activity{Op: opUnshare, Path: path})
+	httputil.NoContent(w)
+}
+
+// handleShareDownload serves a shared file. Every GET counts as a
+// download, except a Range request further in from a client whose
+// download of the link was counted within shareResumeWindow: a player
+// seeking through a video, or a resumed download, would otherwise use up
+// the link. A GET from the first byte always counts. The count is taken
+// before the file is sent, so the last allowed download still completes.
+func (s *Cloud) handleShareDownload(w http.ResponseWriter, r *http.Request) {
+	token := r.PathValue("token")
+	reader := token + " " + clientIP(r)
+	fromStart := rangeFromStart(r.Header.Get("Range"))
+	counts := false
+	now := time.Now()
+
+	var sh Share
+	found := false
+	err := s.updateShares(func(st *shareStore) bool {
+		for i := range st.Shares {
+			if st.Shares[i].Token != token || !st.Shares[i].active(now) {
+				continue
+			}
+			found = true
+			if r.Method == http.MethodGet {
+				last, seen := s.shareReaders[reader]
+				counts = fromStart || !seen || now.Sub(last) > shareResumeWindow
+				if s.shareReaders == nil {
+					s.shareReaders = make(map[string]time.Time)
+				}
+				s.shareReaders[reader] = now
+			}
+			if counts {
+				st.Shares[i].Downloads++
+			}
+			sh = st.Shares[i]
+			return counts
+		}
+		return false
+	})
+	if err != nil {
+		slog.Error("cloud: could not read share links", "err", err)
+		http.Error(w, "link unavailable", http.StatusInternalServerError)
+		return
+	}
+	// Unknown, expired and used-up links look the same to the holder.
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+	full, info, ok := s.shareFile(sh.Path)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	f, err := os.Open(full)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": info.Name()}))
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.Header().Set("X-Robots-Tag", "noindex")
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+}
+
+// rangeFromStart reports whether a Range header, if any, asks for the file
+// from its first byte.
+func rangeFromStart(h string) bool {
+	if h == "" {
+		return true
+	}
+	spec, ok := strings.CutPrefix(h, "bytes=")
+	return ok && strings.HasPrefix(strings.TrimSpace(spec), "0-")
+}
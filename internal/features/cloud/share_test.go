@@ -0,0 +1,194 @@
+package cloud
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func createShare(t *testing.T, mux http.Handler, body string) Share {
+	t.Helper()
+	w := do(t, mux, "POST", "/api/share", body)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("share: %d %s", w.Code, w.Body)
+	}
+	var sh Share
+	if err := json.Unmarshal(w.Body.Bytes(), &sh); err != nil {
+		t.Fatal(err)
+	}
+	return sh
+}
+
+func fetchShare(mux http.Handler, url, rangeHeader string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", url, nil)
+	if rangeHeader != "" {
+		r.Header.Set("Range", rangeHeader)
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	return w
+}
+
+func listShares(t *testing.T, mux http.Handler) []Share {
+	t.Helper()
+	var shares []Share
+	if err := json.Unmarshal(do(t, mux, "GET", "/api/share", "").Body.Bytes(), &shares); err != nil {
+		t.Fatal(err)
+	}
+	return shares
+}
+
+func TestShare_DownloadCountsAndRange(t *testing.T) {
+	c, mux := newUploadMux(t)
+	writeFiles(t, c.DataDir, map[string]string{"docs/report.pdf": "0123456789"})
+
+	sh := createShare(t, mux, `{"path":"/docs/report.pdf","expires_in":"1h","max_downloads":2}`)
+	if len(sh.Token) != 43 || sh.URL != "/share/"+sh.Token || sh.Path != "/docs/report.pdf" {
+		t.Fatalf("share = %+v", sh)
+	}
+	if d := sh.ExpiresAt.Sub(sh.CreatedAt); d != time.Hour {
+		t.Errorf("expires after %v", d)
+	}
+	if other := createShare(t, mux, `{"path":"/docs/report.pdf"}`); other.Token == sh.Token {
+		t.Error("tokens repeat")
+	}
+	if list := do(t, mux, "GET", "/api/files?path=/", "").Body.String(); strings.Contains(list, sharesDirName) {
+		t.Errorf("listing shows the share store: %s", list)
+	}
+
+	w := fetchShare(mux, sh.URL, "")
+	if w.Code != http.StatusOK || w.Body.String() != "0123456789" {
+		t.Fatalf("download: %d %q", w.Code, w.Body)
+	}
+	if cd := w.Header().Get("Content-Disposition"); cd != `attachment; filename=report.pdf` {
+		t.Errorf("Content-Disposition = %q", cd)
+	}
+	// Seeking further in doesn't use up the link.
+	for range 3 {
+		w = fetchShare(mux, sh.URL, "bytes=4-6")
+		if w.Code != http.StatusPartialContent || w.Body.String() != "456" {
+			t.Fatalf("range: %d %q", w.Code, w.Body)
+		}
+	}
+	if w := fetchShare(mux, sh.URL, "bytes=0-"); w.Code != http.StatusPartialContent {
+		t.Fatalf("second download: %d", w.Code)
+	}
+	if w := fetchShare(mux, sh.URL, ""); w.Code != http.StatusNotFound {
+		t.Errorf("third download: %d, want 404", w.Code)
+	}
+	if w := fetchShare(mux, sh.URL, "bytes=4-6"); w.Code != http.StatusNotFound {
+		t.Errorf("range after the last download: %d, want 404", w.Code)
+	}
+	for _, s := range listShares(t, mux) {
+		if s.Token == sh.Token {
+			t.Error("used-up link still listed")
+		}
+	}
+}
+
+func TestShare_RangeFurtherInCounts(t *testing.T) {
+	c, mux := newUploadMux(t)
+	writeFiles(t, c.DataDir, map[string]string{"docs/report.pdf": "0123456789"})
+	sh := createShare(t, mux, `{"path":"/docs/report.pdf","expires_in":"1h","max_downloads":2}`)
+
+	from := func(addr, rangeHeader string) int {
+		r := httptest.NewRequest("GET", sh.URL, nil)
+		r.RemoteAddr = addr
+		r.Header.Set("Range", rangeHeader)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w.Code
+	}
+	// bytes=1- from a client with no download under way is a download of
+	// its own; its later ranges continue it.
+	if code := from("198.51.100.1:1000", "bytes=1-"); code != http.StatusPartialContent {
+		t.Fatalf("first: %d", code)
+	}
+	if code := from("198.51.100.1:1001", "bytes=5-"); code != http.StatusPartialContent {
+		t.Fatalf("resume: %d", code)
+	}
+	if code := from("198.51.100.2:1000", "bytes=1-"); code != http.StatusPartialContent {
+		t.Fatalf("second client: %d", code)
+	}
+	if code := from("198.51.100.3:1000", "bytes=1-"); code != http.StatusNotFound {
+		t.Errorf("third client: %d, want 404", code)
+	}
+	if code := from("198.51.100.1:1002", "bytes=5-"); code != http.StatusNotFound {
+		t.Errorf("resume after the link was used up: %d, want 404", code)
+	}
+}
+
+func TestShare_ExpiryAndRevoke(t *testing.T) {
+	c, mux := newUploadMux(t)
+	writeFiles(t, c.DataDir, map[string]string{"a.txt": "aaa", "b.txt": "bbb"})
+	a := createShare(t, mux, `{"path":"/a.txt","expires_in":"1h"}`)
+	b := createShare(t, mux, `{"path":"/b.txt","expires_in":"1h"}`)
+
+	if shares := listShares(t, mux); len(shares) != 2 || shares[0].Token != b.Token {
+		t.Fatalf("shares = %+v", shares)
+	}
+	if w := do(t, mux, "DELETE", "/api/share/"+a.Token, ""); w.Code != http.StatusNoContent {
+		t.Fatalf("revoke: %d %s", w.Code, w.Body)
+	}
+	if w := fetchShare(mux, a.URL, ""); w.Code != http.StatusNotFound {
+		t.Errorf("revoked link: %d", w.Code)
+	}
+	if w := do(t, mux, "DELETE", "/api/share/"+a.Token, ""); w.Code != http.StatusNotFound {
+		t.Errorf("revoke twice: %d", w.Code)
+	}
+
+	c.expireShares(time.Now().Add(2 * time.Hour))
+	if shares := listShares(t, mux); len(shares) != 0 {
+		t.Errorf("after expiry = %+v", shares)
+	}
+	if w := fetchShare(mux, b.URL, ""); w.Code != http.StatusNotFound {
+		t.Errorf("expired link: %d", w.Code)
+	}
+}
+
+func TestShare_FileGoneOrReplaced(t *testing.T) {
+	c, mux := newUploadMux(t)
+	writeFiles(t, c.DataDir, map[string]string{"a.txt": "aaa"})
+	sh := createShare(t, mux, `{"path":"/a.txt"}`)
+
+	do(t, mux, "DELETE", "/api/delete?path=/a.txt", "")
+	if w := fetchShare(mux, sh.URL, ""); w.Code != http.StatusNotFound {
+		t.Errorf("deleted file: %d", w.Code)
+	}
+	if err := os.Symlink("/etc/passwd", c.DataDir+"/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if w := fetchShare(mux, sh.URL, ""); w.Code != http.StatusNotFound {
+		t.Errorf("symlink in its place: %d", w.Code)
+	}
+}
+
+func TestShare_Validation(t *testing.T) {
+	c, mux := newUploadMux(t)
+	writeFiles(t, c.DataDir, map[string]string{"a.txt": "aaa", "docs/b.txt": "b", ".trash/1-c.txt": "c"})
+
+	for body, want := range map[string]int{
+		`not json`:                                 http.StatusBadRequest,
+		`{"path":"/a.txt","expires_in":"soon"}`:    http.StatusBadRequest,
+		`{"path":"/a.txt","expires_in":"-1h"}`:     http.StatusBadRequest,
+		`{"path":"/a.txt","expires_in":"721h"}`:    http.StatusBadRequest,
+		`{"path":"/a.txt","max_downloads":-1}`:     http.StatusBadRequest,
+		`{"path":"/a.txt","max_downloads":100000}`: http.StatusBadRequest,
+		`{"path":"/.trash/1-c.txt"}`:               http.StatusForbidden,
+		`{"path":"/.shares/shares.json"}`:          http.StatusForbidden,
+		`{"path":"/docs"}`:                         http.StatusNotFound,
+		`{"path":"/"}`:                             http.StatusNotFound,
+		`{"path":"/missing.txt"}`:                  http.StatusNotFound,
+	} {
+		if w := do(t, mux, "POST", "/api/share", body); w.Code != want {
+			t.Errorf("%s: %d, want %d", body, w.Code, want)
+		}
+	}
+	if w := fetchShare(mux, "/share/nope", ""); w.Code != http.StatusNotFound {
+		t.Errorf("unknown token: %d", w.Code)
+	}
+}
@@ -0,0 +1,304 @@
+package cloud
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/httputil"
+	"github.com/strct-org/strct-agent/internal/managed"
+	"github.com/strct-org/strct-agent/internal/platform/disk"
+)
+
+// Storage accounting. DataDir holds more than the user's files: deleted
+// items waiting in the trash, generated thumbnails, and partial uploads.
+// Each lives in a reserved top-level directory that the file API hides, and
+// GET /api/storage reports how much each takes so a user who emptied a
+// folder can see where the space went.
+//
+// The figures are counters the file handlers adjust as they write and
+// remove, so reading them costs nothing. A walk of DataDir corrects any
+// drift every hour (reconcileUsage), and GET /api/status has one started
+// in the background when the figures it reports are older than
+// statusUsageTTL. With a file worker the agent serves /api/status but the
+// worker does the writes, so that walk is what keeps the agent's copy
+// current.
+const (
+	trashDirName  = ".trash"
+	thumbsDirName = ".thumbs"
+
+	statusUsageTTL = time.Minute
+)
+
+// Storage categories.
+const (
+	catLive     = "live"
+	catTrash    = "trash"
+	catCache    = "cache"
+	catInternal = "internal"
+)
+
+// reservedDirs are the top-level directories that are not the user's
+// files, and the category their contents count toward.
+var reservedDirs = map[string]string{
+	trashDirName:     catTrash,
+	thumbsDirName:    catCache,
+	uploadsDirName:   catInternal,
+	sharesDirName:    catInternal,
+	checksumsDirName: catInternal,
+	activityDirName:  catInternal,
+	attachmentsFile:  catInternal,
+	// Generated files an upgrade retired; they may hold passphrases.
+	managed.ObsoleteDirName: catInternal,
+}
+
+// StorageBreakdown is the JSON shape returned by /api/storage.
+type StorageBreakdown struct {
+	LiveBytes        int64     `json:"live_bytes"`        // the user's files
+	TrashBytes       int64     `json:"trash_bytes"`       // deleted, not yet purged
+	CacheBytes       int64     `json:"cache_bytes"`       // thumbnails; regenerated on demand
+	InternalBytes    int64     `json:"internal_bytes"`    // partial uploads, share links, /system, agent state
+	ReclaimableBytes int64     `json:"reclaimable_bytes"` // trash + cache
+	UsedBytes        int64     `json:"used_bytes"`        // sum of the above
+	FreeBytes        uint64    `json:"free_bytes"`
+	ReconciledAt     time.Time `json:"reconciled_at"` // last full walk
+}
+
+// usageCounters holds the bytes per category.
+type usageCounters struct {
+	mu           sync.Mutex
+	bytes        map[string]int64
+	reconciledAt time.Time
+	walking      chan struct{} // closed when the running walk is done; nil if none
+}
+
+func (u *usageCounters) add(cat string, delta int64) {
+	if delta == 0 {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.bytes == nil {
+		u.bytes = make(map[string]int64)
+	}
+	u.bytes[cat] += delta
+	if u.bytes[cat] < 0 {
+		u.bytes[cat] = 0 // a change the last walk already saw
+	}
+}
+
+func (u *usageCounters) set(bytes map[string]int64, at time.Time) {
+	u.mu.Lock()
+	u.bytes = bytes
+	u.reconciledAt = at
+	u.mu.Unlock()
+}
+
+func (u *usageCounters) breakdown() StorageBreakdown {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	b := StorageBreakdown{
+		LiveBytes:     u.bytes[catLive],
+		TrashBytes:    u.bytes[catTrash],
+		CacheBytes:    u.bytes[catCache],
+		InternalBytes: u.bytes[catInternal],
+		ReconciledAt:  u.reconciledAt,
+	}
+	b.ReclaimableBytes = b.TrashBytes + b.CacheBytes
+	b.UsedBytes = b.LiveBytes + b.ReclaimableBytes + b.InternalBytes
+	return b
+}
+
+// category is the storage category of a path under DataDir.
+func (s *Cloud) category(full string) string {
+	rel, err := filepath.Rel(s.DataDir, full)
+	if err != nil {
+		return catLive
+	}
+	top, _, _ := strings.Cut(filepath.ToSlash(rel), "/")
+	if cat, ok := reservedDirs[top]; ok {
+		return cat
+	}
+	if top == systemDirName && s.structured() {
+		return catInternal
+	}
+	if managed.InData(top) {
+		return catInternal // the agent's own state, wifi passwords included
+	}
+	return catLive
+}
+
+// trackSize adjusts the counters for full growing or shrinking by delta.
+func (s *Cloud) trackSize(full string, delta int64) {
+	if s.external(full) {
+		return
+	}
+	s.storage.add(s.category(full), delta)
+}
+
+// sizeOf is the bytes stored at full: a file's size or a tree's total.
+// Missing is 0.
+func sizeOf(full string) int64 {
+	n, _ := disk.GetDirSize(full)
+	return int64(n)
+}
+
+// walkUsage measures every category with one walk of DataDir.
+func (s *Cloud) walkUsage() (map[string]int64, error) {
+	bytes := map[string]int64{catLive: 0, catTrash: 0, catCache: 0, catInternal: 0}
+	entries, err := os.ReadDir(s.DataDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		full := filepath.Join(s.DataDir, e.Name())
+		if full == s.externalDir() {
+			continue // other drives' bytes
+		}
+		bytes[s.category(full)] += sizeOf(full)
+	}
+	return bytes, nil
+}
+
+// reconcileUsage replaces the counters with a fresh walk.
+func (s *Cloud) reconcileUsage(now time.Time) {
+	bytes, err := s.walkUsage()
+	if err != nil {
+		slog.Warn("cloud: storage walk failed", "err", err)
+		return
+	}
+	before := s.storage.breakdown()
+	s.storage.set(bytes, now)
+	if after := s.storage.breakdown(); !before.ReconciledAt.IsZero() && after.UsedBytes != before.UsedBytes {
+		slog.Debug("cloud: storage counters corrected", "drift", after.UsedBytes-before.UsedBytes)
+	}
+}
+
+// refreshUsage starts a reconcileUsage walk unless one is running, and
+// returns a channel closed when the running walk is done. A tree of a few
+// hundred thousand photos takes seconds to walk on an SD card; callers
+// that can use the current figures don't wait.
+func (s *Cloud) refreshUsage() <-chan struct{} {
+	u := &s.storage
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.walking != nil {
+		return u.walking
+	}
+	done := make(chan struct{})
+	u.walking = done
+	usage.Go(func() {
+		s.reconcileUsage(time.Now())
+		u.mu.Lock()
+		u.walking = nil
+		u.mu.Unlock()
+		close(done)
+	})
+	return done
+}
+
+// cachedUsage returns the counters, walking DataDir first only if it never
+// has been. Figures older than statusUsageTTL are returned as they are
+// and refreshed in the background.
+func (s *Cloud) cachedUsage() StorageBreakdown {
+	b := s.storage.breakdown()
+	switch {
+	case b.ReconciledAt.IsZero():
+		<-s.refreshUsage()
+		b = s.storage.breakdown()
+	case time.Since(b.ReconciledAt) > statusUsageTTL:
+		s.refreshUsage()
+	}
+	return b
+}
+
+func (s *Cloud) storageBreakdown() StorageBreakdown {
+	if s.storage.breakdown().ReconciledAt.IsZero() {
+		<-s.refreshUsage()
+	}
+	b := s.storage.breakdown()
+	if free, err := disk.GetFreeDiskSpace(s.DataDir); err == nil {
+		b.FreeBytes = free
+	}
+	return b
+}
+
+// ---------------------------------------------------------------------------
+// Purge controls
+// ---------------------------------------------------------------------------
+
+// purgeResult reports what a purge freed, with the breakdown after it.
+type purgeResult struct {
+	ReclaimedBytes int64            `json:"reclaimed_bytes"`
+	RemovedItems   int              `json:"removed_items"`
+	Storage        StorageBreakdown `json:"storage"`
+}
+
+// purgeDir removes the entries of a reserved directory that were last
+// modified before cutoff (all of them for a zero cutoff).
+func (s *Cloud) purgeDir(dir string, cutoff time.Time) (reclaimed int64, removed int) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, 0
+	}
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || (!cutoff.IsZero() && !info.ModTime().Before(cutoff)) {
+			continue
+		}
+		full := filepath.Join(dir, e.Name())
+		size := sizeOf(full)
+		if err := os.RemoveAll(full); err != nil {
+			slog.Warn("cloud: purge failed", "path", full, "err", err)
+			continue
+		}
+		s.trackSize(full, -size)
+		reclaimed += size
+		removed++
+	}
+	return reclaimed, removed
+}
+
+// handleEmptyTrash purges the trash, or only what was deleted more than
+// older_than_days ago.
+// POST body (optional): {"older_than_days":30}
+func (s *Cloud) handleEmptyTrash(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		OlderThanDays int `json:"older_than_days"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		httputil.BadRequest(w, "invalid JSON")
+		return
+	}
+	if req.OlderThanDays < 0 {
+		httputil.BadRequest(w, "older_than_days must not be negative")
+		return
+	}
+	var cutoff time.Time
+	if req.OlderThanDays > 0 {
+		cutoff = time.Now().AddDate(0, 0, -req.OlderThanDays)
+	}
+
+	reclaimed, removed := s.purgeTrash(cutoff)
+	slog.Info("cloud: trash emptied", "items", removed, "bytes", reclaimed)
+	httputil.OK(w, purgeResult{ReclaimedBytes: reclaimed, RemovedItems: removed, Storage: s.storageBreakdown()})
+}
+
+// handleClearCache removes generated thumbnails. They are rebuilt the next
+// time they are asked for.
+func (s *Cloud) handleClearCache(w http.ResponseWriter, r *http.Request) {
+	reclaimed, removed := s.purgeDir(filepath.Join(s.DataDir, thumbsDirName), time.Time{})
+	slog.Info("cloud: cache cleared", "items", removed, "bytes", reclaimed)
+	httputil.OK(w, purgeResult{ReclaimedBytes: reclaimed, RemovedItems: removed, Storage: s.storageBreakdown()})
+}
+
+func (s *Cloud) handleStorage(w http.ResponseWriter, r *http.Request) {
+	httputil.OK(w, s.storageBreakdown())
+}
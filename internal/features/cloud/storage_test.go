@@ -0,0 +1,268 @@
+package cloud
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/httputil"
+)
+
+func breakdownOf(t *testing.T, mux http.Handler) StorageBreakdown {
+	t.Helper()
+	w := do(t, mux, "GET", "/api/storage", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("storage: %d %s", w.Code, w.Body)
+	}
+	var b StorageBreakdown
+	if err := json.Unmarshal(w.Body.Bytes(), &b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func multipartUpload(t *testing.T, mux http.Handler, dir, name, body string) {
+	t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fw, _ := mw.CreateFormFile("file", name)
+	fw.Write([]byte(body))
+	mw.Close()
+	req := httptest.NewRequest("POST", "/strct_agent/fs/upload?path="+dir, &buf)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("upload: %d %s", w.Code, w.Body)
+	}
+}
+
+// TestStorage_CountersTrackWalk drives every handler that changes DataDir
+// and checks the tracked categories against a fresh walk.
+func TestStorage_CountersTrackWalk(t *testing.T) {
+	c, mux := newUploadMux(t)
+	writeFiles(t, c.DataDir, map[string]string{
+		"docs/a.txt":           strings.Repeat("a", 1000),
+		".trash/old/photo.jpg": strings.Repeat("t", 3000),
+		".thumbs/abc.jpg":      strings.Repeat("c", 200),
+	})
+	before := breakdownOf(t, mux) // first read walks
+	if before.LiveBytes != 1000 || before.TrashBytes != 3000 || before.CacheBytes != 200 {
+		t.Fatalf("initial breakdown = %+v", before)
+	}
+	if before.ReclaimableBytes != 3200 {
+		t.Errorf("reclaimable = %d, want 3200", before.ReclaimableBytes)
+	}
+
+	multipartUpload(t, mux, "/docs", "b.txt", strings.Repeat("b", 500))
+	multipartUpload(t, mux, "/docs", "a.txt", "shorter") // replaces 1000 bytes
+	do(t, mux, "POST", "/api/move", `{"from":"/docs/b.txt","to":"/docs/a.txt","overwrite":true}`)
+	u := initUpload(t, mux, `{"path":"/docs","name":"big.bin"}`)
+	do(t, mux, "PUT", "/api/upload/"+u.ID+"?offset=0", strings.Repeat("x", 4000))
+	mid := breakdownOf(t, mux)
+	if mid.InternalBytes < 4000 {
+		t.Errorf("partial upload not counted as internal: %+v", mid)
+	}
+	do(t, mux, "POST", "/api/upload/"+u.ID+"/complete", "")
+	pending := initUpload(t, mux, `{"name":"pending.bin"}`)
+	do(t, mux, "PUT", "/api/upload/"+pending.ID+"?offset=0", strings.Repeat("p", 700))
+	do(t, mux, "DELETE", "/api/delete?path=/docs/a.txt", "")
+
+	tracked := breakdownOf(t, mux)
+	walked, err := c.walkUsage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Upload metadata files are only picked up by the walk; allow for them.
+	const tolerance = 2048
+	for cat, got := range map[string]int64{
+		catLive: tracked.LiveBytes, catTrash: tracked.TrashBytes,
+		catCache: tracked.CacheBytes, catInternal: tracked.InternalBytes,
+	} {
+		if diff := walked[cat] - got; diff < 0 || diff > tolerance {
+			t.Errorf("%s: tracked %d, walked %d", cat, got, walked[cat])
+		}
+	}
+	if tracked.LiveBytes != 4000 {
+		t.Errorf("live = %d, want 4000", tracked.LiveBytes)
+	}
+	if sum := tracked.LiveBytes + tracked.TrashBytes + tracked.CacheBytes + tracked.InternalBytes; sum != tracked.UsedBytes {
+		t.Errorf("categories sum to %d, used is %d", sum, tracked.UsedBytes)
+	}
+	if fs := sizeOf(c.DataDir); fs-tracked.UsedBytes < 0 || fs-tracked.UsedBytes > tolerance {
+		t.Errorf("used %d, filesystem %d", tracked.UsedBytes, fs)
+	}
+}
+
+func TestEmptyTrash_OlderThanDays(t *testing.T) {
+	c, mux := newUploadMux(t)
+	writeFiles(t, c.DataDir, map[string]string{
+		".trash/old.txt":   strings.Repeat("o", 100),
+		".trash/fresh.txt": strings.Repeat("f", 10),
+	})
+	old := time.Now().AddDate(0, 0, -40)
+	os.Chtimes(filepath.Join(c.DataDir, ".trash", "old.txt"), old, old)
+	breakdownOf(t, mux)
+
+	w := do(t, mux, "POST", "/api/trash/empty", `{"older_than_days":30}`)
+	var res purgeResult
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("empty: %d %s", w.Code, w.Body)
+	}
+	if res.ReclaimedBytes != 100 || res.RemovedItems != 1 || res.Storage.TrashBytes != 10 {
+		t.Errorf("result = %+v", res)
+	}
+
+	w = do(t, mux, "POST", "/api/trash/empty", "")
+	json.Unmarshal(w.Body.Bytes(), &res)
+	if res.ReclaimedBytes != 10 || res.Storage.TrashBytes != 0 {
+		t.Errorf("empty all = %+v", res)
+	}
+	if w := do(t, mux, "POST", "/api/trash/empty", `{"older_than_days":-1}`); w.Code != http.StatusBadRequest {
+		t.Errorf("negative days: got %d", w.Code)
+	}
+}
+
+func TestClearCache(t *testing.T) {
+	c, mux := newUploadMux(t)
+	writeFiles(t, c.DataDir, map[string]string{".thumbs/a.jpg": "aaaa", ".thumbs/b.jpg": "bb"})
+
+	w := do(t, mux, "POST", "/api/storage/clear-cache", "")
+	var res purgeResult
+	json.Unmarshal(w.Body.Bytes(), &res)
+	if res.ReclaimedBytes != 6 || res.RemovedItems != 2 || res.Storage.CacheBytes != 0 {
+		t.Errorf("result = %+v", res)
+	}
+}
+
+func TestReservedDirsAreHidden(t *testing.T) {
+	c, mux := newUploadMux(t)
+	writeFiles(t, c.DataDir, map[string]string{".trash/x.txt": "x", ".thumbs/y.jpg": "y", "z.txt": "z"})
+
+	list := do(t, mux, "GET", "/api/files?path=/", "").Body.String()
+	if strings.Contains(list, ".trash") || strings.Contains(list, ".thumbs") || !strings.Contains(list, "z.txt") {
+		t.Errorf("listing = %s", list)
+	}
+	for _, target := range []string{"/api/files?path=/.trash", "/api/delete?path=/.thumbs"} {
+		method := "GET"
+		if strings.Contains(target, "delete") {
+			method = "DELETE"
+		}
+		if w := do(t, mux, method, target, ""); w.Code != http.StatusForbidden {
+			t.Errorf("%s %s: got %d, want 403", method, target, w.Code)
+		}
+	}
+}
+
+func TestAgentStateIsHidden(t *testing.T) {
+	c, mux := newUploadMux(t)
+	writeFiles(t, c.DataDir, map[string]string{
+		"wifi-config.json":      `{"password":"hunter22"}`,
+		"audit-security.jsonl":  "{}",
+		".router.json.tmp-123":  "{}",
+		"z.txt":                 "z",
+		"docs/wifi-config.json": "mine", // only the top level is the agent's
+	})
+
+	list := do(t, mux, "GET", "/api/files?path=/", "").Body.String()
+	if strings.Contains(list, "wifi-config") || strings.Contains(list, "audit") || strings.Contains(list, "router") || !strings.Contains(list, "z.txt") {
+		t.Errorf("listing = %s", list)
+	}
+	for target, want := range map[string]int{
+		"/files/wifi-config.json":               http.StatusNotFound,
+		"/api/download?paths=/wifi-config.json": http.StatusForbidden,
+		"/files/docs/wifi-config.json":          http.StatusOK,
+	} {
+		if w := do(t, mux, "GET", target, ""); w.Code != want || strings.Contains(w.Body.String(), "hunter22") {
+			t.Errorf("GET %s: %d %s, want %d", target, w.Code, w.Body, want)
+		}
+	}
+	for _, target := range []string{"/api/delete?path=/audit-security.jsonl", "/api/delete?path=/wifi-config.json"} {
+		if w := do(t, mux, "DELETE", target, ""); w.Code != http.StatusForbidden {
+			t.Errorf("DELETE %s: got %d, want 403", target, w.Code)
+		}
+	}
+	if w := do(t, mux, "POST", "/api/move", `{"from":"/z.txt","to":"/wifi-config.json"}`); w.Code == http.StatusOK {
+		t.Error("moved a file over the wifi config")
+	}
+	if got := readFile(t, filepath.Join(c.DataDir, "wifi-config.json")); !strings.Contains(got, "hunter22") {
+		t.Errorf("wifi config now %q", got)
+	}
+}
+
+func statusOf(t testing.TB, mux http.Handler) StatusResponse {
+	t.Helper()
+	w := do(t, httputil.Versioned(mux), "GET", "/api/v1/status", "")
+	var st StatusResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &st); err != nil {
+		t.Fatalf("decode %s: %v", w.Body, err)
+	}
+	return st
+}
+
+func TestStatus_ServesCachedUsage(t *testing.T) {
+	c, mux := newUploadMux(t)
+	writeFiles(t, c.DataDir, map[string]string{"a.txt": strings.Repeat("a", 100)})
+	first := statusOf(t, mux) // first read walks
+	if first.Used != 100 || first.ComputedAt.IsZero() {
+		t.Fatalf("first status = %+v", first)
+	}
+
+	// A write outside the API waits for the next walk; one through it
+	// counts at once. So does the upload's activity entry: have it on
+	// disk before looking.
+	writeFiles(t, c.DataDir, map[string]string{"b.txt": strings.Repeat("b", 50)})
+	multipartUpload(t, mux, "/", "c.txt", strings.Repeat("c", 10))
+	c.flushActivity()
+	activity := uint64(sizeOf(c.activityDir()))
+	if st := statusOf(t, mux); st.Used != 110+activity || !st.ComputedAt.Equal(first.ComputedAt) {
+		t.Errorf("cached status = %+v, want used %d as of %v", st, 110+activity, first.ComputedAt)
+	}
+
+	// Past the TTL the stale figures are served and a walk is started.
+	c.storage.mu.Lock()
+	c.storage.reconciledAt = time.Now().Add(-2 * statusUsageTTL)
+	c.storage.mu.Unlock()
+	if st := statusOf(t, mux); st.Used != 110+activity {
+		t.Errorf("stale status = %+v, want used %d", st, 110+activity)
+	}
+	<-c.refreshUsage()
+	want := 160 + activity + uint64(sizeOf(filepath.Join(c.DataDir, checksumsDirName)))
+	if st := statusOf(t, mux); st.Used != want || !st.ComputedAt.After(first.ComputedAt) {
+		t.Errorf("status after the walk = %+v, want used %d", st, want)
+	}
+}
+
+// BenchmarkStatus_WarmCache serves /api/status over 10,000 files with the
+// counters already filled: no walk, only a statfs.
+func BenchmarkStatus_WarmCache(b *testing.B) {
+	c, mux := newUploadMux(b)
+	for d := range 100 {
+		dir := filepath.Join(c.DataDir, "photos", strconv.Itoa(d))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			b.Fatal(err)
+		}
+		for f := range 100 {
+			if err := os.WriteFile(filepath.Join(dir, strconv.Itoa(f)+".jpg"), []byte("jpeg"), 0644); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	if st := statusOf(b, mux); st.Used != 40000 {
+		b.Fatalf("warm-up status = %+v", st)
+	}
+
+	for b.Loop() {
+		if w := do(b, mux, "GET", "/api/status", ""); w.Code != http.StatusOK {
+			b.Fatalf("status: %d", w.Code)
+		}
+	}
+}
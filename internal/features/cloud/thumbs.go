@@ -0,0 +1,354 @@
+package cloud
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/httputil"
+)
+
+// Thumbnails. GET /api/thumb?path=/photos/img.jpg&size=256 returns a JPEG
+// that fits in a size×size box, built from the original the first time and
+// served from DataDir/.thumbs after that.
+//
+// The cache key covers the file's path, size and modification time, so an
+// edited photo gets a new thumbnail rather than a stale one. Clients should
+// pass the listing's modified_at as &v= so the long browser cache turns
+// over too; the server ignores it. Thumbnails of deleted files are dropped
+// with them, and the oldest go when the cache passes ThumbCacheCap.
+//
+// Thumbnails are made on the background queue as interactive jobs, so
+// they go ahead of hashing and indexing, and a grid asking for the same
+// thumbnail twice decodes it once. On the system disk none are made while
+// it is down to its reserve; see quota.go.
+const (
+	defaultThumbSize     = 256
+	defaultThumbCacheCap = 256 << 20
+	thumbQuality         = 80
+	thumbCacheControl    = "private, max-age=31536000"
+	// maxThumbPixels keeps a crafted or panoramic image from taking the
+	// Orange Pi's memory: decoding allocates about 4 bytes per pixel.
+	maxThumbPixels = 64 << 20
+)
+
+// thumbSizes are the sizes generated. A request is rounded up to the next
+// one so a client can't fill the cache with every size from 1 to 1024.
+var thumbSizes = []int{64, 128, 256, 512, 1024}
+
+// thumbExts are the extensions a thumbnail may exist for; used to find
+// them when a folder is deleted. Whether a file is an image is decided by
+// its content.
+var thumbExts = map[string]bool{".jpg": true, ".jpeg": true, ".png": true, ".gif": true}
+
+var (
+	errNotImage  = errors.New("not a JPEG, PNG or GIF image")
+	errBadImage  = errors.New("image could not be decoded")
+	errHugeImage = errors.New("image too large to thumbnail")
+)
+
+func (s *Cloud) thumbsDir() string {
+	return filepath.Join(s.DataDir, thumbsDirName)
+}
+
+// thumbSize rounds a requested size up to one of thumbSizes.
+func thumbSize(req int) int {
+	for _, n := range thumbSizes {
+		if req <= n {
+			return n
+		}
+	}
+	return thumbSizes[len(thumbSizes)-1]
+}
+
+// thumbPath is where the thumbnail of full at size is cached.
+func (s *Cloud) thumbPath(full string, size int, info fs.FileInfo) string {
+	rel, _ := filepath.Rel(s.DataDir, full)
+	key := fmt.Sprintf("%s\x00%d\x00%d\x00%d", filepath.ToSlash(rel), size, info.Size(), info.ModTime().UnixNano())
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(s.thumbsDir(), hex.EncodeToString(sum[:16])+".jpg")
+}
+
+func (s *Cloud) handleThumb(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	size := defaultThumbSize
+	if v := q.Get("size"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > thumbSizes[len(thumbSizes)-1] {
+			httputil.BadRequest(w, fmt.Sprintf("size must be between 1 and %d", thumbSizes[len(thumbSizes)-1]))
+			return
+		}
+		size = n
+	}
+	size = thumbSize(size)
+
+	full, err := s.userPath(q.Get("path"))
+	if err != nil {
+		httputil.Forbidden(w)
+		return
+	}
+	info, err := os.Lstat(full)
+	if err != nil || !info.Mode().IsRegular() {
+		httputil.Error(w, http.StatusNotFound, "no file at "+q.Get("path"))
+		return
+	}
+
+	cached := s.thumbPath(full, size, info)
+	if _, err := os.Stat(cached); err != nil {
+		_, err := s.background().do(r.Context(), jobThumb, cached, prioInteractive, func(ctx context.Context) (any, error) {
+			return nil, s.makeThumb(ctx, full, cached, size)
+		})
+		if err != nil {
+			switch {
+			case r.Context().Err() != nil:
+				// The client went away; so did the job if nobody else
+				// wanted it.
+			case errors.Is(err, errQueueFull):
+				w.Header().Set("Retry-After", "5")
+				httputil.Error(w, http.StatusServiceUnavailable, err.Error())
+			case errors.Is(err, errNotImage):
+				httputil.Error(w, http.StatusUnsupportedMediaType, err.Error())
+			case errors.Is(err, errBadImage), errors.Is(err, errHugeImage):
+				httputil.Error(w, http.StatusUnprocessableEntity, err.Error())
+			case errors.Is(err, errSystemReserve):
+				q, _ := s.quota()
+				body := reserveBody(q)
+				body["error"], body["code"] = err.Error(), codeSystemReserve
+				httputil.JSON(w, http.StatusInsufficientStorage, body)
+			default:
+				slog.Error("cloud: thumbnail failed", "path", full, "err", err)
+				httputil.InternalError(w, "could not create thumbnail")
+			}
+			return
+		}
+	}
+	f, err := os.Open(cached)
+	if err != nil {
+		httputil.InternalError(w, "could not read thumbnail") // pruned in between
+		return
+	}
+	defer f.Close()
+	now := time.Now()
+	os.Chtimes(cached, now, now) //nolint:errcheck // recently used, pruned last
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", thumbCacheControl)
+	w.Header().Set("ETag", `"`+strings.TrimSuffix(filepath.Base(cached), ".jpg")+`"`)
+	http.ServeContent(w, r, "", info.ModTime(), f)
+}
+
+// makeThumb decodes src, scales it to fit size×size and writes it to dst
+// as a JPEG.
+func (s *Cloud) makeThumb(ctx context.Context, src, dst string, size int) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+	var decodeConfig func(io.Reader) (image.Config, error)
+	var decode func(io.Reader) (image.Image, error)
+	switch http.DetectContentType(head[:n]) {
+	case "image/jpeg":
+		decodeConfig, decode = jpeg.DecodeConfig, jpeg.Decode
+	case "image/png":
+		decodeConfig, decode = png.DecodeConfig, png.Decode
+	case "image/gif":
+		decodeConfig, decode = gif.DecodeConfig, gif.Decode // first frame
+	default:
+		return errNotImage
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	cfg, err := decodeConfig(f)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errBadImage, err)
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 {
+		return errBadImage
+	}
+	if cfg.Width*cfg.Height > maxThumbPixels {
+		return errHugeImage
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err // nobody is waiting for it any more
+	}
+
+	img, err := decode(f)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errBadImage, err)
+	}
+	thumb := downsample(img, size)
+
+	if _, err := s.systemRoom(); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.thumbsDir(), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(s.thumbsDir(), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) //nolint:errcheck — no-op after the rename
+	if err := jpeg.Encode(tmp, thumb, &jpeg.Options{Quality: thumbQuality}); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		return err
+	}
+	s.trackSize(dst, sizeOf(dst))
+	s.capThumbs()
+	return nil
+}
+
+// downsample scales img to fit in a size×size box, averaging every source
+// pixel into the one it lands on, and flattens transparency onto white.
+// Images already small enough keep their size.
+func downsample(img image.Image, size int) *image.RGBA {
+	b := img.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	dw, dh := sw, sh
+	if sw > size || sh > size {
+		if sw >= sh {
+			dw, dh = size, max(1, sh*size/sw)
+		} else {
+			dw, dh = max(1, sw*size/sh), size
+		}
+	}
+
+	// Per destination pixel: summed r, g, b and the source pixel count.
+	sum := make([]uint64, dw*dh*4)
+	cols := make([]int, sw)
+	for x := range cols {
+		cols[x] = x * dw / sw
+	}
+	ycc, _ := img.(*image.YCbCr)
+	for y := 0; y < sh; y++ {
+		row := (y * dh / sh) * dw
+		for x := 0; x < sw; x++ {
+			var r, g, bl uint32
+			if ycc != nil {
+				yi, ci := ycc.YOffset(b.Min.X+x, b.Min.Y+y), ycc.COffset(b.Min.X+x, b.Min.Y+y)
+				r8, g8, b8 := color.YCbCrToRGB(ycc.Y[yi], ycc.Cb[ci], ycc.Cr[ci])
+				r, g, bl = uint32(r8)*0x101, uint32(g8)*0x101, uint32(b8)*0x101
+			} else {
+				var a uint32
+				r, g, bl, a = img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+				r, g, bl = r+0xffff-a, g+0xffff-a, bl+0xffff-a // premultiplied, over white
+			}
+			i := (row + cols[x]) * 4
+			sum[i] += uint64(r)
+			sum[i+1] += uint64(g)
+			sum[i+2] += uint64(bl)
+			sum[i+3]++
+		}
+	}
+
+	out := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for i := 0; i < dw*dh; i++ {
+		n := sum[i*4+3]
+		if n == 0 {
+			n = 1
+		}
+		out.Pix[i*4] = uint8(sum[i*4] / n >> 8)
+		out.Pix[i*4+1] = uint8(sum[i*4+1] / n >> 8)
+		out.Pix[i*4+2] = uint8(sum[i*4+2] / n >> 8)
+		out.Pix[i*4+3] = 0xff
+	}
+	return out
+}
+
+// dropThumbs removes the cached thumbnails of full, a file or a folder
+// that is about to be deleted.
+func (s *Cloud) dropThumbs(full string) {
+	if _, err := os.Stat(s.thumbsDir()); err != nil {
+		return
+	}
+	filepath.WalkDir(full, func(p string, d fs.DirEntry, err error) error { //nolint:errcheck
+		if err != nil || !d.Type().IsRegular() || !thumbExts[strings.ToLower(filepath.Ext(p))] {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		for _, size := range thumbSizes {
+			t := s.thumbPath(p, size, info)
+			n := sizeOf(t)
+			if os.Remove(t) == nil {
+				s.trackSize(t, -n)
+			}
+		}
+		return nil
+	})
+}
+
+// capThumbs removes the least recently served thumbnails once the cache
+// passes ThumbCacheCap, down to three quarters of it.
+func (s *Cloud) capThumbs() {
+	if s.ThumbCacheCap <= 0 || s.storage.breakdown().CacheBytes <= s.ThumbCacheCap {
+		return
+	}
+	entries, err := os.ReadDir(s.thumbsDir())
+	if err != nil {
+		return
+	}
+	type thumb struct {
+		path string
+		size int64
+		used time.Time
+	}
+	var thumbs []thumb
+	var total int64
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		thumbs = append(thumbs, thumb{filepath.Join(s.thumbsDir(), e.Name()), info.Size(), info.ModTime()})
+		total += info.Size()
+	}
+	sort.Slice(thumbs, func(i, j int) bool { return thumbs[i].used.Before(thumbs[j].used) })
+
+	target, removed := s.ThumbCacheCap*3/4, 0
+	for _, t := range thumbs {
+		if total <= target {
+			break
+		}
+		if os.Remove(t.path) == nil {
+			s.trackSize(t.path, -t.size)
+			total -= t.size
+			removed++
+		}
+	}
+	slog.Info("cloud: thumbnail cache pruned", "removed", removed, "bytes", total)
+}
@@ -0,0 +1,195 @@
+package cloud
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func solidImage(w, h int, c color.Color) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+func encodeImage(t *testing.T, format string, img image.Image) string {
+	t.Helper()
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case "jpeg":
+		err = jpeg.Encode(&buf, img, nil)
+	case "png":
+		err = png.Encode(&buf, img)
+	case "gif":
+		err = gif.Encode(&buf, img, nil)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func thumbOf(t *testing.T, mux http.Handler, query string) (*httptest.ResponseRecorder, image.Image) {
+	t.Helper()
+	w := do(t, mux, "GET", "/api/thumb?"+query, "")
+	if w.Code != http.StatusOK {
+		return w, nil
+	}
+	img, err := jpeg.Decode(bytes.NewReader(w.Body.Bytes()))
+	if err != nil {
+		t.Fatalf("%s: not a JPEG: %v", query, err)
+	}
+	return w, img
+}
+
+func cachedThumbs(t *testing.T, c *Cloud) int {
+	t.Helper()
+	entries, _ := os.ReadDir(c.thumbsDir())
+	return len(entries)
+}
+
+func TestThumb_ScalesAndCaches(t *testing.T) {
+	c, mux := newUploadMux(t)
+	red := color.NRGBA{R: 255, A: 255}
+	writeFiles(t, c.DataDir, map[string]string{
+		"photos/wide.jpg": encodeImage(t, "jpeg", solidImage(400, 200, red)),
+		"photos/tall.png": encodeImage(t, "png", solidImage(50, 300, color.NRGBA{})), // transparent
+		"photos/anim.gif": encodeImage(t, "gif", solidImage(20, 10, red)),
+	})
+
+	for _, tc := range []struct {
+		query string
+		w, h  int
+		want  color.RGBA
+	}{
+		{"path=/photos/wide.jpg&size=100", 128, 64, color.RGBA{255, 0, 0, 255}},
+		{"path=/photos/wide.jpg", 256, 128, color.RGBA{255, 0, 0, 255}},
+		{"path=/photos/tall.png&size=64", 10, 64, color.RGBA{255, 255, 255, 255}},
+		{"path=/photos/anim.gif&size=1024", 20, 10, color.RGBA{255, 0, 0, 255}}, // never enlarged
+	} {
+		w, img := thumbOf(t, mux, tc.query)
+		if img == nil {
+			t.Errorf("%s: %d %s", tc.query, w.Code, w.Body)
+			continue
+		}
+		if b := img.Bounds(); b.Dx() != tc.w || b.Dy() != tc.h {
+			t.Errorf("%s: %dx%d, want %dx%d", tc.query, b.Dx(), b.Dy(), tc.w, tc.h)
+		}
+		r, g, b, _ := img.At(img.Bounds().Dx()/2, img.Bounds().Dy()/2).RGBA()
+		if diff(r>>8, uint32(tc.want.R)) > 24 || diff(g>>8, uint32(tc.want.G)) > 24 || diff(b>>8, uint32(tc.want.B)) > 24 {
+			t.Errorf("%s: centre pixel %d,%d,%d, want %v", tc.query, r>>8, g>>8, b>>8, tc.want)
+		}
+		if w.Header().Get("Cache-Control") != thumbCacheControl || w.Header().Get("ETag") == "" {
+			t.Errorf("%s: headers %v", tc.query, w.Header())
+		}
+	}
+	if n := cachedThumbs(t, c); n != 4 {
+		t.Fatalf("cached %d thumbnails, want 4", n)
+	}
+
+	// Served from the cache, and revalidated by ETag.
+	w, _ := thumbOf(t, mux, "path=/photos/wide.jpg&size=90")
+	if n := cachedThumbs(t, c); n != 4 {
+		t.Errorf("cache grew to %d on a repeat request", n)
+	}
+	r := httptest.NewRequest("GET", "/api/thumb?path=/photos/wide.jpg&size=128", nil)
+	r.Header.Set("If-None-Match", w.Header().Get("ETag"))
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, r)
+	if rec.Code != http.StatusNotModified {
+		t.Errorf("revalidation: %d, want 304", rec.Code)
+	}
+	if b := breakdownOf(t, mux); b.CacheBytes == 0 {
+		t.Errorf("thumbnails not counted as cache: %+v", b)
+	}
+
+	// Deleting the folder drops its thumbnails.
+	do(t, mux, "DELETE", "/api/delete?path=/photos", "")
+	if n := cachedThumbs(t, c); n != 0 {
+		t.Errorf("%d thumbnails left after delete", n)
+	}
+}
+
+func diff(a, b uint32) uint32 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
+
+func TestThumb_Errors(t *testing.T) {
+	c, mux := newUploadMux(t)
+	good := encodeImage(t, "jpeg", solidImage(64, 64, color.White))
+	writeFiles(t, c.DataDir, map[string]string{
+		"notes.txt":    "just text",
+		"broken.jpg":   good[:len(good)/3],
+		"fake.png":     "\x89PNG\r\n\x1a\ngarbage",
+		"docs/a.jpg":   good,
+		".trash/x.jpg": good,
+	})
+
+	for query, want := range map[string]int{
+		"path=/notes.txt":              http.StatusUnsupportedMediaType,
+		"path=/broken.jpg":             http.StatusUnprocessableEntity,
+		"path=/fake.png":               http.StatusUnprocessableEntity,
+		"path=/missing.jpg":            http.StatusNotFound,
+		"path=/docs":                   http.StatusNotFound,
+		"path=/.trash/x.jpg":           http.StatusForbidden,
+		"path=/docs/a.jpg&size=0":      http.StatusBadRequest,
+		"path=/docs/a.jpg&size=2048":   http.StatusBadRequest,
+		"path=/docs/a.jpg&size=medium": http.StatusBadRequest,
+	} {
+		if w := do(t, mux, "GET", "/api/thumb?"+query, ""); w.Code != want {
+			t.Errorf("%s: %d, want %d (%s)", query, w.Code, want, w.Body)
+		}
+	}
+	if n := cachedThumbs(t, c); n != 0 {
+		t.Errorf("failed requests cached %d files", n)
+	}
+}
+
+func TestThumb_CacheCap(t *testing.T) {
+	c, mux := newUploadMux(t)
+	files := map[string]string{}
+	for _, name := range []string{"a", "b", "c", "d"} {
+		files[name+".png"] = encodeImage(t, "png", solidImage(300, 300, color.NRGBA{B: 200, A: 255}))
+	}
+	writeFiles(t, c.DataDir, files)
+
+	thumbOf(t, mux, "path=/a.png")
+	one, _ := os.ReadDir(c.thumbsDir())
+	info, _ := one[0].Info()
+	c.ThumbCacheCap = info.Size() * 3
+
+	for _, name := range []string{"b", "c", "d"} {
+		thumbOf(t, mux, "path=/"+name+".png")
+	}
+	if n := cachedThumbs(t, c); n >= 4 || n == 0 {
+		t.Errorf("%d thumbnails cached with room for 3", n)
+	}
+	if _, err := os.Stat(c.thumbPath(filepath.Join(c.DataDir, "d.png"), defaultThumbSize, statOf(t, filepath.Join(c.DataDir, "d.png")))); err != nil {
+		t.Error("newest thumbnail pruned")
+	}
+}
+
+func statOf(t *testing.T, p string) os.FileInfo {
+	t.Helper()
+	info, err := os.Stat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
@@ -0,0 +1,306 @@
+package cloud
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/fsutil"
+	"github.com/strct-org/strct-agent/internal/httputil"
+)
+
+// Trash. DELETE /api/delete moves the item into DataDir/.trash rather
+// than removing it, next to a sidecar recording where it came from:
+//
+//	.trash/1768575845123456789-photo.jpg       the item, renamed
+//	.trash/1768575845123456789-photo.jpg.json  trashMeta
+//
+// GET /api/trash lists the items, POST /api/trash/restore puts one back and
+// DELETE /api/trash removes one for good. The hourly upkeep purges items
+// older than TrashRetention; POST /api/trash/empty purges on demand.
+const trashMetaExt = ".json"
+
+// trashMeta is the sidecar of a trashed item.
+type trashMeta struct {
+	OriginalPath string    `json:"original_path"` // from the DataDir root
+	DeletedAt    time.Time `json:"deleted_at"`
+}
+
+// TrashEntry is one item in GET /api/trash.
+type TrashEntry struct {
+	Path         string     `json:"path"` // "/.trash/<id>", for restore and delete
+	Name         string     `json:"name"` // the name it had before it was deleted
+	Type         string     `json:"type"` // file|folder
+	Size         int64      `json:"size"`
+	OriginalPath string     `json:"original_path"` // "": unknown, can't be restored
+	DeletedAt    time.Time  `json:"deleted_at"`
+	PurgeAt      *time.Time `json:"purge_at,omitempty"` // nil: kept until the trash is emptied
+}
+
+type TrashResponse struct {
+	Items      []TrashEntry `json:"items"`
+	TotalBytes int64        `json:"total_bytes"`
+}
+
+func (s *Cloud) trashDir() string {
+	return filepath.Join(s.DataDir, trashDirName)
+}
+
+// moveToTrash moves full, a path under DataDir, into the trash and returns
+// where it went.
+func (s *Cloud) moveToTrash(full string, now time.Time) (string, error) {
+	rel, err := filepath.Rel(s.DataDir, full)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(s.trashDir(), 0755); err != nil {
+		return "", err
+	}
+	item := filepath.Join(s.trashDir(), fmt.Sprintf("%d-%s", now.UnixNano(), filepath.Base(full)))
+	meta := trashMeta{OriginalPath: "/" + filepath.ToSlash(rel), DeletedAt: now.UTC()}
+	// The sidecar goes first: an item without one can't be restored.
+	if err := fsutil.WriteJSON(item+trashMetaExt, meta); err != nil {
+		return "", fmt.Errorf("write trash sidecar: %w", err)
+	}
+	if err := rename(full, item); err != nil {
+		os.Remove(item + trashMetaExt) //nolint:errcheck
+		return "", err
+	}
+	s.moveSums(full, item)
+	return item, nil
+}
+
+// readTrash lists the trash, newest first. Items without a sidecar are
+// listed with their modification time as the deletion time. strays are
+// sidecars whose item is gone.
+func (s *Cloud) readTrash() (items []TrashEntry, strays []string) {
+	entries, err := os.ReadDir(s.trashDir())
+	if err != nil {
+		return nil, nil
+	}
+	names := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		names[e.Name()] = true
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if item, ok := strings.CutSuffix(name, trashMetaExt); ok && !names[name+trashMetaExt] {
+			if names[item] {
+				continue // a sidecar, read with its item
+			}
+			if _, err := s.loadTrashMeta(name); err == nil {
+				strays = append(strays, name)
+				continue
+			}
+			// A user's .json file that lost its own sidecar.
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		full := filepath.Join(s.trashDir(), name)
+		entry := TrashEntry{
+			Path:      "/" + trashDirName + "/" + name,
+			Name:      trashedName(name),
+			Type:      "file",
+			Size:      sizeOf(full),
+			DeletedAt: info.ModTime().UTC(),
+		}
+		if e.IsDir() {
+			entry.Type = "folder"
+		}
+		if meta, err := s.loadTrashMeta(name + trashMetaExt); err == nil {
+			entry.OriginalPath, entry.DeletedAt = meta.OriginalPath, meta.DeletedAt
+		}
+		if s.TrashRetention > 0 {
+			purgeAt := entry.DeletedAt.Add(s.TrashRetention)
+			entry.PurgeAt = &purgeAt
+		}
+		items = append(items, entry)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].DeletedAt.After(items[j].DeletedAt) })
+	return items, strays
+}
+
+func (s *Cloud) loadTrashMeta(name string) (trashMeta, error) {
+	var meta trashMeta
+	err := fsutil.ReadJSON(filepath.Join(s.trashDir(), name), &meta)
+	if err == nil && meta.OriginalPath == "" {
+		err = errors.New("no original_path")
+	}
+	return meta, err
+}
+
+// trashedName strips the "<timestamp>-" prefix moveToTrash adds.
+func trashedName(id string) string {
+	if ts, name, ok := strings.Cut(id, "-"); ok && ts != "" && strings.Trim(ts, "0123456789") == "" {
+		return name
+	}
+	return id
+}
+
+// trashItem resolves "/.trash/<id>" to the item's full path.
+func (s *Cloud) trashItem(p string) (string, bool) {
+	id, ok := strings.CutPrefix(path.Clean("/"+p), "/"+trashDirName+"/")
+	if !ok || id == "" || strings.Contains(id, "/") {
+		return "", false
+	}
+	full := filepath.Join(s.trashDir(), id)
+	if item, ok := strings.CutSuffix(full, trashMetaExt); ok {
+		if _, err := os.Lstat(item); err == nil {
+			return "", false // the sidecar of item
+		}
+	}
+	return full, true
+}
+
+// removeTrashItem deletes an item and its sidecar, returning the bytes
+// freed.
+func (s *Cloud) removeTrashItem(full string) (int64, error) {
+	size := sizeOf(full) + sizeOf(full+trashMetaExt)
+	if err := os.RemoveAll(full); err != nil {
+		s.trackSize(full, sizeOf(full)+sizeOf(full+trashMetaExt)-size)
+		return 0, err
+	}
+	os.Remove(full + trashMetaExt) //nolint:errcheck
+	s.trackSize(full, -size)
+	s.dropSums(full)
+	return size, nil
+}
+
+// purgeTrash removes the items deleted before cutoff (all of them for a
+// zero cutoff), and sidecars left without an item.
+func (s *Cloud) purgeTrash(cutoff time.Time) (reclaimed int64, removed int) {
+	items, strays := s.readTrash()
+	for _, it := range items {
+		if !cutoff.IsZero() && !it.DeletedAt.Before(cutoff) {
+			continue
+		}
+		full, _ := s.trashItem(it.Path)
+		n, err := s.removeTrashItem(full)
+		if err != nil {
+			slog.Warn("cloud: purge failed", "path", full, "err", err)
+			continue
+		}
+		reclaimed += n
+		removed++
+	}
+	for _, name := range strays {
+		full := filepath.Join(s.trashDir(), name)
+		size := sizeOf(full)
+		if os.Remove(full) == nil {
+			s.trackSize(full, -size)
+			reclaimed += size
+		}
+	}
+	return reclaimed, removed
+}
+
+// expireTrash purges what has been in the trash longer than TrashRetention.
+func (s *Cloud) expireTrash(now time.Time) {
+	if s.TrashRetention <= 0 {
+		return
+	}
+	if reclaimed, removed := s.purgeTrash(now.Add(-s.TrashRetention)); removed > 0 {
+		slog.Info("cloud: purged expired trash", "items", removed, "bytes", reclaimed)
+	}
+}
+
+func (s *Cloud) handleListTrash(w http.ResponseWriter, r *http.Request) {
+	items, _ := s.readTrash()
+	resp := TrashResponse{Items: []TrashEntry{}}
+	for _, it := range items {
+		resp.Items = append(resp.Items, it)
+		resp.TotalBytes += it.Size
+	}
+	httputil.OK(w, resp)
+}
+
+// handleRestoreTrash moves an item back to where it was deleted from,
+// recreating missing parent folders.
+// POST body: {"path":"/.trash/1768575845123456789-photo.jpg"}
+func (s *Cloud) handleRestoreTrash(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Path string `json:"path"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httputil.BadRequest(w, "invalid JSON")
+		return
+	}
+	item, ok := s.trashItem(req.Path)
+	if !ok {
+		httputil.BadRequest(w, "path must be a trash item")
+		return
+	}
+	if _, err := os.Lstat(item); err != nil {
+		httputil.Error(w, http.StatusNotFound, "not in trash: "+req.Path)
+		return
+	}
+	meta, err := s.loadTrashMeta(filepath.Base(item) + trashMetaExt)
+	if err != nil {
+		httputil.Error(w, http.StatusConflict, "original location unknown; move it out of the trash instead")
+		return
+	}
+	dst, err := s.userPath(meta.OriginalPath)
+	if err != nil || dst == s.DataDir {
+		httputil.Forbidden(w)
+		return
+	}
+	if err := s.canChange(dst); err != nil {
+		pathError(w, err)
+		return
+	}
+	if _, err := os.Lstat(dst); err == nil {
+		httputil.Error(w, http.StatusConflict, "an item already exists at "+meta.OriginalPath)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		slog.Error("cloud: failed to recreate folder for restore", "path", dst, "err", err)
+		httputil.InternalError(w, "could not restore item")
+		return
+	}
+
+	size := sizeOf(item)
+	if err := rename(item, dst); err != nil {
+		slog.Error("cloud: failed to restore", "from", item, "to", dst, "err", err)
+		httputil.InternalError(w, "could not restore item")
+		return
+	}
+	metaSize := sizeOf(item + trashMetaExt)
+	os.Remove(item + trashMetaExt) //nolint:errcheck
+	s.trackSize(item, -size-metaSize)
+	s.trackSize(dst, size)
+	s.moveSums(item, dst)
+	s.index.invalidate()
+	s.logActivity(r, Activity{Op: opRestore, Path: s.apiPath(item), To: meta.OriginalPath, Size: size})
+	httputil.OK(w, map[string]string{"status": "restored", "path": meta.OriginalPath})
+}
+
+// handleDeleteTrash removes one trash item for good.
+// DELETE /api/trash?path=/.trash/1768575845123456789-photo.jpg
+func (s *Cloud) handleDeleteTrash(w http.ResponseWriter, r *http.Request) {
+	p := r.URL.Query().Get("path")
+	item, ok := s.trashItem(p)
+	if !ok {
+		httputil.BadRequest(w, "path must be a trash item")
+		return
+	}
+	if _, err := os.Lstat(item); err != nil {
+		httputil.Error(w, http.StatusNotFound, "not in trash: "+p)
+		return
+	}
+	if _, err := s.removeTrashItem(item); err != nil {
+		slog.Error("cloud: failed to delete from trash", "path", item, "err", err)
+		httputil.InternalError(w, "could not delete item")
+		return
+	}
+	httputil.NoContent(w)
+}
@@ -0,0 +1,165 @@
+package cloud
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func listTrash(t *testing.T, mux http.Handler) TrashResponse {
+	t.Helper()
+	w := do(t, mux, "GET", "/api/trash", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("trash: %d %s", w.Code, w.Body)
+	}
+	var resp TrashResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestDelete_MovesToTrashAndRestores(t *testing.T) {
+	c, mux := newUploadMux(t)
+	writeFiles(t, c.DataDir, map[string]string{
+		"photos/2024/beach.jpg": "sand",
+		"photos/2024/sea.jpg":   "water",
+	})
+
+	if w := do(t, mux, "DELETE", "/api/delete?path=/photos/2024/beach.jpg", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("delete file: %d %s", w.Code, w.Body)
+	}
+	if w := do(t, mux, "DELETE", "/api/delete?path=/photos", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("delete folder: %d %s", w.Code, w.Body)
+	}
+	if _, err := os.Stat(filepath.Join(c.DataDir, "photos")); !os.IsNotExist(err) {
+		t.Fatal("deleted folder still in place")
+	}
+
+	trash := listTrash(t, mux)
+	if len(trash.Items) != 2 || trash.TotalBytes != 9 {
+		t.Fatalf("trash = %+v", trash)
+	}
+	folder, file := trash.Items[0], trash.Items[1] // newest first
+	if folder.Name != "photos" || folder.Type != "folder" || folder.OriginalPath != "/photos" || folder.Size != 5 {
+		t.Errorf("folder entry = %+v", folder)
+	}
+	if file.Name != "beach.jpg" || file.Type != "file" || file.OriginalPath != "/photos/2024/beach.jpg" {
+		t.Errorf("file entry = %+v", file)
+	}
+	if file.PurgeAt == nil || !file.PurgeAt.Equal(file.DeletedAt.Add(c.TrashRetention)) {
+		t.Errorf("purge_at = %v, deleted_at %v", file.PurgeAt, file.DeletedAt)
+	}
+	if list := do(t, mux, "GET", "/api/files?path=/", "").Body.String(); strings.Contains(list, "photos") || strings.Contains(list, ".trash") {
+		t.Errorf("listing after delete = %s", list)
+	}
+
+	// The file's folder is gone with the folder delete; restore recreates it.
+	w := do(t, mux, "POST", "/api/trash/restore", `{"path":"`+file.Path+`"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("restore: %d %s", w.Code, w.Body)
+	}
+	if got := readFile(t, filepath.Join(c.DataDir, "photos/2024/beach.jpg")); got != "sand" {
+		t.Errorf("restored file = %q", got)
+	}
+	if w := do(t, mux, "POST", "/api/trash/restore", `{"path":"`+folder.Path+`"}`); w.Code != http.StatusConflict {
+		t.Errorf("restore onto the recreated folder: %d, want 409", w.Code)
+	}
+	if trash := listTrash(t, mux); len(trash.Items) != 1 || trash.Items[0].Path != folder.Path {
+		t.Errorf("trash after restore = %+v", trash.Items)
+	}
+}
+
+func TestDeleteTrash(t *testing.T) {
+	c, mux := newUploadMux(t)
+	writeFiles(t, c.DataDir, map[string]string{"a.txt": "aaa"})
+	do(t, mux, "DELETE", "/api/delete?path=/a.txt", "")
+	item := listTrash(t, mux).Items[0]
+
+	if w := do(t, mux, "DELETE", "/api/trash?path="+item.Path, ""); w.Code != http.StatusNoContent {
+		t.Fatalf("delete from trash: %d %s", w.Code, w.Body)
+	}
+	if entries, _ := os.ReadDir(c.trashDir()); len(entries) != 0 {
+		t.Errorf("left in trash: %v", entries)
+	}
+	if b := breakdownOf(t, mux); b.TrashBytes != 0 {
+		t.Errorf("trash bytes = %d", b.TrashBytes)
+	}
+}
+
+func TestTrash_Validation(t *testing.T) {
+	c, mux := newUploadMux(t)
+	writeFiles(t, c.DataDir, map[string]string{"a.txt": "aaa", ".trash/orphan.txt": "o"})
+	do(t, mux, "DELETE", "/api/delete?path=/a.txt", "")
+	sidecar := listTrash(t, mux).Items[0].Path + trashMetaExt
+
+	for _, tc := range []struct {
+		method, target, body string
+		want                 int
+	}{
+		{"DELETE", "/api/delete?path=/missing.txt", "", http.StatusNotFound},
+		{"DELETE", "/api/trash?path=/a.txt", "", http.StatusBadRequest},
+		{"DELETE", "/api/trash?path=/.trash/../a.txt", "", http.StatusBadRequest},
+		{"DELETE", "/api/trash?path=" + sidecar, "", http.StatusBadRequest},
+		{"DELETE", "/api/trash?path=/.trash/nope", "", http.StatusNotFound},
+		{"POST", "/api/trash/restore", `{"path":"/.trash/nope"}`, http.StatusNotFound},
+		{"POST", "/api/trash/restore", `{"path":"/.trash/orphan.txt"}`, http.StatusConflict},
+		{"POST", "/api/trash/restore", `{"path":"/docs"}`, http.StatusBadRequest},
+		{"POST", "/api/trash/restore", `not json`, http.StatusBadRequest},
+	} {
+		if w := do(t, mux, tc.method, tc.target, tc.body); w.Code != tc.want {
+			t.Errorf("%s %s %s: %d, want %d", tc.method, tc.target, tc.body, w.Code, tc.want)
+		}
+	}
+}
+
+func TestExpireTrash(t *testing.T) {
+	c, mux := newUploadMux(t)
+	writeFiles(t, c.DataDir, map[string]string{"old.txt": "old", "new.txt": "new"})
+	now := time.Now()
+	for name, at := range map[string]time.Time{"old.txt": now.AddDate(0, 0, -31), "new.txt": now.AddDate(0, 0, -1)} {
+		if _, err := c.moveToTrash(filepath.Join(c.DataDir, name), at); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A sidecar whose item is already gone.
+	writeFiles(t, c.DataDir, map[string]string{".trash/1-gone.txt.json": `{"original_path":"/gone.txt"}`})
+
+	c.expireTrash(now)
+	items := listTrash(t, mux).Items
+	if len(items) != 1 || items[0].Name != "new.txt" {
+		t.Errorf("after expiry = %+v", items)
+	}
+	if _, err := os.Stat(filepath.Join(c.trashDir(), "1-gone.txt.json")); !os.IsNotExist(err) {
+		t.Error("stray sidecar kept")
+	}
+
+	c.TrashRetention = 0
+	c.expireTrash(now.AddDate(1, 0, 0))
+	if items := listTrash(t, mux).Items; len(items) != 1 || items[0].PurgeAt != nil {
+		t.Errorf("retention 0 = %+v", items)
+	}
+}
+
+func TestStatus_ReportsTrashSeparately(t *testing.T) {
+	c, mux := newUploadMux(t)
+	writeFiles(t, c.DataDir, map[string]string{"keep.txt": "1234", "bin.txt": "123456"})
+	do(t, mux, "DELETE", "/api/delete?path=/bin.txt", "")
+	// The delete's activity entry is used space too: have it on disk
+	// before the first status walks DataDir.
+	c.flushActivity()
+	info, err := os.Stat(filepath.Join(c.activityDir(), activityFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var st StatusResponse
+	json.Unmarshal(do(t, mux, "GET", "/api/status", "").Body.Bytes(), &st)
+	if st.Used != 4+uint64(info.Size()) || st.Trash < 6 || st.Total < st.Used+st.Trash {
+		t.Errorf("status = %+v", st)
+	}
+}
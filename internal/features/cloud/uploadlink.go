@@ -0,0 +1,610 @@
+package cloud
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/errs"
+	"github.com/strct-org/strct-agent/internal/httputil"
+	"github.com/strct-org/strct-agent/internal/humanize"
+	"github.com/strct-org/strct-agent/internal/statefile"
+)
+
+// Upload links. The inverse of a share link: POST /api/share/upload-link
+// hands out a token for one folder, and whoever holds it can put files
+// there and do nothing else — no listing, no downloads, not even the
+// names of what is already in it:
+//
+//	POST   /api/share/upload-link               {"path":"/inbox/contractor","expires_in":"72h","max_bytes":1073741824,"max_files":20,"extensions":[".dwg",".pdf"]}
+//	GET    /api/share/upload-link               every link kept, newest first
+//	DELETE /api/share/upload-link/{id}          revoke
+//	GET    /api/share/upload-link/{id}/activity what came in through it
+//	GET    /u/{token}                           a small upload page
+//	POST   /u/{token}                           multipart, one or more "file" parts
+//
+// Uploads go through the same checks as /strct_agent/fs/upload: the
+// folder resolves under DataDir with userPath, names are sanitized, and the
+// upload reserve applies. A name that is taken is never overwritten: the
+// file is stored as "name (1).ext". The link's limits are checked as each
+// file streams in; the file that crosses one is removed and the request
+// ends there, keeping the files before it. One request per link at a time.
+//
+// Every file stored is recorded on the link with its size and the client
+// IP, and logged as an upload in the activity log. Links live in
+// DataDir/.shares/upload-links.json; expired and revoked ones are kept
+// uploadLinkKeep for their activity, then dropped by the hourly upkeep.
+const (
+	uploadLinksFile        = "upload-links.json"
+	uploadLinkIDBytes      = 8
+	defaultUploadLinkBytes = 1 << 30
+	defaultUploadLinkFiles = 20
+	maxUploadLinkFiles     = 1000
+	maxUploadLinkExts      = 32
+	uploadLinkKeep         = 30 * 24 * time.Hour
+	// uploadLinkOverhead is what a request may carry besides the files:
+	// multipart headers and boundaries.
+	uploadLinkOverhead = 1 << 20
+)
+
+// uploadLinksSchema versions upload-links.json.
+//
+//	v1: uploadLinkStore as-is
+var uploadLinksSchema = statefile.Schema{
+	Name:       "cloud-upload-links",
+	Migrations: []statefile.Migration{statefile.Stamp},
+}
+
+var (
+	errLinkFull = errors.New("upload link byte limit reached")
+	extPattern  = regexp.MustCompile(`^\.[a-z0-9]{1,16}$`)
+)
+
+// UploadLink is one upload link.
+type UploadLink struct {
+	ID         string     `json:"id"`
+	Token      string     `json:"token"`
+	Path       string     `json:"path"` // the target folder, from the DataDir root
+	URL        string     `json:"url"`  // "/u/<token>", on the agent or the tunnel host
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	MaxBytes   int64      `json:"max_bytes"`
+	MaxFiles   int        `json:"max_files"`
+	Extensions []string   `json:"extensions,omitempty"` // lower case, with the dot; empty: any
+	Bytes      int64      `json:"bytes"`                // received so far
+	Files      int        `json:"files"`
+	Active     bool       `json:"active"` // set in responses
+}
+
+// LinkUpload is one file received through an upload link.
+type LinkUpload struct {
+	Time   time.Time `json:"time"`
+	Name   string    `json:"name"` // as stored, after sanitizing and renaming
+	Path   string    `json:"path"` // from the DataDir root
+	Size   int64     `json:"size"`
+	Client string    `json:"client,omitempty"` // IP the upload came from
+}
+
+type uploadLinkRecord struct {
+	UploadLink
+	Uploads []LinkUpload `json:"uploads"`
+}
+
+// usable reports whether the link still takes files at now.
+func (l *UploadLink) usable(now time.Time) bool {
+	return l.RevokedAt == nil && now.Before(l.ExpiresAt) && l.Files < l.MaxFiles && l.Bytes < l.MaxBytes
+}
+
+// ended is when the link stopped working: revoked or expired. Zero while
+// it has not.
+func (l *UploadLink) ended(now time.Time) time.Time {
+	if l.RevokedAt != nil {
+		return *l.RevokedAt
+	}
+	if !now.Before(l.ExpiresAt) {
+		return l.ExpiresAt
+	}
+	return time.Time{}
+}
+
+// allows reports whether name has one of the link's extensions.
+func (l *UploadLink) allows(name string) bool {
+	return len(l.Extensions) == 0 || slices.Contains(l.Extensions, strings.ToLower(filepath.Ext(name)))
+}
+
+type uploadLinkStore struct {
+	Links []uploadLinkRecord `json:"links"`
+}
+
+func (s *Cloud) uploadLinksPath() string {
+	return filepath.Join(s.DataDir, sharesDirName, uploadLinksFile)
+}
+
+// updateUploadLinks is updateShares for upload-links.json, under the same
+// lock.
+func (s *Cloud) updateUploadLinks(fn func(st *uploadLinkStore) bool) error {
+	s.shareMu.Lock()
+	defer s.shareMu.Unlock()
+
+	var st uploadLinkStore
+	if err := statefile.Load(s.uploadLinksPath(), uploadLinksSchema, &st); err != nil && !statefile.Fresh(err) {
+		return fmt.Errorf("load upload links: %w", err)
+	}
+	if !fn(&st) {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(s.uploadLinksPath()), 0700); err != nil {
+		return err
+	}
+	if err := statefile.Save(s.uploadLinksPath(), uploadLinksSchema, st); err != nil {
+		return fmt.Errorf("save upload links: %w", err)
+	}
+	return nil
+}
+
+// uploadLinkByToken returns the link for token, if it still takes files.
+func (s *Cloud) uploadLinkByToken(token string, now time.Time) (UploadLink, bool, error) {
+	var link UploadLink
+	found := false
+	err := s.updateUploadLinks(func(st *uploadLinkStore) bool {
+		for _, rec := range st.Links {
+			if rec.Token == token && rec.usable(now) {
+				link, found = rec.UploadLink, true
+				break
+			}
+		}
+		return false
+	})
+	return link, found, err
+}
+
+// expireUploadLinks drops the links that ended more than uploadLinkKeep
+// ago.
+func (s *Cloud) expireUploadLinks(now time.Time) {
+	removed := 0
+	err := s.updateUploadLinks(func(st *uploadLinkStore) bool {
+		kept := st.Links[:0]
+		for _, rec := range st.Links {
+			if end := rec.ended(now); end.IsZero() || now.Sub(end) < uploadLinkKeep {
+				kept = append(kept, rec)
+			}
+		}
+		removed = len(st.Links) - len(kept)
+		st.Links = kept
+		return removed > 0
+	})
+	if err != nil {
+		slog.Warn("cloud: could not expire upload links", "err", err)
+	} else if removed > 0 {
+		slog.Info("cloud: expired upload links", "count", removed)
+	}
+}
+
+// normalizeExtensions lower-cases exts and adds the dots, adding the
+// ones it can't use to v.
+func normalizeExtensions(v *errs.Validation, exts []string) []string {
+	if len(exts) > maxUploadLinkExts {
+		v.Addf("extensions", errs.CodeOutOfRange, "at most %d extensions", maxUploadLinkExts)
+		return nil
+	}
+	var out []string
+	for i, e := range exts {
+		e = strings.ToLower(strings.TrimSpace(e))
+		if !strings.HasPrefix(e, ".") {
+			e = "." + e
+		}
+		if !extPattern.MatchString(e) {
+			v.Addf(fmt.Sprintf("extensions[%d]", i), errs.CodeInvalid, "invalid extension %q", e)
+			continue
+		}
+		if !slices.Contains(out, e) {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// handleCreateUploadLink creates a link to upload into one folder, which is
+// created if missing.
+// POST body: {"path":"/inbox/contractor","expires_in":"72h","max_bytes":1073741824,"max_files":20,"extensions":[".dwg",".pdf"]}
+func (s *Cloud) handleCreateUploadLink(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Path       string   `json:"path"`
+		ExpiresIn  string   `json:"expires_in"`
+		MaxBytes   int64    `json:"max_bytes"`
+		MaxFiles   int      `json:"max_files"`
+		Extensions []string `json:"extensions"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httputil.BadRequest(w, "invalid JSON")
+		return
+	}
+	var v errs.Validation
+	ttl := defaultShareTTL
+	if req.ExpiresIn != "" {
+		d, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil || d <= 0 || d > maxShareTTL {
+			v.Add("expires_in", errs.CodeOutOfRange, "expires_in must be a duration between 1s and 720h")
+		}
+		ttl = d
+	}
+	if req.MaxBytes == 0 {
+		req.MaxBytes = defaultUploadLinkBytes
+	}
+	if req.MaxBytes < 0 || req.MaxBytes > maxUploadSize {
+		v.Add("max_bytes", errs.CodeOutOfRange, "max_bytes must be between 1 and 50 GB")
+	}
+	if req.MaxFiles == 0 {
+		req.MaxFiles = defaultUploadLinkFiles
+	}
+	if req.MaxFiles < 0 || req.MaxFiles > maxUploadLinkFiles {
+		v.Addf("max_files", errs.CodeOutOfRange, "max_files must be between 1 and %d", maxUploadLinkFiles)
+	}
+	exts := normalizeExtensions(&v, req.Extensions)
+	if err := v.Err(); err != nil {
+		errs.HTTPResponse(w, err)
+		return
+	}
+	full, err := s.userPath(req.Path)
+	if err != nil || full == s.DataDir {
+		httputil.Forbidden(w)
+		return
+	}
+	if err := s.canWriteIn(full); err != nil {
+		pathError(w, err)
+		return
+	}
+	if info, err := os.Lstat(full); err == nil && !info.IsDir() {
+		httputil.Error(w, http.StatusConflict, req.Path+" is not a folder")
+		return
+	}
+	if err := os.MkdirAll(full, 0755); err != nil {
+		slog.Error("cloud: could not create upload link folder", "err", err)
+		httputil.InternalError(w, "could not create folder")
+		return
+	}
+	rel, _ := filepath.Rel(s.DataDir, full)
+
+	token, err := newShareToken()
+	if err != nil {
+		slog.Error("cloud: could not generate upload link token", "err", err)
+		httputil.InternalError(w, "could not create link")
+		return
+	}
+	id := make([]byte, uploadLinkIDBytes)
+	if _, err := rand.Read(id); err != nil {
+		slog.Error("cloud: could not generate upload link id", "err", err)
+		httputil.InternalError(w, "could not create link")
+		return
+	}
+	now := time.Now().UTC()
+	link := UploadLink{
+		ID:         hex.EncodeToString(id),
+		Token:      token,
+		Path:       "/" + filepath.ToSlash(rel),
+		URL:        "/u/" + token,
+		CreatedAt:  now,
+		ExpiresAt:  now.Add(ttl),
+		MaxBytes:   req.MaxBytes,
+		MaxFiles:   req.MaxFiles,
+		Extensions: exts,
+	}
+	err = s.updateUploadLinks(func(st *uploadLinkStore) bool {
+		st.Links = append(st.Links, uploadLinkRecord{UploadLink: link, Uploads: []LinkUpload{}})
+		return true
+	})
+	if err != nil {
+		slog.Error("cloud: could not save upload link", "err", err)
+		httputil.InternalError(w, "could not create link")
+		return
+	}
+	slog.Info("cloud: upload link created", "id", link.ID, "path", link.Path, "expires_at", link.ExpiresAt,
+		"max_bytes", link.MaxBytes, "max_files", link.MaxFiles)
+	s.logActivity(r, Activity{Op: opShare, Path: link.Path})
+	link.Active = true
+	httputil.JSON(w, http.StatusCreated, link)
+}
+
+// handleListUploadLinks lists the links kept, newest first: the ones in
+// use, and the ones that ended within uploadLinkKeep.
+func (s *Cloud) handleListUploadLinks(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	links := []UploadLink{}
+	err := s.updateUploadLinks(func(st *uploadLinkStore) bool {
+		for _, rec := range st.Links {
+			link := rec.UploadLink
+			link.Active = link.usable(now)
+			links = append(links, link)
+		}
+		return false
+	})
+	if err != nil {
+		slog.Error("cloud: could not read upload links", "err", err)
+		httputil.InternalError(w, "could not read links")
+		return
+	}
+	sort.Slice(links, func(i, j int) bool { return links[i].CreatedAt.After(links[j].CreatedAt) })
+	httputil.OK(w, links)
+}
+
+// handleRevokeUploadLink stops a link; what came through it stays
+// listed. DELETE /api/share/upload-link/{id}
+func (s *Cloud) handleRevokeUploadLink(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	now := time.Now().UTC()
+	found := false
+	var path string
+	err := s.updateUploadLinks(func(st *uploadLinkStore) bool {
+		for i := range st.Links {
+			if l := &st.Links[i]; l.ID == id && l.RevokedAt == nil {
+				l.RevokedAt = &now
+				found, path = true, l.Path
+				return true
+			}
+		}
+		return false
+	})
+	if err != nil {
+		slog.Error("cloud: could not revoke upload link", "err", err)
+		httputil.InternalError(w, "could not revoke link")
+		return
+	}
+	if !found {
+		httputil.Error(w, http.StatusNotFound, "no such link")
+		return
+	}
+	s.logActivity(r, Activity{Op: opUnshare, Path: path})
+	httputil.NoContent(w)
+}
+
+// handleUploadLinkActivity lists what came in through a link, oldest
+// first. GET /api/share/upload-link/{id}/activity
+func (s *Cloud) handleUploadLinkActivity(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	var rec *uploadLinkRecord
+	err := s.updateUploadLinks(func(st *uploadLinkStore) bool {
+		for i := range st.Links {
+			if st.Links[i].ID == id {
+				rec = &st.Links[i]
+				break
+			}
+		}
+		return false
+	})
+	if err != nil {
+		slog.Error("cloud: could not read upload links", "err", err)
+		httputil.InternalError(w, "could not read links")
+		return
+	}
+	if rec == nil {
+		httputil.Error(w, http.StatusNotFound, "no such link")
+		return
+	}
+	rec.Active = rec.usable(time.Now())
+	httputil.OK(w, rec)
+}
+
+//go:embed uploadlink.html
+var uploadPageHTML string
+
+var uploadPage = template.Must(template.New("upload").Parse(uploadPageHTML))
+
+// handleUploadPage serves the page behind an upload link. It names the
+// folder, not its path. GET /u/{token}
+func (s *Cloud) handleUploadPage(w http.ResponseWriter, r *http.Request) {
+	link, ok, err := s.uploadLinkByToken(r.PathValue("token"), time.Now())
+	if err != nil {
+		slog.Error("cloud: could not read upload links", "err", err)
+		http.Error(w, "link unavailable", http.StatusInternalServerError)
+		return
+	}
+	// Unknown, expired, revoked and used-up links look the same.
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	setLinkHeaders(w)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	uploadPage.Execute(w, map[string]any{ //nolint:errcheck
+		"Folder":     path.Base(link.Path),
+		"ExpiresAt":  link.ExpiresAt.Format("2 Jan 2006 15:04 MST"),
+		"FilesLeft":  link.MaxFiles - link.Files,
+		"BytesLeft":  humanize.Bytes(link.MaxBytes - link.Bytes),
+		"Extensions": strings.Join(link.Extensions, ","),
+	})
+}
+
+// setLinkHeaders keeps the token out of caches, search engines and the
+// Referer of anything the page loads.
+func setLinkHeaders(w http.ResponseWriter) {
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.Header().Set("X-Robots-Tag", "noindex")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+}
+
+// linkFile is a file stored through an upload link, as the uploader sees
+// it.
+type linkFile struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// linkUploadError ends a request to an upload link, after the files it
+// stored so far.
+func linkUploadError(w http.ResponseWriter, code int, msg string, stored []linkFile) {
+	httputil.JSON(w, code, map[string]any{"error": msg, "uploaded": stored})
+}
+
+// handleLinkUpload takes the files of a multipart POST to an upload link.
+// POST /u/{token}
+func (s *Cloud) handleLinkUpload(w http.ResponseWriter, r *http.Request) {
+	setLinkHeaders(w)
+	now := time.Now()
+	link, ok, err := s.uploadLinkByToken(r.PathValue("token"), now)
+	if err != nil {
+		slog.Error("cloud: could not read upload links", "err", err)
+		httputil.InternalError(w, "link unavailable")
+		return
+	}
+	if !ok {
+		httputil.Error(w, http.StatusNotFound, "this link is not valid any more")
+		return
+	}
+	if !s.claim("link:" + link.ID) {
+		httputil.Error(w, http.StatusConflict, "another upload through this link is in progress")
+		return
+	}
+	defer s.release("link:" + link.ID)
+	// Read again under the claim: a request that just finished may have
+	// used the link up.
+	if link, ok, err = s.uploadLinkByToken(link.Token, now); err != nil || !ok {
+		httputil.Error(w, http.StatusNotFound, "this link is not valid any more")
+		return
+	}
+	dir, err := s.userPath(link.Path)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if err := s.canWriteIn(dir); err != nil {
+		httputil.Forbidden(w)
+		return
+	}
+	if info, err := os.Lstat(dir); err != nil || !info.IsDir() {
+		httputil.Error(w, http.StatusNotFound, "the folder for this link is gone")
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, link.MaxBytes-link.Bytes+uploadLinkOverhead)
+	mr, err := r.MultipartReader()
+	if err != nil {
+		httputil.BadRequest(w, "could not parse multipart form")
+		return
+	}
+	stored := []linkFile{}
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			linkUploadError(w, http.StatusBadRequest, "upload interrupted", stored)
+			return
+		}
+		if p.FormName() != "file" || p.FileName() == "" {
+			p.Close()
+			continue
+		}
+		f, code, msg := s.storeLinkFile(r, &link, dir, p)
+		p.Close()
+		if code != 0 {
+			linkUploadError(w, code, msg, stored)
+			return
+		}
+		stored = append(stored, f)
+	}
+	if len(stored) == 0 {
+		httputil.BadRequest(w, "no files in the upload")
+		return
+	}
+	httputil.JSON(w, http.StatusCreated, map[string]any{"uploaded": stored})
+}
+
+// storeLinkFile writes one part into dir under link's limits, records it
+// and brings link up to date. A refused file gets the status and message
+// that end the request; a stored one 0.
+func (s *Cloud) storeLinkFile(r *http.Request, link *UploadLink, dir string, p *multipart.Part) (linkFile, int, string) {
+	switch {
+	case link.RevokedAt != nil || !time.Now().Before(link.ExpiresAt):
+		return linkFile{}, http.StatusNotFound, "this link is not valid any more"
+	case link.Files >= link.MaxFiles:
+		return linkFile{}, http.StatusForbidden, fmt.Sprintf("this link takes at most %d files", link.MaxFiles)
+	case link.Bytes >= link.MaxBytes:
+		return linkFile{}, http.StatusRequestEntityTooLarge, "this link has no room left"
+	}
+	name, err := sanitizeName(p.FileName())
+	if err != nil {
+		return linkFile{}, http.StatusBadRequest, err.Error()
+	}
+	if !link.allows(name) {
+		return linkFile{}, http.StatusUnsupportedMediaType,
+			fmt.Sprintf("%s: only %s files are accepted", name, strings.Join(link.Extensions, ", "))
+	}
+	room, _, limited := s.uploadRoom(0)
+	dst, storedName, _, err := s.createUpload(dir, name, conflictRename)
+	switch {
+	case errors.Is(err, errInvalidName):
+		return linkFile{}, http.StatusBadRequest, err.Error()
+	case errors.Is(err, errNameTaken):
+		return linkFile{}, http.StatusConflict, err.Error()
+	case err != nil:
+		slog.Error("cloud: failed to create destination file", "err", err)
+		return linkFile{}, http.StatusInternalServerError, "disk error"
+	}
+	target := dst.Name()
+
+	var src io.Reader = &reserveReader{r: p, left: link.MaxBytes - link.Bytes, err: errLinkFull}
+	if limited {
+		src = &reserveReader{r: src, left: room}
+	}
+	sum := sha256.New()
+	n, err := io.Copy(io.MultiWriter(usage.Writer(dst), sum), src)
+	dst.Close()
+	if err != nil {
+		// Nothing half-written stays behind.
+		os.Remove(target) //nolint:errcheck
+		s.index.invalidate()
+		var tooBig *http.MaxBytesError
+		switch {
+		case errors.Is(err, errLinkFull), errors.As(err, &tooBig):
+			return linkFile{}, http.StatusRequestEntityTooLarge,
+				fmt.Sprintf("%s: this link takes at most %s more", name, humanize.Bytes(link.MaxBytes-link.Bytes))
+		case errors.Is(err, errReserveReached):
+			return linkFile{}, http.StatusInsufficientStorage, "the device is out of space"
+		}
+		slog.Warn("cloud: upload through link failed", "id", link.ID, "err", err)
+		return linkFile{}, http.StatusBadRequest, "upload interrupted"
+	}
+	s.trackSize(target, n)
+	s.index.invalidate()
+	s.recordSum(target, hex.EncodeToString(sum.Sum(nil)))
+	s.logActivity(r, Activity{Op: opUpload, Path: s.apiPath(target), Size: n})
+
+	up := LinkUpload{Time: time.Now().UTC(), Name: storedName, Path: s.apiPath(target), Size: n, Client: clientIP(r)}
+	link.Files++
+	link.Bytes += n
+	err = s.updateUploadLinks(func(st *uploadLinkStore) bool {
+		for i := range st.Links {
+			if rec := &st.Links[i]; rec.ID == link.ID {
+				rec.Uploads = append(rec.Uploads, up)
+				rec.Files++
+				rec.Bytes += n
+				*link = rec.UploadLink
+				return true
+			}
+		}
+		return false
+	})
+	if err != nil {
+		slog.Error("cloud: could not record upload through link", "id", link.ID, "path", up.Path, "err", err)
+	}
+	return linkFile{Name: storedName, Size: n}, 0, ""
+}
@@ -0,0 +1,219 @@
+package cloud
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func createUploadLink(t *testing.T, mux http.Handler, body string) UploadLink {
+	t.Helper()
+	w := do(t, mux, "POST", "/api/share/upload-link", body)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("upload link: %d %s", w.Code, w.Body)
+	}
+	var l UploadLink
+	if err := json.Unmarshal(w.Body.Bytes(), &l); err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+// postToLink uploads files, name and body in turn, to url in one request.
+func postToLink(t *testing.T, mux http.Handler, url string, files ...string) *httptest.ResponseRecorder {
+	t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for i := 0; i+1 < len(files); i += 2 {
+		fw, _ := mw.CreateFormFile("file", files[i])
+		io.WriteString(fw, files[i+1])
+	}
+	mw.Close()
+	req := httptest.NewRequest("POST", url, &buf)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	return w
+}
+
+func linkActivity(t *testing.T, mux http.Handler, id string) uploadLinkRecord {
+	t.Helper()
+	w := do(t, mux, "GET", "/api/share/upload-link/"+id+"/activity", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("activity: %d %s", w.Code, w.Body)
+	}
+	var rec uploadLinkRecord
+	if err := json.Unmarshal(w.Body.Bytes(), &rec); err != nil {
+		t.Fatal(err)
+	}
+	return rec
+}
+
+func TestUploadLink_UploadsRecordedAndNeverOverwrite(t *testing.T) {
+	c, mux := newUploadMux(t)
+	writeFiles(t, c.DataDir, map[string]string{"inbox/contractor/plan.pdf": "mine", "private.txt": "secret"})
+
+	l := createUploadLink(t, mux, `{"path":"/inbox/contractor","expires_in":"72h"}`)
+	if len(l.Token) != 43 || l.URL != "/u/"+l.Token || l.Path != "/inbox/contractor" || !l.Active ||
+		l.MaxFiles != defaultUploadLinkFiles || l.MaxBytes != defaultUploadLinkBytes {
+		t.Fatalf("link = %+v", l)
+	}
+
+	w := do(t, mux, "GET", l.URL, "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "contractor") || strings.Contains(w.Body.String(), "/inbox") {
+		t.Fatalf("page: %d %s", w.Code, w.Body)
+	}
+	if w.Header().Get("Referrer-Policy") != "no-referrer" {
+		t.Errorf("page headers = %v", w.Header())
+	}
+
+	w = postToLink(t, mux, l.URL, "plan.pdf", "theirs", `..\..\notes.txt`, "hello")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("upload: %d %s", w.Code, w.Body)
+	}
+	dir := filepath.Join(c.DataDir, "inbox", "contractor")
+	for name, want := range map[string]string{"plan.pdf": "mine", "plan (1).pdf": "theirs", "notes.txt": "hello"} {
+		if got, err := os.ReadFile(filepath.Join(dir, name)); err != nil || string(got) != want {
+			t.Errorf("%s = %q, %v; want %q", name, got, err, want)
+		}
+	}
+
+	rec := linkActivity(t, mux, l.ID)
+	if rec.Files != 2 || rec.Bytes != 11 || len(rec.Uploads) != 2 {
+		t.Fatalf("activity = %+v", rec)
+	}
+	if u := rec.Uploads[0]; u.Name != "plan (1).pdf" || u.Path != "/inbox/contractor/plan (1).pdf" || u.Size != 6 || u.Client == "" {
+		t.Errorf("first upload = %+v", u)
+	}
+	if !strings.Contains(do(t, mux, "GET", "/api/activity?op=upload", "").Body.String(), "notes.txt") {
+		t.Error("upload missing from the activity log")
+	}
+
+	// The link reaches nothing else.
+	for _, target := range []string{"/u/" + l.Token + "/../private.txt", "/share/" + l.Token} {
+		if w := do(t, mux, "GET", target, ""); w.Code == http.StatusOK && strings.Contains(w.Body.String(), "secret") {
+			t.Errorf("%s served a file", target)
+		}
+	}
+}
+
+func TestUploadLink_Limits(t *testing.T) {
+	c, mux := newUploadMux(t)
+	l := createUploadLink(t, mux, `{"path":"/drop","max_files":2,"max_bytes":10,"extensions":["PDF","dwg"]}`)
+	if strings.Join(l.Extensions, ",") != ".pdf,.dwg" {
+		t.Errorf("extensions = %v", l.Extensions)
+	}
+
+	if w := postToLink(t, mux, l.URL, "setup.exe", "MZ"); w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("exe: %d %s", w.Code, w.Body)
+	}
+	// The file crossing the byte limit goes; the one before it stays.
+	w := postToLink(t, mux, l.URL, "a.pdf", "12345", "b.DWG", "678901")
+	if w.Code != http.StatusRequestEntityTooLarge || !strings.Contains(w.Body.String(), `"a.pdf"`) {
+		t.Fatalf("over the byte limit: %d %s", w.Code, w.Body)
+	}
+	if _, err := os.Stat(filepath.Join(c.DataDir, "drop", "b.DWG")); !os.IsNotExist(err) {
+		t.Errorf("partial file left behind: %v", err)
+	}
+	if w := postToLink(t, mux, l.URL, "b.dwg", "67890"); w.Code != http.StatusCreated {
+		t.Fatalf("second file: %d %s", w.Code, w.Body)
+	}
+	// Used up: the link is gone for the uploader, its activity isn't.
+	if w := postToLink(t, mux, l.URL, "c.pdf", "x"); w.Code != http.StatusNotFound {
+		t.Errorf("after the limit: %d", w.Code)
+	}
+	if w := do(t, mux, "GET", l.URL, ""); w.Code != http.StatusNotFound {
+		t.Errorf("page after the limit: %d", w.Code)
+	}
+	if rec := linkActivity(t, mux, l.ID); rec.Active || rec.Files != 2 || rec.Bytes != 10 {
+		t.Errorf("activity = %+v", rec)
+	}
+}
+
+func TestUploadLink_RevokeAndExpiry(t *testing.T) {
+	c, mux := newUploadMux(t)
+	a := createUploadLink(t, mux, `{"path":"/a","expires_in":"1h"}`)
+	b := createUploadLink(t, mux, `{"path":"/b","expires_in":"1h"}`)
+	postToLink(t, mux, a.URL, "one.txt", "1")
+
+	if w := do(t, mux, "DELETE", "/api/share/upload-link/"+a.ID, ""); w.Code != http.StatusNoContent {
+		t.Fatalf("revoke: %d %s", w.Code, w.Body)
+	}
+	if w := postToLink(t, mux, a.URL, "two.txt", "2"); w.Code != http.StatusNotFound {
+		t.Errorf("revoked link: %d", w.Code)
+	}
+	if w := do(t, mux, "DELETE", "/api/share/upload-link/"+a.ID, ""); w.Code != http.StatusNotFound {
+		t.Errorf("revoke twice: %d", w.Code)
+	}
+	if rec := linkActivity(t, mux, a.ID); rec.RevokedAt == nil || len(rec.Uploads) != 1 {
+		t.Errorf("revoked activity = %+v", rec)
+	}
+	var links []UploadLink
+	json.Unmarshal(do(t, mux, "GET", "/api/share/upload-link", "").Body.Bytes(), &links) //nolint:errcheck
+	if len(links) != 2 || links[0].ID != b.ID || !links[0].Active || links[1].Active {
+		t.Fatalf("links = %+v", links)
+	}
+
+	c.expireUploadLinks(time.Now().Add(2 * time.Hour))
+	if len(linkActivity(t, mux, b.ID).Uploads) != 0 {
+		t.Error("expired link dropped before uploadLinkKeep")
+	}
+	c.expireUploadLinks(time.Now().Add(uploadLinkKeep + 2*time.Hour))
+	if w := do(t, mux, "GET", "/api/share/upload-link/"+b.ID+"/activity", ""); w.Code != http.StatusNotFound {
+		t.Errorf("kept past uploadLinkKeep: %d", w.Code)
+	}
+}
+
+func TestUploadLink_Validation(t *testing.T) {
+	c, mux := newUploadMux(t)
+	writeFiles(t, c.DataDir, map[string]string{"a.txt": "aaa"})
+
+	for body, want := range map[string]int{
+		`not json`:                             http.StatusBadRequest,
+		`{"path":"/in","expires_in":"721h"}`:   http.StatusBadRequest,
+		`{"path":"/in","max_bytes":-1}`:        http.StatusBadRequest,
+		`{"path":"/in","max_files":1001}`:      http.StatusBadRequest,
+		`{"path":"/in","extensions":["../x"]}`: http.StatusBadRequest,
+		`{"path":"/"}`:                         http.StatusForbidden,
+		`{"path":"/.trash"}`:                   http.StatusForbidden,
+		`{"path":"/.shares"}`:                  http.StatusForbidden,
+		`{"path":"/a.txt"}`:                    http.StatusConflict,
+	} {
+		if w := do(t, mux, "POST", "/api/share/upload-link", body); w.Code != want {
+			t.Errorf("%s: %d, want %d", body, w.Code, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(c.DataDir, "in")); !os.IsNotExist(err) {
+		t.Error("a rejected link created its folder")
+	}
+
+	w := do(t, mux, "POST", "/api/share/upload-link",
+		`{"path":"/in","expires_in":"soon","max_bytes":-1,"max_files":1001,"extensions":["pdf","../x","a b"]}`)
+	var resp struct {
+		Errors []struct {
+			Field string `json:"field"`
+			Code  string `json:"code"`
+		} `json:"errors"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	var got []string
+	for _, e := range resp.Errors {
+		got = append(got, e.Field+"="+e.Code)
+	}
+	want := "expires_in=out_of_range max_bytes=out_of_range max_files=out_of_range extensions[1]=invalid extensions[2]=invalid"
+	if w.Code != http.StatusBadRequest || strings.Join(got, " ") != want {
+		t.Errorf("every problem at once: %d %s", w.Code, w.Body)
+	}
+
+	if w := postToLink(t, mux, "/u/nope", "a.txt", "a"); w.Code != http.StatusNotFound {
+		t.Errorf("unknown token: %d", w.Code)
+	}
+}
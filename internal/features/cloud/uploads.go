@@ -0,0 +1,471 @@
+package cloud
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/strct-org/strct-agent/internal/fsutil"
+	"github.com/strct-org/strct-agent/internal/httputil"
+)
+
+// Resumable uploads. A client that may lose its connection halfway through
+// a large file uploads it in chunks instead of one multipart request:
+//
+//	POST /api/upload/init            {"path":"/backups","name":"laptop.img","size":21474836480}
+//	PUT  /api/upload/{id}?offset=0   first chunk
+//	PUT  /api/upload/{id}?offset=N   next chunk; after a drop, GET the upload for its offset
+//	POST /api/upload/{id}/complete   {"sha256":"…"} (optional)
+//
+// Partial data lives in DataDir/.uploads so the final rename never crosses
+// a filesystem. Uploads nobody has written to for uploadTTL are removed.
+const (
+	uploadsDirName = ".uploads"
+	uploadTTL      = 24 * time.Hour
+	maxUploadSize  = 50 << 30 // same hard limit as the multipart upload
+)
+
+var errInvalidUploadID = errors.New("invalid upload id")
+
+// Upload is one resumable upload in progress.
+type Upload struct {
+	ID        string    `json:"id"`
+	Path      string    `json:"path"`             // destination folder under DataDir
+	Name      string    `json:"name"`             // destination file name
+	Size      int64     `json:"size,omitempty"`   // declared total; 0 if unknown
+	SHA256    string    `json:"sha256,omitempty"` // hex, checked on complete
+	Offset    int64     `json:"offset"`           // bytes received so far
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func (s *Cloud) uploadsDir() string { return filepath.Join(s.DataDir, uploadsDirName) }
+
+// uploadFiles returns the metadata and data paths for id, rejecting
+// anything that is not a UUID so id can't escape the uploads directory.
+func (s *Cloud) uploadFiles(id string) (meta, part string, err error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return "", "", errInvalidUploadID
+	}
+	base := filepath.Join(s.uploadsDir(), id)
+	return base + ".json", base + ".part", nil
+}
+
+// loadUpload reads an upload's metadata; the offset and last write time
+// come from the data file itself, so they are right even after a crash
+// mid-chunk.
+func (s *Cloud) loadUpload(id string) (*Upload, error) {
+	meta, part, err := s.uploadFiles(id)
+	if err != nil {
+		return nil, err
+	}
+	var u Upload
+	if err := fsutil.ReadJSON(meta, &u); err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(part)
+	if err != nil {
+		return nil, err
+	}
+	u.Offset = info.Size()
+	u.UpdatedAt = info.ModTime().UTC()
+	u.ExpiresAt = u.UpdatedAt.Add(uploadTTL)
+	return &u, nil
+}
+
+// claim marks id as having a request in flight. Chunks for one upload must
+// arrive in order, so a second concurrent request is refused.
+func (s *Cloud) claim(id string) bool {
+	s.uploadMu.Lock()
+	defer s.uploadMu.Unlock()
+	if s.uploadBusy == nil {
+		s.uploadBusy = make(map[string]bool)
+	}
+	if s.uploadBusy[id] {
+		return false
+	}
+	s.uploadBusy[id] = true
+	return true
+}
+
+func (s *Cloud) release(id string) {
+	s.uploadMu.Lock()
+	delete(s.uploadBusy, id)
+	s.uploadMu.Unlock()
+}
+
+// uploadError maps a loadUpload error to a response.
+func uploadError(w http.ResponseWriter, err error) {
+	if errors.Is(err, os.ErrNotExist) {
+		httputil.Error(w, http.StatusNotFound, "no such upload")
+		return
+	}
+	if errors.Is(err, errInvalidUploadID) {
+		httputil.BadRequest(w, err.Error())
+		return
+	}
+	slog.Error("cloud: could not read upload", "err", err)
+	httputil.InternalError(w, "could not read upload")
+}
+
+// handleUploadInit starts a resumable upload.
+// POST body: {"path":"/backups","name":"laptop.img","size":123,"sha256":"…"}
+func (s *Cloud) handleUploadInit(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Path   string `json:"path"`
+		Name   string `json:"name"`
+		Size   int64  `json:"size"`
+		SHA256 string `json:"sha256"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httputil.BadRequest(w, "invalid JSON")
+		return
+	}
+	// The client chose this name, so it is refused rather than cleaned up
+	// the way a multipart file name is.
+	name, err := sanitizeName(req.Name)
+	if err != nil || name != req.Name {
+		httputil.BadRequest(w, errInvalidName.Error())
+		return
+	}
+	if req.Size < 0 || req.Size > maxUploadSize {
+		httputil.BadRequest(w, "size must be between 0 and 50 GB")
+		return
+	}
+	if req.SHA256 != "" {
+		if b, err := hex.DecodeString(req.SHA256); err != nil || len(b) != sha256.Size {
+			httputil.BadRequest(w, "sha256 must be 64 hex characters")
+			return
+		}
+		req.SHA256 = strings.ToLower(req.SHA256)
+	}
+	dir, err := s.userPath(req.Path)
+	if err != nil || s.category(filepath.Join(dir, name)) != catLive {
+		httputil.Forbidden(w)
+		return
+	}
+	if err := s.canChange(filepath.Join(dir, name)); err != nil {
+		pathError(w, err)
+		return
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		httputil.Error(w, http.StatusNotFound, "destination folder does not exist")
+		return
+	}
+	if req.Size > 0 {
+		if room, q, ok := s.uploadRoom(0); ok && req.Size > room {
+			insufficientStorage(w, q)
+			return
+		}
+	}
+
+	if err := os.MkdirAll(s.uploadsDir(), 0700); err != nil {
+		slog.Error("cloud: could not create uploads dir", "err", err)
+		httputil.InternalError(w, "disk error")
+		return
+	}
+	now := time.Now().UTC()
+	u := Upload{
+		ID:        uuid.NewString(),
+		Path:      path.Clean("/" + filepath.ToSlash(req.Path)),
+		Name:      name,
+		Size:      req.Size,
+		SHA256:    req.SHA256,
+		CreatedAt: now,
+		UpdatedAt: now,
+		ExpiresAt: now.Add(uploadTTL),
+	}
+	meta, part, _ := s.uploadFiles(u.ID)
+	if err := os.WriteFile(part, nil, 0600); err != nil {
+		slog.Error("cloud: could not create upload file", "err", err)
+		httputil.InternalError(w, "disk error")
+		return
+	}
+	if err := fsutil.WriteJSON(meta, u); err != nil {
+		os.Remove(part) //nolint:errcheck
+		slog.Error("cloud: could not save upload", "err", err)
+		httputil.InternalError(w, "disk error")
+		return
+	}
+
+	slog.Info("cloud: resumable upload started", "id", u.ID, "name", u.Name, "size", u.Size)
+	httputil.JSON(w, http.StatusCreated, u)
+}
+
+// handleUploadChunk appends a chunk. offset must equal the bytes received
+// so far; on a mismatch the 409 body carries the offset to resume from.
+func (s *Cloud) handleUploadChunk(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+	if err != nil || offset < 0 {
+		httputil.BadRequest(w, "offset must be a non-negative integer")
+		return
+	}
+	if !s.claim(id) {
+		httputil.Error(w, http.StatusConflict, "another request for this upload is in progress")
+		return
+	}
+	defer s.release(id)
+
+	u, err := s.loadUpload(id)
+	if err != nil {
+		uploadError(w, err)
+		return
+	}
+	if offset != u.Offset {
+		httputil.JSON(w, http.StatusConflict, map[string]any{"error": "offset mismatch", "offset": u.Offset})
+		return
+	}
+
+	limit := int64(maxUploadSize) - u.Offset
+	if u.Size > 0 {
+		limit = u.Size - u.Offset
+	}
+	room, q, limited := s.uploadRoom(0)
+	if limited && r.ContentLength > room {
+		insufficientStorage(w, q)
+		return
+	}
+	_, part, _ := s.uploadFiles(id)
+	f, err := os.OpenFile(part, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		uploadError(w, err)
+		return
+	}
+	var src io.Reader = http.MaxBytesReader(w, r.Body, limit)
+	if limited {
+		src = &reserveReader{r: src, left: room}
+	}
+	n, copyErr := io.Copy(usage.Writer(f), src)
+	// Whatever reached the file counts; the next chunk resumes after it.
+	syncErr := f.Sync()
+	if err := f.Close(); syncErr == nil {
+		syncErr = err
+	}
+	u.Offset += n
+	s.trackSize(part, n)
+
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(copyErr, &tooLarge):
+		httputil.JSON(w, http.StatusRequestEntityTooLarge, map[string]any{"error": "chunk goes past the declared size", "offset": u.Offset})
+	case errors.Is(copyErr, errReserveReached):
+		// What was written is kept: the upload resumes from it once
+		// space is freed.
+		q, _ := s.quota()
+		body := reserveBody(q)
+		body["offset"] = u.Offset
+		httputil.JSON(w, http.StatusInsufficientStorage, body)
+	case copyErr != nil:
+		slog.Warn("cloud: upload chunk interrupted", "id", id, "received", n, "err", copyErr)
+		httputil.JSON(w, http.StatusBadRequest, map[string]any{"error": "chunk interrupted", "offset": u.Offset})
+	case syncErr != nil:
+		slog.Error("cloud: could not sync upload chunk", "id", id, "err", syncErr)
+		httputil.InternalError(w, "disk error")
+	default:
+		httputil.OK(w, map[string]any{"id": id, "offset": u.Offset})
+	}
+}
+
+// handleUploadComplete verifies the upload and renames it into place.
+// POST body (optional): {"sha256":"…"}, overriding the one given at init.
+func (s *Cloud) handleUploadComplete(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	var req struct {
+		SHA256 string `json:"sha256"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		httputil.BadRequest(w, "invalid JSON")
+		return
+	}
+	if !s.claim(id) {
+		httputil.Error(w, http.StatusConflict, "another request for this upload is in progress")
+		return
+	}
+	defer s.release(id)
+
+	u, err := s.loadUpload(id)
+	if err != nil {
+		uploadError(w, err)
+		return
+	}
+	if u.Size > 0 && u.Offset != u.Size {
+		httputil.JSON(w, http.StatusConflict, map[string]any{"error": "upload incomplete", "offset": u.Offset, "size": u.Size})
+		return
+	}
+
+	meta, part, _ := s.uploadFiles(id)
+	want := strings.ToLower(req.SHA256)
+	if want == "" {
+		want = u.SHA256
+	}
+	// Hashed even without a checksum to check: it is recorded below.
+	got, err := fileSHA256(part)
+	if err != nil {
+		slog.Error("cloud: could not hash upload", "id", id, "err", err)
+		httputil.InternalError(w, "disk error")
+		return
+	}
+	if want != "" && got != want {
+		httputil.JSON(w, http.StatusUnprocessableEntity, map[string]any{"error": "checksum mismatch", "sha256": got})
+		return
+	}
+
+	// The destination is checked again: the folder may have been removed
+	// since init.
+	dir, err := secureJoin(s.DataDir, u.Path)
+	if err != nil {
+		httputil.Forbidden(w)
+		return
+	}
+	dst := filepath.Join(dir, u.Name)
+	if err := s.checkExternal(dst); err != nil {
+		pathError(w, err)
+		return
+	}
+	if err := s.canChange(dst); err != nil {
+		pathError(w, err)
+		return
+	}
+	replaced := sizeOf(dst)
+	if err := s.placeUpload(part, dst); err != nil {
+		slog.Error("cloud: could not move upload into place", "id", id, "dst", dst, "err", err)
+		httputil.InternalError(w, "could not save file")
+		return
+	}
+	s.trackSize(part, -u.Offset)
+	s.trackSize(dst, u.Offset-replaced)
+	s.recordSum(dst, got)
+	s.index.invalidate()
+	os.Remove(meta) //nolint:errcheck
+
+	slog.Info("cloud: resumable upload complete", "id", id, "path", dst, "size", u.Offset)
+	s.logActivity(r, Activity{Op: opUpload, Path: s.apiPath(dst), Size: u.Offset})
+	httputil.JSON(w, http.StatusCreated, map[string]any{
+		"status": "uploaded",
+		"path":   path.Join(u.Path, u.Name),
+		"size":   u.Offset,
+	})
+}
+
+func (s *Cloud) handleGetUpload(w http.ResponseWriter, r *http.Request) {
+	u, err := s.loadUpload(r.PathValue("id"))
+	if err != nil {
+		uploadError(w, err)
+		return
+	}
+	httputil.OK(w, u)
+}
+
+// handleListUploads returns the partial uploads, oldest first.
+func (s *Cloud) handleListUploads(w http.ResponseWriter, r *http.Request) {
+	httputil.OK(w, map[string]any{"uploads": s.listUploads()})
+}
+
+func (s *Cloud) handleCancelUpload(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if !s.claim(id) {
+		httputil.Error(w, http.StatusConflict, "another request for this upload is in progress")
+		return
+	}
+	defer s.release(id)
+	if _, err := s.loadUpload(id); err != nil {
+		uploadError(w, err)
+		return
+	}
+	s.removeUpload(id)
+	httputil.NoContent(w)
+}
+
+func (s *Cloud) listUploads() []Upload {
+	entries, err := os.ReadDir(s.uploadsDir())
+	if err != nil {
+		return []Upload{}
+	}
+	out := []Upload{}
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok {
+			continue
+		}
+		if u, err := s.loadUpload(id); err == nil {
+			out = append(out, *u)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+	return out
+}
+
+func (s *Cloud) removeUpload(id string) {
+	meta, part, err := s.uploadFiles(id)
+	if err != nil {
+		return
+	}
+	size := sizeOf(part)
+	if os.Remove(part) == nil {
+		s.trackSize(part, -size)
+	}
+	os.Remove(meta) //nolint:errcheck
+}
+
+// expireUploads removes uploads idle for longer than uploadTTL, along with
+// stray halves of an upload whose other file is gone.
+func (s *Cloud) expireUploads(now time.Time) int {
+	entries, err := os.ReadDir(s.uploadsDir())
+	if err != nil {
+		return 0
+	}
+	removed := 0
+	seen := make(map[string]bool)
+	for _, e := range entries {
+		id := strings.TrimSuffix(strings.TrimSuffix(e.Name(), ".json"), ".part")
+		if seen[id] || uuid.Validate(id) != nil {
+			continue
+		}
+		seen[id] = true
+		// Recently touched files are never stray: init writes the data
+		// file a moment before the metadata.
+		if info, err := e.Info(); err != nil || now.Sub(info.ModTime()) < uploadTTL {
+			continue
+		}
+		if u, err := s.loadUpload(id); err == nil && now.Before(u.ExpiresAt) {
+			continue
+		}
+		if !s.claim(id) {
+			continue
+		}
+		s.removeUpload(id)
+		s.release(id)
+		removed++
+	}
+	if removed > 0 {
+		slog.Info("cloud: expired stale uploads", "count", removed)
+	}
+	return removed
+}
+
+func fileSHA256(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, usage.Reader(f)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
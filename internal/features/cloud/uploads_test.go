@@ -0,0 +1,367 @@
+package cloud
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newUploadMux(t testing.TB) (*Cloud, *http.ServeMux) {
+	t.Helper()
+	c, err := NewFromConfig_Test(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close) // the activity log, before TempDir goes
+	mux := http.NewServeMux()
+	c.RegisterRoutes(mux)
+	return c, mux
+}
+
+func do(t testing.TB, mux http.Handler, method, target, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+	return w
+}
+
+func initUpload(t *testing.T, mux http.Handler, body string) Upload {
+	t.Helper()
+	w := do(t, mux, "POST", "/api/upload/init", body)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("init: %d %s", w.Code, w.Body)
+	}
+	var u Upload
+	if err := json.Unmarshal(w.Body.Bytes(), &u); err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func offsetOf(t *testing.T, w *httptest.ResponseRecorder) int64 {
+	t.Helper()
+	var resp struct {
+		Offset int64 `json:"offset"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode %s: %v", w.Body, err)
+	}
+	return resp.Offset
+}
+
+func TestResumableUpload_ChunksResumeAndComplete(t *testing.T) {
+	c, mux := newUploadMux(t)
+	content := "first half|second half"
+	sum := sha256.Sum256([]byte(content))
+	os.Mkdir(filepath.Join(c.DataDir, "backups"), 0755)
+
+	u := initUpload(t, mux, `{"path":"/backups","name":"laptop.img","size":22}`)
+	if u.ID == "" || u.Offset != 0 {
+		t.Fatalf("init = %+v", u)
+	}
+
+	base := "/api/upload/" + u.ID
+	if w := do(t, mux, "PUT", base+"?offset=0", content[:11]); w.Code != http.StatusOK || offsetOf(t, w) != 11 {
+		t.Fatalf("chunk 1: %d %s", w.Code, w.Body)
+	}
+
+	// A client that lost the response retries from a stale offset.
+	w := do(t, mux, "PUT", base+"?offset=0", content[:11])
+	if w.Code != http.StatusConflict || offsetOf(t, w) != 11 {
+		t.Fatalf("stale offset: %d %s", w.Code, w.Body)
+	}
+	if w := do(t, mux, "GET", base, ""); w.Code != http.StatusOK || offsetOf(t, w) != 11 {
+		t.Fatalf("status: %d %s", w.Code, w.Body)
+	}
+	if w := do(t, mux, "GET", "/api/uploads", ""); !strings.Contains(w.Body.String(), u.ID) {
+		t.Errorf("uploads list = %s", w.Body)
+	}
+
+	if w := do(t, mux, "POST", base+"/complete", ""); w.Code != http.StatusConflict {
+		t.Errorf("complete before all bytes: got %d, want 409", w.Code)
+	}
+	if w := do(t, mux, "PUT", base+"?offset=11", content[11:]); w.Code != http.StatusOK || offsetOf(t, w) != 22 {
+		t.Fatalf("chunk 2: %d %s", w.Code, w.Body)
+	}
+	w = do(t, mux, "POST", base+"/complete", `{"sha256":"`+hex.EncodeToString(sum[:])+`"}`)
+	if w.Code != http.StatusCreated || !strings.Contains(w.Body.String(), `"path":"/backups/laptop.img"`) {
+		t.Fatalf("complete: %d %s", w.Code, w.Body)
+	}
+
+	if b, err := os.ReadFile(filepath.Join(c.DataDir, "backups", "laptop.img")); err != nil || string(b) != content {
+		t.Fatalf("final file = %q, %v", b, err)
+	}
+	if w := do(t, mux, "GET", base, ""); w.Code != http.StatusNotFound {
+		t.Errorf("completed upload still exists: %d", w.Code)
+	}
+	if w := do(t, mux, "GET", "/api/files?path=/", ""); strings.Contains(w.Body.String(), uploadsDirName) {
+		t.Errorf("listing shows the uploads dir: %s", w.Body)
+	}
+}
+
+func TestResumableUpload_ChecksumMismatchKeepsPartial(t *testing.T) {
+	c, mux := newUploadMux(t)
+	u := initUpload(t, mux, `{"name":"notes.txt","sha256":"`+strings.Repeat("ab", 32)+`"}`)
+	do(t, mux, "PUT", "/api/upload/"+u.ID+"?offset=0", "not what was promised")
+
+	w := do(t, mux, "POST", "/api/upload/"+u.ID+"/complete", "")
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("complete: %d %s", w.Code, w.Body)
+	}
+	if _, err := os.Stat(filepath.Join(c.DataDir, "notes.txt")); !os.IsNotExist(err) {
+		t.Error("file moved into place despite checksum mismatch")
+	}
+	if w := do(t, mux, "DELETE", "/api/upload/"+u.ID, ""); w.Code != http.StatusNoContent {
+		t.Errorf("cancel: %d", w.Code)
+	}
+	if entries, _ := os.ReadDir(c.uploadsDir()); len(entries) != 0 {
+		t.Errorf("cancel left %d files behind", len(entries))
+	}
+}
+
+func TestResumableUpload_RejectsChunkPastDeclaredSize(t *testing.T) {
+	_, mux := newUploadMux(t)
+	u := initUpload(t, mux, `{"name":"small.bin","size":4}`)
+
+	w := do(t, mux, "PUT", "/api/upload/"+u.ID+"?offset=0", "too long")
+	if w.Code != http.StatusRequestEntityTooLarge || offsetOf(t, w) != 4 {
+		t.Fatalf("oversized chunk: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestResumableUpload_Validation(t *testing.T) {
+	_, mux := newUploadMux(t)
+	for _, tc := range []struct {
+		method, target, body string
+		want                 int
+	}{
+		{"POST", "/api/upload/init", `{"name":"../x"}`, http.StatusBadRequest},
+		{"POST", "/api/upload/init", `{"name":"x","sha256":"zz"}`, http.StatusBadRequest},
+		{"POST", "/api/upload/init", `{"name":"x","size":-1}`, http.StatusBadRequest},
+		{"POST", "/api/upload/init", `{"path":"/missing","name":"x"}`, http.StatusNotFound},
+		{"POST", "/api/upload/init", `{"path":"/.uploads","name":"x"}`, http.StatusForbidden},
+		{"PUT", "/api/upload/not-a-uuid?offset=0", "x", http.StatusBadRequest},
+		{"PUT", "/api/upload/6f1c2d7e-8a5b-4c3d-9e0f-1a2b3c4d5e6f?offset=0", "x", http.StatusNotFound},
+		{"PUT", "/api/upload/6f1c2d7e-8a5b-4c3d-9e0f-1a2b3c4d5e6f?offset=-1", "x", http.StatusBadRequest},
+	} {
+		if w := do(t, mux, tc.method, tc.target, tc.body); w.Code != tc.want {
+			t.Errorf("%s %s %s: got %d, want %d", tc.method, tc.target, tc.body, w.Code, tc.want)
+		}
+	}
+}
+
+func TestResumableUpload_PartialsAreNotServed(t *testing.T) {
+	_, mux := newUploadMux(t)
+	u := initUpload(t, mux, `{"name":"secret.txt"}`)
+	do(t, mux, "PUT", "/api/upload/"+u.ID+"?offset=0", "partial")
+
+	if w := do(t, mux, "GET", "/files/.uploads/"+u.ID+".part", ""); w.Code != http.StatusNotFound {
+		t.Errorf("partial served: %d", w.Code)
+	}
+	if w := do(t, mux, "GET", "/api/files?path=/.uploads", ""); w.Code != http.StatusForbidden {
+		t.Errorf("uploads dir listed: %d", w.Code)
+	}
+}
+
+func TestExpireUploads(t *testing.T) {
+	c, mux := newUploadMux(t)
+	stale := initUpload(t, mux, `{"name":"stale.bin"}`)
+	fresh := initUpload(t, mux, `{"name":"fresh.bin"}`)
+
+	old := time.Now().Add(-uploadTTL - time.Hour)
+	for _, ext := range []string{".json", ".part"} {
+		os.Chtimes(filepath.Join(c.uploadsDir(), stale.ID+ext), old, old)
+	}
+
+	if n := c.expireUploads(time.Now()); n != 1 {
+		t.Errorf("expired %d uploads, want 1", n)
+	}
+	if _, err := c.loadUpload(stale.ID); !os.IsNotExist(err) {
+		t.Errorf("stale upload still loadable: %v", err)
+	}
+	if _, err := c.loadUpload(fresh.ID); err != nil {
+		t.Errorf("fresh upload removed: %v", err)
+	}
+}
+
+func TestHandleUpload_StreamsMultipartFile(t *testing.T) {
+	c, mux := newUploadMux(t)
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("note", "fields before the file are skipped")
+	fw, _ := mw.CreateFormFile("file", "photo.jpg")
+	io.WriteString(fw, "jpeg bytes")
+	mw.Close()
+
+	req := httptest.NewRequest("POST", "/strct_agent/fs/upload?path=/", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("upload: %d %s", w.Code, w.Body)
+	}
+	if b, _ := os.ReadFile(filepath.Join(c.DataDir, "photo.jpg")); string(b) != "jpeg bytes" {
+		t.Errorf("uploaded = %q", b)
+	}
+}
+
+// uploadAs uploads body as filename to /strct_agent/fs/upload?query.
+func uploadAs(t *testing.T, mux http.Handler, query, filename, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fw, _ := mw.CreateFormFile("file", filename)
+	io.WriteString(fw, body)
+	mw.Close()
+	req := httptest.NewRequest("POST", "/strct_agent/fs/upload?"+query, &buf)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	return w
+}
+
+func storedName(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	var resp struct {
+		Name string `json:"name"`
+		Path string `json:"path"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode %s: %v", w.Body, err)
+	}
+	return resp.Name
+}
+
+func TestSanitizeName(t *testing.T) {
+	for in, want := range map[string]string{
+		"photo.jpg":               "photo.jpg",
+		"../../etc/cron.d/evil":   "evil",
+		`..\..\evil.sh`:           "evil.sh",
+		`C:\Users\me\photo.jpg`:   "photo.jpg",
+		".bashrc":                 "bashrc",
+		"..hidden..":              "hidden..",
+		"  spaced name.txt  ":     "spaced name.txt",
+		"tab\tand\x00nul\x7f.txt": "tabandnul.txt",
+		"..":                      "",
+		". .":                     "",
+		"dir/":                    "",
+		"\xff\xfe.txt":            "",
+		strings.Repeat("x", 256):  "",
+	} {
+		got, err := sanitizeName(in)
+		if want == "" {
+			if err == nil {
+				t.Errorf("sanitizeName(%q) = %q, want an error", in, got)
+			}
+			continue
+		}
+		if err != nil || got != want {
+			t.Errorf("sanitizeName(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+	for name, want := range map[string]string{
+		"photo.jpg":      "photo (2).jpg",
+		"archive.tar.gz": "archive.tar (2).gz",
+		"README":         "README (2)",
+		"bashrc.":        "bashrc (2).",
+	} {
+		if got := numbered(name, 2); got != want {
+			t.Errorf("numbered(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestHandleUpload_TraversalFilenames(t *testing.T) {
+	c, mux := newUploadMux(t)
+	os.Mkdir(filepath.Join(c.DataDir, "docs"), 0755)
+	for filename, want := range map[string]string{
+		"../../etc/cron.d/evil":   "evil",
+		`..\..\..\evil.sh`:        "evil.sh",
+		`C:\Users\me\holiday.jpg`: "holiday.jpg",
+		".checksums":              "checksums",
+		"/docs/../../outside.txt": "outside.txt",
+	} {
+		w := uploadAs(t, mux, "path=/docs", filename, "payload")
+		if w.Code != http.StatusCreated {
+			t.Errorf("%q: %d %s", filename, w.Code, w.Body)
+			continue
+		}
+		if got := storedName(t, w); got != want {
+			t.Errorf("%q stored as %q, want %q", filename, got, want)
+		}
+		if _, err := os.Stat(filepath.Join(c.DataDir, "docs", want)); err != nil {
+			t.Errorf("%q: %v", filename, err)
+		}
+	}
+	entries, _ := os.ReadDir(filepath.Dir(c.DataDir))
+	if len(entries) != 1 {
+		t.Errorf("upload escaped DataDir: %v", entries)
+	}
+
+	for filename, code := range map[string]int{
+		"..":       http.StatusBadRequest,
+		"...":      http.StatusBadRequest,
+		"obsolete": http.StatusCreated, // the agent's backups are in .obsolete
+	} {
+		if w := uploadAs(t, mux, "path=/", filename, "x"); w.Code != code {
+			t.Errorf("%q: %d, want %d", filename, w.Code, code)
+		}
+	}
+}
+
+func TestHandleUpload_Conflict(t *testing.T) {
+	c, mux := newUploadMux(t)
+	file := func(name string) string { return readFile(t, filepath.Join(c.DataDir, name)) }
+
+	if w := uploadAs(t, mux, "path=/", "photo.jpg", "first"); w.Code != http.StatusCreated || storedName(t, w) != "photo.jpg" {
+		t.Fatalf("first upload: %d %s", w.Code, w.Body)
+	}
+	for _, want := range []string{"photo (1).jpg", "photo (2).jpg"} {
+		w := uploadAs(t, mux, "path=/&conflict=rename", "photo.jpg", want)
+		if w.Code != http.StatusCreated || storedName(t, w) != want {
+			t.Fatalf("rename: %d %s, want %s", w.Code, w.Body, want)
+		}
+		if file(want) != want {
+			t.Errorf("%s holds %q", want, file(want))
+		}
+	}
+
+	if w := uploadAs(t, mux, "path=/&conflict=reject", "photo.jpg", "rejected"); w.Code != http.StatusConflict {
+		t.Errorf("reject: %d %s", w.Code, w.Body)
+	}
+	if file("photo.jpg") != "first" {
+		t.Errorf("rejected upload changed the file: %q", file("photo.jpg"))
+	}
+	if w := uploadAs(t, mux, "path=/&conflict=reject", "new.jpg", "fresh"); w.Code != http.StatusCreated {
+		t.Errorf("reject with a free name: %d %s", w.Code, w.Body)
+	}
+
+	// The default overwrites, as before the parameter existed.
+	if w := uploadAs(t, mux, "path=/", "photo.jpg", "second"); w.Code != http.StatusCreated || storedName(t, w) != "photo.jpg" {
+		t.Errorf("overwrite: %d %s", w.Code, w.Body)
+	}
+	if file("photo.jpg") != "second" {
+		t.Errorf("overwritten file = %q", file("photo.jpg"))
+	}
+
+	os.Mkdir(filepath.Join(c.DataDir, "docs"), 0755)
+	if w := uploadAs(t, mux, "path=/&conflict=overwrite", "docs", "x"); w.Code != http.StatusConflict {
+		t.Errorf("overwriting a folder: %d %s", w.Code, w.Body)
+	}
+	if w := uploadAs(t, mux, "path=/&conflict=rename", "docs", "x"); w.Code != http.StatusCreated || storedName(t, w) != "docs (1)" {
+		t.Errorf("renaming past a folder: %d %s", w.Code, w.Body)
+	}
+	if w := uploadAs(t, mux, "path=/&conflict=skip", "other.jpg", "x"); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown policy: %d %s", w.Code, w.Body)
+	}
+}
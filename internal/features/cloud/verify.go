@@ -0,0 +1,343 @@
+package cloud
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/strct-org/strct-agent/internal/httputil"
+	"github.com/strct-org/strct-agent/internal/maintenance"
+)
+
+// Verification. POST /api/verify?path=/docs re-reads every file under a
+// folder in the background and compares it with the checksum recorded
+// for it. A file whose size or modification time no longer matches its
+// record was changed outside the API, over Samba say, and is hashed and
+// recorded afresh rather than reported; so is a file that never had one.
+// Only a file that looks untouched but reads differently is a mismatch:
+// that is the drive going bad.
+//
+// Each file is hashed as a maintenance job on the background queue, so
+// thumbnails go first and maintenance mode stops the verify. Reads are
+// also paced at VerifyReadRate so a verify of the whole drive does not
+// starve uploads and downloads of the disk. One job runs at a time; the
+// last few stay readable on GET /api/verify/{id}.
+const (
+	defaultVerifyReadRate = 8 << 20 // bytes per second
+	maxVerifyMismatches   = 1000    // reported per job; MismatchCount has them all
+	keepVerifyJobs        = 8
+)
+
+// VerifyMismatch is a file whose contents changed while its size and
+// modification time did not, or that could not be read.
+type VerifyMismatch struct {
+	Path     string `json:"path"`
+	Expected string `json:"expected"`
+	Actual   string `json:"actual,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// VerifyJob is the progress of POST /api/verify.
+type VerifyJob struct {
+	ID            string           `json:"id"`
+	Path          string           `json:"path"`
+	State         string           `json:"state"` // running|done|failed
+	StartedAt     time.Time        `json:"started_at"`
+	FinishedAt    *time.Time       `json:"finished_at,omitempty"`
+	FilesTotal    int              `json:"files_total"`
+	FilesDone     int              `json:"files_done"`
+	BytesTotal    int64            `json:"bytes_total"`
+	BytesDone     int64            `json:"bytes_done"`
+	Verified      int              `json:"verified"` // read back as recorded
+	Recorded      int              `json:"recorded"` // no record, or changed since; hashed now
+	Pruned        int              `json:"pruned"`   // records of files that are gone
+	MismatchCount int              `json:"mismatch_count"`
+	Mismatches    []VerifyMismatch `json:"mismatches"`
+	Error         string           `json:"error,omitempty"` // why the job failed
+}
+
+type verifyJobs struct {
+	mu    sync.Mutex
+	jobs  map[string]*VerifyJob
+	order []string // oldest first
+}
+
+// handleStartVerify starts verifying a folder.
+// POST /api/verify?path=/docs
+func (s *Cloud) handleStartVerify(w http.ResponseWriter, r *http.Request) {
+	reqPath := r.URL.Query().Get("path")
+	root, err := s.userPath(reqPath)
+	if err != nil {
+		httputil.Forbidden(w)
+		return
+	}
+	if _, err := os.Stat(root); err != nil {
+		httputil.Error(w, http.StatusNotFound, "not found: "+reqPath)
+		return
+	}
+
+	job := &VerifyJob{ID: uuid.NewString(), Path: s.sumKey(root), State: "running", StartedAt: time.Now().UTC(), Mismatches: []VerifyMismatch{}}
+	v := &s.verify
+	v.mu.Lock()
+	for _, j := range v.jobs {
+		if j.State == "running" {
+			v.mu.Unlock()
+			httputil.Error(w, http.StatusConflict, "a verify job is already running: "+j.ID)
+			return
+		}
+	}
+	if v.jobs == nil {
+		v.jobs = map[string]*VerifyJob{}
+	}
+	v.jobs[job.ID] = job
+	v.order = append(v.order, job.ID)
+	for len(v.order) > keepVerifyJobs {
+		delete(v.jobs, v.order[0])
+		v.order = v.order[1:]
+	}
+	snapshot := job.snapshot()
+	v.mu.Unlock()
+
+	slog.Info("cloud: verify started", "job", job.ID, "path", job.Path)
+	usage.Go(func() { s.runVerify(job, root) })
+	httputil.JSON(w, http.StatusAccepted, snapshot)
+}
+
+// handleGetVerify reports the progress of a verify job.
+// GET /api/verify/{id}
+func (s *Cloud) handleGetVerify(w http.ResponseWriter, r *http.Request) {
+	v := &s.verify
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	job, ok := v.jobs[r.PathValue("id")]
+	if !ok {
+		httputil.Error(w, http.StatusNotFound, "no such verify job")
+		return
+	}
+	httputil.OK(w, job.snapshot())
+}
+
+// snapshot copies job. verify.mu must be held.
+func (job *VerifyJob) snapshot() VerifyJob {
+	c := *job
+	c.Mismatches = append([]VerifyMismatch{}, job.Mismatches...)
+	return c
+}
+
+// updateVerify applies f to job under verify.mu.
+func (s *Cloud) updateVerify(job *VerifyJob, f func(*VerifyJob)) {
+	s.verify.mu.Lock()
+	defer s.verify.mu.Unlock()
+	f(job)
+}
+
+func (s *Cloud) runVerify(job *VerifyJob, root string) {
+	files, err := s.verifyList(root)
+	if err != nil {
+		slog.Error("cloud: verify could not list files", "path", root, "err", err)
+		s.finishVerify(job, err)
+		return
+	}
+	var total int64
+	seen := make(map[string]bool, len(files))
+	for _, f := range files {
+		total += f.size
+		seen[s.sumKey(f.path)] = true
+	}
+	s.updateVerify(job, func(j *VerifyJob) { j.FilesTotal, j.BytesTotal = len(files), total })
+
+	for _, f := range files {
+		if err := s.verifyFile(job, f.path); err != nil {
+			slog.Warn("cloud: verify stopped", "job", job.ID, "err", err)
+			s.finishVerify(job, err)
+			return
+		}
+	}
+	pruned := s.checksums().prune(s.sumKey(root), func(key string) bool {
+		if seen[key] {
+			return false
+		}
+		_, err := os.Lstat(filepath.Join(s.DataDir, filepath.FromSlash(key)))
+		return os.IsNotExist(err)
+	})
+	s.updateVerify(job, func(j *VerifyJob) { j.Pruned = pruned })
+	s.finishVerify(job, nil)
+}
+
+func (s *Cloud) finishVerify(job *VerifyJob, err error) {
+	now := time.Now().UTC()
+	var done VerifyJob
+	s.updateVerify(job, func(j *VerifyJob) {
+		j.State = "done"
+		if err != nil {
+			j.State, j.Error = "failed", err.Error()
+		}
+		j.FinishedAt = &now
+		done = *j
+	})
+	slog.Info("cloud: verify finished", "job", done.ID, "state", done.State,
+		"verified", done.Verified, "recorded", done.Recorded, "mismatches", done.MismatchCount)
+}
+
+type verifyFile struct {
+	path string
+	size int64
+}
+
+// verifyList lists the regular files under root, leaving out the reserved
+// directories when root is DataDir.
+func (s *Cloud) verifyList(root string) ([]verifyFile, error) {
+	var files []verifyFile
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == root {
+				return err
+			}
+			return nil // vanished or unreadable; not ours to report
+		}
+		if d.IsDir() && p != root && s.category(p) != catLive {
+			return filepath.SkipDir
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		files = append(files, verifyFile{path: p, size: info.Size()})
+		return nil
+	})
+	return files, err
+}
+
+// hashed is the result of a hash job.
+type hashed struct {
+	sum string
+	n   int64
+}
+
+// stopsVerify reports whether err is the queue's rather than the file's:
+// the job was cancelled, maintenance mode is on, or the queue is full.
+func stopsVerify(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, maintenance.ErrActive) || errors.Is(err, errQueueFull)
+}
+
+// verifyFile hashes one file on the background queue and compares it with
+// its record. It returns only the errors that stop the whole verify.
+func (s *Cloud) verifyFile(job *VerifyJob, full string) error {
+	key := s.sumKey(full)
+	before, err := os.Stat(full)
+	if err != nil {
+		s.updateVerify(job, func(j *VerifyJob) { j.FilesDone++ })
+		return nil // deleted since it was listed
+	}
+	val, err := s.background().do(context.Background(), jobHash, key, prioMaintenance, func(ctx context.Context) (any, error) {
+		sum, n, err := s.pacedSHA256(ctx, full)
+		return hashed{sum, n}, err
+	})
+	if stopsVerify(err) {
+		return err
+	}
+	h, _ := val.(hashed)
+	s.updateVerify(job, func(j *VerifyJob) { j.FilesDone++; j.BytesDone += h.n })
+	rec, ok := s.checksums().get(key)
+	if err != nil {
+		if ok && rec.current(before) {
+			s.addMismatch(job, VerifyMismatch{Path: key, Expected: rec.SHA256, Error: err.Error()})
+		}
+		return nil
+	}
+	sum := h.sum
+	after, err := os.Stat(full)
+	if err != nil || after.Size() != before.Size() || !after.ModTime().Equal(before.ModTime()) {
+		return nil // written to while it was read; the next verify sees it
+	}
+
+	switch {
+	case !ok || !rec.current(after):
+		s.checksums().set(key, checksum{SHA256: sum, Size: after.Size(), ModTime: after.ModTime()})
+		s.updateVerify(job, func(j *VerifyJob) { j.Recorded++ })
+	case rec.SHA256 == sum:
+		s.updateVerify(job, func(j *VerifyJob) { j.Verified++ })
+	default:
+		slog.Warn("cloud: checksum mismatch", "path", key, "expected", rec.SHA256, "actual", sum)
+		s.addMismatch(job, VerifyMismatch{Path: key, Expected: rec.SHA256, Actual: sum})
+	}
+	return nil
+}
+
+func (s *Cloud) addMismatch(job *VerifyJob, m VerifyMismatch) {
+	s.updateVerify(job, func(j *VerifyJob) {
+		j.MismatchCount++
+		if len(j.Mismatches) < maxVerifyMismatches {
+			j.Mismatches = append(j.Mismatches, m)
+		}
+	})
+}
+
+// pacedSHA256 hashes name, reading at no more than VerifyReadRate, until
+// ctx ends.
+func (s *Cloud) pacedSHA256(ctx context.Context, name string) (string, int64, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	var r io.Reader = &ctxReader{ctx: ctx, r: usage.Reader(f)}
+	if s.VerifyReadRate > 0 {
+		r = &pacedReader{r: r, rate: s.VerifyReadRate, start: time.Now()}
+	}
+	n, err := io.Copy(h, r)
+	if err != nil {
+		return "", n, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+// ctxReader stops reading once ctx ends.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *ctxReader) Read(b []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(b)
+}
+
+// pacedReader sleeps as needed to keep its average rate at rate bytes per
+// second.
+type pacedReader struct {
+	r     io.Reader
+	rate  int64
+	start time.Time
+	n     int64
+}
+
+func (p *pacedReader) Read(b []byte) (int, error) {
+	// At most a second's worth at a time, so the pace stays even.
+	if len(b) > int(p.rate) {
+		b = b[:p.rate]
+	}
+	n, err := p.r.Read(b)
+	p.n += int64(n)
+	due := p.start.Add(time.Duration(float64(p.n) / float64(p.rate) * float64(time.Second)))
+	if d := time.Until(due); d > 0 {
+		time.Sleep(d)
+	}
+	return n, err
+}
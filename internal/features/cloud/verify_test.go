@@ -0,0 +1,206 @@
+package cloud
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/httputil"
+)
+
+func sha(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// listedSums maps the files in dir to the sha256 /api/v1/files reports.
+func listedSums(t *testing.T, mux http.Handler, dir string) map[string]string {
+	t.Helper()
+	w := do(t, httputil.Versioned(mux), "GET", "/api/v1/files?path="+dir, "")
+	var page httputil.Page[FileItem]
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+		t.Fatalf("decode %s: %v", w.Body, err)
+	}
+	sums := map[string]string{}
+	for _, f := range page.Items {
+		sums[f.Name] = f.SHA256
+	}
+	return sums
+}
+
+func startVerify(t *testing.T, mux http.Handler, dir string) VerifyJob {
+	t.Helper()
+	w := do(t, mux, "POST", "/api/verify?path="+dir, "")
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("verify: %d %s", w.Code, w.Body)
+	}
+	var job VerifyJob
+	if err := json.Unmarshal(w.Body.Bytes(), &job); err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
+
+func waitVerify(t *testing.T, mux http.Handler, id string) VerifyJob {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var job VerifyJob
+		if err := json.Unmarshal(do(t, mux, "GET", "/api/verify/"+id, "").Body.Bytes(), &job); err != nil {
+			t.Fatal(err)
+		}
+		if job.State != "running" {
+			return job
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("verify job still running: %+v", job)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestChecksums_RecordedOnUploadAndCarriedAlong(t *testing.T) {
+	c, mux := newUploadMux(t)
+	os.Mkdir(filepath.Join(c.DataDir, "docs"), 0755)
+	os.Mkdir(filepath.Join(c.DataDir, "old"), 0755)
+	multipartUpload(t, mux, "/docs", "a.txt", "alpha")
+
+	u := initUpload(t, mux, `{"path":"/docs","name":"b.txt","size":5}`)
+	do(t, mux, "PUT", "/api/upload/"+u.ID+"?offset=0", "bravo")
+	if w := do(t, mux, "POST", "/api/upload/"+u.ID+"/complete", ""); w.Code != http.StatusCreated {
+		t.Fatalf("complete: %d %s", w.Code, w.Body)
+	}
+	os.WriteFile(filepath.Join(c.DataDir, "docs", "c.txt"), []byte("charlie"), 0644)
+
+	want := map[string]string{"a.txt": sha("alpha"), "b.txt": sha("bravo"), "c.txt": ""}
+	if got := listedSums(t, mux, "/docs"); !maps.Equal(got, want) {
+		t.Fatalf("sums = %v, want %v", got, want)
+	}
+
+	if w := do(t, mux, "POST", "/api/move", `{"from":"/docs","to":"/old/docs"}`); w.Code != http.StatusOK {
+		t.Fatalf("move: %d %s", w.Code, w.Body)
+	}
+	if got := listedSums(t, mux, "/old/docs"); !maps.Equal(got, want) {
+		t.Errorf("after move = %v, want %v", got, want)
+	}
+
+	do(t, mux, "DELETE", "/api/delete?path=/old/docs/a.txt", "")
+	item := listTrash(t, mux).Items[0].Path
+	if _, ok := c.checksums().get(item); !ok {
+		t.Errorf("no checksum kept for trash item %s", item)
+	}
+	do(t, mux, "POST", "/api/trash/restore", `{"path":"`+item+`"}`)
+	if got := listedSums(t, mux, "/old/docs")["a.txt"]; got != sha("alpha") {
+		t.Errorf("after restore a.txt = %q", got)
+	}
+
+	// Editing a file outside the API hides its stale checksum.
+	os.WriteFile(filepath.Join(c.DataDir, "old", "docs", "b.txt"), []byte("bravo, edited"), 0644)
+	if got := listedSums(t, mux, "/old/docs")["b.txt"]; got != "" {
+		t.Errorf("edited b.txt = %q, want none", got)
+	}
+}
+
+func TestVerify_FlagsCorruptionNotEdits(t *testing.T) {
+	c, mux := newUploadMux(t)
+	os.Mkdir(filepath.Join(c.DataDir, "docs"), 0755)
+	for _, name := range []string{"good.txt", "rotten.txt", "edited.txt", "gone.txt"} {
+		multipartUpload(t, mux, "/docs", name, "contents of "+name)
+	}
+	os.WriteFile(filepath.Join(c.DataDir, "docs", "new.txt"), []byte("never uploaded"), 0644)
+	multipartUpload(t, mux, "/", "elsewhere.txt", "outside the folder")
+
+	// Bit rot: different bytes, same size and modification time.
+	rotten := filepath.Join(c.DataDir, "docs", "rotten.txt")
+	info := statOf(t, rotten)
+	os.WriteFile(rotten, []byte("contents of rotten.tx!"), 0644)
+	os.Chtimes(rotten, info.ModTime(), info.ModTime())
+
+	edited := filepath.Join(c.DataDir, "docs", "edited.txt")
+	os.WriteFile(edited, []byte("edited over Samba"), 0644)
+	os.Chtimes(edited, time.Now().Add(time.Hour), time.Now().Add(time.Hour))
+	os.Remove(filepath.Join(c.DataDir, "docs", "gone.txt"))
+
+	job := waitVerify(t, mux, startVerify(t, mux, "/docs").ID)
+	if job.State != "done" || job.Path != "/docs" || job.FilesTotal != 4 || job.FilesDone != 4 {
+		t.Fatalf("job = %+v", job)
+	}
+	if job.Verified != 1 || job.Recorded != 2 || job.Pruned != 1 || job.MismatchCount != 1 {
+		t.Errorf("verified %d, recorded %d, pruned %d, mismatches %d; want 1, 2, 1, 1",
+			job.Verified, job.Recorded, job.Pruned, job.MismatchCount)
+	}
+	want := VerifyMismatch{Path: "/docs/rotten.txt", Expected: sha("contents of rotten.txt"), Actual: sha("contents of rotten.tx!")}
+	if len(job.Mismatches) != 1 || job.Mismatches[0] != want {
+		t.Errorf("mismatches = %+v", job.Mismatches)
+	}
+	if job.BytesDone != job.BytesTotal || job.BytesTotal == 0 {
+		t.Errorf("bytes %d of %d", job.BytesDone, job.BytesTotal)
+	}
+
+	// The edit and the new file are recorded now; the rot is still reported.
+	sums := listedSums(t, mux, "/docs")
+	if sums["edited.txt"] != sha("edited over Samba") || sums["new.txt"] != sha("never uploaded") {
+		t.Errorf("sums after verify = %v", sums)
+	}
+	if _, ok := c.checksums().get("/elsewhere.txt"); !ok {
+		t.Error("verify of /docs pruned a checksum outside it")
+	}
+	again := waitVerify(t, mux, startVerify(t, mux, "/docs").ID)
+	if again.Verified != 3 || again.MismatchCount != 1 {
+		t.Errorf("second run: verified %d, mismatches %d; want 3, 1", again.Verified, again.MismatchCount)
+	}
+}
+
+func TestVerify_PacesReads(t *testing.T) {
+	c, mux := newUploadMux(t)
+	c.VerifyReadRate = 1000
+	multipartUpload(t, mux, "/", "a.bin", string(make([]byte, 200)))
+
+	start := time.Now()
+	job := waitVerify(t, mux, startVerify(t, mux, "/").ID)
+	if job.Verified != 1 {
+		t.Fatalf("job = %+v", job)
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("200 bytes at 1000 B/s took %v", elapsed)
+	}
+}
+
+func TestVerify_Validation(t *testing.T) {
+	c, mux := newUploadMux(t)
+	if w := do(t, mux, "POST", "/api/verify?path=/.trash", ""); w.Code != http.StatusForbidden {
+		t.Errorf("reserved path: %d", w.Code)
+	}
+	if w := do(t, mux, "POST", "/api/verify?path=/nope", ""); w.Code != http.StatusNotFound {
+		t.Errorf("missing path: %d", w.Code)
+	}
+	if w := do(t, mux, "GET", "/api/verify/nope", ""); w.Code != http.StatusNotFound {
+		t.Errorf("unknown job: %d", w.Code)
+	}
+
+	c.verify.jobs = map[string]*VerifyJob{"busy": {ID: "busy", State: "running"}}
+	if w := do(t, mux, "POST", "/api/verify?path=/", ""); w.Code != http.StatusConflict {
+		t.Errorf("second job: %d", w.Code)
+	}
+}
+
+func TestChecksums_SurviveRestart(t *testing.T) {
+	c, mux := newUploadMux(t)
+	multipartUpload(t, mux, "/", "a.txt", "alpha")
+
+	c2 := New(c.DataDir, 8080, true)
+	mux2 := http.NewServeMux()
+	c2.RegisterRoutes(mux2)
+	if got := listedSums(t, mux2, "/")["a.txt"]; got != sha("alpha") {
+		t.Errorf("after restart a.txt = %q", got)
+	}
+	if got := listedSums(t, mux2, "/"); len(got) != 1 {
+		t.Errorf(".checksums is listed: %v", got)
+	}
+}
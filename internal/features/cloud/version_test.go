@@ -0,0 +1,74 @@
+package cloud
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/strct-org/strct-agent/internal/httputil"
+)
+
+func TestStatus_LegacyAndV1FieldNames(t *testing.T) {
+	_, mux := newUploadMux(t)
+	h := httputil.Versioned(mux)
+
+	legacy := do(t, h, "GET", "/api/status", "").Body.String()
+	if !strings.Contains(legacy, `"isOnline":true`) {
+		t.Errorf("legacy status = %s", legacy)
+	}
+	v1 := do(t, h, "GET", "/api/v1/status", "").Body.String()
+	if !strings.Contains(v1, `"is_online":true`) || strings.Contains(v1, "isOnline") {
+		t.Errorf("v1 status = %s", v1)
+	}
+}
+
+func TestFiles_LegacyAndV1Shapes(t *testing.T) {
+	c, mux := newUploadMux(t)
+	h := httputil.Versioned(mux)
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		os.WriteFile(filepath.Join(c.DataDir, name), []byte(name), 0644)
+	}
+
+	var legacy map[string][]map[string]any
+	if err := json.Unmarshal(do(t, h, "GET", "/api/files?path=/", "").Body.Bytes(), &legacy); err != nil {
+		t.Fatal(err)
+	}
+	if len(legacy["files"]) != 3 || legacy["files"][0]["modifiedAt"] == nil {
+		t.Errorf("legacy files = %v", legacy)
+	}
+
+	w := do(t, h, "GET", "/api/v1/files?path=/&offset=1&limit=1", "")
+	var page httputil.Page[map[string]any]
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+		t.Fatalf("decode %s: %v", w.Body, err)
+	}
+	if len(page.Items) != 1 || page.Items[0]["name"] != "b.txt" || page.Items[0]["modified_at"] == nil {
+		t.Errorf("v1 items = %v", page.Items)
+	}
+	if page.Pagination != (httputil.Pagination{Offset: 1, Limit: 1, Total: 3}) {
+		t.Errorf("v1 pagination = %+v", page.Pagination)
+	}
+
+	if w := do(t, h, "GET", "/api/v1/files?path=/&limit=0", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("limit=0: got %d, want 400", w.Code)
+	}
+}
+
+// TestV1Types_SnakeCase catches a camelCase tag creeping into a v1 shape.
+func TestV1Types_SnakeCase(t *testing.T) {
+	snake := regexp.MustCompile(`^[a-z0-9_]+$`)
+	for _, v := range []any{StatusResponse{}, FileItem{}, Upload{}, VerifyJob{}, VerifyMismatch{}, httputil.Pagination{}} {
+		typ := reflect.TypeOf(v)
+		for i := 0; i < typ.NumField(); i++ {
+			name, _, _ := strings.Cut(typ.Field(i).Tag.Get("json"), ",")
+			if name != "-" && !snake.MatchString(name) {
+				t.Errorf("%s.%s: json name %q is not snake_case", typ.Name(), typ.Field(i).Name, name)
+			}
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package monitor
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/strct-org/strct-agent/internal/config"
+)
+
+// DNS latency. Slow lookups make browsing feel broken while pings and the
+// speedtest look fine, so each ping round also times a lookup of one of
+// dnsTimedNames, taken in turn so they aren't all in the cache, against:
+//
+//   - dnsmasq at the AP gateway from wifi.Status, while the AP is up. It is
+//     asked twice: the first lookup is usually a cache miss that goes
+//     upstream, the second is answered from dnsmasq's cache, and the gap
+//     is what the cache saves;
+//   - the upstream (DNSUpstream: MONITOR_DNS_UPSTREAM, 1.1.1.1 by
+//     default), once.
+//
+// The round's lookups are MonitorStats.DNS. DNSLatency is the first lookup
+// at dnsmasq, or at the upstream without an AP: roughly what a client waits
+// for a name it hasn't looked up lately. SERVFAIL answers and failed
+// lookups are counted per server from the start. DNS is healthy when that
+// lookup got an answer within dnsSlow. (dnsProbeName in targets.go only
+// tells whether the system resolver answers at all.)
+const (
+	dnsTimeout = 2 * time.Second
+	dnsSlow    = 500 * time.Millisecond
+)
+
+var dnsTimedNames = []string{
+	"www.google.com",
+	"www.wikipedia.org",
+	"www.cloudflare.com",
+	"www.apple.com",
+	"www.microsoft.com",
+	"www.amazon.com",
+	"www.youtube.com",
+	"www.github.com",
+}
+
+// DNSStats is a round's lookups.
+type DNSStats struct {
+	Name     string       `json:"name"`
+	Local    *DNSResolver `json:"local,omitempty"` // dnsmasq; nil without an AP
+	Upstream *DNSResolver `json:"upstream"`
+	Healthy  bool         `json:"healthy"`
+}
+
+// DNSResolver is one server's lookups in a round, and its counts so far.
+type DNSResolver struct {
+	Server    string   `json:"server"`
+	Latency   *float64 `json:"latency_ms,omitempty"`        // the first lookup
+	Cached    *float64 `json:"cached_latency_ms,omitempty"` // the repeat; dnsmasq only
+	Rcode     string   `json:"rcode,omitempty"`             // NOERROR, NXDOMAIN, SERVFAIL…
+	Error     string   `json:"error,omitempty"`
+	ServFails uint64   `json:"servfails"`
+	Failures  uint64   `json:"failures"` // timeouts and unreachable
+}
+
+// dnsCounts are a server's running totals.
+type dnsCounts struct{ servfails, failures uint64 }
+
+type dnsTiming struct {
+	mu     sync.Mutex
+	next   int // into dnsTimedNames
+	counts map[string]*dnsCounts
+}
+
+// exchangeDNS asks server (host:port) for name's A record.
+func exchangeDNS(ctx context.Context, server, name string) (rcode int, rtt time.Duration, err error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(name), dns.TypeA)
+	c := &dns.Client{Net: "udp", Timeout: dnsTimeout}
+	resp, rtt, err := c.ExchangeContext(ctx, msg, server)
+	if err != nil {
+		return 0, rtt, err
+	}
+	return resp.Rcode, rtt, nil
+}
+
+// timeDNS runs a round's lookups.
+func (m *NetworkMonitor) timeDNS() *DNSStats {
+	p := &m.dnsTiming
+	p.mu.Lock()
+	name := dnsTimedNames[p.next%len(dnsTimedNames)]
+	p.next++
+	p.mu.Unlock()
+
+	st := &DNSStats{Name: name}
+	var wg sync.WaitGroup
+	if m.wifi != nil {
+		if ws := m.wifi.Status(); ws.Active && ws.GatewayIP != "" {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				st.Local = m.lookupAt(ws.GatewayIP, name, true)
+			}()
+		}
+	}
+	upstream := m.Config.DNSUpstream
+	if upstream == "" {
+		upstream = config.DefaultMonitorDNSUpstream
+	}
+	st.Upstream = m.lookupAt(upstream, name, false)
+	wg.Wait()
+
+	lat := st.latency()
+	st.Healthy = lat != nil && *lat <= float64(dnsSlow/time.Millisecond)
+	return st
+}
+
+// latency is the first lookup at dnsmasq, or at the upstream without an
+// AP; nil when it failed or got SERVFAIL.
+func (st *DNSStats) latency() *float64 {
+	if st.Local != nil {
+		return st.Local.Latency
+	}
+	return st.Upstream.Latency
+}
+
+// lookupAt asks server for name, and again when repeat is set to time a
+// cached answer.
+func (m *NetworkMonitor) lookupAt(server, name string, repeat bool) *DNSResolver {
+	r := &DNSResolver{Server: server}
+	addr := net.JoinHostPort(server, "53")
+	ctx, cancel := context.WithTimeout(context.Background(), 2*dnsTimeout)
+	defer cancel()
+
+	rcode, rtt, err := m.exchangeDNS(ctx, addr, name)
+	if err == nil {
+		r.Rcode = dns.RcodeToString[rcode]
+		if rcode != dns.RcodeServerFailure {
+			r.Latency = millis(rtt)
+		}
+		if repeat && rcode != dns.RcodeServerFailure {
+			if _, rtt, err := m.exchangeDNS(ctx, addr, name); err == nil {
+				r.Cached = millis(rtt)
+			}
+		}
+	} else {
+		r.Error = err.Error()
+	}
+
+	p := &m.dnsTiming
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.counts == nil {
+		p.counts = map[string]*dnsCounts{}
+	}
+	c := p.counts[server]
+	if c == nil {
+		c = &dnsCounts{}
+		p.counts[server] = c
+	}
+	switch {
+	case err != nil:
+		c.failures++
+	case rcode == dns.RcodeServerFailure:
+		c.servfails++
+	}
+	r.ServFails, r.Failures = c.servfails, c.failures
+	return r
+}
+
+func millis(d time.Duration) *float64 {
+	v := float64(d.Microseconds()) / 1000
+	return &v
+}
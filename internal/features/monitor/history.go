@@ -0,0 +1,356 @@
+package monitor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/store"
+)
+
+// History of ping and bandwidth samples, so the dashboard can draw graphs
+// without the backend:
+//
+//	GET /api/network/history?metric=latency&from=2026-10-01T00:00:00Z&to=…&resolution=5m
+//
+// hop_latency is the learned hop's of hops.go; role= keeps only the
+// samples taken with that role, e.g. upstream_ap while in extender mode.
+//
+// Samples are kept in memory for historyRetention and appended to the
+// monitor-history log of internal/store as they are taken; Start reads it
+// back. Expired samples are pruned from the log about every
+// historyPruneEvery, and once it passes historyMaxBytes the oldest are
+// dropped until it is half that, so it never grows much past the cap.
+// The monitor.db of older agents, one sample per line, is imported once.
+const (
+	historyLog        = "monitor-history"
+	legacyHistoryFile = "monitor.db"
+	historyRetention  = 7 * 24 * time.Hour
+	historyPruneEvery = time.Hour
+	historyMaxBytes   = 1 << 20
+	maxHistorySamples = 20000 // a ping every 2 min for 7 days is ~5000
+	maxHistoryPoints  = 2000
+	defaultResolution = 5 * time.Minute
+)
+
+// Metrics GET /api/network/history serves.
+const (
+	metricLatency   = "latency"     // ms
+	metricLoss      = "loss"        // %
+	metricBandwidth = "bandwidth"   // Mbps
+	metricHop       = "hop_latency" // ms
+)
+
+var historyMetrics = []string{metricLatency, metricLoss, metricBandwidth, metricHop}
+
+// sample is one record of the history: a ping or a speedtest.
+type sample struct {
+	T    int64    `json:"t"` // Unix seconds
+	Lat  *float64 `json:"lat,omitempty"`
+	Loss *float64 `json:"loss,omitempty"`
+	Down bool     `json:"down,omitempty"`
+	Mbps *float64 `json:"mbps,omitempty"`
+	Hop  *float64 `json:"hop,omitempty"`  // the learned hop's latency
+	Role string   `json:"role,omitempty"` // the hop's role
+}
+
+func (s sample) value(metric string) *float64 {
+	switch metric {
+	case metricLatency:
+		return s.Lat
+	case metricLoss:
+		return s.Loss
+	case metricBandwidth:
+		return s.Mbps
+	case metricHop:
+		return s.Hop
+	}
+	return nil
+}
+
+// HistoryPoint is one bucket of a downsampled metric.
+type HistoryPoint struct {
+	Time    time.Time `json:"t"` // start of the bucket
+	Avg     float64   `json:"avg"`
+	Min     float64   `json:"min"`
+	Max     float64   `json:"max"`
+	Samples int       `json:"samples"`
+}
+
+type history struct {
+	mu      sync.Mutex
+	dir     string // "": memory only
+	backend string // STORE_BACKEND
+	log     store.Log
+	opened  bool
+	samples []sample // oldest first
+	pruned  int64    // the log holds nothing older
+}
+
+// openLocked opens the log on first use, importing monitor.db.
+func (h *history) openLocked() store.Log {
+	if h.opened || h.dir == "" {
+		return h.log
+	}
+	h.opened = true
+	l, err := store.Open(h.backend, h.dir, historyLog)
+	if err != nil {
+		slog.Warn("monitor: could not open history, keeping it in memory", "err", err)
+		return nil
+	}
+	n, err := store.Import(l, filepath.Join(h.dir, legacyHistoryFile), decodeLegacyHistory)
+	if err != nil {
+		slog.Warn("monitor: could not import monitor.db", "err", err)
+	} else if n > 0 {
+		slog.Info("monitor: imported monitor.db", "samples", n)
+	}
+	h.log = l
+	return l
+}
+
+// decodeLegacyHistory reads monitor.db. A line cut short by a power loss
+// doesn't parse and is dropped.
+func decodeLegacyHistory(b []byte) ([]store.Record, error) {
+	var recs []store.Record
+	for _, line := range bytes.Split(b, []byte{'\n'}) {
+		var s sample
+		if len(line) == 0 || json.Unmarshal(line, &s) != nil {
+			continue
+		}
+		recs = append(recs, store.Record{Key: s.T, Data: append(json.RawMessage(nil), line...)})
+	}
+	return recs, nil
+}
+
+// load reads the log back, dropping samples older than the retention.
+func (h *history) load(now time.Time) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	l := h.openLocked()
+	if l == nil {
+		return nil
+	}
+	cutoff := now.Add(-historyRetention).Unix()
+	if err := l.PruneBefore(cutoff); err != nil {
+		return err
+	}
+	h.pruned = cutoff
+	var loaded []sample
+	err := l.Range(cutoff, math.MaxInt64, func(r store.Record) bool {
+		var s sample
+		if json.Unmarshal(r.Data, &s) == nil {
+			loaded = append(loaded, s)
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	// Samples added before load are in the log too.
+	h.samples = loaded
+	h.trimLocked(cutoff)
+	return h.capLocked(l)
+}
+
+// add keeps s and appends it to the log.
+func (h *history) add(s sample) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.samples = append(h.samples, s)
+	h.trimLocked(s.T - int64(historyRetention/time.Second))
+	l := h.openLocked()
+	if l == nil {
+		return
+	}
+	data, err := json.Marshal(s)
+	if err == nil {
+		err = l.Append(store.Record{Key: s.T, Data: data})
+	}
+	if err != nil {
+		slog.Warn("monitor: could not write history", "err", err)
+		return
+	}
+	if oldest := h.samples[0].T; oldest-h.pruned >= int64(historyPruneEvery/time.Second) {
+		if err := l.PruneBefore(oldest); err != nil {
+			slog.Warn("monitor: could not prune history", "err", err)
+		}
+		h.pruned = oldest
+	}
+	if err := h.capLocked(l); err != nil {
+		slog.Warn("monitor: could not shrink history", "err", err)
+	}
+}
+
+// trimLocked drops samples before cutoff and any past maxHistorySamples.
+func (h *history) trimLocked(cutoff int64) {
+	i := 0
+	for i < len(h.samples) && h.samples[i].T < cutoff {
+		i++
+	}
+	if n := len(h.samples) - i; n > maxHistorySamples {
+		i += n - maxHistorySamples
+	}
+	if i > 0 {
+		h.samples = append(h.samples[:0], h.samples[i:]...)
+	}
+}
+
+// capLocked keeps the log under historyMaxBytes: compacted first, and if
+// that isn't enough, down to about half the cap by dropping the oldest
+// samples, so appends run a while before the next time.
+func (h *history) capLocked(l store.Log) error {
+	st := l.Stats()
+	if st.Bytes <= historyMaxBytes {
+		return nil
+	}
+	if st.Dead > 0 {
+		if err := l.Compact(); err != nil {
+			return err
+		}
+		if st = l.Stats(); st.Bytes <= historyMaxBytes {
+			return nil
+		}
+	}
+	keep := max(int(int64(st.Records)*historyMaxBytes/2/st.Bytes), 1)
+	if keep < len(h.samples) {
+		cut := h.samples[len(h.samples)-keep].T
+		if err := l.PruneBefore(cut); err != nil {
+			return err
+		}
+		h.pruned = max(h.pruned, cut)
+		h.trimLocked(cut)
+	}
+	return l.Compact()
+}
+
+// latest returns the newest ping and speedtest samples, for the stats
+// after a restart.
+func (h *history) latest() (ping, bandwidth *sample) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i := len(h.samples) - 1; i >= 0 && (ping == nil || bandwidth == nil); i-- {
+		s := h.samples[i]
+		if ping == nil && s.Lat != nil {
+			ping = &s
+		}
+		if bandwidth == nil && s.Mbps != nil {
+			bandwidth = &s
+		}
+	}
+	return ping, bandwidth
+}
+
+// query downsamples metric between from and to into buckets of res,
+// aligned to multiples of res since the Unix epoch, keeping only the
+// samples of role unless it is "". Empty buckets are left out.
+func (h *history) query(metric, role string, from, to time.Time, res time.Duration) []HistoryPoint {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	step := int64(res / time.Second)
+	out := []HistoryPoint{}
+	for _, s := range h.samples {
+		v := s.value(metric)
+		if v == nil || s.T < from.Unix() || s.T >= to.Unix() || (role != "" && s.Role != role) {
+			continue
+		}
+		start := time.Unix(s.T-s.T%step, 0).UTC()
+		if n := len(out); n > 0 && out[n-1].Time.Equal(start) {
+			p := &out[n-1]
+			p.Avg += (*v - p.Avg) / float64(p.Samples+1)
+			p.Min = math.Min(p.Min, *v)
+			p.Max = math.Max(p.Max, *v)
+			p.Samples++
+			continue
+		}
+		out = append(out, HistoryPoint{Time: start, Avg: *v, Min: *v, Max: *v, Samples: 1})
+	}
+	return out
+}
+
+// parseTime accepts RFC 3339 or Unix seconds.
+func parseTime(name, raw string) (time.Time, error) {
+	if secs, err := strconv.ParseInt(raw, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s must be RFC 3339 or Unix seconds", name)
+	}
+	return t, nil
+}
+
+// HandleHistory serves a metric's history, downsampled.
+// GET /api/network/history?metric=latency|loss|bandwidth|hop_latency&role=&from=&to=&resolution=5m
+// from defaults to a day before to, to to now.
+func (m *NetworkMonitor) HandleHistory(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	metric := q.Get("metric")
+	if metric == "" {
+		metric = metricLatency
+	}
+	if !slices.Contains(historyMetrics, metric) {
+		http.Error(w, "metric must be latency, loss, bandwidth or hop_latency", http.StatusBadRequest)
+		return
+	}
+	role := q.Get("role")
+	if role != "" && !slices.Contains(hopRoles, role) {
+		http.Error(w, "role must be upstream_ap or wan_hop", http.StatusBadRequest)
+		return
+	}
+
+	to := time.Now()
+	if raw := q.Get("to"); raw != "" {
+		t, err := parseTime("to", raw)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		to = t
+	}
+	from := to.Add(-24 * time.Hour)
+	if raw := q.Get("from"); raw != "" {
+		t, err := parseTime("from", raw)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		from = t
+	}
+	if !from.Before(to) {
+		http.Error(w, "from must be before to", http.StatusBadRequest)
+		return
+	}
+
+	res := defaultResolution
+	if raw := q.Get("resolution"); raw != "" {
+		d, err := time.ParseDuration(raw)
+		if err != nil || d < time.Minute || d%time.Second != 0 {
+			http.Error(w, "resolution must be a duration of at least 1m", http.StatusBadRequest)
+			return
+		}
+		res = d
+	}
+	if to.Sub(from)/res > maxHistoryPoints {
+		http.Error(w, fmt.Sprintf("from–to spans more than %d points at this resolution; raise it", maxHistoryPoints),
+			http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"metric":     metric,
+		"role":       role,
+		"from":       from.UTC(),
+		"to":         to.UTC(),
+		"resolution": int64(res / time.Second),
+		"points":     m.history.query(metric, role, from, to, res),
+	})
+}
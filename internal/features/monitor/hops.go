@@ -0,0 +1,114 @@
+package monitor
+
+import (
+	"log/slog"
+	"slices"
+
+	wifi_feature "github.com/strct-org/strct-agent/internal/features/wifi"
+)
+
+// Learned hops. The targets a user sets are the same in every wifi mode,
+// but the hop worth watching besides the internet depends on the mode: in
+// extender mode the upstream AP wlan0 joined, whose signal or busy channel
+// is the usual reason things are slow, and in router mode eth0's next hop,
+// the ISP router. UseWiFi subscribes to wifi's applies, and each round
+// re-reads wifi.Status as well, so the monitor pings the hop of the mode
+// it is in:
+//
+//   - extender: upstream_ap, the next hop of wlan0's default route, which
+//     dhclient sets from its lease;
+//   - router: wan_hop, the next hop of eth0's default route.
+//
+// Hops are pinged with the other targets and reported with Auto set and
+// their role; they are dropped when the mode changes again, and
+// POST /api/network/targets neither lists nor takes them. Their latency
+// goes into the history as hop_latency, tagged with the role. summarize
+// treats them like the gateway target: a hop that doesn't answer is
+// diagLANDown, or diagUpstreamAPDown for the upstream AP.
+//
+// Every target has a role, in TargetStats.Role:
+const (
+	roleInternet   = "internet"
+	roleGateway    = "gateway"     // the "gateway" target
+	roleUpstreamAP = "upstream_ap" // learned, extender mode
+	roleWANHop     = "wan_hop"     // learned, router mode
+)
+
+var hopRoles = []string{roleUpstreamAP, roleWANHop}
+
+// hop is a learned target: its role and the interface whose default route
+// leads to it.
+type hop struct {
+	role  string
+	iface string
+}
+
+// hopsFor is the hops to ping in st's mode.
+func hopsFor(st wifi_feature.Status) []hop {
+	switch st.Mode {
+	case wifi_feature.ModeExtender:
+		return []hop{{roleUpstreamAP, extenderWANIface}}
+	case wifi_feature.ModeRouter:
+		return []hop{{roleWANHop, wanIface}}
+	}
+	return nil
+}
+
+// syncHops picks the hops for wifi's mode now and returns them.
+func (m *NetworkMonitor) syncHops() []hop {
+	var hops []hop
+	if m.wifi != nil {
+		hops = hopsFor(m.wifi.Status())
+	}
+	m.mu.Lock()
+	old := m.hops
+	m.hops = hops
+	m.mu.Unlock()
+	if !slices.Equal(old, hops) {
+		slog.Info("monitor: learned targets changed", "from", hopNames(old), "to", hopNames(hops))
+	}
+	return hops
+}
+
+func (m *NetworkMonitor) currentHops() []hop {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]hop(nil), m.hops...)
+}
+
+// wifiApplied is wifi's OnApply hook. It runs on wifi's goroutine and must
+// not block, so it only wakes the monitor's loop, which re-reads the mode
+// and runs a round if the hops changed.
+func (m *NetworkMonitor) wifiApplied() {
+	select {
+	case m.hopKick <- struct{}{}:
+	default:
+	}
+}
+
+// hopsChanged is the loop's side of wifiApplied.
+func (m *NetworkMonitor) hopsChanged() {
+	if old := m.currentHops(); !slices.Equal(old, m.syncHops()) {
+		m.runPing()
+	}
+}
+
+func hopNames(hops []hop) []string {
+	names := []string{}
+	for _, h := range hops {
+		names = append(names, h.role)
+	}
+	return names
+}
+
+// pingHop pings the next hop of h's interface.
+func (m *NetworkMonitor) pingHop(h hop) TargetStats {
+	ts := TargetStats{Target: h.role, Role: h.role, Auto: true, IsDown: true}
+	addr, err := defaultGateway(m.routeFile, h.iface)
+	if err != nil {
+		ts.Error = err.Error()
+		return ts
+	}
+	ts.Address = addr
+	return m.pingAddr(ts, addr)
+}
@@ -1,33 +1,77 @@
 package monitor
 
 import (
-	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
-	"io"
 	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"path/filepath"
 	"sync"
 	"time"
 
-	ping "github.com/prometheus-community/pro-bing"
+	"github.com/strct-org/strct-agent/internal/agent"
 	"github.com/strct-org/strct-agent/internal/config"
+	"github.com/strct-org/strct-agent/internal/events"
+	"github.com/strct-org/strct-agent/internal/maintenance"
+	"github.com/strct-org/strct-agent/internal/resources"
 )
 
+// usage accounts monitor background work for /api/system/resources.
+var usage = resources.For("monitor")
+
 type MonitorConfig struct {
 	DeviceID   string
 	BackendURL string
 	AuthToken  string
+
+	// Speedtest settings, see speedtest.go. Zero durations and counts
+	// take the config defaults.
+	SpeedtestURLs        []string
+	SpeedtestUploadURL   string
+	SpeedtestDuration    time.Duration
+	SpeedtestConnections int
+
+	// ReportInterval is how often queued samples are sent to the
+	// backend; see report.go. Zero takes the config default.
+	ReportInterval time.Duration
+
+	// DNSUpstream is the resolver timed next to the AP's dnsmasq; see
+	// dns.go. Empty takes the config default.
+	DNSUpstream string
 }
 
 type NetworkMonitor struct {
 	Config          MonitorConfig
 	stats           MonitorStats
 	mu              sync.RWMutex
-	Target          string
+	targets         []string      // see targets.go
+	defaults        []string      // what an empty target list means
+	hops            []hop         // see hops.go
+	hopKick         chan struct{} // wifi applied
+	targetsPath     string        // "": not saved
+	ping            func(addr string) (*MonitorStats, error)
+	newPinger       func(addr string) (pinger, error) // see probe.go
+	dialTCP         func(ctx context.Context, network, addr string) (net.Conn, error)
+	methodMu        sync.Mutex
+	method          string // the ping method rounds start with
+	lookupHost      func(ctx context.Context, host string) ([]string, error)
+	routeFile       string
 	client          *http.Client
 	bandwidthClient *http.Client
+	gate            *maintenance.Gate // nil: never paused
+	history         history           // see history.go
+	outages         outageLog         // see outages.go
+	throughput      throughput        // see throughput.go
+	reports         reportQueue       // see report.go
+	dnsTiming       dnsTiming         // see dns.go
+	exchangeDNS     func(ctx context.Context, server, name string) (rcode int, rtt time.Duration, err error)
+	readNetDev      func() ([]byte, error)
+	wifi            wifiStatus // nil: eth0 only
+	events          events.Publisher
 }
 
 type MonitorStats struct {
@@ -36,12 +80,40 @@ type MonitorStats struct {
 	Loss      *float64  `json:"loss,omitempty"`      // %
 	Bandwidth *float64  `json:"bandwidth,omitempty"` // Pointer to Mbps
 	IsDown    *bool     `json:"is_down,omitempty"`
+	Method    string    `json:"method,omitempty"` // how targets are pinged: icmp, udp or tcp
+
+	// Upload is the upload speed in Mbps, measured only with a
+	// SpeedtestUploadURL. SpeedtestDuration is how long the last
+	// speedtest ran, in seconds.
+	Upload            *float64 `json:"upload,omitempty"`
+	SpeedtestDuration *float64 `json:"speedtest_duration,omitempty"`
+
+	// Targets has each ping target's result; the fields above sum up the
+	// internet ones. Diagnosis is one of the diag* values in targets.go.
+	Targets   []TargetStats `json:"targets,omitempty"`
+	Diagnosis string        `json:"diagnosis,omitempty"`
+
+	// Uptime is the % of the last 30 days with internet and Outage the
+	// outage going on now; see outages.go. Only /api/network/stats fills
+	// them in.
+	Uptime *float64 `json:"uptime,omitempty"`
+	Outage *Outage  `json:"outage,omitempty"`
+
+	// Throughput is the WAN and AP traffic now, from the interface
+	// counters; see throughput.go. Reports and /api/network/stats carry it.
+	Throughput *Throughput `json:"throughput,omitempty"`
+
+	// DNSLatency is how long a client waits for a name it hasn't looked
+	// up lately, in ms, and DNS the lookups behind it; see dns.go.
+	DNSLatency *float64  `json:"dns_latency_ms,omitempty"`
+	DNS        *DNSStats `json:"dns,omitempty"`
 }
 
 func New(cfg MonitorConfig) *NetworkMonitor {
-	return &NetworkMonitor{
-		Target: "8.8.8.8",
-		Config: cfg,
+	m := &NetworkMonitor{
+		targets:  append([]string(nil), defaultTargets...),
+		defaults: defaultTargets,
+		Config:   cfg,
 		client: &http.Client{
 			Timeout: 10 * time.Second,
 			Transport: &http.Transport{
@@ -52,34 +124,86 @@ func New(cfg MonitorConfig) *NetworkMonitor {
 		bandwidthClient: &http.Client{
 			Timeout: 90 * time.Second,
 			Transport: &http.Transport{
-				MaxIdleConnsPerHost: 1,
+				MaxIdleConnsPerHost: config.MaxSpeedtestConnections,
 				IdleConnTimeout:     30 * time.Second,
+				// HTTP/1.1 only: over HTTP/2 the parallel requests would
+				// share one connection.
+				TLSNextProto: map[string]func(string, *tls.Conn) http.RoundTripper{},
 			},
 		},
 	}
+	m.ping = m.probe
+	m.newPinger = newProBing
+	m.dialTCP = (&net.Dialer{}).DialContext
+	m.method = methodICMP
+	m.readNetDev = func() ([]byte, error) { return os.ReadFile(netDevPath) }
+	m.lookupHost = net.DefaultResolver.LookupHost
+	m.exchangeDNS = exchangeDNS
+	m.routeFile = routeFile
+	m.reports.kick = make(chan struct{}, 1)
+	m.hopKick = make(chan struct{}, 1)
+	m.events = events.Discard
+	return m
 }
 
-func NewFromConfig(cfg *config.Config) *NetworkMonitor {
-	return New(MonitorConfig{
+// NewFromConfig is the agent's monitor. Outages opening and closing are
+// published to pub as events.OutageStarted and events.OutageEnded.
+func NewFromConfig(cfg *config.Config, gate *maintenance.Gate, pub events.Publisher) *NetworkMonitor {
+	m := New(MonitorConfig{
 		DeviceID:   cfg.DeviceID,
 		BackendURL: cfg.EffectiveBackendURL(),
-		AuthToken:  cfg.AuthToken,
+		AuthToken:  cfg.Secret(config.SecretAuthToken),
+
+		SpeedtestURLs:        cfg.SpeedtestURLs,
+		SpeedtestUploadURL:   cfg.SpeedtestUploadURL,
+		SpeedtestDuration:    time.Duration(cfg.SpeedtestSeconds) * time.Second,
+		SpeedtestConnections: cfg.SpeedtestConnections,
+
+		ReportInterval: time.Duration(cfg.MonitorReportMinutes) * time.Minute,
+		DNSUpstream:    cfg.MonitorDNSUpstream,
 	})
+	m.gate = gate
+	m.events = pub
+	if targets := configuredTargets(cfg.MonitorTargets); len(targets) > 0 {
+		m.defaults, m.targets = targets, append([]string(nil), targets...)
+	}
+	if cfg.IsDev {
+		m.readNetDev = devNetDev(time.Now())
+	}
+	m.history.dir, m.history.backend = cfg.DataDir, cfg.StoreBackend
+	m.targetsPath = filepath.Join(cfg.DataDir, targetsFile)
+	m.outages.path = filepath.Join(cfg.DataDir, outagesFile)
+	m.reports.dir, m.reports.backend = cfg.DataDir, cfg.StoreBackend
+	return m
 }
 
 func (m *NetworkMonitor) RegisterRoutes(mux *http.ServeMux) {
 	mux.HandleFunc("GET /api/network/stats", m.HandleStats)
 	mux.HandleFunc("POST /api/network/speedtest", m.HandleSpeedtest)
+	mux.HandleFunc("GET /api/network/history", m.HandleHistory)
+	mux.HandleFunc("GET /api/network/targets", m.HandleGetTargets)
+	mux.HandleFunc("POST /api/network/targets", m.HandleSetTargets)
+	mux.HandleFunc("GET /api/network/outages", m.HandleOutages)
+	mux.HandleFunc("GET /api/network/throughput", m.HandleThroughput)
+	mux.HandleFunc("GET /api/network/report-status", m.HandleReportStatus)
 }
 
 func (m *NetworkMonitor) Start(ctx context.Context) error {
-	slog.Info("monitor: starting", "target", m.Target)
+	if err := m.loadTargets(); err != nil {
+		slog.Warn("monitor: using the default ping targets", "err", err)
+	}
+	slog.Info("monitor: starting", "targets", m.currentTargets())
+	m.restoreHistory()
+	m.restoreOutages()
+	m.restoreReports()
 
 	// Run immediately on start, then on schedule
 	m.runPing()
-	m.runBandwidth()
+	m.runBandwidth(ctx, m.defaultOpts())
+	usage.Go(func() { m.runThroughput(ctx) })
+	usage.Go(func() { m.runReports(ctx) })
 
-	go func() {
+	usage.Go(func() {
 		latencyTicker := time.NewTicker(120 * time.Second)
 		bandwidthTicker := time.NewTicker(2 * time.Hour)
 		defer latencyTicker.Stop()
@@ -93,58 +217,84 @@ func (m *NetworkMonitor) Start(ctx context.Context) error {
 			case <-latencyTicker.C:
 				m.runPing()
 			case <-bandwidthTicker.C:
-				m.runBandwidth()
+				m.runBandwidth(ctx, m.defaultOpts())
+			case <-m.hopKick:
+				m.hopsChanged()
 			}
 		}
-	}()
+	})
 
 	return nil
 }
 
 func (m *NetworkMonitor) HandleStats(w http.ResponseWriter, r *http.Request) {
 	m.mu.RLock()
-	defer m.mu.RUnlock()
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(m.stats)
-}
+	stats := m.stats
+	m.mu.RUnlock()
 
-func (m *NetworkMonitor) HandleSpeedtest(w http.ResponseWriter, r *http.Request) {
-	slog.Info("monitor: Triggered via API")
-
-	go func() {
-		m.runPing()
-		m.runBandwidth()
-	}()
+	now := time.Now()
+	_, _, stats.Uptime = m.outages.window(now, uptimeWindowDays*24*time.Hour)
+	stats.Outage = m.outages.current(now)
+	stats.Throughput = m.throughput.current()
 
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"status": "speedtest_initiated"})
+	json.NewEncoder(w).Encode(stats)
 }
 
 func (m *NetworkMonitor) runPing() {
+	defer usage.Time()()
 	slog.Info("runPing")
 
-	stats, err := m.pingTarget()
-	if err != nil {
-		slog.Error("monitor: ping failed", "err", err)
-		return
+	dnsDone := make(chan *DNSStats, 1)
+	go func() { dnsDone <- m.timeDNS() }()
+	results, dnsOK := m.pingAll(m.currentTargets(), m.syncHops())
+	dns := <-dnsDone
+	for _, r := range results {
+		if r.Error != "" {
+			slog.Warn("monitor: ping failed", "target", r.Target, "err", r.Error)
+		}
 	}
+	latency, loss, down, diagnosis := summarize(results, dnsOK)
+	stats := MonitorStats{Latency: latency, Loss: loss, IsDown: &down, Targets: results, Diagnosis: diagnosis,
+		Method: m.pingMethod(), DNS: dns, DNSLatency: dns.latency()}
 
+	now := time.Now()
 	m.mu.Lock()
 	m.stats.Latency = stats.Latency
 	m.stats.Loss = stats.Loss
 	m.stats.IsDown = stats.IsDown
-	m.stats.Timestamp = time.Now()
+	m.stats.Targets = stats.Targets
+	m.stats.Diagnosis = stats.Diagnosis
+	m.stats.Method = stats.Method
+	m.stats.DNS = stats.DNS
+	m.stats.DNSLatency = stats.DNSLatency
+	m.stats.Timestamp = now
 	m.mu.Unlock()
+	s := sample{T: now.Unix(), Lat: stats.Latency, Loss: stats.Loss, Down: down}
+	for _, r := range results {
+		if r.Auto && !r.IsDown {
+			s.Hop, s.Role = r.Latency, r.Role
+			break
+		}
+	}
+	m.history.add(s)
+	m.trackOutage(now, down, diagnosis)
 
-	go m.reportToBackend(*stats)
+	m.reportToBackend(stats)
 }
 
-func (m *NetworkMonitor) runBandwidth() {
+// runBandwidth runs a speedtest unless maintenance mode holds speedtests;
+// switching maintenance on mid-test aborts it.
+func (m *NetworkMonitor) runBandwidth(ctx context.Context, o speedtestOpts) {
+	ctx, done, err := m.gate.Begin(ctx, maintenance.JobSpeedtest)
+	if err != nil {
+		return
+	}
+	defer done()
+	defer usage.Time()()
 	slog.Info("runBandwidth")
 
-	stats, err := m.getBandwidth()
+	stats, err := m.getBandwidth(ctx, o)
 	if err != nil {
 		slog.Error("monitor: bandwidth failed", "err", err)
 
@@ -153,125 +303,66 @@ func (m *NetworkMonitor) runBandwidth() {
 
 	m.mu.Lock()
 	m.stats.Bandwidth = stats.Bandwidth
+	m.stats.Upload = stats.Upload
+	m.stats.SpeedtestDuration = stats.SpeedtestDuration
 	m.mu.Unlock()
+	m.history.add(sample{T: time.Now().Unix(), Mbps: stats.Bandwidth})
 
-	go m.reportToBackend(*stats)
-
+	m.reportToBackend(*stats)
 }
 
-func (m *NetworkMonitor) reportToBackend(stats MonitorStats) {
-	stats.Timestamp = time.Now()
-
-	payload, err := json.Marshal(stats)
-	if err != nil {
-		slog.Error("monitor: failed to marshal stats", "err", err)
-		return
-	}
-
-	url := fmt.Sprintf("%s/api/v1/device/agent/%s/network_metrics", m.Config.BackendURL, m.Config.DeviceID)
-
-	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(payload))
-	if err != nil {
-		slog.Error("monitor: failed to build request", "url", url, "err", err)
-		return
+// restoreHistory loads the history and puts its newest readings back in
+// the stats, so a restart doesn't blank them until the next ping.
+func (m *NetworkMonitor) restoreHistory() {
+	if err := m.history.load(time.Now()); err != nil {
+		slog.Warn("monitor: could not load history", "err", err)
 	}
-
-	req.Header.Set("Content-Type", "application/json")
-	// req.Header.Set("Authorization", "Bearer "+m.Config.AuthToken) //! the auth token is for the frp tunnel, not the API auth middleware
-	//! maybe auth the users into the device to have access to the token
-
-	resp, err := m.client.Do(req)
-	if err != nil {
-		slog.Error("monitor: report upload failed", "err", err)
-		return
+	ping, bw := m.history.latest()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if ping != nil {
+		m.stats.Timestamp = time.Unix(ping.T, 0)
+		m.stats.Latency, m.stats.Loss = ping.Lat, ping.Loss
+		m.stats.IsDown = &ping.Down
 	}
-	defer resp.Body.Close()
-	// Drain body so the connection is returned to the pool immediately.
-	// Without this, the transport holds the connection open until GC.
-	io.Copy(io.Discard, resp.Body)
-
-	if resp.StatusCode >= 400 {
-		slog.Warn("monitor: backend rejected report", "status", resp.StatusCode)
+	if bw != nil {
+		m.stats.Bandwidth = bw.Mbps
 	}
 }
 
-func (m *NetworkMonitor) pingTarget() (*MonitorStats, error) {
-	pinger, err := ping.NewPinger(m.Target)
-	if err != nil {
-		return nil, err
-	}
-
-	pinger.SetPrivileged(true)
-	pinger.Count = 3
-	pinger.Timeout = 2 * time.Second
-
-	err = pinger.Run()
-	if err != nil {
-		return nil, err
+// LinkMbps is the last measured download speed, or 0 before the first
+// speedtest has finished.
+func (m *NetworkMonitor) LinkMbps() float64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.stats.Bandwidth == nil {
+		return 0
 	}
-
-	pStats := pinger.Statistics()
-
-	latVal := float64(pStats.AvgRtt.Microseconds()) / 1000.0
-	lossVal := pStats.PacketLoss
-	isDownVal := pStats.PacketLoss >= 100.0
-
-	return &MonitorStats{
-		Latency:   &latVal,
-		Loss:      &lossVal,
-		IsDown:    &isDownVal,
-		Bandwidth: nil,
-	}, nil
+	return *m.stats.Bandwidth
 }
 
-// func (m *NetworkMonitor) getBandwidth() (*MonitorStats, error) {
-// 	testURL := "http://speedtest.tele2.net/10MB.zip"
-
-// 	start := time.Now()
-
-// 	client := http.Client{
-// 		Timeout: 50 * time.Second,
-// 	}
-
-// 	resp, err := client.Get(testURL)
-// 	if err != nil {
-// 		return nil, fmt.Errorf("download start failed: %w", err)
-// 	}
-// 	defer resp.Body.Close()
-
-// 	written, err := io.Copy(io.Discard, resp.Body)
-// 	if err != nil {
-// 		return nil, fmt.Errorf("download interrupted: %w", err)
-// 	}
-
-// 	duration := time.Since(start)
-
-// 	bits := float64(written) * 8
-// 	mbpsVal := (bits / 1_000_000) / duration.Seconds()
-
-// 	return &MonitorStats{
-// 		Latency:   nil,
-// 		Loss:      nil,
-// 		IsDown:    nil,
-// 		Bandwidth: &mbpsVal,
-// 	}, nil
-// }
-
-func (m *NetworkMonitor) getBandwidth() (*MonitorStats, error) {
-	// Uses m.bandwidthClient — 90s timeout vs the 10s on m.client.
-	// A fresh http.Client here would bypass the pool on every test.
-	resp, err := m.bandwidthClient.Get("http://speedtest.tele2.net/10MB.zip")
-	if err != nil {
-		return nil, fmt.Errorf("monitor: bandwidth download failed: %w", err)
+// Health reports the internet connection and how long ago a report last
+// reached the backend. Neither stops the device serving the LAN.
+func (m *NetworkMonitor) Health() agent.ComponentHealth {
+	h := agent.ComponentHealth{Name: "network", Status: agent.HealthOK, Message: "online"}
+	if o := m.outages.current(time.Now()); o != nil {
+		h.Status = agent.HealthDown
+		h.Message = "no internet since " + o.Start.UTC().Format(time.RFC3339)
+		if o.Diagnosis != "" {
+			h.Message += " (" + o.Diagnosis + ")"
+		}
 	}
-	defer resp.Body.Close()
-
-	start := time.Now()
-	written, err := io.Copy(io.Discard, resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("monitor: bandwidth download interrupted: %w", err)
+	rs := m.reportStatus()
+	if rs.LastSuccess != nil {
+		h.Message += fmt.Sprintf("; last report to the backend %s ago", time.Since(*rs.LastSuccess).Round(time.Second))
+	} else {
+		h.Message += "; no report sent to the backend yet"
 	}
-
-	mbps := (float64(written) * 8 / 1_000_000) / time.Since(start).Seconds()
-	return &MonitorStats{Bandwidth: &mbps}, nil
+	if rs.ConsecutiveFailures > 0 {
+		if h.Status == agent.HealthOK {
+			h.Status = agent.HealthDegraded
+		}
+		h.Message += fmt.Sprintf("; %d reports queued after %d failed sends: %s", rs.Queued, rs.ConsecutiveFailures, rs.LastError)
+	}
+	return h
 }
@@ -0,0 +1,1044 @@
+package monitor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	ping "github.com/prometheus-community/pro-bing"
+	"github.com/strct-org/strct-agent/internal/config"
+	"github.com/strct-org/strct-agent/internal/events"
+	wifi_feature "github.com/strct-org/strct-agent/internal/features/wifi"
+	"github.com/strct-org/strct-agent/internal/maintenance"
+	"github.com/strct-org/strct-agent/internal/store"
+)
+
+// blockingTransport holds every request until its context is cancelled.
+type blockingTransport struct {
+	requests atomic.Int32
+	started  chan struct{}
+}
+
+func (b *blockingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if b.requests.Add(1) == 1 {
+		close(b.started)
+	}
+	<-req.Context().Done()
+	return nil, req.Context().Err()
+}
+
+func newGatedMonitor(t *testing.T) (*NetworkMonitor, *maintenance.Gate, *blockingTransport) {
+	t.Helper()
+	m := New(MonitorConfig{})
+	m.gate = maintenance.New(filepath.Join(t.TempDir(), "maintenance.json"))
+	tr := &blockingTransport{started: make(chan struct{})}
+	m.bandwidthClient = &http.Client{Transport: tr}
+	return m, m.gate, tr
+}
+
+func TestSpeedtest_SkippedDuringMaintenance(t *testing.T) {
+	m, gate, tr := newGatedMonitor(t)
+	if _, err := gate.Enable("imaging SD card", time.Time{}, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	m.runBandwidth(context.Background(), m.defaultOpts())
+
+	rec := httptest.NewRecorder()
+	m.HandleSpeedtest(rec, httptest.NewRequest("POST", "/api/network/speedtest", nil))
+	if rec.Code != http.StatusConflict {
+		t.Errorf("manual speedtest: got %d, want 409", rec.Code)
+	}
+	if n := tr.requests.Load(); n != 0 {
+		t.Errorf("speedtest downloaded %d times during maintenance", n)
+	}
+}
+
+func TestSpeedtest_CancelledWhenMaintenanceStarts(t *testing.T) {
+	m, gate, tr := newGatedMonitor(t)
+
+	returned := make(chan struct{})
+	go func() {
+		m.runBandwidth(context.Background(), m.defaultOpts())
+		close(returned)
+	}()
+	<-tr.started
+
+	st, err := gate.Enable("swap SSD", time.Time{}, 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(st.Running) != 0 {
+		t.Errorf("still running after drain: %v", st.Running)
+	}
+	<-returned
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.stats.Bandwidth != nil {
+		t.Errorf("a cancelled speedtest recorded %v Mbps", *m.stats.Bandwidth)
+	}
+}
+
+func TestSpeedtest_ParallelDownloadAndUpload(t *testing.T) {
+	var active, peak, uploaded atomic.Int64
+	chunk := make([]byte, 32<<10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/gone":
+			http.NotFound(w, r)
+		case "/down":
+			n := active.Add(1)
+			defer active.Add(-1)
+			for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+			}
+			for r.Context().Err() == nil {
+				if _, err := w.Write(chunk); err != nil {
+					return
+				}
+			}
+		case "/up":
+			n, _ := io.Copy(io.Discard, r.Body)
+			uploaded.Add(n)
+		}
+	}))
+	defer srv.Close()
+
+	m := New(MonitorConfig{
+		SpeedtestURLs:      []string{srv.URL + "/gone", srv.URL + "/down"},
+		SpeedtestUploadURL: srv.URL + "/up",
+	})
+	m.runBandwidth(context.Background(), speedtestOpts{duration: 300 * time.Millisecond, connections: 3})
+
+	st := m.stats
+	if st.Bandwidth == nil || *st.Bandwidth <= 0 || st.Upload == nil || *st.Upload <= 0 {
+		t.Fatalf("bandwidth %v, upload %v", st.Bandwidth, st.Upload)
+	}
+	if d := st.SpeedtestDuration; d == nil || *d < 0.6 || *d > 5 {
+		t.Errorf("duration = %v, want about 0.6s", d)
+	}
+	if p := peak.Load(); p != 3 {
+		t.Errorf("%d downloads at once, want 3", p)
+	}
+	if uploaded.Load() == 0 {
+		t.Error("nothing reached the upload sink")
+	}
+}
+
+func TestHandleSpeedtest_RejectsBadOverrides(t *testing.T) {
+	m := New(MonitorConfig{})
+	for _, body := range []string{`{"duration_s":61}`, `{"connections":17}`, `{"duration_s":-1}`, `{"duration_s":"10"}`} {
+		w := httptest.NewRecorder()
+		m.HandleSpeedtest(w, httptest.NewRequest("POST", "/api/network/speedtest", strings.NewReader(body)))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want 400", body, w.Code)
+		}
+	}
+
+	o, err := m.opts(SpeedtestRequest{Connections: 8})
+	if err != nil || o.connections != 8 || o.duration != 10*time.Second {
+		t.Errorf("opts = %+v, %v", o, err)
+	}
+}
+
+// ─── History ─────────────────────────────────────────────────────────────────
+
+func ms(v float64) *float64 { return &v }
+
+func TestHistory_ReloadsAfterRestart(t *testing.T) {
+	for _, backend := range []string{store.BackendJSONL, store.BackendBolt} {
+		t.Run(backend, func(t *testing.T) { testHistoryReload(t, backend) })
+	}
+}
+
+func testHistoryReload(t *testing.T, backend string) {
+	dir := t.TempDir()
+	now := time.Now()
+	m := New(MonitorConfig{})
+	m.history.dir, m.history.backend = dir, backend
+	m.history.add(sample{T: now.Add(-4 * time.Minute).Unix(), Lat: ms(20), Loss: ms(0)})
+	m.history.add(sample{T: now.Add(-3 * time.Minute).Unix(), Mbps: ms(95.5)})
+	m.history.add(sample{T: now.Add(-2 * time.Minute).Unix(), Lat: ms(31), Loss: ms(33.3)})
+
+	m.history.log.Close() // bolt locks its file
+
+	restarted := New(MonitorConfig{})
+	restarted.history.dir, restarted.history.backend = dir, backend
+	restarted.restoreHistory()
+	if n := len(restarted.history.samples); n != 3 {
+		t.Fatalf("reloaded %d samples, want 3", n)
+	}
+	st := restarted.stats
+	if st.Latency == nil || *st.Latency != 31 || *st.Loss != 33.3 || restarted.LinkMbps() != 95.5 {
+		t.Errorf("stats after restart = %+v", st)
+	}
+	if st.Timestamp.Unix() != now.Add(-2*time.Minute).Unix() {
+		t.Errorf("timestamp = %v", st.Timestamp)
+	}
+}
+
+func TestHistory_ExpiresAndCapsDisk(t *testing.T) {
+	dir := t.TempDir()
+	path := store.Path(store.BackendJSONL, dir, historyLog)
+	now := time.Now()
+	h := &history{dir: dir}
+	// Last week's samples, then enough recent ones to pass the cap.
+	h.add(sample{T: now.Add(-historyRetention - time.Hour).Unix(), Lat: ms(1)})
+	for i := range 40000 {
+		h.add(sample{T: now.Add(time.Duration(i-40000) * time.Second).Unix(), Lat: ms(12.25), Loss: ms(0)})
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() > historyMaxBytes {
+		t.Errorf("history is %d bytes, past the %d cap", info.Size(), historyMaxBytes)
+	}
+
+	// Truncated by a power loss mid-append.
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	f.WriteString(`{"t":17`)
+	f.Close()
+
+	reloaded := &history{dir: dir}
+	if err := reloaded.load(now); err != nil {
+		t.Fatal(err)
+	}
+	// The expired sample was pruned.
+	if len(reloaded.samples) != len(h.samples) || reloaded.samples[0].T != h.samples[0].T {
+		t.Errorf("reloaded %d samples from %d, want %d from %d",
+			len(reloaded.samples), reloaded.samples[0].T, len(h.samples), h.samples[0].T)
+	}
+	if newest := reloaded.samples[len(reloaded.samples)-1]; newest.T != now.Add(-time.Second).Unix() {
+		t.Errorf("newest sample = %+v", newest)
+	}
+
+	// Everything expired: the next load empties the file.
+	later := &history{dir: dir}
+	if err := later.load(now.Add(2 * historyRetention)); err != nil || len(later.samples) != 0 {
+		t.Fatalf("load a fortnight later: %d samples, %v", len(later.samples), err)
+	}
+	if info, _ := os.Stat(path); info.Size() != 0 {
+		t.Errorf("history kept %d bytes of expired samples", info.Size())
+	}
+}
+
+func TestHistory_ImportsMonitorDB(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now().Unix()
+	legacy := fmt.Sprintf(`{"t":%d,"lat":20,"loss":0}`+"\n"+`{"t":%d,"mbps":95.5}`+"\n"+`{"t":17`, now-120, now-60)
+	if err := os.WriteFile(filepath.Join(dir, legacyHistoryFile), []byte(legacy), 0644); err != nil {
+		t.Fatal(err)
+	}
+	h := &history{dir: dir, backend: store.BackendBolt}
+	if err := h.load(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if len(h.samples) != 2 || *h.samples[1].Mbps != 95.5 {
+		t.Errorf("imported %+v", h.samples)
+	}
+	if _, err := os.Stat(filepath.Join(dir, legacyHistoryFile)); !os.IsNotExist(err) {
+		t.Errorf("monitor.db kept after the import: %v", err)
+	}
+}
+
+func TestHandleHistory(t *testing.T) {
+	m := New(MonitorConfig{})
+	base := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	for i, lat := range []float64{10, 20, 30, 100, 50} {
+		m.history.add(sample{T: base.Add(time.Duration(i) * 2 * time.Minute).Unix(), Lat: ms(lat), Loss: ms(0)})
+	}
+	m.history.add(sample{T: base.Add(time.Minute).Unix(), Mbps: ms(80)})
+	mux := http.NewServeMux()
+	m.RegisterRoutes(mux)
+
+	get := func(query string) (int, []HistoryPoint) {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", "/api/network/history?"+query, nil))
+		var body struct {
+			Points []HistoryPoint `json:"points"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &body)
+		return w.Code, body.Points
+	}
+
+	from, to := base.Format(time.RFC3339), base.Add(time.Hour).Format(time.RFC3339)
+	code, points := get("metric=latency&from=" + from + "&to=" + to + "&resolution=5m")
+	if code != http.StatusOK || len(points) != 2 {
+		t.Fatalf("latency: %d %+v", code, points)
+	}
+	// 12:00, 12:02, 12:04 | 12:06, 12:08
+	if p := points[0]; !p.Time.Equal(base) || p.Avg != 20 || p.Min != 10 || p.Max != 30 || p.Samples != 3 {
+		t.Errorf("first bucket = %+v", p)
+	}
+	if p := points[1]; !p.Time.Equal(base.Add(5*time.Minute)) || p.Avg != 75 || p.Max != 100 {
+		t.Errorf("second bucket = %+v", p)
+	}
+
+	if _, points := get("metric=bandwidth&resolution=1h&from=" + from + "&to=" + to); len(points) != 1 || points[0].Avg != 80 {
+		t.Errorf("bandwidth = %+v", points)
+	}
+	if _, points := get("metric=latency&from=" + from + "&to=" + base.Add(3*time.Minute).Format(time.RFC3339)); len(points) != 1 || points[0].Samples != 2 {
+		t.Errorf("to is exclusive: %+v", points)
+	}
+
+	for _, bad := range []string{
+		"metric=jitter",
+		"from=yesterday",
+		"from=" + to + "&to=" + from,
+		"resolution=10s",
+		"resolution=1m&from=" + from + "&to=" + base.AddDate(0, 1, 0).Format(time.RFC3339),
+	} {
+		if code, _ := get(bad); code != http.StatusBadRequest {
+			t.Errorf("%s: %d, want 400", bad, code)
+		}
+	}
+}
+
+// ─── Targets ─────────────────────────────────────────────────────────────────
+
+// stubNetwork answers pings from up (address → latency) and lookups from
+// names; the default route goes through 192.168.1.1.
+func stubNetwork(t *testing.T, m *NetworkMonitor, up map[string]float64, names map[string]bool) {
+	t.Helper()
+	m.routeFile = filepath.Join(t.TempDir(), "route")
+	os.WriteFile(m.routeFile, []byte("Iface\tDestination\tGateway\tFlags\n"+
+		"eth0\t0001A8C0\t00000000\t0001\n"+
+		"eth0\t00000000\t0101A8C0\t0003\n"), 0644)
+	m.lookupHost = func(_ context.Context, host string) ([]string, error) {
+		if names[host] {
+			return []string{"203.0.113.7"}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+	m.exchangeDNS = func(context.Context, string, string) (int, time.Duration, error) {
+		return dns.RcodeSuccess, 5 * time.Millisecond, nil
+	}
+	m.ping = func(addr string) (*MonitorStats, error) {
+		lat, ok := up[addr]
+		loss, down := 0.0, !ok
+		if down {
+			loss = 100
+		}
+		return &MonitorStats{Latency: &lat, Loss: &loss, IsDown: &down}, nil
+	}
+}
+
+func TestRunPing_Diagnosis(t *testing.T) {
+	tests := []struct {
+		name    string
+		up      map[string]float64
+		dns     bool
+		want    string
+		latency float64
+	}{
+		{"all up", map[string]float64{"192.168.1.1": 1, "1.1.1.1": 14, "8.8.8.8": 9}, true, diagAllOK, 9},
+		{"isp down", map[string]float64{"192.168.1.1": 1}, true, diagWANDown, 0},
+		{"router down", map[string]float64{}, true, diagLANDown, 0},
+		{"google down", map[string]float64{"192.168.1.1": 1, "1.1.1.1": 14}, true, diagPartial, 14},
+		{"dns down", map[string]float64{"192.168.1.1": 1, "1.1.1.1": 14, "8.8.8.8": 9}, false, diagDNSOnly, 9},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := New(MonitorConfig{})
+			stubNetwork(t, m, tt.up, map[string]bool{dnsProbeName: tt.dns})
+			m.runPing()
+
+			st := m.stats
+			if st.Diagnosis != tt.want {
+				t.Errorf("diagnosis = %q, want %q", st.Diagnosis, tt.want)
+			}
+			if len(st.Targets) != 3 || st.Targets[0].Address != "192.168.1.1" {
+				t.Fatalf("targets = %+v", st.Targets)
+			}
+			if down := tt.latency == 0; *st.IsDown != down || (!down && *st.Latency != tt.latency) {
+				t.Errorf("headline = down %v latency %v", *st.IsDown, st.Latency)
+			}
+		})
+	}
+}
+
+func TestHandleSetTargets(t *testing.T) {
+	dir := t.TempDir()
+	m := New(MonitorConfig{})
+	m.targetsPath = filepath.Join(dir, targetsFile)
+	stubNetwork(t, m, nil, map[string]bool{"isp-dns.example.net": true})
+	mux := http.NewServeMux()
+	m.RegisterRoutes(mux)
+
+	set := func(body string) (int, string) {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("POST", "/api/network/targets", strings.NewReader(body)))
+		return w.Code, w.Body.String()
+	}
+	if code, body := set(`{"targets":["nowhere.invalid","1.1.1.1","also.invalid"]}`); code != http.StatusBadRequest ||
+		!strings.Contains(body, `{"field":"targets[0]","code":"not_found","message":"target \"nowhere.invalid\" does not resolve"}`) ||
+		!strings.Contains(body, `"field":"targets[2]"`) {
+		t.Errorf("unresolvable targets: %d %s", code, body)
+	}
+	if code, body := set(`{"targets":["a","b","c","d","e","f","g","h","i"]}`); code != http.StatusBadRequest {
+		t.Errorf("nine targets: %d %s", code, body)
+	}
+	if !reflect.DeepEqual(m.currentTargets(), defaultTargets) {
+		t.Errorf("rejected requests changed the targets: %v", m.currentTargets())
+	}
+
+	if code, body := set(`{"targets":["Gateway"," 9.9.9.9","isp-dns.example.net","9.9.9.9"]}`); code != http.StatusOK {
+		t.Fatalf("set: %d %s", code, body)
+	}
+	want := []string{"gateway", "9.9.9.9", "isp-dns.example.net"}
+	restarted := New(MonitorConfig{})
+	restarted.targetsPath = m.targetsPath
+	if err := restarted.loadTargets(); err != nil || !reflect.DeepEqual(restarted.currentTargets(), want) {
+		t.Errorf("reloaded %v (%v), want %v", restarted.currentTargets(), err, want)
+	}
+
+	if code, _ := set(`{"targets":[]}`); code != http.StatusOK || !reflect.DeepEqual(m.currentTargets(), defaultTargets) {
+		t.Errorf("empty list: %d %v", code, m.currentTargets())
+	}
+}
+
+func TestConfiguredTargets(t *testing.T) {
+	cfg := &config.Config{DataDir: t.TempDir(), MonitorTargets: []string{" Gateway", "9.9.9.9", "gateway", "isp-dns.example.net"}}
+	m := NewFromConfig(cfg, nil, events.Discard)
+	want := []string{"gateway", "9.9.9.9", "isp-dns.example.net"}
+	if !reflect.DeepEqual(m.currentTargets(), want) {
+		t.Fatalf("targets = %v, want %v", m.currentTargets(), want)
+	}
+	stubNetwork(t, m, nil, nil)
+	mux := http.NewServeMux()
+	m.RegisterRoutes(mux)
+	for _, body := range []string{`{"targets":["1.1.1.1"]}`, `{"targets":[]}`} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("POST", "/api/network/targets", strings.NewReader(body)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: %d %s", body, w.Code, w.Body)
+		}
+	}
+	if !reflect.DeepEqual(m.currentTargets(), want) {
+		t.Errorf("empty list restored %v, want the configured %v", m.currentTargets(), want)
+	}
+
+	many := make([]string, maxTargets+2)
+	for i := range many {
+		many[i] = fmt.Sprintf("10.0.0.%d", i+1)
+	}
+	if got := configuredTargets(many); len(got) != maxTargets {
+		t.Errorf("kept %d of %d, want %d", len(got), len(many), maxTargets)
+	}
+}
+
+// ─── Learned hops ────────────────────────────────────────────────────────────
+
+// switchingWiFi is a wifi whose mode the test changes, calling the
+// OnApply hooks as wifi does after an apply.
+type switchingWiFi struct {
+	mu    sync.Mutex
+	st    wifi_feature.Status
+	hooks []func()
+}
+
+func (w *switchingWiFi) Status() wifi_feature.Status {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.st
+}
+
+func (w *switchingWiFi) OnApply(fn func()) { w.hooks = append(w.hooks, fn) }
+
+func (w *switchingWiFi) apply(mode wifi_feature.Mode) {
+	w.mu.Lock()
+	w.st = wifi_feature.Status{Mode: mode, Active: mode != wifi_feature.ModeOff}
+	w.mu.Unlock()
+	for _, fn := range w.hooks {
+		fn()
+	}
+}
+
+func autoTargets(st MonitorStats) []TargetStats {
+	var out []TargetStats
+	for _, t := range st.Targets {
+		if t.Auto {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+func TestHops_FollowWiFiMode(t *testing.T) {
+	m := New(MonitorConfig{})
+	stubNetwork(t, m, map[string]float64{"192.168.1.1": 1, "10.0.0.1": 7, "1.1.1.1": 14, "8.8.8.8": 9},
+		map[string]bool{dnsProbeName: true})
+	// eth0's default route via 192.168.1.1, wlan0's via 10.0.0.1.
+	os.WriteFile(m.routeFile, []byte("Iface\tDestination\tGateway\tFlags\n"+
+		"eth0\t00000000\t0101A8C0\t0003\n"+
+		"wlan0\t00000000\t0100000A\t0003\n"), 0644)
+	w := &switchingWiFi{}
+	m.UseWiFi(w)
+
+	// The loop's side of a kick; false when there was none.
+	kicked := func() bool {
+		select {
+		case <-m.hopKick:
+			m.hopsChanged()
+			return true
+		default:
+			return false
+		}
+	}
+
+	w.apply(wifi_feature.ModeRouter)
+	if !kicked() {
+		t.Fatal("apply did not wake the monitor")
+	}
+	auto := autoTargets(m.stats)
+	if len(auto) != 1 || auto[0].Target != roleWANHop || auto[0].Role != roleWANHop || auto[0].Address != "192.168.1.1" || *auto[0].Latency != 1 {
+		t.Fatalf("router mode: auto targets = %+v", auto)
+	}
+	if len(m.stats.Targets) != 4 || m.stats.Targets[0].Role != roleGateway || m.stats.Targets[1].Role != roleInternet {
+		t.Errorf("router mode: targets = %+v", m.stats.Targets)
+	}
+
+	w.apply(wifi_feature.ModeExtender)
+	kicked()
+	auto = autoTargets(m.stats)
+	if len(auto) != 1 || auto[0].Role != roleUpstreamAP || auto[0].Address != "10.0.0.1" || *auto[0].Latency != 7 {
+		t.Fatalf("extender mode: auto targets = %+v", auto)
+	}
+	if pts := m.history.query(metricHop, roleUpstreamAP, time.Now().Add(-time.Hour), time.Now().Add(time.Hour), time.Minute); len(pts) != 1 || pts[0].Avg != 7 {
+		t.Errorf("upstream_ap history = %+v", pts)
+	}
+	if pts := m.history.query(metricHop, roleWANHop, time.Now().Add(-time.Hour), time.Now().Add(time.Hour), time.Minute); len(pts) != 1 || pts[0].Avg != 1 {
+		t.Errorf("wan_hop history = %+v", pts)
+	}
+
+	// Re-applying the same mode is not a change: no round.
+	before := m.stats.Timestamp
+	w.apply(wifi_feature.ModeExtender)
+	kicked()
+	if !m.stats.Timestamp.Equal(before) {
+		t.Error("re-applying the same mode ran a round")
+	}
+
+	w.apply(wifi_feature.ModeOff)
+	kicked()
+	if auto := autoTargets(m.stats); len(auto) != 0 || len(m.stats.Targets) != 3 {
+		t.Errorf("off: targets = %+v", m.stats.Targets)
+	}
+	if !reflect.DeepEqual(m.currentTargets(), defaultTargets) {
+		t.Errorf("learned hops leaked into the user's targets: %v", m.currentTargets())
+	}
+}
+
+func TestRunPing_HopDiagnosis(t *testing.T) {
+	tests := []struct {
+		name string
+		mode wifi_feature.Mode
+		up   map[string]float64
+		want string
+	}{
+		{"upstream AP down", wifi_feature.ModeExtender, map[string]float64{"192.168.1.1": 1}, diagUpstreamAPDown},
+		{"upstream AP up, internet down", wifi_feature.ModeExtender, map[string]float64{"192.168.1.1": 1, "10.0.0.1": 3}, diagWANDown},
+		{"eth0 hop down", wifi_feature.ModeRouter, map[string]float64{"10.0.0.1": 3, "1.1.1.1": 14}, diagLANDown},
+		{"all up", wifi_feature.ModeExtender, map[string]float64{"192.168.1.1": 1, "10.0.0.1": 3, "1.1.1.1": 14, "8.8.8.8": 9}, diagAllOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := New(MonitorConfig{})
+			stubNetwork(t, m, tt.up, map[string]bool{dnsProbeName: true})
+			os.WriteFile(m.routeFile, []byte("Iface\tDestination\tGateway\tFlags\n"+
+				"eth0\t00000000\t0101A8C0\t0003\n"+
+				"wlan0\t00000000\t0100000A\t0003\n"), 0644)
+			m.UseWiFi(fakeWiFi{wifi_feature.Status{Mode: tt.mode, Active: true}})
+			m.runPing()
+			if m.stats.Diagnosis != tt.want {
+				t.Errorf("diagnosis = %q, want %q (targets %+v)", m.stats.Diagnosis, tt.want, m.stats.Targets)
+			}
+		})
+	}
+}
+
+// ─── Outages ─────────────────────────────────────────────────────────────────
+
+func TestOutages_OpenCloseAndUptime(t *testing.T) {
+	var reports []outageReport
+	got := make(chan struct{}, 2)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var rep outageReport
+		json.NewDecoder(r.Body).Decode(&rep)
+		reports = append(reports, rep)
+		got <- struct{}{}
+	}))
+	defer backend.Close()
+
+	bus := events.New()
+	sub := bus.Subscribe(4, events.OutageStarted, events.OutageEnded)
+	defer sub.Close()
+
+	path := filepath.Join(t.TempDir(), outagesFile)
+	m := New(MonitorConfig{BackendURL: backend.URL, DeviceID: "dev"})
+	m.outages.path = path
+	m.events = bus
+
+	t0 := time.Now().Add(-10 * time.Hour)
+	round := func(min int, down bool) { m.trackOutage(t0.Add(time.Duration(min)*time.Minute), down, diagWANDown) }
+	round(0, false)
+	round(2, true) // one bad round is not an outage
+	round(4, false)
+	if o := m.outages.current(t0.Add(5 * time.Minute)); o != nil {
+		t.Fatalf("single down round opened %+v", o)
+	}
+	round(120, true)
+	round(122, true)
+	<-got
+	if o := m.outages.current(t0.Add(150 * time.Minute)); o == nil || !o.Start.Equal(t0.Add(120*time.Minute)) || o.Seconds != 30*60 {
+		t.Fatalf("open outage = %+v", o)
+	}
+
+	// Still open after a restart, then closed by the next good round.
+	restarted := New(MonitorConfig{BackendURL: backend.URL, DeviceID: "dev"})
+	restarted.outages.path = path
+	restarted.events = bus
+	restarted.restoreOutages()
+	restarted.trackOutage(t0.Add(210*time.Minute), false, diagAllOK)
+	<-got
+
+	if len(reports) != 2 || reports[0].Type != eventOutageStart || reports[1].Type != eventOutageEnd || reports[1].Outage.Seconds != 90*60 {
+		t.Errorf("reports = %+v", reports)
+	}
+	if len(sub.C) != 2 {
+		t.Fatalf("published %d events, want 2", len(sub.C))
+	}
+	if e := <-sub.C; e.Type != events.OutageStarted || e.Payload.(Outage).End != nil {
+		t.Errorf("first event = %+v", e)
+	}
+	if e := <-sub.C; e.Type != events.OutageEnded || e.Payload.(Outage).Seconds != 90*60 {
+		t.Errorf("second event = %+v", e)
+	}
+
+	w := httptest.NewRecorder()
+	restarted.HandleOutages(w, httptest.NewRequest("GET", "/api/network/outages?days=1", nil))
+	var body struct {
+		Uptime   float64  `json:"uptime"`
+		Downtime int64    `json:"downtime_s"`
+		Outages  []Outage `json:"outages"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	// Tracked for 10h, down for 1.5h of them.
+	if len(body.Outages) != 1 || body.Downtime != 90*60 || body.Uptime < 84.9 || body.Uptime > 85.1 {
+		t.Errorf("outages: %s", w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	restarted.HandleOutages(w, httptest.NewRequest("GET", "/api/network/outages?days=365", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("days=365: got %d, want 400", w.Code)
+	}
+}
+
+// ─── Reports ─────────────────────────────────────────────────────────────────
+
+func TestReports_BatchedRetriedAndKeptAcrossRestart(t *testing.T) {
+	var (
+		status  atomic.Int32 // of network_metrics/batch
+		batches [][]float64  // latencies, per POST
+		singles []float64
+	)
+	status.Store(http.StatusServiceUnavailable)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if code := int(status.Load()); strings.HasSuffix(r.URL.Path, "/batch") && code != http.StatusOK {
+			w.WriteHeader(code)
+			return
+		}
+		var reports []json.RawMessage
+		if strings.HasSuffix(r.URL.Path, "/batch") {
+			var b reportBatch
+			json.NewDecoder(r.Body).Decode(&b)
+			reports = b.Reports
+		} else {
+			var raw json.RawMessage
+			json.NewDecoder(r.Body).Decode(&raw)
+			reports = []json.RawMessage{raw}
+		}
+		var lat []float64
+		for _, rep := range reports {
+			var s MonitorStats
+			json.Unmarshal(rep, &s)
+			lat = append(lat, *s.Latency)
+		}
+		if strings.HasSuffix(r.URL.Path, "/batch") {
+			batches = append(batches, lat)
+		} else {
+			singles = append(singles, lat...)
+		}
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	newMonitor := func() *NetworkMonitor {
+		m := New(MonitorConfig{BackendURL: srv.URL, DeviceID: "dev", ReportInterval: 5 * time.Minute})
+		m.reports.dir = dir
+		m.restoreReports()
+		return m
+	}
+	sample := func(m *NetworkMonitor, lat float64) { m.reportToBackend(MonitorStats{Latency: &lat}) }
+
+	// Backend down: nothing is lost, and retries back off.
+	m := newMonitor()
+	sample(m, 1)
+	sample(m, 2)
+	if wait := m.flushReports(context.Background()); wait != reportRetry {
+		t.Errorf("first retry in %v", wait)
+	}
+	if wait := m.flushReports(context.Background()); wait != 2*reportRetry {
+		t.Errorf("second retry in %v", wait)
+	}
+	if st := m.reportStatus(); st.Queued != 2 || st.ConsecutiveFailures != 2 || st.LastSuccess != nil || st.LastError == "" {
+		t.Errorf("status while down = %+v", st)
+	}
+
+	// Restart with the queue unsent; the restart sends it with what came
+	// since, in one request.
+	m = newMonitor()
+	sample(m, 3)
+	status.Store(http.StatusOK)
+	if wait := m.flushReports(context.Background()); wait != 5*time.Minute {
+		t.Errorf("next flush after success in %v", wait)
+	}
+	if len(batches) != 1 || !reflect.DeepEqual(batches[0], []float64{1, 2, 3}) {
+		t.Errorf("batches = %v", batches)
+	}
+	w := httptest.NewRecorder()
+	m.HandleReportStatus(w, httptest.NewRequest("GET", "/api/network/report-status", nil))
+	var st ReportStatus
+	json.Unmarshal(w.Body.Bytes(), &st)
+	if st.Queued != 0 || st.ConsecutiveFailures != 0 || st.LastSuccess == nil || st.IntervalSeconds != 300 {
+		t.Errorf("status = %s", w.Body)
+	}
+	if restarted := newMonitor(); len(restarted.reports.pending) != 0 {
+		t.Errorf("sent reports would be sent again after a restart: %d", len(restarted.reports.pending))
+	}
+
+	// A backend without the batch endpoint gets them one at a time.
+	status.Store(http.StatusNotFound)
+	sample(m, 4)
+	sample(m, 5)
+	m.flushReports(context.Background())
+	if !reflect.DeepEqual(singles, []float64{4, 5}) || len(batches) != 1 {
+		t.Errorf("singles = %v, batches = %v", singles, batches)
+	}
+
+	// The queue is bounded: the oldest go first.
+	for i := range maxQueuedReports + 5 {
+		sample(m, float64(i))
+	}
+	if st := m.reportStatus(); st.Queued != maxQueuedReports || st.Dropped != 5 {
+		t.Errorf("status when full = %+v", st)
+	}
+	var first MonitorStats
+	json.Unmarshal(m.reports.pending[0], &first)
+	if *first.Latency != 5 {
+		t.Errorf("oldest queued = %v, want 5", *first.Latency)
+	}
+	// So is the log: a restart restores the same queue.
+	restarted := newMonitor()
+	json.Unmarshal(restarted.reports.pending[0], &first)
+	if len(restarted.reports.pending) != maxQueuedReports || *first.Latency != 5 {
+		t.Errorf("restored %d reports from %v", len(restarted.reports.pending), *first.Latency)
+	}
+}
+
+func TestReports_ImportsSavedQueue(t *testing.T) {
+	dir := t.TempDir()
+	legacy := `{"schema_version":1,"reports":[{"latency":1},{"latency":2}]}`
+	if err := os.WriteFile(filepath.Join(dir, legacyReports), []byte(legacy), 0600); err != nil {
+		t.Fatal(err)
+	}
+	m := New(MonitorConfig{})
+	m.reports.dir = dir
+	m.reports.backend = store.BackendBolt
+	m.restoreReports()
+	lat := 3.0
+	m.reportToBackend(MonitorStats{Latency: &lat})
+	if len(m.reports.pending) != 3 || !strings.Contains(string(m.reports.pending[1]), `"latency":2`) {
+		t.Fatalf("pending = %s", m.reports.pending)
+	}
+	var keys []int64
+	store.All(m.reports.log, func(r store.Record) bool { keys = append(keys, r.Key); return true }) //nolint:errcheck
+	if !reflect.DeepEqual(keys, []int64{0, 1, 2}) {
+		t.Errorf("log keys = %v", keys)
+	}
+}
+
+func TestProbe_FallsBackWhenNotPermitted(t *testing.T) {
+	eperm := &net.OpError{Op: "listen", Net: "ip4:icmp", Err: os.NewSyscallError("socket", syscall.EPERM)}
+	eacces := &net.OpError{Op: "listen", Net: "udp4", Err: os.NewSyscallError("socket", syscall.EACCES)}
+	newMonitor := func(errs map[bool]error) (*NetworkMonitor, *[]bool) {
+		m := New(MonitorConfig{})
+		var tried []bool
+		m.newPinger = func(string) (pinger, error) {
+			return &recordingPinger{errs: errs, tried: &tried}, nil
+		}
+		return m, &tried
+	}
+
+	// Neither socket allowed: TCP connects, the first refused.
+	m, tried := newMonitor(map[bool]error{true: eperm, false: eacces})
+	var dials []string
+	m.dialTCP = func(_ context.Context, network, addr string) (net.Conn, error) {
+		dials = append(dials, addr)
+		if len(dials) == 1 {
+			return nil, &net.OpError{Op: "dial", Net: network, Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+		}
+		c, s := net.Pipe()
+		s.Close()
+		return c, nil
+	}
+	stats, err := m.probe("1.1.1.1")
+	if err != nil || *stats.IsDown || *stats.Loss != 0 || stats.Latency == nil {
+		t.Fatalf("tcp probe = %+v, %v", stats, err)
+	}
+	if !reflect.DeepEqual(*tried, []bool{true, false}) || len(dials) != 3 || dials[0] != "1.1.1.1:443" {
+		t.Errorf("tried privileged %v, dialled %v", *tried, dials)
+	}
+	*tried = nil
+	m.probe("8.8.8.8")
+	if len(*tried) != 0 || m.pingMethod() != methodTCP {
+		t.Errorf("second round went back to ICMP: tried %v, method %s", *tried, m.pingMethod())
+	}
+
+	// Only the raw socket refused: UDP ping.
+	m, tried = newMonitor(map[bool]error{true: eperm})
+	stats, err = m.probe("1.1.1.1")
+	if err != nil || *stats.Latency != 12 || m.pingMethod() != methodUDP || !reflect.DeepEqual(*tried, []bool{true, false}) {
+		t.Errorf("udp probe = %+v, %v, method %s, tried %v", stats, err, m.pingMethod(), *tried)
+	}
+
+	// Any other error is the target's: no fallback.
+	m, _ = newMonitor(map[bool]error{true: errors.New("lookup nowhere.invalid: no such host")})
+	if _, err := m.probe("nowhere.invalid"); err == nil || m.pingMethod() != methodICMP {
+		t.Errorf("err %v, method %s", err, m.pingMethod())
+	}
+}
+
+// recordingPinger answers every ping in 12ms, unless its socket fails
+// with errs[privileged], and records which sockets were tried.
+type recordingPinger struct {
+	errs       map[bool]error
+	tried      *[]bool
+	privileged bool
+}
+
+func (p *recordingPinger) SetPrivileged(b bool) { p.privileged = b }
+func (p *recordingPinger) Run() error {
+	*p.tried = append(*p.tried, p.privileged)
+	return p.errs[p.privileged]
+}
+func (p *recordingPinger) Statistics() *ping.Statistics {
+	return &ping.Statistics{AvgRtt: 12 * time.Millisecond}
+}
+
+// fakeWiFi reports a fixed wifi status.
+type fakeWiFi struct{ st wifi_feature.Status }
+
+func (f fakeWiFi) Status() wifi_feature.Status { return f.st }
+func (fakeWiFi) OnApply(func())                {}
+
+func TestParseNetDev(t *testing.T) {
+	snapshot, err := os.ReadFile("testdata/proc-net-dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := parseNetDev(snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]netCounters{
+		"lo":         {2776770, 2776770},
+		"eth0":       {1215645452, 125164722},
+		"wlan0":      {98311204, 904418877},
+		"tailscale0": {512000, 734002},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseNetDev = %v", got)
+	}
+	if _, err := parseNetDev([]byte("  eth0: 12 34\n")); err == nil {
+		t.Error("parseNetDev accepted a short line")
+	}
+}
+
+func TestThroughput_RatesPeaksAndReport(t *testing.T) {
+	snapshot, _ := os.ReadFile("testdata/proc-net-dev")
+	path := filepath.Join(t.TempDir(), "net-dev")
+	os.WriteFile(path, snapshot, 0644)
+	m := New(MonitorConfig{})
+	m.readNetDev = func() ([]byte, error) { return os.ReadFile(path) }
+	m.UseWiFi(fakeWiFi{wifi_feature.Status{Mode: wifi_feature.ModeRouter, Active: true, APInterface: "wlan0"}})
+
+	start := time.Now().Add(-time.Minute)
+	counters := func(eth0Rx, eth0Tx, wlanRx, wlanTx uint64) map[string]netCounters {
+		return map[string]netCounters{"eth0": {eth0Rx, eth0Tx}, "wlan0": {wlanRx, wlanTx}}
+	}
+	m.sampleThroughput() // the baseline, through the file
+	if m.throughput.current() != nil {
+		t.Fatal("rates after a single read")
+	}
+	base, _ := parseNetDev(snapshot)
+	e, w := base["eth0"], base["wlan0"]
+	m.throughput.lastAt = start
+	// 5s later: 50 Mbps down and 5 up on eth0, mirrored on the AP.
+	m.throughput.observe(start.Add(5*time.Second), counters(e.rx+31_250_000, e.tx+3_125_000, w.rx+3_125_000, w.tx+31_250_000), "eth0", "wlan0")
+	// 5s later: 10 down; wlan0's counters went back, a driver reload.
+	m.throughput.observe(start.Add(10*time.Second), counters(e.rx+37_500_000, e.tx+3_750_000, 100, 200), "eth0", "wlan0")
+
+	cur := m.throughput.current()
+	if cur == nil || cur.WAN.Iface != "eth0" || cur.WAN.RxMbps != 10 || cur.WAN.TxMbps != 1 ||
+		cur.WAN.PeakRx != 50 || cur.WAN.PeakTx != 5 {
+		t.Fatalf("wan = %+v", cur)
+	}
+	if cur.AP == nil || cur.AP.Iface != "wlan0" || cur.AP.RxMbps != 0 || cur.AP.PeakTx != 50 {
+		t.Errorf("ap = %+v", cur.AP)
+	}
+
+	w2 := httptest.NewRecorder()
+	m.HandleThroughput(w2, httptest.NewRequest("GET", "/api/network/throughput", nil))
+	var body struct {
+		Interval int               `json:"interval_s"`
+		Samples  []ThroughputPoint `json:"samples"`
+	}
+	json.Unmarshal(w2.Body.Bytes(), &body)
+	if body.Interval != 5 || len(body.Samples) != 2 || body.Samples[0].WANRx != 50 {
+		t.Errorf("throughput response = %s", w2.Body)
+	}
+
+	// The live rate goes out with every report.
+	reported := make(chan MonitorStats, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var b reportBatch
+		json.NewDecoder(r.Body).Decode(&b)
+		var s MonitorStats
+		json.Unmarshal(b.Reports[0], &s)
+		reported <- s
+	}))
+	defer srv.Close()
+	m.Config.BackendURL = srv.URL
+	m.reportToBackend(MonitorStats{})
+	m.flushReports(context.Background())
+	if s := <-reported; s.Throughput == nil || s.Throughput.WAN.RxMbps != 10 {
+		t.Errorf("reported throughput = %+v", s.Throughput)
+	}
+
+	// Extender mode: the WAN is wlan0 and the AP the virtual interface.
+	m.UseWiFi(fakeWiFi{wifi_feature.Status{Mode: wifi_feature.ModeExtender, Active: true, APInterface: "wlan0_ap"}})
+	m.sampleThroughput()
+	if cur := m.throughput.current(); cur.WAN.Iface != "wlan0" || cur.AP.Iface != "wlan0_ap" {
+		t.Errorf("extender = %+v %+v", cur.WAN, cur.AP)
+	}
+}
+
+// ─── DNS ─────────────────────────────────────────────────────────────────────
+
+func TestTimeDNS_LocalCacheAndUpstream(t *testing.T) {
+	m := New(MonitorConfig{})
+	type answer struct {
+		rcode int
+		rtt   time.Duration
+		err   error
+	}
+	var (
+		mu      sync.Mutex
+		asked   []string
+		answers = map[string][]answer{}
+	)
+	m.exchangeDNS = func(_ context.Context, server, name string) (int, time.Duration, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		asked = append(asked, server+" "+name)
+		a := answers[server][0]
+		answers[server] = answers[server][1:]
+		return a.rcode, a.rtt, a.err
+	}
+
+	// Without an AP only the upstream is asked.
+	answers["1.1.1.1:53"] = []answer{{dns.RcodeSuccess, 30 * time.Millisecond, nil}}
+	st := m.timeDNS()
+	if st.Local != nil || st.Upstream.Server != "1.1.1.1" || !st.Healthy || *st.latency() != 30 {
+		t.Errorf("no AP: %+v", st)
+	}
+
+	m.UseWiFi(fakeWiFi{wifi_feature.Status{Active: true, GatewayIP: "10.42.0.1"}})
+	m.Config.DNSUpstream = "9.9.9.9"
+	answers["10.42.0.1:53"] = []answer{{dns.RcodeSuccess, 80 * time.Millisecond, nil}, {dns.RcodeSuccess, time.Millisecond, nil}}
+	answers["9.9.9.9:53"] = []answer{{dns.RcodeSuccess, 60 * time.Millisecond, nil}}
+	st = m.timeDNS()
+	if st.Name == dnsTimedNames[0] {
+		t.Error("the same name was looked up twice in a row")
+	}
+	if l := st.Local; l == nil || *l.Latency != 80 || *l.Cached != 1 || l.Rcode != "NOERROR" {
+		t.Errorf("local = %+v", st.Local)
+	}
+	if !st.Healthy || *st.latency() != 80 {
+		t.Errorf("headline = %v healthy %v", *st.latency(), st.Healthy)
+	}
+
+	// dnsmasq answering SERVFAIL is unhealthy however fast, and counted;
+	// so is an upstream that doesn't answer.
+	answers["10.42.0.1:53"] = []answer{{dns.RcodeServerFailure, time.Millisecond, nil}}
+	answers["9.9.9.9:53"] = []answer{{0, 0, errors.New("i/o timeout")}}
+	st = m.timeDNS()
+	if st.Healthy || st.latency() != nil || st.Local.Cached != nil {
+		t.Errorf("servfail: %+v", st.Local)
+	}
+	if st.Local.ServFails != 1 || st.Local.Rcode != "SERVFAIL" || st.Upstream.Failures != 1 || st.Upstream.Error == "" {
+		t.Errorf("counts: local %+v upstream %+v", st.Local, st.Upstream)
+	}
+	if len(asked) != 6 {
+		t.Errorf("asked %v", asked)
+	}
+
+	// Slow is unhealthy too.
+	answers["10.42.0.1:53"] = []answer{{dns.RcodeNameError, 900 * time.Millisecond, nil}, {dns.RcodeNameError, time.Millisecond, nil}}
+	answers["9.9.9.9:53"] = []answer{{dns.RcodeSuccess, 40 * time.Millisecond, nil}}
+	if st = m.timeDNS(); st.Healthy || st.Local.ServFails != 1 {
+		t.Errorf("slow: %+v", st.Local)
+	}
+}
+
+func TestRunPing_ReportsDNSLatency(t *testing.T) {
+	m := New(MonitorConfig{})
+	stubNetwork(t, m, map[string]float64{"192.168.1.1": 1, "1.1.1.1": 14, "8.8.8.8": 9}, map[string]bool{dnsProbeName: true})
+	m.runPing()
+
+	rec := httptest.NewRecorder()
+	m.HandleStats(rec, httptest.NewRequest(http.MethodGet, "/api/network/stats", nil))
+	var got struct {
+		DNSLatency *float64 `json:"dns_latency_ms"`
+		DNS        struct {
+			Healthy bool `json:"healthy"`
+		} `json:"dns"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got.DNSLatency == nil || *got.DNSLatency != 5 || !got.DNS.Healthy {
+		t.Errorf("stats = %+v", got)
+	}
+	if len(m.reports.pending) != 1 || !strings.Contains(string(m.reports.pending[0]), `"dns_latency_ms":5`) {
+		t.Errorf("report = %s", m.reports.pending)
+	}
+}
@@ -0,0 +1,265 @@
+package monitor
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/events"
+	"github.com/strct-org/strct-agent/internal/statefile"
+)
+
+// Outages. IsDown only says how the last ping round went; the next round
+// overwrites it, so a night without internet left no trace. Rounds are
+// now run through a small state machine:
+//
+//   - outageRounds rounds in a row with every internet target down open
+//     an outage, dated from the first of them;
+//   - the first round that gets through closes it.
+//
+// Outages are kept for outageRetention in DataDir/monitor-outages.json,
+// served on GET /api/network/outages?days=30 and summed up as the uptime
+// in /api/network/stats. Opening and closing one is also reported to the
+// backend, as an outageReport.
+//
+// An outage still open when the agent stops stays open across the restart:
+// the agent can't tell whether the internet came back in between.
+const (
+	outagesFile      = "monitor-outages.json"
+	outageRounds     = 2
+	outageRetention  = 90 * 24 * time.Hour
+	uptimeWindowDays = 30
+	maxOutageDays    = 90
+)
+
+// Outage events sent to the backend.
+const (
+	eventOutageStart = "outage_start"
+	eventOutageEnd   = "outage_end"
+)
+
+// Outage is one stretch without internet.
+type Outage struct {
+	Start time.Time  `json:"start"`
+	End   *time.Time `json:"end,omitempty"` // nil while it lasts
+	// Seconds is the length so far for an open outage.
+	Seconds   int64  `json:"duration_s"`
+	Diagnosis string `json:"diagnosis,omitempty"` // of the round that opened it
+}
+
+// outageReport is what reportOutage posts to the backend.
+type outageReport struct {
+	Type      string    `json:"type"` // eventOutageStart or eventOutageEnd
+	Timestamp time.Time `json:"timestamp"`
+	Outage    Outage    `json:"outage"`
+}
+
+// outagesSchema versions monitor-outages.json.
+//
+//	v1: {"since": …, "outages": [...], "open": {...}}
+var outagesSchema = statefile.Schema{
+	Name:       "monitor-outages",
+	Migrations: []statefile.Migration{statefile.Stamp},
+}
+
+type outagesDoc struct {
+	Since   time.Time `json:"since"`
+	Outages []Outage  `json:"outages"`
+	Open    *Outage   `json:"open,omitempty"`
+}
+
+type outageLog struct {
+	mu       sync.Mutex
+	path     string    // "": memory only
+	since    time.Time // first round tracked; uptime counts from here
+	closed   []Outage  // oldest first
+	open     *Outage
+	downRuns int       // rounds down in a row
+	downFrom time.Time // the first of them
+}
+
+func (l *outageLog) load() error {
+	if l.path == "" {
+		return nil
+	}
+	var doc outagesDoc
+	if err := statefile.Load(l.path, outagesSchema, &doc); err != nil {
+		if statefile.Fresh(err) {
+			return nil
+		}
+		return fmt.Errorf("load outages: %w", err)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.since, l.closed, l.open = doc.Since, doc.Outages, doc.Open
+	if l.open != nil {
+		l.downRuns, l.downFrom = outageRounds, l.open.Start
+	}
+	return nil
+}
+
+func (l *outageLog) saveLocked() {
+	if l.path == "" {
+		return
+	}
+	doc := outagesDoc{Since: l.since, Outages: l.closed, Open: l.open}
+	if doc.Outages == nil {
+		doc.Outages = []Outage{}
+	}
+	if err := statefile.Save(l.path, outagesSchema, doc); err != nil {
+		slog.Warn("monitor: could not save outages", "err", err)
+	}
+}
+
+// observe feeds a ping round taken at now into the state machine and
+// returns the event it caused, if any, with the outage it concerns.
+func (l *outageLog) observe(now time.Time, down bool, diagnosis string) (event string, o Outage) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	save := false
+	if l.since.IsZero() {
+		l.since, save = now, true
+	}
+
+	switch {
+	case down:
+		l.downRuns++
+		if l.downRuns == 1 {
+			l.downFrom = now
+		}
+		if l.open == nil && l.downRuns >= outageRounds {
+			l.open = &Outage{Start: l.downFrom, Diagnosis: diagnosis}
+			event, o, save = eventOutageStart, *l.open, true
+		}
+	default:
+		l.downRuns = 0
+		if l.open != nil {
+			closed := *l.open
+			closed.End = &now
+			closed.Seconds = int64(now.Sub(closed.Start) / time.Second)
+			l.closed = append(l.closed, closed)
+			l.open = nil
+			event, o, save = eventOutageEnd, closed, true
+		}
+	}
+	if save {
+		l.trimLocked(now.Add(-outageRetention))
+		l.saveLocked()
+	}
+	return event, o
+}
+
+func (l *outageLog) trimLocked(cutoff time.Time) {
+	i := 0
+	for i < len(l.closed) && l.closed[i].End.Before(cutoff) {
+		i++
+	}
+	l.closed = l.closed[i:]
+}
+
+// current is the open outage, with its length so far, or nil.
+func (l *outageLog) current(now time.Time) *Outage {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.open == nil {
+		return nil
+	}
+	o := *l.open
+	o.Seconds = int64(now.Sub(o.Start) / time.Second)
+	return &o
+}
+
+// window returns the outages that overlap the window before now, newest
+// first, the time they took out of it and the uptime in %. The window
+// starts no earlier than the first tracked round; uptime is nil if there
+// is none yet.
+func (l *outageLog) window(now time.Time, window time.Duration) (outages []Outage, downtime time.Duration, uptime *float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	from := now.Add(-window)
+	if l.since.After(from) {
+		from = l.since
+	}
+
+	all := append([]Outage(nil), l.closed...)
+	if l.open != nil {
+		o := *l.open
+		o.Seconds = int64(now.Sub(o.Start) / time.Second)
+		all = append(all, o)
+	}
+	outages = []Outage{}
+	for i := len(all) - 1; i >= 0; i-- {
+		o := all[i]
+		end := now
+		if o.End != nil {
+			end = *o.End
+		}
+		if !end.After(from) {
+			continue
+		}
+		start := o.Start
+		if start.Before(from) {
+			start = from
+		}
+		downtime += end.Sub(start)
+		outages = append(outages, o)
+	}
+
+	if l.since.IsZero() || !now.After(from) {
+		return outages, downtime, nil
+	}
+	pct := 100 * (1 - float64(downtime)/float64(now.Sub(from)))
+	return outages, downtime, &pct
+}
+
+// trackOutage runs a ping round through the outage log and reports what
+// it opened or closed, to the backend and on the event bus.
+func (m *NetworkMonitor) trackOutage(now time.Time, down bool, diagnosis string) {
+	event, o := m.outages.observe(now, down, diagnosis)
+	switch event {
+	case eventOutageStart:
+		slog.Warn("monitor: internet outage", "since", o.Start, "diagnosis", o.Diagnosis)
+		m.events.Publish(events.OutageStarted, o)
+	case eventOutageEnd:
+		slog.Info("monitor: internet is back", "outage", time.Duration(o.Seconds)*time.Second)
+		m.events.Publish(events.OutageEnded, o)
+	default:
+		return
+	}
+	go m.reportOutage(outageReport{Type: event, Timestamp: now, Outage: o})
+}
+
+// restoreOutages loads monitor-outages.json.
+func (m *NetworkMonitor) restoreOutages() {
+	if err := m.outages.load(); err != nil {
+		slog.Warn("monitor: could not load outages", "err", err)
+	}
+}
+
+// HandleOutages lists the outages of the last days days, with the uptime
+// over them.
+// GET /api/network/outages?days=30
+func (m *NetworkMonitor) HandleOutages(w http.ResponseWriter, r *http.Request) {
+	days := uptimeWindowDays
+	if raw := r.URL.Query().Get("days"); raw != "" {
+		d, err := strconv.Atoi(raw)
+		if err != nil || d < 1 || d > maxOutageDays {
+			http.Error(w, fmt.Sprintf("days must be between 1 and %d", maxOutageDays), http.StatusBadRequest)
+			return
+		}
+		days = d
+	}
+	outages, downtime, uptime := m.outages.window(time.Now(), time.Duration(days)*24*time.Hour)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"days":       days,
+		"uptime":     uptime,
+		"downtime_s": int64(downtime / time.Second),
+		"outages":    outages,
+	})
+}
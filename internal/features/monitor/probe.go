@@ -0,0 +1,156 @@
+package monitor
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	ping "github.com/prometheus-community/pro-bing"
+)
+
+// Ping methods. A privileged ICMP socket needs CAP_NET_RAW; without it
+// (no setcap, not root) every ping failed with "operation not permitted"
+// and the monitor had nothing to show. So a permission error moves the
+// monitor down a method, for good:
+//
+//   - methodICMP: raw ICMP, the default;
+//   - methodUDP: unprivileged ICMP over a datagram socket, which needs
+//     the agent's group in net.ipv4.ping_group_range;
+//   - methodTCP: the time a TCP connect to port 443 of the target takes.
+//
+// Any other error is the target's, not the method's, and is returned as
+// is. The method in use is MonitorStats.Method.
+const (
+	methodICMP = "icmp"
+	methodUDP  = "udp"
+	methodTCP  = "tcp"
+
+	probeCount   = 3
+	probeTimeout = 2 * time.Second
+	tcpProbePort = "443"
+)
+
+// pingMethods is the fallback order.
+var pingMethods = []string{methodICMP, methodUDP, methodTCP}
+
+// pinger is what probe needs of a pro-bing Pinger.
+type pinger interface {
+	SetPrivileged(bool)
+	Run() error
+	Statistics() *ping.Statistics
+}
+
+// newProBing is the real pinger factory.
+func newProBing(addr string) (pinger, error) {
+	p, err := ping.NewPinger(addr)
+	if err != nil {
+		return nil, err
+	}
+	p.Count = probeCount
+	p.Timeout = probeTimeout
+	return p, nil
+}
+
+// pingMethod is the method rounds start with.
+func (m *NetworkMonitor) pingMethod() string {
+	m.methodMu.Lock()
+	defer m.methodMu.Unlock()
+	return m.method
+}
+
+// downgrade moves the monitor past from after err, logging it once: the
+// targets of a round probe at once and all fail the same way.
+func (m *NetworkMonitor) downgrade(from string, err error) string {
+	m.methodMu.Lock()
+	defer m.methodMu.Unlock()
+	if m.method == from {
+		for i, meth := range pingMethods[:len(pingMethods)-1] {
+			if meth == from {
+				m.method = pingMethods[i+1]
+				break
+			}
+		}
+		slog.Warn("monitor: ping method not permitted, falling back", "from", from, "to", m.method, "err", err)
+	}
+	return m.method
+}
+
+// probe measures addr with the current method, moving down the methods
+// while they aren't permitted.
+func (m *NetworkMonitor) probe(addr string) (*MonitorStats, error) {
+	method := m.pingMethod()
+	for {
+		if method == methodTCP {
+			return m.tcpPing(addr), nil
+		}
+		stats, err := m.icmpPing(addr, method == methodICMP)
+		if err == nil || !notPermitted(err) {
+			return stats, err
+		}
+		method = m.downgrade(method, err)
+	}
+}
+
+// icmpPing pings addr over a raw socket if privileged, a datagram one if
+// not.
+func (m *NetworkMonitor) icmpPing(addr string, privileged bool) (*MonitorStats, error) {
+	p, err := m.newPinger(addr)
+	if err != nil {
+		return nil, err
+	}
+	p.SetPrivileged(privileged)
+	if err := p.Run(); err != nil {
+		return nil, err
+	}
+	s := p.Statistics()
+	latency := float64(s.AvgRtt.Microseconds()) / 1000.0
+	loss := s.PacketLoss
+	down := loss >= 100.0
+	return &MonitorStats{Latency: &latency, Loss: &loss, IsDown: &down}, nil
+}
+
+// tcpPing connects to port 443 of addr probeCount times. A refused
+// connection still went there and back, so it counts as an answer.
+func (m *NetworkMonitor) tcpPing(addr string) *MonitorStats {
+	var (
+		total    time.Duration
+		answered int
+	)
+	target := net.JoinHostPort(addr, tcpProbePort)
+	for range probeCount {
+		ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+		start := time.Now()
+		conn, err := m.dialTCP(ctx, "tcp", target)
+		took := time.Since(start)
+		cancel()
+		if err == nil {
+			conn.Close()
+		}
+		if err == nil || errors.Is(err, syscall.ECONNREFUSED) {
+			total += took
+			answered++
+		}
+	}
+	loss := 100 * float64(probeCount-answered) / probeCount
+	down := answered == 0
+	stats := &MonitorStats{Loss: &loss, IsDown: &down}
+	if answered > 0 {
+		latency := float64((total / time.Duration(answered)).Microseconds()) / 1000.0
+		stats.Latency = &latency
+	}
+	return stats
+}
+
+// notPermitted reports whether err is the socket being refused to us.
+func notPermitted(err error) bool {
+	if errors.Is(err, os.ErrPermission) {
+		return true
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "operation not permitted") || strings.Contains(msg, "permission denied")
+}
@@ -0,0 +1,413 @@
+package monitor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/config"
+	"github.com/strct-org/strct-agent/internal/store"
+)
+
+// Reports. Every ping round and speedtest used to be its own POST to
+// network_metrics, sent as it was taken: on a metered LTE backup link the
+// requests added up, and a sample taken while the backend was unreachable
+// was lost. Samples now wait in a queue:
+//
+//   - the queue is sent every ReportInterval (MONITOR_REPORT_MINUTES,
+//     default 10) as POSTs to network_metrics/batch of up to
+//     maxReportBatch samples, and as soon as it holds maxReportBatch;
+//   - a failed send is retried after reportRetry, doubling up to
+//     maxReportBackoff; past maxQueuedReports the oldest samples are
+//     dropped;
+//   - each sample is also appended to the monitor-reports log of
+//     internal/store, and pruned from it once sent or dropped, so what a
+//     restart or a power loss leaves queued is sent after it;
+//   - a backend without the batch endpoint gets the samples one POST
+//     each, as before.
+//
+// Outage events are still posted as they happen; one that can't be is
+// queued with the samples. GET /api/network/report-status shows the queue.
+const (
+	reportsLog       = "monitor-reports"
+	legacyReports    = "monitor-reports.json" // saved at shutdown by older agents
+	maxQueuedReports = 720                    // a day of ping rounds
+	maxReportBatch   = 100
+	reportRetry      = 30 * time.Second
+	maxReportBackoff = 30 * time.Minute
+)
+
+// legacyReportsDoc is monitor-reports.json, at schema v1.
+type legacyReportsDoc struct {
+	Reports []json.RawMessage `json:"reports"`
+}
+
+func decodeLegacyReports(b []byte) ([]store.Record, error) {
+	var doc legacyReportsDoc
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	recs := make([]store.Record, len(doc.Reports))
+	for i, r := range doc.Reports {
+		recs[i] = store.Record{Key: int64(i), Data: r}
+	}
+	return recs, nil
+}
+
+// reportBatch is the body of a POST to network_metrics/batch: the
+// reports network_metrics takes one at a time, oldest first.
+type reportBatch struct {
+	Reports []json.RawMessage `json:"reports"`
+}
+
+// reportError is a non-2xx response to a report.
+type reportError struct{ code int }
+
+func (e *reportError) Error() string { return fmt.Sprintf("backend returned %d", e.code) }
+
+// retryable reports whether a failed send is worth trying again.
+func retryable(err error) bool {
+	re, ok := err.(*reportError)
+	return !ok || re.code >= 500 || re.code == http.StatusTooManyRequests
+}
+
+// unsupported reports whether the backend doesn't know the endpoint.
+func unsupported(err error) bool {
+	re, ok := err.(*reportError)
+	return ok && (re.code == http.StatusNotFound || re.code == http.StatusMethodNotAllowed)
+}
+
+// ReportStatus is GET /api/network/report-status.
+type ReportStatus struct {
+	Queued              int        `json:"queued"`
+	MaxQueued           int        `json:"max_queued"`
+	IntervalSeconds     int        `json:"interval_s"`
+	LastSuccess         *time.Time `json:"last_success,omitempty"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	LastError           string     `json:"last_error,omitempty"`
+	NextFlush           *time.Time `json:"next_flush,omitempty"`
+	Dropped             uint64     `json:"dropped"`
+}
+
+type reportQueue struct {
+	mu        sync.Mutex
+	dir       string // "": not saved
+	backend   string // STORE_BACKEND
+	log       store.Log
+	pending   []json.RawMessage
+	seq       int64         // the log's key for the next report; pending ends before it
+	kick      chan struct{} // the queue filled a batch
+	failures  int           // in a row
+	lastOK    time.Time
+	lastErr   string
+	next      time.Time
+	dropped   uint64 // only ever from the front
+	noBatches bool   // the backend has no batch endpoint
+}
+
+// queueReport adds report to the queue.
+func (m *NetworkMonitor) queueReport(report any) {
+	payload, err := json.Marshal(report)
+	if err != nil {
+		slog.Error("monitor: failed to marshal report", "err", err)
+		return
+	}
+	q := &m.reports
+	q.mu.Lock()
+	q.pending = append(q.pending, payload)
+	if q.log != nil {
+		if err := q.log.Append(store.Record{Key: q.seq, Data: payload}); err != nil {
+			slog.Warn("monitor: could not save queued report", "err", err)
+		}
+	}
+	q.seq++
+	if over := len(q.pending) - maxQueuedReports; over > 0 {
+		q.pending = q.pending[over:]
+		q.dropped += uint64(over)
+		q.pruneLocked()
+	}
+	full := len(q.pending) >= maxReportBatch && q.failures == 0
+	q.mu.Unlock()
+	if full {
+		select {
+		case q.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// runReports sends the queue every ReportInterval, or sooner when it
+// fills a batch, until ctx is done.
+func (m *NetworkMonitor) runReports(ctx context.Context) {
+	q := &m.reports
+	wait := m.reportInterval()
+	q.mu.Lock()
+	q.next = time.Now().Add(wait)
+	q.mu.Unlock()
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		case <-q.kick:
+		}
+		timer.Reset(m.flushReports(ctx))
+	}
+}
+
+func (m *NetworkMonitor) reportInterval() time.Duration {
+	if m.Config.ReportInterval > 0 {
+		return m.Config.ReportInterval
+	}
+	return config.DefaultMonitorReportMinutes * time.Minute
+}
+
+// flushReports sends the queue, oldest first, and returns how long to wait
+// before the next flush: the interval, or the backoff after a failure.
+func (m *NetworkMonitor) flushReports(ctx context.Context) time.Duration {
+	defer usage.Time()()
+	q := &m.reports
+	for {
+		q.mu.Lock()
+		n := min(len(q.pending), maxReportBatch)
+		batch := q.pending[:n:n]
+		droppedBefore := q.dropped
+		q.mu.Unlock()
+		if n == 0 {
+			break
+		}
+
+		sent, err := m.sendReports(ctx, batch)
+		rejected := err != nil && !retryable(err)
+		done := sent
+		if rejected {
+			done = n // sending them again won't change the answer
+		}
+		q.mu.Lock()
+		// Samples queued meanwhile may have pushed some of the batch out
+		// of the front already.
+		pushedOut := int(q.dropped - droppedBefore)
+		q.pending = q.pending[max(done-pushedOut, 0):]
+		q.pruneLocked()
+		if err != nil && !rejected {
+			q.failures++
+			q.lastErr = err.Error()
+			wait := min(reportRetry<<min(q.failures-1, 16), maxReportBackoff)
+			q.next = time.Now().Add(wait)
+			queued := len(q.pending)
+			q.mu.Unlock()
+			slog.Warn("monitor: report upload failed, will retry", "queued", queued, "in", wait, "err", err)
+			return wait
+		}
+		if rejected {
+			q.dropped += uint64(n - sent)
+			q.lastErr = err.Error()
+		} else {
+			q.lastOK = time.Now()
+		}
+		q.failures = 0
+		q.mu.Unlock()
+		if rejected {
+			slog.Warn("monitor: backend rejected reports, dropping them", "reports", n-sent, "err", err)
+		}
+	}
+
+	wait := m.reportInterval()
+	q.mu.Lock()
+	q.next = time.Now().Add(wait)
+	q.mu.Unlock()
+	return wait
+}
+
+// sendReports posts batch and returns how many of its reports, from the
+// front, the backend took.
+func (m *NetworkMonitor) sendReports(ctx context.Context, batch []json.RawMessage) (int, error) {
+	q := &m.reports
+	q.mu.Lock()
+	noBatches := q.noBatches
+	q.mu.Unlock()
+	if !noBatches {
+		body, err := json.Marshal(reportBatch{Reports: batch})
+		if err != nil {
+			return 0, err
+		}
+		err = m.postReport(ctx, "network_metrics/batch", body)
+		if !unsupported(err) {
+			if err != nil {
+				return 0, err
+			}
+			return len(batch), nil
+		}
+		slog.Info("monitor: backend has no batch endpoint, sending reports one at a time")
+		q.mu.Lock()
+		q.noBatches = true
+		q.mu.Unlock()
+	}
+	for i, report := range batch {
+		if err := m.postReport(ctx, "network_metrics", report); err != nil {
+			return i, err
+		}
+	}
+	return len(batch), nil
+}
+
+func (m *NetworkMonitor) reportToBackend(stats MonitorStats) {
+	stats.Timestamp = time.Now()
+	stats.Throughput = m.throughput.current()
+	m.queueReport(stats)
+}
+
+// reportOutage tells the backend an outage started or ended. It goes to
+// the same endpoint as the stats, right away; its "type" sets it apart.
+// Sent during the outage it usually can't be, and waits in the queue.
+func (m *NetworkMonitor) reportOutage(r outageReport) {
+	payload, err := json.Marshal(r)
+	if err != nil {
+		slog.Error("monitor: failed to marshal report", "err", err)
+		return
+	}
+	err = m.postReport(context.Background(), "network_metrics", payload)
+	switch {
+	case err == nil:
+	case retryable(err):
+		slog.Info("monitor: outage report queued", "err", err)
+		m.queueReport(r)
+	default:
+		slog.Warn("monitor: backend rejected outage report", "err", err)
+	}
+}
+
+// SetBackendURL is where reports go from now on, as after a config
+// reload. Queued reports go there too.
+func (m *NetworkMonitor) SetBackendURL(url string) {
+	m.mu.Lock()
+	m.Config.BackendURL = url
+	m.mu.Unlock()
+}
+
+// postReport posts payload to endpoint under the device's API path.
+func (m *NetworkMonitor) postReport(ctx context.Context, endpoint string, payload []byte) error {
+	m.mu.RLock()
+	backendURL := m.Config.BackendURL
+	m.mu.RUnlock()
+	url := fmt.Sprintf("%s/api/v1/device/agent/%s/%s", backendURL, m.Config.DeviceID, endpoint)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("build request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	// req.Header.Set("Authorization", "Bearer "+m.Config.AuthToken) //! the auth token is for the frp tunnel, not the API auth middleware
+	//! maybe auth the users into the device to have access to the token
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// Drain body so the connection is returned to the pool immediately.
+	// Without this, the transport holds the connection open until GC.
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode >= 300 {
+		return &reportError{code: resp.StatusCode}
+	}
+	return nil
+}
+
+// pruneLocked drops what is no longer pending from the log, so a restart
+// doesn't send it again.
+func (q *reportQueue) pruneLocked() {
+	if q.log == nil {
+		return
+	}
+	if err := q.log.PruneBefore(q.seq - int64(len(q.pending))); err != nil {
+		slog.Warn("monitor: could not prune queued reports", "err", err)
+	}
+}
+
+// restoreReports opens the log and queues the reports a restart left in
+// it, importing monitor-reports.json once.
+func (m *NetworkMonitor) restoreReports() {
+	q := &m.reports
+	if q.dir == "" {
+		return
+	}
+	l, err := store.Open(q.backend, q.dir, reportsLog)
+	if err != nil {
+		slog.Warn("monitor: could not open queued reports, keeping them in memory", "err", err)
+		return
+	}
+	if _, err := store.Import(l, filepath.Join(q.dir, legacyReports), decodeLegacyReports); err != nil {
+		slog.Warn("monitor: could not import monitor-reports.json", "err", err)
+	}
+	var restored []json.RawMessage
+	var seq int64
+	err = store.All(l, func(r store.Record) bool {
+		restored = append(restored, r.Data)
+		seq = r.Key + 1
+		return true
+	})
+	if err != nil {
+		slog.Warn("monitor: could not restore queued reports", "err", err)
+	}
+
+	q.mu.Lock()
+	// Reports queued before the log was open aren't in it yet.
+	for _, p := range q.pending {
+		if err := l.Append(store.Record{Key: seq, Data: p}); err != nil {
+			slog.Warn("monitor: could not save queued report", "err", err)
+		}
+		seq++
+	}
+	q.log, q.seq = l, seq
+	q.pending = append(restored, q.pending...)
+	if over := len(q.pending) - maxQueuedReports; over > 0 {
+		q.pending = q.pending[over:]
+	}
+	q.pruneLocked()
+	q.mu.Unlock()
+	if len(restored) > 0 {
+		slog.Info("monitor: queued reports restored", "reports", len(restored))
+	}
+}
+
+func (m *NetworkMonitor) reportStatus() ReportStatus {
+	q := &m.reports
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	st := ReportStatus{
+		Queued:              len(q.pending),
+		MaxQueued:           maxQueuedReports,
+		IntervalSeconds:     int(m.reportInterval() / time.Second),
+		ConsecutiveFailures: q.failures,
+		LastError:           q.lastErr,
+		Dropped:             q.dropped,
+	}
+	if !q.lastOK.IsZero() {
+		t := q.lastOK
+		st.LastSuccess = &t
+	}
+	if !q.next.IsZero() {
+		t := q.next
+		st.NextFlush = &t
+	}
+	return st
+}
+
+// HandleReportStatus shows the queue of reports for the backend.
+// GET /api/network/report-status
+func (m *NetworkMonitor) HandleReportStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m.reportStatus())
+}
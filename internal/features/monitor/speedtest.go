@@ -0,0 +1,309 @@
+package monitor
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/config"
+)
+
+// Speedtests. One 10MB file from one server measured that server as much
+// as the link: a single TCP stream rarely fills a fast line, and a slow
+// line spent minutes on it. Now the test runs for a set time over several
+// connections at once and counts what arrives:
+//
+//   - SpeedtestConnections workers GET the SpeedtestURLs in a loop for
+//     SpeedtestDuration; a URL that fails moves the worker on to the
+//     next, and Cloudflare's __down endpoint is always last.
+//   - With a SpeedtestUploadURL the same workers then POST random bytes to
+//     it for as long again.
+//
+// POST /api/network/speedtest {"duration_s": 20, "connections": 8} runs
+// one with other settings.
+const (
+	cloudflareDownURL = "https://speed.cloudflare.com/__down?bytes=25000000"
+	uploadChunk       = 25_000_000 // bytes per upload request
+	uploadPattern     = 1 << 20    // random bytes repeated as the upload body
+)
+
+// speedtestOpts are one test's settings.
+type speedtestOpts struct {
+	duration    time.Duration
+	connections int
+}
+
+// SpeedtestRequest is the optional body of POST /api/network/speedtest;
+// a zero field keeps the configured value.
+type SpeedtestRequest struct {
+	DurationS   int `json:"duration_s"`
+	Connections int `json:"connections"`
+}
+
+// defaultOpts are the configured settings.
+func (m *NetworkMonitor) defaultOpts() speedtestOpts {
+	o := speedtestOpts{duration: m.Config.SpeedtestDuration, connections: m.Config.SpeedtestConnections}
+	if o.duration <= 0 {
+		o.duration = config.DefaultSpeedtestSeconds * time.Second
+	}
+	if o.connections <= 0 {
+		o.connections = config.DefaultSpeedtestConnections
+	}
+	return o
+}
+
+// opts applies the overrides in req to the configured settings.
+func (m *NetworkMonitor) opts(req SpeedtestRequest) (speedtestOpts, error) {
+	o := m.defaultOpts()
+	if req.DurationS < 0 || req.DurationS > config.MaxSpeedtestSeconds {
+		return o, fmt.Errorf("duration_s must be between 1 and %d", config.MaxSpeedtestSeconds)
+	}
+	if req.Connections < 0 || req.Connections > config.MaxSpeedtestConnections {
+		return o, fmt.Errorf("connections must be between 1 and %d", config.MaxSpeedtestConnections)
+	}
+	if req.DurationS > 0 {
+		o.duration = time.Duration(req.DurationS) * time.Second
+	}
+	if req.Connections > 0 {
+		o.connections = req.Connections
+	}
+	return o, nil
+}
+
+// decodeSpeedtestRequest reads the optional body of POST
+// /api/network/speedtest; an empty one is the zero request.
+func decodeSpeedtestRequest(r *http.Request) (SpeedtestRequest, error) {
+	var req SpeedtestRequest
+	if r.Body == nil {
+		return req, nil
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		return req, err
+	}
+	return req, nil
+}
+
+// downloadURLs are the URLs the download workers go through, the
+// configured ones first.
+func (m *NetworkMonitor) downloadURLs() []string {
+	urls := append([]string(nil), m.Config.SpeedtestURLs...)
+	for _, u := range urls {
+		if u == cloudflareDownURL {
+			return urls
+		}
+	}
+	return append(urls, cloudflareDownURL)
+}
+
+// getBandwidth runs a speedtest. An upload that fails is logged and left
+// out; only the download failing fails the test.
+func (m *NetworkMonitor) getBandwidth(ctx context.Context, o speedtestOpts) (*MonitorStats, error) {
+	down, took, err := m.measure(ctx, o, m.downloadURLs(), m.download)
+	if err != nil {
+		return nil, fmt.Errorf("monitor: bandwidth download failed: %w", err)
+	}
+	stats := &MonitorStats{Bandwidth: &down}
+
+	if u := m.Config.SpeedtestUploadURL; u != "" {
+		body, err := newUploadBody()
+		if err != nil {
+			return nil, err
+		}
+		up, upTook, err := m.measure(ctx, o, []string{u}, func(ctx context.Context, url string, n *atomic.Int64) error {
+			return m.upload(ctx, url, body, n)
+		})
+		switch {
+		case ctx.Err() != nil:
+			return nil, ctx.Err()
+		case err != nil:
+			slog.Warn("monitor: bandwidth upload failed", "url", u, "err", err)
+		default:
+			stats.Upload = &up
+		}
+		took += upTook
+	}
+
+	secs := took.Seconds()
+	stats.SpeedtestDuration = &secs
+	return stats, nil
+}
+
+// measure runs o.connections workers calling transfer for o.duration and
+// returns the Mbps of the bytes they counted. Each worker starts on its
+// own URL and moves to the next when one fails; it stops once every URL
+// failed in a row.
+func (m *NetworkMonitor) measure(ctx context.Context, o speedtestOpts, urls []string,
+	transfer func(ctx context.Context, url string, n *atomic.Int64) error) (float64, time.Duration, error) {
+	tctx, cancel := context.WithTimeout(ctx, o.duration)
+	defer cancel()
+
+	var (
+		n       atomic.Int64
+		wg      sync.WaitGroup
+		errMu   sync.Mutex
+		lastErr error
+	)
+	start := time.Now()
+	for i := range o.connections {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			u, fails := i%len(urls), 0
+			for tctx.Err() == nil && fails < len(urls) {
+				err := transfer(tctx, urls[u], &n)
+				if err == nil {
+					fails = 0
+					continue
+				}
+				if tctx.Err() != nil {
+					return
+				}
+				errMu.Lock()
+				lastErr = err
+				errMu.Unlock()
+				fails++
+				u = (u + 1) % len(urls)
+			}
+		}()
+	}
+	wg.Wait()
+	took := time.Since(start)
+
+	if err := ctx.Err(); err != nil {
+		return 0, took, err
+	}
+	if n.Load() == 0 {
+		if lastErr == nil {
+			lastErr = errors.New("no data transferred")
+		}
+		return 0, took, lastErr
+	}
+	return float64(n.Load()) * 8 / 1_000_000 / took.Seconds(), took, nil
+}
+
+// download GETs url, counting the body into n until it ends or ctx does.
+func (m *NetworkMonitor) download(ctx context.Context, url string, n *atomic.Int64) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := m.bandwidthClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	got, err := io.Copy(counter{n}, resp.Body)
+	if err == nil && got == 0 {
+		return fmt.Errorf("%s: empty response", url)
+	}
+	return err
+}
+
+// upload POSTs uploadChunk bytes of body to url, counting them into n as
+// the transport reads them.
+func (m *NetworkMonitor) upload(ctx context.Context, url string, body []byte, n *atomic.Int64) error {
+	r := &countingReader{r: io.LimitReader(&repeatReader{buf: body}, uploadChunk), n: n}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, r)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = uploadChunk
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := m.bandwidthClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return nil
+}
+
+// newUploadBody returns the random bytes uploads repeat, so nothing on the
+// way can compress them.
+func newUploadBody() ([]byte, error) {
+	b := make([]byte, uploadPattern)
+	if _, err := rand.Read(b); err != nil {
+		return nil, fmt.Errorf("monitor: upload body: %w", err)
+	}
+	return b, nil
+}
+
+// counter is an io.Writer that only counts.
+type counter struct{ n *atomic.Int64 }
+
+func (c counter) Write(p []byte) (int, error) {
+	c.n.Add(int64(len(p)))
+	return len(p), nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	k, err := c.r.Read(p)
+	c.n.Add(int64(k))
+	return k, err
+}
+
+// repeatReader reads buf over and over.
+type repeatReader struct {
+	buf []byte
+	off int
+}
+
+func (r *repeatReader) Read(p []byte) (int, error) {
+	k := copy(p, r.buf[r.off:])
+	r.off = (r.off + k) % len(r.buf)
+	return k, nil
+}
+
+// ─── Handler ─────────────────────────────────────────────────────────────────
+
+// HandleSpeedtest starts a ping round and a speedtest, with the body's
+// overrides if it has any.
+// POST /api/network/speedtest [{"duration_s": 20, "connections": 8}]
+func (m *NetworkMonitor) HandleSpeedtest(w http.ResponseWriter, r *http.Request) {
+	if m.gate.Active() {
+		http.Error(w, "speedtests are paused for maintenance", http.StatusConflict)
+		return
+	}
+	req, err := decodeSpeedtestRequest(r)
+	if err != nil {
+		http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	o, err := m.opts(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	slog.Info("monitor: speedtest triggered via API", "duration", o.duration, "connections", o.connections)
+
+	go func() {
+		m.runPing()
+		m.runBandwidth(context.Background(), o)
+	}()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":      "speedtest_initiated",
+		"duration_s":  int(o.duration / time.Second),
+		"connections": o.connections,
+	})
+}
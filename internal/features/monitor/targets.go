@@ -0,0 +1,352 @@
+package monitor
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/errs"
+	"github.com/strct-org/strct-agent/internal/statefile"
+)
+
+// Ping targets. Each round pings every target at once, so one flaky host
+// reads as that host and not as "the internet is down":
+//
+//	POST /api/network/targets {"targets": ["gateway", "1.1.1.1", "8.8.8.8"]}
+//
+// "gateway" is the upstream router, the default route's next hop read at
+// each round. The AP gateway in wifi.Status is this device itself, so
+// pinging it would say nothing about the LAN. Other targets are IPs or
+// hostnames; a hostname that doesn't resolve is refused when set. The list
+// is kept in DataDir/monitor-targets.json. Until one is saved, and when an
+// empty list is set, MONITOR_TARGETS (monitor.targets in the config file)
+// is used, or else defaultTargets.
+//
+// The round also resolves dnsProbeName, and the results are summed up in
+// MonitorStats.Diagnosis, with the learned hops of hops.go.
+const (
+	targetGateway      = "gateway"
+	targetsFile        = "monitor-targets.json"
+	maxTargets         = 8
+	resolveTimeout     = 3 * time.Second
+	diagAllOK          = "all_ok"
+	diagLANDown        = "lan_down"         // the upstream router doesn't answer
+	diagUpstreamAPDown = "upstream_ap_down" // extender mode: the AP wlan0 joined doesn't answer
+	diagWANDown        = "lan_ok_wan_down"  // the router answers, nothing past it does
+	diagDNSOnly        = "dns_only_issue"   // pings get through, lookups fail
+	diagPartial        = "partial"          // some internet targets are down
+	diagUnreachable    = "all_down"         // nothing answers and there is no gateway target
+)
+
+var defaultTargets = []string{targetGateway, "1.1.1.1", "8.8.8.8"}
+
+// dnsProbeName is resolved each round to tell a DNS outage from a dead
+// link.
+const dnsProbeName = "www.google.com"
+
+// routeFile is where the default route is read from.
+const routeFile = "/proc/net/route"
+
+// TargetStats is one target's result in the last round.
+type TargetStats struct {
+	Target  string   `json:"target"`
+	Address string   `json:"address,omitempty"` // the router's IP, for "gateway" and learned hops
+	Role    string   `json:"role"`              // one of the role* values in hops.go
+	Auto    bool     `json:"auto,omitempty"`    // learned from the wifi mode, not set by the user
+	Latency *float64 `json:"latency,omitempty"` // ms
+	Loss    *float64 `json:"loss,omitempty"`    // %
+	IsDown  bool     `json:"is_down"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// targetsSchema versions monitor-targets.json.
+//
+//	v1: {"targets": [...]}
+var targetsSchema = statefile.Schema{
+	Name:       "monitor-targets",
+	Migrations: []statefile.Migration{statefile.Stamp},
+}
+
+type targetsDoc struct {
+	Targets []string `json:"targets"`
+}
+
+// loadTargets restores the saved targets, leaving the defaults if there
+// are none.
+func (m *NetworkMonitor) loadTargets() error {
+	if m.targetsPath == "" {
+		return nil
+	}
+	var doc targetsDoc
+	if err := statefile.Load(m.targetsPath, targetsSchema, &doc); err != nil {
+		if statefile.Fresh(err) {
+			return nil
+		}
+		return fmt.Errorf("load monitor targets: %w", err)
+	}
+	if len(doc.Targets) > 0 {
+		m.mu.Lock()
+		m.targets = doc.Targets
+		m.mu.Unlock()
+	}
+	return nil
+}
+
+// configuredTargets trims and dedupes MONITOR_TARGETS, keeping at most
+// maxTargets. They are not resolved: at start there may be no network to
+// ask, and one that never resolves reads as down.
+func configuredTargets(targets []string) []string {
+	var out []string
+	for _, t := range targets {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" || slices.Contains(out, t) {
+			continue
+		}
+		if len(out) == maxTargets {
+			slog.Warn("monitor: too many MONITOR_TARGETS, ignoring the rest", "max", maxTargets, "from", t)
+			break
+		}
+		out = append(out, t)
+	}
+	return out
+}
+
+func (m *NetworkMonitor) currentTargets() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]string(nil), m.targets...)
+}
+
+// normalizeTargets trims and dedupes targets and checks each one is
+// "gateway", an IP or a hostname that resolves, reporting every one that
+// doesn't as an *errs.Validation. An empty list means the defaults.
+func (m *NetworkMonitor) normalizeTargets(ctx context.Context, targets []string) ([]string, error) {
+	if len(targets) == 0 {
+		return append([]string(nil), m.defaults...), nil
+	}
+	var v errs.Validation
+	if len(targets) > maxTargets {
+		v.Addf("targets", errs.CodeOutOfRange, "at most %d targets", maxTargets)
+		return nil, v.Err()
+	}
+	var out []string
+	seen := map[string]bool{}
+	for i, t := range targets {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" || seen[t] {
+			continue
+		}
+		seen[t] = true
+		if t != targetGateway && net.ParseIP(t) == nil {
+			rctx, cancel := context.WithTimeout(ctx, resolveTimeout)
+			addrs, err := m.lookupHost(rctx, t)
+			cancel()
+			if err != nil || len(addrs) == 0 {
+				v.Addf(fmt.Sprintf("targets[%d]", i), errs.CodeNotFound, "target %q does not resolve", t)
+				continue
+			}
+		}
+		out = append(out, t)
+	}
+	if err := v.Err(); err != nil {
+		return nil, err
+	}
+	if len(out) == 0 {
+		v.Add("targets", errs.CodeRequired, "no targets")
+		return nil, v.Err()
+	}
+	return out, nil
+}
+
+// HandleGetTargets returns the ping targets.
+// GET /api/network/targets
+func (m *NetworkMonitor) HandleGetTargets(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(targetsDoc{Targets: m.currentTargets()})
+}
+
+// HandleSetTargets replaces the ping targets and runs a round with them.
+// POST /api/network/targets {"targets": [...]}; an empty list restores
+// the defaults.
+func (m *NetworkMonitor) HandleSetTargets(w http.ResponseWriter, r *http.Request) {
+	var req targetsDoc
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	targets, err := m.normalizeTargets(r.Context(), req.Targets)
+	if err != nil {
+		errs.HTTPResponse(w, err)
+		return
+	}
+	if m.targetsPath != "" {
+		if err := statefile.Save(m.targetsPath, targetsSchema, targetsDoc{Targets: targets}); err != nil {
+			http.Error(w, "save targets: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	m.mu.Lock()
+	m.targets = targets
+	m.mu.Unlock()
+	slog.Info("monitor: ping targets set", "targets", targets)
+
+	go m.runPing()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(targetsDoc{Targets: targets})
+}
+
+// pingAll pings every target and learned hop at once and resolves
+// dnsProbeName alongside. Hops come after the targets.
+func (m *NetworkMonitor) pingAll(targets []string, hops []hop) (results []TargetStats, dnsOK bool) {
+	results = make([]TargetStats, len(targets)+len(hops))
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = m.pingOne(t)
+		}()
+	}
+	for i, h := range hops {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[len(targets)+i] = m.pingHop(h)
+		}()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	addrs, err := m.lookupHost(ctx, dnsProbeName)
+	cancel()
+	wg.Wait()
+	return results, err == nil && len(addrs) > 0
+}
+
+func (m *NetworkMonitor) pingOne(target string) TargetStats {
+	ts := TargetStats{Target: target, Role: roleInternet, IsDown: true}
+	addr := target
+	if target == targetGateway {
+		ts.Role = roleGateway
+		gw, err := defaultGateway(m.routeFile, "")
+		if err != nil {
+			ts.Error = err.Error()
+			return ts
+		}
+		addr = gw
+	}
+	if addr != target {
+		ts.Address = addr
+	}
+	return m.pingAddr(ts, addr)
+}
+
+// pingAddr fills ts in with a ping of addr.
+func (m *NetworkMonitor) pingAddr(ts TargetStats, addr string) TargetStats {
+	stats, err := m.ping(addr)
+	if err != nil {
+		ts.Error = err.Error()
+		return ts
+	}
+	ts.Latency, ts.Loss, ts.IsDown = stats.Latency, stats.Loss, *stats.IsDown
+	return ts
+}
+
+// defaultGateway reads the default route's next hop from path, on iface
+// or on any interface when iface is "", in the format of /proc/net/route:
+//
+//	Iface Destination Gateway  Flags ...
+//	eth0  00000000    0101A8C0 0003  ...
+//
+// Addresses are little-endian hex.
+func defaultGateway(path, iface string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 3 || fields[1] != "00000000" || (iface != "" && fields[0] != iface) {
+			continue
+		}
+		b, err := hex.DecodeString(fields[2])
+		if err != nil || len(b) != 4 || fields[2] == "00000000" {
+			continue
+		}
+		return net.IPv4(b[3], b[2], b[1], b[0]).String(), nil
+	}
+	if iface != "" {
+		return "", fmt.Errorf("no default route on %s", iface)
+	}
+	return "", fmt.Errorf("no default route")
+}
+
+// summarize folds a round into the headline stats: the best internet
+// target's latency and loss, down only when none answers, and the
+// diagnosis. The gateway and learned hops are local: with no internet
+// targets they stand in.
+func summarize(results []TargetStats, dnsOK bool) (latency, loss *float64, down bool, diagnosis string) {
+	var wan []TargetStats
+	gatewayDown, upstreamAPDown, haveGateway := false, false, false
+	for _, r := range results {
+		switch r.Role {
+		case roleUpstreamAP:
+			haveGateway, upstreamAPDown = true, upstreamAPDown || r.IsDown
+		case roleGateway, roleWANHop:
+			haveGateway, gatewayDown = true, gatewayDown || r.IsDown
+		default:
+			wan = append(wan, r)
+		}
+	}
+	if len(wan) == 0 {
+		wan = results
+	}
+
+	up := 0
+	for _, r := range wan {
+		if r.IsDown {
+			continue
+		}
+		up++
+		if latency == nil || (r.Latency != nil && *r.Latency < *latency) {
+			latency = r.Latency
+		}
+		if loss == nil || (r.Loss != nil && *r.Loss < *loss) {
+			loss = r.Loss
+		}
+	}
+	if up == 0 {
+		all := 100.0
+		loss = &all
+	}
+	down = up == 0
+
+	switch {
+	case upstreamAPDown:
+		diagnosis = diagUpstreamAPDown
+	case gatewayDown:
+		diagnosis = diagLANDown
+	case down && haveGateway:
+		diagnosis = diagWANDown
+	case down:
+		diagnosis = diagUnreachable
+	case !dnsOK:
+		diagnosis = diagDNSOnly
+	case up < len(wan):
+		diagnosis = diagPartial
+	default:
+		diagnosis = diagAllOK
+	}
+	return latency, loss, down, diagnosis
+}
@@ -0,0 +1,251 @@
+package monitor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	wifi_feature "github.com/strct-org/strct-agent/internal/features/wifi"
+)
+
+// Throughput. A speedtest fills the link for as long as it runs, which is
+// not what "how busy is my internet right now" should cost. The kernel
+// already counts every byte per interface in /proc/net/dev, so every
+// throughputInterval the monitor reads the counters of the WAN (eth0, or
+// wlan0 in extender mode) and the AP interface from wifi.Status and turns
+// the difference into rates.
+//
+// The last hour is kept in memory for sparklines; GET
+// /api/network/throughput serves it with the current and peak rates, and
+// the current rate goes out with every report to the backend.
+const (
+	netDevPath         = "/proc/net/dev"
+	throughputInterval = 5 * time.Second
+	throughputWindow   = time.Hour
+	throughputPoints   = int(throughputWindow / throughputInterval)
+	wanIface           = "eth0"
+	extenderWANIface   = "wlan0"
+)
+
+// wifiStatus is what the monitor needs from wifi: which interfaces are
+// the AP and the WAN, and a hook to follow mode changes.
+type wifiStatus interface {
+	Status() wifi_feature.Status
+	OnApply(fn func())
+}
+
+// UseWiFi samples the AP interface, and the extender WAN, from w's
+// status, and pings the hops of its mode (see hops.go). Without it only
+// eth0 is sampled and no hop is learned. Call before Start.
+func (m *NetworkMonitor) UseWiFi(w wifiStatus) {
+	m.wifi = w
+	w.OnApply(m.wifiApplied)
+}
+
+// netCounters are an interface's byte counters.
+type netCounters struct{ rx, tx uint64 }
+
+// parseNetDev reads /proc/net/dev:
+//
+//	Inter-|   Receive                                                |  Transmit
+//	 face |bytes    packets errs drop fifo frame compressed multicast|bytes    packets ...
+//	  eth0: 1215645452 1017391    0    0    0     0          0      2133 125164722  661021 ...
+//
+// Old kernels run the name and a long rx count together ("eth0:1215645452").
+func parseNetDev(data []byte) (map[string]netCounters, error) {
+	out := map[string]netCounters{}
+	for _, line := range strings.Split(string(data), "\n") {
+		name, rest, ok := strings.Cut(line, ":")
+		if !ok || strings.Contains(name, "|") {
+			continue
+		}
+		f := strings.Fields(rest)
+		if len(f) < 9 {
+			return nil, fmt.Errorf("parse %s: short line for %s", netDevPath, strings.TrimSpace(name))
+		}
+		rx, err1 := strconv.ParseUint(f[0], 10, 64)
+		tx, err2 := strconv.ParseUint(f[8], 10, 64)
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("parse %s: bad counters for %s", netDevPath, strings.TrimSpace(name))
+		}
+		out[strings.TrimSpace(name)] = netCounters{rx, tx}
+	}
+	return out, nil
+}
+
+// ThroughputPoint is one sample: Mbps in and out on the WAN and the AP.
+type ThroughputPoint struct {
+	T     int64   `json:"t"` // Unix seconds
+	WANRx float64 `json:"wan_rx"`
+	WANTx float64 `json:"wan_tx"`
+	APRx  float64 `json:"ap_rx"`
+	APTx  float64 `json:"ap_tx"`
+}
+
+// IfaceRate is an interface's current and peak rates in Mbps; the peaks
+// are over the last hour.
+type IfaceRate struct {
+	Iface  string  `json:"iface"`
+	RxMbps float64 `json:"rx_mbps"`
+	TxMbps float64 `json:"tx_mbps"`
+	PeakRx float64 `json:"peak_rx_mbps,omitempty"`
+	PeakTx float64 `json:"peak_tx_mbps,omitempty"`
+}
+
+// Throughput is the live rate sent to the backend with MonitorStats.
+type Throughput struct {
+	WAN IfaceRate  `json:"wan"`
+	AP  *IfaceRate `json:"ap,omitempty"` // nil without an AP
+}
+
+type throughput struct {
+	mu     sync.Mutex
+	wan    string
+	ap     string // "": no AP
+	last   map[string]netCounters
+	lastAt time.Time
+	points []ThroughputPoint // oldest first
+}
+
+// observe turns counters read at now into a point. The first read only
+// sets the baseline; an interface that wasn't there before, or whose
+// counters went back (a driver reload), reads 0 for one point.
+func (t *throughput) observe(now time.Time, counters map[string]netCounters, wan, ap string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	prev, prevAt := t.last, t.lastAt
+	t.last, t.lastAt, t.wan, t.ap = counters, now, wan, ap
+	secs := now.Sub(prevAt).Seconds()
+	if prev == nil || secs <= 0 {
+		return
+	}
+
+	p := ThroughputPoint{T: now.Unix()}
+	p.WANRx, p.WANTx = rates(prev, counters, wan, secs)
+	if ap != "" {
+		p.APRx, p.APTx = rates(prev, counters, ap, secs)
+	}
+	t.points = append(t.points, p)
+	if len(t.points) > throughputPoints {
+		t.points = t.points[len(t.points)-throughputPoints:]
+	}
+}
+
+// rates is iface's Mbps in and out between two reads secs apart.
+func rates(prev, cur map[string]netCounters, iface string, secs float64) (rx, tx float64) {
+	a, ok1 := prev[iface]
+	b, ok2 := cur[iface]
+	if !ok1 || !ok2 {
+		return 0, 0
+	}
+	mbps := func(from, to uint64) float64 {
+		if to < from {
+			return 0
+		}
+		return float64(to-from) * 8 / 1_000_000 / secs
+	}
+	return mbps(a.rx, b.rx), mbps(a.tx, b.tx)
+}
+
+// current is the last point's rates with the peaks of the window, or nil
+// before the second read.
+func (t *throughput) current() *Throughput {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.points) == 0 {
+		return nil
+	}
+	last := t.points[len(t.points)-1]
+	cur := &Throughput{WAN: IfaceRate{Iface: t.wan, RxMbps: last.WANRx, TxMbps: last.WANTx}}
+	if t.ap != "" {
+		cur.AP = &IfaceRate{Iface: t.ap, RxMbps: last.APRx, TxMbps: last.APTx}
+	}
+	for _, p := range t.points {
+		cur.WAN.PeakRx = max(cur.WAN.PeakRx, p.WANRx)
+		cur.WAN.PeakTx = max(cur.WAN.PeakTx, p.WANTx)
+		if cur.AP != nil {
+			cur.AP.PeakRx = max(cur.AP.PeakRx, p.APRx)
+			cur.AP.PeakTx = max(cur.AP.PeakTx, p.APTx)
+		}
+	}
+	return cur
+}
+
+func (t *throughput) window() []ThroughputPoint {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]ThroughputPoint{}, t.points...)
+}
+
+// sampleThroughput reads the counters once.
+func (m *NetworkMonitor) sampleThroughput() {
+	data, err := m.readNetDev()
+	if err != nil {
+		slog.Debug("monitor: could not read interface counters", "err", err)
+		return
+	}
+	counters, err := parseNetDev(data)
+	if err != nil {
+		slog.Warn("monitor: interface counters", "err", err)
+		return
+	}
+	wan, ap := wanIface, ""
+	if m.wifi != nil {
+		st := m.wifi.Status()
+		if st.Active {
+			ap = st.APInterface
+		}
+		if st.Mode == wifi_feature.ModeExtender {
+			wan = extenderWANIface
+		}
+	}
+	m.throughput.observe(time.Now(), counters, wan, ap)
+}
+
+// runThroughput samples the counters until ctx ends.
+func (m *NetworkMonitor) runThroughput(ctx context.Context) {
+	m.sampleThroughput()
+	ticker := time.NewTicker(throughputInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.sampleThroughput()
+		}
+	}
+}
+
+// devNetDev stands in for /proc/net/dev on a dev machine: eth0 and wlan0
+// move a steady 24 Mbps down and 3 Mbps up from start.
+func devNetDev(start time.Time) func() ([]byte, error) {
+	return func() ([]byte, error) {
+		s := uint64(time.Since(start).Seconds())
+		down, up := 3_000_000*s, 375_000*s
+		return []byte(fmt.Sprintf(`Inter-|   Receive                                                |  Transmit
+ face |bytes    packets errs drop fifo frame compressed multicast|bytes    packets errs drop fifo colls carrier compressed
+    lo:   48213     512    0    0    0     0          0         0    48213     512    0    0    0     0       0          0
+  eth0: %d    0    0    0    0     0          0         0 %d    0    0    0    0     0       0          0
+ wlan0: %d    0    0    0    0     0          0         0 %d    0    0    0    0     0       0          0
+`, down, up, up, down)), nil
+	}
+}
+
+// HandleThroughput returns the current and peak rates and the last hour
+// of samples.
+// GET /api/network/throughput
+func (m *NetworkMonitor) HandleThroughput(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"interval_s": int(throughputInterval / time.Second),
+		"current":    m.throughput.current(),
+		"samples":    m.throughput.window(),
+	})
+}
@@ -0,0 +1,162 @@
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/strct-org/strct-agent/internal/audit"
+	"github.com/strct-org/strct-agent/internal/platform/firewall"
+)
+
+// blockChain holds one DROP rule per blocked MAC and is jumped from both
+// INPUT and FORWARD, so a blocked device can reach neither the box nor the
+// internet. Living in its own chain keeps the rules out of reach of the
+// wifi teardown, which only deletes its own FORWARD rules.
+const blockChain = "STRCT_BLOCK"
+
+func macDropRule(mac string) []string {
+	return []string{"-m", "mac", "--mac-source", mac, "-j", "DROP"}
+}
+
+// handleBlockDevice toggles iptables DROP rules for a specific MAC.
+// POST body: {"mac":"XX:XX:XX:XX:XX:XX","block":true}
+// Runs iptables OUTSIDE the mutex — holding a write lock during exec is
+// the bug identified in audit issue #3.
+func (rc *RouterController) handleBlockDevice(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		MAC   string `json:"mac"`
+		Block bool   `json:"block"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	// Validate MAC format before passing to iptables
+	if !validMAC(req.MAC) {
+		http.Error(w, "invalid MAC address", http.StatusBadRequest)
+		return
+	}
+	mac := strings.ToLower(req.MAC) // arp reports lower case
+	audit.Target(r.Context(), fmt.Sprintf("mac=%s block=%t", mac, req.Block))
+
+	// Update state first (fast, under lock)
+	rc.mu.Lock()
+	if req.Block {
+		rc.blockedMACs[mac] = true
+	} else {
+		delete(rc.blockedMACs, mac)
+	}
+	rc.mu.Unlock()
+
+	if err := rc.saveState(); err != nil {
+		slog.Error("router: could not persist state", "err", err)
+	}
+
+	rc.mu.RLock()
+	scheduled := rc.scheduled[mac]
+	rc.mu.RUnlock()
+
+	// Run iptables OUTSIDE the lock — these can take hundreds of milliseconds
+	// and would deadlock readers if held under mu.
+	var err error
+	switch {
+	case req.Block:
+		err = rc.blockMAC(mac)
+	case scheduled:
+		// An open schedule window keeps its DROP rule.
+		slog.Info("router: manual block lifted, schedule still blocks", "mac", mac)
+	default:
+		err = rc.unblockMAC(mac)
+	}
+	if err != nil {
+		slog.Error("router: iptables block failed", "mac", mac, "err", err)
+		http.Error(w, "iptables error", http.StatusInternalServerError)
+		return
+	}
+
+	// Reflect the change in the cached list without waiting for a scan.
+	rc.refreshBlockedDevices()
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// ─── Per-device iptables helpers (run OUTSIDE any mutex) ─────────────────────
+
+func (rc *RouterController) ensureBlockChain() error {
+	for _, parent := range []string{"INPUT", "FORWARD"} {
+		if err := firewall.EnsureChain(rc.cmd, "filter", blockChain, parent); err != nil {
+			return fmt.Errorf("%s chain from %s: %w", blockChain, parent, err)
+		}
+	}
+	return nil
+}
+
+// blockMAC adds the DROP rule for a MAC address. Blocking an already
+// blocked MAC is a no-op (checked with iptables -C).
+//
+//	iptables -t filter -A STRCT_BLOCK -m mac --mac-source MAC -j DROP
+func (rc *RouterController) blockMAC(mac string) error {
+	if err := rc.ensureBlockChain(); err != nil {
+		return err
+	}
+	if err := firewall.EnsureRule(rc.cmd, "filter", blockChain, macDropRule(mac)...); err != nil {
+		return fmt.Errorf("block %s: %w", mac, err)
+	}
+	slog.Info("router: device blocked", "mac", mac)
+	return nil
+}
+
+// unblockMAC deletes the DROP rule for a MAC address, if present.
+//
+//	iptables -t filter -D STRCT_BLOCK -m mac --mac-source MAC -j DROP
+func (rc *RouterController) unblockMAC(mac string) error {
+	if err := firewall.DeleteRule(rc.cmd, "filter", blockChain, macDropRule(mac)...); err != nil {
+		return fmt.Errorf("unblock %s: %w", mac, err)
+	}
+	slog.Info("router: device unblocked", "mac", mac)
+	return nil
+}
+
+// applyBlocks rebuilds STRCT_BLOCK from the manual blocks and open
+// schedule windows — on start, and after applyFirewall's flush.
+func (rc *RouterController) applyBlocks() error {
+	if err := rc.ensureBlockChain(); err != nil {
+		return err
+	}
+	firewall.FlushChain(rc.cmd, "filter", blockChain) //nolint:errcheck
+
+	reasons := rc.blockReasons()
+	macs := make([]string, 0, len(reasons))
+	for mac := range reasons {
+		macs = append(macs, mac)
+	}
+	sort.Strings(macs)
+
+	var errs []string
+	for _, mac := range macs {
+		if err := rc.cmd.Run("iptables", append([]string{"-t", "filter", "-A", blockChain}, macDropRule(mac)...)...); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", mac, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("mac blocks: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// sortedBlocked returns the blocked MACs in a stable order.
+func (rc *RouterController) sortedBlocked() []string {
+	rc.mu.RLock()
+	out := make([]string, 0, len(rc.blockedMACs))
+	for mac := range rc.blockedMACs {
+		out = append(out, mac)
+	}
+	rc.mu.RUnlock()
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,262 @@
+package router
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/httputil"
+	"github.com/strct-org/strct-agent/internal/statefile"
+)
+
+const (
+	// historySaveInterval bounds how often last_seen alone is flushed —
+	// scans run every 10s and the SD card shouldn't take a write each time.
+	// New devices and new sessions are saved immediately.
+	historySaveInterval = 5 * time.Minute
+	maxNewDeviceEvents  = 200
+)
+
+// DeviceHistory is everything remembered about a MAC across reboots.
+type DeviceHistory struct {
+	MAC            string    `json:"mac"`
+	FirstSeen      time.Time `json:"first_seen"`
+	LastSeen       time.Time `json:"last_seen"`
+	TotalSessions  int       `json:"total_sessions"`
+	LastIP         string    `json:"last_ip"`
+	Name           string    `json:"name"`
+	PrivateAddress bool      `json:"private_address"`
+}
+
+// NewDeviceEvent is recorded the first time a MAC is ever seen.
+type NewDeviceEvent struct {
+	MAC            string    `json:"mac"`
+	IP             string    `json:"ip"`
+	Name           string    `json:"name"`
+	Vendor         string    `json:"vendor,omitempty"`
+	PrivateAddress bool      `json:"private_address"`
+	SeenAt         time.Time `json:"seen_at"`
+}
+
+// isPrivateMAC reports whether mac is locally administered — what phones
+// use for per-network MAC randomization. Such a device shows up as "new"
+// whenever it rotates its address, so events and history flag it for the
+// app to treat with less alarm.
+func isPrivateMAC(mac string) bool {
+	if len(mac) < 2 {
+		return false
+	}
+	b, err := strconv.ParseUint(mac[:2], 16, 8)
+	return err == nil && b&0x02 != 0
+}
+
+type persistedHistory struct {
+	Devices []DeviceHistory  `json:"devices"`
+	Events  []NewDeviceEvent `json:"events"`
+	Wakes   []WakeEvent      `json:"wakes"`
+}
+
+// deviceHistory tracks every MAC the scan loop has seen. A session starts
+// when a MAC appears that was absent from the previous scan.
+type deviceHistory struct {
+	mu      sync.Mutex
+	path    string
+	devices map[string]*DeviceHistory
+	events  []NewDeviceEvent
+	wakes   []WakeEvent
+	online  map[string]bool
+	saved   time.Time
+	now     func() time.Time
+}
+
+func newDeviceHistory(dataDir string) *deviceHistory {
+	return &deviceHistory{
+		path:    filepath.Join(dataDir, "device-history.json"),
+		devices: make(map[string]*DeviceHistory),
+		online:  make(map[string]bool),
+		now:     time.Now,
+	}
+}
+
+func (h *deviceHistory) load() error {
+	var ph persistedHistory
+	if err := statefile.Load(h.path, historySchema, &ph); err != nil {
+		if statefile.Fresh(err) {
+			return nil
+		}
+		return fmt.Errorf("load device history: %w", err)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i := range ph.Devices {
+		d := ph.Devices[i]
+		h.devices[d.MAC] = &d
+	}
+	h.events = ph.Events
+	h.wakes = ph.Wakes
+	return nil
+}
+
+// observe records one scan and returns the devices never seen before.
+func (h *deviceHistory) observe(devices []ConnectedDevice) []NewDeviceEvent {
+	h.mu.Lock()
+	now := h.now()
+	var fresh []NewDeviceEvent
+	dirty := false
+	online := make(map[string]bool, len(devices))
+
+	for _, d := range devices {
+		online[d.MAC] = true
+		e, known := h.devices[d.MAC]
+		if !known {
+			e = &DeviceHistory{MAC: d.MAC, FirstSeen: now, PrivateAddress: isPrivateMAC(d.MAC)}
+			h.devices[d.MAC] = e
+			fresh = append(fresh, NewDeviceEvent{
+				MAC:            d.MAC,
+				IP:             d.IP,
+				Name:           d.Name,
+				Vendor:         d.Vendor,
+				PrivateAddress: e.PrivateAddress,
+				SeenAt:         now,
+			})
+		}
+		if !h.online[d.MAC] {
+			e.TotalSessions++
+			dirty = true
+		}
+		e.LastSeen, e.LastIP, e.Name = now, d.IP, d.Name
+	}
+	h.online = online
+
+	if len(fresh) > 0 {
+		h.events = append(h.events, fresh...)
+		if over := len(h.events) - maxNewDeviceEvents; over > 0 {
+			h.events = h.events[over:]
+		}
+	}
+	save := dirty || now.Sub(h.saved) >= historySaveInterval
+	var snapshot persistedHistory
+	if save {
+		h.saved = now
+		snapshot = h.snapshotLocked()
+	}
+	h.mu.Unlock()
+
+	if save {
+		if err := statefile.Save(h.path, historySchema, snapshot); err != nil {
+			slog.Warn("router: could not persist device history", "err", err)
+		}
+	}
+	return fresh
+}
+
+func (h *deviceHistory) snapshotLocked() persistedHistory {
+	ph := persistedHistory{
+		Devices: make([]DeviceHistory, 0, len(h.devices)),
+		Events:  append([]NewDeviceEvent{}, h.events...),
+		Wakes:   append([]WakeEvent{}, h.wakes...),
+	}
+	for _, d := range h.devices {
+		ph.Devices = append(ph.Devices, *d)
+	}
+	// Most recently seen first — what the dashboard wants to show.
+	sort.Slice(ph.Devices, func(i, j int) bool {
+		if !ph.Devices[i].LastSeen.Equal(ph.Devices[j].LastSeen) {
+			return ph.Devices[i].LastSeen.After(ph.Devices[j].LastSeen)
+		}
+		return ph.Devices[i].MAC < ph.Devices[j].MAC
+	})
+	return ph
+}
+
+// eventsSince returns new-device events strictly after since.
+func (h *deviceHistory) eventsSince(since time.Time) []NewDeviceEvent {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	out := []NewDeviceEvent{}
+	for _, e := range h.events {
+		if e.SeenAt.After(since) {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// lastSeen returns when the scan last saw mac and at which address.
+func (h *deviceHistory) lastSeen(mac string) (time.Time, string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if d, ok := h.devices[mac]; ok {
+		return d.LastSeen, d.LastIP
+	}
+	return time.Time{}, ""
+}
+
+// recordWake keeps ev, saving at once: a failed wake is what someone
+// comes looking for.
+func (h *deviceHistory) recordWake(ev WakeEvent) {
+	h.mu.Lock()
+	h.wakes = append(h.wakes, ev)
+	if over := len(h.wakes) - maxWakeEvents; over > 0 {
+		h.wakes = h.wakes[over:]
+	}
+	snapshot := h.snapshotLocked()
+	h.mu.Unlock()
+	if err := statefile.Save(h.path, historySchema, snapshot); err != nil {
+		slog.Warn("router: could not persist device history", "err", err)
+	}
+}
+
+// wakesSince returns wake events that finished after since, for mac if set.
+func (h *deviceHistory) wakesSince(since time.Time, mac string) []WakeEvent {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	out := []WakeEvent{}
+	for _, e := range h.wakes {
+		if e.FinishedAt.After(since) && (mac == "" || e.MAC == mac) {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// parseSince accepts RFC 3339 or Unix seconds; "" means the beginning.
+func parseSince(raw string) (time.Time, error) {
+	if raw == "" {
+		return time.Time{}, nil
+	}
+	if secs, err := strconv.ParseInt(raw, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("since must be RFC 3339 or Unix seconds")
+	}
+	return t, nil
+}
+
+// handleDeviceHistory lists every device ever seen, most recent first.
+// GET /api/router/devices/history
+func (rc *RouterController) handleDeviceHistory(w http.ResponseWriter, r *http.Request) {
+	rc.history.mu.Lock()
+	ph := rc.history.snapshotLocked()
+	rc.history.mu.Unlock()
+	httputil.OK(w, ph.Devices)
+}
+
+// handleNewDevices lists first-seen events, optionally after a timestamp.
+// GET /api/router/devices/new?since=2024-06-01T12:00:00Z
+func (rc *RouterController) handleNewDevices(w http.ResponseWriter, r *http.Request) {
+	since, err := parseSince(strings.TrimSpace(r.URL.Query().Get("since")))
+	if err != nil {
+		httputil.BadRequest(w, err.Error())
+		return
+	}
+	httputil.OK(w, rc.history.eventsSince(since))
+}
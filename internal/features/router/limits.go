@@ -0,0 +1,284 @@
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/strct-org/strct-agent/internal/httputil"
+	"github.com/strct-org/strct-agent/internal/platform/firewall"
+)
+
+// Per-device bandwidth limits.
+//
+// Each limited device gets a class id N (also used as its fwmark). Packets
+// from the device's MAC are marked N in mangle/STRCT_LIMIT and the mark is
+// saved on the connection, so replies coming back from the WAN get it too:
+//
+//	iptables -t mangle -A STRCT_LIMIT -j CONNMARK --restore-mark
+//	iptables -t mangle -A STRCT_LIMIT -m mac --mac-source MAC -j MARK --set-mark N
+//	iptables -t mangle -A STRCT_LIMIT -m mac --mac-source MAC -j CONNMARK --save-mark
+//
+// tc then shapes by mark on the egress side of each direction — download
+// leaves through the AP interface, upload through the WAN interface:
+//
+//	tc qdisc add dev IFACE root handle 1: htb default 3e7   (class 999, unshaped)
+//	tc class add dev IFACE parent 1: classid 1:N htb rate RATE
+//	tc filter add dev IFACE parent 1: protocol ip handle N fw flowid 1:N
+const (
+	limitChain    = "STRCT_LIMIT"
+	limitAPIface  = "wlan0" // download: traffic towards devices
+	limitWANIface = "eth0"  // upload: traffic towards the internet
+
+	limitDefaultClass = 999
+	limitFirstClass   = 10
+)
+
+// DeviceLimit is one device's bandwidth cap. A zero rate leaves that
+// direction unshaped.
+type DeviceLimit struct {
+	MAC          string  `json:"mac"`
+	DownloadMbps float64 `json:"download_mbps"`
+	UploadMbps   float64 `json:"upload_mbps"`
+	ClassID      int     `json:"class_id"`
+}
+
+func (l DeviceLimit) classID() string { return fmt.Sprintf("1:%x", l.ClassID) }
+
+// handleSetLimit installs or updates a device limit.
+// POST body: {"mac":"XX:XX:XX:XX:XX:XX","download_mbps":5,"upload_mbps":1}
+func (rc *RouterController) handleSetLimit(w http.ResponseWriter, r *http.Request) {
+	var req DeviceLimit
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httputil.BadRequest(w, "invalid JSON")
+		return
+	}
+	if !validMAC(req.MAC) {
+		httputil.BadRequest(w, "invalid MAC address")
+		return
+	}
+	if req.DownloadMbps < 0 || req.UploadMbps < 0 {
+		httputil.BadRequest(w, "rates must not be negative")
+		return
+	}
+	if req.DownloadMbps == 0 && req.UploadMbps == 0 {
+		httputil.BadRequest(w, "set download_mbps or upload_mbps; use DELETE to remove a limit")
+		return
+	}
+	mac := strings.ToLower(req.MAC)
+
+	rc.mu.Lock()
+	limit := DeviceLimit{MAC: mac, DownloadMbps: req.DownloadMbps, UploadMbps: req.UploadMbps}
+	if existing, ok := rc.limits[mac]; ok {
+		limit.ClassID = existing.ClassID
+	} else {
+		limit.ClassID = nextLimitClass(rc.limits)
+	}
+	rc.limits[mac] = limit
+	rc.mu.Unlock()
+
+	rc.respondLimitApplied(w, limit)
+}
+
+// handleRemoveLimit removes a device limit.
+// DELETE body: {"mac":"XX:XX:XX:XX:XX:XX"}
+func (rc *RouterController) handleRemoveLimit(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		MAC string `json:"mac"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httputil.BadRequest(w, "invalid JSON")
+		return
+	}
+	if !validMAC(req.MAC) {
+		httputil.BadRequest(w, "invalid MAC address")
+		return
+	}
+	mac := strings.ToLower(req.MAC)
+
+	rc.mu.Lock()
+	limit, ok := rc.limits[mac]
+	delete(rc.limits, mac)
+	rc.mu.Unlock()
+
+	if !ok {
+		httputil.Error(w, http.StatusNotFound, "no limit for "+mac)
+		return
+	}
+	limit.DownloadMbps, limit.UploadMbps = 0, 0
+	rc.respondLimitApplied(w, limit)
+}
+
+// respondLimitApplied persists the limit set, re-applies it and reports
+// whether tc accepted it. tc runs outside the lock.
+func (rc *RouterController) respondLimitApplied(w http.ResponseWriter, limit DeviceLimit) {
+	if err := rc.saveState(); err != nil {
+		slog.Error("router: could not persist state", "err", err)
+	}
+
+	resp := map[string]any{"limit": limit, "applied": true}
+	err := rc.applyLimits()
+	if err != nil {
+		slog.Warn("router: bandwidth limit apply failed", "mac", limit.MAC, "err", err)
+		resp["applied"] = false
+		resp["error"] = err.Error()
+	}
+
+	// Update the cached device list now rather than waiting for the next
+	// scan, which re-reads the real tc state anyway.
+	limited := err == nil && (limit.DownloadMbps > 0 || limit.UploadMbps > 0)
+	rc.mu.Lock()
+	for i := range rc.devices {
+		if rc.devices[i].MAC == limit.MAC {
+			rc.devices[i].Limited = limited
+			rc.devices[i].LimitMbps = limit.DownloadMbps
+			rc.devices[i].UploadLimitMbps = limit.UploadMbps
+		}
+	}
+	rc.mu.Unlock()
+
+	httputil.OK(w, resp)
+}
+
+// nextLimitClass returns the lowest class id not used by limits.
+func nextLimitClass(limits map[string]DeviceLimit) int {
+	used := map[int]bool{}
+	for _, l := range limits {
+		used[l.ClassID] = true
+	}
+	id := limitFirstClass
+	for used[id] || id == limitDefaultClass {
+		id++
+	}
+	return id
+}
+
+// sortedLimits returns the limits ordered by class id so applies are
+// deterministic.
+func (rc *RouterController) sortedLimits() []DeviceLimit {
+	rc.mu.RLock()
+	defer rc.mu.RUnlock()
+	out := make([]DeviceLimit, 0, len(rc.limits))
+	for _, l := range rc.limits {
+		out = append(out, l)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ClassID < out[j].ClassID })
+	return out
+}
+
+// applyLimits rebuilds the STRCT_LIMIT chain and both HTB trees from the
+// current limit set. Like applyFirewall it starts from scratch each time;
+// the brief gap in shaping is not noticeable. Priority rules are layered
+// on afterwards since deleting the root qdisc drops them too.
+func (rc *RouterController) applyLimits() error {
+	limits := rc.sortedLimits()
+
+	if err := firewall.EnsureChain(rc.cmd, "mangle", limitChain, "PREROUTING"); err != nil {
+		return err
+	}
+	if err := firewall.FlushChain(rc.cmd, "mangle", limitChain); err != nil {
+		return err
+	}
+
+	rc.cmd.Run("tc", "qdisc", "del", "dev", limitAPIface, "root")  //nolint:errcheck — may not exist
+	rc.cmd.Run("tc", "qdisc", "del", "dev", limitWANIface, "root") //nolint:errcheck — may not exist
+	if len(limits) == 0 {
+		rc.applyPriority(false)
+		return nil
+	}
+
+	if err := rc.cmd.Run("iptables", "-t", "mangle", "-A", limitChain, "-j", "CONNMARK", "--restore-mark"); err != nil {
+		return fmt.Errorf("restore-mark: %w", err)
+	}
+	for _, l := range limits {
+		mark := strconv.Itoa(l.ClassID)
+		if err := rc.cmd.Run("iptables", "-t", "mangle", "-A", limitChain,
+			"-m", "mac", "--mac-source", l.MAC, "-j", "MARK", "--set-mark", mark); err != nil {
+			return fmt.Errorf("mark %s: %w", l.MAC, err)
+		}
+		if err := rc.cmd.Run("iptables", "-t", "mangle", "-A", limitChain,
+			"-m", "mac", "--mac-source", l.MAC, "-j", "CONNMARK", "--save-mark"); err != nil {
+			return fmt.Errorf("save-mark %s: %w", l.MAC, err)
+		}
+	}
+
+	if err := rc.applyHTB(limitAPIface, limits, func(l DeviceLimit) float64 { return l.DownloadMbps }); err != nil {
+		return fmt.Errorf("download shaping: %w", err)
+	}
+	if err := rc.applyHTB(limitWANIface, limits, func(l DeviceLimit) float64 { return l.UploadMbps }); err != nil {
+		return fmt.Errorf("upload shaping: %w", err)
+	}
+	rc.applyPriority(true)
+
+	slog.Info("router: bandwidth limits applied", "devices", len(limits))
+	return nil
+}
+
+// applyHTB installs the root qdisc on iface plus one class and fw filter
+// per limit with a non-zero rate for this direction.
+func (rc *RouterController) applyHTB(iface string, limits []DeviceLimit, rate func(DeviceLimit) float64) error {
+	if err := rc.cmd.Run("tc", "qdisc", "add", "dev", iface, "root", "handle", "1:", "htb",
+		"default", strconv.FormatInt(limitDefaultClass, 16)); err != nil {
+		return fmt.Errorf("tc qdisc: %w", err)
+	}
+	// Unlimited catch-all class for everything unmarked.
+	rc.cmd.Run("tc", "class", "add", "dev", iface, "parent", "1:", //nolint:errcheck
+		"classid", fmt.Sprintf("1:%x", limitDefaultClass), "htb", "rate", "1000mbit")
+
+	for _, l := range limits {
+		mbps := rate(l)
+		if mbps <= 0 {
+			continue
+		}
+		if err := rc.cmd.Run("tc", "class", "add", "dev", iface, "parent", "1:",
+			"classid", l.classID(), "htb", "rate", fmt.Sprintf("%.2fmbit", mbps), "burst", "15k"); err != nil {
+			return fmt.Errorf("tc class %s: %w", l.MAC, err)
+		}
+		if err := rc.cmd.Run("tc", "filter", "add", "dev", iface, "parent", "1:", "protocol", "ip",
+			"handle", strconv.Itoa(l.ClassID), "fw", "flowid", l.classID()); err != nil {
+			return fmt.Errorf("tc filter %s: %w", l.MAC, err)
+		}
+	}
+	return nil
+}
+
+// shapedClasses returns the set of HTB class ids live on both interfaces,
+// read from `tc class show`. In dev mode tc is stubbed, so every configured
+// limit is reported as applied.
+func (rc *RouterController) shapedClasses() map[string]bool {
+	classes := map[string]bool{}
+	if rc.cfg.DevMode {
+		for _, l := range rc.sortedLimits() {
+			classes[l.classID()] = true
+		}
+		return classes
+	}
+	for _, iface := range []string{limitAPIface, limitWANIface} {
+		out, err := rc.cmd.Output("tc", "class", "show", "dev", iface)
+		if err != nil {
+			continue
+		}
+		for _, id := range parseTCClasses(out) {
+			classes[id] = true
+		}
+	}
+	return classes
+}
+
+// parseTCClasses extracts HTB class ids from `tc class show dev X`:
+//
+//	class htb 1:a root prio 0 rate 5Mbit ceil 5Mbit burst 15Kb cburst 1600b
+func parseTCClasses(out []byte) []string {
+	var ids []string
+	for _, line := range strings.Split(string(out), "\n") {
+		f := strings.Fields(line)
+		if len(f) >= 3 && f[0] == "class" && f[1] == "htb" {
+			ids = append(ids, f[2])
+		}
+	}
+	return ids
+}
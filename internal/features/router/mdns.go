@@ -0,0 +1,381 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/ipv4"
+)
+
+// mDNS / DNS-SD discovery. ARP only shows devices that talked recently;
+// most TVs, speakers and printers announce themselves on 224.0.0.251:5353
+// instead. The listener joins that group on the AP interface, asks for the
+// service types below every few minutes, and records what answers:
+//
+//	Living Room TV._googlecast._tcp.local.  → name "Living Room TV", type "tv"
+//
+// Scans merge the result into ConnectedDevice by IP.
+const (
+	mdnsPort          = 5353
+	mdnsQueryInterval = 5 * time.Minute
+	mdnsRetryInterval = time.Minute
+	// mdnsTTL forgets a device that stopped answering; a few query rounds.
+	mdnsTTL = 30 * time.Minute
+)
+
+var mdnsGroup = net.IPv4(224, 0, 0, 251)
+
+// Device types reported in ConnectedDevice.DeviceType.
+const (
+	deviceTypeTV        = "tv"
+	deviceTypeSpeaker   = "speaker"
+	deviceTypePrinter   = "printer"
+	deviceTypeSmartHome = "smart-home"
+)
+
+// mdnsServiceTypes maps the DNS-SD service types we ask for to the device
+// type they imply. A device advertising several keeps the first match in
+// this order.
+var mdnsServiceTypes = []struct {
+	service, deviceType string
+}{
+	{"_ipp._tcp", deviceTypePrinter},
+	{"_ipps._tcp", deviceTypePrinter},
+	{"_printer._tcp", deviceTypePrinter},
+	{"_pdl-datastream._tcp", deviceTypePrinter},
+	{"_googlecast._tcp", deviceTypeTV},
+	{"_airplay._tcp", deviceTypeTV},
+	{"_raop._tcp", deviceTypeSpeaker},
+	{"_spotify-connect._tcp", deviceTypeSpeaker},
+	{"_sonos._tcp", deviceTypeSpeaker},
+	{"_hap._tcp", deviceTypeSmartHome},
+}
+
+// serviceDeviceType returns the device type for a service, refined by the
+// TXT model ("md") where the service alone is ambiguous: a Nest speaker
+// and a Chromecast both advertise _googlecast.
+func serviceDeviceType(service, model string) string {
+	for _, s := range mdnsServiceTypes {
+		if s.service != service {
+			continue
+		}
+		if s.deviceType == deviceTypeTV && isSpeakerModel(model) {
+			return deviceTypeSpeaker
+		}
+		return s.deviceType
+	}
+	return ""
+}
+
+func isSpeakerModel(model string) bool {
+	m := strings.ToLower(model)
+	for _, k := range []string{"home", "nest mini", "nest audio", "speaker", "homepod"} {
+		if strings.Contains(m, k) {
+			return true
+		}
+	}
+	return false
+}
+
+// typeRank orders device types by how specific they are, so a TV that also
+// speaks _raop stays a TV.
+func typeRank(deviceType string) int {
+	for i, s := range mdnsServiceTypes {
+		if s.deviceType == deviceType {
+			return i
+		}
+	}
+	return len(mdnsServiceTypes)
+}
+
+type mdnsDevice struct {
+	Name       string
+	DeviceType string
+	Services   []string
+	seen       time.Time
+}
+
+// discovery holds what mDNS responders announced, keyed by IPv4 address.
+type discovery struct {
+	mu      sync.Mutex
+	devices map[string]*mdnsDevice
+	now     func() time.Time
+}
+
+func newDiscovery() *discovery {
+	return &discovery{devices: make(map[string]*mdnsDevice), now: time.Now}
+}
+
+// lookup returns what is known about ip. A nil discovery knows nothing.
+func (d *discovery) lookup(ip string) (mdnsDevice, bool) {
+	if d == nil {
+		return mdnsDevice{}, false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	dev, ok := d.devices[ip]
+	if !ok || d.now().Sub(dev.seen) > mdnsTTL {
+		return mdnsDevice{}, false
+	}
+	return *dev, true
+}
+
+// mdnsInstance is one service instance assembled from a response's records.
+type mdnsInstance struct {
+	service string // "_googlecast._tcp"
+	label   string // "Living Room TV"
+	host    string // SRV target
+	txt     map[string]string
+}
+
+// handle records the services announced in msg. Responders answer for
+// themselves, so an instance whose SRV host has no A record in the same
+// message is attributed to the sender.
+func (d *discovery) handle(msg *dns.Msg, from net.IP) {
+	if !msg.Response {
+		return
+	}
+	records := append(append([]dns.RR{}, msg.Answer...), msg.Extra...)
+
+	instances := make(map[string]*mdnsInstance)
+	instance := func(name string) *mdnsInstance {
+		key := strings.ToLower(name)
+		in, ok := instances[key]
+		if !ok {
+			label, service, ok := splitInstance(name)
+			if !ok {
+				return nil
+			}
+			in = &mdnsInstance{service: strings.ToLower(service), label: label, txt: map[string]string{}}
+			instances[key] = in
+		}
+		return in
+	}
+	hosts := make(map[string]net.IP)
+
+	for _, rr := range records {
+		switch r := rr.(type) {
+		case *dns.PTR:
+			instance(r.Ptr)
+		case *dns.SRV:
+			if in := instance(r.Hdr.Name); in != nil {
+				in.host = strings.ToLower(r.Target)
+			}
+		case *dns.TXT:
+			if in := instance(r.Hdr.Name); in != nil {
+				for _, kv := range r.Txt {
+					if k, v, ok := strings.Cut(kv, "="); ok {
+						in.txt[strings.ToLower(k)] = v
+					}
+				}
+			}
+		case *dns.A:
+			hosts[strings.ToLower(r.Hdr.Name)] = r.A.To4()
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := d.now()
+	for _, in := range instances {
+		ip := hosts[in.host]
+		if ip == nil {
+			ip = from.To4()
+		}
+		if ip == nil {
+			continue
+		}
+		dev, ok := d.devices[ip.String()]
+		if !ok {
+			dev = &mdnsDevice{}
+			d.devices[ip.String()] = dev
+		}
+		dev.seen = now
+		if !containsString(dev.Services, in.service) {
+			dev.Services = append(dev.Services, in.service)
+			sort.Strings(dev.Services)
+		}
+		if t := serviceDeviceType(in.service, in.txt["md"]); t != "" &&
+			(dev.DeviceType == "" || typeRank(t) < typeRank(dev.DeviceType)) {
+			dev.DeviceType = t
+		}
+		// Cast devices put the user-facing name in TXT fn; the instance
+		// label is a model-plus-UUID string.
+		switch {
+		case in.txt["fn"] != "":
+			dev.Name = in.txt["fn"]
+		case dev.Name == "":
+			dev.Name = in.label
+		}
+	}
+}
+
+// splitInstance splits "living\ room\ tv._googlecast._tcp.local." into
+// its unescaped label and service type.
+func splitInstance(name string) (label, service string, ok bool) {
+	labels := dns.SplitDomainName(name)
+	// label . _service . _proto . local
+	if len(labels) < 4 || labels[len(labels)-1] != "local" {
+		return "", "", false
+	}
+	n := len(labels)
+	service = labels[n-3] + "." + labels[n-2]
+	if !strings.HasPrefix(labels[n-3], "_") {
+		return "", "", false
+	}
+	return unescapeLabel(strings.Join(labels[:n-3], ".")), service, true
+}
+
+// unescapeLabel undoes miekg/dns presentation escaping ("\ " and "\DDD").
+func unescapeLabel(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 >= len(s) {
+			b = append(b, s[i])
+			continue
+		}
+		if i+3 < len(s) {
+			if n, err := strconv.Atoi(s[i+1 : i+4]); err == nil && n < 256 {
+				b = append(b, byte(n))
+				i += 3
+				continue
+			}
+		}
+		b = append(b, s[i+1])
+		i++
+	}
+	return string(b)
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// mdnsQuery asks for every service type we map to a device type.
+func mdnsQuery() ([]byte, error) {
+	m := new(dns.Msg)
+	m.Id = 0 // RFC 6762 §18.1
+	m.RecursionDesired = false
+	for _, s := range mdnsServiceTypes {
+		m.Question = append(m.Question, dns.Question{
+			Name: s.service + ".local.", Qtype: dns.TypePTR, Qclass: dns.ClassINET,
+		})
+	}
+	return m.Pack()
+}
+
+// listen joins the mDNS group on iface and records responses until ctx is
+// done. It returns nil on shutdown and an error if the socket fails.
+func (d *discovery) listen(ctx context.Context, iface string) error {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return fmt.Errorf("interface %s: %w", iface, err)
+	}
+	conn, err := net.ListenMulticastUDP("udp4", ifi, &net.UDPAddr{IP: mdnsGroup, Port: mdnsPort})
+	if err != nil {
+		return fmt.Errorf("join mdns group on %s: %w", iface, err)
+	}
+	// Queries must leave through the AP, not whatever owns the default
+	// multicast route.
+	if err := ipv4.NewPacketConn(conn).SetMulticastInterface(ifi); err != nil {
+		conn.Close()
+		return fmt.Errorf("mdns multicast interface %s: %w", iface, err)
+	}
+
+	defer conn.Close()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	go d.query(ctx, conn)
+
+	slog.Info("router: mdns discovery listening", "iface", iface)
+	buf := make([]byte, 9000)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("mdns read: %w", err)
+		}
+		msg := new(dns.Msg)
+		if err := msg.Unpack(buf[:n]); err != nil {
+			continue // not every 5353 packet is well-formed
+		}
+		d.handle(msg, from.IP)
+	}
+}
+
+func (d *discovery) query(ctx context.Context, conn *net.UDPConn) {
+	q, err := mdnsQuery()
+	if err != nil {
+		slog.Error("router: could not build mdns query", "err", err)
+		return
+	}
+	dst := &net.UDPAddr{IP: mdnsGroup, Port: mdnsPort}
+	ticker := time.NewTicker(mdnsQueryInterval)
+	defer ticker.Stop()
+	for {
+		if _, err := conn.WriteToUDP(q, dst); err != nil && ctx.Err() == nil {
+			slog.Debug("router: mdns query failed", "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// runDiscovery keeps the listener up on the AP interface until ctx is
+// done, retrying while the AP is not up yet. In dev mode a missing
+// interface just disables discovery.
+func (rc *RouterController) runDiscovery(ctx context.Context) {
+	for {
+		iface := rc.apInterface()
+		err := rc.discovery.listen(ctx, iface)
+		if ctx.Err() != nil {
+			return
+		}
+		if rc.cfg.DevMode {
+			slog.Info("router: mdns discovery disabled in dev mode", "reason", err)
+			return
+		}
+		slog.Warn("router: mdns discovery unavailable, retrying", "err", err, "delay", mdnsRetryInterval)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(mdnsRetryInterval):
+		}
+	}
+}
+
+// apInterface is the interface clients join, per wifi; wlan0 until it
+// reports one.
+func (rc *RouterController) apInterface() string {
+	if rc.wifiSvc != nil {
+		if st := rc.wifiSvc.Status(); st.APInterface != "" {
+			return st.APInterface
+		}
+	}
+	return "wlan0"
+}
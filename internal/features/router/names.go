@@ -0,0 +1,342 @@
+package router
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/httputil"
+	"github.com/strct-org/strct-agent/internal/statefile"
+)
+
+// Device naming. A device's display name comes from, in order:
+//
+//  1. a nickname the user set through the API (device-names.json)
+//  2. the friendly name it announces over mDNS ("Living Room TV")
+//  3. the hostname the device sent with its DHCP request (dnsmasq leases)
+//  4. a PTR record from the local resolver
+//  5. the vendor of its MAC prefix ("Apple", "Samsung", …)
+//
+// Nicknames win over everything else — a user who bothered to rename
+// "android-5f2c1a" to "Kid's tablet" expects to keep seeing that. An mDNS
+// name is one the owner set on the device itself, so it beats the DHCP
+// hostname, which for a Chromecast is "Chromecast-3f1c…".
+const (
+	defaultLeasesPath = "/var/lib/misc/dnsmasq.leases"
+	localResolver     = "127.0.0.1:53"
+
+	rdnsTTL         = 10 * time.Minute
+	rdnsNegativeTTL = 2 * time.Minute
+	rdnsTimeout     = 2 * time.Second
+	maxNicknameLen  = 64
+
+	unknownDeviceName = "Unknown Device"
+)
+
+// Name sources reported in ConnectedDevice.NameSource.
+const (
+	nameSourceNickname = "nickname"
+	nameSourceMDNS     = "mdns"
+	nameSourceDHCP     = "dhcp"
+	nameSourceDNS      = "dns"
+	nameSourceVendor   = "vendor"
+)
+
+//go:embed oui.tsv
+var ouiTable []byte
+
+var ouiVendors = parseOUITable(ouiTable)
+
+func parseOUITable(data []byte) map[string]string {
+	vendors := make(map[string]string)
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		line := sc.Text()
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if prefix, vendor, ok := strings.Cut(line, "\t"); ok {
+			vendors[strings.ToUpper(prefix)] = vendor
+		}
+	}
+	return vendors
+}
+
+// lookupVendor returns the vendor for mac's OUI prefix, or "".
+func lookupVendor(mac string) string {
+	hex := strings.ToUpper(strings.NewReplacer(":", "", "-", "").Replace(mac))
+	if len(hex) < 6 {
+		return ""
+	}
+	return ouiVendors[hex[:6]]
+}
+
+// parseLeases reads a dnsmasq leases file:
+//
+//	1718000000 aa:bb:cc:dd:ee:01 192.168.100.50 Pixel-7 01:aa:bb:cc:dd:ee:01
+//
+// and returns MAC → hostname. dnsmasq writes "*" when the client sent none.
+func parseLeases(data []byte) map[string]string {
+	names := make(map[string]string)
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		f := strings.Fields(sc.Text())
+		if len(f) < 4 || f[3] == "*" {
+			continue
+		}
+		names[strings.ToLower(f[1])] = f[3]
+	}
+	return names
+}
+
+// parseLeaseAddrs reads the same file for MAC → leased IP.
+func parseLeaseAddrs(data []byte) map[string]string {
+	addrs := make(map[string]string)
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		if f := strings.Fields(sc.Text()); len(f) >= 3 {
+			addrs[strings.ToLower(f[1])] = f[2]
+		}
+	}
+	return addrs
+}
+
+type rdnsEntry struct {
+	name    string
+	expires time.Time
+}
+
+// deviceNamer resolves display names for the scan loop. Everything is
+// cached: the leases file is re-read only when its mtime changes and PTR
+// lookups run in the background, so a scan never waits on DNS.
+type deviceNamer struct {
+	mu            sync.Mutex
+	leasesPath    string
+	leasesMod     time.Time
+	leases        map[string]string
+	leaseAddrs    map[string]string
+	nicknamesPath string
+	nicknames     map[string]string
+	rdns          map[string]rdnsEntry
+	inflight      map[string]bool
+	lookupAddr    func(ctx context.Context, addr string) ([]string, error)
+	now           func() time.Time
+	discovery     *discovery // nil: no mDNS names
+}
+
+func newDeviceNamer(dataDir string) *deviceNamer {
+	r := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, localResolver)
+		},
+	}
+	return &deviceNamer{
+		leasesPath:    defaultLeasesPath,
+		nicknamesPath: filepath.Join(dataDir, "device-names.json"),
+		nicknames:     make(map[string]string),
+		rdns:          make(map[string]rdnsEntry),
+		inflight:      make(map[string]bool),
+		lookupAddr:    r.LookupAddr,
+		now:           time.Now,
+	}
+}
+
+// name returns the best available name for a device and where it came
+// from. A device with no name at all gets its vendor, then "Unknown Device".
+func (n *deviceNamer) name(mac, ip string) (name, source string) {
+	mac = strings.ToLower(mac)
+	n.refreshLeases()
+
+	n.mu.Lock()
+	nick := n.nicknames[mac]
+	lease := n.leases[mac]
+	n.mu.Unlock()
+
+	mdns, _ := n.discovery.lookup(ip)
+
+	switch {
+	case nick != "":
+		return nick, nameSourceNickname
+	case mdns.Name != "":
+		return mdns.Name, nameSourceMDNS
+	case lease != "":
+		return lease, nameSourceDHCP
+	}
+	if ptr := n.reverse(ip); ptr != "" {
+		return ptr, nameSourceDNS
+	}
+	if vendor := lookupVendor(mac); vendor != "" {
+		return vendor, nameSourceVendor
+	}
+	return unknownDeviceName, ""
+}
+
+func (n *deviceNamer) refreshLeases() {
+	info, err := os.Stat(n.leasesPath)
+	if err != nil {
+		return // no dnsmasq (extender off, dev laptop) — nothing to read
+	}
+	n.mu.Lock()
+	fresh := info.ModTime().Equal(n.leasesMod)
+	n.mu.Unlock()
+	if fresh {
+		return
+	}
+
+	data, err := os.ReadFile(n.leasesPath)
+	if err != nil {
+		slog.Debug("router: could not read dnsmasq leases", "err", err)
+		return
+	}
+	leases, addrs := parseLeases(data), parseLeaseAddrs(data)
+
+	n.mu.Lock()
+	n.leases, n.leaseAddrs, n.leasesMod = leases, addrs, info.ModTime()
+	n.mu.Unlock()
+}
+
+// leaseIP returns the address dnsmasq leased to mac, "" if none.
+func (n *deviceNamer) leaseIP(mac string) string {
+	n.refreshLeases()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.leaseAddrs[strings.ToLower(mac)]
+}
+
+// reverse returns the cached PTR name for ip. On a miss or expiry it
+// starts a background lookup and returns what it has (possibly "").
+func (n *deviceNamer) reverse(ip string) string {
+	if ip == "" {
+		return ""
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	e, ok := n.rdns[ip]
+	if ok && n.now().Before(e.expires) {
+		return e.name
+	}
+	if !n.inflight[ip] {
+		n.inflight[ip] = true
+		go n.resolve(ip)
+	}
+	return e.name
+}
+
+func (n *deviceNamer) resolve(ip string) {
+	ctx, cancel := context.WithTimeout(context.Background(), rdnsTimeout)
+	defer cancel()
+
+	var name string
+	ttl := rdnsNegativeTTL
+	if names, err := n.lookupAddr(ctx, ip); err == nil && len(names) > 0 {
+		name = strings.TrimSuffix(names[0], ".")
+		// dnsmasq answers "host.lan" for its own leases — the domain is noise.
+		if host, _, ok := strings.Cut(name, "."); ok && host != "" {
+			name = host
+		}
+		ttl = rdnsTTL
+	}
+
+	n.mu.Lock()
+	n.rdns[ip] = rdnsEntry{name: name, expires: n.now().Add(ttl)}
+	delete(n.inflight, ip)
+	n.mu.Unlock()
+}
+
+// ─── Nicknames ───────────────────────────────────────────────────────────────
+
+// persistedNames is the on-disk shape of device-names.json.
+type persistedNames struct {
+	Names map[string]string `json:"names"` // lower-case MAC → nickname
+}
+
+func (n *deviceNamer) loadNicknames() error {
+	var pn persistedNames
+	if err := statefile.Load(n.nicknamesPath, namesSchema, &pn); err != nil {
+		if statefile.Fresh(err) {
+			return nil
+		}
+		return fmt.Errorf("load device names: %w", err)
+	}
+	n.mu.Lock()
+	for mac, name := range pn.Names {
+		n.nicknames[strings.ToLower(mac)] = name
+	}
+	n.mu.Unlock()
+	return nil
+}
+
+// setNickname sets (or with name == "" clears) a nickname and persists the
+// whole map.
+func (n *deviceNamer) setNickname(mac, name string) error {
+	n.mu.Lock()
+	if name == "" {
+		delete(n.nicknames, mac)
+	} else {
+		n.nicknames[mac] = name
+	}
+	snapshot := make(map[string]string, len(n.nicknames))
+	for k, v := range n.nicknames {
+		snapshot[k] = v
+	}
+	n.mu.Unlock()
+
+	if err := statefile.Save(n.nicknamesPath, namesSchema, persistedNames{Names: snapshot}); err != nil {
+		return fmt.Errorf("save device names: %w", err)
+	}
+	return nil
+}
+
+// handleSetDeviceName sets a user nickname for a device.
+// POST /api/router/devices/{mac}/name  body: {"name":"Kid's tablet"}
+// An empty name removes the nickname.
+func (rc *RouterController) handleSetDeviceName(w http.ResponseWriter, r *http.Request) {
+	mac := strings.ToLower(r.PathValue("mac"))
+	if !validMAC(mac) {
+		httputil.BadRequest(w, "invalid MAC address")
+		return
+	}
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httputil.BadRequest(w, "invalid JSON")
+		return
+	}
+	name := strings.TrimSpace(req.Name)
+	if len(name) > maxNicknameLen {
+		httputil.BadRequest(w, fmt.Sprintf("name must be at most %d characters", maxNicknameLen))
+		return
+	}
+
+	if err := rc.namer.setNickname(mac, name); err != nil {
+		slog.Error("router: could not persist device name", "mac", mac, "err", err)
+		httputil.InternalError(w, "could not save name")
+		return
+	}
+
+	// Reflect the change in the cached list without waiting for a scan.
+	rc.mu.Lock()
+	for i := range rc.devices {
+		if rc.devices[i].MAC == mac {
+			rc.devices[i].Name, rc.devices[i].NameSource = rc.namer.name(mac, rc.devices[i].IP)
+		}
+	}
+	rc.mu.Unlock()
+
+	httputil.OK(w, map[string]string{"mac": mac, "name": name})
+}
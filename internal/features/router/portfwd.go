@@ -0,0 +1,140 @@
+package router
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/strct-org/strct-agent/internal/errs"
+	"github.com/strct-org/strct-agent/internal/platform/firewall"
+)
+
+// portFwdChain holds every port-forwarding rule, in both the nat table
+// (DNAT, jumped from PREROUTING) and the filter table (ACCEPT, jumped from
+// FORWARD). Rebuilding the rules flushes only this chain, so the adblock
+// port-53 redirect and anything else living in PREROUTING survives.
+const portFwdChain = "STRCT_PORTFWD"
+
+// defaultSubnetBase is used to validate DeviceIP when the wifi feature
+// hasn't brought up an AP yet. Matches wifi's default RouterConfig.
+const defaultSubnetBase = "192.168.100"
+
+// applyPortForwarding rebuilds the STRCT_PORTFWD chains from state.
+//
+//	For each rule:
+//	  iptables -t nat -A STRCT_PORTFWD -p tcp --dport PORT -j DNAT --to-destination IP:PORT
+//	  iptables -t filter -A STRCT_PORTFWD -p tcp -d IP --dport PORT -j ACCEPT
+//	Once:
+//	  iptables -t nat -A POSTROUTING -j MASQUERADE   (only if missing)
+func (rc *RouterController) applyPortForwarding() error {
+	rc.mu.RLock()
+	rules := append([]PortRule(nil), rc.state.PortRules...)
+	rc.mu.RUnlock()
+
+	if err := firewall.EnsureChain(rc.cmd, "nat", portFwdChain, "PREROUTING"); err != nil {
+		return fmt.Errorf("nat chain: %w", err)
+	}
+	if err := firewall.EnsureChain(rc.cmd, "filter", portFwdChain, "FORWARD"); err != nil {
+		return fmt.Errorf("filter chain: %w", err)
+	}
+	firewall.FlushChain(rc.cmd, "nat", portFwdChain)    //nolint:errcheck
+	firewall.FlushChain(rc.cmd, "filter", portFwdChain) //nolint:errcheck
+
+	var errs []string
+	for _, rule := range rules {
+		dest := fmt.Sprintf("%s:%d", rule.DeviceIP, rule.Port)
+		portStr := strconv.Itoa(rule.Port)
+
+		for _, proto := range ruleProtocols(rule.Protocol) {
+			if err := rc.cmd.Run("iptables", "-t", "nat", "-A", portFwdChain,
+				"-p", proto, "--dport", portStr,
+				"-j", "DNAT", "--to-destination", dest); err != nil {
+				errs = append(errs, fmt.Sprintf("%s/%s: %v", rule.Name, proto, err))
+				continue
+			}
+			if err := rc.cmd.Run("iptables", "-t", "filter", "-A", portFwdChain,
+				"-p", proto, "-d", rule.DeviceIP, "--dport", portStr,
+				"-j", "ACCEPT"); err != nil {
+				errs = append(errs, fmt.Sprintf("%s/%s: %v", rule.Name, proto, err))
+			}
+		}
+	}
+
+	// MASQUERADE ensures reply packets route back correctly
+	firewall.EnsureRule(rc.cmd, "nat", "POSTROUTING", "-j", "MASQUERADE") //nolint:errcheck
+
+	// Enable IP forwarding (required for NAT)
+	rc.cmd.Run("sysctl", "-w", "net.ipv4.ip_forward=1") //nolint:errcheck
+
+	if len(errs) > 0 {
+		return fmt.Errorf("port rules: %s", strings.Join(errs, "; "))
+	}
+	slog.Info("router: port forwarding applied", "rules", len(rules))
+	return nil
+}
+
+// ruleProtocols expands a PortRule protocol into iptables -p values.
+func ruleProtocols(protocol string) []string {
+	if strings.EqualFold(protocol, "both") {
+		return []string{"tcp", "udp"}
+	}
+	return []string{strings.ToLower(protocol)}
+}
+
+// validatePortRules checks every rule against the AP subnet and assigns
+// IDs to new rules. Every problem is reported, as an *errs.Validation
+// with fields such as "port_rules[2].device_ip".
+//
+//   - port must be 1-65535
+//   - protocol must be TCP, UDP or BOTH
+//   - device_ip must be a host inside subnetBase.0/24 (not .0, .1 or .255)
+//   - no two rules may claim the same port/protocol pair
+func validatePortRules(rules []PortRule, subnetBase string) error {
+	_, subnet, err := net.ParseCIDR(subnetBase + ".0/24")
+	if err != nil {
+		return fmt.Errorf("invalid AP subnet %q", subnetBase)
+	}
+	gateway := subnetBase + ".1"
+
+	var v errs.Validation
+	seen := make(map[string]string) // "tcp/443" → rule name
+	for i := range rules {
+		rule := &rules[i]
+		field := fmt.Sprintf("port_rules[%d]", i)
+		portOK := rule.Port >= 1 && rule.Port <= 65535
+		if !portOK {
+			v.Addf(field+".port", errs.CodeOutOfRange, "port rule %q: port must be between 1 and 65535", rule.Name)
+		}
+		protoOK := true
+		switch strings.ToLower(rule.Protocol) {
+		case "tcp", "udp", "both":
+		default:
+			v.Addf(field+".protocol", errs.CodeInvalid, "port rule %q: protocol must be TCP, UDP or BOTH", rule.Name)
+			protoOK = false
+		}
+
+		ip := net.ParseIP(rule.DeviceIP).To4()
+		if ip == nil || !subnet.Contains(ip) || ip[3] == 0 || ip[3] == 255 || rule.DeviceIP == gateway {
+			v.Addf(field+".device_ip", errs.CodeInvalid, "port rule %q: device_ip must be a host in %s", rule.Name, subnet)
+		}
+
+		if portOK && protoOK {
+			for _, proto := range ruleProtocols(rule.Protocol) {
+				key := fmt.Sprintf("%s/%d", proto, rule.Port)
+				if other, dup := seen[key]; dup {
+					v.Addf(field+".port", errs.CodeDuplicate, "port rule %q: %s already forwarded by rule %q", rule.Name, key, other)
+					break
+				}
+				seen[key] = rule.Name
+			}
+		}
+
+		if rule.ID == "" {
+			rule.ID = uuid.NewString()
+		}
+	}
+	return v.Err()
+}
@@ -0,0 +1,272 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/httputil"
+)
+
+// Power state of tracked devices: whether a machine someone wakes over the
+// LAN is up. Nothing on the network says so outright, so it is put
+// together from
+//
+//   - a probe every powerProbeInterval: a TCP connect to the device's
+//     configured port (a refusal counts, the host answered), or a ping
+//     without one
+//   - whether the device is in the ARP table and holds a dnsmasq lease
+//   - when the scan last saw it
+//
+// A device whose last probe answered is awake. One that stops answering is
+// asleep once it has answered before, or once it has left the ARP table
+// for powerGoneAfter while keeping its lease. Anything else, such as a
+// device that has never answered a probe, is unknown.
+//
+// Tracked devices stay in GET /api/router/devices while they sleep, at
+// their last address, so the dashboard can offer to wake them.
+const (
+	powerProbeInterval = 30 * time.Second
+	powerProbeTimeout  = 2 * time.Second
+	powerFailsAsleep   = 3 // failed probes in a row
+	powerGoneAfter     = 2 * time.Minute
+)
+
+// Power states in ConnectedDevice.Power.
+const (
+	powerAwake   = "awake"
+	powerAsleep  = "asleep"
+	powerUnknown = "unknown"
+)
+
+// PowerTrack marks a device whose power state is followed.
+type PowerTrack struct {
+	MAC  string `json:"mac"`
+	Port int    `json:"port,omitempty"` // TCP port to probe; 0 pings
+}
+
+// powerObs is what the probes have found for one device.
+type powerObs struct {
+	probedAt   time.Time
+	answeredAt time.Time // zero: never answered
+	fails      int       // failed probes since the last answer
+}
+
+// inferPower combines a device's probes with its presence on the LAN.
+func inferPower(o powerObs, inARP, leased bool, lastSeen, now time.Time) string {
+	switch {
+	case o.probedAt.IsZero():
+		return powerUnknown
+	case o.fails == 0:
+		return powerAwake
+	case o.fails >= powerFailsAsleep && !o.answeredAt.IsZero():
+		return powerAsleep
+	case !inARP && leased && now.Sub(lastSeen) >= powerGoneAfter:
+		return powerAsleep
+	}
+	return powerUnknown
+}
+
+// probeHost reports whether ip answers on port, or to a ping when port is
+// 0. A refused connection is an answer: the host is up.
+func (rc *RouterController) probeHost(ip string, port int) bool {
+	if port == 0 {
+		return rc.cmd.Run("ping", "-c", "1", "-W", strconv.Itoa(int(powerProbeTimeout.Seconds())), ip) == nil
+	}
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(ip, strconv.Itoa(port)), powerProbeTimeout)
+	if err == nil {
+		conn.Close()
+		return true
+	}
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// probeTarget returns where to probe mac: its address in the device list,
+// else its lease, else where the scan last saw it; and its tracked port.
+func (rc *RouterController) probeTarget(mac string) (ip string, port int) {
+	rc.mu.RLock()
+	port = rc.tracked[mac].Port
+	for _, d := range rc.devices {
+		if d.MAC == mac {
+			ip = d.IP
+		}
+	}
+	rc.mu.RUnlock()
+	if ip == "" {
+		ip = rc.namer.leaseIP(mac)
+	}
+	if ip == "" {
+		_, ip = rc.history.lastSeen(mac)
+	}
+	return ip, port
+}
+
+// notePower records one probe of a tracked device.
+func (rc *RouterController) notePower(mac string, answered bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if _, tracked := rc.tracked[mac]; !tracked {
+		return
+	}
+	o := rc.power[mac]
+	now := rc.now()
+	o.probedAt = now
+	if answered {
+		o.answeredAt, o.fails = now, 0
+	} else {
+		o.fails++
+	}
+	rc.power[mac] = o
+}
+
+// powerStates infers the state of every tracked device.
+func (rc *RouterController) powerStates() map[string]string {
+	rc.mu.RLock()
+	obs := make(map[string]powerObs, len(rc.tracked))
+	for mac := range rc.tracked {
+		obs[mac] = rc.power[mac]
+	}
+	inARP := rc.inARP
+	rc.mu.RUnlock()
+
+	now := rc.now()
+	states := make(map[string]string, len(obs))
+	for mac, o := range obs {
+		lastSeen, _ := rc.history.lastSeen(mac)
+		states[mac] = inferPower(o, inARP[mac], rc.namer.leaseIP(mac) != "", lastSeen, now)
+	}
+	return states
+}
+
+// absentTracked lists the tracked devices the scan didn't find, at their
+// lease or last known address.
+func (rc *RouterController) absentTracked(present map[string]bool) []ConnectedDevice {
+	blocked := rc.blockReasons()
+	var out []ConnectedDevice
+	for _, t := range rc.sortedTracked() {
+		if present[t.MAC] {
+			continue
+		}
+		ip := rc.namer.leaseIP(t.MAC)
+		if ip == "" {
+			_, ip = rc.history.lastSeen(t.MAC)
+		}
+		if ip == "" {
+			continue // never seen: nothing to show
+		}
+		name, source := rc.namer.name(t.MAC, ip)
+		today := rc.traffic.today(t.MAC)
+		out = append(out, ConnectedDevice{
+			ID:             t.MAC,
+			IP:             ip,
+			MAC:            t.MAC,
+			Name:           name,
+			NameSource:     source,
+			Vendor:         lookupVendor(t.MAC),
+			PrivateAddress: isPrivateMAC(t.MAC),
+			Blocked:        blocked[t.MAC] != "",
+			BlockedReason:  blocked[t.MAC],
+			RxBytesToday:   today.RxBytes,
+			TxBytesToday:   today.TxBytes,
+		})
+	}
+	return out
+}
+
+// probeTracked probes every tracked device once and updates the cached
+// device list.
+func (rc *RouterController) probeTracked() {
+	defer usage.Time()()
+	for _, t := range rc.sortedTracked() {
+		ip, port := rc.probeTarget(t.MAC)
+		if ip == "" {
+			continue
+		}
+		rc.notePower(t.MAC, rc.probe(ip, port))
+	}
+	rc.refreshPower()
+}
+
+// refreshPower updates the cached device list's power states without
+// waiting for a scan.
+func (rc *RouterController) refreshPower() {
+	states := rc.powerStates()
+	rc.mu.Lock()
+	for i := range rc.devices {
+		rc.devices[i].Power = states[rc.devices[i].MAC]
+	}
+	rc.mu.Unlock()
+}
+
+// runPowerProbes probes tracked devices until ctx is done.
+func (rc *RouterController) runPowerProbes(ctx context.Context) {
+	t := time.NewTicker(powerProbeInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			rc.probeTracked()
+		}
+	}
+}
+
+func (rc *RouterController) sortedTracked() []PowerTrack {
+	rc.mu.RLock()
+	out := make([]PowerTrack, 0, len(rc.tracked))
+	for _, t := range rc.tracked {
+		out = append(out, t)
+	}
+	rc.mu.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].MAC < out[j].MAC })
+	return out
+}
+
+// handleSetPowerTracking starts or stops following a device's power state.
+// POST /api/router/devices/{mac}/power  body: {"track":true,"port":3389}
+func (rc *RouterController) handleSetPowerTracking(w http.ResponseWriter, r *http.Request) {
+	mac := strings.ToLower(r.PathValue("mac"))
+	if !validMAC(mac) {
+		httputil.BadRequest(w, "invalid MAC address")
+		return
+	}
+	var req struct {
+		Track bool `json:"track"`
+		Port  int  `json:"port"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httputil.BadRequest(w, "invalid JSON")
+		return
+	}
+	if req.Port < 0 || req.Port > 65535 {
+		httputil.BadRequest(w, "port must be 0 (ping) or 1-65535")
+		return
+	}
+
+	rc.mu.Lock()
+	if req.Track {
+		if rc.tracked[mac].Port != req.Port {
+			delete(rc.power, mac) // a new port starts over
+		}
+		rc.tracked[mac] = PowerTrack{MAC: mac, Port: req.Port}
+	} else {
+		delete(rc.tracked, mac)
+		delete(rc.power, mac)
+	}
+	rc.mu.Unlock()
+
+	if err := rc.saveState(); err != nil {
+		slog.Error("router: could not persist state", "err", err)
+	}
+	rc.refreshPower() // unknown until the next probe round
+	httputil.OK(w, map[string]any{"mac": mac, "track": req.Track, "port": req.Port})
+}
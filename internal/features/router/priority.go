@@ -0,0 +1,133 @@
+package router
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/strct-org/strct-agent/internal/httputil"
+	"github.com/strct-org/strct-agent/internal/throttle"
+)
+
+// Traffic priority on the AP interface.
+//
+// DNS replies, and small packets from the API port, leave wlan0 ahead of
+// bulk traffic. File downloads share the API port, so API replies are told
+// apart by size: full-size segments stay in the bulk band while JSON
+// replies and ACKs (under 512 bytes) jump the queue.
+//
+// With no bandwidth limits, wlan0 gets a plain prio qdisc and matching
+// packets go to band 1:1:
+//
+//	tc qdisc add dev wlan0 root handle 1: prio
+//	tc filter add dev wlan0 parent 1: protocol ip prio 1 u32 match ip sport 53 0xffff flowid 1:1
+//	tc filter add dev wlan0 parent 1: protocol ip prio 1 u32 match ip sport 8080 0xffff match u16 0x0000 0xfe00 at 2 flowid 1:1
+//
+// When limits are on, applyLimits owns the root as an HTB tree; priority
+// then adds an unshaped class 1:1 beside the per-device ones, so a capped
+// device's DNS replies never queue behind its capped download.
+const (
+	priorityIface = limitAPIface
+	priorityClass = "1:1"
+
+	// dnsPort is dnsmasq; blockerDNSPort is where an in-process blocker
+	// would answer before forwarding.
+	dnsPort        = 53
+	blockerDNSPort = 5354
+
+	// smallPacketMask matches IP total length < 512 in the u16 at offset 2.
+	smallPacketMask = "0xfe00"
+)
+
+// transferStatus is the narrow interface router needs from the transfer
+// governor — only its status, for /api/router/priority.
+type transferStatus interface {
+	Status() throttle.Status
+}
+
+// PriorityStatus reports whether the tc priority rules are live.
+type PriorityStatus struct {
+	Enabled bool   `json:"enabled"`        // TRAFFIC_PRIORITY is set
+	Active  bool   `json:"active"`         // rules installed on the last apply
+	Mode    string `json:"mode,omitempty"` // "prio" or "htb"
+	Ports   []int  `json:"ports,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+func (rc *RouterController) priorityPorts() []int {
+	ports := []int{dnsPort, blockerDNSPort}
+	if rc.cfg.APIPort > 0 {
+		ports = append(ports, rc.cfg.APIPort)
+	}
+	return ports
+}
+
+// applyPriority installs the priority rules on top of whatever root qdisc
+// applyLimits left on the AP interface. Failures are recorded and logged;
+// priority is best-effort and never fails an apply.
+func (rc *RouterController) applyPriority(limitsActive bool) {
+	if !rc.cfg.Priority {
+		return
+	}
+	st := PriorityStatus{Enabled: true, Ports: rc.priorityPorts(), Mode: "prio"}
+	if limitsActive {
+		st.Mode = "htb"
+	}
+
+	if err := rc.installPriority(limitsActive, st.Ports); err != nil {
+		slog.Warn("router: traffic priority not applied", "err", err)
+		st.Error = err.Error()
+	} else {
+		st.Active = true
+	}
+
+	rc.mu.Lock()
+	rc.priority = st
+	rc.mu.Unlock()
+}
+
+func (rc *RouterController) installPriority(limitsActive bool, ports []int) error {
+	if limitsActive {
+		if err := rc.cmd.Run("tc", "class", "add", "dev", priorityIface, "parent", "1:",
+			"classid", priorityClass, "htb", "rate", "1000mbit", "prio", "0"); err != nil {
+			return fmt.Errorf("tc class: %w", err)
+		}
+	} else {
+		if err := rc.cmd.Run("tc", "qdisc", "add", "dev", priorityIface, "root", "handle", "1:", "prio"); err != nil {
+			return fmt.Errorf("tc qdisc: %w", err)
+		}
+	}
+
+	for _, port := range ports {
+		args := []string{"filter", "add", "dev", priorityIface, "parent", "1:", "protocol", "ip",
+			"prio", "1", "u32", "match", "ip", "sport", strconv.Itoa(port), "0xffff"}
+		if port == rc.cfg.APIPort {
+			args = append(args, "match", "u16", "0x0000", smallPacketMask, "at", "2")
+		}
+		args = append(args, "flowid", priorityClass)
+		if err := rc.cmd.Run("tc", args...); err != nil {
+			return fmt.Errorf("tc filter port %d: %w", port, err)
+		}
+	}
+	return nil
+}
+
+// handleGetPriority reports the tc priority rules and the transfer cap.
+func (rc *RouterController) handleGetPriority(w http.ResponseWriter, r *http.Request) {
+	rc.mu.RLock()
+	st := rc.priority
+	rc.mu.RUnlock()
+	if !rc.cfg.Priority {
+		st = PriorityStatus{}
+	}
+
+	var transfers throttle.Status
+	if rc.transfers != nil {
+		transfers = rc.transfers.Status()
+	}
+	httputil.OK(w, map[string]any{
+		"qdisc":     st,
+		"transfers": transfers,
+	})
+}
@@ -0,0 +1,194 @@
+package router
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/metrics"
+	"github.com/strct-org/strct-agent/internal/platform/backend"
+)
+
+// defaultReportHeartbeat is how often an unchanged device list is re-sent
+// so the backend can tell "nothing changed" from "agent went away".
+const defaultReportHeartbeat = 10 * time.Minute
+
+// backendPoster is the narrow interface router needs from the shared
+// backend client.
+type backendPoster interface {
+	DevicePath(suffix string) string
+	Send(ctx context.Context, path string, v any) error
+	Post(ctx context.Context, path string, v any) error
+	PostLatest(ctx context.Context, path string, v any) error
+}
+
+var (
+	reportsSent = metrics.NewCounter("strct_router_device_reports_total",
+		"Connected-device reports by outcome.", "outcome", "sent")
+	reportsSuppressed = metrics.NewCounter("strct_router_device_reports_total",
+		"Connected-device reports by outcome.", "outcome", "suppressed")
+)
+
+// reportedDevice is the normalized form used for hashing and deltas. Only
+// fields listed here count as a change — anything volatile stays out.
+type reportedDevice struct {
+	MAC             string  `json:"mac"`
+	IP              string  `json:"ip"`
+	Name            string  `json:"name"`
+	Blocked         bool    `json:"blocked"`
+	Limited         bool    `json:"limited"`
+	LimitMbps       float64 `json:"limit_mbps"`
+	UploadLimitMbps float64 `json:"upload_limit_mbps"`
+}
+
+func normalizeDevices(devices []ConnectedDevice) []reportedDevice {
+	out := make([]reportedDevice, 0, len(devices))
+	for _, d := range devices {
+		out = append(out, reportedDevice{
+			MAC:             d.MAC,
+			IP:              d.IP,
+			Name:            d.Name,
+			Blocked:         d.Blocked,
+			Limited:         d.Limited,
+			LimitMbps:       d.LimitMbps,
+			UploadLimitMbps: d.UploadLimitMbps,
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].MAC < out[j].MAC })
+	return out
+}
+
+// hashDevices returns a stable hash of a normalized device list.
+func hashDevices(devices []reportedDevice) string {
+	b, _ := json.Marshal(devices) // plain struct slice, cannot fail
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// deviceDelta is the body of POST .../connected_devices/delta. BaseHash
+// lets the backend detect a missed delta and ask for a snapshot.
+type deviceDelta struct {
+	BaseHash string           `json:"base_hash"`
+	Hash     string           `json:"hash"`
+	Joined   []reportedDevice `json:"joined"`
+	Left     []string         `json:"left"` // MACs
+	Changed  []reportedDevice `json:"changed"`
+}
+
+func diffDevices(prev, cur []reportedDevice) deviceDelta {
+	before := make(map[string]reportedDevice, len(prev))
+	for _, d := range prev {
+		before[d.MAC] = d
+	}
+	d := deviceDelta{Joined: []reportedDevice{}, Left: []string{}, Changed: []reportedDevice{}}
+	for _, c := range cur {
+		old, ok := before[c.MAC]
+		switch {
+		case !ok:
+			d.Joined = append(d.Joined, c)
+		case old != c:
+			d.Changed = append(d.Changed, c)
+		}
+		delete(before, c.MAC)
+	}
+	for mac := range before {
+		d.Left = append(d.Left, mac)
+	}
+	sort.Strings(d.Left)
+	return d
+}
+
+// deviceReporter decides whether and how to report a device scan: nothing
+// when the list is unchanged and the heartbeat hasn't elapsed, a delta
+// when the backend supports it, a full snapshot otherwise.
+type deviceReporter struct {
+	mu               sync.Mutex
+	backend          backendPoster
+	heartbeat        time.Duration
+	now              func() time.Time
+	lastHash         string
+	lastSent         time.Time
+	last             []reportedDevice
+	deltaUnsupported bool
+}
+
+func newDeviceReporter(b backendPoster) *deviceReporter {
+	return &deviceReporter{backend: b, heartbeat: defaultReportHeartbeat, now: time.Now}
+}
+
+func (r *deviceReporter) report(ctx context.Context, devices []ConnectedDevice) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cur := normalizeDevices(devices)
+	hash := hashDevices(cur)
+	now := r.now()
+
+	changed := hash != r.lastHash
+	if !changed && now.Sub(r.lastSent) < r.heartbeat {
+		reportsSuppressed.Inc()
+		return
+	}
+
+	// First report, heartbeat, or an old backend: full snapshot.
+	if r.lastHash == "" || !changed || r.deltaUnsupported {
+		r.sendSnapshot(ctx, cur, hash, now)
+		return
+	}
+
+	delta := diffDevices(r.last, cur)
+	delta.BaseHash, delta.Hash = r.lastHash, hash
+	err := r.backend.Send(ctx, r.backend.DevicePath("connected_devices/delta"), delta)
+	switch {
+	case err == nil:
+		r.sent(cur, hash, now)
+	case backend.IsNotSupported(err):
+		slog.Info("router: backend has no delta endpoint, sending snapshots")
+		r.deltaUnsupported = true
+		r.sendSnapshot(ctx, cur, hash, now)
+	default:
+		// A delta can't be queued — it only makes sense against the base
+		// the backend has. Queue a snapshot instead.
+		r.sendSnapshot(ctx, cur, hash, now)
+	}
+}
+
+func (r *deviceReporter) sendSnapshot(ctx context.Context, cur []reportedDevice, hash string, now time.Time) {
+	err := r.backend.PostLatest(ctx, r.backend.DevicePath("connected_devices"), cur)
+	if err != nil && !errors.Is(err, backend.ErrQueued) {
+		slog.Warn("router: backend rejected devices report", "err", err)
+		return
+	}
+	if err != nil {
+		slog.Debug("router: devices report queued", "err", err)
+	}
+	// Queued counts as sent: the queue delivers the snapshot later, and
+	// re-sending the same list every scan would just replace it.
+	r.sent(cur, hash, now)
+}
+
+func (r *deviceReporter) sent(cur []reportedDevice, hash string, now time.Time) {
+	r.last, r.lastHash, r.lastSent = cur, hash, now
+	reportsSent.Inc()
+}
+
+// reportNewDevices posts first-seen events. They go through the offline
+// queue: unlike snapshots, a missed event is never re-sent by a later scan.
+func (r *deviceReporter) reportNewDevices(ctx context.Context, events []NewDeviceEvent) {
+	if len(events) == 0 {
+		return
+	}
+	err := r.backend.Post(ctx, r.backend.DevicePath("device_events"), map[string]any{
+		"type":    "new_device",
+		"devices": events,
+	})
+	if err != nil && !errors.Is(err, backend.ErrQueued) {
+		slog.Warn("router: backend rejected new-device event", "err", err)
+	}
+}
@@ -6,24 +6,38 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"io"
 	"log/slog"
 	"net/http"
 	"os"
 	"regexp"
+	"slices"
 	"strings"
 	"sync"
 	"text/template"
 	"time"
 
 	"github.com/strct-org/strct-agent/internal/config"
+	"github.com/strct-org/strct-agent/internal/errs"
+	"github.com/strct-org/strct-agent/internal/events"
+	"github.com/strct-org/strct-agent/internal/features/wifi"
+	"github.com/strct-org/strct-agent/internal/metrics"
 	"github.com/strct-org/strct-agent/internal/platform/executil"
+	"github.com/strct-org/strct-agent/internal/resources"
 )
 
 type Config struct {
 	DeviceID   string
 	BackendURL string
+	DataDir    string // router.json lives here
 	DevMode    bool
+	Priority   bool // install tc priority rules for DNS and API replies
+	APIPort    int
+}
+
+// wifiStatusReader is the narrow interface router needs from the wifi
+// package — only the active AP subnet, to validate port-forward targets.
+type wifiStatusReader interface {
+	Status() wifi.Status
 }
 
 type PortRule struct {
@@ -53,30 +67,65 @@ type RouterConfig struct {
 }
 
 type ConnectedDevice struct {
-	LimitMbps float64 `json:"limit_mbps"`
-	ID        string  `json:"id"`
-	IP        string  `json:"ip"`
-	MAC       string  `json:"mac"`
-	Name      string  `json:"name"`
-	Blocked   bool    `json:"blocked"`
-	Limited   bool    `json:"limited"`
+	LimitMbps       float64 `json:"limit_mbps"`        // download cap
+	UploadLimitMbps float64 `json:"upload_limit_mbps"` // upload cap
+	ID              string  `json:"id"`
+	IP              string  `json:"ip"`
+	MAC             string  `json:"mac"`
+	Name            string  `json:"name"`
+	NameSource      string  `json:"name_source,omitempty"` // nickname|mdns|dhcp|dns|vendor
+	DeviceType      string  `json:"device_type,omitempty"` // printer|tv|speaker|smart-home, from mDNS
+	Vendor          string  `json:"vendor,omitempty"`
+	PrivateAddress  bool    `json:"private_address"` // randomized (locally administered) MAC
+	Blocked         bool    `json:"blocked"`
+	BlockedReason   string  `json:"blocked_reason,omitempty"` // manual|schedule
+	Limited         bool    `json:"limited"`
+	RxBytesToday    uint64  `json:"rx_bytes_today"`  // downloaded since local midnight
+	TxBytesToday    uint64  `json:"tx_bytes_today"`  // uploaded since local midnight
+	Power           string  `json:"power,omitempty"` // awake|asleep|unknown; tracked devices only
 }
 
 type RouterController struct {
 	state RouterConfig
 	cfg   Config
 	// Slices & Mutexes (24 bytes)
-	devices []ConnectedDevice
-	mu      sync.RWMutex
-	cmd     executil.Runner
-	limitedMACs map[string]float64
+	devices     []ConnectedDevice
+	mu          sync.RWMutex
+	cmd         executil.Runner
+	limits      map[string]DeviceLimit // by lower-case MAC
 	blockedMACs map[string]bool
-	client      *http.Client
+	schedules   []Schedule
+	scheduled   map[string]bool // MACs whose schedule window is open now
+	now         func() time.Time
+	wifiSvc     wifiStatusReader
+	reporter    *deviceReporter // nil disables backend reporting
+	namer       *deviceNamer
+	history     *deviceHistory
+	traffic     *trafficMeter
+	priority    PriorityStatus
+	transfers   transferStatus // nil: no transfer governor
+	wakes       *wakeLimiter
+	sendWake    func(addr string, packet []byte) error
+	wakeSched   []WakeSchedule
+	wakeFired   map[string]string // schedule ID → local date it last fired
+	verifying   sync.WaitGroup    // wakes being verified
+	tracked     map[string]PowerTrack
+	power       map[string]powerObs
+	inARP       map[string]bool // MACs the last scan found
+	probe       func(ip string, port int) bool
+	discovery   *discovery
+	events      events.Publisher
 }
 
-const hostapdTemplate = `# Generated by strct-agent — do not edit manually
+// usage accounts router background work for /api/system/resources.
+var usage = resources.For("router")
+
+const hostapdTemplate = `
+# Generated by strct-agent — do not edit manually
 interface=wlan0
 driver=nl80211
+ctrl_interface=/var/run/hostapd
+ctrl_interface_group=0
 ssid={{.SSID}}
 {{- if eq .Frequency "5GHz"}}
 hw_mode=a
@@ -103,9 +152,10 @@ ignore_broadcast_ssid={{if .IsHidden}}1{{else}}0{{end}}
 max_num_sta={{.MaxClients}}
 `
 
-func New(cfg Config, cmd executil.Runner) *RouterController {
-	return &RouterController{
-		cfg: cfg,
+func New(cfg Config, cmd executil.Runner, wifiSvc wifiStatusReader) *RouterController {
+	rc := &RouterController{
+		cfg:     cfg,
+		wifiSvc: wifiSvc,
 		state: RouterConfig{
 			SSID:            "strct_wifi",
 			Password:        "change_me",
@@ -123,64 +173,137 @@ func New(cfg Config, cmd executil.Runner) *RouterController {
 		},
 		devices:     []ConnectedDevice{},
 		blockedMACs: make(map[string]bool),
-		limitedMACs: make(map[string]float64),
+		scheduled:   make(map[string]bool),
+		now:         time.Now,
+		limits:      make(map[string]DeviceLimit),
 		cmd:         cmd,
-		client: &http.Client{
-			Timeout: 10 * time.Second,
-			Transport: &http.Transport{
-				MaxIdleConnsPerHost: 2,
-				IdleConnTimeout:     90 * time.Second,
-			},
-		},
-	}
+		namer:       newDeviceNamer(cfg.DataDir),
+		history:     newDeviceHistory(cfg.DataDir),
+		traffic:     newTrafficMeter(cfg.DataDir),
+		wakes:       &wakeLimiter{now: time.Now},
+		sendWake:    broadcastUDP,
+		wakeFired:   make(map[string]string),
+		tracked:     make(map[string]PowerTrack),
+		power:       make(map[string]powerObs),
+		discovery:   newDiscovery(),
+		events:      events.Discard,
+	}
+	rc.namer.discovery = rc.discovery
+	rc.probe = rc.probeHost
+	return rc
 }
 
-func NewDefault(cfg Config) *RouterController {
-	return New(cfg, executil.Real{})
+func NewDefault(cfg Config, wifiSvc wifiStatusReader) *RouterController {
+	return New(cfg, executil.Real{}, wifiSvc)
 }
 
-func NewFromConfig(cfg *config.Config) *RouterController {
+// NewFromConfig is the agent's router. First-seen devices are published
+// to pub as events.DeviceJoined.
+func NewFromConfig(cfg *config.Config, wifiSvc wifiStatusReader, be backendPoster, transfers transferStatus, pub events.Publisher) *RouterController {
 	var cmd executil.Runner
 	if cfg.IsDev {
 		cmd = executil.NewDevRunner()
 	} else {
 		cmd = executil.Real{}
 	}
-	return New(Config{
+	rc := New(Config{
 		DeviceID:   cfg.DeviceID,
 		BackendURL: cfg.EffectiveBackendURL(),
+		DataDir:    cfg.DataDir,
 		DevMode:    cfg.IsDev,
-	}, cmd)
+		Priority:   cfg.TrafficPriority,
+		APIPort:    config.APIPort,
+	}, cmd, wifiSvc)
+	rc.reporter = newDeviceReporter(be)
+	rc.transfers = transfers
+	rc.events = pub
+	return rc
 }
 
 func (rc *RouterController) RegisterRoutes(mux *http.ServeMux) {
 	mux.HandleFunc("GET /api/router/config", rc.handleGetConfig)
 	mux.HandleFunc("POST /api/router/config", rc.handleSetConfig)
 	mux.HandleFunc("GET /api/router/devices", rc.handleGetDevices)
+	mux.HandleFunc("GET /api/router/devices/history", rc.handleDeviceHistory)
+	mux.HandleFunc("GET /api/router/devices/new", rc.handleNewDevices)
+	mux.HandleFunc("GET /api/router/devices/usage", rc.handleDeviceUsage)
+	mux.HandleFunc("POST /api/router/devices/{mac}/name", rc.handleSetDeviceName)
+	mux.HandleFunc("POST /api/router/devices/{mac}/power", rc.handleSetPowerTracking)
 	mux.HandleFunc("POST /api/router/block", rc.handleBlockDevice)
-	mux.HandleFunc("POST /api/router/limit", rc.handleLimitDevice)
+	mux.HandleFunc("POST /api/router/wake", rc.handleWake)
+	mux.HandleFunc("GET /api/router/wake-events", rc.handleWakeEvents)
+	mux.HandleFunc("GET /api/router/wake-schedules", rc.handleGetWakeSchedules)
+	mux.HandleFunc("POST /api/router/wake-schedules", rc.handleSetWakeSchedule)
+	mux.HandleFunc("DELETE /api/router/wake-schedules", rc.handleRemoveWakeSchedule)
+	mux.HandleFunc("GET /api/router/schedules", rc.handleGetSchedules)
+	mux.HandleFunc("POST /api/router/schedule", rc.handleSetSchedule)
+	mux.HandleFunc("DELETE /api/router/schedule", rc.handleRemoveSchedule)
+	mux.HandleFunc("POST /api/router/limit", rc.handleSetLimit)
+	mux.HandleFunc("DELETE /api/router/limit", rc.handleRemoveLimit)
+	mux.HandleFunc("GET /api/router/priority", rc.handleGetPriority)
 }
 
+func (rc *RouterController) Name() string { return "router" }
+
+// DependsOn is wifi: the router's rules go on the AP interface.
+func (rc *RouterController) DependsOn() []string { return []string{"wifi"} }
+
 func (rc *RouterController) Start(ctx context.Context) error {
 	slog.Info("router: starting")
 
+	// Restore port rules before the first apply so forwards come back
+	// after a reboot without the dashboard having to re-send them.
+	if err := rc.loadState(); err != nil {
+		slog.Warn("router: could not restore state, starting empty", "err", err)
+	}
+	if err := rc.namer.loadNicknames(); err != nil {
+		slog.Warn("router: could not restore device names", "err", err)
+	}
+	if err := rc.history.load(); err != nil {
+		slog.Warn("router: could not restore device history", "err", err)
+	}
+	// Loaded before applyAll: its firewall rebuild first reads whatever the
+	// kernel counted while the agent was down.
+	if err := rc.traffic.load(); err != nil {
+		slog.Warn("router: could not restore traffic counters", "err", err)
+	}
+
+	// Windows already open go in with applyAll's block rebuild.
+	active := rc.scheduledBlocks(rc.now())
+	rc.mu.Lock()
+	rc.scheduled = active
+	rc.mu.Unlock()
+
 	if err := rc.applyAll(); err != nil {
 		slog.Warn("router: initial apply had errors", "err", err)
 	}
 
-	go func() {
+	usage.Go(func() {
 		ticker := time.NewTicker(10 * time.Second)
 		defer ticker.Stop()
+		acctTicker := time.NewTicker(acctSampleInterval)
+		defer acctTicker.Stop()
+		scheduleTicker := time.NewTicker(scheduleInterval)
+		defer scheduleTicker.Stop()
 		for {
 			select {
 			case <-ctx.Done():
+				rc.sampleTraffic()
 				slog.Info("router: stopped")
 				return
 			case <-ticker.C:
 				rc.scanDevices()
+			case <-acctTicker.C:
+				rc.sampleTraffic()
+			case <-scheduleTicker.C:
+				now := rc.now()
+				rc.enforceSchedules(now)
+				rc.runWakeSchedules(now)
 			}
 		}
-	}()
+	})
+	usage.Go(func() { rc.runDiscovery(ctx) })
+	usage.Go(func() { rc.runPowerProbes(ctx) })
 
 	return nil
 }
@@ -201,10 +324,12 @@ func (rc *RouterController) handleSetConfig(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	// Basic validation
-	if newConfig.SSID == "" || len(newConfig.Password) < 8 {
-		http.Error(w, "ssid required and password must be >= 8 chars", http.StatusBadRequest)
-		return
+	var v errs.Validation
+	if newConfig.SSID == "" {
+		v.Add("ssid", errs.CodeRequired, "ssid is required")
+	}
+	if len(newConfig.Password) < 8 {
+		v.Add("password", errs.CodeTooShort, "password must be >= 8 characters")
 	}
 	if newConfig.Channel == 0 {
 		newConfig.Channel = 36
@@ -212,11 +337,23 @@ func (rc *RouterController) handleSetConfig(w http.ResponseWriter, r *http.Reque
 	if newConfig.MaxClients == 0 {
 		newConfig.MaxClients = 20
 	}
+	if newConfig.PortRules == nil {
+		newConfig.PortRules = []PortRule{}
+	}
+	v.Merge("port_rules", validatePortRules(newConfig.PortRules, rc.subnetBase()))
+	if err := v.Err(); err != nil {
+		errs.HTTPResponse(w, err)
+		return
+	}
 
 	rc.mu.Lock()
 	rc.state = newConfig
 	rc.mu.Unlock()
 
+	if err := rc.saveState(); err != nil {
+		slog.Error("router: could not persist state", "err", err)
+	}
+
 	// Apply asynchronously — don't block the HTTP response
 	go func() {
 		if err := rc.applyAll(); err != nil {
@@ -237,95 +374,18 @@ func (rc *RouterController) handleGetDevices(w http.ResponseWriter, r *http.Requ
 	json.NewEncoder(w).Encode(devices)
 }
 
-// handleBlockDevice toggles iptables DROP rules for a specific MAC.
-// POST body: {"mac":"XX:XX:XX:XX:XX:XX","block":true}
-// Runs iptables OUTSIDE the mutex — holding a write lock during exec is
-// the bug identified in audit issue #3.
-func (rc *RouterController) handleBlockDevice(w http.ResponseWriter, r *http.Request) {
-	var req struct {
-		MAC   string `json:"mac"`
-		Block bool   `json:"block"`
-	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "invalid JSON", http.StatusBadRequest)
-		return
-	}
-
-	// Validate MAC format before passing to iptables
-	if !validMAC(req.MAC) {
-		http.Error(w, "invalid MAC address", http.StatusBadRequest)
-		return
-	}
-
-	// Update state first (fast, under lock)
-	rc.mu.Lock()
-	if req.Block {
-		rc.blockedMACs[req.MAC] = true
-	} else {
-		delete(rc.blockedMACs, req.MAC)
-	}
-	rc.mu.Unlock()
-
-	// Run iptables OUTSIDE the lock — these can take hundreds of milliseconds
-	// and would deadlock readers if held under mu.
-	var err error
-	if req.Block {
-		err = rc.blockMAC(req.MAC)
-	} else {
-		err = rc.unblockMAC(req.MAC)
-	}
-	if err != nil {
-		slog.Error("router: iptables block failed", "mac", req.MAC, "err", err)
-		http.Error(w, "iptables error", http.StatusInternalServerError)
-		return
-	}
-
-	go rc.scanDevices()
-	w.WriteHeader(http.StatusOK)
-}
-
-// handleLimitDevice sets or removes a tc htb bandwidth limit for a device IP.
-// POST body: {"mac":"XX:XX:XX:XX:XX:XX","ip":"192.168.1.x","limit_mbps":5}
-// limit_mbps=0 removes the limit.
-func (rc *RouterController) handleLimitDevice(w http.ResponseWriter, r *http.Request) {
-	var req struct {
-		MAC       string  `json:"mac"`
-		IP        string  `json:"ip"`
-		LimitMbps float64 `json:"limit_mbps"`
-	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "invalid JSON", http.StatusBadRequest)
-		return
-	}
-	if !validMAC(req.MAC) || req.IP == "" {
-		http.Error(w, "invalid MAC or IP", http.StatusBadRequest)
-		return
-	}
-
-	rc.mu.Lock()
-	if req.LimitMbps > 0 {
-		rc.limitedMACs[req.MAC] = req.LimitMbps
-	} else {
-		delete(rc.limitedMACs, req.MAC)
-	}
-	rc.mu.Unlock()
-
-	// tc commands run outside lock
-	var err error
-	if req.LimitMbps > 0 {
-		err = rc.setTCLimit(req.IP, req.LimitMbps)
-	} else {
-		err = rc.removeTCLimit(req.IP)
-	}
-	if err != nil {
-		slog.Warn("router: tc limit failed", "ip", req.IP, "err", err)
-		// Non-fatal — respond OK, tc may not be available on all kernels
-	}
-
-	w.WriteHeader(http.StatusOK)
+// RegisterMetrics exports how many devices the last scan found on the
+// network.
+func (rc *RouterController) RegisterMetrics(g metrics.Gauges) {
+	g.GaugeFunc("strct_wifi_clients", "Devices on the AP's network at the last scan.", func() float64 {
+		rc.mu.RLock()
+		defer rc.mu.RUnlock()
+		return float64(len(rc.inARP))
+	})
 }
 
 func (rc *RouterController) applyAll() error {
+	defer usage.Time()()
 	var errs []string
 
 	if err := rc.applyHostapd(); err != nil {
@@ -340,6 +400,9 @@ func (rc *RouterController) applyAll() error {
 	if err := rc.applyPortForwarding(); err != nil {
 		errs = append(errs, fmt.Sprintf("ports: %v", err))
 	}
+	if err := rc.applyLimits(); err != nil {
+		errs = append(errs, fmt.Sprintf("limits: %v", err))
+	}
 	if err := rc.applyTxPower(); err != nil {
 		errs = append(errs, fmt.Sprintf("txpower: %v", err))
 	}
@@ -442,6 +505,9 @@ func (rc *RouterController) applyFirewall() error {
 	cfg := rc.state
 	rc.mu.RUnlock()
 
+	// The flush below zeroes the accounting counters; bank them first.
+	rc.sampleTraffic()
+
 	// Flush existing rules to start clean
 	rc.cmd.Run("iptables", "-F")
 	rc.cmd.Run("iptables", "-X")
@@ -466,14 +532,14 @@ func (rc *RouterController) applyFirewall() error {
 		rc.cmd.Run("iptables", "-A", "INPUT", "-p", "icmp", "--icmp-type", "echo-request", "-j", "DROP")
 	}
 
-	// Re-apply per-device MAC blocks (they were flushed above)
-	rc.mu.RLock()
-	for mac := range rc.blockedMACs {
-		rc.mu.RUnlock()
-		rc.blockMAC(mac) //nolint:errcheck
-		rc.mu.RLock()
+	// Re-apply per-device accounting and MAC blocks (-F/-X above removed
+	// their chains). Blocks go second so their jump sits above accounting.
+	if err := rc.applyAccounting(); err != nil {
+		slog.Warn("router: could not restore traffic accounting", "err", err)
+	}
+	if err := rc.applyBlocks(); err != nil {
+		slog.Warn("router: could not restore MAC blocks", "err", err)
 	}
-	rc.mu.RUnlock()
 
 	if cfg.IPv6Firewall {
 		rc.cmd.Run("ip6tables", "-P", "INPUT", "DROP")
@@ -489,49 +555,6 @@ func (rc *RouterController) applyFirewall() error {
 	return nil
 }
 
-// applyPortForwarding rebuilds NAT PREROUTING rules for all port rules.
-//
-//	For each rule:
-//	  iptables -t nat -A PREROUTING -p tcp --dport PORT -j DNAT --to-destination IP:PORT
-//	  iptables -A FORWARD -p tcp -d IP --dport PORT -j ACCEPT
-//	  iptables -t nat -A POSTROUTING -j MASQUERADE
-func (rc *RouterController) applyPortForwarding() error {
-	rc.mu.RLock()
-	rules := rc.state.PortRules
-	rc.mu.RUnlock()
-
-	// Flush existing port forwarding rules
-	rc.cmd.Run("iptables", "-t", "nat", "-F", "PREROUTING")
-	rc.cmd.Run("iptables", "-F", "FORWARD")
-
-	for _, rule := range rules {
-		dest := fmt.Sprintf("%s:%d", rule.DeviceIP, rule.Port)
-		portStr := fmt.Sprintf("%d", rule.Port)
-		protos := []string{strings.ToLower(rule.Protocol)}
-		if strings.ToLower(rule.Protocol) == "both" {
-			protos = []string{"tcp", "udp"}
-		}
-
-		for _, proto := range protos {
-			rc.cmd.Run("iptables", "-t", "nat", "-A", "PREROUTING",
-				"-p", proto, "--dport", portStr,
-				"-j", "DNAT", "--to-destination", dest)
-			rc.cmd.Run("iptables", "-A", "FORWARD",
-				"-p", proto, "-d", rule.DeviceIP, "--dport", portStr,
-				"-j", "ACCEPT")
-		}
-	}
-
-	// MASQUERADE ensures reply packets route back correctly
-	rc.cmd.Run("iptables", "-t", "nat", "-A", "POSTROUTING", "-j", "MASQUERADE")
-
-	// Enable IP forwarding (required for NAT)
-	os.WriteFile("/proc/sys/net/ipv4/ip_forward", []byte("1"), 0644) //nolint:errcheck
-
-	slog.Info("router: port forwarding applied", "rules", len(rules))
-	return nil
-}
-
 // applyTxPower sets the WiFi transmit power.
 //
 //	iwconfig wlan0 txpower 30   (Signal Boost: 30 dBm)
@@ -548,82 +571,6 @@ func (rc *RouterController) applyTxPower() error {
 	return nil
 }
 
-// ─── Per-device iptables helpers (run OUTSIDE any mutex) ─────────────────────
-
-// blockMAC adds INPUT and FORWARD DROP rules for a MAC address.
-//
-//	iptables -A INPUT   -m mac --mac-source MAC -j DROP
-//	iptables -A FORWARD -m mac --mac-source MAC -j DROP
-func (rc *RouterController) blockMAC(mac string) error {
-	if err := rc.cmd.Run("iptables", "-A", "INPUT", "-m", "mac", "--mac-source", mac, "-j", "DROP"); err != nil {
-		return fmt.Errorf("block INPUT: %w", err)
-	}
-	if err := rc.cmd.Run("iptables", "-A", "FORWARD", "-m", "mac", "--mac-source", mac, "-j", "DROP"); err != nil {
-		return fmt.Errorf("block FORWARD: %w", err)
-	}
-	slog.Info("router: device blocked", "mac", mac)
-	return nil
-}
-
-// unblockMAC deletes the DROP rules for a MAC address.
-//
-//	iptables -D INPUT   -m mac --mac-source MAC -j DROP
-//	iptables -D FORWARD -m mac --mac-source MAC -j DROP
-func (rc *RouterController) unblockMAC(mac string) error {
-	rc.cmd.Run("iptables", "-D", "INPUT", "-m", "mac", "--mac-source", mac, "-j", "DROP")   //nolint:errcheck
-	rc.cmd.Run("iptables", "-D", "FORWARD", "-m", "mac", "--mac-source", mac, "-j", "DROP") //nolint:errcheck
-	slog.Info("router: device unblocked", "mac", mac)
-	return nil
-}
-
-// setTCLimit applies a bandwidth rate limit to a device IP using Linux tc (traffic control).
-//
-//	tc qdisc add dev wlan0 root handle 1: htb default 999
-//	tc class add dev wlan0 parent 1: classid 1:1 htb rate RATE burst 15k
-//	tc filter add dev wlan0 parent 1:0 protocol ip u32 match ip dst IP/32 flowid 1:1
-//
-// Note: this is a simplified single-class HTB. In production you'd want a
-// class per device so limits don't interfere with each other.
-func (rc *RouterController) setTCLimit(ip string, mbps float64) error {
-	rate := fmt.Sprintf("%.2fmbit", mbps)
-
-	// Set up root qdisc if not already present
-	rc.cmd.Run("tc", "qdisc", "del", "dev", "wlan0", "root") //nolint:errcheck — may not exist
-	if err := rc.cmd.Run("tc", "qdisc", "add", "dev", "wlan0", "root", "handle", "1:", "htb", "default", "999"); err != nil {
-		return fmt.Errorf("tc qdisc: %w", err)
-	}
-
-	// Root class (unlimited — parent for all limited classes)
-	rc.cmd.Run("tc", "class", "add", "dev", "wlan0", "parent", "1:", "classid", "1:999", "htb", "rate", "1000mbit") //nolint:errcheck
-
-	// Per-device limited class
-	if err := rc.cmd.Run("tc", "class", "add", "dev", "wlan0", "parent", "1:", "classid", "1:1", "htb", "rate", rate, "burst", "15k"); err != nil {
-		return fmt.Errorf("tc class: %w", err)
-	}
-
-	// Filter: match traffic destined for this IP → limited class
-	if err := rc.cmd.Run("tc", "filter", "add", "dev", "wlan0",
-		"parent", "1:0", "protocol", "ip",
-		"u32", "match", "ip", "dst", ip+"/32",
-		"flowid", "1:1"); err != nil {
-		return fmt.Errorf("tc filter: %w", err)
-	}
-
-	slog.Info("router: bandwidth limit set", "ip", ip, "rate", rate)
-	return nil
-}
-
-// removeTCLimit removes all tc rules from the wlan0 interface.
-func (rc *RouterController) removeTCLimit(ip string) error {
-	// Simplified: remove entire qdisc. In production you'd delete only
-	// the specific class and filter for this IP.
-	if err := rc.cmd.Run("tc", "qdisc", "del", "dev", "wlan0", "root"); err != nil {
-		return fmt.Errorf("tc del: %w", err)
-	}
-	slog.Info("router: bandwidth limit removed", "ip", ip)
-	return nil
-}
-
 // ─── Device scanning ──────────────────────────────────────────────────────────
 
 // scanDevices reads connected devices using both `arp -a` (layer 2 neighbors)
@@ -631,6 +578,7 @@ func (rc *RouterController) removeTCLimit(ip string) error {
 //
 //	arp -a output: ? (192.168.1.15) at a1:b2:c3:d4:e5:f6 [ether] on wlan0
 func (rc *RouterController) scanDevices() {
+	defer usage.Time()()
 	out, err := rc.cmd.CombinedOutput("arp", "-a")
 	if err != nil {
 		slog.Error("router: arp scan failed", "err", err)
@@ -641,10 +589,15 @@ func (rc *RouterController) scanDevices() {
 	scanner := bufio.NewScanner(bytes.NewReader(out))
 	var detected []ConnectedDevice
 
-	rc.mu.RLock()
-	blocked := rc.blockedMACs
-	limited := rc.limitedMACs
-	rc.mu.RUnlock()
+	blocked := rc.blockReasons()
+
+	// Limited reflects what tc actually has installed, not just what was
+	// requested — a kernel without sch_htb leaves the config unapplied.
+	shaped := rc.shapedClasses()
+	limits := make(map[string]DeviceLimit)
+	for _, l := range rc.sortedLimits() {
+		limits[l.MAC] = l
+	}
 
 	for scanner.Scan() {
 		m := re.FindStringSubmatch(scanner.Text())
@@ -653,51 +606,76 @@ func (rc *RouterController) scanDevices() {
 		}
 		ip, mac := m[1], m[2]
 
-		limitMbps := limited[mac]
+		limit, hasLimit := limits[mac]
+		name, source := rc.namer.name(mac, ip)
+		announced, _ := rc.discovery.lookup(ip)
 		detected = append(detected, ConnectedDevice{
-			ID:        mac,
-			IP:        ip,
-			MAC:       mac,
-			Name:      "Unknown Device", // hostname lookup via reverse DNS if needed
-			Blocked:   blocked[mac],
-			Limited:   limitMbps > 0,
-			LimitMbps: limitMbps,
+			ID:              mac,
+			IP:              ip,
+			MAC:             mac,
+			Name:            name,
+			NameSource:      source,
+			DeviceType:      announced.DeviceType,
+			Vendor:          lookupVendor(mac),
+			PrivateAddress:  isPrivateMAC(mac),
+			Blocked:         blocked[mac] != "",
+			BlockedReason:   blocked[mac],
+			Limited:         hasLimit && shaped[limit.classID()],
+			LimitMbps:       limit.DownloadMbps,
+			UploadLimitMbps: limit.UploadMbps,
 		})
 	}
 
-	rc.mu.Lock()
-	rc.devices = detected
-	rc.mu.Unlock()
+	rc.installAcctRules(detected)
+	for i := range detected {
+		today := rc.traffic.today(detected[i].MAC)
+		detected[i].RxBytesToday, detected[i].TxBytesToday = today.RxBytes, today.TxBytes
+	}
 
-	go rc.reportDevicesToBackend(detected)
-}
+	// Tracked devices that are asleep stay listed, at their last address.
+	inARP := make(map[string]bool, len(detected))
+	for _, d := range detected {
+		inARP[d.MAC] = true
+	}
+	listed := slices.Concat(detected, rc.absentTracked(inARP))
 
-func (rc *RouterController) reportDevicesToBackend(devices []ConnectedDevice) {
-	url := fmt.Sprintf("%s/api/v1/device/agent/%s/connected_devices",
-		rc.cfg.BackendURL, rc.cfg.DeviceID)
+	rc.mu.Lock()
+	rc.devices = listed
+	rc.inARP = inARP
+	rc.mu.Unlock()
+	rc.refreshPower()
 
-	payload, err := json.Marshal(devices)
-	if err != nil {
-		return
+	fresh := rc.history.observe(detected)
+	for _, e := range fresh {
+		slog.Info("router: new device joined", "mac", e.MAC, "ip", e.IP, "name", e.Name, "private", e.PrivateAddress)
+		rc.events.Publish(events.DeviceJoined, e)
 	}
 
-	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(payload))
-	if err != nil {
-		return
-	}
-	req.Header.Set("Content-Type", "application/json")
+	go rc.reportDevicesToBackend(detected, fresh)
+}
 
-	resp, err := rc.client.Do(req)
-	if err != nil {
-		slog.Error("router: backend report failed", "err", err)
+// reportDevicesToBackend hands the scan to the reporter, which only talks
+// to the backend when the list changed or the heartbeat is due. First-seen
+// devices go out as events so the app can push-notify.
+func (rc *RouterController) reportDevicesToBackend(devices []ConnectedDevice, fresh []NewDeviceEvent) {
+	if rc.reporter == nil {
 		return
 	}
-	defer resp.Body.Close()
-	io.Copy(io.Discard, resp.Body) //nolint:errcheck
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	rc.reporter.report(ctx, devices)
+	rc.reporter.reportNewDevices(ctx, fresh)
+}
 
-	if resp.StatusCode >= 400 {
-		slog.Warn("router: backend rejected devices report", "status", resp.StatusCode)
+// subnetBase returns the active AP subnet from the wifi feature, falling
+// back to the default when no AP is up yet.
+func (rc *RouterController) subnetBase() string {
+	if rc.wifiSvc != nil {
+		if st := rc.wifiSvc.Status(); st.Active && st.SubnetBase != "" {
+			return st.SubnetBase
+		}
 	}
+	return defaultSubnetBase
 }
 
 var macRegexp = regexp.MustCompile(`^([0-9A-Fa-f]{2}:){5}[0-9A-Fa-f]{2}$`)
@@ -0,0 +1,1596 @@
+package router
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/strct-org/strct-agent/internal/errs"
+	"github.com/strct-org/strct-agent/internal/events"
+	"github.com/strct-org/strct-agent/internal/features/wifi"
+	"github.com/strct-org/strct-agent/internal/platform/backend"
+	"github.com/strct-org/strct-agent/internal/platform/executil"
+	"github.com/strct-org/strct-agent/internal/throttle"
+)
+
+type wifiStub struct{ status wifi.Status }
+
+func (w wifiStub) Status() wifi.Status { return w.status }
+
+func newTestRouter(t *testing.T, m *executil.Mock) *RouterController {
+	t.Helper()
+	rc := New(Config{DataDir: t.TempDir(), DevMode: true}, m,
+		wifiStub{wifi.Status{Active: true, SubnetBase: "192.168.100"}})
+	t.Cleanup(rc.verifying.Wait) // wake checks write to DataDir
+	return rc
+}
+
+// iptablesCalls returns every iptables invocation the mock saw, in order.
+func iptablesCalls(m *executil.Mock) []string {
+	var out []string
+	for _, c := range m.Calls {
+		if c.Name == "iptables" {
+			out = append(out, c.String())
+		}
+	}
+	return out
+}
+
+var errMissing = errors.New("exit status 1")
+
+func TestApplyPortForwarding_OwnsChain(t *testing.T) {
+	m := &executil.Mock{}
+	// Fresh box: chains and jumps don't exist yet.
+	m.Expect("iptables -t nat -n -L STRCT_PORTFWD", executil.MockResult{Err: errMissing})
+	m.Expect("iptables -t nat -C PREROUTING -j STRCT_PORTFWD", executil.MockResult{Err: errMissing})
+	m.Expect("iptables -t filter -n -L STRCT_PORTFWD", executil.MockResult{Err: errMissing})
+	m.Expect("iptables -t filter -C FORWARD -j STRCT_PORTFWD", executil.MockResult{Err: errMissing})
+	m.Expect("iptables -t nat -C POSTROUTING -j MASQUERADE", executil.MockResult{Err: errMissing})
+
+	rc := newTestRouter(t, m)
+	rc.state.PortRules = []PortRule{
+		{ID: "1", Name: "web", DeviceIP: "192.168.100.50", Protocol: "TCP", Port: 443},
+		{ID: "2", Name: "game", DeviceIP: "192.168.100.51", Protocol: "BOTH", Port: 3074},
+	}
+
+	if err := rc.applyPortForwarding(); err != nil {
+		t.Fatalf("applyPortForwarding() error: %v", err)
+	}
+
+	want := []string{
+		"iptables -t nat -n -L STRCT_PORTFWD",
+		"iptables -t nat -N STRCT_PORTFWD",
+		"iptables -t nat -C PREROUTING -j STRCT_PORTFWD",
+		"iptables -t nat -I PREROUTING 1 -j STRCT_PORTFWD",
+		"iptables -t filter -n -L STRCT_PORTFWD",
+		"iptables -t filter -N STRCT_PORTFWD",
+		"iptables -t filter -C FORWARD -j STRCT_PORTFWD",
+		"iptables -t filter -I FORWARD 1 -j STRCT_PORTFWD",
+		"iptables -t nat -F STRCT_PORTFWD",
+		"iptables -t filter -F STRCT_PORTFWD",
+		"iptables -t nat -A STRCT_PORTFWD -p tcp --dport 443 -j DNAT --to-destination 192.168.100.50:443",
+		"iptables -t filter -A STRCT_PORTFWD -p tcp -d 192.168.100.50 --dport 443 -j ACCEPT",
+		"iptables -t nat -A STRCT_PORTFWD -p tcp --dport 3074 -j DNAT --to-destination 192.168.100.51:3074",
+		"iptables -t filter -A STRCT_PORTFWD -p tcp -d 192.168.100.51 --dport 3074 -j ACCEPT",
+		"iptables -t nat -A STRCT_PORTFWD -p udp --dport 3074 -j DNAT --to-destination 192.168.100.51:3074",
+		"iptables -t filter -A STRCT_PORTFWD -p udp -d 192.168.100.51 --dport 3074 -j ACCEPT",
+		"iptables -t nat -C POSTROUTING -j MASQUERADE",
+		"iptables -t nat -A POSTROUTING -j MASQUERADE",
+	}
+	if got := iptablesCalls(m); !reflect.DeepEqual(got, want) {
+		t.Errorf("iptables calls:\n got: %s\nwant: %s", strings.Join(got, "\n      "), strings.Join(want, "\n      "))
+	}
+}
+
+func TestApplyPortForwarding_NeverFlushesPrerouting(t *testing.T) {
+	m := &executil.Mock{}
+	rc := newTestRouter(t, m)
+	rc.state.PortRules = []PortRule{{ID: "1", Name: "web", DeviceIP: "192.168.100.50", Protocol: "TCP", Port: 80}}
+
+	rc.applyPortForwarding() //nolint:errcheck
+
+	m.AssertNotCalled(t, "iptables -t nat -F PREROUTING")
+	m.AssertNotCalled(t, "iptables -F FORWARD")
+	// Chains already exist (mock -C/-L succeed) → no duplicate jumps or MASQUERADE.
+	m.AssertNotCalled(t, "iptables -t nat -I PREROUTING 1 -j STRCT_PORTFWD")
+	m.AssertNotCalled(t, "iptables -t nat -A POSTROUTING -j MASQUERADE")
+}
+
+func TestValidatePortRules(t *testing.T) {
+	valid := PortRule{Name: "ok", DeviceIP: "192.168.100.50", Protocol: "TCP", Port: 8080}
+
+	tests := []struct {
+		name  string
+		rules []PortRule
+		want  string // the fields reported, "" = valid
+	}{
+		{"valid", []PortRule{valid}, ""},
+		{"port zero", []PortRule{{Name: "p0", DeviceIP: "192.168.100.50", Protocol: "TCP", Port: 0}}, "port_rules[0].port"},
+		{"port too high", []PortRule{{Name: "big", DeviceIP: "192.168.100.50", Protocol: "UDP", Port: 70000}}, "port_rules[0].port"},
+		{"bad protocol", []PortRule{{Name: "icmp", DeviceIP: "192.168.100.50", Protocol: "ICMP", Port: 1}}, "port_rules[0].protocol"},
+		{"outside subnet", []PortRule{{Name: "wan", DeviceIP: "10.0.0.5", Protocol: "TCP", Port: 22}}, "port_rules[0].device_ip"},
+		{"gateway", []PortRule{{Name: "gw", DeviceIP: "192.168.100.1", Protocol: "TCP", Port: 22}}, "port_rules[0].device_ip"},
+		{"not an ip", []PortRule{{Name: "host", DeviceIP: "nas.lan", Protocol: "TCP", Port: 22}}, "port_rules[0].device_ip"},
+		{"duplicate port/proto", []PortRule{valid, {Name: "dup", DeviceIP: "192.168.100.60", Protocol: "TCP", Port: 8080}}, "port_rules[1].port"},
+		{"BOTH overlaps UDP", []PortRule{
+			{Name: "udp", DeviceIP: "192.168.100.60", Protocol: "UDP", Port: 53},
+			{Name: "both", DeviceIP: "192.168.100.61", Protocol: "BOTH", Port: 53},
+		}, "port_rules[1].port"},
+		{"every problem of every rule", []PortRule{
+			{Name: "a", DeviceIP: "10.0.0.5", Protocol: "ICMP", Port: 0},
+			valid,
+			{Name: "b", DeviceIP: "192.168.100.61", Protocol: "TCP", Port: 8080},
+		}, "port_rules[0].port port_rules[0].protocol port_rules[0].device_ip port_rules[2].port"},
+		{"same port different proto", []PortRule{
+			{Name: "t", DeviceIP: "192.168.100.60", Protocol: "TCP", Port: 53},
+			{Name: "u", DeviceIP: "192.168.100.61", Protocol: "UDP", Port: 53},
+		}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validatePortRules(tt.rules, "192.168.100")
+			if tt.want == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				for _, r := range tt.rules {
+					if r.ID == "" {
+						t.Errorf("rule %q was not assigned an ID", r.Name)
+					}
+				}
+				return
+			}
+			var v *errs.Validation
+			if !errors.As(err, &v) {
+				t.Fatalf("expected *errs.Validation, got %v", err)
+			}
+			var fields []string
+			for _, e := range v.Errors {
+				fields = append(fields, e.Field)
+			}
+			if got := strings.Join(fields, " "); got != tt.want {
+				t.Errorf("fields = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleSetConfig_Invalid_Returns400WithEveryProblem(t *testing.T) {
+	rc := newTestRouter(t, &executil.Mock{})
+
+	body := `{"ssid":"","password":"password123","port_rules":[
+		{"name":"nas","device_ip":"192.168.100.20","protocol":"TCP","port":99999},
+		{"name":"cam","device_ip":"10.0.0.9","protocol":"UDP","port":554}]}`
+	req := httptest.NewRequest(http.MethodPost, "/api/router/config", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	rc.handleSetConfig(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Errors []errs.FieldError `json:"errors"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	want := []errs.FieldError{
+		{Field: "ssid", Code: errs.CodeRequired, Message: "ssid is required"},
+		{Field: "port_rules[0].port", Code: errs.CodeOutOfRange, Message: `port rule "nas": port must be between 1 and 65535`},
+		{Field: "port_rules[1].device_ip", Code: errs.CodeInvalid, Message: `port rule "cam": device_ip must be a host in 192.168.100.0/24`},
+	}
+	if !slices.Equal(resp.Errors, want) {
+		t.Errorf("errors = %+v\nwant %+v", resp.Errors, want)
+	}
+	if _, err := os.Stat(rc.statePath()); !os.IsNotExist(err) {
+		t.Error("invalid config must not be persisted")
+	}
+}
+
+func TestState_PersistsPortRulesAcrossRestart(t *testing.T) {
+	dir := t.TempDir()
+	stub := wifiStub{wifi.Status{Active: true, SubnetBase: "192.168.100"}}
+
+	rc := New(Config{DataDir: dir}, &executil.Mock{}, stub)
+	rc.state.PortRules = []PortRule{{ID: "a", Name: "web", DeviceIP: "192.168.100.50", Protocol: "TCP", Port: 443}}
+	if err := rc.saveState(); err != nil {
+		t.Fatalf("saveState: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "router.json")); err != nil {
+		t.Fatalf("router.json not written: %v", err)
+	}
+
+	// Simulate a reboot: new controller, same DataDir.
+	m := &executil.Mock{}
+	restarted := New(Config{DataDir: dir}, m, stub)
+	if err := restarted.loadState(); err != nil {
+		t.Fatalf("loadState: %v", err)
+	}
+	if len(restarted.state.PortRules) != 1 || restarted.state.PortRules[0].Port != 443 {
+		t.Fatalf("port rules not restored: %+v", restarted.state.PortRules)
+	}
+
+	restarted.applyPortForwarding() //nolint:errcheck
+	m.AssertCalled(t, "iptables -t nat -A STRCT_PORTFWD -p tcp --dport 443 -j DNAT --to-destination 192.168.100.50:443")
+}
+
+func postLimit(t *testing.T, rc *RouterController, method, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, "/api/router/limit", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	if method == http.MethodDelete {
+		rc.handleRemoveLimit(w, req)
+	} else {
+		rc.handleSetLimit(w, req)
+	}
+	return w
+}
+
+func TestHandleSetLimit_InstallsClassAndMarkPerDirection(t *testing.T) {
+	m := &executil.Mock{}
+	rc := newTestRouter(t, m)
+
+	w := postLimit(t, rc, http.MethodPost, `{"mac":"AA:BB:CC:DD:EE:01","download_mbps":5,"upload_mbps":1}`)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"applied":true`) {
+		t.Fatalf("expected 200 applied, got %d: %s", w.Code, w.Body.String())
+	}
+
+	m.AssertCalled(t, "iptables -t mangle -A STRCT_LIMIT -m mac --mac-source aa:bb:cc:dd:ee:01 -j MARK --set-mark 10")
+	m.AssertCalled(t, "iptables -t mangle -A STRCT_LIMIT -m mac --mac-source aa:bb:cc:dd:ee:01 -j CONNMARK --save-mark")
+	m.AssertCalled(t, "tc class add dev wlan0 parent 1: classid 1:a htb rate 5.00mbit burst 15k")
+	m.AssertCalled(t, "tc filter add dev wlan0 parent 1: protocol ip handle 10 fw flowid 1:a")
+	m.AssertCalled(t, "tc class add dev eth0 parent 1: classid 1:a htb rate 1.00mbit burst 15k")
+
+	// A second device gets its own class instead of sharing 1:a.
+	postLimit(t, rc, http.MethodPost, `{"mac":"aa:bb:cc:dd:ee:02","download_mbps":2}`)
+	m.AssertCalled(t, "tc class add dev wlan0 parent 1: classid 1:b htb rate 2.00mbit burst 15k")
+	m.AssertNotCalled(t, "tc class add dev eth0 parent 1: classid 1:b htb rate 0.00mbit burst 15k")
+}
+
+func TestHandleSetLimit_Validation(t *testing.T) {
+	rc := newTestRouter(t, &executil.Mock{})
+	for _, body := range []string{
+		`{"mac":"nope","download_mbps":5}`,
+		`{"mac":"aa:bb:cc:dd:ee:01"}`,
+		`{"mac":"aa:bb:cc:dd:ee:01","download_mbps":-1}`,
+	} {
+		if w := postLimit(t, rc, http.MethodPost, body); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", body, w.Code)
+		}
+	}
+}
+
+func TestHandleRemoveLimit(t *testing.T) {
+	m := &executil.Mock{}
+	rc := newTestRouter(t, m)
+	postLimit(t, rc, http.MethodPost, `{"mac":"aa:bb:cc:dd:ee:01","download_mbps":5}`)
+
+	m.Calls = nil
+	if w := postLimit(t, rc, http.MethodDelete, `{"mac":"aa:bb:cc:dd:ee:01"}`); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	m.AssertCalled(t, "tc qdisc del dev wlan0 root")
+	if n := m.CallCount("tc class add dev wlan0 parent 1: classid 1:a htb rate 5.00mbit burst 15k"); n != 0 {
+		t.Error("removed limit was re-installed")
+	}
+
+	if w := postLimit(t, rc, http.MethodDelete, `{"mac":"aa:bb:cc:dd:ee:01"}`); w.Code != http.StatusNotFound {
+		t.Errorf("second delete: expected 404, got %d", w.Code)
+	}
+}
+
+func TestScanDevices_LimitedReflectsTCState(t *testing.T) {
+	m := &executil.Mock{}
+	m.Expect("arp -a", executil.MockResult{Output: []byte(
+		"? (192.168.100.50) at aa:bb:cc:dd:ee:01 [ether] on wlan0\n" +
+			"? (192.168.100.51) at aa:bb:cc:dd:ee:02 [ether] on wlan0\n")})
+	// Only the first device's class made it into the kernel.
+	m.Expect("tc class show dev wlan0", executil.MockResult{Output: []byte(
+		"class htb 1:3e7 root prio 0 rate 1Gbit ceil 1Gbit burst 1375b cburst 1375b\n" +
+			"class htb 1:a root prio 0 rate 5Mbit ceil 5Mbit burst 15Kb cburst 1600b\n")})
+
+	rc := New(Config{DataDir: t.TempDir()}, m, wifiStub{})
+	rc.limits["aa:bb:cc:dd:ee:01"] = DeviceLimit{MAC: "aa:bb:cc:dd:ee:01", DownloadMbps: 5, ClassID: 10}
+	rc.limits["aa:bb:cc:dd:ee:02"] = DeviceLimit{MAC: "aa:bb:cc:dd:ee:02", DownloadMbps: 2, ClassID: 11}
+
+	rc.scanDevices()
+
+	rc.mu.RLock()
+	devices := rc.devices
+	rc.mu.RUnlock()
+	if len(devices) != 2 {
+		t.Fatalf("expected 2 devices, got %+v", devices)
+	}
+	if !devices[0].Limited || devices[0].LimitMbps != 5 {
+		t.Errorf("device 1 should be limited at 5 Mbps: %+v", devices[0])
+	}
+	if devices[1].Limited {
+		t.Errorf("device 2 has no tc class and must not report limited: %+v", devices[1])
+	}
+}
+
+func TestState_PersistsLimitsAcrossRestart(t *testing.T) {
+	dir := t.TempDir()
+	rc := New(Config{DataDir: dir, DevMode: true}, &executil.Mock{}, wifiStub{})
+	postLimit(t, rc, http.MethodPost, `{"mac":"aa:bb:cc:dd:ee:01","download_mbps":5,"upload_mbps":1}`)
+
+	m := &executil.Mock{}
+	restarted := New(Config{DataDir: dir, DevMode: true}, m, wifiStub{})
+	if err := restarted.loadState(); err != nil {
+		t.Fatalf("loadState: %v", err)
+	}
+	if err := restarted.applyLimits(); err != nil {
+		t.Fatalf("applyLimits: %v", err)
+	}
+	m.AssertCalled(t, "tc class add dev wlan0 parent 1: classid 1:a htb rate 5.00mbit burst 15k")
+
+	// Dev mode trusts the config since tc is stubbed.
+	if !restarted.shapedClasses()["1:a"] {
+		t.Error("dev mode should report restored limits as applied")
+	}
+}
+
+type fakeBackend struct {
+	calls    []string // paths, in order
+	bodies   []any
+	deltaErr error
+}
+
+func (f *fakeBackend) DevicePath(suffix string) string { return "/dev/" + suffix }
+
+func (f *fakeBackend) Send(_ context.Context, path string, v any) error {
+	f.calls = append(f.calls, path)
+	f.bodies = append(f.bodies, v)
+	return f.deltaErr
+}
+
+func (f *fakeBackend) Post(_ context.Context, path string, v any) error {
+	f.calls = append(f.calls, path)
+	f.bodies = append(f.bodies, v)
+	return nil
+}
+
+func (f *fakeBackend) PostLatest(_ context.Context, path string, v any) error {
+	f.calls = append(f.calls, path)
+	f.bodies = append(f.bodies, v)
+	return nil
+}
+
+func TestDeviceReporter_SuppressesUnchangedAndSendsDeltas(t *testing.T) {
+	fb := &fakeBackend{}
+	r := newDeviceReporter(fb)
+	now := time.Unix(1_700_000_000, 0)
+	r.now = func() time.Time { return now }
+
+	a := ConnectedDevice{MAC: "aa:bb:cc:dd:ee:01", IP: "192.168.100.50", Name: "tv"}
+	b := ConnectedDevice{MAC: "aa:bb:cc:dd:ee:02", IP: "192.168.100.51", Name: "phone"}
+	sent0, suppressed0 := reportsSent.Value(), reportsSuppressed.Value()
+
+	r.report(context.Background(), []ConnectedDevice{a, b})
+	// Same devices in a different order: hash is stable, nothing sent.
+	r.report(context.Background(), []ConnectedDevice{b, a})
+	if want := []string{"/dev/connected_devices"}; !reflect.DeepEqual(fb.calls, want) {
+		t.Fatalf("calls = %v, want %v", fb.calls, want)
+	}
+
+	b.Blocked = true
+	c := ConnectedDevice{MAC: "aa:bb:cc:dd:ee:03", IP: "192.168.100.52"}
+	r.report(context.Background(), []ConnectedDevice{b, c})
+	if got := fb.calls[len(fb.calls)-1]; got != "/dev/connected_devices/delta" {
+		t.Fatalf("expected a delta, got %s", got)
+	}
+	delta := fb.bodies[len(fb.bodies)-1].(deviceDelta)
+	if len(delta.Joined) != 1 || delta.Joined[0].MAC != c.MAC ||
+		!reflect.DeepEqual(delta.Left, []string{a.MAC}) ||
+		len(delta.Changed) != 1 || !delta.Changed[0].Blocked {
+		t.Errorf("unexpected delta: %+v", delta)
+	}
+
+	// Heartbeat: unchanged list is re-sent as a snapshot after 10 minutes.
+	now = now.Add(defaultReportHeartbeat)
+	r.report(context.Background(), []ConnectedDevice{b, c})
+	if got := fb.calls[len(fb.calls)-1]; got != "/dev/connected_devices" || len(fb.calls) != 3 {
+		t.Errorf("expected heartbeat snapshot as call 3, got %v", fb.calls)
+	}
+
+	if d := reportsSent.Value() - sent0; d != 3 {
+		t.Errorf("sent counter advanced by %d, want 3", d)
+	}
+	if d := reportsSuppressed.Value() - suppressed0; d != 1 {
+		t.Errorf("suppressed counter advanced by %d, want 1", d)
+	}
+}
+
+func TestDeviceReporter_FallsBackToSnapshotsOn404(t *testing.T) {
+	fb := &fakeBackend{deltaErr: &backend.StatusError{Path: "/dev/connected_devices/delta", Code: http.StatusNotFound}}
+	r := newDeviceReporter(fb)
+
+	r.report(context.Background(), []ConnectedDevice{{MAC: "aa:bb:cc:dd:ee:01"}})
+	r.report(context.Background(), []ConnectedDevice{{MAC: "aa:bb:cc:dd:ee:02"}})
+	r.report(context.Background(), []ConnectedDevice{{MAC: "aa:bb:cc:dd:ee:03"}})
+
+	want := []string{
+		"/dev/connected_devices",
+		"/dev/connected_devices/delta",
+		"/dev/connected_devices",
+		"/dev/connected_devices", // no more delta attempts
+	}
+	if !reflect.DeepEqual(fb.calls, want) {
+		t.Errorf("calls = %v, want %v", fb.calls, want)
+	}
+}
+
+func TestParseLeases(t *testing.T) {
+	data := []byte("1718000000 AA:BB:CC:DD:EE:01 192.168.100.50 Pixel-7 01:aa:bb:cc:dd:ee:01\n" +
+		"1718000000 aa:bb:cc:dd:ee:02 192.168.100.51 * *\n" +
+		"garbage\n")
+	want := map[string]string{"aa:bb:cc:dd:ee:01": "Pixel-7"}
+	if got := parseLeases(data); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseLeases = %v, want %v", got, want)
+	}
+}
+
+func TestLookupVendor(t *testing.T) {
+	tests := map[string]string{
+		"b8:27:eb:12:34:56": "Raspberry Pi",
+		"F0:18:98:00:00:01": "Apple",
+		"02:00:00:00:00:01": "",
+		"bad":               "",
+	}
+	for mac, want := range tests {
+		if got := lookupVendor(mac); got != want {
+			t.Errorf("lookupVendor(%q) = %q, want %q", mac, got, want)
+		}
+	}
+}
+
+func TestDeviceNamer_Priority(t *testing.T) {
+	dir := t.TempDir()
+	n := newDeviceNamer(dir)
+	n.leasesPath = filepath.Join(dir, "dnsmasq.leases")
+	os.WriteFile(n.leasesPath, []byte("0 aa:bb:cc:dd:ee:01 192.168.100.50 laptop *\n"), 0644) //nolint:errcheck
+	lookups := 0
+	n.lookupAddr = func(_ context.Context, addr string) ([]string, error) {
+		lookups++
+		if addr == "192.168.100.52" {
+			return []string{"printer.lan."}, nil
+		}
+		return nil, errors.New("NXDOMAIN")
+	}
+	// Populate the PTR cache synchronously instead of via the scan goroutine.
+	n.resolve("192.168.100.50")
+	n.resolve("192.168.100.52")
+	n.resolve("192.168.100.53")
+
+	tests := []struct {
+		mac, ip, wantName, wantSource string
+	}{
+		{"aa:bb:cc:dd:ee:01", "192.168.100.50", "laptop", nameSourceDHCP},
+		{"aa:bb:cc:dd:ee:02", "192.168.100.52", "printer", nameSourceDNS},
+		{"b8:27:eb:00:00:03", "192.168.100.53", "Raspberry Pi", nameSourceVendor},
+		{"02:00:00:00:00:04", "192.168.100.53", unknownDeviceName, ""},
+	}
+	for _, tt := range tests {
+		if name, src := n.name(tt.mac, tt.ip); name != tt.wantName || src != tt.wantSource {
+			t.Errorf("name(%s) = %q/%q, want %q/%q", tt.mac, name, src, tt.wantName, tt.wantSource)
+		}
+	}
+
+	// A nickname beats the DHCP hostname.
+	if err := n.setNickname("aa:bb:cc:dd:ee:01", "Work laptop"); err != nil {
+		t.Fatal(err)
+	}
+	if name, src := n.name("AA:BB:CC:DD:EE:01", "192.168.100.50"); name != "Work laptop" || src != nameSourceNickname {
+		t.Errorf("nickname not preferred: %q/%q", name, src)
+	}
+
+	if lookups != 3 {
+		t.Errorf("cached names should not trigger new lookups, got %d", lookups)
+	}
+}
+
+func TestHandleSetDeviceName_Persists(t *testing.T) {
+	dir := t.TempDir()
+	rc := New(Config{DataDir: dir}, &executil.Mock{}, wifiStub{})
+	mux := http.NewServeMux()
+	rc.RegisterRoutes(mux)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/router/devices/aa:bb:cc:dd:ee:01/name",
+		strings.NewReader(`{"name":"  Living room TV "}`))
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	restarted := New(Config{DataDir: dir}, &executil.Mock{}, wifiStub{})
+	if err := restarted.namer.loadNicknames(); err != nil {
+		t.Fatal(err)
+	}
+	if name, _ := restarted.namer.name("aa:bb:cc:dd:ee:01", ""); name != "Living room TV" {
+		t.Errorf("nickname after restart = %q", name)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/api/router/devices/not-a-mac/name", strings.NewReader(`{"name":"x"}`))
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("invalid MAC: expected 400, got %d", w.Code)
+	}
+}
+
+func TestDeviceHistory_SessionsAndNewDevices(t *testing.T) {
+	dir := t.TempDir()
+	h := newDeviceHistory(dir)
+	now := time.Unix(1_700_000_000, 0)
+	h.now = func() time.Time { return now }
+
+	tv := ConnectedDevice{MAC: "aa:bb:cc:dd:ee:01", IP: "192.168.100.50", Name: "tv"}
+	phone := ConnectedDevice{MAC: "da:a1:19:00:00:02", IP: "192.168.100.51", Name: "phone"}
+
+	if fresh := h.observe([]ConnectedDevice{tv}); len(fresh) != 1 || fresh[0].MAC != tv.MAC {
+		t.Fatalf("first scan: fresh = %+v", fresh)
+	}
+	now = now.Add(10 * time.Second)
+	if fresh := h.observe([]ConnectedDevice{tv, phone}); len(fresh) != 1 || !fresh[0].PrivateAddress {
+		t.Fatalf("second scan: fresh = %+v, want the phone flagged private", fresh)
+	}
+	// tv leaves and comes back: a second session, but not a new device.
+	now = now.Add(10 * time.Second)
+	h.observe([]ConnectedDevice{phone})
+	now = now.Add(10 * time.Second)
+	if fresh := h.observe([]ConnectedDevice{tv, phone}); len(fresh) != 0 {
+		t.Fatalf("returning device reported as new: %+v", fresh)
+	}
+
+	restarted := newDeviceHistory(dir)
+	if err := restarted.load(); err != nil {
+		t.Fatal(err)
+	}
+	got := restarted.snapshotLocked()
+	if len(got.Devices) != 2 || len(got.Events) != 2 {
+		t.Fatalf("restored %d devices, %d events", len(got.Devices), len(got.Events))
+	}
+	for _, d := range got.Devices {
+		if d.MAC == tv.MAC && (d.TotalSessions != 2 || !d.LastSeen.Equal(now) || d.FirstSeen.Equal(now)) {
+			t.Errorf("tv history = %+v", d)
+		}
+		if d.MAC == phone.MAC && (d.TotalSessions != 1 || !d.PrivateAddress) {
+			t.Errorf("phone history = %+v", d)
+		}
+	}
+}
+
+func TestHandleNewDevices_Since(t *testing.T) {
+	rc := New(Config{DataDir: t.TempDir()}, &executil.Mock{}, wifiStub{})
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	rc.history.now = func() time.Time { return now }
+	rc.history.observe([]ConnectedDevice{{MAC: "aa:bb:cc:dd:ee:01"}})
+	now = now.Add(time.Hour)
+	rc.history.observe([]ConnectedDevice{{MAC: "aa:bb:cc:dd:ee:01"}, {MAC: "aa:bb:cc:dd:ee:02"}})
+
+	mux := http.NewServeMux()
+	rc.RegisterRoutes(mux)
+
+	tests := []struct {
+		query    string
+		wantCode int
+		wantN    int
+	}{
+		{"", http.StatusOK, 2},
+		{"?since=2024-06-01T12:30:00Z", http.StatusOK, 1},
+		{"?since=1717245000", http.StatusOK, 1}, // 12:30 UTC
+		{"?since=yesterday", http.StatusBadRequest, 0},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/router/devices/new"+tt.query, nil))
+		if w.Code != tt.wantCode {
+			t.Errorf("%q: code = %d, want %d", tt.query, w.Code, tt.wantCode)
+			continue
+		}
+		if tt.wantCode == http.StatusOK {
+			if n := strings.Count(w.Body.String(), `"mac"`); n != tt.wantN {
+				t.Errorf("%q: %d events, want %d: %s", tt.query, n, tt.wantN, w.Body)
+			}
+		}
+	}
+}
+
+func TestDeviceReporter_PostsNewDeviceEvents(t *testing.T) {
+	fb := &fakeBackend{}
+	r := newDeviceReporter(fb)
+
+	r.reportNewDevices(context.Background(), nil)
+	if len(fb.calls) != 0 {
+		t.Fatalf("posted with no events: %v", fb.calls)
+	}
+	r.reportNewDevices(context.Background(), []NewDeviceEvent{{MAC: "aa:bb:cc:dd:ee:01"}})
+	if want := []string{"/dev/device_events"}; !reflect.DeepEqual(fb.calls, want) {
+		t.Errorf("calls = %v, want %v", fb.calls, want)
+	}
+}
+
+func postBlock(t *testing.T, rc *RouterController, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	rc.handleBlockDevice(w, httptest.NewRequest(http.MethodPost, "/api/router/block", strings.NewReader(body)))
+	return w
+}
+
+const dropRule = "-m mac --mac-source aa:bb:cc:dd:ee:01 -j DROP"
+
+func TestHandleBlockDevice_BlockUsesOwnChainAndPersists(t *testing.T) {
+	m := &executil.Mock{}
+	m.Expect("iptables -t filter -n -L STRCT_BLOCK", executil.MockResult{Err: errMissing})
+	m.Expect("iptables -t filter -C INPUT -j STRCT_BLOCK", executil.MockResult{Err: errMissing})
+	m.Expect("iptables -t filter -C FORWARD -j STRCT_BLOCK", executil.MockResult{Err: errMissing})
+	m.Expect("iptables -t filter -C STRCT_BLOCK "+dropRule, executil.MockResult{Err: errMissing})
+	rc := newTestRouter(t, m)
+
+	if w := postBlock(t, rc, `{"mac":"AA:BB:CC:DD:EE:01","block":true}`); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	m.AssertCalled(t, "iptables -t filter -N STRCT_BLOCK")
+	m.AssertCalled(t, "iptables -t filter -I INPUT 1 -j STRCT_BLOCK")
+	m.AssertCalled(t, "iptables -t filter -I FORWARD 1 -j STRCT_BLOCK")
+	m.AssertCalled(t, "iptables -t filter -A STRCT_BLOCK "+dropRule)
+	for _, c := range iptablesCalls(m) {
+		if strings.Contains(c, "-A INPUT") || strings.Contains(c, "-A FORWARD") {
+			t.Errorf("rule added to a built-in chain: %s", c)
+		}
+	}
+
+	// Blocks survive a restart and are reinstalled on apply.
+	m2 := &executil.Mock{}
+	restarted := New(Config{DataDir: rc.cfg.DataDir, DevMode: true}, m2, wifiStub{})
+	if err := restarted.loadState(); err != nil {
+		t.Fatal(err)
+	}
+	if err := restarted.applyBlocks(); err != nil {
+		t.Fatal(err)
+	}
+	m2.AssertCalled(t, "iptables -t filter -F STRCT_BLOCK")
+	m2.AssertCalled(t, "iptables -t filter -A STRCT_BLOCK "+dropRule)
+}
+
+func TestHandleBlockDevice_DoubleBlockIsIdempotent(t *testing.T) {
+	m := &executil.Mock{}
+	m.Expect("iptables -t filter -C STRCT_BLOCK "+dropRule, executil.MockResult{Err: errMissing})
+	rc := newTestRouter(t, m)
+
+	postBlock(t, rc, `{"mac":"aa:bb:cc:dd:ee:01","block":true}`)
+	// Now the rule exists: iptables -C succeeds.
+	m.Expect("iptables -t filter -C STRCT_BLOCK "+dropRule, executil.MockResult{})
+	if w := postBlock(t, rc, `{"mac":"aa:bb:cc:dd:ee:01","block":true}`); w.Code != http.StatusOK {
+		t.Fatalf("second block: %d", w.Code)
+	}
+	if n := m.CallCount("iptables -t filter -A STRCT_BLOCK " + dropRule); n != 1 {
+		t.Errorf("DROP rule appended %d times, want 1", n)
+	}
+}
+
+func TestHandleBlockDevice_Unblock(t *testing.T) {
+	m := &executil.Mock{}
+	rc := newTestRouter(t, m)
+	rc.blockedMACs["aa:bb:cc:dd:ee:01"] = true
+	rc.devices = []ConnectedDevice{{MAC: "aa:bb:cc:dd:ee:01", Blocked: true}}
+
+	if w := postBlock(t, rc, `{"mac":"aa:bb:cc:dd:ee:01","block":false}`); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	m.AssertCalled(t, "iptables -t filter -D STRCT_BLOCK "+dropRule)
+	if rc.blockedMACs["aa:bb:cc:dd:ee:01"] || rc.devices[0].Blocked {
+		t.Error("device still marked blocked")
+	}
+
+	// Unblocking a MAC with no rule doesn't call -D.
+	m2 := &executil.Mock{}
+	m2.Expect("iptables -t filter -C STRCT_BLOCK "+dropRule, executil.MockResult{Err: errMissing})
+	rc2 := newTestRouter(t, m2)
+	postBlock(t, rc2, `{"mac":"aa:bb:cc:dd:ee:01","block":false}`)
+	m2.AssertNotCalled(t, "iptables -t filter -D STRCT_BLOCK "+dropRule)
+}
+
+func TestApplyHostapd_FallsBackToRestartWhenHUPFails(t *testing.T) {
+	m := &executil.Mock{}
+	m.Expect("systemctl kill -s HUP hostapd", executil.MockResult{Err: errMissing})
+	rc := newTestRouter(t, m)
+
+	if err := rc.applyHostapd(); err != nil {
+		t.Fatalf("applyHostapd: %v", err)
+	}
+	m.AssertCalled(t, "systemctl restart hostapd")
+
+	m = &executil.Mock{}
+	rc = newTestRouter(t, m)
+	if err := rc.applyHostapd(); err != nil {
+		t.Fatalf("applyHostapd: %v", err)
+	}
+	m.AssertNotCalled(t, "systemctl restart hostapd")
+}
+
+func TestApplyFirewall_RulesFollowConfig(t *testing.T) {
+	m := &executil.Mock{}
+	rc := newTestRouter(t, m)
+	rc.state.FirewallEnabled = true
+	rc.state.GuestIsolation = true
+	rc.state.BlockPing = true
+	rc.state.IPv6Firewall = true
+
+	if err := rc.applyFirewall(); err != nil {
+		t.Fatalf("applyFirewall: %v", err)
+	}
+	m.AssertCalled(t, "iptables -P INPUT DROP")
+	m.AssertCalled(t, "iptables -A FORWARD -i wlan0 -o wlan0 -j DROP")
+	m.AssertCalled(t, "iptables -A INPUT -p icmp --icmp-type echo-request -j DROP")
+	m.AssertCalled(t, "ip6tables -P INPUT DROP")
+
+	m = &executil.Mock{}
+	rc = newTestRouter(t, m)
+	rc.state.FirewallEnabled = false
+	if err := rc.applyFirewall(); err != nil {
+		t.Fatalf("applyFirewall: %v", err)
+	}
+	m.AssertCalled(t, "iptables -P INPUT ACCEPT")
+	m.AssertNotCalled(t, "iptables -P INPUT DROP")
+	if m.WasCalled("ip6tables -P INPUT DROP") {
+		t.Error("ip6tables policy set with ipv6_firewall off")
+	}
+}
+
+func TestApplyTxPower_WrapsRunnerError(t *testing.T) {
+	m := &executil.Mock{}
+	m.Expect("iwconfig wlan0 txpower 30", executil.MockResult{Err: errMissing})
+	rc := newTestRouter(t, m)
+	rc.state.TxPower = "30"
+
+	err := rc.applyTxPower()
+	if err == nil || !strings.Contains(err.Error(), "iwconfig txpower 30") {
+		t.Errorf("applyTxPower() = %v, want wrapped iwconfig error", err)
+	}
+}
+
+const acctListCmd = "iptables -t filter -L STRCT_ACCT -v -x -n"
+
+// acctOutput renders STRCT_ACCT counters for one device as iptables -L -v -x -n prints them.
+func acctOutput(mac, ip string, rx, tx uint64) []byte {
+	return []byte("Chain STRCT_ACCT (1 references)\n" +
+		"    pkts      bytes target     prot opt in     out     source               destination\n" +
+		"      10 " + strconv.FormatUint(tx, 10) + " RETURN     all  --  *      *       " + ip + "       0.0.0.0/0            /* strct-acct:" + mac + " */\n" +
+		"      20 " + strconv.FormatUint(rx, 10) + " RETURN     all  --  *      *       0.0.0.0/0            " + ip + "       /* strct-acct:" + mac + " */\n")
+}
+
+func TestParseAcctCounters(t *testing.T) {
+	out := acctOutput("aa:bb:cc:dd:ee:01", "192.168.100.50", 5000, 700)
+	out = append(out, "       1      60 RETURN     all  --  *      *       0.0.0.0/0            0.0.0.0/0\n"...)
+
+	got := parseAcctCounters(out)
+	want := []acctCounter{
+		{MAC: "aa:bb:cc:dd:ee:01", IP: "192.168.100.50", Bytes: 700},
+		{MAC: "aa:bb:cc:dd:ee:01", IP: "192.168.100.50", Rx: true, Bytes: 5000},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseAcctCounters = %+v, want %+v", got, want)
+	}
+}
+
+func TestTrafficMeter_DeltasRolloverAndRestart(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2026, 5, 1, 23, 50, 0, 0, time.Local)
+	clock := func() time.Time { return now }
+	tick := func() { now = now.Add(historySaveInterval) }
+	read := func(rx uint64) []acctCounter {
+		return []acctCounter{{MAC: "aa:bb:cc:dd:ee:01", IP: "192.168.100.50", Rx: true, Bytes: rx}}
+	}
+
+	tm := newTrafficMeter(dir)
+	tm.now = clock
+	tm.record(read(1000))
+	tick()
+	tm.record(read(1500))
+	if got := tm.today("aa:bb:cc:dd:ee:01").RxBytes; got != 1500 {
+		t.Fatalf("today = %d, want 1500", got)
+	}
+
+	// Agent restarts; the kernel kept counting meanwhile. Past midnight
+	// the new bytes land on the new day.
+	tick()
+	restarted := newTrafficMeter(dir)
+	restarted.now = clock
+	if err := restarted.load(); err != nil {
+		t.Fatal(err)
+	}
+	restarted.record(read(1800))
+	if got := restarted.today("aa:bb:cc:dd:ee:01").RxBytes; got != 300 {
+		t.Errorf("new day = %d, want 300 (counted while the agent was down)", got)
+	}
+
+	// A counter that went backwards was reset and counts in full.
+	tick()
+	restarted.record(read(200))
+	if got := restarted.usageSince(7)["aa:bb:cc:dd:ee:01"].RxBytes; got != 2000 {
+		t.Errorf("7d = %d, want 2000", got)
+	}
+	if got := restarted.usageSince(1)["aa:bb:cc:dd:ee:01"].RxBytes; got != 500 {
+		t.Errorf("today = %d, want 500", got)
+	}
+}
+
+func TestScanDevices_InstallsAccountingRulesOnceAndReportsUsage(t *testing.T) {
+	const mac, ip = "aa:bb:cc:dd:ee:01", "192.168.100.50"
+	tx, rx := acctRules(mac, ip)
+	txAdd := "iptables -t filter -A STRCT_ACCT " + strings.Join(tx, " ")
+	rxAdd := "iptables -t filter -A STRCT_ACCT " + strings.Join(rx, " ")
+
+	m := &executil.Mock{}
+	m.Expect("arp -a", executil.MockResult{Output: []byte("? (" + ip + ") at " + mac + " [ether] on wlan0\n")})
+	m.Expect("iptables -t filter -C STRCT_ACCT "+strings.Join(tx, " "), executil.MockResult{Err: errMissing})
+	m.Expect("iptables -t filter -C STRCT_ACCT "+strings.Join(rx, " "), executil.MockResult{Err: errMissing})
+	m.Expect(acctListCmd, executil.MockResult{Output: acctOutput(mac, ip, 9000, 1200)})
+	rc := newTestRouter(t, m)
+
+	rc.scanDevices()
+	rc.sampleTraffic()
+	rc.scanDevices()
+
+	if n := m.CallCount(txAdd); n != 1 {
+		t.Errorf("tx rule added %d times, want 1", n)
+	}
+	if n := m.CallCount(rxAdd); n != 1 {
+		t.Errorf("rx rule added %d times, want 1", n)
+	}
+	rc.mu.RLock()
+	d := rc.devices[0]
+	rc.mu.RUnlock()
+	if d.RxBytesToday != 9000 || d.TxBytesToday != 1200 {
+		t.Errorf("device usage = %d rx / %d tx, want 9000 / 1200", d.RxBytesToday, d.TxBytesToday)
+	}
+
+	w := httptest.NewRecorder()
+	rc.handleDeviceUsage(w, httptest.NewRequest("GET", "/api/router/devices/usage?period=7d", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"rx_bytes":9000`) {
+		t.Errorf("usage: %d %s", w.Code, w.Body)
+	}
+	w = httptest.NewRecorder()
+	rc.handleDeviceUsage(w, httptest.NewRequest("GET", "/api/router/devices/usage?period=month", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("bad period: got %d, want 400", w.Code)
+	}
+}
+
+func TestApplyFirewall_BanksAccountingBeforeFlush(t *testing.T) {
+	const mac, ip = "aa:bb:cc:dd:ee:01", "192.168.100.50"
+	m := &executil.Mock{}
+	m.Expect(acctListCmd, executil.MockResult{Output: acctOutput(mac, ip, 4000, 100)})
+	rc := newTestRouter(t, m)
+
+	if err := rc.applyFirewall(); err != nil {
+		t.Fatal(err)
+	}
+	var list, flush int = -1, -1
+	for i, c := range m.Calls {
+		switch c.String() {
+		case acctListCmd:
+			list = i
+		case "iptables -F":
+			flush = i
+		}
+	}
+	if list < 0 || flush < 0 || list > flush {
+		t.Errorf("counters read at call %d, flush at %d; want read before flush", list, flush)
+	}
+	m.AssertCalled(t, "iptables -t filter -F STRCT_ACCT")
+	if got := rc.traffic.today(mac).RxBytes; got != 4000 {
+		t.Errorf("banked rx = %d, want 4000", got)
+	}
+}
+
+func newPriorityRouter(t *testing.T, m *executil.Mock) *RouterController {
+	t.Helper()
+	rc := newTestRouter(t, m)
+	rc.cfg.Priority = true
+	rc.cfg.APIPort = 8080
+	return rc
+}
+
+func TestApplyLimits_PriorityWithoutLimitsUsesPrioQdisc(t *testing.T) {
+	m := &executil.Mock{}
+	rc := newPriorityRouter(t, m)
+
+	if err := rc.applyLimits(); err != nil {
+		t.Fatalf("applyLimits() error: %v", err)
+	}
+	m.AssertCalled(t, "tc qdisc add dev wlan0 root handle 1: prio")
+	m.AssertCalled(t, "tc filter add dev wlan0 parent 1: protocol ip prio 1 u32 match ip sport 53 0xffff flowid 1:1")
+	m.AssertCalled(t, "tc filter add dev wlan0 parent 1: protocol ip prio 1 u32 match ip sport 5354 0xffff flowid 1:1")
+	// File downloads share the API port; only small replies are promoted.
+	m.AssertCalled(t, "tc filter add dev wlan0 parent 1: protocol ip prio 1 u32 match ip sport 8080 0xffff match u16 0x0000 0xfe00 at 2 flowid 1:1")
+
+	if st := rc.priority; !st.Active || st.Mode != "prio" || st.Error != "" {
+		t.Errorf("priority status = %+v", st)
+	}
+}
+
+func TestApplyLimits_PriorityJoinsHTBTree(t *testing.T) {
+	m := &executil.Mock{}
+	rc := newPriorityRouter(t, m)
+	postLimit(t, rc, http.MethodPost, `{"mac":"aa:bb:cc:dd:ee:01","download_mbps":5}`)
+
+	m.AssertCalled(t, "tc class add dev wlan0 parent 1: classid 1:1 htb rate 1000mbit prio 0")
+	m.AssertCalled(t, "tc filter add dev wlan0 parent 1: protocol ip prio 1 u32 match ip sport 53 0xffff flowid 1:1")
+	m.AssertNotCalled(t, "tc qdisc add dev wlan0 root handle 1: prio")
+	if st := rc.priority; !st.Active || st.Mode != "htb" {
+		t.Errorf("priority status = %+v", st)
+	}
+}
+
+func TestApplyLimits_PriorityFailureIsReportedNotFatal(t *testing.T) {
+	m := &executil.Mock{}
+	m.Expect("tc qdisc add dev wlan0 root handle 1: prio", executil.MockResult{Err: errors.New("RTNETLINK answers: Operation not permitted")})
+	rc := newPriorityRouter(t, m)
+
+	if err := rc.applyLimits(); err != nil {
+		t.Fatalf("priority failure must not fail applyLimits: %v", err)
+	}
+	if st := rc.priority; st.Active || !strings.Contains(st.Error, "not permitted") {
+		t.Errorf("priority status = %+v", st)
+	}
+}
+
+func TestApplyLimits_PriorityDisabledByDefault(t *testing.T) {
+	m := &executil.Mock{}
+	rc := newTestRouter(t, m)
+
+	if err := rc.applyLimits(); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range m.Calls {
+		if c.Name == "tc" && c.Args[0] != "qdisc" {
+			t.Errorf("unexpected %s", c.String())
+		}
+	}
+}
+
+type transferStub struct{ st throttle.Status }
+
+func (s transferStub) Status() throttle.Status { return s.st }
+
+func TestHandleGetPriority(t *testing.T) {
+	rc := newPriorityRouter(t, &executil.Mock{})
+	rc.transfers = transferStub{throttle.Status{LinkMbps: 100, Share: 0.8, LimitMbps: 80, Capped: true}}
+	rc.applyLimits()
+
+	w := httptest.NewRecorder()
+	rc.handleGetPriority(w, httptest.NewRequest(http.MethodGet, "/api/router/priority", nil))
+	body := w.Body.String()
+	for _, want := range []string{`"active":true`, `"mode":"prio"`, `"limit_mbps":80`, `"capped":true`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("response missing %s: %s", want, body)
+		}
+	}
+}
+
+func TestLoadNicknames_MigratesLegacyMap(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "device-names.json")
+	// Before versioning the file was a bare MAC → nickname map.
+	os.WriteFile(path, []byte(`{"AA:BB:CC:DD:EE:01":"Living room TV"}`), 0600)
+
+	rc := New(Config{DataDir: dir}, &executil.Mock{}, wifiStub{})
+	if err := rc.namer.loadNicknames(); err != nil {
+		t.Fatal(err)
+	}
+	if name, _ := rc.namer.name("aa:bb:cc:dd:ee:01", ""); name != "Living room TV" {
+		t.Errorf("nickname = %q", name)
+	}
+	b, _ := os.ReadFile(path)
+	if !strings.Contains(string(b), `"schema_version": 1`) || !strings.Contains(string(b), `"names"`) {
+		t.Errorf("file not rewritten in the v1 shape: %s", b)
+	}
+}
+
+func TestLoadState_CorruptFileMovedAside(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "router.json")
+	os.WriteFile(path, []byte(`{"port_rules":[{"id":`), 0600)
+
+	rc := New(Config{DataDir: dir}, &executil.Mock{}, wifiStub{})
+	if err := rc.loadState(); err != nil {
+		t.Fatalf("corrupt state must not fail the router: %v", err)
+	}
+	if len(rc.state.PortRules) != 0 {
+		t.Errorf("port rules = %v, want defaults", rc.state.PortRules)
+	}
+	if moved, _ := filepath.Glob(path + ".corrupt-*"); len(moved) != 1 {
+		t.Errorf("quarantined files = %v", moved)
+	}
+}
+
+func TestBroadcastUDP_SendsMagicPacket(t *testing.T) {
+	ln, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	mac, _ := net.ParseMAC("00:11:32:AA:BB:CC")
+	if err := broadcastUDP(ln.LocalAddr().String(), magicPacket(mac)); err != nil {
+		t.Fatalf("broadcastUDP: %v", err)
+	}
+
+	buf := make([]byte, 256)
+	ln.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := ln.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("no packet received: %v", err)
+	}
+	got := buf[:n]
+	if len(got) != 102 {
+		t.Fatalf("packet is %d bytes, want 102", len(got))
+	}
+	if !bytes.Equal(got[:6], []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}) {
+		t.Errorf("header = % x", got[:6])
+	}
+	for i := 0; i < 16; i++ {
+		if rep := got[6+i*6 : 12+i*6]; !bytes.Equal(rep, mac) {
+			t.Errorf("repetition %d = % x, want % x", i, rep, []byte(mac))
+		}
+	}
+}
+
+func postWake(rc *RouterController, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	rc.handleWake(w, httptest.NewRequest(http.MethodPost, "/api/router/wake", strings.NewReader(body)))
+	return w
+}
+
+func TestHandleWake(t *testing.T) {
+	rc := newTestRouter(t, &executil.Mock{})
+	now := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+	rc.wakes.now = func() time.Time { return now }
+	var sentTo []string
+	rc.sendWake = func(addr string, packet []byte) error {
+		sentTo = append(sentTo, addr)
+		return nil
+	}
+
+	if w := postWake(rc, `{"mac":"00:11:32:zz:bb:cc"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid MAC: got %d, want 400", w.Code)
+	}
+
+	w := postWake(rc, `{"mac":"00:11:32:AA:BB:CC"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("wake: got %d: %s", w.Code, w.Body)
+	}
+	if len(sentTo) != 1 || sentTo[0] != "192.168.100.255:9" {
+		t.Errorf("sent to %v, want the AP broadcast address", sentTo)
+	}
+
+	for i := 1; i < wakeBurst; i++ {
+		postWake(rc, `{"mac":"00:11:32:AA:BB:CC"}`)
+	}
+	if w := postWake(rc, `{"mac":"00:11:32:AA:BB:CC"}`); w.Code != http.StatusTooManyRequests {
+		t.Errorf("over the limit: got %d, want 429", w.Code)
+	}
+	now = now.Add(wakeWindow)
+	if w := postWake(rc, `{"mac":"00:11:32:AA:BB:CC"}`); w.Code != http.StatusOK {
+		t.Errorf("after the window: got %d, want 200", w.Code)
+	}
+}
+
+func TestHandleWake_RequiresActiveAP(t *testing.T) {
+	rc := New(Config{DataDir: t.TempDir()}, &executil.Mock{}, wifiStub{wifi.Status{Active: false}})
+	rc.sendWake = func(string, []byte) error {
+		t.Error("packet sent with the AP down")
+		return nil
+	}
+	if w := postWake(rc, `{"mac":"00:11:32:AA:BB:CC"}`); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("got %d, want 422", w.Code)
+	}
+}
+
+// castResponse is what a Chromecast sends: the instance label is a UUID
+// string, the name the owner chose is in TXT fn.
+func castResponse(t *testing.T, model string) *dns.Msg {
+	t.Helper()
+	msg := new(dns.Msg)
+	msg.Response = true
+	for _, s := range []string{
+		`_googlecast._tcp.local. 120 IN PTR Chromecast-3f1c._googlecast._tcp.local.`,
+		`Chromecast-3f1c._googlecast._tcp.local. 120 IN SRV 0 0 8009 3f1c.local.`,
+		`Chromecast-3f1c._googlecast._tcp.local. 120 IN TXT "id=3f1c" "md=` + model + `" "fn=Living Room TV"`,
+		`3f1c.local. 120 IN A 192.168.100.60`,
+	} {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg.Answer = append(msg.Answer, rr)
+	}
+	return msg
+}
+
+func TestDiscovery_ParsesCastAnnouncement(t *testing.T) {
+	d := newDiscovery()
+	// Sent from another address (a sleep proxy); the A record wins.
+	d.handle(castResponse(t, "Chromecast"), net.ParseIP("192.168.100.1"))
+
+	dev, ok := d.lookup("192.168.100.60")
+	if !ok {
+		t.Fatal("device not recorded")
+	}
+	if dev.Name != "Living Room TV" || dev.DeviceType != deviceTypeTV {
+		t.Errorf("got %q / %q, want Living Room TV / tv", dev.Name, dev.DeviceType)
+	}
+	if !reflect.DeepEqual(dev.Services, []string{"_googlecast._tcp"}) {
+		t.Errorf("services = %v", dev.Services)
+	}
+
+	d = newDiscovery()
+	d.handle(castResponse(t, "Google Nest Mini"), nil)
+	if dev, _ := d.lookup("192.168.100.60"); dev.DeviceType != deviceTypeSpeaker {
+		t.Errorf("nest mini type = %q, want speaker", dev.DeviceType)
+	}
+}
+
+func TestDiscovery_AttributesToSenderAndKeepsMostSpecificType(t *testing.T) {
+	msg := new(dns.Msg)
+	msg.Response = true
+	for _, s := range []string{
+		`Office\ Printer._ipp._tcp.local. 120 IN SRV 0 0 631 printer.local.`,
+		`Office\ Printer._raop._tcp.local. 120 IN SRV 0 0 7000 printer.local.`,
+	} {
+		rr, _ := dns.NewRR(s)
+		msg.Answer = append(msg.Answer, rr)
+	}
+	d := newDiscovery()
+	d.handle(msg, net.ParseIP("192.168.100.70"))
+
+	dev, ok := d.lookup("192.168.100.70")
+	if !ok || dev.Name != "Office Printer" || dev.DeviceType != deviceTypePrinter {
+		t.Fatalf("got %+v, %v", dev, ok)
+	}
+
+	// Queries (ours or other hosts') are not announcements.
+	msg.Response = false
+	d = newDiscovery()
+	d.handle(msg, net.ParseIP("192.168.100.70"))
+	if _, ok := d.lookup("192.168.100.70"); ok {
+		t.Error("query recorded as a device")
+	}
+}
+
+func TestDiscovery_ForgetsSilentDevices(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	d := newDiscovery()
+	d.now = func() time.Time { return now }
+	d.handle(castResponse(t, "Chromecast"), nil)
+
+	now = now.Add(mdnsTTL + time.Minute)
+	if _, ok := d.lookup("192.168.100.60"); ok {
+		t.Error("stale device still returned")
+	}
+}
+
+func TestScanDevices_MergesMDNSNameAndType(t *testing.T) {
+	const mac, ip = "aa:bb:cc:dd:ee:01", "192.168.100.60"
+	m := &executil.Mock{}
+	m.Expect("arp -a", executil.MockResult{Output: []byte("? (" + ip + ") at " + mac + " [ether] on wlan0\n")})
+	rc := newTestRouter(t, m)
+	rc.namer.leases = map[string]string{mac: "Chromecast-3f1c"}
+	rc.namer.leasesPath = filepath.Join(t.TempDir(), "none")
+	rc.discovery.handle(castResponse(t, "Chromecast"), nil)
+
+	rc.scanDevices()
+
+	rc.mu.RLock()
+	d := rc.devices[0]
+	rc.mu.RUnlock()
+	if d.Name != "Living Room TV" || d.NameSource != nameSourceMDNS || d.DeviceType != deviceTypeTV {
+		t.Errorf("device = %q (%s) type %q", d.Name, d.NameSource, d.DeviceType)
+	}
+
+	// A nickname still wins.
+	rc.namer.nicknames[mac] = "Den TV"
+	rc.scanDevices()
+	rc.mu.RLock()
+	d = rc.devices[0]
+	rc.mu.RUnlock()
+	if d.Name != "Den TV" || d.DeviceType != deviceTypeTV {
+		t.Errorf("nicknamed device = %q type %q", d.Name, d.DeviceType)
+	}
+}
+
+func TestScanDevices_PublishesFirstSeenDevices(t *testing.T) {
+	const mac, ip = "aa:bb:cc:dd:ee:01", "192.168.100.60"
+	m := &executil.Mock{}
+	m.Expect("arp -a", executil.MockResult{Output: []byte("? (" + ip + ") at " + mac + " [ether] on wlan0\n")})
+	rc := newTestRouter(t, m)
+	bus := events.New()
+	sub := bus.Subscribe(4, events.DeviceJoined)
+	defer sub.Close()
+	rc.events = bus
+
+	rc.scanDevices()
+	rc.scanDevices() // seen before: not new
+
+	if len(sub.C) != 1 {
+		t.Fatalf("published %d events, want 1", len(sub.C))
+	}
+	if e := (<-sub.C).Payload.(NewDeviceEvent); e.MAC != mac || e.IP != ip {
+		t.Errorf("event payload = %+v", e)
+	}
+}
+
+func TestRunDiscovery_DevModeWithoutAPInterfaceReturns(t *testing.T) {
+	rc := New(Config{DataDir: t.TempDir(), DevMode: true}, &executil.Mock{},
+		wifiStub{wifi.Status{APInterface: "strct-missing0"}})
+	done := make(chan struct{})
+	go func() {
+		rc.runDiscovery(context.Background())
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("runDiscovery kept retrying in dev mode")
+	}
+}
+
+func TestSchedule_ActiveAt(t *testing.T) {
+	// 2024-06-07 is a Friday.
+	at := func(day int, clock string) time.Time {
+		c, _ := time.Parse("15:04", clock)
+		return time.Date(2024, 6, day, c.Hour(), c.Minute(), 0, 0, time.Local)
+	}
+	overnight := Schedule{Days: []string{"fri"}, BlockFrom: "21:00", BlockUntil: "07:00"}
+	daytime := Schedule{Days: []string{"mon", "fri"}, BlockFrom: "09:00", BlockUntil: "15:30"}
+
+	tests := []struct {
+		name string
+		s    Schedule
+		now  time.Time
+		want bool
+	}{
+		{"before overnight window", overnight, at(7, "20:59"), false},
+		{"overnight start", overnight, at(7, "21:00"), true},
+		{"past midnight belongs to friday", overnight, at(8, "06:59"), true},
+		{"overnight end", overnight, at(8, "07:00"), false},
+		{"thursday night not listed", overnight, at(6, "23:00"), false},
+		{"saturday night not listed", overnight, at(8, "22:00"), false},
+		{"inside daytime window", daytime, at(7, "12:00"), true},
+		{"daytime end is exclusive", daytime, at(7, "15:30"), false},
+		{"daytime on unlisted day", daytime, at(8, "12:00"), false},
+	}
+	for _, tt := range tests {
+		if got := tt.s.activeAt(tt.now); got != tt.want {
+			t.Errorf("%s: activeAt(%s) = %v, want %v", tt.name, tt.now.Format("Mon 15:04"), got, tt.want)
+		}
+	}
+}
+
+func TestHandleSetSchedule_Validates(t *testing.T) {
+	rc := newTestRouter(t, &executil.Mock{})
+	for _, body := range []string{
+		`{"mac":"nope","days":["mon"],"block_from":"21:00","block_until":"07:00"}`,
+		`{"mac":"aa:bb:cc:dd:ee:01","days":[],"block_from":"21:00","block_until":"07:00"}`,
+		`{"mac":"aa:bb:cc:dd:ee:01","days":["monday"],"block_from":"21:00","block_until":"07:00"}`,
+		`{"mac":"aa:bb:cc:dd:ee:01","days":["mon"],"block_from":"9pm","block_until":"07:00"}`,
+		`{"mac":"aa:bb:cc:dd:ee:01","days":["mon"],"block_from":"21:00","block_until":"21:00"}`,
+	} {
+		w := httptest.NewRecorder()
+		rc.handleSetSchedule(w, httptest.NewRequest("POST", "/api/router/schedule", strings.NewReader(body)))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want 400", body, w.Code)
+		}
+	}
+}
+
+func TestEnforceSchedules_BlocksDuringWindowAndPersists(t *testing.T) {
+	const mac = "aa:bb:cc:dd:ee:01"
+	m := &executil.Mock{}
+	m.Expect("iptables -t filter -C STRCT_BLOCK "+dropRule, executil.MockResult{Err: errMissing})
+	rc := newTestRouter(t, m)
+	rc.devices = []ConnectedDevice{{MAC: mac}}
+	// Friday noon, inside the window.
+	inside := time.Date(2024, 6, 7, 12, 0, 0, 0, time.Local)
+	rc.now = func() time.Time { return inside }
+
+	w := httptest.NewRecorder()
+	rc.handleSetSchedule(w, httptest.NewRequest("POST", "/api/router/schedule", strings.NewReader(
+		`{"mac":"AA:BB:CC:DD:EE:01","days":["fri"],"block_from":"08:00","block_until":"15:00"}`)))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"active":true`) {
+		t.Fatalf("set schedule: %d %s", w.Code, w.Body)
+	}
+	m.AssertCalled(t, "iptables -t filter -A STRCT_BLOCK "+dropRule)
+	if d := rc.devices[0]; !d.Blocked || d.BlockedReason != blockReasonSchedule {
+		t.Errorf("device = blocked %v reason %q, want schedule", d.Blocked, d.BlockedReason)
+	}
+
+	// The schedule and an open window survive a restart.
+	m2 := &executil.Mock{}
+	restarted := New(Config{DataDir: rc.cfg.DataDir, DevMode: true}, m2, wifiStub{})
+	if err := restarted.loadState(); err != nil {
+		t.Fatal(err)
+	}
+	if got := restarted.sortedSchedules(); len(got) != 1 || got[0].MAC != mac {
+		t.Fatalf("restored schedules = %+v", got)
+	}
+	restarted.scheduled = restarted.scheduledBlocks(inside)
+	if err := restarted.applyBlocks(); err != nil {
+		t.Fatal(err)
+	}
+	m2.AssertCalled(t, "iptables -t filter -A STRCT_BLOCK "+dropRule)
+
+	m.Expect("iptables -t filter -C STRCT_BLOCK "+dropRule, executil.MockResult{})
+	rc.enforceSchedules(time.Date(2024, 6, 7, 15, 0, 0, 0, time.Local))
+	m.AssertCalled(t, "iptables -t filter -D STRCT_BLOCK "+dropRule)
+	if d := rc.devices[0]; d.Blocked || d.BlockedReason != "" {
+		t.Errorf("device still blocked after the window: %+v", d)
+	}
+}
+
+func TestEnforceSchedules_ManualBlockWins(t *testing.T) {
+	const mac = "aa:bb:cc:dd:ee:01"
+	inside := time.Date(2024, 6, 7, 22, 0, 0, 0, time.Local)
+	after := time.Date(2024, 6, 8, 8, 0, 0, 0, time.Local)
+
+	m := &executil.Mock{}
+	rc := newTestRouter(t, m)
+	rc.schedules = []Schedule{{ID: "s1", MAC: mac, Days: []string{"fri"}, BlockFrom: "21:00", BlockUntil: "07:00"}}
+	rc.devices = []ConnectedDevice{{MAC: mac}}
+
+	// Manually blocked when the window ends: the rule stays.
+	rc.blockedMACs[mac] = true
+	rc.enforceSchedules(inside)
+	rc.enforceSchedules(after)
+	m.AssertNotCalled(t, "iptables -t filter -D STRCT_BLOCK "+dropRule)
+
+	// Manual unblock during an open window keeps the schedule's block.
+	rc.enforceSchedules(inside)
+	if w := postBlock(t, rc, `{"mac":"aa:bb:cc:dd:ee:01","block":false}`); w.Code != http.StatusOK {
+		t.Fatalf("unblock: %d", w.Code)
+	}
+	m.AssertNotCalled(t, "iptables -t filter -D STRCT_BLOCK "+dropRule)
+	if d := rc.devices[0]; !d.Blocked || d.BlockedReason != blockReasonSchedule {
+		t.Errorf("device = blocked %v reason %q, want schedule", d.Blocked, d.BlockedReason)
+	}
+
+	// …until the window closes.
+	rc.enforceSchedules(after)
+	m.AssertCalled(t, "iptables -t filter -D STRCT_BLOCK "+dropRule)
+}
+
+func TestHandleRemoveSchedule(t *testing.T) {
+	rc := newTestRouter(t, &executil.Mock{})
+	rc.schedules = []Schedule{{ID: "s1", MAC: "aa:bb:cc:dd:ee:01", Days: []string{"mon"}, BlockFrom: "21:00", BlockUntil: "07:00"}}
+
+	del := func(body string) int {
+		w := httptest.NewRecorder()
+		rc.handleRemoveSchedule(w, httptest.NewRequest("DELETE", "/api/router/schedule", strings.NewReader(body)))
+		return w.Code
+	}
+	if code := del(`{"id":"s1"}`); code != http.StatusNoContent {
+		t.Errorf("delete: got %d, want 204", code)
+	}
+	if code := del(`{"id":"s1"}`); code != http.StatusNotFound {
+		t.Errorf("second delete: got %d, want 404", code)
+	}
+}
+
+func TestWakeSchedule_DueAt(t *testing.T) {
+	s := WakeSchedule{MAC: "AA:BB:CC:DD:EE:01", Days: []string{"Mon", "fri"}, At: "08:50"}
+	if err := s.validate(); err != nil || s.MAC != "aa:bb:cc:dd:ee:01" || s.Days[0] != "mon" {
+		t.Fatalf("validate = %v, %+v", err, s)
+	}
+	// 2024-06-07 is a Friday.
+	tests := []struct {
+		when string
+		want bool
+	}{
+		{"2024-06-07 08:49", false},
+		{"2024-06-07 08:50", true},
+		{"2024-06-07 08:54", true}, // a late tick still fires
+		{"2024-06-07 08:55", false},
+		{"2024-06-08 08:50", false}, // Saturday
+	}
+	for _, tt := range tests {
+		now, _ := time.ParseInLocation("2006-01-02 15:04", tt.when, time.Local)
+		if got := s.dueAt(now); got != tt.want {
+			t.Errorf("dueAt(%s) = %v, want %v", tt.when, got, tt.want)
+		}
+	}
+
+	for _, bad := range []WakeSchedule{
+		{MAC: "nope", Days: []string{"mon"}, At: "08:50"},
+		{MAC: "aa:bb:cc:dd:ee:01", At: "08:50"},
+		{MAC: "aa:bb:cc:dd:ee:01", Days: []string{"someday"}, At: "08:50"},
+		{MAC: "aa:bb:cc:dd:ee:01", Days: []string{"mon"}, At: "8.50am"},
+	} {
+		if err := bad.validate(); err == nil {
+			t.Errorf("validate(%+v) = nil, want an error", bad)
+		}
+	}
+}
+
+// fastWakeChecks makes a wake attempt probe once and give up.
+func fastWakeChecks(t *testing.T) {
+	window, every := wakeVerifyWindow, wakeProbeEvery
+	wakeVerifyWindow, wakeProbeEvery = 0, 0
+	t.Cleanup(func() { wakeVerifyWindow, wakeProbeEvery = window, every })
+}
+
+func TestRunWakeSchedules_FiresOnceADayAndVerifies(t *testing.T) {
+	fastWakeChecks(t)
+	rc := newTestRouter(t, &executil.Mock{})
+	rc.devices = []ConnectedDevice{{MAC: "aa:bb:cc:dd:ee:01", IP: "192.168.100.50"}}
+	var sent int
+	var mu sync.Mutex
+	rc.sendWake = func(string, []byte) error { mu.Lock(); sent++; mu.Unlock(); return nil }
+	var probed []string
+	rc.probe = func(ip string, port int) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		probed = append(probed, ip+":"+strconv.Itoa(port))
+		return true
+	}
+	rc.tracked["aa:bb:cc:dd:ee:01"] = PowerTrack{MAC: "aa:bb:cc:dd:ee:01", Port: 3389}
+
+	w := httptest.NewRecorder()
+	rc.handleSetWakeSchedule(w, httptest.NewRequest("POST", "/api/router/wake-schedules", strings.NewReader(
+		`{"mac":"AA:BB:CC:DD:EE:01","days":["mon","tue","wed","thu","fri"],"at":"08:50"}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("set wake schedule: %d %s", w.Code, w.Body)
+	}
+
+	friday := time.Date(2024, 6, 7, 8, 50, 0, 0, time.Local)
+	rc.runWakeSchedules(friday)
+	rc.runWakeSchedules(friday.Add(time.Minute)) // same day: already fired
+	rc.verifying.Wait()
+	if sent != 1 || fmt.Sprint(probed) != "[192.168.100.50:3389]" {
+		t.Fatalf("sent %d packets, probed %v; want one packet and a probe of the tracked port", sent, probed)
+	}
+	rc.runWakeSchedules(friday.AddDate(0, 0, 3)) // Monday
+	rc.verifying.Wait()
+	if sent != 2 {
+		t.Errorf("Monday: %d packets in all, want 2", sent)
+	}
+
+	events := rc.history.wakesSince(time.Time{}, "aa:bb:cc:dd:ee:01")
+	if len(events) != 2 || events[0].Result != wakeResultSuccess || events[0].Trigger != wakeTriggerSchedule || events[0].ScheduleID == "" {
+		t.Errorf("wake events = %+v", events)
+	}
+
+	// Schedules survive a restart.
+	restarted := New(Config{DataDir: rc.cfg.DataDir, DevMode: true}, &executil.Mock{}, wifiStub{})
+	if err := restarted.loadState(); err != nil {
+		t.Fatal(err)
+	}
+	if got := restarted.sortedWakeSchedules(); len(got) != 1 || got[0].At != "08:50" {
+		t.Errorf("restored wake schedules = %+v", got)
+	}
+	if _, ok := restarted.tracked["aa:bb:cc:dd:ee:01"]; !ok {
+		t.Error("power tracking not restored")
+	}
+}
+
+func TestWake_RetriesThenRecordsFailure(t *testing.T) {
+	fastWakeChecks(t)
+	rc := newTestRouter(t, &executil.Mock{})
+	rc.devices = []ConnectedDevice{{MAC: "aa:bb:cc:dd:ee:01", IP: "192.168.100.50"}}
+	sent := 0
+	rc.sendWake = func(string, []byte) error { sent++; return nil }
+	rc.probe = func(string, int) bool { return false }
+
+	if w := postWake(rc, `{"mac":"AA:BB:CC:DD:EE:01"}`); w.Code != http.StatusOK {
+		t.Fatalf("wake: %d %s", w.Code, w.Body)
+	}
+	rc.verifying.Wait()
+	if sent != wakeAttempts {
+		t.Errorf("sent %d packets, want %d", sent, wakeAttempts)
+	}
+
+	w := httptest.NewRecorder()
+	rc.handleWakeEvents(w, httptest.NewRequest("GET", "/api/router/wake-events?mac=aa:bb:cc:dd:ee:01", nil))
+	var events []WakeEvent
+	if err := json.Unmarshal(w.Body.Bytes(), &events); err != nil {
+		t.Fatalf("decode %s: %v", w.Body, err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("events = %+v", events)
+	}
+	if e := events[0]; e.Result != wakeResultFailure || e.Attempts != wakeAttempts || e.IP != "192.168.100.50" ||
+		e.Trigger != wakeTriggerManual || e.Error == "" || e.FinishedAt.IsZero() {
+		t.Errorf("event = %+v", e)
+	}
+}
+
+func TestInferPower(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	answered := powerObs{probedAt: now, answeredAt: now}
+	failing := powerObs{probedAt: now, answeredAt: now.Add(-time.Hour), fails: powerFailsAsleep}
+	silent := powerObs{probedAt: now, fails: 1} // never answered
+	tests := []struct {
+		name          string
+		o             powerObs
+		inARP, leased bool
+		lastSeen      time.Time
+		want          string
+	}{
+		{"not probed yet", powerObs{}, true, true, now, powerUnknown},
+		{"answers", answered, true, true, now, powerAwake},
+		{"stopped answering", failing, true, true, now, powerAsleep},
+		{"one miss", powerObs{probedAt: now, answeredAt: now, fails: 1}, true, true, now, powerUnknown},
+		{"never answered but around", silent, true, true, now, powerUnknown},
+		{"gone from ARP, lease held", silent, false, true, now.Add(-powerGoneAfter), powerAsleep},
+		{"gone from ARP, no lease", silent, false, false, now.Add(-powerGoneAfter), powerUnknown},
+		{"just left ARP", silent, false, true, now.Add(-time.Second), powerUnknown},
+	}
+	for _, tt := range tests {
+		if got := inferPower(tt.o, tt.inARP, tt.leased, tt.lastSeen, now); got != tt.want {
+			t.Errorf("%s: %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestScanDevices_KeepsSleepingTrackedDevices(t *testing.T) {
+	const desktop = "aa:bb:cc:dd:ee:01"
+	m := &executil.Mock{}
+	m.Expect("arp -a", executil.MockResult{Output: []byte("? (192.168.100.50) at " + desktop + " [ether] on wlan0\n")})
+	rc := newTestRouter(t, m)
+	rc.namer.leasesPath = filepath.Join(rc.cfg.DataDir, "dnsmasq.leases")
+	os.WriteFile(rc.namer.leasesPath, []byte("0 "+desktop+" 192.168.100.50 desktop *\n"), 0644) //nolint:errcheck
+	up := true
+	rc.probe = func(string, int) bool { return up }
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/api/router/devices/"+desktop+"/power", strings.NewReader(`{"track":true}`))
+	r.SetPathValue("mac", desktop)
+	rc.handleSetPowerTracking(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("track: %d %s", w.Code, w.Body)
+	}
+	rc.scanDevices()
+	rc.probeTracked()
+	if d := rc.devices[0]; d.Power != powerAwake {
+		t.Fatalf("answering desktop = %+v, want awake", d)
+	}
+
+	// It goes to sleep: out of the ARP table, silent to probes.
+	up = false
+	m.Expect("arp -a", executil.MockResult{Output: []byte{}})
+	rc.scanDevices()
+	for range powerFailsAsleep {
+		rc.probeTracked()
+	}
+	if len(rc.devices) != 1 {
+		t.Fatalf("devices = %+v, want the sleeping desktop still listed", rc.devices)
+	}
+	if d := rc.devices[0]; d.MAC != desktop || d.IP != "192.168.100.50" || d.Power != powerAsleep {
+		t.Errorf("sleeping desktop = %+v", d)
+	}
+
+	// Untracked devices carry no power state.
+	r = httptest.NewRequest("POST", "/api/router/devices/"+desktop+"/power", strings.NewReader(`{"track":false}`))
+	r.SetPathValue("mac", desktop)
+	rc.handleSetPowerTracking(httptest.NewRecorder(), r)
+	rc.scanDevices()
+	if len(rc.devices) != 0 {
+		t.Errorf("untracked, absent desktop still listed: %+v", rc.devices)
+	}
+}
@@ -0,0 +1,287 @@
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/strct-org/strct-agent/internal/httputil"
+)
+
+// Parental-control schedules. A schedule blocks a device's internet
+// access between BlockFrom and BlockUntil (local time) on the listed days,
+// with the same STRCT_BLOCK DROP rule a manual block uses. A window whose
+// end is before its start runs past midnight; its day is the day it
+// starts, so {"days":["fri"],"block_from":"21:00","block_until":"07:00"}
+// covers Friday night through Saturday morning.
+//
+// Manual blocks win: a device blocked by hand stays blocked when a window
+// ends, and unblocking it by hand during a window leaves the schedule's
+// block in place.
+const scheduleInterval = time.Minute
+
+// Reasons reported in ConnectedDevice.BlockedReason.
+const (
+	blockReasonManual   = "manual"
+	blockReasonSchedule = "schedule"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+type Schedule struct {
+	ID         string   `json:"id"`
+	MAC        string   `json:"mac"`
+	Days       []string `json:"days"`        // mon|tue|wed|thu|fri|sat|sun
+	BlockFrom  string   `json:"block_from"`  // "21:00"
+	BlockUntil string   `json:"block_until"` // "07:00"; earlier than block_from means the next day
+}
+
+// validate normalises s in place.
+func (s *Schedule) validate() error {
+	if !validMAC(s.MAC) {
+		return fmt.Errorf("invalid MAC address")
+	}
+	s.MAC = strings.ToLower(s.MAC)
+	if len(s.Days) == 0 {
+		return fmt.Errorf("days must list at least one of mon, tue, wed, thu, fri, sat, sun")
+	}
+	for i, d := range s.Days {
+		d = strings.ToLower(d)
+		if _, ok := weekdays[d]; !ok {
+			return fmt.Errorf("unknown day %q", s.Days[i])
+		}
+		s.Days[i] = d
+	}
+	from, err := clockMinutes(s.BlockFrom)
+	if err != nil {
+		return fmt.Errorf("block_from: %w", err)
+	}
+	until, err := clockMinutes(s.BlockUntil)
+	if err != nil {
+		return fmt.Errorf("block_until: %w", err)
+	}
+	if from == until {
+		return fmt.Errorf("block_from and block_until must differ")
+	}
+	return nil
+}
+
+// clockMinutes parses "HH:MM" into minutes since midnight.
+func clockMinutes(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (s Schedule) hasDay(d time.Weekday) bool {
+	for _, name := range s.Days {
+		if weekdays[name] == d {
+			return true
+		}
+	}
+	return false
+}
+
+// activeAt reports whether now falls inside one of s's windows.
+func (s Schedule) activeAt(now time.Time) bool {
+	from, err1 := clockMinutes(s.BlockFrom)
+	until, err2 := clockMinutes(s.BlockUntil)
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	minute := now.Hour()*60 + now.Minute()
+	today := now.Weekday()
+	if from < until {
+		return s.hasDay(today) && minute >= from && minute < until
+	}
+	// Overnight: the evening part belongs to today, the morning part to
+	// yesterday's window.
+	yesterday := (today + 6) % 7
+	return (s.hasDay(today) && minute >= from) || (s.hasDay(yesterday) && minute < until)
+}
+
+// scheduledBlocks returns the MACs some schedule blocks at now.
+func (rc *RouterController) scheduledBlocks(now time.Time) map[string]bool {
+	rc.mu.RLock()
+	defer rc.mu.RUnlock()
+	active := make(map[string]bool)
+	for _, s := range rc.schedules {
+		if s.activeAt(now) {
+			active[s.MAC] = true
+		}
+	}
+	return active
+}
+
+// enforceSchedules brings STRCT_BLOCK in line with the schedules at now,
+// leaving manually blocked MACs alone. iptables runs outside the lock.
+func (rc *RouterController) enforceSchedules(now time.Time) {
+	active := rc.scheduledBlocks(now)
+
+	rc.mu.Lock()
+	var start, end []string
+	for mac := range active {
+		if !rc.scheduled[mac] && !rc.blockedMACs[mac] {
+			start = append(start, mac)
+		}
+	}
+	for mac := range rc.scheduled {
+		if !active[mac] && !rc.blockedMACs[mac] {
+			end = append(end, mac)
+		}
+	}
+	rc.scheduled = active
+	rc.mu.Unlock()
+	sort.Strings(start)
+	sort.Strings(end)
+
+	for _, mac := range start {
+		if err := rc.blockMAC(mac); err != nil {
+			slog.Error("router: scheduled block failed", "mac", mac, "err", err)
+			continue
+		}
+		slog.Info("router: schedule window started", "mac", mac)
+	}
+	for _, mac := range end {
+		if err := rc.unblockMAC(mac); err != nil {
+			slog.Error("router: scheduled unblock failed", "mac", mac, "err", err)
+			continue
+		}
+		slog.Info("router: schedule window ended", "mac", mac)
+	}
+	if len(start)+len(end) > 0 {
+		rc.refreshBlockedDevices()
+	}
+}
+
+// blockReasons returns every blocked MAC with why it is blocked.
+func (rc *RouterController) blockReasons() map[string]string {
+	rc.mu.RLock()
+	defer rc.mu.RUnlock()
+	reasons := make(map[string]string, len(rc.blockedMACs)+len(rc.scheduled))
+	for mac := range rc.scheduled {
+		reasons[mac] = blockReasonSchedule
+	}
+	for mac := range rc.blockedMACs {
+		reasons[mac] = blockReasonManual
+	}
+	return reasons
+}
+
+// refreshBlockedDevices updates the cached device list's block flags
+// without waiting for a scan.
+func (rc *RouterController) refreshBlockedDevices() {
+	reasons := rc.blockReasons()
+	rc.mu.Lock()
+	for i := range rc.devices {
+		reason := reasons[rc.devices[i].MAC]
+		rc.devices[i].Blocked = reason != ""
+		rc.devices[i].BlockedReason = reason
+	}
+	rc.mu.Unlock()
+}
+
+func (rc *RouterController) sortedSchedules() []Schedule {
+	rc.mu.RLock()
+	out := make([]Schedule, len(rc.schedules))
+	copy(out, rc.schedules)
+	rc.mu.RUnlock()
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].MAC != out[j].MAC {
+			return out[i].MAC < out[j].MAC
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out
+}
+
+func (rc *RouterController) handleGetSchedules(w http.ResponseWriter, r *http.Request) {
+	httputil.OK(w, rc.sortedSchedules())
+}
+
+// handleSetSchedule adds a schedule, or replaces the one with the same id.
+// POST body: {"mac":"XX:XX:XX:XX:XX:XX","days":["mon","tue"],"block_from":"21:00","block_until":"07:00"}
+func (rc *RouterController) handleSetSchedule(w http.ResponseWriter, r *http.Request) {
+	var req Schedule
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httputil.BadRequest(w, "invalid JSON")
+		return
+	}
+	if err := req.validate(); err != nil {
+		httputil.BadRequest(w, err.Error())
+		return
+	}
+
+	rc.mu.Lock()
+	replaced := false
+	if req.ID != "" {
+		for i := range rc.schedules {
+			if rc.schedules[i].ID == req.ID {
+				rc.schedules[i] = req
+				replaced = true
+			}
+		}
+	}
+	if !replaced {
+		if req.ID != "" {
+			rc.mu.Unlock()
+			httputil.Error(w, http.StatusNotFound, "no schedule "+req.ID)
+			return
+		}
+		req.ID = uuid.NewString()
+		rc.schedules = append(rc.schedules, req)
+	}
+	rc.mu.Unlock()
+
+	rc.saveSchedulesAndEnforce()
+	httputil.OK(w, map[string]any{"schedule": req, "active": req.activeAt(rc.now())})
+}
+
+// handleRemoveSchedule deletes a schedule. A window in progress ends now.
+// DELETE body: {"id":"…"}
+func (rc *RouterController) handleRemoveSchedule(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httputil.BadRequest(w, "invalid JSON")
+		return
+	}
+
+	rc.mu.Lock()
+	kept := rc.schedules[:0]
+	found := false
+	for _, s := range rc.schedules {
+		if s.ID == req.ID {
+			found = true
+			continue
+		}
+		kept = append(kept, s)
+	}
+	rc.schedules = kept
+	rc.mu.Unlock()
+
+	if !found {
+		httputil.Error(w, http.StatusNotFound, "no schedule "+req.ID)
+		return
+	}
+	rc.saveSchedulesAndEnforce()
+	httputil.NoContent(w)
+}
+
+func (rc *RouterController) saveSchedulesAndEnforce() {
+	if err := rc.saveState(); err != nil {
+		slog.Error("router: could not persist state", "err", err)
+	}
+	rc.enforceSchedules(rc.now())
+}
@@ -0,0 +1,125 @@
+package router
+
+import (
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"strings"
+
+	"github.com/strct-org/strct-agent/internal/statefile"
+)
+
+// Schemas for the files router persists under DataDir. Each list grows by
+// one migration whenever that file's shape changes.
+var (
+	// v1: persistedState as-is
+	stateSchema = statefile.Schema{
+		Name:       "router-state",
+		Migrations: []statefile.Migration{statefile.Stamp},
+	}
+	// v1: the bare MAC → nickname map moved under "names"
+	namesSchema = statefile.Schema{
+		Name:       "device-names",
+		Migrations: []statefile.Migration{statefile.Wrap("names")},
+	}
+	// v1: persistedHistory as-is
+	historySchema = statefile.Schema{
+		Name:       "device-history",
+		Migrations: []statefile.Migration{statefile.Stamp},
+	}
+	// v1: persistedTraffic as-is
+	trafficSchema = statefile.Schema{
+		Name:       "traffic",
+		Migrations: []statefile.Migration{statefile.Stamp},
+	}
+)
+
+// persistedState is the on-disk shape of $DATA_DIR/router.json. Only the
+// runtime state the user builds up through the API lives here — the rest
+// of RouterConfig is re-sent by the dashboard on every save.
+type persistedState struct {
+	PortRules   []PortRule     `json:"port_rules"`
+	Limits      []DeviceLimit  `json:"limits"`
+	BlockedMACs []string       `json:"blocked_macs"`
+	Schedules   []Schedule     `json:"schedules"`
+	Wakes       []WakeSchedule `json:"wake_schedules"`
+	Tracked     []PowerTrack   `json:"power_tracked"`
+}
+
+func (rc *RouterController) statePath() string {
+	return filepath.Join(rc.cfg.DataDir, "router.json")
+}
+
+// loadState restores persisted state into rc. A missing file is the normal
+// first-boot case and not an error.
+func (rc *RouterController) loadState() error {
+	var ps persistedState
+	if err := statefile.Load(rc.statePath(), stateSchema, &ps); err != nil {
+		if statefile.Fresh(err) {
+			return nil
+		}
+		return fmt.Errorf("load router state: %w", err)
+	}
+
+	rc.mu.Lock()
+	if ps.PortRules != nil {
+		rc.state.PortRules = ps.PortRules
+	}
+	for _, l := range ps.Limits {
+		rc.limits[l.MAC] = l
+	}
+	for _, mac := range ps.BlockedMACs {
+		rc.blockedMACs[strings.ToLower(mac)] = true
+	}
+	for _, s := range ps.Schedules {
+		if err := s.validate(); err != nil {
+			slog.Warn("router: dropping invalid schedule", "id", s.ID, "err", err)
+			continue
+		}
+		rc.schedules = append(rc.schedules, s)
+	}
+	for _, s := range ps.Wakes {
+		if err := s.validate(); err != nil {
+			slog.Warn("router: dropping invalid wake schedule", "id", s.ID, "err", err)
+			continue
+		}
+		rc.wakeSched = append(rc.wakeSched, s)
+	}
+	for _, t := range ps.Tracked {
+		if validMAC(t.MAC) {
+			t.MAC = strings.ToLower(t.MAC)
+			rc.tracked[t.MAC] = t
+		}
+	}
+	rc.mu.Unlock()
+
+	slog.Info("router: state restored", "path", rc.statePath(),
+		"port_rules", len(ps.PortRules), "limits", len(ps.Limits), "blocked", len(ps.BlockedMACs), "schedules", len(ps.Schedules),
+		"wake_schedules", len(ps.Wakes), "power_tracked", len(ps.Tracked))
+	return nil
+}
+
+// saveState writes the current persisted subset of rc to disk.
+func (rc *RouterController) saveState() error {
+	limits := rc.sortedLimits()
+	blocked := rc.sortedBlocked()
+	schedules := rc.sortedSchedules()
+	wakes := rc.sortedWakeSchedules()
+	tracked := rc.sortedTracked()
+
+	rc.mu.RLock()
+	ps := persistedState{
+		PortRules:   rc.state.PortRules,
+		Limits:      limits,
+		BlockedMACs: blocked,
+		Schedules:   schedules,
+		Wakes:       wakes,
+		Tracked:     tracked,
+	}
+	rc.mu.RUnlock()
+
+	if err := statefile.Save(rc.statePath(), stateSchema, ps); err != nil {
+		return fmt.Errorf("save router state: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,402 @@
+package router
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/httputil"
+	"github.com/strct-org/strct-agent/internal/platform/firewall"
+	"github.com/strct-org/strct-agent/internal/statefile"
+)
+
+// acctChain holds one RETURN rule per device IP and direction. The rules
+// never change a packet's fate; they exist for their byte counters.
+//
+//	iptables -t filter -A STRCT_ACCT -s IP -m comment --comment strct-acct:MAC -j RETURN  (tx)
+//	iptables -t filter -A STRCT_ACCT -d IP -m comment --comment strct-acct:MAC -j RETURN  (rx)
+const (
+	acctChain          = "STRCT_ACCT"
+	acctCommentPrefix  = "strct-acct:"
+	acctSampleInterval = time.Minute
+	acctRetentionDays  = 31
+	dayLayout          = "2006-01-02"
+)
+
+// DeviceUsage is one device's traffic over a period. Rx is what the
+// device downloaded, Tx what it uploaded.
+type DeviceUsage struct {
+	MAC     string `json:"mac"`
+	Name    string `json:"name,omitempty"`
+	RxBytes uint64 `json:"rx_bytes"`
+	TxBytes uint64 `json:"tx_bytes"`
+}
+
+type dayUsage struct {
+	RxBytes uint64 `json:"rx_bytes"`
+	TxBytes uint64 `json:"tx_bytes"`
+}
+
+// persistedTraffic keeps daily totals and the kernel counters they were
+// last brought up to date with. Saving both together is what lets a
+// restarted agent pick up the bytes counted while it was down.
+type persistedTraffic struct {
+	Days   map[string]map[string]dayUsage `json:"days"`   // local date → MAC
+	Kernel map[string]uint64              `json:"kernel"` // acctCounter.key() → bytes
+}
+
+// acctCounter is one STRCT_ACCT rule's reading.
+type acctCounter struct {
+	MAC   string
+	IP    string
+	Rx    bool
+	Bytes uint64
+}
+
+func (c acctCounter) key() string {
+	dir := "tx"
+	if c.Rx {
+		dir = "rx"
+	}
+	return c.MAC + "|" + c.IP + "|" + dir
+}
+
+func acctRules(mac, ip string) (tx, rx []string) {
+	comment := []string{"-m", "comment", "--comment", acctCommentPrefix + mac, "-j", "RETURN"}
+	tx = append([]string{"-s", ip}, comment...)
+	rx = append([]string{"-d", ip}, comment...)
+	return tx, rx
+}
+
+// parseAcctCounters reads `iptables -L STRCT_ACCT -v -x -n`:
+//
+//	pkts  bytes target prot opt in out source          destination
+//	  12   3400 RETURN all  --  *  *   192.168.100.50  0.0.0.0/0    /* strct-acct:aa:bb:cc:dd:ee:ff */
+func parseAcctCounters(out []byte) []acctCounter {
+	var counters []acctCounter
+	for _, line := range strings.Split(string(out), "\n") {
+		f := strings.Fields(line)
+		if len(f) < 9 || f[2] != "RETURN" {
+			continue
+		}
+		i := strings.Index(line, "/* "+acctCommentPrefix)
+		if i < 0 {
+			continue
+		}
+		rest := strings.Fields(line[i+3+len(acctCommentPrefix):])
+		if len(rest) == 0 {
+			continue
+		}
+		mac := rest[0]
+		bytes, err := strconv.ParseUint(f[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		c := acctCounter{MAC: mac, Bytes: bytes}
+		switch src, dst := f[7], f[8]; {
+		case src != "0.0.0.0/0":
+			c.IP = src
+		case dst != "0.0.0.0/0":
+			c.IP, c.Rx = dst, true
+		default:
+			continue
+		}
+		counters = append(counters, c)
+	}
+	return counters
+}
+
+// trafficMeter turns kernel counter readings into per-device daily totals.
+type trafficMeter struct {
+	mu        sync.Mutex
+	path      string
+	days      map[string]map[string]*dayUsage
+	kernel    map[string]uint64
+	installed map[string]string // MAC → IP whose rules are in STRCT_ACCT
+	saved     time.Time
+	now       func() time.Time
+}
+
+func newTrafficMeter(dataDir string) *trafficMeter {
+	return &trafficMeter{
+		path:      filepath.Join(dataDir, "traffic.json"),
+		days:      make(map[string]map[string]*dayUsage),
+		kernel:    make(map[string]uint64),
+		installed: make(map[string]string),
+		now:       time.Now,
+	}
+}
+
+func (t *trafficMeter) load() error {
+	var pt persistedTraffic
+	if err := statefile.Load(t.path, trafficSchema, &pt); err != nil {
+		if statefile.Fresh(err) {
+			return nil
+		}
+		return fmt.Errorf("load traffic: %w", err)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for day, devices := range pt.Days {
+		t.days[day] = make(map[string]*dayUsage, len(devices))
+		for mac, u := range devices {
+			u := u
+			t.days[day][mac] = &u
+		}
+	}
+	if pt.Kernel != nil {
+		t.kernel = pt.Kernel
+	}
+	return nil
+}
+
+// record adds what each counter moved since the last reading to today.
+// A counter smaller than last time was reset (reboot, chain rebuilt) and
+// counts in full, as does a rule never read before.
+func (t *trafficMeter) record(counters []acctCounter) {
+	t.mu.Lock()
+	now := t.now()
+	today := t.dayLocked(now.Format(dayLayout))
+	kernel := make(map[string]uint64, len(counters))
+	for _, c := range counters {
+		delta := c.Bytes
+		if prev, ok := t.kernel[c.key()]; ok && c.Bytes >= prev {
+			delta = c.Bytes - prev
+		}
+		kernel[c.key()] = c.Bytes
+		if delta == 0 {
+			continue
+		}
+		u := today[c.MAC]
+		if u == nil {
+			u = &dayUsage{}
+			today[c.MAC] = u
+		}
+		if c.Rx {
+			u.RxBytes += delta
+		} else {
+			u.TxBytes += delta
+		}
+	}
+	t.kernel = kernel
+	t.pruneLocked(now)
+
+	// Totals and kernel readings are saved together, so skipping saves
+	// loses nothing across an agent restart — only across a reboot.
+	var snapshot *persistedTraffic
+	if now.Sub(t.saved) >= historySaveInterval {
+		t.saved = now
+		snapshot = t.snapshotLocked()
+	}
+	t.mu.Unlock()
+
+	if snapshot != nil {
+		t.save(snapshot)
+	}
+}
+
+// reset forgets installed rules and kernel readings after STRCT_ACCT was
+// flushed: the rules come back with zeroed counters.
+func (t *trafficMeter) reset() {
+	t.mu.Lock()
+	t.kernel = make(map[string]uint64)
+	t.installed = make(map[string]string)
+	t.saved = t.now()
+	snapshot := t.snapshotLocked()
+	t.mu.Unlock()
+	t.save(snapshot)
+}
+
+func (t *trafficMeter) save(snapshot *persistedTraffic) {
+	if err := statefile.Save(t.path, trafficSchema, snapshot); err != nil {
+		slog.Warn("router: could not persist traffic counters", "err", err)
+	}
+}
+
+func (t *trafficMeter) dayLocked(day string) map[string]*dayUsage {
+	d, ok := t.days[day]
+	if !ok {
+		d = make(map[string]*dayUsage)
+		t.days[day] = d
+	}
+	return d
+}
+
+func (t *trafficMeter) pruneLocked(now time.Time) {
+	oldest := now.AddDate(0, 0, -(acctRetentionDays - 1)).Format(dayLayout)
+	for day := range t.days {
+		if day < oldest {
+			delete(t.days, day)
+		}
+	}
+}
+
+func (t *trafficMeter) snapshotLocked() *persistedTraffic {
+	pt := &persistedTraffic{
+		Days:   make(map[string]map[string]dayUsage, len(t.days)),
+		Kernel: make(map[string]uint64, len(t.kernel)),
+	}
+	for day, devices := range t.days {
+		pt.Days[day] = make(map[string]dayUsage, len(devices))
+		for mac, u := range devices {
+			pt.Days[day][mac] = *u
+		}
+	}
+	for k, v := range t.kernel {
+		pt.Kernel[k] = v
+	}
+	return pt
+}
+
+// today returns mac's usage for the current local day.
+func (t *trafficMeter) today(mac string) dayUsage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if u := t.days[t.now().Format(dayLayout)][mac]; u != nil {
+		return *u
+	}
+	return dayUsage{}
+}
+
+// usageSince sums the last days local days, today included, per MAC.
+func (t *trafficMeter) usageSince(days int) map[string]dayUsage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	out := make(map[string]dayUsage)
+	for i := 0; i < days; i++ {
+		for mac, u := range t.days[now.AddDate(0, 0, -i).Format(dayLayout)] {
+			sum := out[mac]
+			sum.RxBytes += u.RxBytes
+			sum.TxBytes += u.TxBytes
+			out[mac] = sum
+		}
+	}
+	return out
+}
+
+// needsRules returns the devices whose current IP has no counting rules.
+func (t *trafficMeter) needsRules(devices []ConnectedDevice) []ConnectedDevice {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var out []ConnectedDevice
+	for _, d := range devices {
+		if t.installed[d.MAC] != d.IP {
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+func (t *trafficMeter) markInstalled(mac, ip string) {
+	t.mu.Lock()
+	t.installed[mac] = ip
+	t.mu.Unlock()
+}
+
+// ─── iptables (run OUTSIDE any mutex) ────────────────────────────────────────
+
+// installAcctRules adds counting rules for devices seen with a new IP.
+// Rules for a MAC's previous IP stay until the next rebuild and keep
+// counting towards the same MAC.
+func (rc *RouterController) installAcctRules(devices []ConnectedDevice) {
+	pending := rc.traffic.needsRules(devices)
+	if len(pending) == 0 {
+		return
+	}
+	if err := firewall.EnsureChain(rc.cmd, "filter", acctChain, "FORWARD"); err != nil {
+		slog.Warn("router: could not create accounting chain", "err", err)
+		return
+	}
+	for _, d := range pending {
+		tx, rx := acctRules(d.MAC, d.IP)
+		if err := firewall.EnsureRule(rc.cmd, "filter", acctChain, tx...); err != nil {
+			slog.Warn("router: could not add accounting rule", "mac", d.MAC, "err", err)
+			continue
+		}
+		if err := firewall.EnsureRule(rc.cmd, "filter", acctChain, rx...); err != nil {
+			slog.Warn("router: could not add accounting rule", "mac", d.MAC, "err", err)
+			continue
+		}
+		rc.traffic.markInstalled(d.MAC, d.IP)
+	}
+}
+
+// sampleTraffic reads STRCT_ACCT's counters into the meter.
+func (rc *RouterController) sampleTraffic() {
+	out, err := rc.cmd.Output("iptables", "-t", "filter", "-L", acctChain, "-v", "-x", "-n")
+	if err != nil {
+		slog.Debug("router: accounting counters unavailable", "err", err)
+		return
+	}
+	rc.traffic.record(parseAcctCounters(out))
+}
+
+// applyAccounting rebuilds STRCT_ACCT for the devices last scanned — on
+// start, and after applyFirewall's flush. Counters must be sampled before
+// the flush; they restart from zero.
+func (rc *RouterController) applyAccounting() error {
+	if err := firewall.EnsureChain(rc.cmd, "filter", acctChain, "FORWARD"); err != nil {
+		return fmt.Errorf("%s chain: %w", acctChain, err)
+	}
+	firewall.FlushChain(rc.cmd, "filter", acctChain) //nolint:errcheck
+	rc.traffic.reset()
+
+	rc.mu.RLock()
+	devices := append([]ConnectedDevice(nil), rc.devices...)
+	rc.mu.RUnlock()
+	rc.installAcctRules(devices)
+	return nil
+}
+
+// ─── HTTP ────────────────────────────────────────────────────────────────────
+
+// usagePeriods maps ?period= to a number of local days, today included.
+var usagePeriods = map[string]int{"today": 1, "7d": 7}
+
+// handleDeviceUsage reports per-device traffic, heaviest first.
+// GET /api/router/devices/usage?period=today|7d
+func (rc *RouterController) handleDeviceUsage(w http.ResponseWriter, r *http.Request) {
+	period := r.URL.Query().Get("period")
+	if period == "" {
+		period = "today"
+	}
+	days, ok := usagePeriods[period]
+	if !ok {
+		httputil.BadRequest(w, "period must be today or 7d")
+		return
+	}
+
+	names := make(map[string]string)
+	rc.history.mu.Lock()
+	for mac, d := range rc.history.devices {
+		names[mac] = d.Name
+	}
+	rc.history.mu.Unlock()
+
+	totals := rc.traffic.usageSince(days)
+	devices := make([]DeviceUsage, 0, len(totals))
+	for mac, u := range totals {
+		devices = append(devices, DeviceUsage{MAC: mac, Name: names[mac], RxBytes: u.RxBytes, TxBytes: u.TxBytes})
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		a, b := devices[i].RxBytes+devices[i].TxBytes, devices[j].RxBytes+devices[j].TxBytes
+		if a != b {
+			return a > b
+		}
+		return devices[i].MAC < devices[j].MAC
+	})
+
+	now := rc.traffic.now()
+	httputil.OK(w, map[string]any{
+		"period":  period,
+		"since":   now.AddDate(0, 0, -(days - 1)).Format(dayLayout),
+		"devices": devices,
+	})
+}
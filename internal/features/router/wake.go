@@ -0,0 +1,260 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/httputil"
+)
+
+// Wake-on-LAN. The magic packet is 6×0xFF followed by the target MAC
+// repeated 16 times, broadcast over UDP to the AP subnet:
+//
+//	192.168.100.255:9
+const (
+	wakePort   = 9 // discard; what most NICs and WoL tools use
+	wakeBurst  = 5 // requests allowed per wakeWindow
+	wakeWindow = time.Minute
+)
+
+// magicPacket builds the 102-byte WoL payload for mac.
+func magicPacket(mac net.HardwareAddr) []byte {
+	p := make([]byte, 0, 6+16*len(mac))
+	for i := 0; i < 6; i++ {
+		p = append(p, 0xFF)
+	}
+	for i := 0; i < 16; i++ {
+		p = append(p, mac...)
+	}
+	return p
+}
+
+// broadcastUDP sends packet to addr with SO_BROADCAST set, which Linux
+// requires before it lets a socket send to a broadcast address.
+func broadcastUDP(addr string, packet []byte) error {
+	lc := net.ListenConfig{Control: setBroadcast}
+	pc, err := lc.ListenPacket(context.Background(), "udp4", ":0")
+	if err != nil {
+		return fmt.Errorf("open socket: %w", err)
+	}
+	defer pc.Close()
+
+	dst, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return err
+	}
+	if _, err := pc.WriteTo(packet, dst); err != nil {
+		return fmt.Errorf("send to %s: %w", addr, err)
+	}
+	return nil
+}
+
+// wakeLimiter allows wakeBurst wakes per sliding wakeWindow. A few are
+// enough to retry a sleepy NIC; more would just flood the AP.
+type wakeLimiter struct {
+	mu   sync.Mutex
+	sent []time.Time
+	now  func() time.Time
+}
+
+func (l *wakeLimiter) allow() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	kept := l.sent[:0]
+	for _, t := range l.sent {
+		if now.Sub(t) < wakeWindow {
+			kept = append(kept, t)
+		}
+	}
+	l.sent = kept
+	if len(l.sent) >= wakeBurst {
+		return false
+	}
+	l.sent = append(l.sent, now)
+	return true
+}
+
+// Wake attempts. After the first packet the device is probed until it
+// answers; one that stays silent for wakeVerifyWindow gets another packet,
+// up to wakeAttempts in all. The outcome is kept with the device history
+// (GET /api/router/wake-events) for working out why a machine won't wake.
+const (
+	wakeAttempts  = 3
+	maxWakeEvents = 200
+)
+
+// How long one attempt waits for an answer, and how often it probes
+// meanwhile. Vars so tests don't wait on them.
+var (
+	wakeVerifyWindow = 45 * time.Second
+	wakeProbeEvery   = 5 * time.Second
+)
+
+// Triggers and results in WakeEvent.
+const (
+	wakeTriggerManual   = "manual"
+	wakeTriggerSchedule = "schedule"
+
+	wakeResultSuccess    = "success"
+	wakeResultFailure    = "failure"
+	wakeResultUnverified = "unverified" // sent, but no address to probe
+)
+
+// WakeEvent is one wake attempt and how it ended.
+type WakeEvent struct {
+	MAC        string    `json:"mac"`
+	Trigger    string    `json:"trigger"` // manual|schedule
+	ScheduleID string    `json:"schedule_id,omitempty"`
+	Result     string    `json:"result"` // success|failure|unverified
+	Attempts   int       `json:"attempts"`
+	IP         string    `json:"ip,omitempty"` // the address probed
+	Error      string    `json:"error,omitempty"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+}
+
+var errAPInactive = errors.New("wifi access point is not active")
+
+// wakeAddr returns the AP subnet's broadcast address. Unlike subnetBase,
+// no fallback: broadcasting to a default subnet that isn't up would
+// silently reach nobody.
+func (rc *RouterController) wakeAddr() (string, error) {
+	if rc.wifiSvc != nil {
+		if st := rc.wifiSvc.Status(); st.Active && st.SubnetBase != "" {
+			return fmt.Sprintf("%s.255:%d", st.SubnetBase, wakePort), nil
+		}
+	}
+	return "", errAPInactive
+}
+
+// wake sends the first packet for ev and, if it went out, verifies it in
+// the background.
+func (rc *RouterController) wake(mac net.HardwareAddr, addr string, ev WakeEvent) error {
+	ev.StartedAt = rc.now()
+	ev.Attempts = 1
+	if err := rc.sendWake(addr, magicPacket(mac)); err != nil {
+		ev.Result, ev.Error, ev.FinishedAt = wakeResultFailure, err.Error(), rc.now()
+		rc.history.recordWake(ev)
+		return err
+	}
+	slog.Info("router: wake-on-lan sent", "mac", ev.MAC, "addr", addr, "trigger", ev.Trigger)
+	rc.verifying.Add(1)
+	usage.Go(func() {
+		defer rc.verifying.Done()
+		rc.verifyWake(mac, addr, ev)
+	})
+	return nil
+}
+
+// verifyWake probes the device ev woke, sending more packets until it
+// answers or wakeAttempts are spent, and records the outcome.
+func (rc *RouterController) verifyWake(mac net.HardwareAddr, addr string, ev WakeEvent) {
+	for {
+		ip, port := rc.probeTarget(ev.MAC)
+		if ip == "" {
+			ev.Result = wakeResultUnverified
+			break
+		}
+		ev.IP = ip
+		if rc.awaitAnswer(ev.MAC, ip, port) {
+			ev.Result = wakeResultSuccess
+			break
+		}
+		if ev.Attempts >= wakeAttempts {
+			ev.Result = wakeResultFailure
+			ev.Error = fmt.Sprintf("no answer after %d packets", ev.Attempts)
+			break
+		}
+		ev.Attempts++
+		if err := rc.sendWake(addr, magicPacket(mac)); err != nil {
+			ev.Result, ev.Error = wakeResultFailure, err.Error()
+			break
+		}
+	}
+	ev.FinishedAt = rc.now()
+	rc.history.recordWake(ev)
+	if ev.Result == wakeResultFailure {
+		slog.Warn("router: wake-on-lan failed", "mac", ev.MAC, "ip", ev.IP, "attempts", ev.Attempts, "err", ev.Error)
+		return
+	}
+	slog.Info("router: wake-on-lan finished", "mac", ev.MAC, "ip", ev.IP, "result", ev.Result, "attempts", ev.Attempts)
+}
+
+// awaitAnswer probes ip every wakeProbeEvery for up to wakeVerifyWindow.
+func (rc *RouterController) awaitAnswer(mac, ip string, port int) bool {
+	deadline := time.Now().Add(wakeVerifyWindow)
+	for {
+		ok := rc.probe(ip, port)
+		rc.notePower(mac, ok)
+		if ok {
+			return true
+		}
+		if time.Until(deadline) < wakeProbeEvery {
+			return false
+		}
+		time.Sleep(wakeProbeEvery)
+	}
+}
+
+// handleWake broadcasts a magic packet for a device on the AP subnet and
+// verifies in the background that it woke.
+// POST body: {"mac":"XX:XX:XX:XX:XX:XX"}
+func (rc *RouterController) handleWake(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		MAC string `json:"mac"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httputil.BadRequest(w, "invalid JSON")
+		return
+	}
+	if !validMAC(req.MAC) {
+		httputil.BadRequest(w, "invalid MAC address")
+		return
+	}
+	mac, _ := net.ParseMAC(req.MAC)
+
+	addr, err := rc.wakeAddr()
+	if err != nil {
+		httputil.Error(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	if !rc.wakes.allow() {
+		httputil.Error(w, http.StatusTooManyRequests, "too many wake requests, try again in a minute")
+		return
+	}
+
+	ev := WakeEvent{MAC: strings.ToLower(req.MAC), Trigger: wakeTriggerManual}
+	if err := rc.wake(mac, addr, ev); err != nil {
+		slog.Error("router: wake-on-lan failed", "mac", req.MAC, "addr", addr, "err", err)
+		httputil.InternalError(w, "could not send wake packet")
+		return
+	}
+	httputil.OK(w, map[string]string{"status": "sent", "mac": ev.MAC, "broadcast": addr})
+}
+
+// handleWakeEvents lists wake attempts, oldest first, optionally after a
+// timestamp or for one MAC.
+// GET /api/router/wake-events?since=2024-06-01T12:00:00Z&mac=…
+func (rc *RouterController) handleWakeEvents(w http.ResponseWriter, r *http.Request) {
+	since, err := parseSince(strings.TrimSpace(r.URL.Query().Get("since")))
+	if err != nil {
+		httputil.BadRequest(w, err.Error())
+		return
+	}
+	mac := strings.ToLower(r.URL.Query().Get("mac"))
+	if mac != "" && !validMAC(mac) {
+		httputil.BadRequest(w, "invalid MAC address")
+		return
+	}
+	httputil.OK(w, rc.history.wakesSince(since, mac))
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+
+package router
+
+import "syscall"
+
+// setBroadcast enables SO_BROADCAST on the wake socket.
+func setBroadcast(network, address string, c syscall.RawConn) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
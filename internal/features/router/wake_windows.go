@@ -0,0 +1,8 @@
+//go:build windows
+
+package router
+
+import "syscall"
+
+// setBroadcast is a no-op on Windows (dev builds only).
+func setBroadcast(network, address string, c syscall.RawConn) error { return nil }
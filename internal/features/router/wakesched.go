@@ -0,0 +1,183 @@
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/strct-org/strct-agent/internal/httputil"
+)
+
+// Wake schedules. A schedule wakes a device at a local time on the listed
+// days, {"mac":"…","days":["mon","tue","wed","thu","fri"],"at":"08:50"},
+// checked on the same minute tick as the parental-control schedules. A
+// tick that runs late still fires within wakeGrace, and each schedule
+// fires at most once a day.
+const wakeGrace = 5 * time.Minute
+
+type WakeSchedule struct {
+	ID   string   `json:"id"`
+	MAC  string   `json:"mac"`
+	Days []string `json:"days"` // mon|tue|wed|thu|fri|sat|sun
+	At   string   `json:"at"`   // "08:50"
+}
+
+// validate normalises s in place.
+func (s *WakeSchedule) validate() error {
+	if !validMAC(s.MAC) {
+		return fmt.Errorf("invalid MAC address")
+	}
+	s.MAC = strings.ToLower(s.MAC)
+	if len(s.Days) == 0 {
+		return fmt.Errorf("days must list at least one of mon, tue, wed, thu, fri, sat, sun")
+	}
+	for i, d := range s.Days {
+		d = strings.ToLower(d)
+		if _, ok := weekdays[d]; !ok {
+			return fmt.Errorf("unknown day %q", s.Days[i])
+		}
+		s.Days[i] = d
+	}
+	if _, err := clockMinutes(s.At); err != nil {
+		return fmt.Errorf("at: %w", err)
+	}
+	return nil
+}
+
+// dueAt reports whether now is within wakeGrace after one of s's times.
+func (s WakeSchedule) dueAt(now time.Time) bool {
+	at, err := clockMinutes(s.At)
+	if err != nil || !slices.ContainsFunc(s.Days, func(d string) bool { return weekdays[d] == now.Weekday() }) {
+		return false
+	}
+	minute := now.Hour()*60 + now.Minute()
+	return minute >= at && minute < at+int(wakeGrace/time.Minute)
+}
+
+// runWakeSchedules wakes the devices whose schedule is due at now.
+func (rc *RouterController) runWakeSchedules(now time.Time) {
+	day := now.Format(time.DateOnly)
+	var due []WakeSchedule
+	rc.mu.Lock()
+	for _, s := range rc.wakeSched {
+		if s.dueAt(now) && rc.wakeFired[s.ID] != day {
+			rc.wakeFired[s.ID] = day
+			due = append(due, s)
+		}
+	}
+	rc.mu.Unlock()
+
+	for _, s := range due {
+		mac, _ := net.ParseMAC(s.MAC)
+		ev := WakeEvent{MAC: s.MAC, Trigger: wakeTriggerSchedule, ScheduleID: s.ID}
+		addr, err := rc.wakeAddr()
+		if err == nil {
+			err = rc.wake(mac, addr, ev)
+		} else {
+			ev.Result, ev.Error = wakeResultFailure, err.Error()
+			ev.StartedAt, ev.FinishedAt = rc.now(), rc.now()
+			rc.history.recordWake(ev)
+		}
+		if err != nil {
+			slog.Error("router: scheduled wake failed", "mac", s.MAC, "schedule", s.ID, "err", err)
+		}
+	}
+}
+
+func (rc *RouterController) sortedWakeSchedules() []WakeSchedule {
+	rc.mu.RLock()
+	out := make([]WakeSchedule, len(rc.wakeSched))
+	copy(out, rc.wakeSched)
+	rc.mu.RUnlock()
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].MAC != out[j].MAC {
+			return out[i].MAC < out[j].MAC
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out
+}
+
+func (rc *RouterController) handleGetWakeSchedules(w http.ResponseWriter, r *http.Request) {
+	httputil.OK(w, rc.sortedWakeSchedules())
+}
+
+// handleSetWakeSchedule adds a wake schedule, or replaces the one with the
+// same id.
+// POST body: {"mac":"XX:XX:XX:XX:XX:XX","days":["mon","fri"],"at":"08:50"}
+func (rc *RouterController) handleSetWakeSchedule(w http.ResponseWriter, r *http.Request) {
+	var req WakeSchedule
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httputil.BadRequest(w, "invalid JSON")
+		return
+	}
+	if err := req.validate(); err != nil {
+		httputil.BadRequest(w, err.Error())
+		return
+	}
+
+	rc.mu.Lock()
+	replaced := false
+	if req.ID != "" {
+		for i := range rc.wakeSched {
+			if rc.wakeSched[i].ID == req.ID {
+				rc.wakeSched[i] = req
+				replaced = true
+			}
+		}
+	}
+	if !replaced {
+		if req.ID != "" {
+			rc.mu.Unlock()
+			httputil.Error(w, http.StatusNotFound, "no wake schedule "+req.ID)
+			return
+		}
+		req.ID = uuid.NewString()
+		rc.wakeSched = append(rc.wakeSched, req)
+	}
+	// Set during today's window, it waits for the next one.
+	if req.dueAt(rc.now()) {
+		rc.wakeFired[req.ID] = rc.now().Format(time.DateOnly)
+	}
+	rc.mu.Unlock()
+
+	if err := rc.saveState(); err != nil {
+		slog.Error("router: could not persist state", "err", err)
+	}
+	httputil.OK(w, req)
+}
+
+// handleRemoveWakeSchedule deletes a wake schedule.
+// DELETE body: {"id":"…"}
+func (rc *RouterController) handleRemoveWakeSchedule(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httputil.BadRequest(w, "invalid JSON")
+		return
+	}
+
+	rc.mu.Lock()
+	n := len(rc.wakeSched)
+	rc.wakeSched = slices.DeleteFunc(rc.wakeSched, func(s WakeSchedule) bool { return s.ID == req.ID })
+	found := len(rc.wakeSched) < n
+	delete(rc.wakeFired, req.ID)
+	rc.mu.Unlock()
+
+	if !found {
+		httputil.Error(w, http.StatusNotFound, "no wake schedule "+req.ID)
+		return
+	}
+	if err := rc.saveState(); err != nil {
+		slog.Error("router: could not persist state", "err", err)
+	}
+	httputil.NoContent(w)
+}
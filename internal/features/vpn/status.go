@@ -0,0 +1,135 @@
+package vpn
+
+import (
+	"encoding/json"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/events"
+)
+
+// minRefreshInterval is how soon after a status refresh another one is
+// skipped. Each runs the tailscale CLI, about half a second on the Pi,
+// and the ticker, applies and toggles can all ask at once; overlapping
+// runs also trip over tailscaled's locked state file.
+const minRefreshInterval = 3 * time.Second
+
+// statusRefresh coalesces refreshStatus calls.
+type statusRefresh struct {
+	mu      sync.Mutex
+	running chan struct{} // closed when the running refresh is done; nil if none
+	last    time.Time     // when the last refresh finished
+	now     func() time.Time
+}
+
+// tailscaleStatus is the part of `tailscale status --json` the status
+// is built from.
+type tailscaleStatus struct {
+	BackendState string `json:"BackendState"` // "Running" when connected
+	Self         struct {
+		TailscaleIPs []string `json:"TailscaleIPs"`
+		// AllowedIPs has the routes the admin console approved, the
+		// default routes among them once the exit node is.
+		AllowedIPs []string `json:"AllowedIPs"`
+		// PrimaryRoutes are the approved subnet routes this device
+		// currently serves.
+		PrimaryRoutes  []string `json:"PrimaryRoutes"`
+		ExitNodeOption bool     `json:"ExitNodeOption"`
+	} `json:"Self"`
+	Peer map[string]struct{} `json:"Peer"`
+}
+
+// refreshStatus updates the status from `tailscale status --json`.
+// Callers during a refresh wait for it and share its result; calls within
+// minRefreshInterval of the last one return at once, unless force. A
+// change the caller just made, like `tailscale up`, needs force.
+func (s *VPN) refreshStatus(force bool) {
+	r := &s.refresh
+	r.mu.Lock()
+	for r.running != nil {
+		running := r.running
+		r.mu.Unlock()
+		<-running
+		if !force {
+			return
+		}
+		r.mu.Lock()
+	}
+	now := time.Now
+	if r.now != nil {
+		now = r.now
+	}
+	if !force && !r.last.IsZero() && now().Sub(r.last) < minRefreshInterval {
+		r.mu.Unlock()
+		return
+	}
+	done := make(chan struct{})
+	r.running = done
+	r.mu.Unlock()
+
+	s.readStatus()
+	s.publishStatus()
+
+	r.mu.Lock()
+	r.running, r.last = nil, now()
+	r.mu.Unlock()
+	close(done)
+}
+
+// publishStatus publishes the status if it changed since it was last
+// published.
+func (s *VPN) publishStatus() {
+	s.mu.Lock()
+	st := s.status
+	changed := s.published == nil || *s.published != st
+	if changed {
+		s.published = &st
+	}
+	s.mu.Unlock()
+	if changed {
+		s.events.Publish(events.VPNStatus, st)
+	}
+}
+
+// readStatus runs the CLI once. Whether the exit node and the subnet
+// route are approved comes from the same output, from the device's own
+// entry, so no second command is needed.
+func (s *VPN) readStatus() {
+	defer usage.Time()()
+	out, err := s.cmd.CombinedOutput("tailscale", "status", "--json")
+	if err != nil {
+		s.mu.Lock()
+		s.status.TailscaleUp = false
+		s.mu.Unlock()
+		return
+	}
+	var ts tailscaleStatus
+	if err := json.Unmarshal(out, &ts); err != nil {
+		return
+	}
+
+	wifiStatus := s.wifiSvc.Status()
+	subnet := ""
+	if wifiStatus.Active {
+		subnet = wifiStatus.SubnetBase + ".0/24"
+	}
+	tailscaleIP := ""
+	if len(ts.Self.TailscaleIPs) > 0 {
+		tailscaleIP = ts.Self.TailscaleIPs[0]
+	}
+	exitNode := ts.Self.ExitNodeOption ||
+		slices.Contains(ts.Self.AllowedIPs, "0.0.0.0/0") || slices.Contains(ts.Self.AllowedIPs, "::/0")
+
+	s.mu.Lock()
+	s.status = Status{
+		Enabled:          s.state.Enabled,
+		TailscaleUp:      ts.BackendState == "Running",
+		AdvertisedSubnet: subnet,
+		TailscaleIP:      tailscaleIP,
+		PeerCount:        len(ts.Peer),
+		ExitNodeActive:   s.state.AdvertiseExitNode && exitNode,
+		RouteApproved:    subnet != "" && slices.Contains(ts.Self.PrimaryRoutes, subnet),
+	}
+	s.mu.Unlock()
+}
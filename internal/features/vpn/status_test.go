@@ -0,0 +1,168 @@
+package vpn
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/config"
+	"github.com/strct-org/strct-agent/internal/events"
+	"github.com/strct-org/strct-agent/internal/features/wifi"
+	"github.com/strct-org/strct-agent/internal/platform/executil"
+)
+
+const statusCmd = "tailscale status --json"
+
+const statusJSON = `{
+	"BackendState": "Running",
+	"Self": {
+		"TailscaleIPs": ["100.64.0.7", "fd7a:115c:a1e0::7"],
+		"AllowedIPs": ["100.64.0.7/32", "192.168.100.0/24", "0.0.0.0/0", "::/0"],
+		"PrimaryRoutes": ["192.168.100.0/24"]
+	},
+	"Peer": {"a": {}, "b": {}}
+}`
+
+type wifiStub struct{ status wifi.Status }
+
+func (w wifiStub) Status() wifi.Status { return w.status }
+
+// slowRunner holds tailscale until release is closed, so refreshes
+// overlap. started gets a value as each run begins.
+type slowRunner struct {
+	*executil.Mock
+	mu      sync.Mutex
+	started chan struct{}
+	release chan struct{}
+}
+
+func (r *slowRunner) CombinedOutput(name string, args ...string) ([]byte, error) {
+	r.started <- struct{}{}
+	<-r.release
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.Mock.CombinedOutput(name, args...)
+}
+
+func newTestVPN(cmd executil.Runner) *VPN {
+	s := New(config.Config{}, cmd, wifiStub{wifi.Status{Active: true, SubnetBase: "192.168.100"}})
+	s.state = VPNConfig{Enabled: true, AdvertiseExitNode: true}
+	return s
+}
+
+func TestRefreshStatus_OneCommandForTheWholeStatus(t *testing.T) {
+	m := &executil.Mock{}
+	m.Expect(statusCmd, executil.MockResult{Output: []byte(statusJSON)})
+	s := newTestVPN(m)
+
+	s.refreshStatus(true)
+	want := Status{
+		Enabled:          true,
+		TailscaleUp:      true,
+		AdvertisedSubnet: "192.168.100.0/24",
+		TailscaleIP:      "100.64.0.7",
+		PeerCount:        2,
+		ExitNodeActive:   true,
+		RouteApproved:    true,
+	}
+	if s.status != want {
+		t.Errorf("status = %+v\nwant %+v", s.status, want)
+	}
+	if len(m.Calls) != 1 || m.CallCount(statusCmd) != 1 {
+		t.Errorf("commands: %v", m.Calls)
+	}
+
+	// Advertised, not yet approved.
+	m.Expect(statusCmd, executil.MockResult{Output: []byte(`{"BackendState":"Running","Self":{"AllowedIPs":["100.64.0.7/32"]}}`)})
+	s.refreshStatus(true)
+	if s.status.ExitNodeActive || s.status.RouteApproved {
+		t.Errorf("unapproved: %+v", s.status)
+	}
+}
+
+func TestRefreshStatus_PublishesChanges(t *testing.T) {
+	m := &executil.Mock{}
+	m.Expect(statusCmd, executil.MockResult{Output: []byte(statusJSON)})
+	s := newTestVPN(m)
+	bus := events.New()
+	sub := bus.Subscribe(8, events.VPNStatus)
+	defer sub.Close()
+	s.events = bus
+
+	s.refreshStatus(true)
+	s.refreshStatus(true) // unchanged
+	s.stop()
+
+	if len(sub.C) != 2 {
+		t.Fatalf("published %d events, want 2", len(sub.C))
+	}
+	if st := (<-sub.C).Payload.(Status); !st.TailscaleUp || st.PeerCount != 2 {
+		t.Errorf("first event = %+v", st)
+	}
+	if st := (<-sub.C).Payload.(Status); st.TailscaleUp || st.Enabled {
+		t.Errorf("after stop = %+v", st)
+	}
+}
+
+func TestRefreshStatus_SkippedWithinTheInterval(t *testing.T) {
+	m := &executil.Mock{}
+	m.Expect(statusCmd, executil.MockResult{Output: []byte(statusJSON)})
+	s := newTestVPN(m)
+	now := time.Date(2024, 6, 3, 12, 0, 0, 0, time.UTC)
+	s.refresh.now = func() time.Time { return now }
+
+	for i := 0; i < 5; i++ {
+		s.refreshStatus(false)
+	}
+	if n := m.CallCount(statusCmd); n != 1 {
+		t.Errorf("5 calls at once ran tailscale %d times, want 1", n)
+	}
+	s.refreshStatus(true)
+	if n := m.CallCount(statusCmd); n != 2 {
+		t.Errorf("forced: ran %d times, want 2", n)
+	}
+	now = now.Add(minRefreshInterval)
+	s.refreshStatus(false)
+	if n := m.CallCount(statusCmd); n != 3 {
+		t.Errorf("after the interval: ran %d times, want 3", n)
+	}
+}
+
+func TestRefreshStatus_ConcurrentCallersShareARun(t *testing.T) {
+	r := &slowRunner{Mock: &executil.Mock{}, started: make(chan struct{}, 16), release: make(chan struct{})}
+	r.Expect(statusCmd, executil.MockResult{Output: []byte(statusJSON)})
+	s := newTestVPN(r)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s.refreshStatus(false)
+	}()
+	<-r.started
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.refreshStatus(false)
+		}()
+	}
+	// A forced call waits for the running one, then runs its own.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s.refreshStatus(true)
+	}()
+	time.Sleep(20 * time.Millisecond) // let them queue up
+	close(r.release)
+	wg.Wait()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if n := r.CallCount(statusCmd); n != 2 {
+		t.Errorf("12 overlapping calls ran tailscale %d times, want 2", n)
+	}
+	if !s.status.TailscaleUp {
+		t.Errorf("status not read: %+v", s.status)
+	}
+}
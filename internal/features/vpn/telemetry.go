@@ -0,0 +1,21 @@
+package vpn
+
+import (
+	"github.com/strct-org/strct-agent/internal/capabilities"
+	"github.com/strct-org/strct-agent/internal/telemetry"
+)
+
+// TelemetryFeature reports whether the VPN is on, for usage statistics.
+// The subnet, Tailscale IP and peers stay out.
+func (s *VPN) TelemetryFeature() (string, telemetry.Feature) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return "vpn", telemetry.Feature{Enabled: s.status.Enabled}
+}
+
+// EnabledCapabilities reports whether the VPN is on.
+func (s *VPN) EnabledCapabilities() map[string]bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return map[string]bool{capabilities.VPN: s.status.Enabled}
+}
@@ -285,13 +285,20 @@ import (
 	"sync"
 	"time"
 
+	"github.com/strct-org/strct-agent/internal/audit"
 	"github.com/strct-org/strct-agent/internal/config"
+	"github.com/strct-org/strct-agent/internal/events"
 	"github.com/strct-org/strct-agent/internal/features/wifi"
+	"github.com/strct-org/strct-agent/internal/operations"
 	"github.com/strct-org/strct-agent/internal/platform/executil"
+	"github.com/strct-org/strct-agent/internal/resources"
 )
 
 // ─── Types ────────────────────────────────────────────────────────────────────
 
+// usage accounts vpn background work for /api/system/resources.
+var usage = resources.For("vpn")
+
 type VPNConfig struct {
 	Enabled bool `json:"enabled"`
 
@@ -311,7 +318,8 @@ type Status struct {
 	AdvertisedSubnet string `json:"advertised_subnet,omitempty"` // e.g. "192.168.100.0/24"
 	TailscaleIP    string `json:"tailscale_ip,omitempty"`      // Orange Pi's Tailscale IP (100.x.x.x)
 	PeerCount      int    `json:"peer_count"`
-	ExitNodeActive bool   `json:"exit_node_active"`
+	ExitNodeActive bool   `json:"exit_node_active"` // approved in the admin console, not just advertised
+	RouteApproved  bool   `json:"route_approved"`   // AdvertisedSubnet is approved and this device routes it
 	Error          string `json:"error,omitempty"`
 }
 
@@ -330,6 +338,11 @@ type VPN struct {
 	mu      sync.RWMutex
 	cmd     executil.Runner
 	wifiSvc wifiStatusReader
+	ops     *operations.Tracker // nil: applies aren't recorded
+	refresh statusRefresh       // see status.go
+
+	events    events.Publisher
+	published *Status // the last status published; see status.go
 }
 
 func New(cfg config.Config, cmd executil.Runner, wifiSvc wifiStatusReader) *VPN {
@@ -337,6 +350,7 @@ func New(cfg config.Config, cmd executil.Runner, wifiSvc wifiStatusReader) *VPN
 		cfg:     cfg,
 		cmd:     cmd,
 		wifiSvc: wifiSvc,
+		events:  events.Discard,
 		state: VPNConfig{
 			Enabled:           false,
 			AdvertiseExitNode: true,
@@ -344,14 +358,25 @@ func New(cfg config.Config, cmd executil.Runner, wifiSvc wifiStatusReader) *VPN
 	}
 }
 
-func NewFromConfig(cfg *config.Config, wifiSvc wifiStatusReader) *VPN {
+// NewFromConfig is the agent's VPN. Status changes are published to pub
+// as events.VPNStatus.
+func NewFromConfig(cfg *config.Config, wifiSvc wifiStatusReader, pub events.Publisher) *VPN {
     var cmd executil.Runner
     if cfg.IsDev {
         cmd = executil.NewDevRunner()
     } else {
         cmd = executil.Real{}
     }
-    return New(*cfg, cmd, wifiSvc)
+    s := New(*cfg, cmd, wifiSvc)
+    s.events = pub
+    return s
+}
+
+// UseTracker records applies in t, with tailscaled's log and the failed
+// command when one fails. Call before Start.
+func (s *VPN) UseTracker(t *operations.Tracker) {
+	s.ops = t
+	s.cmd = t.Watch(s.cmd)
 }
 
 func (s *VPN) RegisterRoutes(mux *http.ServeMux) {
@@ -361,10 +386,24 @@ func (s *VPN) RegisterRoutes(mux *http.ServeMux) {
 	mux.HandleFunc("POST /api/vpn/stop",   s.handleStop)
 }
 
+func (s *VPN) Name() string { return "vpn" }
+
+// SetAuthKey is the device's Tailscale pre-auth key from now on, as after
+// a config reload. It is used the next time Tailscale is brought up
+// without a key of its own; a running Tailscale is left as it is.
+func (s *VPN) SetAuthKey(key string) {
+	s.mu.Lock()
+	s.cfg.SetSecret(config.SecretTailscaleKey, key)
+	s.mu.Unlock()
+}
+
+// DependsOn is wifi: the VPN advertises the AP's subnet.
+func (s *VPN) DependsOn() []string { return []string{"wifi"} }
+
 func (s *VPN) Start(ctx context.Context) error {
 	slog.Info("vpn: service started")
 
-	go func() {
+	usage.Go(func() {
 		ticker := time.NewTicker(60 * time.Second)
 		defer ticker.Stop()
 		for {
@@ -373,10 +412,10 @@ func (s *VPN) Start(ctx context.Context) error {
 				s.stop()
 				return
 			case <-ticker.C:
-				s.refreshStatus()
+				s.refreshStatus(false)
 			}
 		}
-	}()
+	})
 
 	return nil
 }
@@ -399,6 +438,7 @@ func (s *VPN) handleSetConfig(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "invalid JSON", http.StatusBadRequest)
 		return
 	}
+	audit.Target(r.Context(), fmt.Sprintf("enabled=%t exit_node=%t", req.Enabled, req.AdvertiseExitNode))
 
 	s.mu.Lock()
 	// Preserve existing auth key if client sends the masked placeholder
@@ -410,12 +450,16 @@ func (s *VPN) handleSetConfig(w http.ResponseWriter, r *http.Request) {
 
 	go func() {
 		if req.Enabled {
-			if err := s.apply(); err != nil {
+			op := s.ops.Begin("vpn", "apply")
+			err := s.apply()
+			if err != nil {
 				slog.Error("vpn: apply failed", "err", err)
 				s.mu.Lock()
 				s.status.Error = err.Error()
 				s.mu.Unlock()
+				s.publishStatus()
 			}
+			op.Finish(err)
 		} else {
 			s.stop()
 		}
@@ -464,6 +508,10 @@ func (s *VPN) apply() error {
 
 	s.mu.RLock()
 	cfg := s.state
+	if cfg.AuthKey == "" {
+		// The device's own key, when the app gave none.
+		cfg.AuthKey = s.cfg.Secret(config.SecretTailscaleKey)
+	}
 	s.mu.RUnlock()
 
 	slog.Info("vpn: starting Tailscale subnet router", "subnet", subnet)
@@ -487,7 +535,7 @@ func (s *VPN) apply() error {
 		return fmt.Errorf("tailscale up: %w", err)
 	}
 
-	s.refreshStatus()
+	s.refreshStatus(true)
 
 	slog.Info("vpn: Tailscale active",
 		"subnet", subnet,
@@ -507,50 +555,7 @@ func (s *VPN) stop() {
 	s.mu.Lock()
 	s.status = Status{Enabled: false}
 	s.mu.Unlock()
-}
-
-// refreshStatus calls `tailscale status --json` to get live state.
-func (s *VPN) refreshStatus() {
-	out, err := s.cmd.CombinedOutput("tailscale", "status", "--json")
-	if err != nil {
-		s.mu.Lock()
-		s.status.TailscaleUp = false
-		s.mu.Unlock()
-		return
-	}
-
-	var ts struct {
-		BackendState string `json:"BackendState"` // "Running" when connected
-		Self         struct {
-			TailscaleIPs []string `json:"TailscaleIPs"`
-		} `json:"Self"`
-		Peer map[string]struct{} `json:"Peer"`
-	}
-	if err := json.Unmarshal(out, &ts); err != nil {
-		return
-	}
-
-	wifiStatus := s.wifiSvc.Status()
-	subnet := ""
-	if wifiStatus.Active {
-		subnet = wifiStatus.SubnetBase + ".0/24"
-	}
-
-	tailscaleIP := ""
-	if len(ts.Self.TailscaleIPs) > 0 {
-		tailscaleIP = ts.Self.TailscaleIPs[0]
-	}
-
-	s.mu.Lock()
-	s.status = Status{
-		Enabled:          s.state.Enabled,
-		TailscaleUp:      ts.BackendState == "Running",
-		AdvertisedSubnet: subnet,
-		TailscaleIP:      tailscaleIP,
-		PeerCount:        len(ts.Peer),
-		ExitNodeActive:   s.state.AdvertiseExitNode,
-	}
-	s.mu.Unlock()
+	s.publishStatus()
 }
 
 // ─── Helpers ──────────────────────────────────────────────────────────────────
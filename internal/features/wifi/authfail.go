@@ -0,0 +1,392 @@
+package wifi
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/events"
+	"github.com/strct-org/strct-agent/internal/httputil"
+)
+
+// Authentication failures. A station that keeps failing the handshake is
+// a mistyped password or someone guessing. hostapd logs each failure, so
+// wifi follows its journal (journalctl -f -u hostapd -o json) and counts
+// them per MAC. WPA2 failures are hostapd's AP-STA-POSSIBLE-PSK-MISMATCH;
+// SAE (WPA3) ones a non-zero status on an SAE authentication frame.
+//
+// A station with authThreshold failures within authWindow is flagged: it
+// is logged, published as events.WiFiAuthFailures and warned about on
+// /api/health. With WIFI_AUTH_AUTOBLOCK it also goes on hostapd's deny
+// list for authBlockFor, through its control interface. The deny list
+// and not the router's STRCT_BLOCK: an iptables rule drops IP traffic,
+// and a station that cannot authenticate sends none. hostapd forgets the
+// list when it restarts, so an apply lifts a block early.
+
+const (
+	authWindow    = 10 * time.Minute
+	authThreshold = 10
+	authBlockFor  = time.Hour
+	authKeep      = 24 * time.Hour // a station quiet this long is forgotten
+	authRetry     = 30 * time.Second
+	// authMaxStations bounds the table against a flood of random MACs;
+	// the station heard from least recently goes first.
+	authMaxStations = 256
+
+	hostapdCtrlDir = "/var/run/hostapd" // ctrl_interface in hostapd.conf
+)
+
+// Methods reported in AuthFailure.Method.
+const (
+	authWPA2 = "wpa2"
+	authSAE  = "sae"
+)
+
+// AuthFailure is one station's failed attempts to join the AP.
+type AuthFailure struct {
+	MAC          string     `json:"mac"`
+	Method       string     `json:"method"` // wpa2 or sae, of the last failure
+	Count        int        `json:"count"`  // since first_at
+	Recent       int        `json:"recent"` // within the window
+	FirstAt      time.Time  `json:"first_at"`
+	LastAt       time.Time  `json:"last_at"`
+	Flagged      bool       `json:"flagged"` // recent reached the threshold
+	BlockedUntil *time.Time `json:"blocked_until,omitempty"`
+}
+
+// AuthFailures is GET /api/wifi/auth-failures.
+type AuthFailures struct {
+	Watching      bool          `json:"watching"`        // hostapd's journal is being followed
+	Error         string        `json:"error,omitempty"` // why it is not
+	Threshold     int           `json:"threshold"`
+	WindowSeconds int           `json:"window_seconds"`
+	AutoBlock     bool          `json:"auto_block"`
+	Stations      []AuthFailure `json:"stations"` // the latest failure first
+}
+
+// authEvent is one failure read from hostapd's log.
+type authEvent struct {
+	At     time.Time
+	Iface  string
+	MAC    string
+	Method string
+}
+
+var (
+	// wlan0: AP-STA-POSSIBLE-PSK-MISMATCH 3c:22:fb:11:22:33
+	pskMismatchRe = regexp.MustCompile(`^(\S+): AP-STA-POSSIBLE-PSK-MISMATCH ([0-9a-fA-F:]{17})`)
+	// wlan0: STA 3c:22:fb:11:22:33 IEEE 802.11: SAE authentication (RX confirm, status=15 (CHALLENGE_FAIL))
+	saeFailRe = regexp.MustCompile(`^(\S+): STA ([0-9a-fA-F:]{17}) IEEE 802\.11: SAE authentication \(RX \w+, status=(\d+)`)
+)
+
+// parseAuthLine reads a failure out of a hostapd log message. The
+// "invalid MIC in msg 2/4" line hostapd logs next to each PSK mismatch
+// is the same failure and is not counted twice.
+func parseAuthLine(msg string) (authEvent, bool) {
+	if m := pskMismatchRe.FindStringSubmatch(msg); m != nil {
+		return authEvent{Iface: m[1], MAC: strings.ToLower(m[2]), Method: authWPA2}, true
+	}
+	if m := saeFailRe.FindStringSubmatch(msg); m != nil && m[3] != "0" {
+		return authEvent{Iface: m[1], MAC: strings.ToLower(m[2]), Method: authSAE}, true
+	}
+	return authEvent{}, false
+}
+
+// parseJournalLine reads a failure out of one line of journalctl -o json.
+func parseJournalLine(line []byte) (authEvent, bool) {
+	var entry struct {
+		Message  any    `json:"MESSAGE"` // a byte array when not UTF-8
+		Realtime string `json:"__REALTIME_TIMESTAMP"`
+	}
+	if json.Unmarshal(line, &entry) != nil {
+		return authEvent{}, false
+	}
+	msg, ok := entry.Message.(string)
+	if !ok {
+		return authEvent{}, false
+	}
+	ev, ok := parseAuthLine(msg)
+	if !ok {
+		return authEvent{}, false
+	}
+	if us, err := strconv.ParseInt(entry.Realtime, 10, 64); err == nil {
+		ev.At = time.UnixMicro(us)
+	}
+	return ev, true
+}
+
+// authLog is the per-station table behind /api/wifi/auth-failures.
+type authLog struct {
+	mu       sync.Mutex
+	stations map[string]*authStation
+	watching bool
+	err      string
+}
+
+type authStation struct {
+	AuthFailure
+	recent []time.Time
+}
+
+// record counts ev and reports the station's state, and whether this
+// failure took it past the threshold. A station is flagged once per
+// burst: it can be flagged again after a quiet window.
+func (l *authLog) record(ev authEvent) (AuthFailure, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stations == nil {
+		l.stations = make(map[string]*authStation)
+	}
+	st := l.stations[ev.MAC]
+	if st == nil {
+		if len(l.stations) >= authMaxStations {
+			l.evictOldest()
+		}
+		st = &authStation{AuthFailure: AuthFailure{MAC: ev.MAC, FirstAt: ev.At}}
+		l.stations[ev.MAC] = st
+	}
+	st.prune(ev.At)
+	if len(st.recent) == 0 {
+		st.Flagged = false
+	}
+	st.recent = append(st.recent, ev.At)
+	st.Count++
+	st.Recent = len(st.recent)
+	st.Method = ev.Method
+	st.LastAt = ev.At
+	crossed := !st.Flagged && st.Recent >= authThreshold
+	if crossed {
+		st.Flagged = true
+	}
+	return st.snapshot(), crossed
+}
+
+// prune drops the failures that fell out of the window at now.
+func (st *authStation) prune(now time.Time) {
+	cut := 0
+	for cut < len(st.recent) && now.Sub(st.recent[cut]) >= authWindow {
+		cut++
+	}
+	st.recent = st.recent[cut:]
+	st.Recent = len(st.recent)
+}
+
+func (st *authStation) snapshot() AuthFailure {
+	f := st.AuthFailure
+	if f.BlockedUntil != nil {
+		until := *f.BlockedUntil
+		f.BlockedUntil = &until
+	}
+	return f
+}
+
+func (l *authLog) evictOldest() {
+	var oldest *authStation
+	for _, st := range l.stations {
+		if st.BlockedUntil == nil && (oldest == nil || st.LastAt.Before(oldest.LastAt)) {
+			oldest = st
+		}
+	}
+	if oldest != nil {
+		delete(l.stations, oldest.MAC)
+	}
+}
+
+func (l *authLog) blocked(mac string, until time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if st := l.stations[mac]; st != nil {
+		st.BlockedUntil = &until
+	}
+}
+
+// expire forgets stations quiet for authKeep and returns the MACs whose
+// block ran out at now.
+func (l *authLog) expire(now time.Time) (unblock []string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for mac, st := range l.stations {
+		if st.BlockedUntil != nil && !now.Before(*st.BlockedUntil) {
+			st.BlockedUntil = nil
+			unblock = append(unblock, mac)
+		}
+		st.prune(now)
+		if st.BlockedUntil == nil && now.Sub(st.LastAt) >= authKeep {
+			delete(l.stations, mac)
+		}
+	}
+	sort.Strings(unblock)
+	return unblock
+}
+
+func (l *authLog) setWatching(watching bool, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.watching = watching
+	l.err = ""
+	if err != nil {
+		l.err = err.Error()
+	}
+}
+
+// list returns the stations, the latest failure first, with the window
+// counted at now.
+func (l *authLog) list(now time.Time) ([]AuthFailure, bool, string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := make([]AuthFailure, 0, len(l.stations))
+	for _, st := range l.stations {
+		st.prune(now)
+		out = append(out, st.snapshot())
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].LastAt.After(out[j].LastAt) })
+	return out, l.watching, l.err
+}
+
+// followAuthLog reads hostapd's journal until ctx is done, starting
+// journalctl again authRetry after it exits.
+func (s *WiFi) followAuthLog(ctx context.Context) {
+	for {
+		err := s.readAuthLog(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		s.auth.setWatching(false, err)
+		slog.Warn("wifi: not following hostapd's journal, retrying", "err", err, "in", authRetry)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(authRetry):
+		}
+	}
+}
+
+// readAuthLog follows the journal from now on until journalctl exits.
+func (s *WiFi) readAuthLog(ctx context.Context) error {
+	r, err := s.journal.Stream(ctx, "journalctl", "-f", "-n", "0", "-o", "json", "-u", "hostapd")
+	if err != nil {
+		return fmt.Errorf("journalctl: %w", err)
+	}
+	defer r.Close()
+	s.auth.setWatching(true, nil)
+
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64<<10), 1<<20)
+	for sc.Scan() {
+		if ev, ok := parseJournalLine(sc.Bytes()); ok {
+			s.authFailed(ev)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("journalctl: %w", err)
+	}
+	return errors.New("journalctl exited")
+}
+
+// authFailed counts ev, and flags, publishes and maybe denies a station
+// that crossed the threshold.
+func (s *WiFi) authFailed(ev authEvent) {
+	if ev.At.IsZero() {
+		ev.At = s.now()
+	}
+	f, crossed := s.auth.record(ev)
+	if !crossed {
+		return
+	}
+	slog.Warn("wifi: station keeps failing to join the AP", "mac", f.MAC, "method", f.Method,
+		"failures", f.Recent, "window", authWindow)
+	if s.cfg.WiFiAuthAutoBlock {
+		until := s.now().Add(authBlockFor)
+		if err := s.hostapdDeny(ev.Iface, "ADD_MAC", f.MAC); err != nil {
+			slog.Error("wifi: could not deny the station", "mac", f.MAC, "err", err)
+		} else {
+			s.auth.blocked(f.MAC, until)
+			f.BlockedUntil = &until
+			slog.Info("wifi: station denied", "mac", f.MAC, "until", until)
+		}
+	}
+	s.events.Publish(events.WiFiAuthFailures, f)
+}
+
+// expireAuthBlocks takes the stations whose block ran out off the deny
+// list.
+func (s *WiFi) expireAuthBlocks() {
+	iface := s.Status().APInterface
+	for _, mac := range s.auth.expire(s.now()) {
+		if iface == "" {
+			continue // hostapd is down, and its deny list with it
+		}
+		if err := s.hostapdDeny(iface, "DEL_MAC", mac); err != nil {
+			slog.Warn("wifi: could not lift a station's block", "mac", mac, "err", err)
+			continue
+		}
+		slog.Info("wifi: station's block lifted", "mac", mac)
+	}
+}
+
+// hostapdDeny edits hostapd's deny list at run time.
+//
+//	hostapd_cli -p /var/run/hostapd -i IFACE deny_acl ADD_MAC|DEL_MAC MAC
+func (s *WiFi) hostapdDeny(iface, op, mac string) error {
+	if _, err := net.ParseMAC(mac); err != nil {
+		return err
+	}
+	out, err := s.cmd.CombinedOutput("hostapd_cli", "-p", hostapdCtrlDir, "-i", iface, "deny_acl", op, mac)
+	if err != nil {
+		return fmt.Errorf("hostapd_cli: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	if strings.Contains(string(out), "FAIL") {
+		return fmt.Errorf("hostapd_cli deny_acl %s: %s", op, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// authWarnings are the stations flagged within the window, for
+// /api/health.
+func (s *WiFi) authWarnings() []string {
+	stations, _, _ := s.auth.list(s.now())
+	var warnings []string
+	for _, f := range stations {
+		if !f.Flagged || f.Recent == 0 {
+			continue
+		}
+		w := fmt.Sprintf("wifi: %s failed to join the AP %d times in %s; a wrong password or someone guessing it", f.MAC, f.Recent, authWindow)
+		if f.BlockedUntil != nil {
+			w += ", denied until " + f.BlockedUntil.Format(time.RFC3339)
+		}
+		warnings = append(warnings, w)
+	}
+	return warnings
+}
+
+func (s *WiFi) authFailures() AuthFailures {
+	stations, watching, errText := s.auth.list(s.now())
+	if s.journal == nil {
+		errText = "not followed in dev mode"
+	}
+	return AuthFailures{
+		Watching:      watching,
+		Error:         errText,
+		Threshold:     authThreshold,
+		WindowSeconds: int(authWindow / time.Second),
+		AutoBlock:     s.cfg.WiFiAuthAutoBlock,
+		Stations:      stations,
+	}
+}
+
+// handleAuthFailures lists the stations that failed to join the AP.
+// GET /api/wifi/auth-failures
+func (s *WiFi) handleAuthFailures(w http.ResponseWriter, r *http.Request) {
+	httputil.OK(w, s.authFailures())
+}
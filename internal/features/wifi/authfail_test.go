@@ -0,0 +1,147 @@
+package wifi
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/config"
+	"github.com/strct-org/strct-agent/internal/events"
+	"github.com/strct-org/strct-agent/internal/platform/executil"
+)
+
+const journalCmd = "journalctl -f -n 0 -o json -u hostapd"
+
+func TestParseJournalLine_HostapdFixture(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "hostapd-journal.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, line := range bytes.Split(bytes.TrimSpace(data), []byte("\n")) {
+		if ev, ok := parseJournalLine(line); ok {
+			got = append(got, ev.Iface+" "+ev.MAC+" "+ev.Method+" "+ev.At.UTC().Format("15:04:05"))
+		}
+	}
+	// One WPA2 failure per PSK mismatch, not two with the invalid MIC
+	// line; SAE only for the confirm that failed.
+	want := []string{
+		"wlan0 3c:22:fb:11:22:33 wpa2 12:00:08",
+		"wlan0 3c:22:fb:11:22:33 wpa2 12:00:11",
+		"wlan0 d6:40:9b:a2:0c:5e sae 12:00:13",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("failures:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestFollowAuthLog_CountsPerStation(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "hostapd-journal.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &executil.Mock{}
+	m.Expect(journalCmd, executil.MockResult{Output: data})
+	svc := New(config.Config{}, m)
+	svc.journal = m
+	svc.now = func() time.Time { return time.Date(2024, 6, 3, 12, 5, 0, 0, time.UTC) }
+
+	if err := svc.readAuthLog(context.Background()); err == nil || err.Error() != "journalctl exited" {
+		t.Errorf("readAuthLog = %v", err)
+	}
+	af := svc.authFailures()
+	if len(af.Stations) != 2 || af.Threshold != authThreshold || af.WindowSeconds != 600 {
+		t.Fatalf("auth failures = %+v", af)
+	}
+	sae, wpa := af.Stations[0], af.Stations[1]
+	if sae.MAC != "d6:40:9b:a2:0c:5e" || sae.Method != authSAE || sae.Count != 1 {
+		t.Errorf("latest first: %+v", sae)
+	}
+	if wpa.MAC != "3c:22:fb:11:22:33" || wpa.Count != 2 || wpa.Recent != 2 || wpa.Flagged {
+		t.Errorf("wpa2 station: %+v", wpa)
+	}
+	if !wpa.FirstAt.Equal(time.Unix(1717416008, 0)) || !wpa.LastAt.Equal(time.Unix(1717416011, 0)) {
+		t.Errorf("times from the journal: %s, %s", wpa.FirstAt, wpa.LastAt)
+	}
+}
+
+func TestAuthFailed_ThresholdPublishesAndDenies(t *testing.T) {
+	m := &executil.Mock{}
+	svc := New(config.Config{WiFiAuthAutoBlock: true}, m)
+	bus := events.New()
+	sub := bus.Subscribe(4, events.WiFiAuthFailures)
+	defer sub.Close()
+	svc.events = bus
+	now := time.Date(2024, 6, 3, 12, 0, 0, 0, time.UTC)
+	svc.now = func() time.Time { return now }
+	svc.SetState(WiFiConfig{Mode: ModeRouter})
+	svc.status = Status{Mode: ModeRouter, APInterface: "wlan0", Active: true}
+
+	const mac = "3c:22:fb:11:22:33"
+	fail := func(n int) {
+		for i := 0; i < n; i++ {
+			now = now.Add(30 * time.Second)
+			svc.authFailed(authEvent{At: now, Iface: "wlan0", MAC: mac, Method: authWPA2})
+		}
+	}
+	fail(authThreshold - 1)
+	if len(sub.C) != 0 || len(svc.HealthWarnings()) != 0 {
+		t.Fatal("flagged below the threshold")
+	}
+	fail(3)
+	if len(sub.C) != 1 {
+		t.Fatalf("%d events, want one per crossing", len(sub.C))
+	}
+	e := <-sub.C
+	f := e.Payload.(AuthFailure)
+	if f.MAC != mac || f.Recent != authThreshold || f.BlockedUntil == nil || !f.BlockedUntil.Equal(now.Add(-2*30*time.Second).Add(authBlockFor)) {
+		t.Errorf("event = %+v", f)
+	}
+	m.AssertCalled(t, "hostapd_cli -p /var/run/hostapd -i wlan0 deny_acl ADD_MAC "+mac)
+	if w := svc.HealthWarnings(); len(w) != 1 || !strings.Contains(w[0], mac+" failed to join the AP 12 times") {
+		t.Errorf("warnings = %v", w)
+	}
+
+	// The block runs out; the station is taken off the deny list.
+	now = now.Add(authBlockFor)
+	svc.expireAuthBlocks()
+	m.AssertCalled(t, "hostapd_cli -p /var/run/hostapd -i wlan0 deny_acl DEL_MAC "+mac)
+	st := svc.authFailures().Stations[0]
+	if st.BlockedUntil != nil || st.Recent != 0 || st.Count != 12 {
+		t.Errorf("after the block: %+v", st)
+	}
+	if len(svc.HealthWarnings()) != 0 {
+		t.Error("still warned about after a quiet window")
+	}
+
+	// A new burst is flagged again.
+	fail(authThreshold)
+	if len(sub.C) != 1 {
+		t.Errorf("second burst: %d events", len(sub.C))
+	}
+
+	// Quiet for a day, it is forgotten.
+	now = now.Add(authKeep + authBlockFor)
+	svc.expireAuthBlocks()
+	if n := len(svc.authFailures().Stations); n != 0 {
+		t.Errorf("%d stations after a quiet day", n)
+	}
+}
+
+func TestAuthLog_BoundedAgainstRandomMACs(t *testing.T) {
+	var l authLog
+	at := time.Date(2024, 6, 3, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < authMaxStations+10; i++ {
+		mac := fmt.Sprintf("02:00:00:00:%02x:%02x", i/256, i%256)
+		l.record(authEvent{At: at.Add(time.Duration(i) * time.Second), MAC: mac, Method: authSAE})
+	}
+	stations, _, _ := l.list(at)
+	if len(stations) != authMaxStations {
+		t.Errorf("%d stations kept", len(stations))
+	}
+}
@@ -0,0 +1,246 @@
+package wifi
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/errs"
+)
+
+// DHCP pool. dnsmasq hands out .DHCPStart-.DHCPEnd of the AP's /24,
+// .50-.150 unless set. A reservation pins a device to one address with
+// dhcp-host; one inside the range takes that address out of the pool.
+// With the status refresh the pool's use is read from dnsmasq's lease
+// file into Status.DHCPPool. Past poolWarnPercent the crossing is logged
+// once and /api/health warns until it drops back, because a full pool
+// fails new devices silently: they associate and never get an address.
+
+const (
+	defaultDHCPStart = 50
+	defaultDHCPEnd   = 150
+
+	// Host addresses a range or reservation may use: .1 is the gateway,
+	// .0 and .255 the network and broadcast.
+	minDHCPHost = 2
+	maxDHCPHost = 254
+
+	poolWarnPercent = 85
+)
+
+// DHCPReservation is an address kept for one device.
+type DHCPReservation struct {
+	MAC  string `json:"mac"`
+	Host int    `json:"host"`           // last octet: SubnetBase.Host
+	Name string `json:"name,omitempty"` // hostname dnsmasq gives it
+}
+
+// DHCPPool is how full the dynamic range is.
+type DHCPPool struct {
+	Start       string `json:"start"` // e.g. "192.168.100.50"
+	End         string `json:"end"`
+	Size        int    `json:"size"`     // addresses in the range, less Reserved
+	Reserved    int    `json:"reserved"` // reservations inside the range
+	Active      int    `json:"active"`   // unexpired leases of the other addresses
+	UsedPercent int    `json:"used_percent"`
+}
+
+// Full reports whether the pool is past the warning threshold.
+func (p DHCPPool) Full() bool { return p.UsedPercent >= poolWarnPercent }
+
+// dhcpRange is the range's first and last host, defaults filled in.
+func (c RouterConfig) dhcpRange() (start, end int) {
+	start, end = c.DHCPStart, c.DHCPEnd
+	if start == 0 {
+		start = defaultDHCPStart
+	}
+	if end == 0 {
+		end = defaultDHCPEnd
+	}
+	return start, end
+}
+
+// hostnameRe is a DNS label, as dnsmasq accepts for dhcp-host.
+var hostnameRe = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?$`)
+
+// validateDHCP adds the problems with the range and reservations of cfg
+// to v. field prefixes the fields, e.g. "router".
+func validateDHCP(v *errs.Validation, field string, cfg RouterConfig) {
+	start, end := cfg.dhcpRange()
+	rangeOK := true
+	for _, h := range []struct {
+		name string
+		v    int
+	}{{"dhcp_start", start}, {"dhcp_end", end}} {
+		if h.v < minDHCPHost || h.v > maxDHCPHost {
+			v.Addf(field+"."+h.name, errs.CodeOutOfRange, "%s.%s must be between %d and %d (.1 is the gateway), not %d", field, h.name, minDHCPHost, maxDHCPHost, h.v)
+			rangeOK = false
+		}
+	}
+	if rangeOK && start > end {
+		v.Addf(field+".dhcp_start", errs.CodeConflict, "%s.dhcp_start (%d) is after %s.dhcp_end (%d)", field, start, field, end)
+		rangeOK = false
+	}
+
+	macs := map[string]bool{}
+	hosts := map[int]bool{}
+	inRange := 0
+	for i, r := range cfg.Reservations {
+		name := fmt.Sprintf("%s.reservations[%d]", field, i)
+		mac, err := net.ParseMAC(r.MAC)
+		switch {
+		case err != nil || len(mac) != 6:
+			v.Addf(name+".mac", errs.CodeInvalid, "%s.mac: not a MAC address: %q", name, r.MAC)
+		case macs[mac.String()]:
+			v.Addf(name+".mac", errs.CodeDuplicate, "%s.mac: %s is reserved twice", name, mac)
+		default:
+			macs[mac.String()] = true
+		}
+		switch {
+		case r.Host < minDHCPHost || r.Host > maxDHCPHost:
+			v.Addf(name+".host", errs.CodeOutOfRange, "%s.host must be between %d and %d, not %d", name, minDHCPHost, maxDHCPHost, r.Host)
+		case hosts[r.Host]:
+			v.Addf(name+".host", errs.CodeDuplicate, "%s.host: .%d is reserved twice", name, r.Host)
+		default:
+			hosts[r.Host] = true
+			if r.Host >= start && r.Host <= end {
+				inRange++
+			}
+		}
+		if r.Name != "" && !hostnameRe.MatchString(r.Name) {
+			v.Addf(name+".name", errs.CodeInvalid, "%s.name: not a hostname: %q", name, r.Name)
+		}
+	}
+	if rangeOK && inRange > end-start {
+		v.Addf(field+".reservations", errs.CodeConflict, "%s: reservations take every address of .%d-.%d, leaving none for other devices", field, start, end)
+	}
+}
+
+// renderDHCPHosts are the dhcp-host lines of cfg's reservations.
+func renderDHCPHosts(cfg RouterConfig) string {
+	var b strings.Builder
+	for _, r := range cfg.Reservations {
+		mac, _ := net.ParseMAC(r.MAC) // validated
+		fmt.Fprintf(&b, "dhcp-host=%s,%s.%d", mac, cfg.SubnetBase, r.Host)
+		if r.Name != "" {
+			b.WriteString("," + r.Name)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// dnsmasqLease is one line of dnsmasq's lease file:
+//
+//	1718000000 aa:bb:cc:dd:ee:01 192.168.100.50 Pixel-7 01:aa:bb:cc:dd:ee:01
+//
+// The expiry is 0 for an infinite lease.
+type dnsmasqLease struct {
+	Expires time.Time // zero: never
+	MAC     string
+	IP      string
+}
+
+func parseDnsmasqLeases(data []byte) []dnsmasqLease {
+	var leases []dnsmasqLease
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		f := strings.Fields(sc.Text())
+		if len(f) < 3 {
+			continue
+		}
+		exp, err := strconv.ParseInt(f[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		l := dnsmasqLease{MAC: strings.ToLower(f[1]), IP: f[2]}
+		if exp > 0 {
+			l.Expires = time.Unix(exp, 0)
+		}
+		leases = append(leases, l)
+	}
+	return leases
+}
+
+// poolUsage is cfg's pool, with the leases unexpired at now counted.
+func poolUsage(cfg RouterConfig, leases []dnsmasqLease, now time.Time) DHCPPool {
+	start, end := cfg.dhcpRange()
+	reserved := map[int]bool{}
+	for _, r := range cfg.Reservations {
+		if r.Host >= start && r.Host <= end {
+			reserved[r.Host] = true
+		}
+	}
+	p := DHCPPool{
+		Start:    fmt.Sprintf("%s.%d", cfg.SubnetBase, start),
+		End:      fmt.Sprintf("%s.%d", cfg.SubnetBase, end),
+		Reserved: len(reserved),
+		Size:     end - start + 1 - len(reserved),
+	}
+	seen := map[int]bool{}
+	for _, l := range leases {
+		if !l.Expires.IsZero() && !l.Expires.After(now) {
+			continue
+		}
+		host, ok := strings.CutPrefix(l.IP, cfg.SubnetBase+".")
+		if !ok {
+			continue
+		}
+		h, err := strconv.Atoi(host)
+		if err != nil || h < start || h > end || reserved[h] || seen[h] {
+			continue
+		}
+		seen[h] = true
+		p.Active++
+	}
+	if p.Size > 0 {
+		p.UsedPercent = p.Active * 100 / p.Size
+	}
+	return p
+}
+
+// refreshPool reads the lease file into Status.DHCPPool and logs the
+// crossing of poolWarnPercent. ap is the AP being served.
+func (s *WiFi) refreshPool(ap RouterConfig) {
+	data, err := os.ReadFile(s.paths.DnsmasqLeases)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Debug("wifi: could not read dnsmasq leases", "err", err)
+		}
+		data = nil // no leases handed out yet
+	}
+	pool := poolUsage(ap, parseDnsmasqLeases(data), time.Now())
+
+	s.mu.Lock()
+	warned := s.poolWarned
+	s.poolWarned = pool.Full()
+	s.status.DHCPPool = &pool
+	s.mu.Unlock()
+
+	if pool.Full() && !warned {
+		slog.Warn("wifi: DHCP pool nearly full", "active", pool.Active, "size", pool.Size,
+			"range", pool.Start+"-"+pool.End, "used_percent", pool.UsedPercent)
+	}
+}
+
+// poolWarning is the /api/health warning for a nearly full pool; "" if
+// it is not.
+func poolWarning(st Status) string {
+	p := st.DHCPPool
+	if p == nil || !p.Full() {
+		return ""
+	}
+	msg := fmt.Sprintf("wifi: %d of %d DHCP addresses (%s-%s) are in use (%d%%); new devices can't join once they run out",
+		p.Active, p.Size, p.Start, p.End, p.UsedPercent)
+	if st.Mode == ModeRouter {
+		msg += "; widen the range with router.dhcp_start and router.dhcp_end"
+	}
+	return msg
+}
@@ -0,0 +1,192 @@
+package wifi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/config"
+	"github.com/strct-org/strct-agent/internal/errs"
+	"github.com/strct-org/strct-agent/internal/platform/executil"
+)
+
+func dhcpCfg(start, end int, res ...DHCPReservation) WiFiConfig {
+	return WiFiConfig{Mode: ModeRouter, Router: RouterConfig{
+		SSID: "TestNet", Password: "password123", SubnetBase: "192.168.100",
+		DHCPStart: start, DHCPEnd: end, Reservations: res,
+	}}
+}
+
+func TestValidateConfig_DHCPRange(t *testing.T) {
+	tv := DHCPReservation{MAC: "aa:bb:cc:dd:ee:01", Host: 20, Name: "tv"}
+	cases := []struct {
+		name    string
+		cfg     WiFiConfig
+		wantErr string
+	}{
+		{"default range", dhcpCfg(0, 0), ""},
+		{"widened", dhcpCfg(10, 250), ""},
+		{"one address", dhcpCfg(60, 60), ""},
+		{"reversed", dhcpCfg(150, 50), "router.dhcp_start (150) is after router.dhcp_end (50)"},
+		{"end before the default start", dhcpCfg(0, 40), "router.dhcp_start (50) is after router.dhcp_end (40)"},
+		{"over the gateway", dhcpCfg(1, 100), "router.dhcp_start must be between 2 and 254"},
+		{"past the /24", dhcpCfg(50, 255), "router.dhcp_end must be between 2 and 254"},
+		{"reservation outside the range", dhcpCfg(50, 150, tv), ""},
+		{"reservation inside the range", dhcpCfg(10, 150, tv), ""},
+		{"reservation on the gateway", dhcpCfg(0, 0, DHCPReservation{MAC: "aa:bb:cc:dd:ee:01", Host: 1}), "router.reservations[0].host must be between 2 and 254"},
+		{"bad MAC", dhcpCfg(0, 0, DHCPReservation{MAC: "tv", Host: 20}), "router.reservations[0].mac: not a MAC address"},
+		{"bad name", dhcpCfg(0, 0, DHCPReservation{MAC: "aa:bb:cc:dd:ee:01", Host: 20, Name: "living room"}), "not a hostname"},
+		{"same address twice", dhcpCfg(0, 0, tv, DHCPReservation{MAC: "aa:bb:cc:dd:ee:02", Host: 20}), "router.reservations[1].host: .20 is reserved twice"},
+		{"same device twice", dhcpCfg(0, 0, tv, DHCPReservation{MAC: "AA-BB-CC-DD-EE-01", Host: 21}), "router.reservations[1].mac: aa:bb:cc:dd:ee:01 is reserved twice"},
+		{"reservations fill the range", dhcpCfg(20, 21, tv, DHCPReservation{MAC: "aa:bb:cc:dd:ee:02", Host: 21}), "reservations take every address of .20-.21"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := validateConfig(c.cfg)
+			switch {
+			case c.wantErr == "" && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case c.wantErr != "" && (err == nil || !strings.Contains(err.Error(), c.wantErr)):
+				t.Errorf("error = %v, want %q", err, c.wantErr)
+			}
+		})
+	}
+}
+
+func TestHandleSetConfig_ListsEveryProblem(t *testing.T) {
+	svc := New(config.Config{DataDir: t.TempDir()}, &executil.Mock{})
+	svc.paths = testPaths(t)
+	mux := http.NewServeMux()
+	svc.RegisterRoutes(mux)
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("POST", "/api/wifi/config", strings.NewReader(`{"mode":"router","router":{
+		"ssid":"","password":"short","subnet_base":"192.168.100","dhcp_start":150,"dhcp_end":50,
+		"reservations":[{"mac":"tv","host":20},{"mac":"aa:bb:cc:dd:ee:02","host":20,"name":"living room"}]}}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("got %d %s, want 400", w.Code, w.Body)
+	}
+	var resp struct {
+		Error  string            `json:"error"`
+		Errors []errs.FieldError `json:"errors"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range resp.Errors {
+		got = append(got, e.Field+"="+e.Code)
+	}
+	want := "router.ssid=required router.password=too_short router.dhcp_start=conflict " +
+		"router.reservations[0].mac=invalid router.reservations[1].host=duplicate router.reservations[1].name=invalid"
+	if strings.Join(got, " ") != want {
+		t.Errorf("errors = %v, want %s", got, want)
+	}
+	if !strings.Contains(resp.Error, "router.ssid is required; ") {
+		t.Errorf("error = %q", resp.Error)
+	}
+}
+
+func TestRenderDnsmasqConf_RangeAndReservations(t *testing.T) {
+	cfg := dhcpCfg(10, 200, DHCPReservation{MAC: "AA:BB:CC:DD:EE:01", Host: 20, Name: "tv"},
+		DHCPReservation{MAC: "aa:bb:cc:dd:ee:02", Host: 5}).Router
+	got := string(renderDnsmasqConf(cfg, "wlan0"))
+	for _, want := range []string{
+		"dhcp-range=192.168.100.10,192.168.100.200,24h\n",
+		"dhcp-host=aa:bb:cc:dd:ee:01,192.168.100.20,tv\n",
+		"dhcp-host=aa:bb:cc:dd:ee:02,192.168.100.5\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("strct.conf lacks %q:\n%s", want, got)
+		}
+	}
+
+	def := string(renderDnsmasqConf(RouterConfig{SubnetBase: "192.168.100"}, "wlan0"))
+	if !strings.Contains(def, "dhcp-range=192.168.100.50,192.168.100.150,24h\n") || strings.Contains(def, "dhcp-host") {
+		t.Errorf("default strct.conf:\n%s", def)
+	}
+}
+
+const dnsmasqLeasesFixture = `1717416000 aa:bb:cc:dd:ee:01 192.168.100.20 tv *
+1717416000 aa:bb:cc:dd:ee:02 192.168.100.50 Pixel-7 01:aa:bb:cc:dd:ee:02
+1717416000 aa:bb:cc:dd:ee:03 192.168.100.51 * *
+0 aa:bb:cc:dd:ee:04 192.168.100.52 printer *
+1717300000 aa:bb:cc:dd:ee:05 192.168.100.53 expired *
+1717416000 aa:bb:cc:dd:ee:06 192.168.100.160 outside *
+1717416000 aa:bb:cc:dd:ee:07 192.168.1.54 other-subnet *
+garbage
+`
+
+func TestPoolUsage(t *testing.T) {
+	now := time.Unix(1717400000, 0)
+	leases := parseDnsmasqLeases([]byte(dnsmasqLeasesFixture))
+	if len(leases) != 7 || !leases[3].Expires.IsZero() {
+		t.Fatalf("leases = %+v", leases)
+	}
+
+	// Reservations at .20 (outside the range) and .51 (inside it).
+	cfg := dhcpCfg(50, 54,
+		DHCPReservation{MAC: "aa:bb:cc:dd:ee:01", Host: 20},
+		DHCPReservation{MAC: "aa:bb:cc:dd:ee:03", Host: 51}).Router
+	got := poolUsage(cfg, leases, now)
+	want := DHCPPool{Start: "192.168.100.50", End: "192.168.100.54", Size: 4, Reserved: 1, Active: 2, UsedPercent: 50}
+	if got != want {
+		t.Errorf("pool = %+v\nwant %+v", got, want)
+	}
+
+	// The default range, nothing leased.
+	got = poolUsage(RouterConfig{SubnetBase: "192.168.100"}, nil, now)
+	if got.Size != 101 || got.Active != 0 || got.UsedPercent != 0 {
+		t.Errorf("empty pool = %+v", got)
+	}
+}
+
+func TestRefreshPool_WarnsPastThreshold(t *testing.T) {
+	svc := New(config.Config{}, &executil.Mock{})
+	svc.paths = testPaths(t)
+	svc.paths.DnsmasqLeases = filepath.Join(t.TempDir(), "dnsmasq.leases")
+	svc.state = dhcpCfg(50, 53)
+	svc.status = intendedFor(svc.state).status()
+
+	write := func(n int) {
+		var b strings.Builder
+		exp := time.Now().Add(time.Hour).Unix()
+		for i := 0; i < n; i++ {
+			fmt.Fprintf(&b, "%d aa:bb:cc:dd:ee:%02x 192.168.100.%d * *\n", exp, i, 50+i)
+		}
+		if err := os.WriteFile(svc.paths.DnsmasqLeases, []byte(b.String()), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(3) // 75%
+	svc.refreshPool(svc.state.Router)
+	if p := svc.Status().DHCPPool; p == nil || p.Active != 3 || p.Full() {
+		t.Fatalf("pool = %+v", p)
+	}
+	if w := svc.HealthWarnings(); len(w) != 0 {
+		t.Errorf("warnings at 75%%: %v", w)
+	}
+
+	write(4) // 100%
+	svc.refreshPool(svc.state.Router)
+	w := svc.HealthWarnings()
+	if len(w) != 1 || !strings.Contains(w[0], "4 of 4 DHCP addresses") || !strings.Contains(w[0], "router.dhcp_end") {
+		t.Errorf("warnings at 100%%: %v", w)
+	}
+	if !svc.poolWarned {
+		t.Error("the crossing was not recorded")
+	}
+
+	write(1)
+	svc.refreshPool(svc.state.Router)
+	if w := svc.HealthWarnings(); len(w) != 0 || svc.poolWarned {
+		t.Errorf("warnings after dropping back: %v", w)
+	}
+}
@@ -0,0 +1,75 @@
+package wifi
+
+import (
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/apidoc"
+)
+
+// Examples for /api/openapi.json; see RegisterRoutes.
+var (
+	exampleConfig = WiFiConfig{
+		Mode: ModeRouter,
+		Router: RouterConfig{
+			SSID:        "strct",
+			Password:    maskedSecret,
+			Band:        "5GHz",
+			SubnetBase:  "192.168.100",
+			DNSProvider: "cloudflare",
+			MaxClients:  32,
+			Channel:     36,
+			DHCPStart:   50,
+			DHCPEnd:     150,
+			Reservations: []DHCPReservation{
+				{MAC: "a4:2b:b0:00:00:02", Host: 20, Name: "printer"},
+			},
+		},
+		Extender: ExtenderConfig{ExtenderBand: "2.4GHz"},
+	}
+
+	exampleStatus = Status{
+		Mode:         ModeRouter,
+		SSID:         "strct",
+		APInterface:  "wlan0",
+		SubnetBase:   "192.168.100",
+		GatewayIP:    "192.168.100.1",
+		ConnectedIPs: 3,
+		Active:       true,
+		DHCPPool: &DHCPPool{
+			Start: "192.168.100.50", End: "192.168.100.150",
+			Size: 101, Active: 12, UsedPercent: 11,
+		},
+	}
+
+	exampleScan = []ScannedNetwork{
+		{SSID: "Home", Signal: -48, Frequency: "5180", Encrypted: true, MACAddress: "a4:2b:b0:00:00:01"},
+	}
+
+	exampleRendered = RenderedConfig{
+		Which: "current",
+		Mode:  ModeRouter,
+		Files: []RenderedFile{{
+			Name:    fileHostapd,
+			Path:    "/etc/hostapd/hostapd.conf",
+			Content: "interface=wlan0\nssid=strct\nwpa_passphrase=" + maskedSecret + "\n",
+			SHA256:  "9f2c…",
+			Written: &WrittenFile{SHA256: "9f2c…", At: time.Date(2024, 6, 3, 12, 0, 0, 0, time.UTC)},
+		}},
+	}
+
+	exampleAuthFailures = AuthFailures{
+		Watching:      true,
+		Threshold:     authThreshold,
+		WindowSeconds: int(authWindow / time.Second),
+		Stations: []AuthFailure{{
+			MAC: "3c:22:fb:11:22:33", Method: authWPA2, Count: 14, Recent: 12,
+			FirstAt: time.Date(2024, 6, 3, 11, 52, 0, 0, time.UTC),
+			LastAt:  time.Date(2024, 6, 3, 11, 58, 40, 0, time.UTC),
+			Flagged: true,
+		}},
+	}
+
+	exampleApplying = map[string]any{"status": "applying"}
+
+	whichParam = apidoc.Param{Name: "which", Description: "current (the files on disk, the default) or pending (what the saved config renders to)"}
+)
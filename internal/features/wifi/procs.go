@@ -0,0 +1,147 @@
+package wifi
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ─── Daemons wifi starts ─────────────────────────────────────────────────────
+
+// Extender mode runs wpa_supplicant and dhclient on wlan0. Each is started
+// with a pidfile under RunDir, and teardown signals only those PIDs: a
+// multi-homed box may run other instances (NetworkManager's, or one the user
+// started on eth1) that a killall would take down with ours.
+
+// daemonStopTimeout is how long a daemon gets to exit after SIGTERM, and
+// again after SIGKILL, before it is reported as left over. A var so tests
+// don't wait on it.
+var daemonStopTimeout = 3 * time.Second
+
+// daemon is one process wifi starts for an interface.
+type daemon struct {
+	name    string // as in /proc/<pid>/comm
+	iface   string
+	pidfile string
+}
+
+func (d daemon) String() string { return d.name + " on " + d.iface }
+
+func (s *WiFi) wpaSupplicant() daemon {
+	return daemon{"wpa_supplicant", "wlan0", filepath.Join(s.paths.RunDir, "wpa_supplicant-wlan0.pid")}
+}
+
+func (s *WiFi) dhclient() daemon {
+	return daemon{"dhclient", "wlan0", filepath.Join(s.paths.RunDir, "dhclient-wlan0.pid")}
+}
+
+// startWpaSupplicant brings up our wpa_supplicant on wlan0. Only one can
+// drive an interface, so one already there that isn't ours is asked to quit
+// over its own control socket; instances on other interfaces are left alone.
+func (s *WiFi) startWpaSupplicant() error {
+	d := s.wpaSupplicant()
+	if err := s.stopDaemon(d); err != nil {
+		return err
+	}
+	if s.cmd.Run("wpa_cli", "-i", d.iface, "status") == nil {
+		slog.Warn("wifi: stopping wpa_supplicant the agent did not start", "iface", d.iface)
+		s.cmd.Run("wpa_cli", "-i", d.iface, "terminate") //nolint:errcheck
+	}
+	if err := os.MkdirAll(s.paths.RunDir, 0755); err != nil {
+		return err
+	}
+	return s.cmd.Run("wpa_supplicant", "-B", "-i", d.iface, "-c", s.paths.WpaSupplicant, "-P", d.pidfile)
+}
+
+func (s *WiFi) startDhclient() error {
+	d := s.dhclient()
+	if err := s.stopDaemon(d); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.paths.RunDir, 0755); err != nil {
+		return err
+	}
+	return s.cmd.Run("dhclient", "-pf", d.pidfile, d.iface)
+}
+
+// stopDaemons stops every daemon wifi started and returns those still
+// running afterwards.
+func (s *WiFi) stopDaemons() []string {
+	var leftovers []string
+	for _, d := range []daemon{s.dhclient(), s.wpaSupplicant()} {
+		if err := s.stopDaemon(d); err != nil {
+			slog.Error("wifi: daemon did not stop", "daemon", d.name, "iface", d.iface, "err", err)
+			leftovers = append(leftovers, err.Error())
+		}
+	}
+	return leftovers
+}
+
+// stopDaemon stops the process in d's pidfile: SIGTERM, then SIGKILL if it
+// hasn't exited within daemonStopTimeout. A missing or stale pidfile means
+// there is nothing of ours to stop. The error names a process that survived.
+func (s *WiFi) stopDaemon(d daemon) error {
+	pid, ok := s.pidOf(d)
+	if !ok {
+		os.Remove(d.pidfile) //nolint:errcheck
+		return nil
+	}
+	for _, sig := range []string{"-TERM", "-KILL"} {
+		s.cmd.Run("kill", sig, strconv.Itoa(pid)) //nolint:errcheck
+		if s.waitExit(pid) {
+			os.Remove(d.pidfile) //nolint:errcheck
+			return nil
+		}
+	}
+	return fmt.Errorf("%s (pid %d) still running", d, pid)
+}
+
+// pidOf reads d's pidfile and reports the PID if that process is still d.
+// PIDs are reused, so a live PID running something else counts as stale.
+func (s *WiFi) pidOf(d daemon) (int, bool) {
+	b, err := os.ReadFile(d.pidfile)
+	if err != nil {
+		return 0, false
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil || pid <= 0 {
+		return 0, false
+	}
+	comm, err := os.ReadFile(filepath.Join(s.paths.Proc, strconv.Itoa(pid), "comm"))
+	if err != nil || strings.TrimSpace(string(comm)) != d.name {
+		return 0, false
+	}
+	return pid, true
+}
+
+// waitExit polls until pid is gone or daemonStopTimeout passes.
+func (s *WiFi) waitExit(pid int) bool {
+	dir := filepath.Join(s.paths.Proc, strconv.Itoa(pid))
+	deadline := time.Now().Add(daemonStopTimeout)
+	for {
+		if _, err := os.Stat(dir); os.IsNotExist(err) || isZombie(dir) {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// isZombie reports whether the process at dir has exited but not been
+// reaped. wpa_supplicant -B and dhclient daemonise, so this only shows up
+// briefly, but a zombie can't be signalled any further.
+func isZombie(dir string) bool {
+	b, err := os.ReadFile(filepath.Join(dir, "stat"))
+	if err != nil {
+		return false
+	}
+	// pid (comm) state ... — comm may itself contain ") ".
+	i := strings.LastIndexByte(string(b), ')')
+	return i >= 0 && strings.HasPrefix(strings.TrimSpace(string(b[i+1:])), "Z")
+}
@@ -0,0 +1,166 @@
+package wifi
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/config"
+	"github.com/strct-org/strct-agent/internal/platform/executil"
+)
+
+// procRunner is a Mock whose kill makes the process disappear from the
+// fake /proc, unless it is stubborn.
+type procRunner struct {
+	*executil.Mock
+	proc     string
+	stubborn map[int]bool
+}
+
+func (r *procRunner) Run(name string, args ...string) error {
+	err := r.Mock.Run(name, args...)
+	if name == "kill" && len(args) == 2 {
+		if pid, _ := strconv.Atoi(args[1]); !r.stubborn[pid] {
+			os.RemoveAll(filepath.Join(r.proc, args[1]))
+		}
+	}
+	return err
+}
+
+func newProcWiFi(t *testing.T) (*WiFi, *procRunner) {
+	t.Helper()
+	old := daemonStopTimeout
+	daemonStopTimeout = 10 * time.Millisecond
+	t.Cleanup(func() { daemonStopTimeout = old })
+
+	paths := testPaths(t)
+	r := &procRunner{Mock: &executil.Mock{}, proc: paths.Proc, stubborn: map[int]bool{}}
+	svc := New(config.Config{}, r)
+	svc.paths = paths
+	return svc, r
+}
+
+// fakeProcess puts pid in the fake /proc running comm, and, when pidfile
+// is set, records it there as a daemon wifi started.
+func fakeProcess(t *testing.T, svc *WiFi, pid int, comm, pidfile string) {
+	t.Helper()
+	dir := filepath.Join(svc.paths.Proc, strconv.Itoa(pid))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "comm"), []byte(comm+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if pidfile == "" {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(pidfile), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(pidfile, []byte(strconv.Itoa(pid)+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func assertNoKillall(t *testing.T, m *executil.Mock) {
+	t.Helper()
+	for _, c := range m.Calls {
+		if c.Name == "killall" || c.Name == "pkill" {
+			t.Errorf("issued %q: may kill daemons the agent did not start", c)
+		}
+	}
+}
+
+func TestTeardown_StopsOnlyOwnDaemons(t *testing.T) {
+	svc, r := newProcWiFi(t)
+	fakeProcess(t, svc, 100, "wpa_supplicant", svc.wpaSupplicant().pidfile)
+	fakeProcess(t, svc, 101, "dhclient", svc.dhclient().pidfile)
+	fakeProcess(t, svc, 200, "wpa_supplicant", "") // NetworkManager's, on eth1
+	fakeProcess(t, svc, 201, "dhclient", "")
+
+	svc.teardown()
+
+	r.AssertCalled(t, "kill -TERM 100")
+	r.AssertCalled(t, "kill -TERM 101")
+	for _, pid := range []string{"200", "201"} {
+		r.AssertNotCalled(t, "kill -TERM "+pid)
+		r.AssertNotCalled(t, "kill -KILL "+pid)
+	}
+	assertNoKillall(t, r.Mock)
+	for _, d := range []daemon{svc.wpaSupplicant(), svc.dhclient()} {
+		if _, err := os.Stat(d.pidfile); !os.IsNotExist(err) {
+			t.Errorf("%s pidfile kept", d)
+		}
+	}
+	if st := svc.Status(); st.Leftovers != nil {
+		t.Errorf("leftovers = %v", st.Leftovers)
+	}
+}
+
+func TestTeardown_StalePidfile(t *testing.T) {
+	svc, r := newProcWiFi(t)
+	// The PID was reused by something else since our wpa_supplicant exited.
+	fakeProcess(t, svc, 100, "sshd", svc.wpaSupplicant().pidfile)
+
+	svc.teardown()
+
+	if len(r.Calls) == 0 {
+		t.Fatal("teardown ran nothing")
+	}
+	for _, c := range r.Calls {
+		if c.Name == "kill" {
+			t.Errorf("issued %q for a stale pidfile", c)
+		}
+	}
+	if _, err := os.Stat(svc.wpaSupplicant().pidfile); !os.IsNotExist(err) {
+		t.Error("stale pidfile kept")
+	}
+}
+
+func TestTeardown_ReportsLeftovers(t *testing.T) {
+	svc, r := newProcWiFi(t)
+	fakeProcess(t, svc, 100, "wpa_supplicant", svc.wpaSupplicant().pidfile)
+	r.stubborn[100] = true
+
+	svc.teardown()
+
+	r.AssertCalled(t, "kill -TERM 100")
+	r.AssertCalled(t, "kill -KILL 100")
+	st := svc.Status()
+	if len(st.Leftovers) != 1 || st.Leftovers[0] != "wpa_supplicant on wlan0 (pid 100) still running" {
+		t.Errorf("leftovers = %v", st.Leftovers)
+	}
+
+	r.stubborn[100] = false
+	svc.teardown()
+	if st := svc.Status(); st.Leftovers != nil {
+		t.Errorf("leftovers after a clean teardown = %v", st.Leftovers)
+	}
+}
+
+func TestApplyExtender_ManagesDaemonsByPidfile(t *testing.T) {
+	for _, foreign := range []bool{false, true} {
+		svc, r := newProcWiFi(t)
+		svc.state = WiFiConfig{Mode: ModeExtender, Extender: ExtenderConfig{
+			UpstreamSSID: "Home", UpstreamPassword: "password123",
+			ExtenderSSID: "Ext", ExtenderPassword: "password123", ExtenderBand: "5GHz",
+		}}
+		if !foreign {
+			r.Expect("wpa_cli -i wlan0 status", executil.MockResult{Err: os.ErrNotExist})
+		}
+
+		if err := svc.apply(); err != nil {
+			t.Fatalf("apply: %v", err)
+		}
+
+		wpa, dh := svc.wpaSupplicant(), svc.dhclient()
+		r.AssertCalled(t, "wpa_supplicant -B -i wlan0 -c "+svc.paths.WpaSupplicant+" -P "+wpa.pidfile)
+		r.AssertCalled(t, "dhclient -pf "+dh.pidfile+" wlan0")
+		if got := r.WasCalled("wpa_cli -i wlan0 terminate"); got != foreign {
+			t.Errorf("foreign=%v: wpa_cli terminate called = %v", foreign, got)
+		}
+		assertNoKillall(t, r.Mock)
+	}
+}
@@ -0,0 +1,363 @@
+package wifi
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/strct-org/strct-agent/internal/platform/firewall"
+)
+
+// StatusDegraded is set as Status.Error when reconciliation could not bring
+// the system back in line with the persisted config.
+const StatusDegraded = "degraded — reconciliation needed"
+
+// ─── Intended vs observed ────────────────────────────────────────────────────
+
+// intended is what the persisted WiFiConfig says the live system should
+// look like, flattened to the handful of facts reconciliation checks.
+type intended struct {
+	Mode         Mode
+	APIface      string
+	WANIface     string
+	UpstreamSSID string
+	AP           RouterConfig // what hostapd and dnsmasq should be serving
+}
+
+func intendedFor(cfg WiFiConfig) intended {
+	switch cfg.Mode {
+	case ModeRouter:
+		return intended{Mode: ModeRouter, APIface: "wlan0", WANIface: "eth0", AP: cfg.Router}
+	case ModeExtender:
+		ap := "wlan0_ap"
+		if cfg.Extender.UseSecondRadio {
+			ap = "wlan1"
+		}
+		return intended{
+			Mode:         ModeExtender,
+			APIface:      ap,
+			WANIface:     "wlan0",
+			UpstreamSSID: cfg.Extender.UpstreamSSID,
+			AP:           extenderAPConfig(cfg.Extender),
+		}
+	}
+	return intended{Mode: ModeOff}
+}
+
+func (i intended) gatewayCIDR() string { return i.AP.SubnetBase + ".1/24" }
+
+// status is the Status a fully applied config reports.
+func (i intended) status() Status {
+	return Status{
+		Mode:         i.Mode,
+		Active:       true,
+		SSID:         i.AP.SSID,
+		APInterface:  i.APIface,
+		SubnetBase:   i.AP.SubnetBase,
+		GatewayIP:    i.AP.SubnetBase + ".1",
+		UpstreamSSID: i.UpstreamSSID,
+	}
+}
+
+// observed is the live system as reported by the inspection commands.
+// Every field is filled by one of the pure parse helpers below so the
+// whole reconciliation matrix can be tested without a radio.
+type observed struct {
+	HostapdActive bool
+	DnsmasqActive bool
+	HostapdConf   []byte   // nil when the file is missing
+	APAddrs       []string // CIDRs on the AP interface
+	NATPresent    bool
+	IPForward     bool
+}
+
+// Mismatch is one check where the live system differs from the config.
+type Mismatch struct {
+	Check string `json:"check"`
+	Want  string `json:"want"`
+	Got   string `json:"got"`
+}
+
+func (m Mismatch) String() string {
+	return fmt.Sprintf("%s: want %s, got %s", m.Check, m.Want, m.Got)
+}
+
+const (
+	checkHostapdConf   = "hostapd_conf"
+	checkHostapdActive = "hostapd_active"
+	checkGatewayIP     = "gateway_ip"
+	checkDnsmasqActive = "dnsmasq_active"
+	checkIPForward     = "ip_forward"
+	checkNATRule       = "nat_rule"
+	checkDnsmasqConf   = "dnsmasq_conf" // only from reapply; see rendered.go
+)
+
+// diffState compares want against got and lists every mismatch, in the
+// order apply would have set things up.
+func diffState(want intended, got observed) []Mismatch {
+	if want.Mode == ModeOff {
+		return nil
+	}
+	var out []Mismatch
+	if reason := hostapdConfMismatch(got.HostapdConf, want.APIface, want.AP.SSID); reason != "" {
+		out = append(out, Mismatch{checkHostapdConf, "strct-agent config for " + want.AP.SSID + " on " + want.APIface, reason})
+	}
+	if !got.HostapdActive {
+		out = append(out, Mismatch{checkHostapdActive, "active", "inactive"})
+	}
+	if !containsString(got.APAddrs, want.gatewayCIDR()) {
+		have := "none"
+		if len(got.APAddrs) > 0 {
+			have = strings.Join(got.APAddrs, ",")
+		}
+		out = append(out, Mismatch{checkGatewayIP, want.gatewayCIDR() + " on " + want.APIface, have})
+	}
+	if !got.DnsmasqActive {
+		out = append(out, Mismatch{checkDnsmasqActive, "active", "inactive"})
+	}
+	if !got.IPForward {
+		out = append(out, Mismatch{checkIPForward, "1", "0"})
+	}
+	if !got.NATPresent {
+		out = append(out, Mismatch{checkNATRule, "MASQUERADE on " + want.WANIface, "missing"})
+	}
+	return out
+}
+
+// ─── Pure parsers ────────────────────────────────────────────────────────────
+
+// parseServiceActive reads `systemctl is-active <unit>` stdout. The command
+// exits non-zero for anything but active, so callers ignore its error.
+func parseServiceActive(out []byte) bool {
+	return strings.TrimSpace(string(out)) == "active"
+}
+
+// parseInetAddrs extracts the IPv4 CIDRs from `ip -4 -o addr show dev X`:
+//
+//	3: wlan0    inet 192.168.100.1/24 brd 192.168.100.255 scope global wlan0\ ...
+func parseInetAddrs(out []byte) []string {
+	var addrs []string
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		for i := 0; i+1 < len(fields); i++ {
+			if fields[i] == "inet" {
+				addrs = append(addrs, fields[i+1])
+				break
+			}
+		}
+	}
+	return addrs
+}
+
+// parseSysctlFlag reads `sysctl -n <key>` stdout for a 0/1 key.
+func parseSysctlFlag(out []byte) bool {
+	return strings.TrimSpace(string(out)) == "1"
+}
+
+// parseNATPresent reports whether `iptables -t nat -S POSTROUTING` lists
+// the MASQUERADE rule wifi adds for wanIface.
+func parseNATPresent(out []byte, wanIface string) bool {
+	want := "-A POSTROUTING " + strings.Join(natRules("", wanIface)[0].spec, " ")
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.TrimSpace(line) == want {
+			return true
+		}
+	}
+	return false
+}
+
+// hostapdConfMismatch returns "" when conf is the file writeHostapdConf
+// generates for iface/ssid, or a short reason when it isn't.
+func hostapdConfMismatch(conf []byte, iface, ssid string) string {
+	if conf == nil {
+		return "missing"
+	}
+	text := string(conf)
+	if !strings.HasPrefix(text, "# Generated by strct-agent") {
+		return "not generated by strct-agent"
+	}
+	kv := map[string]string{}
+	for _, line := range strings.Split(text, "\n") {
+		if k, v, ok := strings.Cut(strings.TrimSpace(line), "="); ok {
+			kv[k] = v
+		}
+	}
+	if kv["interface"] != iface {
+		return "interface=" + kv["interface"]
+	}
+	if kv["ssid"] != ssid {
+		return "ssid=" + kv["ssid"]
+	}
+	return ""
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// ─── Repair ──────────────────────────────────────────────────────────────────
+
+type repairAction int
+
+const (
+	repairWriteHostapdConf repairAction = iota
+	repairRestartHostapd
+	repairSetGatewayIP
+	repairRestartDnsmasq
+	repairEnableForwarding
+	repairAddNATRules
+)
+
+// repairPlan turns mismatches into the minimal ordered set of actions that
+// fixes them. Restarting hostapd can drop the interface address, so it
+// always re-assigns the gateway IP afterwards, same as apply does.
+func repairPlan(mismatches []Mismatch) []repairAction {
+	need := map[repairAction]bool{}
+	for _, m := range mismatches {
+		switch m.Check {
+		case checkHostapdConf:
+			need[repairWriteHostapdConf] = true
+			need[repairRestartHostapd] = true
+			need[repairSetGatewayIP] = true
+		case checkHostapdActive:
+			need[repairRestartHostapd] = true
+			need[repairSetGatewayIP] = true
+		case checkGatewayIP:
+			need[repairSetGatewayIP] = true
+		case checkDnsmasqActive, checkDnsmasqConf:
+			need[repairRestartDnsmasq] = true
+		case checkIPForward:
+			need[repairEnableForwarding] = true
+		case checkNATRule:
+			need[repairAddNATRules] = true
+		}
+	}
+	var plan []repairAction
+	for a := repairWriteHostapdConf; a <= repairAddNATRules; a++ {
+		if need[a] {
+			plan = append(plan, a)
+		}
+	}
+	return plan
+}
+
+// inspect gathers the observed state through the runner. All parsing is
+// delegated to the pure helpers above.
+func (s *WiFi) inspect(want intended) observed {
+	var got observed
+
+	out, _ := s.cmd.Output("systemctl", "is-active", "hostapd")
+	got.HostapdActive = parseServiceActive(out)
+	out, _ = s.cmd.Output("systemctl", "is-active", "dnsmasq")
+	got.DnsmasqActive = parseServiceActive(out)
+
+	if conf, err := os.ReadFile(s.paths.Hostapd); err == nil {
+		got.HostapdConf = conf
+	}
+
+	out, _ = s.cmd.Output("ip", "-4", "-o", "addr", "show", "dev", want.APIface)
+	got.APAddrs = parseInetAddrs(out)
+
+	out, _ = s.cmd.Output("sysctl", "-n", "net.ipv4.ip_forward")
+	got.IPForward = parseSysctlFlag(out)
+
+	out, _ = s.cmd.Output("iptables", "-t", "nat", "-S", "POSTROUTING")
+	got.NATPresent = parseNATPresent(out, want.WANIface)
+
+	return got
+}
+
+func (s *WiFi) runRepair(want intended, a repairAction) error {
+	switch a {
+	case repairWriteHostapdConf:
+		return s.writeHostapdConf(want.AP, want.APIface, s.paths.Hostapd)
+	case repairRestartHostapd:
+		return s.cmd.Run("systemctl", "restart", "hostapd")
+	case repairSetGatewayIP:
+		s.cmd.Run("ip", "addr", "flush", "dev", want.APIface) //nolint:errcheck
+		if err := s.cmd.Run("ip", "addr", "add", want.gatewayCIDR(), "dev", want.APIface); err != nil {
+			return err
+		}
+		return s.cmd.Run("ip", "link", "set", want.APIface, "up")
+	case repairRestartDnsmasq:
+		if err := s.writeDnsmasqConf(want.AP, want.APIface); err != nil {
+			return err
+		}
+		return s.cmd.Run("systemctl", "restart", "dnsmasq")
+	case repairEnableForwarding:
+		return s.cmd.Run("sysctl", "-w", "net.ipv4.ip_forward=1")
+	case repairAddNATRules:
+		for _, r := range natRules(want.APIface, want.WANIface) {
+			if err := firewall.EnsureRule(s.cmd, r.table, r.chain, r.spec...); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// reconcile runs once at start. An agent restart leaves hostapd, dnsmasq
+// and the NAT rules in whatever state the previous process (or a reboot)
+// left them, so instead of tearing everything down and re-applying we
+// inspect, repair only what differs, and inspect again. Anything still
+// wrong is reported through Status rather than hidden.
+func (s *WiFi) reconcile() {
+	s.mu.RLock()
+	cfg := s.state
+	s.mu.RUnlock()
+
+	want := intendedFor(cfg)
+	if want.Mode == ModeOff {
+		return
+	}
+
+	// Dev runners stub every command, so there is nothing real to inspect.
+	if s.cfg.IsDev {
+		if err := s.apply(); err != nil {
+			slog.Warn("wifi: dev apply failed", "err", err)
+		}
+		return
+	}
+	defer s.notifyApplied()
+
+	mismatches := diffState(want, s.inspect(want))
+	if len(mismatches) == 0 {
+		s.mu.Lock()
+		s.status = want.status()
+		s.mu.Unlock()
+		slog.Info("wifi: reconciled, no changes needed", "mode", want.Mode)
+		return
+	}
+
+	slog.Warn("wifi: live state differs from config, repairing", "mismatches", len(mismatches))
+	op := s.ops.Begin("wifi", "reconcile")
+	for _, a := range repairPlan(mismatches) {
+		if err := s.runRepair(want, a); err != nil {
+			slog.Warn("wifi: repair step failed", "step", a, "err", err)
+		}
+	}
+
+	remaining := diffState(want, s.inspect(want))
+	st := want.status()
+	if len(remaining) > 0 {
+		st.Error = StatusDegraded
+		for _, m := range remaining {
+			st.Mismatches = append(st.Mismatches, m.String())
+		}
+		slog.Error("wifi: reconciliation incomplete", "mismatches", st.Mismatches)
+		op.Finish(fmt.Errorf("reconciliation incomplete: %s", strings.Join(st.Mismatches, "; ")), s.generatedConfs()...)
+	} else {
+		slog.Info("wifi: reconciled", "mode", want.Mode, "repaired", len(mismatches))
+		op.Finish(nil)
+	}
+
+	s.mu.Lock()
+	s.status = st
+	s.mu.Unlock()
+}
@@ -0,0 +1,218 @@
+package wifi
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/strct-org/strct-agent/internal/config"
+	"github.com/strct-org/strct-agent/internal/platform/executil"
+)
+
+const (
+	ipAddrWlan0  = "3: wlan0    inet 192.168.100.1/24 brd 192.168.100.255 scope global wlan0\\       valid_lft forever preferred_lft forever\n"
+	natSWithMasq = "-P POSTROUTING ACCEPT\n-A POSTROUTING -o eth0 -j MASQUERADE\n"
+)
+
+func routerIntended() intended {
+	return intendedFor(WiFiConfig{
+		Mode: ModeRouter,
+		Router: RouterConfig{
+			SSID: "TestNet", Password: "password123",
+			SubnetBase: "192.168.100", DNSProvider: "cloudflare",
+		},
+	})
+}
+
+func hostapdConfFor(iface, ssid string) []byte {
+	return []byte("# Generated by strct-agent\ninterface=" + iface + "\ndriver=nl80211\nssid=" + ssid + "\n")
+}
+
+func healthyObserved() observed {
+	return observed{
+		HostapdActive: true,
+		DnsmasqActive: true,
+		HostapdConf:   hostapdConfFor("wlan0", "TestNet"),
+		APAddrs:       []string{"192.168.100.1/24"},
+		NATPresent:    true,
+		IPForward:     true,
+	}
+}
+
+func TestDiffState_Matrix(t *testing.T) {
+	tests := []struct {
+		name   string
+		mutate func(*observed)
+		want   []string
+	}{
+		{"healthy", func(*observed) {}, nil},
+		{"hostapd stopped", func(o *observed) { o.HostapdActive = false }, []string{checkHostapdActive}},
+		{"conf missing", func(o *observed) { o.HostapdConf = nil }, []string{checkHostapdConf}},
+		{"conf foreign", func(o *observed) { o.HostapdConf = []byte("interface=wlan0\nssid=TestNet\n") }, []string{checkHostapdConf}},
+		{"conf other ssid", func(o *observed) { o.HostapdConf = hostapdConfFor("wlan0", "Other") }, []string{checkHostapdConf}},
+		{"gateway missing", func(o *observed) { o.APAddrs = nil }, []string{checkGatewayIP}},
+		{"gateway wrong", func(o *observed) { o.APAddrs = []string{"10.0.0.5/24"} }, []string{checkGatewayIP}},
+		{"dnsmasq stopped", func(o *observed) { o.DnsmasqActive = false }, []string{checkDnsmasqActive}},
+		{"forwarding off", func(o *observed) { o.IPForward = false }, []string{checkIPForward}},
+		{"nat missing", func(o *observed) { o.NATPresent = false }, []string{checkNATRule}},
+		{"after reboot", func(o *observed) { *o = observed{HostapdConf: o.HostapdConf} }, []string{
+			checkHostapdActive, checkGatewayIP, checkDnsmasqActive, checkIPForward, checkNATRule,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := healthyObserved()
+			tt.mutate(&got)
+
+			var checks []string
+			for _, m := range diffState(routerIntended(), got) {
+				checks = append(checks, m.Check)
+			}
+			if !reflect.DeepEqual(checks, tt.want) {
+				t.Errorf("checks = %v, want %v", checks, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiffState_ModeOffNeverMismatches(t *testing.T) {
+	if got := diffState(intendedFor(WiFiConfig{Mode: ModeOff}), observed{}); got != nil {
+		t.Errorf("diffState(off) = %v, want nil", got)
+	}
+}
+
+func TestParsers(t *testing.T) {
+	if got := parseInetAddrs([]byte(ipAddrWlan0)); !reflect.DeepEqual(got, []string{"192.168.100.1/24"}) {
+		t.Errorf("parseInetAddrs = %v", got)
+	}
+	if got := parseInetAddrs(nil); got != nil {
+		t.Errorf("parseInetAddrs(nil) = %v, want nil", got)
+	}
+	if !parseServiceActive([]byte("active\n")) || parseServiceActive([]byte("inactive\n")) {
+		t.Error("parseServiceActive misread systemctl output")
+	}
+	if !parseSysctlFlag([]byte("1\n")) || parseSysctlFlag([]byte("0\n")) {
+		t.Error("parseSysctlFlag misread sysctl output")
+	}
+	if !parseNATPresent([]byte(natSWithMasq), "eth0") {
+		t.Error("parseNATPresent missed eth0 MASQUERADE")
+	}
+	if parseNATPresent([]byte(natSWithMasq), "wlan0") {
+		t.Error("parseNATPresent matched the wrong WAN interface")
+	}
+}
+
+func TestRepairPlan(t *testing.T) {
+	tests := []struct {
+		name   string
+		checks []string
+		want   []repairAction
+	}{
+		{"nothing", nil, nil},
+		{"nat only", []string{checkNATRule}, []repairAction{repairAddNATRules}},
+		{"hostapd restart reassigns ip", []string{checkHostapdActive},
+			[]repairAction{repairRestartHostapd, repairSetGatewayIP}},
+		{"conf and active restart once", []string{checkHostapdConf, checkHostapdActive, checkGatewayIP},
+			[]repairAction{repairWriteHostapdConf, repairRestartHostapd, repairSetGatewayIP}},
+		{"order follows apply", []string{checkNATRule, checkIPForward, checkDnsmasqActive},
+			[]repairAction{repairRestartDnsmasq, repairEnableForwarding, repairAddNATRules}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mm []Mismatch
+			for _, c := range tt.checks {
+				mm = append(mm, Mismatch{Check: c})
+			}
+			if got := repairPlan(mm); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("repairPlan = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// newReconcileService returns a router-mode service whose live system looks
+// healthy apart from whatever the test overrides on m.
+func newReconcileService(t *testing.T, m *executil.Mock) *WiFi {
+	t.Helper()
+	svc := New(config.Config{}, m)
+	svc.paths = testPaths(t)
+	svc.state = WiFiConfig{Mode: ModeRouter, Router: routerIntended().AP}
+	if err := os.WriteFile(svc.paths.Hostapd, hostapdConfFor("wlan0", "TestNet"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	m.Expect("systemctl is-active hostapd", executil.MockResult{Output: []byte("active\n")})
+	m.Expect("systemctl is-active dnsmasq", executil.MockResult{Output: []byte("active\n")})
+	m.Expect("ip -4 -o addr show dev wlan0", executil.MockResult{Output: []byte(ipAddrWlan0)})
+	m.Expect("sysctl -n net.ipv4.ip_forward", executil.MockResult{Output: []byte("1\n")})
+	m.Expect("iptables -t nat -S POSTROUTING", executil.MockResult{Output: []byte(natSWithMasq)})
+	return svc
+}
+
+func TestReconcile_HealthyTouchesNothing(t *testing.T) {
+	m := &executil.Mock{}
+	svc := newReconcileService(t, m)
+
+	svc.reconcile()
+
+	m.AssertNotCalled(t, "systemctl restart hostapd")
+	m.AssertNotCalled(t, "systemctl stop hostapd")
+	st := svc.Status()
+	if !st.Active || st.Error != "" || st.GatewayIP != "192.168.100.1" {
+		t.Errorf("status = %+v, want active router with no error", st)
+	}
+}
+
+func TestReconcile_RepairsOnlyDelta(t *testing.T) {
+	m := &executil.Mock{}
+	svc := newReconcileService(t, m)
+	m.Expect("sysctl -n net.ipv4.ip_forward", executil.MockResult{Output: []byte("0\n")})
+
+	svc.reconcile()
+
+	m.AssertCalled(t, "sysctl -w net.ipv4.ip_forward=1")
+	m.AssertNotCalled(t, "systemctl restart hostapd")
+	m.AssertNotCalled(t, "systemctl restart dnsmasq")
+	m.AssertNotCalled(t, "ip addr flush dev wlan0")
+}
+
+func TestReconcile_NotifiesOnApply(t *testing.T) {
+	m := &executil.Mock{}
+	svc := newReconcileService(t, m)
+	calls := 0
+	svc.OnApply(func() {
+		calls++
+		if svc.Status().APInterface != "wlan0" {
+			t.Error("hook ran before status was updated")
+		}
+	})
+
+	svc.reconcile()
+
+	if calls != 1 {
+		t.Errorf("OnApply hook ran %d times, want 1", calls)
+	}
+}
+
+func TestReconcile_UnfixableMarksDegraded(t *testing.T) {
+	m := &executil.Mock{}
+	svc := newReconcileService(t, m)
+	// The mock keeps reporting no MASQUERADE rule after the repair, like a
+	// kernel without the nat table would.
+	m.Expect("iptables -t nat -S POSTROUTING", executil.MockResult{Output: []byte("-P POSTROUTING ACCEPT\n")})
+
+	svc.reconcile()
+
+	st := svc.Status()
+	if st.Error != StatusDegraded {
+		t.Fatalf("status.Error = %q, want %q", st.Error, StatusDegraded)
+	}
+	if len(st.Mismatches) != 1 || st.Mismatches[0] != "nat_rule: want MASQUERADE on eth0, got missing" {
+		t.Errorf("status.Mismatches = %v", st.Mismatches)
+	}
+
+	// refreshStatus must not clear a degraded status.
+	svc.refreshStatus()
+	if svc.Status().Error != StatusDegraded {
+		t.Error("refreshStatus cleared the degraded status")
+	}
+}
@@ -0,0 +1,304 @@
+package wifi
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/agent"
+	"github.com/strct-org/strct-agent/internal/audit"
+	"github.com/strct-org/strct-agent/internal/httputil"
+	"github.com/strct-org/strct-agent/internal/statefile"
+)
+
+// ─── Rendered configs ────────────────────────────────────────────────────────
+
+// wifi keeps the SHA-256 of every hostapd.conf and strct.conf it writes,
+// in DataDir/wifi-rendered.json, so a file changed by hand since shows as
+// drift:
+//
+//	GET  /api/wifi/rendered-config?which=current   the files on disk
+//	GET  /api/wifi/rendered-config?which=pending   what the saved config renders to
+//	POST /api/wifi/rendered-config/reapply         rewrite drifted files, restart their daemons
+//
+// Passphrases are masked as in GET /api/wifi/config. While the AP is up,
+// drift adds a warning to /api/health. The router feature writes its own
+// hostapd.conf for its radio settings, which shows up as drift too.
+const (
+	fileHostapd = "hostapd"
+	fileDnsmasq = "dnsmasq"
+
+	renderedFile = "wifi-rendered.json"
+)
+
+var renderedSchema = statefile.Schema{
+	Name:       "wifi-rendered",
+	Migrations: []statefile.Migration{statefile.Stamp},
+}
+
+// renderedState is wifi-rendered.json.
+type renderedState struct {
+	Files map[string]WrittenFile `json:"files"`
+}
+
+// WrittenFile is a generated file as wifi last wrote it.
+type WrittenFile struct {
+	SHA256 string    `json:"sha256"`
+	At     time.Time `json:"at"`
+}
+
+// RenderedFile is one generated file: its content, masked, and how the
+// file on disk compares to what wifi last wrote.
+type RenderedFile struct {
+	Name    string `json:"name"` // hostapd | dnsmasq
+	Path    string `json:"path"`
+	Content string `json:"content"` // "" when current and missing
+
+	// The file on disk. SHA256 is "" when it is missing.
+	SHA256  string     `json:"sha256,omitempty"`
+	ModTime *time.Time `json:"mtime,omitempty"`
+
+	// Written is nil until wifi wrote the file. Drift is set when the file
+	// on disk no longer is what it wrote.
+	Written *WrittenFile `json:"written,omitempty"`
+	Drift   bool         `json:"drift"`
+
+	// Changed is set, for pending, when the rendered file differs from
+	// the one on disk.
+	Changed bool `json:"changed,omitempty"`
+}
+
+// RenderedConfig is GET /api/wifi/rendered-config.
+type RenderedConfig struct {
+	Which string         `json:"which"` // current | pending
+	Mode  Mode           `json:"mode"`
+	Files []RenderedFile `json:"files"` // pending: none while off
+	Drift bool           `json:"drift"`
+}
+
+func (s *WiFi) renderedPath() string {
+	if s.cfg.DataDir == "" {
+		return ""
+	}
+	return filepath.Join(s.cfg.DataDir, renderedFile)
+}
+
+func (s *WiFi) confPath(name string) string {
+	if name == fileHostapd {
+		return s.paths.Hostapd
+	}
+	return s.paths.Dnsmasq
+}
+
+// loadWritten restores what wifi last wrote.
+func (s *WiFi) loadWritten() error {
+	path := s.renderedPath()
+	if path == "" {
+		return nil
+	}
+	var st renderedState
+	if err := statefile.Load(path, renderedSchema, &st); err != nil {
+		if statefile.Fresh(err) {
+			return nil
+		}
+		return fmt.Errorf("load %s: %w", renderedFile, err)
+	}
+	s.mu.Lock()
+	s.written = st.Files
+	s.mu.Unlock()
+	return nil
+}
+
+// wrote records that the generated file name now holds content.
+func (s *WiFi) wrote(name string, content []byte) {
+	sum := sha256.Sum256(content)
+	s.mu.Lock()
+	if s.written == nil {
+		s.written = map[string]WrittenFile{}
+	}
+	s.written[name] = WrittenFile{SHA256: hex.EncodeToString(sum[:]), At: time.Now().UTC()}
+	written := maps.Clone(s.written)
+	s.mu.Unlock()
+
+	if path := s.renderedPath(); path != "" {
+		if err := statefile.Save(path, renderedSchema, renderedState{Files: written}); err != nil {
+			slog.Warn("wifi: could not save the generated configs' checksums", "err", err)
+		}
+	}
+}
+
+// onDisk describes the generated file name as it is on disk.
+func (s *WiFi) onDisk(name string) (RenderedFile, []byte) {
+	f := RenderedFile{Name: name, Path: s.confPath(name)}
+	content, err := os.ReadFile(f.Path)
+	if err == nil {
+		sum := sha256.Sum256(content)
+		f.SHA256 = hex.EncodeToString(sum[:])
+		if info, err := os.Stat(f.Path); err == nil {
+			t := info.ModTime().UTC()
+			f.ModTime = &t
+		}
+	}
+	s.mu.RLock()
+	if w, ok := s.written[name]; ok {
+		f.Written = &w
+		f.Drift = w.SHA256 != f.SHA256
+	}
+	s.mu.RUnlock()
+	return f, content
+}
+
+// renderedConfig reports the files on disk, or with pending, what the
+// saved config renders to.
+func (s *WiFi) renderedConfig(pending bool) RenderedConfig {
+	s.mu.RLock()
+	want := intendedFor(s.state)
+	s.mu.RUnlock()
+
+	out := RenderedConfig{Which: "current", Mode: want.Mode, Files: []RenderedFile{}}
+	if pending {
+		out.Which = "pending"
+	}
+	for _, name := range []string{fileHostapd, fileDnsmasq} {
+		f, content := s.onDisk(name)
+		out.Drift = out.Drift || f.Drift
+		if pending {
+			if want.Mode == ModeOff {
+				continue
+			}
+			disk := f.SHA256
+			content = want.render(name)
+			sum := sha256.Sum256(content)
+			f.Changed = hex.EncodeToString(sum[:]) != disk
+		}
+		f.Content = maskConf(content)
+		out.Files = append(out.Files, f)
+	}
+	return out
+}
+
+// render is the generated file name for the intended config.
+func (i intended) render(name string) []byte {
+	if name == fileHostapd {
+		return renderHostapdConf(i.AP, i.APIface)
+	}
+	return renderDnsmasqConf(i.AP, i.APIface)
+}
+
+// HealthWarnings reports a nearly full DHCP pool, generated files
+// changed outside the agent, and stations that keep failing to join,
+// while the AP is up.
+func (s *WiFi) HealthWarnings() []string {
+	s.mu.RLock()
+	mode := s.state.Mode
+	s.mu.RUnlock()
+	if mode == ModeOff {
+		return nil
+	}
+	var warnings []string
+	if w := poolWarning(s.Status()); w != "" {
+		warnings = append(warnings, w)
+	}
+	for _, name := range []string{fileHostapd, fileDnsmasq} {
+		if f, _ := s.onDisk(name); f.Drift {
+			what := "was changed"
+			if f.SHA256 == "" {
+				what = "was removed"
+			}
+			warnings = append(warnings, fmt.Sprintf("wifi: %s %s outside the agent since it wrote it at %s; POST /api/wifi/rendered-config/reapply restores it",
+				f.Path, what, f.Written.At.Format(time.RFC3339)))
+		}
+	}
+	return append(warnings, s.authWarnings()...)
+}
+
+// Health reports the mode and whether it came up. In router mode the
+// device is the network's gateway, so the AP being down is critical.
+func (s *WiFi) Health() agent.ComponentHealth {
+	st := s.Status()
+	h := agent.ComponentHealth{Name: "wifi", Status: agent.HealthOK, Critical: st.Mode == ModeRouter}
+	switch {
+	case st.Mode == ModeOff || st.Mode == "": // "" before the first reconcile
+		h.Message = "off"
+	case st.Error == StatusDegraded:
+		h.Status = agent.HealthDegraded
+		h.Message = fmt.Sprintf("%s mode, live state differs from the config: %s", st.Mode, strings.Join(st.Mismatches, "; "))
+	case st.Error != "":
+		h.Status, h.Message = agent.HealthDown, fmt.Sprintf("%s mode: %s", st.Mode, st.Error)
+	case !st.Active:
+		h.Status, h.Message = agent.HealthDegraded, fmt.Sprintf("%s mode, not up yet", st.Mode)
+	default:
+		h.Message = fmt.Sprintf("%s mode on %s, %d devices connected", st.Mode, st.APInterface, st.ConnectedIPs)
+	}
+	return h
+}
+
+// handleRenderedConfig reports the generated files.
+// GET /api/wifi/rendered-config?which=current|pending
+func (s *WiFi) handleRenderedConfig(w http.ResponseWriter, r *http.Request) {
+	switch which := r.URL.Query().Get("which"); which {
+	case "", "current":
+		httputil.OK(w, s.renderedConfig(false))
+	case "pending":
+		httputil.OK(w, s.renderedConfig(true))
+	default:
+		httputil.BadRequest(w, "which must be current or pending, not "+which)
+	}
+}
+
+// handleReapply rewrites the drifted files from the saved config and
+// restarts their daemons, as reconcile would.
+// POST /api/wifi/rendered-config/reapply
+func (s *WiFi) handleReapply(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	want := intendedFor(s.state)
+	s.mu.RUnlock()
+	if want.Mode == ModeOff {
+		httputil.Error(w, http.StatusConflict, "wifi is off: nothing to reapply")
+		return
+	}
+
+	var mismatches []Mismatch
+	var names []string
+	for _, f := range s.renderedConfig(false).Files {
+		if !f.Drift {
+			continue
+		}
+		names = append(names, f.Name)
+		check := checkHostapdConf
+		if f.Name == fileDnsmasq {
+			check = checkDnsmasqConf
+		}
+		mismatches = append(mismatches, Mismatch{check, "as written", "changed"})
+	}
+	audit.Target(r.Context(), strings.Join(names, ","))
+	if len(mismatches) == 0 {
+		httputil.OK(w, s.renderedConfig(false))
+		return
+	}
+
+	slog.Info("wifi: reapplying generated configs", "files", names)
+	op := s.ops.Begin("wifi", "reapply")
+	var errs []error
+	for _, a := range repairPlan(mismatches) {
+		if err := s.runRepair(want, a); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	err := errors.Join(errs...)
+	op.Finish(err, s.generatedConfs()...)
+	s.notifyApplied()
+	if err != nil {
+		httputil.InternalError(w, "reapply: "+err.Error())
+		return
+	}
+	httputil.OK(w, s.renderedConfig(false))
+}
@@ -0,0 +1,181 @@
+package wifi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/strct-org/strct-agent/internal/agent"
+	"github.com/strct-org/strct-agent/internal/config"
+	"github.com/strct-org/strct-agent/internal/platform/executil"
+)
+
+func newRouterService(t *testing.T, dataDir string) (*WiFi, *executil.Mock, *http.ServeMux) {
+	t.Helper()
+	m := &executil.Mock{}
+	svc := New(config.Config{DataDir: dataDir}, m)
+	svc.paths = testPaths(t)
+	svc.state.Mode = ModeRouter
+	svc.state.Router.Password = "hunter2hunter2"
+	mux := http.NewServeMux()
+	svc.RegisterRoutes(mux)
+	return svc, m, mux
+}
+
+func getRendered(t *testing.T, mux *http.ServeMux, which string) RenderedConfig {
+	t.Helper()
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/api/wifi/rendered-config?which="+which, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET %s: %d %s", which, w.Code, w.Body)
+	}
+	var rc RenderedConfig
+	if err := json.Unmarshal(w.Body.Bytes(), &rc); err != nil {
+		t.Fatal(err)
+	}
+	return rc
+}
+
+func TestRenderedConfig_MasksAndFlagsDrift(t *testing.T) {
+	dataDir := t.TempDir()
+	svc, _, mux := newRouterService(t, dataDir)
+
+	// Nothing written yet: pending has both files, current neither.
+	rc := getRendered(t, mux, "pending")
+	if len(rc.Files) != 2 || !rc.Files[0].Changed || rc.Drift {
+		t.Fatalf("pending before apply = %+v", rc)
+	}
+	if err := svc.applyRouter(); err != nil {
+		t.Fatal(err)
+	}
+
+	rc = getRendered(t, mux, "current")
+	hostapd := rc.Files[0]
+	if hostapd.Name != fileHostapd || hostapd.SHA256 == "" || hostapd.ModTime == nil || hostapd.Written == nil || hostapd.Drift {
+		t.Fatalf("hostapd = %+v", hostapd)
+	}
+	if strings.Contains(hostapd.Content, "hunter2") || !strings.Contains(hostapd.Content, "wpa_passphrase="+maskedSecret) {
+		t.Errorf("passphrase not masked:\n%s", hostapd.Content)
+	}
+	if rc := getRendered(t, mux, "pending"); rc.Files[0].Changed || rc.Files[1].Changed {
+		t.Errorf("pending differs from what was just applied: %+v", rc)
+	}
+
+	// Edited by hand; a restart still knows what wifi wrote.
+	os.WriteFile(svc.paths.Dnsmasq, []byte("# mine\n"), 0644) //nolint:errcheck
+	paths := svc.paths
+	svc, _, mux = newRouterService(t, dataDir)
+	svc.paths = paths
+	if err := svc.loadWritten(); err != nil {
+		t.Fatal(err)
+	}
+	rc = getRendered(t, mux, "current")
+	if !rc.Drift || rc.Files[0].Drift || !rc.Files[1].Drift || rc.Files[1].Content != "# mine\n" {
+		t.Errorf("after a hand edit: %+v", rc)
+	}
+	if w := svc.HealthWarnings(); len(w) != 1 || !strings.Contains(w[0], "strct.conf was changed outside the agent") {
+		t.Errorf("warnings = %v", w)
+	}
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/api/wifi/rendered-config?which=both", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("which=both: %d", w.Code)
+	}
+}
+
+func TestReapply_RestoresOnlyDriftedFiles(t *testing.T) {
+	svc, m, mux := newRouterService(t, t.TempDir())
+	if err := svc.applyRouter(); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(svc.paths.Hostapd) //nolint:errcheck
+	if w := svc.HealthWarnings(); len(w) != 1 || !strings.Contains(w[0], "hostapd.conf was removed") {
+		t.Errorf("warnings = %v", w)
+	}
+	*m = executil.Mock{}
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("POST", "/api/wifi/rendered-config/reapply", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("reapply: %d %s", w.Code, w.Body)
+	}
+	var rc RenderedConfig
+	json.Unmarshal(w.Body.Bytes(), &rc) //nolint:errcheck
+	if rc.Drift || svc.HealthWarnings() != nil {
+		t.Errorf("still drifting after reapply: %+v", rc)
+	}
+	m.AssertCalled(t, "systemctl restart hostapd")
+	m.AssertCalled(t, "ip addr add 192.168.100.1/24 dev wlan0")
+	m.AssertNotCalled(t, "systemctl restart dnsmasq")
+
+	svc.state.Mode = ModeOff
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("POST", "/api/wifi/rendered-config/reapply", nil))
+	if w.Code != http.StatusConflict {
+		t.Errorf("reapply while off: %d", w.Code)
+	}
+}
+
+func TestConfig_PassphrasesMaskedAndKept(t *testing.T) {
+	svc, _, mux := newRouterService(t, t.TempDir())
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/api/wifi/config", nil))
+	var cfg WiFiConfig
+	json.Unmarshal(w.Body.Bytes(), &cfg) //nolint:errcheck
+	if cfg.Router.Password != maskedSecret || cfg.Extender.UpstreamPassword != "" {
+		t.Fatalf("GET /api/wifi/config = %+v", cfg)
+	}
+
+	// Posted back as it came, the passphrase stays. Off, so the apply
+	// that follows has nothing to write.
+	cfg.Mode, cfg.Router.SSID = ModeOff, "Renamed"
+	body, _ := json.Marshal(cfg)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("POST", "/api/wifi/config", strings.NewReader(string(body))))
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST: %d %s", w.Code, w.Body)
+	}
+	svc.mu.RLock()
+	got := svc.state.Router
+	svc.mu.RUnlock()
+	if got.SSID != "Renamed" || got.Password != "hunter2hunter2" {
+		t.Errorf("stored router config = %+v", got)
+	}
+}
+
+func TestMaskConf(t *testing.T) {
+	in := "ssid=Home\nwpa_passphrase=secret123\nnetwork={\n    psk=\"secret123\"\n}\n"
+	want := "ssid=Home\nwpa_passphrase=" + maskedSecret + "\nnetwork={\n    psk=\"" + maskedSecret + "\"\n}\n"
+	if got := maskConf([]byte(in)); got != want {
+		t.Errorf("maskConf = %q, want %q", got, want)
+	}
+}
+
+func TestHealth_FollowsTheMode(t *testing.T) {
+	svc := New(config.Config{}, &executil.Mock{})
+	if h := svc.Health(); h.Status != agent.HealthOK || h.Message != "off" || h.Critical {
+		t.Errorf("off: %+v", h)
+	}
+
+	svc.state = dhcpCfg(0, 0)
+	svc.status = intendedFor(svc.state).status()
+	svc.status.Active = true
+	svc.status.ConnectedIPs = 3
+	if h := svc.Health(); h.Status != agent.HealthOK || !h.Critical || h.Message != "router mode on wlan0, 3 devices connected" {
+		t.Errorf("router up: %+v", h)
+	}
+
+	svc.status.Error, svc.status.Mismatches = StatusDegraded, []string{"hostapd not running"}
+	if h := svc.Health(); h.Status != agent.HealthDegraded || !strings.Contains(h.Message, "hostapd not running") {
+		t.Errorf("degraded: %+v", h)
+	}
+
+	svc.status.Error = "hostapd: could not configure wlan0"
+	if h := svc.Health(); h.Status != agent.HealthDown || !h.Critical {
+		t.Errorf("apply failed: %+v", h)
+	}
+}
@@ -0,0 +1,57 @@
+package wifi
+
+import (
+	"fmt"
+	"log/slog"
+	"path/filepath"
+
+	"github.com/strct-org/strct-agent/internal/statefile"
+)
+
+// configSchema versions wifi-config.json.
+//
+//	v1: WiFiConfig as-is
+var configSchema = statefile.Schema{
+	Name:       "wifi-config",
+	Migrations: []statefile.Migration{statefile.Stamp},
+}
+
+// configPath is where the last config accepted by POST /api/wifi/config is
+// kept. It is the "intended" side of the startup reconciliation.
+func (s *WiFi) configPath() string {
+	return filepath.Join(s.cfg.DataDir, "wifi-config.json")
+}
+
+// loadConfig restores the persisted config into s.state. A missing file is
+// the normal first-boot case and leaves the defaults from New in place.
+func (s *WiFi) loadConfig() error {
+	var cfg WiFiConfig
+	if err := statefile.Load(s.configPath(), configSchema, &cfg); err != nil {
+		if statefile.Fresh(err) {
+			return nil
+		}
+		return fmt.Errorf("load wifi config: %w", err)
+	}
+	if err := validateConfig(cfg); err != nil {
+		return fmt.Errorf("load wifi config: %w", err)
+	}
+
+	s.mu.Lock()
+	s.state = cfg
+	s.mu.Unlock()
+
+	slog.Info("wifi: config restored", "path", s.configPath(), "mode", cfg.Mode)
+	return nil
+}
+
+// saveConfig writes the current intended config to disk.
+func (s *WiFi) saveConfig() error {
+	s.mu.RLock()
+	cfg := s.state
+	s.mu.RUnlock()
+
+	if err := statefile.Save(s.configPath(), configSchema, cfg); err != nil {
+		return fmt.Errorf("save wifi config: %w", err)
+	}
+	return nil
+}
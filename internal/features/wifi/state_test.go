@@ -0,0 +1,72 @@
+package wifi
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/strct-org/strct-agent/internal/config"
+	"github.com/strct-org/strct-agent/internal/platform/executil"
+)
+
+func TestLoadConfig_MigratesUnversionedFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "wifi-config.json")
+	legacy := `{"mode":"router","router":{"ssid":"TestNet","password":"password123","band":"5GHz","subnet_base":"192.168.100","dns_provider":"cloudflare"}}`
+	if err := os.WriteFile(path, []byte(legacy), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	svc := New(config.Config{DataDir: dir}, &executil.Mock{})
+	if err := svc.loadConfig(); err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if svc.state.Mode != ModeRouter || svc.state.Router.SSID != "TestNet" {
+		t.Errorf("restored %+v", svc.state)
+	}
+	b, _ := os.ReadFile(path)
+	if !strings.Contains(string(b), `"schema_version": 1`) {
+		t.Errorf("file not stamped with schema_version: %s", b)
+	}
+}
+
+func TestLoadConfig_CorruptFileKeepsDefaults(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "wifi-config.json")
+	os.WriteFile(path, []byte("\x00\x00\x00"), 0600) // power cut mid-write on an old build
+
+	svc := New(config.Config{DataDir: dir}, &executil.Mock{})
+	before := svc.state
+	if err := svc.loadConfig(); err != nil {
+		t.Fatalf("corrupt config must not fail wifi: %v", err)
+	}
+	if !reflect.DeepEqual(svc.state, before) {
+		t.Errorf("state changed to %+v", svc.state)
+	}
+	if moved, _ := filepath.Glob(path + ".corrupt-*"); len(moved) != 1 {
+		t.Errorf("quarantined files = %v", moved)
+	}
+}
+
+func TestNew_ConfiguredDefaultsUntilSaved(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config.Config{DataDir: dir, WiFiSSID: "Fleet", WiFiPassword: "fleetpass1", WiFiBand: "5GHz", WiFiChannel: 36}
+	svc := New(cfg, &executil.Mock{})
+	r := svc.state.Router
+	if r.SSID != "Fleet" || r.Password != "fleetpass1" || r.Band != "5GHz" || r.Channel != 36 || svc.state.Extender.ExtenderSSID != "Fleet-Ext" {
+		t.Errorf("defaults %+v, extender %+v", r, svc.state.Extender)
+	}
+
+	// A config saved on the device wins over them.
+	saved := `{"schema_version":1,"mode":"router","router":{"ssid":"Home","password":"password123","band":"2.4GHz","subnet_base":"192.168.100","dns_provider":"cloudflare"}}`
+	os.WriteFile(filepath.Join(dir, "wifi-config.json"), []byte(saved), 0600)
+	svc = New(cfg, &executil.Mock{})
+	if err := svc.loadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if svc.state.Router.SSID != "Home" {
+		t.Errorf("restored SSID %q, want the saved one", svc.state.Router.SSID)
+	}
+}
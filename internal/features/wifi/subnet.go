@@ -0,0 +1,365 @@
+package wifi
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Subnet conflicts. An AP subnet that overlaps the upstream network (the
+// ISP router handing out 192.168.100.0/24 to eth0 while we serve the same
+// /24 on wlan0) routes some destinations back into the AP and the rest out:
+// "some sites work, some don't". So:
+//
+//   - POST /api/wifi/config looks up the upstream network of the mode's WAN
+//     interface — its live address from `ip -j -4 addr`, or dhclient's
+//     newest unexpired lease when it has none yet — and rejects an AP
+//     subnet that overlaps it with 422, suggesting a free RFC1918 /24.
+//   - In extender mode the upstream can change under us (another network,
+//     a router reset), so the check re-runs with the status refresh and
+//     flips Status to degraded while the conflict lasts.
+//
+// There is no guest network in the tree yet; once there is, its subnet
+// needs the same check in detectConflict.
+const checkSubnetConflict = "subnet_conflict"
+
+// SubnetConflict is an AP subnet that overlaps the upstream network.
+type SubnetConflict struct {
+	Field     string `json:"field"`     // the config field to change, e.g. "router.subnet_base"
+	APSubnet  string `json:"ap_subnet"` // e.g. "192.168.100.0/24"
+	Upstream  string `json:"upstream"`  // e.g. "192.168.100.0/24"
+	Iface     string `json:"upstream_iface"`
+	Source    string `json:"source"`                          // sourceAddr or sourceLease
+	Suggested string `json:"suggested_subnet_base,omitempty"` // e.g. "192.168.101"
+}
+
+// Where an upstream network was learnt from.
+const (
+	sourceAddr  = "ip addr"
+	sourceLease = "dhclient lease"
+)
+
+func (c SubnetConflict) String() string {
+	msg := fmt.Sprintf("%s %s overlaps the upstream network %s on %s", c.Field, c.APSubnet, c.Upstream, c.Iface)
+	if c.Suggested != "" {
+		msg += fmt.Sprintf("; use %s %s instead", c.Field, c.Suggested)
+	}
+	return msg
+}
+
+func (c SubnetConflict) mismatch() Mismatch {
+	return Mismatch{checkSubnetConflict, "AP subnet outside " + c.Upstream + " on " + c.Iface, c.APSubnet}
+}
+
+// ─── Pure helpers ────────────────────────────────────────────────────────────
+
+// ifaceAddr is one IPv4 address on an interface.
+type ifaceAddr struct {
+	Iface  string
+	Prefix netip.Prefix // the address with its prefix length, e.g. 192.168.1.23/24
+}
+
+// parseIPAddrJSON reads `ip -j -4 addr`:
+//
+//	[{"ifname":"eth0","addr_info":[{"family":"inet","local":"192.168.1.23","prefixlen":24}]}]
+func parseIPAddrJSON(out []byte) ([]ifaceAddr, error) {
+	if len(strings.TrimSpace(string(out))) == 0 {
+		return nil, nil
+	}
+	var links []struct {
+		IfName   string `json:"ifname"`
+		AddrInfo []struct {
+			Family    string `json:"family"`
+			Local     string `json:"local"`
+			PrefixLen int    `json:"prefixlen"`
+		} `json:"addr_info"`
+	}
+	if err := json.Unmarshal(out, &links); err != nil {
+		return nil, fmt.Errorf("parse ip -j addr: %w", err)
+	}
+	var addrs []ifaceAddr
+	for _, l := range links {
+		for _, a := range l.AddrInfo {
+			ip, err := netip.ParseAddr(a.Local)
+			if a.Family != "inet" || err != nil || !ip.Is4() || a.PrefixLen < 1 || a.PrefixLen > 32 {
+				continue
+			}
+			addrs = append(addrs, ifaceAddr{l.IfName, netip.PrefixFrom(ip, a.PrefixLen)})
+		}
+	}
+	return addrs, nil
+}
+
+// parseLease returns the network of the newest lease for iface in a
+// dhclient.leases file that hasn't expired at now:
+//
+//	lease {
+//	  interface "wlan0";
+//	  fixed-address 192.168.1.23;
+//	  option subnet-mask 255.255.255.0;
+//	  expire 5 2026/10/16 21:48:11;
+//	}
+//
+// Expiry times are UTC, or "epoch N" with db-time-format local. A lease
+// without a subnet mask is taken as a /24.
+func parseLease(data []byte, iface string, now time.Time) (netip.Prefix, bool) {
+	var (
+		found       netip.Prefix
+		ok, inLease bool
+		cur         struct {
+			iface  string
+			ip     netip.Addr
+			bits   int
+			expire time.Time
+		}
+	)
+	for _, line := range strings.Split(string(data), "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		line = strings.TrimSuffix(strings.TrimSpace(line), ";")
+		switch {
+		case strings.HasPrefix(line, "lease {"):
+			inLease = true
+			cur.iface, cur.ip, cur.bits, cur.expire = "", netip.Addr{}, 24, time.Time{}
+		case line == "}" && inLease:
+			inLease = false
+			if cur.iface == iface && cur.ip.Is4() && cur.bits > 0 && (cur.expire.IsZero() || cur.expire.After(now)) {
+				found, ok = netip.PrefixFrom(cur.ip, cur.bits), true
+			}
+		case !inLease:
+		case strings.HasPrefix(line, "interface "):
+			cur.iface = strings.Trim(strings.TrimPrefix(line, "interface "), `"`)
+		case strings.HasPrefix(line, "fixed-address "):
+			cur.ip, _ = netip.ParseAddr(strings.TrimPrefix(line, "fixed-address "))
+		case strings.HasPrefix(line, "option subnet-mask "):
+			if mask, err := netip.ParseAddr(strings.TrimPrefix(line, "option subnet-mask ")); err == nil && mask.Is4() {
+				cur.bits = maskBits(mask)
+			}
+		case strings.HasPrefix(line, "expire "):
+			cur.expire = parseLeaseTime(strings.Fields(strings.TrimPrefix(line, "expire ")))
+		}
+	}
+	return found, ok
+}
+
+// parseLeaseTime reads "5 2026/10/16 21:48:11" or "epoch 1792187291". A
+// time it can't read is zero, which parseLease takes as not expired.
+func parseLeaseTime(f []string) time.Time {
+	if len(f) >= 2 && f[0] == "epoch" {
+		if n, err := strconv.ParseInt(f[1], 10, 64); err == nil {
+			return time.Unix(n, 0)
+		}
+	}
+	if len(f) >= 3 {
+		if t, err := time.Parse("2006/01/02 15:04:05", f[1]+" "+f[2]); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func maskBits(mask netip.Addr) int {
+	b := mask.As4()
+	n := 0
+	for _, octet := range b {
+		for ; octet&0x80 != 0; octet <<= 1 {
+			n++
+		}
+	}
+	return n
+}
+
+// upstreamNet is the network on the WAN side of the AP.
+type upstreamNet struct {
+	Iface  string
+	Prefix netip.Prefix // masked
+	Source string
+}
+
+// upstreamNets returns wan's networks: its live addresses, or the lease
+// when it has none. Addresses on apIface are ours — wlan0 still carries
+// the router gateway until an extender apply replaces it — not upstream.
+func upstreamNets(wan, apIface string, addrs []ifaceAddr, lease netip.Prefix, hasLease bool) []upstreamNet {
+	var nets []upstreamNet
+	if wan != apIface {
+		for _, a := range addrs {
+			if a.Iface == wan {
+				nets = append(nets, upstreamNet{wan, a.Prefix.Masked(), sourceAddr})
+			}
+		}
+	}
+	if len(nets) == 0 && hasLease {
+		nets = append(nets, upstreamNet{wan, lease.Masked(), sourceLease})
+	}
+	return nets
+}
+
+// subnetPrefix turns a SubnetBase like "192.168.100" into its /24.
+func subnetPrefix(base string) (netip.Prefix, error) {
+	ip, err := netip.ParseAddr(base + ".0")
+	if err != nil || !ip.Is4() || strings.Count(base, ".") != 2 {
+		return netip.Prefix{}, fmt.Errorf("%q is not the first three octets of an IPv4 /24", base)
+	}
+	p := netip.PrefixFrom(ip, 24)
+	if !ip.IsPrivate() {
+		return p, fmt.Errorf("%s is not a private (RFC 1918) network", p)
+	}
+	return p, nil
+}
+
+// findConflict returns the first upstream network ap overlaps.
+func findConflict(ap netip.Prefix, ups []upstreamNet) (upstreamNet, bool) {
+	for _, u := range ups {
+		if ap.Overlaps(u.Prefix) {
+			return u, true
+		}
+	}
+	return upstreamNet{}, false
+}
+
+// suggestSubnetBase returns the first RFC 1918 /24 clear of every network
+// in taken: 192.168.100-254, then 192.168.2-99 (0 and 1 are what most
+// routers ship with), then 10.100-254.0. "" if all of them are taken.
+func suggestSubnetBase(taken []netip.Prefix) string {
+	var candidates []string
+	for i := 100; i <= 254; i++ {
+		candidates = append(candidates, fmt.Sprintf("192.168.%d", i))
+	}
+	for i := 2; i < 100; i++ {
+		candidates = append(candidates, fmt.Sprintf("192.168.%d", i))
+	}
+	for i := 100; i <= 254; i++ {
+		candidates = append(candidates, fmt.Sprintf("10.%d.0", i))
+	}
+next:
+	for _, base := range candidates {
+		p, _ := subnetPrefix(base)
+		for _, t := range taken {
+			if p.Overlaps(t) {
+				continue next
+			}
+		}
+		return base
+	}
+	return ""
+}
+
+// apSubnet is the config field holding the AP subnet of cfg's mode and
+// that subnet.
+func apSubnet(cfg WiFiConfig) (field, base string) {
+	if cfg.Mode == ModeExtender {
+		return "extender.subnet_base", extenderAPConfig(cfg.Extender).SubnetBase
+	}
+	return "router.subnet_base", cfg.Router.SubnetBase
+}
+
+// detectConflict is the whole check over already-gathered facts: cfg's AP
+// subnet against the networks upstream of it. The suggestion stays clear
+// of those, of every local address and of both modes' AP subnets.
+func detectConflict(cfg WiFiConfig, apIface string, addrs []ifaceAddr, lease netip.Prefix, hasLease bool) *SubnetConflict {
+	want := intendedFor(cfg)
+	if want.Mode == ModeOff {
+		return nil
+	}
+	field, base := apSubnet(cfg)
+	ap, err := subnetPrefix(base)
+	if err != nil {
+		return nil // validateConfig's job
+	}
+	ups := upstreamNets(want.WANIface, apIface, addrs, lease, hasLease)
+	u, ok := findConflict(ap, ups)
+	if !ok {
+		return nil
+	}
+
+	taken := []netip.Prefix{ap}
+	for _, a := range addrs {
+		taken = append(taken, a.Prefix.Masked())
+	}
+	for _, u := range ups {
+		taken = append(taken, u.Prefix)
+	}
+	for _, b := range []string{cfg.Router.SubnetBase, extenderAPConfig(cfg.Extender).SubnetBase} {
+		if p, err := subnetPrefix(b); err == nil {
+			taken = append(taken, p)
+		}
+	}
+	return &SubnetConflict{
+		Field:     field,
+		APSubnet:  ap.String(),
+		Upstream:  u.Prefix.String(),
+		Iface:     u.Iface,
+		Source:    u.Source,
+		Suggested: suggestSubnetBase(taken),
+	}
+}
+
+// ─── Live check ──────────────────────────────────────────────────────────────
+
+// subnetConflict gathers the addresses and the lease and runs
+// detectConflict. apIface is the interface currently serving our AP.
+// When neither command nor lease tells anything, there is no conflict.
+func (s *WiFi) subnetConflict(cfg WiFiConfig, apIface string) *SubnetConflict {
+	out, err := s.cmd.Output("ip", "-j", "-4", "addr")
+	if err != nil {
+		slog.Debug("wifi: could not list addresses", "err", err)
+	}
+	addrs, err := parseIPAddrJSON(out)
+	if err != nil {
+		slog.Warn("wifi: subnet check", "err", err)
+	}
+	var (
+		lease    netip.Prefix
+		hasLease bool
+	)
+	if data, err := os.ReadFile(s.paths.Leases); err == nil {
+		lease, hasLease = parseLease(data, intendedFor(cfg).WANIface, time.Now())
+	}
+	return detectConflict(cfg, apIface, addrs, lease, hasLease)
+}
+
+// checkSubnets re-runs the conflict check in extender mode and records
+// the result in Status.
+func (s *WiFi) checkSubnets() {
+	s.mu.RLock()
+	cfg, st := s.state, s.status
+	s.mu.RUnlock()
+	if cfg.Mode != ModeExtender || !st.Active {
+		return
+	}
+
+	c := s.subnetConflict(cfg, st.APInterface)
+	switch {
+	case c != nil && st.SubnetConflict == nil:
+		slog.Error("wifi: AP subnet overlaps the upstream network", "conflict", c.String())
+	case c == nil && st.SubnetConflict != nil:
+		slog.Info("wifi: subnet conflict cleared")
+	}
+
+	s.mu.Lock()
+	s.status.setSubnetConflict(c)
+	s.mu.Unlock()
+}
+
+// setSubnetConflict records c, or its absence, in st: a conflict is one
+// more mismatch of a degraded status.
+func (st *Status) setSubnetConflict(c *SubnetConflict) {
+	st.SubnetConflict = c
+	var kept []string
+	for _, m := range st.Mismatches {
+		if !strings.HasPrefix(m, checkSubnetConflict+":") {
+			kept = append(kept, m)
+		}
+	}
+	st.Mismatches = kept
+	if c != nil {
+		st.Mismatches = append(st.Mismatches, c.mismatch().String())
+		st.Error = StatusDegraded
+	} else if len(kept) == 0 && st.Error == StatusDegraded {
+		st.Error = ""
+	}
+}
@@ -0,0 +1,198 @@
+package wifi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/config"
+	"github.com/strct-org/strct-agent/internal/platform/executil"
+)
+
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	b, err := os.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestParseIPAddrJSON(t *testing.T) {
+	addrs, err := parseIPAddrJSON(readFixture(t, "ip-addr-router.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ifaceAddr{
+		{"lo", netip.MustParsePrefix("127.0.0.1/8")},
+		{"eth0", netip.MustParsePrefix("192.168.100.57/24")},
+		{"wlan0", netip.MustParsePrefix("192.168.100.1/24")},
+		{"docker0", netip.MustParsePrefix("172.17.0.1/16")},
+		{"tailscale0", netip.MustParsePrefix("100.101.102.103/32")},
+	}
+	if !reflect.DeepEqual(addrs, want) {
+		t.Errorf("addrs = %v", addrs)
+	}
+	if addrs, err := parseIPAddrJSON(nil); addrs != nil || err != nil {
+		t.Errorf("parseIPAddrJSON(nil) = %v, %v", addrs, err)
+	}
+	if _, err := parseIPAddrJSON([]byte("Object \"-j\" is unknown")); err == nil {
+		t.Error("parseIPAddrJSON accepted non-JSON output")
+	}
+}
+
+func TestParseLease(t *testing.T) {
+	leases := readFixture(t, "dhclient.leases")
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		iface string
+		now   time.Time
+		want  string
+	}{
+		{"wlan0", now, "192.168.200.41/24"}, // the newest; the 10.20.0.77 one expired
+		{"eth0", now, "192.168.1.23/24"},
+		{"eth0", now.Add(12 * time.Hour), ""},
+		{"wlan0", now.Add(24 * time.Hour), ""},
+		{"wlan1", now, ""},
+	} {
+		got, ok := parseLease(leases, tt.iface, tt.now)
+		if (tt.want == "") == ok || (ok && got.String() != tt.want) {
+			t.Errorf("%s at %s: got %v %v, want %q", tt.iface, tt.now, got, ok, tt.want)
+		}
+	}
+}
+
+func TestDetectConflict(t *testing.T) {
+	router, _ := parseIPAddrJSON(readFixture(t, "ip-addr-router.json"))
+	extender, _ := parseIPAddrJSON(readFixture(t, "ip-addr-extender.json"))
+	routerCfg := func(base string) WiFiConfig {
+		return WiFiConfig{Mode: ModeRouter, Router: RouterConfig{SubnetBase: base}}
+	}
+	extenderCfg := WiFiConfig{Mode: ModeExtender, Router: RouterConfig{SubnetBase: "192.168.100"}}
+	lease := netip.MustParsePrefix("192.168.200.41/24")
+
+	for _, tt := range []struct {
+		name      string
+		cfg       WiFiConfig
+		apIface   string
+		addrs     []ifaceAddr
+		hasLease  bool
+		want      string // upstream, "" for no conflict
+		source    string
+		suggested string
+	}{
+		{"router on the ISP's subnet", routerCfg("192.168.100"), "wlan0", router, false, "192.168.100.0/24", sourceAddr, "192.168.101"},
+		{"router clear", routerCfg("192.168.150"), "wlan0", router, false, "", "", ""},
+		{"upstream /16", routerCfg("192.168.150"), "", []ifaceAddr{{"eth0", netip.MustParsePrefix("192.168.3.9/16")}}, false, "192.168.0.0/16", sourceAddr, "10.100.0"},
+		{"extender, upstream moved onto the AP", extenderCfg, "wlan0_ap", extender, false, "192.168.200.0/23", sourceAddr, "192.168.101"},
+		// Switching from router mode: wlan0 still is the AP, so only the
+		// lease says what the upstream is.
+		{"extender from router mode", extenderCfg, "wlan0", router, true, "192.168.200.0/24", sourceLease, "192.168.101"},
+		{"extender, no upstream yet", extenderCfg, "wlan0", router, false, "", "", ""},
+		{"off", WiFiConfig{Mode: ModeOff}, "", router, true, "", "", ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c := detectConflict(tt.cfg, tt.apIface, tt.addrs, lease, tt.hasLease)
+			if tt.want == "" {
+				if c != nil {
+					t.Fatalf("conflict %+v, want none", c)
+				}
+				return
+			}
+			if c == nil || c.Upstream != tt.want || c.Source != tt.source || c.Suggested != tt.suggested {
+				t.Fatalf("conflict = %+v, want upstream %s from %s, suggestion %s", c, tt.want, tt.source, tt.suggested)
+			}
+		})
+	}
+}
+
+func TestSuggestSubnetBase(t *testing.T) {
+	var taken []netip.Prefix
+	if got := suggestSubnetBase(taken); got != "192.168.100" {
+		t.Errorf("nothing taken: %s", got)
+	}
+	taken = append(taken, netip.MustParsePrefix("192.168.100.0/22"), netip.MustParsePrefix("192.168.104.0/24"))
+	if got := suggestSubnetBase(taken); got != "192.168.105" {
+		t.Errorf("100-104 taken: %s", got)
+	}
+	taken = append(taken, netip.MustParsePrefix("192.168.0.0/16"), netip.MustParsePrefix("10.0.0.0/8"))
+	if got := suggestSubnetBase(taken); got != "" {
+		t.Errorf("everything taken: %s", got)
+	}
+}
+
+func TestHandleSetConfig_RejectsSubnetConflict(t *testing.T) {
+	m := &executil.Mock{}
+	m.Expect("ip -j -4 addr", executil.MockResult{Output: readFixture(t, "ip-addr-router.json")})
+	svc := New(config.Config{DataDir: t.TempDir()}, m)
+	svc.paths = testPaths(t)
+	svc.status = Status{Mode: ModeRouter, Active: true, APInterface: "wlan0"}
+	mux := http.NewServeMux()
+	svc.RegisterRoutes(mux)
+	post := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("POST", "/api/wifi/config", strings.NewReader(body)))
+		return w
+	}
+
+	w := post(`{"mode":"router","router":{"ssid":"TestNet","password":"password123","subnet_base":"192.168.100"}}`)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("got %d %s, want 422", w.Code, w.Body)
+	}
+	var resp struct {
+		Error    string         `json:"error"`
+		Conflict SubnetConflict `json:"conflict"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Conflict.Field != "router.subnet_base" || resp.Conflict.Iface != "eth0" || resp.Conflict.Suggested != "192.168.101" ||
+		!strings.Contains(resp.Error, "use router.subnet_base 192.168.101") {
+		t.Errorf("response = %+v", resp)
+	}
+	if svc.state.Mode != ModeOff {
+		t.Errorf("rejected config was stored: %+v", svc.state)
+	}
+
+	for _, base := range []string{"8.8.8", "192.168", "192.168.300"} {
+		if w := post(`{"mode":"router","router":{"ssid":"TestNet","password":"password123","subnet_base":"` + base + `"}}`); w.Code != http.StatusBadRequest {
+			t.Errorf("subnet_base %s: got %d, want 400", base, w.Code)
+		}
+	}
+}
+
+func TestCheckSubnets_ExtenderDegradedWhileUpstreamOverlaps(t *testing.T) {
+	m := &executil.Mock{}
+	m.Expect("ip -j -4 addr", executil.MockResult{Output: readFixture(t, "ip-addr-extender.json")})
+	svc := New(config.Config{}, m)
+	svc.paths = testPaths(t)
+	svc.state = WiFiConfig{Mode: ModeExtender, Router: svc.state.Router, Extender: ExtenderConfig{
+		UpstreamSSID: "Home", ExtenderSSID: "Ext", ExtenderPassword: "password123",
+	}}
+	svc.status = intendedFor(svc.state).status()
+
+	svc.checkSubnets()
+	st := svc.Status()
+	if st.Error != StatusDegraded || st.SubnetConflict == nil || st.SubnetConflict.Field != "extender.subnet_base" {
+		t.Fatalf("status = %+v", st)
+	}
+	if want := []string{"subnet_conflict: want AP subnet outside 192.168.200.0/23 on wlan0, got 192.168.200.0/24"}; !reflect.DeepEqual(st.Mismatches, want) {
+		t.Errorf("mismatches = %v", st.Mismatches)
+	}
+	svc.checkSubnets()
+	if n := len(svc.Status().Mismatches); n != 1 {
+		t.Errorf("%d mismatches after a second check", n)
+	}
+
+	// The upstream renumbers away from the AP.
+	m.Expect("ip -j -4 addr", executil.MockResult{Output: []byte(
+		`[{"ifname":"wlan0","addr_info":[{"family":"inet","local":"10.0.0.34","prefixlen":22}]}]`)})
+	svc.checkSubnets()
+	if st := svc.Status(); st.Error != "" || st.SubnetConflict != nil || st.Mismatches != nil {
+		t.Errorf("status after the conflict cleared = %+v", st)
+	}
+}
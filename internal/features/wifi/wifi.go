@@ -14,14 +14,29 @@ import (
 	"log/slog"
 	"net/http"
 	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/strct-org/strct-agent/internal/apidoc"
+	"github.com/strct-org/strct-agent/internal/audit"
+	"github.com/strct-org/strct-agent/internal/capabilities"
 	"github.com/strct-org/strct-agent/internal/config"
+	"github.com/strct-org/strct-agent/internal/errs"
+	"github.com/strct-org/strct-agent/internal/events"
+	"github.com/strct-org/strct-agent/internal/operations"
 	"github.com/strct-org/strct-agent/internal/platform/executil"
+	"github.com/strct-org/strct-agent/internal/platform/firewall"
+	"github.com/strct-org/strct-agent/internal/resources"
+	"github.com/strct-org/strct-agent/internal/telemetry"
 )
 
+// usage accounts wifi background work for /api/system/resources.
+var usage = resources.For("wifi")
+
 type Mode string
 
 const (
@@ -36,6 +51,46 @@ type WiFi struct {
 	status Status
 	mu     sync.RWMutex
 	cmd    executil.Runner
+	paths  confPaths
+
+	onApply   []func()            // see OnApply
+	leftovers []string            // daemons the last teardown could not stop
+	ops       *operations.Tracker // nil: applies aren't recorded
+
+	written map[string]WrittenFile // by file name; see rendered.go
+
+	poolWarned bool // the DHCP pool's crossing was logged; see dhcp.go
+
+	journal executil.Streamer // follows hostapd's log; nil in dev mode
+	auth    authLog           // failed joins; see authfail.go
+	now     func() time.Time
+
+	events    events.Publisher
+	published *Status // the last status published; nil before the first
+}
+
+// confPaths are the files wifi generates or reads. Overridable so tests can
+// point them at a temp dir instead of /etc, /run and /proc.
+type confPaths struct {
+	Hostapd       string
+	Dnsmasq       string
+	WpaSupplicant string
+	RunDir        string // pidfiles of the daemons wifi starts
+	Proc          string
+	Leases        string // dhclient's leases, for the upstream subnet
+	DnsmasqLeases string // dnsmasq's, for the DHCP pool; see dhcp.go
+}
+
+func defaultConfPaths() confPaths {
+	return confPaths{
+		Hostapd:       "/etc/hostapd/hostapd.conf",
+		Dnsmasq:       "/etc/dnsmasq.d/strct.conf",
+		WpaSupplicant: "/etc/wpa_supplicant/wpa_supplicant-wlan0.conf",
+		RunDir:        "/run/strct",
+		Proc:          "/proc",
+		Leases:        "/var/lib/dhcp/dhclient.leases",
+		DnsmasqLeases: "/var/lib/misc/dnsmasq.leases",
+	}
 }
 
 type WiFiConfig struct {
@@ -52,6 +107,11 @@ type RouterConfig struct {
 	DNSProvider string `json:"dns_provider"` // cloudflare|google|adguard|quad9
 	MaxClients  int    `json:"max_clients"`  // hostapd: max_num_sta
 	Channel     int    `json:"channel"`      // 1/6/11 for 2.4GHz; 36/40/44/48 for 5GHz
+
+	// The DHCP range's first and last host; 0 is .50 and .150.
+	DHCPStart    int               `json:"dhcp_start,omitempty"`
+	DHCPEnd      int               `json:"dhcp_end,omitempty"`
+	Reservations []DHCPReservation `json:"reservations,omitempty"`
 }
 
 type ExtenderConfig struct {
@@ -59,30 +119,37 @@ type ExtenderConfig struct {
 	UpstreamPassword string `json:"upstream_password"`
 	ExtenderSSID     string `json:"extender_ssid"`
 	ExtenderPassword string `json:"extender_password"`
-	ExtenderBand     string `json:"extender_band"`    // must match upstream band
-	UseSecondRadio   bool   `json:"use_second_radio"` // use wlan1 instead of virtual wlan0_ap
+	ExtenderBand     string `json:"extender_band"`         // must match upstream band
+	UseSecondRadio   bool   `json:"use_second_radio"`      // use wlan1 instead of virtual wlan0_ap
+	SubnetBase       string `json:"subnet_base,omitempty"` // AP side; "" is 192.168.200
 }
 
 // Status is the shared read-only view that sibling packages (vpn, adblock)
 // use to know what's currently active. Get it via Service.Status().
 type Status struct {
-	Mode         Mode   `json:"mode"`
-	SSID         string `json:"ssid,omitempty"`
-	APInterface  string `json:"ap_interface,omitempty"` // "wlan0" or "wlan0_ap" or "wlan1"
-	SubnetBase   string `json:"subnet_base,omitempty"`  // e.g. "192.168.100"
-	GatewayIP    string `json:"gateway_ip,omitempty"`   // e.g. "192.168.100.1"
-	UpstreamSSID string `json:"upstream_ssid,omitempty"` // extender mode only
-	Error        string `json:"error,omitempty"`
-	ConnectedIPs int    `json:"connected_ips"`
-	Active       bool   `json:"active"`
+	Mode         Mode     `json:"mode"`
+	SSID         string   `json:"ssid,omitempty"`
+	APInterface  string   `json:"ap_interface,omitempty"`  // "wlan0" or "wlan0_ap" or "wlan1"
+	SubnetBase   string   `json:"subnet_base,omitempty"`   // e.g. "192.168.100"
+	GatewayIP    string   `json:"gateway_ip,omitempty"`    // e.g. "192.168.100.1"
+	UpstreamSSID string   `json:"upstream_ssid,omitempty"` // extender mode only
+	Error        string   `json:"error,omitempty"`
+	Mismatches   []string `json:"mismatches,omitempty"` // set with Error == StatusDegraded
+	ConnectedIPs int      `json:"connected_ips"`
+	Active       bool     `json:"active"`
+	Leftovers    []string `json:"leftover_processes,omitempty"` // daemons teardown could not stop
+
+	SubnetConflict *SubnetConflict `json:"subnet_conflict,omitempty"` // extender mode: upstream overlaps the AP
+	DHCPPool       *DHCPPool       `json:"dhcp_pool,omitempty"`       // set by the status refresh
 }
 
-
-
 func New(cfg config.Config, cmd executil.Runner) *WiFi {
-	return &WiFi{
-		cfg: cfg,
-		cmd: cmd,
+	s := &WiFi{
+		cfg:    cfg,
+		cmd:    cmd,
+		paths:  defaultConfPaths(),
+		events: events.Discard,
+		now:    time.Now,
 		state: WiFiConfig{
 			Mode: ModeOff,
 			Router: RouterConfig{
@@ -99,19 +166,49 @@ func New(cfg config.Config, cmd executil.Runner) *WiFi {
 				ExtenderPassword: "changeme123",
 				ExtenderBand:     "5GHz",
 				UseSecondRadio:   false,
+				SubnetBase:       "192.168.200",
 			},
 		},
 	}
+	s.applyDefaults(cfg)
+	return s
 }
 
-func NewFromConfig(cfg *config.Config) *WiFi {
+// applyDefaults puts the configured AP settings (WIFI_SSID and the rest,
+// or the config file's wifi section) in place of the built-in ones, for
+// as long as no config is saved. The extender's AP follows the router's
+// name and password, as the built-in ones do.
+func (s *WiFi) applyDefaults(cfg config.Config) {
+	r, e := &s.state.Router, &s.state.Extender
+	if cfg.WiFiSSID != "" {
+		r.SSID, e.ExtenderSSID = cfg.WiFiSSID, cfg.WiFiSSID+"-Ext"
+	}
+	if cfg.WiFiPassword != "" {
+		r.Password, e.ExtenderPassword = cfg.WiFiPassword, cfg.WiFiPassword
+	}
+	if cfg.WiFiBand != "" {
+		r.Band = cfg.WiFiBand
+	}
+	if cfg.WiFiChannel != 0 {
+		r.Channel = cfg.WiFiChannel
+	}
+}
+
+// NewFromConfig is the agent's wifi service. Status changes are
+// published to pub as events.WiFiStatus.
+func NewFromConfig(cfg *config.Config, pub events.Publisher) *WiFi {
 	var cmd executil.Runner
+	var journal executil.Streamer
 	if cfg.IsDev {
 		cmd = executil.NewDevRunner()
 	} else {
 		cmd = executil.NewRealRunner()
+		journal = executil.Real{}
 	}
-	return New(*cfg, cmd)
+	s := New(*cfg, cmd)
+	s.events = pub
+	s.journal = journal
+	return s
 }
 
 // Status returns a snapshot of the current WiFi state
@@ -119,21 +216,143 @@ func NewFromConfig(cfg *config.Config) *WiFi {
 func (s *WiFi) Status() Status {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	return s.status
+	st := s.status
+	st.Leftovers = s.leftovers
+	return st
+}
+
+// TelemetryFeature reports the mode for usage statistics; active is
+// whether it came up.
+func (s *WiFi) TelemetryFeature() (string, telemetry.Feature) {
+	st := s.Status()
+	return "wifi", telemetry.Feature{Enabled: st.Mode != ModeOff && st.Active, Mode: string(st.Mode)}
+}
+
+// EnabledCapabilities reports what the mode has switched on: both modes
+// run an AP, extender mode on wlan1 with UseSecondRadio.
+func (s *WiFi) EnabledCapabilities() map[string]bool {
+	st := s.Status()
+	on := st.Mode != ModeOff && st.Active
+	return map[string]bool{
+		capabilities.WiFi:        on,
+		capabilities.AccessPoint: on,
+		capabilities.SecondRadio: on && st.APInterface == "wlan1",
+	}
+}
+
+// UseTracker records applies and reconciles in t, with a snapshot of the
+// daemons' logs and the generated configs when one fails. Call before
+// Start.
+func (s *WiFi) UseTracker(t *operations.Tracker) {
+	s.ops = t
+	s.cmd = t.Watch(s.cmd)
+}
+
+// generatedConfs are the files a failed operation's snapshot includes.
+func (s *WiFi) generatedConfs() []string {
+	return []string{s.paths.Hostapd, s.paths.Dnsmasq, s.paths.WpaSupplicant}
+}
+
+// OnApply registers fn to run after every apply or start-up reconcile.
+// Applying touches the nat table and the AP interface, so features with
+// their own rules there (adblock's DNS redirect) re-check them. fn runs on
+// wifi's goroutine and must not block.
+func (s *WiFi) OnApply(fn func()) {
+	s.mu.Lock()
+	s.onApply = append(s.onApply, fn)
+	s.mu.Unlock()
+}
+
+func (s *WiFi) notifyApplied() {
+	s.mu.RLock()
+	fns := s.onApply
+	s.mu.RUnlock()
+	for _, fn := range fns {
+		fn()
+	}
+}
+
+// publishStatus publishes the status if it changed since it was last
+// published. It runs once an apply, teardown or refresh is done, so the
+// off status an apply passes through on its way up is not published.
+func (s *WiFi) publishStatus() {
+	st := s.Status()
+	s.mu.Lock()
+	changed := s.published == nil || !reflect.DeepEqual(*s.published, st)
+	if changed {
+		s.published = &st
+	}
+	s.mu.Unlock()
+	if changed {
+		s.events.Publish(events.WiFiStatus, st)
+	}
 }
 
 func (s *WiFi) RegisterRoutes(mux *http.ServeMux) {
-	mux.HandleFunc("GET /api/wifi/config", s.handleGetConfig)
-	mux.HandleFunc("POST /api/wifi/config", s.handleSetConfig)
-	mux.HandleFunc("GET /api/wifi/status", s.handleGetStatus)
-	mux.HandleFunc("GET /api/wifi/scan", s.handleScanNetworks)
-	mux.HandleFunc("POST /api/wifi/stop", s.handleStop)
+	r := apidoc.On(mux, "wifi")
+	r.Register("GET", "/api/wifi/config", s.handleGetConfig, apidoc.RouteDoc{
+		Summary:  "The saved config, passphrases masked",
+		Response: exampleConfig,
+	})
+	r.Register("POST", "/api/wifi/config", s.handleSetConfig, apidoc.RouteDoc{
+		Summary: "Save a config and apply it in the background",
+		Description: "A masked passphrase keeps the saved one. 400, with every problem, for an invalid " +
+			"config; 422, with the conflict, when the AP subnet overlaps the upstream network.",
+		Request:   exampleConfig,
+		Response:  exampleApplying,
+		Validates: true,
+	})
+	r.Register("GET", "/api/wifi/status", s.handleGetStatus, apidoc.RouteDoc{
+		Summary:  "Current mode and AP state",
+		Response: exampleStatus,
+	})
+	r.Register("GET", "/api/wifi/scan", s.handleScanNetworks, apidoc.RouteDoc{
+		Summary:  "Networks in range of wlan0",
+		Response: exampleScan,
+	})
+	r.Register("POST", "/api/wifi/stop", s.handleStop, apidoc.RouteDoc{
+		Summary: "Turn wifi off and tear the AP down in the background",
+	})
+	r.Register("GET", "/api/wifi/rendered-config", s.handleRenderedConfig, apidoc.RouteDoc{
+		Summary:  "The generated hostapd and dnsmasq configs, masked, with drift",
+		Query:    []apidoc.Param{whichParam},
+		Response: exampleRendered,
+	})
+	r.Register("POST", "/api/wifi/rendered-config/reapply", s.handleReapply, apidoc.RouteDoc{
+		Summary:     "Rewrite the drifted configs and restart their daemons",
+		Description: "409 while wifi is off.",
+		Response:    exampleRendered,
+	})
+	r.Register("GET", "/api/wifi/auth-failures", s.handleAuthFailures, apidoc.RouteDoc{
+		Summary: "Stations that failed to join the AP, by MAC",
+		Description: "Read from hostapd's journal. A station with `threshold` failures within the window " +
+			"is flagged, and with WIFI_AUTH_AUTOBLOCK put on hostapd's deny list for an hour.",
+		Response: exampleAuthFailures,
+	})
 }
 
+func (s *WiFi) Name() string { return "wifi" }
+
+// Start restores the saved mode and brings it up before returning, so
+// the features that depend on wifi start with the AP in place.
 func (s *WiFi) Start(ctx context.Context) error {
 	slog.Info("wifi: service started")
 
-	go func() {
+	if err := s.loadConfig(); err != nil {
+		slog.Warn("wifi: could not restore config, staying off", "err", err)
+	}
+	if err := s.loadWritten(); err != nil {
+		slog.Warn("wifi: drift of the generated configs unknown until they are rewritten", "err", err)
+	}
+
+	if s.journal != nil {
+		usage.Go(func() { s.followAuthLog(ctx) })
+	}
+	s.reconcile()
+	s.checkSubnets()
+	s.publishStatus()
+
+	usage.Go(func() {
 		ticker := time.NewTicker(30 * time.Second)
 		defer ticker.Stop()
 		for {
@@ -143,16 +362,19 @@ func (s *WiFi) Start(ctx context.Context) error {
 				return
 			case <-ticker.C:
 				s.refreshStatus()
+				s.checkSubnets()
+				s.expireAuthBlocks()
+				s.publishStatus()
 			}
 		}
-	}()
+	})
 
 	return nil
 }
 
 func (s *WiFi) handleGetConfig(w http.ResponseWriter, r *http.Request) {
 	s.mu.RLock()
-	state := s.state
+	state := s.state.masked()
 	s.mu.RUnlock()
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(state)
@@ -164,8 +386,22 @@ func (s *WiFi) handleSetConfig(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "invalid JSON", http.StatusBadRequest)
 		return
 	}
+	audit.Target(r.Context(), "mode="+string(req.Mode))
+	s.mu.RLock()
+	req.unmask(s.state)
+	s.mu.RUnlock()
 	if err := validateConfig(req); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		errs.HTTPResponse(w, err)
+		return
+	}
+	s.mu.RLock()
+	apIface := s.status.APInterface
+	s.mu.RUnlock()
+	if c := s.subnetConflict(req, apIface); c != nil {
+		slog.Warn("wifi: rejected config, AP subnet overlaps the upstream network", "conflict", c.String())
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(map[string]any{"error": c.String(), "conflict": c})
 		return
 	}
 
@@ -173,13 +409,21 @@ func (s *WiFi) handleSetConfig(w http.ResponseWriter, r *http.Request) {
 	s.state = req
 	s.mu.Unlock()
 
+	if err := s.saveConfig(); err != nil {
+		slog.Error("wifi: could not persist config", "err", err)
+	}
+
 	go func() {
-		if err := s.apply(); err != nil {
+		op := s.ops.Begin("wifi", "apply")
+		err := s.apply()
+		if err != nil {
 			slog.Error("wifi: apply failed", "err", err)
 			s.mu.Lock()
 			s.status.Error = err.Error()
 			s.mu.Unlock()
 		}
+		op.Finish(err, s.generatedConfs()...)
+		s.publishStatus()
 	}()
 
 	w.Header().Set("Content-Type", "application/json")
@@ -187,11 +431,8 @@ func (s *WiFi) handleSetConfig(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *WiFi) handleGetStatus(w http.ResponseWriter, r *http.Request) {
-	s.mu.RLock()
-	st := s.status
-	s.mu.RUnlock()
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(st)
+	json.NewEncoder(w).Encode(s.Status())
 }
 
 func (s *WiFi) handleScanNetworks(w http.ResponseWriter, r *http.Request) {
@@ -208,11 +449,19 @@ func (s *WiFi) handleStop(w http.ResponseWriter, r *http.Request) {
 	s.mu.Lock()
 	s.state.Mode = ModeOff
 	s.mu.Unlock()
-	go s.teardown()
+	if err := s.saveConfig(); err != nil {
+		slog.Error("wifi: could not persist config", "err", err)
+	}
+	go func() {
+		s.teardown()
+		s.publishStatus()
+	}()
 	w.WriteHeader(http.StatusOK)
 }
 
 func (s *WiFi) apply() error {
+	defer usage.Time()()
+	defer s.notifyApplied()
 	s.mu.RLock()
 	mode := s.state.Mode
 	s.mu.RUnlock()
@@ -237,7 +486,7 @@ func (s *WiFi) apply() error {
 //
 //  1. hostapd creates the AP on wlan0
 //  2. wlan0 gets a static gateway IP (SubnetBase.1)
-//  3. dnsmasq provides DHCP (.50-.150) and DNS forwarding
+//  3. dnsmasq provides DHCP (.50-.150 unless set) and DNS forwarding
 //  4. iptables MASQUERADE on eth0 enables NAT
 //
 // Ad blocking and VPN are NOT applied here — they are applied by their
@@ -249,7 +498,7 @@ func (s *WiFi) applyRouter() error {
 
 	slog.Info("wifi: applying router mode", "ssid", cfg.SSID, "band", cfg.Band)
 
-	if err := s.writeHostapdConf(cfg, "wlan0", "/etc/hostapd/hostapd.conf"); err != nil {
+	if err := s.writeHostapdConf(cfg, "wlan0", s.paths.Hostapd); err != nil {
 		return fmt.Errorf("hostapd config: %w", err)
 	}
 	if err := s.cmd.Run("systemctl", "restart", "hostapd"); err != nil {
@@ -263,7 +512,7 @@ func (s *WiFi) applyRouter() error {
 	}
 	s.cmd.Run("ip", "link", "set", "wlan0", "up") //nolint:errcheck
 
-	if err := s.writeDnsmasqConf(cfg.SubnetBase, cfg.DNSProvider, "wlan0"); err != nil {
+	if err := s.writeDnsmasqConf(cfg, "wlan0"); err != nil {
 		return fmt.Errorf("dnsmasq config: %w", err)
 	}
 	if err := s.cmd.Run("systemctl", "restart", "dnsmasq"); err != nil {
@@ -271,24 +520,13 @@ func (s *WiFi) applyRouter() error {
 	}
 
 	// NAT: share eth0 internet with wlan0 devices
-	os.WriteFile("/proc/sys/net/ipv4/ip_forward", []byte("1"), 0644) //nolint:errcheck
-	s.cmd.Run("iptables", "-t", "nat", "-F")                         //nolint:errcheck
-	s.cmd.Run("iptables", "-F", "FORWARD")                           //nolint:errcheck
-	if err := s.cmd.Run("iptables", "-t", "nat", "-A", "POSTROUTING", "-o", "eth0", "-j", "MASQUERADE"); err != nil {
+	s.cmd.Run("sysctl", "-w", "net.ipv4.ip_forward=1") //nolint:errcheck
+	if err := s.addNATRules("wlan0", "eth0"); err != nil {
 		return fmt.Errorf("iptables NAT: %w", err)
 	}
-	s.cmd.Run("iptables", "-A", "FORWARD", "-i", "wlan0", "-o", "eth0", "-j", "ACCEPT")                                                  //nolint:errcheck
-	s.cmd.Run("iptables", "-A", "FORWARD", "-i", "eth0", "-o", "wlan0", "-m", "state", "--state", "RELATED,ESTABLISHED", "-j", "ACCEPT") //nolint:errcheck
 
 	s.mu.Lock()
-	s.status = Status{
-		Mode:        ModeRouter,
-		Active:      true,
-		SSID:        cfg.SSID,
-		APInterface: "wlan0",
-		SubnetBase:  cfg.SubnetBase,
-		GatewayIP:   cfg.SubnetBase + ".1",
-	}
+	s.status = intendedFor(s.state).status()
 	s.mu.Unlock()
 
 	slog.Info("wifi: router mode active", "ssid", cfg.SSID, "gateway", gatewayIP)
@@ -323,23 +561,15 @@ func (s *WiFi) applyExtender() error {
 	if err := s.writeWpaSupplicantConf(cfg.UpstreamSSID, cfg.UpstreamPassword); err != nil {
 		return fmt.Errorf("wpa_supplicant config: %w", err)
 	}
-	s.cmd.Run("killall", "wpa_supplicant") //nolint:errcheck
-	if err := s.cmd.Run("wpa_supplicant", "-B", "-i", "wlan0", "-c", "/etc/wpa_supplicant/wpa_supplicant-wlan0.conf"); err != nil {
+	if err := s.startWpaSupplicant(); err != nil {
 		return fmt.Errorf("start wpa_supplicant: %w", err)
 	}
-	if err := s.cmd.Run("dhclient", "wlan0"); err != nil {
+	if err := s.startDhclient(); err != nil {
 		return fmt.Errorf("dhclient wlan0: %w", err)
 	}
 
-	extCfg := RouterConfig{
-		SSID:       cfg.ExtenderSSID,
-		Password:   cfg.ExtenderPassword,
-		Band:       cfg.ExtenderBand,
-		Channel:    0, // ACS: auto-match upstream channel
-		MaxClients: 20,
-		SubnetBase: "192.168.200",
-	}
-	if err := s.writeHostapdConf(extCfg, apInterface, "/etc/hostapd/hostapd.conf"); err != nil {
+	extCfg := extenderAPConfig(cfg)
+	if err := s.writeHostapdConf(extCfg, apInterface, s.paths.Hostapd); err != nil {
 		return fmt.Errorf("hostapd config: %w", err)
 	}
 	if err := s.cmd.Run("systemctl", "restart", "hostapd"); err != nil {
@@ -347,38 +577,58 @@ func (s *WiFi) applyExtender() error {
 	}
 
 	s.cmd.Run("ip", "addr", "flush", "dev", apInterface) //nolint:errcheck
-	if err := s.cmd.Run("ip", "addr", "add", "192.168.200.1/24", "dev", apInterface); err != nil {
+	if err := s.cmd.Run("ip", "addr", "add", extCfg.SubnetBase+".1/24", "dev", apInterface); err != nil {
 		return fmt.Errorf("set AP interface IP: %w", err)
 	}
 
-	if err := s.writeDnsmasqConf("192.168.200", "cloudflare", apInterface); err != nil {
+	if err := s.writeDnsmasqConf(extCfg, apInterface); err != nil {
 		return fmt.Errorf("dnsmasq config: %w", err)
 	}
 	s.cmd.Run("systemctl", "restart", "dnsmasq") //nolint:errcheck
 
-	os.WriteFile("/proc/sys/net/ipv4/ip_forward", []byte("1"), 0644)                                                                          //nolint:errcheck
-	s.cmd.Run("iptables", "-t", "nat", "-F")                                                                                                  //nolint:errcheck
-	s.cmd.Run("iptables", "-t", "nat", "-A", "POSTROUTING", "-o", "wlan0", "-j", "MASQUERADE")                                                //nolint:errcheck
-	s.cmd.Run("iptables", "-A", "FORWARD", "-i", apInterface, "-o", "wlan0", "-j", "ACCEPT")                                                  //nolint:errcheck
-	s.cmd.Run("iptables", "-A", "FORWARD", "-i", "wlan0", "-o", apInterface, "-m", "state", "--state", "RELATED,ESTABLISHED", "-j", "ACCEPT") //nolint:errcheck
+	s.cmd.Run("sysctl", "-w", "net.ipv4.ip_forward=1") //nolint:errcheck
+	s.addNATRules(apInterface, "wlan0")                //nolint:errcheck
 
 	s.mu.Lock()
-	s.status = Status{
-		Mode:         ModeExtender,
-		Active:       true,
-		SSID:         cfg.ExtenderSSID,
-		APInterface:  apInterface,
-		SubnetBase:   "192.168.200",
-		GatewayIP:    "192.168.200.1",
-		UpstreamSSID: cfg.UpstreamSSID,
-	}
+	s.status = intendedFor(s.state).status()
 	s.mu.Unlock()
 
 	slog.Info("wifi: extender mode active", "new_ssid", cfg.ExtenderSSID, "upstream", cfg.UpstreamSSID)
 	return nil
 }
 
+// extenderAPConfig is the AP side of extender mode, served on
+// cfg.SubnetBase, 192.168.200.0/24 unless set.
+func extenderAPConfig(cfg ExtenderConfig) RouterConfig {
+	subnet := cfg.SubnetBase
+	if subnet == "" {
+		subnet = "192.168.200"
+	}
+	return RouterConfig{
+		SSID:        cfg.ExtenderSSID,
+		Password:    cfg.ExtenderPassword,
+		Band:        cfg.ExtenderBand,
+		Channel:     0, // ACS: auto-match upstream channel
+		MaxClients:  20,
+		SubnetBase:  subnet,
+		DNSProvider: "cloudflare",
+	}
+}
+
 func (s *WiFi) writeHostapdConf(cfg RouterConfig, iface, path string) error {
+	content := renderHostapdConf(cfg, iface)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, content, 0600); err != nil {
+		return err
+	}
+	s.wrote(fileHostapd, content)
+	return nil
+}
+
+// renderHostapdConf is hostapd.conf for an AP of cfg on iface.
+func renderHostapdConf(cfg RouterConfig, iface string) []byte {
 	hwMode := "a"
 	if cfg.Band == "2.4GHz" {
 		hwMode = "g"
@@ -389,6 +639,8 @@ func (s *WiFi) writeHostapdConf(cfg RouterConfig, iface, path string) error {
 	content := fmt.Sprintf(`# Generated by strct-agent
 interface=%s
 driver=nl80211
+ctrl_interface=`+hostapdCtrlDir+`
+ctrl_interface_group=0
 ssid=%s
 hw_mode=%s
 channel=%d
@@ -405,8 +657,7 @@ ieee80211w=1
 ignore_broadcast_ssid=0
 max_num_sta=%d
 `, iface, cfg.SSID, hwMode, cfg.Channel, cfg.Password, cfg.MaxClients)
-
-	return os.WriteFile(path, []byte(content), 0600)
+	return []byte(content)
 }
 
 // writeDnsmasqConf writes /etc/dnsmasq.d/strct.conf.
@@ -415,35 +666,49 @@ max_num_sta=%d
 //
 //	interface=IFACE           only serve DHCP/DNS on the AP interface
 //	dhcp-range=X.50,X.150    IP range handed to connected devices
+//	dhcp-host=MAC,X.20,name   one per reservation
 //	dhcp-option=3,X.1        default gateway = Orange Pi
 //	dhcp-option=6,X.1        DNS server = Orange Pi (dnsmasq itself)
 //	server=1.1.1.1            upstream DNS dnsmasq forwards to
 //	no-resolv                 don't read /etc/resolv.conf (use server= only)
-func (s *WiFi) writeDnsmasqConf(subnetBase, dnsProvider, iface string) error {
+func (s *WiFi) writeDnsmasqConf(cfg RouterConfig, iface string) error {
+	content := renderDnsmasqConf(cfg, iface)
+	if err := os.MkdirAll(filepath.Dir(s.paths.Dnsmasq), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(s.paths.Dnsmasq, content, 0644); err != nil {
+		return err
+	}
+	s.wrote(fileDnsmasq, content)
+	return nil
+}
+
+// renderDnsmasqConf is strct.conf serving DHCP and DNS for cfg on iface.
+func renderDnsmasqConf(cfg RouterConfig, iface string) []byte {
 	dnsServers := map[string][2]string{
 		"cloudflare": {"1.1.1.1", "1.0.0.1"},
 		"google":     {"8.8.8.8", "8.8.4.4"},
 		"adguard":    {"94.140.14.14", "94.140.15.15"},
 		"quad9":      {"9.9.9.9", "149.112.112.112"},
 	}
-	dns, ok := dnsServers[dnsProvider]
+	dns, ok := dnsServers[cfg.DNSProvider]
 	if !ok {
 		dns = dnsServers["cloudflare"]
 	}
+	start, end := cfg.dhcpRange()
 
 	content := fmt.Sprintf(`# Generated by strct-agent
 interface=%s
 bind-interfaces
-dhcp-range=%s.50,%s.150,24h
-dhcp-option=3,%s.1
+dhcp-range=%s.%d,%s.%d,24h
+%sdhcp-option=3,%s.1
 dhcp-option=6,%s.1
 server=%s
 server=%s
 no-resolv
 log-queries
-`, iface, subnetBase, subnetBase, subnetBase, subnetBase, dns[0], dns[1])
-
-	return os.WriteFile("/etc/dnsmasq.d/strct.conf", []byte(content), 0644)
+`, iface, cfg.SubnetBase, start, cfg.SubnetBase, end, renderDHCPHosts(cfg), cfg.SubnetBase, cfg.SubnetBase, dns[0], dns[1])
+	return []byte(content)
 }
 
 func (s *WiFi) writeWpaSupplicantConf(ssid, password string) error {
@@ -457,42 +722,91 @@ network={
     key_mgmt=WPA-PSK
 }
 `, ssid, password)
-	if err := os.MkdirAll("/etc/wpa_supplicant", 0755); err != nil {
+	if err := os.MkdirAll(filepath.Dir(s.paths.WpaSupplicant), 0755); err != nil {
 		return err
 	}
-	return os.WriteFile("/etc/wpa_supplicant/wpa_supplicant-wlan0.conf", []byte(content), 0600)
+	return os.WriteFile(s.paths.WpaSupplicant, []byte(content), 0600)
+}
+
+// natRule is one iptables rule wifi owns: table, chain, rule spec.
+type natRule struct {
+	table, chain string
+	spec         []string
+}
+
+// natRules returns the forwarding rules for sharing wanIface's connection
+// with apIface. apply adds exactly these and teardown removes exactly
+// these — wifi never flushes a whole table or built-in chain, which used
+// to wipe router port forwards and the adblock DNS redirect.
+func natRules(apIface, wanIface string) []natRule {
+	return []natRule{
+		{"nat", "POSTROUTING", []string{"-o", wanIface, "-j", "MASQUERADE"}},
+		{"filter", "FORWARD", []string{"-i", apIface, "-o", wanIface, "-j", "ACCEPT"}},
+		{"filter", "FORWARD", []string{"-i", wanIface, "-o", apIface, "-m", "state", "--state", "RELATED,ESTABLISHED", "-j", "ACCEPT"}},
+	}
+}
+
+// natLayouts lists every AP/WAN interface pair wifi can set up. teardown
+// removes the rules of all of them so a crash between apply and teardown
+// doesn't leave stale rules behind.
+var natLayouts = [][2]string{
+	{"wlan0", "eth0"},     // router
+	{"wlan0_ap", "wlan0"}, // extender, virtual AP
+	{"wlan1", "wlan0"},    // extender, second radio
+}
+
+func (s *WiFi) addNATRules(apIface, wanIface string) error {
+	for _, r := range natRules(apIface, wanIface) {
+		args := append([]string{"-t", r.table, "-A", r.chain}, r.spec...)
+		if err := s.cmd.Run("iptables", args...); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
+func (s *WiFi) removeNATRules() {
+	for _, l := range natLayouts {
+		for _, r := range natRules(l[0], l[1]) {
+			firewall.DeleteRule(s.cmd, r.table, r.chain, r.spec...) //nolint:errcheck
+		}
+	}
+}
 
 func (s *WiFi) teardown() {
 	slog.Info("wifi: tearing down")
-	s.cmd.Run("systemctl", "stop", "hostapd")                        //nolint:errcheck
-	s.cmd.Run("systemctl", "stop", "dnsmasq")                        //nolint:errcheck
-	s.cmd.Run("killall", "wpa_supplicant")                           //nolint:errcheck
-	s.cmd.Run("killall", "dhclient")                                 //nolint:errcheck
-	s.cmd.Run("iptables", "-t", "nat", "-F")                         //nolint:errcheck
-	s.cmd.Run("iptables", "-F", "FORWARD")                           //nolint:errcheck
-	s.cmd.Run("iw", "dev", "wlan0_ap", "del")                        //nolint:errcheck
-	os.WriteFile("/proc/sys/net/ipv4/ip_forward", []byte("0"), 0644) //nolint:errcheck
+	s.cmd.Run("systemctl", "stop", "hostapd") //nolint:errcheck
+	s.cmd.Run("systemctl", "stop", "dnsmasq") //nolint:errcheck
+	leftovers := s.stopDaemons()
+	s.removeNATRules()
+	s.cmd.Run("iw", "dev", "wlan0_ap", "del")          //nolint:errcheck
+	s.cmd.Run("sysctl", "-w", "net.ipv4.ip_forward=0") //nolint:errcheck
 
 	s.mu.Lock()
 	s.status = Status{Mode: ModeOff, Active: false}
+	s.leftovers = leftovers
 	s.mu.Unlock()
 }
 
-
 func (s *WiFi) refreshStatus() {
+	defer usage.Time()()
 	s.mu.RLock()
 	mode := s.state.Mode
 	s.mu.RUnlock()
 	if mode == ModeOff {
 		return
 	}
+	s.mu.RLock()
+	ap := intendedFor(s.state).AP
+	s.mu.RUnlock()
+	s.refreshPool(ap)
 	out, err := s.cmd.CombinedOutput("arp", "-a")
 	if err == nil {
 		s.mu.Lock()
 		s.status.ConnectedIPs = strings.Count(string(out), "wlan0")
-		s.status.Error = ""
+		if len(s.status.Mismatches) == 0 {
+			s.status.Error = ""
+		}
 		s.mu.Unlock()
 	}
 }
@@ -545,28 +859,89 @@ func parseIWScan(data []byte) []ScannedNetwork {
 	return networks
 }
 
+// validateConfig returns every problem with cfg, as an *errs.Validation.
 func validateConfig(cfg WiFiConfig) error {
+	var v errs.Validation
 	switch cfg.Mode {
 	case ModeRouter:
 		if cfg.Router.SSID == "" {
-			return fmt.Errorf("router.ssid is required")
+			v.Add("router.ssid", errs.CodeRequired, "router.ssid is required")
 		}
 		if len(cfg.Router.Password) < 8 {
-			return fmt.Errorf("router.password must be >= 8 characters")
+			v.Add("router.password", errs.CodeTooShort, "router.password must be >= 8 characters")
+		}
+		if _, err := subnetPrefix(cfg.Router.SubnetBase); err != nil {
+			v.Addf("router.subnet_base", errs.CodeInvalid, "router.subnet_base: %v", err)
 		}
+		validateDHCP(&v, "router", cfg.Router)
 	case ModeExtender:
 		if cfg.Extender.UpstreamSSID == "" {
-			return fmt.Errorf("extender.upstream_ssid is required")
+			v.Add("extender.upstream_ssid", errs.CodeRequired, "extender.upstream_ssid is required")
 		}
 		if cfg.Extender.ExtenderSSID == "" {
-			return fmt.Errorf("extender.extender_ssid is required")
+			v.Add("extender.extender_ssid", errs.CodeRequired, "extender.extender_ssid is required")
 		}
 		if len(cfg.Extender.ExtenderPassword) < 8 {
-			return fmt.Errorf("extender.extender_password must be >= 8 characters")
+			v.Add("extender.extender_password", errs.CodeTooShort, "extender.extender_password must be >= 8 characters")
+		}
+		if cfg.Extender.SubnetBase != "" {
+			if _, err := subnetPrefix(cfg.Extender.SubnetBase); err != nil {
+				v.Addf("extender.subnet_base", errs.CodeInvalid, "extender.subnet_base: %v", err)
+			}
 		}
 	case ModeOff:
 	default:
-		return fmt.Errorf("invalid mode: %s", cfg.Mode)
+		v.Addf("mode", errs.CodeInvalid, "invalid mode: %s", cfg.Mode)
 	}
-	return nil
+	return v.Err()
+}
+
+// ─── Secrets ─────────────────────────────────────────────────────────────────
+
+// maskedSecret stands in for a passphrase in API responses. A config
+// posted back with it keeps the passphrase it replaced.
+const maskedSecret = "********"
+
+// confSecrets are the keys of the generated files whose values are
+// passphrases.
+var confSecrets = []string{"wpa_passphrase", "wpa_psk", "sae_password", "psk"}
+
+// masked returns c with its passphrases replaced by maskedSecret.
+func (c WiFiConfig) masked() WiFiConfig {
+	for _, p := range []*string{&c.Router.Password, &c.Extender.UpstreamPassword, &c.Extender.ExtenderPassword} {
+		if *p != "" {
+			*p = maskedSecret
+		}
+	}
+	return c
+}
+
+// unmask puts back the passphrases of prev that c still has masked.
+func (c *WiFiConfig) unmask(prev WiFiConfig) {
+	keep := func(p *string, old string) {
+		if *p == maskedSecret {
+			*p = old
+		}
+	}
+	keep(&c.Router.Password, prev.Router.Password)
+	keep(&c.Extender.UpstreamPassword, prev.Extender.UpstreamPassword)
+	keep(&c.Extender.ExtenderPassword, prev.Extender.ExtenderPassword)
+}
+
+// maskConf returns a generated file with the values of confSecrets
+// replaced by maskedSecret, quotes kept.
+func maskConf(content []byte) string {
+	lines := strings.Split(string(content), "\n")
+	for i, line := range lines {
+		k, v, ok := strings.Cut(line, "=")
+		if !ok || !slices.Contains(confSecrets, strings.TrimSpace(k)) {
+			continue
+		}
+		if strings.HasPrefix(v, `"`) {
+			lines[i] = k + `="` + maskedSecret + `"`
+		} else {
+			lines[i] = k + "=" + maskedSecret
+		}
+	}
+	return strings.Join(lines, "\n")
 }
@@ -1,14 +1,31 @@
 package wifi
 
 import (
+    "path/filepath"
     "testing"
     "github.com/strct-org/strct-agent/internal/config"
+    "github.com/strct-org/strct-agent/internal/events"
     "github.com/strct-org/strct-agent/internal/platform/executil"
 )
 
+// testPaths points the generated config files at a temp dir so tests
+// don't need /etc to exist (or root to write it).
+func testPaths(t *testing.T) confPaths {
+    t.Helper()
+    dir := t.TempDir()
+    return confPaths{
+        Hostapd:       filepath.Join(dir, "hostapd.conf"),
+        Dnsmasq:       filepath.Join(dir, "strct.conf"),
+        WpaSupplicant: filepath.Join(dir, "wpa_supplicant-wlan0.conf"),
+        RunDir:        filepath.Join(dir, "run"),
+        Proc:          filepath.Join(dir, "proc"),
+    }
+}
+
 func TestApplyRouter_IssuesCorrectCommands(t *testing.T) {
     m := &executil.Mock{}
     svc := New(config.Config{}, m)
+    svc.paths = testPaths(t)
     
     svc.state = WiFiConfig{
         Mode: ModeRouter,
@@ -44,6 +61,7 @@ func TestApplyRouter_IssuesCorrectCommands(t *testing.T) {
 func TestApplyRouter_WrongBand_UsesCorrectHWMode(t *testing.T) {
     m := &executil.Mock{}
     svc := New(config.Config{}, m)
+    svc.paths = testPaths(t)
     svc.state = WiFiConfig{
         Mode: ModeRouter,
         Router: RouterConfig{
@@ -60,4 +78,45 @@ func TestApplyRouter_WrongBand_UsesCorrectHWMode(t *testing.T) {
     // (writeHostapdConf writes to /etc/hostapd/hostapd.conf — 
     //  in tests you'd want to make the path configurable, see below)
     m.AssertCalled(t, "systemctl restart hostapd")
-}
\ No newline at end of file
+}
+
+func TestTeardown_RemovesOnlyOwnRules(t *testing.T) {
+    m := &executil.Mock{}
+    svc := New(config.Config{}, m)
+
+    svc.teardown()
+
+    // Whole-table and built-in chain flushes wipe other features' rules
+    // (router port forwards, adblock DNS redirect).
+    m.AssertNotCalled(t, "iptables -t nat -F")
+    m.AssertNotCalled(t, "iptables -F FORWARD")
+
+    m.AssertCalled(t, "iptables -t nat -D POSTROUTING -o eth0 -j MASQUERADE")
+    m.AssertCalled(t, "iptables -t filter -D FORWARD -i wlan0 -o eth0 -j ACCEPT")
+    assertNoKillall(t, m)
+}
+
+func TestPublishStatus_OnlyWhenItChanges(t *testing.T) {
+    bus := events.New()
+    sub := bus.Subscribe(8)
+    defer sub.Close()
+    svc := New(config.Config{}, &executil.Mock{})
+    svc.events = bus
+
+    svc.publishStatus() // the first is always published
+    svc.publishStatus()
+    svc.mu.Lock()
+    svc.status = Status{Mode: ModeRouter, SSID: "TestNet", Active: true}
+    svc.mu.Unlock()
+    svc.publishStatus()
+    svc.publishStatus()
+
+    if len(sub.C) != 2 {
+        t.Fatalf("published %d events, want 2", len(sub.C))
+    }
+    <-sub.C
+    e := <-sub.C
+    if st, ok := e.Payload.(Status); e.Type != events.WiFiStatus || !ok || st.SSID != "TestNet" {
+        t.Errorf("event = %+v", e)
+    }
+}
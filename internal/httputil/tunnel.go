@@ -0,0 +1,46 @@
+package httputil
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// tunnelKey marks the connections frpc opens. It is a context value, not
+// a header, so a visitor can't set it.
+type tunnelKey struct{}
+
+// WithTunnel marks ctx as a connection frpc opened. api.Server sets it on
+// every connection to its tunnel listener.
+func WithTunnel(ctx context.Context) context.Context {
+	return context.WithValue(ctx, tunnelKey{}, true)
+}
+
+// FromTunnel reports whether frpc delivered r, that is whether it came in
+// on the API's tunnel listener. The address and Host say nothing: frpc
+// connects from loopback and passes on whatever Host the visitor sent.
+func FromTunnel(r *http.Request) bool {
+	v, _ := r.Context().Value(tunnelKey{}).(bool)
+	return v
+}
+
+// ClientAddr is the address of the client behind r. frpc connects from
+// loopback, so for a tunnel request it is the address frp appended to
+// X-Forwarded-For; whatever the visitor put there comes before it. ""
+// if r has no address, as over the admin socket.
+func ClientAddr(r *http.Request) string {
+	if FromTunnel(r) {
+		if fwd := r.Header.Values("X-Forwarded-For"); len(fwd) > 0 {
+			parts := strings.Split(fwd[len(fwd)-1], ",")
+			if ip := strings.TrimSpace(parts[len(parts)-1]); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return ""
+	}
+	return host
+}
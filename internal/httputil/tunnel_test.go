@@ -0,0 +1,35 @@
+package httputil_test
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/strct-org/strct-agent/internal/httputil"
+)
+
+func TestClientAddr(t *testing.T) {
+	for _, tc := range []struct {
+		name, remote, fwd string
+		tunnel            bool
+		want              string
+	}{
+		{"lan", "192.168.1.20:40000", "", false, "192.168.1.20"},
+		{"lan ignores the header", "192.168.1.20:40000", "203.0.113.9", false, "192.168.1.20"},
+		{"tunnel", "127.0.0.1:40000", "203.0.113.9", true, "203.0.113.9"},
+		{"tunnel, spoofed entry first", "127.0.0.1:40000", "10.0.0.1, 203.0.113.9", true, "203.0.113.9"},
+		{"tunnel without the header", "127.0.0.1:40000", "", true, "127.0.0.1"},
+		{"admin socket", "@", "", false, ""},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tc.remote
+		if tc.fwd != "" {
+			r.Header.Set("X-Forwarded-For", tc.fwd)
+		}
+		if tc.tunnel {
+			r = r.WithContext(httputil.WithTunnel(r.Context()))
+		}
+		if got := httputil.ClientAddr(r); got != tc.want {
+			t.Errorf("%s: %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package httputil_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/strct-org/strct-agent/internal/httputil"
+)
+
+func TestVersioned_RewritesV1AndMarksIt(t *testing.T) {
+	var gotPath string
+	var gotV1 bool
+	h := httputil.Versioned(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath, gotV1 = r.URL.Path, httputil.V1(r)
+	}))
+
+	for _, tc := range []struct {
+		target, header string
+		wantPath       string
+		wantV1         bool
+	}{
+		{"/api/v1/files?path=/", "", "/api/files", true},
+		{"/api/files?path=/", "", "/api/files", false},
+		// A client can't opt a legacy path into v1 by hand.
+		{"/api/files", "1", "/api/files", false},
+		{"/api/v1", "", "/api/v1", false},
+	} {
+		req := httptest.NewRequest("GET", tc.target, nil)
+		if tc.header != "" {
+			req.Header.Set(httputil.VersionHeader, tc.header)
+		}
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		if gotPath != tc.wantPath || gotV1 != tc.wantV1 {
+			t.Errorf("%s: got (%s, %v), want (%s, %v)", tc.target, gotPath, gotV1, tc.wantPath, tc.wantV1)
+		}
+	}
+}
+
+func TestPaginate(t *testing.T) {
+	items := []int{0, 1, 2, 3, 4}
+	for _, tc := range []struct {
+		query   string
+		want    []int
+		wantErr bool
+	}{
+		{"", items, false},
+		{"?offset=1&limit=2", []int{1, 2}, false},
+		{"?offset=4&limit=10", []int{4}, false},
+		{"?offset=9", []int{}, false},
+		{"?limit=0", nil, true},
+		{"?offset=-1", nil, true},
+		{"?limit=lots", nil, true},
+	} {
+		page, err := httputil.Paginate(httptest.NewRequest("GET", "/api/files"+tc.query, nil), items)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%q: err = %v", tc.query, err)
+			continue
+		}
+		if tc.wantErr {
+			continue
+		}
+		if len(page.Items) != len(tc.want) || page.Pagination.Total != len(items) {
+			t.Errorf("%q: got %+v, want items %v", tc.query, page, tc.want)
+			continue
+		}
+		for i := range tc.want {
+			if page.Items[i] != tc.want[i] {
+				t.Errorf("%q: got %v, want %v", tc.query, page.Items, tc.want)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,17 @@
+package latency
+
+import (
+	"net/http"
+
+	"github.com/strct-org/strct-agent/internal/httputil"
+)
+
+func (t *Tracker) RegisterRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/system/latency", t.handleLatency)
+}
+
+// handleLatency reports request latency per route since the agent started.
+// GET /api/system/latency
+func (t *Tracker) handleLatency(w http.ResponseWriter, r *http.Request) {
+	httputil.OK(w, t.Report())
+}
@@ -0,0 +1,401 @@
+// Package latency times every API request by route. Each route gets a
+// histogram with fixed buckets and a request counter per status code,
+// exported on /metrics and summarised on GET /api/system/latency, and a
+// request slower than the threshold is logged with its route, duration,
+// size, where it came from and what it spent the time on.
+//
+// Handlers say what they are doing with marks on the request context:
+//
+//	latency.Mark(r.Context(), "readdir")
+//
+// puts the time since the previous mark, or since the request started,
+// down to the readdir phase. The slow-request log names the phase that
+// took longest. Mark on a context the tracker didn't make does nothing,
+// so handlers mark unconditionally. A request marked with Stream, one
+// that lasts as long as its client does, is counted but not timed.
+//
+// A fast request costs two allocations, the trace and the copy of the
+// request that carries it; recording it in the histogram costs none.
+package latency
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/metrics"
+)
+
+// Buckets are the histogram upper bounds, in seconds.
+var Buckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// otherRoute labels requests no route matched: 404s, and those a
+// middleware answered before the mux.
+const otherRoute = "other"
+
+// slowLogger is where slow requests are logged. A var so tests can read
+// the records.
+var slowLogger = slog.Default
+
+// maxPhases is how many distinct phases a request records. Time in any
+// past that stays unattributed.
+const maxPhases = 8
+
+type Config struct {
+	// Slow is the duration past which a request is logged. 0 logs none.
+	Slow time.Duration
+	// FromTunnel reports whether a request came through the tunnel, for
+	// the origin in the slow-request log. Optional.
+	FromTunnel func(*http.Request) bool
+	// Registry is where the histograms are registered; nil is
+	// metrics.Default.
+	Registry *metrics.Registry
+}
+
+// Tracker times requests. Safe for concurrent use.
+type Tracker struct {
+	cfg    Config
+	mu     sync.RWMutex
+	routes map[string]*route
+}
+
+type route struct {
+	name     string
+	hist     *metrics.Histogram
+	slow     atomic.Uint64
+	lastSlow atomic.Int64 // unix nanoseconds; 0 if never
+
+	codesMu sync.RWMutex
+	codes   map[int]*metrics.Counter // by status code
+}
+
+func New(cfg Config) *Tracker {
+	if cfg.Registry == nil {
+		cfg.Registry = metrics.Default
+	}
+	return &Tracker{cfg: cfg, routes: make(map[string]*route)}
+}
+
+// ─── Per-request trace ───────────────────────────────────────────────────────
+
+type ctxKey struct{}
+
+type phase struct {
+	name string
+	d    time.Duration
+}
+
+// trace is everything one request needs, in one allocation: the context
+// carrying it, the wrapped writer and the marks.
+type trace struct {
+	ctx    traceCtx
+	w      writer
+	start  time.Time
+	last   time.Time // the previous mark
+	phases [maxPhases]phase
+	n      int
+	stream bool // see Stream
+}
+
+// traceCtx is the request context with the trace in it. It is a type of
+// its own, not context.WithValue, so it can live inside trace.
+type traceCtx struct {
+	context.Context
+	t *trace
+}
+
+func (c *traceCtx) Value(key any) any {
+	if key == (ctxKey{}) {
+		return c.t
+	}
+	return c.Context.Value(key)
+}
+
+// Mark puts the time since the last mark down to phase. Marks are made
+// by the handler's own goroutine; a trace is not safe for concurrent use.
+func Mark(ctx context.Context, name string) {
+	t, _ := ctx.Value(ctxKey{}).(*trace)
+	if t == nil {
+		return
+	}
+	now := time.Now()
+	d := now.Sub(t.last)
+	t.last = now
+	for i := range t.n {
+		if t.phases[i].name == name {
+			t.phases[i].d += d
+			return
+		}
+	}
+	if t.n < maxPhases {
+		t.phases[t.n] = phase{name, d}
+		t.n++
+	}
+}
+
+// Stream marks the request as a stream that lasts as long as its client
+// stays, like GET /api/events. It is counted by status like any other,
+// but kept out of the histogram and the slow-request log, where its hours
+// would drown the requests that are slow.
+func Stream(ctx context.Context) {
+	if t, _ := ctx.Value(ctxKey{}).(*trace); t != nil {
+		t.stream = true
+	}
+}
+
+// writer records the status and the bytes written.
+type writer struct {
+	http.ResponseWriter
+	code  int
+	bytes int64
+}
+
+func (w *writer) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// ReadFrom keeps the underlying writer's sendfile path for downloads.
+func (w *writer) ReadFrom(src io.Reader) (int64, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	n, err := io.Copy(w.ResponseWriter, src)
+	w.bytes += n
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the connection's writer.
+func (w *writer) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+// ─── Middleware ──────────────────────────────────────────────────────────────
+
+// Middleware times each request under the mux route it matched. It must
+// wrap the mux without cloning the request on the way, since the route is
+// read back from the request the mux saw.
+func (t *Tracker) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tr := &trace{start: time.Now()}
+		tr.last = tr.start
+		tr.ctx = traceCtx{Context: r.Context(), t: tr}
+		tr.w = writer{ResponseWriter: w}
+		r = r.WithContext(&tr.ctx)
+
+		next.ServeHTTP(&tr.w, r)
+
+		d := time.Since(tr.start)
+		name := r.Pattern
+		if name == "" {
+			name = otherRoute
+		}
+		code := tr.w.code
+		if code == 0 {
+			code = http.StatusOK
+		}
+		rt := t.route(name)
+		t.counter(rt, code).Inc()
+		if tr.stream {
+			return
+		}
+		rt.hist.Observe(d.Seconds())
+		if t.cfg.Slow > 0 && d >= t.cfg.Slow {
+			rt.slow.Add(1)
+			rt.lastSlow.Store(time.Now().UnixNano())
+			t.logSlow(r, name, tr, d)
+		}
+	})
+}
+
+func (t *Tracker) route(name string) *route {
+	t.mu.RLock()
+	rt, ok := t.routes[name]
+	t.mu.RUnlock()
+	if ok {
+		return rt
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if rt, ok := t.routes[name]; ok {
+		return rt
+	}
+	rt = &route{name: name, codes: make(map[int]*metrics.Counter), hist: t.cfg.Registry.Histogram("strct_http_request_duration_seconds",
+		"API request latency by route.", Buckets, "route", name)}
+	t.routes[name] = rt
+	return rt
+}
+
+// counter is rt's request counter for code.
+func (t *Tracker) counter(rt *route, code int) *metrics.Counter {
+	rt.codesMu.RLock()
+	c, ok := rt.codes[code]
+	rt.codesMu.RUnlock()
+	if ok {
+		return c
+	}
+	rt.codesMu.Lock()
+	defer rt.codesMu.Unlock()
+	if c, ok := rt.codes[code]; ok {
+		return c
+	}
+	c = t.cfg.Registry.Counter("strct_http_requests_total",
+		"API requests by route and status code.", "route", rt.name, "code", strconv.Itoa(code))
+	rt.codes[code] = c
+	return c
+}
+
+func (t *Tracker) logSlow(r *http.Request, name string, tr *trace, d time.Duration) {
+	code := tr.w.code
+	if code == 0 {
+		code = http.StatusOK
+	}
+	attrs := []any{
+		"route", name,
+		"method", r.Method,
+		"path", r.URL.Path,
+		"status", code,
+		"duration", d.Round(time.Millisecond),
+		"bytes_out", tr.w.bytes,
+		"origin", t.origin(r),
+	}
+	if r.ContentLength > 0 {
+		attrs = append(attrs, "bytes_in", r.ContentLength)
+	}
+	if tr.n > 0 {
+		phases := make([]any, 0, tr.n+1)
+		dominant, longest := "", time.Duration(-1)
+		var marked time.Duration
+		for _, p := range tr.phases[:tr.n] {
+			phases = append(phases, slog.Duration(p.name, p.d.Round(time.Microsecond)))
+			marked += p.d
+			if p.d > longest {
+				dominant, longest = p.name, p.d
+			}
+		}
+		if rest := d - marked; rest > 0 {
+			phases = append(phases, slog.Duration("other", rest.Round(time.Microsecond)))
+			if rest > longest {
+				dominant = "other"
+			}
+		}
+		attrs = append(attrs, "phase", dominant, slog.Group("phases", phases...))
+	}
+	slowLogger().Warn("latency: slow request", attrs...)
+}
+
+// origin classes where a request came from: tunnel, socket (the admin
+// socket, or the agent in the file worker), local, lan or remote.
+func (t *Tracker) origin(r *http.Request) string {
+	if t.cfg.FromTunnel != nil && t.cfg.FromTunnel(r) {
+		return "tunnel"
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return "socket"
+	}
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		return "unknown"
+	case ip.IsLoopback():
+		return "local"
+	case ip.IsPrivate() || ip.IsLinkLocalUnicast():
+		return "lan"
+	}
+	return "remote"
+}
+
+// ─── Report ──────────────────────────────────────────────────────────────────
+
+// Bucket is one histogram bucket of a RouteLatency.
+type Bucket struct {
+	LeMs  *float64 `json:"le_ms"` // upper bound; null for the last, unbounded one
+	Count uint64   `json:"count"` // requests in this bucket alone
+}
+
+// RouteLatency is one route's entry in GET /api/system/latency.
+type RouteLatency struct {
+	Route      string     `json:"route"`
+	Count      uint64     `json:"count"`
+	MeanMs     float64    `json:"mean_ms"`
+	P50Ms      float64    `json:"p50_ms"` // estimated from the buckets
+	P90Ms      float64    `json:"p90_ms"`
+	P99Ms      float64    `json:"p99_ms"`
+	SlowCount  uint64     `json:"slow_count"`
+	LastSlowAt *time.Time `json:"last_slow_at,omitempty"`
+	Buckets    []Bucket   `json:"buckets"`
+
+	// Codes counts the requests by status code.
+	Codes map[int]uint64 `json:"codes"`
+}
+
+// Report is the JSON shape of GET /api/system/latency.
+type Report struct {
+	SlowThresholdMs int64          `json:"slow_threshold_ms"` // 0: slow requests are not logged
+	Routes          []RouteLatency `json:"routes"`
+}
+
+// Report summarises every route seen so far, sorted by route.
+func (t *Tracker) Report() Report {
+	t.mu.RLock()
+	names := make([]string, 0, len(t.routes))
+	for name := range t.routes {
+		names = append(names, name)
+	}
+	t.mu.RUnlock()
+	sort.Strings(names)
+
+	rep := Report{SlowThresholdMs: t.cfg.Slow.Milliseconds(), Routes: make([]RouteLatency, 0, len(names))}
+	for _, name := range names {
+		rt := t.route(name)
+		s := rt.hist.Snapshot()
+		rl := RouteLatency{
+			Route:     name,
+			Count:     s.Count,
+			P50Ms:     s.Quantile(0.5) * 1000,
+			P90Ms:     s.Quantile(0.9) * 1000,
+			P99Ms:     s.Quantile(0.99) * 1000,
+			SlowCount: rt.slow.Load(),
+			Buckets:   make([]Bucket, len(s.Counts)),
+			Codes:     make(map[int]uint64),
+		}
+		rt.codesMu.RLock()
+		for code, c := range rt.codes {
+			rl.Codes[code] = c.Value()
+		}
+		rt.codesMu.RUnlock()
+		if s.Count > 0 {
+			rl.MeanMs = s.Sum / float64(s.Count) * 1000
+		}
+		if ns := rt.lastSlow.Load(); ns != 0 {
+			at := time.Unix(0, ns).UTC()
+			rl.LastSlowAt = &at
+		}
+		for i, c := range s.Counts {
+			rl.Buckets[i].Count = c
+			if i < len(s.Bounds) {
+				ms := s.Bounds[i] * 1000
+				rl.Buckets[i].LeMs = &ms
+			}
+		}
+		rep.Routes = append(rep.Routes, rl)
+	}
+	return rep
+}
@@ -0,0 +1,223 @@
+package latency
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/httputil"
+	"github.com/strct-org/strct-agent/internal/metrics"
+)
+
+func newMux(t testing.TB, cfg Config) (*Tracker, *metrics.Registry, http.Handler) {
+	t.Helper()
+	reg := metrics.NewRegistry()
+	cfg.Registry = reg
+	tr := New(cfg)
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/files", func(w http.ResponseWriter, r *http.Request) {
+		Mark(r.Context(), "resolve")
+		if r.URL.Query().Get("slow") != "" {
+			time.Sleep(30 * time.Millisecond)
+		}
+		Mark(r.Context(), "readdir")
+		w.Write([]byte(`{"files":[]}`))
+	})
+	tr.RegisterRoutes(mux)
+	return tr, reg, tr.Middleware(mux)
+}
+
+// captureSlowLog collects what is logged as slow until the test ends.
+func captureSlowLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	l := slog.New(slog.NewJSONHandler(&buf, nil))
+	slowLogger = func() *slog.Logger { return l }
+	t.Cleanup(func() { slowLogger = slog.Default })
+	return &buf
+}
+
+func serve(h http.Handler, target, remote string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", target, nil)
+	req.RemoteAddr = remote
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestMiddleware_HistogramPerRoute(t *testing.T) {
+	tr, reg, h := newMux(t, Config{Slow: time.Hour})
+	for range 2 {
+		serve(h, "/api/files?path=/", "192.168.1.20:5000")
+	}
+	// Counted under the route the /api/v1/ path resolves to.
+	serve(httputil.Versioned(h), "/api/v1/files?path=/", "192.168.1.20:5000")
+	serve(h, "/nope", "192.168.1.20:5000")
+
+	var text bytes.Buffer
+	reg.WriteText(&text)
+	for _, want := range []string{
+		"# TYPE strct_http_request_duration_seconds histogram",
+		`strct_http_request_duration_seconds_bucket{route="GET /api/files",le="0.005"}`,
+		`strct_http_request_duration_seconds_bucket{route="GET /api/files",le="+Inf"} 3`,
+		`strct_http_request_duration_seconds_count{route="GET /api/files"} 3`,
+		`strct_http_request_duration_seconds_count{route="other"} 1`,
+		"# TYPE strct_http_requests_total counter",
+		`strct_http_requests_total{route="GET /api/files",code="200"} 3`,
+		`strct_http_requests_total{route="other",code="404"} 1`,
+	} {
+		if !strings.Contains(text.String(), want) {
+			t.Errorf("/metrics lacks %s:\n%s", want, text.String())
+		}
+	}
+
+	rep := tr.Report()
+	if rep.SlowThresholdMs != time.Hour.Milliseconds() || len(rep.Routes) != 2 {
+		t.Fatalf("report = %+v", rep)
+	}
+	files := rep.Routes[0]
+	if files.Route != "GET /api/files" || files.Count != 3 || files.SlowCount != 0 || len(files.Buckets) != len(Buckets)+1 {
+		t.Errorf("files route = %+v", files)
+	}
+	if len(files.Codes) != 1 || files.Codes[200] != 3 || rep.Routes[1].Codes[404] != 1 {
+		t.Errorf("codes = %v, %v", files.Codes, rep.Routes[1].Codes)
+	}
+	if files.P99Ms <= 0 || files.P99Ms > 5 || files.Buckets[len(Buckets)].LeMs != nil {
+		t.Errorf("files quantiles and buckets = %+v", files)
+	}
+}
+
+func TestMiddleware_LogsSlowRequests(t *testing.T) {
+	logs := captureSlowLog(t)
+	tr, _, h := newMux(t, Config{
+		Slow:       20 * time.Millisecond,
+		FromTunnel: func(r *http.Request) bool { return r.Host == "dev1.strct.org" },
+	})
+	serve(h, "/api/files?path=/", "192.168.1.20:5000")
+	if logs.Len() != 0 {
+		t.Fatalf("fast request logged: %s", logs)
+	}
+
+	req := httptest.NewRequest("GET", "/api/files?slow=1", nil)
+	req.Host, req.RemoteAddr = "dev1.strct.org", "127.0.0.1:40000"
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	var rec struct {
+		Msg      string
+		Route    string
+		Status   int
+		Duration int64
+		BytesOut int64 `json:"bytes_out"`
+		Origin   string
+		Phase    string
+		Phases   map[string]int64
+	}
+	if err := json.Unmarshal(logs.Bytes(), &rec); err != nil {
+		t.Fatalf("decode %s: %v", logs, err)
+	}
+	if rec.Msg != "latency: slow request" || rec.Route != "GET /api/files" || rec.Status != 200 ||
+		rec.BytesOut != int64(len(`{"files":[]}`)) || rec.Origin != "tunnel" {
+		t.Errorf("slow log = %+v", rec)
+	}
+	if rec.Phase != "readdir" || rec.Phases["readdir"] < int64(30*time.Millisecond) || rec.Duration < int64(30*time.Millisecond) {
+		t.Errorf("phase %q of %v, want readdir", rec.Phase, rec.Phases)
+	}
+	if r := tr.Report().Routes[0]; r.SlowCount != 1 || r.LastSlowAt == nil {
+		t.Errorf("report = %+v", r)
+	}
+}
+
+func TestStream_CountedButNotTimed(t *testing.T) {
+	logs := captureSlowLog(t)
+	tr := New(Config{Slow: time.Millisecond, Registry: metrics.NewRegistry()})
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/events", func(w http.ResponseWriter, r *http.Request) {
+		Stream(r.Context())
+		time.Sleep(5 * time.Millisecond)
+	})
+	serve(tr.Middleware(mux), "/api/events", "192.168.1.20:5000")
+
+	r := tr.Report().Routes[0]
+	if r.Count != 0 || r.SlowCount != 0 || r.Codes[200] != 1 {
+		t.Errorf("stream route = %+v", r)
+	}
+	if logs.Len() != 0 {
+		t.Errorf("stream logged as slow: %s", logs)
+	}
+	Stream(context.Background()) // outside a trace: ignored
+}
+
+func TestMark_OutsideATraceIsIgnored(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	Mark(req.Context(), "resolve") // must not panic
+}
+
+func TestOrigin(t *testing.T) {
+	tr := New(Config{Registry: metrics.NewRegistry()})
+	for remote, want := range map[string]string{
+		"127.0.0.1:5000":   "local",
+		"[::1]:5000":       "local",
+		"192.168.4.7:5000": "lan",
+		"10.0.0.3:5000":    "lan",
+		"[fe80::1]:5000":   "lan",
+		"203.0.113.9:5000": "remote",
+		"@":                "socket",
+		"":                 "socket",
+		"not-an-ip:5000":   "unknown",
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = remote
+		if got := tr.origin(req); got != want {
+			t.Errorf("origin(%q) = %q, want %q", remote, got, want)
+		}
+	}
+}
+
+// discard is a ResponseWriter that allocates nothing.
+type discard struct{ h http.Header }
+
+func (d discard) Header() http.Header       { return d.h }
+func (discard) Write(p []byte) (int, error) { return len(p), nil }
+func (discard) WriteHeader(int)             {}
+
+func TestMiddleware_FastPathAllocations(t *testing.T) {
+	reg := metrics.NewRegistry()
+	tr := New(Config{Slow: time.Hour, Registry: reg})
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Mark(r.Context(), "resolve")
+		w.WriteHeader(http.StatusNoContent)
+	})
+	h := tr.Middleware(ok)
+	req := httptest.NewRequest("GET", "/api/files", nil)
+	w := discard{h: http.Header{}}
+	h.ServeHTTP(w, req) // registers the route
+
+	bare := testing.AllocsPerRun(100, func() { ok.ServeHTTP(w, req) })
+	traced := testing.AllocsPerRun(100, func() { h.ServeHTTP(w, req) })
+	// The trace and the request copy carrying it; nothing for the marks
+	// or the histogram.
+	if traced-bare > 2 {
+		t.Errorf("middleware adds %v allocations per request, want at most 2", traced-bare)
+	}
+}
+
+func BenchmarkMiddleware(b *testing.B) {
+	tr := New(Config{Slow: time.Hour, Registry: metrics.NewRegistry()})
+	h := tr.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Mark(r.Context(), "resolve")
+		Mark(r.Context(), "encode")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	req := httptest.NewRequest("GET", "/api/files", nil)
+	w := discard{h: http.Header{}}
+	b.ReportAllocs()
+	for b.Loop() {
+		h.ServeHTTP(w, req)
+	}
+}
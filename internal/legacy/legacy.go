@@ -0,0 +1,377 @@
+// Package legacy moves a device from the old cloud-agent deployment onto
+// this agent, once. The old layout kept device-id.lock and .env in the
+// service's working directory, served /mnt/data through a FileBrowser
+// container and ran frpc from its own loop in cloud-agent.service.
+//
+// Migrate imports the device ID, so the tunnel subdomain stays the same,
+// carries the .env settings over to config.EnvPath, adopts /mnt/data as
+// DataDir where it is, and stops and disables the container and the old
+// unit. Nothing is copied or deleted: the old files stay where they are,
+// and the container and its image are left for the owner to remove.
+// Every step is listed in a Report, also in a dry run; a migration that
+// went through is recorded, and later runs stop at ErrMigrated.
+package legacy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+
+	"github.com/strct-org/strct-agent/internal/config"
+	"github.com/strct-org/strct-agent/internal/fsutil"
+	"github.com/strct-org/strct-agent/internal/platform/disk"
+	"github.com/strct-org/strct-agent/internal/statefile"
+)
+
+// The old deployment's pieces, as installed on devices in the field.
+const (
+	Unit       = "cloud-agent.service"
+	Container  = "filebrowser"
+	DataDir    = "/mnt/data"
+	RecordPath = "/etc/strct/legacy-migration.json"
+)
+
+// unitDirs are where the old unit file may be installed.
+var unitDirs = []string{"/etc/systemd/system", "/lib/systemd/system"}
+
+// recordSchema versions legacy-migration.json.
+//
+//	v1: Report as-is
+var recordSchema = statefile.Schema{
+	Name:       "legacy-migration",
+	Migrations: []statefile.Migration{statefile.Stamp},
+}
+
+// ErrMigrated is returned when this device was migrated before.
+var ErrMigrated = errors.New("already migrated")
+
+// Steps, in the order they run.
+const (
+	StepDeviceID    = "device-id"
+	StepSettings    = "settings"
+	StepDataDir     = "data-dir"
+	StepUnit        = "unit"
+	StepFileBrowser = "filebrowser"
+)
+
+// Action outcomes.
+const (
+	ActionDone    = "done"
+	ActionPlanned = "planned" // a dry run would have done it
+	ActionSkipped = "skipped" // nothing to do
+	ActionFailed  = "failed"
+)
+
+// Action is one step of a migration.
+type Action struct {
+	Step   string `json:"step"`
+	Status string `json:"status"`
+	Detail string `json:"detail"`
+}
+
+// Report lists what a migration did, or would do in a dry run.
+type Report struct {
+	DryRun bool `json:"dry_run"`
+	// Found is false when there is nothing of the old deployment on the
+	// device; Actions is empty then.
+	Found   bool      `json:"legacy_found"`
+	Dir     string    `json:"legacy_dir,omitempty"` // the old working directory
+	Actions []Action  `json:"actions"`
+	At      time.Time `json:"at"`
+}
+
+// Failed reports whether any step failed.
+func (r Report) Failed() bool {
+	return slices.ContainsFunc(r.Actions, func(a Action) bool { return a.Status == ActionFailed })
+}
+
+type commander interface {
+	Output(name string, args ...string) ([]byte, error)
+	CombinedOutput(name string, args ...string) ([]byte, error)
+}
+
+// Options configures Migrate.
+type Options struct {
+	// Root is the file system the device's paths are under: "/" on a
+	// device, a temp dir in tests.
+	Root string
+	// Dir is the old agent's working directory, holding device-id.lock
+	// and .env. Empty takes WorkingDirectory= from the old unit, or "/",
+	// systemd's default.
+	Dir    string
+	DryRun bool
+	Cmd    commander
+	Now    func() time.Time
+}
+
+// device holds a real device's paths; Options.Root is put in front.
+var device = &config.Config{}
+
+func (o Options) path(p string) string { return filepath.Join(o.Root, p) }
+
+// Migrate runs the migration and returns its report. It returns an error
+// only when it could not start: the device was migrated before, or the
+// record could not be read. A step that fails is in the report; the
+// others still run, and a failed migration is not recorded, so it can be
+// run again once the cause is fixed.
+func Migrate(o Options) (Report, error) {
+	if o.Now == nil {
+		o.Now = time.Now
+	}
+	var prev Report
+	switch err := statefile.Load(o.path(RecordPath), recordSchema, &prev); {
+	case err == nil:
+		return prev, fmt.Errorf("%w on %s, see %s", ErrMigrated, prev.At.Format("2006-01-02"), RecordPath)
+	case !statefile.Fresh(err):
+		return Report{}, fmt.Errorf("read migration record: %w", err)
+	}
+
+	unit := o.unitFile()
+	if o.Dir == "" {
+		o.Dir = workingDirectory(unit)
+	}
+	r := Report{DryRun: o.DryRun, Dir: o.Dir, Actions: []Action{}, At: o.Now().UTC()}
+	container := o.containerState()
+	r.Found = unit != "" || container != "" ||
+		exists(o.path(filepath.Join(o.Dir, "device-id.lock"))) || exists(o.path(filepath.Join(o.Dir, ".env")))
+	if !r.Found {
+		return r, nil
+	}
+
+	r.Actions = append(r.Actions,
+		o.importDeviceID(),
+		o.carrySettings(),
+		o.adoptDataDir(),
+		o.disableUnit(unit),
+		o.stopContainer(container),
+	)
+	if !o.DryRun && !r.Failed() {
+		if err := statefile.Save(o.path(RecordPath), recordSchema, r); err != nil {
+			r.Actions = append(r.Actions, Action{"record", ActionFailed, err.Error()})
+		}
+	}
+	return r, nil
+}
+
+// did is a step's Action: done, or planned in a dry run.
+func (o Options) did(step, detail string) Action {
+	if o.DryRun {
+		return Action{step, ActionPlanned, detail}
+	}
+	return Action{step, ActionDone, detail}
+}
+
+// importDeviceID copies the old device ID over the new one. An ID this
+// agent already generated is kept next to it as device-id.lock.replaced.
+func (o Options) importDeviceID() Action {
+	oldPath := filepath.Join(o.Dir, "device-id.lock")
+	b, err := os.ReadFile(o.path(oldPath))
+	if errors.Is(err, os.ErrNotExist) {
+		return Action{StepDeviceID, ActionSkipped, "no " + oldPath + "; the device keeps the ID this agent generated"}
+	}
+	if err != nil {
+		return Action{StepDeviceID, ActionFailed, err.Error()}
+	}
+	id := strings.TrimSpace(string(b))
+	if id == "" {
+		return Action{StepDeviceID, ActionFailed, oldPath + " is empty"}
+	}
+
+	newPath := o.path(config.DeviceIDPath(false))
+	cur, err := os.ReadFile(newPath)
+	current := strings.TrimSpace(string(cur))
+	switch {
+	case err == nil && current == id:
+		return Action{StepDeviceID, ActionSkipped, id + " is already the device ID"}
+	case err != nil && !errors.Is(err, os.ErrNotExist):
+		return Action{StepDeviceID, ActionFailed, err.Error()}
+	}
+	detail := "imported " + id
+	if current != "" {
+		detail += " over " + current + ", kept in device-id.lock.replaced"
+	}
+	if o.DryRun {
+		return o.did(StepDeviceID, detail)
+	}
+	if current != "" {
+		if err := os.WriteFile(newPath+".replaced", cur, 0644); err != nil {
+			return Action{StepDeviceID, ActionFailed, err.Error()}
+		}
+	}
+	if err := fsutil.WriteFileAtomic(newPath, []byte(id), 0644); err != nil {
+		return Action{StepDeviceID, ActionFailed, err.Error()}
+	}
+	return o.did(StepDeviceID, detail)
+}
+
+// carrySettings adds the old .env's values to config.EnvPath. Settings
+// already there are kept. The report names the keys, never the values:
+// AUTH_TOKEN is one of them.
+func (o Options) carrySettings() Action {
+	oldPath := filepath.Join(o.Dir, ".env")
+	old, err := godotenv.Read(o.path(oldPath))
+	if errors.Is(err, os.ErrNotExist) {
+		return Action{StepSettings, ActionSkipped, "no " + oldPath}
+	}
+	if err != nil {
+		return Action{StepSettings, ActionFailed, err.Error()}
+	}
+	newPath := o.path(config.EnvPath(false))
+	merged, err := godotenv.Read(newPath)
+	if errors.Is(err, os.ErrNotExist) {
+		merged, err = map[string]string{}, nil
+	}
+	if err != nil {
+		return Action{StepSettings, ActionFailed, err.Error()}
+	}
+
+	var added, kept []string
+	for k, v := range old {
+		if _, ok := merged[k]; ok {
+			kept = append(kept, k)
+			continue
+		}
+		merged[k] = v
+		added = append(added, k)
+	}
+	slices.Sort(added)
+	slices.Sort(kept)
+	if len(added) == 0 {
+		return Action{StepSettings, ActionSkipped, "every setting in " + oldPath + " is already in " + config.EnvPath(false)}
+	}
+	detail := fmt.Sprintf("%d settings to %s: %s", len(added), config.EnvPath(false), strings.Join(added, ", "))
+	if len(kept) > 0 {
+		detail += "; already set there: " + strings.Join(kept, ", ")
+	}
+	if o.DryRun {
+		return o.did(StepSettings, detail)
+	}
+	content, err := godotenv.Marshal(merged)
+	if err != nil {
+		return Action{StepSettings, ActionFailed, err.Error()}
+	}
+	if err := fsutil.WriteFileAtomic(newPath, []byte(content+"\n"), 0600); err != nil {
+		return Action{StepSettings, ActionFailed, err.Error()}
+	}
+	return o.did(StepSettings, detail)
+}
+
+// adoptDataDir keeps the files in /mnt/data, which is DataDir already on
+// real hardware. What could move it is drive auto-detection mounting a
+// drive at /mnt/strct_data, so a storage decision to stay off the drives
+// is saved, as the setup portal does for the SD card. A drive the old
+// install mounted at /mnt/data through fstab stays mounted there.
+func (o Options) adoptDataDir() Action {
+	fi, err := os.Stat(o.path(DataDir))
+	if err != nil || !fi.IsDir() {
+		return Action{StepDataDir, ActionSkipped, "no " + DataDir}
+	}
+	decPath := device.StorageDecisionPath()
+	if exists(o.path(decPath)) {
+		return Action{StepDataDir, ActionSkipped, "a storage choice is already saved in " + decPath + "; left as it is"}
+	}
+	detail := DataDir + " stays DataDir as it is, nothing copied; drive auto-detection is turned off in " + decPath
+	if o.DryRun {
+		return o.did(StepDataDir, detail)
+	}
+	if err := disk.SaveDecision(o.path(decPath), disk.Decision{UseSDCard: true, DecidedAt: o.Now().UTC()}); err != nil {
+		return Action{StepDataDir, ActionFailed, err.Error()}
+	}
+	return o.did(StepDataDir, detail)
+}
+
+// disableUnit stops the old agent, and with it its frpc, and keeps it
+// from starting at boot. unit is its unit file, "" if there is none.
+func (o Options) disableUnit(unit string) Action {
+	if unit == "" {
+		return Action{StepUnit, ActionSkipped, "no " + Unit}
+	}
+	detail := "stopped and disabled " + Unit + ", and the frpc it ran"
+	if o.DryRun {
+		return o.did(StepUnit, detail)
+	}
+	if out, err := o.Cmd.CombinedOutput("systemctl", "disable", "--now", Unit); err != nil {
+		return Action{StepUnit, ActionFailed, commandError(err, out)}
+	}
+	return o.did(StepUnit, detail)
+}
+
+// stopContainer stops FileBrowser and keeps docker from restarting it.
+// state is the container's docker state, "" if there is none.
+func (o Options) stopContainer(state string) Action {
+	if state == "" {
+		return Action{StepFileBrowser, ActionSkipped, "no " + Container + " container"}
+	}
+	detail := "set the " + Container + " container's restart policy to no"
+	if state == "running" {
+		detail = "stopped the " + Container + " container and set its restart policy to no"
+	}
+	detail += "; remove it with docker rm " + Container
+	if o.DryRun {
+		return o.did(StepFileBrowser, detail)
+	}
+	if out, err := o.Cmd.CombinedOutput("docker", "update", "--restart=no", Container); err != nil {
+		return Action{StepFileBrowser, ActionFailed, commandError(err, out)}
+	}
+	if state == "running" {
+		if out, err := o.Cmd.CombinedOutput("docker", "stop", Container); err != nil {
+			return Action{StepFileBrowser, ActionFailed, commandError(err, out)}
+		}
+	}
+	return o.did(StepFileBrowser, detail)
+}
+
+// unitFile returns the old unit's file under Root, or "".
+func (o Options) unitFile() string {
+	for _, dir := range unitDirs {
+		if p := o.path(filepath.Join(dir, Unit)); exists(p) {
+			return p
+		}
+	}
+	return ""
+}
+
+// containerState is the FileBrowser container's state ("running",
+// "exited", …), or "" without docker or the container.
+func (o Options) containerState() string {
+	out, err := o.Cmd.Output("docker", "inspect", "--format", "{{.State.Status}}", Container)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// workingDirectory reads WorkingDirectory= from a unit file.
+func workingDirectory(unit string) string {
+	b, err := os.ReadFile(unit)
+	if err != nil {
+		return "/"
+	}
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for sc.Scan() {
+		if v, ok := strings.CutPrefix(strings.TrimSpace(sc.Text()), "WorkingDirectory="); ok && filepath.IsAbs(v) {
+			return filepath.Clean(v)
+		}
+	}
+	return "/"
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func commandError(err error, out []byte) string {
+	if msg := strings.TrimSpace(string(out)); msg != "" {
+		return fmt.Sprintf("%v: %s", err, msg)
+	}
+	return err.Error()
+}
@@ -0,0 +1,198 @@
+package legacy
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/joho/godotenv"
+
+	"github.com/strct-org/strct-agent/internal/platform/disk"
+	"github.com/strct-org/strct-agent/internal/platform/executil"
+)
+
+const legacyDir = "/home/pi/cloud-agent"
+
+// legacyRoot lays out a device as the old deployment left it, with this
+// agent installed and started once next to it.
+func legacyRoot(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	for path, content := range map[string]string{
+		"etc/systemd/system/cloud-agent.service": "[Service]\nWorkingDirectory=" + legacyDir + "\nExecStart=" + legacyDir + "/cloud-agent\n",
+		legacyDir + "/device-id.lock":            "device-1f0c\n",
+		legacyDir + "/.env":                      "VPS_IP=203.0.113.7\nAUTH_TOKEN=s3cret\n# the old domain\nDOMAIN=strct.org\n",
+		"mnt/data/photos/beach.jpg":              "jpeg",
+		"etc/strct/device-id.lock":               "device-9a77",
+		"etc/strct/agent.env":                    "VPS_IP=198.51.100.1\n",
+	} {
+		p := filepath.Join(root, path)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func runningContainer() *executil.Mock {
+	m := &executil.Mock{}
+	m.Expect("docker inspect --format {{.State.Status}} filebrowser", executil.MockResult{Output: []byte("running\n")})
+	return m
+}
+
+var at = time.Date(2024, 6, 3, 12, 0, 0, 0, time.UTC)
+
+func TestMigrate_LegacyLayout(t *testing.T) {
+	root := legacyRoot(t)
+	m := runningContainer()
+	r, err := Migrate(Options{Root: root, Cmd: m, Now: func() time.Time { return at }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.Found || r.Dir != legacyDir || r.Failed() || len(r.Actions) != 5 {
+		t.Fatalf("report = %+v", r)
+	}
+	for _, a := range r.Actions {
+		if a.Status != ActionDone {
+			t.Errorf("%s: %s %s", a.Step, a.Status, a.Detail)
+		}
+	}
+
+	// The old ID wins, so the tunnel subdomain stays; the new one is kept.
+	if b, _ := os.ReadFile(filepath.Join(root, "etc/strct/device-id.lock")); string(b) != "device-1f0c" {
+		t.Errorf("device ID = %q", b)
+	}
+	if b, _ := os.ReadFile(filepath.Join(root, "etc/strct/device-id.lock.replaced")); string(b) != "device-9a77" {
+		t.Errorf("replaced ID = %q", b)
+	}
+
+	// Settings are added; one already set on the device is not changed.
+	envPath := filepath.Join(root, "etc/strct/agent.env")
+	env, err := godotenv.Read(envPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env["VPS_IP"] != "198.51.100.1" || env["AUTH_TOKEN"] != "s3cret" || env["DOMAIN"] != "strct.org" || len(env) != 3 {
+		t.Errorf("agent.env = %v", env)
+	}
+	if fi, _ := os.Stat(envPath); fi.Mode().Perm() != 0600 {
+		t.Errorf("agent.env mode %v", fi.Mode().Perm())
+	}
+	if d := r.Actions[1].Detail; d != "2 settings to /etc/strct/agent.env: AUTH_TOKEN, DOMAIN; already set there: VPS_IP" {
+		t.Errorf("settings detail: %s", d)
+	}
+
+	// /mnt/data is adopted where it is.
+	dec, err := disk.LoadDecision(filepath.Join(root, "etc/strct/storage.json"))
+	if err != nil || dec == nil || !dec.UseSDCard || !dec.DecidedAt.Equal(at) {
+		t.Errorf("storage decision = %+v, %v", dec, err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "mnt/data/photos/beach.jpg")); err != nil {
+		t.Error(err)
+	}
+
+	m.AssertCalled(t, "systemctl disable --now cloud-agent.service")
+	m.AssertCalled(t, "docker update --restart=no filebrowser")
+	m.AssertCalled(t, "docker stop filebrowser")
+
+	// Once is enough.
+	if _, err := Migrate(Options{Root: root, Cmd: m}); !errors.Is(err, ErrMigrated) {
+		t.Errorf("second run: %v", err)
+	}
+}
+
+func TestMigrate_DryRunChangesNothing(t *testing.T) {
+	root := legacyRoot(t)
+	before := snapshot(t, root)
+	m := runningContainer()
+	r, err := Migrate(Options{Root: root, DryRun: true, Cmd: m})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.DryRun || len(r.Actions) != 5 {
+		t.Fatalf("report = %+v", r)
+	}
+	for _, a := range r.Actions {
+		if a.Status != ActionPlanned {
+			t.Errorf("%s: %s %s", a.Step, a.Status, a.Detail)
+		}
+	}
+	if after := snapshot(t, root); len(after) != len(before) {
+		t.Errorf("files changed: %v → %v", before, after)
+	} else {
+		for p, c := range before {
+			if after[p] != c {
+				t.Errorf("%s changed", p)
+			}
+		}
+	}
+	if len(m.Calls) != 1 {
+		t.Errorf("ran %v", m.Calls)
+	}
+}
+
+func TestMigrate_NothingFound(t *testing.T) {
+	m := &executil.Mock{}
+	m.Expect("docker inspect --format {{.State.Status}} filebrowser", executil.MockResult{Err: errors.New("exit status 1")})
+	r, err := Migrate(Options{Root: t.TempDir(), Cmd: m})
+	if err != nil || r.Found || len(r.Actions) != 0 || r.Dir != "/" {
+		t.Errorf("report = %+v, %v", r, err)
+	}
+}
+
+func TestMigrate_FailedStepIsNotRecorded(t *testing.T) {
+	root := legacyRoot(t)
+	m := runningContainer()
+	m.Expect("systemctl disable --now cloud-agent.service", executil.MockResult{
+		Output: []byte("Failed to disable unit: Access denied\n"), Err: errors.New("exit status 1"),
+	})
+	r, err := Migrate(Options{Root: root, Cmd: m})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.Failed() || r.Actions[3].Status != ActionFailed || r.Actions[3].Detail != "exit status 1: Failed to disable unit: Access denied" {
+		t.Errorf("unit step: %+v", r.Actions[3])
+	}
+	// The other steps still ran.
+	if r.Actions[0].Status != ActionDone || r.Actions[4].Status != ActionDone {
+		t.Errorf("actions = %+v", r.Actions)
+	}
+	if _, err := os.Stat(filepath.Join(root, "etc/strct/legacy-migration.json")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("recorded a failed migration: %v", err)
+	}
+
+	// Run again once fixed; the done steps have nothing left to do.
+	r, err = Migrate(Options{Root: root, Cmd: runningContainer()})
+	if err != nil || r.Failed() {
+		t.Fatalf("rerun: %+v, %v", r, err)
+	}
+	for _, i := range []int{0, 1, 2} {
+		if r.Actions[i].Status != ActionSkipped {
+			t.Errorf("rerun %s: %s", r.Actions[i].Step, r.Actions[i].Status)
+		}
+	}
+}
+
+// snapshot maps every file under root to its content.
+func snapshot(t *testing.T, root string) map[string]string {
+	t.Helper()
+	files := map[string]string{}
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		b, err := os.ReadFile(p)
+		files[p] = string(b)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
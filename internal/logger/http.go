@@ -0,0 +1,57 @@
+package logger
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/strct-org/strct-agent/internal/httputil"
+)
+
+// defaultLogLimit is how many records /api/system/logs returns without ?limit=.
+const defaultLogLimit = 100
+
+func (r *Ring) RegisterRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/system/logs", r.HandleLogs)
+}
+
+// HandleLogs returns the latest log records, oldest first. Other rings
+// serve it under their own path.
+// GET /api/system/logs                   the last 100 at INFO and above
+// GET /api/system/logs?since=120         only those after record 120
+// GET /api/system/logs?level=warn&limit=20
+// The response's "next" is the since to poll with for what comes after.
+func (r *Ring) HandleLogs(w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	var since uint64
+	if raw := q.Get("since"); raw != "" {
+		n, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			httputil.BadRequest(w, "since must be a record number")
+			return
+		}
+		since = n
+	}
+	limit := defaultLogLimit
+	if raw := q.Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 {
+			httputil.BadRequest(w, "limit must be a positive number")
+			return
+		}
+		limit = n
+	}
+	level := slog.LevelInfo
+	if raw := q.Get("level"); raw != "" {
+		if err := level.UnmarshalText([]byte(raw)); err != nil {
+			httputil.BadRequest(w, "level must be debug, info, warn or error")
+			return
+		}
+	}
+
+	entries, next := r.Since(since, limit, level)
+	if entries == nil {
+		entries = []Entry{}
+	}
+	httputil.OK(w, map[string]any{"entries": entries, "next": next})
+}
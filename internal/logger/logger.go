@@ -19,5 +19,5 @@ func Init(isDev bool) {
 		handler = slog.NewJSONHandler(os.Stdout, opts)
 	}
 
-	slog.SetDefault(slog.New(handler))
+	slog.SetDefault(slog.New(&ringHandler{Handler: handler, ring: Recent}))
 }
@@ -0,0 +1,150 @@
+package logger
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ringSize is how many records Recent keeps: a few hours of a quiet box,
+// enough for `strct logs` without reaching for journalctl.
+const ringSize = 2000
+
+// Recent holds the latest records logged through the default logger, for
+// GET /api/system/logs.
+var Recent = NewRing(ringSize)
+
+// Entry is one log record as /api/system/logs returns it.
+type Entry struct {
+	Seq   uint64    `json:"seq"`
+	Time  time.Time `json:"time"`
+	Level string    `json:"level"`
+	Msg   string    `json:"msg"`
+	// Attrs are the record's attributes as key=value pairs, the way the
+	// text handler writes them.
+	Attrs string `json:"attrs,omitempty"`
+
+	level slog.Level
+}
+
+// Ring is a fixed-size buffer of the latest log records. Each record gets
+// a sequence number so a reader can ask for what came after the last one
+// it saw.
+type Ring struct {
+	mu      sync.Mutex
+	entries []Entry // oldest first once full, see add
+	start   int
+	seq     uint64
+}
+
+func NewRing(size int) *Ring {
+	return &Ring{entries: make([]Entry, 0, size)}
+}
+
+func (r *Ring) add(e Entry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.seq++
+	e.Seq = r.seq
+	if len(r.entries) < cap(r.entries) {
+		r.entries = append(r.entries, e)
+		return
+	}
+	r.entries[r.start] = e
+	r.start = (r.start + 1) % len(r.entries)
+}
+
+// Since returns the newest limit records after seq at level or above,
+// oldest first, and the sequence number to pass as seq next time.
+func (r *Ring) Since(seq uint64, limit int, level slog.Level) ([]Entry, uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var out []Entry
+	for i := len(r.entries) - 1; i >= 0 && len(out) < limit; i-- {
+		e := r.entries[(r.start+i)%len(r.entries)]
+		if e.Seq <= seq {
+			break
+		}
+		if e.level >= level {
+			out = append(out, e)
+		}
+	}
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return out, r.seq
+}
+
+// Handler returns a handler that keeps a copy of each record in r and
+// passes it on to next, for a feature with a log of its own.
+func (r *Ring) Handler(next slog.Handler) slog.Handler {
+	return &ringHandler{Handler: next, ring: r}
+}
+
+// ringHandler passes records on to the real handler and keeps a copy in
+// a Ring.
+type ringHandler struct {
+	slog.Handler
+	ring   *Ring
+	attrs  string // from WithAttrs, already formatted
+	prefix string // from WithGroup, e.g. "req."
+}
+
+func (h *ringHandler) Handle(ctx context.Context, rec slog.Record) error {
+	attrs := h.attrs
+	rec.Attrs(func(a slog.Attr) bool {
+		attrs = appendAttr(attrs, h.prefix, a)
+		return true
+	})
+	h.ring.add(Entry{
+		Time:  rec.Time,
+		Level: rec.Level.String(),
+		Msg:   rec.Message,
+		Attrs: attrs,
+		level: rec.Level,
+	})
+	return h.Handler.Handle(ctx, rec)
+}
+
+func (h *ringHandler) WithAttrs(as []slog.Attr) slog.Handler {
+	c := *h
+	c.Handler = h.Handler.WithAttrs(as)
+	for _, a := range as {
+		c.attrs = appendAttr(c.attrs, h.prefix, a)
+	}
+	return &c
+}
+
+func (h *ringHandler) WithGroup(name string) slog.Handler {
+	c := *h
+	c.Handler = h.Handler.WithGroup(name)
+	c.prefix = h.prefix + name + "."
+	return &c
+}
+
+func appendAttr(s, prefix string, a slog.Attr) string {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return s
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		for _, g := range a.Value.Group() {
+			s = appendAttr(s, prefix+a.Key+".", g)
+		}
+		return s
+	}
+	v := a.Value.String()
+	if a.Value.Kind() == slog.KindTime {
+		v = a.Value.Time().Format(time.RFC3339)
+	}
+	if v == "" || strings.ContainsAny(v, " =\"\n\t") {
+		v = strconv.Quote(v)
+	}
+	if s != "" {
+		s += " "
+	}
+	return s + prefix + a.Key + "=" + v
+}
@@ -0,0 +1,68 @@
+package logger
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// discard drops everything, but at debug level so every record reaches
+// the ring.
+var discard = slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: slog.LevelDebug})
+
+func TestRing_KeepsTheLatestRecords(t *testing.T) {
+	ring := NewRing(3)
+	log := slog.New(&ringHandler{Handler: discard, ring: ring})
+	log.Info("one")
+	log.With("feature", "wifi").WithGroup("req").Warn("two", "path", "/a b")
+	log.Debug("three")
+	log.Error("four", slog.Group("disk", "free", 10))
+
+	got, next := ring.Since(0, 10, slog.LevelDebug)
+	if next != 4 || len(got) != 3 || got[0].Msg != "two" || got[2].Msg != "four" {
+		t.Fatalf("next %d, entries %+v", next, got)
+	}
+	if got[0].Attrs != `feature=wifi req.path="/a b"` || got[2].Attrs != "disk.free=10" {
+		t.Errorf("attrs = %q, %q", got[0].Attrs, got[2].Attrs)
+	}
+
+	if got, _ := ring.Since(2, 10, slog.LevelInfo); len(got) != 1 || got[0].Msg != "four" {
+		t.Errorf("since 2 at info = %+v", got)
+	}
+	if got, _ := ring.Since(0, 1, slog.LevelDebug); len(got) != 1 || got[0].Msg != "four" {
+		t.Errorf("limit 1 = %+v", got)
+	}
+}
+
+func TestHandleLogs(t *testing.T) {
+	ring := NewRing(10)
+	log := slog.New(&ringHandler{Handler: discard, ring: ring})
+	log.Info("started")
+	log.Warn("disk almost full")
+	mux := http.NewServeMux()
+	ring.RegisterRoutes(mux)
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/api/system/logs?level=warn", nil))
+	var body struct {
+		Entries []Entry
+		Next    uint64
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if len(body.Entries) != 1 || body.Entries[0].Level != "WARN" || body.Next != 2 {
+		t.Errorf("body = %s", w.Body)
+	}
+
+	for _, q := range []string{"since=x", "limit=0", "level=loud"} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", "/api/system/logs?"+q, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: %d", q, w.Code)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package maintenance
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/audit"
+	"github.com/strct-org/strct-agent/internal/httputil"
+)
+
+// maxDuration caps auto-expiry so a typo can't park the box for a year.
+const maxDuration = 7 * 24 * time.Hour
+
+func (g *Gate) RegisterRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/system/maintenance-mode", g.handleGet)
+	mux.HandleFunc("POST /api/system/maintenance-mode", g.handleSet)
+}
+
+func (g *Gate) handleGet(w http.ResponseWriter, r *http.Request) {
+	httputil.OK(w, g.Status())
+}
+
+// handleSet switches maintenance mode. Enabling answers once running jobs
+// have stopped or the drain deadline passed; running_jobs lists stragglers.
+// POST /api/system/maintenance-mode  body: {"enabled":true,"reason":"swap SSD","duration":"2h"}
+func (g *Gate) handleSet(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Enabled  bool   `json:"enabled"`
+		Reason   string `json:"reason"`
+		Duration string `json:"duration"` // optional auto-expire, e.g. "90m"
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httputil.BadRequest(w, "invalid JSON")
+		return
+	}
+	audit.Target(r.Context(), "enabled="+strconv.FormatBool(req.Enabled))
+
+	if !req.Enabled {
+		st, err := g.Disable()
+		if err != nil {
+			httputil.InternalError(w, err.Error())
+			return
+		}
+		httputil.OK(w, st)
+		return
+	}
+
+	var expiresAt time.Time
+	if req.Duration != "" {
+		d, err := time.ParseDuration(req.Duration)
+		if err != nil || d <= 0 || d > maxDuration {
+			httputil.BadRequest(w, "duration must be a positive duration of at most "+maxDuration.String())
+			return
+		}
+		expiresAt = g.now().Add(d)
+	}
+	st, err := g.Enable(req.Reason, expiresAt, DrainTimeout)
+	if err != nil {
+		httputil.InternalError(w, err.Error())
+		return
+	}
+	httputil.OK(w, st)
+}
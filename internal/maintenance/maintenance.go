@@ -0,0 +1,250 @@
+// Package maintenance is the "hold still" switch. While maintenance mode
+// is on, background jobs that write to disk or saturate the uplink
+// (blocklist updates, speedtests, OTA, the cloud's hashing and index
+// rebuilds) don't start, and the ones already running are cancelled
+// through their contexts. Serving — the AP, DNS and the file API — is
+// never gated.
+//
+// Schedulers consult the gate before every cycle:
+//
+//	ctx, done, err := gate.Begin(ctx, maintenance.JobSpeedtest)
+//	if err != nil {
+//		return // maintenance mode: skip this cycle
+//	}
+//	defer done()
+//
+// A nil *Gate lets everything through, so features and tests that don't
+// care need not build one.
+package maintenance
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/statefile"
+)
+
+// Job classes. Each gated scheduler uses one.
+const (
+	JobBlocklistUpdate = "blocklist_update"
+	JobSpeedtest       = "speedtest"
+	JobOTA             = "ota"
+	JobCloudBackground = "cloud_background" // hashing and index rebuilds
+)
+
+// Jobs lists every job class the gate knows about, for the status output.
+var Jobs = []string{JobBlocklistUpdate, JobSpeedtest, JobOTA, JobCloudBackground}
+
+// DrainTimeout bounds how long enabling maintenance waits for running
+// jobs to notice their cancelled context and return.
+const DrainTimeout = 30 * time.Second
+
+// ErrActive is returned by Begin while maintenance mode is on.
+var ErrActive = errors.New("maintenance mode is on")
+
+// Status is the JSON shape of the maintenance mode, also embedded in
+// /api/health.
+type Status struct {
+	Enabled   bool       `json:"enabled"`
+	Reason    string     `json:"reason,omitempty"`
+	Since     *time.Time `json:"since,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// Paused lists the job classes held while enabled.
+	Paused []string `json:"paused_jobs,omitempty"`
+	// Running lists jobs still in flight — after enabling, the ones that
+	// did not stop within the drain deadline.
+	Running []string `json:"running_jobs,omitempty"`
+}
+
+// persisted is what survives a restart during maintenance.
+type persisted struct {
+	Enabled   bool       `json:"enabled"`
+	Reason    string     `json:"reason,omitempty"`
+	Since     time.Time  `json:"since"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// stateSchema versions maintenance.json.
+//
+//	v1: persisted as-is
+var stateSchema = statefile.Schema{
+	Name:       "maintenance",
+	Migrations: []statefile.Migration{statefile.Stamp},
+}
+
+type running struct {
+	job    string
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+type Gate struct {
+	mu      sync.Mutex
+	path    string
+	state   persisted
+	running map[*running]struct{}
+	now     func() time.Time
+}
+
+// New returns a gate persisted at path, restoring the mode a previous
+// process left on. An unreadable file leaves maintenance off.
+func New(path string) *Gate {
+	g := &Gate{
+		path:    path,
+		running: make(map[*running]struct{}),
+		now:     time.Now,
+	}
+	if err := statefile.Load(path, stateSchema, &g.state); err != nil {
+		if !statefile.Fresh(err) {
+			slog.Warn("maintenance: could not load state, starting disabled", "err", err)
+		}
+		g.state = persisted{}
+	}
+	if g.state.Enabled {
+		slog.Info("maintenance: still enabled from before restart", "reason", g.state.Reason, "expires_at", g.state.ExpiresAt)
+	}
+	return g
+}
+
+// Active reports whether maintenance mode is on. An expired mode is
+// switched off here, so expiry needs no timer of its own.
+func (g *Gate) Active() bool {
+	if g == nil {
+		return false
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.activeLocked()
+}
+
+func (g *Gate) activeLocked() bool {
+	if !g.state.Enabled {
+		return false
+	}
+	if g.state.ExpiresAt != nil && !g.now().Before(*g.state.ExpiresAt) {
+		slog.Info("maintenance: expired, resuming background jobs")
+		g.state = persisted{}
+		g.saveLocked()
+		return false
+	}
+	return true
+}
+
+// Begin registers a job of class job and returns a context that is
+// cancelled if maintenance mode is switched on while it runs. done must
+// be called when the job returns. While maintenance is on Begin returns
+// ErrActive and the job must not start.
+func (g *Gate) Begin(ctx context.Context, job string) (context.Context, func(), error) {
+	if g == nil {
+		return ctx, func() {}, nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.activeLocked() {
+		slog.Info("maintenance: skipping job", "job", job)
+		return ctx, func() {}, ErrActive
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	r := &running{job: job, cancel: cancel, done: make(chan struct{})}
+	g.running[r] = struct{}{}
+	var once sync.Once
+	return ctx, func() {
+		once.Do(func() {
+			cancel()
+			g.mu.Lock()
+			delete(g.running, r)
+			g.mu.Unlock()
+			close(r.done)
+		})
+	}, nil
+}
+
+// Enable switches maintenance on until expiresAt (zero means until
+// Disable), cancels running jobs and waits up to drain for them to
+// return. The returned Status lists any that are still running.
+func (g *Gate) Enable(reason string, expiresAt time.Time, drain time.Duration) (Status, error) {
+	g.mu.Lock()
+	if !g.state.Enabled {
+		g.state.Since = g.now().UTC()
+	}
+	g.state.Enabled = true
+	g.state.Reason = reason
+	g.state.ExpiresAt = nil
+	if !expiresAt.IsZero() {
+		t := expiresAt.UTC()
+		g.state.ExpiresAt = &t
+	}
+	err := g.saveLocked()
+	expires := g.state.ExpiresAt
+
+	inFlight := make([]*running, 0, len(g.running))
+	for r := range g.running {
+		r.cancel()
+		inFlight = append(inFlight, r)
+	}
+	g.mu.Unlock()
+
+	slog.Info("maintenance: enabled", "reason", reason, "expires_at", expires, "cancelled_jobs", len(inFlight))
+
+	deadline := time.NewTimer(drain)
+	defer deadline.Stop()
+	for _, r := range inFlight {
+		select {
+		case <-r.done:
+		case <-deadline.C:
+			slog.Warn("maintenance: jobs still running after drain deadline", "deadline", drain)
+			return g.Status(), err
+		}
+	}
+	return g.Status(), err
+}
+
+// Disable switches maintenance off; the next scheduled cycles run normally.
+func (g *Gate) Disable() (Status, error) {
+	g.mu.Lock()
+	g.state = persisted{}
+	err := g.saveLocked()
+	g.mu.Unlock()
+	slog.Info("maintenance: disabled")
+	return g.Status(), err
+}
+
+// Status returns the current mode. A nil gate reports disabled.
+func (g *Gate) Status() Status {
+	if g == nil {
+		return Status{}
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var s Status
+	if g.activeLocked() {
+		since := g.state.Since
+		s = Status{
+			Enabled:   true,
+			Reason:    g.state.Reason,
+			Since:     &since,
+			ExpiresAt: g.state.ExpiresAt,
+			Paused:    Jobs,
+		}
+	}
+	for r := range g.running {
+		s.Running = append(s.Running, r.job)
+	}
+	sort.Strings(s.Running)
+	return s
+}
+
+func (g *Gate) saveLocked() error {
+	if err := statefile.Save(g.path, stateSchema, g.state); err != nil {
+		slog.Error("maintenance: could not persist state", "err", err)
+		return fmt.Errorf("persist maintenance mode: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package maintenance
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestGate(t *testing.T) *Gate {
+	t.Helper()
+	return New(filepath.Join(t.TempDir(), "maintenance.json"))
+}
+
+func TestNilGateAllowsEverything(t *testing.T) {
+	var g *Gate
+	if g.Active() {
+		t.Error("nil gate reports active")
+	}
+	_, done, err := g.Begin(context.Background(), JobSpeedtest)
+	if err != nil {
+		t.Fatalf("Begin on nil gate: %v", err)
+	}
+	done()
+	if g.Status().Enabled {
+		t.Error("nil gate status enabled")
+	}
+}
+
+func TestBegin_RefusedWhileActive(t *testing.T) {
+	g := newTestGate(t)
+	for _, job := range Jobs {
+		_, done, err := g.Begin(context.Background(), job)
+		if err != nil {
+			t.Fatalf("%s before maintenance: %v", job, err)
+		}
+		done()
+	}
+
+	g.Enable("swap SSD", time.Time{}, time.Second)
+	for _, job := range Jobs {
+		if _, _, err := g.Begin(context.Background(), job); !errors.Is(err, ErrActive) {
+			t.Errorf("%s during maintenance: err = %v, want ErrActive", job, err)
+		}
+	}
+
+	g.Disable()
+	if _, done, err := g.Begin(context.Background(), JobOTA); err != nil {
+		t.Errorf("after Disable: %v", err)
+	} else {
+		done()
+	}
+}
+
+func TestEnable_CancelsRunningJobs(t *testing.T) {
+	g := newTestGate(t)
+
+	ctx, done, err := g.Begin(context.Background(), JobBlocklistUpdate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		<-ctx.Done() // a cooperating job checkpoints and returns
+		done()
+	}()
+	// This one ignores its context.
+	_, stuckDone, _ := g.Begin(context.Background(), JobSpeedtest)
+	defer stuckDone()
+
+	st, _ := g.Enable("imaging", time.Time{}, 50*time.Millisecond)
+	if ctx.Err() == nil {
+		t.Error("running job's context not cancelled")
+	}
+	if len(st.Running) != 1 || st.Running[0] != JobSpeedtest {
+		t.Errorf("running after drain = %v, want [speedtest]", st.Running)
+	}
+	if !st.Enabled || st.Since == nil || st.ExpiresAt != nil {
+		t.Errorf("status = %+v", st)
+	}
+}
+
+func TestPersistsAndExpires(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "maintenance.json")
+	now := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+
+	g := New(path)
+	g.now = func() time.Time { return now }
+	g.Enable("swap SSD", now.Add(time.Hour), time.Second)
+
+	// A restart mid-maintenance comes back still held.
+	restarted := New(path)
+	restarted.now = func() time.Time { return now.Add(30 * time.Minute) }
+	st := restarted.Status()
+	if !st.Enabled || st.Reason != "swap SSD" || st.ExpiresAt == nil || !st.ExpiresAt.Equal(now.Add(time.Hour)) {
+		t.Fatalf("after restart = %+v", st)
+	}
+
+	restarted.now = func() time.Time { return now.Add(time.Hour) }
+	if restarted.Active() {
+		t.Error("still active at expiry")
+	}
+	if New(path).Active() {
+		t.Error("expiry was not persisted")
+	}
+}
+
+func TestHandleSet(t *testing.T) {
+	g := newTestGate(t)
+	now := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+	g.now = func() time.Time { return now }
+	mux := http.NewServeMux()
+	g.RegisterRoutes(mux)
+
+	post := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("POST", "/api/system/maintenance-mode", strings.NewReader(body)))
+		return rec
+	}
+
+	for _, body := range []string{`{`, `{"enabled":true,"duration":"soon"}`, `{"enabled":true,"duration":"-1h"}`, `{"enabled":true,"duration":"400h"}`} {
+		if rec := post(body); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want 400", body, rec.Code)
+		}
+	}
+	if g.Active() {
+		t.Fatal("rejected requests enabled maintenance")
+	}
+
+	rec := post(`{"enabled":true,"reason":"swap SSD","duration":"90m"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("enable: %d %s", rec.Code, rec.Body)
+	}
+	var st Status
+	json.NewDecoder(rec.Body).Decode(&st)
+	if !st.Enabled || st.ExpiresAt == nil || !st.ExpiresAt.Equal(now.Add(90*time.Minute)) || len(st.Paused) != len(Jobs) {
+		t.Errorf("enable response = %+v", st)
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/api/system/maintenance-mode", nil))
+	if !strings.Contains(rec.Body.String(), `"reason":"swap SSD"`) {
+		t.Errorf("GET = %s", rec.Body)
+	}
+
+	if rec := post(`{"enabled":false}`); rec.Code != http.StatusOK || g.Active() {
+		t.Errorf("disable: %d, active=%v", rec.Code, g.Active())
+	}
+}
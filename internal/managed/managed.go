@@ -0,0 +1,273 @@
+// Package managed is the registry of files the agent generates outside
+// its own state handling — in /etc, in DataDir and in the working
+// directory — and the upgrade sweep that clears away the ones a release
+// stopped writing.
+//
+// Old installs collect stale copies as files move or get renamed: an
+// frpc.toml left in the working directory after it moved to DataDir is
+// just the kind of file later code picks up by accident. Registry lists
+// every generated file with its owner and the release that introduced
+// it; entries marked Obsolete are moved to DataDir/.obsolete/<version>/
+// the first time a new version boots. The sweep only touches exact
+// registered paths: no globs, no directories, no symlinks.
+package managed
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/strct-org/strct-agent/internal/fsutil"
+	"github.com/strct-org/strct-agent/internal/statefile"
+)
+
+// ObsoleteDirName is the top-level DataDir folder obsolete files are
+// backed up to. It is agent state, not the user's files, and hidden like
+// the other reserved folders, so it can't take a name a user would pick.
+const ObsoleteDirName = ".obsolete"
+
+// Base is the directory a File's Path is relative to.
+type Base string
+
+const (
+	Root Base = "root" // the file system root: /etc/…
+	Data Base = "data" // DataDir
+	Work Base = "work" // the agent's working directory
+)
+
+// File is one generated file.
+type File struct {
+	Path  string // slash-separated, relative to Base
+	Base  Base
+	Owner string // the feature that writes it
+	// Since is the release that introduced the file; "" for files that
+	// predate the registry.
+	Since string
+	// Obsolete files are no longer written by this release; the sweep
+	// moves them away. Note says why, for the log.
+	Obsolete bool
+	Note     string
+}
+
+// Registry is every file the agent generates. A feature that starts
+// writing a new file adds it here; one that stops, or moves it, marks
+// the old entry Obsolete instead of deleting it.
+var Registry = []File{
+	{Path: "etc/hostapd/hostapd.conf", Base: Root, Owner: "wifi"}, // router rewrites it too
+	{Path: "etc/dnsmasq.d/strct.conf", Base: Root, Owner: "wifi"},
+	{Path: "etc/dnsmasq.d/adblock.conf", Base: Root, Owner: "adblocker"},
+	{Path: "etc/wpa_supplicant/wpa_supplicant-wlan0.conf", Base: Root, Owner: "wifi"},
+	{Path: "etc/strct/device-id.lock", Base: Root, Owner: "config"},
+	{Path: "etc/strct/device-identity.json", Base: Root, Owner: "config"},
+	{Path: "etc/strct/storage.json", Base: Root, Owner: "setup"},
+	{Path: "etc/strct/maintenance.json", Base: Root, Owner: "maintenance"},
+	{Path: "etc/strct/managed.json", Base: Root, Owner: "managed"},
+	{Path: "etc/strct/api-token.json", Base: Root, Owner: "api"},
+	{Path: "etc/strct/telemetry.json", Base: Root, Owner: "telemetry"},
+	{Path: "etc/strct/agent.env", Base: Root, Owner: "legacy"},
+	{Path: "etc/strct/legacy-migration.json", Base: Root, Owner: "legacy"},
+
+	{Path: "frpc.toml", Base: Data, Owner: "tunnel"},
+	{Path: "frpc", Base: Data, Owner: "tunnel"},
+	{Path: "tunnel-usage.json", Base: Data, Owner: "tunnel"},
+	{Path: "tunnel-proxies.json", Base: Data, Owner: "tunnel"},
+	{Path: "backend-queue.json", Base: Data, Owner: "backend"},
+	{Path: "secrets.enc", Base: Data, Owner: "config"},
+	{Path: "audit-security.jsonl", Base: Data, Owner: "audit"},
+	{Path: "wifi-config.json", Base: Data, Owner: "wifi"},
+	{Path: "wifi-rendered.json", Base: Data, Owner: "wifi"},
+	{Path: "adblock-config.json", Base: Data, Owner: "adblocker"},
+	{Path: "adblock-blocklist.gz", Base: Data, Owner: "adblocker"},
+	{Path: "adblock-lists.json", Base: Data, Owner: "adblocker"},
+	{Path: "adblock-split-dns.json", Base: Data, Owner: "adblocker"},
+	{Path: "router.json", Base: Data, Owner: "router"},
+	{Path: "traffic.json", Base: Data, Owner: "router"},
+	{Path: "device-names.json", Base: Data, Owner: "router"},
+	{Path: "device-history.json", Base: Data, Owner: "router"},
+	{Path: "monitor-targets.json", Base: Data, Owner: "monitor"},
+	{Path: "monitor-outages.json", Base: Data, Owner: "monitor"},
+	{Path: "monitor-history.jsonl", Base: Data, Owner: "monitor"}, // STORE_BACKEND picks one of each
+	{Path: "monitor-history.bolt", Base: Data, Owner: "monitor"},
+	{Path: "monitor-reports.jsonl", Base: Data, Owner: "monitor"},
+	{Path: "monitor-reports.bolt", Base: Data, Owner: "monitor"},
+	{Path: "monitor.db", Base: Data, Owner: "monitor"}, // older agents'; imported once, then removed
+	{Path: "monitor-reports.json", Base: Data, Owner: "monitor"},
+
+	{Path: "frpc.toml", Base: Work, Owner: "tunnel", Obsolete: true,
+		Note: "frpc.toml is written to DataDir"},
+}
+
+// InData reports whether name, a top-level DataDir entry, is a file the
+// agent writes there, or the temp file of an atomic write to one. They
+// share DataDir with the user's files, and the cloud keeps them out of
+// reach.
+func InData(name string) bool {
+	if tmp, ok := strings.CutPrefix(name, "."); ok {
+		if base, _, ok := strings.Cut(tmp, ".tmp-"); ok {
+			name = base // see fsutil.WriteFileAtomic
+		}
+	}
+	for _, f := range Registry {
+		if f.Base == Data && f.Path == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Dirs are the directories Bases resolve to. An empty one skips its
+// files: in dev mode Root is left empty so the sweep stays out of /etc.
+type Dirs struct {
+	Root string
+	Data string
+	Work string
+}
+
+// Resolve returns f's absolute path, or "" if its Base is not set in d.
+func (f File) Resolve(d Dirs) string {
+	var dir string
+	switch f.Base {
+	case Root:
+		dir = d.Root
+	case Data:
+		dir = d.Data
+	case Work:
+		dir = d.Work
+	}
+	if dir == "" {
+		return ""
+	}
+	return filepath.Join(dir, filepath.FromSlash(f.Path))
+}
+
+// backup is where f goes under DataDir/.obsolete/<version>/: its Base,
+// then its Path, so two obsolete frpc.tomls don't collide.
+func (f File) backup(d Dirs, version string) string {
+	return filepath.Join(d.Data, ObsoleteDirName, version, string(f.Base), filepath.FromSlash(f.Path))
+}
+
+// Options configures a Sweep.
+type Options struct {
+	Dirs
+	Version string // the running release
+	// StatePath records the last version swept, so the sweep runs once
+	// per upgrade.
+	StatePath string
+	// DryRun logs what would move and moves nothing. The version is not
+	// recorded, so the next real boot still sweeps.
+	DryRun bool
+	// Files is the registry to sweep; nil means Registry.
+	Files []File
+}
+
+// Moved is an obsolete file the sweep moved, or would have.
+type Moved struct {
+	File   File
+	From   string
+	Backup string
+}
+
+// stateSchema versions managed.json.
+//
+//	v1: sweepState as-is
+var stateSchema = statefile.Schema{
+	Name:       "managed",
+	Migrations: []statefile.Migration{statefile.Stamp},
+}
+
+type sweepState struct {
+	Version string `json:"version"` // last version swept
+}
+
+// Sweep moves the obsolete files in the registry to DataDir/.obsolete/
+// <version>/, unless this version has swept already. A file that could
+// not be moved is logged and reported in the error, and leaves the
+// version unrecorded so the next boot tries again.
+func Sweep(o Options) ([]Moved, error) {
+	if o.Data == "" {
+		return nil, errors.New("managed: no DataDir to back obsolete files up to")
+	}
+	var st sweepState
+	if err := statefile.Load(o.StatePath, stateSchema, &st); err != nil && !statefile.Fresh(err) {
+		return nil, fmt.Errorf("managed: %w", err)
+	}
+	if st.Version == o.Version {
+		slog.Debug("managed: already swept for this version", "version", o.Version)
+		return nil, nil
+	}
+	files := o.Files
+	if files == nil {
+		files = Registry
+	}
+
+	var moved []Moved
+	var errs []error
+	for _, f := range files {
+		if !f.Obsolete {
+			continue
+		}
+		from := f.Resolve(o.Dirs)
+		if from == "" {
+			continue
+		}
+		info, err := os.Lstat(from)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if !info.Mode().IsRegular() {
+			slog.Warn("managed: obsolete path is not a regular file, leaving it", "path", from, "mode", info.Mode())
+			continue
+		}
+		m := Moved{File: f, From: from, Backup: f.backup(o.Dirs, o.Version)}
+		if o.DryRun {
+			slog.Info("managed: would move obsolete file (dry run)",
+				"path", m.From, "backup", m.Backup, "owner", f.Owner, "note", f.Note)
+			moved = append(moved, m)
+			continue
+		}
+		if err := move(m.From, m.Backup); err != nil {
+			slog.Error("managed: could not move obsolete file", "path", m.From, "err", err)
+			errs = append(errs, err)
+			continue
+		}
+		slog.Info("managed: moved obsolete file",
+			"path", m.From, "backup", m.Backup, "owner", f.Owner, "note", f.Note)
+		moved = append(moved, m)
+	}
+	if err := errors.Join(errs...); err != nil || o.DryRun {
+		return moved, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(o.StatePath), 0755); err != nil {
+		return moved, fmt.Errorf("managed: %w", err)
+	}
+	if err := statefile.Save(o.StatePath, stateSchema, sweepState{Version: o.Version}); err != nil {
+		return moved, fmt.Errorf("managed: %w", err)
+	}
+	slog.Info("managed: swept obsolete files", "version", o.Version, "moved", len(moved))
+	return moved, nil
+}
+
+// move copies src to dst, 0600 under a 0700 folder since generated files
+// may hold passphrases and tokens, then removes src. A copy rather than a
+// rename: /etc and DataDir are often different file systems.
+func move(src, dst string) error {
+	b, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return err
+	}
+	if err := fsutil.WriteFileAtomic(dst, b, 0600); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
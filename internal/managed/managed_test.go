@@ -0,0 +1,181 @@
+package managed
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// plant writes files under dir, keyed by slash path.
+func plant(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, body := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func exists(p string) bool {
+	_, err := os.Lstat(p)
+	return err == nil
+}
+
+func newOptions(t *testing.T) Options {
+	t.Helper()
+	tmp := t.TempDir()
+	return Options{
+		Dirs: Dirs{
+			Root: filepath.Join(tmp, "root"),
+			Data: filepath.Join(tmp, "data"),
+			Work: filepath.Join(tmp, "work"),
+		},
+		Version:   "1.4.0",
+		StatePath: filepath.Join(tmp, "root", "etc", "strct", "managed.json"),
+		Files: []File{
+			{Path: "etc/dnsmasq.d/strct.conf", Base: Root, Owner: "wifi"},
+			{Path: "etc/hostapd/hostapd.conf.old", Base: Root, Owner: "wifi", Obsolete: true},
+			{Path: "frpc.toml", Base: Data, Owner: "tunnel"},
+			{Path: "frpc.toml", Base: Work, Owner: "tunnel", Obsolete: true},
+			{Path: "gone.json", Base: Data, Owner: "router", Obsolete: true},
+			{Path: "etc/legacy.d", Base: Root, Owner: "wifi", Obsolete: true},
+		},
+	}
+}
+
+func TestSweep_MovesOnlyRegisteredObsoleteFiles(t *testing.T) {
+	o := newOptions(t)
+	plant(t, o.Root, map[string]string{
+		"etc/dnsmasq.d/strct.conf":      "current",
+		"etc/hostapd/hostapd.conf.old":  "stale ap",
+		"etc/hostapd/hostapd.conf.old~": "not registered",
+		"etc/legacy.d/inside.conf":      "a directory is never moved",
+	})
+	plant(t, o.Work, map[string]string{"frpc.toml": "stale tunnel"})
+	plant(t, o.Data, map[string]string{"frpc.toml": "current tunnel"})
+
+	moved, err := Sweep(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(moved) != 2 {
+		t.Fatalf("moved %d files, want 2: %+v", len(moved), moved)
+	}
+	backups := map[string]string{
+		filepath.Join(o.Root, "etc", "hostapd", "hostapd.conf.old"): filepath.Join(o.Data, ".obsolete", "1.4.0", "root", "etc", "hostapd", "hostapd.conf.old"),
+		filepath.Join(o.Work, "frpc.toml"):                          filepath.Join(o.Data, ".obsolete", "1.4.0", "work", "frpc.toml"),
+	}
+	for from, backup := range backups {
+		if exists(from) {
+			t.Errorf("%s was not moved", from)
+		}
+		info, err := os.Stat(backup)
+		if err != nil {
+			t.Errorf("no backup of %s: %v", from, err)
+			continue
+		}
+		if info.Mode().Perm() != 0600 {
+			t.Errorf("backup %s has mode %v, want 0600", backup, info.Mode().Perm())
+		}
+	}
+	if b, _ := os.ReadFile(filepath.Join(o.Data, ".obsolete", "1.4.0", "work", "frpc.toml")); string(b) != "stale tunnel" {
+		t.Errorf("backup holds %q", b)
+	}
+
+	for _, kept := range []string{
+		filepath.Join(o.Root, "etc", "dnsmasq.d", "strct.conf"),
+		filepath.Join(o.Root, "etc", "hostapd", "hostapd.conf.old~"),
+		filepath.Join(o.Root, "etc", "legacy.d", "inside.conf"),
+		filepath.Join(o.Data, "frpc.toml"),
+	} {
+		if !exists(kept) {
+			t.Errorf("%s was removed", kept)
+		}
+	}
+}
+
+func TestSweep_OncePerVersion(t *testing.T) {
+	o := newOptions(t)
+	plant(t, o.Work, map[string]string{"frpc.toml": "stale"})
+	if moved, err := Sweep(o); err != nil || len(moved) != 1 {
+		t.Fatalf("first sweep: %v, %v", moved, err)
+	}
+
+	// Planted again, say by an old binary run by hand: the same version
+	// does not sweep twice, the next one does.
+	plant(t, o.Work, map[string]string{"frpc.toml": "stale again"})
+	if moved, err := Sweep(o); err != nil || len(moved) != 0 {
+		t.Fatalf("second sweep of 1.4.0: %v, %v", moved, err)
+	}
+	o.Version = "1.5.0"
+	if moved, err := Sweep(o); err != nil || len(moved) != 1 {
+		t.Fatalf("sweep of 1.5.0: %v, %v", moved, err)
+	}
+	if !exists(filepath.Join(o.Data, ".obsolete", "1.5.0", "work", "frpc.toml")) {
+		t.Error("no backup under 1.5.0")
+	}
+}
+
+func TestSweep_DryRun(t *testing.T) {
+	o := newOptions(t)
+	o.DryRun = true
+	plant(t, o.Work, map[string]string{"frpc.toml": "stale"})
+
+	moved, err := Sweep(o)
+	if err != nil || len(moved) != 1 || moved[0].From != filepath.Join(o.Work, "frpc.toml") {
+		t.Fatalf("dry run: %+v, %v", moved, err)
+	}
+	if !exists(filepath.Join(o.Work, "frpc.toml")) || exists(filepath.Join(o.Data, ObsoleteDirName)) {
+		t.Error("dry run moved the file")
+	}
+	if exists(o.StatePath) {
+		t.Error("dry run recorded the version")
+	}
+
+	o.DryRun = false
+	if moved, err := Sweep(o); err != nil || len(moved) != 1 {
+		t.Fatalf("real sweep after a dry run: %v, %v", moved, err)
+	}
+}
+
+func TestSweep_EmptyRootIsSkipped(t *testing.T) {
+	o := newOptions(t)
+	plant(t, o.Root, map[string]string{"etc/hostapd/hostapd.conf.old": "stale"})
+	o.Root = ""
+	o.StatePath = filepath.Join(o.Data, "managed.json")
+
+	if _, err := Sweep(o); err != nil {
+		t.Fatal(err)
+	}
+	if !exists(filepath.Join(filepath.Dir(o.Data), "root", "etc", "hostapd", "hostapd.conf.old")) {
+		t.Error("file under an unset Root was moved")
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	seen := map[string]bool{}
+	for _, f := range Registry {
+		key := string(f.Base) + ":" + f.Path
+		if seen[key] {
+			t.Errorf("%s is registered twice", key)
+		}
+		seen[key] = true
+		switch {
+		case f.Base != Root && f.Base != Data && f.Base != Work:
+			t.Errorf("%s: unknown base %q", f.Path, f.Base)
+		case f.Path == "" || strings.HasPrefix(f.Path, "/") || filepath.ToSlash(filepath.Clean(f.Path)) != f.Path:
+			t.Errorf("%s: path must be clean and relative", f.Path)
+		case strings.ContainsAny(f.Path, "*?["):
+			t.Errorf("%s: the registry holds exact paths, not globs", f.Path)
+		case f.Owner == "":
+			t.Errorf("%s: no owner", f.Path)
+		case f.Obsolete && f.Note == "":
+			t.Errorf("%s: obsolete without a note", f.Path)
+		}
+	}
+}
@@ -0,0 +1,325 @@
+// Package metrics is a deliberately small metrics registry. Features create
+// their counters at package init or construction time and the registry
+// renders them in Prometheus text format, so nothing here needs to know
+// which features exist.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Counter is a monotonically increasing value. Safe for concurrent use.
+type Counter struct {
+	name   string
+	help   string
+	labels string // rendered `{k="v",...}` or ""
+	n      atomic.Uint64
+}
+
+func (c *Counter) Inc()          { c.n.Add(1) }
+func (c *Counter) Add(n uint64)  { c.n.Add(n) }
+func (c *Counter) Value() uint64 { return c.n.Load() }
+
+// Histogram counts observations into fixed buckets. Observe takes no lock
+// and allocates nothing, so it can sit on every request. Safe for
+// concurrent use.
+type Histogram struct {
+	name    string
+	help    string
+	labels  string
+	bounds  []float64       // upper bounds, ascending; +Inf is implied
+	buckets []atomic.Uint64 // per bucket, not cumulative; the last is +Inf
+	count   atomic.Uint64
+	sumBits atomic.Uint64 // float64 sum, as bits
+}
+
+// Observe records v.
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v) // first bound >= v
+	h.buckets[i].Add(1)
+	h.count.Add(1)
+	for {
+		old := h.sumBits.Load()
+		if h.sumBits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+// HistogramSnapshot is a histogram's state at one moment.
+type HistogramSnapshot struct {
+	Bounds []float64 // upper bounds; Counts has one more entry, for +Inf
+	Counts []uint64  // per bucket, not cumulative
+	Count  uint64
+	Sum    float64
+}
+
+// Snapshot copies the histogram. Observations that race with it may be
+// counted in Count but not yet in a bucket, or the other way round.
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	s := HistogramSnapshot{
+		Bounds: h.bounds,
+		Counts: make([]uint64, len(h.buckets)),
+		Count:  h.count.Load(),
+		Sum:    math.Float64frombits(h.sumBits.Load()),
+	}
+	for i := range h.buckets {
+		s.Counts[i] = h.buckets[i].Load()
+	}
+	return s
+}
+
+// Quantile estimates the q-quantile (0 < q <= 1) by interpolating within
+// the bucket it falls in, as Prometheus' histogram_quantile does. One in
+// the +Inf bucket is reported as the highest finite bound.
+func (s HistogramSnapshot) Quantile(q float64) float64 {
+	var total uint64
+	for _, c := range s.Counts {
+		total += c
+	}
+	if total == 0 || len(s.Bounds) == 0 {
+		return 0
+	}
+	rank := q * float64(total)
+	var below uint64
+	for i, c := range s.Counts {
+		if float64(below+c) < rank || c == 0 {
+			below += c
+			continue
+		}
+		if i == len(s.Bounds) {
+			break
+		}
+		lower := 0.0
+		if i > 0 {
+			lower = s.Bounds[i-1]
+		}
+		return lower + (s.Bounds[i]-lower)*(rank-float64(below))/float64(c)
+	}
+	return s.Bounds[len(s.Bounds)-1]
+}
+
+// lines renders h as Prometheus _bucket, _sum and _count lines.
+func (h *Histogram) lines() []string {
+	s := h.Snapshot()
+	le := func(bound string) string {
+		if h.labels == "" {
+			return `{le="` + bound + `"}`
+		}
+		return h.labels[:len(h.labels)-1] + `,le="` + bound + `"}`
+	}
+	out := make([]string, 0, len(s.Counts)+2)
+	var cum uint64
+	for i, c := range s.Counts {
+		cum += c
+		bound := "+Inf"
+		if i < len(s.Bounds) {
+			bound = strconv.FormatFloat(s.Bounds[i], 'g', -1, 64)
+		}
+		out = append(out, fmt.Sprintf("%s_bucket%s %d", h.name, le(bound), cum))
+	}
+	return append(out,
+		fmt.Sprintf("%s_sum%s %s", h.name, h.labels, strconv.FormatFloat(s.Sum, 'g', -1, 64)),
+		fmt.Sprintf("%s_count%s %d", h.name, h.labels, cum),
+	)
+}
+
+// gaugeFunc is a gauge whose value is read at scrape time.
+type gaugeFunc struct {
+	name   string
+	help   string
+	labels string
+	fn     func() float64
+}
+
+// Registry holds every registered metric.
+type Registry struct {
+	mu         sync.Mutex
+	counters   map[string]*Counter   // by name+labels
+	gauges     map[string]*gaugeFunc // by name+labels
+	histograms map[string]*Histogram // by name+labels
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		counters:   make(map[string]*Counter),
+		gauges:     make(map[string]*gaugeFunc),
+		histograms: make(map[string]*Histogram),
+	}
+}
+
+// Default is the process-wide registry served at /metrics.
+var Default = NewRegistry()
+
+// NewCounter registers a counter on Default. See Registry.Counter.
+func NewCounter(name, help string, labels ...string) *Counter {
+	return Default.Counter(name, help, labels...)
+}
+
+// NewGaugeFunc registers a gauge on Default. See Registry.GaugeFunc.
+func NewGaugeFunc(name, help string, fn func() float64, labels ...string) {
+	Default.GaugeFunc(name, help, fn, labels...)
+}
+
+// Counter returns the counter for name and the given label pairs
+// ("key", "value", ...), creating it on first use. Asking twice for the
+// same name and labels returns the same counter.
+func (r *Registry) Counter(name, help string, labels ...string) *Counter {
+	rendered := renderLabels(labels)
+	key := name + rendered
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if c, ok := r.counters[key]; ok {
+		return c
+	}
+	c := &Counter{name: name, help: help, labels: rendered}
+	r.counters[key] = c
+	return c
+}
+
+// Histogram returns the histogram for name and the given label pairs with
+// the given bucket upper bounds (ascending), creating it on first use.
+// Asking again for the same name and labels returns the same histogram,
+// whatever bounds are passed.
+func (r *Registry) Histogram(name, help string, bounds []float64, labels ...string) *Histogram {
+	rendered := renderLabels(labels)
+	key := name + rendered
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if h, ok := r.histograms[key]; ok {
+		return h
+	}
+	h := &Histogram{
+		name:    name,
+		help:    help,
+		labels:  rendered,
+		bounds:  bounds,
+		buckets: make([]atomic.Uint64, len(bounds)+1),
+	}
+	r.histograms[key] = h
+	return h
+}
+
+// GaugeFunc registers a gauge that calls fn on every scrape — for values
+// that already live somewhere else (queue lengths, goroutine counts).
+// Registering the same name and labels again replaces fn.
+func (r *Registry) GaugeFunc(name, help string, fn func() float64, labels ...string) {
+	rendered := renderLabels(labels)
+	r.mu.Lock()
+	r.gauges[name+rendered] = &gaugeFunc{name: name, help: help, labels: rendered, fn: fn}
+	r.mu.Unlock()
+}
+
+// Gauges is what a feature registers its gauges on. *Registry is one.
+type Gauges interface {
+	GaugeFunc(name, help string, fn func() float64, labels ...string)
+}
+
+// Collector is a feature with gauges of its own: the ad blocker's entry
+// count, whether the tunnel is up. main hands each one the registry, so
+// nothing that serves /metrics imports the features.
+type Collector interface {
+	RegisterMetrics(g Gauges)
+}
+
+// Bool is a gauge value for b: 1 or 0.
+func Bool(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Register has each collector register its gauges on r.
+func (r *Registry) Register(cs ...Collector) {
+	for _, c := range cs {
+		c.RegisterMetrics(r)
+	}
+}
+
+// sample is one metric's rendered lines, collected so every kind sorts
+// together.
+type sample struct {
+	name, help, kind, labels string
+	lines                    []string
+}
+
+// WriteText renders every metric in Prometheus text exposition format,
+// grouped by name and sorted so the output is stable.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	all := make([]sample, 0, len(r.counters)+len(r.gauges)+len(r.histograms))
+	line := func(name, labels string, v any) []string {
+		return []string{fmt.Sprintf("%s%s %v", name, labels, v)}
+	}
+	for _, c := range r.counters {
+		all = append(all, sample{c.name, c.help, "counter", c.labels, line(c.name, c.labels, c.Value())})
+	}
+	for _, h := range r.histograms {
+		all = append(all, sample{h.name, h.help, "histogram", h.labels, h.lines()})
+	}
+	gauges := make([]*gaugeFunc, 0, len(r.gauges))
+	for _, g := range r.gauges {
+		gauges = append(gauges, g)
+	}
+	r.mu.Unlock()
+
+	// Gauge funcs run outside the lock — they may take their own locks.
+	for _, g := range gauges {
+		all = append(all, sample{g.name, g.help, "gauge", g.labels, line(g.name, g.labels, g.fn())})
+	}
+
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].name != all[j].name {
+			return all[i].name < all[j].name
+		}
+		return all[i].labels < all[j].labels
+	})
+
+	var last string
+	for _, m := range all {
+		if m.name != last {
+			if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind); err != nil {
+				return err
+			}
+			last = m.name
+		}
+		for _, l := range m.lines {
+			if _, err := fmt.Fprintln(w, l); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Handler serves the registry as text/plain for Prometheus scrapers.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		r.WriteText(w) //nolint:errcheck — client went away
+	})
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func renderLabels(pairs []string) string {
+	if len(pairs) == 0 {
+		return ""
+	}
+	parts := make([]string, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 { // a trailing key without value is ignored
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, pairs[i], labelEscaper.Replace(pairs[i+1])))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
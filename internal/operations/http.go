@@ -0,0 +1,61 @@
+package operations
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/strct-org/strct-agent/internal/httputil"
+)
+
+func (t *Tracker) RegisterRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/operations", t.handleList)
+	mux.HandleFunc("GET /api/operations/{id}", t.handleGet)
+	mux.HandleFunc("GET /api/operations/{id}/context", t.handleContext)
+	mux.HandleFunc("POST /api/operations/{id}/cancel", t.handleCancel)
+}
+
+// handleList returns the latest operations, newest first.
+// GET /api/operations
+func (t *Tracker) handleList(w http.ResponseWriter, r *http.Request) {
+	httputil.OK(w, map[string]any{"operations": t.List()})
+}
+
+// GET /api/operations/{id}
+func (t *Tracker) handleGet(w http.ResponseWriter, r *http.Request) {
+	op, _, ok := t.Get(r.PathValue("id"))
+	if !ok {
+		httputil.Error(w, http.StatusNotFound, "no such operation")
+		return
+	}
+	httputil.OK(w, op)
+}
+
+// handleContext returns what was captured when the operation failed.
+// GET /api/operations/{id}/context
+func (t *Tracker) handleContext(w http.ResponseWriter, r *http.Request) {
+	op, ctx, ok := t.Get(r.PathValue("id"))
+	if !ok {
+		httputil.Error(w, http.StatusNotFound, "no such operation")
+		return
+	}
+	if ctx == nil {
+		httputil.Error(w, http.StatusNotFound, "operation "+op.ID+" is "+op.Status+"; context is captured only on failure")
+		return
+	}
+	httputil.OK(w, map[string]any{"operation": op, "context": ctx})
+}
+
+// handleCancel cancels a running operation that supports it. The
+// operation ends as canceled once the feature has let go; poll it.
+// POST /api/operations/{id}/cancel
+func (t *Tracker) handleCancel(w http.ResponseWriter, r *http.Request) {
+	op, err := t.Cancel(r.PathValue("id"))
+	switch {
+	case errors.Is(err, ErrNotFound):
+		httputil.Error(w, http.StatusNotFound, err.Error())
+	case err != nil:
+		httputil.Error(w, http.StatusConflict, "operation "+op.ID+": "+err.Error())
+	default:
+		httputil.JSON(w, http.StatusAccepted, op)
+	}
+}
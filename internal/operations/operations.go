@@ -0,0 +1,387 @@
+// Package operations records feature applies (wifi, vpn) and, when one
+// fails, what was going on around it. A failed apply used to leave one
+// line in the feature's status; the hostapd or tailscaled logs that said
+// why were gone by the time anyone looked. Now the failure is captured on
+// the spot:
+//
+//   - the agent's own latest log records
+//   - `journalctl -u <units> --since -1m` for the feature's daemons
+//   - the last command that failed during the apply, with its stderr
+//   - the config files the feature generated
+//
+// Secrets are redacted from all of it and the snapshot is capped at
+// maxContextBytes. The last maxOperations operations are kept in memory
+// and served on /api/operations.
+//
+// A feature takes the tracker once, routing its commands through it:
+//
+//	s.cmd = ops.Watch(s.cmd)
+//
+// and wraps each apply:
+//
+//	op := s.ops.Begin("wifi", "apply")
+//	err := s.apply()
+//	op.Finish(err, s.paths.Hostapd, s.paths.Dnsmasq)
+//
+// A long operation also reports its progress and can be canceled; see
+// progress.go. A nil *Tracker and the nil *Op it hands out do nothing.
+package operations
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"os/exec"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/config"
+	"github.com/strct-org/strct-agent/internal/events"
+	"github.com/strct-org/strct-agent/internal/logger"
+	"github.com/strct-org/strct-agent/internal/platform/executil"
+)
+
+const (
+	maxOperations   = 50
+	maxFailures     = 20 // failed commands remembered for the next Finish
+	contextLogs     = 40 // agent log records in a snapshot
+	maxJournalBytes = 16 << 10
+	maxConfigBytes  = 8 << 10
+	maxOutputBytes  = 4 << 10
+	maxContextBytes = 64 << 10
+)
+
+// featureUnits are the systemd units whose journal a feature's snapshot
+// includes.
+var featureUnits = map[string][]string{
+	"wifi":    {"hostapd", "dnsmasq", "wpa_supplicant"},
+	"vpn":     {"tailscaled"},
+	"adblock": {"dnsmasq"},
+}
+
+// Operation states.
+const (
+	StatusRunning = "running"
+	StatusOK      = "ok"
+	StatusFailed  = "failed"
+)
+
+// Operation is one apply as GET /api/operations lists it.
+type Operation struct {
+	ID         string    `json:"id"`
+	Feature    string    `json:"feature"`
+	Action     string    `json:"action"`
+	Started    time.Time `json:"started"`
+	Finished   time.Time `json:"finished,omitempty"`
+	Status     string    `json:"status"`
+	Error      string    `json:"error,omitempty"`
+	HasContext bool      `json:"has_context"`
+	// Progress is the latest an operation reported; see progress.go.
+	Progress   *Progress `json:"progress,omitempty"`
+	Cancelable bool      `json:"cancelable,omitempty"`
+}
+
+// Context is the snapshot taken when an operation fails.
+type Context struct {
+	Captured      time.Time         `json:"captured"`
+	FailedCommand *FailedCommand    `json:"failed_command,omitempty"`
+	Logs          []logger.Entry    `json:"logs"`
+	Units         []string          `json:"units,omitempty"`
+	Journal       string            `json:"journal,omitempty"`
+	Configs       map[string]string `json:"configs,omitempty"` // path → contents
+	// Truncated says parts were cut to stay under maxContextBytes.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// FailedCommand is the last command that exited non-zero during the
+// operation.
+type FailedCommand struct {
+	At      time.Time `json:"at"`
+	Command string    `json:"command"`
+	Error   string    `json:"error"`
+	Output  string    `json:"output,omitempty"` // stderr, or the combined output
+}
+
+type runner interface {
+	CombinedOutput(name string, args ...string) ([]byte, error)
+}
+
+// Tracker keeps the latest operations.
+type Tracker struct {
+	mu       sync.Mutex
+	ops      []*Op // oldest first
+	seq      int
+	failures []FailedCommand // oldest first
+
+	cmd    runner // for journalctl
+	logs   *logger.Ring
+	events events.Publisher
+	now    func() time.Time
+}
+
+func New(cmd runner, logs *logger.Ring) *Tracker {
+	return &Tracker{cmd: cmd, logs: logs, now: time.Now}
+}
+
+func NewFromConfig(cfg *config.Config, bus events.Publisher) *Tracker {
+	var cmd executil.Runner
+	if cfg.IsDev {
+		cmd = executil.NewDevRunner()
+	} else {
+		cmd = executil.Real{}
+	}
+	t := New(cmd, logger.Recent)
+	t.UseEvents(bus)
+	return t
+}
+
+// Op is a running or finished operation.
+type Op struct {
+	t       *Tracker
+	op      Operation
+	context *Context
+
+	cancel    context.CancelFunc // see WithCancel
+	canceled  bool               // by Cancel
+	published time.Time          // the last progress event
+}
+
+// Begin records the start of feature's action.
+func (t *Tracker) Begin(feature, action string) *Op {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.seq++
+	o := &Op{t: t, op: Operation{
+		ID:      strconv.Itoa(t.seq),
+		Feature: feature,
+		Action:  action,
+		Started: t.now(),
+		Status:  StatusRunning,
+	}}
+	t.ops = append(t.ops, o)
+	if len(t.ops) > maxOperations {
+		t.ops = slices.Delete(t.ops, 0, len(t.ops)-maxOperations)
+	}
+	return o
+}
+
+// Finish records how the operation ended. On an error it captures the
+// context, reading configs, the files the feature generated, as they
+// are now. An operation stopped through Cancel ends as StatusCanceled,
+// with no context.
+func (o *Op) Finish(err error, configs ...string) {
+	if o == nil {
+		return
+	}
+	o.t.mu.Lock()
+	canceled := o.canceled && err != nil
+	o.t.mu.Unlock()
+	var ctx *Context
+	if err != nil && !canceled {
+		ctx = o.t.capture(o.op.Feature, o.op.Started, configs)
+		slog.Info("operations: captured failure context", "id", o.op.ID, "feature", o.op.Feature, "action", o.op.Action)
+	}
+	o.t.mu.Lock()
+	if o.cancel != nil {
+		o.cancel()
+	}
+	o.op.Finished = o.t.now()
+	o.op.Status = StatusOK
+	o.op.Cancelable = false
+	switch {
+	case canceled:
+		o.op.Status = StatusCanceled
+		o.op.Error = "canceled"
+	case err != nil:
+		o.op.Status = StatusFailed
+		o.op.Error = redact(err.Error())
+		o.context = ctx
+		o.op.HasContext = true
+	}
+	snap, pub := o.op, o.t.events
+	o.t.mu.Unlock()
+	if pub != nil {
+		pub.Publish(events.OperationUpdated, snap)
+	}
+}
+
+// List returns the operations, newest first.
+func (t *Tracker) List() []Operation {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make([]Operation, 0, len(t.ops))
+	for i := len(t.ops) - 1; i >= 0; i-- {
+		out = append(out, t.ops[i].op)
+	}
+	return out
+}
+
+// Get returns operation id and its context, nil if none was captured.
+func (t *Tracker) Get(id string) (Operation, *Context, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, o := range t.ops {
+		if o.op.ID == id {
+			return o.op, o.context, true
+		}
+	}
+	return Operation{}, nil, false
+}
+
+// capture takes the snapshot for a failed operation of feature that
+// started at since.
+func (t *Tracker) capture(feature string, since time.Time, configs []string) *Context {
+	c := &Context{Captured: t.now(), Logs: []logger.Entry{}}
+
+	t.mu.Lock()
+	for i := len(t.failures) - 1; i >= 0; i-- {
+		if f := t.failures[i]; !f.At.Before(since) {
+			c.FailedCommand = &f
+			break
+		}
+	}
+	t.mu.Unlock()
+
+	if t.logs != nil {
+		if logs, _ := t.logs.Since(0, contextLogs, slog.LevelDebug); logs != nil {
+			c.Logs = logs
+		}
+		for i := range c.Logs {
+			c.Logs[i].Msg = redact(c.Logs[i].Msg)
+			c.Logs[i].Attrs = redact(c.Logs[i].Attrs)
+		}
+	}
+
+	if units := featureUnits[feature]; len(units) > 0 {
+		c.Units = units
+		args := []string{}
+		for _, u := range units {
+			args = append(args, "-u", u)
+		}
+		args = append(args, "--since", "-1m", "-o", "short-iso", "--no-pager")
+		out, err := t.cmd.CombinedOutput("journalctl", args...)
+		if err != nil && len(out) == 0 {
+			out = []byte("journalctl: " + err.Error())
+		}
+		c.Journal = c.tail(redact(string(out)), maxJournalBytes)
+	}
+
+	for _, path := range configs {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		if c.Configs == nil {
+			c.Configs = map[string]string{}
+		}
+		c.Configs[path] = c.tail(redact(string(b)), maxConfigBytes)
+	}
+
+	// Each part is capped; if long log lines still push it over, shed the
+	// oldest records.
+	for len(c.Logs) > 0 && c.size() > maxContextBytes {
+		c.Logs = c.Logs[1:]
+		c.Truncated = true
+	}
+	return c
+}
+
+func (c *Context) tail(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	c.Truncated = true
+	return "…" + s[len(s)-n:]
+}
+
+func (c *Context) size() int {
+	b, _ := json.Marshal(c)
+	return len(b)
+}
+
+// ─── Command failures ────────────────────────────────────────────────────────
+
+// Watch returns r with every failed command recorded for the next
+// capture. A nil tracker returns r as it is.
+func (t *Tracker) Watch(r executil.Runner) executil.Runner {
+	if t == nil {
+		return r
+	}
+	return &watched{Runner: r, t: t}
+}
+
+type watched struct {
+	executil.Runner
+	t *Tracker
+}
+
+func (w *watched) Run(name string, args ...string) error {
+	err := w.Runner.Run(name, args...)
+	w.t.failed(name, args, nil, err)
+	return err
+}
+
+func (w *watched) Output(name string, args ...string) ([]byte, error) {
+	out, err := w.Runner.Output(name, args...)
+	w.t.failed(name, args, nil, err)
+	return out, err
+}
+
+func (w *watched) CombinedOutput(name string, args ...string) ([]byte, error) {
+	out, err := w.Runner.CombinedOutput(name, args...)
+	w.t.failed(name, args, out, err)
+	return out, err
+}
+
+// failed records a command that returned err, with its output or, if
+// there is none, the stderr an *exec.ExitError carries.
+func (t *Tracker) failed(name string, args []string, out []byte, err error) {
+	if err == nil {
+		return
+	}
+	var exit *exec.ExitError
+	if len(out) == 0 && errors.As(err, &exit) {
+		out = exit.Stderr
+	}
+	if len(out) > maxOutputBytes {
+		out = out[len(out)-maxOutputBytes:]
+	}
+	f := FailedCommand{
+		Command: redact(strings.Join(append([]string{name}, args...), " ")),
+		Error:   redact(err.Error()),
+		Output:  redact(strings.TrimSpace(string(out))),
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f.At = t.now()
+	t.failures = append(t.failures, f)
+	if len(t.failures) > maxFailures {
+		t.failures = slices.Delete(t.failures, 0, len(t.failures)-maxFailures)
+	}
+}
+
+// ─── Redaction ───────────────────────────────────────────────────────────────
+
+var (
+	// secretAssign matches key=value and key: value where the key names a
+	// secret: wpa_passphrase=…, psk="…", --authkey=…, password: …, but
+	// not bypass=….
+	secretAssign = regexp.MustCompile(`(?i)(^|[^\w.-])((?:[\w.-]*[_.-])?(?:pass|psk|secret|token|authkey|auth_?key|private_?key)[\w.-]*"?\s*[=:]\s*)("[^"]*"|\S+)`)
+	// tailscaleKey matches auth keys wherever they appear.
+	tailscaleKey = regexp.MustCompile(`tskey-[\w-]+`)
+)
+
+// redact replaces secrets in s with ***.
+func redact(s string) string {
+	s = secretAssign.ReplaceAllString(s, "${1}${2}***")
+	return tailscaleKey.ReplaceAllString(s, "tskey-***")
+}
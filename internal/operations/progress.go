@@ -0,0 +1,128 @@
+package operations
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/events"
+)
+
+// ─── Progress and cancel ─────────────────────────────────────────────────────
+
+// An operation that takes a while reports how far it is, and one that
+// can be stopped says so:
+//
+//	ctx = op.WithCancel(ctx)
+//	op.Progress(operations.Progress{Phase: "downloading", Bytes: n, Total: size})
+//
+// Each report is kept on the Operation and published as an
+// events.OperationUpdated, at most every progressEvery unless the phase
+// changes. POST /api/operations/{id}/cancel cancels the context; the
+// operation then finishes as StatusCanceled.
+
+// StatusCanceled is an operation stopped through Cancel.
+const StatusCanceled = "canceled"
+
+// progressEvery is how often progress within one phase is published.
+const progressEvery = 500 * time.Millisecond
+
+var (
+	ErrNotFound      = errors.New("no such operation")
+	ErrNotCancelable = errors.New("operation cannot be canceled")
+	ErrNotRunning    = errors.New("operation is not running")
+)
+
+// Progress is how far a running operation is.
+type Progress struct {
+	Phase string `json:"phase"`
+	// Bytes of Total are done; Total is 0 when unknown, and so then is
+	// Percent.
+	Bytes   int64   `json:"bytes,omitempty"`
+	Total   int64   `json:"total,omitempty"`
+	Percent float64 `json:"percent,omitempty"`
+	// Items are the things handled so far, such as domains parsed.
+	Items int `json:"items,omitempty"`
+}
+
+// UseEvents publishes operation updates on p.
+func (t *Tracker) UseEvents(p events.Publisher) {
+	if t == nil || p == nil {
+		return
+	}
+	t.mu.Lock()
+	t.events = p
+	t.mu.Unlock()
+}
+
+// ID is the operation's ID, "" for a nil *Op.
+func (o *Op) ID() string {
+	if o == nil {
+		return ""
+	}
+	o.t.mu.Lock()
+	defer o.t.mu.Unlock()
+	return o.op.ID
+}
+
+// WithCancel returns a context that Cancel cancels, and marks the
+// operation cancelable. A nil *Op returns ctx.
+func (o *Op) WithCancel(ctx context.Context) context.Context {
+	if o == nil {
+		return ctx
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	o.t.mu.Lock()
+	o.cancel = cancel
+	o.op.Cancelable = true
+	o.t.mu.Unlock()
+	return ctx
+}
+
+// Progress records p. It is published when the phase changed or
+// progressEvery has passed since the last one.
+func (o *Op) Progress(p Progress) {
+	if o == nil {
+		return
+	}
+	if p.Total > 0 {
+		p.Percent = float64(int(float64(p.Bytes)/float64(p.Total)*1000)) / 10
+	}
+	o.t.mu.Lock()
+	if o.op.Status != StatusRunning {
+		o.t.mu.Unlock()
+		return
+	}
+	now := o.t.now()
+	publish := o.op.Progress == nil || o.op.Progress.Phase != p.Phase || now.Sub(o.published) >= progressEvery
+	o.op.Progress = &p
+	if publish {
+		o.published = now
+	}
+	snap, pub := o.op, o.t.events
+	o.t.mu.Unlock()
+	if publish && pub != nil {
+		pub.Publish(events.OperationUpdated, snap)
+	}
+}
+
+// Cancel cancels operation id's context.
+func (t *Tracker) Cancel(id string) (Operation, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, o := range t.ops {
+		if o.op.ID != id {
+			continue
+		}
+		switch {
+		case o.op.Status != StatusRunning:
+			return o.op, ErrNotRunning
+		case o.cancel == nil:
+			return o.op, ErrNotCancelable
+		}
+		o.canceled = true
+		o.cancel()
+		return o.op, nil
+	}
+	return Operation{}, ErrNotFound
+}
@@ -0,0 +1,104 @@
+package operations
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/events"
+)
+
+func TestProgress_ThrottledWithinAPhase(t *testing.T) {
+	tr, _ := newTestTracker(t)
+	now := time.Unix(1760000000, 0)
+	tr.now = func() time.Time { return now }
+	bus := events.New()
+	sub := bus.Subscribe(16, events.OperationUpdated)
+	defer sub.Close()
+	tr.UseEvents(bus)
+
+	op := tr.Begin("adblock", "update")
+	op.Progress(Progress{Phase: "downloading", Bytes: 0, Total: 4000})
+	op.Progress(Progress{Phase: "downloading", Bytes: 1000, Total: 4000}) // too soon
+	now = now.Add(progressEvery)
+	op.Progress(Progress{Phase: "downloading", Bytes: 3000, Total: 4000, Items: 120})
+	op.Progress(Progress{Phase: "writing", Items: 150}) // new phase
+	op.Finish(nil)
+	op.Progress(Progress{Phase: "reloading"}) // after the end
+
+	var phases []string
+	for len(sub.C) > 0 {
+		e := <-sub.C
+		o := e.Payload.(Operation)
+		switch {
+		case o.Status != StatusRunning:
+			phases = append(phases, o.Status)
+		default:
+			phases = append(phases, o.Progress.Phase)
+		}
+	}
+	if want := "downloading downloading writing ok"; strings.Join(phases, " ") != want {
+		t.Errorf("published %q, want %q", strings.Join(phases, " "), want)
+	}
+	got, _, _ := tr.Get(op.ID())
+	if p := got.Progress; p == nil || p.Phase != "writing" || p.Items != 150 {
+		t.Errorf("progress = %+v", p)
+	}
+
+	op = tr.Begin("adblock", "update")
+	op.Progress(Progress{Phase: "downloading", Bytes: 3000, Total: 4000})
+	if got, _, _ := tr.Get(op.ID()); got.Progress.Percent != 75 {
+		t.Errorf("percent = %v, want 75", got.Progress.Percent)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	tr, _ := newTestTracker(t)
+	mux := http.NewServeMux()
+	tr.RegisterRoutes(mux)
+	cancel := func(id string) int {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("POST", "/api/operations/"+id+"/cancel", nil))
+		return w.Code
+	}
+
+	fixed := tr.Begin("wifi", "apply") // never asked for a context
+	op := tr.Begin("adblock", "update")
+	ctx := op.WithCancel(context.Background())
+	if got, _, _ := tr.Get(op.ID()); !got.Cancelable {
+		t.Error("operation not marked cancelable")
+	}
+
+	if code := cancel(fixed.ID()); code != http.StatusConflict {
+		t.Errorf("uncancelable op: %d, want 409", code)
+	}
+	if code := cancel("99"); code != http.StatusNotFound {
+		t.Errorf("unknown op: %d, want 404", code)
+	}
+	if code := cancel(op.ID()); code != http.StatusAccepted {
+		t.Fatalf("cancel: %d, want 202", code)
+	}
+	select {
+	case <-ctx.Done():
+	default:
+		t.Fatal("context not canceled")
+	}
+
+	// The work notices and returns the context's error.
+	op.Finish(ctx.Err())
+	got, _, _ := tr.Get(op.ID())
+	if got.Status != StatusCanceled || got.Error != "canceled" || got.HasContext || got.Cancelable {
+		t.Errorf("operation = %+v", got)
+	}
+	if code := cancel(op.ID()); code != http.StatusConflict {
+		t.Errorf("finished op: %d, want 409", code)
+	}
+	if _, err := tr.Cancel(op.ID()); !errors.Is(err, ErrNotRunning) {
+		t.Errorf("Cancel finished op = %v", err)
+	}
+	fixed.Finish(nil)
+}
@@ -0,0 +1,43 @@
+package peers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/apidoc"
+	"github.com/strct-org/strct-agent/internal/httputil"
+)
+
+var (
+	sameAccount = true
+
+	// Example for /api/openapi.json.
+	examplePeers = []Peer{{
+		DeviceID:         "device-3b9e",
+		Name:             "strct-office",
+		Addresses:        []string{"192.168.1.23", "192.168.4.1"},
+		Port:             8080,
+		Version:          "1.4.0",
+		CapabilitiesHash: "5f1d0c2a9e7b4431",
+		LastSeen:         time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC),
+		ExpiresAt:        time.Date(2026, 10, 16, 9, 2, 0, 0, time.UTC),
+		SameAccount:      &sameAccount,
+	}}
+)
+
+func (s *Service) RegisterRoutes(mux *http.ServeMux) {
+	apidoc.On(mux, "peers").Register("GET", "/api/peers", s.handlePeers, apidoc.RouteDoc{
+		Summary: "Other strct devices found on this device's networks over mDNS",
+		Description: "What each peer announced about itself, unverified: the list is for showing, and " +
+			"nothing is trusted on the strength of it. A peer is dropped when its announcement " +
+			"expires or it says goodbye. same_account is what the backend says about the peer's " +
+			"device ID, null until it has been asked.",
+		Response: examplePeers,
+	})
+}
+
+// handlePeers lists the peers.
+// GET /api/peers
+func (s *Service) handlePeers(w http.ResponseWriter, r *http.Request) {
+	httputil.OK(w, s.Peers())
+}
@@ -0,0 +1,300 @@
+package peers
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/ipv4"
+)
+
+// ─── Wire format ─────────────────────────────────────────────────────────────
+
+// Each agent answers for one DNS-SD instance, named after its device ID:
+//
+//	_strct._tcp.local.                PTR  device-1f0c…._strct._tcp.local.
+//	device-1f0c…._strct._tcp.local.   SRV  0 0 8080 device-1f0c….local.
+//	device-1f0c…._strct._tcp.local.   TXT  "id=device-1f0c…" "v=1.4.0" "caps=…" "name=strct-kitchen"
+//	device-1f0c….local.               A    the address on the network asked on
+//
+// The A record differs by interface, so a peer on the AP subnet is told
+// the AP address and one on the LAN the LAN address.
+
+const (
+	serviceType = "_strct._tcp"
+	serviceName = serviceType + ".local."
+	mdnsPort    = 5353
+)
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: mdnsPort}
+
+// advert is what this agent announces.
+type advert struct {
+	id, name, version, caps string
+	port                    int
+}
+
+func instanceName(id string) string { return id + "." + serviceName }
+
+// records are the advert's answers for a peer on a network where this
+// agent has addr. ttl 0 is the goodbye sent at shutdown.
+func (a advert) records(addr net.IP, ttl uint32) []dns.RR {
+	instance := instanceName(a.id)
+	host := a.id + ".local."
+	hdr := func(name string, rrtype uint16, flush bool) dns.RR_Header {
+		class := uint16(dns.ClassINET)
+		if flush {
+			class |= 1 << 15 // cache-flush: these records are ours alone
+		}
+		return dns.RR_Header{Name: name, Rrtype: rrtype, Class: class, Ttl: ttl}
+	}
+	return []dns.RR{
+		&dns.PTR{Hdr: hdr(serviceName, dns.TypePTR, false), Ptr: instance},
+		&dns.SRV{Hdr: hdr(instance, dns.TypeSRV, true), Target: host, Port: uint16(a.port)},
+		&dns.TXT{Hdr: hdr(instance, dns.TypeTXT, true), Txt: []string{
+			"id=" + a.id, "v=" + a.version, "caps=" + a.caps, "name=" + a.name,
+		}},
+		&dns.A{Hdr: hdr(host, dns.TypeA, true), A: addr.To4()},
+	}
+}
+
+// response packs records as an unsolicited mDNS response.
+func response(records []dns.RR) ([]byte, error) {
+	m := new(dns.Msg)
+	m.Response = true
+	m.Authoritative = true
+	m.Answer = records[:1]
+	m.Extra = records[1:]
+	return m.Pack()
+}
+
+// query asks for every strct instance.
+func query() ([]byte, error) {
+	m := new(dns.Msg)
+	m.Id = 0 // RFC 6762 §18.1
+	m.Question = []dns.Question{{Name: serviceName, Qtype: dns.TypePTR, Qclass: dns.ClassINET}}
+	return m.Pack()
+}
+
+// asksForUs reports whether a query wants this agent's records.
+func asksForUs(m *dns.Msg, id string) bool {
+	if m.Response {
+		return false
+	}
+	for _, q := range m.Question {
+		name := strings.ToLower(q.Name)
+		if (name == serviceName && (q.Qtype == dns.TypePTR || q.Qtype == dns.TypeANY)) ||
+			name == strings.ToLower(instanceName(id)) {
+			return true
+		}
+	}
+	return false
+}
+
+// sighting is one instance from a response.
+type sighting struct {
+	id, name, version, caps string
+	port                    int
+	addr                    net.IP
+	ttl                     uint32 // 0: the peer said goodbye
+}
+
+// sightings reads the strct instances out of a response. An instance
+// whose host has no A record in the message is at the sender's address:
+// responders answer for themselves.
+func sightings(m *dns.Msg, from net.IP) []sighting {
+	if !m.Response {
+		return nil
+	}
+	type inst struct {
+		sighting
+		host   string
+		hasTTL bool
+	}
+	found := map[string]*inst{}
+	get := func(name string) *inst {
+		name = strings.ToLower(name)
+		if !strings.HasSuffix(name, "."+serviceName) {
+			return nil
+		}
+		in, ok := found[name]
+		if !ok {
+			in = &inst{}
+			found[name] = in
+		}
+		return in
+	}
+	setTTL := func(in *inst, ttl uint32) {
+		if !in.hasTTL || ttl < in.ttl {
+			in.ttl, in.hasTTL = ttl, true
+		}
+	}
+	hosts := map[string]net.IP{}
+	for _, rr := range append(append([]dns.RR{}, m.Answer...), m.Extra...) {
+		switch r := rr.(type) {
+		case *dns.PTR:
+			if strings.EqualFold(r.Hdr.Name, serviceName) {
+				if in := get(r.Ptr); in != nil {
+					setTTL(in, r.Hdr.Ttl)
+				}
+			}
+		case *dns.SRV:
+			if in := get(r.Hdr.Name); in != nil {
+				in.host, in.port = strings.ToLower(r.Target), int(r.Port)
+				setTTL(in, r.Hdr.Ttl)
+			}
+		case *dns.TXT:
+			if in := get(r.Hdr.Name); in != nil {
+				for _, kv := range r.Txt {
+					k, v, _ := strings.Cut(kv, "=")
+					switch k {
+					case "id":
+						in.id = v
+					case "v":
+						in.version = v
+					case "caps":
+						in.caps = v
+					case "name":
+						in.name = v
+					}
+				}
+			}
+		case *dns.A:
+			hosts[strings.ToLower(r.Hdr.Name)] = r.A.To4()
+		}
+	}
+	var out []sighting
+	for _, in := range found {
+		if in.id == "" || !in.hasTTL {
+			continue // not enough to know who it is
+		}
+		in.addr = hosts[in.host]
+		if in.addr == nil {
+			in.addr = from.To4()
+		}
+		if in.addr == nil {
+			continue
+		}
+		out = append(out, in.sighting)
+	}
+	return out
+}
+
+// ─── Socket ──────────────────────────────────────────────────────────────────
+
+// transport is the mDNS socket: the group on this machine's interfaces,
+// or a fake network in tests. Interfaces are by index.
+type transport interface {
+	Join(ifi iface) error
+	// Read returns the next packet and the interface it came in on.
+	Read(b []byte) (n, ifIndex int, from net.IP, err error)
+	// Write multicasts b on one interface.
+	Write(b []byte, ifIndex int) error
+	Close() error
+}
+
+// iface is an interface discovery runs on, with the IPv4 address peers
+// on that network are told.
+type iface struct {
+	Index int
+	Name  string
+	Addr  net.IP
+}
+
+// systemInterfaces are the interfaces that are up, do multicast and have
+// an IPv4 address: the AP and the LAN side. Loopback and point-to-point
+// links (tailscale0) are left out.
+func systemInterfaces() ([]iface, error) {
+	all, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	var out []iface
+	for _, ifi := range all {
+		if ifi.Flags&net.FlagUp == 0 || ifi.Flags&net.FlagMulticast == 0 ||
+			ifi.Flags&(net.FlagLoopback|net.FlagPointToPoint) != 0 {
+			continue
+		}
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if ipn, ok := a.(*net.IPNet); ok && ipn.IP.To4() != nil {
+				out = append(out, iface{Index: ifi.Index, Name: ifi.Name, Addr: ipn.IP.To4()})
+				break
+			}
+		}
+	}
+	return out, nil
+}
+
+// udpTransport shares 224.0.0.251:5353 with the router's mDNS listener
+// and any avahi: Go sets SO_REUSEADDR on multicast listeners.
+type udpTransport struct {
+	conn *net.UDPConn
+	pc   *ipv4.PacketConn
+
+	mu sync.Mutex // SetMulticastInterface and WriteTo go together
+}
+
+func listenUDP() (transport, error) {
+	conn, err := net.ListenMulticastUDP("udp4", nil, mdnsGroup)
+	if err != nil {
+		return nil, fmt.Errorf("listen on mdns group: %w", err)
+	}
+	pc := ipv4.NewPacketConn(conn)
+	if err := pc.SetControlMessage(ipv4.FlagInterface, true); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("mdns interface info: %w", err)
+	}
+	// Our own announcements are no news to us.
+	pc.SetMulticastLoopback(false) //nolint:errcheck
+	return &udpTransport{conn: conn, pc: pc}, nil
+}
+
+func (t *udpTransport) Join(ifi iface) error {
+	nifi, err := net.InterfaceByIndex(ifi.Index)
+	if err != nil {
+		return err
+	}
+	// Already joined, by the listen on the default interface, is fine.
+	if err := t.pc.JoinGroup(nifi, mdnsGroup); err != nil && !strings.Contains(err.Error(), "address already in use") {
+		return fmt.Errorf("join mdns group on %s: %w", ifi.Name, err)
+	}
+	return nil
+}
+
+func (t *udpTransport) Read(b []byte) (int, int, net.IP, error) {
+	n, cm, src, err := t.pc.ReadFrom(b)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	var ifIndex int
+	if cm != nil {
+		ifIndex = cm.IfIndex
+	}
+	var from net.IP
+	if u, ok := src.(*net.UDPAddr); ok {
+		from = u.IP
+	}
+	return n, ifIndex, from, nil
+}
+
+func (t *udpTransport) Write(b []byte, ifIndex int) error {
+	nifi, err := net.InterfaceByIndex(ifIndex)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.pc.SetMulticastInterface(nifi); err != nil {
+		return err
+	}
+	_, err = t.pc.WriteTo(b, nil, mdnsGroup)
+	return err
+}
+
+func (t *udpTransport) Close() error { return t.conn.Close() }
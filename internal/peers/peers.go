@@ -0,0 +1,500 @@
+// Package peers finds the other strct devices on the networks this one
+// is on, over mDNS, and lists them for the app.
+//
+// What a peer announces is unauthenticated: anyone on the LAN can claim
+// any device ID. The list is for showing, not for trusting. Nothing here
+// grants a peer anything; that takes pairing's mutual authentication.
+// The same_account flag is what the backend says about the claimed ID.
+package peers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/strct-org/strct-agent/internal/config"
+	"github.com/strct-org/strct-agent/internal/platform/backend"
+)
+
+const (
+	// recordTTL is what we announce; a peer not heard from again within
+	// it is dropped.
+	recordTTL = 120 * time.Second
+	// queryEvery is how often we ask, well inside recordTTL so a peer
+	// that is still there is never dropped.
+	queryEvery = time.Minute
+	// maxTTL caps what a peer may announce, so one with a long TTL does
+	// not outstay its unplugging by hours.
+	maxTTL = 10 * time.Minute
+	// confirmEvery is how often the backend is asked which peers are on
+	// this device's account. A device can change hands.
+	confirmEvery = 10 * time.Minute
+)
+
+// Confirmer asks the backend which device IDs share this device's
+// account. *backend.Client is one.
+type Confirmer interface {
+	Query(ctx context.Context, path string, v, out any) error
+	DevicePath(suffix string) string
+}
+
+type Config struct {
+	// DeviceID, Version and Port are announced; Name is shown to peers.
+	DeviceID string
+	Version  string
+	Name     string
+	Port     int
+	// Capabilities returns the capabilities hash to announce. It is read
+	// at every announcement, and a change is announced.
+	Capabilities func() string
+	// Backend confirms same-account peers. Nil leaves them unknown.
+	Backend Confirmer
+}
+
+// Peer is another strct device, as it described itself.
+type Peer struct {
+	DeviceID string `json:"device_id"`
+	Name     string `json:"name"`
+	// Addresses are where it is reachable, one per network we share.
+	Addresses        []string  `json:"addresses"`
+	Port             int       `json:"port"`
+	Version          string    `json:"version"`
+	CapabilitiesHash string    `json:"capabilities_hash,omitempty"`
+	LastSeen         time.Time `json:"last_seen"`
+	ExpiresAt        time.Time `json:"expires_at"`
+	// SameAccount is nil until the backend has been asked.
+	SameAccount *bool `json:"same_account"`
+}
+
+type peer struct {
+	Peer
+	// addrs are when each address expires.
+	addrs map[string]time.Time
+}
+
+type Service struct {
+	cfg        Config
+	now        func() time.Time
+	listen     func() (transport, error)
+	interfaces func() ([]iface, error)
+
+	mu     sync.Mutex
+	peers  map[string]*peer
+	joined map[int]iface
+	caps   string // as last announced
+	conn   transport
+
+	confirm chan struct{}
+	loops   sync.WaitGroup
+}
+
+func New(cfg Config) *Service {
+	if cfg.Capabilities == nil {
+		cfg.Capabilities = func() string { return "" }
+	}
+	return &Service{
+		cfg:        cfg,
+		now:        time.Now,
+		listen:     listenUDP,
+		interfaces: systemInterfaces,
+		peers:      map[string]*peer{},
+		joined:     map[int]iface{},
+		confirm:    make(chan struct{}, 1),
+	}
+}
+
+// NewFromConfig announces this device on the API port, named after the
+// host.
+func NewFromConfig(cfg *config.Config, version string, caps func() string, b *backend.Client) *Service {
+	name, _ := os.Hostname()
+	return New(Config{
+		DeviceID:     cfg.DeviceID,
+		Version:      version,
+		Name:         name,
+		Port:         config.APIPort,
+		Capabilities: caps,
+		Backend:      b,
+	})
+}
+
+func (s *Service) Name() string { return "peers" }
+
+// DependsOn wifi, so the AP is up to be announced on.
+func (s *Service) DependsOn() []string { return []string{"wifi"} }
+
+// Start joins the mDNS group on every interface, announces, and keeps
+// answering, asking and expiring until ctx is done.
+func (s *Service) Start(ctx context.Context) error {
+	conn, err := s.listen()
+	if err != nil {
+		return fmt.Errorf("peers: %w", err)
+	}
+	s.mu.Lock()
+	s.conn = conn
+	s.mu.Unlock()
+	s.refreshInterfaces()
+
+	s.loops.Add(3)
+	go func() {
+		defer s.loops.Done()
+		s.read(conn)
+	}()
+	go func() {
+		defer s.loops.Done()
+		s.run(ctx, conn)
+	}()
+	go func() {
+		defer s.loops.Done()
+		s.confirmLoop(ctx)
+	}()
+	return nil
+}
+
+// Stop waits for the loops Start began to finish, goodbyes sent.
+func (s *Service) Stop(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.loops.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Peers lists the peers heard from and not yet expired, by name.
+func (s *Service) Peers() []Peer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expireLocked()
+	out := make([]Peer, 0, len(s.peers))
+	for _, p := range s.peers {
+		out = append(out, p.snapshot())
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Name != out[j].Name {
+			return out[i].Name < out[j].Name
+		}
+		return out[i].DeviceID < out[j].DeviceID
+	})
+	return out
+}
+
+func (p *peer) snapshot() Peer {
+	out := p.Peer
+	out.Addresses = make([]string, 0, len(p.addrs))
+	out.ExpiresAt = time.Time{}
+	for a, expires := range p.addrs {
+		out.Addresses = append(out.Addresses, a)
+		if expires.After(out.ExpiresAt) {
+			out.ExpiresAt = expires
+		}
+	}
+	sort.Strings(out.Addresses)
+	if p.SameAccount != nil {
+		v := *p.SameAccount
+		out.SameAccount = &v
+	}
+	return out
+}
+
+// ─── Loops ───────────────────────────────────────────────────────────────────
+
+// run announces twice, a second apart as RFC 6762 asks, then asks every
+// queryEvery. On the way out it says goodbye and closes the socket,
+// which ends read.
+func (s *Service) run(ctx context.Context, conn transport) {
+	defer conn.Close()
+	s.announce(conn, recordTTL)
+	s.ask(conn)
+
+	t := time.NewTimer(time.Second)
+	defer t.Stop()
+	first := true
+	for {
+		select {
+		case <-ctx.Done():
+			s.announce(conn, 0)
+			return
+		case <-t.C:
+		}
+		for _, ifi := range s.refreshInterfaces() {
+			s.announceOn(conn, ifi, recordTTL)
+			s.askOn(conn, ifi)
+		}
+		if first || s.capsChanged() {
+			s.announce(conn, recordTTL)
+		}
+		if !first {
+			s.ask(conn)
+		}
+		first = false
+		s.mu.Lock()
+		s.expireLocked()
+		s.mu.Unlock()
+		t.Reset(queryEvery)
+	}
+}
+
+func (s *Service) read(conn transport) {
+	buf := make([]byte, 9000)
+	for {
+		n, ifIndex, from, err := conn.Read(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				slog.Debug("peers: read stopped", "err", err)
+			}
+			return
+		}
+		var m dns.Msg
+		if m.Unpack(buf[:n]) != nil {
+			continue
+		}
+		s.handle(conn, &m, ifIndex, from)
+	}
+}
+
+func (s *Service) handle(conn transport, m *dns.Msg, ifIndex int, from net.IP) {
+	if asksForUs(m, s.cfg.DeviceID) {
+		s.mu.Lock()
+		ifi, ok := s.joined[ifIndex]
+		s.mu.Unlock()
+		if ok {
+			s.announceOn(conn, ifi, recordTTL)
+		}
+		return
+	}
+	now := s.now()
+	added := false
+	s.mu.Lock()
+	for _, sg := range sightings(m, from) {
+		if sg.id == s.cfg.DeviceID {
+			continue
+		}
+		added = s.sawLocked(sg, now) || added
+	}
+	s.mu.Unlock()
+	if added {
+		select {
+		case s.confirm <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// sawLocked records a sighting and reports whether the peer is new. A
+// goodbye drops the address, and the peer with its last one.
+func (s *Service) sawLocked(sg sighting, now time.Time) bool {
+	addr := sg.addr.String()
+	p, ok := s.peers[sg.id]
+	if sg.ttl == 0 {
+		if ok {
+			delete(p.addrs, addr)
+			if len(p.addrs) == 0 {
+				delete(s.peers, sg.id)
+				slog.Info("peers: left", "device", sg.id)
+			}
+		}
+		return false
+	}
+	ttl := time.Duration(sg.ttl) * time.Second
+	if ttl > maxTTL {
+		ttl = maxTTL
+	}
+	if !ok {
+		p = &peer{Peer: Peer{DeviceID: sg.id}, addrs: map[string]time.Time{}}
+		s.peers[sg.id] = p
+		slog.Info("peers: found", "device", sg.id, "name", sg.name, "addr", addr)
+	}
+	p.Name, p.Port, p.Version, p.CapabilitiesHash = sg.name, sg.port, sg.version, sg.caps
+	if p.Name == "" {
+		p.Name = sg.id
+	}
+	p.LastSeen = now
+	p.addrs[addr] = now.Add(ttl)
+	return !ok
+}
+
+func (s *Service) expireLocked() {
+	now := s.now()
+	for id, p := range s.peers {
+		for a, expires := range p.addrs {
+			if !now.Before(expires) {
+				delete(p.addrs, a)
+			}
+		}
+		if len(p.addrs) == 0 {
+			delete(s.peers, id)
+			slog.Info("peers: expired", "device", id)
+		}
+	}
+}
+
+// refreshInterfaces joins the group on interfaces that came up since
+// the last call, as the AP does after the setup wizard, and returns
+// them. Interfaces that went away are forgotten.
+func (s *Service) refreshInterfaces() []iface {
+	list, err := s.interfaces()
+	if err != nil {
+		slog.Warn("peers: listing interfaces failed", "err", err)
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current := map[int]bool{}
+	var added []iface
+	for _, ifi := range list {
+		current[ifi.Index] = true
+		if old, ok := s.joined[ifi.Index]; ok {
+			// Same interface; a new address is announced again.
+			s.joined[ifi.Index] = ifi
+			if old.Addr.Equal(ifi.Addr) {
+				continue
+			}
+		} else if err := s.conn.Join(ifi); err != nil {
+			slog.Warn("peers: join failed", "iface", ifi.Name, "err", err)
+			continue
+		}
+		s.joined[ifi.Index] = ifi
+		added = append(added, ifi)
+	}
+	for idx := range s.joined {
+		if !current[idx] {
+			delete(s.joined, idx)
+		}
+	}
+	return added
+}
+
+func (s *Service) capsChanged() bool {
+	caps := s.cfg.Capabilities()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if caps == s.caps {
+		return false
+	}
+	s.caps = caps
+	return true
+}
+
+func (s *Service) interfacesNow() []iface {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]iface, 0, len(s.joined))
+	for _, ifi := range s.joined {
+		out = append(out, ifi)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Index < out[j].Index })
+	return out
+}
+
+func (s *Service) announce(conn transport, ttl time.Duration) {
+	if ttl > 0 {
+		s.capsChanged()
+	}
+	for _, ifi := range s.interfacesNow() {
+		s.announceOn(conn, ifi, ttl)
+	}
+}
+
+func (s *Service) announceOn(conn transport, ifi iface, ttl time.Duration) {
+	s.mu.Lock()
+	a := advert{id: s.cfg.DeviceID, name: s.cfg.Name, version: s.cfg.Version, caps: s.caps, port: s.cfg.Port}
+	s.mu.Unlock()
+	b, err := response(a.records(ifi.Addr, uint32(ttl/time.Second)))
+	if err == nil {
+		err = conn.Write(b, ifi.Index)
+	}
+	if err != nil {
+		slog.Debug("peers: announce failed", "iface", ifi.Name, "err", err)
+	}
+}
+
+func (s *Service) ask(conn transport) {
+	for _, ifi := range s.interfacesNow() {
+		s.askOn(conn, ifi)
+	}
+}
+
+func (s *Service) askOn(conn transport, ifi iface) {
+	b, err := query()
+	if err == nil {
+		err = conn.Write(b, ifi.Index)
+	}
+	if err != nil {
+		slog.Debug("peers: query failed", "iface", ifi.Name, "err", err)
+	}
+}
+
+// ─── Same account ────────────────────────────────────────────────────────────
+
+type confirmRequest struct {
+	DeviceIDs []string `json:"device_ids"`
+}
+
+type confirmResponse struct {
+	SameAccount []string `json:"same_account"`
+}
+
+// confirmLoop asks the backend about the peers when one is found and
+// every confirmEvery.
+func (s *Service) confirmLoop(ctx context.Context) {
+	if s.cfg.Backend == nil {
+		return
+	}
+	t := time.NewTicker(confirmEvery)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		case <-s.confirm:
+		}
+		if err := s.confirmPeers(ctx); err != nil {
+			if backend.IsNotSupported(err) {
+				slog.Debug("peers: backend does not confirm peers")
+			} else if ctx.Err() == nil {
+				slog.Warn("peers: confirming peers failed", "err", err)
+			}
+		}
+	}
+}
+
+func (s *Service) confirmPeers(ctx context.Context) error {
+	var req confirmRequest
+	for _, p := range s.Peers() {
+		req.DeviceIDs = append(req.DeviceIDs, p.DeviceID)
+	}
+	if len(req.DeviceIDs) == 0 {
+		return nil
+	}
+	var resp confirmResponse
+	if err := s.cfg.Backend.Query(ctx, s.cfg.Backend.DevicePath("peers"), req, &resp); err != nil {
+		return err
+	}
+	same := map[string]bool{}
+	for _, id := range resp.SameAccount {
+		same[id] = true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range req.DeviceIDs {
+		if p, ok := s.peers[id]; ok {
+			v := same[id]
+			p.SameAccount = &v
+		}
+	}
+	return nil
+}
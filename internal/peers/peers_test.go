@@ -0,0 +1,315 @@
+package peers
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/strct-org/strct-agent/internal/platform/backend"
+)
+
+// ─── Fake network ────────────────────────────────────────────────────────────
+
+// fakeNet is a few network segments, by name. A packet written on an
+// interface reaches every other member on that interface's segment.
+type fakeNet struct {
+	mu      sync.Mutex
+	members []*fakeConn
+}
+
+type packet struct {
+	b       []byte
+	ifIndex int
+	from    net.IP
+}
+
+type fakeConn struct {
+	net    *fakeNet
+	ifaces []iface // Name is the segment
+	in     chan packet
+	once   sync.Once
+	closed chan struct{}
+}
+
+// attach adds a member with the interfaces given as segment and
+// address, indexed from 1.
+func (n *fakeNet) attach(segAddrs ...string) *fakeConn {
+	c := &fakeConn{net: n, in: make(chan packet, 64), closed: make(chan struct{})}
+	for i := 0; i < len(segAddrs); i += 2 {
+		c.ifaces = append(c.ifaces, iface{Index: i/2 + 1, Name: segAddrs[i], Addr: net.ParseIP(segAddrs[i+1]).To4()})
+	}
+	n.mu.Lock()
+	n.members = append(n.members, c)
+	n.mu.Unlock()
+	return c
+}
+
+func (c *fakeConn) on(ifIndex int) (iface, bool) {
+	for _, ifi := range c.ifaces {
+		if ifi.Index == ifIndex {
+			return ifi, true
+		}
+	}
+	return iface{}, false
+}
+
+func (c *fakeConn) Join(iface) error { return nil }
+
+func (c *fakeConn) Read(b []byte) (int, int, net.IP, error) {
+	select {
+	case p := <-c.in:
+		return copy(b, p.b), p.ifIndex, p.from, nil
+	case <-c.closed:
+		return 0, 0, nil, net.ErrClosed
+	}
+}
+
+func (c *fakeConn) Write(b []byte, ifIndex int) error {
+	src, ok := c.on(ifIndex)
+	if !ok {
+		return errors.New("no such interface")
+	}
+	c.net.mu.Lock()
+	defer c.net.mu.Unlock()
+	for _, m := range c.net.members {
+		if m == c {
+			continue
+		}
+		for _, ifi := range m.ifaces {
+			if ifi.Name != src.Name {
+				continue
+			}
+			select {
+			case m.in <- packet{b: append([]byte(nil), b...), ifIndex: ifi.Index, from: src.Addr}:
+			case <-m.closed:
+			}
+		}
+	}
+	return nil
+}
+
+func (c *fakeConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+// next reads the next message a responder got, or fails.
+func (c *fakeConn) next(t *testing.T) (*dns.Msg, packet) {
+	t.Helper()
+	select {
+	case p := <-c.in:
+		m := new(dns.Msg)
+		if err := m.Unpack(p.b); err != nil {
+			t.Fatal(err)
+		}
+		return m, p
+	case <-time.After(2 * time.Second):
+		t.Fatal("nothing received")
+		return nil, packet{}
+	}
+}
+
+// agentOn is a Service with conn as its socket.
+func agentOn(conn *fakeConn, id, name string) *Service {
+	s := New(Config{DeviceID: id, Name: name, Version: "1.4.0", Port: 8080,
+		Capabilities: func() string { return "caps-" + id }})
+	s.listen = func() (transport, error) { return conn, nil }
+	s.interfaces = func() ([]iface, error) { return conn.ifaces, nil }
+	return s
+}
+
+func eventually(t *testing.T, what string, ok func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for !ok() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for " + what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// ─── Tests ───────────────────────────────────────────────────────────────────
+
+func TestDiscovery_BothNetworksAndGoodbye(t *testing.T) {
+	n := &fakeNet{}
+	a := agentOn(n.attach("ap", "192.168.4.1", "lan", "192.168.1.20"), "device-a", "strct-kitchen")
+	b := agentOn(n.attach("ap", "192.168.4.7", "lan", "192.168.1.23"), "device-b", "strct-office")
+
+	ctxA, stopA := context.WithCancel(context.Background())
+	defer stopA()
+	ctxB, stopB := context.WithCancel(context.Background())
+	defer stopB()
+	if err := a.Start(ctxA); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Start(ctxB); err != nil {
+		t.Fatal(err)
+	}
+
+	// B answers A's query on each network with its address there.
+	eventually(t, "A to see B on both networks", func() bool {
+		ps := a.Peers()
+		return len(ps) == 1 && len(ps[0].Addresses) == 2
+	})
+	p := a.Peers()[0]
+	if p.DeviceID != "device-b" || p.Name != "strct-office" || p.Port != 8080 || p.Version != "1.4.0" ||
+		p.CapabilitiesHash != "caps-device-b" || p.SameAccount != nil ||
+		strings.Join(p.Addresses, ",") != "192.168.1.23,192.168.4.7" {
+		t.Errorf("peer = %+v", p)
+	}
+	if !p.ExpiresAt.After(p.LastSeen) {
+		t.Errorf("expires %v, last seen %v", p.ExpiresAt, p.LastSeen)
+	}
+	eventually(t, "B to see A", func() bool { return len(b.Peers()) == 1 })
+
+	// B shuts down cleanly and says goodbye.
+	stopB()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := b.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "A to drop B", func() bool { return len(a.Peers()) == 0 })
+}
+
+func TestRespond_AddressOfTheNetworkAsked(t *testing.T) {
+	n := &fakeNet{}
+	a := agentOn(n.attach("ap", "192.168.4.1", "lan", "192.168.1.20"), "device-a", "strct-kitchen")
+	phone := n.attach("lan", "192.168.1.50")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := a.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Skip the announcement and query at start.
+	phone.next(t)
+	phone.next(t)
+
+	q, _ := query()
+	if err := phone.Write(q, 1); err != nil {
+		t.Fatal(err)
+	}
+	var m *dns.Msg
+	for m == nil || !m.Response {
+		m, _ = phone.next(t)
+	}
+	got := sightings(m, net.ParseIP("192.168.1.20"))
+	if len(got) != 1 || got[0].id != "device-a" || got[0].addr.String() != "192.168.1.20" ||
+		got[0].ttl != 120 || got[0].name != "strct-kitchen" {
+		t.Errorf("answer = %+v", got)
+	}
+	for _, rr := range m.Extra {
+		if a, ok := rr.(*dns.A); ok && !a.A.Equal(net.ParseIP("192.168.1.20")) {
+			t.Errorf("A record for the LAN has %v", a.A)
+		}
+	}
+}
+
+// responderAnswer is what a fake responder sends for id.
+func responderAnswer(t *testing.T, id string, ttl uint32) *dns.Msg {
+	t.Helper()
+	b, err := response(advert{id: id, name: "strct-" + id, version: "1.3.2", port: 8080}.
+		records(net.ParseIP("192.168.1.30"), ttl))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestSightings_ExpireAndIgnoreSelf(t *testing.T) {
+	s := New(Config{DeviceID: "device-a"})
+	now := time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+	from := net.ParseIP("192.168.1.30")
+
+	s.handle(nil, responderAnswer(t, "device-a", 120), 1, from)
+	if len(s.Peers()) != 0 {
+		t.Fatal("listed itself")
+	}
+
+	s.handle(nil, responderAnswer(t, "device-c", 120), 1, from)
+	ps := s.Peers()
+	if len(ps) != 1 || ps[0].Addresses[0] != "192.168.1.30" || !ps[0].ExpiresAt.Equal(now.Add(recordTTL)) {
+		t.Fatalf("peers = %+v", ps)
+	}
+
+	// A responder asking for a day is held to maxTTL.
+	s.handle(nil, responderAnswer(t, "device-c", 86400), 1, from)
+	if ps := s.Peers(); !ps[0].ExpiresAt.Equal(now.Add(maxTTL)) {
+		t.Errorf("expires %v", ps[0].ExpiresAt)
+	}
+
+	now = now.Add(maxTTL)
+	if ps := s.Peers(); len(ps) != 0 {
+		t.Errorf("not expired: %+v", ps)
+	}
+}
+
+type fakeBackend struct {
+	asked []string
+	same  []string
+	err   error
+}
+
+func (f *fakeBackend) DevicePath(suffix string) string { return "/device/device-a/" + suffix }
+
+func (f *fakeBackend) Query(_ context.Context, path string, v, out any) error {
+	if path != "/device/device-a/peers" {
+		return errors.New("path " + path)
+	}
+	f.asked = v.(confirmRequest).DeviceIDs
+	if f.err != nil {
+		return f.err
+	}
+	out.(*confirmResponse).SameAccount = f.same
+	return nil
+}
+
+func TestConfirmPeers(t *testing.T) {
+	fb := &fakeBackend{err: &backend.StatusError{Code: http.StatusNotFound}}
+	s := New(Config{DeviceID: "device-a", Backend: fb})
+	from := net.ParseIP("192.168.1.30")
+	s.handle(nil, responderAnswer(t, "device-c", 120), 1, from)
+	s.handle(nil, responderAnswer(t, "device-d", 120), 1, from)
+
+	// A backend that doesn't know the route leaves the flag unknown.
+	if err := s.confirmPeers(context.Background()); !backend.IsNotSupported(err) {
+		t.Fatalf("err = %v", err)
+	}
+	if p := s.Peers()[0]; p.SameAccount != nil {
+		t.Errorf("same_account = %v", *p.SameAccount)
+	}
+
+	fb.err, fb.same = nil, []string{"device-d"}
+	if err := s.confirmPeers(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(fb.asked, ",") != "device-c,device-d" {
+		t.Errorf("asked about %v", fb.asked)
+	}
+	for _, p := range s.Peers() {
+		if p.SameAccount == nil || *p.SameAccount != (p.DeviceID == "device-d") {
+			t.Errorf("%s same_account = %v", p.DeviceID, p.SameAccount)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	s.handlePeers(rec, httptest.NewRequest("GET", "/api/peers", nil))
+	if rec.Code != 200 || !strings.Contains(rec.Body.String(), `"same_account":true`) {
+		t.Errorf("GET /api/peers: %d %s", rec.Code, rec.Body)
+	}
+}
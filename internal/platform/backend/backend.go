@@ -0,0 +1,408 @@
+// Package backend is the agent's client for the strct backend API.
+//
+// Every request is signed with the device secret so the backend can tell a
+// real agent from anyone who knows a device ID, and reports that fail
+// because the box is offline are kept in a bounded queue on disk and
+// retried. Features post through one shared Client instead of each
+// building their own http.Client and retry logic.
+package backend
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/config"
+	"github.com/strct-org/strct-agent/internal/metrics"
+	"github.com/strct-org/strct-agent/internal/resources"
+	"github.com/strct-org/strct-agent/internal/statefile"
+)
+
+// usage accounts report traffic for /api/system/resources.
+var usage = resources.For("backend")
+
+// Signature headers. The signature is
+//
+//	hex(HMAC-SHA256(secret, timestamp + "\n" + method + "\n" + path + "\n" + hex(sha256(body))))
+//
+// A registered device also sends the token registration gave it.
+const (
+	HeaderDevice       = "X-Strct-Device"
+	HeaderTimestamp    = "X-Strct-Timestamp"
+	HeaderSignature    = "X-Strct-Signature"
+	HeaderRegistration = "X-Strct-Registration"
+)
+
+const (
+	defaultMaxQueue = 500
+	flushInterval   = 30 * time.Second
+	maxBackoff      = 10 * time.Minute
+)
+
+// ErrQueued is returned by Post when the backend could not be reached and
+// the report was queued for a later retry. It is informational — callers
+// usually only log it.
+var ErrQueued = errors.New("backend unreachable, report queued")
+
+// StatusError is a non-2xx response the backend gave deliberately.
+type StatusError struct {
+	Path string
+	Code int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("backend: %s returned %d", e.Path, e.Code)
+}
+
+// IsNotSupported reports whether err means the backend doesn't know the
+// endpoint — callers use it to fall back to an older API.
+func IsNotSupported(err error) bool {
+	var se *StatusError
+	return errors.As(err, &se) && (se.Code == http.StatusNotFound || se.Code == http.StatusMethodNotAllowed)
+}
+
+// transient reports whether a failed Send is worth retrying later.
+func transient(err error) bool {
+	var se *StatusError
+	if errors.As(err, &se) {
+		return se.Code >= 500 || se.Code == http.StatusTooManyRequests
+	}
+	return err != nil
+}
+
+type Config struct {
+	BaseURL   string
+	DeviceID  string
+	Secret    string
+	QueuePath string // "" keeps the queue in memory only
+	MaxQueue  int
+
+	// Registration is the token registration gave the device; "" before
+	// it is registered.
+	Registration string
+}
+
+// queued is one report waiting for the backend to come back.
+type queued struct {
+	Path     string          `json:"path"`
+	Body     json.RawMessage `json:"body"`
+	Latest   bool            `json:"latest,omitempty"` // superseded by a newer report to the same path
+	QueuedAt time.Time       `json:"queued_at"`
+}
+
+// persistedQueue is the on-disk shape of the offline queue.
+type persistedQueue struct {
+	Reports []queued `json:"reports"`
+}
+
+// queueSchema versions the offline queue file.
+//
+//	v1: the bare report array moved under "reports"
+var queueSchema = statefile.Schema{
+	Name:       "backend-queue",
+	Migrations: []statefile.Migration{statefile.Wrap("reports")},
+}
+
+type Client struct {
+	cfg      Config
+	serverMu sync.RWMutex // guards cfg.BaseURL, cfg.Secret and cfg.Registration
+	http     *http.Client
+	mu       sync.Mutex
+	queue    []queued
+	now      func() time.Time
+
+	sent    *metrics.Counter
+	failed  *metrics.Counter
+	dropped *metrics.Counter
+}
+
+func New(cfg Config, httpClient *http.Client) *Client {
+	if cfg.MaxQueue <= 0 {
+		cfg.MaxQueue = defaultMaxQueue
+	}
+	if httpClient == nil {
+		httpClient = &http.Client{
+			Timeout: 10 * time.Second,
+			Transport: &http.Transport{
+				MaxIdleConnsPerHost: 2,
+				IdleConnTimeout:     90 * time.Second,
+			},
+		}
+	}
+	c := &Client{
+		cfg:     cfg,
+		http:    httpClient,
+		now:     time.Now,
+		sent:    metrics.NewCounter("strct_backend_requests_total", "Backend requests by result.", "result", "sent"),
+		failed:  metrics.NewCounter("strct_backend_requests_total", "Backend requests by result.", "result", "failed"),
+		dropped: metrics.NewCounter("strct_backend_queue_dropped_total", "Queued reports dropped because the queue was full."),
+	}
+	c.loadQueue()
+	return c
+}
+
+func NewFromConfig(cfg *config.Config) *Client {
+	return New(Config{
+		BaseURL:   cfg.EffectiveBackendURL(),
+		DeviceID:  cfg.DeviceID,
+		Secret:    cfg.Secret(config.SecretAuthToken),
+		QueuePath: filepath.Join(cfg.DataDir, "backend-queue.json"),
+
+		// Stored by an earlier run's registration, if any.
+		Registration: cfg.Secret(config.SecretRegistrationToken),
+	}, nil)
+}
+
+// DevicePath returns the per-device API path for suffix, e.g.
+// DevicePath("connected_devices") → /api/v1/device/agent/<id>/connected_devices.
+func (c *Client) DevicePath(suffix string) string {
+	return fmt.Sprintf("/api/v1/device/agent/%s/%s", c.cfg.DeviceID, suffix)
+}
+
+// SetServer is the backend to talk to from now on and the secret to sign
+// with, as after a config reload. The offline queue goes there too.
+func (c *Client) SetServer(baseURL, secret string) {
+	c.serverMu.Lock()
+	c.cfg.BaseURL, c.cfg.Secret = baseURL, secret
+	c.serverMu.Unlock()
+}
+
+// SetRegistration is the token to send from now on, as registration
+// returns it.
+func (c *Client) SetRegistration(token string) {
+	c.serverMu.Lock()
+	c.cfg.Registration = token
+	c.serverMu.Unlock()
+}
+
+// Registered reports whether the client has a registration token.
+func (c *Client) Registered() bool {
+	c.serverMu.RLock()
+	defer c.serverMu.RUnlock()
+	return c.cfg.Registration != ""
+}
+
+// Start flushes the offline queue in the background until ctx is done.
+func (c *Client) Start(ctx context.Context) error {
+	usage.Go(func() {
+		backoff := flushInterval
+		timer := time.NewTimer(backoff)
+		defer timer.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-timer.C:
+				if c.flush(ctx) {
+					backoff = flushInterval
+				} else {
+					backoff = min(backoff*2, maxBackoff)
+				}
+				timer.Reset(backoff)
+			}
+		}
+	})
+	return nil
+}
+
+// Send makes one signed POST attempt with no queueing.
+func (c *Client) Send(ctx context.Context, path string, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("backend: marshal %s: %w", path, err)
+	}
+	return c.send(ctx, path, body)
+}
+
+// Query makes one signed POST, like Send, and decodes the JSON answer
+// into out. It is for questions only the backend can answer; nothing is
+// queued.
+func (c *Client) Query(ctx context.Context, path string, v, out any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("backend: marshal %s: %w", path, err)
+	}
+	return c.do(ctx, path, body, out)
+}
+
+// Post sends v and, if the backend is unreachable, queues it and returns
+// ErrQueued. Rejections (4xx) are returned as *StatusError and not queued.
+func (c *Client) Post(ctx context.Context, path string, v any) error {
+	return c.post(ctx, path, v, false)
+}
+
+// PostLatest is Post for snapshot-style reports where only the newest one
+// matters: a queued report to the same path is replaced, not appended.
+func (c *Client) PostLatest(ctx context.Context, path string, v any) error {
+	return c.post(ctx, path, v, true)
+}
+
+// QueueLen returns the number of reports waiting to be retried.
+func (c *Client) QueueLen() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.queue)
+}
+
+func (c *Client) post(ctx context.Context, path string, v any, latest bool) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("backend: marshal %s: %w", path, err)
+	}
+	err = c.send(ctx, path, body)
+	if err == nil || !transient(err) {
+		return err
+	}
+	c.enqueue(queued{Path: path, Body: body, Latest: latest, QueuedAt: c.now()})
+	return fmt.Errorf("%w: %v", ErrQueued, err)
+}
+
+func (c *Client) send(ctx context.Context, path string, body []byte) error {
+	return c.do(ctx, path, body, nil)
+}
+
+// do POSTs body and decodes the answer into out, or drains it if out is
+// nil.
+func (c *Client) do(ctx context.Context, path string, body []byte, out any) error {
+	c.serverMu.RLock()
+	baseURL, secret, registration := c.cfg.BaseURL, c.cfg.Secret, c.cfg.Registration
+	c.serverMu.RUnlock()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("backend: build request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	c.sign(req, path, body, secret)
+	if registration != "" {
+		req.Header.Set(HeaderRegistration, registration)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		c.failed.Inc()
+		return fmt.Errorf("backend: %s: %w", path, err)
+	}
+	defer resp.Body.Close()
+	usage.AddWritten(int64(len(body)))
+	if resp.StatusCode >= 300 || out == nil {
+		// Drain body so the connection is returned to the pool immediately.
+		io.Copy(io.Discard, usage.Reader(resp.Body)) //nolint:errcheck
+	}
+
+	if resp.StatusCode >= 300 {
+		c.failed.Inc()
+		return &StatusError{Path: path, Code: resp.StatusCode}
+	}
+	c.sent.Inc()
+	if out != nil {
+		if err := json.NewDecoder(usage.Reader(resp.Body)).Decode(out); err != nil {
+			return fmt.Errorf("backend: %s: decode answer: %w", path, err)
+		}
+	}
+	return nil
+}
+
+func (c *Client) sign(req *http.Request, path string, body []byte, secret string) {
+	ts := strconv.FormatInt(c.now().Unix(), 10)
+	sum := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s", ts, req.Method, path, hex.EncodeToString(sum[:]))
+
+	req.Header.Set(HeaderDevice, c.cfg.DeviceID)
+	req.Header.Set(HeaderTimestamp, ts)
+	req.Header.Set(HeaderSignature, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// ─── Offline queue ───────────────────────────────────────────────────────────
+
+func (c *Client) enqueue(q queued) {
+	c.mu.Lock()
+	if q.Latest {
+		kept := c.queue[:0]
+		for _, e := range c.queue {
+			if !(e.Latest && e.Path == q.Path) {
+				kept = append(kept, e)
+			}
+		}
+		c.queue = kept
+	}
+	c.queue = append(c.queue, q)
+	if over := len(c.queue) - c.cfg.MaxQueue; over > 0 {
+		c.queue = c.queue[over:]
+		c.dropped.Add(uint64(over))
+	}
+	c.mu.Unlock()
+	c.saveQueue()
+}
+
+// flush retries queued reports oldest first and stops at the first
+// transient failure. It reports whether the queue is now empty.
+func (c *Client) flush(ctx context.Context) bool {
+	defer usage.Time()()
+	for {
+		c.mu.Lock()
+		if len(c.queue) == 0 {
+			c.mu.Unlock()
+			return true
+		}
+		head := c.queue[0]
+		c.mu.Unlock()
+
+		err := c.send(ctx, head.Path, head.Body)
+		if err != nil && transient(err) {
+			return false
+		}
+		if err != nil {
+			slog.Warn("backend: queued report rejected, dropping", "path", head.Path, "err", err)
+		}
+
+		c.mu.Lock()
+		if len(c.queue) > 0 && c.queue[0].QueuedAt.Equal(head.QueuedAt) && c.queue[0].Path == head.Path {
+			c.queue = c.queue[1:]
+		}
+		c.mu.Unlock()
+		c.saveQueue()
+	}
+}
+
+func (c *Client) loadQueue() {
+	if c.cfg.QueuePath == "" {
+		return
+	}
+	var pq persistedQueue
+	if err := statefile.Load(c.cfg.QueuePath, queueSchema, &pq); err != nil {
+		if !statefile.Fresh(err) {
+			slog.Warn("backend: could not restore offline queue", "err", err)
+		}
+		return
+	}
+	q := pq.Reports
+	c.queue = q
+	if len(q) > 0 {
+		slog.Info("backend: offline queue restored", "reports", len(q))
+	}
+}
+
+func (c *Client) saveQueue() {
+	if c.cfg.QueuePath == "" {
+		return
+	}
+	c.mu.Lock()
+	q := append([]queued(nil), c.queue...)
+	c.mu.Unlock()
+	if err := statefile.Save(c.cfg.QueuePath, queueSchema, persistedQueue{Reports: q}); err != nil {
+		slog.Warn("backend: could not persist offline queue", "err", err)
+	}
+}
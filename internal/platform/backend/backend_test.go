@@ -0,0 +1,212 @@
+package backend
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSend_SignsRequest(t *testing.T) {
+	var gotErr atomic.Value
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		sum := sha256.Sum256(body)
+		mac := hmac.New(sha256.New, []byte("s3cret"))
+		fmt.Fprintf(mac, "%s\n%s\n%s\n%s", r.Header.Get(HeaderTimestamp), r.Method, r.URL.Path, hex.EncodeToString(sum[:]))
+		if r.Header.Get(HeaderDevice) != "dev-1" {
+			gotErr.Store("missing device header")
+		}
+		if !hmac.Equal([]byte(hex.EncodeToString(mac.Sum(nil))), []byte(r.Header.Get(HeaderSignature))) {
+			gotErr.Store("signature mismatch")
+		}
+	}))
+	defer srv.Close()
+
+	c := New(Config{BaseURL: srv.URL, DeviceID: "dev-1", Secret: "s3cret"}, srv.Client())
+	if err := c.Send(context.Background(), c.DevicePath("x"), map[string]int{"a": 1}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if msg := gotErr.Load(); msg != nil {
+		t.Fatal(msg)
+	}
+}
+
+func TestQuery_DecodesAnswer(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/gone" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"same_account":["dev-2"]}`))
+	}))
+	defer srv.Close()
+
+	c := New(Config{BaseURL: srv.URL, DeviceID: "dev-1", Secret: "s3cret"}, srv.Client())
+	var out struct {
+		SameAccount []string `json:"same_account"`
+	}
+	if err := c.Query(context.Background(), "/peers", map[string]any{"device_ids": []string{"dev-2"}}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if len(out.SameAccount) != 1 || out.SameAccount[0] != "dev-2" {
+		t.Errorf("answer = %+v", out)
+	}
+	if err := c.Query(context.Background(), "/gone", nil, &out); !IsNotSupported(err) || c.QueueLen() != 0 {
+		t.Errorf("404: %v, %d queued", err, c.QueueLen())
+	}
+}
+
+func TestPost_QueuesOnlyTransientFailures(t *testing.T) {
+	var code atomic.Int32
+	code.Store(http.StatusServiceUnavailable)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(code.Load()))
+	}))
+	defer srv.Close()
+
+	queuePath := filepath.Join(t.TempDir(), "queue.json")
+	c := New(Config{BaseURL: srv.URL, QueuePath: queuePath}, srv.Client())
+
+	if err := c.Post(context.Background(), "/a", 1); !errors.Is(err, ErrQueued) {
+		t.Fatalf("503: expected ErrQueued, got %v", err)
+	}
+	code.Store(http.StatusBadRequest)
+	if err := c.Post(context.Background(), "/b", 1); errors.Is(err, ErrQueued) || err == nil {
+		t.Fatalf("400: expected a non-queued error, got %v", err)
+	}
+	if n := c.QueueLen(); n != 1 {
+		t.Fatalf("queue length = %d, want 1", n)
+	}
+
+	// Queue survives a restart and drains once the backend is back.
+	restarted := New(Config{BaseURL: srv.URL, QueuePath: queuePath}, srv.Client())
+	if n := restarted.QueueLen(); n != 1 {
+		t.Fatalf("restored queue length = %d, want 1", n)
+	}
+	code.Store(http.StatusOK)
+	if !restarted.flush(context.Background()) || restarted.QueueLen() != 0 {
+		t.Fatalf("flush should drain the queue, %d left", restarted.QueueLen())
+	}
+}
+
+func TestLoadQueue_MigratesLegacyArray(t *testing.T) {
+	queuePath := filepath.Join(t.TempDir(), "queue.json")
+	// Before versioning the queue was a bare array of reports.
+	legacy := `[{"path":"/a","body":{"n":1},"queued_at":"2026-03-01T10:00:00Z"}]`
+	if err := os.WriteFile(queuePath, []byte(legacy), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	c := New(Config{BaseURL: "http://127.0.0.1:0", QueuePath: queuePath}, nil)
+	if n := c.QueueLen(); n != 1 {
+		t.Fatalf("restored queue length = %d, want 1", n)
+	}
+	if c.queue[0].Path != "/a" || string(c.queue[0].Body) != `{"n":1}` {
+		t.Errorf("restored report = %+v", c.queue[0])
+	}
+}
+
+func TestPostLatest_ReplacesQueuedSnapshot(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	c := New(Config{BaseURL: srv.URL, MaxQueue: 3}, srv.Client())
+	for i := 0; i < 5; i++ {
+		c.PostLatest(context.Background(), "/snapshot", i) //nolint:errcheck
+	}
+	if n := c.QueueLen(); n != 1 {
+		t.Fatalf("queue length = %d, want 1", n)
+	}
+	if got := string(c.queue[0].Body); got != "4" {
+		t.Errorf("queued body = %s, want newest (4)", got)
+	}
+
+	for i := 0; i < 5; i++ {
+		c.Post(context.Background(), "/event", i) //nolint:errcheck
+	}
+	if n := c.QueueLen(); n != 3 {
+		t.Errorf("queue length = %d, want MaxQueue (3)", n)
+	}
+}
+
+func TestRegistrar_RetriesUntilRegistered(t *testing.T) {
+	var attempts atomic.Int32
+	var token atomic.Value
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != RegisterPath {
+			token.Store(r.Header.Get(HeaderRegistration))
+			return
+		}
+		var req RegisterRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.DeviceID != "dev-1" || req.AgentVersion != "1.2.0" || req.Hardware.Fingerprint != "ab12" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if attempts.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"registration_token":"reg-1"}`))
+	}))
+	defer srv.Close()
+
+	c := New(Config{BaseURL: srv.URL, DeviceID: "dev-1", Secret: "s3cret"}, srv.Client())
+	saved := make(chan string, 1)
+	r := NewRegistrar(c, RegisterRequest{DeviceID: "dev-1", AgentVersion: "1.2.0", Hardware: Hardware{Arch: "arm64", Fingerprint: "ab12"}},
+		func(tok string) error { saved <- tok; return nil })
+	r.retry = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r.Start(ctx)
+
+	select {
+	case tok := <-saved:
+		if tok != "reg-1" {
+			t.Errorf("saved %q", tok)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("not registered: %+v", r.Status())
+	}
+	r.Stop(context.Background())
+	if s := r.Status(); !s.Registered || s.Attempts != 3 || s.LastError != "" {
+		t.Errorf("status %+v", s)
+	}
+	if err := c.Send(ctx, c.DevicePath("x"), 1); err != nil || token.Load() != "reg-1" {
+		t.Errorf("report after registering: %v, token %v", err, token.Load())
+	}
+
+	// Registered by an earlier run: nothing is sent.
+	attempts.Store(0)
+	again := NewRegistrar(c, RegisterRequest{DeviceID: "dev-1"}, nil)
+	again.Start(ctx)
+	again.Stop(context.Background())
+	if !again.Status().Registered || attempts.Load() != 0 {
+		t.Errorf("registered again: %+v", again.Status())
+	}
+}
+
+func TestRegistrar_GivesUpOnAnOldBackend(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+	r := NewRegistrar(New(Config{BaseURL: srv.URL}, srv.Client()), RegisterRequest{}, nil)
+	r.Start(context.Background())
+	r.Stop(context.Background())
+	if s := r.Status(); s.Registered || !s.Unsupported || s.Attempts != 1 {
+		t.Errorf("status %+v", s)
+	}
+}
@@ -0,0 +1,194 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/config"
+)
+
+// ─── Registration ────────────────────────────────────────────────────────────
+
+// RegisterPath is where a device announces itself, once: its ID, the
+// agent version and the hardware the ID is tied to (see
+// config.Identity). The backend answers with a registration token, which
+// the client sends with every request from then on and which is kept in
+// the secrets store across restarts.
+const RegisterPath = "/api/v1/device/agent/register"
+
+// registerRetry is the first wait after a failed registration; it
+// doubles up to maxBackoff.
+const registerRetry = 30 * time.Second
+
+// RegisterRequest is a registration's body.
+type RegisterRequest struct {
+	DeviceID     string   `json:"device_id"`
+	AgentVersion string   `json:"agent_version"`
+	Hardware     Hardware `json:"hardware"`
+	// PreviousID is the ID the card had on other hardware, for the
+	// backend to carry its history over.
+	PreviousID string `json:"previous_id,omitempty"`
+}
+
+// Hardware is what the device runs on. The hardware ID itself is never
+// sent, only its fingerprint.
+type Hardware struct {
+	Model       string `json:"model,omitempty"`
+	Arch        string `json:"arch"`
+	IDSource    string `json:"id_source,omitempty"` // cpu_serial or eth0_mac
+	Fingerprint string `json:"fingerprint,omitempty"`
+}
+
+type registerAnswer struct {
+	Token string `json:"registration_token"`
+}
+
+// RegistrationStatus is how registration went, for
+// GET /api/agent/identity.
+type RegistrationStatus struct {
+	Registered bool `json:"registered"`
+	// Attempts, LastError and NextAttempt are this run's.
+	Attempts    int       `json:"attempts"`
+	LastError   string    `json:"last_error,omitempty"`
+	NextAttempt time.Time `json:"next_attempt,omitzero"`
+	// Unsupported is a backend with no registration endpoint. The
+	// agent asks again at its next start.
+	Unsupported bool `json:"unsupported,omitempty"`
+}
+
+// Registrar registers the device with the backend on first boot,
+// retrying with backoff until it is.
+type Registrar struct {
+	client *Client
+	req    RegisterRequest
+	save   func(token string) error // keeps the token for the next start
+	retry  time.Duration
+
+	mu     sync.Mutex
+	status RegistrationStatus
+	loop   sync.WaitGroup
+}
+
+func NewRegistrar(c *Client, req RegisterRequest, save func(token string) error) *Registrar {
+	return &Registrar{client: c, req: req, save: save, retry: registerRetry}
+}
+
+// NewRegistrarFromConfig registers cfg's identity with the agent's
+// version and keeps the token in cfg's secrets store.
+func NewRegistrarFromConfig(cfg *config.Config, version string, c *Client) *Registrar {
+	id := cfg.Identity
+	return NewRegistrar(c, RegisterRequest{
+		DeviceID:     cfg.DeviceID,
+		AgentVersion: version,
+		Hardware: Hardware{
+			Model:       id.Model,
+			Arch:        runtime.GOARCH,
+			IDSource:    id.Hardware,
+			Fingerprint: id.Fingerprint,
+		},
+		PreviousID: id.PreviousID,
+	}, func(token string) error {
+		return cfg.SaveSecret(config.SecretRegistrationToken, token)
+	})
+}
+
+func (r *Registrar) Name() string { return "registration" }
+
+// Start registers in the background, unless an earlier run did, until
+// the backend answers or ctx is done.
+func (r *Registrar) Start(ctx context.Context) error {
+	if r.client.Registered() {
+		r.mu.Lock()
+		r.status.Registered = true
+		r.mu.Unlock()
+		return nil
+	}
+	r.loop.Add(1)
+	usage.Go(func() {
+		defer r.loop.Done()
+		r.run(ctx)
+	})
+	return nil
+}
+
+// Stop waits for the retries Start began to end.
+func (r *Registrar) Stop(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		r.loop.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Status returns how registration went.
+func (r *Registrar) Status() RegistrationStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.status
+}
+
+func (r *Registrar) run(ctx context.Context) {
+	backoff := r.retry
+	for {
+		err := r.register(ctx)
+		if err == nil || ctx.Err() != nil {
+			return
+		}
+		r.mu.Lock()
+		r.status.LastError = err.Error()
+		if IsNotSupported(err) {
+			r.status.Unsupported = true
+			r.mu.Unlock()
+			slog.Info("backend: no registration endpoint, reporting unregistered", "err", err)
+			return
+		}
+		r.status.NextAttempt = time.Now().Add(backoff)
+		r.mu.Unlock()
+		slog.Warn("backend: registration failed, retrying", "err", err, "in", backoff)
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+// register makes one attempt.
+func (r *Registrar) register(ctx context.Context) error {
+	r.mu.Lock()
+	r.status.Attempts++
+	r.mu.Unlock()
+
+	var answer registerAnswer
+	if err := r.client.Query(ctx, RegisterPath, r.req, &answer); err != nil {
+		return err
+	}
+	if answer.Token == "" {
+		return errors.New("backend: registration answered with no token")
+	}
+	r.client.SetRegistration(answer.Token)
+	if err := r.save(answer.Token); err != nil {
+		// Registered for this run; the next start registers again.
+		slog.Warn("backend: registration token not saved", "err", err)
+	}
+
+	r.mu.Lock()
+	r.status = RegistrationStatus{Registered: true, Attempts: r.status.Attempts}
+	r.mu.Unlock()
+	slog.Info("backend: device registered", "device_id", r.req.DeviceID, "previous_id", r.req.PreviousID)
+	return nil
+}
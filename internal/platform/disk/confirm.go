@@ -0,0 +1,64 @@
+package disk
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrInvalidToken means a confirm token is unknown, expired, already used,
+// or was issued for a different device.
+var ErrInvalidToken = errors.New("invalid or expired confirm token")
+
+// ConfirmTokens issues short-lived, single-use tokens that authorize one
+// destructive action (formatting) on one device. The UI must fetch a token
+// for the exact device the user picked and send it back, so a stale page
+// or a mistyped path can't wipe the wrong drive.
+type ConfirmTokens struct {
+	mu     sync.Mutex
+	ttl    time.Duration
+	now    func() time.Time
+	tokens map[string]confirmToken
+}
+
+type confirmToken struct {
+	device  string
+	expires time.Time
+}
+
+func NewConfirmTokens(ttl time.Duration) *ConfirmTokens {
+	return &ConfirmTokens{ttl: ttl, now: time.Now, tokens: make(map[string]confirmToken)}
+}
+
+// Issue returns a new token for device and when it expires.
+func (c *ConfirmTokens) Issue(device string) (string, time.Time) {
+	b := make([]byte, 16)
+	rand.Read(b) //nolint:errcheck — crypto/rand never fails on Linux
+	token := hex.EncodeToString(b)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	for t, e := range c.tokens {
+		if now.After(e.expires) {
+			delete(c.tokens, t)
+		}
+	}
+	expires := now.Add(c.ttl)
+	c.tokens[token] = confirmToken{device: device, expires: expires}
+	return token, expires
+}
+
+// Consume validates token for device and invalidates it.
+func (c *ConfirmTokens) Consume(device, token string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.tokens[token]
+	if !ok || e.device != device || c.now().After(e.expires) {
+		return ErrInvalidToken
+	}
+	delete(c.tokens, token)
+	return nil
+}
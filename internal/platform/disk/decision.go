@@ -0,0 +1,44 @@
+package disk
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/statefile"
+)
+
+// decisionSchema versions storage.json.
+//
+//	v1: Decision as-is
+var decisionSchema = statefile.Schema{
+	Name:       "storage-decision",
+	Migrations: []statefile.Migration{statefile.Stamp},
+}
+
+// Decision is the storage choice made during setup. Once saved, later
+// boots use it instead of auto-detecting (and never prompt again).
+type Decision struct {
+	Device    string    `json:"device,omitempty"` // /dev/sda; empty with UseSDCard
+	UseSDCard bool      `json:"use_sd_card"`
+	Formatted bool      `json:"formatted"` // the setup flow formatted Device
+	DecidedAt time.Time `json:"decided_at"`
+}
+
+// LoadDecision returns the saved decision, or nil if none was made yet.
+func LoadDecision(path string) (*Decision, error) {
+	var d Decision
+	if err := statefile.Load(path, decisionSchema, &d); err != nil {
+		if statefile.Fresh(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("load storage decision: %w", err)
+	}
+	return &d, nil
+}
+
+func SaveDecision(path string, d Decision) error {
+	if err := statefile.Save(path, decisionSchema, d); err != nil {
+		return fmt.Errorf("save storage decision: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package disk
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Detect reports why the real Manager can't run on this machine, or nil
+// if it can: it needs lsblk, and a disk besides the one the system runs
+// from. Like wifi.Detect it looks at the machine, not its architecture.
+func Detect(lookPath func(file string) (string, error), listDrives func() ([]Drive, error)) error {
+	if _, err := lookPath("lsblk"); err != nil {
+		return fmt.Errorf("lsblk not found: %w", err)
+	}
+	drives, err := listDrives()
+	if err != nil {
+		return err
+	}
+	for _, d := range drives {
+		if !d.System {
+			return nil
+		}
+	}
+	return errors.New("no drive besides the system disk")
+}
+
+// DataDrives returns the paths of the drives that could hold the data:
+// all but the system disk, which on an x86 box is as likely to be
+// /dev/sda or /dev/nvme0n1 as a data drive is.
+func DataDrives(drives []Drive) []string {
+	var paths []string
+	for _, d := range drives {
+		if !d.System {
+			paths = append(paths, d.Path)
+		}
+	}
+	return paths
+}
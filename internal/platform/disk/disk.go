@@ -7,7 +7,6 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
-	"runtime"
 	"strings"
 )
 
@@ -17,8 +16,10 @@ type Manager interface {
 	EnsureMounted(mountPoint string) error
 }
 
-func New(devMode bool) Manager {
-	if devMode {
+// New returns the real Manager when realHardware is set and Detect finds
+// what it needs, and a mock otherwise.
+func New(realHardware bool) Manager {
+	if !realHardware {
 		slog.Info("disk: Factory: Returning MOCK Disk Manager")
 		return &MockDisk{
 			VirtualPath: "VIRTUAL_NVME",
@@ -26,23 +27,23 @@ func New(devMode bool) Manager {
 		}
 	}
 
-	if runtime.GOOS == "linux" {
-		path, err := detectDevicePath()
-		if err != nil {
-			slog.Error("disk: Auto-detect failed, defaulting to /dev/sda", "err", err)
-			path = "/dev/sda"
+	if err := Detect(exec.LookPath, ListDrives); err != nil {
+		slog.Warn("disk: no usable data drive, using the mock", "err", err)
+		return &MockDisk{
+			VirtualPath: "VIRTUAL_NVME",
+			IsFormatted: false,
 		}
+	}
 
-		slog.Info("disk: Factory: Returning REAL Disk Manager", "path", path)
-		return &RealDisk{
-			DevicePath: path,
-		}
+	path, err := detectDevicePath()
+	if err != nil {
+		slog.Error("disk: Auto-detect failed, defaulting to /dev/sda", "err", err)
+		path = "/dev/sda"
 	}
 
-	slog.Info("disk: Factory: OS is not Linux, defaulting to MOCK")
-	return &MockDisk{
-		VirtualPath: "VIRTUAL_NVME",
-		IsFormatted: false,
+	slog.Info("disk: Factory: Returning REAL Disk Manager", "path", path)
+	return &RealDisk{
+		DevicePath: path,
 	}
 }
 
@@ -12,3 +12,25 @@ func GetFreeDiskSpace(path string) (uint64, error) {
 	// Available blocks * Block size
 	return stat.Bavail * uint64(stat.Bsize), nil
 }
+
+// GetTotalDiskSpace returns the size of the filesystem holding path.
+func GetTotalDiskSpace(path string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return stat.Blocks * uint64(stat.Bsize), nil
+}
+
+// SameDevice reports whether a and b are on the same filesystem, by
+// st_dev: an SD-card DataDir and / are.
+func SameDevice(a, b string) (bool, error) {
+	var sa, sb syscall.Stat_t
+	if err := syscall.Stat(a, &sa); err != nil {
+		return false, err
+	}
+	if err := syscall.Stat(b, &sb); err != nil {
+		return false, err
+	}
+	return sa.Dev == sb.Dev, nil
+}
@@ -33,3 +33,11 @@ func GetFreeDiskSpace(path string) (uint64, error) {
 	// return uint64(freeBytesAvailable), nil
 	return 0, fmt.Errorf("not implemented on windows: %w", err)
 }
+
+func GetTotalDiskSpace(path string) (uint64, error) {
+	return 0, fmt.Errorf("not implemented on windows")
+}
+
+func SameDevice(a, b string) (bool, error) {
+	return false, fmt.Errorf("not implemented on windows")
+}
@@ -0,0 +1,170 @@
+package disk
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/strct-org/strct-agent/internal/humanize"
+)
+
+// Drive is one whole-disk block device the user could pick as the data
+// drive during setup.
+type Drive struct {
+	Path      string    `json:"path"` // /dev/sda, /dev/nvme0n1
+	Model     string    `json:"model,omitempty"`
+	SizeBytes uint64    `json:"size_bytes"`
+	Size      string    `json:"size"`
+	Formatted bool      `json:"formatted"`
+	FSType    string    `json:"fstype,omitempty"`
+	System    bool      `json:"system"` // holds the root filesystem (the SD card)
+	Partition string    `json:"partition,omitempty"`
+	Mount     string    `json:"mountpoint,omitempty"`
+	Contents  *Contents `json:"contents,omitempty"`
+}
+
+// Contents is a quick look at what is already on a formatted drive, so
+// the user doesn't pick a drive without knowing it holds their photos.
+type Contents struct {
+	Entries   int      `json:"entries"`    // top-level files and folders
+	UsedBytes uint64   `json:"used_bytes"` // filesystem usage, not a tree walk
+	Sample    []string `json:"sample"`     // first few top-level names
+}
+
+// lsblkSize accepts SIZE both as a JSON number (util-linux ≥ 2.33 with -b)
+// and as a quoted string (older releases).
+type lsblkSize uint64
+
+func (s *lsblkSize) UnmarshalJSON(b []byte) error {
+	raw := strings.Trim(string(b), `"`)
+	if raw == "" || raw == "null" {
+		*s = 0
+		return nil
+	}
+	v, err := strconv.ParseUint(raw, 10, 64)
+	if err != nil {
+		return fmt.Errorf("lsblk size %q: %w", raw, err)
+	}
+	*s = lsblkSize(v)
+	return nil
+}
+
+type lsblkDriveOutput struct {
+	Blockdevices []lsblkDrive `json:"blockdevices"`
+}
+
+type lsblkDrive struct {
+	Name       string       `json:"name"`
+	Size       lsblkSize    `json:"size"`
+	Type       string       `json:"type"`
+	Mountpoint string       `json:"mountpoint"`
+	FSType     string       `json:"fstype"`
+	Model      string       `json:"model"`
+	Children   []lsblkDrive `json:"children,omitempty"`
+}
+
+// ListDrives returns every disk attached to the board, system disk
+// included (flagged) so the UI can offer "keep using the SD card".
+func ListDrives() ([]Drive, error) {
+	out, err := exec.Command("lsblk", "-J", "-b", "-o", "NAME,SIZE,TYPE,MOUNTPOINT,FSTYPE,MODEL").Output()
+	if err != nil {
+		return nil, fmt.Errorf("lsblk: %w", err)
+	}
+	return ParseDrives(out)
+}
+
+// ParseDrives turns `lsblk -J -b -o NAME,SIZE,TYPE,MOUNTPOINT,FSTYPE,MODEL`
+// output into drives. Loop devices, optical drives and zram are skipped.
+func ParseDrives(out []byte) ([]Drive, error) {
+	var data lsblkDriveOutput
+	if err := json.Unmarshal(out, &data); err != nil {
+		return nil, fmt.Errorf("failed to parse lsblk output: %w", err)
+	}
+
+	var drives []Drive
+	for _, dev := range data.Blockdevices {
+		if dev.Type != "disk" || strings.HasPrefix(dev.Name, "zram") {
+			continue
+		}
+		d := Drive{
+			Path:      "/dev/" + dev.Name,
+			Model:     strings.TrimSpace(dev.Model),
+			SizeBytes: uint64(dev.Size),
+			Size:      humanize.Bytes(int64(dev.Size)),
+			FSType:    dev.FSType,
+			Mount:     dev.Mountpoint,
+			Formatted: dev.FSType != "",
+			System:    dev.Mountpoint == "/",
+		}
+		if d.Formatted {
+			d.Partition = d.Path // filesystem on the bare disk, no partition table
+		}
+		for _, child := range dev.Children {
+			if child.Mountpoint == "/" || child.Mountpoint == "/boot" {
+				d.System = true
+			}
+			// The first partition with a filesystem is the one we'd mount.
+			if child.FSType != "" && (d.Partition == "" || d.Partition == d.Path) {
+				d.Formatted = true
+				d.FSType = child.FSType
+				d.Partition = "/dev/" + child.Name
+				d.Mount = child.Mountpoint
+			}
+		}
+		drives = append(drives, d)
+	}
+	sort.Slice(drives, func(i, j int) bool { return drives[i].Path < drives[j].Path })
+	return drives, nil
+}
+
+// SummarizeContents lists the top level of a mounted filesystem.
+func SummarizeContents(dir string, sample int) (*Contents, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	c := &Contents{Sample: []string{}}
+	for _, e := range entries {
+		if e.Name() == "lost+found" {
+			continue
+		}
+		c.Entries++
+		if len(c.Sample) < sample {
+			c.Sample = append(c.Sample, e.Name())
+		}
+	}
+	if total, err := GetTotalDiskSpace(dir); err == nil {
+		if free, err := GetFreeDiskSpace(dir); err == nil && total >= free {
+			c.UsedBytes = total - free
+		}
+	}
+	return c, nil
+}
+
+// PeekContents mounts d's partition read-only in a temp dir just long
+// enough to summarize it. Already-mounted drives are read in place.
+func PeekContents(d Drive) (*Contents, error) {
+	if !d.Formatted || d.Partition == "" {
+		return nil, nil
+	}
+	if d.Mount != "" {
+		return SummarizeContents(d.Mount, 5)
+	}
+
+	tmp, err := os.MkdirTemp("", "strct-peek-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp)
+
+	if err := exec.Command("mount", "-o", "ro", d.Partition, tmp).Run(); err != nil {
+		return nil, fmt.Errorf("mount %s read-only: %w", d.Partition, err)
+	}
+	defer exec.Command("umount", tmp).Run() //nolint:errcheck
+
+	return SummarizeContents(tmp, 5)
+}
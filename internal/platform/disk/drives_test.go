@@ -0,0 +1,113 @@
+package disk
+
+import (
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseDrives(t *testing.T) {
+	out := []byte(`{"blockdevices":[
+		{"name":"loop0","size":"4096","type":"loop","mountpoint":null,"fstype":null,"model":null},
+		{"name":"mmcblk0","size":31914983424,"type":"disk","mountpoint":null,"fstype":null,"model":null,
+		 "children":[
+			{"name":"mmcblk0p1","size":268435456,"type":"part","mountpoint":"/boot","fstype":"vfat","model":null},
+			{"name":"mmcblk0p2","size":31646547968,"type":"part","mountpoint":"/","fstype":"ext4","model":null}]},
+		{"name":"sda","size":"1000204886016","type":"disk","mountpoint":null,"fstype":null,"model":"Samsung SSD 870 ",
+		 "children":[{"name":"sda1","size":"1000203837440","type":"part","mountpoint":null,"fstype":"exfat","model":null}]},
+		{"name":"nvme0n1","size":512110190592,"type":"disk","mountpoint":null,"fstype":null,"model":"WD Blue SN570"},
+		{"name":"zram0","size":1073741824,"type":"disk","mountpoint":"[SWAP]","fstype":null,"model":null}
+	]}`)
+
+	drives, err := ParseDrives(out)
+	if err != nil {
+		t.Fatalf("ParseDrives: %v", err)
+	}
+	if len(drives) != 3 {
+		t.Fatalf("expected 3 drives, got %d: %+v", len(drives), drives)
+	}
+
+	tests := []struct {
+		path      string
+		system    bool
+		formatted bool
+		partition string
+		model     string
+	}{
+		{"/dev/mmcblk0", true, true, "/dev/mmcblk0p1", ""},
+		{"/dev/nvme0n1", false, false, "", "WD Blue SN570"},
+		{"/dev/sda", false, true, "/dev/sda1", "Samsung SSD 870"},
+	}
+	for i, tt := range tests {
+		d := drives[i]
+		if d.Path != tt.path || d.System != tt.system || d.Formatted != tt.formatted ||
+			d.Partition != tt.partition || d.Model != tt.model {
+			t.Errorf("drive %d = %+v, want %+v", i, d, tt)
+		}
+	}
+	if drives[2].SizeBytes != 1000204886016 {
+		t.Errorf("string size not parsed: %d", drives[2].SizeBytes)
+	}
+}
+
+func TestDetect(t *testing.T) {
+	const (
+		orangePi = `{"blockdevices":[
+			{"name":"mmcblk0","size":31914983424,"type":"disk","mountpoint":null,"fstype":null,"model":null,
+			 "children":[{"name":"mmcblk0p2","size":31646547968,"type":"part","mountpoint":"/","fstype":"ext4","model":null}]},
+			{"name":"nvme0n1","size":512110190592,"type":"disk","mountpoint":null,"fstype":null,"model":"WD Blue SN570"}]}`
+		// An x86 mini-PC boots from its NVMe drive, EFI partition first.
+		miniPC = `{"blockdevices":[
+			{"name":"nvme0n1","size":256060514304,"type":"disk","mountpoint":null,"fstype":null,"model":"KINGSTON OM8PDP3256B",
+			 "children":[
+				{"name":"nvme0n1p1","size":536870912,"type":"part","mountpoint":"/boot/efi","fstype":"vfat","model":null},
+				{"name":"nvme0n1p2","size":255522242560,"type":"part","mountpoint":"/","fstype":"ext4","model":null}]}]}`
+		miniPCWithUSB = `{"blockdevices":[
+			{"name":"nvme0n1","size":256060514304,"type":"disk","mountpoint":null,"fstype":null,"model":"KINGSTON OM8PDP3256B",
+			 "children":[{"name":"nvme0n1p2","size":255522242560,"type":"part","mountpoint":"/","fstype":"ext4","model":null}]},
+			{"name":"sda","size":"2000398934016","type":"disk","mountpoint":null,"fstype":null,"model":"Expansion HDD",
+			 "children":[{"name":"sda1","size":"2000397868544","type":"part","mountpoint":null,"fstype":"ext4","model":null}]}]}`
+	)
+	lookPath := func(have bool) func(string) (string, error) {
+		return func(file string) (string, error) {
+			if !have {
+				return "", exec.ErrNotFound
+			}
+			return "/usr/bin/" + file, nil
+		}
+	}
+
+	tests := []struct {
+		name    string
+		lsblk   bool
+		out     string
+		data    []string
+		wantErr string
+	}{
+		{"orange pi with SSD", true, orangePi, []string{"/dev/nvme0n1"}, ""},
+		{"mini-PC, system disk only", true, miniPC, nil, "no drive besides the system disk"},
+		{"mini-PC with USB drive", true, miniPCWithUSB, []string{"/dev/sda"}, ""},
+		{"no lsblk", false, orangePi, nil, "lsblk not found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			list := func() ([]Drive, error) { return ParseDrives([]byte(tt.out)) }
+			err := Detect(lookPath(tt.lsblk), list)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Detect() = %v, want %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatalf("Detect() = %v", err)
+			}
+			if !tt.lsblk {
+				return
+			}
+			drives, _ := list()
+			if got := DataDrives(drives); !reflect.DeepEqual(got, tt.data) {
+				t.Errorf("DataDrives() = %v, want %v", got, tt.data)
+			}
+		})
+	}
+}
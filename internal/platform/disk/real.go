@@ -50,10 +50,27 @@ func (d *RealDisk) GetStatus() (string, error) {
 }
 
 func (d *RealDisk) Format() error {
+	return d.FormatWithProgress(nil)
+}
+
+// Format stages reported to FormatWithProgress callers.
+const (
+	StagePartitioning = "partitioning"
+	StageFilesystem   = "creating filesystem"
+)
+
+// FormatWithProgress is Format that reports each stage as it starts, so
+// the setup portal can show where a minutes-long mkfs is at.
+func (d *RealDisk) FormatWithProgress(progress func(stage string)) error {
+	if progress == nil {
+		progress = func(string) {}
+	}
 	fmt.Printf("[DISK] REAL FORMATTING INITIATED ON %s\n", d.DevicePath)
 
-	// 1. Create Partition Table & Partition (Uses 100% of disk)
-	if err := exec.Command("parted", d.DevicePath, "--script", "mkpart", "primary", "ext4", "0%", "100%").Run(); err != nil {
+	// 1. Create Partition Table & Partition (Uses 100% of disk). mklabel is
+	// required on a factory-fresh drive, which has no table to add to.
+	progress(StagePartitioning)
+	if err := exec.Command("parted", d.DevicePath, "--script", "mklabel", "gpt", "mkpart", "primary", "ext4", "0%", "100%").Run(); err != nil {
 		return err
 	}
 
@@ -64,6 +81,7 @@ func (d *RealDisk) Format() error {
 	exec.Command("partprobe", d.DevicePath).Run()
 
 	// 4. Format
+	progress(StageFilesystem)
 	if err := exec.Command("mkfs.ext4", "-F", partPath).Run(); err != nil {
 		return err
 	}
@@ -41,6 +41,7 @@ var silentOK = map[string]bool{
 	"killall":        true,
 	"dhclient":       true,
 	"wpa_supplicant": true,
+	"wpa_cli":        true,
 	"hostapd":        true,
 	"dnsmasq":        true,
 	"tailscale":      true,
@@ -141,6 +142,14 @@ func (d *DevRunner) fakeOutput(name string, args []string) ([]byte, bool) {
 			return []byte(fakeTailscaleStatus), true
 		}
 
+	// ── iptables -L STRCT_ACCT -v -x -n  (router traffic accounting) ─────────
+	case "iptables":
+		for _, a := range args {
+			if a == "-L" {
+				return []byte(fakeAcct), true
+			}
+		}
+
 	// ── systemctl is-active <unit> ────────────────────────────────────────────
 	case "systemctl":
 		if len(args) >= 2 && args[0] == "is-active" {
@@ -160,6 +169,16 @@ const fakeARP = `? (192.168.100.50) at a1:b2:c3:d4:e5:f6 [ether] on wlan0
 `
 
 // fakeIPNeigh — same devices, ip-neigh format.
+// fakeAcct — STRCT_ACCT counters for two of the fakeARP devices.
+// router.go parseAcctCounters reads bytes, source, destination and comment.
+const fakeAcct = `Chain STRCT_ACCT (1 references)
+    pkts      bytes target     prot opt in     out     source               destination
+   48211 61734120 RETURN     all  --  *      *       0.0.0.0/0            192.168.100.50       /* strct-acct:a1:b2:c3:d4:e5:f6 */
+   21034  2411877 RETURN     all  --  *      *       192.168.100.50       0.0.0.0/0            /* strct-acct:a1:b2:c3:d4:e5:f6 */
+    3120  4012230 RETURN     all  --  *      *       0.0.0.0/0            192.168.100.51       /* strct-acct:de:ad:be:ef:ca:fe */
+    1502   208114 RETURN     all  --  *      *       192.168.100.51       0.0.0.0/0            /* strct-acct:de:ad:be:ef:ca:fe */
+`
+
 const fakeIPNeigh = `192.168.100.50 dev wlan0 lladdr a1:b2:c3:d4:e5:f6 REACHABLE
 192.168.100.51 dev wlan0 lladdr de:ad:be:ef:ca:fe STALE
 192.168.100.52 dev wlan0 lladdr 11:22:33:44:55:66 REACHABLE
@@ -18,9 +18,13 @@ package executil
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os/exec"
 	"strings"
+	"time"
 )
 
 // Runner is the shared interface. Consuming packages copy the subset of
@@ -38,6 +42,16 @@ type Runner interface {
 	CombinedOutput(name string, args ...string) ([]byte, error)
 }
 
+// Streamer starts a command that keeps running, a log follower like
+// journalctl -f, and hands back its stdout as it is written. It is not
+// part of Runner: few packages need it, and DevRunner has nothing to
+// stream.
+type Streamer interface {
+	// Stream starts the command. It is killed when ctx is done or the
+	// reader is closed; reading ends with io.EOF once it exits.
+	Stream(ctx context.Context, name string, args ...string) (io.ReadCloser, error)
+}
+
 // Real executes commands via os/exec. This is the implementation injected
 // in all non-test code.
 type Real struct{}
@@ -46,10 +60,41 @@ func NewRealRunner() Runner {
 	return &Real{}
 }
 
+// Run keeps the end of the command's stderr: on a non-zero exit the
+// *exec.ExitError carries it in Stderr, as Output's does.
 func (Real) Run(name string, args ...string) error {
-	return exec.Command(name, args...).Run()
+	cmd := exec.Command(name, args...)
+	var stderr tailBuffer
+	cmd.Stderr = &stderr
+	// A daemon that forks (wpa_supplicant -B) may hold stderr open after
+	// the command itself has exited; don't wait on it.
+	cmd.WaitDelay = time.Second
+	err := cmd.Run()
+	if errors.Is(err, exec.ErrWaitDelay) {
+		return nil
+	}
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		exit.Stderr = stderr.Bytes()
+	}
+	return err
 }
 
+// tailBuffer keeps the last stderrTail bytes written to it.
+type tailBuffer struct{ b []byte }
+
+const stderrTail = 4 << 10
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.b = append(t.b, p...)
+	if over := len(t.b) - stderrTail; over > 0 {
+		t.b = append(t.b[:0], t.b[over:]...)
+	}
+	return len(p), nil
+}
+
+func (t *tailBuffer) Bytes() []byte { return t.b }
+
 func (Real) Output(name string, args ...string) ([]byte, error) {
 	return exec.Command(name, args...).Output()
 }
@@ -58,6 +103,31 @@ func (Real) CombinedOutput(name string, args ...string) ([]byte, error) {
 	return exec.Command(name, args...).CombinedOutput()
 }
 
+func (Real) Stream(ctx context.Context, name string, args ...string) (io.ReadCloser, error) {
+	cmd := exec.CommandContext(ctx, name, args...)
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &stream{ReadCloser: out, cmd: cmd}, nil
+}
+
+// stream is a running command's stdout.
+type stream struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+}
+
+// Close kills the command, if it still runs, and reaps it.
+func (s *stream) Close() error {
+	s.cmd.Process.Kill() //nolint:errcheck
+	s.cmd.Wait()         //nolint:errcheck
+	return nil
+}
+
 // Call records a single command invocation for assertion in tests.
 type Call struct {
 	Name string
@@ -132,6 +202,16 @@ func (m *Mock) CombinedOutput(name string, args ...string) ([]byte, error) {
 	return r.Output, r.Err
 }
 
+// Stream hands back the programmed Output as the whole stream, as if
+// the command wrote it and exited.
+func (m *Mock) Stream(_ context.Context, name string, args ...string) (io.ReadCloser, error) {
+	r := m.record(name, args)
+	if r.Err != nil {
+		return nil, r.Err
+	}
+	return io.NopCloser(bytes.NewReader(r.Output)), nil
+}
+
 // WasCalled reports whether the given command string was ever called.
 // The command string is "name arg1 arg2 ..." — same format as Expect.
 func (m *Mock) WasCalled(command string) bool {
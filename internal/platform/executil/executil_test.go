@@ -1 +1,46 @@
 package executil
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestReal_RunKeepsStderr(t *testing.T) {
+	err := Real{}.Run("sh", "-c", "echo starting; echo 'hostapd: could not configure driver' >&2; exit 1")
+	var exit *exec.ExitError
+	if !errors.As(err, &exit) {
+		t.Fatalf("err = %v, want an exit error", err)
+	}
+	if got := strings.TrimSpace(string(exit.Stderr)); got != "hostapd: could not configure driver" {
+		t.Errorf("stderr = %q", got)
+	}
+	if err := (Real{}).Run("sh", "-c", "echo fine >&2"); err != nil {
+		t.Errorf("clean exit: %v", err)
+	}
+}
+
+func TestReal_Stream(t *testing.T) {
+	r, err := Real{}.Stream(context.Background(), "sh", "-c", "echo one; echo two")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := io.ReadAll(r)
+	if err != nil || string(out) != "one\ntwo\n" {
+		t.Errorf("read %q, %v", out, err)
+	}
+	r.Close()
+
+	// Closing stops a command that would run forever.
+	r, err = Real{}.Stream(context.Background(), "sleep", "60")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() { io.ReadAll(r); close(done) }()
+	r.Close()
+	<-done
+}
@@ -0,0 +1,73 @@
+package fileworker
+
+import (
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/strct-org/strct-agent/internal/managed"
+)
+
+// adopt hands DataDir's user content to the worker account:
+//
+//   - DataDir itself stays root-owned, group uid's group, mode 1770: the
+//     worker can create entries but, thanks to the sticky bit, only
+//     delete its own.
+//   - Top-level regular files with mode 0600 are the agent's own state
+//     (fsutil writes everything 0600) and stay root's, out of the
+//     worker's reach, as do 0700 ones: the frpc the tunnel downloads,
+//     which root runs. So does the obsolete folder, which holds the
+//     generated files an upgrade retired.
+//   - Everything else is chowned to the worker.
+//
+// Entries already owned by the worker are skipped, so re-runs are cheap.
+func adopt(dataDir string, uid, gid uint32) error {
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return err
+	}
+	if err := os.Chown(dataDir, 0, int(gid)); err != nil {
+		return err
+	}
+	if err := os.Chmod(dataDir, 0770|os.ModeSticky); err != nil {
+		return err
+	}
+
+	changed := 0
+	err := filepath.WalkDir(dataDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == dataDir {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if filepath.Dir(path) == dataDir && agentState(info) {
+			return nil
+		}
+		if path == filepath.Join(dataDir, managed.ObsoleteDirName) && info.IsDir() {
+			return filepath.SkipDir
+		}
+		if owner, ok := fileOwner(info); ok && owner == uid {
+			return nil
+		}
+		if err := os.Lchown(path, int(uid), int(gid)); err != nil {
+			return err
+		}
+		changed++
+		return nil
+	})
+	if changed > 0 {
+		slog.Info("fileworker: adopted data dir", "path", dataDir, "entries", changed)
+	}
+	return err
+}
+
+// agentState reports whether a top-level DataDir entry is agent state.
+func agentState(info fs.FileInfo) bool {
+	perm := info.Mode().Perm()
+	return info.Mode().IsRegular() && (perm == 0600 || perm == 0700)
+}
@@ -0,0 +1,24 @@
+//go:build !windows
+
+package fileworker
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// sysProcAttr starts the worker as uid/gid with no supplementary groups.
+func sysProcAttr(uid, gid uint32) *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{
+		Credential: &syscall.Credential{Uid: uid, Gid: gid, Groups: []uint32{}},
+		Setpgid:    true,
+	}
+}
+
+func fileOwner(info fs.FileInfo) (uint32, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return st.Uid, true
+}
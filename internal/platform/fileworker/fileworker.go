@@ -0,0 +1,289 @@
+// Package fileworker runs the cloud file handlers in a child process as a
+// dedicated low-privilege user, so a bug in the upload path cannot write
+// anywhere root can. The agent reverse-proxies the file routes to the
+// worker over a unix socket; external URLs do not change.
+//
+// The worker is the agent binary itself started with -file-worker. The
+// Supervisor restarts it whenever it exits, much like the frpc tunnel.
+package fileworker
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	stdhttputil "net/http/httputil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/config"
+	"github.com/strct-org/strct-agent/internal/httputil"
+	"github.com/strct-org/strct-agent/internal/platform/executil"
+)
+
+const (
+	// User is the account the worker runs as. It owns the user content
+	// in DataDir and nothing else.
+	User = "strct-files"
+
+	// Flag is the agent command-line flag that starts worker mode; its
+	// value is the socket path. DataFlag carries DataDir.
+	Flag     = "file-worker"
+	DataFlag = "file-worker-data"
+
+	restartDelay = 2 * time.Second
+	readyTimeout = 10 * time.Second
+)
+
+// processRunner is the subset of executil.Runner the supervisor needs to
+// create the worker account.
+type processRunner interface {
+	Run(name string, args ...string) error
+}
+
+type Config struct {
+	DataDir    string
+	SocketPath string
+	DevMode    bool
+	// Command starts the worker; Supervisor appends the socket and data
+	// flags. Defaults to this executable.
+	Command []string
+}
+
+// Supervisor keeps the worker process running and proxies to it.
+type Supervisor struct {
+	cfg    Config
+	runner processRunner
+	proxy  *stdhttputil.ReverseProxy
+	ready  atomic.Bool
+
+	// credential is the uid/gid the worker runs as; nil runs it as the
+	// agent's own user (dev mode, or an agent not running as root).
+	credential *credential
+}
+
+type credential struct {
+	uid, gid uint32
+}
+
+// New is the base constructor. Use NewFromConfig in application code.
+func New(cfg Config, runner processRunner) *Supervisor {
+	s := &Supervisor{cfg: cfg, runner: runner}
+	s.proxy = &stdhttputil.ReverseProxy{
+		Rewrite: func(r *stdhttputil.ProxyRequest) {
+			r.Out.URL.Scheme = "http"
+			r.Out.URL.Host = "file-worker"
+			r.SetXForwarded() // the worker logs the client's address
+			if ip := httputil.ClientAddr(r.In); ip != "" {
+				r.Out.Header.Set("X-Forwarded-For", ip) // a tunnel visitor's, not frpc's
+			}
+		},
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", s.cfg.SocketPath)
+			},
+			MaxIdleConns:    8,
+			IdleConnTimeout: 90 * time.Second,
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			slog.Warn("fileworker: proxy error", "path", r.URL.Path, "err", err)
+			httputil.Error(w, http.StatusBadGateway, "file service unavailable")
+		},
+	}
+	return s
+}
+
+func NewFromConfig(cfg *config.Config) *Supervisor {
+	socket := "/run/strct-files/files.sock"
+	if cfg.IsDev {
+		socket = filepath.Join(os.TempDir(), "strct-files", "files.sock")
+	}
+	return New(Config{
+		DataDir:    cfg.DataDir,
+		SocketPath: socket,
+		DevMode:    cfg.IsDev,
+	}, executil.Real{})
+}
+
+// Handler proxies to the worker. While it is (re)starting requests get a
+// 503 rather than falling back to root.
+func (s *Supervisor) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.ready.Load() {
+			w.Header().Set("Retry-After", "2")
+			httputil.Error(w, http.StatusServiceUnavailable, "file service is starting")
+			return
+		}
+		s.proxy.ServeHTTP(w, r)
+	})
+}
+
+// Start runs the worker until ctx is cancelled, then waits for it to
+// exit so an agent shutdown never leaves an orphaned worker behind.
+func (s *Supervisor) Start(ctx context.Context) error {
+	if err := s.prepare(); err != nil {
+		return fmt.Errorf("fileworker: %w", err)
+	}
+	s.runLoop(ctx)
+	return nil
+}
+
+// prepare resolves the worker account, hands DataDir's user content to it
+// and creates the socket directory. Without root the worker simply runs
+// as the current user.
+func (s *Supervisor) prepare() error {
+	if !s.cfg.DevMode && os.Geteuid() == 0 {
+		cred, err := s.ensureUser()
+		if err != nil {
+			return err
+		}
+		s.credential = cred
+		if err := adopt(s.cfg.DataDir, cred.uid, cred.gid); err != nil {
+			return fmt.Errorf("adopt %s: %w", s.cfg.DataDir, err)
+		}
+	} else {
+		slog.Warn("fileworker: dev mode or not root, worker runs as the agent's user")
+	}
+
+	dir := filepath.Dir(s.cfg.SocketPath)
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return fmt.Errorf("socket dir: %w", err)
+	}
+	if s.credential != nil {
+		if err := os.Chown(dir, int(s.credential.uid), int(s.credential.gid)); err != nil {
+			return fmt.Errorf("socket dir: %w", err)
+		}
+	}
+	return nil
+}
+
+// ensureUser looks up the worker account, creating a system user with no
+// home and no shell on first run.
+func (s *Supervisor) ensureUser() (*credential, error) {
+	u, err := user.Lookup(User)
+	if _, missing := err.(user.UnknownUserError); missing {
+		slog.Info("fileworker: creating user", "user", User)
+		if err := s.runner.Run("useradd", "--system", "--user-group", "--no-create-home",
+			"--shell", "/usr/sbin/nologin", User); err != nil {
+			return nil, fmt.Errorf("useradd %s: %w", User, err)
+		}
+		u, err = user.Lookup(User)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("lookup %s: %w", User, err)
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("uid %q: %w", u.Uid, err)
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("gid %q: %w", u.Gid, err)
+	}
+	return &credential{uid: uint32(uid), gid: uint32(gid)}, nil
+}
+
+// runLoop runs the worker and restarts it if it exits unexpectedly.
+func (s *Supervisor) runLoop(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Info("fileworker: stopped")
+			return
+		default:
+		}
+
+		err := s.runOnce(ctx)
+		s.ready.Store(false)
+		if ctx.Err() != nil {
+			slog.Info("fileworker: stopped")
+			return
+		}
+		slog.Error("fileworker: worker exited, restarting", "err", err, "delay", restartDelay)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(restartDelay):
+		}
+	}
+}
+
+func (s *Supervisor) runOnce(ctx context.Context) error {
+	os.Remove(s.cfg.SocketPath) //nolint:errcheck — stale socket from a previous worker
+
+	cmd, err := s.command(ctx)
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("start: %w", err)
+	}
+	slog.Info("fileworker: started", "pid", cmd.Process.Pid, "socket", s.cfg.SocketPath)
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	if err := s.waitReady(ctx, exited); err != nil {
+		cmd.Process.Kill() //nolint:errcheck
+		<-exited
+		return err
+	}
+	s.ready.Store(true)
+	return <-exited
+}
+
+func (s *Supervisor) command(ctx context.Context) (*exec.Cmd, error) {
+	argv := s.cfg.Command
+	if len(argv) == 0 {
+		self, err := os.Executable()
+		if err != nil {
+			return nil, fmt.Errorf("locate agent binary: %w", err)
+		}
+		argv = []string{self}
+		if s.cfg.DevMode {
+			argv = append(argv, "-dev")
+		}
+	}
+	args := append(argv[1:len(argv):len(argv)], "-"+Flag, s.cfg.SocketPath, "-"+DataFlag, s.cfg.DataDir)
+
+	cmd := exec.CommandContext(ctx, argv[0], args...)
+	// Let in-flight uploads finish on shutdown before the kill.
+	cmd.Cancel = func() error { return cmd.Process.Signal(syscall.SIGTERM) }
+	cmd.WaitDelay = 5 * time.Second
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Dir = s.cfg.DataDir
+	if s.credential != nil {
+		cmd.SysProcAttr = sysProcAttr(s.credential.uid, s.credential.gid)
+	}
+	return cmd, nil
+}
+
+// waitReady polls the socket until the worker accepts connections.
+func (s *Supervisor) waitReady(ctx context.Context, exited chan error) error {
+	deadline := time.Now().Add(readyTimeout)
+	for time.Now().Before(deadline) {
+		if c, err := net.DialTimeout("unix", s.cfg.SocketPath, time.Second); err == nil {
+			c.Close()
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-exited:
+			exited <- err // runOnce still waits on it
+			return fmt.Errorf("exited before listening: %v", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	return fmt.Errorf("socket not ready after %v", readyTimeout)
+}
@@ -0,0 +1,71 @@
+package fileworker
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHandler_UnavailableUntilReady(t *testing.T) {
+	s := New(Config{SocketPath: filepath.Join(t.TempDir(), "files.sock")}, nil)
+
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/api/files", nil))
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("before ready: got %d, Retry-After %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+
+	// Ready but nothing listening: the proxy reports a bad gateway
+	// instead of hanging or serving from the root process.
+	s.ready.Store(true)
+	rec = httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/api/files", nil))
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("worker gone: got %d, want 502", rec.Code)
+	}
+}
+
+func TestAdopt_LeavesAgentStateToRoot(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root to chown")
+	}
+	const nobody = 65534
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "router.json"), []byte("{}"), 0600)
+	os.WriteFile(filepath.Join(dir, "frpc"), []byte("elf"), 0700)
+	os.WriteFile(filepath.Join(dir, "holiday.jpg"), []byte("jpeg"), 0644)
+	os.MkdirAll(filepath.Join(dir, "Backups"), 0755)
+	// Deeper 0600 files are user content, not agent state.
+	os.WriteFile(filepath.Join(dir, "Backups", "keys.txt"), []byte("x"), 0600)
+	os.MkdirAll(filepath.Join(dir, ".obsolete", "1.4.0", "work"), 0700)
+	os.WriteFile(filepath.Join(dir, ".obsolete", "1.4.0", "work", "frpc.toml"), []byte("token"), 0600)
+
+	if err := adopt(dir, nobody, nobody); err != nil {
+		t.Fatalf("adopt: %v", err)
+	}
+
+	owner := func(name string) uint32 {
+		info, err := os.Lstat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		uid, _ := fileOwner(info)
+		return uid
+	}
+	for _, name := range []string{"router.json", "frpc", ".obsolete", ".obsolete/1.4.0/work/frpc.toml"} {
+		if uid := owner(name); uid != 0 {
+			t.Errorf("%s owned by %d, want root", name, uid)
+		}
+	}
+	for _, name := range []string{"holiday.jpg", "Backups", "Backups/keys.txt"} {
+		if uid := owner(name); uid != nobody {
+			t.Errorf("%s owned by %d, want %d", name, uid, nobody)
+		}
+	}
+	info, _ := os.Stat(dir)
+	if info.Mode()&os.ModeSticky == 0 || info.Mode().Perm() != 0770 {
+		t.Errorf("data dir mode = %v, want sticky 0770", info.Mode())
+	}
+}
@@ -0,0 +1,146 @@
+//go:build integration
+
+package fileworker_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/features/cloud"
+	"github.com/strct-org/strct-agent/internal/platform/executil"
+	"github.com/strct-org/strct-agent/internal/platform/fileworker"
+)
+
+const helperEnv = "STRCT_FILE_WORKER_HELPER"
+
+// TestMain turns the test binary into the worker when the supervisor
+// starts it, the same way the agent binary does with -file-worker.
+func TestMain(m *testing.M) {
+	if os.Getenv(helperEnv) == "" {
+		os.Exit(m.Run())
+	}
+	var socket, dataDir string
+	for i, arg := range os.Args {
+		switch {
+		case arg == "-"+fileworker.Flag && i+1 < len(os.Args):
+			socket = os.Args[i+1]
+		case arg == "-"+fileworker.DataFlag && i+1 < len(os.Args):
+			dataDir = os.Args[i+1]
+		}
+	}
+	mux := http.NewServeMux()
+	cloud.New(dataDir, 8080, true).RegisterFileRoutes(mux)
+	mux.HandleFunc("POST /test/crash", func(http.ResponseWriter, *http.Request) { os.Exit(3) })
+	if err := fileworker.Serve(context.Background(), socket, mux); err != nil {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func waitReady(t *testing.T, h http.Handler) {
+	t.Helper()
+	deadline := time.Now().Add(15 * time.Second)
+	for time.Now().Before(deadline) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/api/files", nil))
+		if rec.Code == http.StatusOK {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal("worker never became ready")
+}
+
+func upload(t *testing.T, url, name, content string) *http.Response {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, _ := mw.CreateFormFile("file", name)
+	io.WriteString(fw, content)
+	mw.Close()
+	resp, err := http.Post(url+"/strct_agent/fs/upload?path=/", mw.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatalf("upload: %v", err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestUploadsThroughProxiedWorker(t *testing.T) {
+	t.Setenv(helperEnv, "1")
+	dataDir := t.TempDir()
+	// Unix socket paths are short; keep it out of the long test dir name.
+	sockDir, err := os.MkdirTemp("", "fw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(sockDir)
+
+	sup := fileworker.New(fileworker.Config{
+		DataDir:    dataDir,
+		SocketPath: filepath.Join(sockDir, "files.sock"),
+		DevMode:    true,
+		Command:    []string{os.Args[0]},
+	}, executil.Real{})
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() { stopped <- sup.Start(ctx) }()
+	defer func() {
+		cancel()
+		if err := <-stopped; err != nil {
+			t.Errorf("Start: %v", err)
+		}
+	}()
+	waitReady(t, sup.Handler())
+
+	// The agent side: same routes as always, file ones proxied.
+	c := cloud.New(dataDir, 8080, true)
+	c.UseWorker(sup.Handler())
+	mux := http.NewServeMux()
+	c.RegisterRoutes(mux)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	if resp := upload(t, srv.URL, "notes.txt", "written by the worker"); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("upload: got %d", resp.StatusCode)
+	}
+	if b, err := os.ReadFile(filepath.Join(dataDir, "notes.txt")); err != nil || string(b) != "written by the worker" {
+		t.Fatalf("uploaded file = %q, %v", b, err)
+	}
+
+	resp, err := http.Get(srv.URL + "/files/notes.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != "written by the worker" {
+		t.Errorf("download = %q", b)
+	}
+
+	resp, err = http.Get(srv.URL + "/api/files?path=/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(b), `"notes.txt"`) {
+		t.Errorf("listing = %s", b)
+	}
+
+	// A crashed worker is restarted and serves again.
+	sup.Handler().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/test/crash", nil))
+	waitReady(t, sup.Handler())
+	if resp := upload(t, srv.URL, "after-restart.txt", "again"); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("upload after restart: got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,41 @@
+package fileworker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Serve is the worker side: it serves h on the unix socket at path until
+// ctx is cancelled. Only the agent (root, or the same user in dev) can
+// connect — the socket is 0600 and its directory belongs to the worker.
+func Serve(ctx context.Context, path string, h http.Handler) error {
+	os.Remove(path) //nolint:errcheck — stale socket
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("fileworker: listen %s: %w", path, err)
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		ln.Close()
+		return fmt.Errorf("fileworker: chmod %s: %w", path, err)
+	}
+
+	srv := &http.Server{Handler: h}
+	go func() {
+		<-ctx.Done()
+		shutCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutCtx)
+	}()
+
+	slog.Info("fileworker: serving", "socket", path, "uid", os.Getuid())
+	if err := srv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("fileworker: %w", err)
+	}
+	return nil
+}
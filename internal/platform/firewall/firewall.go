@@ -0,0 +1,62 @@
+// Package firewall wraps the handful of iptables idioms the features share:
+// owning a dedicated chain, and adding/removing rules idempotently.
+//
+// Every feature that installs rules gets its own STRCT_* chain hooked into
+// a built-in chain with a single jump. Rebuilding a feature's rules then
+// means flushing only that chain, never a built-in one — so router port
+// forwards, MAC blocks and the adblock DNS redirect can't wipe each other.
+package firewall
+
+// runner is the subset of executil.Runner the helpers need.
+type runner interface {
+	Run(name string, args ...string) error
+}
+
+// EnsureChain creates chain in table if it doesn't exist and makes sure
+// parent has a jump to it. The jump is inserted at the top of parent so
+// our rules are evaluated before anything an admin appended by hand.
+//
+//	iptables -t nat -N STRCT_PORTFWD
+//	iptables -t nat -C PREROUTING -j STRCT_PORTFWD || iptables -t nat -I PREROUTING -j STRCT_PORTFWD
+func EnsureChain(r runner, table, chain, parent string) error {
+	if r.Run("iptables", "-t", table, "-n", "-L", chain) != nil {
+		if err := r.Run("iptables", "-t", table, "-N", chain); err != nil {
+			return err
+		}
+	}
+	jump := []string{"-j", chain}
+	if RuleExists(r, table, parent, jump...) {
+		return nil
+	}
+	return r.Run("iptables", append([]string{"-t", table, "-I", parent, "1"}, jump...)...)
+}
+
+// FlushChain removes every rule from chain. The chain itself and the jump
+// into it stay in place.
+func FlushChain(r runner, table, chain string) error {
+	return r.Run("iptables", "-t", table, "-F", chain)
+}
+
+// RuleExists reports whether the rule is already present in chain, using
+// `iptables -C` (exit status 0 → present).
+func RuleExists(r runner, table, chain string, rule ...string) bool {
+	return r.Run("iptables", append([]string{"-t", table, "-C", chain}, rule...)...) == nil
+}
+
+// EnsureRule appends the rule to chain unless an identical rule is already
+// there, so re-running an apply never stacks duplicates.
+func EnsureRule(r runner, table, chain string, rule ...string) error {
+	if RuleExists(r, table, chain, rule...) {
+		return nil
+	}
+	return r.Run("iptables", append([]string{"-t", table, "-A", chain}, rule...)...)
+}
+
+// DeleteRule removes the rule from chain if present. Deleting a rule that
+// doesn't exist is not an error.
+func DeleteRule(r runner, table, chain string, rule ...string) error {
+	if !RuleExists(r, table, chain, rule...) {
+		return nil
+	}
+	return r.Run("iptables", append([]string{"-t", table, "-D", chain}, rule...)...)
+}
@@ -0,0 +1,97 @@
+package tunnel
+
+import (
+	"log/slog"
+	"time"
+)
+
+// ─── Restart backoff ─────────────────────────────────────────────────────────
+
+// With the VPS down, frpc fails its login and exits at once. runLoop waits
+// before each restart, doubling the wait with every failure in a row from
+// restartDelay up to maxRestartDelay, less up to a fifth at random so
+// devices that lost the same VPS don't all come back at once. A failure is
+// any exit, unless frpc had a proxy running for stableAfter before it; that
+// resets the count, as does a proxy running that long now.
+//
+// After breakerAfter failures in a row the breaker is "open": frpc is
+// retried at the longer waits and each exit is logged at debug level
+// instead of as an error. It is "half_open" while a retry runs and
+// "closed" again once a proxy stays up. GET /api/tunnel/status shows the
+// state, the failure count and the next retry.
+const (
+	maxRestartDelay = 5 * time.Minute
+	stableAfter     = time.Minute
+	breakerAfter    = 5
+
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half_open"
+)
+
+// backoffDelay is the wait before the restart after the nth failure in a
+// row, before jitter.
+func backoffDelay(base time.Duration, n int) time.Duration {
+	d := base
+	for i := 1; i < n && d < maxRestartDelay; i++ {
+		d *= 2
+	}
+	return min(d, maxRestartDelay)
+}
+
+// failed counts frpc's exit as a failure and returns how long to wait
+// before restarting it.
+func (s *Service) failed(err error) time.Duration {
+	st := &s.state
+	st.mu.Lock()
+	now := time.Now()
+	st.resetIfStableLocked(now)
+	st.failures++
+	d := backoffDelay(s.restartDelay, st.failures)
+	d -= time.Duration(s.jitter() * float64(d) / 5)
+	st.nextRetry = now.Add(d)
+	n := st.failures
+	st.mu.Unlock()
+
+	switch {
+	case n < breakerAfter:
+		slog.Error("tunnel: frpc exited unexpectedly, restarting",
+			"err", err,
+			"delay", d,
+			"failures", n,
+		)
+	case n == breakerAfter:
+		slog.Warn("tunnel: frpc keeps failing, backing off",
+			"err", err,
+			"delay", d,
+			"failures", n,
+		)
+	default:
+		slog.Debug("tunnel: frpc exited, backing off", "err", err, "delay", d, "failures", n)
+	}
+	return d
+}
+
+// resetIfStableLocked clears the failure count once a proxy has been up
+// for stableAfter. The caller holds mu.
+func (st *supervisor) resetIfStableLocked(now time.Time) {
+	if st.connectedAt.IsZero() || now.Sub(st.connectedAt) < stableAfter || st.failures == 0 {
+		return
+	}
+	if st.failures >= breakerAfter {
+		slog.Info("tunnel: frpc connected again, backoff reset", "failures", st.failures)
+	}
+	st.failures = 0
+}
+
+// breakerLocked is the breaker's state. The caller holds mu.
+func (st *supervisor) breakerLocked() string {
+	switch {
+	case st.failures < breakerAfter:
+		return breakerClosed
+	case st.running:
+		return breakerHalfOpen
+	default:
+		return breakerOpen
+	}
+}
@@ -0,0 +1,105 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBackoffDelay_DoublesUpToTheCap(t *testing.T) {
+	var got []time.Duration
+	for n := 1; n <= 9; n++ {
+		got = append(got, backoffDelay(5*time.Second, n))
+	}
+	want := []time.Duration{5 * time.Second, 10 * time.Second, 20 * time.Second, 40 * time.Second, 80 * time.Second, 160 * time.Second, maxRestartDelay, maxRestartDelay, maxRestartDelay}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("delays = %v, want %v", got, want)
+		}
+	}
+	if d := backoffDelay(5*time.Second, 1000); d != maxRestartDelay {
+		t.Errorf("after 1000 failures: %v", d)
+	}
+}
+
+func TestFailed_OpensTheBreakerAndResetsOnAStableConnection(t *testing.T) {
+	s := New(Config{}, nil)
+	s.jitter = func() float64 { return 0.5 }
+	exit := errors.New("login to server failed")
+
+	for i := 1; i < breakerAfter; i++ {
+		s.started(42, func() {})
+		s.exited(exit)
+		if d, want := s.failed(exit), backoffDelay(s.restartDelay, i)*9/10; d != want {
+			t.Errorf("failure %d: delay %v, want %v", i, d, want)
+		}
+	}
+	if st := s.Status(); st.Breaker != breakerClosed || st.ConsecutiveFailures != breakerAfter-1 || st.NextRetry == nil {
+		t.Fatalf("status = %+v, want closed with a retry", st)
+	}
+	s.failed(exit)
+	if st := s.Status(); st.Breaker != breakerOpen {
+		t.Errorf("breaker = %s after %d failures, want open", st.Breaker, breakerAfter)
+	}
+
+	// A retry runs; its proxy came up, but not for long.
+	s.started(43, func() {})
+	st := s.Status()
+	if st.Breaker != breakerHalfOpen || st.NextRetry != nil {
+		t.Errorf("status while retrying = %+v", st)
+	}
+	s.state.mu.Lock()
+	s.state.connectedAt = time.Now().Add(-stableAfter / 2)
+	s.state.mu.Unlock()
+	s.exited(exit)
+	s.failed(exit)
+	if st := s.Status(); st.ConsecutiveFailures != breakerAfter+1 {
+		t.Errorf("failures = %d after a short connection, want %d", st.ConsecutiveFailures, breakerAfter+1)
+	}
+
+	// This one stays up: the next exit starts over.
+	s.started(44, func() {})
+	s.state.mu.Lock()
+	s.state.connectedAt = time.Now().Add(-2 * stableAfter)
+	s.state.mu.Unlock()
+	s.exited(exit)
+	if d := s.failed(exit); d != s.restartDelay*9/10 {
+		t.Errorf("delay after a stable connection = %v, want the first", d)
+	}
+	if st := s.Status(); st.Breaker != breakerClosed || st.ConsecutiveFailures != 1 {
+		t.Errorf("status = %+v, want closed with one failure", st)
+	}
+}
+
+func TestRunLoop_WaitStopsOnCancel(t *testing.T) {
+	bin := filepath.Join(t.TempDir(), "frpc")
+	if err := os.WriteFile(bin, []byte("#!/bin/sh\nexit 1\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	s := New(Config{}, nil)
+	s.restartDelay = time.Hour
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.runLoop(ctx, bin, "frpc.toml")
+		close(done)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for s.Status().NextRetry == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("frpc exited but no retry was scheduled")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("runLoop still waiting after cancel")
+	}
+}
@@ -10,15 +10,15 @@ package tunnel
 
 import (
 	"context"
-	"os"
+	"io"
 	"os/exec"
 )
 
 // newCommand returns a real *exec.Cmd that will be killed when ctx is cancelled.
-// stdout and stderr are wired to the parent process so frpc output is visible in logs.
-func newCommand(ctx context.Context, name string, args ...string) *exec.Cmd {
+// stdout and stderr both go to out, which logs frpc's lines; see output.go.
+func newCommand(ctx context.Context, out io.Writer, name string, args ...string) *exec.Cmd {
 	cmd := exec.CommandContext(ctx, name, args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	cmd.Stdout = out
+	cmd.Stderr = out
 	return cmd
 }
@@ -0,0 +1,159 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/logger"
+)
+
+// ─── frpc output ─────────────────────────────────────────────────────────────
+
+// frpc logs to stdout, without colours. runLoop sends its stdout and
+// stderr through an output, which logs each line with component=frpc at
+// the level frpc gave it and keeps the last outputLines in a ring, served
+// like /api/system/logs at
+//
+//	GET /api/tunnel/logs
+//
+// Lines that match frpcProblems set the status's frpc_error, in plain
+// words, until frpc next logs in.
+const (
+	outputLines   = 200
+	maxOutputLine = 4096 // longer lines are split
+)
+
+// frpcLine is frpc's log format:
+//
+//	2024-06-03 12:00:00.123 [W] [client/service.go:295] login to the server failed: ...
+var frpcLine = regexp.MustCompile(`^\S+ \S+ \[([A-Z])\] (?:\[[^\]]*\] )?(.*)$`)
+
+var frpcLevels = map[string]slog.Level{
+	"E": slog.LevelError,
+	"W": slog.LevelWarn,
+	"I": slog.LevelInfo,
+	"D": slog.LevelDebug,
+	"T": slog.LevelDebug - 4,
+}
+
+// frpcProblems maps pieces of frpc's error lines to what they mean for
+// the device, first match wins.
+var frpcProblems = []struct{ match, problem string }{
+	{"token in login doesn't match", "frps refused the auth token: AUTH_TOKEN does not match the server's"},
+	{"token mismatch", "frps refused the auth token: AUTH_TOKEN does not match the server's"},
+	{"already exists", "frps already has a proxy of this name: another device may be running with the same DEVICE_ID"},
+	{"already in use", "frps already has a proxy of this name: another device may be running with the same DEVICE_ID"},
+	{"router config conflict", "the subdomain is already taken on frps"},
+	{"port already used", "the remote port is already taken on frps"},
+	{"port unavailable", "the remote port is already taken on frps"},
+	{"port not allowed", "frps does not allow the remote port"},
+	{"connection refused", "frps refused the connection: it is not running, or not on VPS_PORT"},
+	{"i/o timeout", "frps did not answer: the VPS is down or a firewall drops the connection"},
+}
+
+// loginOK is the line frpc logs once frps accepted it.
+const loginOK = "login to server success"
+
+// output splits frpc's output into lines. Stdout and Stderr share it.
+type output struct {
+	s       *Service
+	log     *slog.Logger
+	lines   *logger.Ring
+	mu      sync.Mutex
+	partial []byte
+}
+
+func newOutput(s *Service) *output {
+	lines := logger.NewRing(outputLines)
+	return &output{
+		s:     s,
+		lines: lines,
+		log:   slog.New(lines.Handler(slog.Default().Handler())).With("component", "frpc"),
+	}
+}
+
+func (o *output) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.partial = append(o.partial, p...)
+	for {
+		i := bytes.IndexByte(o.partial, '\n')
+		if i < 0 {
+			if len(o.partial) >= maxOutputLine {
+				o.line(string(o.partial))
+				o.partial = o.partial[:0]
+			}
+			return len(p), nil
+		}
+		o.line(string(o.partial[:i]))
+		o.partial = o.partial[i+1:]
+	}
+}
+
+// flush logs what is left of the last line, once frpc exited.
+func (o *output) flush() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.partial) > 0 {
+		o.line(string(o.partial))
+		o.partial = nil
+	}
+}
+
+func (o *output) line(line string) {
+	line = strings.TrimRight(line, "\r")
+	if strings.TrimSpace(line) == "" {
+		return
+	}
+	level, msg := parseFRPCLine(line)
+	o.log.Log(context.Background(), level, "frpc: "+msg)
+
+	if strings.Contains(msg, loginOK) {
+		o.s.setProblem("")
+	} else if p := frpcProblem(msg); p != "" && level >= slog.LevelWarn {
+		o.s.setProblem(p)
+	}
+}
+
+// parseFRPCLine returns a line's level and message; a line not in frpc's
+// log format is logged whole at info.
+func parseFRPCLine(line string) (slog.Level, string) {
+	m := frpcLine.FindStringSubmatch(line)
+	if m == nil {
+		return slog.LevelInfo, line
+	}
+	level, ok := frpcLevels[m[1]]
+	if !ok {
+		level = slog.LevelInfo
+	}
+	return level, m[2]
+}
+
+func frpcProblem(msg string) string {
+	lower := strings.ToLower(msg)
+	for _, p := range frpcProblems {
+		if strings.Contains(lower, p.match) {
+			return p.problem
+		}
+	}
+	return ""
+}
+
+// setProblem records what frpc's output says is wrong; "" clears it.
+func (s *Service) setProblem(problem string) {
+	st := &s.state
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if problem == st.problem {
+		return
+	}
+	if problem != "" {
+		slog.Warn("tunnel: frpc reports a problem", "problem", problem)
+	}
+	st.problem, st.problemAt = problem, time.Now().UTC()
+}
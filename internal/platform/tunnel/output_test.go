@@ -0,0 +1,110 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/strct-org/strct-agent/internal/logger"
+)
+
+func tunnelLogs(t *testing.T, s *Service, query string) []logger.Entry {
+	t.Helper()
+	mux := http.NewServeMux()
+	s.RegisterRoutes(mux)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/api/tunnel/logs"+query, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /api/tunnel/logs: %d %s", w.Code, w.Body)
+	}
+	var resp struct {
+		Entries []logger.Entry `json:"entries"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp) //nolint:errcheck
+	return resp.Entries
+}
+
+func TestOutput_LogsLinesByLevel(t *testing.T) {
+	// As logger.Init sets it up: debug and above.
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+	s := New(Config{}, nil)
+	// Lines arrive in pieces.
+	fmt.Fprint(s.out, "2024-06-03 12:00:00.123 [I] [sub/root.go:142] start frpc service for config file [frpc.toml]\n2024-06-03 12:00:00.200 [W] [client/service.go:295] login to the ")
+	fmt.Fprint(s.out, "server failed: dial tcp 10.0.0.1:7000: i/o timeout\n")
+	fmt.Fprint(s.out, "2024-06-03 12:00:00.300 [D] [client/control.go:80] heartbeat\npanic: no trailing newline")
+	s.out.flush()
+
+	got := tunnelLogs(t, s, "?level=debug")
+	want := []string{
+		"INFO frpc: start frpc service for config file [frpc.toml]",
+		"WARN frpc: login to the server failed: dial tcp 10.0.0.1:7000: i/o timeout",
+		"DEBUG frpc: heartbeat",
+		"INFO frpc: panic: no trailing newline",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("entries = %+v", got)
+	}
+	for i, e := range got {
+		if e.Level+" "+e.Msg != want[i] || e.Attrs != "component=frpc" {
+			t.Errorf("entry %d = %s %s (%s), want %s", i, e.Level, e.Msg, e.Attrs, want[i])
+		}
+	}
+	if got := tunnelLogs(t, s, ""); len(got) != 3 {
+		t.Errorf("%d entries at info, want 3", len(got))
+	}
+}
+
+func TestOutput_KeepsTheLastLines(t *testing.T) {
+	s := New(Config{}, nil)
+	for i := 0; i < outputLines+50; i++ {
+		fmt.Fprintf(s.out, "2024-06-03 12:00:00.000 [I] [x.go:1] line %d\n", i)
+	}
+	got := tunnelLogs(t, s, fmt.Sprintf("?limit=%d", 2*outputLines))
+	if len(got) != outputLines || got[0].Msg != "frpc: line 50" {
+		t.Errorf("kept %d lines from %q", len(got), got[0].Msg)
+	}
+}
+
+func TestOutput_ProblemUntilLogin(t *testing.T) {
+	s := New(Config{}, nil)
+	fmt.Fprint(s.out, "2024-06-03 12:00:00.000 [E] [client/service.go:295] token in login doesn't match token from configuration\n")
+	st := s.Status()
+	if !strings.Contains(st.FrpcError, "AUTH_TOKEN") || st.FrpcErrorAt == nil {
+		t.Fatalf("status = %+v", st)
+	}
+
+	// Not an error line: left as it was.
+	fmt.Fprint(s.out, "2024-06-03 12:00:01.000 [I] [x.go:1] proxy [web] already exists? checking\n")
+	if !strings.Contains(s.Status().FrpcError, "AUTH_TOKEN") {
+		t.Errorf("an info line replaced the problem: %s", s.Status().FrpcError)
+	}
+
+	fmt.Fprint(s.out, "2024-06-03 12:00:02.000 [I] [client/service.go:301] [abc] login to server success, get run id [abc]\n")
+	if st := s.Status(); st.FrpcError != "" || st.FrpcErrorAt != nil {
+		t.Errorf("after login: %+v", st)
+	}
+
+	fmt.Fprint(s.out, "2024-06-03 12:00:03.000 [W] [proxy/proxy_manager.go:144] [web_dev] start error: proxy [web_dev] already exists\n")
+	if !strings.Contains(s.Status().FrpcError, "DEVICE_ID") {
+		t.Errorf("duplicate proxy: %q", s.Status().FrpcError)
+	}
+}
+
+func TestParseFRPCLine(t *testing.T) {
+	for line, want := range map[string]slog.Level{
+		"2024-06-03 12:00:00.000 [E] [a.go:1] x": slog.LevelError,
+		"2024-06-03 12:00:00.000 [T] [a.go:1] x": slog.LevelDebug - 4,
+		"2024-06-03 12:00:00.000 [I] x":          slog.LevelInfo,
+	} {
+		if got, msg := parseFRPCLine(line); got != want || msg != "x" {
+			t.Errorf("parseFRPCLine(%q) = %v, %q", line, got, msg)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package tunnel
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// releaseTarball is a frp release archive holding frps and frpc.
+func releaseTarball(t *testing.T, frpc string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+	dir := strings.TrimSuffix(frpAsset(runtime.GOOS, runtime.GOARCH), ".tar.gz")
+	tw.WriteHeader(&tar.Header{Name: dir + "/", Typeflag: tar.TypeDir, Mode: 0755})
+	for name, body := range map[string]string{"frps": "server", "frpc": frpc} {
+		tw.WriteHeader(&tar.Header{Name: dir + "/" + name, Typeflag: tar.TypeReg, Mode: 0755, Size: int64(len(body))})
+		tw.Write([]byte(body))
+	}
+	tw.Close()
+	zw.Close()
+	return buf.Bytes()
+}
+
+// newMirror serves archive as this platform's release asset and counts
+// the downloads.
+func newMirror(t *testing.T, archive []byte) (*Service, *int) {
+	t.Helper()
+	hits := new(int)
+	asset := frpAsset(runtime.GOOS, runtime.GOARCH)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*hits++
+		if r.URL.Path != "/v"+frpVersion+"/"+asset {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(archive)
+	}))
+	t.Cleanup(srv.Close)
+
+	sum := sha256.Sum256(archive)
+	s := New(Config{DataDir: t.TempDir(), AutoDownload: true, MirrorURL: srv.URL + "/"}, nil)
+	s.checksums = map[string]string{asset: hex.EncodeToString(sum[:])}
+	return s, hits
+}
+
+func TestFindBinary_DownloadsAndVerifies(t *testing.T) {
+	s, hits := newMirror(t, releaseTarball(t, "#!/bin/sh\n"))
+	path, err := s.findBinary(context.Background(), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != filepath.Join(s.cfg.DataDir, "frpc") {
+		t.Errorf("path = %s", path)
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.Mode().Perm() != 0700 {
+		t.Fatalf("frpc = %v, %v; want mode 0700", info, err)
+	}
+	if b, _ := os.ReadFile(path); string(b) != "#!/bin/sh\n" {
+		t.Errorf("extracted %q, want frpc, not frps", b)
+	}
+	if entries, _ := os.ReadDir(s.cfg.DataDir); len(entries) != 1 {
+		t.Errorf("DataDir holds %v, want frpc alone", entries)
+	}
+
+	// Next time it is found.
+	if _, err := s.findBinary(context.Background(), t.TempDir()); err != nil || *hits != 1 {
+		t.Errorf("second lookup: %v after %d downloads", err, *hits)
+	}
+}
+
+func TestFindBinary_RejectsBadChecksum(t *testing.T) {
+	s, _ := newMirror(t, releaseTarball(t, "tampered"))
+	for asset := range s.checksums {
+		s.checksums[asset] = strings.Repeat("0", 64)
+	}
+	_, err := s.findBinary(context.Background(), t.TempDir())
+	if err == nil {
+		t.Fatal("a tarball with the wrong checksum was installed")
+	}
+	if entries, _ := os.ReadDir(s.cfg.DataDir); len(entries) != 0 {
+		t.Errorf("DataDir holds %v after a failed download", entries)
+	}
+}
+
+func TestFindBinary_NoDownload(t *testing.T) {
+	s, hits := newMirror(t, releaseTarball(t, "frpc"))
+
+	// One next to the agent wins.
+	work := t.TempDir()
+	os.WriteFile(filepath.Join(work, "frpc"), []byte("local"), 0755)
+	if path, err := s.findBinary(context.Background(), work); err != nil || path != filepath.Join(work, "frpc") {
+		t.Errorf("findBinary = %s, %v; want the working directory's", path, err)
+	}
+
+	// Air-gapped: the manual hint, and no request.
+	s.cfg.AutoDownload = false
+	if _, err := s.findBinary(context.Background(), t.TempDir()); err == nil {
+		t.Error("found frpc with downloads off")
+	}
+
+	// An asset without a pinned checksum is never fetched.
+	s.cfg.AutoDownload = true
+	s.checksums = map[string]string{}
+	if _, err := s.findBinary(context.Background(), t.TempDir()); err == nil {
+		t.Error("found frpc with no pinned checksum")
+	}
+	if *hits != 0 {
+		t.Errorf("%d downloads, want none", *hits)
+	}
+}
+
+func TestParseChecksums(t *testing.T) {
+	got := parseChecksums("# comment line\nABCDEF  frp_0.61.0_linux_arm64.tar.gz\n\nbad line here\n")
+	if len(got) != 1 || got["frp_0.61.0_linux_arm64.tar.gz"] != "abcdef" {
+		t.Errorf("parseChecksums = %v", got)
+	}
+}
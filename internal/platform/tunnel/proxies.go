@@ -0,0 +1,344 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/strct-org/strct-agent/internal/audit"
+	"github.com/strct-org/strct-agent/internal/httputil"
+	"github.com/strct-org/strct-agent/internal/statefile"
+)
+
+// ─── Proxies ─────────────────────────────────────────────────────────────────
+
+// By default frpc exposes one proxy, "web": the agent on LocalPort at
+// <device>.<domain>. TUNNEL_PROXIES (tunnel.proxies in the config file)
+// replaces it with a set of its own. LocalPort is the API's tunnel listener
+// (SetLocalPort), and every proxy aimed at it follows it. No proxy reaches
+// the API's own port, where frpc's requests would pass for the device's:
+// http and https proxies given it go to LocalPort, and tcp and stcp ones
+// are refused. The set can be changed at runtime:
+//
+//	POST /api/tunnel/proxies {"proxies": [
+//	  {"name": "web", "type": "https", "local_port": 8080},
+//	  {"name": "ssh", "type": "tcp", "local_port": 22, "remote_port": 6022}]}
+//
+// Types:
+//
+//   - http and https are served by frps' vhosts at Subdomain, which is the
+//     device ID (the default) or ends in "-<device ID>", so a device can't
+//     take another's name. frpc ends https itself, with frp's https2http
+//     plugin and TLS_CERT_FILE and TLS_KEY_FILE;
+//   - tcp takes RemotePort on the VPS;
+//   - stcp opens no port: it is reached through a frpc visitor holding its
+//     SecretKey.
+//
+// Names, subdomains and remote ports are unique in the set. frps wants
+// names unique across devices, so they are rendered as <name>_<device ID>.
+// The set is kept in DataDir/tunnel-proxies.json; a change rewrites
+// frpc.toml and has frpc reload it through its admin API, or restarts
+// frpc if that fails.
+const (
+	proxiesFile = "tunnel-proxies.json"
+	maxProxies  = 16
+
+	proxyHTTP  = "http"
+	proxyHTTPS = "https"
+	proxyTCP   = "tcp"
+	proxySTCP  = "stcp"
+)
+
+var (
+	proxyNameRe = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+	subdomainRe = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+	secretKeyRe = regexp.MustCompile(`^[A-Za-z0-9_-]{8,64}$`)
+)
+
+// ProxySpec is one frpc proxy.
+type ProxySpec struct {
+	Name       string `json:"name"`
+	Type       string `json:"type"` // http, https, tcp or stcp
+	LocalPort  int    `json:"local_port"`
+	Subdomain  string `json:"subdomain,omitempty"`   // http and https
+	RemotePort int    `json:"remote_port,omitempty"` // tcp
+	SecretKey  string `json:"secret_key,omitempty"`  // stcp
+}
+
+// proxiesSchema versions tunnel-proxies.json.
+//
+//	v1: {"proxies": [...]}
+var proxiesSchema = statefile.Schema{
+	Name:       "tunnel-proxies",
+	Migrations: []statefile.Migration{statefile.Stamp},
+}
+
+type proxiesDoc struct {
+	Proxies []ProxySpec `json:"proxies"`
+}
+
+func defaultProxies(localPort int, deviceID string) []ProxySpec {
+	return []ProxySpec{{Name: "web", Type: proxyHTTP, LocalPort: localPort, Subdomain: deviceID}}
+}
+
+// normalizeProxies fills in defaults and checks the set. An empty set
+// means the configured one, or the default.
+func (s *Service) normalizeProxies(specs []ProxySpec) ([]ProxySpec, error) {
+	if len(specs) == 0 {
+		if len(s.configured) == 0 {
+			return defaultProxies(s.localPort(), s.cfg.DeviceID), nil
+		}
+		out := slices.Clone(s.configured)
+		retarget(out, s.builtPort, s.localPort())
+		return out, nil
+	}
+	if len(specs) > maxProxies {
+		return nil, fmt.Errorf("at most %d proxies", maxProxies)
+	}
+	out := make([]ProxySpec, 0, len(specs))
+	names, subdomains, ports := map[string]bool{}, map[string]bool{}, map[int]bool{}
+	for _, p := range specs {
+		p.Name = strings.ToLower(strings.TrimSpace(p.Name))
+		p.Type = strings.ToLower(strings.TrimSpace(p.Type))
+		p.Subdomain = strings.ToLower(strings.TrimSpace(p.Subdomain))
+		if !proxyNameRe.MatchString(p.Name) {
+			return nil, fmt.Errorf("proxy name %q must be 1-32 lowercase letters, digits, - or _", p.Name)
+		}
+		if names[p.Name] {
+			return nil, fmt.Errorf("proxy name %q is used twice", p.Name)
+		}
+		names[p.Name] = true
+		if p.LocalPort < 1 || p.LocalPort > 65535 {
+			return nil, fmt.Errorf("proxy %s: local_port must be between 1 and 65535", p.Name)
+		}
+
+		switch p.Type {
+		case proxyHTTP, proxyHTTPS:
+			if p.RemotePort != 0 || p.SecretKey != "" {
+				return nil, fmt.Errorf("proxy %s: %s takes a subdomain, not remote_port or secret_key", p.Name, p.Type)
+			}
+			if p.Type == proxyHTTPS && (s.cfg.TLSCertFile == "" || s.cfg.TLSKeyFile == "") {
+				return nil, fmt.Errorf("proxy %s: https needs TLS_CERT_FILE and TLS_KEY_FILE", p.Name)
+			}
+			if p.Subdomain == "" {
+				p.Subdomain = s.cfg.DeviceID
+			}
+			if !subdomainRe.MatchString(p.Subdomain) ||
+				(p.Subdomain != s.cfg.DeviceID && !strings.HasSuffix(p.Subdomain, "-"+s.cfg.DeviceID)) {
+				return nil, fmt.Errorf("proxy %s: subdomain must be %q or end in %q", p.Name, s.cfg.DeviceID, "-"+s.cfg.DeviceID)
+			}
+			if subdomains[p.Subdomain] {
+				return nil, fmt.Errorf("proxy %s: subdomain %q is used twice", p.Name, p.Subdomain)
+			}
+			subdomains[p.Subdomain] = true
+		case proxyTCP:
+			if p.Subdomain != "" || p.SecretKey != "" {
+				return nil, fmt.Errorf("proxy %s: tcp takes remote_port, not subdomain or secret_key", p.Name)
+			}
+			if p.RemotePort < 1 || p.RemotePort > 65535 {
+				return nil, fmt.Errorf("proxy %s: tcp needs a remote_port between 1 and 65535", p.Name)
+			}
+			if ports[p.RemotePort] {
+				return nil, fmt.Errorf("proxy %s: remote_port %d is used twice", p.Name, p.RemotePort)
+			}
+			ports[p.RemotePort] = true
+		case proxySTCP:
+			if p.Subdomain != "" || p.RemotePort != 0 {
+				return nil, fmt.Errorf("proxy %s: stcp opens no port on the VPS; it takes secret_key only", p.Name)
+			}
+			if !secretKeyRe.MatchString(p.SecretKey) {
+				return nil, fmt.Errorf("proxy %s: stcp needs a secret_key of 8-64 letters, digits, - or _", p.Name)
+			}
+		default:
+			return nil, fmt.Errorf("proxy %s: type must be http, https, tcp or stcp", p.Name)
+		}
+		if s.cfg.APIPort != 0 {
+			switch {
+			case p.Type == proxyHTTP || p.Type == proxyHTTPS:
+				if p.LocalPort == s.cfg.APIPort {
+					p.LocalPort = s.localPort()
+				}
+			case p.LocalPort == s.cfg.APIPort || p.LocalPort == s.localPort():
+				return nil, fmt.Errorf("proxy %s: %s may not reach the API on local_port %d; use an http or https proxy",
+					p.Name, p.Type, p.LocalPort)
+			}
+		}
+		out = append(out, p)
+	}
+	return out, nil
+}
+
+// loadProxies restores the saved set, keeping the configured one if there
+// is none.
+func (s *Service) loadProxies() error {
+	if s.proxiesPath == "" {
+		return nil
+	}
+	var doc proxiesDoc
+	if err := statefile.Load(s.proxiesPath, proxiesSchema, &doc); err != nil {
+		if statefile.Fresh(err) {
+			return nil
+		}
+		return fmt.Errorf("load tunnel proxies: %w", err)
+	}
+	proxies, err := s.normalizeProxies(doc.Proxies)
+	if err != nil {
+		return fmt.Errorf("saved tunnel proxies: %w", err)
+	}
+	s.proxyMu.Lock()
+	// Saved while the API was on the port the Service was built with.
+	retarget(proxies, s.builtPort, s.cfg.LocalPort)
+	s.cfg.Proxies = proxies
+	s.proxyMu.Unlock()
+	return nil
+}
+
+func (s *Service) localPort() int {
+	s.proxyMu.Lock()
+	defer s.proxyMu.Unlock()
+	return s.cfg.LocalPort
+}
+
+// SetLocalPort is the port of the API's tunnel listener; api.Config.OnPort
+// calls it. The first call lets frpc start. The proxies aimed at the old
+// one move with it, and a running frpc reloads them.
+func (s *Service) SetLocalPort(port int) {
+	s.proxyMu.Lock()
+	old := s.cfg.LocalPort
+	if port <= 0 || port == old {
+		s.proxyMu.Unlock()
+		return
+	}
+	s.cfg.LocalPort = port
+	moved := retarget(s.cfg.Proxies, old, port)
+	cfgPath := s.cfgPath
+	s.proxyMu.Unlock()
+	if old == 0 && s.cfg.APIPort != 0 {
+		slog.Info("tunnel: the API's tunnel listener is up", "port", port, "proxies", moved)
+		close(s.portSet) // runLoop writes frpc.toml and starts frpc
+		return
+	}
+	slog.Info("tunnel: API port changed", "from", old, "to", port, "proxies", moved)
+
+	if moved > 0 && cfgPath != "" {
+		if err := s.rewrite(context.Background(), cfgPath); err != nil {
+			slog.Error("tunnel: frpc still points at the old API port", "port", old, "err", err)
+		}
+	}
+}
+
+// retarget points the proxies on local port from at to instead, and
+// returns how many it moved.
+func retarget(proxies []ProxySpec, from, to int) int {
+	if from == to {
+		return 0
+	}
+	n := 0
+	for i := range proxies {
+		if proxies[i].LocalPort == from {
+			proxies[i].LocalPort = to
+			n++
+		}
+	}
+	return n
+}
+
+// rewrite writes frpc.toml from the current proxies and has a running
+// frpc pick it up.
+func (s *Service) rewrite(ctx context.Context, cfgPath string) error {
+	if err := s.writeConfig(cfgPath); err != nil {
+		return err
+	}
+	if s.Status().Running {
+		s.reload(ctx)
+	}
+	return nil
+}
+
+func (s *Service) currentProxies() []ProxySpec {
+	s.proxyMu.Lock()
+	defer s.proxyMu.Unlock()
+	return append([]ProxySpec(nil), s.cfg.Proxies...)
+}
+
+// reload has frpc re-read frpc.toml, and restarts it if it can't.
+func (s *Service) reload(ctx context.Context) {
+	resp, err := s.adminRequest(ctx, "/api/reload")
+	if err == nil {
+		resp.Body.Close()
+		slog.Info("tunnel: frpc reloaded its proxies")
+		return
+	}
+	slog.Warn("tunnel: frpc reload failed, restarting it", "err", err)
+	s.killFrpc()
+}
+
+// killFrpc stops a running frpc; runLoop starts it again.
+func (s *Service) killFrpc() {
+	s.state.mu.Lock()
+	kill := s.state.kill
+	s.state.mu.Unlock()
+	if kill != nil {
+		kill()
+	}
+}
+
+// handleGetProxies lists the proxies. GET /api/tunnel/proxies
+func (s *Service) handleGetProxies(w http.ResponseWriter, r *http.Request) {
+	httputil.OK(w, proxiesDoc{Proxies: s.currentProxies()})
+}
+
+// handleSetProxies replaces the proxies and has frpc pick them up.
+// POST /api/tunnel/proxies {"proxies": [...]}; an empty list restores the
+// default.
+func (s *Service) handleSetProxies(w http.ResponseWriter, r *http.Request) {
+	var req proxiesDoc
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httputil.BadRequest(w, "invalid JSON: "+err.Error())
+		return
+	}
+	proxies, err := s.normalizeProxies(req.Proxies)
+	if err != nil {
+		httputil.BadRequest(w, err.Error())
+		return
+	}
+	names := make([]string, len(proxies))
+	for i, p := range proxies {
+		names[i] = p.Name + "=" + p.Type
+	}
+	audit.Target(r.Context(), strings.Join(names, ","))
+
+	s.proxyMu.Lock()
+	if s.proxiesPath != "" {
+		// Saved on the API's port, as TUNNEL_PROXIES gives it: the
+		// tunnel listener's changes at every start.
+		saved := proxies
+		if s.cfg.APIPort != 0 {
+			saved = slices.Clone(proxies)
+			retarget(saved, s.cfg.LocalPort, s.cfg.APIPort)
+		}
+		if err := statefile.Save(s.proxiesPath, proxiesSchema, proxiesDoc{Proxies: saved}); err != nil {
+			s.proxyMu.Unlock()
+			httputil.InternalError(w, "save proxies: "+err.Error())
+			return
+		}
+	}
+	s.cfg.Proxies = proxies
+	cfgPath := s.cfgPath
+	s.proxyMu.Unlock()
+	slog.Info("tunnel: proxies set", "proxies", names)
+
+	// Before Start there is no frpc.toml yet; Start writes it with these.
+	if cfgPath != "" {
+		if err := s.rewrite(r.Context(), cfgPath); err != nil {
+			httputil.InternalError(w, err.Error())
+			return
+		}
+	}
+	httputil.OK(w, proxiesDoc{Proxies: proxies})
+}
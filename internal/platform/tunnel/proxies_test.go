@@ -0,0 +1,368 @@
+package tunnel
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/strct-org/strct-agent/internal/api"
+	"github.com/strct-org/strct-agent/internal/config"
+	"github.com/strct-org/strct-agent/internal/statefile"
+)
+
+func newProxyService(t *testing.T) *Service {
+	t.Helper()
+	return New(Config{ServerIP: "1.2.3.4", ServerPort: 7000, AuthToken: "tok", DeviceID: "dev1", LocalPort: 8080,
+		TLSCertFile: "/etc/strct/tls.crt", TLSKeyFile: "/etc/strct/tls.key"}, nil)
+}
+
+func TestNormalizeProxies(t *testing.T) {
+	s := newProxyService(t)
+	got, err := s.normalizeProxies([]ProxySpec{
+		{Name: " Web ", Type: "HTTPS", LocalPort: 8080},
+		{Name: "dav", Type: "http", LocalPort: 8080, Subdomain: "files-dev1"},
+		{Name: "ssh", Type: "tcp", LocalPort: 22, RemotePort: 6022},
+		{Name: "ssh-private", Type: "stcp", LocalPort: 22, SecretKey: "s3cret-key"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got[0].Name != "web" || got[0].Type != proxyHTTPS || got[0].Subdomain != "dev1" || got[1].Subdomain != "files-dev1" {
+		t.Errorf("normalized = %+v", got)
+	}
+	if def, _ := s.normalizeProxies(nil); len(def) != 1 || def[0] != (ProxySpec{Name: "web", Type: proxyHTTP, LocalPort: 8080, Subdomain: "dev1"}) {
+		t.Errorf("default = %+v", def)
+	}
+
+	for name, specs := range map[string][]ProxySpec{
+		"duplicate name":      {{Name: "a", Type: "http", LocalPort: 1}, {Name: "A", Type: "tcp", LocalPort: 2, RemotePort: 6000}},
+		"duplicate subdomain": {{Name: "a", Type: "http", LocalPort: 1}, {Name: "b", Type: "https", LocalPort: 2}},
+		"duplicate port":      {{Name: "a", Type: "tcp", LocalPort: 1, RemotePort: 6000}, {Name: "b", Type: "tcp", LocalPort: 2, RemotePort: 6000}},
+		"tcp without port":    {{Name: "a", Type: "tcp", LocalPort: 22}},
+		"stcp without key":    {{Name: "a", Type: "stcp", LocalPort: 22}},
+		"stcp with port":      {{Name: "a", Type: "stcp", LocalPort: 22, RemotePort: 6000, SecretKey: "s3cret-key"}},
+		"http with port":      {{Name: "a", Type: "http", LocalPort: 80, RemotePort: 6000}},
+		"other device":        {{Name: "a", Type: "http", LocalPort: 80, Subdomain: "dev2"}},
+		"bad subdomain":       {{Name: "a", Type: "http", LocalPort: 80, Subdomain: "x.dev1"}},
+		"bad name":            {{Name: "a b", Type: "http", LocalPort: 80}},
+		"bad type":            {{Name: "a", Type: "udp", LocalPort: 53, RemotePort: 53}},
+		"bad local port":      {{Name: "a", Type: "http", LocalPort: 70000}},
+	} {
+		if _, err := s.normalizeProxies(specs); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+
+	s.cfg.TLSCertFile = ""
+	if _, err := s.normalizeProxies([]ProxySpec{{Name: "web", Type: "https", LocalPort: 8080}}); err == nil {
+		t.Error("https accepted without a certificate")
+	}
+}
+
+func TestNormalizeProxies_KeepsTheAPIPortClosed(t *testing.T) {
+	s := newProxyService(t)
+	s.cfg.APIPort, s.cfg.LocalPort = 8080, 41000
+	got, err := s.normalizeProxies([]ProxySpec{
+		{Name: "web", Type: "http", LocalPort: 8080},
+		{Name: "dav", Type: "https", LocalPort: 8080, Subdomain: "dav-dev1"},
+		{Name: "ssh", Type: "tcp", LocalPort: 22, RemotePort: 6022},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got[0].LocalPort != 41000 || got[1].LocalPort != 41000 || got[2].LocalPort != 22 {
+		t.Errorf("normalized = %+v", got)
+	}
+
+	// Through frpc these would reach the API from loopback, off the
+	// tunnel listener, and pass for the device's own requests.
+	for name, p := range map[string]ProxySpec{
+		"tcp to the API":             {Name: "api", Type: "tcp", LocalPort: 8080, RemotePort: 6080},
+		"stcp to the API":            {Name: "api", Type: "stcp", LocalPort: 8080, SecretKey: "s3cret-key"},
+		"tcp to the tunnel listener": {Name: "api", Type: "tcp", LocalPort: 41000, RemotePort: 6080},
+	} {
+		if _, err := s.normalizeProxies([]ProxySpec{p}); err == nil || !strings.Contains(err.Error(), "may not reach the API") {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestWriteConfig_RendersEveryProxy(t *testing.T) {
+	s := newProxyService(t)
+	proxies, err := s.normalizeProxies([]ProxySpec{
+		{Name: "web", Type: "https", LocalPort: 8080},
+		{Name: "dav", Type: "http", LocalPort: 8080, Subdomain: "dav-dev1"},
+		{Name: "ssh", Type: "tcp", LocalPort: 22, RemotePort: 6022},
+		{Name: "vault", Type: "stcp", LocalPort: 8200, SecretKey: "s3cret-key"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.cfg.Proxies = proxies
+	path := filepath.Join(t.TempDir(), "frpc.toml")
+	if err := s.writeConfig(path); err != nil {
+		t.Fatal(err)
+	}
+
+	var doc struct {
+		Transport struct {
+			TLS struct{ Enable bool } `toml:"tls"`
+		} `toml:"transport"`
+		Proxies []struct {
+			Name, Type, Subdomain, SecretKey string
+			LocalPort, RemotePort            int
+			Plugin                           struct{ Type, LocalAddr, CrtPath, KeyPath string }
+		} `toml:"proxies"`
+	}
+	if _, err := toml.DecodeFile(path, &doc); err != nil {
+		b, _ := os.ReadFile(path)
+		t.Fatalf("frpc.toml doesn't parse: %v\n%s", err, b)
+	}
+	if !doc.Transport.TLS.Enable || len(doc.Proxies) != 4 {
+		t.Fatalf("frpc.toml = %+v", doc)
+	}
+	web, dav, ssh, vault := doc.Proxies[0], doc.Proxies[1], doc.Proxies[2], doc.Proxies[3]
+	if web.Name != "web_dev1" || web.Type != "https" || web.Subdomain != "dev1" || web.Plugin.Type != "https2http" ||
+		web.Plugin.LocalAddr != "127.0.0.1:8080" || web.Plugin.CrtPath != "/etc/strct/tls.crt" || web.Plugin.KeyPath != "/etc/strct/tls.key" {
+		t.Errorf("https proxy = %+v", web)
+	}
+	if dav.Name != "dav_dev1" || dav.Type != "http" || dav.LocalPort != 8080 || dav.Subdomain != "dav-dev1" || dav.Plugin.Type != "" {
+		t.Errorf("http proxy = %+v", dav)
+	}
+	if ssh.Type != "tcp" || ssh.LocalPort != 22 || ssh.RemotePort != 6022 || ssh.Subdomain != "" {
+		t.Errorf("tcp proxy = %+v", ssh)
+	}
+	if vault.Type != "stcp" || vault.LocalPort != 8200 || vault.SecretKey != "s3cret-key" || vault.RemotePort != 0 {
+		t.Errorf("stcp proxy = %+v", vault)
+	}
+}
+
+func TestSetProxies_RewritesAndReloads(t *testing.T) {
+	var reloads atomic.Int32
+	reloadFails := false
+	admin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/reload" {
+			reloads.Add(1)
+			if reloadFails {
+				http.Error(w, "proxy [ssh_dev1] remote port unavailable", http.StatusBadRequest)
+			}
+		}
+	}))
+	defer admin.Close()
+	u, _ := url.Parse(admin.URL)
+	port, _ := strconv.Atoi(u.Port())
+
+	s := newProxyService(t)
+	s.cfg.AdminPort = port
+	s.proxiesPath = filepath.Join(t.TempDir(), proxiesFile)
+	s.cfgPath = filepath.Join(t.TempDir(), "frpc.toml")
+	killed := false
+	s.started(42, func() { killed = true })
+	mux := http.NewServeMux()
+	s.RegisterRoutes(mux)
+	post := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("POST", "/api/tunnel/proxies", strings.NewReader(body)))
+		return w
+	}
+
+	if w := post(`{"proxies":[{"name":"ssh","type":"tcp","local_port":22}]}`); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid set: %d %s", w.Code, w.Body)
+	}
+	if _, err := os.Stat(s.cfgPath); !os.IsNotExist(err) || reloads.Load() != 0 {
+		t.Fatal("an invalid set was written or reloaded")
+	}
+
+	w := post(`{"proxies":[{"name":"web","type":"http","local_port":8080},{"name":"ssh","type":"tcp","local_port":22,"remote_port":6022}]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("set: %d %s", w.Code, w.Body)
+	}
+	b, _ := os.ReadFile(s.cfgPath)
+	if !strings.Contains(string(b), `name = "ssh_dev1"`) || !strings.Contains(string(b), "remotePort = 6022") {
+		t.Errorf("frpc.toml:\n%s", b)
+	}
+	if reloads.Load() != 1 || killed {
+		t.Errorf("reloads = %d, killed %v", reloads.Load(), killed)
+	}
+
+	// A reload frpc refuses falls back to a restart.
+	reloadFails = true
+	if w := post(`{"proxies":[{"name":"ssh","type":"tcp","local_port":22,"remote_port":22}]}`); w.Code != http.StatusOK {
+		t.Fatalf("set: %d %s", w.Code, w.Body)
+	}
+	if !killed {
+		t.Error("frpc not restarted after a failed reload")
+	}
+
+	restarted := newProxyService(t)
+	restarted.proxiesPath = s.proxiesPath
+	if err := restarted.loadProxies(); err != nil {
+		t.Fatal(err)
+	}
+	if p := restarted.currentProxies(); len(p) != 1 || p[0].Name != "ssh" || p[0].RemotePort != 22 {
+		t.Errorf("reloaded %+v", p)
+	}
+}
+
+func TestSetProxies_SavedOnTheAPIPort(t *testing.T) {
+	cfg := Config{DeviceID: "dev1", APIPort: 8080}
+	s := New(cfg, nil)
+	s.proxiesPath = filepath.Join(t.TempDir(), proxiesFile)
+	s.SetLocalPort(41000)
+	mux := http.NewServeMux()
+	s.RegisterRoutes(mux)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("POST", "/api/tunnel/proxies", strings.NewReader(
+		`{"proxies":[{"name":"web","type":"http","local_port":41000},{"name":"ssh","type":"tcp","local_port":22,"remote_port":6022}]}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("set: %d %s", w.Code, w.Body)
+	}
+	var doc proxiesDoc
+	if err := statefile.Load(s.proxiesPath, proxiesSchema, &doc); err != nil || doc.Proxies[0].LocalPort != 8080 {
+		t.Errorf("saved %+v, %v", doc, err)
+	}
+
+	// The next start's tunnel listener has another port, and frpc waits
+	// for it.
+	restarted := New(cfg, nil)
+	restarted.proxiesPath = s.proxiesPath
+	select {
+	case <-restarted.portSet:
+		t.Error("frpc may start before the tunnel listener is up")
+	default:
+	}
+	restarted.SetLocalPort(42000)
+	if err := restarted.loadProxies(); err != nil {
+		t.Fatal(err)
+	}
+	if got := restarted.currentProxies(); got[0].LocalPort != 42000 || got[1].LocalPort != 22 {
+		t.Errorf("reloaded %+v", got)
+	}
+}
+
+func TestSetLocalPort_FollowsTheAPI(t *testing.T) {
+	s := newProxyService(t)
+	s.cfg.Proxies = append(s.cfg.Proxies, ProxySpec{Name: "ssh", Type: proxyTCP, LocalPort: 22, RemotePort: 6022})
+	s.cfgPath = filepath.Join(t.TempDir(), "frpc.toml")
+	if err := s.writeConfig(s.cfgPath); err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/health/live", func(w http.ResponseWriter, r *http.Request) {})
+	srv := api.New(api.Config{Port: 0, OnPort: s.SetLocalPort}, mux)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- srv.Start(ctx) }()
+	deadline := time.Now().Add(5 * time.Second)
+	for srv.Port() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the API never listened")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	b, _ := os.ReadFile(s.cfgPath)
+	port := strconv.Itoa(srv.TunnelPort())
+	if !strings.Contains(string(b), "localPort = "+port) || !strings.Contains(string(b), "localPort = 22") || strings.Contains(string(b), "8080") ||
+		strings.Contains(string(b), "localPort = "+strconv.Itoa(srv.Port())) {
+		t.Errorf("frpc.toml after the tunnel listener bound port %s:\n%s", port, b)
+	}
+
+	// The self-test asks the agent before the VPS.
+	var public atomic.Int32
+	vps := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { public.Add(1) }))
+	defer vps.Close()
+	s.cfg.PublicURL = vps.URL
+	s.checkReach(context.Background())
+	if r := s.Status().Reachability; !r.OK || public.Load() != 1 {
+		t.Errorf("with the agent up: %+v, %d public requests", r, public.Load())
+	}
+
+	cancel()
+	<-done
+	s.checkReach(context.Background())
+	if r := s.Status().Reachability; r.OK || r.FailedAt != "local" || !strings.Contains(r.Error, "local port "+port) || public.Load() != 1 {
+		t.Errorf("with the agent down: %+v, %d public requests", r, public.Load())
+	}
+}
+
+func TestSetServer_RestartsFrpcOnTheNewServer(t *testing.T) {
+	s := newProxyService(t)
+	s.cfgPath = filepath.Join(t.TempDir(), "frpc.toml")
+	if err := s.writeConfig(s.cfgPath); err != nil {
+		t.Fatal(err)
+	}
+	killed := false
+	s.started(4242, func() { killed = true })
+
+	s.SetServer("203.0.113.9", 7001, "new-token")
+	b, _ := os.ReadFile(s.cfgPath)
+	if !strings.Contains(string(b), `serverAddr = "203.0.113.9"`) || !strings.Contains(string(b), "serverPort = 7001") ||
+		!strings.Contains(string(b), `auth.token = "new-token"`) {
+		t.Errorf("frpc.toml:\n%s", b)
+	}
+	if !killed {
+		t.Error("frpc kept running on the old server")
+	}
+
+	// Nothing changed, nothing restarted.
+	killed = false
+	s.SetServer("203.0.113.9", 7001, "new-token")
+	if killed {
+		t.Error("restarted for the same server")
+	}
+}
+
+func TestLoadProxies_RetargetsTheBuiltPort(t *testing.T) {
+	s := newProxyService(t)
+	s.proxiesPath = filepath.Join(t.TempDir(), proxiesFile)
+	s.SetLocalPort(9090)
+	if err := statefile.Save(s.proxiesPath, proxiesSchema, proxiesDoc{Proxies: []ProxySpec{
+		{Name: "web", Type: proxyHTTP, LocalPort: 8080},
+		{Name: "ssh", Type: proxyTCP, LocalPort: 22, RemotePort: 6022},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.loadProxies(); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.currentProxies(); got[0].LocalPort != 9090 || got[1].LocalPort != 22 {
+		t.Errorf("proxies = %+v", got)
+	}
+}
+
+func TestNewFromConfig_ConfiguredProxies(t *testing.T) {
+	cfg := &config.Config{DeviceID: "dev1", DataDir: t.TempDir(), TunnelProxies: []config.TunnelProxy{
+		{Name: "Web", Type: "http", LocalPort: config.APIPort},
+		{Name: "ssh", Type: "tcp", LocalPort: 22, RemotePort: 6022},
+	}}
+	s := NewFromConfig(cfg)
+	got := s.currentProxies()
+	if len(got) != 2 || got[0].Name != "web" || got[0].Subdomain != "dev1" || got[1].RemotePort != 6022 {
+		t.Fatalf("proxies = %+v", got)
+	}
+
+	// An empty set restores them, on the port the API moved to.
+	s.SetLocalPort(9090)
+	restored, err := s.normalizeProxies(nil)
+	if err != nil || len(restored) != 2 || restored[0].LocalPort != 9090 || restored[1].LocalPort != 22 {
+		t.Errorf("empty set = %+v, %v", restored, err)
+	}
+
+	// A set that doesn't check out leaves the default proxy.
+	cfg.TunnelProxies = []config.TunnelProxy{{Name: "web", Type: "ftp", LocalPort: 21}}
+	// On no port until the API's tunnel listener is up.
+	if got := NewFromConfig(cfg).currentProxies(); len(got) != 1 || got[0].Type != proxyHTTP || got[0].LocalPort != 0 {
+		t.Errorf("refused set: proxies = %+v", got)
+	}
+}
@@ -0,0 +1,504 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/agent"
+	"github.com/strct-org/strct-agent/internal/config"
+	"github.com/strct-org/strct-agent/internal/httputil"
+	"github.com/strct-org/strct-agent/internal/metrics"
+	"github.com/strct-org/strct-agent/internal/telemetry"
+)
+
+// ─── Tunnel status ───────────────────────────────────────────────────────────
+
+// A frpc process that is running says little about whether the device can
+// be reached: it may be retrying a login frps refuses, or frps may have
+// lost the route. The Service keeps track of three things:
+//
+//   - the process, from runLoop: whether frpc runs, when it last
+//     (re)started, how many times it has been restarted and the restart
+//     backoff (backoff.go);
+//   - the proxies, every adminPoll, from frpc's admin API (webServer in
+//     frpc.toml, on loopback, with a password made at each Start). A proxy
+//     is "running" once frps took it. A frpc with no proxy running for
+//     proxyStuckAfter has lost frps and is restarted; a single proxy that
+//     frps refuses, say for a taken port, is left alone;
+//   - reachability, every reachEvery: PublicURL/api/health/live is requested
+//     from the public side, out through the VPS and back down the tunnel,
+//     and the latency and outcome recorded. The check is counted as tunnel
+//     usage, about a kilobyte a time. The agent on LocalPort is asked
+//     first: if it doesn't answer, the VPS is not to blame, and the public
+//     request is skipped.
+//
+// All three are served at
+//
+//	GET /api/tunnel/status
+const (
+	defaultAdminPort = 7400
+	adminUser        = "strct"
+	adminPoll        = 30 * time.Second
+	proxyStuckAfter  = 3 * time.Minute
+	reachEvery       = 5 * time.Minute
+	reachTimeout     = 10 * time.Second
+)
+
+// ProxyStatus is one proxy as frpc's admin API reports it.
+type ProxyStatus struct {
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	Status     string `json:"status"` // "running" once frps took it, else e.g. "start error"
+	Error      string `json:"error,omitempty"`
+	RemoteAddr string `json:"remote_addr,omitempty"`
+}
+
+// Reachability is the last request to the device from the public side.
+type Reachability struct {
+	URL                 string     `json:"url"`
+	CheckedAt           time.Time  `json:"checked_at"`
+	OK                  bool       `json:"ok"`
+	LatencyMs           float64    `json:"latency_ms,omitempty"`
+	StatusCode          int        `json:"status_code,omitempty"`
+	Error               string     `json:"error,omitempty"`
+	LastOK              *time.Time `json:"last_ok,omitempty"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+
+	// FailedAt says which end failed: "local" when the agent did not
+	// answer on LocalPort, "public" when the request through the VPS did.
+	FailedAt string `json:"failed_at,omitempty"`
+}
+
+// Status is GET /api/tunnel/status.
+type Status struct {
+	Running     bool       `json:"running"`
+	PID         int        `json:"pid,omitempty"`
+	StartedAt   *time.Time `json:"started_at,omitempty"`
+	LastRestart *time.Time `json:"last_restart,omitempty"`
+	Restarts    int        `json:"restarts"`
+	LastExit    string     `json:"last_exit,omitempty"`
+
+	// Breaker is the restart backoff's state: closed, open or half_open.
+	// NextRetry is set while runLoop waits to restart frpc.
+	Breaker             string     `json:"breaker"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	NextRetry           *time.Time `json:"next_retry,omitempty"`
+
+	// Connected is set while frpc runs and every proxy is running.
+	Connected        bool          `json:"connected"`
+	Proxies          []ProxyStatus `json:"proxies"`
+	ProxiesCheckedAt *time.Time    `json:"proxies_checked_at,omitempty"`
+	AdminError       string        `json:"admin_error,omitempty"`
+
+	// FrpcError is the last problem frpc's log names, in plain words;
+	// see output.go. Cleared when frpc logs in.
+	FrpcError   string     `json:"frpc_error,omitempty"`
+	FrpcErrorAt *time.Time `json:"frpc_error_at,omitempty"`
+
+	// Reachability is nil until the first check, and without a
+	// PublicURL.
+	Reachability *Reachability `json:"reachability,omitempty"`
+}
+
+type supervisor struct {
+	mu          sync.Mutex
+	running     bool
+	pid         int
+	startedAt   time.Time
+	lastRestart time.Time
+	starts      int
+	lastExit    string
+	kill        context.CancelFunc // stops the running frpc
+
+	failures    int       // exits in a row without a stable connection
+	nextRetry   time.Time // zero unless waiting to restart
+	connectedAt time.Time // since when a proxy has been running
+
+	proxies   []ProxyStatus
+	proxiesAt time.Time
+	adminErr  string
+	downSince time.Time // since when a running frpc has had no proxy up
+
+	reach *Reachability
+
+	problem   string // from frpc's output
+	problemAt time.Time
+}
+
+// publicURL is where the internet reaches the device: the frps vhost for
+// its subdomain. Empty in dev mode, where there is none.
+func publicURL(cfg *config.Config) string {
+	if cfg.IsDev || cfg.DeviceID == "" || cfg.Domain == "" || cfg.Domain == "localhost" {
+		return ""
+	}
+	return fmt.Sprintf("https://%s.%s", cfg.DeviceID, cfg.Domain)
+}
+
+func newAdminPassword() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// started records that frpc is running as pid; kill stops it.
+func (s *Service) started(pid int, kill context.CancelFunc) {
+	st := &s.state
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	now := time.Now()
+	if st.starts > 0 {
+		st.lastRestart = now
+	}
+	st.starts++
+	st.running, st.pid, st.startedAt, st.kill = true, pid, now, kill
+	st.proxies, st.adminErr = nil, ""
+	st.downSince = now
+	st.nextRetry, st.connectedAt = time.Time{}, time.Time{}
+}
+
+// exited records that frpc stopped, with err unless it was told to.
+func (s *Service) exited(err error) {
+	st := &s.state
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.running, st.pid, st.kill = false, 0, nil
+	if err != nil {
+		st.lastExit = err.Error()
+	}
+}
+
+// supervise polls the admin API and checks reachability until ctx is
+// done.
+func (s *Service) supervise(ctx context.Context) {
+	admin := time.NewTicker(adminPoll)
+	defer admin.Stop()
+	var reach <-chan time.Time
+	if s.cfg.PublicURL != "" {
+		t := time.NewTicker(reachEvery)
+		defer t.Stop()
+		reach = t.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-admin.C:
+			s.pollAdmin(ctx)
+			if s.cfg.PublicURL != "" && s.Status().Reachability == nil {
+				s.checkReach(ctx) // the first one doesn't wait reachEvery
+			}
+		case <-reach:
+			s.checkReach(ctx)
+		}
+	}
+}
+
+// pollAdmin asks frpc for its proxies and restarts it when none has been
+// up for proxyStuckAfter.
+func (s *Service) pollAdmin(ctx context.Context) {
+	proxies, err := s.fetchProxies(ctx)
+	now := time.Now()
+
+	st := &s.state
+	st.mu.Lock()
+	if !st.running {
+		st.mu.Unlock()
+		return
+	}
+	st.proxiesAt = now
+	st.proxies, st.adminErr = proxies, ""
+	if err != nil {
+		st.adminErr = err.Error()
+	}
+	if anyRunning(proxies) {
+		st.downSince = time.Time{}
+		if st.connectedAt.IsZero() {
+			st.connectedAt = now
+		}
+		st.resetIfStableLocked(now)
+	} else {
+		st.connectedAt = time.Time{}
+		if st.downSince.IsZero() {
+			st.downSince = now
+		}
+	}
+	stuck := !st.downSince.IsZero() && now.Sub(st.downSince) >= proxyStuckAfter
+	kill, since := st.kill, st.downSince
+	st.mu.Unlock()
+
+	if stuck && kill != nil {
+		slog.Warn("tunnel: no proxy running, restarting frpc", "since", since, "proxies", proxies, "err", err)
+		kill()
+	}
+}
+
+func anyRunning(proxies []ProxyStatus) bool {
+	for _, p := range proxies {
+		if p.Status == "running" {
+			return true
+		}
+	}
+	return false
+}
+
+func allRunning(proxies []ProxyStatus, err error) bool {
+	if err != nil || len(proxies) == 0 {
+		return false
+	}
+	for _, p := range proxies {
+		if p.Status != "running" {
+			return false
+		}
+	}
+	return true
+}
+
+// adminRequest GETs path from frpc's admin API. The caller closes the
+// body of a 200; anything else is an error.
+func (s *Service) adminRequest(ctx context.Context, path string) (*http.Response, error) {
+	url := fmt.Sprintf("http://127.0.0.1:%d%s", s.cfg.AdminPort, path)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(adminUser, s.adminPass)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		return nil, fmt.Errorf("frpc admin API %s returned %d: %s", path, resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	return resp, nil
+}
+
+// fetchProxies reads GET /api/status from frpc's admin API: the proxies
+// grouped by type.
+func (s *Service) fetchProxies(ctx context.Context) ([]ProxyStatus, error) {
+	resp, err := s.adminRequest(ctx, "/api/status")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var byType map[string][]struct {
+		Name       string `json:"name"`
+		Type       string `json:"type"`
+		Status     string `json:"status"`
+		Err        string `json:"err"`
+		RemoteAddr string `json:"remote_addr"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&byType); err != nil {
+		return nil, fmt.Errorf("decode frpc status: %w", err)
+	}
+	proxies := []ProxyStatus{}
+	for _, ps := range byType {
+		for _, p := range ps {
+			proxies = append(proxies, ProxyStatus{Name: p.Name, Type: p.Type, Status: p.Status, Error: p.Err, RemoteAddr: p.RemoteAddr})
+		}
+	}
+	sort.Slice(proxies, func(i, j int) bool { return proxies[i].Name < proxies[j].Name })
+	return proxies, nil
+}
+
+// checkReach requests PublicURL/api/health/live, once the agent answers
+// locally, and records how it went. /api/health itself answers 503 while
+// the agent is down, which says nothing of the tunnel.
+func (s *Service) checkReach(ctx context.Context) {
+	url := s.cfg.PublicURL + "/api/health/live"
+	r := Reachability{URL: url, CheckedAt: time.Now().UTC()}
+
+	err := s.checkLocal(ctx)
+	if err != nil {
+		r.FailedAt = "local"
+	} else {
+		start := time.Now()
+		var req *http.Request
+		if req, err = http.NewRequestWithContext(ctx, http.MethodGet, url, nil); err == nil {
+			var resp *http.Response
+			if resp, err = s.client.Do(req); err == nil {
+				io.Copy(io.Discard, resp.Body) //nolint:errcheck
+				resp.Body.Close()
+				r.StatusCode = resp.StatusCode
+				r.LatencyMs = float64(time.Since(start).Microseconds()) / 1000
+				if resp.StatusCode != http.StatusOK {
+					err = fmt.Errorf("%s returned %d", url, resp.StatusCode)
+				}
+			}
+		}
+	}
+	if ctx.Err() != nil {
+		return
+	}
+	r.OK = err == nil
+	if err != nil {
+		r.Error = err.Error()
+		if r.FailedAt == "" {
+			r.FailedAt = "public"
+		}
+	}
+
+	st := &s.state
+	st.mu.Lock()
+	prev := st.reach
+	if prev != nil {
+		r.LastOK, r.ConsecutiveFailures = prev.LastOK, prev.ConsecutiveFailures
+	}
+	if r.OK {
+		t := r.CheckedAt
+		r.LastOK, r.ConsecutiveFailures = &t, 0
+	} else {
+		r.ConsecutiveFailures++
+	}
+	st.reach = &r
+	st.mu.Unlock()
+
+	switch {
+	case !r.OK && (prev == nil || prev.OK || prev.FailedAt != r.FailedAt):
+		if r.FailedAt == "local" {
+			slog.Warn("tunnel: the agent does not answer on its local port; the tunnel has nothing to reach", "err", err)
+		} else {
+			slog.Warn("tunnel: device not reachable from the internet", "url", url, "err", err)
+		}
+	case r.OK && prev != nil && !prev.OK:
+		slog.Info("tunnel: device reachable from the internet again", "url", url, "latency_ms", r.LatencyMs)
+	}
+}
+
+// checkLocal requests the agent's /api/health/live on LocalPort, where frpc
+// sends the tunnel's requests. Without a LocalPort there is nothing to
+// check.
+func (s *Service) checkLocal(ctx context.Context) error {
+	port := s.localPort()
+	if port == 0 {
+		return nil
+	}
+	url := fmt.Sprintf("http://127.0.0.1:%d/api/health/live", port)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("the agent on local port %d: %w", port, err)
+	}
+	io.Copy(io.Discard, resp.Body) //nolint:errcheck
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("the agent on local port %d returned %d", port, resp.StatusCode)
+	}
+	return nil
+}
+
+// Status reports frpc's process, its proxies and the last reachability
+// check.
+func (s *Service) Status() Status {
+	st := &s.state
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	out := Status{
+		Running:    st.running,
+		PID:        st.pid,
+		Restarts:   max(st.starts-1, 0),
+		LastExit:   st.lastExit,
+		Proxies:    append([]ProxyStatus{}, st.proxies...),
+		AdminError: st.adminErr,
+
+		Breaker:             st.breakerLocked(),
+		ConsecutiveFailures: st.failures,
+	}
+	if !st.nextRetry.IsZero() {
+		t := st.nextRetry
+		out.NextRetry = &t
+	}
+	out.Connected = st.running && allRunning(st.proxies, nil) && st.adminErr == ""
+	if st.running {
+		t := st.startedAt
+		out.StartedAt = &t
+	}
+	if !st.lastRestart.IsZero() {
+		t := st.lastRestart
+		out.LastRestart = &t
+	}
+	if !st.proxiesAt.IsZero() {
+		t := st.proxiesAt
+		out.ProxiesCheckedAt = &t
+	}
+	if st.reach != nil {
+		r := *st.reach
+		out.Reachability = &r
+	}
+	if st.problem != "" {
+		t := st.problemAt
+		out.FrpcError, out.FrpcErrorAt = st.problem, &t
+	}
+	return out
+}
+
+// RegisterMetrics exports whether frpc runs and whether its proxies are
+// up.
+func (s *Service) RegisterMetrics(g metrics.Gauges) {
+	g.GaugeFunc("strct_tunnel_running", "1 while frpc runs.", func() float64 {
+		return metrics.Bool(s.Status().Running)
+	})
+	g.GaugeFunc("strct_tunnel_up", "1 while frpc runs and every proxy is running.", func() float64 {
+		return metrics.Bool(s.Status().Connected)
+	})
+}
+
+// TelemetryFeature reports whether frpc runs, for usage statistics.
+func (s *Service) TelemetryFeature() (string, telemetry.Feature) {
+	return "tunnel", telemetry.Feature{Enabled: s.Status().Running}
+}
+
+// Health reports whether frpc is connected and the device reachable
+// through it. The LAN works without the tunnel, so it is not critical.
+func (s *Service) Health() agent.ComponentHealth {
+	st := s.Status()
+	h := agent.ComponentHealth{Name: "tunnel", Status: agent.HealthOK, Message: "connected"}
+	switch {
+	case !st.Running:
+		h.Status, h.Message = agent.HealthDown, "frpc is not running"
+		if st.FrpcError != "" {
+			h.Message += ": " + st.FrpcError
+		} else if st.LastExit != "" {
+			h.Message += ": " + st.LastExit
+		}
+		if st.NextRetry != nil {
+			h.Message += "; retrying at " + st.NextRetry.UTC().Format(time.RFC3339)
+		}
+	case !st.Connected:
+		h.Status, h.Message = agent.HealthDegraded, "frpc is running, but not every proxy is up"
+		if st.FrpcError != "" {
+			h.Message += ": " + st.FrpcError
+		}
+	case st.Reachability != nil && !st.Reachability.OK:
+		h.Status, h.Message = agent.HealthDegraded, "connected, but not reachable from the internet: "+st.Reachability.Error
+	}
+	return h
+}
+
+func (s *Service) RegisterRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/tunnel/status", s.handleStatus)
+	mux.HandleFunc("GET /api/tunnel/logs", s.out.lines.HandleLogs)
+	mux.HandleFunc("GET /api/tunnel/proxies", s.handleGetProxies)
+	mux.HandleFunc("POST /api/tunnel/proxies", s.handleSetProxies)
+}
+
+// handleStatus reports the tunnel. GET /api/tunnel/status
+func (s *Service) handleStatus(w http.ResponseWriter, r *http.Request) {
+	httputil.OK(w, s.Status())
+}
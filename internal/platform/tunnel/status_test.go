@@ -0,0 +1,161 @@
+package tunnel
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/metrics"
+)
+
+// newAdminService returns a Service whose frpc is "running" with its admin
+// API served by h.
+func newAdminService(t *testing.T, h http.HandlerFunc) (*Service, *bool) {
+	t.Helper()
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	u, _ := url.Parse(srv.URL)
+	port, _ := strconv.Atoi(u.Port())
+
+	s := New(Config{AdminPort: port}, nil)
+	s.adminPass = "pw"
+	killed := new(bool)
+	s.started(42, func() { *killed = true })
+	return s, killed
+}
+
+func TestPollAdmin_ReadsProxies(t *testing.T) {
+	s, killed := newAdminService(t, func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != adminUser || pass != "pw" || r.URL.Path != "/api/status" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"http":[{"name":"web_dev","type":"http","status":"running","err":"","remote_addr":"dev.strct.org:80"}],"tcp":[]}`))
+	})
+
+	s.pollAdmin(context.Background())
+	st := s.Status()
+	if !st.Running || st.PID != 42 || !st.Connected || st.AdminError != "" || st.ProxiesCheckedAt == nil {
+		t.Fatalf("status = %+v", st)
+	}
+	if len(st.Proxies) != 1 || st.Proxies[0] != (ProxyStatus{Name: "web_dev", Type: "http", Status: "running", RemoteAddr: "dev.strct.org:80"}) {
+		t.Errorf("proxies = %+v", st.Proxies)
+	}
+	if *killed {
+		t.Error("a running proxy restarted frpc")
+	}
+}
+
+func TestPollAdmin_RestartsStuckProxy(t *testing.T) {
+	s, killed := newAdminService(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"http":[{"name":"web_dev","type":"http","status":"start error","err":"router config conflict"}]}`))
+	})
+
+	s.pollAdmin(context.Background())
+	if st := s.Status(); st.Connected || st.Proxies[0].Error != "router config conflict" || *killed {
+		t.Fatalf("status = %+v, killed %v", st, *killed)
+	}
+
+	s.state.mu.Lock()
+	s.state.downSince = time.Now().Add(-proxyStuckAfter)
+	s.state.mu.Unlock()
+	s.pollAdmin(context.Background())
+	if !*killed {
+		t.Fatal("frpc not restarted after proxyStuckAfter")
+	}
+
+	s.exited(nil)
+	s.started(43, func() {})
+	if st := s.Status(); st.Restarts != 1 || st.LastRestart == nil || st.PID != 43 || len(st.Proxies) != 0 {
+		t.Errorf("after the restart = %+v", st)
+	}
+}
+
+func TestPollAdmin_AdminUnreachable(t *testing.T) {
+	s := New(Config{AdminPort: 1}, nil)
+	s.started(42, func() {})
+	s.pollAdmin(context.Background())
+	if st := s.Status(); st.Connected || st.AdminError == "" {
+		t.Errorf("status = %+v", st)
+	}
+}
+
+func TestCheckReach(t *testing.T) {
+	code := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/health/live" {
+			code = http.StatusNotFound
+		}
+		w.WriteHeader(code)
+	}))
+	defer srv.Close()
+	s := New(Config{PublicURL: srv.URL}, nil)
+
+	s.checkReach(context.Background())
+	r := s.Status().Reachability
+	if r == nil || !r.OK || r.StatusCode != 200 || r.LatencyMs <= 0 || r.LastOK == nil || r.URL != srv.URL+"/api/health/live" {
+		t.Fatalf("reachability = %+v", r)
+	}
+
+	code = http.StatusBadGateway
+	s.checkReach(context.Background())
+	s.checkReach(context.Background())
+	r2 := s.Status().Reachability
+	if r2.OK || r2.StatusCode != 502 || r2.ConsecutiveFailures != 2 || r2.Error == "" || !r2.LastOK.Equal(*r.LastOK) {
+		t.Errorf("after failures = %+v", r2)
+	}
+}
+
+func TestWriteConfig_AdminAPI(t *testing.T) {
+	s := New(Config{ServerIP: "1.2.3.4", ServerPort: 7000, AuthToken: "tok", DeviceID: "dev", LocalPort: 8080}, nil)
+	s.adminPass = "secret"
+	path := filepath.Join(t.TempDir(), "frpc.toml")
+	if err := s.writeConfig(path); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := os.ReadFile(path)
+	for _, want := range []string{`webServer.addr = "127.0.0.1"`, "webServer.port = 7400", `webServer.user = "strct"`, `webServer.password = "secret"`} {
+		if !strings.Contains(string(b), want) {
+			t.Errorf("frpc.toml lacks %q:\n%s", want, b)
+		}
+	}
+}
+
+func TestStatusRoute(t *testing.T) {
+	s := New(Config{}, nil)
+	mux := http.NewServeMux()
+	s.RegisterRoutes(mux)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/api/tunnel/status", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"running":false`) {
+		t.Errorf("GET /api/tunnel/status: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestRegisterMetrics(t *testing.T) {
+	s := New(Config{}, nil)
+	reg := metrics.NewRegistry()
+	reg.Register(s)
+	scrape := func() string {
+		var b strings.Builder
+		reg.WriteText(&b) //nolint:errcheck
+		return b.String()
+	}
+	if out := scrape(); !strings.Contains(out, "strct_tunnel_running 0") || !strings.Contains(out, "strct_tunnel_up 0") {
+		t.Errorf("before start:\n%s", out)
+	}
+	s.started(42, func() {})
+	s.state.mu.Lock()
+	s.state.proxies = []ProxyStatus{{Name: "web_dev", Status: "running"}}
+	s.state.mu.Unlock()
+	if out := scrape(); !strings.Contains(out, "strct_tunnel_running 1") || !strings.Contains(out, "strct_tunnel_up 1") {
+		t.Errorf("connected:\n%s", out)
+	}
+}
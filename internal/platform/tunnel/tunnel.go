@@ -5,11 +5,16 @@ package tunnel
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"html/template"
 	"log/slog"
+	"math/rand/v2"
+	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
+	"sync"
 	"time"
 
 	"github.com/strct-org/strct-agent/internal/config"
@@ -39,72 +44,220 @@ type Config struct {
 	AuthToken  string
 	DeviceID   string
 	DataDir    string
-	LocalPort  int
+	// LocalPort is where frpc reaches the agent: the API's tunnel
+	// listener, once SetLocalPort says where it is. While it is 0 and
+	// APIPort is set, frpc is not started.
+	LocalPort int
+	// APIPort is the API's own port. No proxy reaches it, since requests
+	// there pass for the device's own: http and https proxies aimed at it
+	// go to LocalPort instead, and tcp and stcp ones are refused. 0 checks
+	// nothing.
+	APIPort int
+
+	// AdminPort is where frpc's admin API listens, on loopback; see
+	// status.go. 0 takes defaultAdminPort.
+	AdminPort int
+	// PublicURL is the device as the internet reaches it, checked
+	// through the tunnel. Empty: not checked.
+	PublicURL string
+
+	// Proxies are what frpc exposes; see proxies.go. Empty takes the
+	// default, the agent on LocalPort at the device's subdomain.
+	// TLSCertFile and TLSKeyFile serve https proxies.
+	Proxies     []ProxySpec
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// AutoDownload fetches a missing frpc from MirrorURL; see
+	// provision.go. "" takes config.DefaultFRPCMirrorURL.
+	AutoDownload bool
+	MirrorURL    string
 }
 
 // Service manages the frpc child process lifecycle.
 type Service struct {
 	cfg    Config
 	runner processRunner
+
+	restartDelay time.Duration  // the first wait; see backoff.go
+	jitter       func() float64 // in [0, 1)
+	adminPass    string         // for frpc's admin API, new on every Start
+	client       *http.Client
+	state        supervisor // see status.go
+	out          *output    // frpc's stdout and stderr
+
+	downloads *http.Client      // frp releases; provision sets a deadline
+	checksums map[string]string // asset → SHA-256
+
+	proxyMu     sync.Mutex // guards cfg.Proxies, cfg.LocalPort and cfgPath
+	proxiesPath string     // "": not saved
+	cfgPath     string     // frpc.toml, once Start wrote it
+	builtPort   int        // cfg.LocalPort as New got it
+
+	portSet chan struct{} // closed once cfg.LocalPort is known; see runLoop
+
+	configured []ProxySpec // TUNNEL_PROXIES, checked; nil: the default proxy
+
+	loops sync.WaitGroup // runLoop and supervise; see Stop
 }
 
 // New is the base constructor. Use NewFromConfig in application code.
 // Pass executil.Real{} for runner in production.
 func New(cfg Config, runner processRunner) *Service {
-	return &Service{cfg: cfg, runner: runner}
+	if cfg.AdminPort == 0 {
+		cfg.AdminPort = defaultAdminPort
+	}
+	if len(cfg.Proxies) == 0 {
+		cfg.Proxies = defaultProxies(cfg.LocalPort, cfg.DeviceID)
+	}
+	if cfg.MirrorURL == "" {
+		cfg.MirrorURL = config.DefaultFRPCMirrorURL
+	}
+	s := &Service{
+		cfg:          cfg,
+		runner:       runner,
+		restartDelay: 5 * time.Second,
+		jitter:       rand.Float64,
+		client:       &http.Client{Timeout: reachTimeout},
+		downloads:    &http.Client{},
+		checksums:    parseChecksums(pinnedChecksums),
+		builtPort:    cfg.LocalPort,
+		portSet:      make(chan struct{}),
+	}
+	if cfg.LocalPort != 0 || cfg.APIPort == 0 {
+		close(s.portSet)
+	}
+	s.out = newOutput(s)
+	return s
 }
 
 // NewFromConfig constructs a Service from the global application config.
 // This is what main.go calls — it injects the real OS runner automatically.
 func NewFromConfig(cfg *config.Config) *Service {
-	return New(
+	s := New(
 		Config{
-			ServerIP:   cfg.VPSIP,
-			ServerPort: cfg.VPSPort,
-			AuthToken:  cfg.AuthToken,
-			DeviceID:   cfg.DeviceID,
-			DataDir:    cfg.DataDir,
-			LocalPort:  8080,
+			ServerIP:    cfg.VPSIP,
+			ServerPort:  cfg.VPSPort,
+			AuthToken:   cfg.Secret(config.SecretAuthToken),
+			DeviceID:    cfg.DeviceID,
+			DataDir:     cfg.DataDir,
+			APIPort:     config.APIPort,
+			PublicURL:   publicURL(cfg),
+			TLSCertFile: cfg.TLSCertFile,
+			TLSKeyFile:  cfg.TLSKeyFile,
+
+			AutoDownload: cfg.FRPCAutoDownload,
+			MirrorURL:    cfg.FRPCMirrorURL,
 		},
 		executil.Real{}, // production: real os/exec
 	)
+	s.proxiesPath = filepath.Join(cfg.DataDir, proxiesFile)
+	if len(cfg.TunnelProxies) > 0 {
+		specs := make([]ProxySpec, len(cfg.TunnelProxies))
+		for i, p := range cfg.TunnelProxies {
+			specs[i] = ProxySpec(p)
+		}
+		if proxies, err := s.normalizeProxies(specs); err != nil {
+			slog.Warn("tunnel: TUNNEL_PROXIES refused, using the default proxy", "err", err)
+		} else {
+			s.configured, s.cfg.Proxies = proxies, slices.Clone(proxies)
+		}
+	}
+	return s
 }
 
+func (s *Service) Name() string { return "tunnel" }
+
 func (s *Service) Start(ctx context.Context) error {
 	projectRoot, err := os.Getwd()
 	if err != nil {
 		return fmt.Errorf("tunnel: could not determine working directory: %w", err)
 	}
 
-	frpcBinary := filepath.Join(projectRoot, "frpc")
 	frpcConfig := filepath.Join(s.cfg.DataDir, "frpc.toml")
 
-	// Fail fast if the binary isn't present — no point proceeding.
-	if _, err := os.Stat(frpcBinary); os.IsNotExist(err) {
-		slog.Error("tunnel: frpc binary missing",
-			"path", frpcBinary,
-			"hint", "wget https://github.com/fatedier/frp/releases/download/v0.61.0/frp_0.61.0_linux_arm64.tar.gz",
-		)
-		return fmt.Errorf("tunnel: frpc binary not found at %s", frpcBinary)
+	// Fail fast if the binary isn't present and can't be downloaded — no
+	// point proceeding.
+	frpcBinary, err := s.findBinary(ctx, projectRoot)
+	if err != nil {
+		return err
 	}
 
+	pass, err := newAdminPassword()
+	if err != nil {
+		return fmt.Errorf("tunnel: could not generate admin password: %w", err)
+	}
+	s.adminPass = pass
+	if err := s.loadProxies(); err != nil {
+		slog.Warn("tunnel: using the default proxies", "err", err)
+	}
 	if err := s.writeConfig(frpcConfig); err != nil {
 		return err
 	}
+	s.proxyMu.Lock()
+	s.cfgPath = frpcConfig
+	s.proxyMu.Unlock()
 
 	// chmod +x — use the injected runner so tests don't need a real binary.
-	if err := s.runner.Run("chmod", "+x", frpcBinary); err != nil {
-		// Non-fatal: binary might already be executable.
-		slog.Warn("tunnel: could not chmod binary", "path", frpcBinary, "err", err)
+	// Skipped when it already is: a downloaded frpc must stay 0700.
+	if info, err := os.Stat(frpcBinary); err != nil || info.Mode().Perm()&0100 == 0 {
+		if err := s.runner.Run("chmod", "+x", frpcBinary); err != nil {
+			// Non-fatal: binary might already be executable.
+			slog.Warn("tunnel: could not chmod binary", "path", frpcBinary, "err", err)
+		}
 	}
 
-	go s.runLoop(ctx, frpcBinary, frpcConfig)
+	s.loops.Add(2)
+	go func() {
+		defer s.loops.Done()
+		s.runLoop(ctx, frpcBinary, frpcConfig)
+	}()
+	go func() {
+		defer s.loops.Done()
+		s.supervise(ctx)
+	}()
 	return nil
 }
 
-// runLoop runs frpc and restarts it if it exits unexpectedly.
+// Stop waits for frpc to be killed and the loops to return once Start's
+// context is done, so a restart does not race the old frpc for the
+// admin port.
+func (s *Service) Stop(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.loops.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// runLoop runs frpc, once LocalPort is known, and restarts it if it exits
+// unexpectedly, backing off while it keeps failing; see backoff.go.
 // It exits cleanly when ctx is cancelled.
 func (s *Service) runLoop(ctx context.Context, binary, cfgPath string) {
+	select {
+	case <-s.portSet:
+	default:
+		slog.Info("tunnel: waiting for the API's tunnel listener")
+		select {
+		case <-ctx.Done():
+			slog.Info("tunnel: stopped")
+			return
+		case <-s.portSet:
+		}
+	}
+	if s.builtPort == 0 && s.cfg.APIPort != 0 {
+		// Start wrote frpc.toml before SetLocalPort could have.
+		if err := s.writeConfig(cfgPath); err != nil {
+			slog.Error("tunnel: frpc not started", "err", err)
+			return
+		}
+	}
 	for {
 		// Check for cancellation before each attempt.
 		select {
@@ -123,25 +276,37 @@ func (s *Service) runLoop(ctx context.Context, binary, cfgPath string) {
 		// If you ever need to test runLoop, you can extract this into a
 		// "processLauncher" interface with a single RunContext method.
 		// For now, keeping it simple is the right call.
-		cmd := newCommand(ctx, binary, "-c", cfgPath)
-
-		if err := cmd.Run(); err != nil {
-			if ctx.Err() != nil {
-				// Context was cancelled — this exit was expected.
-				slog.Info("tunnel: frpc stopped by context cancellation")
-				return
-			}
-			slog.Error("tunnel: frpc exited unexpectedly, restarting",
-				"err", err,
-				"delay", "5s",
-			)
+		// runCtx is also cancelled by the supervisor to restart a frpc
+		// whose proxy is stuck; see status.go.
+		runCtx, kill := context.WithCancel(ctx)
+		cmd := newCommand(runCtx, s.out, binary, "-c", cfgPath)
+
+		err := cmd.Start()
+		if err == nil {
+			s.started(cmd.Process.Pid, kill)
+			err = cmd.Wait()
+		}
+		s.out.flush()
+		kill()
+		if ctx.Err() != nil {
+			// Context was cancelled — this exit was expected.
+			s.exited(nil)
+			slog.Info("tunnel: frpc stopped by context cancellation")
+			return
+		}
+		if err == nil {
+			err = errors.New("exited without an error")
 		}
+		s.exited(err)
+		delay := s.failed(err)
 
 		// Wait before restarting, but wake immediately if ctx is cancelled.
+		t := time.NewTimer(delay)
 		select {
 		case <-ctx.Done():
+			t.Stop()
 			return
-		case <-time.After(5 * time.Second):
+		case <-t.C:
 		}
 	}
 }
@@ -156,44 +321,108 @@ func (s *Service) writeConfig(path string) error {
 		panic(fmt.Sprintf("tunnel: frpc config template is invalid: %v", err))
 	}
 
+	s.proxyMu.Lock()
+	serverIP, serverPort, token := s.cfg.ServerIP, s.cfg.ServerPort, s.cfg.AuthToken
+	s.proxyMu.Unlock()
+
 	var buf bytes.Buffer
 	if err := tmpl.Execute(&buf, templateData{
-		ServerIP:   s.cfg.ServerIP,
-		ServerPort: s.cfg.ServerPort,
-		Token:      s.cfg.AuthToken,
-		DeviceID:   s.cfg.DeviceID,
-		LocalPort:  s.cfg.LocalPort,
+		ServerIP:    serverIP,
+		ServerPort:  serverPort,
+		Token:       token,
+		DeviceID:    s.cfg.DeviceID,
+		AdminPort:   s.cfg.AdminPort,
+		AdminUser:   adminUser,
+		AdminPass:   s.adminPass,
+		Proxies:     s.currentProxies(),
+		TLSCertFile: s.cfg.TLSCertFile,
+		TLSKeyFile:  s.cfg.TLSKeyFile,
 	}); err != nil {
 		return fmt.Errorf("tunnel: could not render frpc config: %w", err)
 	}
 
-	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+	// 0600: it holds the auth token, and the file worker treats 0600
+	// files at the top of DataDir as agent state it must not touch.
+	if err := os.WriteFile(path, buf.Bytes(), 0600); err != nil {
 		return fmt.Errorf("tunnel: could not write frpc config to %s: %w", path, err)
 	}
 
 	slog.Info("tunnel: config written",
 		"path", path,
 		"deviceID", s.cfg.DeviceID,
-		"server", fmt.Sprintf("%s:%d", s.cfg.ServerIP, s.cfg.ServerPort),
+		"server", fmt.Sprintf("%s:%d", serverIP, serverPort),
 	)
 	return nil
 }
 
+// SetServer is the frps server and token to connect with from now on, as
+// after a config reload. frpc.toml is rewritten and a running frpc is
+// restarted on it: frpc's own reload only picks up proxies.
+func (s *Service) SetServer(ip string, port int, token string) {
+	s.proxyMu.Lock()
+	if ip == s.cfg.ServerIP && port == s.cfg.ServerPort && token == s.cfg.AuthToken {
+		s.proxyMu.Unlock()
+		return
+	}
+	s.cfg.ServerIP, s.cfg.ServerPort, s.cfg.AuthToken = ip, port, token
+	cfgPath := s.cfgPath
+	s.proxyMu.Unlock()
+	slog.Info("tunnel: server changed", "server", fmt.Sprintf("%s:%d", ip, port))
+
+	if cfgPath == "" {
+		return // Start writes it
+	}
+	if err := s.writeConfig(cfgPath); err != nil {
+		slog.Error("tunnel: frpc still connects to the old server", "err", err)
+		return
+	}
+	s.killFrpc()
+}
+
 type templateData struct {
-	ServerIP   string
-	Token      string
-	DeviceID   string
-	ServerPort int
-	LocalPort  int
+	ServerIP    string
+	Token       string
+	DeviceID    string
+	ServerPort  int
+	AdminPort   int
+	AdminUser   string
+	AdminPass   string
+	Proxies     []ProxySpec
+	TLSCertFile string
+	TLSKeyFile  string
 }
 
 const frpConfigTmpl = `serverAddr = "{{.ServerIP}}"
 serverPort = {{.ServerPort}}
 auth.token = "{{.Token}}"
+transport.tls.enable = true
+log.to = "console"
+log.disablePrintColor = true
 
+webServer.addr = "127.0.0.1"
+webServer.port = {{.AdminPort}}
+webServer.user = "{{.AdminUser}}"
+webServer.password = "{{.AdminPass}}"
+{{range .Proxies}}
 [[proxies]]
-name = "web_{{.DeviceID}}"
-type = "http"
+name = "{{.Name}}_{{$.DeviceID}}"
+type = "{{.Type}}"
+{{- if eq .Type "https"}}
+subdomain = "{{.Subdomain}}"
+
+[proxies.plugin]
+type = "https2http"
+localAddr = "127.0.0.1:{{.LocalPort}}"
+crtPath = "{{$.TLSCertFile}}"
+keyPath = "{{$.TLSKeyFile}}"
+{{- else}}
 localPort = {{.LocalPort}}
-subdomain = "{{.DeviceID}}"
-`
+{{- end}}
+{{- if eq .Type "http"}}
+subdomain = "{{.Subdomain}}"
+{{- else if eq .Type "tcp"}}
+remotePort = {{.RemotePort}}
+{{- else if eq .Type "stcp"}}
+secretKey = "{{.SecretKey}}"
+{{- end}}
+{{end}}`
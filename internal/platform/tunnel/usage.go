@@ -0,0 +1,431 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/config"
+	"github.com/strct-org/strct-agent/internal/httputil"
+	"github.com/strct-org/strct-agent/internal/humanize"
+	"github.com/strct-org/strct-agent/internal/metrics"
+	"github.com/strct-org/strct-agent/internal/statefile"
+)
+
+// ─── Tunnel usage ────────────────────────────────────────────────────────────
+
+// Usage counts the bytes that reach the agent through the tunnel, per day,
+// so a metered VPS or mobile uplink doesn't run over unnoticed. frpc keeps
+// no per-proxy traffic counters of its own (frps does, on the VPS), so the
+// counting happens here, around the API handler: a request is tunnel-origin
+// when frpc delivered it, on the API's tunnel listener (httputil.FromTunnel).
+//
+//	GET /api/tunnel/usage?month=2024-06   per-day bytes and the month total
+//
+// With a monthly budget set, crossing 80% and 100% of it is logged once per
+// month and shown on /api/health. If BlockDownloads is on, file downloads
+// through the tunnel are refused once the budget is used up; everything
+// else, the API that manages the device included, keeps working.
+const (
+	usageFile = "tunnel-usage.json"
+	// usageKeepDays is how much history is kept: this month and the last
+	// twelve, whatever their lengths.
+	usageKeepDays = 400
+	usageFlush    = time.Minute
+	dayLayout     = "2006-01-02"
+	monthLayout   = "2006-01"
+)
+
+// budgetThresholds are the percentages of the budget that are warned about.
+var budgetThresholds = []int{80, 100}
+
+// downloadPaths are the routes that stop through the tunnel once the
+// budget is used up. They are the ones that move whole files out.
+var downloadPaths = []string{"/api/download", "/files/", "/share/", "/dav/"}
+
+// usageSchema versions tunnel-usage.json.
+//
+//	v1: usageState as-is
+var usageSchema = statefile.Schema{
+	Name:       "tunnel-usage",
+	Migrations: []statefile.Migration{statefile.Stamp},
+}
+
+var (
+	bytesIn  = metrics.NewCounter("strct_tunnel_bytes_total", "Bytes through the tunnel by direction.", "direction", "in")
+	bytesOut = metrics.NewCounter("strct_tunnel_bytes_total", "Bytes through the tunnel by direction.", "direction", "out")
+)
+
+// DayUsage is one day's tunnel traffic, in the device's local time.
+type DayUsage struct {
+	Date     string `json:"date"`
+	BytesIn  int64  `json:"bytes_in"`  // requests, uploads included
+	BytesOut int64  `json:"bytes_out"` // responses, downloads included
+	Requests int64  `json:"requests"`
+}
+
+func (d DayUsage) total() int64 { return d.BytesIn + d.BytesOut }
+
+// MonthUsage is the response of GET /api/tunnel/usage.
+type MonthUsage struct {
+	Month    string     `json:"month"`
+	Days     []DayUsage `json:"days"` // every day of the month, up to today
+	BytesIn  int64      `json:"bytes_in"`
+	BytesOut int64      `json:"bytes_out"`
+	Total    int64      `json:"total_bytes"`
+	Requests int64      `json:"requests"`
+	// Budget is the monthly budget in bytes, 0 if none is set.
+	Budget      int64   `json:"budget_bytes"`
+	UsedPercent float64 `json:"used_percent,omitempty"`
+	// DownloadsBlocked is set while downloads through the tunnel are
+	// refused for this month.
+	DownloadsBlocked bool `json:"downloads_blocked"`
+}
+
+type usageState struct {
+	Days []DayUsage `json:"days"`
+	// Warned is the highest threshold already warned about, per month.
+	Warned map[string]int `json:"warned"`
+}
+
+type UsageConfig struct {
+	DataDir string
+	// Budget is the monthly allowance in bytes, in and out together.
+	// 0 means no budget.
+	Budget int64
+	// BlockDownloads refuses file downloads through the tunnel once the
+	// month's budget is used up.
+	BlockDownloads bool
+}
+
+// Usage meters tunnel traffic. It is an agent service: Start keeps the
+// counters on disk until shutdown.
+type Usage struct {
+	cfg UsageConfig
+	now func() time.Time
+
+	mu     sync.Mutex
+	days   map[string]*DayUsage
+	warned map[string]int
+	dirty  bool
+}
+
+func NewUsage(cfg UsageConfig) *Usage {
+	u := &Usage{
+		cfg:    cfg,
+		now:    time.Now,
+		days:   map[string]*DayUsage{},
+		warned: map[string]int{},
+	}
+	u.load()
+	return u
+}
+
+// NewUsageFromConfig builds the meter for the agent's own tunnel.
+func NewUsageFromConfig(cfg *config.Config) *Usage {
+	return NewUsage(UsageConfig{
+		DataDir:        cfg.DataDir,
+		Budget:         int64(cfg.TunnelBudgetGB * (1 << 30)),
+		BlockDownloads: cfg.TunnelBlockDownloads,
+	})
+}
+
+func (u *Usage) path() string {
+	return filepath.Join(u.cfg.DataDir, usageFile)
+}
+
+func (u *Usage) load() {
+	var st usageState
+	if err := statefile.Load(u.path(), usageSchema, &st); err != nil && !statefile.Fresh(err) {
+		slog.Warn("tunnel: could not load usage, starting from zero", "err", err)
+		return
+	}
+	for i := range st.Days {
+		d := st.Days[i]
+		u.days[d.Date] = &d
+	}
+	for month, pct := range st.Warned {
+		u.warned[month] = pct
+	}
+}
+
+// Start writes the counters out every minute and once more on shutdown.
+func (u *Usage) Start(ctx context.Context) error {
+	t := time.NewTicker(usageFlush)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			u.save()
+			return nil
+		case <-t.C:
+			u.save()
+		}
+	}
+}
+
+func (u *Usage) save() {
+	u.mu.Lock()
+	if !u.dirty {
+		u.mu.Unlock()
+		return
+	}
+	cutoff := u.now().AddDate(0, 0, -usageKeepDays).Format(dayLayout)
+	st := usageState{Days: []DayUsage{}, Warned: map[string]int{}}
+	for date, d := range u.days {
+		if date < cutoff {
+			delete(u.days, date)
+			continue
+		}
+		st.Days = append(st.Days, *d)
+	}
+	for month, pct := range u.warned {
+		if month+"-31" >= cutoff {
+			st.Warned[month] = pct
+		}
+	}
+	u.dirty = false
+	u.mu.Unlock()
+
+	sort.Slice(st.Days, func(i, j int) bool { return st.Days[i].Date < st.Days[j].Date })
+	if err := statefile.Save(u.path(), usageSchema, st); err != nil {
+		slog.Error("tunnel: could not save usage", "err", err)
+		u.mu.Lock()
+		u.dirty = true
+		u.mu.Unlock()
+	}
+}
+
+// record adds one request's bytes to today's counters and warns the first
+// time the month crosses a budget threshold.
+func (u *Usage) record(in, out int64) {
+	bytesIn.Add(uint64(in))
+	bytesOut.Add(uint64(out))
+
+	now := u.now()
+	date, month := now.Format(dayLayout), now.Format(monthLayout)
+
+	u.mu.Lock()
+	d, ok := u.days[date]
+	if !ok {
+		d = &DayUsage{Date: date}
+		u.days[date] = d
+	}
+	d.BytesIn += in
+	d.BytesOut += out
+	d.Requests++
+	u.dirty = true
+
+	var crossed int
+	var used int64
+	if u.cfg.Budget > 0 {
+		used = u.monthTotalLocked(month)
+		for _, pct := range budgetThresholds {
+			if used*100 >= u.cfg.Budget*int64(pct) && u.warned[month] < pct {
+				crossed = pct
+			}
+		}
+		if crossed > 0 {
+			u.warned[month] = crossed
+		}
+	}
+	u.mu.Unlock()
+
+	if crossed > 0 {
+		slog.Warn("tunnel: monthly budget threshold crossed",
+			"percent", crossed,
+			"used", humanize.Bytes(used),
+			"budget", humanize.Bytes(u.cfg.Budget),
+			"month", month,
+			"downloads_blocked", crossed >= 100 && u.cfg.BlockDownloads,
+		)
+	}
+}
+
+func (u *Usage) monthTotalLocked(month string) int64 {
+	var total int64
+	for date, d := range u.days {
+		if strings.HasPrefix(date, month) {
+			total += d.total()
+		}
+	}
+	return total
+}
+
+// exhausted reports whether this month's budget is used up.
+func (u *Usage) exhausted() bool {
+	if u.cfg.Budget <= 0 {
+		return false
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.monthTotalLocked(u.now().Format(monthLayout)) >= u.cfg.Budget
+}
+
+// Month returns the usage for the month month falls in.
+func (u *Usage) Month(month time.Time) MonthUsage {
+	now := u.now()
+	m := MonthUsage{Month: month.Format(monthLayout), Days: []DayUsage{}, Budget: u.cfg.Budget}
+
+	u.mu.Lock()
+	first := time.Date(month.Year(), month.Month(), 1, 0, 0, 0, 0, now.Location())
+	for day := first; day.Month() == first.Month() && !day.After(now); day = day.AddDate(0, 0, 1) {
+		d := DayUsage{Date: day.Format(dayLayout)}
+		if got, ok := u.days[d.Date]; ok {
+			d = *got
+		}
+		m.Days = append(m.Days, d)
+		m.BytesIn += d.BytesIn
+		m.BytesOut += d.BytesOut
+		m.Requests += d.Requests
+	}
+	u.mu.Unlock()
+
+	m.Total = m.BytesIn + m.BytesOut
+	if m.Budget > 0 {
+		m.UsedPercent = float64(m.Total) * 100 / float64(m.Budget)
+		m.DownloadsBlocked = u.cfg.BlockDownloads && m.Month == now.Format(monthLayout) && m.Total >= m.Budget
+	}
+	return m
+}
+
+// HealthWarnings reports a budget at or past its first threshold.
+func (u *Usage) HealthWarnings() []string {
+	if u.cfg.Budget <= 0 {
+		return nil
+	}
+	m := u.Month(u.now())
+	if m.UsedPercent < float64(budgetThresholds[0]) {
+		return nil
+	}
+	msg := fmt.Sprintf("tunnel: %.0f%% of the %s monthly budget used", m.UsedPercent, humanize.Bytes(m.Budget))
+	if m.DownloadsBlocked {
+		msg += "; downloads through the tunnel are paused until next month"
+	}
+	return []string{msg}
+}
+
+func (u *Usage) RegisterRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/tunnel/usage", u.handleUsage)
+}
+
+// handleUsage returns one month's usage. GET /api/tunnel/usage?month=2024-06;
+// the current month if month is omitted.
+func (u *Usage) handleUsage(w http.ResponseWriter, r *http.Request) {
+	month := u.now()
+	if v := r.URL.Query().Get("month"); v != "" {
+		t, err := time.ParseInLocation(monthLayout, v, month.Location())
+		if err != nil {
+			httputil.BadRequest(w, "month must look like 2024-06")
+			return
+		}
+		month = t
+	}
+	httputil.OK(w, u.Month(month))
+}
+
+// Meter wraps the API handler. It counts tunnel-origin requests and, with
+// BlockDownloads, refuses downloads through the tunnel once the budget is
+// used up. Sizes are what crossed the HTTP layer — headers and bodies, not
+// TLS or frp framing — so they run a little under what the VPS bills.
+func (u *Usage) Meter(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !httputil.FromTunnel(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &countingWriter{ResponseWriter: w}
+		cb := &countingBody{ReadCloser: r.Body}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = cb
+		}
+		defer func() {
+			if !cw.wroteHeader {
+				cw.countHeader(http.StatusOK) // net/http sends it after we return
+			}
+			in := int64(len(r.Method)+len(r.URL.RequestURI())+len(r.Proto)+4) + headerSize(r.Header) + cb.n
+			u.record(in, cw.n)
+		}()
+
+		if u.cfg.BlockDownloads && isDownload(r) && u.exhausted() {
+			now := u.now()
+			resume := time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, now.Location())
+			cw.Header().Set("Retry-After", strconv.Itoa(int(resume.Sub(now).Seconds())+1))
+			httputil.Error(cw, http.StatusTooManyRequests,
+				"the monthly tunnel budget is used up; downloads resume on "+resume.Format(dayLayout))
+			return
+		}
+		next.ServeHTTP(cw, r)
+	})
+}
+
+func isDownload(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	for _, p := range downloadPaths {
+		if r.URL.Path == p || (strings.HasSuffix(p, "/") && strings.HasPrefix(r.URL.Path, p)) {
+			return true
+		}
+	}
+	return false
+}
+
+// headerSize approximates the wire size of h: "Key: value\r\n" per value.
+func headerSize(h http.Header) int64 {
+	var n int64
+	for k, vs := range h {
+		for _, v := range vs {
+			n += int64(len(k) + len(v) + 4)
+		}
+	}
+	return n + 2 // blank line
+}
+
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+type countingWriter struct {
+	http.ResponseWriter
+	n           int64
+	wroteHeader bool
+}
+
+// countHeader adds the status line and headers, once.
+func (w *countingWriter) countHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.n += int64(len("HTTP/1.1 000 \r\n")+len(http.StatusText(code))) + headerSize(w.Header())
+	}
+}
+
+func (w *countingWriter) WriteHeader(code int) {
+	w.countHeader(code)
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.countHeader(http.StatusOK)
+	n, err := w.ResponseWriter.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController flush a stream through the meter.
+func (w *countingWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
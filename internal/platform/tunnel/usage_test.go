@@ -0,0 +1,167 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/httputil"
+)
+
+const testDevice = "device-abc"
+
+func newTestUsage(t *testing.T, cfg UsageConfig, now time.Time) *Usage {
+	t.Helper()
+	cfg.DataDir = t.TempDir()
+	u := NewUsage(cfg)
+	u.now = func() time.Time { return now }
+	return u
+}
+
+// serve sends one request from loopback through the meter to a handler
+// that writes body, on the tunnel listener if tunnel is set.
+func serve(u *Usage, tunnel bool, host, target, body string) *httptest.ResponseRecorder {
+	h := u.Meter(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	r := httptest.NewRequest("GET", target, nil)
+	r.RemoteAddr = "127.0.0.1:51000"
+	r.Host = host
+	if tunnel {
+		r = r.WithContext(httputil.WithTunnel(r.Context()))
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestMeter_CountsOnlyTunnelRequests(t *testing.T) {
+	now := time.Date(2024, 6, 3, 12, 0, 0, 0, time.Local)
+	u := newTestUsage(t, UsageConfig{}, now)
+	tunnelHost := testDevice + ".strct.org"
+
+	serve(u, true, tunnelHost, "/api/files?path=/", strings.Repeat("x", 1000))
+	serve(u, true, "foo-"+testDevice+".strct.org", "/api/health", "ok")
+	// Off the tunnel listener nothing counts, whatever the Host says.
+	serve(u, false, tunnelHost, "/api/files", strings.Repeat("x", 1000))
+	serve(u, false, "foo-"+testDevice+".strct.org", "/api/files", strings.Repeat("x", 1000))
+	serve(u, false, "localhost:8080", "/api/files", strings.Repeat("x", 1000))
+
+	m := u.Month(now)
+	if m.Month != "2024-06" || len(m.Days) != 3 {
+		t.Fatalf("month = %s, %d days", m.Month, len(m.Days))
+	}
+	day := m.Days[2]
+	if day.Date != "2024-06-03" || day.Requests != 2 {
+		t.Fatalf("day = %+v", day)
+	}
+	if day.BytesOut < 1002 || day.BytesOut > 1200 || day.BytesIn == 0 {
+		t.Errorf("bytes out %d, in %d", day.BytesOut, day.BytesIn)
+	}
+	if m.Total != day.BytesIn+day.BytesOut || m.Requests != 2 {
+		t.Errorf("month = %+v", m)
+	}
+}
+
+func TestUsage_PersistsAcrossRestarts(t *testing.T) {
+	now := time.Date(2024, 6, 3, 12, 0, 0, 0, time.Local)
+	u := newTestUsage(t, UsageConfig{}, now)
+	u.record(100, 2000)
+	u.days["2022-01-01"] = &DayUsage{Date: "2022-01-01", BytesOut: 5}
+	u.save()
+
+	again := NewUsage(u.cfg)
+	again.now = u.now
+	if m := again.Month(now); m.BytesIn != 100 || m.BytesOut != 2000 {
+		t.Errorf("after reload = %+v", m)
+	}
+	if _, ok := again.days["2022-01-01"]; ok {
+		t.Error("day older than the retained history kept")
+	}
+}
+
+func TestUsage_BudgetWarningsAndDownloadBlock(t *testing.T) {
+	now := time.Date(2024, 6, 30, 12, 0, 0, 0, time.Local)
+	u := newTestUsage(t, UsageConfig{Budget: 10_000, BlockDownloads: true}, now)
+	tunnelHost := testDevice + ".strct.org"
+
+	u.record(0, 7_000)
+	if u.warned["2024-06"] != 0 || u.HealthWarnings() != nil {
+		t.Fatalf("warned at 70%%: %v %v", u.warned, u.HealthWarnings())
+	}
+	u.record(0, 1_500)
+	if u.warned["2024-06"] != 80 {
+		t.Errorf("warned = %v, want 80", u.warned)
+	}
+	if w := u.HealthWarnings(); len(w) != 1 || !strings.Contains(w[0], "85%") {
+		t.Errorf("health warnings = %v", w)
+	}
+	if w := serve(u, true, tunnelHost, "/api/download?path=/a", "file"); w.Code != http.StatusOK {
+		t.Errorf("download under budget: %d", w.Code)
+	}
+
+	u.record(0, 2_000)
+	if u.warned["2024-06"] != 100 {
+		t.Errorf("warned = %v, want 100", u.warned)
+	}
+	for _, target := range []string{"/api/download?path=/a", "/files/a.txt", "/share/tok"} {
+		w := serve(u, true, tunnelHost, target, "file")
+		if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+			t.Errorf("%s over budget: %d %q", target, w.Code, w.Header().Get("Retry-After"))
+		}
+	}
+	// The device stays manageable through the tunnel, and nothing is
+	// refused on the LAN.
+	if w := serve(u, true, tunnelHost, "/api/tunnel/usage", "{}"); w.Code != http.StatusOK {
+		t.Errorf("control plane over budget: %d", w.Code)
+	}
+	if w := serve(u, false, "strct.local", "/api/download?path=/a", "file"); w.Code != http.StatusOK {
+		t.Errorf("LAN download over budget: %d", w.Code)
+	}
+	if w := u.HealthWarnings(); len(w) != 1 || !strings.Contains(w[0], "paused") {
+		t.Errorf("health warnings = %v", w)
+	}
+
+	// A new month starts over.
+	u.now = func() time.Time { return now.AddDate(0, 0, 1) }
+	if w := serve(u, true, tunnelHost, "/files/a.txt", "file"); w.Code != http.StatusOK {
+		t.Errorf("download next month: %d", w.Code)
+	}
+}
+
+func TestHandleUsage(t *testing.T) {
+	now := time.Date(2024, 7, 2, 9, 0, 0, 0, time.Local)
+	u := newTestUsage(t, UsageConfig{Budget: 1_000}, now)
+	u.days["2024-06-15"] = &DayUsage{Date: "2024-06-15", BytesIn: 10, BytesOut: 240, Requests: 3}
+	mux := http.NewServeMux()
+	u.RegisterRoutes(mux)
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/api/tunnel/usage?month=2024-06", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("usage: %d %s", w.Code, w.Body)
+	}
+	var m MonthUsage
+	if err := json.Unmarshal(w.Body.Bytes(), &m); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Days) != 30 || m.Days[14].Requests != 3 || m.Total != 250 || m.UsedPercent != 25 {
+		t.Errorf("june = %+v", m)
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/api/tunnel/usage", nil))
+	json.Unmarshal(w.Body.Bytes(), &m)
+	if m.Month != "2024-07" || len(m.Days) != 2 || m.Total != 0 {
+		t.Errorf("current month = %+v", m)
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/api/tunnel/usage?month=june", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("bad month: %d", w.Code)
+	}
+}
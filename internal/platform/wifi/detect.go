@@ -0,0 +1,112 @@
+package wifi
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Detection. Whether the real provider can run depends on what the
+// machine has, not on its architecture: an x86 mini-PC with a USB WiFi
+// card drives NetworkManager the same way the Orange Pi does.
+
+// DefaultInterface is the interface the rest of the agent configures.
+const DefaultInterface = "wlan0"
+
+// requiredTools are the binaries the real provider and the wifi feature
+// run.
+var requiredTools = []string{"nmcli", "iw"}
+
+// Env is what Detect looks at.
+type Env struct {
+	SysClassNet string // normally /sys/class/net
+	LookPath    func(file string) (string, error)
+}
+
+// SystemEnv is this machine.
+func SystemEnv() Env {
+	return Env{SysClassNet: "/sys/class/net", LookPath: exec.LookPath}
+}
+
+// Detect returns the wireless interface the real provider should use:
+// DefaultInterface when it is wireless, else the first wireless one by
+// name. It fails when a required tool is missing or there is no wireless
+// interface.
+func Detect(env Env) (string, error) {
+	for _, tool := range requiredTools {
+		if _, err := env.LookPath(tool); err != nil {
+			return "", fmt.Errorf("%s not found: %w", tool, err)
+		}
+	}
+	wireless, _, err := Wireless(env.SysClassNet)
+	if err != nil {
+		return "", err
+	}
+	if len(wireless) == 0 {
+		return "", fmt.Errorf("no wireless interface in %s", env.SysClassNet)
+	}
+	if slices.Contains(wireless, DefaultInterface) {
+		return DefaultInterface, nil
+	}
+	return wireless[0], nil
+}
+
+// Wireless returns the wireless interfaces in sysClassNet by name, and
+// how many radios they are on: a virtual AP interface such as wlan0_ap
+// shares wlan0's phy, a USB dongle's wlan1 brings its own.
+func Wireless(sysClassNet string) (ifaces []string, radios int, err error) {
+	entries, err := os.ReadDir(sysClassNet)
+	if err != nil {
+		return nil, 0, fmt.Errorf("list network interfaces: %w", err)
+	}
+	phys := map[string]bool{}
+	for _, e := range entries {
+		dir := filepath.Join(sysClassNet, e.Name())
+		if !isWireless(dir) {
+			continue
+		}
+		ifaces = append(ifaces, e.Name())
+		// phy80211 links to the phy; without the link, as with older
+		// drivers, the interface is taken to be its own radio.
+		phy := e.Name()
+		if target, err := os.Readlink(filepath.Join(dir, "phy80211")); err == nil {
+			phy = filepath.Base(target)
+		}
+		phys[phy] = true
+	}
+	return ifaces, len(phys), nil
+}
+
+// SupportsAP reports whether `iw list` output lists AP among a radio's
+// supported interface modes, which hostapd needs.
+func SupportsAP(iwList []byte) bool {
+	inModes := false
+	for _, line := range strings.Split(string(iwList), "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(trimmed, "Supported interface modes:"):
+			inModes = true
+		case inModes && strings.HasPrefix(trimmed, "* "):
+			if strings.TrimPrefix(trimmed, "* ") == "AP" {
+				return true
+			}
+		default:
+			inModes = false
+		}
+	}
+	return false
+}
+
+// isWireless reports whether the interface at dir in sysfs is a WiFi
+// one: cfg80211 drivers link it to its phy, older ones add wireless/.
+func isWireless(dir string) bool {
+	for _, name := range []string{"phy80211", "wireless"} {
+		if _, err := os.Lstat(filepath.Join(dir, name)); err == nil {
+			return true
+		}
+	}
+	return false
+}
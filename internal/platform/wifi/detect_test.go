@@ -0,0 +1,126 @@
+package wifi_test
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/strct-org/strct-agent/internal/platform/wifi"
+)
+
+// ---------------------------------------------------------------------------
+// Detect
+// ---------------------------------------------------------------------------
+
+// fakeSysfs builds a /sys/class/net with the given interfaces; each maps
+// to the entry that marks it wireless ("" for none).
+func fakeSysfs(t *testing.T, ifaces map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, marker := range ifaces {
+		if err := os.MkdirAll(filepath.Join(dir, name), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if marker != "" {
+			if err := os.Mkdir(filepath.Join(dir, name, marker), 0o755); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return dir
+}
+
+func lookPath(have ...string) func(string) (string, error) {
+	return func(file string) (string, error) {
+		for _, h := range have {
+			if h == file {
+				return "/usr/bin/" + file, nil
+			}
+		}
+		return "", exec.ErrNotFound
+	}
+}
+
+func TestDetect(t *testing.T) {
+	tests := []struct {
+		name    string
+		ifaces  map[string]string
+		tools   []string
+		want    string
+		wantErr string
+	}{
+		{"orange pi", map[string]string{"eth0": "", "wlan0": "phy80211"}, []string{"nmcli", "iw"}, "wlan0", ""},
+		{"wlan0 preferred", map[string]string{"wlan0": "wireless", "wlx00c0ca123456": "phy80211"}, []string{"nmcli", "iw"}, "wlan0", ""},
+		{"x86 with USB card", map[string]string{"enp1s0": "", "lo": "", "wlx00c0ca123456": "phy80211"}, []string{"nmcli", "iw"}, "wlx00c0ca123456", ""},
+		{"x86 built-in card", map[string]string{"enp1s0": "", "wlp2s0": "wireless"}, []string{"nmcli", "iw"}, "wlp2s0", ""},
+		{"wired only", map[string]string{"enp1s0": "", "lo": ""}, []string{"nmcli", "iw"}, "", "no wireless interface"},
+		{"no NetworkManager", map[string]string{"wlan0": "phy80211"}, []string{"iw"}, "", "nmcli not found"},
+		{"no iw", map[string]string{"wlan0": "phy80211"}, []string{"nmcli"}, "", "iw not found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := wifi.Detect(wifi.Env{SysClassNet: fakeSysfs(t, tt.ifaces), LookPath: lookPath(tt.tools...)})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Detect() = %q, %v; want error containing %q", got, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("Detect() = %q, %v; want %q", got, err, tt.want)
+			}
+		})
+	}
+
+	_, err := wifi.Detect(wifi.Env{SysClassNet: filepath.Join(t.TempDir(), "missing"), LookPath: lookPath("nmcli", "iw")})
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("no sysfs: %v", err)
+	}
+}
+
+func TestWireless_CountsRadios(t *testing.T) {
+	dir := fakeSysfs(t, map[string]string{"eth0": "", "wlan2": "wireless"})
+	// wlan0 and its virtual AP share phy0; the dongle's wlan1 is phy1.
+	for iface, phy := range map[string]string{"wlan0": "phy0", "wlan0_ap": "phy0", "wlan1": "phy1"} {
+		if err := os.Mkdir(filepath.Join(dir, iface), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink("../../ieee80211/"+phy, filepath.Join(dir, iface, "phy80211")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ifaces, radios, err := wifi.Wireless(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(ifaces, ",") != "wlan0,wlan0_ap,wlan1,wlan2" || radios != 3 {
+		t.Errorf("Wireless() = %v, %d radios", ifaces, radios)
+	}
+}
+
+const iwListFixture = `Wiphy phy0
+	max # scan SSIDs: 10
+	Supported interface modes:
+		 * managed
+		 * AP
+		 * monitor
+	Band 1:
+		Capabilities: 0x1862
+`
+
+func TestSupportsAP(t *testing.T) {
+	if !wifi.SupportsAP([]byte(iwListFixture)) {
+		t.Error("AP listed, not found")
+	}
+	noAP := strings.Replace(iwListFixture, "* AP", "* P2P-client", 1)
+	if wifi.SupportsAP([]byte(noAP)) {
+		t.Error("AP found without being listed")
+	}
+	// "* AP" elsewhere, as in the combinations list, is not a mode.
+	if wifi.SupportsAP([]byte("Wiphy phy0\n\tvalid interface combinations:\n\t\t * #{ AP } <= 1\n")) {
+		t.Error("AP found outside the modes")
+	}
+}
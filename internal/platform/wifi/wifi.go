@@ -1,6 +1,7 @@
 package wifi
 
 import (
+	"log/slog"
 	"net/http"
 	"time"
 
@@ -27,9 +28,22 @@ func HasInternet() bool {
 	return err == nil
 }
 
-func New(isArm64 bool) Provider {
-	if isArm64 {
-		return NewRealWiFi("wlan0", executil.Real{})
+// New returns the real provider when realHardware is set and Detect finds
+// what it needs, and the mock otherwise.
+func New(realHardware bool) Provider {
+	if !realHardware {
+		return &MockWiFi{}
 	}
-	return &MockWiFi{}
+	iface, err := Detect(SystemEnv())
+	if err != nil {
+		slog.Warn("wifi: no usable WiFi hardware, using the mock", "err", err)
+		return &MockWiFi{}
+	}
+	if iface != DefaultInterface {
+		// Setup works on any interface; the wifi feature's modes are
+		// written for wlan0.
+		slog.Warn("wifi: the wireless interface is not wlan0; rename it for the hotspot, router and extender modes",
+			"iface", iface)
+	}
+	return NewRealWiFi(iface, executil.Real{})
 }
@@ -0,0 +1,17 @@
+//go:build !windows
+
+package resources
+
+import (
+	"syscall"
+	"time"
+)
+
+// processCPUTime returns user+system CPU time used by the agent so far.
+func processCPUTime() time.Duration {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		return 0
+	}
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
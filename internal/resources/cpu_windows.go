@@ -0,0 +1,8 @@
+//go:build windows
+
+package resources
+
+import "time"
+
+// processCPUTime is not tracked on Windows (dev builds only).
+func processCPUTime() time.Duration { return 0 }
@@ -0,0 +1,29 @@
+package resources
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/httputil"
+)
+
+func (t *Tracker) RegisterRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/system/resources", t.handleResources)
+}
+
+// handleResources reports per-feature and process usage.
+// GET /api/system/resources            lifetime totals
+// GET /api/system/resources?window=5m  totals and rates for the last 5 minutes
+func (t *Tracker) handleResources(w http.ResponseWriter, r *http.Request) {
+	var window time.Duration
+	if raw := r.URL.Query().Get("window"); raw != "" {
+		d, err := time.ParseDuration(raw)
+		if err != nil || d <= 0 || d > sampleHistory {
+			httputil.BadRequest(w, fmt.Sprintf("window must be a duration between 1s and %s", sampleHistory))
+			return
+		}
+		window = d
+	}
+	httputil.OK(w, t.Report(window))
+}
@@ -0,0 +1,386 @@
+// Package resources does lightweight per-feature accounting of where the
+// agent spends its time: active time in background work, bytes moved, and
+// goroutines alive. It answers "is it the router scan or the blocklist
+// download eating the Pi" without attaching pprof.
+//
+// Each feature takes a handle once:
+//
+//	var usage = resources.For("router")
+//
+// and then wraps work sections with `defer usage.Time()()`, launches its
+// loops with usage.Go, and counts transfers with usage.Reader/Writer.
+package resources
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"runtime"
+	"runtime/debug"
+	"runtime/pprof"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/metrics"
+)
+
+const (
+	sampleInterval = 10 * time.Second
+	sampleHistory  = time.Hour
+)
+
+// Feature accounts resource use for one feature. Safe for concurrent use.
+type Feature struct {
+	name       string
+	activeNs   atomic.Int64
+	goroutines atomic.Int64
+	read       *metrics.Counter
+	written    *metrics.Counter
+	started    *metrics.Counter
+	activeMs   *metrics.Counter
+	queue      atomic.Pointer[func() QueueStats]
+}
+
+// Time starts timing a work section and returns the func that stops it:
+//
+//	defer usage.Time()()
+func (f *Feature) Time() (stop func()) {
+	start := time.Now()
+	return func() {
+		d := time.Since(start)
+		f.activeNs.Add(int64(d))
+		f.activeMs.Add(uint64(d.Milliseconds()))
+	}
+}
+
+func (f *Feature) AddRead(n int64) {
+	if n > 0 {
+		f.read.Add(uint64(n))
+	}
+}
+
+func (f *Feature) AddWritten(n int64) {
+	if n > 0 {
+		f.written.Add(uint64(n))
+	}
+}
+
+// Go runs fn in a goroutine counted against the feature and labeled
+// feature=<name> for pprof. A panic is logged with its stack instead of
+// taking the whole agent down.
+func (f *Feature) Go(fn func()) {
+	f.goroutines.Add(1)
+	f.started.Inc()
+	go func() {
+		defer f.goroutines.Add(-1)
+		defer func() {
+			if p := recover(); p != nil {
+				slog.Error("resources: goroutine panicked", "feature", f.name, "panic", p, "stack", string(debug.Stack()))
+			}
+		}()
+		pprof.Do(context.Background(), pprof.Labels("feature", f.name), func(context.Context) { fn() })
+	}()
+}
+
+// ReportQueue adds the feature's background job queue to the report;
+// stats is called on every report.
+func (f *Feature) ReportQueue(stats func() QueueStats) {
+	f.queue.Store(&stats)
+}
+
+func (f *Feature) queueStats() *QueueStats {
+	stats := f.queue.Load()
+	if stats == nil {
+		return nil
+	}
+	q := (*stats)()
+	return &q
+}
+
+// Reader counts bytes read through r against the feature.
+func (f *Feature) Reader(r io.Reader) io.Reader { return &countingReader{r: r, f: f} }
+
+// Writer counts bytes written through w against the feature.
+func (f *Feature) Writer(w io.Writer) io.Writer { return &countingWriter{w: w, f: f} }
+
+type countingReader struct {
+	r io.Reader
+	f *Feature
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.f.AddRead(int64(n))
+	return n, err
+}
+
+type countingWriter struct {
+	w io.Writer
+	f *Feature
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.f.AddWritten(int64(n))
+	return n, err
+}
+
+// ─── Tracker ─────────────────────────────────────────────────────────────────
+
+// featureSample is one feature's cumulative counters at a point in time.
+type featureSample struct {
+	activeNs       int64
+	read, written  uint64
+	started        uint64
+	goroutinesLive int64
+}
+
+type sample struct {
+	at       time.Time
+	cpu      time.Duration
+	features map[string]featureSample
+}
+
+// Tracker owns the features and a rolling hour of samples for windowed
+// rates. Start runs the sampler; it's an agent Service.
+type Tracker struct {
+	mu       sync.Mutex
+	registry *metrics.Registry
+	features map[string]*Feature
+	samples  []sample
+	started  time.Time
+	now      func() time.Time
+	cpuTime  func() time.Duration
+}
+
+func NewTracker(registry *metrics.Registry) *Tracker {
+	return &Tracker{
+		registry: registry,
+		features: make(map[string]*Feature),
+		started:  time.Now(),
+		now:      time.Now,
+		cpuTime:  processCPUTime,
+	}
+}
+
+// Default is the process-wide tracker behind /api/system/resources.
+var Default = NewTracker(metrics.Default)
+
+// For returns the Default tracker's handle for feature.
+func For(feature string) *Feature { return Default.Feature(feature) }
+
+// Feature returns the handle for name, creating it on first use.
+func (t *Tracker) Feature(name string) *Feature {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if f, ok := t.features[name]; ok {
+		return f
+	}
+	f := &Feature{
+		name: name,
+		read: t.registry.Counter("strct_feature_io_bytes_total",
+			"Bytes read or written by a feature.", "feature", name, "direction", "read"),
+		written: t.registry.Counter("strct_feature_io_bytes_total",
+			"Bytes read or written by a feature.", "feature", name, "direction", "write"),
+		started: t.registry.Counter("strct_feature_goroutines_started_total",
+			"Goroutines launched by a feature.", "feature", name),
+		activeMs: t.registry.Counter("strct_feature_active_milliseconds_total",
+			"Time a feature spent in timed work sections.", "feature", name),
+	}
+	t.registry.GaugeFunc("strct_feature_goroutines", "Goroutines currently running per feature.",
+		func() float64 { return float64(f.goroutines.Load()) }, "feature", name)
+	t.features[name] = f
+	return f
+}
+
+// Start samples every feature every 10s until ctx is done.
+func (t *Tracker) Start(ctx context.Context) error {
+	t.sample()
+	go func() {
+		ticker := time.NewTicker(sampleInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				t.sample()
+			}
+		}
+	}()
+	return nil
+}
+
+func (t *Tracker) sample() {
+	s := t.current()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.samples = append(t.samples, s)
+	cutoff := s.at.Add(-sampleHistory)
+	drop := 0
+	for drop < len(t.samples)-1 && t.samples[drop].at.Before(cutoff) {
+		drop++
+	}
+	t.samples = t.samples[drop:]
+}
+
+func (t *Tracker) current() sample {
+	t.mu.Lock()
+	features := make([]*Feature, 0, len(t.features))
+	for _, f := range t.features {
+		features = append(features, f)
+	}
+	t.mu.Unlock()
+
+	s := sample{at: t.now(), cpu: t.cpuTime(), features: make(map[string]featureSample, len(features))}
+	for _, f := range features {
+		s.features[f.name] = featureSample{
+			activeNs:       f.activeNs.Load(),
+			read:           f.read.Value(),
+			written:        f.written.Value(),
+			started:        f.started.Value(),
+			goroutinesLive: f.goroutines.Load(),
+		}
+	}
+	return s
+}
+
+// baseline returns the newest sample at least window old, or the oldest
+// sample when history is shorter than window.
+func (t *Tracker) baseline(now time.Time, window time.Duration) (sample, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.samples) == 0 {
+		return sample{}, false
+	}
+	base := t.samples[0]
+	for _, s := range t.samples {
+		if now.Sub(s.at) < window {
+			break
+		}
+		base = s
+	}
+	return base, true
+}
+
+// ─── Report ──────────────────────────────────────────────────────────────────
+
+// FeatureUsage is one row of the report. Totals cover the window (or the
+// process lifetime when no window was asked for).
+type FeatureUsage struct {
+	Feature           string  `json:"feature"`
+	ActiveSeconds     float64 `json:"active_seconds"`
+	ActivePercent     float64 `json:"active_percent"` // of wall time in the window
+	BytesRead         uint64  `json:"bytes_read"`
+	BytesWritten      uint64  `json:"bytes_written"`
+	ReadBps           float64 `json:"read_bps"`
+	WriteBps          float64 `json:"write_bps"`
+	Goroutines        int64   `json:"goroutines"` // running now
+	GoroutinesStarted uint64  `json:"goroutines_started"`
+	// Queue is the feature's background job queue, if it has one. Its
+	// counts are lifetime totals whatever the window.
+	Queue *QueueStats `json:"queue,omitempty"`
+}
+
+// QueueStats is the state of a feature's background job queue.
+type QueueStats struct {
+	Workers       int            `json:"workers"`
+	Depth         int            `json:"depth"` // waiting to run
+	Running       int            `json:"running"`
+	Done          uint64         `json:"done"`
+	DonePerMinute float64        `json:"done_per_minute"` // over the last minute
+	Types         []JobTypeStats `json:"types"`
+}
+
+// JobTypeStats counts one kind of job.
+type JobTypeStats struct {
+	Type         string  `json:"type"`
+	Queued       int     `json:"queued"`
+	Running      int     `json:"running"`
+	Done         uint64  `json:"done"`
+	Failed       uint64  `json:"failed"`
+	Cancelled    uint64  `json:"cancelled"`
+	Deduplicated uint64  `json:"deduplicated"` // joined a job already queued or running
+	AvgMs        float64 `json:"avg_ms"`
+}
+
+// ProcessUsage is the process-wide summary.
+type ProcessUsage struct {
+	CPUSeconds    float64 `json:"cpu_seconds"`
+	CPUPercent    float64 `json:"cpu_percent"` // of one core
+	Goroutines    int     `json:"goroutines"`
+	HeapBytes     uint64  `json:"heap_bytes"`
+	SysBytes      uint64  `json:"sys_bytes"`
+	UptimeSeconds float64 `json:"uptime_seconds"`
+}
+
+type Report struct {
+	WindowSeconds float64        `json:"window_seconds"`
+	Features      []FeatureUsage `json:"features"`
+	Process       ProcessUsage   `json:"process"`
+}
+
+// Report returns usage over the last window, or lifetime totals for 0.
+// When the sampler hasn't collected that much history yet the report
+// covers what it has and WindowSeconds says how much that is.
+func (t *Tracker) Report(window time.Duration) Report {
+	cur := t.current()
+	base := sample{at: t.started, features: map[string]featureSample{}}
+	if window > 0 {
+		if b, ok := t.baseline(cur.at, window); ok {
+			base = b
+		}
+	}
+	elapsed := cur.at.Sub(base.at).Seconds()
+
+	perSec := func(v float64) float64 {
+		if elapsed <= 0 {
+			return 0
+		}
+		return v / elapsed
+	}
+
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	cpu := (cur.cpu - base.cpu).Seconds()
+
+	r := Report{
+		WindowSeconds: elapsed,
+		Features:      make([]FeatureUsage, 0, len(cur.features)),
+		Process: ProcessUsage{
+			CPUSeconds:    cpu,
+			CPUPercent:    100 * perSec(cpu),
+			Goroutines:    runtime.NumGoroutine(),
+			HeapBytes:     ms.HeapAlloc,
+			SysBytes:      ms.Sys,
+			UptimeSeconds: cur.at.Sub(t.started).Seconds(),
+		},
+	}
+	for name, c := range cur.features {
+		b := base.features[name] // zero for a feature born inside the window
+		active := time.Duration(c.activeNs - b.activeNs).Seconds()
+		read, written := c.read-b.read, c.written-b.written
+		r.Features = append(r.Features, FeatureUsage{
+			Feature:           name,
+			ActiveSeconds:     active,
+			ActivePercent:     100 * perSec(active),
+			BytesRead:         read,
+			BytesWritten:      written,
+			ReadBps:           perSec(float64(read)),
+			WriteBps:          perSec(float64(written)),
+			Goroutines:        c.goroutinesLive,
+			GoroutinesStarted: c.started - b.started,
+			Queue:             t.Feature(name).queueStats(),
+		})
+	}
+	// Busiest first — the row the user is looking for.
+	sort.Slice(r.Features, func(i, j int) bool {
+		if r.Features[i].ActiveSeconds != r.Features[j].ActiveSeconds {
+			return r.Features[i].ActiveSeconds > r.Features[j].ActiveSeconds
+		}
+		return r.Features[i].Feature < r.Features[j].Feature
+	})
+	return r
+}
@@ -0,0 +1,195 @@
+package resources
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/metrics"
+)
+
+func newTestTracker() (*Tracker, *time.Time) {
+	t := NewTracker(metrics.NewRegistry())
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	t.started = now
+	t.now = func() time.Time { return now }
+	t.cpuTime = func() time.Duration { return 0 }
+	return t, &now
+}
+
+func row(t *testing.T, r Report, feature string) FeatureUsage {
+	t.Helper()
+	for _, f := range r.Features {
+		if f.Feature == feature {
+			return f
+		}
+	}
+	t.Fatalf("no row for %q in %+v", feature, r.Features)
+	return FeatureUsage{}
+}
+
+func TestFeature_CountsIOAndGoroutines(t *testing.T) {
+	tr, _ := newTestTracker()
+	f := tr.Feature("adblock")
+	if tr.Feature("adblock") != f {
+		t.Fatal("Feature should return the same handle for the same name")
+	}
+
+	if _, err := io.Copy(io.Discard, f.Reader(strings.NewReader("0123456789"))); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	f.Writer(&buf).Write([]byte("abcd"))
+
+	release := make(chan struct{})
+	running := make(chan struct{})
+	f.Go(func() {
+		close(running)
+		<-release
+	})
+	<-running
+
+	got := row(t, tr.Report(0), "adblock")
+	if got.BytesRead != 10 || got.BytesWritten != 4 {
+		t.Errorf("bytes = %d read / %d written, want 10 / 4", got.BytesRead, got.BytesWritten)
+	}
+	if got.Goroutines != 1 || got.GoroutinesStarted != 1 {
+		t.Errorf("goroutines = %d running / %d started, want 1 / 1", got.Goroutines, got.GoroutinesStarted)
+	}
+
+	close(release)
+	deadline := time.Now().Add(2 * time.Second)
+	for f.goroutines.Load() != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := f.goroutines.Load(); n != 0 {
+		t.Errorf("goroutines after exit = %d, want 0", n)
+	}
+}
+
+func TestFeature_GoRecoversPanic(t *testing.T) {
+	tr, _ := newTestTracker()
+	f := tr.Feature("router")
+	done := make(chan struct{})
+	f.Go(func() {
+		defer close(done)
+		panic("boom")
+	})
+	<-done
+
+	deadline := time.Now().Add(2 * time.Second)
+	for f.goroutines.Load() != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := f.goroutines.Load(); n != 0 {
+		t.Errorf("goroutines after panic = %d, want 0", n)
+	}
+}
+
+func TestReport_Window(t *testing.T) {
+	tr, now := newTestTracker()
+	f := tr.Feature("monitor")
+
+	// 10 minutes ago: 1000 bytes and 2s of work already done.
+	f.AddRead(1000)
+	f.activeNs.Add(int64(2 * time.Second))
+	*now = now.Add(-10 * time.Minute)
+	tr.sample()
+	*now = now.Add(5 * time.Minute)
+	tr.sample()
+
+	// In the last 5 minutes: 3000 more bytes and 30s more work.
+	f.AddRead(3000)
+	f.activeNs.Add(int64(30 * time.Second))
+	*now = now.Add(5 * time.Minute)
+
+	lifetime := row(t, tr.Report(0), "monitor")
+	if lifetime.BytesRead != 4000 || lifetime.ActiveSeconds != 32 {
+		t.Errorf("lifetime = %+v, want 4000 bytes / 32s", lifetime)
+	}
+
+	r := tr.Report(5 * time.Minute)
+	if r.WindowSeconds != 300 {
+		t.Errorf("window = %vs, want 300", r.WindowSeconds)
+	}
+	got := row(t, r, "monitor")
+	if got.BytesRead != 3000 || got.ActiveSeconds != 30 {
+		t.Errorf("window row = %+v, want 3000 bytes / 30s", got)
+	}
+	if got.ReadBps != 10 || got.ActivePercent != 10 {
+		t.Errorf("rates = %v B/s, %v%% active; want 10, 10", got.ReadBps, got.ActivePercent)
+	}
+
+	// Asking for more history than exists covers what there is.
+	if r := tr.Report(time.Hour); r.WindowSeconds != 600 {
+		t.Errorf("window beyond history = %vs, want 600", r.WindowSeconds)
+	}
+}
+
+func TestReport_BusiestFirst(t *testing.T) {
+	tr, _ := newTestTracker()
+	tr.Feature("cloud")
+	tr.Feature("router").activeNs.Add(int64(time.Second))
+	tr.Feature("adblock").activeNs.Add(int64(5 * time.Second))
+
+	r := tr.Report(0)
+	var order []string
+	for _, f := range r.Features {
+		order = append(order, f.Feature)
+	}
+	if strings.Join(order, ",") != "adblock,router,cloud" {
+		t.Errorf("order = %v, want adblock,router,cloud", order)
+	}
+}
+
+func TestHandleResources(t *testing.T) {
+	tr, _ := newTestTracker()
+	tr.Feature("wifi")
+	mux := http.NewServeMux()
+	tr.RegisterRoutes(mux)
+
+	for _, q := range []string{"?window=abc", "?window=-5m", "?window=2h"} {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("GET", "/api/system/resources"+q, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want 400", q, rec.Code)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/api/system/resources?window=5m", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body)
+	}
+	var r Report
+	if err := json.NewDecoder(rec.Body).Decode(&r); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Features) != 1 || r.Features[0].Feature != "wifi" || r.Process.Goroutines == 0 {
+		t.Errorf("report = %+v", r)
+	}
+}
+
+func TestMetrics_ExposeFeatureSeries(t *testing.T) {
+	reg := metrics.NewRegistry()
+	tr := NewTracker(reg)
+	tr.Feature("vpn").AddWritten(42)
+
+	var buf bytes.Buffer
+	reg.WriteText(&buf)
+	out := buf.String()
+	for _, want := range []string{
+		`strct_feature_io_bytes_total{feature="vpn",direction="write"} 42`,
+		"# TYPE strct_feature_goroutines gauge",
+		`strct_feature_goroutines{feature="vpn"} 0`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("metrics missing %q:\n%s", want, out)
+		}
+	}
+}
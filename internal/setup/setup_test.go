@@ -0,0 +1,312 @@
+package setup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/platform/disk"
+	"github.com/strct-org/strct-agent/internal/platform/wifi"
+)
+
+func init() { connectDelay = 0 }
+
+// fakeWiFi records Connect calls.
+type fakeWiFi struct {
+	wifi.MockWiFi
+	mu    sync.Mutex
+	ssids []string
+}
+
+func (f *fakeWiFi) Connect(ssid, password string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.ssids = append(f.ssids, ssid)
+	return nil
+}
+
+func (f *fakeWiFi) connects() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.ssids...)
+}
+
+type fakeDrives struct {
+	drives    []disk.Drive
+	formatErr error
+	mu        sync.Mutex
+	formatted []string
+}
+
+func (f *fakeDrives) ListDrives() ([]disk.Drive, error) { return f.drives, nil }
+
+func (f *fakeDrives) Format(device string, progress func(string)) error {
+	progress(disk.StagePartitioning)
+	progress(disk.StageFilesystem)
+	f.mu.Lock()
+	f.formatted = append(f.formatted, device)
+	f.mu.Unlock()
+	return f.formatErr
+}
+
+func testDrives() *fakeDrives {
+	return &fakeDrives{drives: []disk.Drive{
+		{Path: "/dev/mmcblk0", System: true, Formatted: true, FSType: "ext4"},
+		{Path: "/dev/nvme0n1", Formatted: false},
+		{Path: "/dev/sda", Formatted: true, FSType: "exfat", Contents: &disk.Contents{Entries: 2, Sample: []string{"Photos", "Music"}}},
+	}}
+}
+
+type harness struct {
+	mux       *http.ServeMux
+	wifi      *fakeWiFi
+	drives    *fakeDrives
+	decision  string
+	connected chan struct{}
+}
+
+func newHarness(t *testing.T, withStorage bool) *harness {
+	t.Helper()
+	h := &harness{
+		wifi:      &fakeWiFi{},
+		drives:    testDrives(),
+		decision:  filepath.Join(t.TempDir(), "storage.json"),
+		connected: make(chan struct{}, 1),
+	}
+	var storage *Storage
+	if withStorage {
+		storage = NewStorage(h.drives, h.decision)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	h.mux = buildMux(ctx, h.wifi, storage, h.connected)
+	return h
+}
+
+func (h *harness) do(t *testing.T, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	h.mux.ServeHTTP(rec, req)
+	return rec
+}
+
+func (h *harness) state(t *testing.T) WizardState {
+	t.Helper()
+	var s WizardState
+	if err := json.NewDecoder(h.do(t, "GET", "/setup/state", "").Body).Decode(&s); err != nil {
+		t.Fatalf("decode state: %v", err)
+	}
+	return s
+}
+
+func (h *harness) waitConnected(t *testing.T) {
+	t.Helper()
+	select {
+	case <-h.connected:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("WiFi never connected (state %+v)", h.state(t))
+	}
+}
+
+func (h *harness) connects(t *testing.T) []string { return h.wifi.connects() }
+
+func (h *harness) formatToken(t *testing.T, device string) string {
+	t.Helper()
+	rec := h.do(t, "POST", "/storage/format-token", `{"device":"`+device+`"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("format-token: %d %s", rec.Code, rec.Body)
+	}
+	var resp struct {
+		Token string `json:"confirm_token"`
+	}
+	json.NewDecoder(rec.Body).Decode(&resp)
+	return resp.Token
+}
+
+func TestConnect_WithoutStorageStepConnectsRightAway(t *testing.T) {
+	h := newHarness(t, false)
+
+	rec := h.do(t, "POST", "/connect", `{"ssid":"Home","password":"pw"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("connect: %d %s", rec.Code, rec.Body)
+	}
+	h.waitConnected(t)
+	if got := h.connects(t); len(got) != 1 || got[0] != "Home" {
+		t.Errorf("Connect calls = %v, want [Home]", got)
+	}
+	// Unknown paths fall through to the portal page.
+	if rec := h.do(t, "GET", "/storage/drives", ""); rec.Header().Get("Content-Type") != "text/html" {
+		t.Error("storage routes should not exist without a storage step")
+	}
+}
+
+func TestConnect_HoldsCredentialsForStorageStep(t *testing.T) {
+	h := newHarness(t, true)
+
+	if rec := h.do(t, "POST", "/connect", `{"ssid":""}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("empty ssid: got %d, want 400", rec.Code)
+	}
+	if rec := h.do(t, "POST", "/storage", `{"use_sd_card":true}`); rec.Code != http.StatusConflict {
+		t.Errorf("storage before credentials: got %d, want 409", rec.Code)
+	}
+
+	rec := h.do(t, "POST", "/connect", `{"ssid":"Home","password":"pw"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("connect: %d %s", rec.Code, rec.Body)
+	}
+	if s := h.state(t); s.Step != StepStorage || s.SSID != "Home" {
+		t.Fatalf("state = %+v, want storage step for Home", s)
+	}
+	if rec := h.do(t, "POST", "/connect", `{"ssid":"Other"}`); rec.Code != http.StatusConflict {
+		t.Errorf("second connect: got %d, want 409", rec.Code)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if got := h.connects(t); len(got) != 0 {
+		t.Errorf("connected before storage was chosen: %v", got)
+	}
+
+	var drives []disk.Drive
+	json.NewDecoder(h.do(t, "GET", "/storage/drives", "").Body).Decode(&drives)
+	if len(drives) != 3 || drives[2].Contents == nil || drives[2].Contents.Entries != 2 {
+		t.Errorf("drives = %+v", drives)
+	}
+}
+
+func TestStorage_UseSDCard(t *testing.T) {
+	h := newHarness(t, true)
+	h.do(t, "POST", "/connect", `{"ssid":"Home"}`)
+
+	rec := h.do(t, "POST", "/storage", `{"use_sd_card":true}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("storage: %d %s", rec.Code, rec.Body)
+	}
+	h.waitConnected(t)
+
+	dec, err := disk.LoadDecision(h.decision)
+	if err != nil || dec == nil || !dec.UseSDCard {
+		t.Fatalf("decision = %+v, %v; want UseSDCard", dec, err)
+	}
+}
+
+func TestStorage_FormattedDriveNeedsNoToken(t *testing.T) {
+	h := newHarness(t, true)
+	h.do(t, "POST", "/connect", `{"ssid":"Home"}`)
+
+	if rec := h.do(t, "POST", "/storage", `{"device":"/dev/sda"}`); rec.Code != http.StatusOK {
+		t.Fatalf("storage: %d %s", rec.Code, rec.Body)
+	}
+	h.waitConnected(t)
+
+	dec, _ := disk.LoadDecision(h.decision)
+	if dec == nil || dec.Device != "/dev/sda" || dec.Formatted {
+		t.Errorf("decision = %+v, want /dev/sda unformatted-by-us", dec)
+	}
+	h.drives.mu.Lock()
+	defer h.drives.mu.Unlock()
+	if len(h.drives.formatted) != 0 {
+		t.Errorf("formatted %v without being asked", h.drives.formatted)
+	}
+}
+
+func TestStorage_FormatRequiresConfirmToken(t *testing.T) {
+	h := newHarness(t, true)
+	h.do(t, "POST", "/connect", `{"ssid":"Home"}`)
+
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{"unformatted without format", `{"device":"/dev/nvme0n1"}`, http.StatusBadRequest},
+		{"format without token", `{"device":"/dev/nvme0n1","format":true}`, http.StatusForbidden},
+		{"format with bogus token", `{"device":"/dev/nvme0n1","format":true,"confirm_token":"nope"}`, http.StatusForbidden},
+		{"system drive", `{"device":"/dev/mmcblk0","format":true}`, http.StatusBadRequest},
+		{"unknown drive", `{"device":"/dev/sdz"}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := h.do(t, "POST", "/storage", tt.body); rec.Code != tt.want {
+				t.Errorf("got %d (%s), want %d", rec.Code, rec.Body, tt.want)
+			}
+		})
+	}
+
+	if rec := h.do(t, "POST", "/storage/format-token", `{"device":"/dev/mmcblk0"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("token for system drive: got %d, want 400", rec.Code)
+	}
+
+	// A token is bound to the drive it was issued for.
+	token := h.formatToken(t, "/dev/sda")
+	rec := h.do(t, "POST", "/storage", `{"device":"/dev/nvme0n1","format":true,"confirm_token":"`+token+`"}`)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("token for another drive: got %d, want 403", rec.Code)
+	}
+	if s := h.state(t); s.Step != StepStorage {
+		t.Errorf("rejected requests moved the wizard to %q", s.Step)
+	}
+}
+
+func TestStorage_FormatThenConnect(t *testing.T) {
+	h := newHarness(t, true)
+	h.do(t, "POST", "/connect", `{"ssid":"Home"}`)
+
+	token := h.formatToken(t, "/dev/nvme0n1")
+	rec := h.do(t, "POST", "/storage", `{"device":"/dev/nvme0n1","format":true,"confirm_token":"`+token+`"}`)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("storage: %d %s", rec.Code, rec.Body)
+	}
+	h.waitConnected(t)
+
+	if s := h.state(t); s.Step != StepConnecting {
+		t.Errorf("step = %q, want connecting", s.Step)
+	}
+	dec, _ := disk.LoadDecision(h.decision)
+	if dec == nil || dec.Device != "/dev/nvme0n1" || !dec.Formatted {
+		t.Errorf("decision = %+v, want formatted /dev/nvme0n1", dec)
+	}
+	if got := h.connects(t); len(got) != 1 || got[0] != "Home" {
+		t.Errorf("Connect calls = %v, want [Home]", got)
+	}
+}
+
+func TestStorage_FormatFailureReturnsToStorageStep(t *testing.T) {
+	h := newHarness(t, true)
+	h.drives.formatErr = errors.New("mkfs.ext4: device busy")
+	h.do(t, "POST", "/connect", `{"ssid":"Home"}`)
+
+	token := h.formatToken(t, "/dev/nvme0n1")
+	h.do(t, "POST", "/storage", `{"device":"/dev/nvme0n1","format":true,"confirm_token":"`+token+`"}`)
+
+	deadline := time.Now().Add(2 * time.Second)
+	var s WizardState
+	for time.Now().Before(deadline) {
+		if s = h.state(t); s.Step == StepStorage {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if s.Step != StepStorage || !strings.Contains(s.Error, "device busy") {
+		t.Fatalf("state = %+v, want storage step with the mkfs error", s)
+	}
+	if dec, _ := disk.LoadDecision(h.decision); dec != nil {
+		t.Errorf("decision saved after a failed format: %+v", dec)
+	}
+	if got := h.connects(t); len(got) != 0 {
+		t.Errorf("connected after a failed format: %v", got)
+	}
+
+	// The token was spent; the user has to confirm again.
+	rec := h.do(t, "POST", "/storage", `{"device":"/dev/nvme0n1","format":true,"confirm_token":"`+token+`"}`)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("reused token: got %d, want 403", rec.Code)
+	}
+}
@@ -0,0 +1,318 @@
+package setup
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/platform/disk"
+)
+
+// confirmTokenTTL bounds how long a "yes, erase this drive" click stays
+// valid. Long enough to read the warning, short enough that a page left
+// open overnight can't format whatever is plugged in the next morning.
+const confirmTokenTTL = 5 * time.Minute
+
+// Step is where the setup wizard is. The portal UI polls /setup/state and
+// renders the matching card.
+//
+//	credentials → storage → formatting → connecting
+//	           ↘─────────────────────────↗  (no storage step)
+type Step string
+
+const (
+	StepCredentials Step = "credentials"
+	StepStorage     Step = "storage"
+	StepFormatting  Step = "formatting"
+	StepConnecting  Step = "connecting"
+)
+
+// DriveManager is what the storage step needs from the disk package.
+type DriveManager interface {
+	ListDrives() ([]disk.Drive, error)
+	Format(device string, progress func(stage string)) error
+}
+
+// SystemDrives is the DriveManager backed by lsblk, parted and mkfs.
+type SystemDrives struct{}
+
+func (SystemDrives) ListDrives() ([]disk.Drive, error) {
+	drives, err := disk.ListDrives()
+	if err != nil {
+		return nil, err
+	}
+	for i, d := range drives {
+		if d.System || !d.Formatted {
+			continue
+		}
+		c, err := disk.PeekContents(d)
+		if err != nil {
+			slog.Warn("setup: could not read drive contents", "device", d.Path, "err", err)
+			continue
+		}
+		drives[i].Contents = c
+	}
+	return drives, nil
+}
+
+func (SystemDrives) Format(device string, progress func(stage string)) error {
+	return (&disk.RealDisk{DevicePath: device}).FormatWithProgress(progress)
+}
+
+// Storage is the optional storage step of the setup wizard. A nil
+// *Storage means the step is skipped (headless install, decision already
+// made, dev mode).
+type Storage struct {
+	drives       DriveManager
+	tokens       *disk.ConfirmTokens
+	decisionPath string
+	now          func() time.Time
+}
+
+func NewStorage(drives DriveManager, decisionPath string) *Storage {
+	return &Storage{
+		drives:       drives,
+		tokens:       disk.NewConfirmTokens(confirmTokenTTL),
+		decisionPath: decisionPath,
+		now:          time.Now,
+	}
+}
+
+// findDrive returns the listed drive with path device.
+func (s *Storage) findDrive(device string) (disk.Drive, error) {
+	drives, err := s.drives.ListDrives()
+	if err != nil {
+		return disk.Drive{}, err
+	}
+	for _, d := range drives {
+		if d.Path == device {
+			return d, nil
+		}
+	}
+	return disk.Drive{}, errUnknownDrive
+}
+
+var errUnknownDrive = errors.New("unknown drive")
+
+// ─── Wizard state machine ────────────────────────────────────────────────────
+
+// WizardState is the JSON shape of GET /setup/state.
+type WizardState struct {
+	Step     Step   `json:"step"`
+	SSID     string `json:"ssid,omitempty"`
+	Device   string `json:"device,omitempty"`
+	Progress string `json:"progress,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+type wizard struct {
+	mu       sync.Mutex
+	step     Step
+	creds    Credentials
+	device   string
+	progress string
+	err      string
+}
+
+func newWizard() *wizard {
+	return &wizard{step: StepCredentials}
+}
+
+func (w *wizard) state() WizardState {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return WizardState{
+		Step:     w.step,
+		SSID:     w.creds.SSID,
+		Device:   w.device,
+		Progress: w.progress,
+		Error:    w.err,
+	}
+}
+
+// advance moves from → to and reports whether the wizard was at from.
+// Handlers use it so a double-click or a stale tab can't run a step twice.
+func (w *wizard) advance(from, to Step) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.step != from {
+		return false
+	}
+	w.step, w.err, w.progress = to, "", ""
+	return true
+}
+
+func (w *wizard) setProgress(stage string) {
+	w.mu.Lock()
+	w.progress = stage
+	w.mu.Unlock()
+}
+
+// fail returns the wizard to step with a message for the UI.
+func (w *wizard) fail(step Step, msg string) {
+	w.mu.Lock()
+	w.step, w.err, w.progress = step, msg, ""
+	w.mu.Unlock()
+}
+
+// ─── Handlers ────────────────────────────────────────────────────────────────
+
+func (p *portal) handleState(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, p.wizard.state())
+}
+
+// handleDrives lists the drives the user can pick from.
+// GET /storage/drives
+func (p *portal) handleDrives(w http.ResponseWriter, r *http.Request) {
+	drives, err := p.storage.drives.ListDrives()
+	if err != nil {
+		slog.Error("setup: listing drives failed", "err", err)
+		http.Error(w, "could not list drives", http.StatusInternalServerError)
+		return
+	}
+	if drives == nil {
+		drives = []disk.Drive{}
+	}
+	writeJSON(w, http.StatusOK, drives)
+}
+
+// handleFormatToken issues the confirm token the UI must send back to
+// format device. The user gets it by ticking "erase everything on …".
+// POST /storage/format-token  body: {"device":"/dev/sda"}
+func (p *portal) handleFormatToken(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Device string `json:"device"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if p.wizard.state().Step != StepStorage {
+		http.Error(w, "not at the storage step", http.StatusConflict)
+		return
+	}
+	d, err := p.storage.findDrive(req.Device)
+	if err != nil {
+		http.Error(w, "unknown drive", http.StatusBadRequest)
+		return
+	}
+	if d.System {
+		http.Error(w, "refusing to format the system drive", http.StatusBadRequest)
+		return
+	}
+
+	token, expires := p.storage.tokens.Issue(d.Path)
+	writeJSON(w, http.StatusOK, map[string]any{
+		"device":        d.Path,
+		"confirm_token": token,
+		"expires_at":    expires.UTC().Format(time.RFC3339),
+	})
+}
+
+// handleChooseStorage records the user's choice and finishes setup.
+// POST /storage  body: {"use_sd_card":true}
+//
+//	or {"device":"/dev/sda"}                                      (already formatted)
+//	or {"device":"/dev/sda","format":true,"confirm_token":"…"}    (erase it first)
+func (p *portal) handleChooseStorage(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Device       string `json:"device"`
+		UseSDCard    bool   `json:"use_sd_card"`
+		Format       bool   `json:"format"`
+		ConfirmToken string `json:"confirm_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if p.wizard.state().Step != StepStorage {
+		http.Error(w, "not at the storage step", http.StatusConflict)
+		return
+	}
+
+	if req.UseSDCard {
+		p.decide(w, disk.Decision{UseSDCard: true})
+		return
+	}
+
+	d, err := p.storage.findDrive(req.Device)
+	if err != nil {
+		http.Error(w, "unknown drive", http.StatusBadRequest)
+		return
+	}
+	if d.System {
+		http.Error(w, "the system drive can only be used as the SD card option", http.StatusBadRequest)
+		return
+	}
+	if !req.Format {
+		if !d.Formatted {
+			http.Error(w, "drive is not formatted — authorize formatting to use it", http.StatusBadRequest)
+			return
+		}
+		p.decide(w, disk.Decision{Device: d.Path})
+		return
+	}
+
+	if err := p.storage.tokens.Consume(d.Path, req.ConfirmToken); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if !p.wizard.advance(StepStorage, StepFormatting) {
+		http.Error(w, "not at the storage step", http.StatusConflict)
+		return
+	}
+	p.wizard.mu.Lock()
+	p.wizard.device = d.Path
+	p.wizard.mu.Unlock()
+
+	slog.Info("setup: formatting data drive", "device", d.Path)
+	go p.format(d.Path)
+
+	writeJSON(w, http.StatusAccepted, p.wizard.state())
+}
+
+// format erases device in the background and, on success, records the
+// decision and connects. On failure the wizard goes back to the storage
+// step with the error so the user can pick again.
+func (p *portal) format(device string) {
+	if err := p.storage.drives.Format(device, p.wizard.setProgress); err != nil {
+		slog.Error("setup: formatting failed", "device", device, "err", err)
+		p.wizard.fail(StepStorage, "formatting "+device+" failed: "+err.Error())
+		return
+	}
+	dec := disk.Decision{Device: device, Formatted: true, DecidedAt: p.storage.now().UTC()}
+	if err := disk.SaveDecision(p.storage.decisionPath, dec); err != nil {
+		slog.Error("setup: could not save storage decision", "err", err)
+		p.wizard.fail(StepStorage, "could not save storage choice")
+		return
+	}
+	if p.wizard.advance(StepFormatting, StepConnecting) {
+		p.startConnect()
+	}
+}
+
+// decide saves a decision that needs no formatting and connects.
+func (p *portal) decide(w http.ResponseWriter, dec disk.Decision) {
+	dec.DecidedAt = p.storage.now().UTC()
+	if err := disk.SaveDecision(p.storage.decisionPath, dec); err != nil {
+		slog.Error("setup: could not save storage decision", "err", err)
+		http.Error(w, "could not save storage choice", http.StatusInternalServerError)
+		return
+	}
+	if !p.wizard.advance(StepStorage, StepConnecting) {
+		http.Error(w, "not at the storage step", http.StatusConflict)
+		return
+	}
+	slog.Info("setup: storage chosen", "device", dec.Device, "sd_card", dec.UseSDCard)
+	writeJSON(w, http.StatusOK, p.wizard.state())
+	p.startConnect()
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
@@ -230,6 +230,27 @@ const HtmlPage = `
                 <button class="btn-secondary" onclick="backToList()" style="width: 100%; margin-top: 10px; padding: 12px; border-radius: 9999px; border:none; color: #666;">Back</button>
             </div>
 
+            <!-- Storage State -->
+            <div id="storage-card" class="card hidden">
+                <h3 style="margin-bottom: 5px;">Choose data drive</h3>
+                <p style="margin-bottom: 15px; font-size: 14px; color: #666;">Where should your files be stored?</p>
+                <ul id="drives"></ul>
+                <label id="format-confirm" class="hidden" style="display:block; margin: 15px 0; font-size: 14px; color: #a33;">
+                    <input id="format-check" type="checkbox" style="width:auto; margin:0 8px 0 0;">
+                    <span id="format-warning"></span>
+                </label>
+                <p id="storage-error" class="hidden" style="margin: 10px 0; color: #a33; font-size: 14px;"></p>
+                <button class="btn" onclick="chooseStorage()" style="width: 100%; margin-top: 10px;">Continue</button>
+            </div>
+
+            <!-- Formatting State -->
+            <div id="formatting-card" class="card hidden" style="text-align: center">
+                <div class="spinner"></div>
+                <h3 style="margin: 15px 0 5px;">Preparing drive...</h3>
+                <p id="format-progress" style="color: #666;">Starting</p>
+                <p style="margin-top: 10px; font-size: 14px; color: #666;">Do not unplug the drive.</p>
+            </div>
+
              <!-- Success State -->
              <div id="success-card" class="card hidden" style="text-align: center">
                 <h3 style="margin-bottom: 10px;">Connecting...</h3>
@@ -243,7 +264,7 @@ const HtmlPage = `
     const el = (id) => document.getElementById(id);
 
     function show(id) {
-        ['intro-card', 'loading', 'list-card', 'form-card', 'success-card'].forEach(i => el(i).classList.add('hidden'));
+        ['intro-card', 'loading', 'list-card', 'form-card', 'storage-card', 'formatting-card', 'success-card'].forEach(i => el(i).classList.add('hidden'));
         el(id).classList.remove('hidden');
     }
 
@@ -294,7 +315,12 @@ const HtmlPage = `
                 body: JSON.stringify({ssid, password: pass})
             });
             if (!res.ok) throw new Error("Connection failed");
-            show('success-card');
+            let state = await res.json();
+            if (state.step === 'storage') {
+                loadDrives();
+            } else {
+                show('success-card');
+            }
         } catch (e) {
             alert("Failed to send credentials.");
             btn.innerText = "Connect";
@@ -302,6 +328,122 @@ const HtmlPage = `
         }
     }
 
+    let drives = [];
+    let selectedDrive = null; // null = keep using the SD card
+
+    function fmtBytes(n) {
+        const units = ['B', 'KB', 'MB', 'GB', 'TB'];
+        let i = 0;
+        while (n >= 1024 && i < units.length - 1) { n /= 1024; i++; }
+        return n.toFixed(1) + ' ' + units[i];
+    }
+
+    function driveItem(title, detail, onclick) {
+        let li = document.createElement('li');
+        li.className = 'net-item';
+        let div = document.createElement('div');
+        let strong = document.createElement('strong');
+        strong.innerText = title;
+        let small = document.createElement('small');
+        small.innerText = detail;
+        div.appendChild(strong);
+        div.appendChild(small);
+        li.appendChild(div);
+        li.onclick = () => {
+            document.querySelectorAll('#drives .net-item').forEach(x => x.style.outline = '');
+            li.style.outline = '2px solid var(--accent-yellow)';
+            onclick();
+        };
+        return li;
+    }
+
+    async function loadDrives() {
+        show('loading');
+        try {
+            let res = await fetch('/storage/drives');
+            if (!res.ok) throw new Error("Drive list failed");
+            drives = await res.json();
+        } catch (e) {
+            drives = [];
+        }
+
+        let list = el('drives');
+        list.innerHTML = '';
+        selectedDrive = null;
+        list.appendChild(driveItem('SD card', 'Keep files on the built-in card', () => selectDrive(null)));
+        drives.filter(d => !d.system).forEach(d => {
+            let detail = d.size + ' · ' + (d.formatted ? d.fstype : 'not formatted');
+            if (d.contents) {
+                detail += ' · ' + d.contents.entries + ' items, ' + fmtBytes(d.contents.used_bytes) + ' used';
+                if (d.contents.sample.length) detail += ' (' + d.contents.sample.join(', ') + ')';
+            }
+            list.appendChild(driveItem((d.model || 'Drive') + ' ' + d.path, detail, () => selectDrive(d)));
+        });
+        el('storage-error').classList.add('hidden');
+        show('storage-card');
+    }
+
+    function selectDrive(d) {
+        selectedDrive = d;
+        el('format-check').checked = false;
+        if (d) {
+            el('format-warning').innerText = d.formatted
+                ? 'Erase everything on ' + d.path + ' and format it (optional)'
+                : d.path + ' must be formatted before use. Erase it?';
+            el('format-confirm').classList.remove('hidden');
+        } else {
+            el('format-confirm').classList.add('hidden');
+        }
+    }
+
+    function storageError(msg) {
+        el('storage-error').innerText = msg;
+        el('storage-error').classList.remove('hidden');
+        show('storage-card');
+    }
+
+    async function chooseStorage() {
+        let body = {use_sd_card: true};
+        if (selectedDrive) {
+            let format = el('format-check').checked;
+            if (!selectedDrive.formatted && !format) {
+                return storageError('Tick the box to allow formatting this drive.');
+            }
+            body = {device: selectedDrive.path, format: format};
+            if (format) {
+                let tr = await fetch('/storage/format-token', {
+                    method: 'POST',
+                    body: JSON.stringify({device: selectedDrive.path})
+                });
+                if (!tr.ok) return storageError(await tr.text());
+                body.confirm_token = (await tr.json()).confirm_token;
+            }
+        }
+
+        let res = await fetch('/storage', {method: 'POST', body: JSON.stringify(body)});
+        if (!res.ok) return storageError(await res.text());
+        let state = await res.json();
+        if (state.step === 'formatting') {
+            show('formatting-card');
+            pollFormatting();
+        } else {
+            show('success-card');
+        }
+    }
+
+    async function pollFormatting() {
+        try {
+            let state = await (await fetch('/setup/state')).json();
+            if (state.step === 'storage') return storageError(state.error || 'Formatting failed');
+            if (state.step === 'connecting') return show('success-card');
+            el('format-progress').innerText = state.progress || 'Starting';
+        } catch (e) {
+            // The hotspot drops once we connect — that means we are done.
+            return show('success-card');
+        }
+        setTimeout(pollFormatting, 1000);
+    }
+
     function resetUI() { show('intro-card'); }
     function backToList() { show('list-card'); }
 </script>
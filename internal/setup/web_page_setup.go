@@ -18,7 +18,10 @@ type Credentials struct {
 	Password string `json:"password"`
 }
 
-func StartCaptivePortal(ctx context.Context, wifiMgr wifi.Provider, done chan<- bool, devMode bool) {
+// StartCaptivePortal serves the setup wizard until the device is online.
+// storage adds the data-drive step after the WiFi credentials; pass nil
+// to skip it.
+func StartCaptivePortal(ctx context.Context, wifiMgr wifi.Provider, storage *Storage, done chan<- bool, devMode bool) {
 	port := ":80"
 	if devMode {
 		port = ":8082"
@@ -29,7 +32,7 @@ func StartCaptivePortal(ctx context.Context, wifiMgr wifi.Provider, done chan<-
 	// we need to trigger server shutdown AND notify the caller.
 	connected := make(chan struct{})
 
-	mux := buildMux(ctx, wifiMgr, connected)
+	mux := buildMux(ctx, wifiMgr, storage, connected)
 
 	srv := &http.Server{
 		Addr:         port,
@@ -89,8 +92,23 @@ func StartCaptivePortal(ctx context.Context, wifiMgr wifi.Provider, done chan<-
 	// AFTER ListenAndServe returns, guaranteed in both shutdown paths.
 }
 
-// buildMux wires up the three routes. Extracted so Start is readable.
-func buildMux(ctx context.Context, wifiMgr wifi.Provider, connected chan<- struct{}) *http.ServeMux {
+// connectDelay gives the HTTP response time to reach the browser before the
+// hotspot drops. A var so tests don't wait on it.
+var connectDelay = 2 * time.Second
+
+// portal holds the handlers' shared state for one captive-portal run.
+type portal struct {
+	ctx       context.Context
+	wifiMgr   wifi.Provider
+	storage   *Storage
+	wizard    *wizard
+	connected chan<- struct{}
+}
+
+// buildMux wires up the routes. Extracted so Start is readable. storage
+// may be nil, in which case /connect connects straight away.
+func buildMux(ctx context.Context, wifiMgr wifi.Provider, storage *Storage, connected chan<- struct{}) *http.ServeMux {
+	p := &portal{ctx: ctx, wifiMgr: wifiMgr, storage: storage, wizard: newWizard(), connected: connected}
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("GET /scan", func(w http.ResponseWriter, r *http.Request) {
@@ -104,54 +122,13 @@ func buildMux(ctx context.Context, wifiMgr wifi.Provider, connected chan<- struc
 		json.NewEncoder(w).Encode(networks)
 	})
 
-	mux.HandleFunc("POST /connect", func(w http.ResponseWriter, r *http.Request) {
-		var creds Credentials
-		if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
-			http.Error(w, "invalid JSON", http.StatusBadRequest)
-			return
-		}
-		if creds.SSID == "" {
-			http.Error(w, "ssid is required", http.StatusBadRequest)
-			return
-		}
-
-		slog.Info("setup: credentials received", "ssid", creds.SSID)
-
-		// Respond immediately — the hotspot will drop when we switch to
-		// client mode, so the browser must get the response before we Connect.
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprint(w, "Credentials received. Connecting...")
-
-		// Apply credentials in the background.
-		// Use ctx so this is cancelled cleanly if the agent shuts down
-		// in the ~2s window before we call Connect.
-		go func() {
-			// Brief delay so the HTTP response reaches the browser before
-			// the network interface changes and the connection drops.
-			select {
-			case <-ctx.Done():
-				slog.Warn("setup: context cancelled before connect attempt")
-				return
-			case <-time.After(2 * time.Second):
-			}
-
-			slog.Info("setup: connecting to WiFi", "ssid", creds.SSID)
-			if err := wifiMgr.Connect(creds.SSID, creds.Password); err != nil {
-				slog.Error("setup: WiFi connect failed", "ssid", creds.SSID, "err", err)
-				// TODO: signal the frontend somehow (websocket / retry endpoint)
-				// For now, the user will have to retry from the hotspot.
-				return
-			}
-
-			slog.Info("setup: WiFi connected successfully", "ssid", creds.SSID)
-			// Non-blocking send: if the shutdown watcher already fired
-			// (e.g. ctx cancelled), we don't deadlock.
-			select {
-			case connected <- struct{}{}:
-			default:
-			}
-		}()
-	})
+	mux.HandleFunc("POST /connect", p.handleConnect)
+	mux.HandleFunc("GET /setup/state", p.handleState)
+	if storage != nil {
+		mux.HandleFunc("GET /storage/drives", p.handleDrives)
+		mux.HandleFunc("POST /storage/format-token", p.handleFormatToken)
+		mux.HandleFunc("POST /storage", p.handleChooseStorage)
+	}
 
 	mux.HandleFunc("GET /", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/html")
@@ -162,6 +139,79 @@ func buildMux(ctx context.Context, wifiMgr wifi.Provider, connected chan<- struc
 	return mux
 }
 
+// handleConnect takes the WiFi credentials. With a storage step pending
+// they are held until the user picks a drive; otherwise we connect now.
+func (p *portal) handleConnect(w http.ResponseWriter, r *http.Request) {
+	var creds Credentials
+	if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
+		http.Error(w, "invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if creds.SSID == "" {
+		http.Error(w, "ssid is required", http.StatusBadRequest)
+		return
+	}
+
+	next := StepConnecting
+	if p.storage != nil {
+		next = StepStorage
+	}
+	if !p.wizard.advance(StepCredentials, next) {
+		http.Error(w, "credentials already submitted", http.StatusConflict)
+		return
+	}
+	p.wizard.mu.Lock()
+	p.wizard.creds = creds
+	p.wizard.mu.Unlock()
+
+	slog.Info("setup: credentials received", "ssid", creds.SSID, "next", next)
+
+	// Respond immediately — the hotspot will drop when we switch to
+	// client mode, so the browser must get the response before we Connect.
+	writeJSON(w, http.StatusOK, p.wizard.state())
+
+	if next == StepConnecting {
+		p.startConnect()
+	}
+}
+
+// startConnect applies the stored credentials in the background.
+// Use ctx so this is cancelled cleanly if the agent shuts down
+// in the ~2s window before we call Connect.
+func (p *portal) startConnect() {
+	p.wizard.mu.Lock()
+	creds := p.wizard.creds
+	p.wizard.mu.Unlock()
+
+	go func() {
+		// Brief delay so the HTTP response reaches the browser before
+		// the network interface changes and the connection drops.
+		select {
+		case <-p.ctx.Done():
+			slog.Warn("setup: context cancelled before connect attempt")
+			return
+		case <-time.After(connectDelay):
+		}
+
+		slog.Info("setup: connecting to WiFi", "ssid", creds.SSID)
+		if err := p.wifiMgr.Connect(creds.SSID, creds.Password); err != nil {
+			slog.Error("setup: WiFi connect failed", "ssid", creds.SSID, "err", err)
+			// TODO: signal the frontend somehow (websocket / retry endpoint)
+			// For now, the user will have to retry from the hotspot.
+			p.wizard.fail(StepCredentials, "could not connect to "+creds.SSID)
+			return
+		}
+
+		slog.Info("setup: WiFi connected successfully", "ssid", creds.SSID)
+		// Non-blocking send: if the shutdown watcher already fired
+		// (e.g. ctx cancelled), we don't deadlock.
+		select {
+		case p.connected <- struct{}{}:
+		default:
+		}
+	}()
+}
+
 // func StartCaptivePortal(ctx context.Context, wifiMgr wifi.Provider, done chan<- bool, devMode bool) {
 // 	mux := http.NewServeMux()
 
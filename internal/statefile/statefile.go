@@ -0,0 +1,178 @@
+// Package statefile versions the JSON documents features persist under
+// DataDir and /etc/strct. Every document carries a schema_version; loading
+// an older one runs the registered migrations in order and rewrites the
+// file, and a file that no longer parses is moved aside instead of taking
+// its feature down.
+//
+// Files written before versioning have no schema_version and are treated
+// as version 0, so every Schema's first migration lifts the old shape to
+// version 1.
+package statefile
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/fsutil"
+	"github.com/strct-org/strct-agent/internal/metrics"
+)
+
+const versionKey = "schema_version"
+
+// ErrCorrupt is returned by Load when the file could not be decoded and
+// was moved aside. The caller should carry on with its defaults.
+var ErrCorrupt = errors.New("state file corrupt")
+
+// Migration upgrades a document by one version. doc is the decoded JSON
+// (map[string]any for objects, []any for arrays) with numbers kept as
+// json.Number; the result must be a map[string]any.
+type Migration func(doc any) (any, error)
+
+// Schema describes one kind of persisted document. Migrations[i] upgrades
+// version i to i+1, so the current version is len(Migrations).
+type Schema struct {
+	Name       string // for logs and metrics, e.g. "wifi-config"
+	Migrations []Migration
+}
+
+func (s Schema) Version() int { return len(s.Migrations) }
+
+// Stamp is the migration for a document whose shape did not change; it
+// only gains a schema_version.
+func Stamp(doc any) (any, error) {
+	if _, ok := doc.(map[string]any); !ok {
+		return nil, fmt.Errorf("expected a JSON object, got %T", doc)
+	}
+	return doc, nil
+}
+
+// Wrap returns a migration that nests a whole document under field, for
+// files that used to be a bare map or array and so had nowhere to put
+// a schema_version.
+func Wrap(field string) Migration {
+	return func(doc any) (any, error) {
+		return map[string]any{field: doc}, nil
+	}
+}
+
+// Fresh reports whether a Load error means "start from defaults": no file
+// yet, or a corrupt one that has been moved aside.
+func Fresh(err error) bool {
+	return errors.Is(err, os.ErrNotExist) || errors.Is(err, ErrCorrupt)
+}
+
+// Load decodes the document at path into v, migrating and rewriting it
+// first if it is older than s. A missing file returns an error satisfying
+// errors.Is(err, os.ErrNotExist). An undecodable file is renamed to
+// <path>.corrupt-<timestamp> and ErrCorrupt is returned. A file newer than
+// s (after a rollback) is left untouched and returned as an error.
+func Load(path string, s Schema, v any) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var doc any
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return quarantine(path, s, err)
+	}
+
+	version, err := versionOf(doc)
+	if err != nil {
+		return quarantine(path, s, err)
+	}
+	if version > s.Version() {
+		return fmt.Errorf("%s: schema version %d is newer than supported %d", filepath.Base(path), version, s.Version())
+	}
+
+	from := version
+	for version < s.Version() {
+		doc, err = s.Migrations[version](doc)
+		if err != nil {
+			return quarantine(path, s, fmt.Errorf("migrate v%d: %w", version, err))
+		}
+		version++
+	}
+	obj, ok := doc.(map[string]any)
+	if !ok {
+		return quarantine(path, s, fmt.Errorf("expected a JSON object, got %T", doc))
+	}
+	obj[versionKey] = version
+
+	migrated, err := json.Marshal(obj)
+	if err != nil {
+		return fmt.Errorf("encode %s: %w", filepath.Base(path), err)
+	}
+	if err := json.Unmarshal(migrated, v); err != nil {
+		return quarantine(path, s, err)
+	}
+
+	if from != version {
+		if err := fsutil.WriteJSON(path, obj); err != nil {
+			// v is already usable; the next save writes the new shape.
+			slog.Warn("statefile: could not rewrite migrated file", "doc", s.Name, "path", path, "err", err)
+		} else {
+			slog.Info("statefile: migrated", "doc", s.Name, "from", from, "to", version)
+		}
+	}
+	return nil
+}
+
+// Save writes v, which must encode as a JSON object, with the schema's
+// current version.
+func Save(path string, s Schema, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("marshal %s: %w", filepath.Base(path), err)
+	}
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(b, &obj); err != nil {
+		return fmt.Errorf("%s: state must be a JSON object: %w", s.Name, err)
+	}
+	obj[versionKey] = json.RawMessage(strconv.Itoa(s.Version()))
+	return fsutil.WriteJSON(path, obj)
+}
+
+// versionOf returns the document's schema_version, 0 if it has none.
+func versionOf(doc any) (int, error) {
+	obj, ok := doc.(map[string]any)
+	if !ok {
+		return 0, nil
+	}
+	raw, ok := obj[versionKey]
+	if !ok {
+		return 0, nil
+	}
+	n, ok := raw.(json.Number)
+	if !ok {
+		return 0, fmt.Errorf("%s is %T, not a number", versionKey, raw)
+	}
+	v, err := strconv.Atoi(n.String())
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid %s %q", versionKey, n)
+	}
+	return v, nil
+}
+
+// quarantine moves an undecodable file aside so the feature can start from
+// defaults while the original stays around for inspection.
+func quarantine(path string, s Schema, cause error) error {
+	dst := fmt.Sprintf("%s.corrupt-%s", path, time.Now().UTC().Format("20060102T150405Z"))
+	if err := os.Rename(path, dst); err != nil {
+		return fmt.Errorf("decode %s: %w (could not move aside: %v)", filepath.Base(path), cause, err)
+	}
+	metrics.NewCounter("strct_state_files_quarantined_total",
+		"Persisted state files moved aside because they could not be decoded.", "doc", s.Name).Inc()
+	slog.Warn("statefile: corrupt file moved aside, starting from defaults",
+		"doc", s.Name, "path", path, "moved_to", dst, "err", cause)
+	return fmt.Errorf("%w: %s: %v", ErrCorrupt, filepath.Base(path), cause)
+}
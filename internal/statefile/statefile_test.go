@@ -0,0 +1,184 @@
+package statefile
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type settings struct {
+	DisplayName string `json:"display_name"`
+	Retries     int    `json:"retries"`
+	Bytes       uint64 `json:"bytes"`
+}
+
+// testSchema has a rename at v2 on top of the usual v1 stamp.
+var testSchema = Schema{
+	Name: "test",
+	Migrations: []Migration{
+		Stamp,
+		func(doc any) (any, error) {
+			m := doc.(map[string]any)
+			m["display_name"] = m["name"]
+			delete(m, "name")
+			return m, nil
+		},
+	},
+}
+
+func writeFixture(t *testing.T, body string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "settings.json")
+	if err := os.WriteFile(path, []byte(body), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func readVersion(t *testing.T, path string) int {
+	t.Helper()
+	var doc struct {
+		Version int `json:"schema_version"`
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		t.Fatal(err)
+	}
+	return doc.Version
+}
+
+func TestLoad_MigratesUnversionedFile(t *testing.T) {
+	path := writeFixture(t, `{"name":"kitchen","retries":3,"bytes":18446744073709551615}`)
+
+	var s settings
+	if err := Load(path, testSchema, &s); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	want := settings{DisplayName: "kitchen", Retries: 3, Bytes: 18446744073709551615}
+	if s != want {
+		t.Errorf("loaded %+v, want %+v", s, want)
+	}
+
+	// The file is rewritten in the new shape, so the next load is a no-op.
+	if v := readVersion(t, path); v != 2 {
+		t.Errorf("rewritten schema_version = %d, want 2", v)
+	}
+	var again settings
+	if err := Load(path, testSchema, &again); err != nil || again != want {
+		t.Errorf("second load = %+v, %v", again, err)
+	}
+}
+
+func TestLoad_RunsOnlyPendingMigrations(t *testing.T) {
+	path := writeFixture(t, `{"schema_version":1,"name":"hall","retries":1}`)
+
+	var s settings
+	if err := Load(path, testSchema, &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.DisplayName != "hall" {
+		t.Errorf("display_name = %q, want hall", s.DisplayName)
+	}
+}
+
+func TestLoad_CurrentVersionIsNotRewritten(t *testing.T) {
+	body := `{"schema_version":2,"display_name":"den"}`
+	path := writeFixture(t, body)
+
+	var s settings
+	if err := Load(path, testSchema, &s); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(path); string(b) != body {
+		t.Errorf("file rewritten: %s", b)
+	}
+}
+
+func TestLoad_QuarantinesCorruptFile(t *testing.T) {
+	for _, body := range []string{
+		`{"name":"kitchen",`,
+		`{"schema_version":"two"}`,
+		`{"schema_version":2,"retries":"many"}`,
+		`["not","an","object"]`,
+	} {
+		path := writeFixture(t, body)
+
+		var s settings
+		err := Load(path, testSchema, &s)
+		if !errors.Is(err, ErrCorrupt) || !Fresh(err) {
+			t.Errorf("%s: err = %v, want ErrCorrupt", body, err)
+		}
+		if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s: corrupt file left in place", body)
+		}
+		moved, _ := filepath.Glob(path + ".corrupt-*")
+		if len(moved) != 1 {
+			t.Fatalf("%s: quarantined files = %v", body, moved)
+		}
+		if b, _ := os.ReadFile(moved[0]); string(b) != body {
+			t.Errorf("%s: quarantined copy = %s", body, b)
+		}
+	}
+}
+
+func TestLoad_NewerVersionIsLeftAlone(t *testing.T) {
+	body := `{"schema_version":9,"display_name":"future"}`
+	path := writeFixture(t, body)
+
+	var s settings
+	err := Load(path, testSchema, &s)
+	if err == nil || Fresh(err) || !strings.Contains(err.Error(), "newer") {
+		t.Fatalf("err = %v, want a newer-version error", err)
+	}
+	if b, _ := os.ReadFile(path); string(b) != body {
+		t.Errorf("file changed: %s", b)
+	}
+}
+
+func TestLoad_MissingFile(t *testing.T) {
+	var s settings
+	err := Load(filepath.Join(t.TempDir(), "nope.json"), testSchema, &s)
+	if !errors.Is(err, os.ErrNotExist) || !Fresh(err) {
+		t.Errorf("err = %v, want ErrNotExist", err)
+	}
+}
+
+func TestSave_StampsCurrentVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "settings.json")
+	if err := Save(path, testSchema, settings{DisplayName: "attic", Bytes: 1 << 62}); err != nil {
+		t.Fatal(err)
+	}
+	if v := readVersion(t, path); v != 2 {
+		t.Errorf("schema_version = %d, want 2", v)
+	}
+	var s settings
+	if err := Load(path, testSchema, &s); err != nil || s.DisplayName != "attic" || s.Bytes != 1<<62 {
+		t.Errorf("round trip = %+v, %v", s, err)
+	}
+
+	if err := Save(path, testSchema, []string{"array"}); err == nil {
+		t.Error("saving a non-object succeeded")
+	}
+}
+
+func TestWrap_LegacyBareDocuments(t *testing.T) {
+	schema := Schema{Name: "names", Migrations: []Migration{Wrap("names")}}
+	path := writeFixture(t, `{"aa:bb:cc:dd:ee:01":"Laptop"}`)
+
+	var doc struct {
+		Names map[string]string `json:"names"`
+	}
+	if err := Load(path, schema, &doc); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(doc.Names); got != "map[aa:bb:cc:dd:ee:01:Laptop]" {
+		t.Errorf("names = %s", got)
+	}
+}
@@ -0,0 +1,168 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// The bolt backend keeps records in one bucket under 16-byte keys: the
+// record's key, its sign bit flipped so negative keys sort first, then a
+// sequence number that keeps records with the same key apart and in
+// append order.
+var boltBucket = []byte("records")
+
+type boltLog struct {
+	mu    sync.Mutex // Compact swaps db
+	path  string
+	db    *bolt.DB
+	floor int64
+}
+
+func openBolt(path string) (*boltLog, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("store: open %s: %w", path, err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("store: open %s: %w", path, err)
+	}
+	return &boltLog{path: path, db: db, floor: minKey}, nil
+}
+
+func boltKey(key int64, seq uint64) []byte {
+	b := make([]byte, 16)
+	binary.BigEndian.PutUint64(b, uint64(key)^(1<<63))
+	binary.BigEndian.PutUint64(b[8:], seq)
+	return b
+}
+
+func keyOf(b []byte) int64 {
+	return int64(binary.BigEndian.Uint64(b) ^ (1 << 63))
+}
+
+func (l *boltLog) Append(recs ...Record) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltBucket)
+		for _, r := range recs {
+			if r.Key < l.floor {
+				continue
+			}
+			seq, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+			if err := b.Put(boltKey(r.Key, seq), r.Data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (l *boltLog) Range(from, to int64, fn func(Record) bool) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	start := max(from, l.floor)
+	if start >= to {
+		return nil
+	}
+	end := boltKey(to, 0)
+	return l.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltBucket).Cursor()
+		for k, v := c.Seek(boltKey(start, 0)); k != nil && bytes.Compare(k, end) < 0; k, v = c.Next() {
+			if !fn(Record{Key: keyOf(k), Data: append([]byte(nil), v...)}) {
+				break
+			}
+		}
+		return nil
+	})
+}
+
+func (l *boltLog) PruneBefore(key int64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if key <= l.floor {
+		return nil
+	}
+	l.floor = key
+	end := boltKey(key, 0)
+	return l.db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltBucket).Cursor()
+		for k, _ := c.First(); k != nil && bytes.Compare(k, end) < 0; k, _ = c.First() {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Compact copies the live records into a fresh file: bbolt reuses the
+// pages pruning freed but never shrinks its file.
+func (l *boltLog) Compact() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	tmp := l.path + ".tmp"
+	os.Remove(tmp) //nolint:errcheck
+	dst, err := bolt.Open(tmp, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return fmt.Errorf("store: compact %s: %w", l.path, err)
+	}
+	err = bolt.Compact(dst, l.db, 1<<20)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp) //nolint:errcheck
+		return fmt.Errorf("store: compact %s: %w", l.path, err)
+	}
+	if err := l.db.Close(); err != nil {
+		return err
+	}
+	renameErr := os.Rename(tmp, l.path)
+	if renameErr != nil {
+		os.Remove(tmp) //nolint:errcheck
+	}
+	db, err := bolt.Open(l.path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return fmt.Errorf("store: reopen %s: %w", l.path, err)
+	}
+	l.db = db
+	if renameErr != nil {
+		return fmt.Errorf("store: compact %s: %w", l.path, renameErr)
+	}
+	return nil
+}
+
+func (l *boltLog) Stats() Stats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var st Stats
+	l.db.View(func(tx *bolt.Tx) error { //nolint:errcheck
+		st.Records = tx.Bucket(boltBucket).Stats().KeyN
+		return nil
+	})
+	// bbolt grows its file ahead of the data in it.
+	if fi, err := os.Stat(l.path); err == nil {
+		st.Bytes = fi.Size()
+	}
+	return st
+}
+
+func (l *boltLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.db.Close()
+}
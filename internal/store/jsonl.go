@@ -0,0 +1,260 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+// The jsonl backend. Each record is a line
+//
+//	{"k":1729080000,"d":{...}}
+//
+// and PruneBefore appends {"prune":1729080000}: records above that line
+// with lower keys are gone. A line cut short by a power loss doesn't
+// parse; it is cut off at open so the next append starts a fresh line.
+// Once pruned records are at least half the file, and at least
+// minCompactDead of them, the file is rewritten with the live ones.
+const (
+	minCompactDead = 64
+	maxLine        = 1 << 20
+)
+
+type jsonlLine struct {
+	Key   *int64          `json:"k,omitempty"`
+	Data  json.RawMessage `json:"d,omitempty"`
+	Prune *int64          `json:"prune,omitempty"`
+}
+
+type jsonlLog struct {
+	mu    sync.Mutex
+	path  string
+	f     *os.File // O_APPEND
+	floor int64    // what PruneBefore dropped is below it
+	keys  []int64  // of the live records, in file order
+	dead  int
+	size  int64
+}
+
+func openJSONL(path string) (*jsonlLog, error) {
+	l := &jsonlLog{path: path, floor: minKey}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	var all []int64
+	good, err := scanJSONL(f, func(ln jsonlLine) {
+		switch {
+		case ln.Prune != nil:
+			l.floor = max(l.floor, *ln.Prune)
+		case ln.Key != nil:
+			all = append(all, *ln.Key)
+		}
+	})
+	if err == nil {
+		// Drop a torn last line.
+		err = f.Truncate(good)
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("store: open %s: %w", path, err)
+	}
+	for _, k := range all {
+		if k >= l.floor {
+			l.keys = append(l.keys, k)
+		} else {
+			l.dead++
+		}
+	}
+	l.f, l.size = f, good
+	return l, nil
+}
+
+// scanJSONL reads r's lines into fn and returns the offset just past the
+// last complete line. Lines that don't parse are skipped.
+func scanJSONL(r io.Reader, fn func(jsonlLine)) (int64, error) {
+	br := bufio.NewReaderSize(r, 64<<10)
+	var off int64
+	for {
+		line, err := br.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			// A record past the buffer: read the rest of it.
+			rest, rerr := br.ReadBytes('\n')
+			line, err = append(append([]byte(nil), line...), rest...), rerr
+		}
+		if err == io.EOF {
+			return off, nil
+		}
+		if err != nil {
+			return off, err
+		}
+		off += int64(len(line))
+		var ln jsonlLine
+		if len(line) <= maxLine && json.Unmarshal(line, &ln) == nil {
+			fn(ln)
+		}
+	}
+}
+
+func (l *jsonlLog) Append(recs ...Record) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var buf bytes.Buffer
+	var keys []int64
+	for _, r := range recs {
+		if r.Key < l.floor {
+			continue
+		}
+		k := r.Key
+		line, err := json.Marshal(jsonlLine{Key: &k, Data: r.Data})
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+		keys = append(keys, k)
+	}
+	if buf.Len() == 0 {
+		return nil
+	}
+	if err := l.write(buf.Bytes()); err != nil {
+		return err
+	}
+	l.keys = append(l.keys, keys...)
+	return nil
+}
+
+func (l *jsonlLog) write(b []byte) error {
+	n, err := l.f.Write(b)
+	l.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("store: write %s: %w", l.path, err)
+	}
+	return nil
+}
+
+func (l *jsonlLog) Range(from, to int64, fn func(Record) bool) error {
+	l.mu.Lock()
+	f, err := os.Open(l.path)
+	if err != nil {
+		l.mu.Unlock()
+		return err
+	}
+	var recs []Record
+	floor := l.floor
+	_, err = scanJSONL(io.LimitReader(f, l.size), func(ln jsonlLine) {
+		if ln.Key != nil && *ln.Key >= floor && *ln.Key >= from && *ln.Key < to {
+			recs = append(recs, Record{Key: *ln.Key, Data: ln.Data})
+		}
+	})
+	l.mu.Unlock()
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("store: read %s: %w", l.path, err)
+	}
+	// Appends are usually in order already.
+	sort.SliceStable(recs, func(i, j int) bool { return recs[i].Key < recs[j].Key })
+	for _, r := range recs {
+		if !fn(r) {
+			break
+		}
+	}
+	return nil
+}
+
+func (l *jsonlLog) PruneBefore(key int64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if key <= l.floor {
+		return nil
+	}
+	l.floor = key
+	kept := l.keys[:0]
+	for _, k := range l.keys {
+		if k >= key {
+			kept = append(kept, k)
+		}
+	}
+	dropped := len(l.keys) - len(kept)
+	l.keys = kept
+	if dropped == 0 {
+		return nil
+	}
+	line, _ := json.Marshal(jsonlLine{Prune: &key})
+	if err := l.write(append(line, '\n')); err != nil {
+		return err
+	}
+	l.dead += dropped
+	if l.dead >= minCompactDead && l.dead >= len(l.keys) {
+		return l.compactLocked()
+	}
+	return nil
+}
+
+func (l *jsonlLog) Compact() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.compactLocked()
+}
+
+// compactLocked rewrites the file with the live records, in file order.
+func (l *jsonlLog) compactLocked() error {
+	if _, err := l.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	tmp := l.path + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp) //nolint:errcheck — no-op after a successful rename
+	w := bufio.NewWriter(out)
+	var size int64
+	_, err = scanJSONL(io.LimitReader(l.f, l.size), func(ln jsonlLine) {
+		if ln.Key == nil || *ln.Key < l.floor {
+			return
+		}
+		line, _ := json.Marshal(ln)
+		n, _ := w.Write(append(line, '\n'))
+		size += int64(n)
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, l.path)
+	}
+	if err != nil {
+		return fmt.Errorf("store: compact %s: %w", l.path, err)
+	}
+	l.f.Close()
+	f, err := os.OpenFile(l.path, os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("store: reopen %s: %w", l.path, err)
+	}
+	l.f, l.size, l.dead = f, size, 0
+	return nil
+}
+
+func (l *jsonlLog) Stats() Stats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return Stats{Records: len(l.keys), Dead: l.dead, Bytes: l.size}
+}
+
+func (l *jsonlLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
@@ -0,0 +1,171 @@
+// Package store is the append-only record log under the agent's
+// time-series and queue files: the monitor's history and its queue of
+// reports for the backend. Each used to keep its own file format, with
+// its own compaction; they now share one Log with two backends:
+//
+//   - jsonl (the default): one JSON line per record in <name>.jsonl,
+//     pruning appends a marker line and the file is rewritten once half
+//     of it is pruned records. Range reads the whole file;
+//   - bolt: a bbolt database in <name>.bolt, keyed in order, so Range
+//     seeks to its start instead of reading everything. It costs more
+//     disk per record and suits retention that makes the file large.
+//
+// STORE_BACKEND picks one. Opening a log with one backend while only the
+// other's file exists copies the records over, so switching loses
+// nothing, and Import does the same once for a feature's older file.
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// Backends.
+const (
+	BackendJSONL = "jsonl"
+	BackendBolt  = "bolt"
+)
+
+// Record is one entry. Key orders the log, e.g. Unix seconds for a
+// history or a sequence number for a queue; several records may share a
+// key. Data is the caller's JSON.
+type Record struct {
+	Key  int64
+	Data json.RawMessage
+}
+
+// Stats is a log's size.
+type Stats struct {
+	Records int   // live
+	Dead    int   // pruned but still on disk; jsonl only
+	Bytes   int64 // on disk
+}
+
+// Log is an append-only log of records. It is safe for concurrent use.
+type Log interface {
+	// Append adds recs. A record whose key is below what PruneBefore
+	// already dropped is dropped too.
+	Append(recs ...Record) error
+	// Range calls fn with the records whose keys are in [from, to), in
+	// key order and, for equal keys, in the order they were appended,
+	// until fn returns false.
+	Range(from, to int64, fn func(Record) bool) error
+	// PruneBefore drops the records with keys below key.
+	PruneBefore(key int64) error
+	// Compact gives back the space pruned records hold on disk.
+	Compact() error
+	Stats() Stats
+	Close() error
+}
+
+// Path is the file Open keeps name's records in, in dir.
+func Path(backend, dir, name string) string {
+	if backend == BackendBolt {
+		return filepath.Join(dir, name+".bolt")
+	}
+	return filepath.Join(dir, name+".jsonl")
+}
+
+// Open opens name's log in dir with backend ("" is jsonl), creating it if
+// need be.
+func Open(backend, dir, name string) (Log, error) {
+	var other string
+	switch backend {
+	case "", BackendJSONL:
+		backend, other = BackendJSONL, BackendBolt
+	case BackendBolt:
+		other = BackendJSONL
+	default:
+		return nil, fmt.Errorf("store: unknown backend %q", backend)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	path := Path(backend, dir, name)
+	_, statErr := os.Stat(path)
+	l, err := open(backend, path)
+	if err != nil {
+		return nil, err
+	}
+	if otherPath := Path(other, dir, name); os.IsNotExist(statErr) {
+		if err := convert(l, other, otherPath); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+func open(backend, path string) (Log, error) {
+	if backend == BackendBolt {
+		return openBolt(path)
+	}
+	return openJSONL(path)
+}
+
+// convert moves the records of the other backend's file, if there is
+// one, into l.
+func convert(l Log, backend, path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return nil
+	}
+	old, err := open(backend, path)
+	if err != nil {
+		return fmt.Errorf("store: open %s to convert it: %w", filepath.Base(path), err)
+	}
+	var recs []Record
+	err = old.Range(minKey, maxKey, func(r Record) bool {
+		recs = append(recs, r)
+		return true
+	})
+	old.Close()
+	if err != nil {
+		return fmt.Errorf("store: read %s to convert it: %w", filepath.Base(path), err)
+	}
+	if err := l.Append(recs...); err != nil {
+		return err
+	}
+	slog.Info("store: converted log", "from", filepath.Base(path), "records", len(recs))
+	return os.Remove(path)
+}
+
+// Import fills l once from a feature's older file at path: decode turns
+// its bytes into records. The file is removed once they are in l. A log
+// that already holds records was imported before a crash kept the file,
+// which is then only removed. Without the file Import does nothing.
+func Import(l Log, path string, decode func([]byte) ([]Record, error)) (int, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	if l.Stats().Records == 0 {
+		recs, err := decode(b)
+		if err != nil {
+			return 0, fmt.Errorf("store: import %s: %w", filepath.Base(path), err)
+		}
+		if err := l.Append(recs...); err != nil {
+			return 0, err
+		}
+		n = len(recs)
+	}
+	return n, os.Remove(path)
+}
+
+// The widest range.
+const (
+	minKey = -1 << 63
+	maxKey = 1<<63 - 1
+)
+
+// All is Range over every key.
+func All(l Log, fn func(Record) bool) error {
+	return l.Range(minKey, maxKey, fn)
+}
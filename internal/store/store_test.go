@@ -0,0 +1,258 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var backends = []string{BackendJSONL, BackendBolt}
+
+func rec(key int64, v string) Record {
+	b, _ := json.Marshal(v)
+	return Record{Key: key, Data: b}
+}
+
+func openLog(t testing.TB, backend, dir string) Log {
+	t.Helper()
+	l, err := Open(backend, dir, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+// dump lists the records in [from, to) as "key=value".
+func dump(t *testing.T, l Log, from, to int64) []string {
+	t.Helper()
+	var out []string
+	err := l.Range(from, to, func(r Record) bool {
+		var v string
+		json.Unmarshal(r.Data, &v) //nolint:errcheck
+		out = append(out, fmt.Sprintf("%d=%s", r.Key, v))
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func wantRecords(t *testing.T, got []string, want ...string) {
+	t.Helper()
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("records = %v, want %v", got, want)
+	}
+}
+
+func TestLog_RangeOrdersByKeyThenAppend(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(backend, func(t *testing.T) {
+			l := openLog(t, backend, t.TempDir())
+			if err := l.Append(rec(3, "c"), rec(1, "a"), rec(2, "b1"), rec(-5, "neg")); err != nil {
+				t.Fatal(err)
+			}
+			if err := l.Append(rec(2, "b2")); err != nil {
+				t.Fatal(err)
+			}
+			wantRecords(t, dump(t, l, minKey, maxKey), "-5=neg", "1=a", "2=b1", "2=b2", "3=c")
+			wantRecords(t, dump(t, l, 2, 3), "2=b1", "2=b2")
+
+			var n int
+			l.Range(minKey, maxKey, func(Record) bool { n++; return n < 2 }) //nolint:errcheck
+			if n != 2 {
+				t.Errorf("fn called %d times after returning false, want 2", n)
+			}
+		})
+	}
+}
+
+func TestLog_PruneBeforeSurvivesReopen(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(backend, func(t *testing.T) {
+			dir := t.TempDir()
+			l, err := Open(backend, dir, "test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := int64(1); i <= 5; i++ {
+				l.Append(rec(i, "x")) //nolint:errcheck
+			}
+			if err := l.PruneBefore(3); err != nil {
+				t.Fatal(err)
+			}
+			// Late records below the prune point are dropped.
+			l.Append(rec(2, "late"), rec(6, "x")) //nolint:errcheck
+			if st := l.Stats(); st.Records != 4 {
+				t.Errorf("Records = %d, want 4", st.Records)
+			}
+			l.Close()
+
+			l = openLog(t, backend, dir)
+			wantRecords(t, dump(t, l, minKey, maxKey), "3=x", "4=x", "5=x", "6=x")
+		})
+	}
+}
+
+func TestLog_CompactShrinksFile(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(backend, func(t *testing.T) {
+			dir := t.TempDir()
+			l := openLog(t, backend, dir)
+			big := string(make([]byte, 1000))
+			for i := int64(0); i < 2000; i++ {
+				l.Append(rec(i, big)) //nolint:errcheck
+			}
+			before := l.Stats().Bytes
+			l.PruneBefore(1990) //nolint:errcheck
+			if err := l.Compact(); err != nil {
+				t.Fatal(err)
+			}
+			st := l.Stats()
+			if st.Records != 10 || st.Dead != 0 || st.Bytes >= before/4 {
+				t.Errorf("after compaction %+v, want 10 records in well under %d bytes", st, before)
+			}
+			fi, err := os.Stat(Path(backend, dir, "test"))
+			if err != nil || fi.Size() != st.Bytes {
+				t.Errorf("file size = %v (%v), Stats says %d", fi.Size(), err, st.Bytes)
+			}
+			// Still appendable, and in order.
+			l.Append(rec(5000, "after")) //nolint:errcheck
+			got := dump(t, l, 1999, maxKey)
+			wantRecords(t, got, "1999="+big, "5000=after")
+		})
+	}
+}
+
+func TestJSONL_PruningCompactsOnItsOwn(t *testing.T) {
+	l := openLog(t, BackendJSONL, t.TempDir())
+	for i := int64(0); i < 200; i++ {
+		l.Append(rec(i, "x")) //nolint:errcheck
+	}
+	l.PruneBefore(50) //nolint:errcheck
+	if st := l.Stats(); st.Dead != 50 {
+		t.Fatalf("Dead = %d after pruning a quarter, want 50", st.Dead)
+	}
+	l.PruneBefore(120) //nolint:errcheck
+	if st := l.Stats(); st.Dead != 0 || st.Records != 80 {
+		t.Errorf("after pruning over half: %+v, want compacted to 80 records", st)
+	}
+}
+
+func TestJSONL_DropsTornLastLine(t *testing.T) {
+	dir := t.TempDir()
+	path := Path(BackendJSONL, dir, "test")
+	os.WriteFile(path, []byte(`{"k":1,"d":"a"}`+"\n"+`{"k":2,"d":"b"}`+"\n"+`{"k":3,"d":`), 0600) //nolint:errcheck
+
+	l := openLog(t, BackendJSONL, dir)
+	l.Append(rec(4, "d")) //nolint:errcheck
+	wantRecords(t, dump(t, l, minKey, maxKey), "1=a", "2=b", "4=d")
+}
+
+func TestOpen_ConvertsBetweenBackends(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(BackendJSONL, dir, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Append(rec(1, "a"), rec(2, "b")) //nolint:errcheck
+	l.Close()
+
+	l, err = Open(BackendBolt, dir, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantRecords(t, dump(t, l, minKey, maxKey), "1=a", "2=b")
+	if _, err := os.Stat(Path(BackendJSONL, dir, "test")); !os.IsNotExist(err) {
+		t.Errorf("jsonl file still there after converting: %v", err)
+	}
+	l.Append(rec(3, "c")) //nolint:errcheck
+	l.Close()
+
+	l = openLog(t, BackendJSONL, dir)
+	wantRecords(t, dump(t, l, minKey, maxKey), "1=a", "2=b", "3=c")
+}
+
+func TestImport_OnlyIntoAnEmptyLog(t *testing.T) {
+	dir := t.TempDir()
+	legacy := filepath.Join(dir, "old.json")
+	decode := func(b []byte) ([]Record, error) {
+		var vals []string
+		if err := json.Unmarshal(b, &vals); err != nil {
+			return nil, err
+		}
+		recs := make([]Record, len(vals))
+		for i, v := range vals {
+			recs[i] = rec(int64(i), v)
+		}
+		return recs, nil
+	}
+
+	os.WriteFile(legacy, []byte(`["a","b"]`), 0600) //nolint:errcheck
+	l := openLog(t, BackendJSONL, dir)
+	if n, err := Import(l, legacy, decode); err != nil || n != 2 {
+		t.Fatalf("Import = %d, %v; want 2 records", n, err)
+	}
+	if _, err := os.Stat(legacy); !os.IsNotExist(err) {
+		t.Errorf("legacy file kept after import: %v", err)
+	}
+
+	// A file left by a crash after the import isn't imported twice.
+	os.WriteFile(legacy, []byte(`["a","b"]`), 0600) //nolint:errcheck
+	if n, err := Import(l, legacy, decode); err != nil || n != 0 {
+		t.Errorf("second Import = %d, %v; want 0", n, err)
+	}
+	wantRecords(t, dump(t, l, minKey, maxKey), "0=a", "1=b")
+
+	if n, err := Import(l, legacy, decode); err != nil || n != 0 {
+		t.Errorf("Import without a file = %d, %v; want 0, nil", n, err)
+	}
+}
+
+// ─── Benchmarks ──────────────────────────────────────────────────────────────
+
+// benchSample is about the size of a monitor history sample.
+var benchSample = json.RawMessage(`{"t":1729080000,"target":"1.1.1.1","ms":12.5,"loss":0,"hop":"192.168.1.1","role":"gateway"}`)
+
+func BenchmarkAppend(b *testing.B) {
+	for _, backend := range backends {
+		b.Run(backend, func(b *testing.B) {
+			l := openLog(b, backend, b.TempDir())
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := l.Append(Record{Key: int64(i), Data: benchSample}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkRange reads the last hour out of a day of 10 s samples.
+func BenchmarkRange(b *testing.B) {
+	const day, hour = 8640, 360
+	for _, backend := range backends {
+		b.Run(backend, func(b *testing.B) {
+			l := openLog(b, backend, b.TempDir())
+			recs := make([]Record, day)
+			for i := range recs {
+				recs[i] = Record{Key: int64(i), Data: benchSample}
+			}
+			if err := l.Append(recs...); err != nil {
+				b.Fatal(err)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				n := 0
+				l.Range(day-hour, day, func(Record) bool { n++; return true }) //nolint:errcheck
+				if n != hour {
+					b.Fatalf("read %d records, want %d", n, hour)
+				}
+			}
+		})
+	}
+}
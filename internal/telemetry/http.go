@@ -0,0 +1,43 @@
+package telemetry
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/strct-org/strct-agent/internal/audit"
+	"github.com/strct-org/strct-agent/internal/httputil"
+)
+
+func (s *Service) RegisterRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/system/telemetry", s.handleStatus)
+	mux.HandleFunc("POST /api/system/telemetry", s.handleSet)
+	mux.HandleFunc("GET /api/system/telemetry/preview", s.handlePreview)
+}
+
+func (s *Service) handleStatus(w http.ResponseWriter, r *http.Request) {
+	httputil.OK(w, s.Status())
+}
+
+// handleSet switches usage statistics on or off.
+// POST /api/system/telemetry  body: {"enabled":true}
+func (s *Service) handleSet(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Enabled *bool `json:"enabled"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Enabled == nil {
+		httputil.BadRequest(w, `body must be {"enabled": true|false}`)
+		return
+	}
+	audit.Target(r.Context(), "enabled="+strconv.FormatBool(*req.Enabled))
+	s.SetEnabled(*req.Enabled)
+	httputil.OK(w, s.Status())
+}
+
+// handlePreview returns the payload the next send would carry, byte for
+// byte, whether telemetry is on or not. Previewing counts nothing as sent.
+// GET /api/system/telemetry/preview
+func (s *Service) handlePreview(w http.ResponseWriter, r *http.Request) {
+	p, _ := s.payload()
+	httputil.OK(w, p)
+}
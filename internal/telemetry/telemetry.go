@@ -0,0 +1,342 @@
+// Package telemetry sends anonymous usage statistics to the strct backend,
+// once a day, and only after the user switched it on:
+//
+//	POST /api/system/telemetry {"enabled": true}
+//
+// It is off by default. GET /api/system/telemetry/preview shows the exact
+// payload the next send would carry, on or off.
+//
+// The payload is a fixed schema, not a redacted snapshot: fields lists
+// every JSON path it may hold, and a test fails if Payload grows one that
+// is not listed. Feature names, modes and error classes are checked
+// against fixed sets too, so a value nobody allowed becomes "other" or is
+// dropped. File names, domains, MAC and IP addresses, SSIDs and the
+// device ID have no field to go in.
+package telemetry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/config"
+	"github.com/strct-org/strct-agent/internal/logger"
+	"github.com/strct-org/strct-agent/internal/platform/backend"
+	"github.com/strct-org/strct-agent/internal/statefile"
+)
+
+const (
+	// SchemaVersion is Payload's version; bump it with fields.
+	SchemaVersion = 1
+
+	sendEvery  = 24 * time.Hour
+	checkEvery = time.Hour // how often Start looks whether a send is due
+
+	// backendPath is not under the device's path: the payload is not
+	// about a device. Requests are still signed.
+	backendPath = "/api/v1/telemetry"
+
+	modelPath = "/proc/device-tree/model"
+	// maxErrorScan bounds the log records read for one payload.
+	maxErrorScan = 5000
+)
+
+// fields is every JSON path a Payload may hold; "*" is a map key.
+var fields = []string{
+	"schema",
+	"version",
+	"hardware",
+	"arch",
+	"features.*.enabled",
+	"features.*.mode",
+	"errors.*",
+}
+
+// features are the feature names a payload may carry, with the modes
+// each may report.
+var features = map[string][]string{
+	"wifi":    {"off", "router", "extender"},
+	"adblock": nil,
+	"vpn":     nil,
+	"tunnel":  nil,
+}
+
+// errorClasses are the components error records are counted under: the
+// "pkg:" every log message starts with. Any other is counted as "other".
+var errorClasses = []string{
+	"adblock", "agent", "api", "audit", "backend", "cloud", "config",
+	"disk", "errs", "fileworker", "firewall", "maintenance", "managed",
+	"monitor", "operations", "router", "setup", "statefile", "telemetry",
+	"tunnel", "vpn", "wifi",
+}
+
+var (
+	versionRe = regexp.MustCompile(`^v?[0-9]+\.[0-9]+\.[0-9]+(-[0-9A-Za-z.]+)?$`)
+	modelRe   = regexp.MustCompile(`^(Raspberry Pi|Orange Pi|Radxa|Rock) [A-Za-z0-9 +]{1,40}$`)
+	revRe     = regexp.MustCompile(` Rev [0-9.]+$`)
+)
+
+// Payload is what is sent.
+type Payload struct {
+	Schema   int                `json:"schema"`
+	Version  string             `json:"version"`  // the agent's release
+	Hardware string             `json:"hardware"` // board model, "other" or "unknown"
+	Arch     string             `json:"arch"`
+	Features map[string]Feature `json:"features"`
+	// Errors counts error log records by component since the last send.
+	Errors map[string]int `json:"errors"`
+}
+
+// Feature is one feature's state in the payload.
+type Feature struct {
+	Enabled bool   `json:"enabled"`
+	Mode    string `json:"mode,omitempty"`
+}
+
+// Source is a feature that reports its state; name must be one of
+// features.
+type Source interface {
+	TelemetryFeature() (name string, f Feature)
+}
+
+// poster is the part of backend.Client telemetry sends with.
+type poster interface {
+	PostLatest(ctx context.Context, path string, v any) error
+}
+
+var stateSchema = statefile.Schema{
+	Name:       "telemetry",
+	Migrations: []statefile.Migration{statefile.Stamp},
+}
+
+// state is telemetry.json: the user's choice and the last send.
+type state struct {
+	Enabled   bool       `json:"enabled"`
+	ChangedAt *time.Time `json:"changed_at,omitempty"`
+	LastSent  *time.Time `json:"last_sent,omitempty"`
+}
+
+type Config struct {
+	// Path is where the opt-in is kept. Empty keeps it in memory.
+	Path    string
+	Version string
+	// ModelPath is the board model file; "" is /proc/device-tree/model.
+	ModelPath string
+	Sources   []Source
+	// Logs is where error records are counted; nil is logger.Recent.
+	Logs *logger.Ring
+}
+
+// Service assembles and sends the payload. Safe for concurrent use.
+type Service struct {
+	cfg     Config
+	backend poster
+	now     func() time.Time
+
+	mu       sync.Mutex
+	st       state
+	errSeq   uint64 // log records up to here were counted in a sent payload
+	lastErr  string
+	sendNext chan struct{}
+}
+
+func New(cfg Config, backend poster) *Service {
+	if cfg.ModelPath == "" {
+		cfg.ModelPath = modelPath
+	}
+	if cfg.Logs == nil {
+		cfg.Logs = logger.Recent
+	}
+	s := &Service{cfg: cfg, backend: backend, now: time.Now, sendNext: make(chan struct{}, 1)}
+	if cfg.Path != "" {
+		if err := statefile.Load(cfg.Path, stateSchema, &s.st); err != nil && !statefile.Fresh(err) {
+			// Off until the file is readable again: never send on a guess.
+			slog.Warn("telemetry: could not read the opt-in, staying off", "path", cfg.Path, "err", err)
+			s.st = state{}
+		}
+	}
+	return s
+}
+
+// NewFromConfig sends through b with the agent's sources.
+func NewFromConfig(cfg *config.Config, version string, b *backend.Client, sources ...Source) *Service {
+	return New(Config{Path: cfg.TelemetryPath(), Version: version, Sources: sources}, b)
+}
+
+// Start sends a payload whenever one is due and telemetry is on, until
+// ctx is done.
+func (s *Service) Start(ctx context.Context) error {
+	go func() {
+		t := time.NewTicker(checkEvery)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			case <-s.sendNext:
+			}
+			s.sendIfDue(ctx)
+		}
+	}()
+	return nil
+}
+
+// sendIfDue sends when telemetry is on and the last send is a day old.
+func (s *Service) sendIfDue(ctx context.Context) {
+	s.mu.Lock()
+	due := s.st.Enabled && (s.st.LastSent == nil || s.now().Sub(*s.st.LastSent) >= sendEvery)
+	s.mu.Unlock()
+	if !due {
+		return
+	}
+	p, seq := s.payload()
+	err := s.backend.PostLatest(ctx, backendPath, p)
+	if errors.Is(err, backend.ErrQueued) {
+		err = nil // the backend client sends it once it can
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.lastErr = err.Error()
+		slog.Warn("telemetry: send failed", "err", err)
+		return
+	}
+	now := s.now().UTC()
+	s.st.LastSent, s.errSeq, s.lastErr = &now, seq, ""
+	s.saveLocked()
+}
+
+func (s *Service) saveLocked() {
+	if s.cfg.Path == "" {
+		return
+	}
+	if err := statefile.Save(s.cfg.Path, stateSchema, s.st); err != nil {
+		slog.Error("telemetry: could not save the opt-in", "path", s.cfg.Path, "err", err)
+	}
+}
+
+// SetEnabled records the user's choice. Switching on sends the first
+// payload right away.
+func (s *Service) SetEnabled(on bool) {
+	s.mu.Lock()
+	changed := s.st.Enabled != on
+	if changed {
+		now := s.now().UTC()
+		s.st.Enabled, s.st.ChangedAt = on, &now
+		s.saveLocked()
+	}
+	s.mu.Unlock()
+	if !changed {
+		return
+	}
+	slog.Info("telemetry: usage statistics switched", "enabled", on)
+	if on {
+		select {
+		case s.sendNext <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// payload assembles the next payload, and returns the log position to
+// count errors from once it is sent.
+func (s *Service) payload() (Payload, uint64) {
+	s.mu.Lock()
+	since := s.errSeq
+	s.mu.Unlock()
+
+	p := Payload{
+		Schema:   SchemaVersion,
+		Version:  "unknown",
+		Hardware: hardwareModel(s.cfg.ModelPath),
+		Arch:     runtime.GOARCH,
+		Features: map[string]Feature{},
+		Errors:   map[string]int{},
+	}
+	if versionRe.MatchString(s.cfg.Version) {
+		p.Version = s.cfg.Version
+	}
+	for _, src := range s.cfg.Sources {
+		name, f := src.TelemetryFeature()
+		modes, ok := features[name]
+		if !ok {
+			continue
+		}
+		if !slices.Contains(modes, f.Mode) {
+			f.Mode = ""
+		}
+		p.Features[name] = f
+	}
+
+	records, seq := s.cfg.Logs.Since(since, maxErrorScan, slog.LevelError)
+	for _, e := range records {
+		p.Errors[errorClass(e.Msg)]++
+	}
+	return p, seq
+}
+
+// errorClass is the component a log message names, or "other".
+func errorClass(msg string) string {
+	pkg, _, ok := strings.Cut(msg, ":")
+	if ok && slices.Contains(errorClasses, pkg) {
+		return pkg
+	}
+	return "other"
+}
+
+// hardwareModel is the board model without its revision: "unknown" when
+// there is no model file, "other" for a board not in modelRe.
+func hardwareModel(path string) string {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "unknown"
+	}
+	model := revRe.ReplaceAllString(strings.TrimSpace(strings.TrimRight(string(b), "\x00")), "")
+	if modelRe.MatchString(model) {
+		return model
+	}
+	return "other"
+}
+
+// Status is GET /api/system/telemetry.
+type Status struct {
+	Enabled   bool       `json:"enabled"`
+	ChangedAt *time.Time `json:"changed_at,omitempty"`
+	LastSent  *time.Time `json:"last_sent,omitempty"`
+	NextSend  *time.Time `json:"next_send,omitempty"` // while on; checked hourly
+	LastError string     `json:"last_error,omitempty"`
+}
+
+func (s *Service) Status() Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := Status{Enabled: s.st.Enabled, ChangedAt: s.st.ChangedAt, LastSent: s.st.LastSent, LastError: s.lastErr}
+	if st.Enabled {
+		next := s.now().UTC()
+		if st.LastSent != nil {
+			next = st.LastSent.Add(sendEvery)
+		}
+		st.NextSend = &next
+	}
+	return st
+}
+
+// SecurityPosture reports whether anything leaves the device.
+func (s *Service) SecurityPosture() (string, any) {
+	st := s.Status()
+	return "telemetry", struct {
+		Enabled   bool       `json:"enabled"`
+		ChangedAt *time.Time `json:"changed_at,omitempty"`
+		Endpoint  string     `json:"endpoint"`
+	}{st.Enabled, st.ChangedAt, fmt.Sprintf("POST %s, once a day", backendPath)}
+}
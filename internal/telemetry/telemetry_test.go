@@ -0,0 +1,257 @@
+package telemetry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/logger"
+	"github.com/strct-org/strct-agent/internal/platform/backend"
+)
+
+type source struct {
+	name string
+	f    Feature
+}
+
+func (s source) TelemetryFeature() (string, Feature) { return s.name, s.f }
+
+type fakeBackend struct {
+	err  error
+	sent []string // JSON bodies
+}
+
+func (b *fakeBackend) PostLatest(_ context.Context, path string, v any) error {
+	if path != backendPath {
+		return fmt.Errorf("posted to %s", path)
+	}
+	body, _ := json.Marshal(v)
+	b.sent = append(b.sent, string(body))
+	return b.err
+}
+
+// typePaths is every JSON path t can hold, the way fields spells them.
+func typePaths(t reflect.Type, prefix string) []string {
+	switch t.Kind() {
+	case reflect.Pointer:
+		return typePaths(t.Elem(), prefix)
+	case reflect.Map, reflect.Slice, reflect.Array:
+		return typePaths(t.Elem(), join(prefix, "*"))
+	case reflect.Struct:
+		var out []string
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if name == "-" || !f.IsExported() {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			out = append(out, typePaths(f.Type, join(prefix, name))...)
+		}
+		return out
+	}
+	return []string{prefix}
+}
+
+// valuePaths is every JSON path in a decoded payload.
+func valuePaths(v any, prefix string, mapKeys bool) []string {
+	switch v := v.(type) {
+	case map[string]any:
+		var out []string
+		for k, e := range v {
+			key := k
+			if mapKeys {
+				key = "*"
+			}
+			// Below the top level, features and errors are keyed by name.
+			out = append(out, valuePaths(e, join(prefix, key), prefix == "" && (k == "features" || k == "errors"))...)
+		}
+		return out
+	case []any:
+		var out []string
+		for _, e := range v {
+			out = append(out, valuePaths(e, join(prefix, "*"), false)...)
+		}
+		return out
+	}
+	return []string{prefix}
+}
+
+func join(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + "." + name
+}
+
+// A field added to Payload or Feature has to be added to fields, where it
+// gets reviewed, or this fails.
+func TestPayload_OnlyWhitelistedFields(t *testing.T) {
+	got := typePaths(reflect.TypeOf(Payload{}), "")
+	sort.Strings(got)
+	want := slices.Clone(fields)
+	sort.Strings(want)
+	if !slices.Equal(got, want) {
+		t.Fatalf("Payload has fields %q, the whitelist %q", got, want)
+	}
+
+	// And what is actually sent, in case it is ever built some other way.
+	s := New(Config{Version: "1.4.0", Sources: []Source{
+		source{"wifi", Feature{Enabled: true, Mode: "router"}},
+		source{"adblock", Feature{Enabled: true}},
+	}, Logs: errorLog(t, "wifi: hostapd exited")}, &fakeBackend{})
+	p, _ := s.payload()
+	body, _ := json.Marshal(p)
+	var v any
+	json.Unmarshal(body, &v) //nolint:errcheck
+	for _, path := range valuePaths(v, "", false) {
+		if !slices.Contains(fields, path) {
+			t.Errorf("payload holds %s, which is not whitelisted: %s", path, body)
+		}
+	}
+}
+
+func errorLog(t *testing.T, msgs ...string) *logger.Ring {
+	t.Helper()
+	r := logger.NewRing(100)
+	log := slog.New(r.Handler(slog.NewTextHandler(io.Discard, nil)))
+	log.Info("wifi: not an error")
+	for _, m := range msgs {
+		log.Error(m, "mac", "aa:bb:cc:dd:ee:ff")
+	}
+	return r
+}
+
+func TestPayload_DropsWhatIsNotAllowed(t *testing.T) {
+	dir := t.TempDir()
+	model := filepath.Join(dir, "model")
+	os.WriteFile(model, []byte("Raspberry Pi 4 Model B Rev 1.4\x00"), 0o644) //nolint:errcheck
+	s := New(Config{
+		Version:   "1.4.0-dirty+/home/alice/src",
+		ModelPath: model,
+		Sources: []Source{
+			source{"wifi", Feature{Enabled: true, Mode: "192.168.1.1"}},
+			source{"vpn", Feature{Enabled: true, Mode: "100.64.0.7"}},
+			source{"media-library", Feature{Enabled: true, Mode: "/mnt/data/holiday.mp4"}},
+		},
+		Logs: errorLog(t,
+			"wifi: client aa:bb:cc:dd:ee:ff rejected",
+			"dial 10.0.0.5:443: connection refused",
+			"adblock: blocked ads.example.com",
+		),
+	}, &fakeBackend{})
+
+	p, _ := s.payload()
+	want := Payload{
+		Schema:   SchemaVersion,
+		Version:  "unknown",
+		Hardware: "Raspberry Pi 4 Model B",
+		Arch:     p.Arch,
+		Features: map[string]Feature{"wifi": {Enabled: true}, "vpn": {Enabled: true}},
+		Errors:   map[string]int{"wifi": 1, "adblock": 1, "other": 1},
+	}
+	if !reflect.DeepEqual(p, want) {
+		t.Errorf("payload = %+v\nwant %+v", p, want)
+	}
+	body, _ := json.Marshal(p)
+	for _, leak := range []string{"192.168", "100.64", "10.0.0.5", "aa:bb", "example.com", "holiday", "alice", "media-library"} {
+		if strings.Contains(string(body), leak) {
+			t.Errorf("payload leaks %q: %s", leak, body)
+		}
+	}
+
+	for m, want := range map[string]string{
+		"Orange Pi 5 Plus":                    "Orange Pi 5 Plus",
+		"Raspberry Pi 5 Model B Rev 1.0":      "Raspberry Pi 5 Model B",
+		"ACME board, serial 00000000deadbeef": "other",
+	} {
+		os.WriteFile(model, []byte(m), 0o644) //nolint:errcheck
+		if got := hardwareModel(model); got != want {
+			t.Errorf("hardwareModel(%q) = %q, want %q", m, got, want)
+		}
+	}
+	if got := hardwareModel(filepath.Join(dir, "none")); got != "unknown" {
+		t.Errorf("no model file: %q", got)
+	}
+}
+
+func TestOptIn_PersistedAndPreviewIsWhatIsSent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "telemetry.json")
+	b := &fakeBackend{}
+	logs := errorLog(t, "tunnel: frpc exited")
+	cfg := Config{Path: path, Version: "1.4.0", Logs: logs, Sources: []Source{source{"tunnel", Feature{Enabled: true}}}}
+	s := New(cfg, b)
+	mux := http.NewServeMux()
+	s.RegisterRoutes(mux)
+
+	// Off by default: nothing is sent.
+	s.sendIfDue(context.Background())
+	if len(b.sent) != 0 || s.Status().Enabled {
+		t.Fatalf("sent %d while off", len(b.sent))
+	}
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/api/system/telemetry/preview", nil))
+	preview := strings.TrimSpace(w.Body.String())
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("POST", "/api/system/telemetry", strings.NewReader(`{}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("POST without enabled: %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("POST", "/api/system/telemetry", strings.NewReader(`{"enabled":true}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST: %d %s", w.Code, w.Body)
+	}
+
+	// A restart keeps the choice.
+	s = New(cfg, b)
+	if st := s.Status(); !st.Enabled || st.ChangedAt == nil || st.NextSend == nil {
+		t.Fatalf("after a restart: %+v", st)
+	}
+	name, posture := s.SecurityPosture()
+	if j, _ := json.Marshal(posture); name != "telemetry" || !strings.Contains(string(j), `"enabled":true`) {
+		t.Errorf("posture %s = %s", name, j)
+	}
+
+	// Queued for later counts as sent.
+	b.err = fmt.Errorf("%w: offline", backend.ErrQueued)
+	s.sendIfDue(context.Background())
+	if len(b.sent) != 1 || b.sent[0] != preview {
+		t.Fatalf("sent %q\npreview %q", b.sent, preview)
+	}
+	s.sendIfDue(context.Background())
+	if len(b.sent) != 1 {
+		t.Errorf("sent again within a day")
+	}
+
+	// A day later, errors already sent are not counted again.
+	s.now = func() time.Time { return time.Now().Add(sendEvery) }
+	s.sendIfDue(context.Background())
+	if len(b.sent) != 2 || strings.Contains(b.sent[1], `"tunnel":1`) {
+		t.Errorf("second send: %q", b.sent)
+	}
+	if s.Status().LastSent == nil {
+		t.Error("last send not recorded")
+	}
+
+	s.SetEnabled(false)
+	if New(cfg, b).Status().Enabled {
+		t.Error("switched off, but on after a restart")
+	}
+}
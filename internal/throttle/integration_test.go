@@ -0,0 +1,151 @@
+//go:build integration
+
+package throttle_test
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/strct-org/strct-agent/internal/throttle"
+)
+
+// TestFloodedTransfers_LeaveDNSResponsive floods a governor-wrapped file
+// server with parallel uploads and downloads while timing DNS queries to a
+// local resolver, then checks the aggregate cap held and DNS stayed quick.
+//
+//	go test -tags integration -run Flooded -v ./internal/throttle/
+func TestFloodedTransfers_LeaveDNSResponsive(t *testing.T) {
+	const (
+		linkMbps  = 200
+		share     = 0.5
+		transfers = 8
+		duration  = 3 * time.Second
+	)
+	dnsAddr := startDNS(t)
+
+	// Bytes are counted server-side, behind the governor: client-side
+	// counts include whatever sits in socket buffers.
+	var moved atomic.Int64
+	stop := make(chan struct{})
+
+	gov := throttle.New(func() float64 { return linkMbps }, share)
+	blob := make([]byte, 64<<20)
+	mux := http.NewServeMux()
+	mux.Handle("GET /files/blob", gov.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, &countingReader{r: bytes.NewReader(blob), n: &moved, stop: stop})
+	})))
+	mux.Handle("POST /upload", gov.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, &countingReader{r: r.Body, n: &moved, stop: stop})
+	})))
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < transfers; i++ {
+		wg.Add(1)
+		go func(upload bool) {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if upload {
+					resp, err := http.Post(srv.URL+"/upload", "application/octet-stream", bytes.NewReader(blob))
+					if err == nil {
+						resp.Body.Close()
+					}
+					continue
+				}
+				resp, err := http.Get(srv.URL + "/files/blob")
+				if err != nil {
+					continue
+				}
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+			}
+		}(i%2 == 0)
+	}
+
+	start := time.Now()
+	var latencies []time.Duration
+	c := &dns.Client{Timeout: time.Second}
+	for time.Since(start) < duration {
+		m := new(dns.Msg)
+		m.SetQuestion("strct.local.", dns.TypeA)
+		_, rtt, err := c.Exchange(m, dnsAddr)
+		if err != nil {
+			t.Fatalf("dns query during flood: %v", err)
+		}
+		latencies = append(latencies, rtt)
+		time.Sleep(20 * time.Millisecond)
+	}
+	elapsed := time.Since(start)
+	close(stop)
+	srv.CloseClientConnections()
+	wg.Wait()
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	p50 := latencies[len(latencies)/2]
+	p95 := latencies[len(latencies)*95/100]
+	mbps := float64(moved.Load()) * 8 / 1e6 / elapsed.Seconds()
+	t.Logf("transfers: %.1f Mbps aggregate (cap %.0f); dns: %d queries, p50 %v, p95 %v",
+		mbps, linkMbps*share, len(latencies), p50, p95)
+
+	// One burst of slack per transfer on top of the cap.
+	if max := linkMbps*share + float64(transfers*256*1024*8)/1e6/elapsed.Seconds(); mbps > max {
+		t.Errorf("transfers moved %.1f Mbps, above the %.1f Mbps cap", mbps, max)
+	}
+	if p95 > 50*time.Millisecond {
+		t.Errorf("dns p95 = %v under flood, want < 50ms", p95)
+	}
+}
+
+func startDNS(t *testing.T) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		rr, _ := dns.NewRR(r.Question[0].Name + " 60 IN A 192.168.4.1")
+		m.Answer = append(m.Answer, rr)
+		w.WriteMsg(m)
+	})
+	srv := &dns.Server{PacketConn: pc, Handler: handler}
+	go srv.ActivateAndServe()
+	t.Cleanup(func() { srv.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+// countingReader tallies bytes moved and ends the stream once the flood
+// is over.
+type countingReader struct {
+	r    io.Reader
+	n    *atomic.Int64
+	stop chan struct{}
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	select {
+	case <-c.stop:
+		return 0, io.EOF
+	default:
+	}
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,194 @@
+// Package throttle keeps bulk file transfers from starving everything else
+// on the Pi's single uplink. All transfers draw from one token bucket
+// sized to a share of the link speed the monitor last measured, so a 20 GB
+// upload leaves headroom for DNS answers and API calls.
+//
+// A nil *Governor passes everything through untouched.
+package throttle
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// burst is how far ahead of the rate a transfer may run, and the largest
+// chunk waited for at once.
+const burst = 256 * 1024
+
+// Status is what /api/router/priority reports about the transfer cap.
+type Status struct {
+	LinkMbps        float64 `json:"link_mbps"`  // last measured, 0 if unknown
+	Share           float64 `json:"share"`      // fraction of the link transfers may use
+	LimitMbps       float64 `json:"limit_mbps"` // 0 means uncapped
+	Capped          bool    `json:"capped"`
+	ActiveTransfers int64   `json:"active_transfers"`
+}
+
+type Governor struct {
+	capacity func() float64 // measured link speed in Mbps, 0 if unknown
+	share    float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+	sleep  func(context.Context, time.Duration) error
+
+	active atomic.Int64
+}
+
+// New returns a governor capping transfers at share of capacity(). A
+// share of 1 or more, or an unknown capacity, leaves transfers uncapped.
+func New(capacity func() float64, share float64) *Governor {
+	return &Governor{
+		capacity: capacity,
+		share:    share,
+		tokens:   burst,
+		now:      time.Now,
+		sleep:    sleepCtx,
+	}
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// limitMbps is the current aggregate cap, 0 for none.
+func (g *Governor) limitMbps() (link, limit float64) {
+	link = g.capacity()
+	if link <= 0 || g.share >= 1 {
+		return link, 0
+	}
+	return link, link * g.share
+}
+
+func (g *Governor) Status() Status {
+	if g == nil {
+		return Status{}
+	}
+	link, limit := g.limitMbps()
+	return Status{
+		LinkMbps:        link,
+		Share:           g.share,
+		LimitMbps:       limit,
+		Capped:          limit > 0,
+		ActiveTransfers: g.active.Load(),
+	}
+}
+
+// wait blocks until n bytes may be sent under the shared rate.
+func (g *Governor) wait(ctx context.Context, n int) error {
+	_, limit := g.limitMbps()
+	if limit <= 0 {
+		return nil
+	}
+	rate := limit * 1e6 / 8 // bytes per second
+
+	g.mu.Lock()
+	now := g.now()
+	if !g.last.IsZero() {
+		g.tokens += now.Sub(g.last).Seconds() * rate
+		if g.tokens > burst {
+			g.tokens = burst
+		}
+	}
+	g.last = now
+	// Take the bytes now and let the bucket go negative: concurrent
+	// transfers queue up behind each other instead of all waking at once.
+	g.tokens -= float64(n)
+	var d time.Duration
+	if g.tokens < 0 {
+		d = time.Duration(-g.tokens / rate * float64(time.Second))
+	}
+	g.mu.Unlock()
+
+	if d > 0 {
+		return g.sleep(ctx, d)
+	}
+	return nil
+}
+
+// Reader paces reads from r, e.g. an upload body being written to disk.
+func (g *Governor) Reader(ctx context.Context, r io.Reader) io.Reader {
+	if g == nil {
+		return r
+	}
+	return &reader{ctx: ctx, r: r, g: g}
+}
+
+type reader struct {
+	ctx context.Context
+	r   io.Reader
+	g   *Governor
+}
+
+func (t *reader) Read(p []byte) (int, error) {
+	if len(p) > burst {
+		p = p[:burst]
+	}
+	n, err := t.r.Read(p)
+	if n > 0 {
+		if werr := t.g.wait(t.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// Handler paces both the request body (uploads) and the response body
+// (downloads) of h, and counts each request as an active transfer.
+func (g *Governor) Handler(h http.Handler) http.Handler {
+	if g == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		g.active.Add(1)
+		defer g.active.Add(-1)
+		if r.Body != nil {
+			r.Body = &body{Reader: g.Reader(r.Context(), r.Body), Closer: r.Body}
+		}
+		h.ServeHTTP(&responseWriter{ResponseWriter: w, ctx: r.Context(), g: g}, r)
+	})
+}
+
+type body struct {
+	io.Reader
+	io.Closer
+}
+
+type responseWriter struct {
+	http.ResponseWriter
+	ctx context.Context
+	g   *Governor
+}
+
+func (w *responseWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > burst {
+			chunk = chunk[:burst]
+		}
+		if err := w.g.wait(w.ctx, len(chunk)); err != nil {
+			return written, err
+		}
+		n, err := w.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
@@ -0,0 +1,155 @@
+package throttle
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeClock advances only when the governor sleeps.
+type fakeClock struct {
+	now   time.Time
+	slept time.Duration
+}
+
+func (c *fakeClock) sleep(ctx context.Context, d time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.now = c.now.Add(d)
+	c.slept += d
+	return nil
+}
+
+func newTestGovernor(linkMbps, share float64) (*Governor, *fakeClock) {
+	clock := &fakeClock{now: time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)}
+	g := New(func() float64 { return linkMbps }, share)
+	g.now = func() time.Time { return clock.now }
+	g.sleep = clock.sleep
+	return g, clock
+}
+
+func TestNilGovernorPassesThrough(t *testing.T) {
+	var g *Governor
+	src := strings.NewReader("payload")
+	if g.Reader(context.Background(), src) != io.Reader(src) {
+		t.Error("nil governor wrapped the reader")
+	}
+	if g.Status() != (Status{}) {
+		t.Errorf("nil status = %+v", g.Status())
+	}
+}
+
+func TestUncapped(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		link, share float64
+	}{
+		{"unmeasured link", 0, 0.8},
+		{"full share", 100, 1},
+	} {
+		g, clock := newTestGovernor(tc.link, tc.share)
+		n, err := io.Copy(io.Discard, g.Reader(context.Background(), bytes.NewReader(make([]byte, 4<<20))))
+		if err != nil || n != 4<<20 {
+			t.Fatalf("%s: copied %d, %v", tc.name, n, err)
+		}
+		if clock.slept != 0 {
+			t.Errorf("%s: slept %v, want no pacing", tc.name, clock.slept)
+		}
+		if st := g.Status(); st.Capped || st.LimitMbps != 0 {
+			t.Errorf("%s: status = %+v", tc.name, st)
+		}
+	}
+}
+
+func TestReader_PacesToShareOfLink(t *testing.T) {
+	// 16 Mbps link at half share: 1 MB/s for transfers.
+	g, clock := newTestGovernor(16, 0.5)
+	const size = 4 << 20
+
+	n, err := io.Copy(io.Discard, g.Reader(context.Background(), bytes.NewReader(make([]byte, size))))
+	if err != nil || n != size {
+		t.Fatalf("copied %d, %v", n, err)
+	}
+
+	// The first burst goes out immediately; the rest at 1 MB/s.
+	want := time.Duration(float64(size-burst) / 1e6 * float64(time.Second))
+	if diff := clock.slept - want; diff < -10*time.Millisecond || diff > 10*time.Millisecond {
+		t.Errorf("slept %v, want about %v", clock.slept, want)
+	}
+	if st := g.Status(); !st.Capped || st.LimitMbps != 8 || st.LinkMbps != 16 {
+		t.Errorf("status = %+v", st)
+	}
+}
+
+func TestReader_TransfersShareOneBucket(t *testing.T) {
+	g, clock := newTestGovernor(16, 0.5)
+	a := g.Reader(context.Background(), bytes.NewReader(make([]byte, 2<<20)))
+	b := g.Reader(context.Background(), bytes.NewReader(make([]byte, 2<<20)))
+
+	// Interleave the two transfers the way concurrent uploads would.
+	buf := make([]byte, 64*1024)
+	for done := 0; done < 2; {
+		done = 0
+		for _, r := range []io.Reader{a, b} {
+			if _, err := r.Read(buf); err == io.EOF {
+				done++
+			}
+		}
+	}
+
+	want := time.Duration(float64(4<<20-burst) / 1e6 * float64(time.Second))
+	if clock.slept < want-10*time.Millisecond {
+		t.Errorf("two transfers slept %v together, want about %v: the cap must be aggregate", clock.slept, want)
+	}
+}
+
+func TestReader_StopsOnCancel(t *testing.T) {
+	g, _ := newTestGovernor(16, 0.5)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := io.Copy(io.Discard, g.Reader(ctx, bytes.NewReader(make([]byte, 4<<20))))
+	if err != context.Canceled {
+		t.Errorf("err = %v, want context.Canceled", err)
+	}
+}
+
+func TestHandler_PacesDownloadsAndCountsTransfers(t *testing.T) {
+	g, clock := newTestGovernor(16, 0.5)
+	var during int64
+	h := g.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		during = g.Status().ActiveTransfers
+		w.Write(make([]byte, 2<<20))
+	}))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/files/backup.tar", nil))
+
+	if rec.Body.Len() != 2<<20 {
+		t.Fatalf("body = %d bytes", rec.Body.Len())
+	}
+	if during != 1 || g.Status().ActiveTransfers != 0 {
+		t.Errorf("active transfers = %d during, %d after", during, g.Status().ActiveTransfers)
+	}
+	if clock.slept == 0 {
+		t.Error("download was not paced")
+	}
+}
+
+func TestHandler_PacesUploadBody(t *testing.T) {
+	g, clock := newTestGovernor(16, 0.5)
+	h := g.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+	}))
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/strct_agent/fs/upload", bytes.NewReader(make([]byte, 2<<20))))
+	if clock.slept == 0 {
+		t.Error("upload was not paced")
+	}
+}
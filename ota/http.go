@@ -0,0 +1,102 @@
+package ota
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/apidoc"
+	"github.com/strct-org/strct-agent/internal/audit"
+	"github.com/strct-org/strct-agent/internal/httputil"
+	"github.com/strct-org/strct-agent/internal/maintenance"
+)
+
+// checkTimeout bounds an on-demand check; the version file is a few bytes.
+const checkTimeout = 15 * time.Second
+
+// applyTimeout bounds an on-demand install, download included.
+const applyTimeout = 5 * time.Minute
+
+// Example for /api/openapi.json.
+var exampleStatus = Status{
+	Current:   "1.3.0",
+	Channel:   ChannelStable,
+	Enabled:   true,
+	LastCheck: time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC),
+	NextCheck: time.Date(2026, 10, 17, 9, 0, 0, 0, time.UTC),
+	Latest:    "1.4.0",
+	Available: true,
+}
+
+func (s *Service) RegisterRoutes(mux *http.ServeMux) {
+	r := apidoc.On(mux, "ota")
+	r.Register("GET", "/api/ota/status", s.handleStatus, apidoc.RouteDoc{
+		Summary:     "Running version, last and next check, the latest release and the last error",
+		Description: "The updater checks every UPDATE_CHECK_HOURS and installs what it finds.",
+		Response:    exampleStatus,
+	})
+	r.Register("POST", "/api/ota/check", s.handleCheck, apidoc.RouteDoc{
+		Summary:     "Check for a newer release now, without installing it",
+		Description: "503 without UPDATE_URL; 502 when the release storage can't be read.",
+		Response:    exampleStatus,
+	})
+	r.Register("POST", "/api/ota/apply", s.handleApply, apidoc.RouteDoc{
+		Summary: "Install a newer release now and restart into it",
+		Description: "Answers once the release is installed, with `installed` set, then the agent " +
+			"finishes the requests in flight, stops its services and starts the new binary. " +
+			"Nothing is installed when there is no newer release. 409 during maintenance mode " +
+			"or while an update is being applied; 503 without UPDATE_URL.",
+		Response: exampleStatus,
+	})
+}
+
+func (s *Service) handleStatus(w http.ResponseWriter, r *http.Request) {
+	httputil.OK(w, s.Status())
+}
+
+// handleCheck checks for a newer release.
+// POST /api/ota/check
+func (s *Service) handleCheck(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), checkTimeout)
+	defer cancel()
+	if _, err := s.Check(ctx); err != nil {
+		s.writeError(w, err)
+		return
+	}
+	httputil.OK(w, s.Status())
+}
+
+// handleApply installs a newer release and, once the answer is written,
+// restarts the agent into it.
+// POST /api/ota/apply
+func (s *Service) handleApply(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), applyTimeout)
+	defer cancel()
+	rel, err := s.Apply(ctx)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	if rel.Available {
+		audit.Target(r.Context(), "version="+rel.Latest)
+	}
+	httputil.OK(w, s.Status())
+	if rel.Available {
+		// The API server waits for this request before it stops.
+		s.requestRestart()
+	}
+}
+
+func (s *Service) writeError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrNotConfigured):
+		httputil.Error(w, http.StatusServiceUnavailable, "update checks are not configured (UPDATE_URL)")
+	case errors.Is(err, ErrBusy), errors.Is(err, maintenance.ErrActive):
+		httputil.Error(w, http.StatusConflict, err.Error())
+	default:
+		slog.Warn("ota: update failed", "err", err)
+		httputil.Error(w, http.StatusBadGateway, err.Error())
+	}
+}
@@ -1,52 +1,105 @@
 package ota
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
-	"os"
 	"runtime"
 	"strings"
 	"time"
 
 	"github.com/blang/semver"
 	"github.com/minio/selfupdate"
+	"github.com/strct-org/strct-agent/internal/maintenance"
+)
+
+// Update channels. Each is a directory under the storage URL holding a
+// release of its own, version.txt, the binaries and their .sha256, so a
+// release can go to beta devices before it is published to stable.
+const (
+	ChannelStable = "stable"
+	ChannelBeta   = "beta"
 )
 
 type Config struct {
 	CurrentVersion string
 	StorageURL     string
+	// Channel is the directory under StorageURL to update from; ""
+	// is ChannelStable.
+	Channel string
+	// Gate holds updates while maintenance mode is on. Optional.
+	Gate *maintenance.Gate
+	// TargetPath is the binary an update replaces; "" is the running
+	// one.
+	TargetPath string
+
+	// Interval is how often Service checks for, and installs, a newer
+	// release; 0 is DefaultInterval.
+	Interval time.Duration
+}
+
+// DefaultInterval is how often a Service checks without
+// Config.Interval.
+const DefaultInterval = 24 * time.Hour
+
+func (cfg Config) interval() time.Duration {
+	if cfg.Interval <= 0 {
+		return DefaultInterval
+	}
+	return cfg.Interval
 }
 
-func StartUpdater(cfg Config) {
-	ticker := time.NewTicker(100 * time.Hour)
-
-	// Check on startup
-	go func() {
-		if err := checkForUpdate(cfg); err != nil {
-			slog.Error("ota: initial update check failed", "err", err)
-		}
-	}()
-
-	// Infinite Loop
-	go func() {
-		for range ticker.C {
-			if err := checkForUpdate(cfg); err != nil {
-				slog.Error("ota: update check failed", "err", err)
-			}
-		}
-	}()
+// Release is the outcome of an update check.
+type Release struct {
+	Current   string `json:"current"`
+	Latest    string `json:"latest"`
+	Available bool   `json:"update_available"`
+	Channel   string `json:"channel"`
 }
 
-func checkForUpdate(cfg Config) error {
-	slog.Info("ota: checking for updates...")
+// binaryName is the release asset for this platform.
+var binaryName = fmt.Sprintf("strct-agent-%s-%s", runtime.GOOS, runtime.GOARCH)
+
+func (cfg Config) channel() string {
+	if cfg.Channel == "" {
+		return ChannelStable
+	}
+	return cfg.Channel
+}
+
+// releaseURL is where cfg's channel is published.
+func (cfg Config) releaseURL() (string, error) {
+	channel := cfg.channel()
+	if strings.ContainsAny(channel, "/?#") || channel == "." || channel == ".." {
+		return "", fmt.Errorf("invalid update channel %q", channel)
+	}
+	return strings.TrimRight(cfg.StorageURL, "/") + "/" + channel, nil
+}
 
-	resp, err := http.Get(fmt.Sprintf("%s/version.txt", cfg.StorageURL))
+// Check fetches the published version and compares it with the running
+// one, without downloading anything.
+func Check(ctx context.Context, cfg Config) (Release, error) {
+	base, err := cfg.releaseURL()
+	if err != nil {
+		return Release{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, base+"/version.txt", nil)
 	if err != nil {
-		return fmt.Errorf("failed to fetch version file: %w", err)
+		return Release{}, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return Release{}, fmt.Errorf("failed to fetch version file: %w", err)
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Release{}, fmt.Errorf("failed to fetch version file: %s", resp.Status)
+	}
 
 	remoteVerStrRaw, _ := io.ReadAll(resp.Body)
 	remoteVerStr := strings.TrimSpace(string(remoteVerStrRaw))
@@ -54,32 +107,51 @@ func checkForUpdate(cfg Config) error {
 	// Parse and Compare Versions
 	vCurrent, err := semver.Make(cfg.CurrentVersion)
 	if err != nil {
-		return fmt.Errorf("invalid current version '%s': %w", cfg.CurrentVersion, err)
+		return Release{}, fmt.Errorf("invalid current version '%s': %w", cfg.CurrentVersion, err)
 	}
 	vRemote, err := semver.Make(remoteVerStr)
 	if err != nil {
-		return fmt.Errorf("invalid remote version '%s': %w", remoteVerStr, err)
+		return Release{}, fmt.Errorf("invalid remote version '%s': %w", remoteVerStr, err)
 	}
+	return Release{Current: vCurrent.String(), Latest: vRemote.String(), Available: vRemote.GT(vCurrent), Channel: cfg.channel()}, nil
+}
 
-	//less than or equal
-	if vRemote.LTE(vCurrent) {
-		slog.Info("ota: no update needed", "remote_version", vRemote, "current_version", vCurrent)
-		return nil
+// Install checks for a newer release and, if there is one, downloads it
+// for this platform, verifies it against its published .sha256 and
+// replaces the binary at cfg.TargetPath. A binary that doesn't match is
+// refused and the old one kept. The caller restarts into the new one.
+func Install(ctx context.Context, cfg Config) (Release, error) {
+	rel, err := Check(ctx, cfg)
+	if err != nil || !rel.Available {
+		return rel, err
 	}
 
-	slog.Info("ota: new version found", "remote_version", vRemote, "current_version", vCurrent)
+	slog.Info("ota: new version found", "remote_version", rel.Latest, "current_version", rel.Current, "channel", rel.Channel)
 
-	// define the binary name based on architecture
-	binName := fmt.Sprintf("strct-agent-%s-%s", runtime.GOOS, runtime.GOARCH)
-	binURL := fmt.Sprintf("%s/%s", cfg.StorageURL, binName)
+	base, err := cfg.releaseURL()
+	if err != nil {
+		return rel, err
+	}
+	binURL := fmt.Sprintf("%s/%s", base, binaryName)
 	checksumURL := binURL + ".sha256"
 
 	// download and Apply
-	return doUpdate(binURL, checksumURL)
+	return rel, doUpdate(ctx, binURL, checksumURL, cfg.TargetPath)
 }
 
-func doUpdate(binURL, checksumURL string) error {
-	resp, err := http.Get(binURL)
+func doUpdate(ctx context.Context, binURL, checksumURL, target string) error {
+	// The checksum first: without one there is nothing to check the
+	// binary against, so it isn't downloaded.
+	checksum, err := fetchChecksum(ctx, checksumURL)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, binURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return err
 	}
@@ -88,27 +160,46 @@ func doUpdate(binURL, checksumURL string) error {
 		return fmt.Errorf("binary download failed: %s", resp.Status)
 	}
 
-	// B. Verify Checksum (Security Best Practice)
-	// We verify the stream as we read it to avoid loading huge files into memory
-	// However, selfupdate.Apply consumes the stream. Ideally, verify header/checksum first.
-	// For simplicity, we trust the connection or verify a separate hash file.
-
-	// NOTE: Production code should download the .sha256 file and verify here.
-	// verification logic omitted for brevity but highly recommended.
-
-	// C. Apply the update
+	// selfupdate hashes the new binary before the swap and refuses one
+	// that doesn't match, leaving the running binary in place.
 	err = selfupdate.Apply(resp.Body, selfupdate.Options{
-		// Calculate checksum of downloaded bytes to verify integrity before swap
-		Checksum: []byte{}, // You would pass the expected checksum bytes here if you fetched them
+		TargetPath: target,
+		Checksum:   checksum,
 	})
 
 	if err != nil {
 		// Rollback happens automatically if Apply fails
 		return fmt.Errorf("update apply failed: %w", err)
 	}
-
-	slog.Info("ota: update applied successfully, restarting now")
-
-	os.Exit(0)
 	return nil
 }
+
+// fetchChecksum reads a sha256sum-style file: the hex SHA-256, optionally
+// followed by the file name.
+func fetchChecksum(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch checksum: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch checksum: %s", resp.Status)
+	}
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch checksum: %w", err)
+	}
+	fields := strings.Fields(string(raw))
+	if len(fields) == 0 {
+		return nil, errors.New("checksum file is empty")
+	}
+	sum, err := hex.DecodeString(fields[0])
+	if err != nil || len(sum) != sha256.Size {
+		return nil, fmt.Errorf("checksum file does not start with a SHA-256: %q", fields[0])
+	}
+	return sum, nil
+}
@@ -0,0 +1,230 @@
+package ota
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/maintenance"
+)
+
+func TestService_SkippedDuringMaintenance(t *testing.T) {
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Write([]byte("1.0.0"))
+	}))
+	defer srv.Close()
+
+	gate := maintenance.New(filepath.Join(t.TempDir(), "maintenance.json"))
+	s := New(Config{CurrentVersion: "1.0.0", StorageURL: srv.URL, Gate: gate}, nil)
+	ctx := context.Background()
+
+	if _, err := gate.Enable("imaging SD card", time.Time{}, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Apply(ctx); !errors.Is(err, maintenance.ErrActive) {
+		t.Errorf("Apply during maintenance = %v, want ErrActive", err)
+	}
+	if n := hits.Load(); n != 0 {
+		t.Errorf("update server contacted %d times during maintenance", n)
+	}
+
+	if _, err := gate.Disable(); err != nil {
+		t.Fatal(err)
+	}
+	if rel, err := s.Apply(ctx); err != nil || rel.Available {
+		t.Errorf("Apply after maintenance = %+v, %v", rel, err)
+	}
+	if n := hits.Load(); n != 1 {
+		t.Errorf("update server contacted %d times after maintenance, want 1", n)
+	}
+}
+
+func TestService_Routes(t *testing.T) {
+	bin := []byte("#!/bin/sh\necho 1.1.0\n")
+	sum := sha256.Sum256(bin)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/stable/version.txt":
+			w.Write([]byte("1.1.0\n"))
+		case "/stable/" + binaryName:
+			w.Write(bin)
+		case "/stable/" + binaryName + ".sha256":
+			w.Write([]byte(hex.EncodeToString(sum[:]) + "  " + binaryName + "\n"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	target := filepath.Join(t.TempDir(), "strct-agent")
+	os.WriteFile(target, []byte("#!/bin/sh\necho 1.0.0\n"), 0755)
+	var restarts atomic.Int32
+	s := New(Config{CurrentVersion: "1.0.0", StorageURL: srv.URL, TargetPath: target}, func() { restarts.Add(1) })
+	mux := http.NewServeMux()
+	s.RegisterRoutes(mux)
+	call := func(method, path string) (int, Status) {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		var st Status
+		json.Unmarshal(w.Body.Bytes(), &st)
+		return w.Code, st
+	}
+
+	if code, st := call("GET", "/api/ota/status"); code != http.StatusOK || !st.Enabled || st.Current != "1.0.0" || !st.LastCheck.IsZero() {
+		t.Errorf("status before a check: %d %+v", code, st)
+	}
+	if code, st := call("POST", "/api/ota/check"); code != http.StatusOK || !st.Available || st.Latest != "1.1.0" || st.LastCheck.IsZero() {
+		t.Errorf("check: %d %+v", code, st)
+	}
+	if n := restarts.Load(); n != 0 {
+		t.Fatalf("a check restarted the agent %d times", n)
+	}
+
+	code, st := call("POST", "/api/ota/apply")
+	if code != http.StatusOK || st.Installed != "1.1.0" || st.Applying || st.LastError != "" {
+		t.Errorf("apply: %d %+v", code, st)
+	}
+	if b, _ := os.ReadFile(target); !bytes.Equal(b, bin) {
+		t.Errorf("target = %q, want the new binary", b)
+	}
+	if n := restarts.Load(); n != 1 {
+		t.Errorf("apply restarted the agent %d times, want 1", n)
+	}
+	// Installed, and restarting into it: nothing more to apply.
+	if code, _ := call("POST", "/api/ota/apply"); code != http.StatusConflict {
+		t.Errorf("second apply: %d, want 409", code)
+	}
+
+	off := New(Config{CurrentVersion: "1.0.0"}, nil)
+	if err := off.Start(context.Background()); err != nil {
+		t.Errorf("Start without UPDATE_URL: %v", err)
+	}
+	if _, err := off.Check(context.Background()); !errors.Is(err, ErrNotConfigured) {
+		t.Errorf("Check without UPDATE_URL = %v", err)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/stable/version.txt":
+			w.Write([]byte("1.3.0\n"))
+		case "/beta/version.txt":
+			w.Write([]byte("1.4.0-beta.1\n"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		cfg  Config
+		ok   bool
+		want Release
+	}{
+		{Config{CurrentVersion: "1.2.0", StorageURL: srv.URL}, true, Release{"1.2.0", "1.3.0", true, ChannelStable}},
+		{Config{CurrentVersion: "1.3.0", StorageURL: srv.URL}, true, Release{"1.3.0", "1.3.0", false, ChannelStable}},
+		{Config{CurrentVersion: "1.3.0", StorageURL: srv.URL, Channel: ChannelBeta}, true, Release{"1.3.0", "1.4.0-beta.1", true, ChannelBeta}},
+		{Config{CurrentVersion: "1.2.0", StorageURL: srv.URL, Channel: "../stable"}, false, Release{}},
+		{Config{CurrentVersion: "dev", StorageURL: srv.URL}, false, Release{}},
+	} {
+		got, err := Check(context.Background(), tc.cfg)
+		if (err == nil) != tc.ok || (tc.ok && got != tc.want) {
+			t.Errorf("%+v: %+v, %v", tc.cfg, got, err)
+		}
+	}
+}
+
+func TestFetchChecksum(t *testing.T) {
+	const sum = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+	for _, tc := range []struct {
+		body string
+		code int
+		ok   bool
+	}{
+		{sum + "\n", http.StatusOK, true},
+		{sum + "  strct-agent-linux-arm64\n", http.StatusOK, true},
+		{strings.ToUpper(sum), http.StatusOK, true},
+		{"", http.StatusOK, false},
+		{sum[:62], http.StatusOK, false},
+		{"not-a-checksum  strct-agent-linux-arm64", http.StatusOK, false},
+		{"", http.StatusNotFound, false},
+	} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tc.code)
+			w.Write([]byte(tc.body))
+		}))
+		got, err := fetchChecksum(context.Background(), srv.URL)
+		srv.Close()
+		if (err == nil) != tc.ok || (tc.ok && hex.EncodeToString(got) != sum) {
+			t.Errorf("%d %q: %x, %v", tc.code, tc.body, got, err)
+		}
+	}
+}
+
+func TestInstall_VerifiesTheChecksum(t *testing.T) {
+	bin := []byte("#!/bin/sh\necho 1.1.0\n")
+	sum := sha256.Sum256(bin)
+	files := map[string]string{
+		"/beta/version.txt":   "1.1.0\n",
+		"/beta/" + binaryName: string(bin),
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	target := filepath.Join(t.TempDir(), "strct-agent")
+	old := []byte("#!/bin/sh\necho 1.0.0\n")
+	os.WriteFile(target, old, 0755)
+	cfg := Config{CurrentVersion: "1.0.0", StorageURL: srv.URL, Channel: ChannelBeta, TargetPath: target}
+	ctx := context.Background()
+
+	for name, checksum := range map[string]string{
+		"no checksum":      "",
+		"wrong checksum":   strings.Repeat("0", 64) + "  " + binaryName + "\n",
+		"garbled checksum": "not-a-checksum\n",
+	} {
+		delete(files, "/beta/"+binaryName+".sha256")
+		if checksum != "" {
+			files["/beta/"+binaryName+".sha256"] = checksum
+		}
+		if _, err := Install(ctx, cfg); err == nil {
+			t.Errorf("%s: installed", name)
+		}
+		if b, _ := os.ReadFile(target); !bytes.Equal(b, old) {
+			t.Fatalf("%s: the binary was replaced with %q", name, b)
+		}
+	}
+
+	// The stable channel has no release; beta's is installed.
+	if _, err := Install(ctx, Config{CurrentVersion: "1.0.0", StorageURL: srv.URL, TargetPath: target}); err == nil {
+		t.Error("installed from the stable channel, which has no release")
+	}
+	files["/beta/"+binaryName+".sha256"] = hex.EncodeToString(sum[:]) + "  " + binaryName + "\n"
+	rel, err := Install(ctx, cfg)
+	if err != nil || !rel.Available || rel.Channel != ChannelBeta {
+		t.Fatalf("Install = %+v, %v", rel, err)
+	}
+	if b, _ := os.ReadFile(target); !bytes.Equal(b, bin) {
+		t.Errorf("target = %q, want the new binary", b)
+	}
+}
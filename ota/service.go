@@ -0,0 +1,217 @@
+package ota
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/strct-org/strct-agent/internal/config"
+	"github.com/strct-org/strct-agent/internal/maintenance"
+	"github.com/strct-org/strct-agent/internal/resources"
+)
+
+var usage = resources.For("ota")
+
+var (
+	// ErrNotConfigured is a Service with no storage URL.
+	ErrNotConfigured = errors.New("ota: updates are not configured (UPDATE_URL)")
+	// ErrBusy is an apply while another is running, or after one
+	// installed an update the agent has yet to restart into.
+	ErrBusy = errors.New("ota: an update is already being applied")
+	// ErrRestart is the cause the agent's context is cancelled with when
+	// an update was installed: the agent shuts down as it does on
+	// SIGTERM, then starts the new binary.
+	ErrRestart = errors.New("ota: restarting into an installed update")
+)
+
+// Status is what the updater last found, for GET /api/ota/status.
+type Status struct {
+	Current string `json:"current"`
+	Channel string `json:"channel"`
+	// Enabled is false without UPDATE_URL.
+	Enabled   bool      `json:"enabled"`
+	LastCheck time.Time `json:"last_check,omitzero"`
+	NextCheck time.Time `json:"next_check,omitzero"`
+	// Latest and Available are the last successful check's.
+	Latest    string `json:"latest,omitempty"`
+	Available bool   `json:"update_available"`
+	LastError string `json:"last_error,omitempty"`
+	// Applying is set while a release is downloaded and installed.
+	// Installed is the version installed, which the agent is restarting
+	// into.
+	Applying  bool   `json:"applying,omitempty"`
+	Installed string `json:"installed,omitempty"`
+}
+
+// Service checks for a newer release every Config.Interval and installs
+// it, and does either on request. Once one is installed it asks the
+// agent to restart, rather than exiting under requests in flight.
+type Service struct {
+	cfg     Config
+	restart func() // shuts the agent down and starts the new binary
+
+	mu     sync.Mutex
+	status Status
+	loop   sync.WaitGroup
+}
+
+func New(cfg Config, restart func()) *Service {
+	return &Service{
+		cfg:     cfg,
+		restart: restart,
+		status:  Status{Current: cfg.CurrentVersion, Channel: cfg.channel(), Enabled: cfg.StorageURL != ""},
+	}
+}
+
+// NewFromConfig updates version from UPDATE_URL's UPDATE_CHANNEL every
+// UPDATE_CHECK_HOURS, outside maintenance mode.
+func NewFromConfig(cfg *config.Config, version string, gate *maintenance.Gate, restart func()) *Service {
+	return New(Config{
+		CurrentVersion: version,
+		StorageURL:     cfg.UpdateURL,
+		Channel:        cfg.UpdateChannel,
+		Gate:           gate,
+		Interval:       time.Duration(cfg.UpdateCheckHours) * time.Hour,
+	}, restart)
+}
+
+func (s *Service) Name() string { return "ota" }
+
+// Start checks for an update now and then every interval until ctx is
+// done. Without a storage URL there is nothing to check.
+func (s *Service) Start(ctx context.Context) error {
+	if s.cfg.StorageURL == "" {
+		slog.Info("ota: UPDATE_URL not set, automatic updates off")
+		return nil
+	}
+	s.loop.Add(1)
+	usage.Go(func() {
+		defer s.loop.Done()
+		s.run(ctx)
+	})
+	return nil
+}
+
+// Stop waits for the checks Start began to end.
+func (s *Service) Stop(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.loop.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Status returns what the updater last found.
+func (s *Service) Status() Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status
+}
+
+func (s *Service) run(ctx context.Context) {
+	interval := s.cfg.interval()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		rel, err := s.Apply(ctx)
+		switch {
+		case err == nil && rel.Available:
+			s.requestRestart()
+			return
+		case err != nil && ctx.Err() == nil && !errors.Is(err, maintenance.ErrActive) && !errors.Is(err, ErrBusy):
+			slog.Error("ota: update failed", "err", err)
+		}
+		s.mu.Lock()
+		s.status.NextCheck = time.Now().Add(interval).UTC()
+		s.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Check looks for a newer release without installing it.
+func (s *Service) Check(ctx context.Context) (Release, error) {
+	if s.cfg.StorageURL == "" {
+		return Release{}, ErrNotConfigured
+	}
+	rel, err := Check(ctx, s.cfg)
+	s.record(rel, err)
+	return rel, err
+}
+
+// Apply installs a newer release if there is one. The caller restarts
+// into it when the release is Available and err is nil; see
+// requestRestart. It returns maintenance.ErrActive during maintenance.
+func (s *Service) Apply(ctx context.Context) (Release, error) {
+	if s.cfg.StorageURL == "" {
+		return Release{}, ErrNotConfigured
+	}
+	s.mu.Lock()
+	if s.status.Applying || s.status.Installed != "" {
+		s.mu.Unlock()
+		return Release{}, ErrBusy
+	}
+	s.status.Applying = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.status.Applying = false
+		s.mu.Unlock()
+	}()
+
+	ctx, done, err := s.cfg.Gate.Begin(ctx, maintenance.JobOTA)
+	if err != nil {
+		return Release{}, err
+	}
+	defer done()
+
+	slog.Info("ota: checking for updates", "channel", s.cfg.channel())
+	rel, err := Install(ctx, s.cfg)
+	s.record(rel, err)
+	if err != nil {
+		return rel, err
+	}
+	if !rel.Available {
+		slog.Info("ota: no update needed", "remote_version", rel.Latest, "current_version", rel.Current)
+		return rel, nil
+	}
+	s.mu.Lock()
+	s.status.Installed = rel.Latest
+	s.mu.Unlock()
+	slog.Info("ota: update installed", "version", rel.Latest)
+	return rel, nil
+}
+
+// requestRestart asks the agent to restart into the installed update.
+func (s *Service) requestRestart() {
+	slog.Info("ota: asking the agent to restart into the update", "version", s.Status().Installed)
+	if s.restart != nil {
+		s.restart()
+	}
+}
+
+// record keeps a check's outcome for Status.
+func (s *Service) record(rel Release, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.LastCheck = time.Now().UTC()
+	if rel.Latest != "" {
+		s.status.Latest, s.status.Available = rel.Latest, rel.Available
+	}
+	s.status.LastError = ""
+	if err != nil {
+		s.status.LastError = err.Error()
+	}
+}